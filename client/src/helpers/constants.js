@@ -398,6 +398,8 @@ export const SPECIAL_FILTER_ID = {
     PARENTAL: -3,
     SAFE_BROWSING: -4,
     SAFE_SEARCH: -5,
+    DEFAULT_DENY: -6,
+    REBINDING: -7,
 };
 
 export const BLOCK_ACTIONS = {
@@ -806,6 +806,10 @@ export const getSpecialFilterName = (filterId) => {
             return i18n.t('safe_browsing');
         case SPECIAL_FILTER_ID.SAFE_SEARCH:
             return i18n.t('safe_search');
+        case SPECIAL_FILTER_ID.DEFAULT_DENY:
+            return i18n.t('default_deny');
+        case SPECIAL_FILTER_ID.REBINDING:
+            return i18n.t('rebinding_protection');
         default:
             return i18n.t('unknown_filter', { filterId });
     }
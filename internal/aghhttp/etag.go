@@ -0,0 +1,81 @@
+package aghhttp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ETag returns a strong entity tag of the JSON encoding of v.  The same values
+// always have the same entity tags, so it can be used to detect changes of the
+// resource between the requests.
+func ETag(v any) (etag string, err error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("encoding entity: %w", err)
+	}
+
+	sum := sha256.Sum256(b)
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// SetETag sets the ETag header in w to the entity tag of v.  v is expected to
+// be the representation of the resource written into the response afterwards.
+// It calls [Error] on any returned error.
+func SetETag(w http.ResponseWriter, r *http.Request, v any) (err error) {
+	etag, err := ETag(v)
+	if err != nil {
+		Error(r, w, http.StatusInternalServerError, "%s", err)
+
+		return err
+	}
+
+	w.Header().Set(HdrNameETag, etag)
+
+	return nil
+}
+
+// CheckIfMatch checks the If-Match header of r against the entity tag of the
+// current representation of the resource cur.  If the header is absent, or if
+// it is "*", or if it contains the entity tag, ok is true.  Otherwise, it
+// responds with "412 Precondition Failed", so that the clients may detect the
+// concurrent modification of the resource.
+func CheckIfMatch(w http.ResponseWriter, r *http.Request, cur any) (ok bool) {
+	hdr := r.Header.Get(HdrNameIfMatch)
+	if hdr == "" {
+		return true
+	}
+
+	etag, err := ETag(cur)
+	if err != nil {
+		Error(r, w, http.StatusInternalServerError, "%s", err)
+
+		return false
+	}
+
+	if matchesIfMatch(hdr, etag) {
+		return true
+	}
+
+	w.Header().Set(HdrNameETag, etag)
+	Error(r, w, http.StatusPreconditionFailed, "resource was modified: etag is %s", etag)
+
+	return false
+}
+
+// matchesIfMatch returns true if the value of the If-Match header hdr matches
+// etag using the strong comparison.  See RFC 9110, section 13.1.1.
+func matchesIfMatch(hdr, etag string) (ok bool) {
+	for _, tag := range strings.Split(hdr, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
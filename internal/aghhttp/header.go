@@ -6,12 +6,17 @@ package aghhttp
 //
 // TODO(a.garipov): Remove unused.
 const (
+	HdrNameAccept                   = "Accept"
 	HdrNameAcceptEncoding           = "Accept-Encoding"
 	HdrNameAccessControlAllowOrigin = "Access-Control-Allow-Origin"
 	HdrNameAltSvc                   = "Alt-Svc"
 	HdrNameContentEncoding          = "Content-Encoding"
 	HdrNameContentType              = "Content-Type"
+	HdrNameETag                     = "ETag"
+	HdrNameIfMatch                  = "If-Match"
 	HdrNameOrigin                   = "Origin"
+	HdrNameProxyAuthorization       = "Proxy-Authorization"
+	HdrNameRetryAfter               = "Retry-After"
 	HdrNameServer                   = "Server"
 	HdrNameTrailer                  = "Trailer"
 	HdrNameUserAgent                = "User-Agent"
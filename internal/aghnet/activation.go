@@ -0,0 +1,202 @@
+package aghnet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// The environment variables of the systemd socket activation protocol.  See
+// sd_listen_fds(3).
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+)
+
+// listenFDsStart is the first file descriptor passed by the service manager.
+const listenFDsStart = 3
+
+// ActivatedSockets are the sockets passed to the process by the service
+// manager using the systemd socket activation protocol.  A nil
+// *ActivatedSockets is valid and contains no sockets.
+type ActivatedSockets struct {
+	// TCP are the passed stream sockets.
+	TCP []*net.TCPListener
+
+	// UDP are the passed datagram sockets.
+	UDP []*net.UDPConn
+}
+
+// ListenActivated returns the sockets passed to the process by the service
+// manager using the systemd socket activation protocol.  socks is nil if there
+// are none.  It unsets the environment variables of the protocol, so that the
+// child processes don't consider the sockets theirs, and so must only be
+// called once.
+func ListenActivated() (socks *ActivatedSockets, err error) {
+	pid, fds := os.Getenv(envListenPID), os.Getenv(envListenFDs)
+	for _, env := range []string{envListenPID, envListenFDs, envListenFDNames} {
+		_ = os.Unsetenv(env)
+	}
+
+	n, err := listenFDsNum(pid, fds, os.Getpid())
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %w", err)
+	} else if n == 0 {
+		return nil, nil
+	}
+
+	files := make([]*os.File, n)
+	for i := range files {
+		fd := listenFDsStart + i
+		files[i] = os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+	}
+
+	socks, err = socketsFromFiles(files)
+	if err != nil {
+		return socks, fmt.Errorf("socket activation: %w", err)
+	}
+
+	return socks, nil
+}
+
+// listenFDsNum returns the number of the sockets passed to the process with
+// the PID self according to the values of the environment variables pid and
+// fds.  n is zero if the sockets are passed to another process.
+func listenFDsNum(pid, fds string, self int) (n int, err error) {
+	if pid == "" || fds == "" {
+		return 0, nil
+	}
+
+	p, err := strconv.Atoi(pid)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s: %w", envListenPID, err)
+	} else if p != self {
+		return 0, nil
+	}
+
+	n, err = strconv.Atoi(fds)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s: %w", envListenFDs, err)
+	} else if n < 0 {
+		return 0, fmt.Errorf("bad %s: negative value %d", envListenFDs, n)
+	}
+
+	return n, nil
+}
+
+// socketsFromFiles returns the sockets of files and closes them.  The files
+// which aren't TCP or UDP sockets are skipped with an error.
+func socketsFromFiles(files []*os.File) (socks *ActivatedSockets, err error) {
+	socks = &ActivatedSockets{}
+
+	var errs []error
+	for _, f := range files {
+		err = socks.add(f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.Name(), err))
+		}
+
+		// The sockets use the duplicates of the descriptors.
+		err = f.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("closing %s: %w", f.Name(), err))
+		}
+	}
+
+	return socks, errors.List("converting sockets", errs...)
+}
+
+// add adds the socket of f to socks.
+func (socks *ActivatedSockets) add(f *os.File) (err error) {
+	l, lErr := net.FileListener(f)
+	if lErr == nil {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			return errors.WithDeferred(fmt.Errorf("unsupported listener %T", l), l.Close())
+		}
+
+		socks.TCP = append(socks.TCP, tl)
+
+		return nil
+	}
+
+	c, cErr := net.FilePacketConn(f)
+	if cErr != nil {
+		return fmt.Errorf("not a socket: %w", errors.List("bad file", lErr, cErr))
+	}
+
+	uc, ok := c.(*net.UDPConn)
+	if !ok {
+		return errors.WithDeferred(fmt.Errorf("unsupported packet conn %T", c), c.Close())
+	}
+
+	socks.UDP = append(socks.UDP, uc)
+
+	return nil
+}
+
+// TCPListeners returns the TCP listeners from socks bound to port.  socks may
+// be nil.
+func (socks *ActivatedSockets) TCPListeners(port uint16) (ls []*net.TCPListener) {
+	if socks == nil {
+		return nil
+	}
+
+	for _, l := range socks.TCP {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok && addr.Port == int(port) {
+			ls = append(ls, l)
+		}
+	}
+
+	return ls
+}
+
+// UDPConns returns the UDP connections from socks bound to port.  socks may be
+// nil.
+func (socks *ActivatedSockets) UDPConns(port uint16) (conns []*net.UDPConn) {
+	if socks == nil {
+		return nil
+	}
+
+	for _, c := range socks.UDP {
+		if addr, ok := c.LocalAddr().(*net.UDPAddr); ok && addr.Port == int(port) {
+			conns = append(conns, c)
+		}
+	}
+
+	return conns
+}
+
+// DupListener returns a new listener using the duplicate of the descriptor of
+// l, so that closing it leaves l open.
+func DupListener(l *net.TCPListener) (dup net.Listener, err error) {
+	f, err := l.File()
+	if err != nil {
+		return nil, fmt.Errorf("getting file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	return net.FileListener(f)
+}
+
+// DupUDPConn returns a new connection using the duplicate of the descriptor of
+// c, so that closing it leaves c open.
+func DupUDPConn(c *net.UDPConn) (dup *net.UDPConn, err error) {
+	f, err := c.File()
+	if err != nil {
+		return nil, fmt.Errorf("getting file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// The duplicate of a UDP socket is always a UDP connection.
+	return pc.(*net.UDPConn), nil
+}
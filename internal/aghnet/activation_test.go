@@ -0,0 +1,72 @@
+package aghnet
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenFDsNum(t *testing.T) {
+	const self = 1234
+
+	testCases := []struct {
+		name       string
+		pid        string
+		fds        string
+		wantErrMsg string
+		want       int
+	}{{
+		name:       "none",
+		pid:        "",
+		fds:        "",
+		wantErrMsg: "",
+		want:       0,
+	}, {
+		name:       "self",
+		pid:        "1234",
+		fds:        "2",
+		wantErrMsg: "",
+		want:       2,
+	}, {
+		name:       "other_process",
+		pid:        "4321",
+		fds:        "2",
+		wantErrMsg: "",
+		want:       0,
+	}, {
+		name:       "bad_pid",
+		pid:        "pid",
+		fds:        "2",
+		wantErrMsg: `bad LISTEN_PID: strconv.Atoi: parsing "pid": invalid syntax`,
+		want:       0,
+	}, {
+		name:       "bad_fds",
+		pid:        "1234",
+		fds:        "fds",
+		wantErrMsg: `bad LISTEN_FDS: strconv.Atoi: parsing "fds": invalid syntax`,
+		want:       0,
+	}, {
+		name:       "negative_fds",
+		pid:        "1234",
+		fds:        "-1",
+		wantErrMsg: "bad LISTEN_FDS: negative value -1",
+		want:       0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := listenFDsNum(tc.pid, tc.fds, self)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, n)
+		})
+	}
+}
+
+func TestActivatedSockets_nil(t *testing.T) {
+	var socks *ActivatedSockets
+
+	assert.Empty(t, socks.TCPListeners(53))
+	assert.Empty(t, socks.UDPConns(53))
+}
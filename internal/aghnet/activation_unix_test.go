@@ -0,0 +1,65 @@
+//go:build darwin || freebsd || linux || openbsd
+
+package aghnet
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketsFromFiles(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, c.Close)
+
+	lf, err := l.File()
+	require.NoError(t, err)
+
+	cf, err := c.File()
+	require.NoError(t, err)
+
+	tmp, err := os.CreateTemp(t.TempDir(), "")
+	require.NoError(t, err)
+
+	socks, err := socketsFromFiles([]*os.File{lf, cf, tmp})
+	require.Error(t, err)
+	require.NotNil(t, socks)
+
+	require.Len(t, socks.TCP, 1)
+	require.Len(t, socks.UDP, 1)
+	testutil.CleanupAndRequireSuccess(t, socks.TCP[0].Close)
+	testutil.CleanupAndRequireSuccess(t, socks.UDP[0].Close)
+
+	tcpPort := uint16(l.Addr().(*net.TCPAddr).Port)
+	udpPort := uint16(c.LocalAddr().(*net.UDPAddr).Port)
+
+	assert.Len(t, socks.TCPListeners(tcpPort), 1)
+	assert.Empty(t, socks.TCPListeners(tcpPort+1))
+	assert.Len(t, socks.UDPConns(udpPort), 1)
+	assert.Empty(t, socks.UDPConns(udpPort+1))
+
+	t.Run("dup", func(t *testing.T) {
+		dupL, dupErr := DupListener(socks.TCP[0])
+		require.NoError(t, dupErr)
+		require.NoError(t, dupL.Close())
+
+		// Closing the duplicate leaves the original open.
+		assert.NoError(t, socks.TCP[0].SetDeadline(time.Now()))
+
+		dupC, dupErr := DupUDPConn(socks.UDP[0])
+		require.NoError(t, dupErr)
+		require.NoError(t, dupC.Close())
+
+		assert.NoError(t, socks.UDP[0].SetDeadline(time.Now()))
+	})
+}
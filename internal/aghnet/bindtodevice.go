@@ -0,0 +1,13 @@
+package aghnet
+
+import "syscall"
+
+// ControlFunc is the type of the functions to be set to net.Dialer.Control.
+type ControlFunc = func(network, address string, c syscall.RawConn) (err error)
+
+// BindToDeviceControl returns the function to be set to net.Dialer.Control,
+// which binds the socket to the network interface named iface, so that the
+// connection only goes through it.
+func BindToDeviceControl(iface string) (ctrl ControlFunc, err error) {
+	return bindToDeviceControl(iface)
+}
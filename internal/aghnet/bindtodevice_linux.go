@@ -0,0 +1,41 @@
+//go:build linux
+
+package aghnet
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/sys/unix"
+)
+
+// bindToDeviceControl returns the function setting the SO_BINDTODEVICE option
+// on the socket.  The interface isn't required to exist yet, since it may be a
+// tunnel brought up later.
+func bindToDeviceControl(iface string) (ctrl ControlFunc, err error) {
+	return func(_, _ string, c syscall.RawConn) (err error) {
+		cerr := c.Control(func(fd uintptr) {
+			err = unix.BindToDevice(int(fd), iface)
+			if err != nil {
+				err = os.NewSyscallError("setsockopt", err)
+			}
+		})
+
+		const (
+			errMsg    = "binding to device"
+			errMsgFmt = errMsg + ": %w"
+		)
+
+		if err != nil && cerr != nil {
+			err = errors.List(errMsg, err, cerr)
+		} else if err != nil {
+			err = fmt.Errorf(errMsgFmt, err)
+		} else if cerr != nil {
+			err = fmt.Errorf(errMsgFmt, cerr)
+		}
+
+		return err
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package aghnet
+
+import (
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+)
+
+// bindToDeviceControl returns an error since binding the sockets to the
+// network interfaces is only supported on Linux.
+func bindToDeviceControl(_ string) (ctrl ControlFunc, err error) {
+	return nil, aghos.Unsupported("binding to network interface")
+}
@@ -0,0 +1,157 @@
+package aghnet
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"golang.org/x/exp/slices"
+)
+
+// IgnoreMatcher matches the DNS requests, which should be ignored by the
+// statistics or the query log, by the requested host names and the addresses
+// of the clients.  A nil *IgnoreMatcher ignores nothing.
+type IgnoreMatcher struct {
+	// hosts are the lowercased host names matched exactly.
+	hosts *stringutil.Set
+
+	// wildcards are the lowercased domain names, which subdomains are matched.
+	wildcards []string
+
+	// clients are the subnets of the clients, which requests are matched.
+	clients []netip.Prefix
+
+	// values are the original entries of the list.
+	values []string
+}
+
+// NewIgnoreMatcher returns a new matcher for list.  Each entry of list is
+// either a host name (example.org), a wildcard matching the subdomains of a
+// domain name (*.example.org), or an IP address or a CIDR of the clients
+// (192.168.1.50, 192.168.1.0/24).
+func NewIgnoreMatcher(list []string) (m *IgnoreMatcher, err error) {
+	m = &IgnoreMatcher{
+		hosts: stringutil.NewSet(),
+	}
+
+	set := stringutil.NewSet()
+	for i, v := range list {
+		var key string
+		key, err = m.add(v)
+		if err != nil {
+			return nil, fmt.Errorf("entry at index %d: %w", i, err)
+		}
+
+		if set.Has(key) {
+			return nil, fmt.Errorf("duplicate entry %q", v)
+		}
+
+		set.Add(key)
+		m.values = append(m.values, v)
+	}
+
+	return m, nil
+}
+
+// add adds the entry v to m.  key is the normalized form of v.
+func (m *IgnoreMatcher) add(v string) (key string, err error) {
+	if pref, perr := netip.ParsePrefix(v); perr == nil {
+		pref = pref.Masked()
+		m.clients = append(m.clients, pref)
+
+		return pref.String(), nil
+	} else if ip, perr := netip.ParseAddr(v); perr == nil {
+		pref = netip.PrefixFrom(ip, ip.BitLen())
+		m.clients = append(m.clients, pref)
+
+		return pref.String(), nil
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(v, "."))
+	// TODO(a.garipov): Think about ignoring empty (".") names in the future.
+	if host == "" {
+		return "", errors.Error("host name is empty")
+	}
+
+	if host == "*" || strings.HasPrefix(host, "*.") {
+		domain := strings.TrimPrefix(host[1:], ".")
+		if domain == "" {
+			return "", fmt.Errorf("wildcard %q: domain name is empty", v)
+		}
+
+		m.wildcards = append(m.wildcards, domain)
+
+		return host, nil
+	}
+
+	m.hosts.Add(host)
+
+	return host, nil
+}
+
+// Has returns true if the request for host from the client with ip should be
+// ignored.  ip may be invalid, in which case only host is checked.  m may be
+// nil.
+func (m *IgnoreMatcher) Has(host string, ip netip.Addr) (ok bool) {
+	if m == nil {
+		return false
+	}
+
+	return m.HasHost(host) || m.hasClient(ip)
+}
+
+// HasHost returns true if the requests for host should be ignored regardless of
+// the client.  m may be nil.
+func (m *IgnoreMatcher) HasHost(host string) (ok bool) {
+	if m == nil {
+		return false
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if m.hosts.Has(host) {
+		return true
+	}
+
+	for _, domain := range m.wildcards {
+		if netutil.IsSubdomain(host, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasClient returns true if the requests from ip should be ignored.
+func (m *IgnoreMatcher) hasClient(ip netip.Addr) (ok bool) {
+	if !ip.IsValid() {
+		return false
+	}
+
+	ip = ip.Unmap()
+	for _, pref := range m.clients {
+		if pref.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Values returns a sorted copy of the original entries of m.  m may be nil.
+func (m *IgnoreMatcher) Values() (values []string) {
+	if m == nil {
+		return []string{}
+	}
+
+	values = slices.Clone(m.values)
+	if values == nil {
+		values = []string{}
+	}
+
+	slices.Sort(values)
+
+	return values
+}
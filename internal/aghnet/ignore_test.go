@@ -0,0 +1,121 @@
+package aghnet_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIgnoreMatcher(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		list       []string
+	}{{
+		name:       "valid",
+		wantErrMsg: "",
+		list:       []string{"example.org", "*.example.org", "192.168.1.50", "10.0.0.0/8"},
+	}, {
+		name:       "empty",
+		wantErrMsg: "entry at index 1: host name is empty",
+		list:       []string{"example.org", "."},
+	}, {
+		name:       "empty_wildcard",
+		wantErrMsg: `entry at index 0: wildcard "*.": domain name is empty`,
+		list:       []string{"*."},
+	}, {
+		name:       "duplicate_host",
+		wantErrMsg: `duplicate entry "Example.org."`,
+		list:       []string{"example.org", "Example.org."},
+	}, {
+		name:       "duplicate_client",
+		wantErrMsg: `duplicate entry "192.168.1.50/32"`,
+		list:       []string{"192.168.1.50", "192.168.1.50/32"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := aghnet.NewIgnoreMatcher(tc.list)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestIgnoreMatcher_Has(t *testing.T) {
+	m, err := aghnet.NewIgnoreMatcher([]string{
+		"host.example",
+		"*.wildcard.example",
+		"192.168.1.50",
+		"2001:db8::/32",
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		ip   netip.Addr
+		name string
+		host string
+		want bool
+	}{{
+		ip:   netip.Addr{},
+		name: "host",
+		host: "HOST.example.",
+		want: true,
+	}, {
+		ip:   netip.Addr{},
+		name: "host_subdomain",
+		host: "sub.host.example",
+		want: false,
+	}, {
+		ip:   netip.Addr{},
+		name: "wildcard",
+		host: "a.b.wildcard.example",
+		want: true,
+	}, {
+		ip:   netip.Addr{},
+		name: "wildcard_apex",
+		host: "wildcard.example",
+		want: false,
+	}, {
+		ip:   netip.MustParseAddr("192.168.1.50"),
+		name: "client",
+		host: "other.example",
+		want: true,
+	}, {
+		ip:   netip.MustParseAddr("::ffff:192.168.1.50"),
+		name: "client_mapped",
+		host: "other.example",
+		want: true,
+	}, {
+		ip:   netip.MustParseAddr("2001:db8::1"),
+		name: "client_subnet",
+		host: "other.example",
+		want: true,
+	}, {
+		ip:   netip.MustParseAddr("192.168.1.51"),
+		name: "other_client",
+		host: "other.example",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, m.Has(tc.host, tc.ip))
+		})
+	}
+
+	t.Run("nil", func(t *testing.T) {
+		var nilMatcher *aghnet.IgnoreMatcher
+
+		assert.False(t, nilMatcher.Has("host.example", netip.MustParseAddr("192.168.1.50")))
+		assert.Empty(t, nilMatcher.Values())
+	})
+
+	t.Run("values", func(t *testing.T) {
+		want := []string{"*.wildcard.example", "192.168.1.50", "2001:db8::/32", "host.example"}
+		assert.Equal(t, want, m.Values())
+	})
+}
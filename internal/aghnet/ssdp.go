@@ -0,0 +1,484 @@
+package aghnet
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// SSDP: The Simple Service Discovery Protocol
+
+const (
+	// ssdpMaxDevices is the maximum number of the devices, for which the
+	// descriptions are fetched and remembered.
+	ssdpMaxDevices = 1000
+
+	// ssdpMaxMsgSize is the maximum size of an SSDP message.
+	ssdpMaxMsgSize = 8192
+
+	// ssdpMaxDescSize is the maximum size of a device description document.
+	ssdpMaxDescSize = 64 * 1024
+
+	// ssdpMaxNameLen is the maximum length of the name, manufacturer, and model
+	// of a device.
+	ssdpMaxNameLen = 255
+
+	// ssdpQueueSize is the maximum number of the descriptions waiting to be
+	// fetched.
+	ssdpQueueSize = 64
+
+	// ssdpFetchTimeout is the timeout of fetching a device description.
+	ssdpFetchTimeout = 5 * time.Second
+
+	// ssdpRefetchInterval is the minimum time between the fetches of the same
+	// device description.
+	ssdpRefetchInterval = 1 * time.Hour
+)
+
+// ssdpGroup is the IPv4 multicast address of SSDP.
+var ssdpGroup = netip.AddrPortFrom(netip.AddrFrom4([4]byte{239, 255, 255, 250}), 1900)
+
+// ssdpSearchMsg is the M-SEARCH request for the root devices.  See UPnP Device
+// Architecture, version 2.0, section 1.3.2.
+var ssdpSearchMsg = []byte("M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: 239.255.255.250:1900\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"MX: 2\r\n" +
+	"ST: upnp:rootdevice\r\n" +
+	"\r\n")
+
+// SSDPDevice is the information about a UPnP device discovered using SSDP.
+type SSDPDevice struct {
+	// IP is the address of the device.
+	IP netip.Addr
+
+	// FriendlyName is the human-readable name of the device.  It's never
+	// empty.
+	FriendlyName string
+
+	// Manufacturer is the name of the manufacturer of the device, if any.
+	Manufacturer string
+
+	// Model is the model name of the device, if any.
+	Model string
+}
+
+// SSDPConfig is the configuration structure for an *SSDPListener.
+type SSDPConfig struct {
+	// OnDevice is called for each discovered or updated device.  It must not
+	// be nil.
+	OnDevice func(d *SSDPDevice)
+
+	// OnGone is called for each device which has announced that it's leaving
+	// the network.  It must not be nil.
+	OnGone func(ip netip.Addr)
+
+	// Client is used to fetch the device descriptions.  It must not be nil.
+	Client *http.Client
+
+	// SearchInterval is the interval between the searches of the devices.  If
+	// zero, only the announcements of the devices are processed.
+	SearchInterval time.Duration
+}
+
+// SSDPListener discovers the UPnP devices in the local network by listening
+// for their announcements and searching for them.  The friendly names and
+// models of the devices are taken from their description documents.
+type SSDPListener struct {
+	conf *SSDPConfig
+
+	// fetchedMu protects fetched.
+	fetchedMu *sync.Mutex
+
+	// fetched are the locations of the descriptions of the devices and the
+	// times, when they were last fetched.
+	fetched map[netip.Addr]ssdpFetch
+
+	// queue are the descriptions waiting to be fetched.
+	queue chan ssdpTarget
+
+	// notifyConn receives the announcements of the devices.  It's nil if the
+	// SSDP port is not available.
+	notifyConn *net.UDPConn
+
+	// searchConn sends the search requests and receives the responses.
+	searchConn *net.UDPConn
+
+	// done is closed when the listener is closed.
+	done chan struct{}
+}
+
+// ssdpFetch is the record of a fetched device description.
+type ssdpFetch struct {
+	time     time.Time
+	location string
+}
+
+// ssdpTarget is a device description to fetch.
+type ssdpTarget struct {
+	location *url.URL
+	ip       netip.Addr
+}
+
+// NewSSDPListener returns a new properly initialized *SSDPListener.  Call
+// [SSDPListener.Start] to start it.
+func NewSSDPListener(conf *SSDPConfig) (l *SSDPListener) {
+	return &SSDPListener{
+		conf:      conf,
+		fetchedMu: &sync.Mutex{},
+		fetched:   map[netip.Addr]ssdpFetch{},
+		queue:     make(chan ssdpTarget, ssdpQueueSize),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start starts listening for the device announcements and searching for the
+// devices.  It's not an error if the SSDP port is used by another application,
+// since the devices are still found by searching.
+func (l *SSDPListener) Start() (err error) {
+	l.notifyConn, err = net.ListenMulticastUDP("udp4", nil, net.UDPAddrFromAddrPort(ssdpGroup))
+	if err != nil {
+		log.Info("ssdp: not listening for announcements: %s", err)
+	}
+
+	l.searchConn, err = net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		if l.notifyConn != nil {
+			err = errors.WithDeferred(err, l.notifyConn.Close())
+		}
+
+		return fmt.Errorf("listening for search responses: %w", err)
+	}
+
+	if l.notifyConn != nil {
+		go l.readLoop(l.notifyConn)
+	}
+
+	go l.readLoop(l.searchConn)
+	go l.fetchLoop()
+
+	if l.conf.SearchInterval > 0 {
+		go l.searchLoop()
+	}
+
+	return nil
+}
+
+// Close stops l.
+func (l *SSDPListener) Close() (err error) {
+	close(l.done)
+
+	var errs []error
+	for _, c := range []*net.UDPConn{l.notifyConn, l.searchConn} {
+		if c == nil {
+			continue
+		}
+
+		if closeErr := c.Close(); closeErr != nil {
+			errs = append(errs, closeErr)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.List("closing ssdp listener", errs...)
+	}
+
+	return nil
+}
+
+// readLoop handles the SSDP messages received by conn until it's closed.
+func (l *SSDPListener) readLoop(conn *net.UDPConn) {
+	defer log.OnPanic("ssdp: reading")
+
+	buf := make([]byte, ssdpMaxMsgSize)
+	for {
+		n, addr, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			log.Debug("ssdp: reading: %s", err)
+
+			continue
+		}
+
+		l.handleMsg(addr.Addr().Unmap(), buf[:n])
+	}
+}
+
+// searchLoop sends the search requests until l is closed.
+func (l *SSDPListener) searchLoop() {
+	defer log.OnPanic("ssdp: searching")
+
+	t := time.NewTicker(l.conf.SearchInterval)
+	defer t.Stop()
+
+	for {
+		_, err := l.searchConn.WriteToUDPAddrPort(ssdpSearchMsg, ssdpGroup)
+		if err != nil {
+			log.Debug("ssdp: sending search: %s", err)
+		}
+
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+			// Go on.
+		}
+	}
+}
+
+// fetchLoop fetches the queued device descriptions until l is closed.
+func (l *SSDPListener) fetchLoop() {
+	defer log.OnPanic("ssdp: fetching")
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case tgt := <-l.queue:
+			d, err := l.fetch(tgt)
+			if err != nil {
+				log.Debug("ssdp: fetching description of %s: %s", tgt.ip, err)
+
+				continue
+			}
+
+			l.conf.OnDevice(d)
+		}
+	}
+}
+
+// handleMsg handles the SSDP message msg sent from ip.
+func (l *SSDPListener) handleMsg(ip netip.Addr, msg []byte) {
+	m, err := parseSSDPMsg(msg)
+	if err != nil {
+		log.Debug("ssdp: bad message from %s: %s", ip, err)
+
+		return
+	} else if m == nil {
+		return
+	}
+
+	if m.byebye {
+		l.fetchedMu.Lock()
+		delete(l.fetched, ip)
+		l.fetchedMu.Unlock()
+
+		l.conf.OnGone(ip)
+
+		return
+	}
+
+	loc, err := parseSSDPLocation(ip, m.location)
+	if err != nil {
+		log.Debug("ssdp: bad location from %s: %s", ip, err)
+
+		return
+	}
+
+	if l.shouldFetch(ip, m.location, time.Now()) {
+		select {
+		case l.queue <- ssdpTarget{location: loc, ip: ip}:
+		default:
+			log.Debug("ssdp: too many descriptions to fetch, dropping %s", ip)
+		}
+	}
+}
+
+// shouldFetch returns true if the description at location of the device with
+// ip must be fetched at now.  It remembers the fetch if so.
+func (l *SSDPListener) shouldFetch(ip netip.Addr, location string, now time.Time) (ok bool) {
+	l.fetchedMu.Lock()
+	defer l.fetchedMu.Unlock()
+
+	f, ok := l.fetched[ip]
+	if ok && f.location == location && now.Sub(f.time) < ssdpRefetchInterval {
+		return false
+	} else if !ok && len(l.fetched) >= ssdpMaxDevices {
+		return false
+	}
+
+	l.fetched[ip] = ssdpFetch{
+		time:     now,
+		location: location,
+	}
+
+	return true
+}
+
+// fetch fetches and parses the description of the device from tgt.
+func (l *SSDPListener) fetch(tgt ssdpTarget) (d *SSDPDevice, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ssdpFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tgt.location.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := l.conf.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	d, err = parseSSDPDesc(io.LimitReader(resp.Body, ssdpMaxDescSize))
+	if err != nil {
+		return nil, fmt.Errorf("parsing: %w", err)
+	}
+
+	d.IP = tgt.ip
+
+	return d, nil
+}
+
+// ssdpMsg is a parsed SSDP message.
+type ssdpMsg struct {
+	// location is the URL of the description of the device.  It's empty if
+	// byebye is true.
+	location string
+
+	// byebye is true if the device is leaving the network.
+	byebye bool
+}
+
+// parseSSDPMsg parses an SSDP announcement or a search response from b.  m is
+// nil if b is any other SSDP message.
+func parseSSDPMsg(b []byte) (m *ssdpMsg, err error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+	line, err := r.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("reading start line: %w", err)
+	}
+
+	isNotify := strings.HasPrefix(line, "NOTIFY ")
+	if !isNotify && !strings.HasPrefix(line, "HTTP/1.1 200") {
+		// Most likely the search requests from other control points.
+		return nil, nil
+	}
+
+	// Some devices don't send the empty line after the headers.
+	h, err := r.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("reading headers: %w", err)
+	}
+
+	if isNotify && h.Get("Nts") == "ssdp:byebye" {
+		// The devices send a byebye message for each of their services, so
+		// only consider the one for the root device.
+		if h.Get("Nt") != "upnp:rootdevice" {
+			return nil, nil
+		}
+
+		return &ssdpMsg{byebye: true}, nil
+	}
+
+	loc := h.Get("Location")
+	if loc == "" {
+		return nil, errors.Error("no location")
+	}
+
+	return &ssdpMsg{location: loc}, nil
+}
+
+// parseSSDPLocation parses the location of the description of the device with
+// ip.  The description must be served over HTTP by the device itself, so that
+// the announcements can't make AdGuard Home request other hosts.
+func parseSSDPLocation(ip netip.Addr, location string) (u *url.URL, err error) {
+	u, err = url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("bad scheme %q", u.Scheme)
+	}
+
+	host, err := netip.ParseAddr(u.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("bad host: %w", err)
+	} else if host.Unmap() != ip {
+		return nil, fmt.Errorf("host %s doesn't match sender", host)
+	}
+
+	return u, nil
+}
+
+// ssdpDesc is the part of the UPnP device description document used to
+// describe the device.  See UPnP Device Architecture, version 2.0, section
+// 2.3.
+type ssdpDesc struct {
+	Device struct {
+		FriendlyName string `xml:"friendlyName"`
+		Manufacturer string `xml:"manufacturer"`
+		ModelName    string `xml:"modelName"`
+	} `xml:"device"`
+}
+
+// parseSSDPDesc parses the device description document from r.  d.IP is not
+// set.
+func parseSSDPDesc(r io.Reader) (d *SSDPDevice, err error) {
+	desc := &ssdpDesc{}
+	err = xml.NewDecoder(r).Decode(desc)
+	if err != nil {
+		return nil, err
+	}
+
+	d = &SSDPDevice{
+		FriendlyName: sanitizeSSDPName(desc.Device.FriendlyName),
+		Manufacturer: sanitizeSSDPName(desc.Device.Manufacturer),
+		Model:        sanitizeSSDPName(desc.Device.ModelName),
+	}
+
+	if d.FriendlyName == "" {
+		return nil, errors.Error("no friendly name")
+	}
+
+	return d, nil
+}
+
+// sanitizeSSDPName removes the control characters and the surrounding spaces
+// from s and truncates it to ssdpMaxNameLen bytes.
+func sanitizeSSDPName(s string) (sanitized string) {
+	s = strings.TrimSpace(strings.Map(func(r rune) (res rune) {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+
+		return r
+	}, s))
+
+	if len(s) <= ssdpMaxNameLen {
+		return s
+	}
+
+	// Don't cut the last rune in half.
+	s = s[:ssdpMaxNameLen]
+	for len(s) > 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+
+	return s
+}
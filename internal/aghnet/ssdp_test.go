@@ -0,0 +1,204 @@
+package aghnet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSSDPDesc is a device description document for tests.
+const testSSDPDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+    <friendlyName> Living Room TV </friendlyName>
+    <manufacturer>ACME</manufacturer>
+    <modelName>TV-3000</modelName>
+  </device>
+</root>`
+
+func TestParseSSDPMsg(t *testing.T) {
+	testCases := []struct {
+		want       *ssdpMsg
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		want: &ssdpMsg{location: "http://192.168.1.2:8080/desc.xml"},
+		name: "notify_alive",
+		in: "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"NT: upnp:rootdevice\r\n" +
+			"NTS: ssdp:alive\r\n" +
+			"LOCATION: http://192.168.1.2:8080/desc.xml\r\n" +
+			"\r\n",
+		wantErrMsg: "",
+	}, {
+		want: &ssdpMsg{location: "http://192.168.1.2/desc.xml"},
+		name: "search_response",
+		in: "HTTP/1.1 200 OK\r\n" +
+			"ST: upnp:rootdevice\r\n" +
+			"location: http://192.168.1.2/desc.xml\r\n",
+		wantErrMsg: "",
+	}, {
+		want: &ssdpMsg{byebye: true},
+		name: "byebye",
+		in: "NOTIFY * HTTP/1.1\r\n" +
+			"NT: upnp:rootdevice\r\n" +
+			"NTS: ssdp:byebye\r\n" +
+			"\r\n",
+		wantErrMsg: "",
+	}, {
+		want: nil,
+		name: "byebye_service",
+		in: "NOTIFY * HTTP/1.1\r\n" +
+			"NT: urn:schemas-upnp-org:service:ContentDirectory:1\r\n" +
+			"NTS: ssdp:byebye\r\n" +
+			"\r\n",
+		wantErrMsg: "",
+	}, {
+		want: nil,
+		name: "search",
+		in: "M-SEARCH * HTTP/1.1\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"\r\n",
+		wantErrMsg: "",
+	}, {
+		want: nil,
+		name: "no_location",
+		in: "NOTIFY * HTTP/1.1\r\n" +
+			"NTS: ssdp:alive\r\n" +
+			"\r\n",
+		wantErrMsg: "no location",
+	}, {
+		want:       nil,
+		name:       "empty",
+		in:         "",
+		wantErrMsg: "reading start line: EOF",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := parseSSDPMsg([]byte(tc.in))
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, m)
+		})
+	}
+}
+
+func TestParseSSDPLocation(t *testing.T) {
+	ip := netip.MustParseAddr("192.168.1.2")
+
+	testCases := []struct {
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		name:       "valid",
+		in:         "http://192.168.1.2:8080/desc.xml",
+		wantErrMsg: "",
+	}, {
+		name:       "other_host",
+		in:         "http://192.168.1.3/desc.xml",
+		wantErrMsg: "host 192.168.1.3 doesn't match sender",
+	}, {
+		name:       "hostname",
+		in:         "http://example.com/desc.xml",
+		wantErrMsg: `bad host: ParseAddr("example.com"): unexpected character (at "example.com")`,
+	}, {
+		name:       "bad_scheme",
+		in:         "file:///etc/passwd",
+		wantErrMsg: `bad scheme "file"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseSSDPLocation(ip, tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestParseSSDPDesc(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		d, err := parseSSDPDesc(strings.NewReader(testSSDPDesc))
+		require.NoError(t, err)
+
+		assert.Equal(t, &SSDPDevice{
+			FriendlyName: "Living Room TV",
+			Manufacturer: "ACME",
+			Model:        "TV-3000",
+		}, d)
+	})
+
+	t.Run("no_name", func(t *testing.T) {
+		_, err := parseSSDPDesc(strings.NewReader(`<root><device></device></root>`))
+		testutil.AssertErrorMsg(t, "no friendly name", err)
+	})
+
+	t.Run("long_name", func(t *testing.T) {
+		name := strings.Repeat("я", ssdpMaxNameLen)
+		d, err := parseSSDPDesc(strings.NewReader(
+			"<root><device><friendlyName>\t" + name + "</friendlyName></device></root>",
+		))
+		require.NoError(t, err)
+
+		assert.Equal(t, name[:ssdpMaxNameLen-1], d.FriendlyName)
+	})
+}
+
+func TestSSDPListener_handleMsg(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(testSSDPDesc))
+	}))
+	t.Cleanup(srv.Close)
+
+	var gone []netip.Addr
+	l := NewSSDPListener(&SSDPConfig{
+		OnDevice: func(_ *SSDPDevice) {},
+		OnGone:   func(ip netip.Addr) { gone = append(gone, ip) },
+		Client:   srv.Client(),
+	})
+
+	ip := netip.MustParseAddr("127.0.0.1")
+	alive := []byte("NOTIFY * HTTP/1.1\r\n" +
+		"NT: upnp:rootdevice\r\n" +
+		"NTS: ssdp:alive\r\n" +
+		"LOCATION: " + srv.URL + "/desc.xml\r\n" +
+		"\r\n")
+
+	l.handleMsg(ip, alive)
+	require.Len(t, l.queue, 1)
+
+	// The same location must not be fetched again too soon.
+	l.handleMsg(ip, alive)
+	require.Len(t, l.queue, 1)
+
+	d, err := l.fetch(<-l.queue)
+	require.NoError(t, err)
+
+	assert.Equal(t, &SSDPDevice{
+		IP:           ip,
+		FriendlyName: "Living Room TV",
+		Manufacturer: "ACME",
+		Model:        "TV-3000",
+	}, d)
+
+	l.handleMsg(ip, []byte("NOTIFY * HTTP/1.1\r\n"+
+		"NT: upnp:rootdevice\r\n"+
+		"NTS: ssdp:byebye\r\n"+
+		"\r\n"))
+	assert.Equal(t, []netip.Addr{ip}, gone)
+
+	// The description must be fetched again after the device has returned.
+	assert.True(t, l.shouldFetch(ip, srv.URL+"/desc.xml", time.Now()))
+}
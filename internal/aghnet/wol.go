@@ -0,0 +1,77 @@
+package aghnet
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// DefaultWOLPort is the port Wake-on-LAN magic packets are sent to by default.
+// It's the discard port, which is the most commonly used one for Wake-on-LAN.
+const DefaultWOLPort uint16 = 9
+
+// magicPacketLen is the length of the Wake-on-LAN magic packet: six bytes of
+// synchronization stream followed by sixteen repetitions of the MAC address.
+const magicPacketLen = 6 + 16*6
+
+// NewMagicPacket returns the Wake-on-LAN magic packet for the device with the
+// hardware address mac.  mac must be a 48-bit EUI.
+func NewMagicPacket(mac net.HardwareAddr) (pkt []byte, err error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("bad mac %s: want 6 bytes, got %d", mac, len(mac))
+	}
+
+	pkt = make([]byte, 0, magicPacketLen)
+	pkt = append(pkt, bytes.Repeat([]byte{0xff}, 6)...)
+	pkt = append(pkt, bytes.Repeat(mac, 16)...)
+
+	return pkt, nil
+}
+
+// WakeOnLAN sends the Wake-on-LAN magic packet for the device with the hardware
+// address mac to the UDP address dst, which is usually a broadcast one.  If dst
+// is not valid, the limited broadcast address on DefaultWOLPort is used.
+func WakeOnLAN(mac net.HardwareAddr, dst netip.AddrPort) (err error) {
+	pkt, err := NewMagicPacket(mac)
+	if err != nil {
+		return fmt.Errorf("building magic packet: %w", err)
+	}
+
+	if !dst.IsValid() {
+		dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte{255, 255, 255, 255}), DefaultWOLPort)
+	}
+
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(dst))
+	if err != nil {
+		return fmt.Errorf("dialing %s: %w", dst, err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	_, err = conn.Write(pkt)
+	if err != nil {
+		return fmt.Errorf("sending magic packet to %s: %w", dst, err)
+	}
+
+	return nil
+}
+
+// WOLDestination returns the address on DefaultWOLPort to send the Wake-on-LAN
+// magic packet for the device with ip to.  It's the directed broadcast address
+// of the first IPv4 subnet from subnets containing ip, so that the packet is
+// sent through the right interface, or the limited broadcast address, if there
+// is no such subnet or ip is not valid.
+func WOLDestination(ip netip.Addr, subnets []netip.Prefix) (dst netip.AddrPort) {
+	ip = ip.Unmap()
+	if ip.Is4() {
+		for _, subnet := range subnets {
+			if subnet.Addr().Unmap().Is4() && subnet.Contains(ip) {
+				return netip.AddrPortFrom(BroadcastFromPref(subnet), DefaultWOLPort)
+			}
+		}
+	}
+
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte{255, 255, 255, 255}), DefaultWOLPort)
+}
@@ -0,0 +1,95 @@
+package aghnet_test
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMagicPacket(t *testing.T) {
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+
+	pkt, err := aghnet.NewMagicPacket(mac)
+	require.NoError(t, err)
+	require.Len(t, pkt, 102)
+
+	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, pkt[:6])
+	for i := 6; i < len(pkt); i += len(mac) {
+		assert.Equal(t, []byte(mac), pkt[i:i+len(mac)])
+	}
+
+	_, err = aghnet.NewMagicPacket(net.HardwareAddr{0x00, 0x11})
+	testutil.AssertErrorMsg(t, "bad mac 00:11: want 6 bytes, got 2", err)
+}
+
+func TestWakeOnLAN(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	dst := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+
+	err = aghnet.WakeOnLAN(mac, netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port()))
+	require.NoError(t, err)
+
+	err = conn.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+
+	want, err := aghnet.NewMagicPacket(mac)
+	require.NoError(t, err)
+
+	assert.Equal(t, want, buf[:n])
+}
+
+func TestWOLDestination(t *testing.T) {
+	subnets := []netip.Prefix{
+		netip.MustParsePrefix("fe80::/64"),
+		netip.MustParsePrefix("10.0.0.1/8"),
+		netip.MustParsePrefix("192.168.1.1/24"),
+	}
+
+	limited := netip.AddrPortFrom(netip.MustParseAddr("255.255.255.255"), aghnet.DefaultWOLPort)
+
+	testCases := []struct {
+		ip   netip.Addr
+		want netip.AddrPort
+		name string
+	}{{
+		ip:   netip.MustParseAddr("192.168.1.42"),
+		want: netip.MustParseAddrPort("192.168.1.255:9"),
+		name: "directed",
+	}, {
+		ip:   netip.MustParseAddr("::ffff:10.1.2.3"),
+		want: netip.MustParseAddrPort("10.255.255.255:9"),
+		name: "mapped",
+	}, {
+		ip:   netip.MustParseAddr("172.16.0.1"),
+		want: limited,
+		name: "no_subnet",
+	}, {
+		ip:   netip.MustParseAddr("fe80::1"),
+		want: limited,
+		name: "ipv6",
+	}, {
+		ip:   netip.Addr{},
+		want: limited,
+		name: "no_ip",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, aghnet.WOLDestination(tc.ip, subnets))
+		})
+	}
+}
@@ -54,6 +54,12 @@ func HaveAdminRights() (bool, error) {
 	return haveAdminRights()
 }
 
+// FreeSpace returns the number of bytes available to the current user on the
+// file system containing path.
+func FreeSpace(path string) (free uint64, err error) {
+	return freeSpace(path)
+}
+
 // MaxCmdOutputSize is the maximum length of performed shell command output in
 // bytes.
 const MaxCmdOutputSize = 64 * 1024
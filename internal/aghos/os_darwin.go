@@ -0,0 +1,15 @@
+//go:build darwin
+
+package aghos
+
+import "syscall"
+
+func freeSpace(path string) (free uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -44,3 +44,13 @@ func isOpenWrt() (ok bool) {
 
 	return err == nil && ok
 }
+
+func freeSpace(path string) (free uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -96,3 +96,13 @@ func TestLargestLabeled(t *testing.T) {
 		assert.Equal(t, 1, instances)
 	})
 }
+
+func TestFreeSpace(t *testing.T) {
+	free, err := FreeSpace(t.TempDir())
+	require.NoError(t, err)
+
+	assert.Positive(t, free)
+
+	_, err = FreeSpace("/nonexistent/path")
+	assert.Error(t, err)
+}
@@ -26,6 +26,20 @@ func rootDirFS() (fsys fs.FS) {
 	return os.DirFS(filepath.VolumeName(sysDir))
 }
 
+func freeSpace(path string) (free uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	err = windows.GetDiskFreeSpaceEx(p, &free, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return free, nil
+}
+
 func setRlimit(val uint64) (err error) {
 	return Unsupported("setrlimit")
 }
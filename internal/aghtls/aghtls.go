@@ -32,27 +32,64 @@ func SaferCipherSuites() (safe []uint16) {
 	return safe
 }
 
-// ParseCipherIDs returns a set of cipher suites with the cipher names provided
-func ParseCipherIDs(ciphers []string) (userCiphers []uint16, err error) {
-	for _, cipher := range ciphers {
-		exists, cipherID := CipherExists(cipher)
-		if exists {
-			userCiphers = append(userCiphers, cipherID)
-		} else {
-			return nil, fmt.Errorf("unknown cipher : %s ", cipher)
+// ParseCiphers returns the IDs of the cipher suites with the names from
+// cipherNames.  cipherIDs is nil if cipherNames is nil.
+func ParseCiphers(cipherNames []string) (cipherIDs []uint16, err error) {
+	if cipherNames == nil {
+		return nil, nil
+	}
+
+	cipherIDs = make([]uint16, 0, len(cipherNames))
+	for _, name := range cipherNames {
+		id, ok := cipherID(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher %q", name)
 		}
+
+		cipherIDs = append(cipherIDs, id)
 	}
 
-	return userCiphers, nil
+	return cipherIDs, nil
 }
 
-// CipherExists returns cipherid if exists, else return false in boolean
-func CipherExists(cipher string) (exists bool, cipherID uint16) {
+// cipherID returns the ID of the supported cipher suite with the name.
+func cipherID(name string) (id uint16, ok bool) {
 	for _, s := range tls.CipherSuites() {
-		if s.Name == cipher {
-			return true, s.ID
+		if s.Name == name {
+			return s.ID, true
 		}
 	}
 
-	return false, 0
+	return 0, false
+}
+
+// ParseVersion returns the TLS version with the name, either "1.2" or "1.3".
+// v is [tls.VersionTLS12] if name is empty.  The earlier versions aren't
+// supported, since they are deprecated by RFC 8996.
+func ParseVersion(name string) (v uint16, err error) {
+	switch name {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported tls version %q", name)
+	}
+}
+
+// VersionName returns the human-readable name of the TLS version v, for
+// example "TLS 1.3".
+func VersionName(v uint16) (name string) {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", v)
+	}
 }
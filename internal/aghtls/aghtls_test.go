@@ -7,6 +7,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtls"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMain(m *testing.M) {
@@ -54,3 +55,75 @@ func TestParseCiphers(t *testing.T) {
 		})
 	}
 }
+
+func TestParseVersion(t *testing.T) {
+	testCases := []struct {
+		name       string
+		in         string
+		wantErrMsg string
+		want       uint16
+	}{{
+		name:       "empty",
+		in:         "",
+		wantErrMsg: "",
+		want:       tls.VersionTLS12,
+	}, {
+		name:       "tls12",
+		in:         "1.2",
+		wantErrMsg: "",
+		want:       tls.VersionTLS12,
+	}, {
+		name:       "tls13",
+		in:         "1.3",
+		wantErrMsg: "",
+		want:       tls.VersionTLS13,
+	}, {
+		name:       "deprecated",
+		in:         "1.1",
+		wantErrMsg: `unsupported tls version "1.1"`,
+		want:       0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := aghtls.ParseVersion(tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestHandshakeStats(t *testing.T) {
+	t.Run("nil", func(t *testing.T) {
+		var s *aghtls.HandshakeStats
+		assert.NoError(t, s.VerifyConnection(tls.ConnectionState{}))
+		assert.Equal(t, &aghtls.HandshakeCounts{
+			Versions: map[uint16]uint64{},
+			Ciphers:  map[uint16]uint64{},
+		}, s.Counts())
+	})
+
+	s := aghtls.NewHandshakeStats()
+	require.NoError(t, s.VerifyConnection(tls.ConnectionState{
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+	}))
+
+	before := s.Counts()
+
+	require.NoError(t, s.VerifyConnection(tls.ConnectionState{
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+		DidResume:   true,
+	}))
+
+	assert.Equal(t, &aghtls.HandshakeCounts{
+		Versions: map[uint16]uint64{tls.VersionTLS13: 2},
+		Ciphers:  map[uint16]uint64{tls.TLS_AES_128_GCM_SHA256: 2},
+		Total:    2,
+		Resumed:  1,
+	}, s.Counts())
+
+	// The previously returned counts are not changed.
+	assert.Equal(t, uint64(1), before.Versions[tls.VersionTLS13])
+}
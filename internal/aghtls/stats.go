@@ -0,0 +1,101 @@
+package aghtls
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"golang.org/x/exp/maps"
+)
+
+// HandshakeStats collects the statistics of the TLS handshakes completed by a
+// group of listeners.  It's safe for concurrent use.  A nil *HandshakeStats
+// collects nothing.
+type HandshakeStats struct {
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// versions are the numbers of the handshakes by the negotiated protocol
+	// version.
+	versions map[uint16]uint64
+
+	// ciphers are the numbers of the handshakes by the negotiated cipher
+	// suite.
+	ciphers map[uint16]uint64
+
+	// total is the total number of the handshakes.
+	total uint64
+
+	// resumed is the number of the handshakes which resumed a previous
+	// session.
+	resumed uint64
+}
+
+// NewHandshakeStats returns a new properly initialized *HandshakeStats.
+func NewHandshakeStats() (s *HandshakeStats) {
+	return &HandshakeStats{
+		mu:       &sync.Mutex{},
+		versions: map[uint16]uint64{},
+		ciphers:  map[uint16]uint64{},
+	}
+}
+
+// VerifyConnection records the handshake described by cs.  It's intended to be
+// used as [tls.Config.VerifyConnection], which is also called on the resumed
+// sessions, and always returns nil.
+func (s *HandshakeStats) VerifyConnection(cs tls.ConnectionState) (err error) {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.versions[cs.Version]++
+	s.ciphers[cs.CipherSuite]++
+	s.total++
+	if cs.DidResume {
+		s.resumed++
+	}
+
+	return nil
+}
+
+// HandshakeCounts are the numbers of the TLS handshakes collected by
+// [HandshakeStats].
+type HandshakeCounts struct {
+	// Versions are the numbers of the handshakes by the negotiated protocol
+	// version.
+	Versions map[uint16]uint64
+
+	// Ciphers are the numbers of the handshakes by the negotiated cipher
+	// suite.
+	Ciphers map[uint16]uint64
+
+	// Total is the total number of the handshakes.
+	Total uint64
+
+	// Resumed is the number of the handshakes which resumed a previous
+	// session.
+	Resumed uint64
+}
+
+// Counts returns the current numbers of the handshakes.  s may be nil, in which
+// case the counts are empty.
+func (s *HandshakeStats) Counts() (c *HandshakeCounts) {
+	if s == nil {
+		return &HandshakeCounts{
+			Versions: map[uint16]uint64{},
+			Ciphers:  map[uint16]uint64{},
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return &HandshakeCounts{
+		Versions: maps.Clone(s.versions),
+		Ciphers:  maps.Clone(s.ciphers),
+		Total:    s.total,
+		Resumed:  s.resumed,
+	}
+}
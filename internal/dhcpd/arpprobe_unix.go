@@ -0,0 +1,161 @@
+//go:build darwin || freebsd || linux || openbsd
+
+package dhcpd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/ethernet"
+
+	//lint:ignore SA1019 See the TODO in go.mod.
+	"github.com/mdlayher/raw"
+)
+
+// arpAvailable sends an ARP probe for the target IP address, as described by
+// RFC 5227.  It returns true if no other device claims the address until the
+// timeout, which means that the address isn't in use even by the devices
+// ignoring ICMP.
+func (s *v4Server) arpAvailable(target net.IP) (avail bool) {
+	if s.conf.ARPProbeTimeout == 0 {
+		return true
+	}
+
+	log.Debug("dhcpv4: sending arp probe for %s", target)
+
+	inUse, err := arpProbe(
+		s.conf.InterfaceName,
+		target,
+		time.Duration(s.conf.ARPProbeTimeout)*time.Millisecond,
+	)
+	if err != nil {
+		log.Error("dhcpv4: arp probe: %s", err)
+
+		return true
+	} else if inUse {
+		log.Info("dhcpv4: ip conflict: %s is claimed by another device via arp", target)
+
+		return false
+	}
+
+	log.Debug("dhcpv4: arp probe is complete: %q", target)
+
+	return true
+}
+
+// arpProbe sends an ARP probe for target via the network interface with
+// ifaceName and waits for the conflicting packets until timeout.
+func arpProbe(ifaceName string, target net.IP, timeout time.Duration) (inUse bool, err error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return false, fmt.Errorf("getting interface: %w", err)
+	}
+
+	conn, err := raw.ListenPacket(iface, uint16(ethernet.EtherTypeARP), nil)
+	if err != nil {
+		return false, fmt.Errorf("creating raw arp connection: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	pkt, err := buildARPProbe(iface.HardwareAddr, target)
+	if err != nil {
+		return false, err
+	}
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return false, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	_, err = conn.WriteTo(pkt, &raw.Addr{HardwareAddr: ethernet.Broadcast})
+	if err != nil {
+		return false, fmt.Errorf("writing probe: %w", err)
+	}
+
+	buf := make([]byte, ethernetMaxLen)
+	for {
+		var n int
+		n, _, err = conn.ReadFrom(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				// No conflicting packets until the timeout.
+				return false, nil
+			}
+
+			return false, fmt.Errorf("reading: %w", err)
+		}
+
+		if isARPConflict(buf[:n], iface.HardwareAddr, target) {
+			return true, nil
+		}
+	}
+}
+
+// ethernetMaxLen is the maximum length of an untagged Ethernet frame without
+// the frame check sequence.
+const ethernetMaxLen = 1514
+
+// buildARPProbe returns an Ethernet frame containing the ARP probe for target
+// sent from the hardware address srcMAC.
+func buildARPProbe(srcMAC net.HardwareAddr, target net.IP) (pkt []byte, err error) {
+	ethLayer := &layers.Ethernet{
+		SrcMAC:       srcMAC,
+		DstMAC:       ethernet.Broadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+
+	// The sender protocol address of a probe is all zeroes, so that it doesn't
+	// pollute the ARP caches of the other hosts.
+	arpLayer := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   net.IPv4len,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   srcMAC,
+		SourceProtAddress: net.IPv4zero.To4(),
+		DstHwAddress:      make(net.HardwareAddr, 6),
+		DstProtAddress:    target.To4(),
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ethLayer, arpLayer)
+	if err != nil {
+		return nil, fmt.Errorf("serializing layers: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// isARPConflict returns true if the Ethernet frame pkt shows that target is
+// used by another device or is being probed by it.  ownMAC is the hardware
+// address of the probing interface.
+func isARPConflict(pkt []byte, ownMAC net.HardwareAddr, target net.IP) (ok bool) {
+	p := gopacket.NewPacket(pkt, layers.LayerTypeEthernet, gopacket.DecodeOptions{
+		NoCopy: true,
+		Lazy:   true,
+	})
+
+	arpLayer, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok || bytes.Equal(arpLayer.SourceHwAddress, ownMAC) {
+		return false
+	}
+
+	target = target.To4()
+	if net.IP(arpLayer.SourceProtAddress).Equal(target) {
+		// Any ARP packet from the address means that it's used.
+		return true
+	}
+
+	// Another device probing the same address, see RFC 5227, section 2.1.1.
+	return arpLayer.Operation == layers.ARPRequest &&
+		net.IP(arpLayer.SourceProtAddress).Equal(net.IPv4zero) &&
+		net.IP(arpLayer.DstProtAddress).Equal(target)
+}
@@ -0,0 +1,113 @@
+//go:build darwin || freebsd || linux || openbsd
+
+package dhcpd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mdlayher/ethernet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildARPProbe(t *testing.T) {
+	ownMAC := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	target := net.IP{192, 168, 10, 100}
+
+	pkt, err := buildARPProbe(ownMAC, target)
+	require.NoError(t, err)
+
+	p := gopacket.NewPacket(pkt, layers.LayerTypeEthernet, gopacket.Default)
+
+	eth, ok := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	require.True(t, ok)
+
+	assert.Equal(t, ethernet.Broadcast, eth.DstMAC)
+	assert.Equal(t, ownMAC, eth.SrcMAC)
+
+	arpLayer, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+	require.True(t, ok)
+
+	assert.Equal(t, uint16(layers.ARPRequest), arpLayer.Operation)
+	assert.Equal(t, []byte(net.IPv4zero.To4()), arpLayer.SourceProtAddress)
+	assert.Equal(t, []byte(target), arpLayer.DstProtAddress)
+
+	// An own probe isn't a conflict.
+	assert.False(t, isARPConflict(pkt, ownMAC, target))
+}
+
+func TestIsARPConflict(t *testing.T) {
+	ownMAC := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	otherMAC := net.HardwareAddr{6, 5, 4, 3, 2, 1}
+	target := net.IP{192, 168, 10, 100}
+
+	newPkt := func(t *testing.T, op uint16, srcIP, dstIP net.IP) (pkt []byte) {
+		t.Helper()
+
+		buf := gopacket.NewSerializeBuffer()
+		err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &layers.Ethernet{
+			SrcMAC:       otherMAC,
+			DstMAC:       ownMAC,
+			EthernetType: layers.EthernetTypeARP,
+		}, &layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   net.IPv4len,
+			Operation:         op,
+			SourceHwAddress:   otherMAC,
+			SourceProtAddress: srcIP.To4(),
+			DstHwAddress:      ownMAC,
+			DstProtAddress:    dstIP.To4(),
+		})
+		require.NoError(t, err)
+
+		return buf.Bytes()
+	}
+
+	testCases := []struct {
+		srcIP net.IP
+		dstIP net.IP
+		name  string
+		op    uint16
+		want  bool
+	}{{
+		srcIP: target,
+		dstIP: net.IPv4zero,
+		name:  "reply",
+		op:    layers.ARPReply,
+		want:  true,
+	}, {
+		srcIP: net.IPv4zero,
+		dstIP: target,
+		name:  "other_probe",
+		op:    layers.ARPRequest,
+		want:  true,
+	}, {
+		srcIP: net.IP{192, 168, 10, 1},
+		dstIP: target,
+		name:  "other_request",
+		op:    layers.ARPRequest,
+		want:  false,
+	}, {
+		srcIP: net.IP{192, 168, 10, 101},
+		dstIP: net.IPv4zero,
+		name:  "other_reply",
+		op:    layers.ARPReply,
+		want:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pkt := newPkt(t, tc.op, tc.srcIP, tc.dstIP)
+			assert.Equal(t, tc.want, isARPConflict(pkt, ownMAC, target))
+		})
+	}
+
+	t.Run("not_arp", func(t *testing.T) {
+		assert.False(t, isARPConflict([]byte{1, 2, 3}, ownMAC, target))
+	})
+}
@@ -2,8 +2,10 @@ package dhcpd
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"net/netip"
+	"strings"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
@@ -20,6 +22,10 @@ type ServerConfig struct {
 	// Register an HTTP handler
 	HTTPRegister aghhttp.RegisterFunc `yaml:"-"`
 
+	// VendorByMAC, if not nil, returns the name of the vendor of the hardware
+	// address for the responses of the HTTP API.
+	VendorByMAC func(mac net.HardwareAddr) (vendor string) `yaml:"-"`
+
 	Enabled       bool   `yaml:"enabled"`
 	InterfaceName string `yaml:"interface_name"`
 
@@ -29,6 +35,11 @@ type ServerConfig struct {
 	LocalDomainName string `yaml:"local_domain_name"`
 
 	Conf4 V4ServerConf `yaml:"dhcpv4"`
+
+	// Scopes4 are the additional DHCPv4 scopes, each served on its own
+	// network interface.
+	Scopes4 []*V4ScopeConf `yaml:"dhcpv4_scopes"`
+
 	Conf6 V6ServerConf `yaml:"dhcpv6"`
 
 	WorkDir    string `yaml:"-"`
@@ -84,6 +95,22 @@ type V4ServerConf struct {
 	// 0: disable
 	ICMPTimeout uint32 `yaml:"icmp_timeout_msec" json:"-"`
 
+	// ICMPSkip are the IP addresses and the CIDRs of the dynamic addresses
+	// offered without sending the ICMP echo request, for example the ones of
+	// the devices which are known to be asleep or to answer for the others.
+	ICMPSkip []string `yaml:"icmp_skip" json:"-"`
+
+	// ARPProbeTimeout is the time in milliseconds to wait for the other
+	// devices to claim an address after sending an ARP probe for it before
+	// offering it, which detects the statically-configured devices ignoring
+	// ICMP.  0 disables the probes.
+	ARPProbeTimeout uint32 `yaml:"arp_probe_timeout_msec" json:"-"`
+
+	// DeclineQuarantine is the time in seconds during which the address
+	// declined by a client isn't offered to any client.  0 means the lease
+	// duration.
+	DeclineQuarantine uint32 `yaml:"decline_quarantine" json:"-"`
+
 	// Custom Options.
 	//
 	// Option with arbitrary hexadecimal data:
@@ -94,6 +121,19 @@ type V4ServerConf struct {
 	//     DEC_CODE ip IP_ADDR
 	Options []string `yaml:"options" json:"-"`
 
+	// OptionTemplates are the sets of options sent only to the clients
+	// matching their conditions.  They are applied in order after Options, so
+	// the later templates override the earlier ones.
+	OptionTemplates []*V4OptionTemplate `yaml:"option_templates" json:"option_templates"`
+
+	// Netboot is the configuration of the network boot of the clients.  It
+	// may be nil.
+	Netboot *V4NetbootConf `yaml:"netboot" json:"netboot"`
+
+	// IPv6OnlyPreferred is the configuration of the IPv6-Only Preferred
+	// option.  It may be nil.
+	IPv6OnlyPreferred *V4IPv6OnlyConf `yaml:"ipv6_only_preferred" json:"ipv6_only_preferred"`
+
 	ipRange *ipRange
 
 	leaseTime  time.Duration // the time during which a dynamic lease is considered valid
@@ -110,6 +150,106 @@ type V4ServerConf struct {
 	// TODO(a.garipov): This is utter madness and must be refactored.  It just
 	// begs for deadlock bugs and other nastiness.
 	notify func(uint32)
+
+	// events is the log of the DHCP events.  It may be nil.
+	events *eventLog
+
+	// counters are the numbers of the handled DHCP messages.  It may be nil.
+	counters *msgCounters
+
+	// declineQuarantine is the parsed DeclineQuarantine.
+	declineQuarantine time.Duration
+
+	// icmpSkip is the parsed ICMPSkip.
+	icmpSkip []netip.Prefix
+}
+
+// V4ScopeConf is the configuration of an additional DHCPv4 scope.  Each scope
+// is served on its own network interface and has its own range, gateway, and
+// options.
+type V4ScopeConf struct {
+	// Name is the unique name of the scope.
+	Name string `yaml:"name"`
+
+	// InterfaceName is the name of the network interface the scope is served
+	// on.  It must differ from the interfaces of the other scopes and of the
+	// main DHCP server.
+	InterfaceName string `yaml:"interface_name"`
+
+	// Enabled shows if the scope is served when the DHCP server is enabled.
+	Enabled bool `yaml:"enabled"`
+
+	V4ServerConf `yaml:",inline"`
+}
+
+// LeaseDurationInfinite is the lease duration meaning an infinite lease.  See
+// RFC 2131, section 3.3.
+const LeaseDurationInfinite uint32 = math.MaxUint32
+
+// V4OptionTemplate is a set of DHCPv4 options sent only to the clients matching
+// its conditions.  At least one condition must be set, and when both are set,
+// the client must match both.
+type V4OptionTemplate struct {
+	// VendorClass, if not empty, is the prefix of the vendor class identifier
+	// (option 60) of the matching clients, for example "PXEClient".
+	VendorClass string `yaml:"vendor_class" json:"vendor_class"`
+
+	// MACPrefix, if not empty, is the prefix of the hardware address of the
+	// matching clients, for example "aa:bb:cc".
+	MACPrefix string `yaml:"mac_prefix" json:"mac_prefix"`
+
+	// Options are the options in the format of [V4ServerConf.Options].  The
+	// text values of the TFTP server name (option 66) and the bootfile name
+	// (option 67) are also put into the sname and the file fields of the
+	// response.
+	Options []string `yaml:"options" json:"options"`
+
+	// LeaseDuration, if not zero, is the lease time in seconds for the
+	// matching clients, for example short leases for the guests.
+	// [LeaseDurationInfinite] means an infinite lease.  The lease time of a
+	// static lease takes precedence over it.
+	LeaseDuration uint32 `yaml:"lease_duration" json:"lease_duration"`
+}
+
+// The bounds of the V6ONLY_WAIT value of the IPv6-Only Preferred option.  See
+// RFC 8925, section 3.4.
+const (
+	// MinIPv6OnlyWait is the minimum V6ONLY_WAIT value in seconds.
+	MinIPv6OnlyWait uint32 = 300
+
+	// DefaultIPv6OnlyWait is the V6ONLY_WAIT value in seconds used when none
+	// is configured.
+	DefaultIPv6OnlyWait uint32 = 1800
+)
+
+// V4IPv6OnlyConf is the configuration of the IPv6-Only Preferred option
+// (option 108), which tells the IPv6-capable clients requesting it to disable
+// their IPv4 stack instead of getting a lease.  See RFC 8925.
+type V4IPv6OnlyConf struct {
+	// WaitTime is the V6ONLY_WAIT value in seconds, the time during which the
+	// clients don't request IPv4 leases again.  If zero, [DefaultIPv6OnlyWait]
+	// is used.  Otherwise, it must not be less than [MinIPv6OnlyWait].
+	WaitTime uint32 `yaml:"wait_time" json:"wait_time"`
+
+	// Enabled defines if the option is sent to the clients.
+	Enabled bool `yaml:"enabled" json:"enabled"`
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *V4IPv6OnlyConf) validate() (err error) {
+	if c == nil || c.WaitTime == 0 {
+		return nil
+	}
+
+	if c.WaitTime < MinIPv6OnlyWait {
+		return fmt.Errorf(
+			"ipv6-only preferred: wait time %d is less than %d",
+			c.WaitTime,
+			MinIPv6OnlyWait,
+		)
+	}
+
+	return nil
 }
 
 // errNilConfig is an error returned by validation method if the config is nil.
@@ -126,6 +266,44 @@ func ensureV4(ip netip.Addr, kind string) (ip4 netip.Addr, err error) {
 	return ip4, nil
 }
 
+// V4NetbootConf is the configuration of the network boot of the DHCPv4
+// clients.  The PXE and UEFI HTTP boot clients receive the boot file for their
+// architecture from option 93.  The clients without that option are considered
+// legacy BIOS ones.
+type V4NetbootConf struct {
+	// ServerIP is the address of the TFTP server put into the siaddr field of
+	// the responses.  If it's invalid, siaddr isn't set.
+	ServerIP netip.Addr `yaml:"server_ip" json:"server_ip"`
+
+	// ServerName is the name of the TFTP server sent in option 66 and the
+	// sname field.
+	ServerName string `yaml:"server_name" json:"server_name"`
+
+	// BIOSBootFile is the boot file for the legacy BIOS clients.
+	BIOSBootFile string `yaml:"bios_boot_file" json:"bios_boot_file"`
+
+	// UEFIBootFile is the boot file for the x86-64 UEFI clients.
+	UEFIBootFile string `yaml:"uefi_boot_file" json:"uefi_boot_file"`
+
+	// ARM64BootFile is the boot file for the ARM64 UEFI clients.
+	ARM64BootFile string `yaml:"arm64_boot_file" json:"arm64_boot_file"`
+
+	// HTTPBootURL is the URL of the boot file for the UEFI HTTP boot clients.
+	HTTPBootURL string `yaml:"http_boot_url" json:"http_boot_url"`
+
+	// Enabled defines if the boot information is sent to the clients.
+	Enabled bool `yaml:"enabled" json:"enabled"`
+
+	// ProxyDHCP, if true, makes the server only answer the network boot
+	// clients with the boot information without offering them any addresses,
+	// so that it works alongside another DHCP server.
+	ProxyDHCP bool `yaml:"proxy_dhcp" json:"proxy_dhcp"`
+
+	// BOOTP, if true, makes the server answer the BOOTP requests of the
+	// clients with static leases.
+	BOOTP bool `yaml:"bootp" json:"bootp"`
+}
+
 // Validate returns an error if c is not a valid configuration.
 //
 // TODO(e.burkov):  Don't set the config fields when the server itself will stop
@@ -198,7 +376,40 @@ func (c *V4ServerConf) Validate() (err error) {
 		)
 	}
 
-	return nil
+	c.icmpSkip, err = parseICMPSkip(c.ICMPSkip)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is and there is
+		// an annotation deferred already.
+		return err
+	}
+
+	// Don't wrap the error since it's informative enough as is and there is an
+	// annotation deferred already.
+	return c.IPv6OnlyPreferred.validate()
+}
+
+// parseICMPSkip parses the IPv4 addresses and CIDRs of the ICMP skip-list.
+func parseICMPSkip(skip []string) (prefs []netip.Prefix, err error) {
+	for i, s := range skip {
+		var pref netip.Prefix
+		if strings.Contains(s, "/") {
+			pref, err = netip.ParsePrefix(s)
+		} else {
+			var ip netip.Addr
+			ip, err = netip.ParseAddr(s)
+			pref = netip.PrefixFrom(ip, ip.BitLen())
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("icmp skip at index %d: %w", i, err)
+		} else if !pref.Addr().Is4() {
+			return nil, fmt.Errorf("icmp skip at index %d: %q is not an ipv4 network", i, s)
+		}
+
+		prefs = append(prefs, pref.Masked())
+	}
+
+	return prefs, nil
 }
 
 // V6ServerConf - server configuration
@@ -17,10 +17,11 @@ import (
 const dbFilename = "leases.db"
 
 type leaseJSON struct {
-	HWAddr   []byte `json:"mac"`
-	IP       []byte `json:"ip"`
-	Hostname string `json:"host"`
-	Expiry   int64  `json:"exp"`
+	HWAddr        []byte `json:"mac"`
+	IP            []byte `json:"ip"`
+	Hostname      string `json:"host"`
+	Expiry        int64  `json:"exp"`
+	LeaseDuration uint32 `json:"lease_duration,omitempty"`
 }
 
 func normalizeIP(ip net.IP) net.IP {
@@ -63,10 +64,11 @@ func (s *server) dbLoad() (err error) {
 		}
 
 		lease := Lease{
-			HWAddr:   obj[i].HWAddr,
-			IP:       obj[i].IP,
-			Hostname: obj[i].Hostname,
-			Expiry:   time.Unix(obj[i].Expiry, 0),
+			HWAddr:        obj[i].HWAddr,
+			IP:            obj[i].IP,
+			Hostname:      obj[i].Hostname,
+			Expiry:        time.Unix(obj[i].Expiry, 0),
+			LeaseDuration: obj[i].LeaseDuration,
 		}
 
 		if len(obj[i].IP) == 16 {
@@ -85,7 +87,7 @@ func (s *server) dbLoad() (err error) {
 	}
 
 	leases4 := normalizeLeases(staticLeases, dynLeases)
-	err = s.srv4.ResetLeases(leases4)
+	err = s.resetLeases4(leases4)
 	if err != nil {
 		return fmt.Errorf("resetting dhcpv4 leases: %w", err)
 	}
@@ -137,20 +139,22 @@ func (s *server) dbStore() (err error) {
 	// "null" into the database file if leases are empty.
 	leases := []leaseJSON{}
 
-	leases4 := s.srv4.getLeasesRef()
-	for _, l := range leases4 {
-		if l.Expiry.Unix() == 0 {
-			continue
-		}
+	for _, srv := range s.v4Servers() {
+		for _, l := range srv.getLeasesRef() {
+			if l.Expiry.Unix() == 0 {
+				continue
+			}
 
-		lease := leaseJSON{
-			HWAddr:   l.HWAddr,
-			IP:       l.IP,
-			Hostname: l.Hostname,
-			Expiry:   l.Expiry.Unix(),
-		}
+			lease := leaseJSON{
+				HWAddr:        l.HWAddr,
+				IP:            l.IP,
+				Hostname:      l.Hostname,
+				Expiry:        l.Expiry.Unix(),
+				LeaseDuration: l.LeaseDuration,
+			}
 
-		leases = append(leases, lease)
+			leases = append(leases, lease)
+		}
 	}
 
 	if s.srv6 != nil {
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/netip"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -48,6 +49,15 @@ type Lease struct {
 	//
 	// TODO(a.garipov): Migrate leases.db and use netip.Addr.
 	IP net.IP `json:"ip"`
+
+	// LeaseDuration, if not zero, is the lease time in seconds sent to the
+	// client of a static DHCPv4 lease instead of the configured one.
+	// [LeaseDurationInfinite] means an infinite lease.
+	LeaseDuration uint32 `json:"lease_duration,omitempty"`
+
+	// Vendor is the name of the vendor of HWAddr, if known.  It's only set in
+	// the responses of the HTTP API.
+	Vendor string `json:"vendor,omitempty"`
 }
 
 // Clone returns a deep copy of l.
@@ -57,10 +67,12 @@ func (l *Lease) Clone() (clone *Lease) {
 	}
 
 	return &Lease{
-		Expiry:   l.Expiry,
-		Hostname: l.Hostname,
-		HWAddr:   slices.Clone(l.HWAddr),
-		IP:       slices.Clone(l.IP),
+		Expiry:        l.Expiry,
+		Hostname:      l.Hostname,
+		HWAddr:        slices.Clone(l.HWAddr),
+		IP:            slices.Clone(l.IP),
+		LeaseDuration: l.LeaseDuration,
+		Vendor:        l.Vendor,
 	}
 }
 
@@ -118,6 +130,9 @@ func (l *Lease) UnmarshalJSON(data []byte) (err error) {
 	aux := struct {
 		*lease
 		HWAddr string `json:"mac"`
+
+		// Vendor shadows the field of lease, since it's ignored in requests.
+		Vendor string `json:"vendor"`
 	}{
 		lease: (*lease)(l),
 	}
@@ -213,12 +228,25 @@ type server struct {
 	srv4 DHCPServer
 	srv6 DHCPServer
 
+	// scopesMu protects scopes.
+	scopesMu sync.RWMutex
+
+	// scopes are the additional DHCPv4 scopes.
+	scopes []*scope4
+
 	// TODO(a.garipov): Either create a separate type for the internal config or
 	// just put the config values into Server.
 	conf *ServerConfig
 
 	// Called when the leases DB is modified
 	onLeaseChanged []OnLeaseChangedT
+
+	// events is the log of the DHCPv4 events.
+	events *eventLog
+
+	// counters are the numbers of the DHCPv4 messages handled by all the
+	// DHCPv4 servers.
+	counters *msgCounters
 }
 
 // type check
@@ -232,6 +260,7 @@ func Create(conf *ServerConfig) (s *server, err error) {
 			ConfigModified: conf.ConfigModified,
 
 			HTTPRegister: conf.HTTPRegister,
+			VendorByMAC:  conf.VendorByMAC,
 
 			Enabled:       conf.Enabled,
 			InterfaceName: conf.InterfaceName,
@@ -240,6 +269,8 @@ func Create(conf *ServerConfig) (s *server, err error) {
 
 			DBFilePath: filepath.Join(conf.WorkDir, dbFilename),
 		},
+		events:   newEventLog(filepath.Join(conf.WorkDir, eventsFilename)),
+		counters: &msgCounters{},
 	}
 
 	// TODO(e.burkov):  Don't register handlers, see TODO on
@@ -249,6 +280,8 @@ func Create(conf *ServerConfig) (s *server, err error) {
 	v4conf := conf.Conf4
 	v4conf.InterfaceName = s.conf.InterfaceName
 	v4conf.notify = s.onNotify
+	v4conf.events = s.events
+	v4conf.counters = s.counters
 	v4conf.Enabled = s.conf.Enabled && v4conf.RangeStart.IsValid()
 
 	s.srv4, err = v4Create(&v4conf)
@@ -260,6 +293,15 @@ func Create(conf *ServerConfig) (s *server, err error) {
 		log.Debug("dhcpd: warning: creating dhcpv4 srv: %s", err)
 	}
 
+	s.scopes, err = s.newScopes4(conf.Scopes4, s.conf.InterfaceName)
+	if err != nil {
+		if s.conf.Enabled {
+			return nil, fmt.Errorf("creating dhcpv4 scopes: %w", err)
+		}
+
+		log.Debug("dhcpd: warning: creating dhcpv4 scopes: %s", err)
+	}
+
 	v6conf := conf.Conf6
 	v6conf.Enabled = s.conf.Enabled
 	if len(v6conf.RangeStart) == 0 {
@@ -273,9 +315,10 @@ func Create(conf *ServerConfig) (s *server, err error) {
 	}
 
 	s.conf.Conf4 = conf.Conf4
+	s.conf.Scopes4 = conf.Scopes4
 	s.conf.Conf6 = conf.Conf6
 
-	if s.conf.Enabled && !v4conf.Enabled && !v6conf.Enabled {
+	if s.conf.Enabled && !v4conf.Enabled && !v6conf.Enabled && !hasEnabledScopes4(s.scopes) {
 		return nil, fmt.Errorf("neither dhcpv4 nor dhcpv6 srv is configured")
 	}
 
@@ -296,9 +339,11 @@ func (s *server) Enabled() (ok bool) {
 
 // resetLeases resets all leases in the lease database.
 func (s *server) resetLeases() (err error) {
-	err = s.srv4.ResetLeases(nil)
-	if err != nil {
-		return err
+	for _, srv := range s.v4Servers() {
+		err = srv.ResetLeases(nil)
+		if err != nil {
+			return err
+		}
 	}
 
 	if s.srv6 != nil {
@@ -343,6 +388,7 @@ func (s *server) WriteDiskConfig(c *ServerConfig) {
 	c.LocalDomainName = s.conf.LocalDomainName
 
 	s.srv4.WriteDiskConfig4(&c.Conf4)
+	c.Scopes4 = s.conf.Scopes4
 	s.srv6.WriteDiskConfig6(&c.Conf6)
 }
 
@@ -358,6 +404,17 @@ func (s *server) Start() (err error) {
 		return err
 	}
 
+	if !s.conf.Enabled {
+		return nil
+	}
+
+	for _, sc := range s.scopes4() {
+		err = sc.srv.Start()
+		if err != nil {
+			return fmt.Errorf("starting scope %q: %w", sc.conf.Name, err)
+		}
+	}
+
 	return nil
 }
 
@@ -373,26 +430,40 @@ func (s *server) Stop() (err error) {
 		return err
 	}
 
+	for _, sc := range s.scopes4() {
+		err = sc.srv.Stop()
+		if err != nil {
+			return fmt.Errorf("stopping scope %q: %w", sc.conf.Name, err)
+		}
+	}
+
 	return nil
 }
 
 // Leases returns the list of active IPv4 and IPv6 DHCP leases.  It's safe for
 // concurrent use.
 func (s *server) Leases(flags GetLeasesFlags) (leases []*Lease) {
-	return append(s.srv4.GetLeases(flags), s.srv6.GetLeases(flags)...)
+	for _, srv := range s.v4Servers() {
+		leases = append(leases, srv.GetLeases(flags)...)
+	}
+
+	return append(leases, s.srv6.GetLeases(flags)...)
 }
 
 // FindMACbyIP returns a MAC address by the IP address of its lease, if there is
 // one.
 func (s *server) FindMACbyIP(ip netip.Addr) (mac net.HardwareAddr) {
 	if ip.Is4() {
-		return s.srv4.FindMACbyIP(ip)
+		return s.v4ServerFor(ip).FindMACbyIP(ip)
 	}
 
 	return s.srv6.FindMACbyIP(ip)
 }
 
-// AddStaticLease - add static v4 lease
+// AddStaticLease adds a static DHCPv4 lease to the server of the scope
+// containing its IP address.
 func (s *server) AddStaticLease(l *Lease) error {
-	return s.srv4.AddStaticLease(l)
+	ip, _ := ipToAddr4(l.IP)
+
+	return s.v4ServerFor(ip).AddStaticLease(l)
 }
@@ -0,0 +1,285 @@
+package dhcpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// eventsFilename is the name of the file containing the DHCP events log.  The
+// previous part of the log is kept in the file with the rotatedEventsSuffix.
+const eventsFilename = "dhcp_events.json"
+
+// rotatedEventsSuffix is the suffix of the rotated DHCP events log file.
+const rotatedEventsSuffix = ".1"
+
+// defaultEventsMaxSize is the default maximum size of the DHCP events log
+// file, after which it's rotated.
+const defaultEventsMaxSize = 1 * 1024 * 1024
+
+// eventType is the type of a DHCP event.
+type eventType string
+
+// eventType values.
+const (
+	eventTypeDiscover eventType = "discover"
+	eventTypeLease    eventType = "lease"
+	eventTypeRenew    eventType = "renew"
+	eventTypeDecline  eventType = "decline"
+	eventTypeRelease  eventType = "release"
+	eventTypeExpire   eventType = "expire"
+	eventTypeConflict eventType = "conflict"
+)
+
+// event is a single entry of the DHCP events log.
+type event struct {
+	// Time is the time of the event.
+	Time time.Time `json:"time"`
+
+	// Type is the type of the event.
+	Type eventType `json:"type"`
+
+	// HWAddr is the hardware address of the client, if any.
+	HWAddr string `json:"mac,omitempty"`
+
+	// IP is the IP address the event relates to, if any.
+	IP netip.Addr `json:"ip,omitempty"`
+
+	// Hostname is the hostname of the client, if any.
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// newEvent returns a new event of typ happened now.  ip may be nil.
+func newEvent(typ eventType, mac net.HardwareAddr, ip net.IP, hostname string) (e *event) {
+	e = &event{
+		Time:     time.Now(),
+		Type:     typ,
+		Hostname: hostname,
+	}
+
+	if len(mac) > 0 {
+		e.HWAddr = mac.String()
+	}
+
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		e.IP = addr.Unmap()
+	}
+
+	return e
+}
+
+// eventFilter contains the conditions for the DHCP events to match.  The empty
+// fields match any event.
+type eventFilter struct {
+	// since is the earliest time of the events to match.
+	since time.Time
+
+	// until is the latest time of the events to match.
+	until time.Time
+
+	// hwAddr is the hardware address of the clients, as formatted by
+	// [net.HardwareAddr.String].
+	hwAddr string
+
+	// limit is the maximum number of the events to return.  It must be
+	// positive.
+	limit int
+}
+
+// match returns true if e matches f.
+func (f *eventFilter) match(e *event) (ok bool) {
+	switch {
+	case f.hwAddr != "" && e.HWAddr != f.hwAddr:
+		return false
+	case !f.since.IsZero() && e.Time.Before(f.since):
+		return false
+	case !f.until.IsZero() && e.Time.After(f.until):
+		return false
+	default:
+		return true
+	}
+}
+
+// eventLog is the rotating on-disk log of DHCP events.  A nil *eventLog is a
+// valid log that discards all the events.
+type eventLog struct {
+	// mu protects the files of the log.
+	mu *sync.Mutex
+
+	// path is the path to the current log file.
+	path string
+
+	// maxSize is the size of the current log file after which it's rotated.
+	maxSize int64
+}
+
+// newEventLog returns a new DHCP events log writing to the file at path.
+func newEventLog(path string) (l *eventLog) {
+	return &eventLog{
+		mu:      &sync.Mutex{},
+		path:    path,
+		maxSize: defaultEventsMaxSize,
+	}
+}
+
+// add writes e to the log.  Errors are logged, since they must not break the
+// handling of the DHCP messages.
+func (l *eventLog) add(e *event) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.write(e)
+	if err != nil {
+		log.Error("dhcpd: writing event: %s", err)
+	}
+}
+
+// write appends e to the current log file and rotates it, if needed.  l.mu is
+// expected to be locked.
+func (l *eventLog) write(e *event) (err error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		return fmt.Errorf("writing: %w", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("getting file info: %w", err)
+	} else if fi.Size() < l.maxSize {
+		return nil
+	}
+
+	log.Debug("dhcpd: rotating events log at %d bytes", fi.Size())
+
+	err = os.Rename(l.path, l.path+rotatedEventsSuffix)
+	if err != nil {
+		return fmt.Errorf("rotating: %w", err)
+	}
+
+	return nil
+}
+
+// find returns the events matching f, the newest first.
+func (l *eventLog) find(f *eventFilter) (events []*event, err error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, p := range []string{l.path + rotatedEventsSuffix, l.path} {
+		events, err = readEvents(p, f, events)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	if len(events) > f.limit {
+		events = events[:f.limit]
+	}
+
+	return events, nil
+}
+
+// readEvents appends the events matching f from the log file at path to
+// events.  Malformed entries are skipped.
+func readEvents(path string, f *eventFilter, events []*event) (res []*event, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return events, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading events: %w", err)
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		e := &event{}
+		err = json.Unmarshal(s.Bytes(), e)
+		if err != nil {
+			log.Debug("dhcpd: decoding event from %q: %s", path, err)
+
+			continue
+		}
+
+		if f.match(e) {
+			events = append(events, e)
+		}
+	}
+
+	return events, s.Err()
+}
+
+// msgCounters are the numbers of the DHCPv4 messages of some types handled
+// since the start of the server.  A nil *msgCounters is valid and counts
+// nothing.
+type msgCounters struct {
+	// declines is the number of the handled DHCPDECLINE messages.
+	declines atomic.Uint64
+
+	// releases is the number of the handled DHCPRELEASE messages.
+	releases atomic.Uint64
+}
+
+// countDecline increments the number of the handled DHCPDECLINE messages.
+func (c *msgCounters) countDecline() {
+	if c != nil {
+		c.declines.Add(1)
+	}
+}
+
+// countRelease increments the number of the handled DHCPRELEASE messages.
+func (c *msgCounters) countRelease() {
+	if c != nil {
+		c.releases.Add(1)
+	}
+}
+
+// msgCountersJSON is the JSON representation of the DHCPv4 message counters.
+type msgCountersJSON struct {
+	// Declines is the number of the addresses declined by the clients.
+	Declines uint64 `json:"declines"`
+
+	// Releases is the number of the leases released by the clients.
+	Releases uint64 `json:"releases"`
+}
+
+// toJSON returns the current values of c.
+func (c *msgCounters) toJSON() (j *msgCountersJSON) {
+	j = &msgCountersJSON{}
+	if c != nil {
+		j.Declines = c.declines.Load()
+		j.Releases = c.releases.Load()
+	}
+
+	return j
+}
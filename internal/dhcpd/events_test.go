@@ -0,0 +1,112 @@
+package dhcpd
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLog(t *testing.T) {
+	mac1 := net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA}
+	mac2 := net.HardwareAddr{0xBB, 0xBB, 0xBB, 0xBB, 0xBB, 0xBB}
+	ip := net.IP{192, 168, 0, 10}
+
+	l := newEventLog(filepath.Join(t.TempDir(), eventsFilename))
+
+	start := time.Now()
+	l.add(newEvent(eventTypeDiscover, mac1, nil, "host"))
+	l.add(newEvent(eventTypeLease, mac1, ip, "host"))
+	l.add(newEvent(eventTypeRenew, mac2, ip, ""))
+	l.add(newEvent(eventTypeConflict, nil, ip, ""))
+
+	testCases := []struct {
+		filter    *eventFilter
+		name      string
+		wantTypes []eventType
+	}{{
+		filter:    &eventFilter{limit: 10},
+		name:      "all",
+		wantTypes: []eventType{eventTypeConflict, eventTypeRenew, eventTypeLease, eventTypeDiscover},
+	}, {
+		filter:    &eventFilter{limit: 2},
+		name:      "limit",
+		wantTypes: []eventType{eventTypeConflict, eventTypeRenew},
+	}, {
+		filter:    &eventFilter{hwAddr: mac1.String(), limit: 10},
+		name:      "mac",
+		wantTypes: []eventType{eventTypeLease, eventTypeDiscover},
+	}, {
+		filter:    &eventFilter{until: start.Add(-time.Second), limit: 10},
+		name:      "until",
+		wantTypes: nil,
+	}, {
+		filter:    &eventFilter{since: start.Add(-time.Second), limit: 10},
+		name:      "since",
+		wantTypes: []eventType{eventTypeConflict, eventTypeRenew, eventTypeLease, eventTypeDiscover},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			events, err := l.find(tc.filter)
+			require.NoError(t, err)
+
+			var types []eventType
+			for _, e := range events {
+				types = append(types, e.Type)
+			}
+
+			assert.Equal(t, tc.wantTypes, types)
+		})
+	}
+
+	t.Run("fields", func(t *testing.T) {
+		events, err := l.find(&eventFilter{hwAddr: mac1.String(), limit: 1})
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+
+		e := events[0]
+		assert.Equal(t, mac1.String(), e.HWAddr)
+		assert.Equal(t, netip.MustParseAddr("192.168.0.10"), e.IP)
+		assert.Equal(t, "host", e.Hostname)
+	})
+}
+
+func TestEventLog_rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), eventsFilename)
+
+	l := newEventLog(path)
+	l.maxSize = 1
+
+	l.add(newEvent(eventTypeLease, nil, nil, "first"))
+	l.add(newEvent(eventTypeLease, nil, nil, "second"))
+	l.add(newEvent(eventTypeLease, nil, nil, "third"))
+
+	// Only the last rotated file is kept.
+	_, err := os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	events, err := l.find(&eventFilter{limit: 10})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	assert.Equal(t, "third", events[0].Hostname)
+}
+
+func TestEventLog_nil(t *testing.T) {
+	var l *eventLog
+
+	assert.NotPanics(t, func() {
+		l.add(newEvent(eventTypeLease, nil, nil, ""))
+	})
+
+	events, err := l.find(&eventFilter{limit: 10})
+	require.NoError(t, err)
+
+	assert.Empty(t, events)
+}
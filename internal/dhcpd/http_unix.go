@@ -8,7 +8,10 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
@@ -18,11 +21,24 @@ import (
 )
 
 type v4ServerConfJSON struct {
-	GatewayIP     netip.Addr `json:"gateway_ip"`
-	SubnetMask    netip.Addr `json:"subnet_mask"`
-	RangeStart    netip.Addr `json:"range_start"`
-	RangeEnd      netip.Addr `json:"range_end"`
-	LeaseDuration uint32     `json:"lease_duration"`
+	GatewayIP  netip.Addr `json:"gateway_ip"`
+	SubnetMask netip.Addr `json:"subnet_mask"`
+	RangeStart netip.Addr `json:"range_start"`
+	RangeEnd   netip.Addr `json:"range_end"`
+
+	// OptionTemplates are the conditional options.  If nil, the current ones
+	// are kept.
+	OptionTemplates []*V4OptionTemplate `json:"option_templates"`
+
+	// Netboot is the configuration of the network boot.  If nil, the current
+	// one is kept.
+	Netboot *V4NetbootConf `json:"netboot"`
+
+	// IPv6OnlyPreferred is the configuration of the IPv6-Only Preferred
+	// option.  If nil, the current one is kept.
+	IPv6OnlyPreferred *V4IPv6OnlyConf `json:"ipv6_only_preferred"`
+
+	LeaseDuration uint32 `json:"lease_duration"`
 }
 
 func (j *v4ServerConfJSON) toServerConf() *V4ServerConf {
@@ -31,11 +47,14 @@ func (j *v4ServerConfJSON) toServerConf() *V4ServerConf {
 	}
 
 	return &V4ServerConf{
-		GatewayIP:     j.GatewayIP,
-		SubnetMask:    j.SubnetMask,
-		RangeStart:    j.RangeStart,
-		RangeEnd:      j.RangeEnd,
-		LeaseDuration: j.LeaseDuration,
+		GatewayIP:         j.GatewayIP,
+		SubnetMask:        j.SubnetMask,
+		RangeStart:        j.RangeStart,
+		RangeEnd:          j.RangeEnd,
+		LeaseDuration:     j.LeaseDuration,
+		OptionTemplates:   j.OptionTemplates,
+		Netboot:           j.Netboot,
+		IPv6OnlyPreferred: j.IPv6OnlyPreferred,
 	}
 }
 
@@ -63,6 +82,10 @@ type dhcpStatusResponse struct {
 	Leases       []*Lease     `json:"leases"`
 	StaticLeases []*Lease     `json:"static_leases"`
 	Enabled      bool         `json:"enabled"`
+
+	// V4Counters are the numbers of the DHCPv4 messages handled since the
+	// start of the server.
+	V4Counters *msgCountersJSON `json:"v4_counters"`
 }
 
 func (s *server) handleDHCPStatus(w http.ResponseWriter, r *http.Request) {
@@ -71,6 +94,8 @@ func (s *server) handleDHCPStatus(w http.ResponseWriter, r *http.Request) {
 		IfaceName: s.conf.InterfaceName,
 		V4:        V4ServerConf{},
 		V6:        V6ServerConf{},
+
+		V4Counters: s.counters.toJSON(),
 	}
 
 	s.srv4.WriteDiskConfig4(&status.V4)
@@ -78,10 +103,24 @@ func (s *server) handleDHCPStatus(w http.ResponseWriter, r *http.Request) {
 
 	status.Leases = s.Leases(LeasesDynamic)
 	status.StaticLeases = s.Leases(LeasesStatic)
+	s.setVendors(status.Leases)
+	s.setVendors(status.StaticLeases)
 
 	_ = aghhttp.WriteJSONResponse(w, r, status)
 }
 
+// setVendors sets the vendors of the hardware addresses of leases, if the
+// vendor lookup is configured.
+func (s *server) setVendors(leases []*Lease) {
+	if s.conf.VendorByMAC == nil {
+		return
+	}
+
+	for _, l := range leases {
+		l.Vendor = s.conf.VendorByMAC(l.HWAddr)
+	}
+}
+
 func (s *server) enableDHCP(ifaceName string) (code int, err error) {
 	var hasStaticIP bool
 	hasStaticIP, err = aghnet.IfaceHasStaticIP(ifaceName)
@@ -153,15 +192,33 @@ func (s *server) handleDHCPSetConfigV4(
 
 	// Set the default values for the fields not configurable via web API.
 	c4 := &V4ServerConf{
-		notify:      s.onNotify,
-		ICMPTimeout: s.conf.Conf4.ICMPTimeout,
-		Options:     s.conf.Conf4.Options,
+		notify:            s.onNotify,
+		ICMPTimeout:       s.conf.Conf4.ICMPTimeout,
+		ICMPSkip:          s.conf.Conf4.ICMPSkip,
+		ARPProbeTimeout:   s.conf.Conf4.ARPProbeTimeout,
+		Options:           s.conf.Conf4.Options,
+		OptionTemplates:   s.conf.Conf4.OptionTemplates,
+		Netboot:           s.conf.Conf4.Netboot,
+		IPv6OnlyPreferred: s.conf.Conf4.IPv6OnlyPreferred,
 	}
 
 	s.srv4.WriteDiskConfig4(c4)
 	v4Conf.notify = c4.notify
 	v4Conf.ICMPTimeout = c4.ICMPTimeout
+	v4Conf.ICMPSkip = c4.ICMPSkip
+	v4Conf.ARPProbeTimeout = c4.ARPProbeTimeout
 	v4Conf.Options = c4.Options
+	if v4Conf.OptionTemplates == nil {
+		v4Conf.OptionTemplates = c4.OptionTemplates
+	}
+
+	if v4Conf.Netboot == nil {
+		v4Conf.Netboot = c4.Netboot
+	}
+
+	if v4Conf.IPv6OnlyPreferred == nil {
+		v4Conf.IPv6OnlyPreferred = c4.IPv6OnlyPreferred
+	}
 
 	srv4, err := v4Create(v4Conf)
 
@@ -209,6 +266,12 @@ func (s *server) handleDHCPSetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.setConfig(w, r, conf)
+}
+
+// setConfig validates conf, applies it, and restarts the DHCP server.  Any
+// errors are written to w.
+func (s *server) setConfig(w http.ResponseWriter, r *http.Request, conf *dhcpServerConfigJSON) {
 	srv4, v4Enabled, err := s.handleDHCPSetConfigV4(conf)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "bad dhcpv4 configuration: %s", err)
@@ -255,6 +318,102 @@ func (s *server) handleDHCPSetConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// configJSON returns the JSON representation of the current configuration of
+// the DHCP server.
+func (s *server) configJSON() (conf *dhcpServerConfigJSON) {
+	c4 := &V4ServerConf{}
+	s.srv4.WriteDiskConfig4(c4)
+
+	c6 := &V6ServerConf{}
+	s.srv6.WriteDiskConfig6(c6)
+
+	v6Start, _ := netip.AddrFromSlice(c6.RangeStart)
+
+	return &dhcpServerConfigJSON{
+		V4: &v4ServerConfJSON{
+			GatewayIP:         c4.GatewayIP,
+			SubnetMask:        c4.SubnetMask,
+			RangeStart:        c4.RangeStart,
+			RangeEnd:          c4.RangeEnd,
+			OptionTemplates:   c4.OptionTemplates,
+			Netboot:           c4.Netboot,
+			IPv6OnlyPreferred: c4.IPv6OnlyPreferred,
+			LeaseDuration:     c4.LeaseDuration,
+		},
+		V6: &v6ServerConfJSON{
+			RangeStart:    v6Start,
+			LeaseDuration: c6.LeaseDuration,
+		},
+		InterfaceName: s.conf.InterfaceName,
+		Enabled:       aghalg.BoolToNullBool(s.conf.Enabled),
+	}
+}
+
+// handleDHCPConfig is the handler for the GET /control/dhcp/config HTTP API.
+// Unlike the GET /control/dhcp/status one, it only returns the configuration
+// of the server.
+func (s *server) handleDHCPConfig(w http.ResponseWriter, r *http.Request) {
+	conf := s.configJSON()
+
+	err := aghhttp.SetETag(w, r, conf)
+	if err != nil {
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, conf)
+}
+
+// handleDHCPReplaceConfig is the handler for the PUT
+// /control/dhcp/config/replace HTTP API.  Unlike the POST
+// /control/dhcp/set_config one, it replaces the whole configuration, so the
+// omitted protocols are disabled and the omitted option templates and network
+// boot settings are removed.  The request is rejected if its If-Match header
+// doesn't match the entity tag of the current configuration, see
+// [server.handleDHCPConfig].
+func (s *server) handleDHCPReplaceConfig(w http.ResponseWriter, r *http.Request) {
+	conf := &dhcpServerConfigJSON{}
+	err := json.NewDecoder(r.Body).Decode(conf)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to parse new dhcp config json: %s", err)
+
+		return
+	}
+
+	if conf.Enabled == aghalg.NBNull {
+		aghhttp.Error(r, w, http.StatusBadRequest, "enabled is required")
+
+		return
+	}
+
+	if conf.V4 == nil {
+		conf.V4 = &v4ServerConfJSON{}
+	}
+
+	if conf.V4.OptionTemplates == nil {
+		conf.V4.OptionTemplates = []*V4OptionTemplate{}
+	}
+
+	if conf.V4.Netboot == nil {
+		conf.V4.Netboot = &V4NetbootConf{}
+	}
+
+	if conf.V4.IPv6OnlyPreferred == nil {
+		conf.V4.IPv6OnlyPreferred = &V4IPv6OnlyConf{}
+	}
+
+	if conf.V6 == nil {
+		conf.V6 = &v6ServerConfJSON{}
+	}
+
+	// The modifying HTTP APIs are serialized by the control lock, so the
+	// configuration can't be changed between the check and the replacement.
+	if !aghhttp.CheckIfMatch(w, r, s.configJSON()) {
+		return
+	}
+
+	s.setConfig(w, r, conf)
+}
+
 // setConfFromJSON sets configuration parameters in s from the new configuration
 // decoded from JSON.
 func (s *server) setConfFromJSON(conf *dhcpServerConfigJSON, srv4, srv6 DHCPServer) {
@@ -503,9 +662,9 @@ func (s *server) handleDHCPAddStaticLease(w http.ResponseWriter, r *http.Request
 	}
 
 	var srv DHCPServer
-	if ip4 := l.IP.To4(); ip4 != nil {
-		l.IP = ip4
-		srv = s.srv4
+	if ip, ok := ipToAddr4(l.IP); ok {
+		l.IP = l.IP.To4()
+		srv = s.v4ServerFor(ip)
 	} else {
 		l.IP = l.IP.To16()
 		srv = s.srv6
@@ -548,7 +707,8 @@ func (s *server) handleDHCPRemoveStaticLease(w http.ResponseWriter, r *http.Requ
 	}
 
 	l.IP = ip4
-	err = s.srv4.RemoveStaticLease(l)
+	ip, _ := ipToAddr4(ip4)
+	err = s.v4ServerFor(ip).RemoveStaticLease(l)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
 
@@ -564,6 +724,8 @@ func (s *server) handleReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.setScopes4(nil)
+
 	err = os.Remove(s.conf.DBFilePath)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		log.Error("dhcp: removing db: %s", err)
@@ -573,6 +735,7 @@ func (s *server) handleReset(w http.ResponseWriter, r *http.Request) {
 		ConfigModified: s.conf.ConfigModified,
 
 		HTTPRegister: s.conf.HTTPRegister,
+		VendorByMAC:  s.conf.VendorByMAC,
 
 		LocalDomainName: s.conf.LocalDomainName,
 
@@ -606,6 +769,267 @@ func (s *server) handleResetLeases(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+const (
+	// defaultEventsLimit is the default maximum number of the DHCP events
+	// returned by the GET /control/dhcp/events HTTP API.
+	defaultEventsLimit = 100
+
+	// maxEventsLimit is the maximum number of the DHCP events returned by the
+	// GET /control/dhcp/events HTTP API.
+	maxEventsLimit = 1000
+)
+
+// eventsResp is the response to the GET /control/dhcp/events HTTP API.
+type eventsResp struct {
+	Events []*event `json:"events"`
+}
+
+// parseEventFilter parses the DHCP events filter from the URL query of the
+// request.
+func parseEventFilter(q url.Values) (f *eventFilter, err error) {
+	f = &eventFilter{
+		limit: defaultEventsLimit,
+	}
+
+	if macStr := q.Get("mac"); macStr != "" {
+		var mac net.HardwareAddr
+		mac, err = net.ParseMAC(macStr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing mac: %w", err)
+		}
+
+		f.hwAddr = mac.String()
+	}
+
+	for _, p := range []struct {
+		t    *time.Time
+		name string
+	}{{
+		t:    &f.since,
+		name: "since",
+	}, {
+		t:    &f.until,
+		name: "until",
+	}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+
+		*p.t, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", p.name, err)
+		}
+	}
+
+	if limStr := q.Get("limit"); limStr != "" {
+		f.limit, err = strconv.Atoi(limStr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing limit: %w", err)
+		} else if f.limit <= 0 || f.limit > maxEventsLimit {
+			return nil, fmt.Errorf("limit: %d out of range [1, %d]", f.limit, maxEventsLimit)
+		}
+	}
+
+	return f, nil
+}
+
+// handleDHCPEvents is the handler for the GET /control/dhcp/events HTTP API.
+func (s *server) handleDHCPEvents(w http.ResponseWriter, r *http.Request) {
+	f, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	events, err := s.events.find(f)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "finding events: %s", err)
+
+		return
+	}
+
+	if events == nil {
+		events = []*event{}
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, &eventsResp{Events: events})
+}
+
+// v4ScopeJSON is the JSON representation of an additional DHCPv4 scope.
+type v4ScopeJSON struct {
+	GatewayIP  netip.Addr `json:"gateway_ip"`
+	SubnetMask netip.Addr `json:"subnet_mask"`
+	RangeStart netip.Addr `json:"range_start"`
+	RangeEnd   netip.Addr `json:"range_end"`
+
+	OptionTemplates   []*V4OptionTemplate `json:"option_templates"`
+	Netboot           *V4NetbootConf      `json:"netboot"`
+	IPv6OnlyPreferred *V4IPv6OnlyConf     `json:"ipv6_only_preferred"`
+
+	// ICMPTimeout is the time in milliseconds to wait for the reply to the
+	// ICMP echo request sent before offering an address.  If it's nil, the
+	// previous value is kept.
+	ICMPTimeout *uint32 `json:"icmp_timeout_msec"`
+
+	Name          string   `json:"name"`
+	InterfaceName string   `json:"interface_name"`
+	Options       []string `json:"options"`
+
+	// ICMPSkip are the IP addresses and the CIDRs of the addresses offered
+	// without the ICMP echo request.  If it's nil, the previous value is
+	// kept.
+	ICMPSkip []string `json:"icmp_skip"`
+
+	LeaseDuration uint32 `json:"lease_duration"`
+	Enabled       bool   `json:"enabled"`
+}
+
+// newV4ScopeJSON returns the JSON representation of the scope configuration.
+func newV4ScopeJSON(c *V4ScopeConf) (j *v4ScopeJSON) {
+	icmpTimeout := c.ICMPTimeout
+
+	return &v4ScopeJSON{
+		GatewayIP:         c.GatewayIP,
+		SubnetMask:        c.SubnetMask,
+		RangeStart:        c.RangeStart,
+		RangeEnd:          c.RangeEnd,
+		OptionTemplates:   c.OptionTemplates,
+		Netboot:           c.Netboot,
+		IPv6OnlyPreferred: c.IPv6OnlyPreferred,
+		ICMPTimeout:       &icmpTimeout,
+		Name:              c.Name,
+		InterfaceName:     c.InterfaceName,
+		Options:           c.Options,
+		ICMPSkip:          c.ICMPSkip,
+		LeaseDuration:     c.LeaseDuration,
+		Enabled:           c.Enabled,
+	}
+}
+
+// toScopeConf returns the scope configuration.  The fields not configurable
+// via web API are copied from prev, which may be nil.
+func (j *v4ScopeJSON) toScopeConf(prev *V4ServerConf) (c *V4ScopeConf) {
+	icmpTimeout := prev.ICMPTimeout
+	if j.ICMPTimeout != nil {
+		icmpTimeout = *j.ICMPTimeout
+	}
+
+	icmpSkip := prev.ICMPSkip
+	if j.ICMPSkip != nil {
+		icmpSkip = j.ICMPSkip
+	}
+
+	return &V4ScopeConf{
+		Name:          j.Name,
+		InterfaceName: j.InterfaceName,
+		Enabled:       j.Enabled,
+		V4ServerConf: V4ServerConf{
+			GatewayIP:         j.GatewayIP,
+			SubnetMask:        j.SubnetMask,
+			RangeStart:        j.RangeStart,
+			RangeEnd:          j.RangeEnd,
+			LeaseDuration:     j.LeaseDuration,
+			ICMPTimeout:       icmpTimeout,
+			ICMPSkip:          icmpSkip,
+			ARPProbeTimeout:   prev.ARPProbeTimeout,
+			Options:           j.Options,
+			OptionTemplates:   j.OptionTemplates,
+			Netboot:           j.Netboot,
+			IPv6OnlyPreferred: j.IPv6OnlyPreferred,
+		},
+	}
+}
+
+// v4ScopesJSON is the response for the GET /control/dhcp/v4/scopes HTTP API
+// and the request for the POST /control/dhcp/v4/set_scopes one.
+type v4ScopesJSON struct {
+	Scopes []*v4ScopeJSON `json:"scopes"`
+}
+
+// handleDHCPScopesV4 is the handler for the GET /control/dhcp/v4/scopes HTTP
+// API.
+func (s *server) handleDHCPScopesV4(w http.ResponseWriter, r *http.Request) {
+	resp := s.scopesJSON4()
+
+	err := aghhttp.SetETag(w, r, resp)
+	if err != nil {
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// scopesJSON4 returns the JSON representation of the current additional DHCPv4
+// scopes.
+func (s *server) scopesJSON4() (resp *v4ScopesJSON) {
+	resp = &v4ScopesJSON{
+		Scopes: []*v4ScopeJSON{},
+	}
+
+	for _, sc := range s.scopes4() {
+		resp.Scopes = append(resp.Scopes, newV4ScopeJSON(sc.conf))
+	}
+
+	return resp
+}
+
+// handleDHCPSetScopesV4 is the handler for the POST
+// /control/dhcp/v4/set_scopes HTTP API.  It replaces all the additional DHCPv4 scopes.
+// The request is rejected if its If-Match header doesn't match the entity tag
+// of the current scopes, see [server.handleDHCPScopesV4].
+func (s *server) handleDHCPSetScopesV4(w http.ResponseWriter, r *http.Request) {
+	req := &v4ScopesJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	// The modifying HTTP APIs are serialized by the control lock, so the
+	// scopes can't be changed between the check and the replacement.
+	if !aghhttp.CheckIfMatch(w, r, s.scopesJSON4()) {
+		return
+	}
+
+	prev := map[string]*V4ServerConf{}
+	for _, sc := range s.scopes4() {
+		prev[sc.conf.Name] = &sc.conf.V4ServerConf
+	}
+
+	confs := make([]*V4ScopeConf, 0, len(req.Scopes))
+	for i, j := range req.Scopes {
+		if j == nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "scope at index %d: %s", i, errNilConfig)
+
+			return
+		}
+
+		p, ok := prev[j.Name]
+		if !ok {
+			p = &s.conf.Conf4
+		}
+
+		confs = append(confs, j.toScopeConf(p))
+	}
+
+	scopes, err := s.newScopes4(confs, s.conf.InterfaceName)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad dhcpv4 scopes: %s", err)
+
+		return
+	}
+
+	err = s.replaceScopes4(scopes)
+	s.conf.Scopes4 = confs
+	s.conf.ConfigModified()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "replacing dhcpv4 scopes: %s", err)
+	}
+}
+
 func (s *server) registerHandlers() {
 	if s.conf.HTTPRegister == nil {
 		return
@@ -614,9 +1038,14 @@ func (s *server) registerHandlers() {
 	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/status", s.handleDHCPStatus)
 	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/interfaces", s.handleDHCPInterfaces)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/set_config", s.handleDHCPSetConfig)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/config", s.handleDHCPConfig)
+	s.conf.HTTPRegister(http.MethodPut, "/control/dhcp/config/replace", s.handleDHCPReplaceConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/find_active_dhcp", s.handleDHCPFindActiveServer)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/add_static_lease", s.handleDHCPAddStaticLease)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/remove_static_lease", s.handleDHCPRemoveStaticLease)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/reset", s.handleReset)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/reset_leases", s.handleResetLeases)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/events", s.handleDHCPEvents)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/v4/scopes", s.handleDHCPScopesV4)
+	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/v4/set_scopes", s.handleDHCPSetScopesV4)
 }
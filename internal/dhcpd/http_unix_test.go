@@ -0,0 +1,419 @@
+//go:build darwin || freebsd || linux || openbsd
+
+package dhcpd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_handleDHCPEvents(t *testing.T) {
+	mac := net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA}
+
+	s := &server{
+		events: newEventLog(filepath.Join(t.TempDir(), eventsFilename)),
+	}
+	s.events.add(newEvent(eventTypeDiscover, mac, nil, ""))
+	s.events.add(newEvent(eventTypeLease, mac, net.IP{192, 168, 0, 10}, ""))
+	s.events.add(newEvent(eventTypeDiscover, net.HardwareAddr{1, 2, 3, 4, 5, 6}, nil, ""))
+
+	testCases := []struct {
+		name       string
+		query      string
+		wantErrMsg string
+		wantLen    int
+	}{{
+		name:       "all",
+		query:      "",
+		wantErrMsg: "",
+		wantLen:    3,
+	}, {
+		name:       "mac",
+		query:      "?mac=AA:AA:AA:AA:AA:AA",
+		wantErrMsg: "",
+		wantLen:    2,
+	}, {
+		name:       "limit",
+		query:      "?limit=1",
+		wantErrMsg: "",
+		wantLen:    1,
+	}, {
+		name:       "since",
+		query:      "?since=2100-01-01T00:00:00Z",
+		wantErrMsg: "",
+		wantLen:    0,
+	}, {
+		name:       "bad_mac",
+		query:      "?mac=bad",
+		wantErrMsg: "parsing mac: address bad: invalid MAC address\n",
+		wantLen:    0,
+	}, {
+		name:  "bad_time",
+		query: "?until=yesterday",
+		wantErrMsg: `parsing until: parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": ` +
+			`cannot parse "yesterday" as "2006"` + "\n",
+		wantLen: 0,
+	}, {
+		name:       "bad_limit",
+		query:      "?limit=0",
+		wantErrMsg: "limit: 0 out of range [1, 1000]\n",
+		wantLen:    0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/control/dhcp/events"+tc.query, nil)
+			w := httptest.NewRecorder()
+
+			s.handleDHCPEvents(w, r)
+			if tc.wantErrMsg != "" {
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				assert.Equal(t, tc.wantErrMsg, w.Body.String())
+
+				return
+			}
+
+			require.Equal(t, http.StatusOK, w.Code)
+
+			resp := &eventsResp{}
+			err := json.NewDecoder(w.Body).Decode(resp)
+			require.NoError(t, err)
+
+			assert.Len(t, resp.Events, tc.wantLen)
+		})
+	}
+}
+
+func TestServer_handleDHCPSetScopesV4(t *testing.T) {
+	s := &server{
+		conf: &ServerConfig{
+			ConfigModified: func() {},
+			InterfaceName:  "eth0",
+			DBFilePath:     filepath.Join(t.TempDir(), dbFilename),
+		},
+	}
+
+	var err error
+	s.srv4, err = v4Create(&V4ServerConf{
+		Enabled:    true,
+		RangeStart: netip.MustParseAddr("192.168.10.100"),
+		RangeEnd:   netip.MustParseAddr("192.168.10.200"),
+		GatewayIP:  netip.MustParseAddr("192.168.10.1"),
+		SubnetMask: netip.MustParseAddr("255.255.255.0"),
+		notify:     s.onNotify,
+	})
+	require.NoError(t, err)
+
+	s.srv6, err = v6Create(V6ServerConf{})
+	require.NoError(t, err)
+
+	newScope := func(name, iface, subnet string) (j *v4ScopeJSON) {
+		icmpTimeout := uint32(500)
+
+		return &v4ScopeJSON{
+			GatewayIP:     netip.MustParseAddr(subnet + ".1"),
+			SubnetMask:    netip.MustParseAddr("255.255.255.0"),
+			RangeStart:    netip.MustParseAddr(subnet + ".100"),
+			RangeEnd:      netip.MustParseAddr(subnet + ".200"),
+			ICMPTimeout:   &icmpTimeout,
+			Name:          name,
+			InterfaceName: iface,
+			ICMPSkip:      []string{subnet + ".128/28"},
+			LeaseDuration: 3600,
+			Enabled:       true,
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		scopes     []*v4ScopeJSON
+	}{{
+		name:       "duplicate_name",
+		wantErrMsg: `bad dhcpv4 scopes: scope "guest": duplicate name` + "\n",
+		scopes: []*v4ScopeJSON{
+			newScope("guest", "eth1", "192.168.20"),
+			newScope("guest", "eth2", "192.168.30"),
+		},
+	}, {
+		name: "main_interface",
+		wantErrMsg: `bad dhcpv4 scopes: scope "guest": ` +
+			`interface "eth0" is used by the main server` + "\n",
+		scopes: []*v4ScopeJSON{
+			newScope("guest", "eth0", "192.168.20"),
+		},
+	}, {
+		name: "same_interface",
+		wantErrMsg: `bad dhcpv4 scopes: scope "iot": ` +
+			`interface "eth1" is used by another scope` + "\n",
+		scopes: []*v4ScopeJSON{
+			newScope("guest", "eth1", "192.168.20"),
+			newScope("iot", "eth1", "192.168.30"),
+		},
+	}, {
+		name: "overlap",
+		wantErrMsg: `bad dhcpv4 scopes: scope "iot": subnet 192.168.20.1/24 ` +
+			`overlaps with subnet 192.168.20.1/24 of scope "guest"` + "\n",
+		scopes: []*v4ScopeJSON{
+			newScope("guest", "eth1", "192.168.20"),
+			newScope("iot", "eth2", "192.168.20"),
+		},
+	}, {
+		name: "bad_range",
+		wantErrMsg: `bad dhcpv4 scopes: scope "guest": dhcpv4: ` +
+			`range start 192.168.20.100 is outside network 192.168.30.1/24` + "\n",
+		scopes: []*v4ScopeJSON{{
+			GatewayIP:     netip.MustParseAddr("192.168.30.1"),
+			SubnetMask:    netip.MustParseAddr("255.255.255.0"),
+			RangeStart:    netip.MustParseAddr("192.168.20.100"),
+			RangeEnd:      netip.MustParseAddr("192.168.20.200"),
+			Name:          "guest",
+			InterfaceName: "eth1",
+		}},
+	}, {
+		name:       "success",
+		wantErrMsg: "",
+		scopes: []*v4ScopeJSON{
+			newScope("guest", "eth1", "192.168.20"),
+			newScope("iot", "eth2", "192.168.30"),
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, jerr := json.Marshal(&v4ScopesJSON{Scopes: tc.scopes})
+			require.NoError(t, jerr)
+
+			r := httptest.NewRequest(http.MethodPost, "/control/dhcp/v4/set_scopes", bytes.NewReader(b))
+			w := httptest.NewRecorder()
+
+			s.handleDHCPSetScopesV4(w, r)
+			if tc.wantErrMsg != "" {
+				assert.Equal(t, http.StatusBadRequest, w.Code)
+				assert.Equal(t, tc.wantErrMsg, w.Body.String())
+
+				return
+			}
+
+			require.Equal(t, http.StatusOK, w.Code)
+
+			r = httptest.NewRequest(http.MethodGet, "/control/dhcp/v4/scopes", nil)
+			w = httptest.NewRecorder()
+
+			s.handleDHCPScopesV4(w, r)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			resp := &v4ScopesJSON{}
+			jerr = json.NewDecoder(w.Body).Decode(resp)
+			require.NoError(t, jerr)
+
+			assert.Equal(t, tc.scopes, resp.Scopes)
+		})
+	}
+
+	l := &Lease{
+		Hostname: "guest-host",
+		HWAddr:   net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA},
+		IP:       net.IP{192, 168, 20, 50},
+	}
+
+	require.NoError(t, s.AddStaticLease(l))
+
+	scopes := s.scopes4()
+	require.Len(t, scopes, 2)
+
+	assert.Empty(t, s.srv4.GetLeases(LeasesAll))
+	assert.Len(t, scopes[0].srv.GetLeases(LeasesAll), 1)
+	assert.Equal(t, l.HWAddr, s.FindMACbyIP(netip.MustParseAddr("192.168.20.50")))
+
+	// Make sure the leases are loaded back into the scopes containing them.
+	require.NoError(t, s.resetLeases4(nil))
+	require.NoError(t, s.dbLoad())
+
+	assert.Empty(t, s.srv4.GetLeases(LeasesAll))
+	assert.Len(t, scopes[0].srv.GetLeases(LeasesAll), 1)
+	assert.Len(t, s.Leases(LeasesStatic), 1)
+}
+
+func TestServer_handleDHCPReplaceConfig(t *testing.T) {
+	s := &server{
+		conf: &ServerConfig{
+			ConfigModified: func() {},
+			InterfaceName:  "eth0",
+			DBFilePath:     filepath.Join(t.TempDir(), dbFilename),
+		},
+	}
+
+	var err error
+	s.srv4, err = v4Create(&V4ServerConf{
+		Enabled:       true,
+		RangeStart:    netip.MustParseAddr("192.168.10.100"),
+		RangeEnd:      netip.MustParseAddr("192.168.10.200"),
+		GatewayIP:     netip.MustParseAddr("192.168.10.1"),
+		SubnetMask:    netip.MustParseAddr("255.255.255.0"),
+		LeaseDuration: 3600,
+		notify:        s.onNotify,
+	})
+	require.NoError(t, err)
+
+	s.srv6, err = v6Create(V6ServerConf{})
+	require.NoError(t, err)
+
+	getConfig := func(t *testing.T) (conf *dhcpServerConfigJSON, etag string) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "/control/dhcp/config", nil)
+		w := httptest.NewRecorder()
+
+		s.handleDHCPConfig(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		conf = &dhcpServerConfigJSON{}
+		err = json.NewDecoder(w.Body).Decode(conf)
+		require.NoError(t, err)
+
+		return conf, w.Header().Get(aghhttp.HdrNameETag)
+	}
+
+	conf, etag := getConfig(t)
+	require.NotEmpty(t, etag)
+
+	assert.Equal(t, netip.MustParseAddr("192.168.10.1"), conf.V4.GatewayIP)
+
+	const body = `{"enabled":false,"interface_name":"eth0","v4":{` +
+		`"gateway_ip":"192.168.30.1","subnet_mask":"255.255.255.0",` +
+		`"range_start":"192.168.30.100","range_end":"192.168.30.200",` +
+		`"lease_duration":3600}}`
+
+	testCases := []struct {
+		name     string
+		body     string
+		ifMatch  string
+		wantCode int
+	}{{
+		name:     "no_enabled",
+		body:     `{"interface_name":"eth0"}`,
+		ifMatch:  etag,
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "success",
+		body:     body,
+		ifMatch:  etag,
+		wantCode: http.StatusOK,
+	}, {
+		// The entity tag is outdated after the previous replacement.
+		name:     "modified",
+		body:     body,
+		ifMatch:  etag,
+		wantCode: http.StatusPreconditionFailed,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/control/dhcp/config/replace", strings.NewReader(tc.body))
+			r.Header.Set(aghhttp.HdrNameIfMatch, tc.ifMatch)
+			w := httptest.NewRecorder()
+
+			s.handleDHCPReplaceConfig(w, r)
+			assert.Equal(t, tc.wantCode, w.Code)
+		})
+	}
+
+	newConf, newETag := getConfig(t)
+	assert.NotEqual(t, etag, newETag)
+
+	assert.Equal(t, netip.MustParseAddr("192.168.30.1"), newConf.V4.GatewayIP)
+	assert.Empty(t, newConf.V4.OptionTemplates)
+	assert.False(t, newConf.V6.RangeStart.IsValid())
+
+	// Make sure that replacing the configuration with the same one doesn't
+	// change it.
+	b, err := json.Marshal(newConf)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPut, "/control/dhcp/config/replace", bytes.NewReader(b))
+	r.Header.Set(aghhttp.HdrNameIfMatch, newETag)
+	w := httptest.NewRecorder()
+
+	s.handleDHCPReplaceConfig(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	_, etag = getConfig(t)
+	assert.Equal(t, newETag, etag)
+}
+
+func TestServer_handleDHCPStatus_vendor(t *testing.T) {
+	const vendor = "Espressif Inc."
+
+	mac := net.HardwareAddr{0xA8, 0x03, 0x2A, 0x01, 0x02, 0x03}
+	s := &server{
+		conf: &ServerConfig{
+			DBFilePath: filepath.Join(t.TempDir(), dbFilename),
+			VendorByMAC: func(m net.HardwareAddr) (v string) {
+				if bytes.Equal(m, mac) {
+					return vendor
+				}
+
+				return ""
+			},
+		},
+		counters: &msgCounters{},
+	}
+
+	var err error
+	s.srv4, err = v4Create(&V4ServerConf{
+		Enabled:    true,
+		RangeStart: netip.MustParseAddr("192.168.10.100"),
+		RangeEnd:   netip.MustParseAddr("192.168.10.200"),
+		GatewayIP:  netip.MustParseAddr("192.168.10.1"),
+		SubnetMask: netip.MustParseAddr("255.255.255.0"),
+		notify:     s.onNotify,
+	})
+	require.NoError(t, err)
+
+	s.srv6, err = v6Create(V6ServerConf{})
+	require.NoError(t, err)
+
+	// The vendor from the request must be ignored.
+	l := &Lease{}
+	err = json.Unmarshal([]byte(`{
+		"mac": "a8:03:2a:01:02:03",
+		"ip": "192.168.10.150",
+		"hostname": "sensor",
+		"vendor": "Forged"
+	}`), l)
+	require.NoError(t, err)
+
+	assert.Empty(t, l.Vendor)
+
+	err = s.srv4.AddStaticLease(l)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/control/dhcp/status", nil)
+	w := httptest.NewRecorder()
+	s.handleDHCPStatus(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Don't decode the leases into [Lease], since it ignores the vendor.
+	resp := &struct {
+		StaticLeases []struct {
+			Vendor string `json:"vendor"`
+		} `json:"static_leases"`
+	}{}
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+	require.Len(t, resp.StaticLeases, 1)
+
+	assert.Equal(t, vendor, resp.StaticLeases[0].Vendor)
+}
@@ -40,9 +40,14 @@ func (s *server) registerHandlers() {
 	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/status", s.notImplemented)
 	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/interfaces", s.notImplemented)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/set_config", s.notImplemented)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/config", s.notImplemented)
+	s.conf.HTTPRegister(http.MethodPut, "/control/dhcp/config/replace", s.notImplemented)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/find_active_dhcp", s.notImplemented)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/add_static_lease", s.notImplemented)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/remove_static_lease", s.notImplemented)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/reset", s.notImplemented)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/reset_leases", s.notImplemented)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/events", s.notImplemented)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dhcp/v4/scopes", s.notImplemented)
+	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/v4/set_scopes", s.notImplemented)
 }
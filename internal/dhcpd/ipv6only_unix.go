@@ -0,0 +1,62 @@
+//go:build darwin || freebsd || linux || openbsd
+
+package dhcpd
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// optionIPv6OnlyPreferred is the code of the IPv6-Only Preferred option.  See
+// RFC 8925.
+const optionIPv6OnlyPreferred dhcpv4.GenericOptionCode = 108
+
+// ipv6OnlyWait returns the V6ONLY_WAIT value to send to the client of req.  ok
+// is false if the client didn't request the IPv6-Only Preferred option or it's
+// disabled.
+func (s *v4Server) ipv6OnlyWait(req *dhcpv4.DHCPv4) (wait uint32, ok bool) {
+	c := s.conf.IPv6OnlyPreferred
+	if c == nil || !c.Enabled || !isIPv6OnlyRequested(req) {
+		return 0, false
+	}
+
+	if c.WaitTime == 0 {
+		return DefaultIPv6OnlyWait, true
+	}
+
+	return c.WaitTime, true
+}
+
+// isIPv6OnlyRequested returns true if the client of req lists the IPv6-Only
+// Preferred option in its parameter request list.
+func isIPv6OnlyRequested(req *dhcpv4.DHCPv4) (ok bool) {
+	// Don't use [dhcpv4.OptionCodeList.Has], since it compares the codes as
+	// interface values, and the parsed ones have an unexported type.
+	for _, code := range req.ParameterRequestList() {
+		if code.Code() == optionIPv6OnlyPreferred.Code() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// optIPv6OnlyPreferred returns the IPv6-Only Preferred option with the
+// V6ONLY_WAIT value wait.
+func optIPv6OnlyPreferred(wait uint32) (opt dhcpv4.Option) {
+	return dhcpv4.OptGeneric(optionIPv6OnlyPreferred, binary.BigEndian.AppendUint32(nil, wait))
+}
+
+// handleDiscoverIPv6Only handles the DHCPDISCOVER from an IPv6-only capable
+// client by offering it no address and telling it to disable IPv4 for wait
+// seconds.  See RFC 8925, section 3.3.
+func (s *v4Server) handleDiscoverIPv6Only(req, resp *dhcpv4.DHCPv4, wait uint32) {
+	log.Debug("dhcpv4: %s prefers ipv6-only, offering no address", req.ClientHWAddr)
+
+	resp.YourIPAddr = net.IP{0, 0, 0, 0}
+	resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	resp.UpdateOption(optIPv6OnlyPreferred(wait))
+}
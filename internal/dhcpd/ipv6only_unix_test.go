@@ -0,0 +1,166 @@
+//go:build darwin || freebsd || linux || openbsd
+
+package dhcpd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestV4IPv6OnlyConf_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *V4IPv6OnlyConf
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &V4IPv6OnlyConf{Enabled: true},
+		name:       "default",
+		wantErrMsg: "",
+	}, {
+		conf:       &V4IPv6OnlyConf{WaitTime: MinIPv6OnlyWait, Enabled: true},
+		name:       "min",
+		wantErrMsg: "",
+	}, {
+		conf:       &V4IPv6OnlyConf{WaitTime: MinIPv6OnlyWait - 1, Enabled: true},
+		name:       "too_small",
+		wantErrMsg: "ipv6-only preferred: wait time 299 is less than 300",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.conf.validate()
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+// newIPv6OnlyReq returns a new DHCP message of type mt from a client, which
+// requests the IPv6-Only Preferred option if requested is true.
+func newIPv6OnlyReq(t *testing.T, mt dhcpv4.MessageType, requested bool) (req *dhcpv4.DHCPv4) {
+	t.Helper()
+
+	opts := []dhcpv4.OptionCode{dhcpv4.OptionSubnetMask, dhcpv4.OptionRouter}
+	if requested {
+		opts = append(opts, optionIPv6OnlyPreferred)
+	}
+
+	req, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(net.HardwareAddr{0xAA, 0xBB, 0xCC, 0x01, 0x02, 0x03}),
+		dhcpv4.WithMessageType(mt),
+		dhcpv4.WithOption(dhcpv4.OptParameterRequestList(opts...)),
+	)
+	require.NoError(t, err)
+
+	return req
+}
+
+func TestV4Server_ipv6OnlyWait(t *testing.T) {
+	testCases := []struct {
+		conf      *V4IPv6OnlyConf
+		name      string
+		wantWait  uint32
+		requested bool
+		wantOK    bool
+	}{{
+		conf:      nil,
+		name:      "nil",
+		wantWait:  0,
+		requested: true,
+		wantOK:    false,
+	}, {
+		conf:      &V4IPv6OnlyConf{WaitTime: 600, Enabled: false},
+		name:      "disabled",
+		wantWait:  0,
+		requested: true,
+		wantOK:    false,
+	}, {
+		conf:      &V4IPv6OnlyConf{WaitTime: 600, Enabled: true},
+		name:      "not_requested",
+		wantWait:  0,
+		requested: false,
+		wantOK:    false,
+	}, {
+		conf:      &V4IPv6OnlyConf{WaitTime: 600, Enabled: true},
+		name:      "requested",
+		wantWait:  600,
+		requested: true,
+		wantOK:    true,
+	}, {
+		conf:      &V4IPv6OnlyConf{Enabled: true},
+		name:      "default",
+		wantWait:  DefaultIPv6OnlyWait,
+		requested: true,
+		wantOK:    true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := defaultV4ServerConf()
+			conf.IPv6OnlyPreferred = tc.conf
+
+			s, err := v4Create(conf)
+			require.NoError(t, err)
+
+			req := newIPv6OnlyReq(t, dhcpv4.MessageTypeDiscover, tc.requested)
+			wait, ok := s.ipv6OnlyWait(req)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantWait, wait)
+		})
+	}
+}
+
+func TestV4Server_handle_ipv6Only(t *testing.T) {
+	conf := defaultV4ServerConf()
+	conf.IPv6OnlyPreferred = &V4IPv6OnlyConf{WaitTime: 600, Enabled: true}
+
+	s, err := v4Create(conf)
+	require.NoError(t, err)
+
+	wantOpt := []byte{0, 0, 0x02, 0x58}
+
+	t.Run("discover", func(t *testing.T) {
+		req := newIPv6OnlyReq(t, dhcpv4.MessageTypeDiscover, true)
+		resp, respErr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, respErr)
+
+		res := s.handle(req, resp)
+		require.Positive(t, res)
+
+		assert.Equal(t, dhcpv4.MessageTypeOffer, resp.MessageType())
+		assert.Equal(t, net.IPv4zero.To4(), resp.YourIPAddr.To4())
+		assert.Equal(t, wantOpt, resp.Options.Get(optionIPv6OnlyPreferred))
+		assert.Empty(t, s.GetLeases(LeasesDynamic))
+	})
+
+	t.Run("discover_not_requested", func(t *testing.T) {
+		req := newIPv6OnlyReq(t, dhcpv4.MessageTypeDiscover, false)
+		resp, respErr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, respErr)
+
+		res := s.handle(req, resp)
+		require.Positive(t, res)
+
+		assert.Equal(t, dhcpv4.MessageTypeOffer, resp.MessageType())
+		assert.False(t, resp.YourIPAddr.IsUnspecified())
+		assert.Nil(t, resp.Options.Get(optionIPv6OnlyPreferred))
+	})
+
+	t.Run("update_options", func(t *testing.T) {
+		req := newIPv6OnlyReq(t, dhcpv4.MessageTypeRequest, true)
+		resp, respErr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, respErr)
+
+		s.updateOptions(req, resp, nil)
+
+		assert.Equal(t, wantOpt, resp.Options.Get(optionIPv6OnlyPreferred))
+	})
+}
@@ -0,0 +1,285 @@
+//go:build darwin || freebsd || linux || openbsd
+
+package dhcpd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// pxeVendorClass is the prefix of the vendor class identifier of the PXE
+	// clients.
+	pxeVendorClass = "PXEClient"
+
+	// httpBootVendorClass is the prefix of the vendor class identifier of the
+	// UEFI HTTP boot clients.
+	httpBootVendorClass = "HTTPClient"
+
+	// maxBootFileLen is the maximum length of a boot file name, which must fit
+	// the file field of a DHCPv4 message.
+	maxBootFileLen = 127
+
+	// maxServerNameLen is the maximum length of a TFTP server name, which must
+	// fit the sname field of a DHCPv4 message.
+	maxServerNameLen = 63
+)
+
+// pxeDiscoveryControl is the value of option 43 sent by the ProxyDHCP server.
+// It contains the PXE_DISCOVERY_CONTROL suboption with bit 3 set, which makes
+// the clients download the boot file from the offer directly instead of
+// discovering the boot servers.
+//
+// See the Preboot Execution Environment Specification, version 2.1, section
+// 2.2.5.
+var pxeDiscoveryControl = []byte{6, 1, 1 << 3, 255}
+
+// netboot is the parsed [V4NetbootConf].
+type netboot struct {
+	// serverIP is the address of the TFTP server.  It's nil if not set.
+	serverIP net.IP
+
+	// serverName is the name of the TFTP server.
+	serverName string
+
+	// biosFile, uefiFile, arm64File, and httpURL are the boot files for the
+	// corresponding architectures.  Empty strings mean no network boot.
+	biosFile  string
+	uefiFile  string
+	arm64File string
+	httpURL   string
+
+	// proxy defines if the server works as a ProxyDHCP server.
+	proxy bool
+
+	// bootp defines if the BOOTP requests are answered.
+	bootp bool
+}
+
+// newNetboot parses c.  It returns nil if c is nil or disabled.
+func newNetboot(c *V4NetbootConf) (n *netboot, err error) {
+	if c == nil || !c.Enabled {
+		return nil, nil
+	}
+
+	defer func() { err = errors.Annotate(err, "netboot: %w") }()
+
+	n = &netboot{
+		serverName: c.ServerName,
+		biosFile:   c.BIOSBootFile,
+		uefiFile:   c.UEFIBootFile,
+		arm64File:  c.ARM64BootFile,
+		httpURL:    c.HTTPBootURL,
+		proxy:      c.ProxyDHCP,
+		bootp:      c.BOOTP,
+	}
+
+	if c.ServerIP.IsValid() {
+		if !c.ServerIP.Is4() {
+			return nil, fmt.Errorf("server ip %s is not an ipv4 address", c.ServerIP)
+		}
+
+		n.serverIP = c.ServerIP.AsSlice()
+	}
+
+	if l := len(c.ServerName); l > maxServerNameLen {
+		return nil, fmt.Errorf("server name is too long: got %d bytes, max %d", l, maxServerNameLen)
+	}
+
+	files := []string{c.BIOSBootFile, c.UEFIBootFile, c.ARM64BootFile, c.HTTPBootURL}
+	if !slices.ContainsFunc(files, func(f string) (ok bool) { return f != "" }) {
+		return nil, errors.Error("no boot files")
+	}
+
+	for _, f := range files {
+		if l := len(f); l > maxBootFileLen {
+			return nil, fmt.Errorf("boot file %q is too long: got %d bytes, max %d", f, l, maxBootFileLen)
+		}
+	}
+
+	if c.HTTPBootURL != "" {
+		var u *url.URL
+		u, err = url.Parse(c.HTTPBootURL)
+		if err != nil {
+			return nil, fmt.Errorf("http boot url: %w", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("http boot url %q: scheme must be http or https", c.HTTPBootURL)
+		}
+	}
+
+	return n, nil
+}
+
+// isNetbootClient returns true if req is sent by a PXE or a UEFI HTTP boot
+// client.
+func isNetbootClient(req *dhcpv4.DHCPv4) (ok bool) {
+	class := req.ClassIdentifier()
+
+	return strings.HasPrefix(class, pxeVendorClass) || strings.HasPrefix(class, httpBootVendorClass)
+}
+
+// bootFile returns the boot file for the client architectures from req.  isHTTP
+// is true if the file is the URL for the UEFI HTTP boot.
+func (n *netboot) bootFile(req *dhcpv4.DHCPv4) (file string, isHTTP bool) {
+	archs := req.ClientArch()
+	if len(archs) == 0 {
+		// The clients without the architecture option predate RFC 4578 and are
+		// all legacy BIOS ones.
+		return n.biosFile, false
+	}
+
+	for _, a := range archs {
+		switch a {
+		case iana.INTEL_X86PC:
+			file = n.biosFile
+		case iana.EFI_X86_64, iana.EFI_BC:
+			file = n.uefiFile
+		case iana.EFI_ARM64:
+			file = n.arm64File
+		case iana.EFI_X86_64_HTTP, iana.EFI_ARM64_HTTP:
+			file, isHTTP = n.httpURL, true
+		}
+
+		if file != "" {
+			return file, isHTTP
+		}
+	}
+
+	return "", false
+}
+
+// apply sets the boot information for the network boot client req in resp.
+// ok is false if req isn't a network boot client or there is no boot file for
+// its architecture.
+func (n *netboot) apply(req, resp *dhcpv4.DHCPv4) (ok bool) {
+	if n == nil || !isNetbootClient(req) {
+		return false
+	}
+
+	file, isHTTP := n.bootFile(req)
+	if file == "" {
+		log.Debug("dhcpv4: netboot: no boot file for %s with arch %v", req.ClientHWAddr, req.ClientArch())
+
+		return false
+	}
+
+	n.setBootFile(resp, file)
+
+	if isHTTP {
+		// The UEFI HTTP boot clients ignore the offers without this vendor
+		// class.  See UEFI Specification, version 2.9, section 24.7.2.
+		resp.UpdateOption(dhcpv4.OptClassIdentifier(httpBootVendorClass))
+	} else if n.proxy {
+		// The PXE clients ignore the ProxyDHCP offers without these options.
+		resp.UpdateOption(dhcpv4.OptClassIdentifier(pxeVendorClass))
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, pxeDiscoveryControl))
+	}
+
+	return true
+}
+
+// setBootFile sets the boot server and file fields and options in resp.
+func (n *netboot) setBootFile(resp *dhcpv4.DHCPv4, file string) {
+	if n.serverIP != nil {
+		resp.ServerIPAddr = slices.Clone(n.serverIP)
+	}
+
+	if n.serverName != "" {
+		resp.ServerHostName = n.serverName
+		resp.UpdateOption(dhcpv4.OptTFTPServerName(n.serverName))
+	}
+
+	resp.BootFileName = file
+	resp.UpdateOption(dhcpv4.OptBootFileName(file))
+}
+
+// handleProxy handles req in the ProxyDHCP mode.  The network boot clients
+// receive the boot information without any addresses, and the other requests
+// are ignored.  ok is false if req must not be answered.
+//
+// See the Preboot Execution Environment Specification, version 2.1, section
+// 2.2.3.
+func (s *v4Server) handleProxy(req, resp *dhcpv4.DHCPv4) (ok bool) {
+	var mt dhcpv4.MessageType
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		mt = dhcpv4.MessageTypeOffer
+	case dhcpv4.MessageTypeRequest:
+		// Only answer the requests addressed to this server, since the other
+		// ones are for the DHCP server providing the addresses.
+		if !req.ServerIdentifier().Equal(s.conf.dnsIPAddrs[0].AsSlice()) {
+			return false
+		}
+
+		mt = dhcpv4.MessageTypeAck
+	default:
+		return false
+	}
+
+	if !s.netboot.apply(req, resp) {
+		return false
+	}
+
+	resp.UpdateOption(dhcpv4.OptMessageType(mt))
+	resp.UpdateOption(dhcpv4.OptServerIdentifier(s.conf.dnsIPAddrs[0].AsSlice()))
+
+	log.Debug("dhcpv4: netboot: proxy %s for %s", mt, req.ClientHWAddr)
+
+	return true
+}
+
+// handleBOOTP handles the BOOTP request req.  Only the clients with static
+// leases are answered, since BOOTP has no means to expire the dynamic ones.
+// ok is false if req must not be answered.
+//
+// See RFC 951 and RFC 1497.
+func (s *v4Server) handleBOOTP(req, resp *dhcpv4.DHCPv4) (ok bool) {
+	if s.netboot == nil || !s.netboot.bootp || s.netboot.proxy {
+		return false
+	}
+
+	s.leasesLock.Lock()
+	l := s.findLease(req.ClientHWAddr)
+	s.leasesLock.Unlock()
+
+	if l == nil || !l.IsStatic() {
+		log.Debug("dhcpv4: bootp: no static lease for %s", req.ClientHWAddr)
+
+		return false
+	}
+
+	resp.YourIPAddr = slices.Clone(l.IP)
+
+	// The BOOTP clients don't send the parameter request lists, so send the
+	// basic network configuration unconditionally.
+	for _, code := range []dhcpv4.OptionCode{
+		dhcpv4.OptionSubnetMask,
+		dhcpv4.OptionRouter,
+		dhcpv4.OptionDomainNameServer,
+	} {
+		if val := s.implicitOpts.Get(code); val != nil {
+			resp.UpdateOption(dhcpv4.OptGeneric(code, val))
+		}
+	}
+
+	for code, val := range s.explicitOpts {
+		if val != nil {
+			resp.Options[code] = val
+		}
+	}
+
+	file, _ := s.netboot.bootFile(req)
+	if file != "" {
+		s.netboot.setBootFile(resp, file)
+	}
+
+	return true
+}
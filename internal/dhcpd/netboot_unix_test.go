@@ -0,0 +1,293 @@
+//go:build darwin || freebsd || linux || openbsd
+
+package dhcpd
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestNetbootConf returns the network boot configuration to use in tests.
+func newTestNetbootConf() (c *V4NetbootConf) {
+	return &V4NetbootConf{
+		ServerIP:      netip.MustParseAddr("192.168.10.5"),
+		ServerName:    "tftp.lan",
+		BIOSBootFile:  "pxelinux.0",
+		UEFIBootFile:  "grubx64.efi",
+		ARM64BootFile: "grubaa64.efi",
+		HTTPBootURL:   "http://192.168.10.5/boot.efi",
+		Enabled:       true,
+	}
+}
+
+func TestNewNetboot(t *testing.T) {
+	testCases := []struct {
+		conf       *V4NetbootConf
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &V4NetbootConf{Enabled: false},
+		name:       "disabled",
+		wantErrMsg: "",
+	}, {
+		conf:       newTestNetbootConf(),
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf:       &V4NetbootConf{Enabled: true},
+		name:       "no_files",
+		wantErrMsg: "netboot: no boot files",
+	}, {
+		conf: &V4NetbootConf{
+			ServerIP:     netip.MustParseAddr("fe80::1"),
+			BIOSBootFile: "pxelinux.0",
+			Enabled:      true,
+		},
+		name:       "ipv6_server",
+		wantErrMsg: "netboot: server ip fe80::1 is not an ipv4 address",
+	}, {
+		conf: &V4NetbootConf{
+			BIOSBootFile: strings.Repeat("a", maxBootFileLen+1),
+			Enabled:      true,
+		},
+		name: "long_file",
+		wantErrMsg: `netboot: boot file "` + strings.Repeat("a", maxBootFileLen+1) +
+			`" is too long: got 128 bytes, max 127`,
+	}, {
+		conf: &V4NetbootConf{
+			HTTPBootURL: "tftp://192.168.10.5/boot.efi",
+			Enabled:     true,
+		},
+		name: "bad_http_url",
+		wantErrMsg: `netboot: http boot url "tftp://192.168.10.5/boot.efi": ` +
+			`scheme must be http or https`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newNetboot(tc.conf)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+// newNetbootReq returns a new DHCPDISCOVER from a client with vendorClass and
+// archs.
+func newNetbootReq(t *testing.T, vendorClass string, archs ...iana.Arch) (req *dhcpv4.DHCPv4) {
+	t.Helper()
+
+	mods := []dhcpv4.Modifier{
+		dhcpv4.WithHwAddr(net.HardwareAddr{0xAA, 0xBB, 0xCC, 0x01, 0x02, 0x03}),
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+	}
+	if vendorClass != "" {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClassIdentifier(vendorClass)))
+	}
+
+	if len(archs) > 0 {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClientArch(archs...)))
+	}
+
+	req, err := dhcpv4.New(mods...)
+	require.NoError(t, err)
+
+	return req
+}
+
+func TestV4Server_updateOptions_netboot(t *testing.T) {
+	conf := defaultV4ServerConf()
+	conf.Netboot = newTestNetbootConf()
+
+	s, err := v4Create(conf)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name         string
+		vendorClass  string
+		wantBootFile string
+		wantClass    string
+		archs        []iana.Arch
+	}{{
+		name:         "bios_no_arch",
+		vendorClass:  "PXEClient:Arch:00000:UNDI:002001",
+		wantBootFile: "pxelinux.0",
+		wantClass:    "",
+		archs:        nil,
+	}, {
+		name:         "bios",
+		vendorClass:  "PXEClient:Arch:00000:UNDI:002001",
+		wantBootFile: "pxelinux.0",
+		wantClass:    "",
+		archs:        []iana.Arch{iana.INTEL_X86PC},
+	}, {
+		name:         "uefi",
+		vendorClass:  "PXEClient:Arch:00007:UNDI:003016",
+		wantBootFile: "grubx64.efi",
+		wantClass:    "",
+		archs:        []iana.Arch{iana.EFI_X86_64},
+	}, {
+		name:         "arm64",
+		vendorClass:  "PXEClient:Arch:00011:UNDI:003000",
+		wantBootFile: "grubaa64.efi",
+		wantClass:    "",
+		archs:        []iana.Arch{iana.EFI_ARM64},
+	}, {
+		name:         "http",
+		vendorClass:  "HTTPClient:Arch:00016:UNDI:003001",
+		wantBootFile: "http://192.168.10.5/boot.efi",
+		wantClass:    httpBootVendorClass,
+		archs:        []iana.Arch{iana.EFI_X86_64_HTTP},
+	}, {
+		name:         "unsupported_arch",
+		vendorClass:  "PXEClient:Arch:00002:UNDI:003000",
+		wantBootFile: "",
+		wantClass:    "",
+		archs:        []iana.Arch{iana.EFI_ITANIUM},
+	}, {
+		name:         "not_netboot",
+		vendorClass:  "MSFT 5.0",
+		wantBootFile: "",
+		wantClass:    "",
+		archs:        nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newNetbootReq(t, tc.vendorClass, tc.archs...)
+			resp, respErr := dhcpv4.NewReplyFromRequest(req)
+			require.NoError(t, respErr)
+
+			s.updateOptions(req, resp, nil)
+
+			assert.Equal(t, tc.wantBootFile, resp.BootFileName)
+			assert.Equal(t, tc.wantBootFile, resp.BootFileNameOption())
+			assert.Equal(t, tc.wantClass, resp.ClassIdentifier())
+			if tc.wantBootFile == "" {
+				return
+			}
+
+			assert.Equal(t, net.IP{192, 168, 10, 5}, resp.ServerIPAddr.To4())
+			assert.Equal(t, "tftp.lan", resp.ServerHostName)
+			assert.Equal(t, "tftp.lan", resp.TFTPServerName())
+		})
+	}
+}
+
+func TestV4Server_handleProxy(t *testing.T) {
+	conf := defaultV4ServerConf()
+	conf.Netboot = newTestNetbootConf()
+	conf.Netboot.ProxyDHCP = true
+
+	s, err := v4Create(conf)
+	require.NoError(t, err)
+
+	t.Run("discover", func(t *testing.T) {
+		req := newNetbootReq(t, "PXEClient:Arch:00007:UNDI:003016", iana.EFI_X86_64)
+		resp, respErr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, respErr)
+
+		require.True(t, s.handleProxy(req, resp))
+
+		assert.Equal(t, dhcpv4.MessageTypeOffer, resp.MessageType())
+		assert.True(t, resp.YourIPAddr.IsUnspecified())
+		assert.Equal(t, "grubx64.efi", resp.BootFileName)
+		assert.Equal(t, pxeVendorClass, resp.ClassIdentifier())
+		assert.Equal(t, pxeDiscoveryControl, resp.Options.Get(dhcpv4.OptionVendorSpecificInformation))
+		assert.Empty(t, s.GetLeases(LeasesDynamic))
+	})
+
+	t.Run("not_netboot", func(t *testing.T) {
+		req := newNetbootReq(t, "MSFT 5.0")
+		resp, respErr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, respErr)
+
+		assert.False(t, s.handleProxy(req, resp))
+	})
+
+	t.Run("request_other_server", func(t *testing.T) {
+		req := newNetbootReq(t, "PXEClient:Arch:00000:UNDI:002001")
+		req.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeRequest))
+		req.UpdateOption(dhcpv4.OptServerIdentifier(net.IP{192, 168, 10, 1}))
+
+		resp, respErr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, respErr)
+
+		assert.False(t, s.handleProxy(req, resp))
+	})
+
+	t.Run("request", func(t *testing.T) {
+		req := newNetbootReq(t, "PXEClient:Arch:00000:UNDI:002001")
+		req.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeRequest))
+		req.UpdateOption(dhcpv4.OptServerIdentifier(DefaultSelfIP.AsSlice()))
+
+		resp, respErr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, respErr)
+
+		require.True(t, s.handleProxy(req, resp))
+
+		assert.Equal(t, dhcpv4.MessageTypeAck, resp.MessageType())
+		assert.Equal(t, "pxelinux.0", resp.BootFileName)
+	})
+}
+
+func TestV4Server_handleBOOTP(t *testing.T) {
+	conf := defaultV4ServerConf()
+	conf.Netboot = newTestNetbootConf()
+	conf.Netboot.BOOTP = true
+
+	s, err := v4Create(conf)
+	require.NoError(t, err)
+
+	s.implicitOpts.Update(dhcpv4.OptDNS(DefaultSelfIP.AsSlice()))
+
+	staticMAC := net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA}
+	err = s.AddStaticLease(&Lease{
+		Hostname: "diskless.local",
+		HWAddr:   staticMAC,
+		IP:       net.IP{192, 168, 10, 150},
+	})
+	require.NoError(t, err)
+
+	newBOOTPReq := func(mac net.HardwareAddr) (req *dhcpv4.DHCPv4) {
+		req, err = dhcpv4.New(dhcpv4.WithHwAddr(mac))
+		require.NoError(t, err)
+		require.Equal(t, dhcpv4.MessageTypeNone, req.MessageType())
+
+		return req
+	}
+
+	t.Run("static", func(t *testing.T) {
+		req := newBOOTPReq(staticMAC)
+		resp, respErr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, respErr)
+
+		require.True(t, s.handleBOOTP(req, resp))
+
+		assert.Equal(t, net.IP{192, 168, 10, 150}, resp.YourIPAddr.To4())
+		assert.Equal(t, dhcpv4.MessageTypeNone, resp.MessageType())
+		assert.Equal(t, "pxelinux.0", resp.BootFileName)
+		assert.Equal(t, net.IPMask(DefaultSubnetMask.AsSlice()), resp.SubnetMask())
+		assert.Equal(t, []net.IP{DefaultGatewayIP.AsSlice()}, resp.Router())
+		assert.Equal(t, []net.IP{DefaultSelfIP.AsSlice()}, resp.DNS())
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		req := newBOOTPReq(net.HardwareAddr{0xBB, 0xBB, 0xBB, 0xBB, 0xBB, 0xBB})
+		resp, respErr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, respErr)
+
+		assert.False(t, s.handleBOOTP(req, resp))
+	})
+}
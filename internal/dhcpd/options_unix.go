@@ -3,6 +3,7 @@
 package dhcpd
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"net"
@@ -396,3 +397,137 @@ func (s *v4Server) prepareOptions() {
 		s.explicitOpts = nil
 	}
 }
+
+// optionTemplate is a parsed [V4OptionTemplate].
+type optionTemplate struct {
+	// opts are the options to set.  The nil values mean that the options
+	// must be removed.
+	opts dhcpv4.Options
+
+	// vendorClass is the prefix of the vendor class identifier to match.
+	vendorClass string
+
+	// macPrefix is the prefix of the hardware address to match.
+	macPrefix net.HardwareAddr
+
+	// leaseTime is the lease time for the matching clients.  Zero means the
+	// configured one.
+	leaseTime time.Duration
+}
+
+// newOptionTemplates parses confs.  It returns an error if any of them is
+// invalid.
+func newOptionTemplates(confs []*V4OptionTemplate) (tmpls []*optionTemplate, err error) {
+	for i, c := range confs {
+		var t *optionTemplate
+		t, err = newOptionTemplate(c)
+		if err != nil {
+			return nil, fmt.Errorf("option template at index %d: %w", i, err)
+		}
+
+		tmpls = append(tmpls, t)
+	}
+
+	return tmpls, nil
+}
+
+// newOptionTemplate parses c.
+func newOptionTemplate(c *V4OptionTemplate) (t *optionTemplate, err error) {
+	if c == nil {
+		return nil, errNilConfig
+	} else if c.VendorClass == "" && c.MACPrefix == "" {
+		return nil, errors.Error("no vendor class or mac prefix")
+	}
+
+	t = &optionTemplate{
+		opts:        dhcpv4.Options{},
+		vendorClass: c.VendorClass,
+		leaseTime:   time.Duration(c.LeaseDuration) * time.Second,
+	}
+
+	if c.MACPrefix != "" {
+		t.macPrefix, err = parseMACPrefix(c.MACPrefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, o := range c.Options {
+		var code dhcpv4.OptionCode
+		var val dhcpv4.OptionValue
+		code, val, err = parseDHCPOption(o)
+		if err != nil {
+			return nil, fmt.Errorf("option at index %d: %w", i, err)
+		}
+
+		t.opts.Update(dhcpv4.Option{Code: code, Value: val})
+	}
+
+	return t, nil
+}
+
+// parseMACPrefix parses a prefix of a hardware address in the colon- or
+// hyphen-separated hexadecimal form, like "aa:bb:cc".
+func parseMACPrefix(s string) (pref net.HardwareAddr, err error) {
+	defer func() { err = errors.Annotate(err, "bad mac prefix %q: %w", s) }()
+
+	parts := strings.FieldsFunc(s, func(r rune) (ok bool) { return r == ':' || r == '-' })
+	if len(parts) == 0 || len(parts) > 20 {
+		return nil, errors.Error("bad number of octets")
+	}
+
+	pref = make(net.HardwareAddr, 0, len(parts))
+	for _, p := range parts {
+		if len(p) != 2 {
+			return nil, fmt.Errorf("bad octet %q", p)
+		}
+
+		var b []byte
+		b, err = hex.DecodeString(p)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is and
+			// there is an annotation deferred already.
+			return nil, err
+		}
+
+		pref = append(pref, b[0])
+	}
+
+	return pref, nil
+}
+
+// match returns true if req matches the conditions of t.
+func (t *optionTemplate) match(req *dhcpv4.DHCPv4) (ok bool) {
+	if t.vendorClass != "" && !strings.HasPrefix(req.ClassIdentifier(), t.vendorClass) {
+		return false
+	}
+
+	if pl := len(t.macPrefix); pl > 0 {
+		mac := req.ClientHWAddr
+		if len(mac) < pl || !bytes.Equal(mac[:pl], t.macPrefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// apply sets the options of t in resp.
+func (t *optionTemplate) apply(resp *dhcpv4.DHCPv4) {
+	for code, val := range t.opts {
+		if val == nil {
+			delete(resp.Options, code)
+
+			continue
+		}
+
+		resp.Options[code] = val
+
+		switch code {
+		case dhcpv4.OptionTFTPServerName.Code():
+			resp.ServerHostName = string(val)
+		case dhcpv4.OptionBootfileName.Code():
+			resp.BootFileName = string(val)
+		}
+	}
+}
@@ -266,3 +266,46 @@ func TestPrepareOptions(t *testing.T) {
 		})
 	}
 }
+
+func TestNewOptionTemplates(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		conf       *V4OptionTemplate
+	}{{
+		name:       "valid",
+		wantErrMsg: "",
+		conf: &V4OptionTemplate{
+			VendorClass: "PXEClient",
+			MACPrefix:   "aa-bb-cc",
+			Options:     []string{"43 hex 0601", "67 text pxelinux.0"},
+		},
+	}, {
+		name:       "no_conditions",
+		wantErrMsg: "option template at index 0: no vendor class or mac prefix",
+		conf: &V4OptionTemplate{
+			Options: []string{"67 text pxelinux.0"},
+		},
+	}, {
+		name:       "bad_mac_prefix",
+		wantErrMsg: `option template at index 0: bad mac prefix "aa:b": bad octet "b"`,
+		conf: &V4OptionTemplate{
+			MACPrefix: "aa:b",
+		},
+	}, {
+		name: "bad_option",
+		wantErrMsg: `option template at index 0: option at index 0: ` +
+			`invalid option string "67 txt pxelinux.0": unknown option type "txt"`,
+		conf: &V4OptionTemplate{
+			VendorClass: "PXEClient",
+			Options:     []string{"67 txt pxelinux.0"},
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newOptionTemplates([]*V4OptionTemplate{tc.conf})
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package dhcpd
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/exp/slices"
+)
+
+// scope4 is an additional DHCPv4 scope served by its own DHCPv4 server.
+type scope4 struct {
+	// conf is the configuration of the scope as it was set by user.
+	conf *V4ScopeConf
+
+	// srv is the DHCPv4 server of the scope.
+	srv DHCPServer
+
+	// subnet is the subnet of the scope.
+	subnet netip.Prefix
+}
+
+// newScope4 validates conf and creates the DHCPv4 server for the scope.
+func (s *server) newScope4(conf *V4ScopeConf) (sc *scope4, err error) {
+	defer func() { err = errors.Annotate(err, "scope %q: %w", conf.Name) }()
+
+	v4conf := conf.V4ServerConf
+	v4conf.Enabled = conf.Enabled
+	v4conf.InterfaceName = conf.InterfaceName
+	v4conf.notify = s.onNotify
+	v4conf.events = s.events
+	v4conf.counters = s.counters
+
+	err = v4conf.Validate()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is and there is
+		// an annotation deferred already.
+		return nil, err
+	}
+
+	srv, err := v4Create(&v4conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &scope4{
+		conf:   conf,
+		srv:    srv,
+		subnet: v4conf.subnet,
+	}, nil
+}
+
+// newScopes4 validates confs and creates the DHCPv4 servers for the scopes.
+// mainIface is the name of the network interface of the main DHCP server.
+func (s *server) newScopes4(confs []*V4ScopeConf, mainIface string) (scopes []*scope4, err error) {
+	names := map[string]struct{}{}
+	ifaces := map[string]struct{}{}
+	for i, conf := range confs {
+		if conf == nil {
+			return nil, fmt.Errorf("scope at index %d: %w", i, errNilConfig)
+		} else if conf.Name == "" {
+			return nil, fmt.Errorf("scope at index %d: empty name", i)
+		}
+
+		if _, ok := names[conf.Name]; ok {
+			return nil, fmt.Errorf("scope %q: duplicate name", conf.Name)
+		}
+
+		names[conf.Name] = struct{}{}
+
+		if conf.InterfaceName == "" {
+			return nil, fmt.Errorf("scope %q: empty interface name", conf.Name)
+		} else if conf.InterfaceName == mainIface {
+			return nil, fmt.Errorf(
+				"scope %q: interface %q is used by the main server",
+				conf.Name,
+				conf.InterfaceName,
+			)
+		}
+
+		if _, ok := ifaces[conf.InterfaceName]; ok {
+			return nil, fmt.Errorf(
+				"scope %q: interface %q is used by another scope",
+				conf.Name,
+				conf.InterfaceName,
+			)
+		}
+
+		ifaces[conf.InterfaceName] = struct{}{}
+
+		var sc *scope4
+		sc, err = s.newScope4(conf)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, err
+		}
+
+		for _, other := range scopes {
+			if other.subnet.Overlaps(sc.subnet) {
+				return nil, fmt.Errorf(
+					"scope %q: subnet %s overlaps with subnet %s of scope %q",
+					conf.Name,
+					sc.subnet,
+					other.subnet,
+					other.conf.Name,
+				)
+			}
+		}
+
+		scopes = append(scopes, sc)
+	}
+
+	return scopes, nil
+}
+
+// hasEnabledScopes4 returns true if any of scopes is enabled.
+func hasEnabledScopes4(scopes []*scope4) (ok bool) {
+	return slices.IndexFunc(scopes, func(sc *scope4) (ok bool) { return sc.conf.Enabled }) >= 0
+}
+
+// scopes4 returns a copy of the current additional DHCPv4 scopes.  It's safe
+// for concurrent use.
+func (s *server) scopes4() (scopes []*scope4) {
+	s.scopesMu.RLock()
+	defer s.scopesMu.RUnlock()
+
+	return slices.Clone(s.scopes)
+}
+
+// setScopes4 replaces the current additional DHCPv4 scopes with scopes and
+// returns the previous ones.  It's safe for concurrent use.
+func (s *server) setScopes4(scopes []*scope4) (prev []*scope4) {
+	s.scopesMu.Lock()
+	defer s.scopesMu.Unlock()
+
+	prev, s.scopes = s.scopes, scopes
+
+	return prev
+}
+
+// v4Servers returns the main DHCPv4 server followed by the servers of the
+// additional scopes.
+func (s *server) v4Servers() (srvs []DHCPServer) {
+	srvs = []DHCPServer{s.srv4}
+	for _, sc := range s.scopes4() {
+		srvs = append(srvs, sc.srv)
+	}
+
+	return srvs
+}
+
+// v4ServerFor returns the DHCPv4 server of the scope containing ip.  If no
+// scope contains it, the main DHCPv4 server is returned.
+func (s *server) v4ServerFor(ip netip.Addr) (srv DHCPServer) {
+	for _, sc := range s.scopes4() {
+		if sc.subnet.Contains(ip) {
+			return sc.srv
+		}
+	}
+
+	return s.srv4
+}
+
+// partitionLeases4 distributes the DHCPv4 leases between scopes by their
+// subnets.  rest are the leases not contained in any of the scopes.
+func partitionLeases4(scopes []*scope4, leases []*Lease) (scopeLeases [][]*Lease, rest []*Lease) {
+	scopeLeases = make([][]*Lease, len(scopes))
+
+leasesLoop:
+	for _, l := range leases {
+		if ip, ok := ipToAddr4(l.IP); ok {
+			for i, sc := range scopes {
+				if sc.subnet.Contains(ip) {
+					scopeLeases[i] = append(scopeLeases[i], l)
+
+					continue leasesLoop
+				}
+			}
+		}
+
+		rest = append(rest, l)
+	}
+
+	return scopeLeases, rest
+}
+
+// resetLeases4 distributes leases between the main DHCPv4 server and the
+// additional scopes by their subnets and resets the leases of each of them.
+func (s *server) resetLeases4(leases []*Lease) (err error) {
+	scopes := s.scopes4()
+	scopeLeases, mainLeases := partitionLeases4(scopes, leases)
+
+	err = s.srv4.ResetLeases(mainLeases)
+	if err != nil {
+		return err
+	}
+
+	for i, sc := range scopes {
+		err = sc.srv.ResetLeases(scopeLeases[i])
+		if err != nil {
+			return fmt.Errorf("scope %q: %w", sc.conf.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// replaceScopes4 stops the current additional DHCPv4 scopes and replaces them
+// with scopes.  The leases of the previous scopes are moved into the new scopes
+// containing them, and the rest of them are dropped.  The new scopes are
+// started if the DHCP server is enabled.
+func (s *server) replaceScopes4(scopes []*scope4) (err error) {
+	prev := s.setScopes4(scopes)
+
+	var leases []*Lease
+	for _, sc := range prev {
+		err = sc.srv.Stop()
+		if err != nil {
+			return fmt.Errorf("stopping scope %q: %w", sc.conf.Name, err)
+		}
+
+		leases = append(leases, sc.srv.GetLeases(LeasesAll)...)
+	}
+
+	scopeLeases, _ := partitionLeases4(scopes, leases)
+	for i, sc := range scopes {
+		err = sc.srv.ResetLeases(scopeLeases[i])
+		if err != nil {
+			return fmt.Errorf("resetting leases of scope %q: %w", sc.conf.Name, err)
+		}
+	}
+
+	err = s.dbStore()
+	if err != nil {
+		return fmt.Errorf("storing leases: %w", err)
+	}
+
+	if !s.conf.Enabled {
+		return nil
+	}
+
+	for _, sc := range scopes {
+		err = sc.srv.Start()
+		if err != nil {
+			return fmt.Errorf("starting scope %q: %w", sc.conf.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// ipToAddr4 converts ip into a netip.Addr.  ok is false if ip isn't an IPv4
+// address.
+func ipToAddr4(ip net.IP) (addr netip.Addr, ok bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return netip.Addr{}, false
+	}
+
+	return netip.AddrFrom4(*(*[4]byte)(ip4)), true
+}
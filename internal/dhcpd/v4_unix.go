@@ -42,7 +42,15 @@ type v4Server struct {
 	// have intersections with [implicitOpts].
 	explicitOpts dhcpv4.Options
 
-	// leasesLock protects leases, leaseHosts, and leasedOffsets.
+	// optTemplates are the parsed conf.OptionTemplates.
+	optTemplates []*optionTemplate
+
+	// netboot is the parsed conf.Netboot.  It's nil if the network boot is
+	// disabled.
+	netboot *netboot
+
+	// leasesLock protects leases, leaseHosts, leasedOffsets, pendingEvents,
+	// and expireLogged.
 	leasesLock sync.Mutex
 
 	// leasedOffsets contains offsets from conf.ipRange.start that have been
@@ -54,6 +62,15 @@ type v4Server struct {
 
 	// leases contains all dynamic and static leases.
 	leases []*Lease
+
+	// pendingEvents are the DHCP events happened while leasesLock was locked.
+	// They are written into the log by writeEvents after unlocking it, so that
+	// the file operations don't hold the lock.
+	pendingEvents []*event
+
+	// expireLogged are the expiration times of the dynamic leases, which
+	// expiry has already been logged.
+	expireLogged map[*Lease]time.Time
 }
 
 func (s *v4Server) enabled() (ok bool) {
@@ -128,6 +145,7 @@ func (s *v4Server) ResetLeases(leases []*Lease) (err error) {
 	s.leasedOffsets = newBitSet()
 	s.leaseHosts = stringutil.NewSet()
 	s.leases = nil
+	s.expireLogged = map[*Lease]time.Time{}
 
 	for _, l := range leases {
 		if !l.IsStatic() {
@@ -181,10 +199,14 @@ func (s *v4Server) GetLeases(flags GetLeasesFlags) (leases []*Lease) {
 	getDynamic := flags&LeasesDynamic != 0
 	getStatic := flags&LeasesStatic != 0
 
+	defer s.writeEvents()
+
 	s.leasesLock.Lock()
 	defer s.leasesLock.Unlock()
 
 	now := time.Now()
+	s.logExpiredLocked(now)
+
 	for _, l := range s.leases {
 		if getDynamic && l.Expiry.After(now) && !s.isBlocklisted(l) {
 			leases = append(leases, l.Clone())
@@ -226,11 +248,12 @@ func (s *v4Server) FindMACbyIP(ip netip.Addr) (mac net.HardwareAddr) {
 // defaultHwAddrLen is the default length of a hardware (MAC) address.
 const defaultHwAddrLen = 6
 
-// Add the specified IP to the black list for a time period
-func (s *v4Server) blocklistLease(l *Lease) {
+// blocklistLease makes the address of l unavailable for the clients for the
+// period d.
+func (s *v4Server) blocklistLease(l *Lease, d time.Duration) {
 	l.HWAddr = make(net.HardwareAddr, defaultHwAddrLen)
 	l.Hostname = ""
-	l.Expiry = time.Now().Add(s.conf.leaseTime)
+	l.Expiry = time.Now().Add(d)
 }
 
 // rmLeaseByIndex removes a lease by its index in the leases slice.
@@ -253,6 +276,7 @@ func (s *v4Server) rmLeaseByIndex(i int) {
 	}
 
 	s.leaseHosts.Del(l.Hostname)
+	delete(s.expireLogged, l)
 
 	log.Debug("dhcpv4: removed lease %s (%s)", l.IP, l.HWAddr)
 }
@@ -453,16 +477,45 @@ func (s *v4Server) RemoveStaticLease(l *Lease) (err error) {
 	return s.rmLease(l)
 }
 
-// addrAvailable sends an ICP request to the specified IP address.  It returns
+// addrAvailable returns true if neither the ICMP request nor the ARP probe
+// show that the target IP address is used by another device.
+func (s *v4Server) addrAvailable(target net.IP) (avail bool) {
+	return s.pingAvailable(target) && s.arpAvailable(target)
+}
+
+// icmpSkipped returns true if the target IP address is in the ICMP skip-list.
+func (s *v4Server) icmpSkipped(target net.IP) (ok bool) {
+	ip, ok := netip.AddrFromSlice(target)
+	if !ok {
+		return false
+	}
+
+	ip = ip.Unmap()
+	for _, pref := range s.conf.icmpSkip {
+		if pref.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pingAvailable sends an ICP request to the specified IP address.  It returns
 // true if the remote host doesn't reply, which probably means that the IP
 // address is available.
 //
 // TODO(a.garipov): I'm not sure that this is the best way to do this.
-func (s *v4Server) addrAvailable(target net.IP) (avail bool) {
+func (s *v4Server) pingAvailable(target net.IP) (avail bool) {
 	if s.conf.ICMPTimeout == 0 {
 		return true
 	}
 
+	if s.icmpSkipped(target) {
+		log.Debug("dhcpv4: icmp echo to %s is skipped", target)
+
+		return true
+	}
+
 	pinger, err := ping.NewPinger(target.String())
 	if err != nil {
 		log.Error("dhcpv4: ping.NewPinger(): %s", err)
@@ -537,6 +590,42 @@ func (s *v4Server) findExpiredLease() int {
 	return -1
 }
 
+// addEventLocked queues e to be written into the events log by
+// [v4Server.writeEvents].  s.leasesLock is expected to be locked.
+func (s *v4Server) addEventLocked(e *event) {
+	s.pendingEvents = append(s.pendingEvents, e)
+}
+
+// writeEvents writes the queued events into the events log.  s.leasesLock is
+// expected to be unlocked.
+func (s *v4Server) writeEvents() {
+	s.leasesLock.Lock()
+	events := s.pendingEvents
+	s.pendingEvents = nil
+	s.leasesLock.Unlock()
+
+	for _, e := range events {
+		s.conf.events.add(e)
+	}
+}
+
+// logExpiredLocked queues the expire events for the dynamic leases, which have
+// expired by now since the previous check.  The blocklisted leases are
+// skipped, since they don't belong to any client.  s.leasesLock is expected to
+// be locked.
+func (s *v4Server) logExpiredLocked(now time.Time) {
+	for _, l := range s.leases {
+		if l.IsStatic() || s.isBlocklisted(l) || !l.Expiry.Before(now) {
+			continue
+		} else if logged, ok := s.expireLogged[l]; ok && logged.Equal(l.Expiry) {
+			continue
+		}
+
+		s.expireLogged[l] = l.Expiry
+		s.addEventLocked(newEvent(eventTypeExpire, l.HWAddr, l.IP, l.Hostname))
+	}
+}
+
 // reserveLease reserves a lease for a client by its MAC-address.  It returns
 // nil if it couldn't allocate a new lease.
 func (s *v4Server) reserveLease(mac net.HardwareAddr) (l *Lease, err error) {
@@ -549,6 +638,8 @@ func (s *v4Server) reserveLease(mac net.HardwareAddr) (l *Lease, err error) {
 			return nil, nil
 		}
 
+		s.logExpiredLocked(time.Now())
+
 		copy(s.leases[i].HWAddr, mac)
 
 		return s.leases[i], nil
@@ -562,10 +653,10 @@ func (s *v4Server) reserveLease(mac net.HardwareAddr) (l *Lease, err error) {
 	return l, nil
 }
 
-// commitLease refreshes l's values.  It takes the desired hostname into account
-// when setting it into the lease, but generates a unique one if the provided
-// can't be used.
-func (s *v4Server) commitLease(l *Lease, hostname string) {
+// commitLease refreshes l's values and extends it for leaseTime.  It takes the
+// desired hostname into account when setting it into the lease, but generates a
+// unique one if the provided can't be used.
+func (s *v4Server) commitLease(l *Lease, hostname string, leaseTime time.Duration) {
 	prev := l.Hostname
 	hostname = s.validHostnameForClient(hostname, l.IP)
 
@@ -583,7 +674,7 @@ func (s *v4Server) commitLease(l *Lease, hostname string) {
 		l.Hostname = hostname
 	}
 
-	l.Expiry = time.Now().Add(s.conf.leaseTime)
+	l.Expiry = time.Now().Add(leaseTime)
 	if prev != "" && prev != l.Hostname {
 		s.leaseHosts.Del(prev)
 	}
@@ -607,7 +698,8 @@ func (s *v4Server) allocateLease(mac net.HardwareAddr) (l *Lease, err error) {
 			return l, nil
 		}
 
-		s.blocklistLease(l)
+		s.addEventLocked(newEvent(eventTypeConflict, nil, l.IP, ""))
+		s.blocklistLease(l, s.conf.leaseTime)
 	}
 }
 
@@ -615,7 +707,10 @@ func (s *v4Server) allocateLease(mac net.HardwareAddr) (l *Lease, err error) {
 func (s *v4Server) handleDiscover(req, resp *dhcpv4.DHCPv4) (l *Lease, err error) {
 	mac := req.ClientHWAddr
 
+	s.conf.events.add(newEvent(eventTypeDiscover, mac, req.RequestedIPAddress(), req.HostName()))
+
 	defer s.conf.notify(LeaseChangedDBStore)
+	defer s.writeEvents()
 
 	s.leasesLock.Lock()
 	defer s.leasesLock.Unlock()
@@ -841,10 +936,20 @@ func (s *v4Server) handleRequest(req, resp *dhcpv4.DHCPv4) (lease *Lease, needsR
 		s.conf.notify(LeaseChangedAdded)
 		s.conf.notify(LeaseChangedDBStore)
 	}()
+	defer s.writeEvents()
 
 	s.leasesLock.Lock()
 	defer s.leasesLock.Unlock()
 
+	typ := eventTypeLease
+	if lease.Expiry.After(time.Now()) {
+		typ = eventTypeRenew
+	}
+
+	defer func() {
+		s.addEventLocked(newEvent(typ, lease.HWAddr, lease.IP, lease.Hostname))
+	}()
+
 	if lease.IsStatic() {
 		if lease.Hostname != "" {
 			// TODO(e.burkov):  This option is used to update the server's DNS
@@ -856,7 +961,7 @@ func (s *v4Server) handleRequest(req, resp *dhcpv4.DHCPv4) (lease *Lease, needsR
 		return lease, needsReply
 	}
 
-	s.commitLease(lease, hostname)
+	s.commitLease(lease, hostname, s.leaseTimeFor(req, lease))
 
 	if isRequested {
 		resp.UpdateOption(dhcpv4.OptHostName(lease.Hostname))
@@ -865,105 +970,86 @@ func (s *v4Server) handleRequest(req, resp *dhcpv4.DHCPv4) (lease *Lease, needsR
 	return lease, needsReply
 }
 
-// handleDecline is the handler for the DHCP Decline request.
-func (s *v4Server) handleDecline(req, resp *dhcpv4.DHCPv4) (err error) {
-	s.conf.notify(LeaseChangedDBStore)
-
-	s.leasesLock.Lock()
-	defer s.leasesLock.Unlock()
+// findDynamicLease returns the index of the dynamic lease for mac with ip or
+// -1 if there is none.  s.leasesLock is expected to be locked.
+func (s *v4Server) findDynamicLease(mac net.HardwareAddr, ip net.IP) (i int) {
+	return slices.IndexFunc(s.leases, func(l *Lease) (ok bool) {
+		return !l.IsStatic() && bytes.Equal(l.HWAddr, mac) && l.IP.Equal(ip)
+	})
+}
 
+// handleDecline is the handler for the DHCP Decline request.  The declined
+// address is quarantined, so that it isn't offered to any client during the
+// configured period.  The server doesn't reply to such requests.
+//
+// See https://datatracker.ietf.org/doc/html/rfc2131#section-4.3.3.
+func (s *v4Server) handleDecline(req *dhcpv4.DHCPv4) {
 	mac := req.ClientHWAddr
 	reqIP := req.RequestedIPAddress()
 	if reqIP == nil {
 		reqIP = req.ClientIPAddr
 	}
 
-	var oldLease *Lease
-	for _, l := range s.leases {
-		if bytes.Equal(l.HWAddr, mac) && l.IP.Equal(reqIP) {
-			oldLease = l
-
-			break
-		}
-	}
-
-	if oldLease == nil {
-		log.Info("dhcpv4: lease with ip %s for %s not found", reqIP, mac)
-
-		return nil
-	}
-
-	err = s.rmDynamicLease(oldLease)
-	if err != nil {
-		return fmt.Errorf("removing old lease for %s: %w", mac, err)
-	}
+	s.conf.counters.countDecline()
 
-	newLease, err := s.allocateLease(mac)
-	if err != nil {
-		return fmt.Errorf("allocating new lease for %s: %w", mac, err)
-	} else if newLease == nil {
-		log.Info("dhcpv4: allocating new lease for %s: no more ip addresses", mac)
+	defer s.conf.notify(LeaseChangedDBStore)
 
-		resp.YourIPAddr = make([]byte, 4)
-		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	defer s.writeEvents()
 
-		return nil
-	}
+	s.leasesLock.Lock()
+	defer s.leasesLock.Unlock()
 
-	newLease.Hostname = oldLease.Hostname
-	newLease.Expiry = time.Now().Add(s.conf.leaseTime)
+	i := s.findDynamicLease(mac, reqIP)
+	if i < 0 {
+		log.Info("dhcpv4: decline: lease with ip %s for %s not found", reqIP, mac)
 
-	err = s.addLease(newLease)
-	if err != nil {
-		return fmt.Errorf("adding new lease for %s: %w", mac, err)
+		return
 	}
 
-	log.Info("dhcpv4: changed ip from %s to %s for %s", reqIP, newLease.IP, mac)
-
-	resp.YourIPAddr = make([]byte, 4)
-	copy(resp.YourIPAddr, newLease.IP)
+	l := s.leases[i]
+	s.addEventLocked(newEvent(eventTypeDecline, mac, reqIP, l.Hostname))
 
-	resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	s.leaseHosts.Del(l.Hostname)
+	delete(s.expireLogged, l)
+	s.blocklistLease(l, s.conf.declineQuarantine)
 
-	return nil
+	log.Info("dhcpv4: quarantined ip %s declined by %s until %s", reqIP, mac, l.Expiry)
 }
 
-// handleRelease is the handler for the DHCP Release request.
-func (s *v4Server) handleRelease(req, resp *dhcpv4.DHCPv4) (err error) {
+// handleRelease is the handler for the DHCP Release request.  The released
+// lease is removed, so that its address is available for the other clients
+// immediately.  The server doesn't reply to such requests.
+//
+// See https://datatracker.ietf.org/doc/html/rfc2131#section-4.3.4.
+func (s *v4Server) handleRelease(req *dhcpv4.DHCPv4) {
 	mac := req.ClientHWAddr
 	reqIP := req.RequestedIPAddress()
 	if reqIP == nil {
 		reqIP = req.ClientIPAddr
 	}
 
+	s.conf.counters.countRelease()
+
 	// TODO(a.garipov): Add a separate notification type for dynamic lease
 	// removal?
 	defer s.conf.notify(LeaseChangedDBStore)
 
-	n := 0
+	defer s.writeEvents()
+
 	s.leasesLock.Lock()
 	defer s.leasesLock.Unlock()
 
-	for _, l := range s.leases {
-		if !bytes.Equal(l.HWAddr, mac) || !l.IP.Equal(reqIP) {
-			continue
-		}
+	i := s.findDynamicLease(mac, reqIP)
+	if i < 0 {
+		log.Info("dhcpv4: release: lease with ip %s for %s not found", reqIP, mac)
 
-		err = s.rmDynamicLease(l)
-		if err != nil {
-			err = fmt.Errorf("removing dynamic lease for %s: %w", mac, err)
-
-			return
-		}
-
-		n++
+		return
 	}
 
-	log.Info("dhcpv4: released %d dynamic leases for %s", n, mac)
-
-	resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	s.addEventLocked(newEvent(eventTypeRelease, mac, reqIP, s.leases[i].Hostname))
+	s.rmLeaseByIndex(i)
 
-	return nil
+	log.Info("dhcpv4: released lease with ip %s for %s", reqIP, mac)
 }
 
 // Find a lease associated with MAC and prepare response
@@ -982,6 +1068,12 @@ func (s *v4Server) handle(req, resp *dhcpv4.DHCPv4) int {
 	var l *Lease
 	switch mt := req.MessageType(); mt {
 	case dhcpv4.MessageTypeDiscover:
+		if wait, ok := s.ipv6OnlyWait(req); ok {
+			s.handleDiscoverIPv6Only(req, resp, wait)
+
+			return 1
+		}
+
 		l, err = s.handleDiscover(req, resp)
 		if err != nil {
 			log.Error("dhcpv4: handling discover: %s", err)
@@ -1002,40 +1094,51 @@ func (s *v4Server) handle(req, resp *dhcpv4.DHCPv4) int {
 			return -1 // drop packet
 		}
 	case dhcpv4.MessageTypeDecline:
-		err = s.handleDecline(req, resp)
-		if err != nil {
-			log.Error("dhcpv4: handling decline: %s", err)
+		s.handleDecline(req)
 
-			return 0
-		}
+		return -1
 	case dhcpv4.MessageTypeRelease:
-		err = s.handleRelease(req, resp)
-		if err != nil {
-			log.Error("dhcpv4: handling release: %s", err)
+		s.handleRelease(req)
 
-			return 0
-		}
+		return -1
 	}
 
 	if l != nil {
 		resp.YourIPAddr = slices.Clone(l.IP)
 	}
 
-	s.updateOptions(req, resp)
+	s.updateOptions(req, resp, l)
 
 	return 1
 }
 
-// updateOptions updates the options of the response in accordance with the
-// request and RFC 2131.
+// leaseTimeFor returns the lease time for the client of req with the lease l,
+// which may be nil.  The lease time of the static lease takes precedence over
+// the ones of the matching option templates, and the later templates override
+// the earlier ones.
+func (s *v4Server) leaseTimeFor(req *dhcpv4.DHCPv4, l *Lease) (d time.Duration) {
+	if l.IsStatic() && l.LeaseDuration != 0 {
+		return time.Duration(l.LeaseDuration) * time.Second
+	}
+
+	d = s.conf.leaseTime
+	for _, t := range s.optTemplates {
+		if t.leaseTime != 0 && t.match(req) {
+			d = t.leaseTime
+		}
+	}
+
+	return d
+}
+
+// updateOptions updates the options of the response to the client with the
+// lease l, which may be nil, in accordance with the request and RFC 2131.
 //
 // See https://datatracker.ietf.org/doc/html/rfc2131#section-4.3.1.
-func (s *v4Server) updateOptions(req, resp *dhcpv4.DHCPv4) {
+func (s *v4Server) updateOptions(req, resp *dhcpv4.DHCPv4, l *Lease) {
 	// Set IP address lease time for all DHCPOFFER messages and DHCPACK messages
 	// replied for DHCPREQUEST.
-	//
-	// TODO(e.burkov):  Inspect why this is always set to configured value.
-	resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(s.conf.leaseTime))
+	resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(s.leaseTimeFor(req, l)))
 
 	// If the server recognizes the parameter as a parameter defined in the Host
 	// Requirements Document, the server MUST include the default value for that
@@ -1057,6 +1160,23 @@ func (s *v4Server) updateOptions(req, resp *dhcpv4.DHCPv4) {
 			delete(resp.Options, code)
 		}
 	}
+
+	// Apply the templates after the boot information so that they're able to
+	// override it for specific clients.
+	s.netboot.apply(req, resp)
+
+	for _, t := range s.optTemplates {
+		if t.match(req) {
+			t.apply(resp)
+		}
+	}
+
+	// The clients sending requests despite the option, for example the ones
+	// rebooting with a previous lease, are also told to prefer IPv6.  See RFC
+	// 8925, section 3.3.
+	if wait, ok := s.ipv6OnlyWait(req); ok {
+		resp.UpdateOption(optIPv6OnlyPreferred(wait))
+	}
 }
 
 // client(0.0.0.0:68) -> (Request:ClientMAC,Type=Discover,ClientID,ReqIP,HostName) -> server(255.255.255.255:67)
@@ -1073,6 +1193,8 @@ func (s *v4Server) packetHandler(conn net.PacketConn, peer net.Addr, req *dhcpv4
 		dhcpv4.MessageTypeDecline,
 		dhcpv4.MessageTypeRelease:
 		// Go on.
+	case dhcpv4.MessageTypeNone:
+		// Go on, since that's a BOOTP request.
 	default:
 		log.Debug("dhcpv4: unsupported message type %d", req.MessageType())
 
@@ -1093,6 +1215,20 @@ func (s *v4Server) packetHandler(conn net.PacketConn, peer net.Addr, req *dhcpv4
 		return
 	}
 
+	if s.netboot != nil && s.netboot.proxy {
+		if s.handleProxy(req, resp) {
+			s.send(peer, conn, req, resp)
+		}
+
+		return
+	} else if req.MessageType() == dhcpv4.MessageTypeNone {
+		if s.handleBOOTP(req, resp) {
+			s.send(peer, conn, req, resp)
+		}
+
+		return
+	}
+
 	r := s.handle(req, resp)
 	if r < 0 {
 		return
@@ -1258,7 +1394,8 @@ func (s *v4Server) Stop() (err error) {
 // Create DHCPv4 server
 func v4Create(conf *V4ServerConf) (srv *v4Server, err error) {
 	s := &v4Server{
-		leaseHosts: stringutil.NewSet(),
+		leaseHosts:   stringutil.NewSet(),
+		expireLogged: map[*Lease]time.Time{},
 	}
 
 	err = conf.Validate()
@@ -1281,7 +1418,22 @@ func v4Create(conf *V4ServerConf) (srv *v4Server, err error) {
 		s.conf.leaseTime = time.Second * time.Duration(conf.LeaseDuration)
 	}
 
+	s.conf.declineQuarantine = s.conf.leaseTime
+	if conf.DeclineQuarantine != 0 {
+		s.conf.declineQuarantine = time.Second * time.Duration(conf.DeclineQuarantine)
+	}
+
 	s.prepareOptions()
 
+	s.optTemplates, err = newOptionTemplates(conf.OptionTemplates)
+	if err != nil {
+		return s, fmt.Errorf("dhcpv4: %w", err)
+	}
+
+	s.netboot, err = newNetboot(conf.Netboot)
+	if err != nil {
+		return s, fmt.Errorf("dhcpv4: %w", err)
+	}
+
 	return s, nil
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -485,7 +486,7 @@ func TestV4Server_updateOptions(t *testing.T) {
 		require.IsType(t, (*v4Server)(nil), s)
 
 		t.Run(tc.name, func(t *testing.T) {
-			s.updateOptions(req, resp)
+			s.updateOptions(req, resp, nil)
 
 			for c, v := range tc.wantOpts {
 				if v == nil {
@@ -500,6 +501,163 @@ func TestV4Server_updateOptions(t *testing.T) {
 	}
 }
 
+func TestV4Server_updateOptions_templates(t *testing.T) {
+	pxeMAC := net.HardwareAddr{0xAA, 0xBB, 0xCC, 0x01, 0x02, 0x03}
+	otherMAC := net.HardwareAddr{0x11, 0x22, 0x33, 0x01, 0x02, 0x03}
+
+	conf := defaultV4ServerConf()
+	conf.OptionTemplates = []*V4OptionTemplate{{
+		VendorClass: "PXEClient",
+		Options: []string{
+			"66 text 192.168.10.2",
+			"67 text pxelinux.0",
+		},
+	}, {
+		VendorClass: "PXEClient",
+		MACPrefix:   "aa:bb:cc",
+		Options:     []string{"67 text special.efi"},
+	}}
+
+	s, err := v4Create(conf)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name         string
+		mac          net.HardwareAddr
+		vendorClass  string
+		wantBootFile string
+		wantTFTP     string
+	}{{
+		name:         "pxe",
+		mac:          otherMAC,
+		vendorClass:  "PXEClient:Arch:00000:UNDI:002001",
+		wantBootFile: "pxelinux.0",
+		wantTFTP:     "192.168.10.2",
+	}, {
+		name:         "pxe_mac",
+		mac:          pxeMAC,
+		vendorClass:  "PXEClient:Arch:00007:UNDI:003016",
+		wantBootFile: "special.efi",
+		wantTFTP:     "192.168.10.2",
+	}, {
+		name:         "mac_only",
+		mac:          pxeMAC,
+		vendorClass:  "",
+		wantBootFile: "",
+		wantTFTP:     "",
+	}, {
+		name:         "other",
+		mac:          otherMAC,
+		vendorClass:  "MSFT 5.0",
+		wantBootFile: "",
+		wantTFTP:     "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mods := []dhcpv4.Modifier{dhcpv4.WithHwAddr(tc.mac)}
+			if tc.vendorClass != "" {
+				mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClassIdentifier(tc.vendorClass)))
+			}
+
+			req, err := dhcpv4.New(mods...)
+			require.NoError(t, err)
+
+			resp, err := dhcpv4.NewReplyFromRequest(req)
+			require.NoError(t, err)
+
+			s.updateOptions(req, resp, nil)
+
+			assert.Equal(t, tc.wantBootFile, resp.BootFileNameOption())
+			assert.Equal(t, tc.wantBootFile, resp.BootFileName)
+			assert.Equal(t, tc.wantTFTP, resp.TFTPServerName())
+			assert.Equal(t, tc.wantTFTP, resp.ServerHostName)
+		})
+	}
+}
+
+func TestV4Server_leaseTimeFor(t *testing.T) {
+	guestMAC := net.HardwareAddr{0xAA, 0xBB, 0xCC, 0x01, 0x02, 0x03}
+	otherMAC := net.HardwareAddr{0x11, 0x22, 0x33, 0x01, 0x02, 0x03}
+
+	conf := defaultV4ServerConf()
+	conf.LeaseDuration = 3600
+	conf.OptionTemplates = []*V4OptionTemplate{{
+		MACPrefix:     "aa:bb:cc",
+		LeaseDuration: 600,
+	}, {
+		VendorClass: "MSFT",
+		Options:     []string{"252 text http://wpad.lan/wpad.dat"},
+	}}
+
+	s, err := v4Create(conf)
+	require.NoError(t, err)
+
+	staticLease := &Lease{
+		Expiry:        time.Unix(leaseExpireStatic, 0),
+		LeaseDuration: LeaseDurationInfinite,
+	}
+
+	testCases := []struct {
+		lease       *Lease
+		name        string
+		mac         net.HardwareAddr
+		vendorClass string
+		want        time.Duration
+	}{{
+		lease:       nil,
+		name:        "default",
+		mac:         otherMAC,
+		vendorClass: "",
+		want:        time.Hour,
+	}, {
+		lease:       nil,
+		name:        "template",
+		mac:         guestMAC,
+		vendorClass: "",
+		want:        10 * time.Minute,
+	}, {
+		lease:       nil,
+		name:        "template_without_duration",
+		mac:         otherMAC,
+		vendorClass: "MSFT 5.0",
+		want:        time.Hour,
+	}, {
+		lease:       staticLease,
+		name:        "static",
+		mac:         guestMAC,
+		vendorClass: "",
+		want:        time.Duration(LeaseDurationInfinite) * time.Second,
+	}, {
+		lease:       &Lease{Expiry: time.Unix(leaseExpireStatic, 0)},
+		name:        "static_default",
+		mac:         guestMAC,
+		vendorClass: "",
+		want:        10 * time.Minute,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mods := []dhcpv4.Modifier{dhcpv4.WithHwAddr(tc.mac)}
+			if tc.vendorClass != "" {
+				mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClassIdentifier(tc.vendorClass)))
+			}
+
+			req, reqErr := dhcpv4.New(mods...)
+			require.NoError(t, reqErr)
+
+			assert.Equal(t, tc.want, s.leaseTimeFor(req, tc.lease))
+
+			resp, respErr := dhcpv4.NewReplyFromRequest(req)
+			require.NoError(t, respErr)
+
+			s.updateOptions(req, resp, tc.lease)
+
+			assert.Equal(t, tc.want, resp.IPAddressLeaseTime(0))
+		})
+	}
+}
+
 func TestV4StaticLease_Get(t *testing.T) {
 	sIface := defaultSrv(t)
 
@@ -862,3 +1020,249 @@ func TestV4Server_Send(t *testing.T) {
 		assert.True(t, resp.IsBroadcast())
 	})
 }
+
+func TestV4Server_events(t *testing.T) {
+	events := newEventLog(filepath.Join(t.TempDir(), eventsFilename))
+
+	conf := defaultV4ServerConf()
+	conf.events = events
+
+	s, err := v4Create(conf)
+	require.NoError(t, err)
+
+	s.conf.dnsIPAddrs = []netip.Addr{DefaultGatewayIP}
+
+	mac := net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA}
+	req, err := dhcpv4.NewDiscovery(mac)
+	require.NoError(t, err)
+
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, s.handle(req, resp))
+
+	req, err = dhcpv4.NewRequestFromOffer(resp)
+	require.NoError(t, err)
+
+	resp, err = dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, s.handle(req, resp))
+
+	// Request the same address again to renew the lease.
+	req, err = dhcpv4.NewRequestFromOffer(resp)
+	require.NoError(t, err)
+
+	resp, err = dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, s.handle(req, resp))
+
+	got, err := events.find(&eventFilter{hwAddr: mac.String(), limit: 10})
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+
+	assert.Equal(t, eventTypeRenew, got[0].Type)
+	assert.Equal(t, eventTypeLease, got[1].Type)
+	assert.Equal(t, eventTypeDiscover, got[2].Type)
+	assert.Equal(t, DefaultRangeStart, got[1].IP)
+}
+
+func TestV4Server_events_expire(t *testing.T) {
+	events := newEventLog(filepath.Join(t.TempDir(), eventsFilename))
+
+	conf := defaultV4ServerConf()
+	conf.events = events
+
+	s, err := v4Create(conf)
+	require.NoError(t, err)
+
+	expired := time.Now().Add(-time.Hour)
+	err = s.ResetLeases([]*Lease{{
+		Expiry:   expired,
+		Hostname: "expired",
+		HWAddr:   net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA},
+		IP:       net.IP{192, 168, 10, 150},
+	}, {
+		Expiry: expired,
+		HWAddr: make(net.HardwareAddr, 6),
+		IP:     net.IP{192, 168, 10, 151},
+	}})
+	require.NoError(t, err)
+
+	// The expiry must be logged only once.
+	_ = s.GetLeases(LeasesAll)
+	_ = s.GetLeases(LeasesAll)
+
+	got, err := events.find(&eventFilter{limit: 10})
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+
+	assert.Equal(t, eventTypeExpire, got[0].Type)
+	assert.Equal(t, "expired", got[0].Hostname)
+}
+
+func TestV4Server_handle_declineRelease(t *testing.T) {
+	const quarantine = 3600
+
+	conf := defaultV4ServerConf()
+	conf.counters = &msgCounters{}
+	conf.DeclineQuarantine = quarantine
+
+	s, err := v4Create(conf)
+	require.NoError(t, err)
+
+	lease := func(t *testing.T, mac net.HardwareAddr) (ip net.IP) {
+		t.Helper()
+
+		req, rerr := dhcpv4.NewDiscovery(mac)
+		require.NoError(t, rerr)
+
+		resp, rerr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, rerr)
+		require.Equal(t, 1, s.handle(req, resp))
+
+		req, rerr = dhcpv4.NewRequestFromOffer(resp)
+		require.NoError(t, rerr)
+
+		resp, rerr = dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, rerr)
+		require.Equal(t, 1, s.handle(req, resp))
+
+		return resp.YourIPAddr
+	}
+
+	handle := func(t *testing.T, mt dhcpv4.MessageType, mac net.HardwareAddr, ip net.IP) {
+		t.Helper()
+
+		req, rerr := dhcpv4.New(
+			dhcpv4.WithMessageType(mt),
+			dhcpv4.WithHwAddr(mac),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)),
+		)
+		require.NoError(t, rerr)
+
+		resp, rerr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, rerr)
+
+		assert.Equal(t, -1, s.handle(req, resp))
+	}
+
+	firstIP := DefaultRangeStart.AsSlice()
+	secondIP := DefaultRangeStart.Next().AsSlice()
+
+	declMAC := net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA}
+	relMAC := net.HardwareAddr{0xBB, 0xBB, 0xBB, 0xBB, 0xBB, 0xBB}
+	newMAC := net.HardwareAddr{0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC}
+
+	require.Equal(t, firstIP, []byte(lease(t, declMAC)))
+
+	t.Run("decline", func(t *testing.T) {
+		start := time.Now()
+		handle(t, dhcpv4.MessageTypeDecline, declMAC, firstIP)
+
+		assert.Empty(t, s.GetLeases(LeasesDynamic))
+
+		leases := s.getLeasesRef()
+		require.Len(t, leases, 1)
+
+		quarantined := leases[0]
+		assert.True(t, s.isBlocklisted(quarantined))
+		assert.Empty(t, quarantined.Hostname)
+		assert.False(t, quarantined.Expiry.Before(start.Add(quarantine*time.Second)))
+
+		assert.Equal(t, secondIP, []byte(lease(t, relMAC)))
+	})
+
+	t.Run("release", func(t *testing.T) {
+		handle(t, dhcpv4.MessageTypeRelease, relMAC, secondIP)
+
+		assert.Empty(t, s.GetLeases(LeasesDynamic))
+		assert.Len(t, s.getLeasesRef(), 1)
+
+		assert.Equal(t, secondIP, []byte(lease(t, newMAC)))
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		handle(t, dhcpv4.MessageTypeRelease, relMAC, secondIP)
+		handle(t, dhcpv4.MessageTypeDecline, declMAC, firstIP)
+
+		assert.Len(t, s.GetLeases(LeasesDynamic), 1)
+	})
+
+	assert.Equal(t, &msgCountersJSON{
+		Declines: 2,
+		Releases: 2,
+	}, conf.counters.toJSON())
+}
+
+func TestV4Server_icmpSkipped(t *testing.T) {
+	t.Run("bad", func(t *testing.T) {
+		testCases := []struct {
+			name       string
+			wantErrMsg string
+			skip       []string
+		}{{
+			name: "bad_ip",
+			wantErrMsg: `dhcpv4: icmp skip at index 0: ` +
+				`ParseAddr("192.168.10"): IPv4 address too short`,
+			skip: []string{"192.168.10"},
+		}, {
+			name: "bad_cidr",
+			wantErrMsg: `dhcpv4: icmp skip at index 1: ` +
+				`netip.ParsePrefix("192.168.10.0/33"): prefix length out of range`,
+			skip: []string{"192.168.10.150", "192.168.10.0/33"},
+		}, {
+			name:       "ipv6",
+			wantErrMsg: `dhcpv4: icmp skip at index 0: "2001:db8::/64" is not an ipv4 network`,
+			skip:       []string{"2001:db8::/64"},
+		}}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				conf := defaultV4ServerConf()
+				conf.ICMPSkip = tc.skip
+
+				_, err := v4Create(conf)
+				testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			})
+		}
+	})
+
+	conf := defaultV4ServerConf()
+	conf.ICMPTimeout = 1000
+	conf.ICMPSkip = []string{"192.168.10.150", "192.168.10.180/30"}
+
+	s, err := v4Create(conf)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		target net.IP
+		want   bool
+	}{{
+		name:   "ip",
+		target: net.IP{192, 168, 10, 150},
+		want:   true,
+	}, {
+		name:   "cidr",
+		target: net.IP{192, 168, 10, 183},
+		want:   true,
+	}, {
+		name:   "mapped",
+		target: net.ParseIP("192.168.10.181"),
+		want:   true,
+	}, {
+		name:   "other",
+		target: net.IP{192, 168, 10, 151},
+		want:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, s.icmpSkipped(tc.target))
+			if tc.want {
+				// The skipped addresses are available without waiting for
+				// the reply.
+				assert.True(t, s.pingAvailable(tc.target))
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"strings"
 	"sync"
 	"time"
 
@@ -316,6 +317,7 @@ func (s *v6Server) reserveLease(mac net.HardwareAddr) *Lease {
 			return nil
 		}
 		copy(s.leases[i].HWAddr, mac)
+		s.leases[i].Hostname = ""
 		return s.leases[i]
 	}
 
@@ -323,15 +325,59 @@ func (s *v6Server) reserveLease(mac net.HardwareAddr) *Lease {
 	return &l
 }
 
-func (s *v6Server) commitDynamicLease(l *Lease) {
+func (s *v6Server) commitDynamicLease(l *Lease, hostname string) {
 	l.Expiry = time.Now().Add(s.conf.leaseTime)
 
 	s.leasesLock.Lock()
+	s.setLeaseHostname(l, hostname)
 	s.conf.notify(LeaseChangedDBStore)
 	s.leasesLock.Unlock()
 	s.conf.notify(LeaseChangedAdded)
 }
 
+// setLeaseHostname sets the hostname of l unless hostname is empty or is already
+// used by another lease.  s.leasesLock is expected to be locked.
+func (s *v6Server) setLeaseHostname(l *Lease, hostname string) {
+	if hostname == "" || hostname == l.Hostname {
+		return
+	}
+
+	for _, other := range s.leases {
+		if other != l && other.Hostname == hostname {
+			log.Info("dhcpv6: hostname %q already exists", hostname)
+
+			return
+		}
+	}
+
+	l.Hostname = hostname
+}
+
+// clientHostname returns the normalized hostname from the Client FQDN option
+// of msg, see RFC 4704.  hostname is empty if there is no such option or the
+// hostname is invalid.  Only the first label of the domain name is used, since
+// the domain itself is set by the server.
+func clientHostname(msg *dhcpv6.Message) (hostname string) {
+	fqdn := msg.Options.FQDN()
+	if fqdn == nil || fqdn.DomainName == nil || len(fqdn.DomainName.Labels) == 0 {
+		return ""
+	}
+
+	label, _, _ := strings.Cut(fqdn.DomainName.Labels[0], ".")
+	hostname, err := normalizeHostname(label)
+	if err == nil && hostname != "" {
+		err = netutil.ValidateHostname(hostname)
+	}
+
+	if err != nil {
+		log.Info("dhcpv6: %s", err)
+
+		return ""
+	}
+
+	return hostname
+}
+
 // Check Client ID
 func (s *v6Server) checkCID(msg *dhcpv6.Message) error {
 	if msg.Options.ClientID() == nil {
@@ -411,7 +457,7 @@ func (s *v6Server) commitLease(msg *dhcpv6.Message, lease *Lease) time.Duration
 		dhcpv6.MessageTypeRebind:
 
 		if lease.Expiry.Unix() != leaseExpireStatic {
-			s.commitDynamicLease(lease)
+			s.commitDynamicLease(lease, clientHostname(msg))
 		}
 	}
 	return lifetime
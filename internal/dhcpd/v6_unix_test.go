@@ -8,6 +8,7 @@ import (
 
 	"github.com/insomniacslk/dhcp/dhcpv6"
 	"github.com/insomniacslk/dhcp/iana"
+	"github.com/insomniacslk/dhcp/rfc1035label"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -282,6 +283,68 @@ func TestV6GetDynamicLease(t *testing.T) {
 	})
 }
 
+func TestV6_process_hostname(t *testing.T) {
+	sIface, err := v6Create(V6ServerConf{
+		Enabled:    true,
+		RangeStart: net.ParseIP("2001::2"),
+		notify:     notify6,
+	})
+	require.NoError(t, err)
+
+	s, ok := sIface.(*v6Server)
+	require.True(t, ok)
+
+	s.sid = dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LLT,
+		HwType:        iana.HWTypeEthernet,
+		LinkLayerAddr: net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA},
+	}
+
+	request := func(mac net.HardwareAddr, fqdn string) {
+		req, reqErr := dhcpv6.NewSolicit(mac)
+		require.NoError(t, reqErr)
+
+		msg, reqErr := req.GetInnerMessage()
+		require.NoError(t, reqErr)
+
+		resp, reqErr := dhcpv6.NewAdvertiseFromSolicit(msg)
+		require.NoError(t, reqErr)
+		require.True(t, s.process(msg, req, resp))
+
+		resp.AddOption(dhcpv6.OptServerID(s.sid))
+
+		req, reqErr = dhcpv6.NewRequestFromAdvertise(resp)
+		require.NoError(t, reqErr)
+
+		msg, reqErr = req.GetInnerMessage()
+		require.NoError(t, reqErr)
+
+		msg.AddOption(&dhcpv6.OptFQDN{
+			DomainName: &rfc1035label.Labels{Labels: []string{fqdn}},
+		})
+
+		resp, reqErr = dhcpv6.NewReplyFromMessage(msg)
+		require.NoError(t, reqErr)
+		require.True(t, s.process(msg, req, resp))
+	}
+
+	mac1 := net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA}
+	mac2 := net.HardwareAddr{0xBB, 0xBB, 0xBB, 0xBB, 0xBB, 0xBB}
+
+	request(mac1, "My_Host.example.org")
+	request(mac2, "my-host")
+
+	ls := s.GetLeases(LeasesDynamic)
+	require.Len(t, ls, 2)
+
+	assert.Equal(t, mac1, ls[0].HWAddr)
+	assert.Equal(t, "my-host", ls[0].Hostname)
+
+	// The hostname is already taken by the first client.
+	assert.Equal(t, mac2, ls[1].HWAddr)
+	assert.Empty(t, ls[1].Hostname)
+}
+
 func TestIP6InRange(t *testing.T) {
 	start := net.ParseIP("2001::2")
 
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/netip"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
@@ -33,6 +34,10 @@ type accessManager struct {
 	// TODO(a.garipov): Create a type for a set of IP networks.
 	allowedNets []netip.Prefix
 	blockedNets []netip.Prefix
+
+	// temporary are the parsed temporary allowed clients, including the
+	// expired ones.
+	temporary []*temporaryAccess
 }
 
 // processAccessClients is a helper for processing a list of client strings,
@@ -64,7 +69,12 @@ func processAccessClients(
 }
 
 // newAccessCtx creates a new accessCtx.
-func newAccessCtx(allowed, blocked, blockedHosts []string) (a *accessManager, err error) {
+func newAccessCtx(
+	allowed []string,
+	blocked []string,
+	blockedHosts []string,
+	temporary []*TemporaryAccessClient,
+) (a *accessManager, err error) {
 	a = &accessManager{
 		allowedIPs: map[netip.Addr]unit{},
 		blockedIPs: map[netip.Addr]unit{},
@@ -83,6 +93,11 @@ func newAccessCtx(allowed, blocked, blockedHosts []string) (a *accessManager, er
 		return nil, fmt.Errorf("adding blocked: %w", err)
 	}
 
+	a.temporary, err = newTemporaryAccesses(temporary)
+	if err != nil {
+		return nil, fmt.Errorf("adding temporary allowed: %w", err)
+	}
+
 	b := &strings.Builder{}
 	for _, h := range blockedHosts {
 		stringutil.WriteToBuilder(b, strings.ToLower(h), "\n")
@@ -127,6 +142,22 @@ func (a *accessManager) isBlockedClientID(id string) (ok bool) {
 	return a.blockedClientIDs.Has(id)
 }
 
+// isTemporarilyAllowed returns true if the client with ip and clientID is
+// allowed by one of the temporary entries at now.  ip may be unset.
+func (a *accessManager) isTemporarilyAllowed(
+	ip netip.Addr,
+	clientID string,
+	now time.Time,
+) (ok bool) {
+	for _, t := range a.temporary {
+		if t.allows(ip, clientID, now) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // isBlockedHost returns true if host should be blocked.
 func (a *accessManager) isBlockedHost(host string, qt rules.RRType) (ok bool) {
 	_, ok = a.blockedHostsEng.MatchRequest(&urlfilter.DNSRequest{
@@ -182,8 +213,28 @@ func (s *Server) accessListJSON() (j accessListJSON) {
 	}
 }
 
+// accessListRespJSON is the response for the GET /control/access/list HTTP
+// API.
+type accessListRespJSON struct {
+	accessListJSON
+
+	// TemporaryAllowedClients are the unexpired temporary allowed clients.
+	TemporaryAllowedClients []*TemporaryAccessClient `json:"temporary_allowed_clients"`
+}
+
 func (s *Server) handleAccessList(w http.ResponseWriter, r *http.Request) {
-	_ = aghhttp.WriteJSONResponse(w, r, s.accessListJSON())
+	s.serverLock.RLock()
+	temporary := unexpiredTemporaryClients(s.conf.TemporaryAllowedClients, time.Now())
+	s.serverLock.RUnlock()
+
+	if temporary == nil {
+		temporary = []*TemporaryAccessClient{}
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, &accessListRespJSON{
+		accessListJSON:          s.accessListJSON(),
+		TemporaryAllowedClients: temporary,
+	})
 }
 
 // validateAccessSet checks the internal accessListJSON lists.  To search for
@@ -241,7 +292,7 @@ func (s *Server) handleAccessSet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var a *accessManager
-	a, err = newAccessCtx(list.AllowedClients, list.DisallowedClients, list.BlockedHosts)
+	a, err = newAccessCtx(list.AllowedClients, list.DisallowedClients, list.BlockedHosts, nil)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "creating access ctx: %s", err)
 
@@ -263,5 +314,8 @@ func (s *Server) handleAccessSet(w http.ResponseWriter, r *http.Request) {
 	s.conf.AllowedClients = list.AllowedClients
 	s.conf.DisallowedClients = list.DisallowedClients
 	s.conf.BlockedHosts = list.BlockedHosts
+
+	// Keep the temporary allowed clients, since they're managed separately.
+	a.temporary = s.access.temporary
 	s.access = a
 }
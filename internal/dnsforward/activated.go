@@ -0,0 +1,140 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// startActivated starts serving the queries from the sockets passed by the
+// service manager, if any.  The duplicates of the sockets are used, so that
+// stopping the server leaves the passed ones open for the next start.
+// s.dnsProxy must be initialized.
+func (s *Server) startActivated() (err error) {
+	for _, l := range s.conf.ActivatedTCPListeners {
+		var dup net.Listener
+		dup, err = aghnet.DupListener(l)
+		if err != nil {
+			s.stopActivated()
+
+			return fmt.Errorf("duplicating activated listener %s: %w", l.Addr(), err)
+		}
+
+		s.activatedListeners = append(s.activatedListeners, dup)
+		go s.serveProxyProto(s.dnsProxy, dup, proxy.ProtoTCP, nil)
+
+		log.Info("dnsforward: listening to tcp://%s from service manager", dup.Addr())
+	}
+
+	for _, c := range s.conf.ActivatedUDPConns {
+		var dup *net.UDPConn
+		dup, err = aghnet.DupUDPConn(c)
+		if err != nil {
+			s.stopActivated()
+
+			return fmt.Errorf("duplicating activated conn %s: %w", c.LocalAddr(), err)
+		}
+
+		s.activatedConns = append(s.activatedConns, dup)
+		go s.serveActivatedUDP(dup)
+
+		log.Info("dnsforward: listening to udp://%s from service manager", dup.LocalAddr())
+	}
+
+	return nil
+}
+
+// stopActivated closes the duplicates of the sockets started by
+// s.startActivated.
+func (s *Server) stopActivated() {
+	for _, l := range s.activatedListeners {
+		err := l.Close()
+		if err != nil {
+			log.Error("dnsforward: closing activated listener %s: %s", l.Addr(), err)
+		}
+	}
+
+	for _, c := range s.activatedConns {
+		err := c.Close()
+		if err != nil {
+			log.Error("dnsforward: closing activated conn %s: %s", c.LocalAddr(), err)
+		}
+	}
+
+	s.activatedListeners, s.activatedConns = nil, nil
+}
+
+// serveActivatedUDP reads the queries from conn until it's closed.  It's
+// intended to be used as a goroutine.
+func (s *Server) serveActivatedUDP(conn *net.UDPConn) {
+	defer log.OnPanic("dnsforward: serving activated udp")
+
+	for {
+		buf := make([]byte, dns.MaxMsgSize)
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Debug("dnsforward: udp: activated conn closed")
+
+				return
+			}
+
+			log.Debug("dnsforward: udp: reading query: %s", err)
+
+			continue
+		}
+
+		go s.handleActivatedUDP(conn, buf[:n], addr)
+	}
+}
+
+// handleActivatedUDP passes the query from packet to the request handlers of
+// the current proxy and writes the response back to addr using conn.
+func (s *Server) handleActivatedUDP(conn *net.UDPConn, packet []byte, addr *net.UDPAddr) {
+	defer log.OnPanic("dnsforward: handling activated udp query")
+
+	prx := s.proxy()
+	if prx == nil {
+		return
+	}
+
+	req := &dns.Msg{}
+	err := req.Unpack(packet)
+	if err != nil {
+		log.Debug("dnsforward: udp: unpacking query from %s: %s", addr, err)
+
+		return
+	}
+
+	pctx := &proxy.DNSContext{
+		Proto:     proxy.ProtoUDP,
+		Req:       req,
+		Addr:      addr,
+		Conn:      conn,
+		StartTime: time.Now(),
+	}
+
+	if !serveRequest(prx, pctx) || pctx.Res == nil {
+		return
+	}
+
+	pctx.Res.Truncate(respMaxSize(pctx))
+
+	data, err := pctx.Res.Pack()
+	if err != nil {
+		log.Error("dnsforward: udp: packing response: %s", err)
+
+		return
+	}
+
+	_, err = conn.WriteToUDP(data, addr)
+	if err != nil {
+		log.Debug("dnsforward: udp: writing response to %s: %s", addr, err)
+	}
+}
@@ -0,0 +1,80 @@
+//go:build darwin || freebsd || linux || openbsd
+
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_activated(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, c.Close)
+
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs:        []*net.UDPAddr{{}},
+		TCPListenAddrs:        []*net.TCPAddr{{}},
+		ActivatedTCPListeners: []*net.TCPListener{l},
+		ActivatedUDPConns:     []*net.UDPConn{c},
+		FilteringConfig: FilteringConfig{
+			ProtectionEnabled: true,
+			EDNSClientSubnet:  &EDNSClientSubnet{Enabled: false},
+		},
+	}, nil)
+
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{newGoogleUpstream()}
+
+	require.Nil(t, s.dnsProxy.TCPListenAddr)
+	require.Nil(t, s.dnsProxy.UDPListenAddr)
+
+	startDeferStop(t, s)
+
+	assert.Nil(t, s.listenProxy)
+	require.Len(t, s.activatedListeners, 1)
+	require.Len(t, s.activatedConns, 1)
+
+	for _, netw := range []string{"tcp", "udp"} {
+		addr := l.Addr().String()
+		if netw == "udp" {
+			addr = c.LocalAddr().String()
+		}
+
+		t.Run(netw, func(t *testing.T) {
+			client := &dns.Client{Net: netw}
+			resp, _, exchErr := client.Exchange(createGoogleATestMessage(), addr)
+			require.NoError(t, exchErr)
+
+			assertGoogleAResponse(t, resp)
+		})
+	}
+
+	t.Run("restart", func(t *testing.T) {
+		require.NoError(t, s.Stop())
+
+		// The sockets passed by the service manager are kept open.
+		assert.NoError(t, l.SetDeadline(time.Time{}))
+		assert.NoError(t, c.SetDeadline(time.Time{}))
+
+		require.NoError(t, s.Start())
+		require.Len(t, s.activatedConns, 1)
+
+		client := &dns.Client{Net: "udp"}
+		resp, _, exchErr := client.Exchange(createGoogleATestMessage(), c.LocalAddr().String())
+		require.NoError(t, exchErr)
+
+		assertGoogleAResponse(t, resp)
+	})
+}
@@ -0,0 +1,195 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+// AnswerRules are the post-processing rules applied to the answer section of
+// the responses received from the upstreams before returning them to the
+// clients.  Each rule is one of the following:
+//
+//	strip TYPE
+//	strip_ech
+//	ttl SECONDS
+//
+// The strip rule removes the records of the type TYPE, for example AAAA or
+// HTTPS, from the answer section.  The strip_ech rule removes the ECH
+// configurations from the HTTPS and SVCB records.  The ttl rule sets the TTL of
+// all records of the answer section to SECONDS.  A nil *AnswerRules changes
+// nothing.
+type AnswerRules struct {
+	// ttl is the TTL set to the records.  It's only used if setTTL is true.
+	ttl uint32
+
+	// stripTypes are the types of the records removed from the answers.
+	stripTypes []uint16
+
+	// stripECH, if true, removes the ECH configurations from the HTTPS and
+	// SVCB records.
+	stripECH bool
+
+	// setTTL, if true, sets the TTL of the records to ttl.
+	setTTL bool
+}
+
+// ParseAnswerRules parses the answer post-processing rules, see [AnswerRules].
+// Empty lines and comments, see [IsCommentOrEmpty], are skipped.  rules is nil
+// if lines contain no rules.
+func ParseAnswerRules(lines []string) (rules *AnswerRules, err error) {
+	ar := &AnswerRules{}
+	hasRules := false
+	for i, l := range lines {
+		l = strings.TrimSpace(l)
+		if IsCommentOrEmpty(l) {
+			continue
+		}
+
+		err = ar.parseRule(l)
+		if err != nil {
+			return nil, fmt.Errorf("answer rule at index %d: %w", i, err)
+		}
+
+		hasRules = true
+	}
+
+	if !hasRules {
+		return nil, nil
+	}
+
+	return ar, nil
+}
+
+// parseRule parses a single rule from l and adds it to ar.
+func (ar *AnswerRules) parseRule(l string) (err error) {
+	fields := strings.Fields(l)
+	switch name := fields[0]; name {
+	case "strip_ech":
+		if len(fields) != 1 {
+			return fmt.Errorf("%s: unexpected arguments", name)
+		}
+
+		ar.stripECH = true
+	case "strip":
+		if len(fields) != 2 {
+			return fmt.Errorf("%s: want 1 argument, got %d", name, len(fields)-1)
+		}
+
+		rrType, ok := dns.StringToType[strings.ToUpper(fields[1])]
+		if !ok {
+			return fmt.Errorf("%s: unknown record type %q", name, fields[1])
+		}
+
+		if !slices.Contains(ar.stripTypes, rrType) {
+			ar.stripTypes = append(ar.stripTypes, rrType)
+		}
+	case "ttl":
+		if len(fields) != 2 {
+			return fmt.Errorf("%s: want 1 argument, got %d", name, len(fields)-1)
+		}
+
+		var ttl uint64
+		ttl, err = strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		ar.ttl, ar.setTTL = uint32(ttl), true
+	default:
+		return fmt.Errorf("unknown rule %q", name)
+	}
+
+	return nil
+}
+
+// apply applies the rules to the answer section of resp.  resp must not be
+// shared, since its records are modified in place.  ar may be nil.
+func (ar *AnswerRules) apply(resp *dns.Msg) {
+	if ar == nil {
+		return
+	}
+
+	answer := resp.Answer[:0]
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		if slices.Contains(ar.stripTypes, hdr.Rrtype) {
+			continue
+		}
+
+		if ar.stripECH {
+			stripSVCBKey(rr, dns.SVCB_ECHCONFIG)
+		}
+
+		if ar.setTTL {
+			hdr.Ttl = ar.ttl
+		}
+
+		answer = append(answer, rr)
+	}
+
+	resp.Answer = answer
+}
+
+// stripSVCBKey removes the parameters with key from rr if it's either an
+// HTTPS or an SVCB record.
+func stripSVCBKey(rr dns.RR, key dns.SVCBKey) {
+	var svcb *dns.SVCB
+	switch rr := rr.(type) {
+	case *dns.HTTPS:
+		svcb = &rr.SVCB
+	case *dns.SVCB:
+		svcb = rr
+	default:
+		return
+	}
+
+	vals := svcb.Value[:0]
+	for _, kv := range svcb.Value {
+		if kv.Key() != key {
+			vals = append(vals, kv)
+		}
+	}
+
+	svcb.Value = vals
+}
+
+// processAnswerRules applies the global and the client-specific answer
+// post-processing rules to the response received from the upstream.  The
+// global rules are applied first.
+func (s *Server) processAnswerRules(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	res := dctx.result
+	if !dctx.responseFromUpstream || (res.IsFiltered && !res.DryRun) || pctx.Res == nil {
+		return resultCodeSuccess
+	}
+
+	clientRules := s.clientAnswerRules(dctx)
+	if s.answerRules == nil && clientRules == nil {
+		return resultCodeSuccess
+	}
+
+	// Copy the response, since its records may be shared with the caches.
+	pctx.Res = pctx.Res.Copy()
+	s.answerRules.apply(pctx.Res)
+	clientRules.apply(pctx.Res)
+
+	return resultCodeSuccess
+}
+
+// clientAnswerRules returns the answer post-processing rules of the client of
+// the request, if any.
+func (s *Server) clientAnswerRules(dctx *dnsContext) (rules *AnswerRules) {
+	rulesByClient := s.conf.GetAnswerRulesByClient
+	pctx := dctx.proxyCtx
+	if pctx.Addr == nil || rulesByClient == nil {
+		return nil
+	}
+
+	// Use the ClientID first, since it has a higher priority.
+	return rulesByClient(stringutil.Coalesce(dctx.clientID, ipStringFromAddr(pctx.Addr)))
+}
@@ -0,0 +1,201 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAnswerRules(t *testing.T) {
+	testCases := []struct {
+		want       *AnswerRules
+		name       string
+		wantErrMsg string
+		lines      []string
+	}{{
+		want:       nil,
+		name:       "empty",
+		wantErrMsg: "",
+		lines:      []string{"", "# comment"},
+	}, {
+		want: &AnswerRules{
+			ttl:        60,
+			stripTypes: []uint16{dns.TypeAAAA, dns.TypeHTTPS},
+			stripECH:   true,
+			setTTL:     true,
+		},
+		name:       "all",
+		wantErrMsg: "",
+		lines:      []string{"strip AAAA", "strip https", "strip aaaa", "strip_ech", " ttl 60 "},
+	}, {
+		want:       nil,
+		name:       "unknown_rule",
+		wantErrMsg: `answer rule at index 1: unknown rule "drop"`,
+		lines:      []string{"", "drop A"},
+	}, {
+		want:       nil,
+		name:       "unknown_type",
+		wantErrMsg: `answer rule at index 0: strip: unknown record type "BAD"`,
+		lines:      []string{"strip BAD"},
+	}, {
+		want:       nil,
+		name:       "no_type",
+		wantErrMsg: `answer rule at index 0: strip: want 1 argument, got 0`,
+		lines:      []string{"strip"},
+	}, {
+		want:       nil,
+		name:       "ech_args",
+		wantErrMsg: `answer rule at index 0: strip_ech: unexpected arguments`,
+		lines:      []string{"strip_ech all"},
+	}, {
+		want: nil,
+		name: "bad_ttl",
+		wantErrMsg: `answer rule at index 0: ttl: strconv.ParseUint: ` +
+			`parsing "-1": invalid syntax`,
+		lines: []string{"ttl -1"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := ParseAnswerRules(tc.lines)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, rules)
+		})
+	}
+}
+
+// newTestHTTPSRR returns a new HTTPS record for name with an ALPN and an ECH
+// configuration values.
+func newTestHTTPSRR(name string, ttl uint32) (rr *dns.HTTPS) {
+	return &dns.HTTPS{
+		SVCB: dns.SVCB{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeHTTPS,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Priority: 1,
+			Target:   ".",
+			Value: []dns.SVCBKeyValue{
+				&dns.SVCBAlpn{Alpn: []string{"h2"}},
+				&dns.SVCBECHConfig{ECH: []byte{1, 2, 3}},
+			},
+		},
+	}
+}
+
+func TestServer_processAnswerRules(t *testing.T) {
+	const (
+		host    = "example.org."
+		ttl     = 3600
+		newTTL  = 60
+		cliAddr = "1.2.3.4"
+	)
+
+	globalRules, err := ParseAnswerRules([]string{"strip_ech"})
+	require.NoError(t, err)
+
+	cliRules, err := ParseAnswerRules([]string{"strip AAAA", "ttl 60"})
+	require.NoError(t, err)
+
+	s := &Server{
+		answerRules: globalRules,
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				GetAnswerRulesByClient: func(id string) (rules *AnswerRules) {
+					if id == cliAddr {
+						return cliRules
+					}
+
+					return nil
+				},
+			},
+		},
+	}
+
+	newResp := func() (resp *dns.Msg) {
+		return &dns.Msg{
+			Answer: []dns.RR{
+				newRR(t, host, dns.TypeA, ttl, net.IP{1, 2, 3, 4}),
+				newRR(t, host, dns.TypeAAAA, ttl, net.ParseIP("2001:db8::1")),
+				newTestHTTPSRR(host, ttl),
+			},
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		addr       string
+		wantTypes  []uint16
+		wantTTL    uint32
+		isFiltered bool
+		wantECH    bool
+	}{{
+		name:       "global",
+		addr:       "5.6.7.8",
+		wantTypes:  []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeHTTPS},
+		wantTTL:    ttl,
+		isFiltered: false,
+		wantECH:    false,
+	}, {
+		name:       "client",
+		addr:       cliAddr,
+		wantTypes:  []uint16{dns.TypeA, dns.TypeHTTPS},
+		wantTTL:    newTTL,
+		isFiltered: false,
+		wantECH:    false,
+	}, {
+		name:       "filtered",
+		addr:       cliAddr,
+		wantTypes:  []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeHTTPS},
+		wantTTL:    ttl,
+		isFiltered: true,
+		wantECH:    true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			orig := newResp()
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Addr: &net.UDPAddr{IP: net.ParseIP(tc.addr), Port: 53},
+					Res:  orig,
+				},
+				result:               &filtering.Result{IsFiltered: tc.isFiltered},
+				responseFromUpstream: true,
+			}
+
+			rc := s.processAnswerRules(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			resp := dctx.proxyCtx.Res
+			require.Len(t, resp.Answer, len(tc.wantTypes))
+
+			for i, rr := range resp.Answer {
+				hdr := rr.Header()
+				assert.Equal(t, tc.wantTypes[i], hdr.Rrtype)
+				assert.Equal(t, tc.wantTTL, hdr.Ttl)
+			}
+
+			https := testutil.RequireTypeAssert[*dns.HTTPS](t, resp.Answer[len(resp.Answer)-1])
+			hasECH := false
+			for _, kv := range https.Value {
+				hasECH = hasECH || kv.Key() == dns.SVCB_ECHCONFIG
+			}
+
+			assert.Equal(t, tc.wantECH, hasECH)
+
+			// The original response must not be modified.
+			assert.Len(t, orig.Answer, 3)
+			assert.Len(t, testutil.RequireTypeAssert[*dns.HTTPS](t, orig.Answer[2]).Value, 2)
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// BlockedResponseSOA is the contents of the SOA record synthesized for the
+// blocked and NXDOMAIN responses.  The zero fields are replaced with the default
+// values, see defaultSOA.  The TTL of the record is
+// [FilteringConfig.BlockedResponseTTL].
+type BlockedResponseSOA struct {
+	// NS is the primary name server of the zone.
+	NS string `yaml:"ns" json:"ns"`
+
+	// Mbox is the mailbox of the person responsible for the zone.  If empty,
+	// "hostmaster." followed by the requested domain name is used.
+	Mbox string `yaml:"mbox" json:"mbox"`
+
+	// Serial is the serial number of the zone.
+	Serial uint32 `yaml:"serial" json:"serial"`
+
+	// Refresh is the refresh interval of the zone in seconds.
+	Refresh uint32 `yaml:"refresh" json:"refresh"`
+
+	// Retry is the retry interval of the zone in seconds.
+	Retry uint32 `yaml:"retry" json:"retry"`
+
+	// Expire is the expiration interval of the zone in seconds.
+	Expire uint32 `yaml:"expire" json:"expire"`
+
+	// MinTTL is the negative caching TTL in seconds.  Note that resolvers use
+	// the minimum of it and the TTL of the record itself.
+	MinTTL uint32 `yaml:"min_ttl" json:"min_ttl"`
+}
+
+// defaultSOA is the default contents of the synthesized SOA record.  The
+// values of the intervals are copied from VeriSign's nonexistent .com domain.
+// Their exact values are not important in our use case, because they are used
+// for domain transfers between primary and secondary DNS servers.  The name
+// server and the serial number are copied from AdGuard DNS.
+var defaultSOA = BlockedResponseSOA{
+	NS:      "fake-for-negative-caching.adguard.com.",
+	Serial:  100500,
+	Refresh: 1800,
+	Retry:   900,
+	Expire:  604800,
+	MinTTL:  86400,
+}
+
+// withDefaults returns a copy of soa with the zero fields replaced with the
+// default values.  Mbox is kept empty, since its default value depends on the
+// request.
+func (soa BlockedResponseSOA) withDefaults() (res BlockedResponseSOA) {
+	return BlockedResponseSOA{
+		NS:      aghalg.Coalesce(soa.NS, defaultSOA.NS),
+		Mbox:    soa.Mbox,
+		Serial:  aghalg.Coalesce(soa.Serial, defaultSOA.Serial),
+		Refresh: aghalg.Coalesce(soa.Refresh, defaultSOA.Refresh),
+		Retry:   aghalg.Coalesce(soa.Retry, defaultSOA.Retry),
+		Expire:  aghalg.Coalesce(soa.Expire, defaultSOA.Expire),
+		MinTTL:  aghalg.Coalesce(soa.MinTTL, defaultSOA.MinTTL),
+	}
+}
+
+// validate returns an error if soa contains invalid domain names.
+func (soa *BlockedResponseSOA) validate() (err error) {
+	for _, f := range []struct {
+		name string
+		val  string
+	}{{
+		name: "ns",
+		val:  soa.NS,
+	}, {
+		name: "mbox",
+		val:  soa.Mbox,
+	}} {
+		if f.val == "" {
+			continue
+		}
+
+		err = netutil.ValidateDomainName(strings.TrimSuffix(f.val, "."))
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+
+	return nil
+}
+
+// normalize makes the domain names in soa fully qualified.
+func (soa *BlockedResponseSOA) normalize() {
+	if soa.NS != "" {
+		soa.NS = dns.Fqdn(soa.NS)
+	}
+
+	if soa.Mbox != "" {
+		soa.Mbox = dns.Fqdn(soa.Mbox)
+	}
+}
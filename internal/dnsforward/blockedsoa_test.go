@@ -0,0 +1,78 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_genSOA(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("blocked.example.", dns.TypeA)
+
+	testCases := []struct {
+		name string
+		want *dns.SOA
+		conf FilteringConfig
+	}{{
+		name: "default",
+		want: &dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   "blocked.example.",
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    defaultValues.BlockedResponseTTL,
+			},
+			Ns:      "fake-for-negative-caching.adguard.com.",
+			Mbox:    "hostmaster.blocked.example.",
+			Serial:  100500,
+			Refresh: 1800,
+			Retry:   900,
+			Expire:  604800,
+			Minttl:  86400,
+		},
+		conf: FilteringConfig{},
+	}, {
+		name: "custom",
+		want: &dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   "blocked.example.",
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    300,
+			},
+			Ns:      "ns.example.org.",
+			Mbox:    "hostmaster.example.org.",
+			Serial:  1,
+			Refresh: 1800,
+			Retry:   900,
+			Expire:  604800,
+			Minttl:  60,
+		},
+		conf: FilteringConfig{
+			BlockedResponseTTL: 300,
+			BlockedResponseSOA: BlockedResponseSOA{
+				NS:     "ns.example.org.",
+				Mbox:   "hostmaster.example.org.",
+				Serial: 1,
+				MinTTL: 60,
+			},
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				conf: ServerConfig{
+					FilteringConfig: tc.conf,
+				},
+			}
+
+			rrs := s.genSOA(req)
+			require.Len(t, rrs, 1)
+
+			assert.Equal(t, tc.want, rrs[0])
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// captureTTL is the TTL of the answers to the captured clients in seconds.
+// It's short, so that the clients stop using the capture address soon after
+// they are acknowledged.
+const captureTTL = 10
+
+// processCapture answers the requests of the captured local clients with the
+// capture address for the A queries and empty responses for the rest, so that
+// the clients are redirected to the landing page until acknowledged.
+func (s *Server) processCapture(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if pctx.Res != nil || !dctx.isLocalClient || s.conf.GetCaptureIPByClient == nil {
+		return resultCodeSuccess
+	}
+
+	ip, _ := netutil.IPAndPortFromAddr(pctx.Addr)
+	if ip == nil {
+		return resultCodeSuccess
+	}
+
+	captureIP := s.conf.GetCaptureIPByClient(ip)
+	if captureIP == nil {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dnsforward: capturing request %q from %s", pctx.Req.Question[0].Name, ip)
+
+	req := pctx.Req
+	resp := s.makeResponse(req)
+	if req.Question[0].Qtype == dns.TypeA {
+		ans := s.genAnswerA(req, captureIP)
+		ans.Hdr.Ttl = captureTTL
+		resp.Answer = append(resp.Answer, ans)
+	}
+
+	pctx.Res = resp
+
+	return resultCodeSuccess
+}
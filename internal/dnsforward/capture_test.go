@@ -0,0 +1,104 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_processCapture(t *testing.T) {
+	captureIP := net.IP{192, 168, 0, 1}
+	capturedIP := net.IP{192, 168, 0, 2}
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				GetCaptureIPByClient: func(ip net.IP) (addr net.IP) {
+					if ip.Equal(capturedIP) {
+						return captureIP
+					}
+
+					return nil
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		ip         net.IP
+		name       string
+		qtype      uint16
+		isLocal    bool
+		wantAnswer bool
+		wantNoData bool
+	}{{
+		ip:         capturedIP,
+		name:       "captured_a",
+		qtype:      dns.TypeA,
+		isLocal:    true,
+		wantAnswer: true,
+		wantNoData: false,
+	}, {
+		ip:         capturedIP,
+		name:       "captured_aaaa",
+		qtype:      dns.TypeAAAA,
+		isLocal:    true,
+		wantAnswer: true,
+		wantNoData: true,
+	}, {
+		ip:         net.IP{192, 168, 0, 3},
+		name:       "acknowledged",
+		qtype:      dns.TypeA,
+		isLocal:    true,
+		wantAnswer: false,
+		wantNoData: false,
+	}, {
+		ip:         capturedIP,
+		name:       "not_local",
+		qtype:      dns.TypeA,
+		isLocal:    false,
+		wantAnswer: false,
+		wantNoData: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req:  (&dns.Msg{}).SetQuestion("example.org.", tc.qtype),
+					Addr: &net.UDPAddr{IP: tc.ip, Port: 53},
+				},
+				isLocalClient: tc.isLocal,
+			}
+
+			rc := s.processCapture(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			res := dctx.proxyCtx.Res
+			if !tc.wantAnswer {
+				assert.Nil(t, res)
+
+				return
+			}
+
+			require.NotNil(t, res)
+
+			if tc.wantNoData {
+				assert.Empty(t, res.Answer)
+
+				return
+			}
+
+			require.Len(t, res.Answer, 1)
+
+			a := testutil.RequireTypeAssert[*dns.A](t, res.Answer[0])
+			assert.Equal(t, captureIP.To16(), a.A.To16())
+			assert.Equal(t, uint32(captureTTL), a.Hdr.Ttl)
+		})
+	}
+}
@@ -8,7 +8,9 @@ import (
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 )
 
@@ -107,12 +109,72 @@ type quicConnection interface {
 	ConnectionState() (cs quic.ConnectionState)
 }
 
+// clientIDEDNSOption is the code of the private-use EDNS0 option containing
+// the ClientID of a plain DNS request.  It's the same one dnsmasq uses for its
+// --add-cpe-id option.
+const clientIDEDNSOption uint16 = 65074
+
+// clientIDFromEDNS extracts the ClientID from the EDNS0 option of req and
+// removes the option, so that it isn't forwarded upstream.  If trusted is
+// false, the option is removed but ignored, since anyone could set it.
+func clientIDFromEDNS(req *dns.Msg, trusted bool) (clientID string, err error) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return "", nil
+	}
+
+	var data []byte
+	found := false
+	opts := opt.Option[:0]
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == clientIDEDNSOption {
+			data, found = local.Data, true
+
+			continue
+		}
+
+		opts = append(opts, o)
+	}
+
+	opt.Option = opts
+	if !found {
+		return "", nil
+	} else if !trusted {
+		log.Debug("dnsforward: ignoring edns clientid from untrusted address")
+
+		return "", nil
+	}
+
+	clientID = string(data)
+	err = ValidateClientID(clientID)
+	if err != nil {
+		return "", fmt.Errorf("clientid check: %w", err)
+	}
+
+	return strings.ToLower(clientID), nil
+}
+
 // clientIDFromDNSContext extracts the client's ID from the server name of the
-// client's DoT or DoQ request or the path of the client's DoH.  If the protocol
-// is not one of these, clientID is an empty string and err is nil.
+// client's DoT or DoQ request or the path of the client's DoH.  For plain DNS
+// requests, it extracts the ID from the EDNS0 option, if it's enabled and the
+// request comes from one of the trusted proxies.  If the protocol is not one of
+// these, clientID is an empty string and err is nil.
 func (s *Server) clientIDFromDNSContext(pctx *proxy.DNSContext) (clientID string, err error) {
 	proto := pctx.Proto
-	if proto == proxy.ProtoHTTPS {
+	if proto == proxy.ProtoUDP || proto == proxy.ProtoTCP {
+		if !s.conf.EDNSClientID {
+			return "", nil
+		}
+
+		ip, _ := netutil.IPAndPortFromAddr(pctx.Addr)
+		trusted := s.trustedProxies != nil && s.trustedProxies.Contains(ip)
+		clientID, err = clientIDFromEDNS(pctx.Req, trusted)
+		if err != nil {
+			return "", fmt.Errorf("checking edns: %w", err)
+		}
+
+		return clientID, nil
+	} else if proto == proxy.ProtoHTTPS {
 		clientID, err = clientIDFromDNSContextHTTPS(pctx)
 		if err != nil {
 			return "", fmt.Errorf("checking url: %w", err)
@@ -125,8 +187,7 @@ func (s *Server) clientIDFromDNSContext(pctx *proxy.DNSContext) (clientID string
 		return "", nil
 	}
 
-	hostSrvName := s.conf.ServerName
-	if hostSrvName == "" {
+	if s.conf.ServerName == "" && len(s.conf.wildcardBases) == 0 {
 		return "", nil
 	}
 
@@ -135,6 +196,11 @@ func (s *Server) clientIDFromDNSContext(pctx *proxy.DNSContext) (clientID string
 		return "", err
 	}
 
+	hostSrvName := s.hostServerName(cliSrvName)
+	if hostSrvName == "" {
+		return "", nil
+	}
+
 	clientID, err = clientIDFromClientServerName(
 		hostSrvName,
 		cliSrvName,
@@ -147,6 +213,25 @@ func (s *Server) clientIDFromDNSContext(pctx *proxy.DNSContext) (clientID string
 	return clientID, nil
 }
 
+// hostServerName returns the server name of the host to extract the ClientID
+// from cliSrvName with.  It's the configured server name, if any.  Otherwise,
+// it's the parent domain of the certificate's wildcard name matching
+// cliSrvName, so that the deployments with wildcard certificates don't need to
+// configure it.  hostSrvName is empty if there is no such name.
+func (s *Server) hostServerName(cliSrvName string) (hostSrvName string) {
+	if s.conf.ServerName != "" {
+		return s.conf.ServerName
+	}
+
+	for _, base := range s.conf.wildcardBases {
+		if netutil.IsImmediateSubdomain(cliSrvName, base) {
+			return base
+		}
+	}
+
+	return ""
+}
+
 // clientServerName returns the TLS server name based on the protocol.  For
 // DNS-over-HTTPS requests, it will return the hostname part of the Host header
 // if there is one.
@@ -8,9 +8,12 @@ import (
 	"testing"
 
 	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // testTLSConn is a tlsConn for tests.
@@ -364,3 +367,189 @@ func TestClientIDFromDNSContextHTTPS(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_clientIDFromDNSContext_edns(t *testing.T) {
+	const ecsCode = dns.EDNS0SUBNET
+
+	newReq := func(opts ...dns.EDNS0) (req *dns.Msg) {
+		req = (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, opts...)
+
+		return req
+	}
+
+	newIDOpt := func(id string) (o *dns.EDNS0_LOCAL) {
+		return &dns.EDNS0_LOCAL{Code: clientIDEDNSOption, Data: []byte(id)}
+	}
+
+	trustedAddr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 53}
+	untrustedAddr := &net.UDPAddr{IP: net.IP{192, 168, 0, 2}, Port: 53}
+
+	testCases := []struct {
+		req          *dns.Msg
+		addr         net.Addr
+		name         string
+		wantClientID string
+		wantErrMsg   string
+		wantOpts     int
+		enabled      bool
+	}{{
+		req:          newReq(newIDOpt("cli")),
+		addr:         trustedAddr,
+		name:         "disabled",
+		wantClientID: "",
+		wantErrMsg:   "",
+		wantOpts:     1,
+		enabled:      false,
+	}, {
+		req:          (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA),
+		addr:         trustedAddr,
+		name:         "no_edns",
+		wantClientID: "",
+		wantErrMsg:   "",
+		wantOpts:     0,
+		enabled:      true,
+	}, {
+		req:          newReq(&dns.EDNS0_SUBNET{Code: ecsCode, Family: 1}),
+		addr:         trustedAddr,
+		name:         "no_option",
+		wantClientID: "",
+		wantErrMsg:   "",
+		wantOpts:     1,
+		enabled:      true,
+	}, {
+		req:          newReq(newIDOpt("Cli"), &dns.EDNS0_SUBNET{Code: ecsCode, Family: 1}),
+		addr:         trustedAddr,
+		name:         "clientid",
+		wantClientID: "cli",
+		wantErrMsg:   "",
+		wantOpts:     1,
+		enabled:      true,
+	}, {
+		req:          newReq(newIDOpt("cli"), &dns.EDNS0_SUBNET{Code: ecsCode, Family: 1}),
+		addr:         untrustedAddr,
+		name:         "untrusted",
+		wantClientID: "",
+		wantErrMsg:   "",
+		wantOpts:     1,
+		enabled:      true,
+	}, {
+		req:          newReq(newIDOpt("!!!")),
+		addr:         untrustedAddr,
+		name:         "untrusted_invalid_clientid",
+		wantClientID: "",
+		wantErrMsg:   "",
+		wantOpts:     0,
+		enabled:      true,
+	}, {
+		req:          newReq(newIDOpt("!!!")),
+		addr:         trustedAddr,
+		name:         "invalid_clientid",
+		wantClientID: "",
+		wantErrMsg: `checking edns: clientid check: invalid clientid "!!!": ` +
+			`bad hostname label rune '!'`,
+		wantOpts: 0,
+		enabled:  true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := &Server{
+				conf: ServerConfig{
+					FilteringConfig: FilteringConfig{EDNSClientID: tc.enabled},
+				},
+				trustedProxies: netutil.SliceSubnetSet{{
+					IP:   net.IP{127, 0, 0, 0},
+					Mask: net.CIDRMask(8, netutil.IPv4BitLen),
+				}},
+			}
+
+			pctx := &proxy.DNSContext{
+				Proto: proxy.ProtoUDP,
+				Req:   tc.req,
+				Addr:  tc.addr,
+			}
+
+			clientID, err := srv.clientIDFromDNSContext(pctx)
+			assert.Equal(t, tc.wantClientID, clientID)
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			var opts []dns.EDNS0
+			if opt := tc.req.IsEdns0(); opt != nil {
+				opts = opt.Option
+			}
+
+			assert.Len(t, opts, tc.wantOpts)
+		})
+	}
+}
+
+func TestServer_clientIDFromDNSContext_wildcard(t *testing.T) {
+	srv := &Server{
+		conf: ServerConfig{
+			TLSConfig: TLSConfig{
+				StrictSNICheck: true,
+				wildcardBases:  []string{"dns.example", "dns.example.net"},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name         string
+		proto        proxy.Proto
+		cliSrvName   string
+		wantClientID string
+	}{{
+		name:         "tls_clientid",
+		proto:        proxy.ProtoTLS,
+		cliSrvName:   "cli.dns.example",
+		wantClientID: "cli",
+	}, {
+		name:         "quic_clientid",
+		proto:        proxy.ProtoQUIC,
+		cliSrvName:   "cli.dns.example",
+		wantClientID: "cli",
+	}, {
+		name:         "quic_second_base",
+		proto:        proxy.ProtoQUIC,
+		cliSrvName:   "Other.dns.example.net",
+		wantClientID: "other",
+	}, {
+		name:         "tls_base",
+		proto:        proxy.ProtoTLS,
+		cliSrvName:   "dns.example",
+		wantClientID: "",
+	}, {
+		name:         "quic_no_match",
+		proto:        proxy.ProtoQUIC,
+		cliSrvName:   "cli.other.example",
+		wantClientID: "",
+	}, {
+		name:         "tls_not_immediate",
+		proto:        proxy.ProtoTLS,
+		cliSrvName:   "a.cli.dns.example",
+		wantClientID: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pctx := &proxy.DNSContext{
+				Proto: tc.proto,
+			}
+
+			if tc.proto == proxy.ProtoQUIC {
+				pctx.QUICConnection = testQUICConnection{serverName: tc.cliSrvName}
+			} else {
+				pctx.Conn = testTLSConn{serverName: tc.cliSrvName}
+			}
+
+			clientID, err := srv.clientIDFromDNSContext(pctx)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantClientID, clientID)
+		})
+	}
+}
@@ -62,6 +62,17 @@ type FilteringConfig struct {
 	// nil if there are no custom upstreams for the client.
 	GetCustomUpstreamByClient func(id string) (conf *proxy.UpstreamConfig, err error) `yaml:"-"`
 
+	// GetAnswerRulesByClient is a callback that returns the answer
+	// post-processing rules of the client with the IP address or ClientID.  It
+	// returns nil if the client has no rules.
+	GetAnswerRulesByClient func(id string) (rules *AnswerRules) `yaml:"-"`
+
+	// GetCaptureIPByClient is a callback that returns the IP address the
+	// A queries of the local client with the IP address ip must be answered
+	// with while the client is captured, see [Server.processCapture].  It
+	// returns nil if the client isn't captured.
+	GetCaptureIPByClient func(ip net.IP) (captureIP net.IP) `yaml:"-"`
+
 	// Protection configuration
 
 	// ProtectionEnabled defines whether or not use any of filtering features.
@@ -81,6 +92,10 @@ type FilteringConfig struct {
 	// 0, then default value is used (3600).
 	BlockedResponseTTL uint32 `yaml:"blocked_response_ttl"`
 
+	// BlockedResponseSOA is the contents of the SOA record in the blocked and
+	// NXDOMAIN responses.
+	BlockedResponseSOA BlockedResponseSOA `yaml:"blocked_response_soa"`
+
 	// ParentalBlockHost is the IP (or domain name) which is used to respond to
 	// DNS requests blocked by parental control.
 	ParentalBlockHost string `yaml:"parental_block_host"`
@@ -125,6 +140,25 @@ type FilteringConfig struct {
 	// when FastestAddr is true.
 	FastestTimeout timeutil.Duration `yaml:"fastest_timeout"`
 
+	// UpstreamPipelining, if true, enables reusing a single connection to
+	// each of the plain TCP upstreams with IP addresses and the Unix domain
+	// socket upstreams, and sending the queries over it without waiting for
+	// the previous responses.  Otherwise, a new connection is opened for each
+	// query.
+	UpstreamPipelining bool `yaml:"upstream_pipelining"`
+
+	// UpstreamPool is the configuration of the connections to the upstreams.
+	UpstreamPool UpstreamPoolConfig `yaml:"upstream_pool"`
+
+	// RecursiveMode defines whether the requests are resolved recursively
+	// starting from the root name servers, either instead of the default
+	// upstreams or when all the upstreams fail.
+	RecursiveMode RecursiveMode `yaml:"recursive_mode"`
+
+	// UpstreamFailover is the configuration of the secondary upstreams used
+	// while all the default upstreams are failing.
+	UpstreamFailover UpstreamFailover `yaml:"upstream_failover"`
+
 	// Access settings
 
 	// AllowedClients is the slice of IP addresses, CIDR networks, and
@@ -139,12 +173,30 @@ type FilteringConfig struct {
 	// BlockedHosts is the list of hosts that should be blocked.
 	BlockedHosts []string `yaml:"blocked_hosts"`
 
+	// TemporaryAllowedClients are the clients allowed until their expiration
+	// time regardless of [FilteringConfig.AllowedClients] and
+	// [FilteringConfig.DisallowedClients].  The expired ones are ignored and
+	// aren't written back to the configuration file.
+	TemporaryAllowedClients []*TemporaryAccessClient `yaml:"temporary_allowed_clients"`
+
 	// TrustedProxies is the list of IP addresses and CIDR networks to detect
 	// proxy servers addresses the DoH requests from which should be handled.
 	// The value of nil or an empty slice for this field makes Proxy not trust
 	// any address.
 	TrustedProxies []string `yaml:"trusted_proxies"`
 
+	// EDNSClientID, if true, enables taking the ClientIDs of plain DNS
+	// requests from the EDNS0 option set by forwarders, such as the one of
+	// dnsmasq's --add-cpe-id.  The option is only accepted from the
+	// TrustedProxies and is removed before forwarding the request upstream.
+	EDNSClientID bool `yaml:"edns_client_id"`
+
+	// ProxyProtocol, if true, makes the plain DNS-over-TCP and DNS-over-TLS
+	// listeners accept the PROXY protocol headers of version 1 and 2 from
+	// TrustedProxies, so that the addresses of the clients behind the proxies
+	// are used instead of the ones of the proxies.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+
 	// DNS cache settings
 
 	// CacheSize is the DNS cache size (in bytes).
@@ -161,6 +213,39 @@ type FilteringConfig struct {
 	// CacheOptimistic defines if optimistic cache mechanism should be used.
 	CacheOptimistic bool `yaml:"cache_optimistic"`
 
+	// CacheAggressiveNSEC, if true, enables the aggressive use of the
+	// DNSSEC-validated NSEC and NSEC3 records to synthesize NXDOMAIN responses,
+	// as described by RFC 8198.  It has no effect if CacheSize is zero.
+	CacheAggressiveNSEC bool `yaml:"cache_aggressive_nsec"`
+
+	// CacheServeStale, if true, enables serving the expired responses when the
+	// upstreams fail, as described by RFC 8767.  Such responses are refreshed
+	// in the background.  The responses are kept in a separate cache of
+	// CacheSize bytes, so it has no effect if CacheSize is zero.
+	CacheServeStale bool `yaml:"cache_serve_stale"`
+
+	// CacheMaxStale is the maximum time in seconds since the expiry of a
+	// response during which it may be served stale.  If it's zero, one day is
+	// used.
+	CacheMaxStale uint32 `yaml:"cache_max_stale"`
+
+	// CachePartitioning, if true, partitions the DNS cache by the policies of
+	// the clients, so that the clients with different upstreams, EDNS Client
+	// Subnet data, or filtering settings don't share the cached responses.
+	// The cache of dnsproxy, including its optimistic caching, isn't used
+	// then.  It has no effect if CacheSize is zero.
+	CachePartitioning bool `yaml:"cache_partitioning"`
+
+	// CachePrefetch, if true, enables the refreshing of the responses to the
+	// most popular requests shortly before they expire.  It has no effect if
+	// CacheSize is zero, CachePartitioning is true, or the EDNS Client Subnet
+	// is enabled.
+	CachePrefetch bool `yaml:"cache_prefetch"`
+
+	// CachePrefetchTop is the number of the most popular requests the
+	// responses to which are prefetched.  If it's zero, 100 is used.
+	CachePrefetchTop uint `yaml:"cache_prefetch_top"`
+
 	// Other settings
 
 	// BogusNXDomain is the list of IP addresses, responses with them will be
@@ -184,6 +269,56 @@ type FilteringConfig struct {
 	// HandleDDR, if true, handle DDR requests
 	HandleDDR bool `yaml:"handle_ddr"`
 
+	// AnswerRules are the answer post-processing rules applied to the
+	// responses from the upstreams for all clients.  See [AnswerRules] for the
+	// syntax.
+	AnswerRules []string `yaml:"answer_rules"`
+
+	// RebindingProtection, if true, blocks the responses from the upstreams
+	// for the public domain names, which contain private, loopback,
+	// link-local, or unspecified IP addresses, as well as the ones from the
+	// private networks, to mitigate the DNS rebinding attacks against the
+	// devices in the local network.
+	RebindingProtection bool `yaml:"rebinding_protection"`
+
+	// RebindingAllowlist are the domain names, the responses for which and
+	// for their subdomains aren't checked by [RebindingProtection].
+	RebindingAllowlist []string `yaml:"rebinding_allowlist"`
+
+	// LocalZones are the zones served authoritatively from the zone files.
+	// The requests for the names within them never reach the upstreams.
+	LocalZones []*LocalZoneConfig `yaml:"local_zones"`
+
+	// ZoneTransfer is the configuration of the zone transfers of the local
+	// DNS data to the secondary servers.
+	ZoneTransfer ZoneTransferConfig `yaml:"zone_transfer"`
+
+	// Views are the named sets of DNS settings for the groups of clients.  The
+	// first view matching the client is used.
+	Views []*View `yaml:"views"`
+
+	// HTTPSBlock, if true, blocks the HTTPS and SVCB requests for the hosts
+	// which are filtered for the address requests.  It takes precedence over
+	// [HTTPSStripECH] and [HTTPSStripIPv6Hint].
+	HTTPSBlock bool `yaml:"https_block"`
+
+	// HTTPSStripECH, if true, removes the ECH configurations from the HTTPS
+	// and SVCB responses for the hosts which are filtered for the address
+	// requests.
+	HTTPSStripECH bool `yaml:"https_strip_ech"`
+
+	// HTTPSStripIPv6Hint, if true, removes the IPv6 hints from the HTTPS and
+	// SVCB responses for the hosts which are filtered for the address
+	// requests.
+	HTTPSStripIPv6Hint bool `yaml:"https_strip_ipv6hint"`
+
+	// Dnstap is the configuration of the dnstap exporter.
+	Dnstap DnstapConfig `yaml:"dnstap"`
+
+	// SlowQueryThreshold is the processing time starting from which the
+	// queries are put into the slow-query log.  Zero disables the log.
+	SlowQueryThreshold timeutil.Duration `yaml:"slow_query_threshold"`
+
 	// IpsetList is the ipset configuration that allows AdGuard Home to add IP
 	// addresses of the specified domain names to an ipset list.  Syntax:
 	//
@@ -217,6 +352,10 @@ type TLSConfig struct {
 	QUICListenAddrs  []*net.UDPAddr `yaml:"-" json:"-"`
 	HTTPSListenAddrs []*net.TCPAddr `yaml:"-" json:"-"`
 
+	// PureProxy are the listeners, which forward the queries to the upstream
+	// servers without any filtering or logging.
+	PureProxy PureProxyConfig `yaml:"-" json:"-"`
+
 	// PEM-encoded certificates chain
 	CertificateChain string `yaml:"certificate_chain" json:"certificate_chain"`
 	// PEM-encoded private key
@@ -235,10 +374,19 @@ type TLSConfig struct {
 	// DNS names from certificate (SAN) or CN value from Subject
 	dnsNames []string
 
+	// wildcardBases are the parent domains of the certificate's wildcard DNS
+	// names, for example "dns.example" for "*.dns.example".  These are used
+	// to extract the ClientIDs when ServerName is empty.
+	wildcardBases []string
+
 	// OverrideTLSCiphers, when set, contains the names of the cipher suites to
 	// use.  If the slice is empty, the default safe suites are used.
 	OverrideTLSCiphers []string `yaml:"override_tls_ciphers,omitempty" json:"-"`
 
+	// MinTLSVersion is the minimum version of TLS accepted by the listeners,
+	// either "1.2" or "1.3".  If empty, TLS 1.2 is used.
+	MinTLSVersion string `yaml:"min_tls_version,omitempty" json:"-"`
+
 	// StrictSNICheck controls if the connections with SNI mismatching the
 	// certificate's ones should be rejected.
 	StrictSNICheck bool `yaml:"strict_sni_check" json:"-"`
@@ -246,6 +394,62 @@ type TLSConfig struct {
 	// hasIPAddrs is set during the certificate parsing and is true if the
 	// configured certificate contains at least a single IP address.
 	hasIPAddrs bool
+
+	// QUIC is the configuration of the QUIC transport of the DNS-over-QUIC
+	// listeners.
+	QUIC QUICConfig `yaml:"quic" json:"quic"`
+}
+
+// QUICConfig is the configuration of the QUIC transport of the DNS-over-QUIC
+// listeners.  The zero QUICConfig means the default settings.
+type QUICConfig struct {
+	// MaxIdleTimeout is the maximum duration of inactivity after which the
+	// connection is closed.  If zero, defaultDoQMaxIdleTimeout is used.
+	MaxIdleTimeout timeutil.Duration `yaml:"max_idle_timeout" json:"max_idle_timeout"`
+
+	// KeepAlivePeriod is the period of sending the keep-alive packets, which
+	// prevents idle connections of roaming clients from being closed.  If
+	// zero, no keep-alive packets are sent.
+	KeepAlivePeriod timeutil.Duration `yaml:"keep_alive_period" json:"keep_alive_period"`
+
+	// Disable0RTT, if true, disables accepting the 0-RTT data from the
+	// clients resuming their sessions.
+	Disable0RTT bool `yaml:"disable_0rtt" json:"disable_0rtt"`
+
+	// CongestionControl is the congestion control algorithm.  If empty,
+	// CongestionControlReno is used.
+	CongestionControl CongestionControl `yaml:"congestion_control" json:"congestion_control,omitempty"`
+}
+
+// CongestionControl is the name of a QUIC congestion control algorithm.
+type CongestionControl string
+
+// CongestionControlReno is the NewReno congestion control algorithm, the only
+// one the QUIC implementation currently provides.
+const CongestionControlReno CongestionControl = "reno"
+
+// Validate returns an error if c contains invalid settings.
+func (c *QUICConfig) Validate() (err error) {
+	idle, keepAlive := c.MaxIdleTimeout.Duration, c.KeepAlivePeriod.Duration
+	if idle < 0 {
+		return fmt.Errorf("max_idle_timeout: negative value %s", idle)
+	} else if keepAlive < 0 {
+		return fmt.Errorf("keep_alive_period: negative value %s", keepAlive)
+	}
+
+	if idle == 0 {
+		idle = defaultDoQMaxIdleTimeout
+	}
+
+	if keepAlive >= idle {
+		return fmt.Errorf("keep_alive_period: %s must be less than max_idle_timeout %s", keepAlive, idle)
+	}
+
+	if cc := c.CongestionControl; cc != "" && cc != CongestionControlReno {
+		return fmt.Errorf("congestion_control: unsupported algorithm %q, only %q is available", cc, CongestionControlReno)
+	}
+
+	return nil
 }
 
 // DNSCryptConfig is the DNSCrypt server configuration struct.
@@ -278,12 +482,23 @@ type ServerConfig struct {
 	// TLSCiphers are the IDs of TLS cipher suites to use.
 	TLSCiphers []uint16
 
+	// TLSMinVersion is the minimum version of TLS accepted by the encrypted
+	// listeners.  If zero, TLS 1.2 is used.
+	TLSMinVersion uint16
+
+	// TLSHandshakeStats, if not nil, collects the statistics of the TLS
+	// handshakes of the encrypted listeners.
+	TLSHandshakeStats *aghtls.HandshakeStats
+
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func()
 
 	// Register an HTTP handler
 	HTTPRegister aghhttp.RegisterFunc
 
+	// ZonesDir is the directory for the zone files uploaded via the HTTP API.
+	ZonesDir string
+
 	// LocalPTRResolvers is a slice of addresses to be used as upstreams for
 	// resolving PTR queries for local addresses.
 	LocalPTRResolvers []string
@@ -307,6 +522,13 @@ type ServerConfig struct {
 	// UseHTTP3Upstreams defines if HTTP/3 is be allowed for DNS-over-HTTPS
 	// upstreams.
 	UseHTTP3Upstreams bool
+
+	// ActivatedTCPListeners and ActivatedUDPConns are the plain DNS sockets
+	// passed by the service manager.  If any of them is set, the server
+	// serves the queries from them instead of listening on TCPListenAddrs or
+	// UDPListenAddrs respectively.  The server never closes them.
+	ActivatedTCPListeners []*net.TCPListener
+	ActivatedUDPConns     []*net.UDPConn
 }
 
 // if any of ServerConfig values are zero, then default values from below are used
@@ -351,7 +573,7 @@ func (s *Server) createProxyConfig() (conf proxy.Config, err error) {
 		conf.EDNSAddr = ip
 	}
 
-	if srvConf.CacheSize != 0 {
+	if srvConf.CacheSize != 0 && !srvConf.CachePartitioning {
 		conf.CacheEnabled = true
 		conf.CacheSizeBytes = int(srvConf.CacheSize)
 	}
@@ -380,6 +602,23 @@ func (s *Server) createProxyConfig() (conf proxy.Config, err error) {
 		return conf, fmt.Errorf("validating tls: %w", err)
 	}
 
+	if len(srvConf.ActivatedTCPListeners) > 0 {
+		conf.TCPListenAddr = nil
+	}
+
+	if len(srvConf.ActivatedUDPConns) > 0 {
+		conf.UDPListenAddr = nil
+	}
+
+	s.proxyProtoTCPAddrs, s.proxyProtoTLSAddrs = nil, nil
+	if srvConf.ProxyProtocol {
+		// dnsproxy doesn't accept the PROXY protocol headers, so accept the
+		// TCP and TLS connections using our own listeners, which pass the
+		// queries to dnsProxy's handlers.
+		s.proxyProtoTCPAddrs, conf.TCPListenAddr = conf.TCPListenAddr, nil
+		s.proxyProtoTLSAddrs, conf.TLSListenAddr = conf.TLSListenAddr, nil
+	}
+
 	if c := srvConf.DNSCryptConfig; c.Enabled {
 		conf.DNSCryptUDPListenAddr = c.UDPListenAddrs
 		conf.DNSCryptTCPListenAddr = c.TCPListenAddrs
@@ -449,6 +688,25 @@ func UpstreamHTTPVersions(http3 bool) (v []upstream.HTTPVersion) {
 	}
 }
 
+// loadUpstreams returns the upstream configuration lines either from the file,
+// if it's set, or from c.UpstreamDNS.
+func (c *FilteringConfig) loadUpstreams() (upstreams []string, err error) {
+	if c.UpstreamDNSFileName == "" {
+		return c.UpstreamDNS, nil
+	}
+
+	data, err := os.ReadFile(c.UpstreamDNSFileName)
+	if err != nil {
+		return nil, fmt.Errorf("reading upstream from file: %w", err)
+	}
+
+	upstreams = stringutil.SplitTrimmed(string(data), "\n")
+
+	log.Debug("dns: using %d upstream servers from file %s", len(upstreams), c.UpstreamDNSFileName)
+
+	return upstreams, nil
+}
+
 // prepareUpstreamSettings - prepares upstream DNS server settings
 func (s *Server) prepareUpstreamSettings() error {
 	// We're setting a customized set of RootCAs.  The reason is that Go default
@@ -459,35 +717,38 @@ func (s *Server) prepareUpstreamSettings() error {
 	upstream.RootCAs = s.conf.TLSv12Roots
 	upstream.CipherSuites = s.conf.TLSCiphers
 
-	// Load upstreams either from the file, or from the settings
-	var upstreams []string
-	if s.conf.UpstreamDNSFileName != "" {
-		data, err := os.ReadFile(s.conf.UpstreamDNSFileName)
-		if err != nil {
-			return fmt.Errorf("reading upstream from file: %w", err)
-		}
-
-		upstreams = stringutil.SplitTrimmed(string(data), "\n")
-
-		log.Debug("dns: using %d upstream servers from file %s", len(upstreams), s.conf.UpstreamDNSFileName)
-	} else {
-		upstreams = s.conf.UpstreamDNS
+	upstreams, err := s.conf.loadUpstreams()
+	if err != nil {
+		return err
 	}
 
 	httpVersions := UpstreamHTTPVersions(s.conf.UseHTTP3Upstreams)
 	upstreams = stringutil.FilterOut(upstreams, IsCommentOrEmpty)
-	upstreamConfig, err := proxy.ParseUpstreamsConfig(
+	upstreamConfig, err := ParseUpstreamsConfig(
 		upstreams,
 		&upstream.Options{
 			Bootstrap:    s.conf.BootstrapDNS,
 			Timeout:      s.conf.UpstreamTimeout,
 			HTTPVersions: httpVersions,
 		},
+		s.upsPool,
 	)
 	if err != nil {
 		return fmt.Errorf("parsing upstream config: %w", err)
 	}
 
+	if s.conf.RecursiveMode == RecursiveModePrimary {
+		// The upstreams for the specific domains are still used, but the
+		// default ones are replaced with the recursive resolver.
+		for _, u := range upstreamConfig.Upstreams {
+			if err = u.Close(); err != nil {
+				log.Debug("dnsforward: closing upstream %s: %s", u.Address(), err)
+			}
+		}
+
+		upstreamConfig.Upstreams = []upstream.Upstream{s.recursor}
+	}
+
 	if len(upstreamConfig.Upstreams) == 0 {
 		log.Info("warning: no default upstream servers specified, using %v", defaultDNS)
 		var uc *proxy.UpstreamConfig
@@ -506,6 +767,20 @@ func (s *Server) prepareUpstreamSettings() error {
 		upstreamConfig.Upstreams = uc.Upstreams
 	}
 
+	s.upsFailover, err = newUpstreamFailover(
+		s.conf.UpstreamFailover,
+		upstreamConfig,
+		&upstream.Options{
+			Bootstrap:    s.conf.BootstrapDNS,
+			Timeout:      s.conf.UpstreamTimeout,
+			HTTPVersions: httpVersions,
+		},
+		s.upsPool,
+	)
+	if err != nil {
+		return fmt.Errorf("upstream failover: %w", err)
+	}
+
 	s.conf.UpstreamConfig = upstreamConfig
 
 	return nil
@@ -551,11 +826,13 @@ func (s *Server) prepareIpsetListSettings() (err error) {
 
 // prepareTLS - prepares TLS configuration for the DNS proxy
 func (s *Server) prepareTLS(proxyConfig *proxy.Config) (err error) {
+	s.doqListenAddrs = nil
+
 	if len(s.conf.CertificateChainData) == 0 || len(s.conf.PrivateKeyData) == 0 {
 		return nil
 	}
 
-	if s.conf.TLSListenAddrs == nil && s.conf.QUICListenAddrs == nil {
+	if s.conf.TLSListenAddrs == nil && s.conf.QUICListenAddrs == nil && s.conf.PureProxy.isEmpty() {
 		return nil
 	}
 
@@ -569,6 +846,19 @@ func (s *Server) prepareTLS(proxyConfig *proxy.Config) (err error) {
 		proxyConfig.QUICListenAddr,
 	)
 
+	if s.conf.QUIC != (QUICConfig{}) {
+		err = s.conf.QUIC.Validate()
+		if err != nil {
+			return fmt.Errorf("validating quic config: %w", err)
+		}
+
+		// dnsproxy doesn't allow configuring the QUIC transport, so accept
+		// the DNS-over-QUIC connections using our own listeners, which pass the
+		// queries to dnsProxy's handlers.  These should be removed once
+		// dnsproxy accepts a QUIC configuration.
+		s.doqListenAddrs, proxyConfig.QUICListenAddr = proxyConfig.QUICListenAddr, nil
+	}
+
 	s.conf.cert, err = tls.X509KeyPair(s.conf.CertificateChainData, s.conf.PrivateKeyData)
 	if err != nil {
 		return fmt.Errorf("failed to parse TLS keypair: %w", err)
@@ -581,6 +871,13 @@ func (s *Server) prepareTLS(proxyConfig *proxy.Config) (err error) {
 
 	s.conf.hasIPAddrs = aghtls.CertificateHasIP(cert)
 
+	s.conf.wildcardBases = nil
+	for _, dn := range cert.DNSNames {
+		if isWildcard(dn) {
+			s.conf.wildcardBases = append(s.conf.wildcardBases, strings.ToLower(dn[2:]))
+		}
+	}
+
 	if s.conf.StrictSNICheck {
 		if len(cert.DNSNames) != 0 {
 			s.conf.dnsNames = cert.DNSNames
@@ -592,10 +889,16 @@ func (s *Server) prepareTLS(proxyConfig *proxy.Config) (err error) {
 		}
 	}
 
+	minVersion := s.conf.TLSMinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
 	proxyConfig.TLSConfig = &tls.Config{
-		GetCertificate: s.onGetCertificate,
-		CipherSuites:   s.conf.TLSCiphers,
-		MinVersion:     tls.VersionTLS12,
+		GetCertificate:   s.onGetCertificate,
+		VerifyConnection: s.conf.TLSHandshakeStats.VerifyConnection,
+		CipherSuites:     s.conf.TLSCiphers,
+		MinVersion:       minVersion,
 	}
 
 	return nil
@@ -0,0 +1,232 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// diagnosticsDomain is the domain name queried while diagnosing the upstream
+// and bootstrap servers.
+const diagnosticsDomain = "example.org."
+
+// Stages of the server diagnostics.
+const (
+	diagStageConfig    = "config"
+	diagStageDial      = "dial"
+	diagStageHandshake = "handshake"
+	diagStageExchange  = "exchange"
+)
+
+// diagStage returns the stage of diagnostics at which err occurred.  Errors
+// of resolving the server's hostname and of connecting to it are reported as
+// diagStageDial, the TLS certificate and record errors as diagStageHandshake,
+// and all the others as diagStageExchange.
+func diagStage(err error) (stage string) {
+	var (
+		opErr   *net.OpError
+		dnsErr  *net.DNSError
+		recErr  tls.RecordHeaderError
+		authErr x509.UnknownAuthorityError
+		hostErr x509.HostnameError
+		certErr x509.CertificateInvalidError
+	)
+
+	switch {
+	case
+		errors.As(err, &opErr) && opErr.Op == "dial",
+		errors.As(err, &dnsErr):
+		return diagStageDial
+	case
+		errors.As(err, &recErr),
+		errors.As(err, &authErr),
+		errors.As(err, &hostErr),
+		errors.As(err, &certErr):
+		return diagStageHandshake
+	default:
+		return diagStageExchange
+	}
+}
+
+// serverDiagnostics is the result of diagnosing a single DNS server.
+type serverDiagnostics struct {
+	// Address is the address of the server as configured.
+	Address string `json:"address"`
+
+	// Domains are the domains the upstream is used for, if it's
+	// domain-specific.
+	Domains []string `json:"domains,omitempty"`
+
+	// Stage is the stage of diagnostics which failed, if any.
+	Stage string `json:"stage,omitempty"`
+
+	// Error is the error which occurred, if any.
+	Error string `json:"error,omitempty"`
+
+	// RCode is the response code of the server's reply, if any.
+	RCode string `json:"rcode,omitempty"`
+
+	// LatencyMs is the time spent on connecting to the server, handshaking
+	// with it, and exchanging the query, in milliseconds.
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// diagnosticsResp is the response to the GET /control/dns/diagnostics HTTP
+// API.
+type diagnosticsResp struct {
+	Upstreams  []*serverDiagnostics `json:"upstreams"`
+	Bootstraps []*serverDiagnostics `json:"bootstraps"`
+}
+
+// diagnoseServer connects to the server at addr using bootstrap to resolve
+// its hostname, if needed, and queries it for diagnosticsDomain.  It never
+// returns nil.
+func diagnoseServer(
+	addr string,
+	domains []string,
+	bootstrap []string,
+	timeout time.Duration,
+) (res *serverDiagnostics) {
+	res = &serverDiagnostics{
+		Address: addr,
+		Domains: domains,
+	}
+
+	u, err := addressToUpstream(addr, &upstream.Options{
+		Bootstrap: bootstrap,
+		Timeout:   timeout,
+	}, nil)
+	if err != nil {
+		res.Stage, res.Error = diagStageConfig, err.Error()
+
+		return res
+	}
+	defer func() {
+		if cerr := u.Close(); cerr != nil {
+			log.Debug("dnsforward: diagnostics: closing %q: %s", addr, cerr)
+		}
+	}()
+
+	req := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{{
+			Name:   diagnosticsDomain,
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		}},
+	}
+
+	start := time.Now()
+	resp, err := u.Exchange(req)
+	res.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		res.Stage, res.Error = diagStage(err), err.Error()
+
+		return res
+	}
+
+	res.RCode = dns.RcodeToString[resp.Rcode]
+
+	return res
+}
+
+// diagnose tests each of the configured upstream and bootstrap servers.
+func (s *Server) diagnose() (resp *diagnosticsResp) {
+	s.serverLock.RLock()
+	upstreams, err := s.conf.loadUpstreams()
+	upstreamFile := s.conf.UpstreamDNSFileName
+	bootstraps := s.conf.BootstrapDNS
+	timeout := s.conf.UpstreamTimeout
+	s.serverLock.RUnlock()
+
+	if len(bootstraps) == 0 {
+		bootstraps = defaultBootstrap
+	}
+
+	// Parse the upstreams before starting the checks, since the results are
+	// written concurrently.
+	var parsed []*serverDiagnostics
+	if err != nil {
+		parsed = append(parsed, &serverDiagnostics{
+			Address: upstreamFile,
+			Stage:   diagStageConfig,
+			Error:   err.Error(),
+		})
+	}
+
+	for _, line := range upstreams {
+		if IsCommentOrEmpty(line) {
+			continue
+		}
+
+		addr, domains, err := separateUpstream(line)
+		if err != nil {
+			parsed = append(parsed, &serverDiagnostics{
+				Address: line,
+				Stage:   diagStageConfig,
+				Error:   err.Error(),
+			})
+		} else if addr != "#" {
+			parsed = append(parsed, &serverDiagnostics{
+				Address: addr,
+				Domains: domains,
+			})
+		}
+	}
+
+	resp = &diagnosticsResp{
+		Upstreams:  parsed,
+		Bootstraps: make([]*serverDiagnostics, len(bootstraps)),
+	}
+
+	wg := &sync.WaitGroup{}
+	for i, u := range parsed {
+		if u.Stage != "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, u *serverDiagnostics) {
+			defer wg.Done()
+
+			resp.Upstreams[i] = diagnoseServer(u.Address, u.Domains, bootstraps, timeout)
+		}(i, u)
+	}
+
+	for i, b := range bootstraps {
+		wg.Add(1)
+		go func(i int, b string) {
+			defer wg.Done()
+
+			// Bootstrap servers must be IP addresses, so they don't need
+			// bootstrapping themselves.
+			resp.Bootstraps[i] = diagnoseServer(b, nil, nil, timeout)
+		}(i, b)
+	}
+
+	wg.Wait()
+
+	if resp.Upstreams == nil {
+		resp.Upstreams = []*serverDiagnostics{}
+	}
+
+	return resp
+}
+
+// handleDiagnostics is the handler for the GET /control/dns/diagnostics HTTP
+// API.
+func (s *Server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, s.diagnose())
+}
@@ -0,0 +1,117 @@
+package dnsforward
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_diagnose(t *testing.T) {
+	goodHandler := dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		err := w.WriteMsg(new(dns.Msg).SetRcode(m, dns.RcodeNameError))
+		require.NoError(testutil.PanicT{}, err)
+	})
+	badHandler := dns.HandlerFunc(func(w dns.ResponseWriter, _ *dns.Msg) {
+		err := w.WriteMsg(new(dns.Msg))
+		require.NoError(testutil.PanicT{}, err)
+	})
+
+	goodUps := (&url.URL{
+		Scheme: "tcp",
+		Host:   newLocalUpstreamListener(t, 0, goodHandler).String(),
+	}).String()
+	badUps := (&url.URL{
+		Scheme: "tcp",
+		Host:   newLocalUpstreamListener(t, 0, badHandler).String(),
+	}).String()
+
+	s := &Server{}
+	s.conf.UpstreamTimeout = 100 * time.Millisecond
+	s.conf.BootstrapDNS = []string{goodUps}
+	s.conf.UpstreamDNS = []string{
+		"# comment",
+		goodUps,
+		"[/example.com/]" + badUps,
+		"[/example.net/]#",
+		"[/bad",
+	}
+
+	resp := s.diagnose()
+
+	require.Len(t, resp.Upstreams, 3)
+	require.Len(t, resp.Bootstraps, 1)
+
+	good := resp.Upstreams[0]
+	assert.Equal(t, goodUps, good.Address)
+	assert.Equal(t, "NXDOMAIN", good.RCode)
+	assert.Empty(t, good.Stage)
+	assert.Empty(t, good.Error)
+
+	bad := resp.Upstreams[1]
+	assert.Equal(t, badUps, bad.Address)
+	assert.Equal(t, []string{"example.com"}, bad.Domains)
+	assert.Equal(t, diagStageExchange, bad.Stage)
+	assert.NotEmpty(t, bad.Error)
+
+	malformed := resp.Upstreams[2]
+	assert.Equal(t, "[/bad", malformed.Address)
+	assert.Equal(t, diagStageConfig, malformed.Stage)
+
+	boot := resp.Bootstraps[0]
+	assert.Equal(t, goodUps, boot.Address)
+	assert.Equal(t, "NXDOMAIN", boot.RCode)
+}
+
+func TestServer_diagnose_stages(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	closedUps := (&url.URL{Scheme: "tcp", Host: l.Addr().String()}).String()
+	require.NoError(t, l.Close())
+
+	// The certificate of the test server isn't trusted, so the TLS handshake
+	// fails.
+	tlsSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(tlsSrv.Close)
+
+	untrustedUps := (&url.URL{Scheme: "tls", Host: tlsSrv.Listener.Addr().String()}).String()
+
+	upsFile := filepath.Join(t.TempDir(), "upstreams.txt")
+	err = os.WriteFile(upsFile, []byte(closedUps+"\n"+untrustedUps+"\n"), 0o644)
+	require.NoError(t, err)
+
+	s := &Server{}
+	s.conf.UpstreamTimeout = time.Second
+	s.conf.BootstrapDNS = []string{closedUps}
+	s.conf.UpstreamDNS = []string{"# must be ignored"}
+	s.conf.UpstreamDNSFileName = upsFile
+
+	resp := s.diagnose()
+	require.Len(t, resp.Upstreams, 2)
+
+	assert.Equal(t, closedUps, resp.Upstreams[0].Address)
+	assert.Equal(t, diagStageDial, resp.Upstreams[0].Stage)
+
+	assert.Equal(t, untrustedUps, resp.Upstreams[1].Address)
+	assert.Equal(t, diagStageHandshake, resp.Upstreams[1].Stage)
+
+	t.Run("no_file", func(t *testing.T) {
+		s.conf.UpstreamDNSFileName = filepath.Join(t.TempDir(), "none.txt")
+
+		resp = s.diagnose()
+		require.Len(t, resp.Upstreams, 1)
+
+		assert.Equal(t, s.conf.UpstreamDNSFileName, resp.Upstreams[0].Address)
+		assert.Equal(t, diagStageConfig, resp.Upstreams[0].Stage)
+	})
+}
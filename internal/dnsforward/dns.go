@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/dnsproxy/proxy"
@@ -28,6 +29,10 @@ type dnsContext struct {
 	// setts are the filtering settings for the client.
 	setts *filtering.Settings
 
+	// view is the DNS view of the client.  It's nil if the client doesn't
+	// belong to any.
+	view *View
+
 	result *filtering.Result
 	// origResp is the response received from upstream.  It is set when the
 	// response is modified by filters.
@@ -52,6 +57,9 @@ type dnsContext struct {
 	// startTime is the time at which the processing of the request has started.
 	startTime time.Time
 
+	// timings is the breakdown of the processing time of the request.
+	timings queryTimings
+
 	// protectionEnabled shows if the filtering is enabled, and if the
 	// server's DNS filter is ready.
 	protectionEnabled bool
@@ -63,9 +71,18 @@ type dnsContext struct {
 	// responseAD shows if the response had the AD bit set.
 	responseAD bool
 
+	// servedStale shows if the response is a previous, possibly expired, one
+	// served because of the upstream failure.
+	servedStale bool
+
 	// isLocalClient shows if client's IP address is from locally served
 	// network.
 	isLocalClient bool
+
+	// stripHTTPS shows if the configured parameters should be removed from
+	// the HTTPS and SVCB records of the response, since the requested host is
+	// filtered for the address requests.
+	stripHTTPS bool
 }
 
 // resultCode is the result of a request processing function.
@@ -105,16 +122,22 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, pctx *proxy.DNSContext) error
 	mods := []modProcessFunc{
 		s.processRecursion,
 		s.processInitial,
+		s.processZoneTransfer,
 		s.processDDRQuery,
 		s.processDetermineLocal,
 		s.processDHCPHosts,
+		s.processLocalZones,
 		s.processRestrictLocal,
 		s.processDHCPAddrs,
+		s.processCapture,
 		s.processFilteringBeforeRequest,
 		s.processLocalPTR,
 		s.processUpstream,
 		s.processFilteringAfterResponse,
+		s.processAnswerRules,
+		s.processHTTPSRecords,
 		s.ipset.process,
+		s.processDnstap,
 		s.processQueryLogsAndStats,
 	}
 	for _, process := range mods {
@@ -194,11 +217,11 @@ func (s *Server) processInitial(dctx *dnsContext) (rc resultCode) {
 	return resultCodeSuccess
 }
 
-func (s *Server) setTableHostToIP(t hostToIPTable) {
+func (s *Server) setTableHostToIP(t, t6 hostToIPTable) {
 	s.tableHostToIPLock.Lock()
 	defer s.tableHostToIPLock.Unlock()
 
-	s.tableHostToIP = t
+	s.tableHostToIP, s.tableHostToIP6 = t, t6
 }
 
 func (s *Server) setTableIPToHost(t ipToHostTable) {
@@ -215,7 +238,7 @@ func (s *Server) onDHCPLeaseChanged(flags int) {
 		dhcpd.LeaseChangedRemovedStatic:
 		// Go on.
 	case dhcpd.LeaseChangedRemovedAll:
-		s.setTableHostToIP(nil)
+		s.setTableHostToIP(nil, nil)
 		s.setTableIPToHost(nil)
 
 		return
@@ -225,6 +248,7 @@ func (s *Server) onDHCPLeaseChanged(flags int) {
 
 	ll := s.dhcpServer.Leases(dhcpd.LeasesAll)
 	hostToIP := make(hostToIPTable, len(ll))
+	hostToIP6 := hostToIPTable{}
 	ipToHost := make(ipToHostTable, len(ll))
 
 	for _, l := range ll {
@@ -239,10 +263,8 @@ func (s *Server) onDHCPLeaseChanged(flags int) {
 
 		lowhost := strings.ToLower(l.Hostname + "." + s.localDomainSuffix)
 
-		// Assume that we only process IPv4 now.
-		//
 		// TODO(a.garipov):  Remove once we switch to netip.Addr more fully.
-		ip, err := netutil.IPToAddr(l.IP, netutil.AddrFamilyIPv4)
+		ip, err := netutil.IPToAddrNoMapped(l.IP)
 		if err != nil {
 			log.Debug("dnsforward: skipping invalid ip %v from dhcp: %s", l.IP, err)
 
@@ -250,13 +272,22 @@ func (s *Server) onDHCPLeaseChanged(flags int) {
 		}
 
 		ipToHost[ip] = lowhost
-		hostToIP[lowhost] = ip
+		if ip.Is4() {
+			hostToIP[lowhost] = ip
+		} else {
+			hostToIP6[lowhost] = ip
+		}
 	}
 
-	s.setTableHostToIP(hostToIP)
+	s.setTableHostToIP(hostToIP, hostToIP6)
 	s.setTableIPToHost(ipToHost)
 
-	log.Debug("dnsforward: added %d a and ptr entries from dhcp", len(ipToHost))
+	log.Debug(
+		"dnsforward: added %d a, %d aaaa, and %d ptr entries from dhcp",
+		len(hostToIP),
+		len(hostToIP6),
+		len(ipToHost),
+	)
 }
 
 // processDDRQuery responds to Discovery of Designated Resolvers (DDR) SVCB
@@ -319,7 +350,7 @@ func (s *Server) makeDDRResponse(req *dns.Msg) (resp *dns.Msg) {
 		// addresses.
 		//
 		// See https://github.com/AdguardTeam/AdGuardHome/issues/4927.
-		for _, addr := range s.dnsProxy.TLSListenAddr {
+		for _, addr := range aghalg.CoalesceSlice(s.proxyProtoTLSAddrs, s.dnsProxy.TLSListenAddr) {
 			values := []dns.SVCBKeyValue{
 				&dns.SVCBAlpn{Alpn: []string{"dot"}},
 				&dns.SVCBPort{Port: uint16(addr.Port)},
@@ -336,7 +367,7 @@ func (s *Server) makeDDRResponse(req *dns.Msg) (resp *dns.Msg) {
 		}
 	}
 
-	for _, addr := range s.dnsProxy.QUICListenAddr {
+	for _, addr := range aghalg.CoalesceSlice(s.doqListenAddrs, s.dnsProxy.QUICListenAddr) {
 		values := []dns.SVCBKeyValue{
 			&dns.SVCBAlpn{Alpn: []string{"doq"}},
 			&dns.SVCBPort{Port: uint16(addr.Port)},
@@ -370,23 +401,22 @@ func (s *Server) processDetermineLocal(dctx *dnsContext) (rc resultCode) {
 	return rc
 }
 
-// dhcpHostToIP tries to get an IP leased by DHCP and returns the copy of
-// address since the data inside the internal table may be changed while request
-// processing.  It's safe for concurrent use.
-func (s *Server) dhcpHostToIP(host string) (ip netip.Addr, ok bool) {
+// dhcpHostToIP tries to get the IPv4 and the IPv6 addresses leased by DHCP to
+// host.  ok is true if host has at least one of them, the other one is then
+// invalid.  It's safe for concurrent use.
+func (s *Server) dhcpHostToIP(host string) (ip, ip6 netip.Addr, ok bool) {
 	s.tableHostToIPLock.Lock()
 	defer s.tableHostToIPLock.Unlock()
 
-	ip, ok = s.tableHostToIP[host]
+	ip, ok4 := s.tableHostToIP[host]
+	ip6, ok6 := s.tableHostToIP6[host]
 
-	return ip, ok
+	return ip, ip6, ok4 || ok6
 }
 
-// processDHCPHosts respond to A requests if the target hostname is known to
-// the server.  It responds with a mapped IP address if the DNS64 is enabled and
-// the request is for AAAA.
-//
-// TODO(a.garipov): Adapt to AAAA as well.
+// processDHCPHosts respond to A and AAAA requests if the target hostname is
+// known to the server.  It responds to AAAA requests with a mapped IPv4
+// address if the host has no IPv6 address leased and DNS64 is enabled.
 func (s *Server) processDHCPHosts(dctx *dnsContext) (rc resultCode) {
 	pctx := dctx.proxyCtx
 	req := pctx.Req
@@ -404,7 +434,7 @@ func (s *Server) processDHCPHosts(dctx *dnsContext) (rc resultCode) {
 		return resultCodeFinish
 	}
 
-	ip, ok := s.dhcpHostToIP(reqHost)
+	ip, ip6, ok := s.dhcpHostToIP(reqHost)
 	if !ok {
 		// Go on and process them with filters, including dnsrewrite ones, and
 		// possibly route them to a domain-specific upstream.
@@ -413,18 +443,26 @@ func (s *Server) processDHCPHosts(dctx *dnsContext) (rc resultCode) {
 		return resultCodeSuccess
 	}
 
-	log.Debug("dnsforward: dhcp record for %q is %s", reqHost, ip)
+	log.Debug("dnsforward: dhcp records for %q are %v and %v", reqHost, ip, ip6)
 
 	resp := s.makeResponse(req)
 	switch q.Qtype {
 	case dns.TypeA:
-		a := &dns.A{
-			Hdr: s.hdr(req, dns.TypeA),
-			A:   ip.AsSlice(),
+		if ip.IsValid() {
+			a := &dns.A{
+				Hdr: s.hdr(req, dns.TypeA),
+				A:   ip.AsSlice(),
+			}
+			resp.Answer = append(resp.Answer, a)
 		}
-		resp.Answer = append(resp.Answer, a)
 	case dns.TypeAAAA:
-		if s.dns64Pref != (netip.Prefix{}) {
+		if ip6.IsValid() {
+			aaaa := &dns.AAAA{
+				Hdr:  s.hdr(req, dns.TypeAAAA),
+				AAAA: ip6.AsSlice(),
+			}
+			resp.Answer = append(resp.Answer, aaaa)
+		} else if ip.IsValid() && s.dns64Pref != (netip.Prefix{}) {
 			// Respond with DNS64-mapped address for IPv4 host if DNS64 is
 			// enabled.
 			aaaa := &dns.AAAA{
@@ -610,6 +648,9 @@ func (s *Server) processFilteringBeforeRequest(ctx *dnsContext) (rc resultCode)
 		return resultCodeSuccess
 	}
 
+	start := time.Now()
+	defer func() { ctx.timings.filtering += time.Since(start) }()
+
 	var err error
 	if ctx.result, err = s.filterDNSRequest(ctx); err != nil {
 		ctx.err = err
@@ -650,9 +691,66 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 	}
 
 	s.setCustomUpstream(pctx, dctx.clientID)
+	if pctx.CustomUpstreamConfig == nil && dctx.view != nil {
+		// The client has no upstreams of its own, so use the ones of its view,
+		// if any.
+		pctx.CustomUpstreamConfig = dctx.view.upsConf
+	}
+
+	// Don't use the aggressive negative cache for the clients with custom
+	// upstreams, since their answers may differ.
+	nsecCache := s.nsecCache
+	if pctx.CustomUpstreamConfig != nil {
+		nsecCache = nil
+	}
+
+	cacheStart := time.Now()
+	if res := nsecCache.get(req, cacheStart); res != nil {
+		dctx.timings.cache = time.Since(cacheStart)
+		log.Debug("dnsforward: synthesized nxdomain for %q from nsec cache", q.Name)
+		pctx.Res = res
+
+		return resultCodeSuccess
+	}
+
+	var partKey, staleKey []byte
+	if s.partCache != nil {
+		var pol uint64
+		pol, pctx.ReqECS = s.cachePolicy(dctx)
+		partKey = partCacheKey(pol, req)
+		staleKey = partKey
+	} else if s.staleCache != nil {
+		pol, _ := s.cachePolicy(dctx)
+		staleKey = partCacheKey(pol, req)
+	}
 
 	reqWantsDNSSEC := s.setReqAD(req)
 
+	prefetchKey, usePrefetch := s.prefetchKey(dctx)
+
+	res, ups := s.partCache.get(partKey, req, time.Now())
+	if res == nil && usePrefetch {
+		res, ups = s.prefetcher.get(prefetchKey, req, respMaxSize(pctx), time.Now())
+	}
+
+	dctx.timings.cache = time.Since(cacheStart)
+	if res != nil {
+		log.Debug("dnsforward: response for %q from cache", q.Name)
+		pctx.Res = res
+		pctx.CachedUpstreamAddr = ups
+
+		dctx.responseFromUpstream = true
+		dctx.responseAD = res.AuthenticatedData
+		s.setRespAD(pctx, reqWantsDNSSEC)
+
+		return resultCodeSuccess
+	}
+
+	var restoreDO func(resp *dns.Msg)
+	if nsecCache != nil {
+		restoreDO = setDO(req)
+	}
+
 	// Process the request further since it wasn't filtered.
 	prx := s.proxy()
 	if prx == nil {
@@ -661,7 +759,38 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 		return resultCodeError
 	}
 
-	if err := prx.Resolve(pctx); err != nil {
+	failover := s.upstreamFailover()
+	usesDefault := pctx.CustomUpstreamConfig == nil
+
+	resolveStart := time.Now()
+	if usesDefault {
+		pctx.CustomUpstreamConfig = failover.upstreamConfig(resolveStart)
+	}
+
+	err := prx.Resolve(pctx)
+	if err != nil && usesDefault && pctx.CustomUpstreamConfig == nil {
+		// The primary tier has either just failed over or failed the probe,
+		// so retry with the secondary one.
+		pctx.CustomUpstreamConfig = failover.activeSecondary()
+		if pctx.CustomUpstreamConfig != nil {
+			err = prx.Resolve(pctx)
+		}
+	}
+
+	if err != nil {
+		err = s.resolveFallback(pctx, err)
+	}
+
+	s.recordResolveTime(dctx, time.Since(resolveStart))
+	if err == nil {
+		nsecCache.set(pctx.Res, time.Now())
+	}
+
+	if restoreDO != nil {
+		restoreDO(pctx.Res)
+	}
+
+	if err != nil {
 		if errors.Is(err, upstream.ErrNoUpstreams) {
 			// Do not even put into querylog.  Currently this happens either
 			// when the private resolvers enabled and the request is DNS64 PTR,
@@ -674,11 +803,30 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 			return resultCodeFinish
 		}
 
+		if s.serveStale(dctx, staleKey, reqWantsDNSSEC) {
+			return resultCodeSuccess
+		}
+
+		s.countUpstreamFailure(dctx, err)
 		dctx.err = err
 
 		return resultCodeError
 	}
 
+	if pctx.Res.Rcode == dns.RcodeServerFailure && s.serveStale(dctx, staleKey, reqWantsDNSSEC) {
+		return resultCodeSuccess
+	}
+
+	if pctx.Upstream != nil {
+		s.staleCache.set(staleKey, pctx.Res, pctx.Upstream.Address(), time.Now())
+
+		if s.partCache != nil {
+			s.partCache.set(partKey, pctx.Res, pctx.Upstream.Address(), time.Now())
+		} else if usePrefetch {
+			s.prefetcher.set(prefetchKey, req, pctx.Res, pctx.Upstream.Address(), time.Now())
+		}
+	}
+
 	dctx.responseFromUpstream = true
 	dctx.responseAD = pctx.Res.AuthenticatedData
 
@@ -737,9 +885,6 @@ func (s *Server) isDHCPClientHostQ(q dns.Question) (reqHost string, ok bool) {
 		return "", false
 	}
 
-	// Include AAAA here, because despite the fact that we don't support it yet,
-	// the expected behavior here is to respond with an empty answer and not
-	// NXDOMAIN.
 	if qt := q.Qtype; qt != dns.TypeA && qt != dns.TypeAAAA {
 		return "", false
 	}
@@ -814,7 +959,26 @@ func (s *Server) filterAfterResponse(dctx *dnsContext, pctx *proxy.DNSContext) (
 		return resultCodeSuccess
 	}
 
+	// The request itself would have been filtered, so there is no need to
+	// check the response.
+	if dctx.result.DryRun {
+		return resultCodeSuccess
+	}
+
+	start := time.Now()
 	result, err := s.filterDNSResponse(pctx, dctx.setts)
+	if err == nil && result == nil {
+		result = s.filterServiceDiscovery(pctx, dctx.setts)
+	}
+
+	if err == nil && result == nil {
+		result = s.filterResponseSize(pctx, dctx.setts)
+	}
+
+	if err == nil && result == nil {
+		result = s.filterRebinding(pctx, dctx.setts)
+	}
+	dctx.timings.filtering += time.Since(start)
 	if err != nil {
 		dctx.err = err
 
@@ -823,7 +987,9 @@ func (s *Server) filterAfterResponse(dctx *dnsContext, pctx *proxy.DNSContext) (
 
 	if result != nil {
 		dctx.result = result
-		dctx.origResp = pctx.Res
+		if !result.DryRun {
+			dctx.origResp = pctx.Res
+		}
 	}
 
 	return resultCodeSuccess
@@ -7,6 +7,7 @@ import (
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -328,58 +329,83 @@ func TestServer_ProcessDHCPHosts(t *testing.T) {
 	const (
 		examplecom = "example.com"
 		examplelan = "example." + defaultLocalDomainSuffix
+		example6   = "example6"
 	)
 
 	knownIP := netip.MustParseAddr("1.2.3.4")
+	knownIP6 := netip.MustParseAddr("2001:db8::1")
 	testCases := []struct {
-		name    string
-		host    string
-		suffix  string
-		wantIP  netip.Addr
-		wantRes resultCode
-		qtyp    uint16
+		name       string
+		host       string
+		suffix     string
+		wantIP     netip.Addr
+		wantRes    resultCode
+		qtyp       uint16
+		wantNoData bool
 	}{{
-		name:    "success_external",
-		host:    examplecom,
-		suffix:  defaultLocalDomainSuffix,
-		wantIP:  netip.Addr{},
-		wantRes: resultCodeSuccess,
-		qtyp:    dns.TypeA,
+		name:       "success_external",
+		host:       examplecom,
+		suffix:     defaultLocalDomainSuffix,
+		wantIP:     netip.Addr{},
+		wantRes:    resultCodeSuccess,
+		qtyp:       dns.TypeA,
+		wantNoData: false,
+	}, {
+		name:       "success_external_non_a",
+		host:       examplecom,
+		suffix:     defaultLocalDomainSuffix,
+		wantIP:     netip.Addr{},
+		wantRes:    resultCodeSuccess,
+		qtyp:       dns.TypeCNAME,
+		wantNoData: false,
+	}, {
+		name:       "success_internal",
+		host:       examplelan,
+		suffix:     defaultLocalDomainSuffix,
+		wantIP:     knownIP,
+		wantRes:    resultCodeSuccess,
+		qtyp:       dns.TypeA,
+		wantNoData: false,
 	}, {
-		name:    "success_external_non_a",
-		host:    examplecom,
-		suffix:  defaultLocalDomainSuffix,
-		wantIP:  netip.Addr{},
-		wantRes: resultCodeSuccess,
-		qtyp:    dns.TypeCNAME,
+		name:       "success_internal_unknown",
+		host:       "example-new.lan",
+		suffix:     defaultLocalDomainSuffix,
+		wantIP:     netip.Addr{},
+		wantRes:    resultCodeSuccess,
+		qtyp:       dns.TypeA,
+		wantNoData: false,
 	}, {
-		name:    "success_internal",
-		host:    examplelan,
-		suffix:  defaultLocalDomainSuffix,
-		wantIP:  knownIP,
-		wantRes: resultCodeSuccess,
-		qtyp:    dns.TypeA,
+		name:       "success_internal_aaaa",
+		host:       examplelan,
+		suffix:     defaultLocalDomainSuffix,
+		wantIP:     netip.Addr{},
+		wantRes:    resultCodeSuccess,
+		qtyp:       dns.TypeAAAA,
+		wantNoData: true,
 	}, {
-		name:    "success_internal_unknown",
-		host:    "example-new.lan",
-		suffix:  defaultLocalDomainSuffix,
-		wantIP:  netip.Addr{},
-		wantRes: resultCodeSuccess,
-		qtyp:    dns.TypeA,
+		name:       "success_internal_ipv6",
+		host:       example6 + "." + defaultLocalDomainSuffix,
+		suffix:     defaultLocalDomainSuffix,
+		wantIP:     knownIP6,
+		wantRes:    resultCodeSuccess,
+		qtyp:       dns.TypeAAAA,
+		wantNoData: false,
 	}, {
-		name:    "success_internal_aaaa",
-		host:    examplelan,
-		suffix:  defaultLocalDomainSuffix,
-		wantIP:  netip.Addr{},
-		wantRes: resultCodeSuccess,
-		qtyp:    dns.TypeAAAA,
+		name:       "success_internal_ipv6_a",
+		host:       example6 + "." + defaultLocalDomainSuffix,
+		suffix:     defaultLocalDomainSuffix,
+		wantIP:     netip.Addr{},
+		wantRes:    resultCodeSuccess,
+		qtyp:       dns.TypeA,
+		wantNoData: true,
 	}, {
-		name:    "success_custom_suffix",
-		host:    "example.custom",
-		suffix:  "custom",
-		wantIP:  knownIP,
-		wantRes: resultCodeSuccess,
-		qtyp:    dns.TypeA,
+		name:       "success_custom_suffix",
+		host:       "example.custom",
+		suffix:     "custom",
+		wantIP:     knownIP,
+		wantRes:    resultCodeSuccess,
+		qtyp:       dns.TypeA,
+		wantNoData: false,
 	}}
 
 	for _, tc := range testCases {
@@ -389,6 +415,9 @@ func TestServer_ProcessDHCPHosts(t *testing.T) {
 			tableHostToIP: hostToIPTable{
 				"example." + tc.suffix: knownIP,
 			},
+			tableHostToIP6: hostToIPTable{
+				example6 + "." + tc.suffix: knownIP6,
+			},
 		}
 
 		req := &dns.Msg{
@@ -422,16 +451,27 @@ func TestServer_ProcessDHCPHosts(t *testing.T) {
 
 			require.NoError(t, dctx.err)
 
-			if tc.qtyp == dns.TypeAAAA {
-				// TODO(a.garipov): Remove this special handling
-				// when we fully support AAAA.
+			switch {
+			case tc.wantNoData:
 				require.NotNil(t, pctx.Res)
 
-				ans := pctx.Res.Answer
-				require.Len(t, ans, 0)
-			} else if tc.wantIP == (netip.Addr{}) {
+				assert.Equal(t, dns.RcodeSuccess, pctx.Res.Rcode)
+				assert.Empty(t, pctx.Res.Answer)
+			case tc.wantIP == (netip.Addr{}):
 				assert.Nil(t, pctx.Res)
-			} else {
+			case tc.wantIP.Is6():
+				require.NotNil(t, pctx.Res)
+
+				ans := pctx.Res.Answer
+				require.Len(t, ans, 1)
+
+				aaaa := testutil.RequireTypeAssert[*dns.AAAA](t, ans[0])
+
+				ip, err := netutil.IPToAddr(aaaa.AAAA, netutil.AddrFamilyIPv6)
+				require.NoError(t, err)
+
+				assert.Equal(t, tc.wantIP, ip)
+			default:
 				require.NotNil(t, pctx.Res)
 
 				ans := pctx.Res.Answer
@@ -448,6 +488,48 @@ func TestServer_ProcessDHCPHosts(t *testing.T) {
 	}
 }
 
+func TestServer_onDHCPLeaseChanged(t *testing.T) {
+	const host = "myhost"
+
+	dhcp := &dhcpd.MockInterface{
+		OnEnabled: func() (ok bool) { return true },
+		OnLeases: func(flags dhcpd.GetLeasesFlags) (leases []*dhcpd.Lease) {
+			return []*dhcpd.Lease{{
+				IP:       net.IP{192, 168, 12, 34},
+				HWAddr:   net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA},
+				Hostname: host,
+			}, {
+				IP:       net.ParseIP("2001:db8::1"),
+				HWAddr:   net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA},
+				Hostname: host,
+			}}
+		},
+	}
+
+	s := &Server{
+		dhcpServer:        dhcp,
+		localDomainSuffix: defaultLocalDomainSuffix,
+	}
+
+	s.onDHCPLeaseChanged(dhcpd.LeaseChangedAdded)
+
+	ip, ip6, ok := s.dhcpHostToIP(host + "." + defaultLocalDomainSuffix)
+	require.True(t, ok)
+
+	assert.Equal(t, netip.MustParseAddr("192.168.12.34"), ip)
+	assert.Equal(t, netip.MustParseAddr("2001:db8::1"), ip6)
+
+	gotHost, ok := s.ipToDHCPHost(ip6)
+	require.True(t, ok)
+
+	assert.Equal(t, host+"."+defaultLocalDomainSuffix, gotHost)
+
+	s.onDHCPLeaseChanged(dhcpd.LeaseChangedRemovedAll)
+
+	_, _, ok = s.dhcpHostToIP(host + "." + defaultLocalDomainSuffix)
+	assert.False(t, ok)
+}
+
 func TestServer_ProcessRestrictLocal(t *testing.T) {
 	const (
 		extPTRQuestion = "251.252.253.254.in-addr.arpa."
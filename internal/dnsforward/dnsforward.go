@@ -25,6 +25,7 @@ import (
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 )
 
 // DefaultTimeout is the default upstream timeout
@@ -81,6 +82,10 @@ type Server struct {
 	localResolvers *proxy.Proxy
 	sysResolvers   aghnet.SystemResolvers
 
+	// trustedProxies are the networks parsed from conf.TrustedProxies.  Only
+	// these may set the ClientIDs of plain DNS requests.
+	trustedProxies netutil.SubnetSet
+
 	// recDetector is a cache for recursive requests.  It is used to detect
 	// and prevent recursive requests only for private upstreams.
 	//
@@ -95,12 +100,73 @@ type Server struct {
 	// anonymizer masks the client's IP addresses if needed.
 	anonymizer *aghnet.IPMut
 
+	// tableHostToIP and tableHostToIP6 are the tables of hostnames of the DHCP
+	// clients to their IPv4 and IPv6 addresses correspondingly.  Both are
+	// protected by tableHostToIPLock.
 	tableHostToIP     hostToIPTable
+	tableHostToIP6    hostToIPTable
 	tableHostToIPLock sync.Mutex
 
 	tableIPToHost     ipToHostTable
 	tableIPToHostLock sync.Mutex
 
+	// answerRules are the global answer post-processing rules.  It's nil if
+	// there are none.
+	answerRules *AnswerRules
+
+	// rebindingAllowlist are the normalized domain names exempt from the DNS
+	// rebinding protection.
+	rebindingAllowlist []string
+
+	// localZones are the zones served authoritatively by the server itself.
+	localZones []*localZone
+
+	// recursor is the embedded recursive resolver.  It's nil if
+	// conf.RecursiveMode is disabled.
+	recursor *recursor
+
+	// nsecCache is the aggressive negative cache.  It's nil if
+	// conf.CacheAggressiveNSEC is false or the cache is disabled.
+	nsecCache *nsecCache
+
+	// partCache is the DNS cache partitioned by the policies of the clients.
+	// It's nil if conf.CachePartitioning is false or the cache is disabled.
+	partCache *partCache
+
+	// staleCache keeps the expired responses to serve them when the upstreams
+	// fail.  It's nil if conf.CacheServeStale is false or the cache is
+	// disabled.
+	staleCache *staleCache
+
+	// prefetcher refreshes the responses to the most popular requests.  It's
+	// nil if conf.CachePrefetch is false or the prefetching isn't possible.
+	prefetcher *prefetcher
+
+	// dnstap is the dnstap exporter.  It's nil if conf.Dnstap isn't enabled.
+	dnstap *dnstapWriter
+
+	// xfr serves the zone transfers to the secondaries.  It's nil if
+	// conf.ZoneTransfer isn't enabled.
+	xfr *zoneTransfer
+
+	// slowQueries is the log of the queries processed for longer than
+	// conf.SlowQueryThreshold.
+	slowQueries *slowQueryLog
+
+	// upsLatency are the response time histograms of the upstreams.
+	upsLatency *upstreamLatency
+
+	// upsPool applies the connection settings to the upstreams and collects
+	// their utilization statistics.
+	upsPool *UpstreamPool
+
+	// upsFailover switches the default upstreams to the secondary ones while
+	// they are failing.  It's nil if conf.UpstreamFailover is disabled.
+	upsFailover *upstreamFailover
+
+	// sessions are the encrypted DNS sessions of the clients.
+	sessions *sessionTracker
+
 	// clientIDCache is a temporary storage for ClientIDs that were extracted
 	// during the BeforeRequestHandler stage.
 	clientIDCache cache.Cache
@@ -109,6 +175,45 @@ type Server struct {
 	// We don't Start() it and so no listen port is required.
 	internalProxy *proxy.Proxy
 
+	// listenProxy is the started proxy owning the listeners.  It differs from
+	// dnsProxy after [Server.Reload] has kept the listeners, since the queries
+	// it accepts are then resolved by dnsProxy.  It's nil if dnsProxy has no
+	// listeners of its own.
+	listenProxy *proxy.Proxy
+
+	// doqListenAddrs are the addresses of the DNS-over-QUIC listeners served
+	// by the server itself instead of dnsProxy.  It's only set when the QUIC
+	// transport is configured, see [Server.prepareTLS].
+	doqListenAddrs []*net.UDPAddr
+
+	// doqListeners are the DNS-over-QUIC listeners started on doqListenAddrs.
+	doqListeners []quic.EarlyListener
+
+	// proxyProtoTCPAddrs and proxyProtoTLSAddrs are the addresses of the plain
+	// DNS-over-TCP and DNS-over-TLS listeners served by the server itself
+	// instead of dnsProxy.  They're only set when the PROXY protocol is
+	// enabled, see [Server.createProxyConfig].
+	proxyProtoTCPAddrs []*net.TCPAddr
+	proxyProtoTLSAddrs []*net.TCPAddr
+
+	// proxyProtoListeners are the listeners started on proxyProtoTCPAddrs and
+	// proxyProtoTLSAddrs.
+	proxyProtoListeners []net.Listener
+
+	// pureProxy is the proxy owning the pure proxy listeners.  It's nil if
+	// there are none, see [PureProxyConfig].
+	pureProxy *proxy.Proxy
+
+	// listenPureProxy is the started pureProxy.  Like listenProxy, it differs
+	// from pureProxy after [Server.Reload] has kept the listeners.
+	listenPureProxy *proxy.Proxy
+
+	// activatedListeners and activatedConns are the duplicates of the sockets
+	// from conf.ActivatedTCPListeners and conf.ActivatedUDPConns served by the
+	// server itself.
+	activatedListeners []net.Listener
+	activatedConns     []*net.UDPConn
+
 	isRunning bool
 
 	conf ServerConfig
@@ -170,7 +275,11 @@ func NewServer(p DNSCreateParams) (s *Server, err error) {
 			EnableLRU: true,
 			MaxCount:  defaultClientIDCacheCount,
 		}),
-		anonymizer: p.Anonymizer,
+		anonymizer:  p.Anonymizer,
+		slowQueries: newSlowQueryLog(),
+		upsLatency:  newUpstreamLatency(),
+		upsPool:     newUpstreamPool(),
+		sessions:    newSessionTracker(),
 	}
 
 	// TODO(e.burkov): Enable the refresher after the actual implementation
@@ -208,6 +317,18 @@ func (s *Server) Close() {
 	s.stats = nil
 	s.queryLog = nil
 	s.dnsProxy = nil
+	s.listenProxy = nil
+
+	if s.dnstap != nil {
+		if err := s.dnstap.Close(); err != nil {
+			log.Error("closing dnstap: %s", err)
+		}
+
+		s.dnstap = nil
+	}
+
+	s.prefetcher.close()
+	s.prefetcher = nil
 
 	if err := s.ipset.close(); err != nil {
 		log.Error("closing ipset: %s", err)
@@ -226,8 +347,10 @@ func (s *Server) WriteDiskConfig(c *FilteringConfig) {
 	c.AllowedClients = stringutil.CloneSlice(sc.AllowedClients)
 	c.DisallowedClients = stringutil.CloneSlice(sc.DisallowedClients)
 	c.BlockedHosts = stringutil.CloneSlice(sc.BlockedHosts)
+	c.TemporaryAllowedClients = unexpiredTemporaryClients(sc.TemporaryAllowedClients, time.Now())
 	c.TrustedProxies = stringutil.CloneSlice(sc.TrustedProxies)
 	c.UpstreamDNS = stringutil.CloneSlice(sc.UpstreamDNS)
+	c.UpstreamFailover.Upstreams = stringutil.CloneSlice(sc.UpstreamFailover.Upstreams)
 }
 
 // RDNSSettings returns the copy of actual RDNS configuration.
@@ -362,11 +485,52 @@ func (s *Server) Start() error {
 
 // startLocked starts the DNS server without locking. For internal use only.
 func (s *Server) startLocked() error {
-	err := s.dnsProxy.Start()
-	if err == nil {
-		s.isRunning = true
+	// dnsproxy refuses to start without any addresses, which is the case when
+	// all its listeners are replaced by the sockets passed by the service
+	// manager, so only initialize it then.
+	var err error
+	if hasListenAddrs(s.dnsProxy) {
+		err = s.dnsProxy.Start()
+		if err != nil {
+			return err
+		}
+
+		s.listenProxy = s.dnsProxy
+	} else {
+		err = s.dnsProxy.Init()
+		if err != nil {
+			return err
+		}
 	}
-	return err
+
+	for _, start := range []func() error{
+		s.startDoQ,
+		s.startProxyProto,
+		s.startPureProxy,
+		s.startActivated,
+	} {
+		err = start()
+		if err != nil {
+			s.stopListeners()
+
+			return err
+		}
+	}
+
+	s.isRunning = true
+
+	return nil
+}
+
+// hasListenAddrs returns true if prx has any addresses to listen on.
+func hasListenAddrs(prx *proxy.Proxy) (ok bool) {
+	return len(prx.UDPListenAddr) > 0 ||
+		len(prx.TCPListenAddr) > 0 ||
+		len(prx.TLSListenAddr) > 0 ||
+		len(prx.HTTPSListenAddr) > 0 ||
+		len(prx.QUICListenAddr) > 0 ||
+		len(prx.DNSCryptUDPListenAddr) > 0 ||
+		len(prx.DNSCryptTCPListenAddr) > 0
 }
 
 // defaultLocalTimeout is the default timeout for resolving addresses from
@@ -441,13 +605,14 @@ func (s *Server) setupResolvers(localAddrs []string) (err error) {
 	log.Debug("upstreams to resolve PTR for local addresses: %v", localAddrs)
 
 	var upsConfig *proxy.UpstreamConfig
-	upsConfig, err = proxy.ParseUpstreamsConfig(
+	upsConfig, err = ParseUpstreamsConfig(
 		localAddrs,
 		&upstream.Options{
 			Bootstrap: bootstraps,
 			Timeout:   defaultLocalTimeout,
 			// TODO(e.burkov): Should we verify server's certificates?
 		},
+		s.upsPool,
 	)
 	if err != nil {
 		return fmt.Errorf("parsing upstreams: %w", err)
@@ -472,8 +637,40 @@ func (s *Server) Prepare(conf *ServerConfig) (err error) {
 		return fmt.Errorf("checking blocking mode: %w", err)
 	}
 
+	err = s.conf.BlockedResponseSOA.validate()
+	if err != nil {
+		return fmt.Errorf("checking blocked response soa: %w", err)
+	}
+
+	s.conf.BlockedResponseSOA.normalize()
+
+	err = s.conf.UpstreamPool.validate()
+	if err != nil {
+		return fmt.Errorf("checking upstream pool: %w", err)
+	}
+
+	err = s.upsPool.setConfig(s.conf.UpstreamPool, s.conf.UpstreamPipelining)
+	if err != nil {
+		return fmt.Errorf("checking upstream pool: %w", err)
+	}
+
 	s.initDefaultSettings()
 
+	err = s.conf.RecursiveMode.validate()
+	if err != nil {
+		return fmt.Errorf("checking recursive mode: %w", err)
+	}
+
+	err = s.conf.UpstreamFailover.validate()
+	if err != nil {
+		return fmt.Errorf("checking upstream failover: %w", err)
+	}
+
+	s.recursor = nil
+	if s.conf.RecursiveMode.enabled() {
+		s.recursor = newRecursor(s.conf.UpstreamTimeout)
+	}
+
 	err = s.prepareIpsetListSettings()
 	if err != nil {
 		// Don't wrap the error, because it's informative enough as is.
@@ -485,23 +682,92 @@ func (s *Server) Prepare(conf *ServerConfig) (err error) {
 		return fmt.Errorf("preparing upstream settings: %w", err)
 	}
 
+	err = s.prepareViews()
+	if err != nil {
+		return fmt.Errorf("preparing views: %w", err)
+	}
+
 	var proxyConfig proxy.Config
 	proxyConfig, err = s.createProxyConfig()
 	if err != nil {
 		return fmt.Errorf("preparing proxy: %w", err)
 	}
 
+	err = s.preparePureProxy(&proxyConfig)
+	if err != nil {
+		return fmt.Errorf("preparing pure proxy: %w", err)
+	}
+
 	s.setupDNS64()
 
+	s.answerRules, err = ParseAnswerRules(s.conf.AnswerRules)
+	if err != nil {
+		return fmt.Errorf("preparing answer rules: %w", err)
+	}
+
+	s.rebindingAllowlist, err = parseRebindingAllowlist(s.conf.RebindingAllowlist)
+	if err != nil {
+		return fmt.Errorf("preparing rebinding allowlist: %w", err)
+	}
+
+	s.localZones, err = loadLocalZones(s.conf.LocalZones)
+	if err != nil {
+		return fmt.Errorf("preparing local zones: %w", err)
+	}
+
+	s.xfr = nil
+	if s.conf.ZoneTransfer.Enabled {
+		s.xfr, err = newZoneTransfer(&s.conf.ZoneTransfer, s.localDomainSuffix)
+		if err != nil {
+			return fmt.Errorf("preparing zone transfer: %w", err)
+		}
+	}
+
+	err = s.prepareDnstap()
+	if err != nil {
+		return fmt.Errorf("preparing dnstap: %w", err)
+	}
+
+	s.nsecCache = nil
+	if s.conf.CacheAggressiveNSEC && s.conf.CacheSize != 0 {
+		s.nsecCache = newNSECCache(s.conf.CacheMaxTTL)
+	}
+
+	s.partCache = nil
+	if s.conf.CachePartitioning && s.conf.CacheSize != 0 {
+		s.partCache = newPartCache(s.conf.CacheSize, s.conf.CacheMinTTL, s.conf.CacheMaxTTL)
+	}
+
+	s.staleCache = nil
+	if s.conf.CacheServeStale && s.conf.CacheSize != 0 {
+		s.staleCache = newStaleCache(
+			s.conf.CacheSize,
+			s.conf.CacheMaxStale,
+			s.conf.CacheMinTTL,
+			s.conf.CacheMaxTTL,
+			s.staleResolve,
+		)
+	}
+
+	s.preparePrefetcher()
+
 	err = s.prepareInternalProxy()
 	if err != nil {
 		return fmt.Errorf("preparing internal proxy: %w", err)
 	}
 
+	trusted, err := netutil.ParseSubnets(s.conf.TrustedProxies...)
+	if err != nil {
+		return fmt.Errorf("parsing trusted proxies: %w", err)
+	}
+
+	s.trustedProxies = netutil.SliceSubnetSet(trusted)
+
 	s.access, err = newAccessCtx(
 		s.conf.AllowedClients,
 		s.conf.DisallowedClients,
 		s.conf.BlockedHosts,
+		s.conf.TemporaryAllowedClients,
 	)
 	if err != nil {
 		return fmt.Errorf("preparing access: %w", err)
@@ -595,12 +861,7 @@ func (s *Server) stopLocked() (err error) {
 	// This will require filtering all the non-critical errors in
 	// [upstream.Upstream] implementations.
 
-	if s.dnsProxy != nil {
-		err = s.dnsProxy.Stop()
-		if err != nil {
-			log.Error("dnsforward: closing primary resolvers: %s", err)
-		}
-	}
+	s.stopListeners()
 
 	if upsConf := s.internalProxy.UpstreamConfig; upsConf != nil {
 		err = upsConf.Close()
@@ -616,11 +877,31 @@ func (s *Server) stopLocked() (err error) {
 		}
 	}
 
+	s.upsFailover.close()
+
 	s.isRunning = false
 
 	return nil
 }
 
+// stopListeners stops the listening proxy and the listeners served by the
+// server itself.
+func (s *Server) stopListeners() {
+	if s.listenProxy != nil {
+		err := s.listenProxy.Stop()
+		if err != nil {
+			log.Error("dnsforward: closing primary resolvers: %s", err)
+		}
+
+		s.listenProxy = nil
+	}
+
+	s.stopDoQ()
+	s.stopProxyProto()
+	s.stopPureProxy()
+	s.stopActivated()
+}
+
 // IsRunning returns true if the DNS server is running.
 func (s *Server) IsRunning() bool {
 	s.serverLock.RLock()
@@ -690,6 +971,21 @@ func (s *Server) IsBlockedClient(ip netip.Addr, clientID string) (blocked bool,
 	s.serverLock.RLock()
 	defer s.serverLock.RUnlock()
 
+	return s.isBlockedClientLocked(ip, clientID)
+}
+
+// isBlockedClientLocked is like [Server.IsBlockedClient] but requires
+// s.serverLock to be locked.
+func (s *Server) isBlockedClientLocked(
+	ip netip.Addr,
+	clientID string,
+) (blocked bool, rule string) {
+	if s.access.isTemporarilyAllowed(ip, clientID, time.Now()) {
+		log.Debug("client %v (id %q) is temporarily allowed", ip, clientID)
+
+		return false, ""
+	}
+
 	blockedByIP := false
 	if ip != (netip.Addr{}) {
 		blockedByIP, rule = s.access.isBlockedIP(ip)
@@ -0,0 +1,574 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/version"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"golang.org/x/exp/slices"
+)
+
+// DnstapConfig is the configuration of the dnstap exporter, which sends the
+// client queries and responses to a dnstap receiver using the Frame Streams
+// protocol.
+//
+// See https://dnstap.info.
+type DnstapConfig struct {
+	// Address is the address of the dnstap receiver, either
+	// "unix:///path/to/socket" or "tcp://host:port".
+	Address string `yaml:"address"`
+
+	// Identity is the identity of the server sent within the messages.  If
+	// empty, the hostname is used.
+	Identity string `yaml:"identity"`
+
+	// Enabled defines if the dnstap exporter is enabled.
+	Enabled bool `yaml:"enabled"`
+}
+
+// Frame Streams constants.
+//
+// See https://farsightsec.github.io/fstrm.
+const (
+	// fstrmContentType is the content type of the dnstap data frames.
+	fstrmContentType = "protobuf:dnstap.Dnstap"
+
+	// fstrmFieldContentType is the type of the content type field of the
+	// control frames.
+	fstrmFieldContentType uint32 = 0x01
+
+	// fstrmMaxControlLen is the maximum length of the control frames accepted
+	// from the receiver.
+	fstrmMaxControlLen = 512
+)
+
+// fstrmControl is the type of the Frame Streams control frames.
+type fstrmControl uint32
+
+// fstrmControl values.
+const (
+	fstrmControlAccept fstrmControl = 0x01
+	fstrmControlStart  fstrmControl = 0x02
+	fstrmControlStop   fstrmControl = 0x03
+	fstrmControlReady  fstrmControl = 0x04
+	fstrmControlFinish fstrmControl = 0x05
+)
+
+// Dnstap protobuf constants.
+//
+// See https://github.com/dnstap/dnstap.pb/blob/master/dnstap.proto.
+const (
+	dnstapTypeMessage = 1
+
+	dnstapMessageClientQuery    = 5
+	dnstapMessageClientResponse = 6
+
+	dnstapFamilyINET  = 1
+	dnstapFamilyINET6 = 2
+
+	dnstapProtoUDP         = 1
+	dnstapProtoTCP         = 2
+	dnstapProtoDoT         = 3
+	dnstapProtoDoH         = 4
+	dnstapProtoDNSCryptUDP = 5
+	dnstapProtoDNSCryptTCP = 6
+	dnstapProtoDoQ         = 7
+)
+
+// Settings of the dnstap writer.
+const (
+	// dnstapQueueSize is the maximum number of messages waiting to be sent.
+	// The new messages are dropped when the queue is full.
+	dnstapQueueSize = 10_000
+
+	// dnstapTimeout is the timeout for connecting to the receiver, for the
+	// Frame Streams handshake, and for writing each frame.
+	dnstapTimeout = 1 * time.Second
+
+	// dnstapRedialIvl is the minimum interval between the attempts to connect
+	// to the receiver.  The messages are dropped while it's unavailable.
+	dnstapRedialIvl = 5 * time.Second
+)
+
+// dnstapMessage is a single client query or response to send.
+type dnstapMessage struct {
+	// queryTime is the time the query was received.
+	queryTime time.Time
+
+	// responseTime is the time the response was sent.  It's only set for the
+	// responses.
+	responseTime time.Time
+
+	// queryAddr is the IP address of the client.
+	queryAddr net.IP
+
+	// query is the wire-format query message.
+	query []byte
+
+	// response is the wire-format response message.  It's nil for queries.
+	response []byte
+
+	// queryPort is the port of the client.
+	queryPort uint16
+
+	// proto is the dnstap socket protocol of the query.
+	proto uint64
+}
+
+// dnstapWriter sends the messages to the dnstap receiver from a separate
+// goroutine, so that a slow or unavailable receiver doesn't slow down the
+// processing of the DNS queries.
+type dnstapWriter struct {
+	// conn is the connection to the receiver.  It's only used in the writing
+	// goroutine and is nil when disconnected.
+	conn net.Conn
+
+	// lastDial is the time of the last attempt to connect to the receiver.
+	lastDial time.Time
+
+	// mu protects msgs from being written to after closing.
+	mu *sync.RWMutex
+
+	// msgs is the queue of the messages to send.
+	msgs chan *dnstapMessage
+
+	// done is closed when the writing goroutine exits.
+	done chan struct{}
+
+	// network is the network of the receiver, either "unix" or "tcp".
+	network string
+
+	// address is the address of the receiver.
+	address string
+
+	// identity is the identity of the server.
+	identity []byte
+
+	// version is the version of the server.
+	version []byte
+
+	// closed is true if the writer is closed.
+	closed bool
+}
+
+// newDnstapWriter returns a new properly initialized *dnstapWriter and starts
+// its writing goroutine.  conf must not be nil.
+func newDnstapWriter(conf *DnstapConfig) (w *dnstapWriter, err error) {
+	u, err := url.Parse(conf.Address)
+	if err != nil {
+		return nil, fmt.Errorf("bad address: %w", err)
+	}
+
+	w = &dnstapWriter{
+		mu:      &sync.RWMutex{},
+		msgs:    make(chan *dnstapMessage, dnstapQueueSize),
+		done:    make(chan struct{}),
+		network: u.Scheme,
+		version: []byte("AdGuard Home " + version.Version()),
+	}
+
+	switch u.Scheme {
+	case "unix":
+		w.address = u.Path
+	case "tcp":
+		w.address = u.Host
+	default:
+		return nil, fmt.Errorf("bad address %q: unsupported scheme %q", conf.Address, u.Scheme)
+	}
+
+	if w.address == "" {
+		return nil, fmt.Errorf("bad address %q: empty", conf.Address)
+	}
+
+	identity := conf.Identity
+	if identity == "" {
+		identity, err = os.Hostname()
+		if err != nil {
+			log.Debug("dnsforward: dnstap: getting hostname: %s", err)
+		}
+	}
+
+	w.identity = []byte(identity)
+
+	go w.loop()
+
+	return w, nil
+}
+
+// add queues msg for sending.  msg must not be modified.
+func (w *dnstapWriter) add(msg *dnstapMessage) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return
+	}
+
+	select {
+	case w.msgs <- msg:
+		// Go on.
+	default:
+		log.Debug("dnsforward: dnstap: queue is full, dropping message")
+	}
+}
+
+// loop sends the queued messages until the queue is closed.
+func (w *dnstapWriter) loop() {
+	defer log.OnPanic("dnsforward: dnstap")
+	defer close(w.done)
+
+	for msg := range w.msgs {
+		w.send(w.encode(msg))
+	}
+
+	if w.conn != nil {
+		w.disconnect()
+	}
+}
+
+// send writes data within a data frame to the receiver, connecting to it if
+// necessary.
+func (w *dnstapWriter) send(data []byte) {
+	if w.conn == nil {
+		if time.Since(w.lastDial) < dnstapRedialIvl {
+			return
+		}
+
+		w.lastDial = time.Now()
+		err := w.connect()
+		if err != nil {
+			log.Error("dnsforward: dnstap: connecting to %s: %s", w.address, err)
+
+			return
+		}
+
+		log.Info("dnsforward: dnstap: connected to %s", w.address)
+	}
+
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	err := w.conn.SetWriteDeadline(time.Now().Add(dnstapTimeout))
+	if err == nil {
+		_, err = w.conn.Write(append(frame, data...))
+	}
+
+	if err != nil {
+		log.Error("dnsforward: dnstap: writing to %s: %s", w.address, err)
+
+		cerr := w.conn.Close()
+		if cerr != nil {
+			log.Debug("dnsforward: dnstap: closing connection: %s", cerr)
+		}
+
+		w.conn = nil
+	}
+}
+
+// connect connects to the receiver and performs the bidirectional Frame
+// Streams handshake.
+func (w *dnstapWriter) connect() (err error) {
+	conn, err := net.DialTimeout(w.network, w.address, dnstapTimeout)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, conn.Close())
+		}
+	}()
+
+	err = conn.SetDeadline(time.Now().Add(dnstapTimeout))
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	err = writeFstrmControl(conn, fstrmControlReady)
+	if err != nil {
+		return fmt.Errorf("writing ready: %w", err)
+	}
+
+	err = readFstrmControl(conn, fstrmControlAccept)
+	if err != nil {
+		return fmt.Errorf("reading accept: %w", err)
+	}
+
+	err = writeFstrmControl(conn, fstrmControlStart)
+	if err != nil {
+		return fmt.Errorf("writing start: %w", err)
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("resetting deadline: %w", err)
+	}
+
+	w.conn = conn
+
+	return nil
+}
+
+// disconnect stops the Frame Streams session and closes the connection to the
+// receiver.  w.conn must not be nil.
+func (w *dnstapWriter) disconnect() {
+	conn := w.conn
+	w.conn = nil
+
+	err := conn.SetDeadline(time.Now().Add(dnstapTimeout))
+	if err == nil {
+		err = writeFstrmControl(conn, fstrmControlStop)
+	}
+
+	if err == nil {
+		err = readFstrmControl(conn, fstrmControlFinish)
+	}
+
+	err = errors.WithDeferred(err, conn.Close())
+	if err != nil {
+		log.Debug("dnsforward: dnstap: disconnecting: %s", err)
+	}
+}
+
+// writeFstrmControl writes the control frame of type typ with the dnstap
+// content type to w.
+func writeFstrmControl(w io.Writer, typ fstrmControl) (err error) {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(typ))
+	if typ != fstrmControlStop {
+		payload = binary.BigEndian.AppendUint32(payload, fstrmFieldContentType)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(fstrmContentType)))
+		payload = append(payload, fstrmContentType...)
+	}
+
+	// The control frames are prefixed with the zero escape sequence.
+	frame := make([]byte, 4, 8+len(payload))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	_, err = w.Write(append(frame, payload...))
+
+	return err
+}
+
+// readFstrmControl reads a control frame from r and checks that its type is
+// want.
+func readFstrmControl(r io.Reader, want fstrmControl) (err error) {
+	var hdr [8]byte
+	_, err = io.ReadFull(r, hdr[:])
+	if err != nil {
+		return err
+	}
+
+	if esc := binary.BigEndian.Uint32(hdr[:4]); esc != 0 {
+		return fmt.Errorf("got data frame of length %d, want control frame", esc)
+	}
+
+	l := binary.BigEndian.Uint32(hdr[4:])
+	if l < 4 || l > fstrmMaxControlLen {
+		return fmt.Errorf("bad control frame length %d", l)
+	}
+
+	payload := make([]byte, l)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return err
+	}
+
+	if got := fstrmControl(binary.BigEndian.Uint32(payload)); got != want {
+		return fmt.Errorf("got control frame of type %d, want %d", got, want)
+	}
+
+	return nil
+}
+
+// encode returns the protobuf-encoded Dnstap message containing msg.
+func (w *dnstapWriter) encode(msg *dnstapMessage) (b []byte) {
+	var m []byte
+	if msg.response == nil {
+		m = appendPBVarint(m, 1, dnstapMessageClientQuery)
+	} else {
+		m = appendPBVarint(m, 1, dnstapMessageClientResponse)
+	}
+
+	if ip4 := msg.queryAddr.To4(); ip4 != nil {
+		m = appendPBVarint(m, 2, dnstapFamilyINET)
+		m = appendPBBytes(m, 4, ip4)
+	} else if msg.queryAddr != nil {
+		m = appendPBVarint(m, 2, dnstapFamilyINET6)
+		m = appendPBBytes(m, 4, msg.queryAddr)
+	}
+
+	m = appendPBVarint(m, 3, msg.proto)
+	m = appendPBVarint(m, 6, uint64(msg.queryPort))
+	m = appendPBVarint(m, 8, uint64(msg.queryTime.Unix()))
+	m = appendPBFixed32(m, 9, uint32(msg.queryTime.Nanosecond()))
+	m = appendPBBytes(m, 10, msg.query)
+
+	if msg.response != nil {
+		m = appendPBVarint(m, 12, uint64(msg.responseTime.Unix()))
+		m = appendPBFixed32(m, 13, uint32(msg.responseTime.Nanosecond()))
+		m = appendPBBytes(m, 14, msg.response)
+	}
+
+	b = appendPBBytes(b, 1, w.identity)
+	b = appendPBBytes(b, 2, w.version)
+	b = appendPBBytes(b, 14, m)
+	b = appendPBVarint(b, 15, dnstapTypeMessage)
+
+	return b
+}
+
+// Protobuf wire types.
+const (
+	pbWireVarint  = 0
+	pbWireBytes   = 2
+	pbWireFixed32 = 5
+)
+
+// appendPBVarint appends the varint field with number n and value v to b.
+func appendPBVarint(b []byte, n int, v uint64) (res []byte) {
+	b = binary.AppendUvarint(b, uint64(n<<3|pbWireVarint))
+
+	return binary.AppendUvarint(b, v)
+}
+
+// appendPBBytes appends the length-delimited field with number n and value v
+// to b.
+func appendPBBytes(b []byte, n int, v []byte) (res []byte) {
+	b = binary.AppendUvarint(b, uint64(n<<3|pbWireBytes))
+	b = binary.AppendUvarint(b, uint64(len(v)))
+
+	return append(b, v...)
+}
+
+// appendPBFixed32 appends the fixed32 field with number n and value v to b.
+func appendPBFixed32(b []byte, n int, v uint32) (res []byte) {
+	b = binary.AppendUvarint(b, uint64(n<<3|pbWireFixed32))
+
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+// type check
+var _ io.Closer = (*dnstapWriter)(nil)
+
+// Close implements the [io.Closer] interface for *dnstapWriter.  It sends the
+// remaining queued messages and closes the connection to the receiver.
+func (w *dnstapWriter) Close() (err error) {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+
+		return nil
+	}
+
+	w.closed = true
+	close(w.msgs)
+	w.mu.Unlock()
+
+	<-w.done
+
+	return nil
+}
+
+// prepareDnstap closes the previous dnstap writer, if any, and creates a new
+// one, if it's enabled in the configuration.
+func (s *Server) prepareDnstap() (err error) {
+	if s.dnstap != nil {
+		err = s.dnstap.Close()
+		if err != nil {
+			log.Debug("dnsforward: closing dnstap: %s", err)
+		}
+
+		s.dnstap = nil
+	}
+
+	conf := &s.conf.Dnstap
+	if !conf.Enabled {
+		return nil
+	}
+
+	s.dnstap, err = newDnstapWriter(conf)
+
+	return err
+}
+
+// processDnstap sends the client query and the response to the dnstap
+// receiver, if the exporter is enabled.
+func (s *Server) processDnstap(dctx *dnsContext) (rc resultCode) {
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
+	if s.dnstap == nil {
+		return resultCodeSuccess
+	}
+
+	pctx := dctx.proxyCtx
+	query, err := pctx.Req.Pack()
+	if err != nil {
+		log.Debug("dnsforward: dnstap: packing query: %s", err)
+
+		return resultCodeSuccess
+	}
+
+	ip, port := netutil.IPAndPortFromAddr(pctx.Addr)
+	ip = slices.Clone(ip)
+	s.anonymizer.Load()(ip)
+
+	msg := &dnstapMessage{
+		queryTime: dctx.startTime,
+		queryAddr: ip,
+		query:     query,
+		queryPort: uint16(port),
+		proto:     dnstapProto(pctx),
+	}
+	s.dnstap.add(msg)
+
+	if pctx.Res == nil {
+		return resultCodeSuccess
+	}
+
+	resp, err := pctx.Res.Pack()
+	if err != nil {
+		log.Debug("dnsforward: dnstap: packing response: %s", err)
+
+		return resultCodeSuccess
+	}
+
+	respMsg := *msg
+	respMsg.responseTime = time.Now()
+	respMsg.response = resp
+	s.dnstap.add(&respMsg)
+
+	return resultCodeSuccess
+}
+
+// dnstapProto returns the dnstap socket protocol of the request.
+func dnstapProto(pctx *proxy.DNSContext) (proto uint64) {
+	_, isUDP := pctx.Addr.(*net.UDPAddr)
+
+	switch pctx.Proto {
+	case proxy.ProtoTLS:
+		return dnstapProtoDoT
+	case proxy.ProtoHTTPS:
+		return dnstapProtoDoH
+	case proxy.ProtoQUIC:
+		return dnstapProtoDoQ
+	case proxy.ProtoDNSCrypt:
+		if isUDP {
+			return dnstapProtoDNSCryptUDP
+		}
+
+		return dnstapProtoDNSCryptTCP
+	case proxy.ProtoTCP:
+		return dnstapProtoTCP
+	default:
+		return dnstapProtoUDP
+	}
+}
@@ -0,0 +1,192 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDnstapWriter(t *testing.T) {
+	testCases := []struct {
+		name       string
+		addr       string
+		wantErrMsg string
+	}{{
+		name:       "unix",
+		addr:       "unix:///run/dnstap.sock",
+		wantErrMsg: "",
+	}, {
+		name:       "tcp",
+		addr:       "tcp://127.0.0.1:6000",
+		wantErrMsg: "",
+	}, {
+		name:       "bad_scheme",
+		addr:       "udp://127.0.0.1:6000",
+		wantErrMsg: `bad address "udp://127.0.0.1:6000": unsupported scheme "udp"`,
+	}, {
+		name:       "empty",
+		addr:       "tcp://",
+		wantErrMsg: `bad address "tcp://": empty`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w, err := newDnstapWriter(&DnstapConfig{Address: tc.addr})
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if err == nil {
+				testutil.CleanupAndRequireSuccess(t, w.Close)
+			}
+		})
+	}
+}
+
+func TestDnstapWriter(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", sockPath)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	w, err := newDnstapWriter(&DnstapConfig{
+		Address:  "unix://" + sockPath,
+		Identity: "test",
+		Enabled:  true,
+	})
+	require.NoError(t, err)
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	query, err := req.Pack()
+	require.NoError(t, err)
+
+	resp, err := (&dns.Msg{}).SetReply(req).Pack()
+	require.NoError(t, err)
+
+	queryTime := time.Unix(1_000_000, 123)
+	msg := &dnstapMessage{
+		queryTime: queryTime,
+		queryAddr: net.IP{1, 2, 3, 4},
+		query:     query,
+		queryPort: 5353,
+		proto:     dnstapProtoUDP,
+	}
+	w.add(msg)
+	w.add(&dnstapMessage{
+		queryTime:    queryTime,
+		responseTime: queryTime.Add(time.Second),
+		queryAddr:    net.IP{1, 2, 3, 4},
+		query:        query,
+		response:     resp,
+		queryPort:    5353,
+		proto:        dnstapProtoUDP,
+	})
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	require.NoError(t, readFstrmControl(conn, fstrmControlReady))
+	require.NoError(t, writeFstrmControl(conn, fstrmControlAccept))
+	require.NoError(t, readFstrmControl(conn, fstrmControlStart))
+
+	t.Run("query", func(t *testing.T) {
+		fields := pbTestDecode(t, readTestFstrmData(t, conn))
+		assert.Equal(t, []byte("test"), fields[1])
+		assert.Equal(t, uint64(dnstapTypeMessage), fields[15])
+
+		m := pbTestDecode(t, testutil.RequireTypeAssert[[]byte](t, fields[14]))
+		assert.Equal(t, uint64(dnstapMessageClientQuery), m[1])
+		assert.Equal(t, uint64(dnstapFamilyINET), m[2])
+		assert.Equal(t, uint64(dnstapProtoUDP), m[3])
+		assert.Equal(t, []byte{1, 2, 3, 4}, m[4])
+		assert.Equal(t, uint64(5353), m[6])
+		assert.Equal(t, uint64(1_000_000), m[8])
+		assert.Equal(t, uint32(123), m[9])
+		assert.Equal(t, query, m[10])
+		assert.NotContains(t, m, 14)
+	})
+
+	t.Run("response", func(t *testing.T) {
+		fields := pbTestDecode(t, readTestFstrmData(t, conn))
+
+		m := pbTestDecode(t, testutil.RequireTypeAssert[[]byte](t, fields[14]))
+		assert.Equal(t, uint64(dnstapMessageClientResponse), m[1])
+		assert.Equal(t, uint64(1_000_001), m[12])
+		assert.Equal(t, resp, m[14])
+	})
+
+	go func() {
+		// Reply to the stop frame sent on closing.
+		if readFstrmControl(conn, fstrmControlStop) == nil {
+			_ = writeFstrmControl(conn, fstrmControlFinish)
+		}
+	}()
+
+	require.NoError(t, w.Close())
+
+	// The messages added after closing must be dropped.
+	w.add(msg)
+}
+
+// readTestFstrmData reads a Frame Streams data frame from r.
+func readTestFstrmData(t *testing.T, r io.Reader) (data []byte) {
+	t.Helper()
+
+	var hdr [4]byte
+	_, err := io.ReadFull(r, hdr[:])
+	require.NoError(t, err)
+
+	data = make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	_, err = io.ReadFull(r, data)
+	require.NoError(t, err)
+
+	return data
+}
+
+// pbTestDecode decodes the protobuf message b into a map of field numbers to
+// their values of types uint64, uint32, or []byte.
+func pbTestDecode(t *testing.T, b []byte) (fields map[int]any) {
+	t.Helper()
+
+	fields = map[int]any{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		require.Positive(t, n)
+
+		b = b[n:]
+		num := int(key >> 3)
+		switch key & 0x7 {
+		case pbWireVarint:
+			var v uint64
+			v, n = binary.Uvarint(b)
+			require.Positive(t, n)
+
+			fields[num], b = v, b[n:]
+		case pbWireBytes:
+			var l uint64
+			l, n = binary.Uvarint(b)
+			require.Positive(t, n)
+
+			b = b[n:]
+			require.GreaterOrEqual(t, uint64(len(b)), l)
+
+			fields[num], b = b[:l], b[l:]
+		case pbWireFixed32:
+			require.GreaterOrEqual(t, len(b), 4)
+
+			fields[num], b = binary.LittleEndian.Uint32(b), b[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&0x7)
+		}
+	}
+
+	return fields
+}
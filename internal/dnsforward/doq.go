@@ -0,0 +1,313 @@
+package dnsforward
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// defaultDoQMaxIdleTimeout is the default maximum idle timeout of the
+// DNS-over-QUIC connections.  It's the same as the one used by dnsproxy.
+const defaultDoQMaxIdleTimeout = 5 * time.Minute
+
+// doqProtos are the ALPN tokens of DNS-over-QUIC, including the ones of the
+// previous drafts, in the order of preference.
+var doqProtos = []string{proxy.NextProtoDQ, "doq-i02", "doq-i00", "dq"}
+
+// quicConfig returns the QUIC transport configuration for the DNS-over-QUIC
+// listeners.
+func (c *QUICConfig) quicConfig() (conf *quic.Config) {
+	idle := c.MaxIdleTimeout.Duration
+	if idle == 0 {
+		idle = defaultDoQMaxIdleTimeout
+	}
+
+	allow0RTT := !c.Disable0RTT
+
+	return &quic.Config{
+		MaxIdleTimeout:        idle,
+		KeepAlivePeriod:       c.KeepAlivePeriod.Duration,
+		MaxIncomingStreams:    math.MaxUint16,
+		MaxIncomingUniStreams: math.MaxUint16,
+		Allow0RTT: func(_ net.Addr) (ok bool) {
+			return allow0RTT
+		},
+	}
+}
+
+// startDoQ starts the DNS-over-QUIC listeners on s.doqListenAddrs, if any.
+// s.dnsProxy must be started.
+func (s *Server) startDoQ() (err error) {
+	if len(s.doqListenAddrs) == 0 {
+		return nil
+	}
+
+	tlsConf := s.dnsProxy.TLSConfig.Clone()
+	tlsConf.NextProtos = doqProtos
+	quicConf := s.conf.QUIC.quicConfig()
+
+	for _, addr := range s.doqListenAddrs {
+		var l quic.EarlyListener
+		l, err = quic.ListenAddrEarly(addr.String(), tlsConf, quicConf)
+		if err != nil {
+			s.stopDoQ()
+
+			return fmt.Errorf("listening quic on %s: %w", addr, err)
+		}
+
+		s.doqListeners = append(s.doqListeners, l)
+		go s.serveDoQ(l)
+
+		log.Info("dnsforward: listening to quic://%s", l.Addr())
+	}
+
+	return nil
+}
+
+// stopDoQ closes the DNS-over-QUIC listeners started by s.startDoQ.
+func (s *Server) stopDoQ() {
+	for _, l := range s.doqListeners {
+		err := l.Close()
+		if err != nil {
+			log.Error("dnsforward: closing quic listener %s: %s", l.Addr(), err)
+		}
+	}
+
+	s.doqListeners = nil
+}
+
+// serveDoQ accepts the connections from l until it's closed.  It's intended to
+// be used as a goroutine.
+func (s *Server) serveDoQ(l quic.EarlyListener) {
+	defer log.OnPanic("dnsforward: serving quic")
+
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			logDoQErr("accepting quic conn", err)
+
+			return
+		}
+
+		go s.handleDoQConn(conn)
+	}
+}
+
+// handleDoQConn accepts the streams of conn until it's closed.  Each stream
+// carries a single query.
+func (s *Server) handleDoQConn(conn quic.Connection) {
+	defer log.OnPanic("dnsforward: handling quic conn")
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			logDoQErr("accepting quic stream", err)
+			closeDoQConn(conn, proxy.DoQCodeNoError)
+
+			return
+		}
+
+		go func() {
+			defer log.OnPanic("dnsforward: handling quic stream")
+
+			s.handleDoQStream(conn, stream)
+
+			// Indicate that no more data will be sent on this stream.
+			_ = stream.Close()
+		}()
+	}
+}
+
+// handleDoQStream reads the query from stream, passes it to the request
+// handlers of s.dnsProxy, and writes the response back.
+func (s *Server) handleDoQStream(conn quic.Connection, stream quic.Stream) {
+	// The query may be prefixed with its 2-octet length.
+	data, err := io.ReadAll(io.LimitReader(stream, dns.MaxMsgSize+2))
+	if err != nil {
+		logDoQErr("reading quic stream", err)
+
+		return
+	}
+
+	req, ver, err := unpackDoQ(data)
+	if err != nil {
+		log.Debug("dnsforward: quic: %s", err)
+		closeDoQConn(conn, proxy.DoQCodeProtocolError)
+
+		return
+	}
+
+	pctx := &proxy.DNSContext{
+		Proto:          proxy.ProtoQUIC,
+		Req:            req,
+		Addr:           conn.RemoteAddr(),
+		QUICStream:     stream,
+		QUICConnection: conn,
+		DoQVersion:     ver,
+		StartTime:      time.Now(),
+	}
+
+	prx := s.proxy()
+	if prx == nil {
+		closeDoQConn(conn, proxy.DoQCodeInternalError)
+
+		return
+	}
+
+	if !serveRequest(prx, pctx) {
+		return
+	}
+
+	err = writeDoQ(stream, pctx)
+	if err != nil {
+		log.Debug("dnsforward: quic: %s", err)
+		closeDoQConn(conn, proxy.DoQCodeInternalError)
+	}
+}
+
+// ownRequestID is the last ID of the requests accepted by the server's own
+// listeners.  The highest bit of these IDs is set to avoid collisions with the
+// ones assigned by dnsproxy.
+var ownRequestID uint64
+
+// serveRequest passes pctx, accepted by one of the server's own listeners, to
+// the request handlers configured in prx, the same ones prx uses for the other
+// protocols.  respond is false if no response must be sent.
+//
+// dnsproxy doesn't export the request handling of its listeners, so this only
+// repeats the checks it makes before calling the handlers.
+func serveRequest(prx *proxy.Proxy, pctx *proxy.DNSContext) (respond bool) {
+	if pctx.RequestID == 0 {
+		pctx.RequestID = atomic.AddUint64(&ownRequestID, 1) | 1<<63
+	}
+
+	req := pctx.Req
+	if req.Response {
+		log.Debug("dnsforward: %s: dropping response packet from %s", pctx.Proto, pctx.Addr)
+
+		return false
+	}
+
+	if h := prx.BeforeRequestHandler; h != nil {
+		ok, err := h(prx, pctx)
+		if err != nil {
+			log.Error("dnsforward: %s: before request: %s", pctx.Proto, err)
+			pctx.Res = (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure)
+
+			return true
+		} else if !ok {
+			return false
+		}
+	}
+
+	var err error
+	switch {
+	case len(req.Question) != 1:
+		pctx.Res = (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure)
+	case prx.RefuseAny && req.Question[0].Qtype == dns.TypeANY:
+		pctx.Res = (&dns.Msg{}).SetRcode(req, dns.RcodeNotImplemented)
+	case prx.RequestHandler != nil:
+		err = prx.RequestHandler(prx, pctx)
+	default:
+		err = prx.Resolve(pctx)
+	}
+
+	if err != nil {
+		log.Debug("dnsforward: %s: handling request: %s", pctx.Proto, err)
+	}
+
+	return true
+}
+
+// unpackDoQ unpacks the DNS-over-QUIC query from data and detects the version
+// of the protocol.
+func unpackDoQ(data []byte) (req *dns.Msg, ver proxy.DoQVersion, err error) {
+	if len(data) < 2 {
+		return nil, 0, fmt.Errorf("query too short: %d bytes", len(data))
+	}
+
+	// The messages of DoQ v1 are prefixed with their length, unlike the ones
+	// of the previous drafts.
+	req, ver = &dns.Msg{}, proxy.DoQv1
+	if int(binary.BigEndian.Uint16(data)) == len(data)-2 {
+		err = req.Unpack(data[2:])
+	} else {
+		ver = proxy.DoQv1Draft
+		err = req.Unpack(data)
+	}
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("unpacking query: %w", err)
+	}
+
+	// See https://www.rfc-editor.org/rfc/rfc9250.html#section-5.5.2.
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0TCPKEEPALIVE {
+				return nil, 0, errors.Error("query contains edns tcp keepalive option")
+			}
+		}
+	}
+
+	return req, ver, nil
+}
+
+// writeDoQ writes the response from pctx to w using the protocol version of
+// the query.
+func writeDoQ(w io.Writer, pctx *proxy.DNSContext) (err error) {
+	if pctx.Res == nil {
+		return errors.Error("no response to write")
+	}
+
+	data, err := pctx.Res.Pack()
+	if err != nil {
+		return fmt.Errorf("packing response: %w", err)
+	}
+
+	if pctx.DoQVersion == proxy.DoQv1 {
+		data = append(binary.BigEndian.AppendUint16(nil, uint16(len(data))), data...)
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return fmt.Errorf("writing response: %w", err)
+	}
+
+	return nil
+}
+
+// closeDoQConn closes conn with code and logs the error, if any.
+func closeDoQConn(conn quic.Connection, code quic.ApplicationErrorCode) {
+	err := conn.CloseWithError(code, "")
+	if err != nil {
+		log.Debug("dnsforward: closing quic conn with code %d: %s", code, err)
+	}
+}
+
+// logDoQErr logs err occurred during the action on the debug level if it's
+// caused by closing or timing out, and on the error level otherwise.
+func logDoQErr(action string, err error) {
+	var appErr *quic.ApplicationError
+	var idleErr *quic.IdleTimeoutError
+	if errors.Is(err, quic.ErrServerClosed) ||
+		errors.Is(err, quic.Err0RTTRejected) ||
+		errors.As(err, &idleErr) ||
+		(errors.As(err, &appErr) && appErr.ErrorCode == proxy.DoQCodeNoError) {
+		log.Debug("dnsforward: %s: closed or timed out: %s", action, err)
+
+		return
+	}
+
+	log.Error("dnsforward: %s: %s", action, err)
+}
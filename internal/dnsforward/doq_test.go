@@ -0,0 +1,224 @@
+package dnsforward
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQUICConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		conf       QUICConfig
+	}{{
+		name:       "empty",
+		wantErrMsg: "",
+		conf:       QUICConfig{},
+	}, {
+		name:       "valid",
+		wantErrMsg: "",
+		conf: QUICConfig{
+			MaxIdleTimeout:  timeutil.Duration{Duration: time.Minute},
+			KeepAlivePeriod: timeutil.Duration{Duration: 15 * time.Second},
+			Disable0RTT:     true,
+		},
+	}, {
+		name:       "reno",
+		wantErrMsg: "",
+		conf: QUICConfig{
+			CongestionControl: CongestionControlReno,
+		},
+	}, {
+		name:       "bad_congestion_control",
+		wantErrMsg: `congestion_control: unsupported algorithm "bbr", only "reno" is available`,
+		conf: QUICConfig{
+			CongestionControl: "bbr",
+		},
+	}, {
+		name:       "negative_idle",
+		wantErrMsg: "max_idle_timeout: negative value -1s",
+		conf: QUICConfig{
+			MaxIdleTimeout: timeutil.Duration{Duration: -time.Second},
+		},
+	}, {
+		name:       "negative_keep_alive",
+		wantErrMsg: "keep_alive_period: negative value -1s",
+		conf: QUICConfig{
+			KeepAlivePeriod: timeutil.Duration{Duration: -time.Second},
+		},
+	}, {
+		name:       "keep_alive_too_long",
+		wantErrMsg: "keep_alive_period: 5m0s must be less than max_idle_timeout 5m0s",
+		conf: QUICConfig{
+			KeepAlivePeriod: timeutil.Duration{Duration: defaultDoQMaxIdleTimeout},
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.conf.Validate()
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestQUICConfig_quicConfig(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		conf := (&QUICConfig{}).quicConfig()
+
+		assert.Equal(t, defaultDoQMaxIdleTimeout, conf.MaxIdleTimeout)
+		assert.Zero(t, conf.KeepAlivePeriod)
+		assert.True(t, conf.Allow0RTT(nil))
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		conf := (&QUICConfig{
+			MaxIdleTimeout:  timeutil.Duration{Duration: time.Minute},
+			KeepAlivePeriod: timeutil.Duration{Duration: 15 * time.Second},
+			Disable0RTT:     true,
+		}).quicConfig()
+
+		assert.Equal(t, time.Minute, conf.MaxIdleTimeout)
+		assert.Equal(t, 15*time.Second, conf.KeepAlivePeriod)
+		assert.False(t, conf.Allow0RTT(nil))
+	})
+}
+
+func TestDoQ_messages(t *testing.T) {
+	// DNS-over-QUIC messages must have zero IDs.
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	req.Id = 0
+	resp := (&dns.Msg{}).SetRcode(req, dns.RcodeSuccess)
+
+	reqData, err := req.Pack()
+	require.NoError(t, err)
+
+	prefixed := append([]byte{0, byte(len(reqData))}, reqData...)
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		data       []byte
+		wantVer    proxy.DoQVersion
+	}{{
+		name:       "v1",
+		wantErrMsg: "",
+		data:       prefixed,
+		wantVer:    proxy.DoQv1,
+	}, {
+		name:       "draft",
+		wantErrMsg: "",
+		data:       reqData,
+		wantVer:    proxy.DoQv1Draft,
+	}, {
+		name:       "short",
+		wantErrMsg: "query too short: 1 bytes",
+		data:       []byte{0},
+		wantVer:    0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ver, uerr := unpackDoQ(tc.data)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, uerr)
+			if tc.wantErrMsg != "" {
+				return
+			}
+
+			require.NotNil(t, got)
+
+			assert.Equal(t, req.Question, got.Question)
+			assert.Equal(t, tc.wantVer, ver)
+
+			buf := &bytes.Buffer{}
+			err = writeDoQ(buf, &proxy.DNSContext{Res: resp, DoQVersion: ver})
+			require.NoError(t, err)
+
+			written, _, uerr := unpackDoQ(buf.Bytes())
+			require.NoError(t, uerr)
+
+			assert.Equal(t, resp.Id, written.Id)
+			assert.True(t, written.Response)
+		})
+	}
+
+	t.Run("no_response", func(t *testing.T) {
+		err = writeDoQ(&bytes.Buffer{}, &proxy.DNSContext{DoQVersion: proxy.DoQv1})
+		testutil.AssertErrorMsg(t, "no response to write", err)
+	})
+}
+
+func TestServeRequest(t *testing.T) {
+	var handled bool
+	prx := &proxy.Proxy{
+		Config: proxy.Config{
+			RefuseAny: true,
+			BeforeRequestHandler: func(_ *proxy.Proxy, pctx *proxy.DNSContext) (ok bool, err error) {
+				return pctx.Req.Question[0].Name != "dropped.example.", nil
+			},
+			RequestHandler: func(_ *proxy.Proxy, pctx *proxy.DNSContext) (err error) {
+				handled = true
+				pctx.Res = (&dns.Msg{}).SetReply(pctx.Req)
+
+				return nil
+			},
+		},
+	}
+
+	testCases := []struct {
+		req         *dns.Msg
+		name        string
+		wantRespond bool
+		wantHandled bool
+		wantRcode   int
+	}{{
+		req:         (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA),
+		name:        "handled",
+		wantRespond: true,
+		wantHandled: true,
+		wantRcode:   dns.RcodeSuccess,
+	}, {
+		req:         (&dns.Msg{}).SetReply((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)),
+		name:        "response",
+		wantRespond: false,
+		wantHandled: false,
+		wantRcode:   0,
+	}, {
+		req:         (&dns.Msg{}).SetQuestion("dropped.example.", dns.TypeA),
+		name:        "dropped",
+		wantRespond: false,
+		wantHandled: false,
+		wantRcode:   0,
+	}, {
+		req:         (&dns.Msg{}).SetQuestion("example.org.", dns.TypeANY),
+		name:        "refuse_any",
+		wantRespond: true,
+		wantHandled: false,
+		wantRcode:   dns.RcodeNotImplemented,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handled = false
+			pctx := &proxy.DNSContext{Proto: proxy.ProtoQUIC, Req: tc.req}
+
+			respond := serveRequest(prx, pctx)
+			assert.Equal(t, tc.wantRespond, respond)
+			assert.Equal(t, tc.wantHandled, handled)
+
+			if tc.wantRespond {
+				require.NotNil(t, pctx.Res)
+
+				assert.Equal(t, tc.wantRcode, pctx.Res.Rcode)
+			}
+		})
+	}
+}
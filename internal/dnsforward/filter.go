@@ -19,13 +19,20 @@ func (s *Server) beforeRequestHandler(
 	_ *proxy.Proxy,
 	pctx *proxy.DNSContext,
 ) (reply bool, err error) {
+	// Lock the server, since the configuration may be reloaded while the
+	// listeners are running.
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
 	clientID, err := s.clientIDFromDNSContext(pctx)
 	if err != nil {
 		return false, fmt.Errorf("getting clientid: %w", err)
 	}
 
+	s.recordSession(pctx, clientID)
+
 	addrPort := netutil.NetAddrToAddrPort(pctx.Addr)
-	blocked, _ := s.IsBlockedClient(addrPort.Addr(), clientID)
+	blocked, _ := s.isBlockedClientLocked(addrPort.Addr(), clientID)
 	if blocked {
 		return s.preBlockedResponse(pctx)
 	}
@@ -51,15 +58,19 @@ func (s *Server) beforeRequestHandler(
 }
 
 // getClientRequestFilteringSettings looks up client filtering settings using
-// the client's IP address and ID, if any, from dctx.
+// the client's IP address and ID, if any, from dctx.  It also sets the client's
+// view in dctx and applies it to the settings.
 func (s *Server) getClientRequestFilteringSettings(dctx *dnsContext) *filtering.Settings {
 	setts := s.dnsFilter.GetConfig()
 	setts.ProtectionEnabled = dctx.protectionEnabled
+	ip, _ := netutil.IPAndPortFromAddr(dctx.proxyCtx.Addr)
 	if s.conf.FilterHandler != nil {
-		ip, _ := netutil.IPAndPortFromAddr(dctx.proxyCtx.Addr)
 		s.conf.FilterHandler(ip, dctx.clientID, &setts)
 	}
 
+	dctx.view = s.findView(ip, setts.ClientTags)
+	s.applyView(dctx.view, &setts)
+
 	return &setts
 }
 
@@ -77,7 +88,22 @@ func (s *Server) filterDNSRequest(dctx *dnsContext) (res *filtering.Result, err
 
 	// TODO(a.garipov): Make CheckHost return a pointer.
 	res = &resVal
+	if res.Reason == filtering.NotFilteredNotFound && isHTTPSType(q.Qtype) {
+		var httpsRes *filtering.Result
+		httpsRes, err = s.filterHTTPSRequest(dctx, host)
+		if err != nil {
+			return nil, err
+		} else if httpsRes != nil {
+			res = httpsRes
+		}
+	}
+
+	s.dnsFilter.RecordBlocked(host, dctx.setts, res)
+
 	switch {
+	case res.IsFiltered && dctx.setts.DryRun:
+		log.Debug("dnsforward: dry run: host %q would be filtered, reason %q", host, res.Reason)
+		res.DryRun = true
 	case res.IsFiltered:
 		log.Tracef("host %q is filtered, reason %q, rule: %q", host, res.Reason, res.Rules[0].Text)
 		pctx.Res = s.genDNSFilterMessage(pctx, res)
@@ -187,6 +213,15 @@ func (s *Server) filterDNSResponse(
 			return nil, err
 		} else if res == nil {
 			continue
+		} else if res.IsFiltered && setts.DryRun {
+			log.Debug(
+				"dnsforward: dry run: %s would be filtered by response: %s",
+				pctx.Req.Question[0].Name,
+				host,
+			)
+			res.DryRun = true
+
+			return res, nil
 		} else if res.IsFiltered {
 			pctx.Res = s.genDNSFilterMessage(pctx, res)
 			log.Debug("DNSFwd: Matched %s by response: %s", pctx.Req.Question[0].Name, host)
@@ -197,3 +232,100 @@ func (s *Server) filterDNSResponse(
 
 	return nil, nil
 }
+
+// filterServiceDiscovery checks the targets of the SRV and NAPTR records of the
+// response from pctx against the rules of the blocked services, so that the
+// clients can't discover the hosts of a blocked service through the discovery
+// names outside of its domains.  The response is replaced with the negative
+// one if any of them matches.  res is not nil if the response has been
+// blocked.
+func (s *Server) filterServiceDiscovery(
+	pctx *proxy.DNSContext,
+	setts *filtering.Settings,
+) (res *filtering.Result) {
+	if len(setts.ServicesRules) == 0 {
+		return nil
+	}
+
+	for _, rrs := range [][]dns.RR{pctx.Res.Answer, pctx.Res.Extra} {
+		for _, rr := range rrs {
+			var host string
+			switch rr := rr.(type) {
+			case *dns.SRV:
+				host = rr.Target
+			case *dns.NAPTR:
+				host = rr.Replacement
+			default:
+				continue
+			}
+
+			host = strings.TrimSuffix(host, ".")
+			if host == "" {
+				continue
+			}
+
+			r := filtering.CheckBlockedServices(host, setts)
+			if !r.IsFiltered {
+				continue
+			}
+
+			log.Debug(
+				"dnsforward: %s points to %s of blocked service %s",
+				pctx.Req.Question[0].Name,
+				host,
+				r.ServiceName,
+			)
+
+			if setts.DryRun {
+				r.DryRun = true
+			} else {
+				pctx.Res = s.genDNSFilterMessage(pctx, &r)
+			}
+
+			return &r
+		}
+	}
+
+	return nil
+}
+
+// filterResponseSize checks the size of the response of pctx against the rules
+// with the size modifiers.  The response is replaced with the blocked one, if
+// it's too large, or truncated, if it's sent over UDP and a truncating rule
+// matches it.  res is not nil if the response has been blocked.
+func (s *Server) filterResponseSize(
+	pctx *proxy.DNSContext,
+	setts *filtering.Settings,
+) (res *filtering.Result) {
+	if !setts.FilteringEnabled || pctx.Res == nil {
+		return nil
+	}
+
+	q := pctx.Req.Question[0]
+	host := strings.TrimSuffix(q.Name, ".")
+	size := pctx.Res.Len()
+	res, truncLimit := s.dnsFilter.CheckResponseSize(
+		host,
+		q.Qtype,
+		size,
+		pctx.Proto == proxy.ProtoUDP,
+		setts,
+	)
+	if res != nil {
+		if setts.DryRun {
+			log.Debug("dnsforward: dry run: response of %d bytes to %s would be blocked", size, q.Name)
+			res.DryRun = true
+		} else {
+			pctx.Res = s.genDNSFilterMessage(pctx, res)
+		}
+
+		return res
+	}
+
+	if truncLimit > 0 && !setts.DryRun {
+		log.Debug("dnsforward: truncating response of %d bytes to %s to %d", size, q.Name, truncLimit)
+		pctx.Res.Truncate(truncLimit)
+	}
+
+	return nil
+}
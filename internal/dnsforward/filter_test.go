@@ -155,3 +155,171 @@ func TestHandleDNSRequest_filterDNSResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleDNSRequest_dryRun(t *testing.T) {
+	const rules = `||blocked.domain^`
+
+	forwardConf := ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			ProtectionEnabled: true,
+			BlockingMode:      BlockingModeDefault,
+			EDNSClientSubnet: &EDNSClientSubnet{
+				Enabled: false,
+			},
+		},
+	}
+	filters := []filtering.Filter{{
+		ID: 0, Data: []byte(rules),
+	}}
+
+	f, err := filtering.New(&filtering.Config{DryRun: true}, filters)
+	require.NoError(t, err)
+	f.SetEnabled(true)
+
+	s, err := NewServer(DNSCreateParams{
+		DHCPServer:  testDHCP,
+		DNSFilter:   f,
+		PrivateNets: netutil.SubnetSetFunc(netutil.IsLocallyServed),
+	})
+	require.NoError(t, err)
+
+	err = s.Prepare(&forwardConf)
+	require.NoError(t, err)
+
+	ql := &testQueryLog{}
+	s.queryLog = ql
+
+	blockedIP := net.IP{1, 2, 3, 4}
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&aghtest.Upstream{
+			CName: map[string][]string{
+				"should.block.": {"blocked.domain."},
+			},
+			IPv4: map[string][]net.IP{
+				"blocked.domain.": {blockedIP},
+				"should.block.":   {blockedIP},
+			},
+		},
+	}
+	startDeferStop(t, s)
+
+	testCases := []struct {
+		name   string
+		host   string
+		wantIP net.IP
+	}{{
+		name:   "request",
+		host:   "blocked.domain.",
+		wantIP: blockedIP,
+	}, {
+		name:   "response",
+		host:   "should.block.",
+		wantIP: blockedIP,
+	}}
+
+	for _, tc := range testCases {
+		dctx := &proxy.DNSContext{
+			Proto: proxy.ProtoUDP,
+			Req:   createTestMessage(tc.host),
+			Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1},
+		}
+
+		t.Run(tc.name, func(t *testing.T) {
+			err = s.handleDNSRequest(nil, dctx)
+			require.NoError(t, err)
+			require.NotNil(t, dctx.Res)
+			require.NotEmpty(t, dctx.Res.Answer)
+
+			a, ok := dctx.Res.Answer[len(dctx.Res.Answer)-1].(*dns.A)
+			require.True(t, ok)
+
+			assert.Equal(t, tc.wantIP, a.A.To4())
+
+			require.NotNil(t, ql.lastParams)
+
+			res := ql.lastParams.Result
+			require.NotNil(t, res)
+
+			assert.True(t, res.IsFiltered)
+			assert.True(t, res.DryRun)
+			assert.Equal(t, filtering.FilteredBlockList, res.Reason)
+		})
+	}
+}
+
+func TestServer_filterServiceDiscovery(t *testing.T) {
+	filtering.InitModule()
+
+	f, err := filtering.New(&filtering.Config{}, nil)
+	require.NoError(t, err)
+
+	setts := &filtering.Settings{
+		ProtectionEnabled: true,
+		FilteringEnabled:  true,
+	}
+	f.ApplyBlockedServices(setts, []string{"9gag"})
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				BlockingMode: BlockingModeDefault,
+			},
+		},
+	}
+
+	req := createTestMessageWithType("_sips._tcp.example.org.", dns.TypeSRV)
+
+	testCases := []struct {
+		rr        dns.RR
+		name      string
+		wantRcode int
+	}{{
+		rr: &dns.SRV{
+			Hdr:    dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSRV},
+			Target: "sip.example.org.",
+		},
+		name:      "not_blocked",
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		rr: &dns.SRV{
+			Hdr:    dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSRV},
+			Target: "sip.9gag.com.",
+		},
+		name:      "srv",
+		wantRcode: dns.RcodeNameError,
+	}, {
+		rr: &dns.NAPTR{
+			Hdr:         dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeNAPTR},
+			Service:     "SIPS+D2T",
+			Replacement: "_sips._tcp.9gag.com.",
+		},
+		name:      "naptr",
+		wantRcode: dns.RcodeNameError,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{tc.rr}
+
+			pctx := &proxy.DNSContext{
+				Req: req,
+				Res: resp,
+			}
+
+			res := s.filterServiceDiscovery(pctx, setts)
+			if tc.wantRcode == dns.RcodeSuccess {
+				assert.Nil(t, res)
+			} else {
+				require.NotNil(t, res)
+
+				assert.Equal(t, filtering.FilteredBlockedService, res.Reason)
+				assert.Equal(t, "9gag", res.ServiceName)
+			}
+
+			assert.Equal(t, tc.wantRcode, pctx.Res.Rcode)
+		})
+	}
+}
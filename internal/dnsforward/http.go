@@ -24,25 +24,46 @@ import (
 
 // jsonDNSConfig is the JSON representation of the DNS server configuration.
 type jsonDNSConfig struct {
-	Upstreams         *[]string     `json:"upstream_dns"`
-	UpstreamsFile     *string       `json:"upstream_dns_file"`
-	Bootstraps        *[]string     `json:"bootstrap_dns"`
-	ProtectionEnabled *bool         `json:"protection_enabled"`
-	RateLimit         *uint32       `json:"ratelimit"`
-	BlockingMode      *BlockingMode `json:"blocking_mode"`
-	EDNSCSEnabled     *bool         `json:"edns_cs_enabled"`
-	DNSSECEnabled     *bool         `json:"dnssec_enabled"`
-	DisableIPv6       *bool         `json:"disable_ipv6"`
-	UpstreamMode      *string       `json:"upstream_mode"`
-	CacheSize         *uint32       `json:"cache_size"`
-	CacheMinTTL       *uint32       `json:"cache_ttl_min"`
-	CacheMaxTTL       *uint32       `json:"cache_ttl_max"`
-	CacheOptimistic   *bool         `json:"cache_optimistic"`
-	ResolveClients    *bool         `json:"resolve_clients"`
-	UsePrivateRDNS    *bool         `json:"use_private_ptr_resolvers"`
-	LocalPTRUpstreams *[]string     `json:"local_ptr_upstreams"`
-	BlockingIPv4      net.IP        `json:"blocking_ipv4"`
-	BlockingIPv6      net.IP        `json:"blocking_ipv6"`
+	Upstreams         *[]string      `json:"upstream_dns"`
+	UpstreamsFile     *string        `json:"upstream_dns_file"`
+	Bootstraps        *[]string      `json:"bootstrap_dns"`
+	ProtectionEnabled *bool          `json:"protection_enabled"`
+	RateLimit         *uint32        `json:"ratelimit"`
+	BlockingMode      *BlockingMode  `json:"blocking_mode"`
+	EDNSCSEnabled     *bool          `json:"edns_cs_enabled"`
+	DNSSECEnabled     *bool          `json:"dnssec_enabled"`
+	DisableIPv6       *bool          `json:"disable_ipv6"`
+	UpstreamMode      *string        `json:"upstream_mode"`
+	RecursiveMode     *RecursiveMode `json:"recursive_mode"`
+	CacheSize         *uint32        `json:"cache_size"`
+	CacheMinTTL       *uint32        `json:"cache_ttl_min"`
+	CacheMaxTTL       *uint32        `json:"cache_ttl_max"`
+	CacheOptimistic   *bool          `json:"cache_optimistic"`
+	CacheAggrNSEC     *bool          `json:"cache_aggressive_nsec"`
+	CachePartition    *bool          `json:"cache_partitioning"`
+	CachePrefetch     *bool          `json:"cache_prefetch"`
+	ResolveClients    *bool          `json:"resolve_clients"`
+	UsePrivateRDNS    *bool          `json:"use_private_ptr_resolvers"`
+	LocalPTRUpstreams *[]string      `json:"local_ptr_upstreams"`
+	AnswerRules       *[]string      `json:"answer_rules"`
+	HTTPSBlock        *bool          `json:"https_block"`
+	HTTPSStripECH     *bool          `json:"https_strip_ech"`
+	HTTPSStripIPv6    *bool          `json:"https_strip_ipv6hint"`
+	Rebinding         *bool          `json:"rebinding_protection"`
+	RebindingAllow    *[]string      `json:"rebinding_allowlist"`
+	BlockingIPv4      net.IP         `json:"blocking_ipv4"`
+	BlockingIPv6      net.IP         `json:"blocking_ipv6"`
+
+	// BlockedResponseTTL is the TTL of the blocked responses.
+	BlockedResponseTTL *uint32 `json:"blocked_response_ttl"`
+
+	// BlockedResponseSOA is the contents of the SOA record in the blocked and
+	// NXDOMAIN responses.
+	BlockedResponseSOA *BlockedResponseSOA `json:"blocked_response_soa"`
+
+	// UpstreamFailover is the configuration of the secondary upstreams used
+	// while all the default upstreams are failing.
+	UpstreamFailover *UpstreamFailover `json:"upstream_failover"`
 }
 
 func (s *Server) getDNSConfig() (c *jsonDNSConfig) {
@@ -56,6 +77,9 @@ func (s *Server) getDNSConfig() (c *jsonDNSConfig) {
 	blockingMode := s.conf.BlockingMode
 	blockingIPv4 := s.conf.BlockingIPv4
 	blockingIPv6 := s.conf.BlockingIPv6
+	blockedRespTTL := s.conf.BlockedResponseTTL
+	blockedRespSOA := s.conf.BlockedResponseSOA.withDefaults()
+	upstreamFailover := s.conf.UpstreamFailover.withDefaults()
 	ratelimit := s.conf.Ratelimit
 	enableEDNSClientSubnet := s.conf.EDNSClientSubnet.Enabled
 	enableDNSSEC := s.conf.EnableDNSSEC
@@ -64,9 +88,23 @@ func (s *Server) getDNSConfig() (c *jsonDNSConfig) {
 	cacheMinTTL := s.conf.CacheMinTTL
 	cacheMaxTTL := s.conf.CacheMaxTTL
 	cacheOptimistic := s.conf.CacheOptimistic
+	cacheAggrNSEC := s.conf.CacheAggressiveNSEC
+	cachePartition := s.conf.CachePartitioning
+	cachePrefetch := s.conf.CachePrefetch
 	resolveClients := s.conf.ResolveClients
 	usePrivateRDNS := s.conf.UsePrivateRDNS
 	localPTRUpstreams := stringutil.CloneSliceOrEmpty(s.conf.LocalPTRResolvers)
+	answerRules := stringutil.CloneSliceOrEmpty(s.conf.AnswerRules)
+	httpsBlock := s.conf.HTTPSBlock
+	httpsStripECH := s.conf.HTTPSStripECH
+	httpsStripIPv6 := s.conf.HTTPSStripIPv6Hint
+	rebinding := s.conf.RebindingProtection
+	rebindingAllow := stringutil.CloneSliceOrEmpty(s.conf.RebindingAllowlist)
+	recursiveMode := s.conf.RecursiveMode
+	if recursiveMode == "" {
+		recursiveMode = RecursiveModeDisabled
+	}
+
 	var upstreamMode string
 	if s.conf.FastestAddr {
 		upstreamMode = "fastest_addr"
@@ -90,10 +128,24 @@ func (s *Server) getDNSConfig() (c *jsonDNSConfig) {
 		CacheMinTTL:       &cacheMinTTL,
 		CacheMaxTTL:       &cacheMaxTTL,
 		CacheOptimistic:   &cacheOptimistic,
+		CacheAggrNSEC:     &cacheAggrNSEC,
+		CachePartition:    &cachePartition,
+		CachePrefetch:     &cachePrefetch,
 		UpstreamMode:      &upstreamMode,
+		RecursiveMode:     &recursiveMode,
 		ResolveClients:    &resolveClients,
 		UsePrivateRDNS:    &usePrivateRDNS,
 		LocalPTRUpstreams: &localPTRUpstreams,
+		AnswerRules:       &answerRules,
+		HTTPSBlock:        &httpsBlock,
+		HTTPSStripECH:     &httpsStripECH,
+		HTTPSStripIPv6:    &httpsStripIPv6,
+		Rebinding:         &rebinding,
+		RebindingAllow:    &rebindingAllow,
+
+		BlockedResponseTTL: &blockedRespTTL,
+		BlockedResponseSOA: &blockedRespSOA,
+		UpstreamFailover:   &upstreamFailover,
 	}
 }
 
@@ -136,10 +188,16 @@ func (req *jsonDNSConfig) checkBootstrap() (err error) {
 		return nil
 	}
 
+	return validateBootstraps(*req.Bootstraps)
+}
+
+// validateBootstraps returns an error if any of the bootstrap DNS servers is
+// invalid.
+func validateBootstraps(bootstraps []string) (err error) {
 	var b string
 	defer func() { err = errors.Annotate(err, "checking bootstrap %s: invalid address: %w", b) }()
 
-	for _, b = range *req.Bootstraps {
+	for _, b = range bootstraps {
 		if b == "" {
 			return errors.Error("empty")
 		}
@@ -173,11 +231,46 @@ func (req *jsonDNSConfig) validate(privateNets netutil.SubnetSet) (err error) {
 		return err
 	}
 
+	if req.AnswerRules != nil {
+		_, err = ParseAnswerRules(*req.AnswerRules)
+		if err != nil {
+			return fmt.Errorf("validating answer rules: %w", err)
+		}
+	}
+
+	if req.RebindingAllow != nil {
+		_, err = parseRebindingAllowlist(*req.RebindingAllow)
+		if err != nil {
+			return fmt.Errorf("validating rebinding allowlist: %w", err)
+		}
+	}
+
 	err = req.checkBlockingMode()
 	if err != nil {
 		return err
 	}
 
+	if req.RecursiveMode != nil {
+		err = req.RecursiveMode.validate()
+		if err != nil {
+			return fmt.Errorf("recursive_mode: %w", err)
+		}
+	}
+
+	if req.BlockedResponseSOA != nil {
+		err = req.BlockedResponseSOA.validate()
+		if err != nil {
+			return fmt.Errorf("blocked_response_soa: %w", err)
+		}
+	}
+
+	if req.UpstreamFailover != nil {
+		err = req.UpstreamFailover.validate()
+		if err != nil {
+			return fmt.Errorf("upstream_failover: %w", err)
+		}
+	}
+
 	switch {
 	case !req.checkUpstreamsMode():
 		return errors.Error("upstream_mode: incorrect value")
@@ -255,6 +348,16 @@ func (s *Server) setConfig(dc *jsonDNSConfig) (shouldRestart bool) {
 	setIfNotNil(&s.conf.AAAADisabled, dc.DisableIPv6)
 	setIfNotNil(&s.conf.ResolveClients, dc.ResolveClients)
 	setIfNotNil(&s.conf.UsePrivateRDNS, dc.UsePrivateRDNS)
+	setIfNotNil(&s.conf.HTTPSBlock, dc.HTTPSBlock)
+	setIfNotNil(&s.conf.HTTPSStripECH, dc.HTTPSStripECH)
+	setIfNotNil(&s.conf.HTTPSStripIPv6Hint, dc.HTTPSStripIPv6)
+	setIfNotNil(&s.conf.RebindingProtection, dc.Rebinding)
+	setIfNotNil(&s.conf.BlockedResponseTTL, dc.BlockedResponseTTL)
+
+	if dc.BlockedResponseSOA != nil {
+		s.conf.BlockedResponseSOA = *dc.BlockedResponseSOA
+		s.conf.BlockedResponseSOA.normalize()
+	}
 
 	return s.setConfigRestartable(dc)
 }
@@ -285,6 +388,13 @@ func (s *Server) setConfigRestartable(dc *jsonDNSConfig) (shouldRestart bool) {
 		setIfNotNil(&s.conf.CacheMinTTL, dc.CacheMinTTL),
 		setIfNotNil(&s.conf.CacheMaxTTL, dc.CacheMaxTTL),
 		setIfNotNil(&s.conf.CacheOptimistic, dc.CacheOptimistic),
+		setIfNotNil(&s.conf.CacheAggressiveNSEC, dc.CacheAggrNSEC),
+		setIfNotNil(&s.conf.CachePartitioning, dc.CachePartition),
+		setIfNotNil(&s.conf.CachePrefetch, dc.CachePrefetch),
+		setIfNotNil(&s.conf.AnswerRules, dc.AnswerRules),
+		setIfNotNil(&s.conf.RebindingAllowlist, dc.RebindingAllow),
+		setIfNotNil(&s.conf.RecursiveMode, dc.RecursiveMode),
+		setIfNotNil(&s.conf.UpstreamFailover, dc.UpstreamFailover),
 	} {
 		shouldRestart = shouldRestart || hasSet
 		if shouldRestart {
@@ -343,12 +453,13 @@ func newUpstreamConfig(upstreams []string) (conf *proxy.UpstreamConfig, err erro
 		}
 	}
 
-	conf, err = proxy.ParseUpstreamsConfig(
+	conf, err = ParseUpstreamsConfig(
 		upstreams,
 		&upstream.Options{
 			Bootstrap: []string{},
 			Timeout:   DefaultTimeout,
 		},
+		nil,
 	)
 	if err != nil {
 		return nil, err
@@ -419,6 +530,7 @@ var protocols = []string{
 	"tcp://",
 	"tls://",
 	"udp://",
+	"unix://",
 }
 
 // validateUpstream returns an error if u alongside with domains is not a valid
@@ -432,6 +544,12 @@ func validateUpstream(u string, domains []string) (useDefault bool, err error) {
 		return useDefault, nil
 	}
 
+	u, _, err = splitUpstreamPolicy(u)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return false, err
+	}
+
 	// Check if the upstream has a valid protocol prefix.
 	//
 	// TODO(e.burkov):  Validate the domain name.
@@ -603,10 +721,10 @@ func checkDNS(
 
 	log.Debug("dnsforward: checking if upstream %q works", upstreamAddr)
 
-	u, err := upstream.AddressToUpstream(upstreamAddr, &upstream.Options{
+	u, err := addressToUpstream(upstreamAddr, &upstream.Options{
 		Bootstrap: bootstrap,
 		Timeout:   timeout,
-	})
+	}, nil)
 	if err != nil {
 		return fmt.Errorf("failed to choose upstream for %q: %w", upstreamAddr, err)
 	}
@@ -682,6 +800,10 @@ func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 // handleCacheClear is the handler for the POST /control/cache_clear HTTP API.
 func (s *Server) handleCacheClear(w http.ResponseWriter, _ *http.Request) {
 	s.dnsProxy.ClearCache()
+	s.nsecCache.clear()
+	s.partCache.clear()
+	s.staleCache.clear()
+	s.prefetcher.clear()
 	_, _ = io.WriteString(w, "OK")
 }
 
@@ -719,9 +841,19 @@ func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister(http.MethodGet, "/control/dns_info", s.handleGetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dns_config", s.handleSetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/test_upstream_dns", s.handleTestUpstreamDNS)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dns/diagnostics", s.handleDiagnostics)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dns/slow_queries", s.handleSlowQueries)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dns/prefetch", s.handlePrefetchStats)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dns/sessions", s.handleSessions)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dns/upstream_pool", s.handleUpstreamPool)
+	s.conf.HTTPRegister(http.MethodGet, "/control/dns/zones", s.handleLocalZones)
+	s.conf.HTTPRegister(http.MethodPost, "/control/dns/zones/upload", s.handleLocalZoneUpload)
+	s.conf.HTTPRegister(http.MethodPost, "/control/dns/zones/reload", s.handleLocalZonesReload)
 
 	s.conf.HTTPRegister(http.MethodGet, "/control/access/list", s.handleAccessList)
 	s.conf.HTTPRegister(http.MethodPost, "/control/access/set", s.handleAccessSet)
+	s.conf.HTTPRegister(http.MethodPost, "/control/access/temporary/add", s.handleTemporaryAccessAdd)
+	s.conf.HTTPRegister(http.MethodPost, "/control/access/temporary/remove", s.handleTemporaryAccessRemove)
 
 	s.conf.HTTPRegister(http.MethodPost, "/control/cache_clear", s.handleCacheClear)
 
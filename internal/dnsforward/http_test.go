@@ -216,6 +216,42 @@ func TestDNSForwardHTTP_handleSetConfig(t *testing.T) {
 	}, {
 		name:    "local_ptr_upstreams_null",
 		wantSet: "",
+	}, {
+		name:    "answer_rules_good",
+		wantSet: "",
+	}, {
+		name: "answer_rules_bad",
+		wantSet: `validating answer rules: answer rule at index 0: ` +
+			`strip: unknown record type "BAD"`,
+	}, {
+		name:    "https",
+		wantSet: "",
+	}, {
+		name:    "cache_partitioning",
+		wantSet: "",
+	}, {
+		name:    "cache_prefetch",
+		wantSet: "",
+	}, {
+		name:    "blocked_response",
+		wantSet: "",
+	}, {
+		name: "blocked_response_soa_bad",
+		wantSet: `blocked_response_soa: ns: bad domain name "bad..name": ` +
+			`bad domain name label "": domain name label is empty`,
+	}, {
+		name:    "recursive_mode",
+		wantSet: "",
+	}, {
+		name:    "recursive_mode_bad",
+		wantSet: `recursive_mode: bad recursive mode "bad"`,
+	}, {
+		name:    "upstream_failover",
+		wantSet: "",
+	}, {
+		name: "upstream_failover_bad",
+		wantSet: `upstream_failover: upstreams: "[/example.org/]9.9.9.9": ` +
+			`domain-specific upstreams aren't supported`,
 	}}
 
 	var data map[string]struct {
@@ -339,6 +375,18 @@ func TestValidateUpstreams(t *testing.T) {
 			"[/host/]sdns://AQMAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20",
 			"[/пример.рф/]8.8.8.8",
 		},
+	}, {
+		name:    "valid_policy",
+		wantErr: ``,
+		set: []string{
+			"https://dns.adguard.com/dns-query#timeout=2s,retries=2,backoff=100ms",
+			"[/host.com/]1.1.1.1#retries=1",
+		},
+	}, {
+		name: "bad_policy",
+		wantErr: `validating upstream "1.1.1.1#retries=20": upstream "1.1.1.1": ` +
+			`option "retries": must not be greater than 10, got 20`,
+		set: []string{"1.1.1.1#retries=20"},
 	}, {
 		name: "bad_domain",
 		wantErr: `bad upstream for domain "[/!/]8.8.8.8": domain at index 0: ` +
@@ -0,0 +1,74 @@
+package dnsforward
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// isHTTPSType returns true if qt is either the HTTPS or the SVCB type.
+func isHTTPSType(qt uint16) (ok bool) {
+	return qt == dns.TypeHTTPS || qt == dns.TypeSVCB
+}
+
+// filterHTTPSRequest applies the HTTPS records settings to the HTTPS or SVCB
+// request for host, which isn't filtered itself.  The rules with the dnstype
+// modifier may only match the address requests, so the filtered hosts could
+// otherwise leak via the HTTPS records.  res is not nil if the request should
+// be blocked.
+func (s *Server) filterHTTPSRequest(dctx *dnsContext, host string) (res *filtering.Result, err error) {
+	conf := &s.conf
+	if !conf.HTTPSBlock && !conf.HTTPSStripECH && !conf.HTTPSStripIPv6Hint {
+		return nil, nil
+	}
+
+	for _, qt := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var addrRes filtering.Result
+		addrRes, err = s.dnsFilter.CheckHost(host, qt, dctx.setts)
+		if err != nil {
+			return nil, fmt.Errorf("checking host %q for %s: %w", host, dns.Type(qt), err)
+		} else if !addrRes.IsFiltered {
+			continue
+		}
+
+		if conf.HTTPSBlock {
+			return &addrRes, nil
+		}
+
+		if dctx.setts.DryRun {
+			log.Debug("dnsforward: dry run: https records of %q would be stripped", host)
+		} else {
+			dctx.stripHTTPS = true
+		}
+
+		return nil, nil
+	}
+
+	return nil, nil
+}
+
+// processHTTPSRecords removes the configured parameters from the HTTPS and
+// SVCB records of the response received from the upstream, if the requested
+// host is filtered for the address requests.
+func (s *Server) processHTTPSRecords(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if !dctx.stripHTTPS || !dctx.responseFromUpstream || pctx.Res == nil {
+		return resultCodeSuccess
+	}
+
+	// Copy the response, since its records may be shared with the caches.
+	pctx.Res = pctx.Res.Copy()
+	for _, rr := range pctx.Res.Answer {
+		if s.conf.HTTPSStripECH {
+			stripSVCBKey(rr, dns.SVCB_ECHCONFIG)
+		}
+
+		if s.conf.HTTPSStripIPv6Hint {
+			stripSVCBKey(rr, dns.SVCB_IPV6HINT)
+		}
+	}
+
+	return resultCodeSuccess
+}
@@ -0,0 +1,168 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_filterDNSRequest_https(t *testing.T) {
+	const rules = `||dnstype.example.org^$dnstype=A|AAAA`
+
+	forwardConf := ServerConfig{
+		FilteringConfig: FilteringConfig{
+			ProtectionEnabled: true,
+			BlockingMode:      BlockingModeDefault,
+			EDNSClientSubnet: &EDNSClientSubnet{
+				Enabled: false,
+			},
+		},
+	}
+
+	f, err := filtering.New(&filtering.Config{}, []filtering.Filter{{
+		ID: 0, Data: []byte(rules),
+	}})
+	require.NoError(t, err)
+
+	f.SetEnabled(true)
+
+	s, err := NewServer(DNSCreateParams{
+		DNSFilter:   f,
+		PrivateNets: netutil.SubnetSetFunc(netutil.IsLocallyServed),
+	})
+	require.NoError(t, err)
+
+	err = s.Prepare(&forwardConf)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name         string
+		host         string
+		block        bool
+		stripECH     bool
+		dryRun       bool
+		wantFiltered bool
+		wantStrip    bool
+	}{{
+		name:         "disabled",
+		host:         "dnstype.example.org.",
+		block:        false,
+		stripECH:     false,
+		dryRun:       false,
+		wantFiltered: false,
+		wantStrip:    false,
+	}, {
+		name:         "block",
+		host:         "dnstype.example.org.",
+		block:        true,
+		stripECH:     true,
+		dryRun:       false,
+		wantFiltered: true,
+		wantStrip:    false,
+	}, {
+		name:         "strip",
+		host:         "dnstype.example.org.",
+		block:        false,
+		stripECH:     true,
+		dryRun:       false,
+		wantFiltered: false,
+		wantStrip:    true,
+	}, {
+		name:         "strip_dry_run",
+		host:         "dnstype.example.org.",
+		block:        false,
+		stripECH:     true,
+		dryRun:       true,
+		wantFiltered: false,
+		wantStrip:    false,
+	}, {
+		name:         "not_filtered",
+		host:         "example.org.",
+		block:        true,
+		stripECH:     true,
+		dryRun:       false,
+		wantFiltered: false,
+		wantStrip:    false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s.conf.HTTPSBlock = tc.block
+			s.conf.HTTPSStripECH = tc.stripECH
+
+			req := &dns.Msg{
+				Question: []dns.Question{{
+					Name:   tc.host,
+					Qtype:  dns.TypeHTTPS,
+					Qclass: dns.ClassINET,
+				}},
+			}
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: req,
+				},
+				setts: &filtering.Settings{
+					ProtectionEnabled: true,
+					FilteringEnabled:  true,
+					DryRun:            tc.dryRun,
+				},
+			}
+
+			res, err := s.filterDNSRequest(dctx)
+			require.NoError(t, err)
+			require.NotNil(t, res)
+
+			assert.Equal(t, tc.wantFiltered, res.IsFiltered)
+			assert.Equal(t, tc.wantStrip, dctx.stripHTTPS)
+			assert.Equal(t, tc.wantFiltered, dctx.proxyCtx.Res != nil)
+		})
+	}
+}
+
+func TestServer_processHTTPSRecords(t *testing.T) {
+	const host = "example.org."
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				HTTPSStripECH:      true,
+				HTTPSStripIPv6Hint: true,
+			},
+		},
+	}
+
+	orig := &dns.Msg{
+		Answer: []dns.RR{newTestHTTPSRR(host, 3600)},
+	}
+
+	https := testutil.RequireTypeAssert[*dns.HTTPS](t, orig.Answer[0])
+	https.Value = append(https.Value, &dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP("2001:db8::1")}})
+
+	dctx := &dnsContext{
+		proxyCtx: &proxy.DNSContext{
+			Res: orig,
+		},
+		responseFromUpstream: true,
+		stripHTTPS:           true,
+	}
+
+	rc := s.processHTTPSRecords(dctx)
+	require.Equal(t, resultCodeSuccess, rc)
+
+	require.Len(t, dctx.proxyCtx.Res.Answer, 1)
+
+	https = testutil.RequireTypeAssert[*dns.HTTPS](t, dctx.proxyCtx.Res.Answer[0])
+	require.Len(t, https.Value, 1)
+
+	assert.Equal(t, dns.SVCB_ALPN, https.Value[0].Key())
+
+	// The original response must not be modified.
+	assert.Len(t, testutil.RequireTypeAssert[*dns.HTTPS](t, orig.Answer[0]).Value, 3)
+}
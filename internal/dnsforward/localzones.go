@@ -0,0 +1,471 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/mathutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/google/renameio/maybe"
+	"github.com/miekg/dns"
+)
+
+// LocalZoneConfig is the configuration of a zone served authoritatively by the
+// server itself.
+type LocalZoneConfig struct {
+	// Origin is the domain name of the apex of the zone.  It's also the
+	// initial $ORIGIN of the zone file.
+	Origin string `yaml:"origin"`
+
+	// File is the path to the zone file in the RFC 1035 format.
+	File string `yaml:"file"`
+}
+
+// maxLocalZoneCNAMEs is the maximum number of CNAME records followed within a
+// local zone when answering a query.
+const maxLocalZoneCNAMEs = 8
+
+// localZone is a parsed local zone.
+type localZone struct {
+	// soa is the SOA record of the zone apex.
+	soa *dns.SOA
+
+	// records are the resource records of the zone by their lowercased
+	// fully-qualified names.
+	records map[string][]dns.RR
+
+	// nodes are the lowercased fully-qualified names existing in the zone,
+	// including the empty non-terminals.
+	nodes map[string]unit
+
+	// origin is the lowercased fully-qualified domain name of the apex.
+	origin string
+
+	// file is the path to the zone file.
+	file string
+
+	// count is the number of the resource records in the zone.
+	count int
+}
+
+// loadLocalZones parses the zone files from confs.
+func loadLocalZones(confs []*LocalZoneConfig) (zones []*localZone, err error) {
+	zones = make([]*localZone, 0, len(confs))
+	origins := map[string]unit{}
+	for i, c := range confs {
+		var z *localZone
+		z, err = loadLocalZone(c)
+		if err != nil {
+			return nil, fmt.Errorf("zone at index %d: %w", i, err)
+		}
+
+		if _, ok := origins[z.origin]; ok {
+			return nil, fmt.Errorf("zone at index %d: duplicate origin %q", i, c.Origin)
+		}
+
+		origins[z.origin] = unit{}
+		zones = append(zones, z)
+	}
+
+	return zones, nil
+}
+
+// loadLocalZone parses the zone file from c.
+func loadLocalZone(c *LocalZoneConfig) (z *localZone, err error) {
+	if c == nil {
+		return nil, errors.Error("no zone config")
+	}
+
+	f, err := os.Open(c.File)
+	if err != nil {
+		return nil, fmt.Errorf("opening zone file: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	return parseLocalZone(f, c.Origin, c.File)
+}
+
+// parseLocalZone parses the zone with origin from r.  file is only used for
+// the error messages.  The $INCLUDE directives aren't allowed.
+func parseLocalZone(r io.Reader, origin, file string) (z *localZone, err error) {
+	err = netutil.ValidateDomainName(strings.TrimSuffix(origin, "."))
+	if err != nil {
+		return nil, fmt.Errorf("origin: %w", err)
+	}
+
+	z = &localZone{
+		records: map[string][]dns.RR{},
+		nodes:   map[string]unit{},
+		origin:  dns.CanonicalName(origin),
+		file:    file,
+	}
+
+	zp := dns.NewZoneParser(r, z.origin, file)
+	zp.SetIncludeAllowed(false)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		err = z.add(rr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = zp.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if z.soa == nil {
+		return nil, errors.Error("no soa record")
+	}
+
+	for name, rrs := range z.records {
+		if len(rrs) > 1 && hasCNAME(rrs) {
+			return nil, fmt.Errorf("%s: cname and other data", name)
+		}
+	}
+
+	return z, nil
+}
+
+// hasCNAME returns true if rrs contain a CNAME record.
+func hasCNAME(rrs []dns.RR) (ok bool) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			return true
+		}
+	}
+
+	return false
+}
+
+// add validates rr and adds it to z.
+func (z *localZone) add(rr dns.RR) (err error) {
+	hdr := rr.Header()
+	name := strings.ToLower(hdr.Name)
+	if hdr.Class != dns.ClassINET {
+		return fmt.Errorf("%s: bad class %s", hdr.Name, dns.Class(hdr.Class))
+	} else if !dns.IsSubDomain(z.origin, name) {
+		return fmt.Errorf("%s: out of zone %s", hdr.Name, z.origin)
+	}
+
+	switch rr.(type) {
+	case *dns.SOA:
+		if name != z.origin {
+			return fmt.Errorf("%s: soa record not at zone origin", hdr.Name)
+		} else if z.soa != nil {
+			return fmt.Errorf("%s: multiple soa records", hdr.Name)
+		}
+
+		z.soa = rr.(*dns.SOA)
+	case *dns.NS:
+		if name != z.origin {
+			return fmt.Errorf("%s: ns record not at zone origin", hdr.Name)
+		}
+	case *dns.A, *dns.AAAA, *dns.CNAME, *dns.MX, *dns.TXT, *dns.SRV:
+		// Go on.
+	default:
+		return fmt.Errorf("%s: unsupported record type %s", hdr.Name, dns.Type(hdr.Rrtype))
+	}
+
+	z.records[name] = append(z.records[name], rr)
+	z.count++
+
+	for n := name; n != z.origin; n = parentDomain(n) {
+		z.nodes[n] = unit{}
+	}
+
+	z.nodes[z.origin] = unit{}
+
+	return nil
+}
+
+// parentDomain returns the parent domain of the fully-qualified domain name,
+// which must not be the root one.
+func parentDomain(name string) (parent string) {
+	return name[strings.IndexByte(name, '.')+1:]
+}
+
+// find returns the records for name, which must be lowercased and within z,
+// synthesizing them from the wildcard records if needed, see RFC 4592.  ok is
+// false if there is no such name in z.
+func (z *localZone) find(name string) (rrs []dns.RR, ok bool) {
+	if _, ok = z.nodes[name]; ok {
+		return z.records[name], true
+	}
+
+	// Look for the wildcard at the closest encloser, which always exists,
+	// since the origin is one of the nodes.
+	n := parentDomain(name)
+	for ; ; n = parentDomain(n) {
+		if _, ok = z.nodes[n]; ok {
+			break
+		}
+	}
+
+	wild := "*." + n
+	if _, ok = z.nodes[wild]; !ok {
+		return nil, false
+	}
+
+	for _, rr := range z.records[wild] {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, true
+}
+
+// answer fills resp with the authoritative answer to the question q, which
+// must be within z.  The CNAME records are followed as long as their targets
+// are within z and don't form a loop.
+func (z *localZone) answer(resp *dns.Msg, q dns.Question) {
+	resp.Authoritative = true
+
+	name := strings.ToLower(q.Name)
+	visited := map[string]unit{name: {}}
+	for i := 0; i <= maxLocalZoneCNAMEs; i++ {
+		rrs, ok := z.find(name)
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = []dns.RR{z.negativeSOA()}
+
+			return
+		}
+
+		var cname *dns.CNAME
+		answered := false
+		for _, rr := range rrs {
+			if rt := rr.Header().Rrtype; rt == q.Qtype || q.Qtype == dns.TypeANY {
+				resp.Answer = append(resp.Answer, dns.Copy(rr))
+				answered = true
+			} else if c, isCNAME := rr.(*dns.CNAME); isCNAME {
+				cname = c
+			}
+		}
+
+		if cname == nil {
+			if !answered {
+				resp.Ns = []dns.RR{z.negativeSOA()}
+			}
+
+			return
+		}
+
+		resp.Answer = append(resp.Answer, dns.Copy(cname))
+
+		name = strings.ToLower(cname.Target)
+		if _, ok = visited[name]; ok || !dns.IsSubDomain(z.origin, name) {
+			return
+		}
+
+		visited[name] = unit{}
+	}
+}
+
+// negativeSOA returns the SOA record for the authority section of the negative
+// responses, see RFC 2308.
+func (z *localZone) negativeSOA() (soa *dns.SOA) {
+	soa = dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = mathutil.Min(soa.Hdr.Ttl, soa.Minttl)
+
+	return soa
+}
+
+// localZoneFor returns the most specific local zone containing name or nil if
+// there is none.  s.serverLock is expected to be locked.
+func (s *Server) localZoneFor(name string) (z *localZone) {
+	for _, lz := range s.localZones {
+		if dns.IsSubDomain(lz.origin, name) && (z == nil || len(lz.origin) > len(z.origin)) {
+			z = lz
+		}
+	}
+
+	return z
+}
+
+// processLocalZones responds authoritatively to the requests for the names
+// within the local zones.  Such responses aren't filtered.
+func (s *Server) processLocalZones(dctx *dnsContext) (rc resultCode) {
+	pctx := dctx.proxyCtx
+	if pctx.Res != nil {
+		return resultCodeSuccess
+	}
+
+	req := pctx.Req
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return resultCodeSuccess
+	}
+
+	s.serverLock.RLock()
+	z := s.localZoneFor(q.Name)
+	s.serverLock.RUnlock()
+
+	if z == nil {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dnsforward: answering %q from local zone %q", q.Name, z.origin)
+
+	resp := s.makeResponse(req)
+	z.answer(resp, q)
+	pctx.Res = resp
+
+	return resultCodeSuccess
+}
+
+// localZoneJSON is the JSON structure for a local zone.
+type localZoneJSON struct {
+	Origin  string `json:"origin"`
+	File    string `json:"file"`
+	Records int    `json:"records"`
+}
+
+// localZonesJSON is the JSON structure for the local zones.
+type localZonesJSON struct {
+	Zones []*localZoneJSON `json:"zones"`
+}
+
+// localZoneUploadReq is the JSON structure for the request to upload a local
+// zone.
+type localZoneUploadReq struct {
+	// Origin is the domain name of the apex of the zone.
+	Origin string `json:"origin"`
+
+	// Data is the content of the zone file.
+	Data string `json:"data"`
+}
+
+// localZonesToJSON returns the JSON representation of the local zones.
+// s.serverLock is expected to be locked.
+func (s *Server) localZonesToJSON() (resp *localZonesJSON) {
+	resp = &localZonesJSON{
+		Zones: make([]*localZoneJSON, 0, len(s.localZones)),
+	}
+
+	for _, z := range s.localZones {
+		resp.Zones = append(resp.Zones, &localZoneJSON{
+			Origin:  z.origin,
+			File:    z.file,
+			Records: z.count,
+		})
+	}
+
+	return resp
+}
+
+// handleLocalZones is the handler for the GET /control/dns/zones HTTP API.
+func (s *Server) handleLocalZones(w http.ResponseWriter, r *http.Request) {
+	s.serverLock.RLock()
+	resp := s.localZonesToJSON()
+	s.serverLock.RUnlock()
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// handleLocalZoneUpload is the handler for the POST /control/dns/zones/upload
+// HTTP API.  It saves the zone file into the zones directory and starts
+// serving the zone, replacing the one with the same origin, if any.
+func (s *Server) handleLocalZoneUpload(w http.ResponseWriter, r *http.Request) {
+	req := &localZoneUploadReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	if s.conf.ZonesDir == "" {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "no zones directory")
+
+		return
+	}
+
+	origin := strings.ToLower(strings.TrimSuffix(req.Origin, "."))
+	file := filepath.Join(s.conf.ZonesDir, origin+".zone")
+	z, err := parseLocalZone(strings.NewReader(req.Data), origin, file)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing zone: %s", err)
+
+		return
+	}
+
+	err = os.MkdirAll(s.conf.ZonesDir, 0o755)
+	if err == nil {
+		err = maybe.WriteFile(file, []byte(req.Data), 0o644)
+	}
+
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "writing zone file: %s", err)
+
+		return
+	}
+
+	s.setLocalZone(z)
+	s.conf.ConfigModified()
+
+	log.Debug("dnsforward: uploaded local zone %q with %d records", z.origin, z.count)
+}
+
+// setLocalZone starts serving z instead of the local zone with the same origin,
+// if any, and updates the configuration accordingly.
+func (s *Server) setLocalZone(z *localZone) {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+
+	c := &LocalZoneConfig{
+		Origin: strings.TrimSuffix(z.origin, "."),
+		File:   z.file,
+	}
+
+	// Don't modify the slices in place, since they may be shared with the
+	// configuration being written.
+	confs := make([]*LocalZoneConfig, 0, len(s.conf.LocalZones)+1)
+	for _, lzc := range s.conf.LocalZones {
+		if dns.CanonicalName(lzc.Origin) != z.origin {
+			confs = append(confs, lzc)
+		}
+	}
+
+	zones := make([]*localZone, 0, len(s.localZones)+1)
+	for _, lz := range s.localZones {
+		if lz.origin != z.origin {
+			zones = append(zones, lz)
+		}
+	}
+
+	s.conf.LocalZones = append(confs, c)
+	s.localZones = append(zones, z)
+}
+
+// handleLocalZonesReload is the handler for the POST /control/dns/zones/reload
+// HTTP API.  It parses the zone files again and responds with the new local
+// zones.  The previous zones are kept in case of an error.
+func (s *Server) handleLocalZonesReload(w http.ResponseWriter, r *http.Request) {
+	s.serverLock.RLock()
+	confs := s.conf.LocalZones
+	s.serverLock.RUnlock()
+
+	zones, err := loadLocalZones(confs)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusUnprocessableEntity, "loading local zones: %s", err)
+
+		return
+	}
+
+	s.serverLock.Lock()
+	s.localZones = zones
+	resp := s.localZonesToJSON()
+	s.serverLock.Unlock()
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
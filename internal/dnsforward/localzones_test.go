@@ -0,0 +1,373 @@
+package dnsforward
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZone is the content of the zone file used in the tests.
+const testZone = `$TTL 300
+@        IN SOA   ns.lab.example. admin.lab.example. 1 3600 600 86400 60
+@        IN NS    ns.lab.example.
+@        IN MX    10 mail.lab.example.
+ns       IN A     192.168.1.1
+nas      IN A     192.168.1.2
+nas      IN AAAA  fd00::2
+mail     IN CNAME nas
+www      IN CNAME web.example.org.
+loop1    IN CNAME loop2
+loop2    IN CNAME loop1
+_sip._tcp IN SRV  0 5 5060 nas
+*.apps   IN A     192.168.1.3
+txt      IN TXT   "hello world"
+a.b      IN A     192.168.1.4
+`
+
+func TestParseLocalZone(t *testing.T) {
+	z, err := parseLocalZone(strings.NewReader(testZone), "Lab.Example.", "test.zone")
+	require.NoError(t, err)
+
+	assert.Equal(t, "lab.example.", z.origin)
+	assert.Equal(t, 14, z.count)
+	require.NotNil(t, z.soa)
+
+	assert.Equal(t, uint32(60), z.soa.Minttl)
+
+	testCases := []struct {
+		name       string
+		origin     string
+		in         string
+		wantErrMsg string
+	}{{
+		name:       "no_soa",
+		origin:     "lab.example",
+		in:         "nas IN A 192.168.1.2\n",
+		wantErrMsg: "no soa record",
+	}, {
+		name:   "bad_origin",
+		origin: "../etc",
+		in:     "",
+		wantErrMsg: `origin: bad domain name "../etc": ` +
+			`bad domain name label "": domain name label is empty`,
+	}, {
+		name:       "out_of_zone",
+		origin:     "lab.example",
+		in:         "nas.example.org. IN A 192.168.1.2\n",
+		wantErrMsg: "nas.example.org.: out of zone lab.example.",
+	}, {
+		name:       "unsupported_type",
+		origin:     "lab.example",
+		in:         "nas IN HINFO amd64 linux\n",
+		wantErrMsg: "nas.lab.example.: unsupported record type HINFO",
+	}, {
+		name:       "ns_not_at_origin",
+		origin:     "lab.example",
+		in:         "sub IN NS ns.example.org.\n",
+		wantErrMsg: "sub.lab.example.: ns record not at zone origin",
+	}, {
+		name:   "cname_and_other_data",
+		origin: "lab.example",
+		in: "@ IN SOA ns admin 1 3600 600 86400 60\n" +
+			"nas IN CNAME ns\n" +
+			"nas IN A 192.168.1.2\n",
+		wantErrMsg: "nas.lab.example.: cname and other data",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err = parseLocalZone(strings.NewReader(tc.in), tc.origin, "test.zone")
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+
+	t.Run("include", func(t *testing.T) {
+		_, err = parseLocalZone(strings.NewReader("$INCLUDE other.zone\n"), "lab.example", "test.zone")
+		assert.Error(t, err)
+	})
+}
+
+func TestServer_processLocalZones(t *testing.T) {
+	z, err := parseLocalZone(strings.NewReader(testZone), "lab.example", "test.zone")
+	require.NoError(t, err)
+
+	sub, err := parseLocalZone(
+		strings.NewReader("@ IN SOA ns admin 1 3600 600 86400 30\nnas IN A 10.0.0.1\n"),
+		"sub.lab.example",
+		"sub.zone",
+	)
+	require.NoError(t, err)
+
+	s := &Server{
+		localZones: []*localZone{z, sub},
+	}
+
+	testCases := []struct {
+		name       string
+		host       string
+		wantAns    []string
+		qtype      uint16
+		wantRcode  int
+		wantSOATTL uint32
+		wantNoResp bool
+	}{{
+		name:      "a",
+		host:      "NAS.lab.example.",
+		wantAns:   []string{"192.168.1.2"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "aaaa",
+		host:      "nas.lab.example.",
+		wantAns:   []string{"fd00::2"},
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "cname_in_zone",
+		host:      "mail.lab.example.",
+		wantAns:   []string{"nas.lab.example.", "192.168.1.2"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "cname_out_of_zone",
+		host:      "www.lab.example.",
+		wantAns:   []string{"web.example.org."},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "cname_loop",
+		host:      "loop1.lab.example.",
+		wantAns:   []string{"loop2.lab.example.", "loop1.lab.example."},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "mx",
+		host:      "lab.example.",
+		wantAns:   []string{"mail.lab.example."},
+		qtype:     dns.TypeMX,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "srv",
+		host:      "_sip._tcp.lab.example.",
+		wantAns:   []string{"nas.lab.example."},
+		qtype:     dns.TypeSRV,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "txt",
+		host:      "txt.lab.example.",
+		wantAns:   []string{"hello world"},
+		qtype:     dns.TypeTXT,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "wildcard",
+		host:      "grafana.apps.lab.example.",
+		wantAns:   []string{"192.168.1.3"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:       "nodata",
+		host:       "nas.lab.example.",
+		wantAns:    nil,
+		qtype:      dns.TypeTXT,
+		wantRcode:  dns.RcodeSuccess,
+		wantSOATTL: 60,
+	}, {
+		name:       "empty_non_terminal",
+		host:       "b.lab.example.",
+		wantAns:    nil,
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSOATTL: 60,
+	}, {
+		name:       "nxdomain",
+		host:       "printer.lab.example.",
+		wantAns:    nil,
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeNameError,
+		wantSOATTL: 60,
+	}, {
+		name:      "most_specific_zone",
+		host:      "nas.sub.lab.example.",
+		wantAns:   []string{"10.0.0.1"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:       "not_local",
+		host:       "example.org.",
+		qtype:      dns.TypeA,
+		wantNoResp: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: createTestMessageWithType(tc.host, tc.qtype),
+				},
+			}
+
+			rc := s.processLocalZones(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			resp := dctx.proxyCtx.Res
+			if tc.wantNoResp {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+
+			assert.True(t, resp.Authoritative)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.Equal(t, tc.wantAns, answerValues(resp.Answer))
+
+			if tc.wantSOATTL == 0 {
+				assert.Empty(t, resp.Ns)
+
+				return
+			}
+
+			require.Len(t, resp.Ns, 1)
+
+			assert.Equal(t, tc.wantSOATTL, resp.Ns[0].Header().Ttl)
+		})
+	}
+}
+
+// answerValues returns the data of the records from rrs as strings.
+func answerValues(rrs []dns.RR) (vals []string) {
+	for _, rr := range rrs {
+		var v string
+		switch rr := rr.(type) {
+		case *dns.A:
+			v = rr.A.String()
+		case *dns.AAAA:
+			v = rr.AAAA.String()
+		case *dns.CNAME:
+			v = rr.Target
+		case *dns.MX:
+			v = rr.Mx
+		case *dns.SRV:
+			v = rr.Target
+		case *dns.TXT:
+			v = strings.Join(rr.Txt, " ")
+		}
+
+		vals = append(vals, v)
+	}
+
+	return vals
+}
+
+func TestServer_handleLocalZoneUpload(t *testing.T) {
+	dir := t.TempDir()
+
+	var modified int
+	s := &Server{
+		conf: ServerConfig{
+			ConfigModified: func() { modified++ },
+			ZonesDir:       dir,
+		},
+	}
+
+	upload := func(t *testing.T, origin, data string) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		b, err := json.Marshal(&localZoneUploadReq{
+			Origin: origin,
+			Data:   data,
+		})
+		require.NoError(t, err)
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/control/dns/zones/upload", bytes.NewReader(b))
+		s.handleLocalZoneUpload(w, r)
+
+		return w
+	}
+
+	w := upload(t, "Lab.Example.", testZone)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	wantFile := filepath.Join(dir, "lab.example.zone")
+	assert.Equal(t, []*LocalZoneConfig{{
+		Origin: "lab.example",
+		File:   wantFile,
+	}}, s.conf.LocalZones)
+	assert.Equal(t, 1, modified)
+
+	data, err := os.ReadFile(wantFile)
+	require.NoError(t, err)
+
+	assert.Equal(t, testZone, string(data))
+
+	// Replace the zone.
+	w = upload(t, "lab.example", "@ IN SOA ns admin 1 3600 600 86400 60\nnas IN A 10.0.0.1\n")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, s.localZones, 1)
+	require.Len(t, s.conf.LocalZones, 1)
+
+	dctx := &dnsContext{
+		proxyCtx: &proxy.DNSContext{
+			Req: createTestMessage("nas.lab.example."),
+		},
+	}
+	s.processLocalZones(dctx)
+	require.NotNil(t, dctx.proxyCtx.Res)
+
+	assert.Equal(t, []string{"10.0.0.1"}, answerValues(dctx.proxyCtx.Res.Answer))
+
+	w = upload(t, "lab.example", "nas IN A 10.0.0.1\n")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 2, modified)
+
+	// Modify the file and reload the zones.
+	err = os.WriteFile(wantFile, []byte(testZone), 0o644)
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	s.handleLocalZonesReload(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.JSONEq(t, `{
+		"zones": [{
+			"origin": "lab.example.",
+			"file": `+string(mustMarshal(t, wantFile))+`,
+			"records": 14
+		}]
+	}`, w.Body.String())
+
+	err = os.WriteFile(wantFile, []byte("nas IN A 10.0.0.1\n"), 0o644)
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	s.handleLocalZonesReload(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// The previous zones are kept.
+	require.Len(t, s.localZones, 1)
+
+	assert.Equal(t, 14, s.localZones[0].count)
+}
+
+// mustMarshal returns the JSON encoding of v.
+func mustMarshal(t *testing.T, v any) (b []byte) {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+
+	return b
+}
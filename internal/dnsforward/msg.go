@@ -60,9 +60,11 @@ func (s *Server) genDNSFilterMessage(
 	default:
 		// If the query was filtered by Safe Search, filtering also must return
 		// the IP addresses that must be used in response.  Return them
-		// regardless of the filtering method.
+		// regardless of the filtering method.  No addresses mean that the
+		// enforced endpoint has none of the requested family, so respond with
+		// no data to make the clients use the other one.
 		ips := ipsFromRules(res.Rules)
-		if res.Reason == filtering.FilteredSafeSearch && len(ips) > 0 {
+		if res.Reason == filtering.FilteredSafeSearch {
 			return s.genResponseWithIPs(req, ips)
 		}
 
@@ -317,16 +319,14 @@ func (s *Server) genSOA(request *dns.Msg) []dns.RR {
 		zone = request.Question[0].Name
 	}
 
+	conf := s.conf.BlockedResponseSOA.withDefaults()
 	soa := dns.SOA{
-		// values copied from verisign's nonexistent .com domain
-		// their exact values are not important in our use case because they are used for domain transfers between primary/secondary DNS servers
-		Refresh: 1800,
-		Retry:   900,
-		Expire:  604800,
-		Minttl:  86400,
-		// copied from AdGuard DNS
-		Ns:     "fake-for-negative-caching.adguard.com.",
-		Serial: 100500,
+		Refresh: conf.Refresh,
+		Retry:   conf.Retry,
+		Expire:  conf.Expire,
+		Minttl:  conf.MinTTL,
+		Ns:      conf.NS,
+		Serial:  conf.Serial,
 		// rest is request-specific
 		Hdr: dns.RR_Header{
 			Name:   zone,
@@ -334,13 +334,17 @@ func (s *Server) genSOA(request *dns.Msg) []dns.RR {
 			Ttl:    s.conf.BlockedResponseTTL,
 			Class:  dns.ClassINET,
 		},
-		Mbox: "hostmaster.", // zone will be appended later if it's not empty or "."
+		Mbox: conf.Mbox,
 	}
 	if soa.Hdr.Ttl == 0 {
 		soa.Hdr.Ttl = defaultValues.BlockedResponseTTL
 	}
-	if len(zone) > 0 && zone[0] != '.' {
-		soa.Mbox += zone
+	if soa.Mbox == "" {
+		// zone will be appended if it's not empty or "."
+		soa.Mbox = "hostmaster."
+		if len(zone) > 0 && zone[0] != '.' {
+			soa.Mbox += zone
+		}
 	}
 	return []dns.RR{&soa}
 }
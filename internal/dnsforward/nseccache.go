@@ -0,0 +1,657 @@
+package dnsforward
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// nsecCacheMaxRecords is the maximum number of NSEC and NSEC3 records kept in
+// the aggressive negative cache.
+const nsecCacheMaxRecords = 10_000
+
+// nsec3MaxIterations is the maximum number of additional NSEC3 hash iterations
+// accepted by the cache.  Zones with more iterations aren't cached, since
+// hashing the names becomes too expensive, see RFC 9276.
+const nsec3MaxIterations = 150
+
+// nsecRecord is a cached NSEC or NSEC3 record along with its signatures.
+type nsecRecord struct {
+	// expire is the time after which the record is no longer used.
+	expire time.Time
+
+	// rr is either a *dns.NSEC or a *dns.NSEC3.
+	rr dns.RR
+
+	// sigs are the RRSIG records covering rr.
+	sigs []dns.RR
+
+	// owner is the lowercased owner name of an NSEC record or the uppercased
+	// hash label of an NSEC3 one.
+	owner string
+
+	// next is the lowercased next domain name of an NSEC record or the
+	// uppercased next hash of an NSEC3 one.
+	next string
+}
+
+// nsecZone is the cached denial-of-existence data of a single zone.
+type nsecZone struct {
+	// soaExpire is the time after which soa is no longer used.
+	soaExpire time.Time
+
+	// soa is the SOA record of the zone put into the synthesized responses.
+	soa *dns.SOA
+
+	// soaSigs are the RRSIG records covering soa.
+	soaSigs []dns.RR
+
+	// records are the NSEC or NSEC3 records of the zone by their owner names.
+	records map[string]*nsecRecord
+
+	// nsec3Salt and nsec3Iterations are the NSEC3 parameters of the zone.
+	// They are only set if nsec3 is true.
+	nsec3Salt       string
+	nsec3Iterations uint16
+
+	// nsec3 is true if the zone uses NSEC3 records instead of NSEC ones.
+	nsec3 bool
+}
+
+// nsecCache is the aggressive negative cache, which synthesizes NXDOMAIN
+// responses from the validated NSEC and NSEC3 records previously received from
+// the upstreams, as described by RFC 8198.
+type nsecCache struct {
+	// mu protects zones and count.
+	mu *sync.Mutex
+
+	// zones are the cached zones by their lowercased names.
+	zones map[string]*nsecZone
+
+	// count is the total number of records in zones.
+	count int
+
+	// maxTTL, if not zero, is the maximum TTL of the cached records in
+	// seconds.
+	maxTTL uint32
+}
+
+// newNSECCache returns a new properly initialized *nsecCache.
+func newNSECCache(maxTTL uint32) (c *nsecCache) {
+	return &nsecCache{
+		mu:     &sync.Mutex{},
+		zones:  map[string]*nsecZone{},
+		maxTTL: maxTTL,
+	}
+}
+
+// clear removes all records from the cache.  c may be nil.
+func (c *nsecCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.zones = map[string]*nsecZone{}
+	c.count = 0
+}
+
+// set stores the NSEC and NSEC3 records from the authority section of resp if
+// it's a validated negative response.  c may be nil.
+func (c *nsecCache) set(resp *dns.Msg, now time.Time) {
+	if c == nil || resp == nil || !resp.AuthenticatedData || !isNegative(resp) {
+		return
+	}
+
+	var soa *dns.SOA
+	sigs := map[nsecSigKey][]dns.RR{}
+	for _, rr := range resp.Ns {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			soa = rr
+		case *dns.RRSIG:
+			k := nsecSigKey{name: strings.ToLower(rr.Hdr.Name), typ: rr.TypeCovered}
+			sigs[k] = append(sigs[k], rr)
+		}
+	}
+
+	if soa == nil {
+		return
+	}
+
+	zoneName := strings.ToLower(soa.Hdr.Name)
+	negTTL := c.ttl(soa.Minttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeExpired(now)
+
+	z := c.zones[zoneName]
+	if z == nil {
+		z = &nsecZone{records: map[string]*nsecRecord{}}
+	}
+
+	n := c.count
+	for _, rr := range resp.Ns {
+		if n >= nsecCacheMaxRecords {
+			break
+		}
+
+		ttl := negTTL
+		if rrTTL := rr.Header().Ttl; rrTTL < ttl {
+			ttl = rrTTL
+		}
+
+		rec := newNSECRecord(z, zoneName, rr)
+		if rec == nil {
+			continue
+		}
+
+		rec.expire = now.Add(time.Duration(ttl) * time.Second)
+		rec.sigs = sigs[nsecSigKey{
+			name: strings.ToLower(rr.Header().Name),
+			typ:  rr.Header().Rrtype,
+		}]
+
+		if _, ok := z.records[rec.owner]; !ok {
+			n++
+		}
+
+		z.records[rec.owner] = rec
+	}
+
+	if len(z.records) == 0 {
+		return
+	}
+
+	c.count = n
+
+	soaTTL := negTTL
+	if soa.Hdr.Ttl < soaTTL {
+		soaTTL = soa.Hdr.Ttl
+	}
+
+	z.soa = soa
+	z.soaSigs = sigs[nsecSigKey{name: zoneName, typ: dns.TypeSOA}]
+	z.soaExpire = now.Add(time.Duration(soaTTL) * time.Second)
+
+	c.zones[zoneName] = z
+}
+
+// nsecSigKey is the key to find the signatures of a record.
+type nsecSigKey struct {
+	// name is the lowercased owner name of the record.
+	name string
+
+	// typ is the type of the record.
+	typ uint16
+}
+
+// ttl returns the negative caching TTL limited by c.maxTTL.
+func (c *nsecCache) ttl(minTTL uint32) (ttl uint32) {
+	if c.maxTTL != 0 && minTTL > c.maxTTL {
+		return c.maxTTL
+	}
+
+	return minTTL
+}
+
+// removeExpired removes the expired records and zones from c.  c.mu is
+// expected to be locked.
+func (c *nsecCache) removeExpired(now time.Time) {
+	for name, z := range c.zones {
+		for owner, rec := range z.records {
+			if !rec.expire.After(now) {
+				delete(z.records, owner)
+				c.count--
+			}
+		}
+
+		if len(z.records) == 0 || !z.soaExpire.After(now) {
+			c.count -= len(z.records)
+			delete(c.zones, name)
+		}
+	}
+}
+
+// isNegative returns true if resp is either an NXDOMAIN or a NODATA response.
+func isNegative(resp *dns.Msg) (ok bool) {
+	switch resp.Rcode {
+	case dns.RcodeNameError:
+		return true
+	case dns.RcodeSuccess:
+		return len(resp.Answer) == 0
+	default:
+		return false
+	}
+}
+
+// newNSECRecord returns a new record for rr if it's an NSEC or a supported NSEC3
+// record from the zone z named zoneName.  Otherwise, it returns nil.
+func newNSECRecord(z *nsecZone, zoneName string, rr dns.RR) (rec *nsecRecord) {
+	owner := strings.ToLower(rr.Header().Name)
+	if !dns.IsSubDomain(zoneName, owner) {
+		return nil
+	}
+
+	switch rr := rr.(type) {
+	case *dns.NSEC:
+		if len(z.records) > 0 && z.nsec3 {
+			return nil
+		}
+
+		z.nsec3 = false
+
+		return &nsecRecord{
+			rr:    rr,
+			owner: owner,
+			next:  strings.ToLower(rr.NextDomain),
+		}
+	case *dns.NSEC3:
+		return newNSEC3Record(z, zoneName, owner, rr)
+	default:
+		return nil
+	}
+}
+
+// newNSEC3Record returns a new record for rr if its parameters are supported
+// and match the ones of z.  Otherwise, it returns nil.
+func newNSEC3Record(z *nsecZone, zoneName, owner string, rr *dns.NSEC3) (rec *nsecRecord) {
+	if rr.Hash != dns.SHA1 || rr.Iterations > nsec3MaxIterations {
+		return nil
+	}
+
+	hash, _, _ := strings.Cut(owner, ".")
+	if owner[len(hash)+1:] != zoneName {
+		return nil
+	}
+
+	if len(z.records) == 0 {
+		z.nsec3 = true
+		z.nsec3Salt = rr.Salt
+		z.nsec3Iterations = rr.Iterations
+	} else if !z.nsec3 || z.nsec3Salt != rr.Salt || z.nsec3Iterations != rr.Iterations {
+		return nil
+	}
+
+	return &nsecRecord{
+		rr:    rr,
+		owner: strings.ToUpper(hash),
+		next:  strings.ToUpper(rr.NextDomain),
+	}
+}
+
+// get returns an NXDOMAIN response to req synthesized from the cached records
+// or nil if there are no records proving the nonexistence of the requested
+// name.  c may be nil.
+func (c *nsecCache) get(req *dns.Msg, now time.Time) (resp *dns.Msg) {
+	if c == nil || req.CheckingDisabled {
+		return nil
+	}
+
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	qname := strings.ToLower(q.Name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	zoneName, z := c.findZone(qname)
+	if z == nil || !z.soaExpire.After(now) {
+		return nil
+	}
+
+	var proof []*nsecRecord
+	if z.nsec3 {
+		proof = z.denyNSEC3(zoneName, qname, now)
+	} else {
+		proof = z.denyNSEC(qname, now)
+	}
+
+	if len(proof) == 0 {
+		return nil
+	}
+
+	return z.synthesize(req, proof, now)
+}
+
+// findZone returns the closest cached zone containing qname.  c.mu is expected
+// to be locked.
+func (c *nsecCache) findZone(qname string) (name string, z *nsecZone) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(qname, off) {
+		name = qname[off:]
+		if z = c.zones[name]; z != nil {
+			return name, z
+		}
+	}
+
+	return ".", c.zones["."]
+}
+
+// denyNSEC returns the NSEC records proving that qname doesn't exist or nil if
+// there are none.  It requires both the record covering qname and the one
+// covering the wildcard at the closest encloser of qname.
+func (z *nsecZone) denyNSEC(qname string, now time.Time) (proof []*nsecRecord) {
+	nameRec := z.findNSEC(qname, now)
+	if nameRec == nil {
+		return nil
+	}
+
+	ce := closestEncloser(qname, nameRec.owner, nameRec.next)
+	wcRec := z.findNSEC(wildcardName(ce), now)
+	if wcRec == nil {
+		return nil
+	} else if wcRec == nameRec {
+		return []*nsecRecord{nameRec}
+	}
+
+	return []*nsecRecord{nameRec, wcRec}
+}
+
+// findNSEC returns the unexpired NSEC record covering name or nil if there is
+// none.
+func (z *nsecZone) findNSEC(name string, now time.Time) (rec *nsecRecord) {
+	for _, r := range z.records {
+		if r.expire.After(now) && nsecCovers(r, name) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// nsecCovers returns true if the NSEC record rec proves that name doesn't exist.
+func nsecCovers(rec *nsecRecord, name string) (ok bool) {
+	if dns.IsSubDomain(rec.owner, name) {
+		// The names below a delegation point or a DNAME record aren't covered
+		// by the zone's NSEC records, see RFC 4035, section 5.4.
+		types := rec.rr.(*dns.NSEC).TypeBitMap
+		if hasType(types, dns.TypeDNAME) ||
+			(hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA)) {
+			return false
+		}
+	}
+
+	if canonicalCompare(rec.owner, name) >= 0 {
+		return false
+	}
+
+	// The next name of the last record in the zone is the zone apex.
+	return canonicalCompare(name, rec.next) < 0 || canonicalCompare(rec.next, rec.owner) <= 0
+}
+
+// denyNSEC3 returns the NSEC3 records proving that qname doesn't exist in the
+// zone named zoneName or nil if there are none.  It requires the closest
+// encloser proof along with the record covering the wildcard at the closest
+// encloser, see RFC 5155, section 8.4.
+func (z *nsecZone) denyNSEC3(zoneName, qname string, now time.Time) (proof []*nsecRecord) {
+	labels := dns.SplitDomainName(qname)
+	zoneLabels := dns.CountLabel(zoneName)
+	for i := 1; i <= len(labels)-zoneLabels; i++ {
+		ce := strings.Join(labels[i:], ".") + "."
+		ceRec := z.findNSEC3(nsec3Matches, z.hash(ce), now)
+		if ceRec == nil {
+			continue
+		}
+
+		types := ceRec.rr.(*dns.NSEC3).TypeBitMap
+		if hasType(types, dns.TypeDNAME) ||
+			(hasType(types, dns.TypeNS) && !hasType(types, dns.TypeSOA)) {
+			return nil
+		}
+
+		nextCloser := strings.Join(labels[i-1:], ".") + "."
+		ncRec := z.findNSEC3(nsec3Covers, z.hash(nextCloser), now)
+		if ncRec == nil || ncRec.rr.(*dns.NSEC3).Flags&nsec3OptOut != 0 {
+			// Opt-out records don't prove the nonexistence of a name, see RFC
+			// 8198, section 5.
+			return nil
+		}
+
+		wcRec := z.findNSEC3(nsec3Covers, z.hash(wildcardName(ce)), now)
+		if wcRec == nil {
+			return nil
+		}
+
+		return uniqueRecords(ceRec, ncRec, wcRec)
+	}
+
+	return nil
+}
+
+// nsec3OptOut is the Opt-Out flag of NSEC3 records.
+const nsec3OptOut = 1
+
+// hash returns the NSEC3 hash of name using the parameters of z.
+func (z *nsecZone) hash(name string) (h string) {
+	return dns.HashName(name, dns.SHA1, z.nsec3Iterations, z.nsec3Salt)
+}
+
+// findNSEC3 returns the unexpired NSEC3 record for which f returns true or nil
+// if there is none.
+func (z *nsecZone) findNSEC3(
+	f func(rec *nsecRecord, hash string) (ok bool),
+	hash string,
+	now time.Time,
+) (rec *nsecRecord) {
+	if hash == "" {
+		return nil
+	}
+
+	for _, r := range z.records {
+		if r.expire.After(now) && f(r, hash) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// nsec3Matches returns true if hash is the owner hash of rec.
+func nsec3Matches(rec *nsecRecord, hash string) (ok bool) {
+	return rec.owner == hash
+}
+
+// nsec3Covers returns true if hash is strictly between the owner and the next
+// hashes of rec.
+func nsec3Covers(rec *nsecRecord, hash string) (ok bool) {
+	if rec.owner < rec.next {
+		return rec.owner < hash && hash < rec.next
+	}
+
+	// The last record in the zone or the only one.
+	return hash != rec.owner && (hash > rec.owner || hash < rec.next)
+}
+
+// synthesize returns the NXDOMAIN response to req with the data from z and
+// proof.  The DNSSEC records are only included if req has the DO bit set.
+func (z *nsecZone) synthesize(req *dns.Msg, proof []*nsecRecord, now time.Time) (resp *dns.Msg) {
+	withSigs := hasDO(req)
+
+	resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+	resp.RecursionAvailable = true
+	resp.AuthenticatedData = withSigs || req.AuthenticatedData
+
+	resp.Ns = appendWithTTL(resp.Ns, z.soa, z.soaExpire, now)
+	if withSigs {
+		for _, sig := range z.soaSigs {
+			resp.Ns = appendWithTTL(resp.Ns, sig, z.soaExpire, now)
+		}
+	}
+
+	for _, rec := range proof {
+		if !withSigs {
+			// The NSEC and NSEC3 records are DNSSEC ones as well.
+			continue
+		}
+
+		resp.Ns = appendWithTTL(resp.Ns, rec.rr, rec.expire, now)
+		for _, sig := range rec.sigs {
+			resp.Ns = appendWithTTL(resp.Ns, sig, rec.expire, now)
+		}
+	}
+
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), withSigs)
+	}
+
+	return resp
+}
+
+// appendWithTTL appends a copy of rr with the TTL set to the time left until
+// expire to rrs.
+func appendWithTTL(rrs []dns.RR, rr dns.RR, expire, now time.Time) (res []dns.RR) {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = uint32(expire.Sub(now) / time.Second)
+
+	return append(rrs, rr)
+}
+
+// uniqueRecords returns recs without the duplicates.
+func uniqueRecords(recs ...*nsecRecord) (res []*nsecRecord) {
+	for _, rec := range recs {
+		unique := true
+		for _, r := range res {
+			if r == rec {
+				unique = false
+
+				break
+			}
+		}
+
+		if unique {
+			res = append(res, rec)
+		}
+	}
+
+	return res
+}
+
+// closestEncloser returns the closest encloser of qname, which is the longest
+// ancestor of qname shared with either the owner or the next name of the NSEC
+// record covering it.
+func closestEncloser(qname, owner, next string) (ce string) {
+	n := dns.CompareDomainName(qname, owner)
+	if nextN := dns.CompareDomainName(qname, next); nextN > n {
+		n = nextN
+	}
+
+	labels := dns.SplitDomainName(qname)
+
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
+
+// wildcardName returns the wildcard name at the closest encloser ce.
+func wildcardName(ce string) (name string) {
+	if ce == "." {
+		return "*."
+	}
+
+	return "*." + ce
+}
+
+// hasType returns true if types contains typ.
+func hasType(types []uint16, typ uint16) (ok bool) {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canonicalCompare compares the lowercased domain names a and b in the
+// canonical DNS name order, see RFC 4034, section 6.1.
+func canonicalCompare(a, b string) (res int) {
+	aLabels, bLabels := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(aLabels)-1, len(bLabels)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(aLabels[i], bLabels[j]); c != 0 {
+			return c
+		}
+	}
+
+	return len(aLabels) - len(bLabels)
+}
+
+// setDO sets the DNSSEC OK bit in req, so that the upstreams return the DNSSEC
+// records required by the aggressive negative cache.  restore reverts the
+// changes made to req and removes the DNSSEC records from resp, since the
+// client hasn't requested them.  restore is nil if req already has the bit.
+func setDO(req *dns.Msg) (restore func(resp *dns.Msg)) {
+	opt := req.IsEdns0()
+	if opt != nil && opt.Do() {
+		return nil
+	}
+
+	wantAD := req.AuthenticatedData
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	} else {
+		opt.SetDo(true)
+	}
+
+	return func(resp *dns.Msg) {
+		if opt == nil {
+			req.Extra = removeOPT(req.Extra)
+		} else {
+			opt.SetDo(false)
+		}
+
+		if resp == nil {
+			return
+		}
+
+		resp.Answer = removeDNSSEC(resp.Answer, resp.Question)
+		resp.Ns = removeDNSSEC(resp.Ns, nil)
+		resp.Extra = removeDNSSEC(resp.Extra, nil)
+		if opt == nil {
+			resp.Extra = removeOPT(resp.Extra)
+		} else if respOpt := resp.IsEdns0(); respOpt != nil {
+			respOpt.SetDo(false)
+		}
+
+		// The validating upstreams set the AD bit for the requests with the
+		// DO bit, see RFC 6840, section 5.8.
+		resp.AuthenticatedData = resp.AuthenticatedData && wantAD
+	}
+}
+
+// removeOPT returns rrs without the OPT records.
+func removeOPT(rrs []dns.RR) (res []dns.RR) {
+	res = rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			res = append(res, rr)
+		}
+	}
+
+	return res
+}
+
+// removeDNSSEC returns rrs without the DNSSEC records except for the ones of
+// the types requested by questions.
+func removeDNSSEC(rrs []dns.RR, questions []dns.Question) (res []dns.RR) {
+	res = rrs[:0]
+	for _, rr := range rrs {
+		typ := rr.Header().Rrtype
+		switch typ {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if len(questions) == 0 || questions[0].Qtype != typ {
+				continue
+			}
+		}
+
+		res = append(res, rr)
+	}
+
+	return res
+}
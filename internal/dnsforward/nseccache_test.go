@@ -0,0 +1,280 @@
+package dnsforward
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestNegResp returns a new validated NXDOMAIN response from the zone
+// example with rrs in the authority section.
+func newTestNegResp(rrs ...dns.RR) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetRcode(
+		(&dns.Msg{}).SetQuestion("b.example.", dns.TypeA),
+		dns.RcodeNameError,
+	)
+	resp.AuthenticatedData = true
+	resp.Ns = append([]dns.RR{&dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   "example.",
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Ns:     "ns.example.",
+		Mbox:   "hostmaster.example.",
+		Minttl: 300,
+	}}, rrs...)
+
+	return resp
+}
+
+// newTestNSEC returns a new NSEC record.
+func newTestNSEC(owner, next string, types ...uint16) (rr *dns.NSEC) {
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   owner,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    600,
+		},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+func TestNSECCache_nsec(t *testing.T) {
+	now := time.Now()
+
+	c := newNSECCache(0)
+	c.set(newTestNegResp(
+		newTestNSEC("example.", "a.example.", dns.TypeSOA, dns.TypeNS),
+		newTestNSEC("a.example.", "d.example.", dns.TypeA),
+		newTestNSEC("sub.example.", "z.example.", dns.TypeNS),
+	), now)
+
+	testCases := []struct {
+		name     string
+		qname    string
+		wantNXDo bool
+	}{{
+		name:     "covered",
+		qname:    "c.example.",
+		wantNXDo: true,
+	}, {
+		name:     "covered_below",
+		qname:    "x.a.example.",
+		wantNXDo: true,
+	}, {
+		name:     "existing",
+		qname:    "a.example.",
+		wantNXDo: false,
+	}, {
+		name:     "not_cached",
+		qname:    "e.example.",
+		wantNXDo: false,
+	}, {
+		name:     "delegation",
+		qname:    "x.sub.example.",
+		wantNXDo: false,
+	}, {
+		name:     "other_zone",
+		qname:    "c.example.org.",
+		wantNXDo: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.qname, dns.TypeA)
+			resp := c.get(req, now.Add(time.Minute))
+			if !tc.wantNXDo {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+
+			assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+			require.Len(t, resp.Ns, 1)
+
+			soa, ok := resp.Ns[0].(*dns.SOA)
+			require.True(t, ok)
+
+			assert.Equal(t, uint32(240), soa.Hdr.Ttl)
+		})
+	}
+
+	t.Run("dnssec", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("c.example.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, true)
+
+		resp := c.get(req, now)
+		require.NotNil(t, resp)
+
+		assert.True(t, resp.AuthenticatedData)
+		require.Len(t, resp.Ns, 3)
+
+		assert.Equal(t, "a.example.", resp.Ns[1].Header().Name)
+		assert.Equal(t, "example.", resp.Ns[2].Header().Name)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		req := (&dns.Msg{}).SetQuestion("c.example.", dns.TypeA)
+		assert.Nil(t, c.get(req, now.Add(301*time.Second)))
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		c.clear()
+
+		req := (&dns.Msg{}).SetQuestion("c.example.", dns.TypeA)
+		assert.Nil(t, c.get(req, now))
+	})
+}
+
+func TestNSECCache_set_unvalidated(t *testing.T) {
+	now := time.Now()
+
+	resp := newTestNegResp(newTestNSEC("a.example.", "d.example.", dns.TypeA))
+	resp.AuthenticatedData = false
+
+	c := newNSECCache(0)
+	c.set(resp, now)
+
+	req := (&dns.Msg{}).SetQuestion("c.example.", dns.TypeA)
+	assert.Nil(t, c.get(req, now))
+}
+
+func TestNSECCache_nsec3(t *testing.T) {
+	const (
+		iterations = 1
+		salt       = "AABBCCDD"
+	)
+
+	now := time.Now()
+
+	hashes := []string{}
+	for _, name := range []string{"example.", "a.example.", "d.example."} {
+		hashes = append(hashes, dns.HashName(name, dns.SHA1, iterations, salt))
+	}
+
+	sort.Strings(hashes)
+
+	newResp := func(optOut bool) (resp *dns.Msg) {
+		var rrs []dns.RR
+		for i, h := range hashes {
+			rr := &dns.NSEC3{
+				Hdr: dns.RR_Header{
+					Name:   h + ".example.",
+					Rrtype: dns.TypeNSEC3,
+					Class:  dns.ClassINET,
+					Ttl:    600,
+				},
+				Hash:       dns.SHA1,
+				Iterations: iterations,
+				Salt:       salt,
+				NextDomain: hashes[(i+1)%len(hashes)],
+				TypeBitMap: []uint16{dns.TypeA},
+			}
+
+			if optOut {
+				rr.Flags = nsec3OptOut
+			}
+
+			rrs = append(rrs, rr)
+		}
+
+		return newTestNegResp(rrs...)
+	}
+
+	testCases := []struct {
+		name     string
+		qname    string
+		optOut   bool
+		wantNXDo bool
+	}{{
+		name:     "covered",
+		qname:    "b.example.",
+		optOut:   false,
+		wantNXDo: true,
+	}, {
+		name:     "covered_below",
+		qname:    "x.y.a.example.",
+		optOut:   false,
+		wantNXDo: true,
+	}, {
+		name:     "existing",
+		qname:    "a.example.",
+		optOut:   false,
+		wantNXDo: false,
+	}, {
+		name:     "apex",
+		qname:    "example.",
+		optOut:   false,
+		wantNXDo: false,
+	}, {
+		name:     "opt_out",
+		qname:    "b.example.",
+		optOut:   true,
+		wantNXDo: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newNSECCache(0)
+			c.set(newResp(tc.optOut), now)
+
+			req := (&dns.Msg{}).SetQuestion(tc.qname, dns.TypeA)
+			resp := c.get(req, now)
+			if tc.wantNXDo {
+				require.NotNil(t, resp)
+
+				assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+			} else {
+				assert.Nil(t, resp)
+			}
+		})
+	}
+}
+
+func TestSetDO(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("example.", dns.TypeA)
+
+	restore := setDO(req)
+	require.NotNil(t, restore)
+
+	assert.True(t, hasDO(req))
+
+	resp := newTestNegResp(
+		newTestNSEC("a.example.", "d.example.", dns.TypeA),
+		&dns.RRSIG{
+			Hdr: dns.RR_Header{
+				Name:   "a.example.",
+				Rrtype: dns.TypeRRSIG,
+				Class:  dns.ClassINET,
+			},
+			TypeCovered: dns.TypeNSEC,
+		},
+	)
+	resp.SetEdns0(dns.DefaultMsgSize, true)
+
+	restore(resp)
+
+	assert.Nil(t, req.IsEdns0())
+	assert.Nil(t, resp.IsEdns0())
+	assert.False(t, resp.AuthenticatedData)
+
+	require.Len(t, resp.Ns, 1)
+
+	assert.Equal(t, dns.TypeSOA, resp.Ns[0].Header().Rrtype)
+
+	t.Run("has_do", func(t *testing.T) {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+
+		assert.Nil(t, setDO(req))
+	})
+}
@@ -0,0 +1,320 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// The default lengths of the EDNS Client Subnet networks, the same as the ones
+// used by dnsproxy.
+const (
+	ecsDefaultMaskV4 = 24
+	ecsDefaultMaskV6 = 56
+)
+
+// partCache is the DNS response cache partitioned by the policies of the
+// clients, so that the clients with different upstreams, EDNS Client Subnet
+// data, or filtering settings never share the cached responses.  It's used
+// instead of the dnsproxy's cache, which is shared by all clients.
+type partCache struct {
+	// items contains the packed responses prefixed with their expiration
+	// times.
+	items cache.Cache
+
+	// minTTL and maxTTL, if not zero, are the bounds of the TTLs of the
+	// cached responses in seconds.
+	minTTL uint32
+	maxTTL uint32
+}
+
+// newPartCache returns a new properly initialized *partCache of size bytes.
+func newPartCache(size, minTTL, maxTTL uint32) (c *partCache) {
+	return &partCache{
+		items: cache.New(cache.Config{
+			MaxSize:   uint(size),
+			EnableLRU: true,
+		}),
+		minTTL: minTTL,
+		maxTTL: maxTTL,
+	}
+}
+
+// clear removes all cached responses.  c may be nil.
+func (c *partCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.items.Clear()
+}
+
+// get returns a copy of the cached response for key with the TTLs decreased by
+// the time passed since caching and with the ID of req.  It also returns the
+// address of the upstream which the response has been received from.  c may
+// be nil.
+func (c *partCache) get(key []byte, req *dns.Msg, now time.Time) (resp *dns.Msg, ups string) {
+	if c == nil {
+		return nil, ""
+	}
+
+	data := c.items.Get(key)
+	if len(data) < 10 {
+		return nil, ""
+	}
+
+	expire := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	left := expire.Sub(now)
+	if left <= 0 {
+		c.items.Del(key)
+
+		return nil, ""
+	}
+
+	upsLen := int(binary.BigEndian.Uint16(data[8:]))
+	data = data[10:]
+	if len(data) < upsLen {
+		return nil, ""
+	}
+
+	ups, data = string(data[:upsLen]), data[upsLen:]
+
+	resp = &dns.Msg{}
+	err := resp.Unpack(data)
+	if err != nil {
+		log.Debug("dnsforward: partitioned cache: unpacking: %s", err)
+
+		return nil, ""
+	}
+
+	resp.Id = req.Id
+	capTTLs(resp, uint32(left.Seconds()))
+
+	return resp, ups
+}
+
+// capTTLs decreases the TTLs of the records in resp exceeding ttl to ttl.
+func capTTLs(resp *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT && hdr.Ttl > ttl {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+}
+
+// set caches resp received from the upstream with address ups for key, if it's
+// cacheable.  c may be nil.
+func (c *partCache) set(key []byte, resp *dns.Msg, ups string, now time.Time) {
+	if c == nil || resp == nil || resp.Truncated {
+		return
+	}
+
+	ttl, ok := respCacheTTL(resp)
+	if !ok {
+		return
+	}
+
+	if c.minTTL != 0 && ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+
+	if c.maxTTL != 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	if ttl == 0 {
+		return
+	}
+
+	packed, err := resp.Pack()
+	if err != nil {
+		log.Debug("dnsforward: partitioned cache: packing: %s", err)
+
+		return
+	}
+
+	data := make([]byte, 10, 10+len(ups)+len(packed))
+	binary.BigEndian.PutUint64(data, uint64(now.Add(time.Duration(ttl)*time.Second).UnixNano()))
+	binary.BigEndian.PutUint16(data[8:], uint16(len(ups)))
+	data = append(data, ups...)
+	data = append(data, packed...)
+
+	c.items.Set(key, data)
+}
+
+// respCacheTTL returns the TTL resp may be cached for.  ok is false if resp
+// isn't cacheable.
+func respCacheTTL(resp *dns.Msg) (ttl uint32, ok bool) {
+	var rrs []dns.RR
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		rrs = resp.Answer
+		if len(rrs) == 0 {
+			// A NODATA response, use the SOA from the authority section.
+			rrs = resp.Ns
+		}
+	case dns.RcodeNameError:
+		rrs = resp.Ns
+	default:
+		return 0, false
+	}
+
+	found := false
+	for _, rr := range rrs {
+		rrTTL := rr.Header().Ttl
+		if soa, isSOA := rr.(*dns.SOA); isSOA && soa.Minttl < rrTTL {
+			rrTTL = soa.Minttl
+		}
+
+		if !found || rrTTL < ttl {
+			ttl, found = rrTTL, true
+		}
+	}
+
+	return ttl, found
+}
+
+// partCacheKey returns the key of the cached response for req within the
+// partition of the policy with hash pol.
+func partCacheKey(pol uint64, req *dns.Msg) (key []byte) {
+	q := req.Question[0]
+
+	var flags byte
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		flags |= 1
+	}
+
+	if req.CheckingDisabled {
+		flags |= 1 << 1
+	}
+
+	key = make([]byte, 13, 13+len(q.Name))
+	binary.BigEndian.PutUint64(key, pol)
+	binary.BigEndian.PutUint16(key[8:], q.Qtype)
+	binary.BigEndian.PutUint16(key[10:], q.Qclass)
+	key[12] = flags
+
+	return append(key, strings.ToLower(q.Name)...)
+}
+
+// cachePolicy returns the hash of the client's policy affecting the response
+// to the request of dctx: the custom upstreams, the EDNS Client Subnet network
+// sent to the upstreams, and the filtering settings.  It also returns that
+// network, if any.
+func (s *Server) cachePolicy(dctx *dnsContext) (pol uint64, ecs *net.IPNet) {
+	h := fnv.New64a()
+	pctx := dctx.proxyCtx
+
+	if ups := pctx.CustomUpstreamConfig; ups != nil {
+		_, _ = h.Write([]byte("upstreams:"))
+		writeUpstreamsHash(h, ups)
+	}
+
+	ecs = s.requestECS(pctx)
+	if ecs != nil {
+		_, _ = fmt.Fprintf(h, "ecs:%s;", ecs)
+	}
+
+	if setts := dctx.setts; setts != nil {
+		_, _ = fmt.Fprintf(
+			h,
+			"filtering:%t,%t,%t,%t,%t,%t,%t,%t;",
+			setts.ProtectionEnabled,
+			setts.FilteringEnabled,
+			setts.SafeSearchEnabled,
+			setts.SafeBrowsingEnabled,
+			setts.ParentalEnabled,
+			setts.ParentalStrictSearch,
+			setts.DefaultDeny,
+			setts.DryRun,
+		)
+
+		for _, svc := range setts.ServicesRules {
+			_, _ = fmt.Fprintf(h, "%s,", svc.Name)
+		}
+	}
+
+	return h.Sum64(), ecs
+}
+
+// writeUpstreamsHash writes the addresses of the upstreams from ups into h in
+// a stable order.
+func writeUpstreamsHash(h hash.Hash, ups *proxy.UpstreamConfig) {
+	writeAddrs := func(upss []upstream.Upstream) {
+		for _, u := range upss {
+			_, _ = fmt.Fprintf(h, "%s,", u.Address())
+		}
+
+		_, _ = h.Write([]byte{';'})
+	}
+
+	writeAddrs(ups.Upstreams)
+	for _, domainUps := range []map[string][]upstream.Upstream{
+		ups.DomainReservedUpstreams,
+		ups.SpecifiedDomainUpstreams,
+	} {
+		domains := maps.Keys(domainUps)
+		slices.Sort(domains)
+		for _, d := range domains {
+			_, _ = fmt.Fprintf(h, "%s=", d)
+			writeAddrs(domainUps[d])
+		}
+	}
+}
+
+// requestECS returns the EDNS Client Subnet network dnsproxy sends to the
+// upstreams for the request of pctx, if any.
+func (s *Server) requestECS(pctx *proxy.DNSContext) (ecs *net.IPNet) {
+	if opt := pctx.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if sn, ok := o.(*dns.EDNS0_SUBNET); ok && sn.SourceNetmask != 0 {
+				return &net.IPNet{
+					IP:   sn.Address,
+					Mask: net.CIDRMask(int(sn.SourceNetmask), len(sn.Address)*8),
+				}
+			}
+		}
+	}
+
+	ecsConf := s.conf.EDNSClientSubnet
+	if ecsConf == nil || !ecsConf.Enabled {
+		return nil
+	}
+
+	var ip net.IP
+	if ecsConf.UseCustom {
+		ip = net.ParseIP(ecsConf.CustomIP)
+	} else {
+		ip, _ = netutil.IPAndPortFromAddr(pctx.Addr)
+		if ip == nil || netutil.IsSpecialPurpose(ip) {
+			return nil
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(ecsDefaultMaskV4, netutil.IPv4BitLen)
+
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	} else if ip != nil {
+		mask := net.CIDRMask(ecsDefaultMaskV6, netutil.IPv6BitLen)
+
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+
+	return nil
+}
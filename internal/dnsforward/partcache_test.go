@@ -0,0 +1,142 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartCache(t *testing.T) {
+	const ups = "tls://1.1.1.1:853"
+
+	now := time.Now()
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   "example.org.",
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    300,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}}
+
+	c := newPartCache(4096, 0, 0)
+	keyA := partCacheKey(1, req)
+	keyB := partCacheKey(2, req)
+	c.set(keyA, resp, ups, now)
+
+	t.Run("hit", func(t *testing.T) {
+		newReq := req.Copy()
+		newReq.Id = 1234
+
+		got, gotUps := c.get(keyA, newReq, now.Add(100*time.Second))
+		require.NotNil(t, got)
+
+		assert.Equal(t, ups, gotUps)
+		assert.Equal(t, newReq.Id, got.Id)
+
+		require.Len(t, got.Answer, 1)
+
+		assert.Equal(t, uint32(200), got.Answer[0].Header().Ttl)
+	})
+
+	t.Run("other_partition", func(t *testing.T) {
+		got, _ := c.get(keyB, req, now)
+		assert.Nil(t, got)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		got, _ := c.get(keyA, req, now.Add(300*time.Second))
+		assert.Nil(t, got)
+	})
+
+	t.Run("not_cacheable", func(t *testing.T) {
+		servFail := (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure)
+		c.set(keyB, servFail, ups, now)
+
+		got, _ := c.get(keyB, req, now)
+		assert.Nil(t, got)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		c.set(keyA, resp, ups, now)
+		c.clear()
+
+		got, _ := c.get(keyA, req, now)
+		assert.Nil(t, got)
+	})
+}
+
+func TestServer_cachePolicy(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				EDNSClientSubnet: &EDNSClientSubnet{
+					Enabled: true,
+				},
+			},
+		},
+	}
+
+	newDctx := func(ip net.IP, setts *filtering.Settings) (dctx *dnsContext) {
+		return &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req:  (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA),
+				Addr: &net.UDPAddr{IP: ip, Port: 53},
+			},
+			setts: setts,
+		}
+	}
+
+	defaultSetts := &filtering.Settings{
+		ProtectionEnabled: true,
+		FilteringEnabled:  true,
+	}
+
+	polA, ecs := s.cachePolicy(newDctx(net.IP{1, 2, 3, 4}, defaultSetts))
+	require.NotNil(t, ecs)
+
+	assert.Equal(t, "1.2.3.0/24", ecs.String())
+
+	testCases := []struct {
+		ip       net.IP
+		setts    *filtering.Settings
+		name     string
+		wantSame bool
+	}{{
+		ip:       net.IP{1, 2, 3, 5},
+		setts:    defaultSetts,
+		name:     "same_subnet",
+		wantSame: true,
+	}, {
+		ip:       net.IP{1, 2, 4, 4},
+		setts:    defaultSetts,
+		name:     "other_subnet",
+		wantSame: false,
+	}, {
+		ip: net.IP{1, 2, 3, 4},
+		setts: &filtering.Settings{
+			ProtectionEnabled: true,
+			FilteringEnabled:  true,
+			SafeSearchEnabled: true,
+		},
+		name:     "other_settings",
+		wantSame: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pol, _ := s.cachePolicy(newDctx(tc.ip, tc.setts))
+			assert.Equal(t, tc.wantSame, pol == polA)
+		})
+	}
+}
@@ -0,0 +1,541 @@
+package dnsforward
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Prefetching constants.
+const (
+	// defaultPrefetchTop is the default number of the most popular requests
+	// the responses to which are prefetched.
+	defaultPrefetchTop = 100
+
+	// prefetchTrackFactor is how many times more requests than the prefetched
+	// ones are counted to find out the most popular ones.
+	prefetchTrackFactor = 10
+
+	// prefetchTickIvl is the interval between the checks of the prefetched
+	// responses for the upcoming expiry.
+	prefetchTickIvl = 1 * time.Second
+
+	// prefetchDecayIvl is the interval after which the popularity of the
+	// requests is halved, so that the requests which only have been popular
+	// long ago are eventually replaced.
+	prefetchDecayIvl = 10 * time.Minute
+
+	// prefetchRetryIvl is the interval between the attempts to refresh a
+	// response after a failed one.
+	prefetchRetryIvl = 5 * time.Second
+
+	// prefetchMinLeft is the minimum time before the expiry of a response at
+	// which it's refreshed.
+	prefetchMinLeft = 2 * time.Second
+)
+
+// prefetchResolveFunc is the signature of the functions resolving the
+// prefetched requests.  ups is the address of the upstream the response has
+// been received from.
+type prefetchResolveFunc func(req *dns.Msg) (resp *dns.Msg, ups string, err error)
+
+// prefetchItem is a response prefetched for one of the most popular requests.
+type prefetchItem struct {
+	// req is the request used to refresh resp.
+	req *dns.Msg
+
+	// resp is the latest response to req.
+	resp *dns.Msg
+
+	// expire is the time resp expires at.
+	expire time.Time
+
+	// nextTry is the time before which resp isn't refreshed after a failed
+	// attempt.
+	nextTry time.Time
+
+	// ups is the address of the upstream resp has been received from.
+	ups string
+
+	// ttl is the TTL of resp at the time it's been received.
+	ttl time.Duration
+
+	// used is true if resp has been used since it's been received.  The
+	// responses nobody has requested aren't refreshed.
+	used bool
+}
+
+// prefetcher stores the responses to the most popular requests and refreshes
+// them in the background shortly before they expire, so that the clients get
+// them without waiting for the upstreams.  A nil *prefetcher is valid and
+// prefetches nothing.
+type prefetcher struct {
+	// mu protects all the fields below except done and resolve.
+	mu *sync.Mutex
+
+	// counts are the popularity counters of the requests.
+	counts map[string]uint64
+
+	// items are the prefetched responses.
+	items map[string]*prefetchItem
+
+	// resolve is used to refresh the responses.
+	resolve prefetchResolveFunc
+
+	// done is closed when the prefetcher stops.
+	done chan struct{}
+
+	// lastDecay is the time the counters have been halved last time.
+	lastDecay time.Time
+
+	// top is the maximum number of the prefetched responses.
+	top int
+
+	// minTTL and maxTTL, if not zero, are the bounds of the TTLs of the
+	// prefetched responses in seconds.
+	minTTL uint32
+	maxTTL uint32
+
+	// hits and misses are the numbers of the requests answered and not
+	// answered with the prefetched responses correspondingly.
+	hits   uint64
+	misses uint64
+
+	// refreshes and failures are the numbers of the successful and failed
+	// refreshes correspondingly.
+	refreshes uint64
+	failures  uint64
+}
+
+// newPrefetcher returns a new properly initialized *prefetcher, which is
+// refreshing the responses until closed.  If top is zero, defaultPrefetchTop
+// is used.
+func newPrefetcher(
+	top uint,
+	minTTL uint32,
+	maxTTL uint32,
+	resolve prefetchResolveFunc,
+) (p *prefetcher) {
+	if top == 0 {
+		top = defaultPrefetchTop
+	}
+
+	p = &prefetcher{
+		mu:        &sync.Mutex{},
+		counts:    map[string]uint64{},
+		items:     map[string]*prefetchItem{},
+		resolve:   resolve,
+		done:      make(chan struct{}),
+		lastDecay: time.Now(),
+		top:       int(top),
+		minTTL:    minTTL,
+		maxTTL:    maxTTL,
+	}
+
+	go p.loop()
+
+	return p
+}
+
+// close stops refreshing the responses.  It doesn't wait for the refresh in
+// progress, if any, to finish.  p may be nil.
+func (p *prefetcher) close() {
+	if p == nil {
+		return
+	}
+
+	close(p.done)
+}
+
+// clear removes all the prefetched responses.  p may be nil.
+func (p *prefetcher) clear() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.items = map[string]*prefetchItem{}
+}
+
+// get counts the request for key and returns a copy of the prefetched
+// response for it with the TTLs decreased by the time passed since receiving
+// and with the ID of req.  It also returns the address of the upstream which
+// the response has been received from.  maxSize, if positive, is the maximum
+// size of the response.  p may be nil.
+func (p *prefetcher) get(
+	key string,
+	req *dns.Msg,
+	maxSize int,
+	now time.Time,
+) (resp *dns.Msg, ups string) {
+	if p == nil {
+		return nil, ""
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.countLocked(key, now)
+
+	item, ok := p.items[key]
+	if !ok || !now.Before(item.expire) || (maxSize > 0 && item.resp.Len() > maxSize) {
+		p.misses++
+
+		return nil, ""
+	}
+
+	p.hits++
+	item.used = true
+
+	resp = item.resp.Copy()
+	resp.Id = req.Id
+	capTTLs(resp, uint32(item.expire.Sub(now).Seconds()))
+
+	return resp, item.ups
+}
+
+// set stores resp received from the upstream with address ups for key, if the
+// request for key is one of the most popular ones and resp is cacheable.  p
+// may be nil.
+func (p *prefetcher) set(key string, req, resp *dns.Msg, ups string, now time.Time) {
+	if p == nil || resp == nil || resp.Truncated {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if item, ok := p.items[key]; ok {
+		_ = p.updateLocked(item, resp, ups, now)
+
+		return
+	}
+
+	item := &prefetchItem{req: req.Copy()}
+	if p.updateLocked(item, resp, ups, now) && p.admitLocked(key) {
+		p.items[key] = item
+	}
+}
+
+// countLocked increases the popularity of the request for key.  p.mu is
+// expected to be locked.
+func (p *prefetcher) countLocked(key string, now time.Time) {
+	if _, ok := p.counts[key]; !ok && len(p.counts) >= p.top*prefetchTrackFactor {
+		p.decayLocked(now)
+	}
+
+	p.counts[key]++
+}
+
+// decayLocked halves the popularity of all requests and removes the requests
+// which aren't popular anymore along with their responses.  p.mu is expected
+// to be locked.
+func (p *prefetcher) decayLocked(now time.Time) {
+	for k, n := range p.counts {
+		n /= 2
+		if n == 0 {
+			delete(p.counts, k)
+			delete(p.items, k)
+		} else {
+			p.counts[k] = n
+		}
+	}
+
+	p.lastDecay = now
+}
+
+// admitLocked returns true if the response for key should be stored, evicting
+// the response to the least popular request if there is no room.  p.mu is
+// expected to be locked.
+func (p *prefetcher) admitLocked(key string) (ok bool) {
+	if len(p.items) < p.top {
+		return true
+	}
+
+	var minKey string
+	var minCount uint64
+	for k := range p.items {
+		if n := p.counts[k]; minKey == "" || n < minCount {
+			minKey, minCount = k, n
+		}
+	}
+
+	if p.counts[key] <= minCount {
+		return false
+	}
+
+	delete(p.items, minKey)
+
+	return true
+}
+
+// updateLocked sets resp received from the upstream with address ups as the
+// response of item.  ok is false if resp isn't cacheable.  p.mu is expected to
+// be locked.
+func (p *prefetcher) updateLocked(
+	item *prefetchItem,
+	resp *dns.Msg,
+	ups string,
+	now time.Time,
+) (ok bool) {
+	ttl, ok := respCacheTTL(resp)
+	if !ok {
+		return false
+	}
+
+	if p.minTTL != 0 && ttl < p.minTTL {
+		ttl = p.minTTL
+	}
+
+	if p.maxTTL != 0 && ttl > p.maxTTL {
+		ttl = p.maxTTL
+	}
+
+	if ttl == 0 {
+		return false
+	}
+
+	item.resp = resp.Copy()
+	item.ups = ups
+	item.ttl = time.Duration(ttl) * time.Second
+	item.expire = now.Add(item.ttl)
+	item.nextTry = time.Time{}
+	item.used = false
+
+	return true
+}
+
+// loop refreshes the responses which are about to expire until p is closed.
+// It's intended to be used as a goroutine.
+func (p *prefetcher) loop() {
+	defer log.OnPanic("dnsforward: prefetcher")
+
+	ticker := time.NewTicker(prefetchTickIvl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case now := <-ticker.C:
+			for key, req := range p.due(now) {
+				resp, ups, err := p.resolve(req)
+				p.finishRefresh(key, resp, ups, err, time.Now())
+			}
+		}
+	}
+}
+
+// due returns the copies of the requests the responses to which should be
+// refreshed at now by their keys.  It also removes the expired responses which
+// nobody has used.
+func (p *prefetcher) due(now time.Time) (reqs map[string]*dns.Msg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if now.Sub(p.lastDecay) >= prefetchDecayIvl {
+		p.decayLocked(now)
+	}
+
+	reqs = map[string]*dns.Msg{}
+	for key, item := range p.items {
+		left := item.expire.Sub(now)
+		threshold := item.ttl / 10
+		if threshold < prefetchMinLeft {
+			threshold = prefetchMinLeft
+		}
+
+		if left > threshold {
+			continue
+		} else if !item.used {
+			if left <= 0 {
+				delete(p.items, key)
+			}
+
+			continue
+		} else if now.Before(item.nextTry) {
+			continue
+		}
+
+		reqs[key] = item.req.Copy()
+	}
+
+	return reqs
+}
+
+// finishRefresh stores the result of the refresh of the response for key.
+func (p *prefetcher) finishRefresh(
+	key string,
+	resp *dns.Msg,
+	ups string,
+	err error,
+	now time.Time,
+) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	item, ok := p.items[key]
+	if !ok {
+		// Evicted while refreshing.
+		return
+	}
+
+	if err == nil && resp != nil && p.updateLocked(item, resp, ups, now) {
+		p.refreshes++
+
+		return
+	}
+
+	p.failures++
+	item.nextTry = now.Add(prefetchRetryIvl)
+	if err != nil {
+		log.Debug("dnsforward: prefetching %q: %s", item.req.Question[0].Name, err)
+	}
+}
+
+// prefetchResolve resolves the prefetched request req using the upstreams of
+// the current DNS proxy.
+func (s *Server) prefetchResolve(req *dns.Msg) (resp *dns.Msg, ups string, err error) {
+	prx := s.proxy()
+	if prx == nil {
+		return nil, "", srvClosedErr
+	}
+
+	pctx := &proxy.DNSContext{
+		// Use TCP so that the response isn't truncated.
+		Proto: proxy.ProtoTCP,
+		Req:   req,
+		// Set the upstreams explicitly to bypass the dnsproxy's cache, which
+		// would just return the same response.
+		CustomUpstreamConfig: prx.UpstreamConfig,
+		StartTime:            time.Now(),
+	}
+
+	err = prx.Resolve(pctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if pctx.Upstream != nil {
+		ups = pctx.Upstream.Address()
+	}
+
+	return pctx.Res, ups, nil
+}
+
+// prefetchKey returns the key of the prefetched response for the request of
+// dctx.  ok is false if the response for the request can't be prefetched since
+// it may differ between the clients.
+func (s *Server) prefetchKey(dctx *dnsContext) (key string, ok bool) {
+	pctx := dctx.proxyCtx
+	if s.prefetcher == nil || pctx.CustomUpstreamConfig != nil || s.requestECS(pctx) != nil {
+		return "", false
+	}
+
+	return string(partCacheKey(0, pctx.Req)), true
+}
+
+// respMaxSize returns the maximum size of the response to the request of pctx
+// or zero if there is no limit.
+func respMaxSize(pctx *proxy.DNSContext) (size int) {
+	if pctx.Proto != proxy.ProtoUDP {
+		return 0
+	}
+
+	size = dns.MinMsgSize
+	if opt := pctx.Req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+
+	return size
+}
+
+// preparePrefetcher closes the previous prefetcher, if any, and creates a new
+// one, if it's enabled in the configuration.
+func (s *Server) preparePrefetcher() {
+	s.prefetcher.close()
+	s.prefetcher = nil
+
+	conf := s.conf
+	if !conf.CachePrefetch || conf.CacheSize == 0 || conf.CachePartitioning {
+		return
+	} else if ecs := conf.EDNSClientSubnet; ecs != nil && ecs.Enabled {
+		return
+	}
+
+	s.prefetcher = newPrefetcher(
+		conf.CachePrefetchTop,
+		conf.CacheMinTTL,
+		conf.CacheMaxTTL,
+		s.prefetchResolve,
+	)
+}
+
+// prefetchStatsResp is the response to the GET /control/dns/prefetch HTTP API.
+type prefetchStatsResp struct {
+	// Enabled is true if the prefetching is enabled.
+	Enabled bool `json:"enabled"`
+
+	// Items is the number of the currently prefetched responses.
+	Items int `json:"items"`
+
+	// Hits and Misses are the numbers of the requests answered and not
+	// answered with the prefetched responses correspondingly.
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+
+	// HitRate is the share of the requests answered with the prefetched
+	// responses.
+	HitRate float64 `json:"hit_rate"`
+
+	// Refreshes and Failures are the numbers of the successful and failed
+	// refreshes correspondingly.
+	Refreshes uint64 `json:"refreshes"`
+	Failures  uint64 `json:"failures"`
+}
+
+// stats returns the current statistics of p.  p may be nil.
+func (p *prefetcher) stats() (resp *prefetchStatsResp) {
+	if p == nil {
+		return &prefetchStatsResp{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	resp = &prefetchStatsResp{
+		Enabled:   true,
+		Items:     len(p.items),
+		Hits:      p.hits,
+		Misses:    p.misses,
+		Refreshes: p.refreshes,
+		Failures:  p.failures,
+	}
+
+	if total := p.hits + p.misses; total != 0 {
+		resp.HitRate = float64(p.hits) / float64(total)
+	}
+
+	return resp
+}
+
+// handlePrefetchStats is the handler for the GET /control/dns/prefetch HTTP
+// API.
+func (s *Server) handlePrefetchStats(w http.ResponseWriter, r *http.Request) {
+	var p *prefetcher
+	func() {
+		s.serverLock.RLock()
+		defer s.serverLock.RUnlock()
+
+		p = s.prefetcher
+	}()
+
+	_ = aghhttp.WriteJSONResponse(w, r, p.stats())
+}
@@ -0,0 +1,120 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPrefetchResp returns a response to req with a single A record with
+// ip and ttl.
+func newTestPrefetchResp(req *dns.Msg, ip net.IP, ttl uint32) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		A: ip,
+	}}
+
+	return resp
+}
+
+func TestPrefetcher(t *testing.T) {
+	const ups = "tls://1.1.1.1:853"
+
+	p := newPrefetcher(1, 0, 0, func(_ *dns.Msg) (_ *dns.Msg, _ string, err error) {
+		return nil, "", errors.Error("not implemented")
+	})
+	t.Cleanup(p.close)
+
+	now := time.Now()
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	key := string(partCacheKey(0, req))
+	otherReq := (&dns.Msg{}).SetQuestion("example.net.", dns.TypeA)
+	otherKey := string(partCacheKey(0, otherReq))
+
+	resp, _ := p.get(key, req, 0, now)
+	assert.Nil(t, resp)
+
+	p.set(key, req, newTestPrefetchResp(req, net.IP{1, 2, 3, 4}, 100), ups, now)
+
+	t.Run("hit", func(t *testing.T) {
+		newReq := req.Copy()
+		newReq.Id = 1234
+
+		got, gotUps := p.get(key, newReq, 0, now.Add(10*time.Second))
+		require.NotNil(t, got)
+
+		assert.Equal(t, ups, gotUps)
+		assert.Equal(t, newReq.Id, got.Id)
+
+		require.Len(t, got.Answer, 1)
+
+		assert.Equal(t, uint32(90), got.Answer[0].Header().Ttl)
+	})
+
+	t.Run("too_large", func(t *testing.T) {
+		got, _ := p.get(key, req, 10, now)
+		assert.Nil(t, got)
+	})
+
+	t.Run("less_popular", func(t *testing.T) {
+		p.get(otherKey, otherReq, 0, now)
+		p.set(otherKey, otherReq, newTestPrefetchResp(otherReq, net.IP{5, 6, 7, 8}, 100), ups, now)
+
+		got, _ := p.get(otherKey, otherReq, 0, now)
+		assert.Nil(t, got)
+	})
+
+	t.Run("due", func(t *testing.T) {
+		assert.Empty(t, p.due(now.Add(50*time.Second)))
+
+		reqs := p.due(now.Add(95 * time.Second))
+		require.Contains(t, reqs, key)
+
+		assert.Equal(t, req.Question, reqs[key].Question)
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		refreshed := now.Add(95 * time.Second)
+
+		p.finishRefresh(key, nil, "", errors.Error("test error"), refreshed)
+		assert.Empty(t, p.due(refreshed))
+
+		newResp := newTestPrefetchResp(req, net.IP{4, 3, 2, 1}, 100)
+		p.finishRefresh(key, newResp, ups, nil, refreshed)
+
+		got, _ := p.get(key, req, 0, refreshed.Add(50*time.Second))
+		require.NotNil(t, got)
+		require.Len(t, got.Answer, 1)
+
+		assert.Equal(t, net.IP{4, 3, 2, 1}, got.Answer[0].(*dns.A).A)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats := p.stats()
+		assert.True(t, stats.Enabled)
+		assert.Equal(t, 1, stats.Items)
+		assert.Equal(t, uint64(2), stats.Hits)
+		assert.Equal(t, uint64(4), stats.Misses)
+		assert.Equal(t, uint64(1), stats.Refreshes)
+		assert.Equal(t, uint64(1), stats.Failures)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		p.clear()
+
+		got, _ := p.get(key, req, 0, now)
+		assert.Nil(t, got)
+	})
+}
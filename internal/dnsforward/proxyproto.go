@@ -0,0 +1,416 @@
+package dnsforward
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// proxyProtoTimeout is the timeout for reading the PROXY protocol header and
+// each of the queries from the connection.  It's the same as the one used by
+// dnsproxy.
+const proxyProtoTimeout = 10 * time.Second
+
+// proxyProtoV1MaxLen is the maximum length of the PROXY protocol header of
+// version 1 including the CRLF.
+const proxyProtoV1MaxLen = 107
+
+// proxyProtoV2Sig is the signature of the PROXY protocol header of version 2.
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The commands of the PROXY protocol header of version 2.
+const (
+	proxyProtoCmdLocal = 0x0
+	proxyProtoCmdProxy = 0x1
+)
+
+// The address families and protocols of the PROXY protocol header of
+// version 2.
+const (
+	proxyProtoFamTCP4 = 0x11
+	proxyProtoFamTCP6 = 0x21
+)
+
+// errNoProxyHeader is returned when the connection from a trusted proxy doesn't
+// start with a PROXY protocol header.
+const errNoProxyHeader errors.Error = "no proxy protocol header"
+
+// readProxyHeader reads the PROXY protocol header of version 1 or 2 from r and
+// returns the source address of the client.  src is nil if the header doesn't
+// carry the address, for example, if it's sent by the health checks of the
+// proxy.
+//
+// See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+func readProxyHeader(r *bufio.Reader) (src *net.TCPAddr, err error) {
+	sig, err := r.Peek(len(proxyProtoV2Sig))
+	if err != nil {
+		return nil, fmt.Errorf("reading signature: %w", err)
+	}
+
+	switch {
+	case bytes.Equal(sig, proxyProtoV2Sig):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	default:
+		return nil, errNoProxyHeader
+	}
+}
+
+// readProxyHeaderV1 reads the text PROXY protocol header of version 1 from r.
+func readProxyHeaderV1(r *bufio.Reader) (src *net.TCPAddr, err error) {
+	defer func() { err = errors.Annotate(err, "v1 header: %w") }()
+
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	} else if len(line) > proxyProtoV1MaxLen {
+		return nil, fmt.Errorf("too long: %d bytes", len(line))
+	} else if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.Error("no crlf")
+	}
+
+	// The fields are: "PROXY", protocol, source address, destination address,
+	// source port, and destination port.
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	} else if len(fields) != 6 {
+		return nil, fmt.Errorf("bad number of fields: %d", len(fields))
+	}
+
+	proto := fields[1]
+	if proto != "TCP4" && proto != "TCP6" {
+		return nil, fmt.Errorf("bad protocol %q", proto)
+	}
+
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("source address: %w", err)
+	} else if ip.Is4() != (proto == "TCP4") {
+		return nil, fmt.Errorf("source address %s doesn't match protocol %s", ip, proto)
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("source port: %w", err)
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyHeaderV2 reads the binary PROXY protocol header of version 2 from r.
+func readProxyHeaderV2(r *bufio.Reader) (src *net.TCPAddr, err error) {
+	defer func() { err = errors.Annotate(err, "v2 header: %w") }()
+
+	// The signature is followed by the version and the command, the address
+	// family and the protocol, and the length of the rest of the header.
+	hdr := make([]byte, len(proxyProtoV2Sig)+4)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+
+	verCmd, fam := hdr[len(proxyProtoV2Sig)], hdr[len(proxyProtoV2Sig)+1]
+	if ver := verCmd >> 4; ver != 2 {
+		return nil, fmt.Errorf("bad version %d", ver)
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(hdr[len(proxyProtoV2Sig)+2:]))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, fmt.Errorf("reading addresses: %w", err)
+	}
+
+	switch cmd := verCmd & 0xf; cmd {
+	case proxyProtoCmdLocal:
+		return nil, nil
+	case proxyProtoCmdProxy:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("bad command %d", cmd)
+	}
+
+	var ipLen int
+	switch fam {
+	case proxyProtoFamTCP4:
+		ipLen = net.IPv4len
+	case proxyProtoFamTCP6:
+		ipLen = net.IPv6len
+	default:
+		// The address information of the unspecified and unsupported
+		// families must be ignored.
+		return nil, nil
+	}
+
+	// The addresses are: source address, destination address, source port, and
+	// destination port, followed by the optional TLVs.
+	if len(data) < 2*ipLen+4 {
+		return nil, fmt.Errorf("addresses too short: %d bytes", len(data))
+	}
+
+	ip, _ := netip.AddrFromSlice(data[:ipLen])
+	port := binary.BigEndian.Uint16(data[2*ipLen:])
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
+
+// proxyProtoConn is a connection whose PROXY protocol header has been read.
+type proxyProtoConn struct {
+	net.Conn
+
+	// r is the reader of Conn, which may contain the buffered data following
+	// the header.
+	r *bufio.Reader
+
+	// remote is the address of the client from the header.
+	remote net.Addr
+}
+
+// type check
+var _ net.Conn = (*proxyProtoConn)(nil)
+
+// Read implements the [net.Conn] interface for *proxyProtoConn.
+func (c *proxyProtoConn) Read(b []byte) (n int, err error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr implements the [net.Conn] interface for *proxyProtoConn.
+func (c *proxyProtoConn) RemoteAddr() (addr net.Addr) {
+	return c.remote
+}
+
+// startProxyProto starts the DNS-over-TCP and DNS-over-TLS listeners on
+// s.proxyProtoTCPAddrs and s.proxyProtoTLSAddrs, if any.  s.dnsProxy must be
+// started.
+func (s *Server) startProxyProto() (err error) {
+	prx := s.dnsProxy
+	for _, addr := range s.proxyProtoTCPAddrs {
+		err = s.listenProxyProto(prx, addr, proxy.ProtoTCP, nil)
+		if err != nil {
+			s.stopProxyProto()
+
+			return err
+		}
+	}
+
+	for _, addr := range s.proxyProtoTLSAddrs {
+		err = s.listenProxyProto(prx, addr, proxy.ProtoTLS, prx.TLSConfig)
+		if err != nil {
+			s.stopProxyProto()
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listenProxyProto starts serving the queries of proto on addr using prx.
+// tlsConf must not be nil if proto is [proxy.ProtoTLS].
+func (s *Server) listenProxyProto(
+	prx *proxy.Proxy,
+	addr *net.TCPAddr,
+	proto proxy.Proto,
+	tlsConf *tls.Config,
+) (err error) {
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listening %s on %s: %w", proto, addr, err)
+	}
+
+	s.proxyProtoListeners = append(s.proxyProtoListeners, l)
+	go s.serveProxyProto(prx, l, proto, tlsConf)
+
+	log.Info("dnsforward: listening to %s://%s with proxy protocol", proto, l.Addr())
+
+	return nil
+}
+
+// stopProxyProto closes the listeners started by s.startProxyProto.
+func (s *Server) stopProxyProto() {
+	for _, l := range s.proxyProtoListeners {
+		err := l.Close()
+		if err != nil {
+			log.Error("dnsforward: closing listener %s: %s", l.Addr(), err)
+		}
+	}
+
+	s.proxyProtoListeners = nil
+}
+
+// serveProxyProto accepts the connections from l until it's closed.  It's
+// intended to be used as a goroutine.
+func (s *Server) serveProxyProto(
+	prx *proxy.Proxy,
+	l net.Listener,
+	proto proxy.Proto,
+	tlsConf *tls.Config,
+) {
+	defer log.OnPanic("dnsforward: serving proxy protocol")
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Debug("dnsforward: %s: listener closed", proto)
+			} else {
+				log.Error("dnsforward: %s: accepting conn: %s", proto, err)
+			}
+
+			return
+		}
+
+		go s.handleProxyProtoConn(prx, conn, proto, tlsConf)
+	}
+}
+
+// handleProxyProtoConn reads the PROXY protocol header from conn, if it's
+// enabled and conn is accepted from a trusted proxy, and then serves the
+// queries from it until it's closed.
+func (s *Server) handleProxyProtoConn(
+	prx *proxy.Proxy,
+	conn net.Conn,
+	proto proxy.Proto,
+	tlsConf *tls.Config,
+) {
+	defer log.OnPanic("dnsforward: handling proxy protocol conn")
+
+	defer func() {
+		err := conn.Close()
+		if err != nil {
+			log.Debug("dnsforward: %s: closing conn: %s", proto, err)
+		}
+	}()
+
+	// The sockets passed by the service manager are also served here, so only
+	// accept the headers when the protocol is enabled.
+	if s.conf.ProxyProtocol {
+		accepted, err := s.acceptProxyHeader(conn)
+		if err != nil {
+			log.Debug("dnsforward: %s: %s", proto, err)
+
+			return
+		}
+
+		conn = accepted
+	}
+
+	if tlsConf != nil {
+		conn = tls.Server(conn, tlsConf)
+	}
+
+	for {
+		if !s.serveProxyProtoQuery(prx, conn, proto) {
+			return
+		}
+	}
+}
+
+// acceptProxyHeader returns conn with the address of the client from the PROXY
+// protocol header, if conn is accepted from a trusted proxy.  Otherwise, conn
+// is returned as is.
+func (s *Server) acceptProxyHeader(conn net.Conn) (accepted net.Conn, err error) {
+	addrPort := netutil.NetAddrToAddrPort(conn.RemoteAddr())
+	if s.trustedProxies == nil || !s.trustedProxies.Contains(addrPort.Addr().AsSlice()) {
+		return conn, nil
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(proxyProtoTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	src, err := readProxyHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading proxy header from %s: %w", conn.RemoteAddr(), err)
+	}
+
+	ppConn := &proxyProtoConn{
+		Conn:   conn,
+		r:      r,
+		remote: conn.RemoteAddr(),
+	}
+
+	if src != nil {
+		log.Debug("dnsforward: proxy %s forwards client %s", conn.RemoteAddr(), src)
+
+		ppConn.remote = src
+	}
+
+	return ppConn, nil
+}
+
+// serveProxyProtoQuery reads a single query from conn, passes it to the request
+// handlers of prx, and writes the response back.  ok is false if conn must be
+// closed.
+func (s *Server) serveProxyProtoQuery(prx *proxy.Proxy, conn net.Conn, proto proxy.Proto) (ok bool) {
+	err := conn.SetDeadline(time.Now().Add(proxyProtoTimeout))
+	if err != nil {
+		log.Debug("dnsforward: %s: setting deadline: %s", proto, err)
+	}
+
+	packet, err := proxyutil.ReadPrefixed(conn)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Debug("dnsforward: %s: reading query: %s", proto, err)
+		}
+
+		return false
+	}
+
+	req := &dns.Msg{}
+	err = req.Unpack(packet)
+	if err != nil {
+		log.Debug("dnsforward: %s: unpacking query: %s", proto, err)
+
+		return false
+	}
+
+	pctx := &proxy.DNSContext{
+		Proto:     proto,
+		Req:       req,
+		Addr:      conn.RemoteAddr(),
+		Conn:      conn,
+		StartTime: time.Now(),
+	}
+
+	if !serveRequest(prx, pctx) {
+		return true
+	} else if pctx.Res == nil {
+		// Close the connection right away, like dnsproxy does.
+		return false
+	}
+
+	data, err := pctx.Res.Pack()
+	if err != nil {
+		log.Error("dnsforward: %s: packing response: %s", proto, err)
+
+		return false
+	}
+
+	err = proxyutil.WritePrefixed(data, conn)
+	if err != nil {
+		log.Debug("dnsforward: %s: writing response: %s", proto, err)
+
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,205 @@
+package dnsforward
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestProxyHeaderV2 returns a new PROXY protocol header of version 2 with
+// the command, the address family, and the addresses data.
+func newTestProxyHeaderV2(cmd, fam byte, data ...byte) (hdr string) {
+	b := append([]byte{}, proxyProtoV2Sig...)
+	b = append(b, 0x20|cmd, fam, 0, byte(len(data)))
+	b = append(b, data...)
+
+	return string(b)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	// The addresses of the TCP over IPv4 followed by a TLV.
+	v4Data := []byte{
+		1, 2, 3, 4,
+		5, 6, 7, 8,
+		0x30, 0x39,
+		0, 53,
+		0x04, 0, 1, 0,
+	}
+
+	testCases := []struct {
+		name       string
+		hdr        string
+		wantSrc    string
+		wantErrMsg string
+	}{{
+		name:       "v1_tcp4",
+		hdr:        "PROXY TCP4 1.2.3.4 5.6.7.8 12345 53\r\n",
+		wantSrc:    "1.2.3.4:12345",
+		wantErrMsg: "",
+	}, {
+		name:       "v1_tcp6",
+		hdr:        "PROXY TCP6 2001:db8::1 2001:db8::2 12345 53\r\n",
+		wantSrc:    "[2001:db8::1]:12345",
+		wantErrMsg: "",
+	}, {
+		name:       "v1_unknown",
+		hdr:        "PROXY UNKNOWN\r\n",
+		wantSrc:    "",
+		wantErrMsg: "",
+	}, {
+		name:       "v1_bad_proto",
+		hdr:        "PROXY UDP4 1.2.3.4 5.6.7.8 12345 53\r\n",
+		wantSrc:    "",
+		wantErrMsg: `v1 header: bad protocol "UDP4"`,
+	}, {
+		name:    "v1_mismatch",
+		hdr:     "PROXY TCP6 1.2.3.4 5.6.7.8 12345 53\r\n",
+		wantSrc: "",
+		wantErrMsg: "v1 header: source address 1.2.3.4 doesn't match " +
+			"protocol TCP6",
+	}, {
+		name:       "v1_bad_fields",
+		hdr:        "PROXY TCP4  1.2.3.4 5.6.7.8 12345 53\r\n",
+		wantSrc:    "",
+		wantErrMsg: "v1 header: bad number of fields: 7",
+	}, {
+		name:       "v1_no_crlf",
+		hdr:        "PROXY TCP4 1.2.3.4 5.6.7.8 12345 53\n",
+		wantSrc:    "",
+		wantErrMsg: "v1 header: no crlf",
+	}, {
+		name:       "v1_too_long",
+		hdr:        "PROXY UNKNOWN " + strings.Repeat("a", proxyProtoV1MaxLen) + "\r\n",
+		wantSrc:    "",
+		wantErrMsg: "v1 header: too long: 123 bytes",
+	}, {
+		name:       "v2_tcp4",
+		hdr:        newTestProxyHeaderV2(proxyProtoCmdProxy, proxyProtoFamTCP4, v4Data...),
+		wantSrc:    "1.2.3.4:12345",
+		wantErrMsg: "",
+	}, {
+		name:       "v2_local",
+		hdr:        newTestProxyHeaderV2(proxyProtoCmdLocal, 0),
+		wantSrc:    "",
+		wantErrMsg: "",
+	}, {
+		name:       "v2_unspec",
+		hdr:        newTestProxyHeaderV2(proxyProtoCmdProxy, 0),
+		wantSrc:    "",
+		wantErrMsg: "",
+	}, {
+		name:       "v2_short",
+		hdr:        newTestProxyHeaderV2(proxyProtoCmdProxy, proxyProtoFamTCP6, v4Data...),
+		wantSrc:    "",
+		wantErrMsg: "v2 header: addresses too short: 16 bytes",
+	}, {
+		name:       "v2_bad_cmd",
+		hdr:        newTestProxyHeaderV2(0x2, proxyProtoFamTCP4, v4Data...),
+		wantSrc:    "",
+		wantErrMsg: "v2 header: bad command 2",
+	}, {
+		name:       "none",
+		hdr:        "\x00\x1cquery of some length",
+		wantSrc:    "",
+		wantErrMsg: string(errNoProxyHeader),
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			const rest = "rest"
+
+			r := bufio.NewReader(strings.NewReader(tc.hdr + rest))
+			src, err := readProxyHeader(r)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if tc.wantErrMsg != "" {
+				return
+			}
+
+			if tc.wantSrc == "" {
+				assert.Nil(t, src)
+			} else {
+				require.NotNil(t, src)
+
+				assert.Equal(t, tc.wantSrc, src.String())
+			}
+
+			// The data following the header must not be consumed.
+			got, err := r.Peek(len(rest))
+			require.NoError(t, err)
+
+			assert.Equal(t, rest, string(got))
+		})
+	}
+}
+
+func TestServer_proxyProto(t *testing.T) {
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		FilteringConfig: FilteringConfig{
+			ProtectionEnabled: true,
+			TrustedProxies:    []string{"127.0.0.0/8"},
+			ProxyProtocol:     true,
+			EDNSClientSubnet:  &EDNSClientSubnet{Enabled: false},
+		},
+	}, nil)
+
+	ql := &testQueryLog{}
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{newGoogleUpstream()}
+	s.queryLog = ql
+
+	require.Nil(t, s.dnsProxy.TCPListenAddr)
+
+	startDeferStop(t, s)
+
+	require.Len(t, s.proxyProtoListeners, 1)
+
+	addr := s.proxyProtoListeners[0].Addr().String()
+
+	t.Run("forwarded", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		testutil.CleanupAndRequireSuccess(t, c.Close)
+
+		_, err = c.Write([]byte("PROXY TCP4 1.2.3.4 127.0.0.1 12345 53\r\n"))
+		require.NoError(t, err)
+
+		conn := &dns.Conn{Conn: c}
+		err = conn.WriteMsg(createGoogleATestMessage())
+		require.NoError(t, err)
+
+		resp, err := conn.ReadMsg()
+		require.NoError(t, err)
+
+		assertGoogleAResponse(t, resp)
+
+		require.NotNil(t, ql.lastParams)
+
+		assert.Equal(t, net.IP{1, 2, 3, 4}, ql.lastParams.ClientIP.To4())
+	})
+
+	t.Run("no_header", func(t *testing.T) {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		testutil.CleanupAndRequireSuccess(t, c.Close)
+
+		conn := &dns.Conn{Conn: c}
+		err = conn.WriteMsg(createGoogleATestMessage())
+		require.NoError(t, err)
+
+		// The connections from the trusted proxies without the header must be
+		// closed.
+		_, err = conn.ReadMsg()
+		assert.Error(t, err)
+	})
+}
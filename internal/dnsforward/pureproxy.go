@@ -0,0 +1,110 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// PureProxyConfig is the configuration of the pure proxy listeners.  The
+// queries accepted by them are only resolved using the upstream servers, so
+// that the filtering, the query log, and the statistics don't apply to them.
+// This allows serving the unfiltered clients, like a guest network, from the
+// same instance.
+type PureProxyConfig struct {
+	// TLSListenAddrs are the addresses of the DNS-over-TLS listeners.
+	TLSListenAddrs []*net.TCPAddr
+
+	// HTTPSListenAddrs are the addresses of the DNS-over-HTTPS listeners.
+	HTTPSListenAddrs []*net.TCPAddr
+
+	// QUICListenAddrs are the addresses of the DNS-over-QUIC listeners.  The
+	// QUIC transport settings don't apply to them.
+	QUICListenAddrs []*net.UDPAddr
+}
+
+// isEmpty returns true if c has no listeners.
+func (c *PureProxyConfig) isEmpty() (ok bool) {
+	return len(c.TLSListenAddrs) == 0 && len(c.HTTPSListenAddrs) == 0 && len(c.QUICListenAddrs) == 0
+}
+
+// preparePureProxy initializes the proxy owning the pure proxy listeners.
+// mainConf is the configuration of the main proxy with the TLS settings
+// already prepared.
+func (s *Server) preparePureProxy(mainConf *proxy.Config) (err error) {
+	s.pureProxy = nil
+
+	c := s.conf.PureProxy
+	if c.isEmpty() {
+		return nil
+	}
+
+	if mainConf.TLSConfig == nil {
+		return errors.Error("no certificate configured")
+	}
+
+	s.pureProxy = &proxy.Proxy{
+		Config: proxy.Config{
+			TLSListenAddr:   c.TLSListenAddrs,
+			HTTPSListenAddr: c.HTTPSListenAddrs,
+			QUICListenAddr:  c.QUICListenAddrs,
+			TLSConfig:       mainConf.TLSConfig,
+			HTTP3:           mainConf.HTTP3,
+			RefuseAny:       mainConf.RefuseAny,
+			MaxGoroutines:   mainConf.MaxGoroutines,
+			// The upstreams aren't used to resolve the queries, see
+			// [Server.handlePureProxyRequest], but dnsproxy requires them.
+			UpstreamConfig: mainConf.UpstreamConfig,
+			RequestHandler: s.handlePureProxyRequest,
+		},
+	}
+
+	return nil
+}
+
+// handlePureProxyRequest resolves the query accepted by the pure proxy
+// listeners using the current main proxy, so that the upstreams and the cache
+// reloaded by [Server.Reload] are used even though the listeners are kept.
+// None of the server's own request processing is applied.
+func (s *Server) handlePureProxyRequest(_ *proxy.Proxy, pctx *proxy.DNSContext) (err error) {
+	prx := s.proxy()
+	if prx == nil {
+		return srvClosedErr
+	}
+
+	return prx.Resolve(pctx)
+}
+
+// startPureProxy starts the pure proxy listeners, if any.
+func (s *Server) startPureProxy() (err error) {
+	if s.pureProxy == nil {
+		return nil
+	}
+
+	err = s.pureProxy.Start()
+	if err != nil {
+		return fmt.Errorf("starting pure proxy: %w", err)
+	}
+
+	s.listenPureProxy = s.pureProxy
+
+	return nil
+}
+
+// stopPureProxy stops the pure proxy listeners started by s.startPureProxy.
+func (s *Server) stopPureProxy() {
+	if s.listenPureProxy == nil {
+		return
+	}
+
+	p := s.listenPureProxy
+	s.listenPureProxy = nil
+
+	err := p.Stop()
+	if err != nil {
+		log.Error("dnsforward: stopping pure proxy: %s", err)
+	}
+}
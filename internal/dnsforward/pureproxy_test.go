@@ -0,0 +1,115 @@
+package dnsforward
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_pureProxy(t *testing.T) {
+	_, certPem, keyPem := createServerTLSConfig(t)
+
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			ProtectionEnabled: true,
+			BlockingMode:      BlockingModeDefault,
+			EDNSClientSubnet:  &EDNSClientSubnet{Enabled: false},
+		},
+	}, nil)
+
+	s.conf.TLSConfig = TLSConfig{
+		TLSListenAddrs:       []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		CertificateChainData: certPem,
+		PrivateKeyData:       keyPem,
+		PureProxy: PureProxyConfig{
+			TLSListenAddrs: []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}},
+		},
+	}
+
+	err := s.Prepare(&s.conf)
+	require.NoError(t, err)
+
+	ql := &testQueryLog{}
+	s.queryLog = ql
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{&aghtest.UpstreamMock{
+		OnAddress: func() (addr string) { return "upstream.example" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return aghtest.MatchedResponse(req, dns.TypeA, "nxdomain.example.org", "1.2.3.4"), nil
+		},
+		OnClose: func() (err error) { return nil },
+	}}
+
+	startDeferStop(t, s)
+	require.NotNil(t, s.listenPureProxy)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPem)
+	tlsConf := &tls.Config{
+		ServerName: tlsServerName,
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	exchange := func(t *testing.T, addr net.Addr) (resp *dns.Msg) {
+		t.Helper()
+
+		conn, dialErr := dns.DialWithTLS("tcp-tls", addr.String(), tlsConf)
+		require.NoError(t, dialErr)
+
+		t.Cleanup(func() { _ = conn.Close() })
+
+		err = conn.WriteMsg(createTestMessage("nxdomain.example.org."))
+		require.NoError(t, err)
+
+		resp, err = conn.ReadMsg()
+		require.NoError(t, err)
+		require.Len(t, resp.Answer, 1)
+
+		return resp
+	}
+
+	t.Run("filtered", func(t *testing.T) {
+		resp := exchange(t, s.dnsProxy.Addr(proxy.ProtoTLS))
+
+		assert.True(t, resp.Answer[0].(*dns.A).A.IsUnspecified())
+		assert.NotNil(t, ql.lastParams)
+	})
+
+	ql.lastParams = nil
+
+	t.Run("pure", func(t *testing.T) {
+		resp := exchange(t, s.listenPureProxy.Addr(proxy.ProtoTLS))
+
+		assert.Equal(t, net.IP{1, 2, 3, 4}, resp.Answer[0].(*dns.A).A.To4())
+		assert.Nil(t, ql.lastParams)
+	})
+}
+
+func TestServer_preparePureProxy_noCert(t *testing.T) {
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			EDNSClientSubnet: &EDNSClientSubnet{Enabled: false},
+		},
+	}, nil)
+
+	s.conf.PureProxy = PureProxyConfig{
+		TLSListenAddrs: []*net.TCPAddr{{IP: net.IP{127, 0, 0, 1}}},
+	}
+
+	err := s.Prepare(&s.conf)
+	testutil.AssertErrorMsg(t, "preparing pure proxy: no certificate configured", err)
+}
@@ -0,0 +1,134 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// nonPublicSuffixes are the domain name suffixes, which are never considered
+// public by the DNS rebinding protection in addition to the local domain
+// suffix of the server.
+var nonPublicSuffixes = []string{
+	"home.arpa",
+	"internal",
+	"local",
+	"localhost",
+}
+
+// parseRebindingAllowlist validates and normalizes the domain names from
+// domains.
+func parseRebindingAllowlist(domains []string) (allowlist []string, err error) {
+	allowlist = make([]string, 0, len(domains))
+	for i, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		err = netutil.ValidateDomainName(d)
+		if err != nil {
+			return nil, fmt.Errorf("domain at index %d: %w", i, err)
+		}
+
+		allowlist = append(allowlist, d)
+	}
+
+	return allowlist, nil
+}
+
+// matchesDomains returns true if host is one of domains or is a subdomain of
+// any of them.  host and domains must be lowercased and have no trailing dot.
+func matchesDomains(host string, domains []string) (ok bool) {
+	for _, d := range domains {
+		if host == d || netutil.IsSubdomain(host, d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isPublicDomain returns true if the DNS rebinding protection applies to host.
+// host must be lowercased and have no trailing dot.
+func (s *Server) isPublicDomain(host string) (ok bool) {
+	if !strings.Contains(host, ".") {
+		// Single-label names are resolved within the local network.
+		return false
+	}
+
+	return !matchesDomains(host, nonPublicSuffixes) &&
+		!matchesDomains(host, []string{s.localDomainSuffix}) &&
+		!matchesDomains(host, s.rebindingAllowlist)
+}
+
+// isRebindingAddr returns true if ip must not be returned for a public domain
+// name.
+func (s *Server) isRebindingAddr(ip netip.Addr) (ok bool) {
+	ip = ip.Unmap()
+
+	return ip.IsPrivate() ||
+		ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsUnspecified() ||
+		(s.privateNets != nil && s.privateNets.Contains(ip.AsSlice()))
+}
+
+// filterRebinding checks the addresses in the response of pctx to the request
+// for a public domain name, so that a malicious domain couldn't make the
+// browsers of the clients access the devices in the local network.  The
+// response is replaced with the blocked one if any of them is private.  res is
+// not nil if the response has been blocked.
+func (s *Server) filterRebinding(
+	pctx *proxy.DNSContext,
+	setts *filtering.Settings,
+) (res *filtering.Result) {
+	if !s.conf.RebindingProtection || pctx.Res == nil {
+		return nil
+	}
+
+	q := pctx.Req.Question[0]
+	host := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	if !s.isPublicDomain(host) {
+		return nil
+	}
+
+	for _, rr := range pctx.Res.Answer {
+		var ip netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			ip, _ = netip.AddrFromSlice(rr.AAAA)
+		default:
+			continue
+		}
+
+		if !s.isRebindingAddr(ip) {
+			continue
+		}
+
+		log.Debug("dnsforward: rebinding: %s resolves to private address %s", q.Name, ip)
+
+		res = &filtering.Result{
+			Rules: []*filtering.ResultRule{{
+				FilterListID: filtering.RebindingListID,
+				Text:         "dns rebinding protection",
+			}},
+			Reason:     filtering.FilteredRebinding,
+			IsFiltered: true,
+		}
+
+		if setts.DryRun {
+			res.DryRun = true
+		} else {
+			pctx.Res = s.genDNSFilterMessage(pctx, res)
+		}
+
+		return res
+	}
+
+	return nil
+}
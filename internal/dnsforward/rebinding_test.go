@@ -0,0 +1,174 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRebindingAllowlist(t *testing.T) {
+	got, err := parseRebindingAllowlist([]string{"Router.Example.", "nas.example.org"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"router.example", "nas.example.org"}, got)
+
+	_, err = parseRebindingAllowlist([]string{"example.org", "bad..domain"})
+	testutil.AssertErrorMsg(
+		t,
+		`domain at index 1: bad domain name "bad..domain": `+
+			`bad domain name label "": domain name label is empty`,
+		err,
+	)
+}
+
+func TestServer_filterRebinding(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				BlockingMode:        BlockingModeDefault,
+				RebindingProtection: true,
+			},
+		},
+		localDomainSuffix:  defaultLocalDomainSuffix,
+		rebindingAllowlist: []string{"allowed.example"},
+	}
+
+	testCases := []struct {
+		rr        dns.RR
+		name      string
+		host      string
+		wantBlock bool
+	}{{
+		rr:        newA("www.example.org.", net.IP{203, 0, 113, 1}),
+		name:      "public",
+		host:      "www.example.org.",
+		wantBlock: false,
+	}, {
+		rr:        newA("evil.example.", net.IP{192, 168, 1, 1}),
+		name:      "private",
+		host:      "evil.example.",
+		wantBlock: true,
+	}, {
+		rr:        newA("evil.example.", net.IP{127, 0, 0, 1}),
+		name:      "loopback",
+		host:      "evil.example.",
+		wantBlock: true,
+	}, {
+		rr:        newA("evil.example.", net.IPv4zero),
+		name:      "unspecified",
+		host:      "evil.example.",
+		wantBlock: true,
+	}, {
+		rr: &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: "evil.example.", Rrtype: dns.TypeAAAA},
+			AAAA: net.ParseIP("fe80::1"),
+		},
+		name:      "link_local_v6",
+		host:      "evil.example.",
+		wantBlock: true,
+	}, {
+		rr: &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: "evil.example.", Rrtype: dns.TypeAAAA},
+			AAAA: net.ParseIP("::ffff:10.0.0.1"),
+		},
+		name:      "mapped",
+		host:      "evil.example.",
+		wantBlock: true,
+	}, {
+		rr:        newA("nas.allowed.example.", net.IP{192, 168, 1, 2}),
+		name:      "allowlist",
+		host:      "nas.allowed.example.",
+		wantBlock: false,
+	}, {
+		rr:        newA("printer.lan.", net.IP{192, 168, 1, 3}),
+		name:      "local_domain",
+		host:      "printer.lan.",
+		wantBlock: false,
+	}, {
+		rr:        newA("nas.home.arpa.", net.IP{192, 168, 1, 4}),
+		name:      "home_arpa",
+		host:      "nas.home.arpa.",
+		wantBlock: false,
+	}, {
+		rr:        newA("router.", net.IP{192, 168, 1, 5}),
+		name:      "single_label",
+		host:      "router.",
+		wantBlock: false,
+	}}
+
+	setts := &filtering.Settings{}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestMessageWithType(tc.host, tc.rr.Header().Rrtype)
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{tc.rr}
+
+			pctx := &proxy.DNSContext{
+				Req: req,
+				Res: resp,
+			}
+
+			res := s.filterRebinding(pctx, setts)
+			if !tc.wantBlock {
+				assert.Nil(t, res)
+				assert.Equal(t, resp, pctx.Res)
+
+				return
+			}
+
+			require.NotNil(t, res)
+
+			assert.Equal(t, filtering.FilteredRebinding, res.Reason)
+			assert.True(t, res.IsFiltered)
+			assert.NotEqual(t, resp, pctx.Res)
+		})
+	}
+
+	t.Run("dry_run", func(t *testing.T) {
+		req := createTestMessage("evil.example.")
+		resp := (&dns.Msg{}).SetReply(req)
+		resp.Answer = []dns.RR{newA("evil.example.", net.IP{10, 0, 0, 1})}
+
+		pctx := &proxy.DNSContext{
+			Req: req,
+			Res: resp,
+		}
+
+		res := s.filterRebinding(pctx, &filtering.Settings{DryRun: true})
+		require.NotNil(t, res)
+
+		assert.True(t, res.DryRun)
+		assert.Equal(t, resp, pctx.Res)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		disabled := &Server{
+			localDomainSuffix: defaultLocalDomainSuffix,
+		}
+
+		req := createTestMessage("evil.example.")
+		resp := (&dns.Msg{}).SetReply(req)
+		resp.Answer = []dns.RR{newA("evil.example.", net.IP{10, 0, 0, 1})}
+
+		pctx := &proxy.DNSContext{
+			Req: req,
+			Res: resp,
+		}
+
+		assert.Nil(t, disabled.filterRebinding(pctx, setts))
+	})
+}
+
+// newA returns a new A record for name with ip.
+func newA(name string, ip net.IP) (rr *dns.A) {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET},
+		A:   ip,
+	}
+}
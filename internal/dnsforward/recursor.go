@@ -0,0 +1,569 @@
+package dnsforward
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/mathutil"
+	"github.com/miekg/dns"
+)
+
+// RecursiveMode is the mode of the embedded recursive resolver.
+type RecursiveMode string
+
+// Allowed recursive modes.
+const (
+	// RecursiveModeDisabled means that the requests are only resolved by the
+	// upstreams.
+	RecursiveModeDisabled RecursiveMode = "disabled"
+
+	// RecursiveModePrimary means that the requests are resolved by the
+	// recursive resolver instead of the default upstreams.  The upstreams for
+	// the specific domains are still used.
+	RecursiveModePrimary RecursiveMode = "primary"
+
+	// RecursiveModeFallback means that the requests are resolved by the
+	// recursive resolver when all the upstreams fail.
+	RecursiveModeFallback RecursiveMode = "fallback"
+)
+
+// validate returns an error if m isn't a valid recursive mode.  The empty
+// mode is considered the same as [RecursiveModeDisabled].
+func (m RecursiveMode) validate() (err error) {
+	switch m {
+	case "", RecursiveModeDisabled, RecursiveModePrimary, RecursiveModeFallback:
+		return nil
+	default:
+		return fmt.Errorf("bad recursive mode %q", m)
+	}
+}
+
+// enabled returns true if the recursive resolver is used in mode m.
+func (m RecursiveMode) enabled() (ok bool) {
+	return m == RecursiveModePrimary || m == RecursiveModeFallback
+}
+
+// rootHints are the addresses of the root name servers, see
+// https://www.internic.net/domain/named.root.
+var rootHints = []netip.Addr{
+	netip.MustParseAddr("198.41.0.4"),
+	netip.MustParseAddr("170.247.170.2"),
+	netip.MustParseAddr("192.33.4.12"),
+	netip.MustParseAddr("199.7.91.13"),
+	netip.MustParseAddr("192.203.230.10"),
+	netip.MustParseAddr("192.5.5.241"),
+	netip.MustParseAddr("192.112.36.4"),
+	netip.MustParseAddr("198.97.190.53"),
+	netip.MustParseAddr("192.36.148.17"),
+	netip.MustParseAddr("192.58.128.30"),
+	netip.MustParseAddr("193.0.14.129"),
+	netip.MustParseAddr("199.7.83.42"),
+	netip.MustParseAddr("202.12.27.33"),
+	netip.MustParseAddr("2001:503:ba3e::2:30"),
+	netip.MustParseAddr("2801:1b8:10::b"),
+	netip.MustParseAddr("2001:500:2::c"),
+	netip.MustParseAddr("2001:500:2d::d"),
+	netip.MustParseAddr("2001:500:a8::e"),
+	netip.MustParseAddr("2001:500:2f::f"),
+	netip.MustParseAddr("2001:500:12::d0d"),
+	netip.MustParseAddr("2001:500:1::53"),
+	netip.MustParseAddr("2001:7fe::53"),
+	netip.MustParseAddr("2001:503:c27::2:30"),
+	netip.MustParseAddr("2001:7fd::1"),
+	netip.MustParseAddr("2001:500:9f::42"),
+	netip.MustParseAddr("2001:dc3::35"),
+}
+
+// Limits of the recursive resolution.
+const (
+	// maxRecursorSteps is the maximum number of the queries to the
+	// authoritative servers made to resolve a single name.
+	maxRecursorSteps = 32
+
+	// maxRecursorDepth is the maximum depth of the nested resolutions of the
+	// addresses of the name servers without glue.
+	maxRecursorDepth = 4
+
+	// maxRecursorCNAMEs is the maximum length of the followed CNAME chain.
+	maxRecursorCNAMEs = 8
+
+	// maxRecursorServers is the maximum number of the name servers of a zone
+	// queried before giving up.
+	maxRecursorServers = 4
+
+	// maxRecursorDelegations is the maximum number of the cached delegations.
+	maxRecursorDelegations = 4096
+
+	// maxDelegationTTL is the maximum time a delegation is cached for.
+	maxDelegationTTL = 24 * time.Hour
+
+	// recursorUDPSize is the EDNS(0) UDP payload size advertised to the
+	// authoritative servers, as recommended by the DNS Flag Day 2020.
+	recursorUDPSize = 1232
+)
+
+// recursorExchangeFunc sends req to the authoritative name server at addr and
+// returns its response.
+type recursorExchangeFunc func(req *dns.Msg, addr netip.AddrPort) (resp *dns.Msg, err error)
+
+// recursor is a recursive resolver, which resolves the names starting from the
+// root name servers and minimizes the names sent to the authoritative servers,
+// as described by RFC 9156.  It doesn't validate DNSSEC.
+type recursor struct {
+	// exchange sends the requests to the authoritative servers.
+	exchange recursorExchangeFunc
+
+	// delegationsMu protects delegations.
+	delegationsMu *sync.Mutex
+
+	// delegations are the cached name servers of the zones.
+	delegations map[string]*delegation
+
+	// roots are the addresses of the root name servers.
+	roots []netip.AddrPort
+}
+
+// delegation are the addresses of the name servers of a zone.
+type delegation struct {
+	expire  time.Time
+	servers []netip.AddrPort
+}
+
+// type check
+var _ upstream.Upstream = (*recursor)(nil)
+
+// newRecursor returns a new recursor using the root hints and the timeout for
+// each query to the authoritative servers.
+func newRecursor(timeout time.Duration) (r *recursor) {
+	udp := &dns.Client{Net: "udp", Timeout: timeout}
+	tcp := &dns.Client{Net: "tcp", Timeout: timeout}
+
+	return &recursor{
+		exchange: func(req *dns.Msg, addr netip.AddrPort) (resp *dns.Msg, err error) {
+			resp, _, err = udp.Exchange(req, addr.String())
+			if err == nil && resp.Truncated {
+				resp, _, err = tcp.Exchange(req, addr.String())
+			}
+
+			return resp, err
+		},
+		delegationsMu: &sync.Mutex{},
+		delegations:   map[string]*delegation{},
+		roots:         hintsToAddrPorts(rootHints),
+	}
+}
+
+// hintsToAddrPorts returns the DNS addresses of the servers with IP addresses
+// from ips.
+func hintsToAddrPorts(ips []netip.Addr) (addrs []netip.AddrPort) {
+	addrs = make([]netip.AddrPort, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, netip.AddrPortFrom(ip, 53))
+	}
+
+	return addrs
+}
+
+// Address implements the [upstream.Upstream] interface for *recursor.
+func (r *recursor) Address() (addr string) { return "recursive" }
+
+// Close implements the [upstream.Upstream] interface for *recursor.
+func (r *recursor) Close() (err error) { return nil }
+
+// Exchange implements the [upstream.Upstream] interface for *recursor.
+func (r *recursor) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if len(req.Question) != 1 {
+		return nil, errors.Error("recursive resolver: expected exactly one question")
+	}
+
+	q := req.Question[0]
+	res, err := r.resolve(q.Name, q.Qtype, 0)
+	if err != nil {
+		return nil, fmt.Errorf("recursive resolver: resolving %q: %w", q.Name, err)
+	}
+
+	resp = (&dns.Msg{}).SetRcode(req, res.Rcode)
+	resp.RecursionAvailable = true
+	resp.Answer = res.Answer
+	resp.Ns = res.Ns
+
+	return resp, nil
+}
+
+// resolve resolves name of type qtype following the CNAME chains.  depth is
+// the depth of the nested resolution.
+func (r *recursor) resolve(name string, qtype uint16, depth int) (resp *dns.Msg, err error) {
+	if depth > maxRecursorDepth {
+		return nil, errors.Error("resolution is too deep")
+	}
+
+	name = dns.CanonicalName(name)
+
+	var chain []dns.RR
+	for cnames := 0; ; cnames++ {
+		if cnames > maxRecursorCNAMEs {
+			return nil, errors.Error("cname chain is too long")
+		}
+
+		resp, err = r.iterate(name, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, resp.Answer...)
+
+		target, ok := unresolvedCNAME(resp.Answer, name, qtype)
+		if !ok {
+			resp.Answer = chain
+
+			return resp, nil
+		}
+
+		name = target
+	}
+}
+
+// unresolvedCNAME returns the target of the CNAME chain starting at name in
+// ans if ans doesn't contain the records of type qtype for it.
+func unresolvedCNAME(ans []dns.RR, name string, qtype uint16) (target string, ok bool) {
+	if qtype == dns.TypeCNAME {
+		return "", false
+	}
+
+	target = name
+	for i := 0; i <= len(ans); i++ {
+		next, found := "", false
+		for _, rr := range ans {
+			h := rr.Header()
+			if dns.CanonicalName(h.Name) != target {
+				continue
+			}
+
+			if h.Rrtype == qtype {
+				return "", false
+			}
+
+			if cname, isCNAME := rr.(*dns.CNAME); isCNAME {
+				next, found = dns.CanonicalName(cname.Target), true
+			}
+		}
+
+		if !found {
+			break
+		}
+
+		target = next
+	}
+
+	return target, target != name
+}
+
+// iterate resolves name of type qtype by querying the authoritative servers
+// starting from the closest known zone.  depth is the depth of the nested
+// resolution.
+func (r *recursor) iterate(name string, qtype uint16, depth int) (resp *dns.Msg, err error) {
+	zone, servers := r.closestDelegation(name, time.Now())
+	total := dns.CountLabel(name)
+	labels := dns.CountLabel(zone)
+
+	for i := 0; i < maxRecursorSteps; i++ {
+		qname, qt := name, qtype
+
+		// Only send the next label below the known zone.
+		minimized := labels < total-1
+		if minimized {
+			labels++
+			qname = lastLabels(name, labels)
+			qt = dns.TypeA
+		}
+
+		resp, err = r.query(servers, qname, qt)
+		if err != nil {
+			return nil, err
+		}
+
+		if cut, nsNames := referral(resp, zone, qname); cut != "" {
+			var addrs []netip.AddrPort
+			addrs, err = r.serverAddrs(resp, zone, nsNames, depth)
+			if err != nil {
+				return nil, fmt.Errorf("resolving name servers of %q: %w", cut, err)
+			}
+
+			r.setDelegation(cut, addrs, referralTTL(resp, cut), time.Now())
+
+			zone, servers = cut, addrs
+			labels = dns.CountLabel(cut)
+
+			continue
+		}
+
+		if !minimized {
+			return resp, nil
+		}
+
+		switch resp.Rcode {
+		case dns.RcodeSuccess:
+			// Not a zone cut, go on with the next label.
+		case dns.RcodeNameError:
+			// There is nothing below a nonexistent name, see RFC 8020.
+			return resp, nil
+		default:
+			// Some servers respond incorrectly to the minimized queries, so
+			// send the full name instead.
+			log.Debug("dnsforward: recursive resolver: rcode %d for %q", resp.Rcode, qname)
+			labels = total
+		}
+	}
+
+	return nil, errors.Error("too many steps")
+}
+
+// lastLabels returns the last n labels of the FQDN name.
+func lastLabels(name string, n int) (sub string) {
+	idx := dns.Split(name)
+
+	return name[idx[len(idx)-n]:]
+}
+
+// referral returns the zone cut and the names of its name servers if resp is
+// a referral from zone to a zone containing qname.
+func referral(resp *dns.Msg, zone, qname string) (cut string, nsNames []string) {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return "", nil
+	}
+
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		owner := dns.CanonicalName(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue
+		}
+
+		if cut == "" {
+			cut = owner
+		} else if owner != cut {
+			continue
+		}
+
+		nsNames = append(nsNames, dns.CanonicalName(ns.Ns))
+	}
+
+	return cut, nsNames
+}
+
+// referralTTL returns the TTL of the NS records of cut in resp.
+func referralTTL(resp *dns.Msg, cut string) (ttl time.Duration) {
+	ttl = maxDelegationTTL
+	for _, rr := range resp.Ns {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeNS && dns.CanonicalName(h.Name) == cut {
+			ttl = mathutil.Min(ttl, time.Duration(h.Ttl)*time.Second)
+		}
+	}
+
+	return ttl
+}
+
+// serverAddrs returns the addresses of the name servers with nsNames.  The
+// glue records from resp are only trusted for the names within zone, the other
+// names are resolved.
+func (r *recursor) serverAddrs(
+	resp *dns.Msg,
+	zone string,
+	nsNames []string,
+	depth int,
+) (addrs []netip.AddrPort, err error) {
+	for _, rr := range resp.Extra {
+		name := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(zone, name) || !containsName(nsNames, name) {
+			continue
+		}
+
+		if ip, ok := rrAddr(rr); ok {
+			addrs = append(addrs, netip.AddrPortFrom(ip, 53))
+		}
+	}
+
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	var errs []error
+	for i, name := range nsNames {
+		if i >= maxRecursorServers {
+			break
+		}
+
+		var nsResp *dns.Msg
+		nsResp, err = r.resolve(name, dns.TypeA, depth+1)
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		for _, rr := range nsResp.Answer {
+			if ip, ok := rrAddr(rr); ok {
+				addrs = append(addrs, netip.AddrPortFrom(ip, 53))
+			}
+		}
+
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.List("no addresses", errs...)
+	}
+
+	return nil, errors.Error("no addresses")
+}
+
+// containsName returns true if names contains name.
+func containsName(names []string, name string) (ok bool) {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rrAddr returns the IP address from rr if it's an A or an AAAA record.
+func rrAddr(rr dns.RR) (ip netip.Addr, ok bool) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip, ok = netip.AddrFromSlice(rr.A.To4())
+	case *dns.AAAA:
+		ip, ok = netip.AddrFromSlice(rr.AAAA)
+	}
+
+	return ip, ok
+}
+
+// query sends a non-recursive query for qname of type qtype to the servers
+// until one of them responds.
+func (r *recursor) query(servers []netip.AddrPort, qname string, qtype uint16) (resp *dns.Msg, err error) {
+	req := (&dns.Msg{}).SetQuestion(qname, qtype)
+	req.RecursionDesired = false
+	req.SetEdns0(recursorUDPSize, false)
+
+	// Start from a random server to spread the load.
+	n := mathutil.Min(len(servers), maxRecursorServers)
+	off := rand.Intn(len(servers))
+
+	var errs []error
+	for i := 0; i < n; i++ {
+		addr := servers[(off+i)%len(servers)]
+		resp, err = r.exchange(req, addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+
+			continue
+		}
+
+		if len(resp.Question) != 1 || !questionsEqual(resp.Question[0], req.Question[0]) {
+			errs = append(errs, fmt.Errorf("%s: question mismatch", addr))
+
+			continue
+		}
+
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			errs = append(errs, fmt.Errorf("%s: rcode %s", addr, dns.RcodeToString[resp.Rcode]))
+
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return nil, errors.List(fmt.Sprintf("querying %q", qname), errs...)
+}
+
+// questionsEqual returns true if a and b are the same questions, ignoring the
+// case of the names.
+func questionsEqual(a, b dns.Question) (ok bool) {
+	return a.Qtype == b.Qtype &&
+		a.Qclass == b.Qclass &&
+		dns.CanonicalName(a.Name) == dns.CanonicalName(b.Name)
+}
+
+// closestDelegation returns the closest enclosing zone of name with the known
+// name servers and their addresses.
+func (r *recursor) closestDelegation(name string, now time.Time) (zone string, servers []netip.AddrPort) {
+	r.delegationsMu.Lock()
+	defer r.delegationsMu.Unlock()
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		d, ok := r.delegations[name[off:]]
+		if !ok {
+			continue
+		}
+
+		if now.After(d.expire) {
+			delete(r.delegations, name[off:])
+
+			continue
+		}
+
+		return name[off:], d.servers
+	}
+
+	return ".", r.roots
+}
+
+// setDelegation caches the name servers of zone for ttl.
+func (r *recursor) setDelegation(zone string, servers []netip.AddrPort, ttl time.Duration, now time.Time) {
+	r.delegationsMu.Lock()
+	defer r.delegationsMu.Unlock()
+
+	if len(r.delegations) >= maxRecursorDelegations {
+		// Don't bother with eviction, since the popular zones are cached again
+		// quickly.
+		r.delegations = map[string]*delegation{}
+	}
+
+	r.delegations[zone] = &delegation{
+		expire:  now.Add(ttl),
+		servers: servers,
+	}
+}
+
+// resolveFallback resolves the request of pctx recursively if the recursive
+// resolver is used as a fallback and the upstreams have failed with upsErr.
+// err is upsErr if the request hasn't been resolved.
+func (s *Server) resolveFallback(pctx *proxy.DNSContext, upsErr error) (err error) {
+	if s.recursor == nil ||
+		s.conf.RecursiveMode != RecursiveModeFallback ||
+		errors.Is(upsErr, upstream.ErrNoUpstreams) {
+		return upsErr
+	}
+
+	q := pctx.Req.Question[0]
+	log.Debug("dnsforward: upstreams failed, resolving %q recursively: %s", q.Name, upsErr)
+
+	resp, err := s.recursor.Exchange(pctx.Req)
+	if err != nil {
+		log.Debug("dnsforward: %s", err)
+
+		return upsErr
+	}
+
+	pctx.Res = resp
+	pctx.Upstream = s.recursor
+
+	return nil
+}
@@ -0,0 +1,392 @@
+package dnsforward
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAuthServer is an authoritative name server for the tests.
+type fakeAuthServer struct {
+	// records are the records of the served zone.
+	records []dns.RR
+
+	// delegations are the NS records of the delegated subzones along with
+	// their glue.
+	delegations []dns.RR
+
+	// origin is the origin of the served zone.
+	origin string
+}
+
+// newFakeAuthServer returns a new authoritative server for origin serving the
+// records and the delegations in the zone file format.
+func newFakeAuthServer(t *testing.T, origin string, records, delegations []string) (s *fakeAuthServer) {
+	t.Helper()
+
+	s = &fakeAuthServer{
+		origin: origin,
+	}
+
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		require.NoError(t, err)
+
+		s.records = append(s.records, rr)
+	}
+
+	for _, r := range delegations {
+		rr, err := dns.NewRR(r)
+		require.NoError(t, err)
+
+		s.delegations = append(s.delegations, rr)
+	}
+
+	return s
+}
+
+// respond returns the response of s to req.
+func (s *fakeAuthServer) respond(req *dns.Msg) (resp *dns.Msg) {
+	q := req.Question[0]
+	qname := dns.CanonicalName(q.Name)
+	resp = (&dns.Msg{}).SetReply(req)
+
+	for _, rr := range s.delegations {
+		ns, ok := rr.(*dns.NS)
+		if !ok || !dns.IsSubDomain(ns.Hdr.Name, qname) {
+			continue
+		}
+
+		resp.Ns = append(resp.Ns, ns)
+		for _, glue := range s.delegations {
+			if glue.Header().Rrtype != dns.TypeNS && glue.Header().Name == ns.Ns {
+				resp.Extra = append(resp.Extra, glue)
+			}
+		}
+	}
+
+	if len(resp.Ns) > 0 {
+		return resp
+	}
+
+	resp.Authoritative = true
+
+	exists := false
+	for _, rr := range s.records {
+		h := rr.Header()
+		if !dns.IsSubDomain(qname, h.Name) {
+			continue
+		}
+
+		exists = true
+		if h.Name == qname && (h.Rrtype == q.Qtype || h.Rrtype == dns.TypeCNAME) {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+
+	if !exists {
+		resp.Rcode = dns.RcodeNameError
+	}
+
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   s.origin,
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			Ns:     "ns." + s.origin,
+			Mbox:   "admin." + s.origin,
+			Minttl: 60,
+		}}
+	}
+
+	return resp
+}
+
+// fakeAuthNet is a network of fake authoritative servers.
+type fakeAuthNet struct {
+	// mu protects queries.
+	mu *sync.Mutex
+
+	// servers are the servers by their addresses.
+	servers map[netip.AddrPort]*fakeAuthServer
+
+	// queries are the names queried from each server.
+	queries map[netip.AddrPort][]string
+}
+
+// exchange implements the [recursorExchangeFunc] for *fakeAuthNet.
+func (n *fakeAuthNet) exchange(req *dns.Msg, addr netip.AddrPort) (resp *dns.Msg, err error) {
+	if req.RecursionDesired {
+		return nil, errors.Error("recursion desired")
+	}
+
+	s, ok := n.servers[addr]
+	if !ok {
+		return nil, errors.Error("timeout")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.queries[addr] = append(n.queries[addr], req.Question[0].Name)
+
+	return s.respond(req), nil
+}
+
+// reset clears the recorded queries.
+func (n *fakeAuthNet) reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.queries = map[netip.AddrPort][]string{}
+}
+
+func TestRecursor(t *testing.T) {
+	var (
+		rootAddr  = netip.MustParseAddrPort("192.0.2.1:53")
+		exAddr    = netip.MustParseAddrPort("192.0.2.2:53")
+		otherAddr = netip.MustParseAddrPort("192.0.2.3:53")
+		subAddr   = netip.MustParseAddrPort("192.0.2.4:53")
+		deadAddr  = netip.MustParseAddrPort("192.0.2.5:53")
+	)
+
+	root := newFakeAuthServer(t, ".", nil, []string{
+		"example. 3600 IN NS ns.example.",
+		"ns.example. 3600 IN A 192.0.2.2",
+		"other. 3600 IN NS ns.other.",
+		"ns.other. 3600 IN A 192.0.2.3",
+		"dead. 3600 IN NS ns.dead.",
+		"ns.dead. 3600 IN A 192.0.2.5",
+	})
+
+	example := newFakeAuthServer(t, "example.", []string{
+		"www.example. 300 IN CNAME web.other.",
+		"mail.example. 300 IN A 192.0.2.25",
+	}, []string{
+		"sub.example. 3600 IN NS ns.sub.example.",
+		"ns.sub.example. 3600 IN A 192.0.2.4",
+		// The glue for the name outside of the zone must be ignored.
+		"noglue.example. 3600 IN NS ns.other.",
+		"ns.other. 3600 IN A 192.0.2.66",
+	})
+
+	other := newFakeAuthServer(t, "other.", []string{
+		"web.other. 300 IN A 192.0.2.80",
+		"ns.other. 300 IN A 192.0.2.3",
+	}, nil)
+
+	sub := newFakeAuthServer(t, "sub.example.", []string{
+		"a.b.sub.example. 300 IN A 192.0.2.40",
+	}, nil)
+
+	fakeNet := &fakeAuthNet{
+		mu: &sync.Mutex{},
+		servers: map[netip.AddrPort]*fakeAuthServer{
+			rootAddr:  root,
+			exAddr:    example,
+			otherAddr: other,
+			subAddr:   sub,
+		},
+	}
+
+	// other also serves the zone delegated to it without glue.
+	other.records = append(other.records, example.records...)
+	noglue, err := dns.NewRR("host.noglue.example. 300 IN A 192.0.2.99")
+	require.NoError(t, err)
+
+	other.records = append(other.records, noglue)
+
+	newTestRecursor := func() (r *recursor) {
+		fakeNet.reset()
+
+		return &recursor{
+			exchange:      fakeNet.exchange,
+			delegationsMu: &sync.Mutex{},
+			delegations:   map[string]*delegation{},
+			roots:         []netip.AddrPort{rootAddr},
+		}
+	}
+
+	testCases := []struct {
+		wantQueries map[netip.AddrPort][]string
+		name        string
+		host        string
+		wantAns     []string
+		wantRcode   int
+	}{{
+		wantQueries: map[netip.AddrPort][]string{
+			rootAddr: {"example."},
+			exAddr:   {"mail.example."},
+		},
+		name:      "simple",
+		host:      "mail.example.",
+		wantAns:   []string{"192.0.2.25"},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		wantQueries: map[netip.AddrPort][]string{
+			rootAddr:  {"example.", "other."},
+			exAddr:    {"www.example."},
+			otherAddr: {"web.other."},
+		},
+		name:      "cname",
+		host:      "WWW.example.",
+		wantAns:   []string{"web.other.", "192.0.2.80"},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		wantQueries: map[netip.AddrPort][]string{
+			rootAddr: {"example."},
+			exAddr:   {"sub.example."},
+			subAddr:  {"b.sub.example.", "a.b.sub.example."},
+		},
+		name:      "minimization",
+		host:      "a.b.sub.example.",
+		wantAns:   []string{"192.0.2.40"},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		wantQueries: map[netip.AddrPort][]string{
+			rootAddr: {"example."},
+			exAddr:   {"nx.example."},
+		},
+		name:      "nxdomain",
+		host:      "nx.example.",
+		wantAns:   nil,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		wantQueries: map[netip.AddrPort][]string{
+			rootAddr: {"example."},
+			exAddr:   {"nx.example."},
+		},
+		name:      "nxdomain_minimized",
+		host:      "deep.nx.example.",
+		wantAns:   nil,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		wantQueries: map[netip.AddrPort][]string{
+			rootAddr:  {"example.", "other."},
+			exAddr:    {"noglue.example."},
+			otherAddr: {"ns.other.", "host.noglue.example."},
+		},
+		name:      "no_glue",
+		host:      "host.noglue.example.",
+		wantAns:   []string{"192.0.2.99"},
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRecursor()
+
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			resp, exchErr := r.Exchange(req)
+			require.NoError(t, exchErr)
+
+			assert.Equal(t, req.Id, resp.Id)
+			assert.True(t, resp.RecursionAvailable)
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.Equal(t, tc.wantAns, answerValues(resp.Answer))
+			assert.Equal(t, tc.wantQueries, fakeNet.queries)
+		})
+	}
+
+	t.Run("delegation_cache", func(t *testing.T) {
+		r := newTestRecursor()
+
+		_, err = r.Exchange((&dns.Msg{}).SetQuestion("mail.example.", dns.TypeA))
+		require.NoError(t, err)
+
+		fakeNet.reset()
+
+		resp, exchErr := r.Exchange((&dns.Msg{}).SetQuestion("a.b.sub.example.", dns.TypeA))
+		require.NoError(t, exchErr)
+
+		assert.Equal(t, []string{"192.0.2.40"}, answerValues(resp.Answer))
+		assert.NotContains(t, fakeNet.queries, rootAddr)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		r := newTestRecursor()
+
+		_, err = r.Exchange((&dns.Msg{}).SetQuestion("host.dead.", dns.TypeA))
+		require.Error(t, err)
+
+		assert.Contains(t, err.Error(), deadAddr.String()+": timeout")
+	})
+}
+
+func TestServer_resolveFallback(t *testing.T) {
+	rootAddr := netip.MustParseAddrPort("192.0.2.1:53")
+	fakeNet := &fakeAuthNet{
+		mu: &sync.Mutex{},
+		servers: map[netip.AddrPort]*fakeAuthServer{
+			rootAddr: newFakeAuthServer(t, ".", []string{"example. 300 IN A 192.0.2.10"}, nil),
+		},
+		queries: map[netip.AddrPort][]string{},
+	}
+
+	r := &recursor{
+		exchange:      fakeNet.exchange,
+		delegationsMu: &sync.Mutex{},
+		delegations:   map[string]*delegation{},
+		roots:         []netip.AddrPort{rootAddr},
+	}
+
+	const upsErr errors.Error = "upstream failed"
+
+	testCases := []struct {
+		wantErr error
+		name    string
+		mode    RecursiveMode
+		wantRes bool
+	}{{
+		wantErr: nil,
+		name:    "fallback",
+		mode:    RecursiveModeFallback,
+		wantRes: true,
+	}, {
+		wantErr: upsErr,
+		name:    "primary",
+		mode:    RecursiveModePrimary,
+		wantRes: false,
+	}, {
+		wantErr: upsErr,
+		name:    "disabled",
+		mode:    RecursiveModeDisabled,
+		wantRes: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				recursor: r,
+			}
+			s.conf.RecursiveMode = tc.mode
+
+			pctx := &proxy.DNSContext{
+				Req: createTestMessage("example."),
+			}
+
+			err := s.resolveFallback(pctx, upsErr)
+			assert.ErrorIs(t, err, tc.wantErr)
+
+			if !tc.wantRes {
+				assert.Nil(t, pctx.Res)
+
+				return
+			}
+
+			require.NotNil(t, pctx.Res)
+
+			assert.Equal(t, []string{"192.0.2.10"}, answerValues(pctx.Res.Answer))
+			assert.Equal(t, r, pctx.Upstream)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/ameshkov/dnscrypt/v2"
+)
+
+// errNotRunning is returned by [Server.Reload] when the server isn't running.
+const errNotRunning errors.Error = "server is not running"
+
+// listenConfig is the part of the server's configuration which can't be
+// changed without restarting the listeners, since dnsproxy only uses it in the
+// listening proxy.
+type listenConfig struct {
+	dnsCryptCert         *dnscrypt.Cert
+	quic                 QUICConfig
+	dnsCryptProviderName string
+	udp                  []*net.UDPAddr
+	tcp                  []*net.TCPAddr
+	tls                  []*net.TCPAddr
+	https                []*net.TCPAddr
+	quicAddrs            []*net.UDPAddr
+	dnsCryptUDP          []*net.UDPAddr
+	dnsCryptTCP          []*net.TCPAddr
+	doq                  []*net.UDPAddr
+	proxyProtoTCP        []*net.TCPAddr
+	proxyProtoTLS        []*net.TCPAddr
+	pureTLS              []*net.TCPAddr
+	pureHTTPS            []*net.TCPAddr
+	pureQUIC             []*net.UDPAddr
+	activatedTCP         []*net.TCPListener
+	activatedUDP         []*net.UDPConn
+	ratelimitWhitelist   []string
+	tlsCiphers           []uint16
+	tlsMinVersion        uint16
+	ratelimit            int
+	maxGoroutines        int
+	http3                bool
+	refuseAny            bool
+}
+
+// listenConfig returns the current listening configuration of s.  s.dnsProxy
+// must not be nil.
+func (s *Server) listenConfig() (c *listenConfig) {
+	p := s.dnsProxy
+
+	return &listenConfig{
+		dnsCryptCert:         p.DNSCryptResolverCert,
+		quic:                 s.conf.QUIC,
+		dnsCryptProviderName: p.DNSCryptProviderName,
+		udp:                  p.UDPListenAddr,
+		tcp:                  p.TCPListenAddr,
+		tls:                  p.TLSListenAddr,
+		https:                p.HTTPSListenAddr,
+		quicAddrs:            p.QUICListenAddr,
+		dnsCryptUDP:          p.DNSCryptUDPListenAddr,
+		dnsCryptTCP:          p.DNSCryptTCPListenAddr,
+		doq:                  s.doqListenAddrs,
+		proxyProtoTCP:        s.proxyProtoTCPAddrs,
+		proxyProtoTLS:        s.proxyProtoTLSAddrs,
+		pureTLS:              s.conf.PureProxy.TLSListenAddrs,
+		pureHTTPS:            s.conf.PureProxy.HTTPSListenAddrs,
+		pureQUIC:             s.conf.PureProxy.QUICListenAddrs,
+		activatedTCP:         s.conf.ActivatedTCPListeners,
+		activatedUDP:         s.conf.ActivatedUDPConns,
+		ratelimitWhitelist:   p.RatelimitWhitelist,
+		tlsCiphers:           s.conf.TLSCiphers,
+		tlsMinVersion:        s.conf.TLSMinVersion,
+		ratelimit:            p.Ratelimit,
+		maxGoroutines:        p.MaxGoroutines,
+		http3:                p.HTTP3,
+		refuseAny:            p.RefuseAny,
+	}
+}
+
+// Reload applies the new configuration to the running DNS server.  Unlike
+// [Server.Reconfigure], it only restarts the listeners if their configuration
+// has changed.  Otherwise, the queries accepted by the current listeners are
+// resolved using the new configuration.  conf must not be nil.
+func (s *Server) Reload(conf *ServerConfig) (err error) {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+
+	if !s.isRunning {
+		return errNotRunning
+	}
+
+	prevProxy := s.dnsProxy
+	prevListen := s.listenConfig()
+	prevUps := []*proxy.UpstreamConfig{
+		s.internalProxy.UpstreamConfig,
+		s.localResolvers.UpstreamConfig,
+	}
+	prevFailover := s.upsFailover
+
+	err = s.Prepare(conf)
+	if err != nil {
+		return fmt.Errorf("could not reload the server: %w", err)
+	}
+
+	if reflect.DeepEqual(prevListen, s.listenConfig()) {
+		err = s.dnsProxy.Init()
+		if err != nil {
+			s.dnsProxy = prevProxy
+
+			return fmt.Errorf("could not reload the server: %w", err)
+		}
+
+		closeUpstreamConfigs(prevUps)
+		prevFailover.close()
+
+		log.Info("dnsforward: reloaded the configuration, listeners kept")
+
+		return nil
+	}
+
+	log.Info("dnsforward: listeners changed, restarting them")
+
+	s.stopListeners()
+	closeUpstreamConfigs(prevUps)
+	prevFailover.close()
+
+	// See the comment in [Server.Reconfigure].
+	time.Sleep(100 * time.Millisecond)
+
+	err = s.startLocked()
+	if err != nil {
+		return fmt.Errorf("could not reload the server: %w", err)
+	}
+
+	return nil
+}
+
+// closeUpstreamConfigs closes the non-nil upstream configurations from confs
+// and logs the errors.
+func closeUpstreamConfigs(confs []*proxy.UpstreamConfig) {
+	for _, c := range confs {
+		if c == nil {
+			continue
+		}
+
+		err := c.Close()
+		if err != nil {
+			log.Error("dnsforward: closing previous upstreams: %s", err)
+		}
+	}
+}
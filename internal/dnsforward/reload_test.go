@@ -0,0 +1,74 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Reload(t *testing.T) {
+	conf := ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			ProtectionEnabled: true,
+			BlockingMode:      BlockingModeREFUSED,
+			EDNSClientSubnet: &EDNSClientSubnet{
+				Enabled: false,
+			},
+		},
+	}
+
+	s := createTestServer(t, &filtering.Config{}, conf, nil)
+
+	err := s.Reload(&conf)
+	assert.ErrorIs(t, err, errNotRunning)
+
+	startDeferStop(t, s)
+
+	addr := s.listenProxy.Addr(proxy.ProtoUDP).String()
+	req := createTestMessage("nxdomain.example.org.")
+
+	reply, err := dns.Exchange(req, addr)
+	require.NoError(t, err)
+
+	assert.Equal(t, dns.RcodeRefused, reply.Rcode)
+
+	t.Run("keep_listeners", func(t *testing.T) {
+		listenProxy := s.listenProxy
+
+		conf.BlockingMode = BlockingModeNXDOMAIN
+		err = s.Reload(&conf)
+		require.NoError(t, err)
+
+		assert.True(t, listenProxy == s.listenProxy)
+		assert.True(t, s.dnsProxy != s.listenProxy)
+
+		reply, err = dns.Exchange(req, addr)
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	})
+
+	t.Run("restart_listeners", func(t *testing.T) {
+		conf.UDPListenAddrs = []*net.UDPAddr{{IP: net.IP{127, 0, 0, 1}}}
+		err = s.Reload(&conf)
+		require.NoError(t, err)
+
+		assert.True(t, s.dnsProxy == s.listenProxy)
+
+		_, err = dns.Exchange(req, addr)
+		assert.Error(t, err)
+
+		newAddr := s.listenProxy.Addr(proxy.ProtoUDP).String()
+		reply, err = dns.Exchange(req, newAddr)
+		require.NoError(t, err)
+
+		assert.Equal(t, dns.RcodeNameError, reply.Rcode)
+	})
+}
@@ -0,0 +1,312 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// Serve-stale constants.  See RFC 8767.
+const (
+	// staleTTL is the TTL of the records of the stale responses in seconds.
+	// See RFC 8767, section 4.
+	staleTTL = 30
+
+	// defaultMaxStale is the default maximum time since the expiry of a
+	// response during which it may be served stale.
+	defaultMaxStale = 1 * timeutil.Day
+
+	// staleRefreshIvl is the minimum interval between the background refreshes
+	// of the same stale response, the failure recheck timer of RFC 8767.
+	staleRefreshIvl = 30 * time.Second
+)
+
+// staleResolveFunc is the signature of the functions refreshing the stale
+// responses in the background.  req is the request to resolve using the
+// upstreams ups on behalf of the client with the address addr.  upsAddr is
+// the address of the upstream the response has been received from.
+type staleResolveFunc func(
+	req *dns.Msg,
+	ups *proxy.UpstreamConfig,
+	addr net.Addr,
+) (resp *dns.Msg, upsAddr string, err error)
+
+// staleCache keeps the latest responses received from the upstreams for some
+// time after their expiry, so that they can be served when the upstreams fail,
+// as described by RFC 8767.  A nil *staleCache is valid and serves nothing.
+type staleCache struct {
+	// items contains the packed responses prefixed with their expiration
+	// times and the addresses of the upstreams.
+	items cache.Cache
+
+	// resolve is used to refresh the stale responses.
+	resolve staleResolveFunc
+
+	// mu protects nextRefresh.
+	mu *sync.Mutex
+
+	// nextRefresh are the times before which the stale responses with the
+	// corresponding keys aren't refreshed again.
+	nextRefresh map[string]time.Time
+
+	// maxStale is the maximum time since the expiry of a response during
+	// which it's served.
+	maxStale time.Duration
+
+	// minTTL and maxTTL, if not zero, are the bounds of the TTLs of the
+	// cached responses in seconds.
+	minTTL uint32
+	maxTTL uint32
+}
+
+// newStaleCache returns a new properly initialized *staleCache of size bytes.
+// maxStale is the maximum staleness of the served responses in seconds, if it's
+// zero, defaultMaxStale is used.
+func newStaleCache(size, maxStale, minTTL, maxTTL uint32, resolve staleResolveFunc) (c *staleCache) {
+	c = &staleCache{
+		items: cache.New(cache.Config{
+			MaxSize:   uint(size),
+			EnableLRU: true,
+		}),
+		resolve:     resolve,
+		mu:          &sync.Mutex{},
+		nextRefresh: map[string]time.Time{},
+		maxStale:    defaultMaxStale,
+		minTTL:      minTTL,
+		maxTTL:      maxTTL,
+	}
+
+	if maxStale != 0 {
+		c.maxStale = time.Duration(maxStale) * time.Second
+	}
+
+	return c
+}
+
+// clear removes all cached responses.  c may be nil.
+func (c *staleCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.items.Clear()
+}
+
+// get returns a copy of the response for key with the ID of req, if its expiry
+// has been no longer than c.maxStale ago.  The TTLs of the expired responses
+// are set to staleTTL.  It also returns the address of the upstream which the
+// response has been received from.  c may be nil.
+func (c *staleCache) get(key []byte, req *dns.Msg, now time.Time) (resp *dns.Msg, ups string) {
+	if c == nil {
+		return nil, ""
+	}
+
+	data := c.items.Get(key)
+	if len(data) < 10 {
+		return nil, ""
+	}
+
+	expire := time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+	left := expire.Sub(now)
+	if -left > c.maxStale {
+		c.items.Del(key)
+
+		return nil, ""
+	}
+
+	upsLen := int(binary.BigEndian.Uint16(data[8:]))
+	data = data[10:]
+	if len(data) < upsLen {
+		return nil, ""
+	}
+
+	ups, data = string(data[:upsLen]), data[upsLen:]
+
+	resp = &dns.Msg{}
+	err := resp.Unpack(data)
+	if err != nil {
+		log.Debug("dnsforward: stale cache: unpacking: %s", err)
+
+		return nil, ""
+	}
+
+	resp.Id = req.Id
+	if left > 0 {
+		capTTLs(resp, uint32(left.Seconds()))
+	} else {
+		setTTLs(resp, staleTTL)
+	}
+
+	return resp, ups
+}
+
+// setTTLs sets the TTLs of all the records in resp to ttl.
+func setTTLs(resp *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+}
+
+// set caches resp received from the upstream with address ups for key, if it's
+// cacheable.  c may be nil.
+func (c *staleCache) set(key []byte, resp *dns.Msg, ups string, now time.Time) {
+	if c == nil || resp == nil || resp.Truncated {
+		return
+	}
+
+	ttl, ok := respCacheTTL(resp)
+	if !ok {
+		return
+	}
+
+	if c.minTTL != 0 && ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+
+	if c.maxTTL != 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	packed, err := resp.Pack()
+	if err != nil {
+		log.Debug("dnsforward: stale cache: packing: %s", err)
+
+		return
+	}
+
+	data := make([]byte, 10, 10+len(ups)+len(packed))
+	binary.BigEndian.PutUint64(data, uint64(now.Add(time.Duration(ttl)*time.Second).UnixNano()))
+	binary.BigEndian.PutUint16(data[8:], uint16(len(ups)))
+	data = append(data, ups...)
+	data = append(data, packed...)
+
+	c.items.Set(key, data)
+}
+
+// refresh resolves req for key again in a separate goroutine and caches the
+// response, unless key has been refreshed within the last staleRefreshIvl.
+// ups and addr are the upstreams and the address of the client.  c may be nil.
+func (c *staleCache) refresh(
+	key []byte,
+	req *dns.Msg,
+	ups *proxy.UpstreamConfig,
+	addr net.Addr,
+	now time.Time,
+) {
+	if c == nil || !c.startRefresh(string(key), now) {
+		return
+	}
+
+	req = req.Copy()
+	go func() {
+		defer log.OnPanic("dnsforward: refreshing stale response")
+
+		resp, upsAddr, err := c.resolve(req, ups, addr)
+		if err != nil {
+			log.Debug("dnsforward: refreshing stale %q: %s", req.Question[0].Name, err)
+
+			return
+		}
+
+		c.set(key, resp, upsAddr, time.Now())
+	}()
+}
+
+// startRefresh returns true if the response for key should be refreshed now
+// and postpones the next refresh.  It also removes the outdated refresh times.
+func (c *staleCache) startRefresh(key string, now time.Time) (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if next, found := c.nextRefresh[key]; found && now.Before(next) {
+		return false
+	}
+
+	for k, next := range c.nextRefresh {
+		if !now.Before(next) {
+			delete(c.nextRefresh, k)
+		}
+	}
+
+	c.nextRefresh[key] = now.Add(staleRefreshIvl)
+
+	return true
+}
+
+// staleResolve refreshes the stale response to req using the upstreams ups of
+// the client with address addr or, if ups is nil, the ones of the current DNS
+// proxy.
+func (s *Server) staleResolve(
+	req *dns.Msg,
+	ups *proxy.UpstreamConfig,
+	addr net.Addr,
+) (resp *dns.Msg, upsAddr string, err error) {
+	prx := s.proxy()
+	if prx == nil {
+		return nil, "", srvClosedErr
+	}
+
+	if ups == nil {
+		// Set the upstreams explicitly to bypass the dnsproxy's cache.
+		ups = prx.UpstreamConfig
+	}
+
+	pctx := &proxy.DNSContext{
+		// Use TCP so that the response isn't truncated.
+		Proto:                proxy.ProtoTCP,
+		Req:                  req,
+		Addr:                 addr,
+		CustomUpstreamConfig: ups,
+		StartTime:            time.Now(),
+	}
+
+	err = prx.Resolve(pctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if pctx.Upstream != nil {
+		upsAddr = pctx.Upstream.Address()
+	}
+
+	return pctx.Res, upsAddr, nil
+}
+
+// serveStale sets the stale response for the request of dctx with key as the
+// response, if there is one, and starts its refresh in the background.  ok is
+// true if the response has been set.
+func (s *Server) serveStale(dctx *dnsContext, key []byte, reqWantsDNSSEC bool) (ok bool) {
+	pctx := dctx.proxyCtx
+	now := time.Now()
+
+	res, ups := s.staleCache.get(key, pctx.Req, now)
+	if res == nil {
+		return false
+	}
+
+	log.Debug("dnsforward: serving stale response for %q", pctx.Req.Question[0].Name)
+
+	pctx.Res = res
+	pctx.Upstream = nil
+	pctx.CachedUpstreamAddr = ups
+
+	dctx.responseFromUpstream = true
+	dctx.responseAD = res.AuthenticatedData
+	dctx.servedStale = true
+	s.setRespAD(pctx, reqWantsDNSSEC)
+
+	s.staleCache.refresh(key, pctx.Req, pctx.CustomUpstreamConfig, pctx.Addr, now)
+
+	return true
+}
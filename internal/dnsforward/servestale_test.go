@@ -0,0 +1,159 @@
+package dnsforward
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleCache(t *testing.T) {
+	const (
+		ups      = "tls://1.1.1.1:853"
+		maxStale = 3600
+	)
+
+	now := time.Now()
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   "example.org.",
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    300,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}}
+
+	resolved := make(chan *dns.Msg, 1)
+	resolve := func(
+		r *dns.Msg,
+		_ *proxy.UpstreamConfig,
+		_ net.Addr,
+	) (res *dns.Msg, upsAddr string, err error) {
+		resolved <- r
+
+		return nil, "", errors.Error("upstream failed")
+	}
+
+	c := newStaleCache(4096, maxStale, 0, 0, resolve)
+	key := partCacheKey(0, req)
+	c.set(key, resp, ups, now)
+
+	testCases := []struct {
+		name    string
+		since   time.Duration
+		wantTTL uint32
+		wantHit bool
+	}{{
+		name:    "fresh",
+		since:   100 * time.Second,
+		wantTTL: 200,
+		wantHit: true,
+	}, {
+		name:    "stale",
+		since:   (300 + maxStale - 1) * time.Second,
+		wantTTL: staleTTL,
+		wantHit: true,
+	}, {
+		name:    "too_stale",
+		since:   (300 + maxStale + 1) * time.Second,
+		wantHit: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, gotUps := c.get(key, req, now.Add(tc.since))
+			if !tc.wantHit {
+				assert.Nil(t, got)
+
+				return
+			}
+
+			require.NotNil(t, got)
+			require.Len(t, got.Answer, 1)
+
+			assert.Equal(t, ups, gotUps)
+			assert.Equal(t, tc.wantTTL, got.Answer[0].Header().Ttl)
+		})
+	}
+
+	t.Run("refresh", func(t *testing.T) {
+		c.refresh(key, req, nil, nil, now)
+
+		got := <-resolved
+		assert.Equal(t, req.Question, got.Question)
+
+		// Don't refresh the same response again until the interval passes.
+		c.refresh(key, req, nil, nil, now.Add(staleRefreshIvl/2))
+		c.refresh(key, req, nil, nil, now.Add(staleRefreshIvl))
+
+		got = <-resolved
+		assert.Equal(t, req.Question, got.Question)
+		assert.Empty(t, resolved)
+	})
+}
+
+func TestServer_serveStale(t *testing.T) {
+	var failing atomic.Bool
+	ups := aghtest.NewUpstreamMock(func(req *dns.Msg) (resp *dns.Msg, err error) {
+		if failing.Load() {
+			return nil, errors.Error("upstream failed")
+		}
+
+		return aghtest.MatchedResponse(req, dns.TypeA, "host", "192.168.0.1"), nil
+	})
+
+	s := createTestServer(t, &filtering.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			CacheSize:       4096,
+			CacheServeStale: true,
+			EDNSClientSubnet: &EDNSClientSubnet{
+				Enabled: false,
+			},
+		},
+	}, nil)
+	s.conf.GetCustomUpstreamByClient = func(_ string) (conf *proxy.UpstreamConfig, err error) {
+		return &proxy.UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		}, nil
+	}
+	startDeferStop(t, s)
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+
+	reply, err := dns.Exchange(createTestMessage("host."), addr)
+	require.NoError(t, err)
+	require.Len(t, reply.Answer, 1)
+
+	failing.Store(true)
+
+	reply, err = dns.Exchange(createTestMessage("host."), addr)
+	require.NoError(t, err)
+
+	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+	require.Len(t, reply.Answer, 1)
+
+	a, ok := reply.Answer[0].(*dns.A)
+	require.True(t, ok)
+
+	assert.Equal(t, net.IP{192, 168, 0, 1}, a.A.To4())
+
+	reply, err = dns.Exchange(createTestMessage("other.host."), addr)
+	require.NoError(t, err)
+
+	assert.Equal(t, dns.RcodeServerFailure, reply.Rcode)
+}
@@ -0,0 +1,236 @@
+package dnsforward
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+const (
+	// sessionIdleTimeout is the time after the last request of an encrypted
+	// DNS session after which it's no longer considered connected.  It's the
+	// same as the default idle timeout of the DNS-over-QUIC connections.
+	sessionIdleTimeout = defaultDoQMaxIdleTimeout
+
+	// maxSessions is the maximum number of the tracked encrypted DNS sessions.
+	maxSessions = 1000
+)
+
+// sessionKey is the key of an encrypted DNS session.
+type sessionKey struct {
+	// proto is the protocol of the session.
+	proto querylog.ClientProto
+
+	// addr is the remote address of the session's connection.
+	addr netip.AddrPort
+}
+
+// session is an encrypted DNS session, that is a connection of a client over
+// one of the encrypted DNS protocols.
+type session struct {
+	// firstSeen is the time of the first request of the session.
+	firstSeen time.Time
+
+	// lastSeen is the time of the last request of the session.
+	lastSeen time.Time
+
+	// clientID is the ClientID of the last request of the session, if any.
+	clientID string
+
+	// serverName is the server name sent by the client, if any.
+	serverName string
+
+	// requests is the number of the requests of the session.
+	requests uint64
+}
+
+// sessionTracker tracks the encrypted DNS sessions of the clients.  A nil
+// *sessionTracker is valid and tracks nothing.
+type sessionTracker struct {
+	// mu protects sessions.
+	mu *sync.Mutex
+
+	// sessions are the tracked sessions.  Its length doesn't exceed
+	// maxSessions.
+	sessions map[sessionKey]*session
+}
+
+// newSessionTracker returns a new properly initialized *sessionTracker.
+func newSessionTracker() (t *sessionTracker) {
+	return &sessionTracker{
+		mu:       &sync.Mutex{},
+		sessions: map[sessionKey]*session{},
+	}
+}
+
+// record records a request of the session with key made at now.  If the
+// tracker is full, the sessions of the new connections aren't tracked until the
+// idle ones expire.
+func (t *sessionTracker) record(key sessionKey, clientID, srvName string, now time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sess, ok := t.sessions[key]
+	if !ok {
+		if len(t.sessions) >= maxSessions {
+			t.expireLocked(now)
+			if len(t.sessions) >= maxSessions {
+				return
+			}
+		}
+
+		sess = &session{
+			firstSeen: now,
+		}
+		t.sessions[key] = sess
+	}
+
+	sess.lastSeen = now
+	sess.clientID = clientID
+	sess.serverName = srvName
+	sess.requests++
+}
+
+// expireLocked removes the sessions idle for longer than sessionIdleTimeout at
+// now.  t.mu is expected to be locked.
+func (t *sessionTracker) expireLocked(now time.Time) {
+	for k, sess := range t.sessions {
+		if now.Sub(sess.lastSeen) > sessionIdleTimeout {
+			delete(t.sessions, k)
+		}
+	}
+}
+
+// sessionJSON is a single encrypted DNS session in the response to the GET
+// /control/dns/sessions HTTP API.
+type sessionJSON struct {
+	// FirstSeen is the time of the first request of the session.
+	FirstSeen time.Time `json:"first_seen"`
+
+	// LastSeen is the time of the last request of the session.
+	LastSeen time.Time `json:"last_seen"`
+
+	// ClientID is the ClientID of the session, if any.
+	ClientID string `json:"client_id,omitempty"`
+
+	// Protocol is the protocol of the session, "doh", "dot", or "doq".
+	Protocol querylog.ClientProto `json:"protocol"`
+
+	// ServerName is the server name sent by the client, if any.
+	ServerName string `json:"server_name,omitempty"`
+
+	// RemoteAddr is the remote address of the connection.  The IP address is
+	// anonymized, if the anonymization is enabled.
+	RemoteAddr string `json:"remote_addr"`
+
+	// Requests is the number of the requests made within the session.
+	Requests uint64 `json:"requests"`
+}
+
+// list returns the sessions which aren't idle at now, the most recently active
+// first.  anonymize is used to mask the IP addresses of the sessions.
+func (t *sessionTracker) list(now time.Time, anonymize aghnet.IPMutFunc) (sessions []*sessionJSON) {
+	sessions = []*sessionJSON{}
+	if t == nil {
+		return sessions
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expireLocked(now)
+
+	for k, sess := range t.sessions {
+		ip := net.IP(k.addr.Addr().AsSlice())
+		anonymize(ip)
+
+		sessions = append(sessions, &sessionJSON{
+			FirstSeen:  sess.firstSeen,
+			LastSeen:   sess.lastSeen,
+			ClientID:   sess.clientID,
+			Protocol:   k.proto,
+			ServerName: sess.serverName,
+			RemoteAddr: netutil.JoinHostPort(ip.String(), int(k.addr.Port())),
+			Requests:   sess.requests,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) (less bool) {
+		a, b := sessions[i], sessions[j]
+		if !a.LastSeen.Equal(b.LastSeen) {
+			return a.LastSeen.After(b.LastSeen)
+		}
+
+		return a.RemoteAddr < b.RemoteAddr
+	})
+
+	return sessions
+}
+
+// sessionProto returns the client protocol of the encrypted DNS protocol
+// proto.  ok is false if proto isn't one of those.
+func sessionProto(proto proxy.Proto) (cp querylog.ClientProto, ok bool) {
+	switch proto {
+	case proxy.ProtoHTTPS:
+		return querylog.ClientProtoDoH, true
+	case proxy.ProtoQUIC:
+		return querylog.ClientProtoDoQ, true
+	case proxy.ProtoTLS:
+		return querylog.ClientProtoDoT, true
+	default:
+		return "", false
+	}
+}
+
+// recordSession records the request of pctx with clientID in the session
+// tracker if it's made over one of the encrypted DNS protocols.
+func (s *Server) recordSession(pctx *proxy.DNSContext, clientID string) {
+	cp, ok := sessionProto(pctx.Proto)
+	if !ok {
+		return
+	}
+
+	var srvName string
+	if pctx.Proto != proxy.ProtoHTTPS || pctx.HTTPRequest != nil {
+		var err error
+		srvName, err = clientServerName(pctx, pctx.Proto)
+		if err != nil {
+			log.Debug("dnsforward: sessions: getting server name: %s", err)
+		}
+	}
+
+	key := sessionKey{
+		proto: cp,
+		addr:  netutil.NetAddrToAddrPort(pctx.Addr),
+	}
+
+	s.sessions.record(key, clientID, srvName, time.Now())
+}
+
+// sessionsResp is the response to the GET /control/dns/sessions HTTP API.
+type sessionsResp struct {
+	// Sessions are the currently connected encrypted DNS sessions, the most
+	// recently active first.
+	Sessions []*sessionJSON `json:"sessions"`
+}
+
+// handleSessions is the handler for the GET /control/dns/sessions HTTP API.
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, &sessionsResp{
+		Sessions: s.sessions.list(time.Now(), s.anonymizer.Load()),
+	})
+}
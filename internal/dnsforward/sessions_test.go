@@ -0,0 +1,66 @@
+package dnsforward
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTracker(t *testing.T) {
+	tr := newSessionTracker()
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	dotKey := sessionKey{
+		proto: querylog.ClientProtoDoT,
+		addr:  netip.MustParseAddrPort("192.168.0.1:1234"),
+	}
+	doqKey := sessionKey{
+		proto: querylog.ClientProtoDoQ,
+		addr:  netip.MustParseAddrPort("192.168.0.2:4321"),
+	}
+
+	tr.record(dotKey, "cli", "cli.dns.example", now)
+	tr.record(doqKey, "", "dns.example", now.Add(time.Second))
+	tr.record(dotKey, "cli", "cli.dns.example", now.Add(2*time.Second))
+
+	nop := func(_ net.IP) {}
+	sessions := tr.list(now.Add(3*time.Second), nop)
+	require.Len(t, sessions, 2)
+
+	assert.Equal(t, &sessionJSON{
+		FirstSeen:  now,
+		LastSeen:   now.Add(2 * time.Second),
+		ClientID:   "cli",
+		Protocol:   querylog.ClientProtoDoT,
+		ServerName: "cli.dns.example",
+		RemoteAddr: "192.168.0.1:1234",
+		Requests:   2,
+	}, sessions[0])
+	assert.Equal(t, querylog.ClientProtoDoQ, sessions[1].Protocol)
+
+	t.Run("anonymized", func(t *testing.T) {
+		anon := func(ip net.IP) { ip[len(ip)-1] = 0 }
+		sessions = tr.list(now.Add(3*time.Second), anon)
+		require.Len(t, sessions, 2)
+
+		assert.Equal(t, "192.168.0.0:1234", sessions[0].RemoteAddr)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		sessions = tr.list(now.Add(time.Second+sessionIdleTimeout+time.Millisecond), nop)
+		require.Len(t, sessions, 1)
+
+		assert.Equal(t, querylog.ClientProtoDoT, sessions[0].Protocol)
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var nilTracker *sessionTracker
+		assert.NotPanics(t, func() { nilTracker.record(dotKey, "", "", now) })
+		assert.Empty(t, nilTracker.list(now, nop))
+	})
+}
@@ -0,0 +1,374 @@
+package dnsforward
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/maps"
+)
+
+// slowQueryLogSize is the maximum number of the queries kept in the slow-query
+// log.
+const slowQueryLogSize = 100
+
+// queryTimings is the breakdown of the time spent on processing a single
+// request.
+type queryTimings struct {
+	// filtering is the time spent on filtering the request and the response.
+	filtering time.Duration
+
+	// cache is the time spent on looking the response up in the caches.
+	cache time.Duration
+
+	// upstream is the time spent on exchanging with the upstream.
+	upstream time.Duration
+}
+
+// toMs returns d in milliseconds with the microsecond precision.
+func toMs(d time.Duration) (ms float64) {
+	return float64(d.Microseconds()) / 1000
+}
+
+// slowQuery is an entry of the slow-query log.
+type slowQuery struct {
+	// Time is the time at which the processing of the request has started.
+	Time time.Time `json:"time"`
+
+	// Domain is the requested domain name.
+	Domain string `json:"domain"`
+
+	// Type is the requested resource record type.
+	Type string `json:"type"`
+
+	// Client is the ClientID or the IP address of the client.  The IP address
+	// is anonymized, if the anonymization is enabled.
+	Client string `json:"client"`
+
+	// Upstream is the address of the upstream the response has been received
+	// from, if any.
+	Upstream string `json:"upstream,omitempty"`
+
+	// ElapsedMs is the total processing time in milliseconds.
+	ElapsedMs float64 `json:"elapsed_ms"`
+
+	// FilteringMs is the time spent on filtering in milliseconds.
+	FilteringMs float64 `json:"filtering_ms"`
+
+	// CacheMs is the time spent on looking up the caches in milliseconds.
+	CacheMs float64 `json:"cache_ms"`
+
+	// UpstreamMs is the time spent on exchanging with the upstream in
+	// milliseconds.
+	UpstreamMs float64 `json:"upstream_ms"`
+
+	// Cached is true if the response has been taken from the cache.
+	Cached bool `json:"cached"`
+}
+
+// slowQueryLog is the ring buffer of the last slow queries.  A nil
+// *slowQueryLog is a valid log that keeps nothing.
+type slowQueryLog struct {
+	// mu protects entries and next.
+	mu *sync.Mutex
+
+	// entries are the logged queries.  Its length doesn't exceed
+	// slowQueryLogSize.
+	entries []*slowQuery
+
+	// next is the index in entries to write the next query to once the log is
+	// full.
+	next int
+}
+
+// newSlowQueryLog returns a new properly initialized *slowQueryLog.
+func newSlowQueryLog() (l *slowQueryLog) {
+	return &slowQueryLog{
+		mu:      &sync.Mutex{},
+		entries: make([]*slowQuery, 0, slowQueryLogSize),
+	}
+}
+
+// add puts q into the log, replacing the oldest query if it's full.
+func (l *slowQueryLog) add(q *slowQuery) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.entries) < slowQueryLogSize {
+		l.entries = append(l.entries, q)
+
+		return
+	}
+
+	l.entries[l.next] = q
+	l.next = (l.next + 1) % slowQueryLogSize
+}
+
+// list returns the logged queries, the newest first.
+func (l *slowQueryLog) list() (qs []*slowQuery) {
+	if l == nil {
+		return []*slowQuery{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := len(l.entries)
+	qs = make([]*slowQuery, 0, n)
+	for i := 1; i <= n; i++ {
+		qs = append(qs, l.entries[(l.next-i+n)%n])
+	}
+
+	return qs
+}
+
+// latencyBuckets are the upper bounds of the buckets of the upstream response
+// time histograms.  The last bucket of a histogram, one more than the bounds,
+// is the one of the longer exchanges.
+var latencyBuckets = []time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// latencyHist is the response time histogram of a single upstream.
+type latencyHist struct {
+	// counts are the numbers of the exchanges within each of latencyBuckets,
+	// plus the number of the longer ones.
+	counts []uint64
+
+	// total is the total number of the exchanges.
+	total uint64
+
+	// max is the longest exchange time.
+	max time.Duration
+}
+
+// add records the exchange which took d.
+func (h *latencyHist) add(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) (ok bool) {
+		return d <= latencyBuckets[i]
+	})
+
+	h.counts[i]++
+	h.total++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// percentile returns the upper bound of the bucket containing the p-th
+// percentile of the exchange times, with p in the range from 0 to 100.  For the
+// last bucket or if the bound exceeds the longest exchange time, it returns the
+// latter.
+func (h *latencyHist) percentile(p uint64) (d time.Duration) {
+	if h.total == 0 {
+		return 0
+	}
+
+	// Round the rank up, so that the rank of the 100th percentile is the
+	// total number.
+	rank := (h.total*p + 99) / 100
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen < rank {
+			continue
+		}
+
+		if i < len(latencyBuckets) && latencyBuckets[i] < h.max {
+			return latencyBuckets[i]
+		}
+
+		break
+	}
+
+	return h.max
+}
+
+// upstreamLatency are the response time histograms of the upstreams.  A nil
+// *upstreamLatency is valid and records nothing.
+type upstreamLatency struct {
+	// mu protects hists.
+	mu *sync.Mutex
+
+	// hists are the histograms by the addresses of the upstreams.
+	hists map[string]*latencyHist
+}
+
+// newUpstreamLatency returns a new properly initialized *upstreamLatency.
+func newUpstreamLatency() (l *upstreamLatency) {
+	return &upstreamLatency{
+		mu:    &sync.Mutex{},
+		hists: map[string]*latencyHist{},
+	}
+}
+
+// record records the exchange with the upstream with addr which took d.
+func (l *upstreamLatency) record(addr string, d time.Duration) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.hists[addr]
+	if !ok {
+		h = &latencyHist{
+			counts: make([]uint64, len(latencyBuckets)+1),
+		}
+		l.hists[addr] = h
+	}
+
+	h.add(d)
+}
+
+// upstreamLatencyJSON is the response time summary of a single upstream.
+type upstreamLatencyJSON struct {
+	// Address is the address of the upstream.
+	Address string `json:"address"`
+
+	// Count is the number of the exchanges with the upstream.
+	Count uint64 `json:"count"`
+
+	// P50Ms, P90Ms, and P99Ms are the percentiles of the response time in
+	// milliseconds.  These are the upper bounds of the histogram buckets, so
+	// they may be greater than the actual percentiles.
+	P50Ms float64 `json:"p50_ms"`
+	P90Ms float64 `json:"p90_ms"`
+	P99Ms float64 `json:"p99_ms"`
+
+	// MaxMs is the longest response time in milliseconds.
+	MaxMs float64 `json:"max_ms"`
+}
+
+// summary returns the response time summaries of the upstreams sorted by their
+// addresses.
+func (l *upstreamLatency) summary() (sum []*upstreamLatencyJSON) {
+	sum = []*upstreamLatencyJSON{}
+	if l == nil {
+		return sum
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	addrs := maps.Keys(l.hists)
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		h := l.hists[addr]
+		sum = append(sum, &upstreamLatencyJSON{
+			Address: addr,
+			Count:   h.total,
+			P50Ms:   toMs(h.percentile(50)),
+			P90Ms:   toMs(h.percentile(90)),
+			P99Ms:   toMs(h.percentile(99)),
+			MaxMs:   toMs(h.max),
+		})
+	}
+
+	return sum
+}
+
+// recordResolveTime records the time d spent on resolving the request of dctx
+// by the proxy.  It's the time of the exchange with the upstream unless the
+// response has been taken from the cache of the proxy.
+func (s *Server) recordResolveTime(dctx *dnsContext, d time.Duration) {
+	pctx := dctx.proxyCtx
+	if pctx.Upstream == nil {
+		dctx.timings.cache += d
+
+		return
+	}
+
+	dctx.timings.upstream = d
+	s.upsLatency.record(pctx.Upstream.Address(), d)
+}
+
+// logSlowQuery puts the request into the slow-query log if it has been
+// processed for longer than the configured threshold.  ip is the anonymized
+// address of the client.  s.serverLock is expected to be locked.
+func (s *Server) logSlowQuery(dctx *dnsContext, elapsed time.Duration, ip net.IP) {
+	threshold := s.conf.SlowQueryThreshold.Duration
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+
+	pctx := dctx.proxyCtx
+	q := pctx.Req.Question[0]
+	sq := &slowQuery{
+		Time:        dctx.startTime,
+		Domain:      strings.ToLower(strings.TrimSuffix(q.Name, ".")),
+		Type:        dns.Type(q.Qtype).String(),
+		Client:      dctx.clientID,
+		ElapsedMs:   toMs(elapsed),
+		FilteringMs: toMs(dctx.timings.filtering),
+		CacheMs:     toMs(dctx.timings.cache),
+		UpstreamMs:  toMs(dctx.timings.upstream),
+	}
+
+	if sq.Client == "" && ip != nil {
+		sq.Client = ip.String()
+	}
+
+	if pctx.Upstream != nil {
+		sq.Upstream = pctx.Upstream.Address()
+	} else if pctx.CachedUpstreamAddr != "" {
+		sq.Upstream = pctx.CachedUpstreamAddr
+		sq.Cached = true
+	}
+
+	s.slowQueries.add(sq)
+}
+
+// slowQueriesResp is the response to the GET /control/dns/slow_queries HTTP
+// API.
+type slowQueriesResp struct {
+	// Queries are the logged slow queries, the newest first.
+	Queries []*slowQuery `json:"queries"`
+
+	// Upstreams are the response time summaries of the upstreams.
+	Upstreams []*upstreamLatencyJSON `json:"upstreams"`
+
+	// ThresholdMs is the configured threshold of the slow queries in
+	// milliseconds.  Zero means that the slow-query log is disabled.
+	ThresholdMs float64 `json:"threshold_ms"`
+}
+
+// handleSlowQueries is the handler for the GET /control/dns/slow_queries HTTP
+// API.
+func (s *Server) handleSlowQueries(w http.ResponseWriter, r *http.Request) {
+	var threshold timeutil.Duration
+	func() {
+		s.serverLock.RLock()
+		defer s.serverLock.RUnlock()
+
+		threshold = s.conf.SlowQueryThreshold
+	}()
+
+	_ = aghhttp.WriteJSONResponse(w, r, &slowQueriesResp{
+		Queries:     s.slowQueries.list(),
+		Upstreams:   s.upsLatency.summary(),
+		ThresholdMs: toMs(threshold.Duration),
+	})
+}
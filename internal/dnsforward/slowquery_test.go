@@ -0,0 +1,157 @@
+package dnsforward
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowQueryLog(t *testing.T) {
+	l := newSlowQueryLog()
+	require.Empty(t, l.list())
+
+	const n = slowQueryLogSize + 10
+	for i := 0; i < n; i++ {
+		l.add(&slowQuery{Domain: strconv.Itoa(i)})
+	}
+
+	qs := l.list()
+	require.Len(t, qs, slowQueryLogSize)
+
+	assert.Equal(t, strconv.Itoa(n-1), qs[0].Domain)
+	assert.Equal(t, strconv.Itoa(n-slowQueryLogSize), qs[len(qs)-1].Domain)
+
+	var nilLog *slowQueryLog
+	assert.NotPanics(t, func() { nilLog.add(&slowQuery{}) })
+	assert.Empty(t, nilLog.list())
+}
+
+func TestLatencyHist_percentile(t *testing.T) {
+	h := &latencyHist{
+		counts: make([]uint64, len(latencyBuckets)+1),
+	}
+	assert.Zero(t, h.percentile(50))
+
+	// 90 fast exchanges, 9 slower ones, and a single very slow one.
+	for i := 0; i < 90; i++ {
+		h.add(3 * time.Millisecond)
+	}
+
+	for i := 0; i < 9; i++ {
+		h.add(150 * time.Millisecond)
+	}
+
+	h.add(7 * time.Second)
+
+	testCases := []struct {
+		want time.Duration
+		name string
+		p    uint64
+	}{{
+		want: 5 * time.Millisecond,
+		name: "p50",
+		p:    50,
+	}, {
+		want: 5 * time.Millisecond,
+		name: "p90",
+		p:    90,
+	}, {
+		want: 200 * time.Millisecond,
+		name: "p99",
+		p:    99,
+	}, {
+		want: 7 * time.Second,
+		name: "p100",
+		p:    100,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, h.percentile(tc.p))
+		})
+	}
+
+	t.Run("below_bound", func(t *testing.T) {
+		small := &latencyHist{
+			counts: make([]uint64, len(latencyBuckets)+1),
+		}
+		small.add(300 * time.Microsecond)
+
+		assert.Equal(t, 300*time.Microsecond, small.percentile(50))
+	})
+}
+
+func TestUpstreamLatency_summary(t *testing.T) {
+	l := newUpstreamLatency()
+	l.record("tls://2.2.2.2", 10*time.Millisecond)
+	l.record("tls://1.1.1.1", 1500*time.Microsecond)
+	l.record("tls://1.1.1.1", 40*time.Millisecond)
+
+	sum := l.summary()
+	require.Len(t, sum, 2)
+
+	assert.Equal(t, &upstreamLatencyJSON{
+		Address: "tls://1.1.1.1",
+		Count:   2,
+		P50Ms:   2,
+		P90Ms:   40,
+		P99Ms:   40,
+		MaxMs:   40,
+	}, sum[0])
+	assert.Equal(t, "tls://2.2.2.2", sum[1].Address)
+}
+
+func TestServer_logSlowQuery(t *testing.T) {
+	const threshold = 100 * time.Millisecond
+
+	newDctx := func() (dctx *dnsContext) {
+		return &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req: (&dns.Msg{}).SetQuestion("Example.ORG.", dns.TypeAAAA),
+			},
+			startTime: time.Now(),
+			timings: queryTimings{
+				filtering: 2 * time.Millisecond,
+				upstream:  150 * time.Millisecond,
+			},
+		}
+	}
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				SlowQueryThreshold: timeutil.Duration{Duration: threshold},
+			},
+		},
+		slowQueries: newSlowQueryLog(),
+	}
+
+	ip := net.IP{192, 168, 0, 1}
+
+	s.logSlowQuery(newDctx(), threshold/2, ip)
+	require.Empty(t, s.slowQueries.list())
+
+	s.logSlowQuery(newDctx(), 155*time.Millisecond, ip)
+	qs := s.slowQueries.list()
+	require.Len(t, qs, 1)
+
+	q := qs[0]
+	assert.Equal(t, "example.org", q.Domain)
+	assert.Equal(t, "AAAA", q.Type)
+	assert.Equal(t, ip.String(), q.Client)
+	assert.Equal(t, float64(155), q.ElapsedMs)
+	assert.Equal(t, float64(2), q.FilteringMs)
+	assert.Equal(t, float64(150), q.UpstreamMs)
+	assert.False(t, q.Cached)
+
+	s.conf.SlowQueryThreshold = timeutil.Duration{}
+	s.logSlowQuery(newDctx(), time.Hour, ip)
+	assert.Len(t, s.slowQueries.list(), 1)
+}
@@ -0,0 +1,362 @@
+package dnsforward
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// SOCKS5 protocol values.  See RFC 1928 and RFC 1929.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+
+	socks5PasswordVersion = 0x01
+
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded = 0x00
+)
+
+// maxSOCKS5UDPHeaderLen is the maximum length of the header of a UDP datagram
+// relayed by a SOCKS5 proxy: the reserved field, the fragment number, the
+// address type, the longest domain name with its length, and the port.
+const maxSOCKS5UDPHeaderLen = 2 + 1 + 1 + 1 + 255 + 2
+
+// socks5Associate establishes a UDP association with the SOCKS5 proxy at
+// proxyAddr, connecting to it with dial, and authenticating with user, if it's
+// not nil.  See RFC 1928, section 7.
+func socks5Associate(
+	ctx context.Context,
+	dial func(ctx context.Context, network, addr string) (conn net.Conn, err error),
+	proxyAddr string,
+	user *url.Userinfo,
+) (pc *socks5PacketConn, err error) {
+	ctrl, err := dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to proxy: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, ctrl.Close())
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = ctrl.SetDeadline(deadline)
+	}
+
+	err = socks5Authenticate(ctrl, user)
+	if err != nil {
+		return nil, fmt.Errorf("authenticating: %w", err)
+	}
+
+	// The client address is unknown before the UDP socket is bound, so let
+	// the proxy accept the datagrams from any address.
+	_, err = ctrl.Write([]byte{
+		socks5Version, socks5CmdUDPAssociate, 0x00,
+		socks5AddrIPv4, 0, 0, 0, 0, 0, 0,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("writing associate request: %w", err)
+	}
+
+	hdr := make([]byte, 4)
+	_, err = io.ReadFull(ctrl, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("reading associate reply: %w", err)
+	} else if hdr[0] != socks5Version {
+		return nil, fmt.Errorf("bad version %d", hdr[0])
+	} else if hdr[1] != socks5ReplySucceeded {
+		return nil, fmt.Errorf("associate failed with code %d", hdr[1])
+	}
+
+	relay, err := readSOCKS5AddrPort(ctrl, hdr[3])
+	if err != nil {
+		return nil, fmt.Errorf("reading relay address: %w", err)
+	}
+
+	// The proxies listening on all the interfaces often reply with the
+	// unspecified address, which means the address of the proxy itself.
+	if relay.Addr().IsUnspecified() {
+		tcpAddr, ok := ctrl.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, fmt.Errorf("unspecified relay address for proxy %s", ctrl.RemoteAddr())
+		}
+
+		relay = netip.AddrPortFrom(tcpAddr.AddrPort().Addr().Unmap(), relay.Port())
+	}
+
+	udpConn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(relay))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to relay: %w", err)
+	}
+
+	_ = ctrl.SetDeadline(time.Time{})
+
+	return &socks5PacketConn{
+		ctrl:  ctrl,
+		relay: udpConn,
+	}, nil
+}
+
+// socks5Authenticate negotiates the authentication method over conn and
+// authenticates with user, if it's not nil.
+func socks5Authenticate(conn net.Conn, user *url.Userinfo) (err error) {
+	method := byte(socks5AuthNone)
+	if user != nil {
+		method = socks5AuthPassword
+	}
+
+	_, err = conn.Write([]byte{socks5Version, 1, method})
+	if err != nil {
+		return fmt.Errorf("writing greeting: %w", err)
+	}
+
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return fmt.Errorf("reading greeting: %w", err)
+	} else if resp[0] != socks5Version {
+		return fmt.Errorf("bad version %d", resp[0])
+	} else if resp[1] != method {
+		return fmt.Errorf("method %d not accepted", method)
+	} else if method == socks5AuthNone {
+		return nil
+	}
+
+	name := user.Username()
+	pass, _ := user.Password()
+	if len(name) > 255 || len(pass) > 255 {
+		return errors.Error("username or password too long")
+	}
+
+	req := []byte{socks5PasswordVersion, byte(len(name))}
+	req = append(req, name...)
+	req = append(req, byte(len(pass)))
+	req = append(req, pass...)
+	_, err = conn.Write(req)
+	if err != nil {
+		return fmt.Errorf("writing credentials: %w", err)
+	}
+
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return fmt.Errorf("reading credentials status: %w", err)
+	} else if resp[1] != 0 {
+		return errors.Error("bad credentials")
+	}
+
+	return nil
+}
+
+// readSOCKS5AddrPort reads the IP address of the type atyp and the port from
+// r.
+func readSOCKS5AddrPort(r io.Reader, atyp byte) (ap netip.AddrPort, err error) {
+	var addrLen int
+	switch atyp {
+	case socks5AddrIPv4:
+		addrLen = 4
+	case socks5AddrIPv6:
+		addrLen = 16
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unsupported address type %d", atyp)
+	}
+
+	buf := make([]byte, addrLen+2)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	ip, _ := netip.AddrFromSlice(buf[:addrLen])
+
+	return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(buf[addrLen:])), nil
+}
+
+// appendSOCKS5Addr appends the SOCKS5 representation of the host and the port
+// from hostPort to b.  host may be either an IP address or a domain name.
+func appendSOCKS5Addr(b []byte, hostPort string) (res []byte, err error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return b, err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return b, fmt.Errorf("parsing port: %w", err)
+	}
+
+	if ip, ipErr := netip.ParseAddr(host); ipErr == nil {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			b = append(b, socks5AddrIPv4)
+		} else {
+			b = append(b, socks5AddrIPv6)
+		}
+
+		b = append(b, ip.AsSlice()...)
+	} else if len(host) <= 255 {
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	} else {
+		return b, fmt.Errorf("host %q too long", host)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// socks5Addr is the address of a host relayed by a SOCKS5 proxy, which may be
+// a domain name resolved by the proxy.
+type socks5Addr string
+
+// type check
+var _ net.Addr = socks5Addr("")
+
+// Network implements the [net.Addr] interface for socks5Addr.
+func (a socks5Addr) Network() (network string) {
+	return "udp"
+}
+
+// String implements the [net.Addr] interface for socks5Addr.
+func (a socks5Addr) String() (s string) {
+	return string(a)
+}
+
+// socks5PacketConn is a net.PacketConn which relays the datagrams through a
+// SOCKS5 proxy.  Note that it intentionally doesn't expose the underlying UDP
+// socket, so that the users like quic-go don't bypass the relay.
+type socks5PacketConn struct {
+	// ctrl is the TCP connection which keeps the association alive.
+	ctrl net.Conn
+
+	// relay is the UDP socket connected to the relay of the proxy.
+	relay *net.UDPConn
+}
+
+// type check
+var _ net.PacketConn = (*socks5PacketConn)(nil)
+
+// ReadFrom implements the [net.PacketConn] interface for *socks5PacketConn.
+// The fragmented datagrams are dropped.
+func (c *socks5PacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	buf := make([]byte, len(b)+maxSOCKS5UDPHeaderLen)
+	for {
+		n, err = c.relay.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		var hdrLen int
+		addr, hdrLen, err = parseSOCKS5UDPHeader(buf[:n])
+		if err != nil {
+			// Drop the malformed and fragmented datagrams.
+			continue
+		}
+
+		return copy(b, buf[hdrLen:n]), addr, nil
+	}
+}
+
+// parseSOCKS5UDPHeader parses the header of the relayed datagram b and returns
+// the address of the sender and the length of the header.
+func parseSOCKS5UDPHeader(b []byte) (addr net.Addr, hdrLen int, err error) {
+	if len(b) < 4 {
+		return nil, 0, io.ErrUnexpectedEOF
+	} else if b[2] != 0 {
+		return nil, 0, errors.Error("fragmented datagram")
+	}
+
+	switch b[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		addrLen := 4
+		if b[3] == socks5AddrIPv6 {
+			addrLen = 16
+		}
+
+		hdrLen = 4 + addrLen + 2
+		if len(b) < hdrLen {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+
+		ip, _ := netip.AddrFromSlice(b[4 : 4+addrLen])
+		port := binary.BigEndian.Uint16(b[4+addrLen:])
+
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), hdrLen, nil
+	case socks5AddrDomain:
+		if len(b) < 5 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+
+		nameLen := int(b[4])
+		hdrLen = 5 + nameLen + 2
+		if len(b) < hdrLen {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+
+		port := binary.BigEndian.Uint16(b[5+nameLen:])
+		hostPort := net.JoinHostPort(string(b[5:5+nameLen]), strconv.Itoa(int(port)))
+
+		return socks5Addr(hostPort), hdrLen, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported address type %d", b[3])
+	}
+}
+
+// WriteTo implements the [net.PacketConn] interface for *socks5PacketConn.
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	buf := make([]byte, 3, 3+maxSOCKS5UDPHeaderLen+len(b))
+	buf, err = appendSOCKS5Addr(buf, addr.String())
+	if err != nil {
+		return 0, fmt.Errorf("encoding address: %w", err)
+	}
+
+	_, err = c.relay.Write(append(buf, b...))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Close implements the [net.PacketConn] interface for *socks5PacketConn.  It
+// also ends the association.
+func (c *socks5PacketConn) Close() (err error) {
+	return errors.WithDeferred(c.relay.Close(), c.ctrl.Close())
+}
+
+// LocalAddr implements the [net.PacketConn] interface for *socks5PacketConn.
+func (c *socks5PacketConn) LocalAddr() (addr net.Addr) {
+	return c.relay.LocalAddr()
+}
+
+// SetDeadline implements the [net.PacketConn] interface for *socks5PacketConn.
+func (c *socks5PacketConn) SetDeadline(t time.Time) (err error) {
+	return c.relay.SetDeadline(t)
+}
+
+// SetReadDeadline implements the [net.PacketConn] interface for
+// *socks5PacketConn.
+func (c *socks5PacketConn) SetReadDeadline(t time.Time) (err error) {
+	return c.relay.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements the [net.PacketConn] interface for
+// *socks5PacketConn.
+func (c *socks5PacketConn) SetWriteDeadline(t time.Time) (err error) {
+	return c.relay.SetWriteDeadline(t)
+}
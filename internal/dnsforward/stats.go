@@ -1,7 +1,11 @@
 package dnsforward
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"net"
+	"os"
 	"strings"
 	"time"
 
@@ -9,6 +13,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/miekg/dns"
@@ -20,6 +25,12 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 	elapsed := time.Since(dctx.startTime)
 	pctx := dctx.proxyCtx
 
+	if isLoggingIgnored(dctx) {
+		log.Debug("dnsforward: client of request %d is ignored; not logging", pctx.RequestID)
+
+		return resultCodeSuccess
+	}
+
 	shouldLog := true
 	msg := pctx.Req
 	q := msg.Question[0]
@@ -33,6 +44,10 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 	ip, _ := netutil.IPAndPortFromAddr(pctx.Addr)
 	ip = slices.Clone(ip)
 
+	// Match the ignored clients by their real addresses, since ip is
+	// anonymized below.
+	clientIP, _ := netutil.IPToAddrNoMapped(ip)
+
 	s.serverLock.RLock()
 	defer s.serverLock.RUnlock()
 
@@ -45,7 +60,7 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 	// stopped, but its workers haven't yet exited.
 	if shouldLog &&
 		s.queryLog != nil &&
-		s.queryLog.ShouldLog(host, q.Qtype, q.Qclass) {
+		s.queryLog.ShouldLog(host, q.Qtype, q.Qclass, clientIP) {
 		s.logQuery(dctx, pctx, elapsed, ip)
 	} else {
 		log.Debug(
@@ -56,13 +71,82 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 		)
 	}
 
-	if s.stats != nil && s.stats.ShouldCount(host, q.Qtype, q.Qclass) {
-		s.updateStats(dctx, elapsed, *dctx.result, ip)
+	s.logSlowQuery(dctx, elapsed, ip)
+
+	if s.stats != nil && s.stats.ShouldCount(host, q.Qtype, q.Qclass, clientIP) {
+		upsErr := stats.UpstreamErrNone
+		if res := pctx.Res; dctx.responseFromUpstream && res != nil && res.Rcode == dns.RcodeServerFailure {
+			upsErr = stats.UpstreamErrServFail
+		}
+
+		s.updateStats(dctx, elapsed, *dctx.result, ip, upsErr)
 	}
 
 	return resultCodeSuccess
 }
 
+// countUpstreamFailure writes the request which couldn't be resolved because
+// of the upstream error err into statistics.
+func (s *Server) countUpstreamFailure(dctx *dnsContext, err error) {
+	if isLoggingIgnored(dctx) {
+		return
+	}
+
+	pctx := dctx.proxyCtx
+	q := pctx.Req.Question[0]
+	host := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+
+	ip, _ := netutil.IPAndPortFromAddr(pctx.Addr)
+	ip = slices.Clone(ip)
+	clientIP, _ := netutil.IPToAddrNoMapped(ip)
+
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
+	if s.stats == nil || !s.stats.ShouldCount(host, q.Qtype, q.Qclass, clientIP) {
+		return
+	}
+
+	s.anonymizer.Load()(ip)
+
+	s.updateStats(dctx, time.Since(dctx.startTime), *dctx.result, ip, upstreamErrorKind(err))
+}
+
+// isLoggingIgnored returns true if the settings of the client of the request
+// exclude it from the query log and the statistics.
+func isLoggingIgnored(dctx *dnsContext) (ok bool) {
+	return dctx.setts != nil && dctx.setts.IgnoreLogging
+}
+
+// upstreamErrorKind returns the kind of the upstream error err for statistics.
+func upstreamErrorKind(err error) (kind stats.UpstreamError) {
+	var (
+		netErr     net.Error
+		recHdrErr  tls.RecordHeaderError
+		authErr    x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+	)
+
+	switch {
+	case
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return stats.UpstreamErrTimeout
+	case
+		errors.As(err, &recHdrErr),
+		errors.As(err, &authErr),
+		errors.As(err, &hostErr),
+		errors.As(err, &invalidErr),
+		// The TLS alerts have no exported type, so check the message.
+		strings.Contains(err.Error(), "tls: "):
+		return stats.UpstreamErrTLS
+	default:
+		return stats.UpstreamErrOther
+	}
+}
+
 // logQuery pushes the request details into the query log.
 func (s *Server) logQuery(
 	dctx *dnsContext,
@@ -111,6 +195,7 @@ func (s *Server) updateStats(
 	elapsed time.Duration,
 	res filtering.Result,
 	clientIP net.IP,
+	upsErr stats.UpstreamError,
 ) {
 	pctx := ctx.proxyCtx
 	e := stats.Entry{}
@@ -125,6 +210,8 @@ func (s *Server) updateStats(
 
 	e.Time = uint32(elapsed / 1000)
 	e.Result = stats.RNotFiltered
+	e.UpstreamError = upsErr
+	e.ServedStale = ctx.servedStale
 
 	switch res.Reason {
 	case filtering.FilteredSafeBrowsing:
@@ -135,7 +222,9 @@ func (s *Server) updateStats(
 		e.Result = stats.RSafeSearch
 	case filtering.FilteredBlockList,
 		filtering.FilteredInvalid,
-		filtering.FilteredBlockedService:
+		filtering.FilteredBlockedService,
+		filtering.FilteredDefaultDeny,
+		filtering.FilteredRebinding:
 		e.Result = stats.RFiltered
 	}
 
@@ -1,7 +1,12 @@
 package dnsforward
 
 import (
+	"context"
+	"crypto/x509"
+	"fmt"
 	"net"
+	"net/netip"
+	"os"
 	"testing"
 	"time"
 
@@ -11,6 +16,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -31,7 +37,7 @@ func (l *testQueryLog) Add(p *querylog.AddParams) {
 }
 
 // ShouldLog implements the [querylog.QueryLog] interface for *testQueryLog.
-func (l *testQueryLog) ShouldLog(string, uint16, uint16) bool {
+func (l *testQueryLog) ShouldLog(string, uint16, uint16, netip.Addr) bool {
 	return true
 }
 
@@ -50,7 +56,7 @@ func (l *testStats) Update(e stats.Entry) {
 }
 
 // ShouldCount implements the [stats.Interface] interface for *testStats.
-func (l *testStats) ShouldCount(string, uint16, uint16) bool {
+func (l *testStats) ShouldCount(string, uint16, uint16, netip.Addr) bool {
 	return true
 }
 
@@ -208,3 +214,92 @@ func TestProcessQueryLogsAndStats(t *testing.T) {
 		})
 	}
 }
+
+func TestUpstreamErrorKind(t *testing.T) {
+	testCases := []struct {
+		err  error
+		name string
+		want stats.UpstreamError
+	}{{
+		err:  os.ErrDeadlineExceeded,
+		name: "deadline",
+		want: stats.UpstreamErrTimeout,
+	}, {
+		err:  fmt.Errorf("exchanging: %w", context.DeadlineExceeded),
+		name: "context_deadline",
+		want: stats.UpstreamErrTimeout,
+	}, {
+		err:  errors.List("all upstreams failed", x509.UnknownAuthorityError{}),
+		name: "unknown_authority",
+		want: stats.UpstreamErrTLS,
+	}, {
+		err:  errors.Error("remote error: tls: handshake failure"),
+		name: "tls_alert",
+		want: stats.UpstreamErrTLS,
+	}, {
+		err:  errors.Error("connection refused"),
+		name: "other",
+		want: stats.UpstreamErrOther,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, upstreamErrorKind(tc.err))
+		})
+	}
+}
+
+func TestServer_countUpstreamFailure(t *testing.T) {
+	st := &testStats{}
+	srv := &Server{
+		stats:      st,
+		anonymizer: aghnet.NewIPMut(nil),
+	}
+
+	dctx := &dnsContext{
+		proxyCtx: &proxy.DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion("Example.com.", dns.TypeA),
+			Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 1234},
+		},
+		startTime: time.Now(),
+		result:    &filtering.Result{},
+	}
+
+	srv.countUpstreamFailure(dctx, os.ErrDeadlineExceeded)
+
+	assert.Equal(t, "example.com", st.lastEntry.Domain)
+	assert.Equal(t, "1.2.3.4", st.lastEntry.Client)
+	assert.Equal(t, stats.RNotFiltered, st.lastEntry.Result)
+	assert.Equal(t, stats.UpstreamErrTimeout, st.lastEntry.UpstreamError)
+}
+
+func TestServer_processQueryLogsAndStats_ignoreLogging(t *testing.T) {
+	ql := &testQueryLog{}
+	st := &testStats{}
+	srv := &Server{
+		queryLog:   ql,
+		stats:      st,
+		anonymizer: aghnet.NewIPMut(nil),
+	}
+
+	dctx := &dnsContext{
+		proxyCtx: &proxy.DNSContext{
+			Req:  (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA),
+			Res:  &dns.Msg{},
+			Addr: &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 1234},
+		},
+		setts: &filtering.Settings{
+			IgnoreLogging: true,
+		},
+		startTime: time.Now(),
+		result:    &filtering.Result{},
+	}
+
+	code := srv.processQueryLogsAndStats(dctx)
+	assert.Equal(t, resultCodeSuccess, code)
+
+	srv.countUpstreamFailure(dctx, os.ErrDeadlineExceeded)
+
+	assert.Nil(t, ql.lastParams)
+	assert.Equal(t, stats.Entry{}, st.lastEntry)
+}
@@ -0,0 +1,671 @@
+package dnsforward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/mathutil"
+	"github.com/miekg/dns"
+)
+
+// unixScheme is the URL scheme of the upstreams listening on Unix domain
+// sockets, for example "unix:///var/run/unbound.sock".
+const unixScheme = "unix"
+
+// errPipeClosed is returned when the pipelined connection to the upstream is
+// closed before receiving the response.
+const errPipeClosed errors.Error = "pipelined connection closed"
+
+// streamConf is the configuration of the connections of a *streamUpstream.
+type streamConf struct {
+	// idleTimeout is the time after which an unused pipelined connection is
+	// closed.  Zero means never.
+	idleTimeout time.Duration
+
+	// maxConns is the maximum number of pipelined connections.  Zero means
+	// one.
+	maxConns uint32
+
+	// pipelining, if true, enables reusing the connections and pipelining the
+	// queries.
+	pipelining bool
+
+	// bind defines the local address and the network interface of the TCP
+	// connections.
+	bind *upstreamBind
+
+	// proxy is the SOCKS5 proxy the queries are sent through, if any.  It's
+	// ignored for the Unix domain socket upstreams.
+	proxy *upstreamProxy
+}
+
+// streamUpstream is an upstream.Upstream using a stream connection, either TCP
+// or a Unix domain socket, with the messages prefixed with their length.  When
+// pipelining is enabled, it reuses a few connections for all the queries and
+// sends them without waiting for the previous responses.
+type streamUpstream struct {
+	// mu protects conns and closed.
+	mu *sync.Mutex
+
+	// conns are the current pipelined connections.  It's empty if there are
+	// no connections yet or pipelining is disabled.
+	conns []*pipelinedConn
+
+	// addr is the address of the upstream as configured.
+	addr string
+
+	// network is the network to dial, either "tcp" or "unix".
+	network string
+
+	// dialAddr is the address to dial.
+	dialAddr string
+
+	// bind defines the local address and the network interface of the
+	// connections.  It's nil for the Unix domain socket upstreams.
+	bind *upstreamBind
+
+	// timeout is the timeout of a single query.
+	timeout time.Duration
+
+	// idleTimeout is the time after which an unused pipelined connection is
+	// closed.  Zero means never.
+	idleTimeout time.Duration
+
+	// maxConns is the maximum number of pipelined connections.  It's at least
+	// one.
+	maxConns int
+
+	// pipelining, if true, enables reusing the connections and pipelining the
+	// queries.
+	pipelining bool
+
+	// closed is true if the upstream is closed.
+	closed bool
+}
+
+// type check
+var _ upstream.Upstream = (*streamUpstream)(nil)
+
+// newStreamUpstream returns a new *streamUpstream for addr, if it's a Unix
+// domain socket upstream or if it's a plain TCP upstream with an IP address and
+// pipelining is enabled.  Otherwise it returns nil and no error.
+func newStreamUpstream(
+	addr string,
+	timeout time.Duration,
+	conf streamConf,
+) (u *streamUpstream, err error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	u = &streamUpstream{
+		mu:          &sync.Mutex{},
+		addr:        addr,
+		timeout:     timeout,
+		idleTimeout: conf.idleTimeout,
+		maxConns:    mathutil.Max(int(conf.maxConns), 1),
+		pipelining:  conf.pipelining,
+	}
+
+	pipelining := conf.pipelining
+
+	switch {
+	case strings.HasPrefix(addr, unixScheme+"://"):
+		var uu *url.URL
+		uu, err = url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing unix upstream: %w", err)
+		} else if uu.Host != "" || !filepath.IsAbs(uu.Path) {
+			return nil, fmt.Errorf("unix upstream %q: want absolute path", addr)
+		}
+
+		u.network, u.dialAddr = unixScheme, uu.Path
+	case pipelining && strings.HasPrefix(addr, "tcp://"):
+		hostPort := strings.TrimPrefix(addr, "tcp://")
+		var ap netip.AddrPort
+		if ap, err = netip.ParseAddrPort(hostPort); err == nil {
+			u.dialAddr = ap.String()
+		} else if ip, ipErr := netip.ParseAddr(hostPort); ipErr == nil {
+			ap = netip.AddrPortFrom(ip, 53)
+			u.dialAddr = ap.String()
+		} else {
+			// Hostnames require bootstrapping, so leave them to dnsproxy.
+			return nil, nil
+		}
+
+		err = conf.bind.checkUpstreamAddr(ap.Addr())
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", addr, err)
+		}
+
+		u.network, u.bind = "tcp", conf.bind
+	default:
+		return nil, nil
+	}
+
+	return u, nil
+}
+
+// addressToUpstream is a wrapper around [upstream.AddressToUpstream] which also
+// supports the Unix domain socket upstreams, pipelining of TCP queries with the
+// settings from pool, and the upstream policies, see [newCustomUpstream].
+// pool may be nil.
+func addressToUpstream(
+	addr string,
+	opts *upstream.Options,
+	pool *UpstreamPool,
+) (u upstream.Upstream, err error) {
+	u, err = newCustomUpstream(addr, opts, pool)
+	if err != nil || u != nil {
+		return u, err
+	}
+
+	return upstream.AddressToUpstream(addr, opts)
+}
+
+// ParseUpstreamsConfig is a wrapper around [proxy.ParseUpstreamsConfig] which
+// also supports the Unix domain socket upstreams, the upstream policies, and
+// the connection settings of pool, see [addressToUpstream] and
+// [UpstreamPool.wrapConfig].  pool may be nil.
+func ParseUpstreamsConfig(
+	upstreams []string,
+	opts *upstream.Options,
+	pool *UpstreamPool,
+) (conf *proxy.UpstreamConfig, err error) {
+	// Replace the addresses dnsproxy doesn't support with placeholders and
+	// substitute the actual upstreams after parsing, so that the handling of
+	// domain-specific upstreams stays the same.
+	var placeholders map[string]upstream.Upstream
+	lines := make([]string, len(upstreams))
+	for i, line := range upstreams {
+		lines[i] = line
+
+		addr, _, sepErr := separateUpstream(line)
+		if sepErr != nil {
+			// Let dnsproxy report the error.
+			continue
+		}
+
+		var u upstream.Upstream
+		u, err = newCustomUpstream(addr, opts, pool)
+		if err != nil {
+			return nil, fmt.Errorf("upstream at index %d: %w", i, err)
+		} else if u == nil {
+			continue
+		}
+
+		if placeholders == nil {
+			placeholders = map[string]upstream.Upstream{}
+		}
+
+		ph := fmt.Sprintf("tcp://custom-%d.upstream.invalid:53", i)
+		placeholders[ph] = u
+		lines[i] = line[:len(line)-len(addr)] + ph
+	}
+
+	conf, err = proxy.ParseUpstreamsConfig(lines, opts)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	if placeholders != nil {
+		replacePlaceholders(conf.Upstreams, placeholders)
+		for _, m := range []map[string][]upstream.Upstream{
+			conf.DomainReservedUpstreams,
+			conf.SpecifiedDomainUpstreams,
+		} {
+			for _, ups := range m {
+				replacePlaceholders(ups, placeholders)
+			}
+		}
+	}
+
+	pool.wrapConfig(conf)
+
+	return conf, nil
+}
+
+// replacePlaceholders replaces the placeholder upstreams in ups with the
+// actual ones from placeholders.
+func replacePlaceholders(ups []upstream.Upstream, placeholders map[string]upstream.Upstream) {
+	for i, u := range ups {
+		if actual, ok := placeholders[u.Address()]; ok {
+			ups[i] = actual
+		}
+	}
+}
+
+// Address implements the [upstream.Upstream] interface for *streamUpstream.
+func (u *streamUpstream) Address() (addr string) {
+	return u.addr
+}
+
+// Exchange implements the [upstream.Upstream] interface for *streamUpstream.
+func (u *streamUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if !u.pipelining {
+		return u.exchangeOnce(req)
+	}
+
+	for {
+		var pc *pipelinedConn
+		var fresh bool
+		pc, fresh, err = u.pipelinedConn()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err = pc.exchange(req, u.timeout)
+		pc.done()
+		if err == nil {
+			return resp, nil
+		} else if !errors.Is(err, errPipeClosed) {
+			// The connection is still fine, for example the upstream is just
+			// slow to answer this query, so keep it for the other ones.
+			return nil, fmt.Errorf("exchanging with %s: %w", u.addr, err)
+		}
+
+		u.dropConn(pc)
+
+		// Retry on a new connection if the reused one is closed by the
+		// upstream in the meantime.
+		if fresh {
+			return nil, fmt.Errorf("exchanging with %s: %w", u.addr, err)
+		}
+	}
+}
+
+// exchangeOnce dials a new connection to the upstream, exchanges req over it,
+// and closes it.
+func (u *streamUpstream) exchangeOnce(req *dns.Msg) (resp *dns.Msg, err error) {
+	conn, err := u.bind.dialer(u.network, u.timeout).Dial(u.network, u.dialAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s: %w", u.addr, err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	err = conn.SetDeadline(time.Now().Add(u.timeout))
+	if err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	dc := &dns.Conn{Conn: conn}
+	err = dc.WriteMsg(req)
+	if err != nil {
+		return nil, fmt.Errorf("writing to %s: %w", u.addr, err)
+	}
+
+	resp, err = dc.ReadMsg()
+	if err != nil {
+		return nil, fmt.Errorf("reading from %s: %w", u.addr, err)
+	} else if resp.Id != req.Id {
+		return nil, dns.ErrId
+	}
+
+	return resp, nil
+}
+
+// pipelinedConn returns the least loaded pipelined connection or dials a new
+// one, if all the current ones are busy and there are less than u.maxConns of
+// them.  fresh is true if the connection has just been dialed.  The caller
+// must call [pipelinedConn.done] on pc when it's done with the query.
+func (u *streamUpstream) pipelinedConn() (pc *pipelinedConn, fresh bool, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return nil, false, net.ErrClosed
+	}
+
+	u.removeBrokenLocked()
+
+	load := 0
+	for _, c := range u.conns {
+		if l := c.load(); pc == nil || l < load {
+			pc, load = c, l
+		}
+	}
+
+	if pc != nil && (load == 0 || len(u.conns) >= u.maxConns) {
+		pc.acquire()
+
+		return pc, false, nil
+	}
+
+	conn, err := u.bind.dialer(u.network, u.timeout).Dial(u.network, u.dialAddr)
+	if err != nil {
+		return nil, false, fmt.Errorf("dialing %s: %w", u.addr, err)
+	}
+
+	log.Debug("dnsforward: opened pipelined connection to %s", u.addr)
+
+	pc = newPipelinedConn(conn, u.idleTimeout)
+	pc.acquire()
+	u.conns = append(u.conns, pc)
+
+	return pc, true, nil
+}
+
+// removeBrokenLocked removes the broken connections, including the ones closed
+// due to being idle, from u.conns.  u.mu must be locked.
+func (u *streamUpstream) removeBrokenLocked() {
+	live := u.conns[:0]
+	for _, c := range u.conns {
+		if !c.isBroken() {
+			live = append(live, c)
+		}
+	}
+
+	// Don't keep the references to the removed connections.
+	for i := len(live); i < len(u.conns); i++ {
+		u.conns[i] = nil
+	}
+
+	u.conns = live
+}
+
+// openConns returns the number of the open pipelined connections.
+func (u *streamUpstream) openConns() (n int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.removeBrokenLocked()
+
+	return len(u.conns)
+}
+
+// dropConn closes pc and forgets it.
+func (u *streamUpstream) dropConn(pc *pipelinedConn) {
+	pc.fail(errPipeClosed)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.removeBrokenLocked()
+}
+
+// Close implements the [upstream.Upstream] interface for *streamUpstream.
+func (u *streamUpstream) Close() (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+	for _, c := range u.conns {
+		c.fail(errPipeClosed)
+	}
+
+	u.conns = nil
+
+	return nil
+}
+
+// pipelinedConn is a connection to an upstream which allows sending several
+// queries without waiting for the responses.  The queries get unique IDs
+// within the connection, and the responses are matched to them by the IDs,
+// since they may arrive out of order.
+type pipelinedConn struct {
+	// conn is the underlying connection.
+	conn *dns.Conn
+
+	// writeMu serializes writing to conn.
+	writeMu *sync.Mutex
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// pending are the channels awaiting the responses by the IDs of the
+	// queries.
+	pending map[uint16]chan *dns.Msg
+
+	// err is the error which broke the connection, if any.
+	err error
+
+	// idleTimer closes the connection when it's been unused for idleTimeout.
+	// It's nil if there are pending queries or idleTimeout is zero.
+	idleTimer *time.Timer
+
+	// idleTimeout is the time after which an unused connection is closed.
+	// Zero means never.
+	idleTimeout time.Duration
+
+	// users is the number of the queries which have chosen the connection,
+	// including the ones which haven't been sent yet.
+	users int
+
+	// nextID is the ID to try for the next query.
+	nextID uint16
+}
+
+// newPipelinedConn returns a new *pipelinedConn over conn and starts reading
+// the responses from it.  The connection is closed after being unused for
+// idleTimeout, unless it's zero.
+func newPipelinedConn(conn net.Conn, idleTimeout time.Duration) (pc *pipelinedConn) {
+	pc = &pipelinedConn{
+		conn:        &dns.Conn{Conn: conn},
+		writeMu:     &sync.Mutex{},
+		mu:          &sync.Mutex{},
+		pending:     map[uint16]chan *dns.Msg{},
+		idleTimeout: idleTimeout,
+	}
+
+	go pc.readLoop()
+
+	return pc
+}
+
+// readLoop reads the responses from the connection and passes them to the
+// pending queries until the connection breaks.  It's intended to be used as a
+// goroutine.
+func (pc *pipelinedConn) readLoop() {
+	defer log.OnPanic("dnsforward: reading pipelined conn")
+
+	for {
+		resp, err := pc.conn.ReadMsg()
+		if err != nil {
+			log.Debug("dnsforward: reading pipelined conn: %s", err)
+			pc.fail(errPipeClosed)
+
+			return
+		}
+
+		pc.mu.Lock()
+		ch, ok := pc.pending[resp.Id]
+		delete(pc.pending, resp.Id)
+		pc.mu.Unlock()
+
+		if ok {
+			ch <- resp
+		} else {
+			log.Debug("dnsforward: pipelined conn: unexpected response id %d", resp.Id)
+		}
+	}
+}
+
+// register returns a new unique ID for a query and the channel to receive the
+// response to it.
+func (pc *pipelinedConn) register() (id uint16, ch chan *dns.Msg, err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.err != nil {
+		return 0, nil, pc.err
+	} else if len(pc.pending) > int(^uint16(0)) {
+		return 0, nil, errors.Error("too many pending queries")
+	}
+
+	for {
+		id = pc.nextID
+		pc.nextID++
+		if _, ok := pc.pending[id]; !ok {
+			break
+		}
+	}
+
+	ch = make(chan *dns.Msg, 1)
+	pc.pending[id] = ch
+
+	if pc.idleTimer != nil {
+		pc.idleTimer.Stop()
+		pc.idleTimer = nil
+	}
+
+	return id, ch, nil
+}
+
+// release releases the ID of a finished query and starts the idle timer, if
+// there are no more pending queries.
+func (pc *pipelinedConn) release(id uint16) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	delete(pc.pending, id)
+	if pc.err == nil && pc.idleTimeout > 0 && len(pc.pending) == 0 {
+		pc.idleTimer = time.AfterFunc(pc.idleTimeout, pc.closeIdle)
+	}
+}
+
+// closeIdle closes the connection, if it has no pending queries.  It's
+// intended to be used with [time.AfterFunc].
+func (pc *pipelinedConn) closeIdle() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if len(pc.pending) == 0 {
+		log.Debug("dnsforward: closing idle pipelined conn")
+
+		pc.failLocked(errPipeClosed)
+	}
+}
+
+// acquire accounts a new query, which has chosen the connection.
+func (pc *pipelinedConn) acquire() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.users++
+}
+
+// done accounts the end of a query previously accounted by
+// [pipelinedConn.acquire].
+func (pc *pipelinedConn) done() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.users--
+}
+
+// load returns the number of the queries using the connection.
+func (pc *pipelinedConn) load() (n int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.users
+}
+
+// isBroken returns true if the connection is broken or closed.
+func (pc *pipelinedConn) isBroken() (ok bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.err != nil
+}
+
+// exchange sends req over the connection and waits for the response at most
+// for timeout.  The ID of the query is released when it's done, so a late
+// response to a timed out query is ignored.  err is errPipeClosed only if the
+// connection is broken.
+func (pc *pipelinedConn) exchange(req *dns.Msg, timeout time.Duration) (resp *dns.Msg, err error) {
+	id, ch, err := pc.register()
+	if err != nil {
+		return nil, err
+	}
+
+	defer pc.release(id)
+
+	msg := req.Copy()
+	msg.Id = id
+
+	err = pc.write(msg, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case resp = <-ch:
+		if resp == nil {
+			return nil, errPipeClosed
+		}
+
+		resp.Id = req.Id
+
+		return resp, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("waiting for response: %w", context.DeadlineExceeded)
+	}
+}
+
+// write writes msg to the connection.
+func (pc *pipelinedConn) write(msg *dns.Msg, timeout time.Duration) (err error) {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+
+	err = pc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err == nil {
+		err = pc.conn.WriteMsg(msg)
+	}
+
+	if err != nil {
+		log.Debug("dnsforward: writing to pipelined conn: %s", err)
+
+		return errPipeClosed
+	}
+
+	return nil
+}
+
+// fail marks the connection as broken with err, closes it, and wakes up the
+// pending queries.
+func (pc *pipelinedConn) fail(err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.failLocked(err)
+}
+
+// failLocked is like [pipelinedConn.fail] but requires pc.mu to be locked.
+func (pc *pipelinedConn) failLocked(err error) {
+	if pc.err != nil {
+		return
+	}
+
+	if pc.idleTimer != nil {
+		pc.idleTimer.Stop()
+		pc.idleTimer = nil
+	}
+
+	pc.err = err
+	for _, ch := range pc.pending {
+		close(ch)
+	}
+
+	pc.pending = nil
+
+	closeErr := pc.conn.Close()
+	if closeErr != nil {
+		log.Debug("dnsforward: closing pipelined conn: %s", closeErr)
+	}
+}
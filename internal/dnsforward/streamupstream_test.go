@@ -0,0 +1,263 @@
+package dnsforward
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startStreamServer starts a DNS server on a stream listener of network and
+// returns its address.  The server answers each query with a single A record.
+func startStreamServer(t *testing.T, network, addr string) (listenAddr string) {
+	t.Helper()
+
+	l, err := net.Listen(network, addr)
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+				},
+				A: net.IP{1, 2, 3, 4},
+			}}
+
+			_ = w.WriteMsg(resp)
+		}),
+	}
+
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	return l.Addr().String()
+}
+
+func TestStreamUpstream_Exchange(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "dns.sock")
+	startStreamServer(t, "unix", sockPath)
+	tcpAddr := startStreamServer(t, "tcp", "127.0.0.1:0")
+
+	testCases := []struct {
+		name       string
+		addr       string
+		pipelining bool
+	}{{
+		name:       "unix",
+		addr:       "unix://" + sockPath,
+		pipelining: false,
+	}, {
+		name:       "unix_pipelining",
+		addr:       "unix://" + sockPath,
+		pipelining: true,
+	}, {
+		name:       "tcp_pipelining",
+		addr:       "tcp://" + tcpAddr,
+		pipelining: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := newStreamUpstream(tc.addr, time.Second, streamConf{pipelining: tc.pipelining})
+			require.NoError(t, err)
+			require.NotNil(t, u)
+
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			assert.Equal(t, tc.addr, u.Address())
+
+			const n = 10
+
+			wg := &sync.WaitGroup{}
+			wg.Add(n)
+			for i := 0; i < n; i++ {
+				go func() {
+					defer wg.Done()
+
+					req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+					resp, exErr := u.Exchange(req)
+					if assert.NoError(t, exErr) {
+						assert.Equal(t, req.Id, resp.Id)
+						assert.Len(t, resp.Answer, 1)
+					}
+				}()
+			}
+
+			wg.Wait()
+		})
+	}
+}
+
+func TestStreamUpstream_Exchange_timeout(t *testing.T) {
+	const slowName = "slow.example."
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	var conns int32
+	slowRecv := make(chan struct{}, 1)
+	go func() {
+		for {
+			c, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			atomic.AddInt32(&conns, 1)
+			t.Cleanup(func() { _ = c.Close() })
+
+			// Answer all the queries except the slow one, which is never
+			// answered.
+			go func() {
+				dc := &dns.Conn{Conn: c}
+				for {
+					req, readErr := dc.ReadMsg()
+					if readErr != nil {
+						return
+					}
+
+					if req.Question[0].Name == slowName {
+						slowRecv <- struct{}{}
+
+						continue
+					}
+
+					_ = dc.WriteMsg((&dns.Msg{}).SetReply(req))
+				}
+			}()
+		}
+	}()
+
+	u, err := newStreamUpstream(
+		"tcp://"+l.Addr().String(),
+		500*time.Millisecond,
+		streamConf{pipelining: true},
+	)
+	require.NoError(t, err)
+	require.NotNil(t, u)
+
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	slowErr := make(chan error, 1)
+	go func() {
+		_, exErr := u.Exchange((&dns.Msg{}).SetQuestion(slowName, dns.TypeA))
+		slowErr <- exErr
+	}()
+
+	<-slowRecv
+
+	// The fast query is answered while the slow one is still pending.
+	req := (&dns.Msg{}).SetQuestion("fast.example.", dns.TypeA)
+	resp, err := u.Exchange(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, req.Id, resp.Id)
+
+	err = <-slowErr
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The timeout of the slow query must not close the connection.
+	req = (&dns.Msg{}).SetQuestion("fast.example.", dns.TypeA)
+	resp, err = u.Exchange(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, req.Id, resp.Id)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+}
+
+func TestNewStreamUpstream(t *testing.T) {
+	testCases := []struct {
+		name       string
+		addr       string
+		wantErrMsg string
+		pipelining bool
+		wantNil    bool
+	}{{
+		name:       "unix",
+		addr:       "unix:///var/run/dns.sock",
+		wantErrMsg: "",
+		pipelining: false,
+		wantNil:    false,
+	}, {
+		name:       "unix_relative",
+		addr:       "unix://dns.sock",
+		wantErrMsg: `unix upstream "unix://dns.sock": want absolute path`,
+		pipelining: false,
+		wantNil:    true,
+	}, {
+		name:       "tcp_no_pipelining",
+		addr:       "tcp://1.2.3.4",
+		wantErrMsg: "",
+		pipelining: false,
+		wantNil:    true,
+	}, {
+		name:       "tcp_pipelining",
+		addr:       "tcp://1.2.3.4",
+		wantErrMsg: "",
+		pipelining: true,
+		wantNil:    false,
+	}, {
+		name:       "tcp_hostname",
+		addr:       "tcp://dns.example",
+		wantErrMsg: "",
+		pipelining: true,
+		wantNil:    true,
+	}, {
+		name:       "udp",
+		addr:       "udp://1.2.3.4",
+		wantErrMsg: "",
+		pipelining: true,
+		wantNil:    true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := newStreamUpstream(tc.addr, 0, streamConf{pipelining: tc.pipelining})
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantNil, u == nil)
+		})
+	}
+}
+
+func TestParseUpstreamsConfig_stream(t *testing.T) {
+	pool := newUpstreamPool()
+	err := pool.setConfig(UpstreamPoolConfig{}, true)
+	require.NoError(t, err)
+
+	conf, err := ParseUpstreamsConfig([]string{
+		"unix:///var/run/dns.sock",
+		"[/example.org/]unix:///var/run/dns.sock",
+		"tcp://1.2.3.4",
+	}, &upstream.Options{}, pool)
+	require.NoError(t, err)
+
+	require.Len(t, conf.Upstreams, 2)
+	assert.Equal(t, "unix:///var/run/dns.sock", conf.Upstreams[0].Address())
+	assert.Equal(t, "tcp://1.2.3.4", conf.Upstreams[1].Address())
+
+	ups := conf.DomainReservedUpstreams["example.org."]
+	require.Len(t, ups, 1)
+
+	require.IsType(t, (*pooledUpstream)(nil), ups[0])
+	assert.IsType(t, (*streamUpstream)(nil), ups[0].(*pooledUpstream).Upstream)
+}
@@ -0,0 +1,226 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// TemporaryAccessClient is a client allowed to use the DNS server until a
+// certain time.
+type TemporaryAccessClient struct {
+	// Expires is the time since which the entry is ignored.
+	Expires time.Time `yaml:"expires" json:"expires"`
+
+	// Client is the IP address, CIDR network, or ClientID of the client.
+	Client string `yaml:"client" json:"client"`
+}
+
+// unexpiredTemporaryClients returns the copies of the entries from clients,
+// which haven't expired at now.
+func unexpiredTemporaryClients(
+	clients []*TemporaryAccessClient,
+	now time.Time,
+) (unexpired []*TemporaryAccessClient) {
+	for _, c := range clients {
+		if c != nil && now.Before(c.Expires) {
+			unexpired = append(unexpired, &TemporaryAccessClient{
+				Expires: c.Expires,
+				Client:  c.Client,
+			})
+		}
+	}
+
+	return unexpired
+}
+
+// temporaryAccess is a parsed [TemporaryAccessClient].
+type temporaryAccess struct {
+	// expires is the time since which the entry is ignored.
+	expires time.Time
+
+	// clientID is the ClientID of the client.  It's empty if the entry is
+	// defined by an IP address or a network.
+	clientID string
+
+	// prefix is the network of the client.  It's a single-address network if
+	// the entry is defined by an IP address, and it's unset if clientID is
+	// not empty.
+	prefix netip.Prefix
+}
+
+// newTemporaryAccess parses c.  c must not be nil.
+func newTemporaryAccess(c *TemporaryAccessClient) (t *temporaryAccess, err error) {
+	if c.Expires.IsZero() {
+		return nil, errors.Error("no expiration time")
+	}
+
+	t = &temporaryAccess{
+		expires: c.Expires,
+	}
+
+	if ip, ipErr := netip.ParseAddr(c.Client); ipErr == nil {
+		t.prefix = netip.PrefixFrom(ip, ip.BitLen())
+	} else if t.prefix, err = netip.ParsePrefix(c.Client); err != nil {
+		err = ValidateClientID(c.Client)
+		if err != nil {
+			return nil, errors.Error("bad ip, cidr, or clientid")
+		}
+
+		t.clientID = c.Client
+	}
+
+	return t, nil
+}
+
+// newTemporaryAccesses parses clients.
+func newTemporaryAccesses(clients []*TemporaryAccessClient) (ts []*temporaryAccess, err error) {
+	ts = make([]*temporaryAccess, 0, len(clients))
+	for i, c := range clients {
+		if c == nil {
+			return nil, fmt.Errorf("value at index %d: nil entry", i)
+		}
+
+		var t *temporaryAccess
+		t, err = newTemporaryAccess(c)
+		if err != nil {
+			return nil, fmt.Errorf("value %q at index %d: %w", c.Client, i, err)
+		}
+
+		ts = append(ts, t)
+	}
+
+	return ts, nil
+}
+
+// allows returns true if t hasn't expired at now and matches the client with
+// ip and clientID.  ip may be unset.
+func (t *temporaryAccess) allows(ip netip.Addr, clientID string, now time.Time) (ok bool) {
+	if !now.Before(t.expires) {
+		return false
+	}
+
+	if t.clientID != "" {
+		return t.clientID == clientID
+	}
+
+	return ip.IsValid() && t.prefix.Contains(ip)
+}
+
+// temporaryAccessReq is the request for the POST
+// /control/access/temporary/add and /control/access/temporary/remove HTTP
+// APIs.
+type temporaryAccessReq struct {
+	// Client is the IP address, CIDR network, or ClientID of the client.
+	Client string `json:"client"`
+
+	// Duration is the duration during which the client is allowed.  It's
+	// ignored when removing the entry.
+	Duration timeutil.Duration `json:"duration"`
+}
+
+// handleTemporaryAccessAdd is the handler for the POST
+// /control/access/temporary/add HTTP API.  It allows the client for the
+// requested duration, replacing its previous temporary entry, if any.
+func (s *Server) handleTemporaryAccessAdd(w http.ResponseWriter, r *http.Request) {
+	req := &temporaryAccessReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	if req.Duration.Duration <= 0 {
+		aghhttp.Error(r, w, http.StatusBadRequest, "duration must be positive")
+
+		return
+	}
+
+	c := &TemporaryAccessClient{
+		Expires: time.Now().Add(req.Duration.Duration),
+		Client:  req.Client,
+	}
+
+	_, err = newTemporaryAccess(c)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "client %q: %s", req.Client, err)
+
+		return
+	}
+
+	s.setTemporaryAccess(c.Client, c)
+	s.conf.ConfigModified()
+
+	log.Debug("access: allowed %q until %s", c.Client, c.Expires)
+}
+
+// handleTemporaryAccessRemove is the handler for the POST
+// /control/access/temporary/remove HTTP API.
+func (s *Server) handleTemporaryAccessRemove(w http.ResponseWriter, r *http.Request) {
+	req := &temporaryAccessReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	if !s.setTemporaryAccess(req.Client, nil) {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no temporary entry for client %q", req.Client)
+
+		return
+	}
+
+	s.conf.ConfigModified()
+
+	log.Debug("access: removed temporary entry for %q", req.Client)
+}
+
+// setTemporaryAccess removes the unexpired temporary entry for client, if any,
+// adds c, if it's not nil, and applies the result.  It also removes the expired
+// entries.  found is true if there was an unexpired entry for client.  c must
+// be valid.
+func (s *Server) setTemporaryAccess(client string, c *TemporaryAccessClient) (found bool) {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+
+	prev := unexpiredTemporaryClients(s.conf.TemporaryAllowedClients, time.Now())
+	clients := make([]*TemporaryAccessClient, 0, len(prev)+1)
+	for _, p := range prev {
+		if p.Client == client {
+			found = true
+		} else {
+			clients = append(clients, p)
+		}
+	}
+
+	if c != nil {
+		clients = append(clients, c)
+	}
+
+	ts, err := newTemporaryAccesses(clients)
+	if err != nil {
+		// Shouldn't happen, since the entries are validated.
+		log.Error("access: parsing temporary entries: %s", err)
+
+		return found
+	}
+
+	// Copy the access manager instead of modifying it, since accessManager
+	// values aren't changed after creation.
+	a := *s.access
+	a.temporary = ts
+
+	s.access = &a
+	s.conf.TemporaryAllowedClients = clients
+
+	return found
+}
@@ -0,0 +1,278 @@
+package dnsforward
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTemporaryAccesses(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		in         []*TemporaryAccessClient
+	}{{
+		name:       "empty",
+		wantErrMsg: "",
+		in:         nil,
+	}, {
+		name:       "valid",
+		wantErrMsg: "",
+		in: []*TemporaryAccessClient{{
+			Expires: expires,
+			Client:  "203.0.113.5",
+		}, {
+			Expires: expires,
+			Client:  "2001:db8::/32",
+		}, {
+			Expires: expires,
+			Client:  "client-1",
+		}},
+	}, {
+		name:       "nil",
+		wantErrMsg: "value at index 0: nil entry",
+		in:         []*TemporaryAccessClient{nil},
+	}, {
+		name:       "no_expires",
+		wantErrMsg: `value "203.0.113.5" at index 0: no expiration time`,
+		in: []*TemporaryAccessClient{{
+			Client: "203.0.113.5",
+		}},
+	}, {
+		name:       "bad_client",
+		wantErrMsg: `value "!!!" at index 0: bad ip, cidr, or clientid`,
+		in: []*TemporaryAccessClient{{
+			Expires: expires,
+			Client:  "!!!",
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts, err := newTemporaryAccesses(tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if err == nil {
+				assert.Len(t, ts, len(tc.in))
+			}
+		})
+	}
+}
+
+func TestAccessManager_isTemporarilyAllowed(t *testing.T) {
+	now := time.Now()
+
+	a, err := newAccessCtx(nil, nil, nil, []*TemporaryAccessClient{{
+		Expires: now.Add(time.Hour),
+		Client:  "203.0.113.5",
+	}, {
+		Expires: now.Add(time.Hour),
+		Client:  "198.51.100.0/24",
+	}, {
+		Expires: now.Add(time.Hour),
+		Client:  "client-1",
+	}, {
+		Expires: now.Add(-time.Hour),
+		Client:  "192.0.2.1",
+	}})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		ip       netip.Addr
+		want     assert.BoolAssertionFunc
+		name     string
+		clientID string
+	}{{
+		ip:       netip.MustParseAddr("203.0.113.5"),
+		want:     assert.True,
+		name:     "ip",
+		clientID: "",
+	}, {
+		ip:       netip.MustParseAddr("198.51.100.10"),
+		want:     assert.True,
+		name:     "cidr",
+		clientID: "",
+	}, {
+		ip:       netip.MustParseAddr("192.0.2.2"),
+		want:     assert.True,
+		name:     "clientid",
+		clientID: "client-1",
+	}, {
+		ip:       netip.Addr{},
+		want:     assert.True,
+		name:     "clientid_no_ip",
+		clientID: "client-1",
+	}, {
+		ip:       netip.MustParseAddr("192.0.2.1"),
+		want:     assert.False,
+		name:     "expired",
+		clientID: "",
+	}, {
+		ip:       netip.MustParseAddr("203.0.113.6"),
+		want:     assert.False,
+		name:     "no_match",
+		clientID: "client-2",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.want(t, a.isTemporarilyAllowed(tc.ip, tc.clientID, now))
+		})
+	}
+}
+
+func TestServer_IsBlockedClient_temporary(t *testing.T) {
+	const (
+		allowedID = "admin-laptop"
+		blockedIP = "203.0.113.5"
+	)
+
+	expires := time.Now().Add(time.Hour)
+	temporary := []*TemporaryAccessClient{{
+		Expires: expires,
+		Client:  blockedIP,
+	}, {
+		Expires: expires,
+		Client:  allowedID,
+	}}
+
+	ip := netip.MustParseAddr(blockedIP)
+	otherIP := netip.MustParseAddr("203.0.113.6")
+
+	t.Run("allowlist", func(t *testing.T) {
+		a, err := newAccessCtx([]string{"192.0.2.1"}, nil, nil, temporary)
+		require.NoError(t, err)
+
+		s := &Server{access: a}
+
+		blocked, _ := s.IsBlockedClient(ip, "")
+		assert.False(t, blocked)
+
+		blocked, _ = s.IsBlockedClient(otherIP, allowedID)
+		assert.False(t, blocked)
+
+		blocked, _ = s.IsBlockedClient(otherIP, "")
+		assert.True(t, blocked)
+	})
+
+	t.Run("blocklist", func(t *testing.T) {
+		a, err := newAccessCtx(nil, []string{blockedIP, "203.0.113.0/24"}, nil, temporary)
+		require.NoError(t, err)
+
+		s := &Server{access: a}
+
+		blocked, _ := s.IsBlockedClient(ip, "")
+		assert.False(t, blocked)
+
+		blocked, _ = s.IsBlockedClient(otherIP, "")
+		assert.True(t, blocked)
+	})
+}
+
+func TestServer_handleTemporaryAccess(t *testing.T) {
+	a, err := newAccessCtx([]string{"192.0.2.1"}, nil, nil, nil)
+	require.NoError(t, err)
+
+	modified := 0
+	s := &Server{
+		access: a,
+		conf: ServerConfig{
+			ConfigModified: func() { modified++ },
+		},
+	}
+
+	const client = "203.0.113.5"
+	ip := netip.MustParseAddr(client)
+
+	do := func(t *testing.T, h http.HandlerFunc, body string) (code int) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		return w.Code
+	}
+
+	t.Run("add_bad", func(t *testing.T) {
+		code := do(t, s.handleTemporaryAccessAdd, `{"client":"203.0.113.5","duration":"0s"}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code = do(t, s.handleTemporaryAccessAdd, `{"client":"!!!","duration":"24h"}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		assert.Zero(t, modified)
+	})
+
+	t.Run("add", func(t *testing.T) {
+		start := time.Now()
+		code := do(t, s.handleTemporaryAccessAdd, `{"client":"203.0.113.5","duration":"24h"}`)
+		require.Equal(t, http.StatusOK, code)
+
+		// Add it again to make sure that the entry is replaced.
+		code = do(t, s.handleTemporaryAccessAdd, `{"client":"203.0.113.5","duration":"48h"}`)
+		require.Equal(t, http.StatusOK, code)
+
+		assert.Equal(t, 2, modified)
+
+		blocked, _ := s.IsBlockedClient(ip, "")
+		assert.False(t, blocked)
+
+		w := httptest.NewRecorder()
+		s.handleAccessList(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &accessListRespJSON{}
+		err = json.NewDecoder(w.Body).Decode(resp)
+		require.NoError(t, err)
+
+		require.Len(t, resp.TemporaryAllowedClients, 1)
+
+		c := resp.TemporaryAllowedClients[0]
+		assert.Equal(t, client, c.Client)
+		assert.False(t, c.Expires.Before(start.Add(48*time.Hour)))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		code := do(t, s.handleTemporaryAccessRemove, `{"client":"203.0.113.5"}`)
+		require.Equal(t, http.StatusOK, code)
+
+		blocked, _ := s.IsBlockedClient(ip, "")
+		assert.True(t, blocked)
+
+		code = do(t, s.handleTemporaryAccessRemove, `{"client":"203.0.113.5"}`)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		assert.Equal(t, 3, modified)
+		assert.Empty(t, s.conf.TemporaryAllowedClients)
+	})
+}
+
+func TestUnexpiredTemporaryClients(t *testing.T) {
+	now := time.Now()
+	valid := &TemporaryAccessClient{
+		Expires: now.Add(time.Minute),
+		Client:  "203.0.113.5",
+	}
+
+	got := unexpiredTemporaryClients([]*TemporaryAccessClient{valid, {
+		Expires: now,
+		Client:  "203.0.113.6",
+	}}, now)
+	require.Len(t, got, 1)
+
+	assert.Equal(t, valid, got[0])
+
+	// Make sure that the entries are copied.
+	got[0].Client = "203.0.113.7"
+	assert.Equal(t, "203.0.113.5", valid.Client)
+}
@@ -0,0 +1,220 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// errBindUnsupported is returned when the connections to an upstream can't be
+// bound to the local address or the network interface.
+const errBindUnsupported errors.Error = "binding requires plain dns upstream with ip address"
+
+// upstreamBind defines the local address and the network interface the
+// connections to an upstream are made from.  A nil *upstreamBind is valid and
+// leaves both to the system.
+type upstreamBind struct {
+	// ctrl binds the sockets to the network interface.  It's nil if the
+	// interface isn't set.
+	ctrl aghnet.ControlFunc
+
+	// addr is the local IP address.  If it's invalid, the address is chosen by
+	// the system.
+	addr netip.Addr
+}
+
+// newUpstreamBind returns a new *upstreamBind for the local IP address addr
+// and the network interface named iface, either of which may be empty.  It
+// returns nil if both are.
+func newUpstreamBind(addr netip.Addr, iface string) (b *upstreamBind, err error) {
+	if !addr.IsValid() && iface == "" {
+		return nil, nil
+	}
+
+	b = &upstreamBind{
+		addr: addr.Unmap(),
+	}
+
+	if iface != "" {
+		b.ctrl, err = aghnet.BindToDeviceControl(iface)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %w", iface, err)
+		}
+	}
+
+	return b, nil
+}
+
+// checkUpstreamAddr returns an error if the upstream IP address ip can't be
+// dialed from the local address of b.
+func (b *upstreamBind) checkUpstreamAddr(ip netip.Addr) (err error) {
+	if b == nil || !b.addr.IsValid() || b.addr.Is4() == ip.Unmap().Is4() {
+		return nil
+	}
+
+	return fmt.Errorf("bind address %s and upstream address %s are of different families", b.addr, ip)
+}
+
+// dialer returns a dialer for the connections of network, either "udp" or
+// "tcp", according to b.
+func (b *upstreamBind) dialer(network string, timeout time.Duration) (d *net.Dialer) {
+	d = &net.Dialer{
+		Timeout: timeout,
+	}
+
+	if b == nil {
+		return d
+	}
+
+	d.Control = b.ctrl
+	if b.addr.IsValid() {
+		local := netip.AddrPortFrom(b.addr, 0)
+		if network == "tcp" {
+			d.LocalAddr = net.TCPAddrFromAddrPort(local)
+		} else {
+			d.LocalAddr = net.UDPAddrFromAddrPort(local)
+		}
+	}
+
+	return d
+}
+
+// plainUpstream is an upstream.Upstream for a plain DNS server with an IP
+// address, which connections are either bound according to an *upstreamBind or
+// made through an *upstreamProxy.  The truncated UDP responses are retried
+// over TCP.
+type plainUpstream struct {
+	// bind defines the local address and the network interface of the
+	// connections.
+	bind *upstreamBind
+
+	// proxy is the proxy the queries are sent through, if any.
+	proxy *upstreamProxy
+
+	// addr is the address of the upstream with the scheme, if it's not UDP,
+	// and the port.
+	addr string
+
+	// network is the network of the queries, either "udp" or "tcp".
+	network string
+
+	// dialAddr is the address to dial.
+	dialAddr string
+
+	// timeout is the timeout of a single query.
+	timeout time.Duration
+}
+
+// type check
+var _ upstream.Upstream = (*plainUpstream)(nil)
+
+// newPlainUpstream returns a new *plainUpstream for addr bound according to
+// bind or, if p isn't nil, querying it through p.  It returns nil and no error
+// if addr is the special address of the default upstreams.
+func newPlainUpstream(
+	addr string,
+	timeout time.Duration,
+	bind *upstreamBind,
+	p *upstreamProxy,
+) (u *plainUpstream, err error) {
+	if addr == "#" {
+		return nil, nil
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	u = &plainUpstream{
+		bind:    bind,
+		proxy:   p,
+		network: "udp",
+		timeout: timeout,
+	}
+
+	errUnsupported := errBindUnsupported
+	if p != nil {
+		errUnsupported = errProxyUnsupported
+	}
+
+	hostPort := addr
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		if scheme != "udp" && scheme != "tcp" {
+			return nil, fmt.Errorf("upstream %q: %w", addr, errUnsupported)
+		}
+
+		u.network, hostPort = scheme, rest
+	}
+
+	ap, err := netip.ParseAddrPort(hostPort)
+	if err != nil {
+		ip, ipErr := netip.ParseAddr(hostPort)
+		if ipErr != nil {
+			return nil, fmt.Errorf("upstream %q: %w", addr, errUnsupported)
+		}
+
+		ap = netip.AddrPortFrom(ip, 53)
+	}
+
+	err = bind.checkUpstreamAddr(ap.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %w", addr, err)
+	}
+
+	// Use the same address format as dnsproxy.
+	u.dialAddr = ap.String()
+	u.addr = u.dialAddr
+	if u.network == "tcp" {
+		u.addr = "tcp://" + u.dialAddr
+	}
+
+	return u, nil
+}
+
+// Address implements the [upstream.Upstream] interface for *plainUpstream.
+func (u *plainUpstream) Address() (addr string) {
+	return u.addr
+}
+
+// Exchange implements the [upstream.Upstream] interface for *plainUpstream.
+func (u *plainUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	resp, err = u.exchange(u.network, req)
+	if err == nil && resp.Truncated && u.network == "udp" {
+		resp, err = u.exchange("tcp", req)
+	}
+
+	return resp, err
+}
+
+// exchange sends req to the upstream over network and returns the response.
+func (u *plainUpstream) exchange(network string, req *dns.Msg) (resp *dns.Msg, err error) {
+	if u.proxy != nil {
+		return u.exchangeProxied(network, req)
+	}
+
+	c := &dns.Client{
+		Net:     network,
+		UDPSize: dns.MaxMsgSize,
+		Dialer:  u.bind.dialer(network, u.timeout),
+		Timeout: u.timeout,
+	}
+
+	resp, _, err = c.Exchange(req, u.dialAddr)
+	if err != nil {
+		return nil, fmt.Errorf("exchanging with %s over %s: %w", u.addr, network, err)
+	}
+
+	return resp, nil
+}
+
+// Close implements the [upstream.Upstream] interface for *plainUpstream.
+func (u *plainUpstream) Close() (err error) {
+	return nil
+}
@@ -0,0 +1,179 @@
+package dnsforward
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPlainUpstream(t *testing.T) {
+	bind4 := &upstreamBind{addr: netip.MustParseAddr("127.0.0.1")}
+
+	testCases := []struct {
+		bind       *upstreamBind
+		name       string
+		addr       string
+		wantAddr   string
+		wantErrMsg string
+	}{{
+		bind:       bind4,
+		name:       "udp",
+		addr:       "1.2.3.4",
+		wantAddr:   "1.2.3.4:53",
+		wantErrMsg: "",
+	}, {
+		bind:       bind4,
+		name:       "udp_scheme_port",
+		addr:       "udp://1.2.3.4:5353",
+		wantAddr:   "1.2.3.4:5353",
+		wantErrMsg: "",
+	}, {
+		bind:       nil,
+		name:       "tcp_ipv6",
+		addr:       "tcp://[2001:db8::1]:53",
+		wantAddr:   "tcp://[2001:db8::1]:53",
+		wantErrMsg: "",
+	}, {
+		bind:       bind4,
+		name:       "default",
+		addr:       "#",
+		wantAddr:   "",
+		wantErrMsg: "",
+	}, {
+		bind:     bind4,
+		name:     "encrypted",
+		addr:     "tls://1.2.3.4",
+		wantAddr: "",
+		wantErrMsg: `upstream "tls://1.2.3.4": ` +
+			`binding requires plain dns upstream with ip address`,
+	}, {
+		bind:     bind4,
+		name:     "hostname",
+		addr:     "dns.example",
+		wantAddr: "",
+		wantErrMsg: `upstream "dns.example": ` +
+			`binding requires plain dns upstream with ip address`,
+	}, {
+		bind:     bind4,
+		name:     "family",
+		addr:     "[2001:db8::1]:53",
+		wantAddr: "",
+		wantErrMsg: `upstream "[2001:db8::1]:53": bind address 127.0.0.1 and ` +
+			`upstream address 2001:db8::1 are of different families`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := newPlainUpstream(tc.addr, 0, tc.bind, nil)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			if tc.wantAddr == "" {
+				assert.Nil(t, u)
+
+				return
+			}
+
+			require.NotNil(t, u)
+
+			assert.Equal(t, tc.wantAddr, u.Address())
+		})
+	}
+}
+
+func TestPlainUpstream_Exchange(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	remoteAddrs := make(chan net.Addr, 1)
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			remoteAddrs <- w.RemoteAddr()
+
+			_ = w.WriteMsg((&dns.Msg{}).SetReply(req))
+		}),
+	}
+
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	bind, err := newUpstreamBind(netip.MustParseAddr("127.0.0.1"), "")
+	require.NoError(t, err)
+
+	u, err := newPlainUpstream(pc.LocalAddr().String(), time.Second, bind, nil)
+	require.NoError(t, err)
+
+	resp, err := u.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	addr, _ := testutil.RequireReceive(t, remoteAddrs, time.Second)
+	udpAddr, ok := addr.(*net.UDPAddr)
+	require.True(t, ok)
+
+	assert.Equal(t, netip.MustParseAddr("127.0.0.1"), udpAddr.AddrPort().Addr().Unmap())
+}
+
+func TestParseUpstreamsConfig_bind(t *testing.T) {
+	pool := newUpstreamPool()
+	err := pool.setConfig(UpstreamPoolConfig{
+		BindAddress: netip.MustParseAddr("127.0.0.1"),
+	}, false)
+	require.NoError(t, err)
+
+	conf, err := ParseUpstreamsConfig([]string{
+		"1.2.3.4",
+		"[/example.org/]tcp://1.2.3.4#timeout=1s",
+		"[/example.net/]#",
+	}, &upstream.Options{}, pool)
+	require.NoError(t, err)
+
+	require.Len(t, conf.Upstreams, 1)
+
+	pu, ok := conf.Upstreams[0].(*pooledUpstream)
+	require.True(t, ok)
+
+	assert.IsType(t, (*plainUpstream)(nil), pu.Upstream)
+	assert.Equal(t, "1.2.3.4:53", pu.Address())
+
+	ups := conf.DomainReservedUpstreams["example.org."]
+	require.Len(t, ups, 1)
+
+	assert.Equal(t, "tcp://1.2.3.4:53", ups[0].Address())
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err = ParseUpstreamsConfig([]string{
+			"https://dns.example/dns-query",
+		}, &upstream.Options{}, pool)
+		testutil.AssertErrorMsg(
+			t,
+			`upstream at index 0: upstream "https://dns.example/dns-query": `+
+				`binding requires plain dns upstream with ip address`,
+			err,
+		)
+	})
+
+	t.Run("override", func(t *testing.T) {
+		conf, err = ParseUpstreamsConfig([]string{
+			"1.2.3.4#bind=127.0.0.1",
+			"tls://1.2.3.4",
+		}, &upstream.Options{}, nil)
+		require.NoError(t, err)
+
+		require.Len(t, conf.Upstreams, 2)
+
+		assert.IsType(t, (*plainUpstream)(nil), conf.Upstreams[0])
+		assert.Equal(t, "tls://1.2.3.4:853", conf.Upstreams[1].Address())
+	})
+}
@@ -0,0 +1,354 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+)
+
+// Default failover settings.
+const (
+	defaultFailoverThreshold uint32 = 3
+	defaultFailoverHoldTime         = 1 * time.Minute
+)
+
+// UpstreamFailover is the configuration of the secondary tier of the default
+// upstreams, which is only used while the whole primary tier, that is
+// [FilteringConfig.UpstreamDNS], is failing.
+type UpstreamFailover struct {
+	// Upstreams are the secondary upstreams.  The domain-specific upstreams
+	// aren't supported, since the ones of the primary tier are used for their
+	// domains anyway.  If empty, the failover is disabled.
+	Upstreams []string `yaml:"upstreams" json:"upstreams"`
+
+	// Threshold is the number of the consecutive failed queries to each of the
+	// primary upstreams after which the primary tier is considered failing.
+	// Zero means the default value.
+	Threshold uint32 `yaml:"threshold" json:"threshold"`
+
+	// HoldTime is the time the secondary tier is used for before the primary
+	// one is probed again, which prevents flapping between the tiers.  Zero
+	// means the default value.
+	HoldTime timeutil.Duration `yaml:"hold_time" json:"hold_time"`
+}
+
+// withDefaults returns a copy of c with the zero fields replaced with the
+// default values.
+func (c UpstreamFailover) withDefaults() (res UpstreamFailover) {
+	return UpstreamFailover{
+		Upstreams: stringutil.CloneSliceOrEmpty(c.Upstreams),
+		Threshold: aghalg.Coalesce(c.Threshold, defaultFailoverThreshold),
+		HoldTime: timeutil.Duration{
+			Duration: aghalg.Coalesce(c.HoldTime.Duration, defaultFailoverHoldTime),
+		},
+	}
+}
+
+// validate returns an error if c is invalid.
+func (c *UpstreamFailover) validate() (err error) {
+	if c.HoldTime.Duration < 0 {
+		return errors.Error("hold_time: negative value")
+	}
+
+	upstreams := stringutil.FilterOut(c.Upstreams, IsCommentOrEmpty)
+	for _, u := range upstreams {
+		if strings.HasPrefix(u, "[/") {
+			return fmt.Errorf("upstreams: %q: domain-specific upstreams aren't supported", u)
+		}
+	}
+
+	err = ValidateUpstreams(upstreams)
+	if err != nil {
+		return fmt.Errorf("upstreams: %w", err)
+	}
+
+	return nil
+}
+
+// upstreamTier is the name of a tier of the default upstreams.
+type upstreamTier string
+
+// Upstream tiers.
+const (
+	upstreamTierPrimary   upstreamTier = "primary"
+	upstreamTierSecondary upstreamTier = "secondary"
+)
+
+// upstreamFailover switches the queries from the primary tier of the default
+// upstreams to the secondary one while all the primary upstreams are failing.
+// A nil *upstreamFailover is valid and always uses the primary tier.
+type upstreamFailover struct {
+	// secondary are the secondary upstreams.  Only those are closed together
+	// with the failover.
+	secondary *proxy.UpstreamConfig
+
+	// route is the configuration the queries are resolved with while the
+	// secondary tier is active.  It shares the domain-specific upstreams with
+	// the primary configuration.
+	route *proxy.UpstreamConfig
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// primary are the wrapped upstreams of the primary tier.
+	primary []*tieredUpstream
+
+	// switchedAt is the time of the latest switch between the tiers.
+	switchedAt time.Time
+
+	// probeAt is the time after which a query is sent to the primary tier
+	// while the secondary one is active.
+	probeAt time.Time
+
+	// active is the tier currently in use.
+	active upstreamTier
+
+	// switches is the number of the switches between the tiers.
+	switches uint64
+
+	// threshold is the number of the consecutive failures of each primary
+	// upstream which makes the primary tier fail.
+	threshold uint32
+
+	// holdTime is the time between the probes of the failing primary tier.
+	holdTime time.Duration
+}
+
+// newUpstreamFailover wraps the default upstreams of primary and returns the
+// failover to the secondary upstreams according to conf.  It returns nil if the
+// failover is disabled.  conf must be valid.
+func newUpstreamFailover(
+	conf UpstreamFailover,
+	primary *proxy.UpstreamConfig,
+	opts *upstream.Options,
+	pool *UpstreamPool,
+) (f *upstreamFailover, err error) {
+	upstreams := stringutil.FilterOut(conf.Upstreams, IsCommentOrEmpty)
+	if len(upstreams) == 0 {
+		return nil, nil
+	}
+
+	secondary, err := ParseUpstreamsConfig(upstreams, opts, pool)
+	if err != nil {
+		return nil, fmt.Errorf("parsing secondary upstreams: %w", err)
+	}
+
+	conf = conf.withDefaults()
+	f = &upstreamFailover{
+		secondary: secondary,
+		route: &proxy.UpstreamConfig{
+			Upstreams:                secondary.Upstreams,
+			DomainReservedUpstreams:  primary.DomainReservedUpstreams,
+			SpecifiedDomainUpstreams: primary.SpecifiedDomainUpstreams,
+			SubdomainExclusions:      primary.SubdomainExclusions,
+		},
+		mu:         &sync.Mutex{},
+		switchedAt: time.Now(),
+		active:     upstreamTierPrimary,
+		threshold:  conf.Threshold,
+		holdTime:   conf.HoldTime.Duration,
+	}
+
+	for i, u := range primary.Upstreams {
+		tu := &tieredUpstream{
+			Upstream: u,
+			failover: f,
+		}
+
+		f.primary = append(f.primary, tu)
+		primary.Upstreams[i] = tu
+	}
+
+	return f, nil
+}
+
+// upstreamConfig returns the configuration to resolve a query without custom
+// upstreams with at now.  It returns nil if the primary tier should be used,
+// including the case when the query probes the failing primary tier.
+func (f *upstreamFailover) upstreamConfig(now time.Time) (conf *proxy.UpstreamConfig) {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.active == upstreamTierPrimary {
+		return nil
+	}
+
+	if !now.Before(f.probeAt) {
+		// Only send a single probe per hold time.
+		f.probeAt = now.Add(f.holdTime)
+
+		return nil
+	}
+
+	return f.route
+}
+
+// activeSecondary returns the configuration routing to the secondary tier if
+// it's active and nil otherwise.  It's used to retry the queries failed by the
+// primary tier, which may have failed over due to them.
+func (f *upstreamFailover) activeSecondary() (conf *proxy.UpstreamConfig) {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.active == upstreamTierSecondary {
+		return f.route
+	}
+
+	return nil
+}
+
+// record accounts the result of a query to the primary upstream u and switches
+// the tiers if needed.
+func (f *upstreamFailover) record(u *tieredUpstream, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		u.failures = 0
+		if f.active == upstreamTierSecondary {
+			f.switchTo(upstreamTierPrimary, time.Now())
+		}
+
+		return
+	}
+
+	u.failures++
+	if f.active == upstreamTierSecondary {
+		return
+	}
+
+	for _, pu := range f.primary {
+		if pu.failures < f.threshold {
+			return
+		}
+	}
+
+	now := time.Now()
+	f.probeAt = now.Add(f.holdTime)
+	f.switchTo(upstreamTierSecondary, now)
+}
+
+// switchTo makes tier active.  f.mu must be locked.
+func (f *upstreamFailover) switchTo(tier upstreamTier, now time.Time) {
+	log.Info("dnsforward: upstream failover: switching from %s to %s tier", f.active, tier)
+
+	f.active = tier
+	f.switchedAt = now
+	f.switches++
+}
+
+// close closes the secondary upstreams of f.
+func (f *upstreamFailover) close() {
+	if f == nil {
+		return
+	}
+
+	closeUpstreamConfigs([]*proxy.UpstreamConfig{f.secondary})
+}
+
+// tieredUpstream is a primary upstream which accounts the results of its
+// queries in the failover.
+type tieredUpstream struct {
+	upstream.Upstream
+
+	// failover is the failover the upstream belongs to.
+	failover *upstreamFailover
+
+	// failures is the number of the consecutive failed queries.  It's
+	// protected by failover.mu.
+	failures uint32
+}
+
+// type check
+var _ upstream.Upstream = (*tieredUpstream)(nil)
+
+// Exchange implements the [upstream.Upstream] interface for *tieredUpstream.
+func (u *tieredUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	resp, err = u.Upstream.Exchange(req)
+	u.failover.record(u, err)
+
+	return resp, err
+}
+
+// upstreamFailoverJSON is the state of the failover in the GET
+// /control/dns/upstream_pool HTTP API.
+type upstreamFailoverJSON struct {
+	SwitchedAt string `json:"switched_at"`
+
+	Active upstreamTier `json:"active_tier"`
+
+	Primary   []*tieredUpstreamJSON `json:"primary"`
+	Secondary []string              `json:"secondary"`
+
+	Switches  uint64            `json:"switches"`
+	Threshold uint32            `json:"threshold"`
+	HoldTime  timeutil.Duration `json:"hold_time"`
+}
+
+// tieredUpstreamJSON is the state of a single primary upstream.
+type tieredUpstreamJSON struct {
+	Address string `json:"address"`
+
+	// Failures is the number of the consecutive failed queries.
+	Failures uint32 `json:"failures"`
+}
+
+// toJSON returns the state of f.  It returns nil if f is nil.
+func (f *upstreamFailover) toJSON() (j *upstreamFailoverJSON) {
+	if f == nil {
+		return nil
+	}
+
+	j = &upstreamFailoverJSON{
+		Primary:   make([]*tieredUpstreamJSON, 0, len(f.primary)),
+		Secondary: make([]string, 0, len(f.secondary.Upstreams)),
+		HoldTime:  timeutil.Duration{Duration: f.holdTime},
+		Threshold: f.threshold,
+	}
+
+	for _, u := range f.secondary.Upstreams {
+		j.Secondary = append(j.Secondary, u.Address())
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	j.SwitchedAt = f.switchedAt.Format(time.RFC3339)
+	j.Active = f.active
+	j.Switches = f.switches
+
+	for _, u := range f.primary {
+		j.Primary = append(j.Primary, &tieredUpstreamJSON{
+			Address:  u.Address(),
+			Failures: u.failures,
+		})
+	}
+
+	return j
+}
+
+// upstreamFailover returns the current failover of s.  It may be nil.
+func (s *Server) upstreamFailover() (f *upstreamFailover) {
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
+	return s.upsFailover
+}
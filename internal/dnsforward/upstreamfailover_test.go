@@ -0,0 +1,177 @@
+package dnsforward
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSwitchableUpstream returns an upstream with addr, which fails the queries
+// while failing is true.
+func newSwitchableUpstream(addr string, failing *atomic.Bool) (u upstream.Upstream) {
+	mu := aghtest.NewUpstreamMock(func(req *dns.Msg) (resp *dns.Msg, err error) {
+		if failing.Load() {
+			return nil, errors.Error("test error")
+		}
+
+		return (&dns.Msg{}).SetReply(req), nil
+	})
+	mu.OnAddress = func() (a string) { return addr }
+
+	return mu
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	failing1, failing2 := &atomic.Bool{}, &atomic.Bool{}
+	primary := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{
+			newSwitchableUpstream("1.1.1.1:53", failing1),
+			newSwitchableUpstream("2.2.2.2:53", failing2),
+		},
+	}
+
+	const holdTime = time.Hour
+
+	f, err := newUpstreamFailover(UpstreamFailover{
+		Upstreams: []string{"# comment", "9.9.9.9"},
+		Threshold: 2,
+		HoldTime:  timeutil.Duration{Duration: holdTime},
+	}, primary, &upstream.Options{}, nil)
+	require.NoError(t, err)
+	require.NotNil(t, f)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) {
+		f.close()
+
+		return nil
+	})
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	exchangeAll := func() {
+		for _, u := range primary.Upstreams {
+			_, _ = u.Exchange(req)
+		}
+	}
+
+	t.Run("partial_failure", func(t *testing.T) {
+		failing1.Store(true)
+		exchangeAll()
+		exchangeAll()
+		exchangeAll()
+
+		assert.Nil(t, f.upstreamConfig(time.Now()))
+		assert.Nil(t, f.activeSecondary())
+		assert.Equal(t, upstreamTierPrimary, f.toJSON().Active)
+	})
+
+	var switchedAt time.Time
+	t.Run("failover", func(t *testing.T) {
+		failing2.Store(true)
+		exchangeAll()
+		assert.Nil(t, f.activeSecondary())
+
+		exchangeAll()
+		switchedAt = time.Now()
+
+		route := f.upstreamConfig(switchedAt)
+		require.NotNil(t, route)
+		require.Len(t, route.Upstreams, 1)
+
+		assert.True(t, route == f.activeSecondary())
+		assert.Equal(t, "9.9.9.9:53", route.Upstreams[0].Address())
+
+		j := f.toJSON()
+		assert.Equal(t, upstreamTierSecondary, j.Active)
+		assert.Equal(t, uint64(1), j.Switches)
+		assert.Equal(t, []string{"9.9.9.9:53"}, j.Secondary)
+		assert.Equal(t, []*tieredUpstreamJSON{{
+			Address:  "1.1.1.1:53",
+			Failures: 5,
+		}, {
+			Address:  "2.2.2.2:53",
+			Failures: 2,
+		}}, j.Primary)
+	})
+
+	t.Run("failed_probe", func(t *testing.T) {
+		probeAt := switchedAt.Add(holdTime)
+		require.Nil(t, f.upstreamConfig(probeAt))
+
+		// Only a single query probes the primary tier.
+		assert.NotNil(t, f.upstreamConfig(probeAt))
+
+		exchangeAll()
+		assert.NotNil(t, f.activeSecondary())
+		assert.NotNil(t, f.upstreamConfig(probeAt.Add(holdTime/2)))
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		failing2.Store(false)
+		require.Nil(t, f.upstreamConfig(switchedAt.Add(3*holdTime)))
+
+		exchangeAll()
+		assert.Nil(t, f.activeSecondary())
+		assert.Nil(t, f.upstreamConfig(switchedAt.Add(3*holdTime)))
+
+		j := f.toJSON()
+		assert.Equal(t, upstreamTierPrimary, j.Active)
+		assert.Equal(t, uint64(2), j.Switches)
+	})
+}
+
+func TestUpstreamFailover_nil(t *testing.T) {
+	var f *upstreamFailover
+
+	assert.Nil(t, f.upstreamConfig(time.Now()))
+	assert.Nil(t, f.activeSecondary())
+	assert.Nil(t, f.toJSON())
+	assert.NotPanics(t, f.close)
+}
+
+func TestUpstreamFailover_validate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		conf       UpstreamFailover
+	}{{
+		name:       "empty",
+		wantErrMsg: "",
+		conf:       UpstreamFailover{},
+	}, {
+		name:       "valid",
+		wantErrMsg: "",
+		conf: UpstreamFailover{
+			Upstreams: []string{"# comment", "9.9.9.9", "tls://dns.example"},
+			Threshold: 5,
+			HoldTime:  timeutil.Duration{Duration: time.Minute},
+		},
+	}, {
+		name:       "negative_hold_time",
+		wantErrMsg: "hold_time: negative value",
+		conf: UpstreamFailover{
+			HoldTime: timeutil.Duration{Duration: -time.Minute},
+		},
+	}, {
+		name: "domain_specific",
+		wantErrMsg: `upstreams: "[/example.org/]9.9.9.9": ` +
+			`domain-specific upstreams aren't supported`,
+		conf: UpstreamFailover{
+			Upstreams: []string{"[/example.org/]9.9.9.9"},
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// maxUpstreamRetries is the maximum number of retries of a query to a single
+// upstream.
+const maxUpstreamRetries = 10
+
+// upstreamPolicy is the timeout, the retry policy, and the binding of the
+// connections of a single upstream.  It's set in the upstream configuration
+// after the address and the '#' character, for example:
+//
+//	https://dns.example/dns-query#timeout=2s,retries=2,backoff=100ms
+//	1.1.1.1#interface=wg0
+type upstreamPolicy struct {
+	// bindAddr is the local IP address of the connections.  If either it's
+	// valid or bindIface isn't empty, they override the ones from
+	// [UpstreamPoolConfig].
+	bindAddr netip.Addr
+
+	// bindIface is the name of the network interface of the connections.
+	bindIface string
+
+	// timeout is the timeout of a single attempt.  If it's zero, the common
+	// upstream timeout is used.
+	timeout time.Duration
+
+	// backoff is the delay before the first retry, doubled before each of the
+	// next ones.
+	backoff time.Duration
+
+	// retries is the number of the attempts made after the first one fails.
+	retries uint
+}
+
+// splitUpstreamPolicy splits the upstream policy from addr.  pol is nil if
+// addr has none.
+func splitUpstreamPolicy(addr string) (clean string, pol *upstreamPolicy, err error) {
+	// An address starting with '#' is either a comment or the special address
+	// of the default upstreams.
+	i := strings.LastIndexByte(addr, '#')
+	if i <= 0 || i == len(addr)-1 {
+		return addr, nil, nil
+	}
+
+	pol, err = parseUpstreamPolicy(addr[i+1:])
+	if err != nil {
+		return "", nil, fmt.Errorf("upstream %q: %w", addr[:i], err)
+	}
+
+	return addr[:i], pol, nil
+}
+
+// parseUpstreamPolicy parses the comma-separated key-value options of the
+// upstream policy from s.
+func parseUpstreamPolicy(s string) (pol *upstreamPolicy, err error) {
+	pol = &upstreamPolicy{}
+	for _, opt := range strings.Split(s, ",") {
+		key, val, ok := strings.Cut(opt, "=")
+		if !ok {
+			return nil, fmt.Errorf("option %q: no value", opt)
+		}
+
+		switch key {
+		case "timeout":
+			pol.timeout, err = time.ParseDuration(val)
+			if err == nil && pol.timeout <= 0 {
+				err = fmt.Errorf("must be positive, got %s", pol.timeout)
+			}
+		case "backoff":
+			pol.backoff, err = time.ParseDuration(val)
+			if err == nil && pol.backoff < 0 {
+				err = fmt.Errorf("must not be negative, got %s", pol.backoff)
+			}
+		case "retries":
+			var retries uint64
+			retries, err = strconv.ParseUint(val, 10, 0)
+			if err == nil && retries > maxUpstreamRetries {
+				err = fmt.Errorf("must not be greater than %d, got %d", maxUpstreamRetries, retries)
+			}
+
+			pol.retries = uint(retries)
+		case "bind":
+			pol.bindAddr, err = netip.ParseAddr(val)
+		case "interface":
+			pol.bindIface = val
+			if val == "" {
+				err = errors.Error("empty value")
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("option %q: %w", key, err)
+		}
+	}
+
+	return pol, nil
+}
+
+// retryUpstream is an upstream.Upstream which retries the failed queries with
+// an exponential backoff.
+type retryUpstream struct {
+	upstream.Upstream
+
+	// backoff is the delay before the first retry.
+	backoff time.Duration
+
+	// retries is the number of the retries.
+	retries uint
+}
+
+// type check
+var _ upstream.Upstream = (*retryUpstream)(nil)
+
+// Exchange implements the [upstream.Upstream] interface for *retryUpstream.
+func (u *retryUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	for attempt := uint(0); ; attempt++ {
+		resp, err = u.Upstream.Exchange(req)
+		if err == nil || attempt == u.retries {
+			return resp, err
+		}
+
+		wait := u.backoff << attempt
+		log.Debug(
+			"dnsforward: upstream %s: attempt %d: %s; retrying in %s",
+			u.Address(),
+			attempt+1,
+			err,
+			wait,
+		)
+
+		time.Sleep(wait)
+	}
+}
+
+// newCustomUpstream returns a new upstream for addr, if it has an upstream
+// policy, it has to be bound to a local address or a network interface, or it
+// isn't supported by dnsproxy, see [newBaseUpstream].  Otherwise it returns nil
+// and no error.  pool may be nil.
+func newCustomUpstream(
+	addr string,
+	opts *upstream.Options,
+	pool *UpstreamPool,
+) (u upstream.Upstream, err error) {
+	clean, pol, err := splitUpstreamPolicy(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := pool.streamConf()
+	if pol == nil {
+		return newBaseUpstream(addr, opts.Timeout, conf)
+	}
+
+	if pol.bindAddr.IsValid() || pol.bindIface != "" {
+		conf.bind, err = newUpstreamBind(pol.bindAddr, pol.bindIface)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", clean, err)
+		}
+
+		// The upstreams bound explicitly are queried directly, which allows
+		// excluding some of them, such as the local ones, from proxying.
+		conf.proxy = nil
+	}
+
+	opts = opts.Clone()
+	if pol.timeout > 0 {
+		opts.Timeout = pol.timeout
+	}
+
+	u, err = newBaseUpstream(clean, opts.Timeout, conf)
+	if err != nil {
+		return nil, err
+	} else if u == nil {
+		u, err = upstream.AddressToUpstream(clean, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if pol.retries == 0 {
+		return u, nil
+	}
+
+	return &retryUpstream{
+		Upstream: u,
+		backoff:  pol.backoff,
+		retries:  pol.retries,
+	}, nil
+}
+
+// newBaseUpstream returns a new upstream for addr without an upstream policy,
+// if it isn't supported by dnsproxy or its connections are bound or proxied
+// according to conf, see [newStreamUpstream], [newPlainUpstream], and
+// [newProxiedUpstream].  Otherwise it returns nil and no error.
+func newBaseUpstream(
+	addr string,
+	timeout time.Duration,
+	conf streamConf,
+) (u upstream.Upstream, err error) {
+	if conf.proxy != nil && !strings.HasPrefix(addr, unixScheme+"://") {
+		return newProxiedUpstream(addr, timeout, conf.proxy)
+	}
+
+	su, err := newStreamUpstream(addr, timeout, conf)
+	if err != nil {
+		return nil, err
+	} else if su != nil {
+		return su, nil
+	} else if conf.bind == nil {
+		return nil, nil
+	}
+
+	pu, err := newPlainUpstream(addr, timeout, conf.bind, nil)
+	if pu == nil {
+		return nil, err
+	}
+
+	return pu, nil
+}
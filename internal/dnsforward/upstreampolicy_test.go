@@ -0,0 +1,174 @@
+package dnsforward
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitUpstreamPolicy(t *testing.T) {
+	testCases := []struct {
+		wantPol    *upstreamPolicy
+		name       string
+		addr       string
+		wantClean  string
+		wantErrMsg string
+	}{{
+		wantPol:    nil,
+		name:       "none",
+		addr:       "tls://dns.example",
+		wantClean:  "tls://dns.example",
+		wantErrMsg: "",
+	}, {
+		wantPol:    nil,
+		name:       "default",
+		addr:       "#",
+		wantClean:  "#",
+		wantErrMsg: "",
+	}, {
+		wantPol: &upstreamPolicy{
+			timeout: 2 * time.Second,
+			backoff: 100 * time.Millisecond,
+			retries: 3,
+		},
+		name:       "all",
+		addr:       "https://dns.example/dns-query#timeout=2s,retries=3,backoff=100ms",
+		wantClean:  "https://dns.example/dns-query",
+		wantErrMsg: "",
+	}, {
+		wantPol: &upstreamPolicy{
+			timeout: time.Second,
+		},
+		name:       "timeout",
+		addr:       "1.2.3.4#timeout=1s",
+		wantClean:  "1.2.3.4",
+		wantErrMsg: "",
+	}, {
+		wantPol: &upstreamPolicy{
+			bindAddr:  netip.MustParseAddr("192.168.1.2"),
+			bindIface: "wg0",
+		},
+		name:       "bind",
+		addr:       "1.2.3.4#bind=192.168.1.2,interface=wg0",
+		wantClean:  "1.2.3.4",
+		wantErrMsg: "",
+	}, {
+		wantPol:    nil,
+		name:       "unknown",
+		addr:       "1.2.3.4#ttl=1s",
+		wantClean:  "",
+		wantErrMsg: `upstream "1.2.3.4": unknown option "ttl"`,
+	}, {
+		wantPol:    nil,
+		name:       "no_value",
+		addr:       "1.2.3.4#retries",
+		wantClean:  "",
+		wantErrMsg: `upstream "1.2.3.4": option "retries": no value`,
+	}, {
+		wantPol:   nil,
+		name:      "bad_timeout",
+		addr:      "1.2.3.4#timeout=0s",
+		wantClean: "",
+		wantErrMsg: `upstream "1.2.3.4": option "timeout": ` +
+			`must be positive, got 0s`,
+	}, {
+		wantPol:   nil,
+		name:      "bad_backoff",
+		addr:      "1.2.3.4#backoff=-1s",
+		wantClean: "",
+		wantErrMsg: `upstream "1.2.3.4": option "backoff": ` +
+			`must not be negative, got -1s`,
+	}, {
+		wantPol:   nil,
+		name:      "bad_bind",
+		addr:      "1.2.3.4#bind=wg0",
+		wantClean: "",
+		wantErrMsg: `upstream "1.2.3.4": option "bind": ` +
+			`ParseAddr("wg0"): unable to parse IP`,
+	}, {
+		wantPol:    nil,
+		name:       "empty_interface",
+		addr:       "1.2.3.4#interface=",
+		wantClean:  "",
+		wantErrMsg: `upstream "1.2.3.4": option "interface": empty value`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clean, pol, err := splitUpstreamPolicy(tc.addr)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantClean, clean)
+			assert.Equal(t, tc.wantPol, pol)
+		})
+	}
+}
+
+func TestRetryUpstream_Exchange(t *testing.T) {
+	const testErr errors.Error = "test error"
+
+	newUps := func(failures int) (u *retryUpstream, attempts *int) {
+		attempts = new(int)
+
+		return &retryUpstream{
+			Upstream: aghtest.NewUpstreamMock(func(req *dns.Msg) (resp *dns.Msg, err error) {
+				*attempts++
+				if *attempts <= failures {
+					return nil, testErr
+				}
+
+				return (&dns.Msg{}).SetReply(req), nil
+			}),
+			backoff: time.Millisecond,
+			retries: 2,
+		}, attempts
+	}
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+
+	t.Run("success", func(t *testing.T) {
+		u, attempts := newUps(2)
+
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+
+		assert.NotNil(t, resp)
+		assert.Equal(t, 3, *attempts)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		u, attempts := newUps(3)
+
+		_, err := u.Exchange(req)
+		assert.ErrorIs(t, err, testErr)
+		assert.Equal(t, 3, *attempts)
+	})
+}
+
+func TestParseUpstreamsConfig_policy(t *testing.T) {
+	conf, err := ParseUpstreamsConfig([]string{
+		"1.2.3.4#timeout=1s,retries=1",
+		"[/example.org/]tls://1.2.3.4#timeout=1s",
+		"8.8.8.8",
+	}, &upstream.Options{}, nil)
+	require.NoError(t, err)
+
+	require.Len(t, conf.Upstreams, 2)
+
+	assert.IsType(t, (*retryUpstream)(nil), conf.Upstreams[0])
+	assert.Equal(t, "1.2.3.4:53", conf.Upstreams[0].Address())
+	assert.Equal(t, "8.8.8.8:53", conf.Upstreams[1].Address())
+
+	ups := conf.DomainReservedUpstreams["example.org."]
+	require.Len(t, ups, 1)
+
+	assert.Equal(t, "tls://1.2.3.4:853", ups[0].Address())
+}
@@ -0,0 +1,274 @@
+package dnsforward
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBlockingUpstream returns an upstream with addr, which signals on started
+// about each query and answers it only after release is closed.
+func newBlockingUpstream(addr string, started chan<- unit, release <-chan unit) (u upstream.Upstream) {
+	mu := aghtest.NewUpstreamMock(func(req *dns.Msg) (resp *dns.Msg, err error) {
+		started <- unit{}
+		<-release
+
+		return (&dns.Msg{}).SetReply(req), nil
+	})
+	mu.OnAddress = func() (a string) { return addr }
+
+	return mu
+}
+
+func TestUpstreamPool_wrap_limit(t *testing.T) {
+	pool := newUpstreamPool()
+	err := pool.setConfig(UpstreamPoolConfig{
+		MaxConns:       2,
+		MaxQUICStreams: 1,
+	}, false)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		addr      string
+		wantLimit uint32
+	}{{
+		name:      "tls",
+		addr:      "tls://dns.example:853",
+		wantLimit: 2,
+	}, {
+		name:      "tcp",
+		addr:      "tcp://1.2.3.4:53",
+		wantLimit: 2,
+	}, {
+		name:      "quic",
+		addr:      "quic://dns.example:853",
+		wantLimit: 1,
+	}, {
+		name:      "udp",
+		addr:      "1.2.3.4:53",
+		wantLimit: 0,
+	}, {
+		name:      "https",
+		addr:      "https://dns.example/dns-query",
+		wantLimit: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pu := pool.wrap(newBlockingUpstream(tc.addr, nil, nil))
+			testutil.CleanupAndRequireSuccess(t, pu.Close)
+
+			assert.Equal(t, int(tc.wantLimit), cap(pu.sem))
+		})
+	}
+
+	t.Run("pipelined", func(t *testing.T) {
+		pipelinedPool := newUpstreamPool()
+		err = pipelinedPool.setConfig(UpstreamPoolConfig{MaxConns: 2}, true)
+		require.NoError(t, err)
+
+		su, err := newStreamUpstream("tcp://1.2.3.4", 0, pipelinedPool.streamConf())
+		require.NoError(t, err)
+
+		pu := pipelinedPool.wrap(su)
+		testutil.CleanupAndRequireSuccess(t, pu.Close)
+
+		assert.Nil(t, pu.sem)
+		assert.Equal(t, 2, su.maxConns)
+	})
+}
+
+func TestPooledUpstream_Exchange(t *testing.T) {
+	const addr = "tls://dns.example:853"
+
+	pool := newUpstreamPool()
+	err := pool.setConfig(UpstreamPoolConfig{MaxConns: 1}, false)
+	require.NoError(t, err)
+
+	started := make(chan unit, 2)
+	release := make(chan unit)
+	pu := pool.wrap(newBlockingUpstream(addr, started, release))
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+
+			_, exErr := pu.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+			assert.NoError(t, exErr)
+		}()
+	}
+
+	<-started
+
+	// The second query must wait for the first one.
+	require.Eventually(t, func() (ok bool) {
+		return pu.usage.waited.Load() == 1
+	}, time.Second, time.Millisecond)
+
+	got := pool.toJSON()
+	require.Len(t, got.Upstreams, 1)
+
+	assert.Equal(t, &upstreamUsageJSON{
+		Address:      addr,
+		Queries:      2,
+		Waited:       1,
+		InFlight:     1,
+		PeakInFlight: 1,
+		Conns:        0,
+		MaxInFlight:  1,
+	}, got.Upstreams[0])
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int64(0), pu.usage.inFlight.Load())
+
+	// Closing the upstream removes its statistics.
+	require.NoError(t, pu.Close())
+	require.NoError(t, pu.Close())
+
+	assert.Empty(t, pool.toJSON().Upstreams)
+}
+
+func TestUpstreamPool_wrapConfig(t *testing.T) {
+	pool := newUpstreamPool()
+
+	u := newBlockingUpstream("tls://dns.example:853", nil, nil)
+	conf := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{u},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"example.org.": {u},
+		},
+	}
+
+	pool.wrapConfig(conf)
+
+	require.IsType(t, (*pooledUpstream)(nil), conf.Upstreams[0])
+	assert.Equal(t, conf.Upstreams[0], conf.DomainReservedUpstreams["example.org."][0])
+
+	var nilPool *UpstreamPool
+	conf = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{u},
+	}
+
+	nilPool.wrapConfig(conf)
+
+	assert.Equal(t, u, conf.Upstreams[0])
+}
+
+func TestStreamUpstream_Exchange_maxConns(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	// Answer the queries only after all of them are received, so that all
+	// the connections are busy.
+	const n = 4
+
+	reqs := make(chan unit, n)
+	answer := make(chan unit)
+	go func() {
+		for {
+			c, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			t.Cleanup(func() { _ = c.Close() })
+
+			go func() {
+				dc := &dns.Conn{Conn: c}
+				for {
+					req, readErr := dc.ReadMsg()
+					if readErr != nil {
+						return
+					}
+
+					reqs <- unit{}
+					go func() {
+						<-answer
+						_ = dc.WriteMsg((&dns.Msg{}).SetReply(req))
+					}()
+				}
+			}()
+		}
+	}()
+
+	u, err := newStreamUpstream("tcp://"+l.Addr().String(), time.Second, streamConf{
+		idleTimeout: 100 * time.Millisecond,
+		maxConns:    2,
+		pipelining:  true,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, u)
+
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+
+			_, exErr := u.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+			assert.NoError(t, exErr)
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		<-reqs
+	}
+
+	assert.Equal(t, 2, u.openConns())
+
+	close(answer)
+	wg.Wait()
+
+	// The connections are closed after being idle.
+	assert.Eventually(t, func() (ok bool) {
+		return u.openConns() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestUpstreamPoolConfig_validate(t *testing.T) {
+	c := &UpstreamPoolConfig{}
+	assert.NoError(t, c.validate())
+
+	c.IdleTimeout = timeutil.Duration{Duration: -time.Second}
+	testutil.AssertErrorMsg(t, "idle_timeout: negative value", c.validate())
+}
+
+func TestServer_handleUpstreamPool(t *testing.T) {
+	pool := newUpstreamPool()
+	err := pool.setConfig(UpstreamPoolConfig{MaxConns: 4}, true)
+	require.NoError(t, err)
+
+	s := &Server{upsPool: pool}
+
+	w := httptest.NewRecorder()
+	s.handleUpstreamPool(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.JSONEq(t, `{
+		"upstreams": [],
+		"idle_timeout": "0s",
+		"max_conns": 4,
+		"max_quic_streams": 0,
+		"pipelining": true
+	}`, w.Body.String())
+}
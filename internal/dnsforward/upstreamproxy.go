@@ -0,0 +1,415 @@
+package dnsforward
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	xproxy "golang.org/x/net/proxy"
+)
+
+// errProxyUnsupported is returned when the queries to an upstream can't be sent
+// through the SOCKS5 proxy.
+const errProxyUnsupported errors.Error = "proxying requires plain dns upstream with ip address " +
+	"or dns-over-quic upstream"
+
+// upstreamProxy is the SOCKS5 proxy the queries to the upstreams are sent
+// through.  The UDP queries, including the DNS-over-QUIC ones, are relayed
+// using the UDP ASSOCIATE command.  A nil *upstreamProxy is valid and means
+// that the upstreams are queried directly.
+type upstreamProxy struct {
+	// dialer connects to the hosts through the proxy over TCP.
+	dialer xproxy.ContextDialer
+
+	// user are the credentials of the proxy, if any.
+	user *url.Userinfo
+
+	// addr is the address of the proxy.
+	addr string
+}
+
+// newUpstreamProxy returns a new *upstreamProxy for the proxy with the URL
+// rawURL, either socks5://host:port or socks5h://host:port, optionally with
+// the credentials.  It returns nil if rawURL is empty.
+func newUpstreamProxy(rawURL string) (p *upstreamProxy, err error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing proxy url: %w", err)
+	} else if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("proxy url: unsupported scheme %q, want socks5", u.Scheme)
+	} else if u.Port() == "" {
+		return nil, errors.Error("proxy url: no port")
+	}
+
+	d, err := xproxy.FromURL(u, &net.Dialer{})
+	if err != nil {
+		return nil, fmt.Errorf("creating socks5 dialer: %w", err)
+	}
+
+	return &upstreamProxy{
+		// The dialer returned by [xproxy.FromURL] for SOCKS5 always
+		// implements [xproxy.ContextDialer].
+		dialer: d.(xproxy.ContextDialer),
+		user:   u.User,
+		addr:   u.Host,
+	}, nil
+}
+
+// dialTCP connects to addr through the proxy.
+func (p *upstreamProxy) dialTCP(ctx context.Context, addr string) (conn net.Conn, err error) {
+	return p.dialer.DialContext(ctx, "tcp", addr)
+}
+
+// associate establishes a new UDP association with the proxy.  The caller
+// must close pc.
+func (p *upstreamProxy) associate(ctx context.Context) (pc *socks5PacketConn, err error) {
+	return socks5Associate(ctx, (&net.Dialer{}).DialContext, p.addr, p.user)
+}
+
+// exchangeProxied sends req to the upstream through the proxy over network and
+// returns the response.
+func (u *plainUpstream) exchangeProxied(network string, req *dns.Msg) (resp *dns.Msg, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	if network == "tcp" {
+		return u.exchangeProxiedTCP(ctx, req)
+	}
+
+	pc, err := u.proxy.associate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("associating with proxy: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, pc.Close()) }()
+
+	_ = pc.SetDeadline(time.Now().Add(u.timeout))
+
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing request: %w", err)
+	}
+
+	_, err = pc.WriteTo(packed, socks5Addr(u.dialAddr))
+	if err != nil {
+		return nil, fmt.Errorf("writing to %s: %w", u.addr, err)
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		return nil, fmt.Errorf("reading from %s: %w", u.addr, err)
+	}
+
+	resp = &dns.Msg{}
+	err = resp.Unpack(buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("unpacking response from %s: %w", u.addr, err)
+	} else if resp.Id != req.Id {
+		return nil, dns.ErrId
+	}
+
+	return resp, nil
+}
+
+// exchangeProxiedTCP sends req to the upstream through the proxy over TCP and
+// returns the response.
+func (u *plainUpstream) exchangeProxiedTCP(ctx context.Context, req *dns.Msg) (resp *dns.Msg, err error) {
+	conn, err := u.proxy.dialTCP(ctx, u.dialAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing %s through proxy: %w", u.addr, err)
+	}
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	_ = conn.SetDeadline(time.Now().Add(u.timeout))
+
+	dc := &dns.Conn{Conn: conn}
+	err = dc.WriteMsg(req)
+	if err != nil {
+		return nil, fmt.Errorf("writing to %s: %w", u.addr, err)
+	}
+
+	resp, err = dc.ReadMsg()
+	if err != nil {
+		return nil, fmt.Errorf("reading from %s: %w", u.addr, err)
+	} else if resp.Id != req.Id {
+		return nil, dns.ErrId
+	}
+
+	return resp, nil
+}
+
+// newProxiedUpstream returns a new upstream for addr, which queries are sent
+// through p.  addr must be either a plain DNS upstream with an IP address or a
+// DNS-over-QUIC upstream.  It returns nil and no error if addr is the special
+// address of the default upstreams.
+func newProxiedUpstream(
+	addr string,
+	timeout time.Duration,
+	p *upstreamProxy,
+) (u upstream.Upstream, err error) {
+	if strings.HasPrefix(addr, "quic://") {
+		return newDoQUpstream(addr, timeout, p)
+	}
+
+	pu, err := newPlainUpstream(addr, timeout, nil, p)
+	if pu == nil {
+		return nil, err
+	}
+
+	return pu, nil
+}
+
+// doqUpstream is an upstream.Upstream for a DNS-over-QUIC server, which is
+// connected to through a SOCKS5 proxy.  See RFC 9250.
+type doqUpstream struct {
+	// mu protects conn, pconn, and closed.
+	mu *sync.Mutex
+
+	// conn is the current QUIC connection.  It's nil if there is none yet or
+	// the previous one is broken.
+	conn quic.Connection
+
+	// pconn is the UDP association conn uses.
+	pconn net.PacketConn
+
+	// proxy is the proxy the connection is established through.
+	proxy *upstreamProxy
+
+	// addr is the address of the upstream with the scheme and the port.
+	addr string
+
+	// host is the hostname or the IP address of the upstream, which is also
+	// used as the server name.
+	host string
+
+	// target is the address of the upstream sent to the proxy.
+	target socks5Addr
+
+	// timeout is the timeout of a single query or of the establishment of a
+	// connection.
+	timeout time.Duration
+
+	// closed is true if the upstream is closed.
+	closed bool
+}
+
+// type check
+var _ upstream.Upstream = (*doqUpstream)(nil)
+
+// newDoQUpstream returns a new *doqUpstream for addr, connecting to it through
+// p.  The hostnames are resolved by the proxy.
+func newDoQUpstream(addr string, timeout time.Duration, p *upstreamProxy) (u *doqUpstream, err error) {
+	uu, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing quic upstream: %w", err)
+	} else if uu.Hostname() == "" {
+		return nil, fmt.Errorf("quic upstream %q: no host", addr)
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	port := uu.Port()
+	if port == "" {
+		port = "853"
+	}
+
+	hostPort := net.JoinHostPort(uu.Hostname(), port)
+
+	return &doqUpstream{
+		mu:      &sync.Mutex{},
+		proxy:   p,
+		addr:    "quic://" + hostPort,
+		host:    uu.Hostname(),
+		target:  socks5Addr(hostPort),
+		timeout: timeout,
+	}, nil
+}
+
+// Address implements the [upstream.Upstream] interface for *doqUpstream.
+func (u *doqUpstream) Address() (addr string) {
+	return u.addr
+}
+
+// Exchange implements the [upstream.Upstream] interface for *doqUpstream.
+func (u *doqUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	for {
+		var conn quic.Connection
+		var fresh bool
+		conn, fresh, err = u.connection()
+		if err != nil {
+			return nil, fmt.Errorf("connecting to %s: %w", u.addr, err)
+		}
+
+		resp, err = u.exchangeConn(conn, req)
+		if err == nil {
+			return resp, nil
+		}
+
+		u.dropConn(conn)
+
+		// Retry on a new connection if the reused one is closed by the
+		// upstream or the proxy in the meantime.
+		if fresh {
+			return nil, fmt.Errorf("exchanging with %s: %w", u.addr, err)
+		}
+	}
+}
+
+// connection returns the current QUIC connection or establishes a new one.
+// fresh is true if the connection has just been established.
+func (u *doqUpstream) connection() (conn quic.Connection, fresh bool, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return nil, false, net.ErrClosed
+	} else if u.conn != nil {
+		return u.conn, false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	pconn, err := u.proxy.associate(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("associating with proxy: %w", err)
+	}
+
+	tlsConf := &tls.Config{
+		ServerName:   u.host,
+		RootCAs:      upstream.RootCAs,
+		CipherSuites: upstream.CipherSuites,
+		NextProtos:   []string{proxy.NextProtoDQ},
+		MinVersion:   tls.VersionTLS13,
+	}
+
+	var remote net.Addr = u.target
+	if ap, apErr := netip.ParseAddrPort(string(u.target)); apErr == nil {
+		remote = net.UDPAddrFromAddrPort(ap)
+	}
+
+	conn, err = quic.DialContext(ctx, pconn, remote, u.host, tlsConf, &quic.Config{
+		HandshakeIdleTimeout: u.timeout,
+	})
+	if err != nil {
+		return nil, false, errors.WithDeferred(fmt.Errorf("dialing quic: %w", err), pconn.Close())
+	}
+
+	u.conn, u.pconn = conn, pconn
+
+	return conn, true, nil
+}
+
+// exchangeConn sends req over a new stream of conn and returns the response.
+func (u *doqUpstream) exchangeConn(conn quic.Connection, req *dns.Msg) (resp *dns.Msg, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("opening stream: %w", err)
+	}
+
+	_ = stream.SetDeadline(time.Now().Add(u.timeout))
+
+	// The message ID must be zero, see RFC 9250, section 4.2.1.
+	q := req.Copy()
+	q.Id = 0
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing request: %w", err)
+	}
+
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packed)), uint16(len(packed)))
+	_, err = stream.Write(append(buf, packed...))
+	if err != nil {
+		return nil, fmt.Errorf("writing request: %w", err)
+	}
+
+	// Closing the stream only closes its sending side, which signals the end
+	// of the request.
+	err = stream.Close()
+	if err != nil {
+		return nil, fmt.Errorf("closing stream: %w", err)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(stream, dns.MaxMsgSize+2))
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	} else if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return nil, errors.Error("bad response length")
+	}
+
+	resp = &dns.Msg{}
+	err = resp.Unpack(data[2:])
+	if err != nil {
+		return nil, fmt.Errorf("unpacking response: %w", err)
+	}
+
+	resp.Id = req.Id
+
+	return resp, nil
+}
+
+// dropConn closes conn and its UDP association, if it's still the current
+// connection.
+func (u *doqUpstream) dropConn(conn quic.Connection) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != conn {
+		return
+	}
+
+	u.closeLocked()
+}
+
+// closeLocked closes the current connection, if any.  u.mu must be locked.
+func (u *doqUpstream) closeLocked() {
+	if u.conn == nil {
+		return
+	}
+
+	err := u.conn.CloseWithError(quic.ApplicationErrorCode(proxy.DoQCodeNoError), "")
+	if err != nil {
+		log.Debug("dnsforward: closing quic connection to %s: %s", u.addr, err)
+	}
+
+	err = u.pconn.Close()
+	if err != nil {
+		log.Debug("dnsforward: closing association for %s: %s", u.addr, err)
+	}
+
+	u.conn, u.pconn = nil, nil
+}
+
+// Close implements the [upstream.Upstream] interface for *doqUpstream.
+func (u *doqUpstream) Close() (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+	u.closeLocked()
+
+	return nil
+}
@@ -0,0 +1,450 @@
+package dnsforward
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSOCKS5Server is a minimal SOCKS5 proxy supporting the CONNECT and the
+// UDP ASSOCIATE commands with the username and password authentication.
+type testSOCKS5Server struct {
+	// udpRelayed is the number of the relayed datagrams.
+	udpRelayed atomic.Uint32
+
+	// tcpConnected is the number of the relayed TCP connections.
+	tcpConnected atomic.Uint32
+
+	// user and pass are the credentials the clients must use.
+	user string
+	pass string
+}
+
+// start starts s and returns its address.
+func (s *testSOCKS5Server) start(t *testing.T) (addr string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	go func() {
+		for {
+			conn, aErr := l.Accept()
+			if aErr != nil {
+				return
+			}
+
+			go s.handle(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// handle serves a single client connection.
+func (s *testSOCKS5Server) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	buf := make([]byte, 512)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	} else if _, err = io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+
+	_, _ = conn.Write([]byte{socks5Version, socks5AuthPassword})
+
+	// Read the username and the password.
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+
+	user := make([]byte, buf[1])
+	_, _ = io.ReadFull(conn, user)
+	_, _ = io.ReadFull(conn, buf[:1])
+	pass := make([]byte, buf[0])
+	_, _ = io.ReadFull(conn, pass)
+	if string(user) != s.user || string(pass) != s.pass {
+		_, _ = conn.Write([]byte{socks5PasswordVersion, 1})
+
+		return
+	}
+
+	_, _ = conn.Write([]byte{socks5PasswordVersion, 0})
+
+	// Read the request.
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+
+	cmd := buf[1]
+	target, err := readSOCKS5AddrPort(conn, buf[3])
+	if err != nil {
+		return
+	}
+
+	switch cmd {
+	case 0x01:
+		s.connect(conn, target)
+	case socks5CmdUDPAssociate:
+		s.associate(conn)
+	}
+}
+
+// connect relays conn to target.
+func (s *testSOCKS5Server) connect(conn net.Conn, target netip.AddrPort) {
+	tc, err := net.Dial("tcp", target.String())
+	if err != nil {
+		return
+	}
+	defer func() { _ = tc.Close() }()
+
+	s.tcpConnected.Add(1)
+	_, _ = conn.Write([]byte{socks5Version, socks5ReplySucceeded, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+
+	go func() { _, _ = io.Copy(tc, conn) }()
+	_, _ = io.Copy(conn, tc)
+}
+
+// associate relays the datagrams from the client of conn until conn is
+// closed.
+func (s *testSOCKS5Server) associate(conn net.Conn) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		return
+	}
+	defer func() { _ = relay.Close() }()
+
+	reply := []byte{socks5Version, socks5ReplySucceeded, 0}
+	reply, _ = appendSOCKS5Addr(reply, relay.LocalAddr().String())
+	_, _ = conn.Write(reply)
+
+	go func() {
+		var clientAddr *net.UDPAddr
+		buf := make([]byte, dns.MaxMsgSize+maxSOCKS5UDPHeaderLen)
+		for {
+			n, from, rErr := relay.ReadFromUDP(buf)
+			if rErr != nil {
+				return
+			}
+
+			if clientAddr == nil || from.String() == clientAddr.String() {
+				clientAddr = from
+				addr, hdrLen, pErr := parseSOCKS5UDPHeader(buf[:n])
+				if pErr != nil {
+					continue
+				}
+
+				s.udpRelayed.Add(1)
+				ap := addr.(*net.UDPAddr).AddrPort()
+				_, _ = relay.WriteToUDPAddrPort(buf[hdrLen:n], ap)
+
+				continue
+			}
+
+			// A response from the target.
+			resp, _ := appendSOCKS5Addr([]byte{0, 0, 0}, from.String())
+			_, _ = relay.WriteToUDP(append(resp, buf[:n]...), clientAddr)
+		}
+	}()
+
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+// startUDPServer starts a plain DNS server on UDP and returns its address.  The
+// server answers each query with a single A record.
+func startUDPServer(t *testing.T) (addr string) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler:    dns.HandlerFunc(answerA),
+	}
+
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	return pc.LocalAddr().String()
+}
+
+// answerA answers req with a single A record.
+func answerA(w dns.ResponseWriter, req *dns.Msg) {
+	_ = w.WriteMsg(newAResp(req))
+}
+
+// newAResp returns the response to req with a single A record.
+func newAResp(req *dns.Msg) (resp *dns.Msg) {
+	resp = (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   req.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}}
+
+	return resp
+}
+
+func TestPlainUpstream_Exchange_proxy(t *testing.T) {
+	srv := &testSOCKS5Server{user: "user", pass: "pass"}
+	proxyAddr := srv.start(t)
+
+	p, err := newUpstreamProxy("socks5://user:pass@" + proxyAddr)
+	require.NoError(t, err)
+
+	udpAddr := startUDPServer(t)
+	tcpAddr := startStreamServer(t, "tcp", "127.0.0.1:0")
+
+	t.Run("udp", func(t *testing.T) {
+		u, uErr := newPlainUpstream(udpAddr, time.Second, nil, p)
+		require.NoError(t, uErr)
+
+		resp, uErr := u.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+		require.NoError(t, uErr)
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, uint32(1), srv.udpRelayed.Load())
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		u, uErr := newPlainUpstream("tcp://"+tcpAddr, time.Second, nil, p)
+		require.NoError(t, uErr)
+
+		resp, uErr := u.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+		require.NoError(t, uErr)
+		require.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, uint32(1), srv.tcpConnected.Load())
+	})
+
+	t.Run("bad_credentials", func(t *testing.T) {
+		badP, pErr := newUpstreamProxy("socks5://user:wrong@" + proxyAddr)
+		require.NoError(t, pErr)
+
+		u, uErr := newPlainUpstream(udpAddr, time.Second, nil, badP)
+		require.NoError(t, uErr)
+
+		_, uErr = u.Exchange((&dns.Msg{}).SetQuestion("example.org.", dns.TypeA))
+		testutil.AssertErrorMsg(
+			t,
+			"associating with proxy: authenticating: bad credentials",
+			uErr,
+		)
+	})
+}
+
+// startDoQServer starts a DNS-over-QUIC server and returns its address, the
+// pool with its certificate, and the number of the accepted connections.  The
+// server answers each query with a single A record.
+func startDoQServer(t *testing.T) (addr string, roots *x509.CertPool, conns *atomic.Uint32) {
+	t.Helper()
+
+	tlsConf, certPem, _ := createServerTLSConfig(t)
+	tlsConf.NextProtos = doqProtos
+
+	l, err := quic.ListenAddr("127.0.0.1:0", tlsConf, nil)
+	require.NoError(t, err)
+
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	conns = &atomic.Uint32{}
+	go func() {
+		for {
+			conn, aErr := l.Accept(context.Background())
+			if aErr != nil {
+				return
+			}
+
+			conns.Add(1)
+			go serveTestDoQConn(conn)
+		}
+	}()
+
+	roots = x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPem)
+
+	return l.Addr().String(), roots, conns
+}
+
+// serveTestDoQConn answers the queries on the streams of conn.
+func serveTestDoQConn(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		data, err := io.ReadAll(stream)
+		if err != nil || len(data) < 2 {
+			return
+		}
+
+		req := &dns.Msg{}
+		if err = req.Unpack(data[2:]); err != nil {
+			return
+		}
+
+		packed, _ := newAResp(req).Pack()
+		buf := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+		_, _ = stream.Write(append(buf, packed...))
+		_ = stream.Close()
+	}
+}
+
+func TestDoQUpstream_Exchange(t *testing.T) {
+	srv := &testSOCKS5Server{user: "user", pass: "pass"}
+	proxyAddr := srv.start(t)
+
+	p, err := newUpstreamProxy("socks5://user:pass@" + proxyAddr)
+	require.NoError(t, err)
+
+	doqAddr, roots, conns := startDoQServer(t)
+
+	prevRoots := upstream.RootCAs
+	upstream.RootCAs = roots
+	t.Cleanup(func() { upstream.RootCAs = prevRoots })
+
+	_, port, err := net.SplitHostPort(doqAddr)
+	require.NoError(t, err)
+
+	u, err := newDoQUpstream("quic://"+net.JoinHostPort(tlsServerName, port), time.Second, p)
+	require.NoError(t, err)
+
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	// Resolve the server name of the certificate to the test server.
+	u.target = socks5Addr(doqAddr)
+
+	for i := 0; i < 2; i++ {
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+		resp, exErr := u.Exchange(req)
+		require.NoError(t, exErr)
+
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, req.Id, resp.Id)
+	}
+
+	// The connection is reused.
+	assert.Equal(t, uint32(1), conns.Load())
+}
+
+func TestParseUpstreamsConfig_proxy(t *testing.T) {
+	pool := newUpstreamPool()
+	err := pool.setConfig(UpstreamPoolConfig{
+		ProxyURL: "socks5://127.0.0.1:1080",
+	}, false)
+	require.NoError(t, err)
+
+	conf, err := ParseUpstreamsConfig([]string{
+		"1.2.3.4",
+		"quic://dns.example",
+		"[/local/]192.168.1.1#interface=lo",
+	}, &upstream.Options{}, pool)
+	require.NoError(t, err)
+
+	require.Len(t, conf.Upstreams, 2)
+
+	pu, ok := conf.Upstreams[0].(*pooledUpstream)
+	require.True(t, ok)
+
+	plain, ok := pu.Upstream.(*plainUpstream)
+	require.True(t, ok)
+
+	assert.NotNil(t, plain.proxy)
+	assert.Equal(t, "quic://dns.example:853", conf.Upstreams[1].Address())
+
+	ups := conf.DomainReservedUpstreams["local."]
+	require.Len(t, ups, 1)
+
+	local, ok := ups[0].(*pooledUpstream).Upstream.(*plainUpstream)
+	require.True(t, ok)
+
+	assert.Nil(t, local.proxy)
+
+	_, err = ParseUpstreamsConfig([]string{
+		"tls://dns.example",
+	}, &upstream.Options{}, pool)
+	testutil.AssertErrorMsg(
+		t,
+		`upstream at index 0: upstream "tls://dns.example": proxying requires plain dns `+
+			`upstream with ip address or dns-over-quic upstream`,
+		err,
+	)
+
+	t.Run("bad_config", func(t *testing.T) {
+		badConf := UpstreamPoolConfig{
+			ProxyURL:    "socks5://127.0.0.1:1080",
+			BindAddress: netip.MustParseAddr("127.0.0.1"),
+		}
+		testutil.AssertErrorMsg(
+			t,
+			"proxy_url: binding and proxying are mutually exclusive",
+			badConf.validate(),
+		)
+
+		err = newUpstreamPool().setConfig(UpstreamPoolConfig{
+			ProxyURL: "http://127.0.0.1:3128",
+		}, false)
+		testutil.AssertErrorMsg(
+			t,
+			`proxy_url: proxy url: unsupported scheme "http", want socks5`,
+			err,
+		)
+	})
+}
+
+func TestSOCKS5Addr(t *testing.T) {
+	testCases := []struct {
+		name     string
+		hostPort string
+	}{{
+		name:     "ipv4",
+		hostPort: "1.2.3.4:53",
+	}, {
+		name:     "ipv6",
+		hostPort: "[2001:db8::1]:853",
+	}, {
+		name:     "domain",
+		hostPort: "dns.example:853",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := appendSOCKS5Addr([]byte{0, 0, 0}, tc.hostPort)
+			require.NoError(t, err)
+
+			addr, hdrLen, err := parseSOCKS5UDPHeader(append(b, "payload"...))
+			require.NoError(t, err)
+
+			assert.Equal(t, len(b), hdrLen)
+			assert.Equal(t, tc.hostPort, addr.String())
+		})
+	}
+
+	_, _, err := parseSOCKS5UDPHeader([]byte{0, 0, 1, socks5AddrIPv4, 1, 2, 3, 4, 0, 53})
+	testutil.AssertErrorMsg(t, "fragmented datagram", err)
+}
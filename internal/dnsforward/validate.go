@@ -0,0 +1,93 @@
+package dnsforward
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// Validate returns the errors of the values of c, which are otherwise only
+// found when the server is prepared, so that the configuration can be checked
+// without starting the server.  errs is nil if c is valid.
+func (c *FilteringConfig) Validate() (errs []error) {
+	upstreams, err := c.loadUpstreams()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("upstream_dns_file: %w", err))
+	} else if err = ValidateUpstreams(upstreams); err != nil {
+		errs = append(errs, fmt.Errorf("upstream_dns: %w", err))
+	}
+
+	err = validateBootstraps(c.BootstrapDNS)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("bootstrap_dns: %w", err))
+	}
+
+	err = validateBlockingMode(c.BlockingMode, c.BlockingIPv4, c.BlockingIPv6)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("blocking_mode: %w", err))
+	}
+
+	err = c.BlockedResponseSOA.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("blocked_response_soa: %w", err))
+	}
+
+	err = c.UpstreamPool.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("upstream_pool: %w", err))
+	}
+
+	err = c.RecursiveMode.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("recursive_mode: %w", err))
+	}
+
+	err = c.UpstreamFailover.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("upstream_failover: %w", err))
+	}
+
+	_, err = newAccessCtx(
+		c.AllowedClients,
+		c.DisallowedClients,
+		c.BlockedHosts,
+		c.TemporaryAllowedClients,
+	)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("access settings: %w", err))
+	}
+
+	_, err = netutil.ParseSubnets(c.TrustedProxies...)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+
+	for i, s := range c.BogusNXDomain {
+		_, err = netutil.ParseSubnet(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bogus_nxdomain: subnet at index %d: %w", i, err))
+		}
+	}
+
+	_, err = ParseAnswerRules(c.AnswerRules)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("answer_rules: %w", err))
+	}
+
+	_, err = parseRebindingAllowlist(c.RebindingAllowlist)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("rebinding_allowlist: %w", err))
+	}
+
+	_, err = loadLocalZones(c.LocalZones)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("local_zones: %w", err))
+	}
+
+	err = c.ZoneTransfer.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("zone_transfer: %w", err))
+	}
+
+	return errs
+}
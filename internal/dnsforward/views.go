@@ -0,0 +1,151 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"golang.org/x/exp/slices"
+)
+
+// View is a named set of DNS settings for the clients with certain tags or
+// from certain subnets, so that the same domain may be resolved differently
+// for different groups of clients.  The settings of a view are evaluated
+// before the global ones.
+type View struct {
+	// upsConf is the parsed upstream configuration of Upstreams.  It's nil if
+	// there are no upstreams in the view.
+	upsConf *proxy.UpstreamConfig
+
+	// Name is the unique name of the view.
+	Name string `yaml:"name"`
+
+	// Tags are the client tags of the view.  A client matches the view if it
+	// has any of them.
+	Tags []string `yaml:"tags"`
+
+	// Subnets are the networks of the view.  A client matches the view if its
+	// IP address is within any of them.
+	Subnets []netip.Prefix `yaml:"subnets"`
+
+	// Rewrites are the legacy DNS rewrites of the view, which are checked
+	// before the global ones.
+	Rewrites []*filtering.LegacyRewrite `yaml:"rewrites"`
+
+	// BlockedServices, if not nil, are the services blocked for the clients of
+	// the view instead of the global blocked services.  The clients with their
+	// own blocked services aren't affected.
+	BlockedServices []string `yaml:"blocked_services"`
+
+	// Upstreams, if not empty, are the upstreams used for the clients of the
+	// view instead of the global ones.  The clients with their own upstreams
+	// aren't affected.
+	Upstreams []string `yaml:"upstreams"`
+}
+
+// matches returns true if the client with ip and tags belongs to v.
+func (v *View) matches(ip netip.Addr, tags []string) (ok bool) {
+	for _, t := range tags {
+		if slices.Contains(v.Tags, t) {
+			return true
+		}
+	}
+
+	if !ip.IsValid() {
+		return false
+	}
+
+	for _, subnet := range v.Subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// prepareViews validates s.conf.Views and prepares their rewrites and
+// upstreams.
+func (s *Server) prepareViews() (err error) {
+	names := stringutil.NewSet()
+	for i, v := range s.conf.Views {
+		if v.Name == "" {
+			return fmt.Errorf("view at index %d: name: %w", i, errors.Error("empty"))
+		} else if names.Has(v.Name) {
+			return fmt.Errorf("view at index %d: name %q: %w", i, v.Name, errors.Error("duplicated"))
+		}
+
+		names.Add(v.Name)
+
+		err = s.prepareView(v)
+		if err != nil {
+			return fmt.Errorf("view %q: %w", v.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// prepareView prepares the rewrites and the upstreams of v.
+func (s *Server) prepareView(v *View) (err error) {
+	err = filtering.PrepareRewrites(v.Rewrites)
+	if err != nil {
+		return fmt.Errorf("rewrites: %w", err)
+	}
+
+	v.upsConf = nil
+	upstreams := stringutil.FilterOut(v.Upstreams, IsCommentOrEmpty)
+	if len(upstreams) == 0 {
+		return nil
+	}
+
+	v.upsConf, err = ParseUpstreamsConfig(
+		upstreams,
+		&upstream.Options{
+			Bootstrap:    s.conf.BootstrapDNS,
+			Timeout:      s.conf.UpstreamTimeout,
+			HTTPVersions: UpstreamHTTPVersions(s.conf.UseHTTP3Upstreams),
+		},
+		s.upsPool,
+	)
+	if err != nil {
+		return fmt.Errorf("upstreams: %w", err)
+	}
+
+	return nil
+}
+
+// findView returns the first view the client with ip and tags belongs to, or
+// nil if there is none.
+func (s *Server) findView(ip net.IP, tags []string) (v *View) {
+	if len(s.conf.Views) == 0 {
+		return nil
+	}
+
+	addr, _ := netutil.IPToAddrNoMapped(ip)
+	for _, v = range s.conf.Views {
+		if v.matches(addr, tags) {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// applyView applies the settings of the client's view, if any, to setts.
+func (s *Server) applyView(v *View, setts *filtering.Settings) {
+	if v == nil {
+		return
+	}
+
+	setts.Rewrites = v.Rewrites
+	if v.BlockedServices != nil && !setts.UseOwnBlockedServices {
+		s.dnsFilter.ApplyBlockedServices(setts, v.BlockedServices)
+	}
+}
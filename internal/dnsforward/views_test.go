@@ -0,0 +1,135 @@
+package dnsforward
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_findView(t *testing.T) {
+	iotView := &View{
+		Name:    "iot",
+		Subnets: []netip.Prefix{netip.MustParsePrefix("192.168.20.0/24")},
+	}
+	trustedView := &View{
+		Name: "trusted",
+		Tags: []string{"user_admin"},
+	}
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				Views: []*View{iotView, trustedView},
+			},
+		},
+	}
+
+	testCases := []struct {
+		want *View
+		name string
+		ip   net.IP
+		tags []string
+	}{{
+		want: iotView,
+		name: "subnet",
+		ip:   net.IP{192, 168, 20, 5},
+		tags: nil,
+	}, {
+		want: trustedView,
+		name: "tag",
+		ip:   net.IP{192, 168, 10, 5},
+		tags: []string{"device_pc", "user_admin"},
+	}, {
+		want: iotView,
+		name: "first_match",
+		ip:   net.IP{192, 168, 20, 5},
+		tags: []string{"user_admin"},
+	}, {
+		want: nil,
+		name: "none",
+		ip:   net.IP{192, 168, 10, 5},
+		tags: []string{"device_pc"},
+	}, {
+		want: nil,
+		name: "no_ip",
+		ip:   nil,
+		tags: nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := s.findView(tc.ip, tc.tags)
+			assert.True(t, tc.want == v)
+		})
+	}
+}
+
+func TestServer_prepareViews(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		views      []*View
+	}{{
+		name:       "success",
+		wantErrMsg: "",
+		views: []*View{{
+			Name:      "iot",
+			Rewrites:  []*filtering.LegacyRewrite{{Domain: "host.com", Answer: "1.2.3.4"}},
+			Upstreams: []string{"# comment", "1.1.1.1"},
+		}},
+	}, {
+		name:       "empty_name",
+		wantErrMsg: "view at index 0: name: empty",
+		views:      []*View{{}},
+	}, {
+		name:       "duplicated_name",
+		wantErrMsg: `view at index 1: name "iot": duplicated`,
+		views:      []*View{{Name: "iot"}, {Name: "iot"}},
+	}, {
+		name:       "bad_rewrite",
+		wantErrMsg: `view "iot": rewrites: at index 0: nil rewrite entry`,
+		views: []*View{{
+			Name:     "iot",
+			Rewrites: []*filtering.LegacyRewrite{nil},
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				conf: ServerConfig{
+					FilteringConfig: FilteringConfig{
+						Views: tc.views,
+					},
+				},
+			}
+
+			err := s.prepareViews()
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+
+	t.Run("upstreams", func(t *testing.T) {
+		v := &View{
+			Name:      "iot",
+			Upstreams: []string{"# comment", "1.1.1.1"},
+		}
+		s := &Server{
+			conf: ServerConfig{
+				FilteringConfig: FilteringConfig{
+					Views: []*View{v},
+				},
+			},
+		}
+
+		require.NoError(t, s.prepareViews())
+		require.NotNil(t, v.upsConf)
+
+		assert.Len(t, v.upsConf.Upstreams, 1)
+	})
+}
@@ -0,0 +1,750 @@
+package dnsforward
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash/maphash"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+// ZoneTransferConfig is the configuration of the zone transfers of the local
+// DNS data, that is the hosts from the DHCP leases and the legacy DNS rewrites,
+// to the secondary DNS servers.
+type ZoneTransferConfig struct {
+	// Zones are the origins of the zones which can be transferred.  If empty,
+	// only the zone of the local domain name is.
+	Zones []string `yaml:"zones"`
+
+	// NameServers are the names of the authoritative servers put into the NS
+	// records of the zones.  The first one is also the primary server in the
+	// SOA records.
+	NameServers []string `yaml:"name_servers"`
+
+	// Secondaries are the IP addresses of the secondary servers allowed to
+	// request the transfers.
+	Secondaries []netip.Addr `yaml:"secondaries"`
+
+	// TSIGKeys are the keys, one of which must sign the transfer requests.
+	TSIGKeys []*TSIGKey `yaml:"tsig_keys"`
+
+	// Enabled defines if the zone transfers are enabled.
+	Enabled bool `yaml:"enabled"`
+}
+
+// TSIGKey is a shared secret key for the transaction signatures, see RFC 8945.
+type TSIGKey struct {
+	// Name is the name of the key.
+	Name string `yaml:"name"`
+
+	// Algorithm is the name of the HMAC algorithm.  If empty, hmac-sha256 is
+	// used.
+	Algorithm string `yaml:"algorithm"`
+
+	// Secret is the base64-encoded secret.
+	Secret string `yaml:"secret"`
+}
+
+// Parameters of the SOA records of the transferred zones.  The refresh
+// interval is short, since the zones are generated as the DHCP leases and
+// the rewrites change and no NOTIFY messages are sent.
+const (
+	xfrSOARefresh = 300
+	xfrSOARetry   = 60
+	xfrSOAExpire  = 7 * 24 * 60 * 60
+)
+
+// xfrTSIGFudge is the permitted error in the time signed of the responses.
+const xfrTSIGFudge = 300
+
+// xfrEnvelopeSize is the maximum size of the uncompressed records in a single
+// message of a zone transfer.  It leaves the room for the header, the question,
+// and the OPT and the TSIG records within [dns.MaxMsgSize].
+const xfrEnvelopeSize = dns.MaxMsgSize - 2048
+
+// xfrTSIGAlgorithms are the supported TSIG algorithms.
+var xfrTSIGAlgorithms = []string{
+	dns.HmacSHA1,
+	dns.HmacSHA224,
+	dns.HmacSHA256,
+	dns.HmacSHA384,
+	dns.HmacSHA512,
+}
+
+// validate returns an error if c is enabled and isn't valid.
+func (c *ZoneTransferConfig) validate() (err error) {
+	if !c.Enabled {
+		return nil
+	}
+
+	_, err = newZoneTransfer(c, defaultLocalDomainSuffix)
+
+	return err
+}
+
+// zoneTransfer serves the zone transfers to the secondaries.
+type zoneTransfer struct {
+	// keys are the TSIG keys by their lowercased fully-qualified names.
+	keys map[string]*xfrKey
+
+	// mu protects serials.
+	mu *sync.Mutex
+
+	// serials are the states of the zones by their origins.
+	serials map[string]*xfrZoneState
+
+	// origins are the lowercased fully-qualified origins of the zones.
+	origins []string
+
+	// nameServers are the fully-qualified names of the authoritative servers.
+	nameServers []string
+
+	// secondaries are the addresses of the secondaries.
+	secondaries []netip.Addr
+
+	// seed is the seed of the hash of the zone data.
+	seed maphash.Seed
+}
+
+// xfrKey is a prepared TSIG key.
+type xfrKey struct {
+	// name is the lowercased fully-qualified name of the key.
+	name string
+
+	// algorithm is the fully-qualified name of the algorithm.
+	algorithm string
+
+	// secret is the base64-encoded secret, as used by package dns.
+	secret string
+}
+
+// xfrZoneState is the state of a transferred zone used to detect the changes
+// of its data.
+type xfrZoneState struct {
+	// sum is the hash of the records of the zone.
+	sum uint64
+
+	// serial is the serial of the zone with these records.
+	serial uint32
+}
+
+// newZoneTransfer returns a new properly initialized *zoneTransfer.  conf must
+// not be nil.  localDomain is the origin of the zone used if conf has none.
+func newZoneTransfer(conf *ZoneTransferConfig, localDomain string) (x *zoneTransfer, err error) {
+	x = &zoneTransfer{
+		keys:        map[string]*xfrKey{},
+		mu:          &sync.Mutex{},
+		serials:     map[string]*xfrZoneState{},
+		secondaries: slices.Clone(conf.Secondaries),
+		seed:        maphash.MakeSeed(),
+	}
+
+	zones := conf.Zones
+	if len(zones) == 0 {
+		zones = []string{localDomain}
+	}
+
+	for i, z := range zones {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(z, "."))
+		if err != nil {
+			return nil, fmt.Errorf("zones: at index %d: %w", i, err)
+		}
+
+		x.origins = append(x.origins, dns.CanonicalName(z))
+	}
+
+	if len(conf.NameServers) == 0 {
+		return nil, errors.Error("name_servers: no values")
+	}
+
+	for i, ns := range conf.NameServers {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(ns, "."))
+		if err != nil {
+			return nil, fmt.Errorf("name_servers: at index %d: %w", i, err)
+		}
+
+		x.nameServers = append(x.nameServers, dns.CanonicalName(ns))
+	}
+
+	if len(x.secondaries) == 0 {
+		return nil, errors.Error("secondaries: no values")
+	}
+
+	for i, addr := range x.secondaries {
+		if !addr.IsValid() {
+			return nil, fmt.Errorf("secondaries: at index %d: bad ip address", i)
+		}
+
+		x.secondaries[i] = addr.Unmap()
+	}
+
+	if len(conf.TSIGKeys) == 0 {
+		return nil, errors.Error("tsig_keys: no values")
+	}
+
+	for i, k := range conf.TSIGKeys {
+		var key *xfrKey
+		key, err = newXFRKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("tsig_keys: at index %d: %w", i, err)
+		} else if _, ok := x.keys[key.name]; ok {
+			return nil, fmt.Errorf("tsig_keys: at index %d: duplicate name %q", i, k.Name)
+		}
+
+		x.keys[key.name] = key
+	}
+
+	return x, nil
+}
+
+// newXFRKey validates k and returns the prepared key.
+func newXFRKey(k *TSIGKey) (key *xfrKey, err error) {
+	if k == nil {
+		return nil, errors.Error("no key")
+	}
+
+	err = netutil.ValidateDomainName(strings.TrimSuffix(k.Name, "."))
+	if err != nil {
+		return nil, fmt.Errorf("name: %w", err)
+	}
+
+	alg := dns.HmacSHA256
+	if k.Algorithm != "" {
+		alg = dns.CanonicalName(k.Algorithm)
+	}
+
+	if !slices.Contains(xfrTSIGAlgorithms, alg) {
+		return nil, fmt.Errorf("algorithm: unsupported value %q", k.Algorithm)
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(k.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("secret: %w", err)
+	} else if len(secret) == 0 {
+		return nil, errors.Error("secret: empty value")
+	}
+
+	return &xfrKey{
+		name:      dns.CanonicalName(k.Name),
+		algorithm: alg,
+		secret:    k.Secret,
+	}, nil
+}
+
+// isSecondary returns true if addr is one of the secondaries.
+func (x *zoneTransfer) isSecondary(addr netip.Addr) (ok bool) {
+	return slices.Contains(x.secondaries, addr.Unmap())
+}
+
+// zoneFor returns the origin of the zone with the apex name or an empty string
+// if there is no such zone.
+func (x *zoneTransfer) zoneFor(name string) (origin string) {
+	name = strings.ToLower(name)
+	if slices.Contains(x.origins, name) {
+		return name
+	}
+
+	return ""
+}
+
+// verify verifies the TSIG record of req, which must be signed.  tsigErr is the
+// TSIG error code to respond with if it isn't valid.  key is the key, with
+// which the response must be signed, and is only nil if the key isn't known.
+func (x *zoneTransfer) verify(req *dns.Msg) (key *xfrKey, tsigErr uint16) {
+	t := req.IsTsig()
+	key, ok := x.keys[strings.ToLower(t.Hdr.Name)]
+	if !ok || !strings.EqualFold(t.Algorithm, key.algorithm) {
+		return nil, dns.RcodeBadKey
+	}
+
+	// The original wire format of the request isn't available, so try both
+	// the uncompressed and the compressed forms, which covers the messages
+	// of the common implementations.
+	compress := req.Compress
+	defer func() { req.Compress = compress }()
+
+	for _, compress := range []bool{false, true} {
+		req.Compress = compress
+		b, err := req.Pack()
+		if err != nil {
+			return key, dns.RcodeBadSig
+		}
+
+		err = dns.TsigVerify(b, key.secret, "", false)
+		if err == nil {
+			return key, dns.RcodeSuccess
+		} else if errors.Is(err, dns.ErrTime) {
+			return key, dns.RcodeBadTime
+		}
+	}
+
+	return key, dns.RcodeBadSig
+}
+
+// serial returns the serial of the zone with origin and the records rrs, which
+// must be sorted.  The serial is the current Unix time when the records
+// change, so that it survives the restarts, unless it isn't greater than the
+// previous one.
+func (x *zoneTransfer) serial(origin string, rrs []dns.RR, now time.Time) (serial uint32) {
+	h := &maphash.Hash{}
+	h.SetSeed(x.seed)
+	for _, rr := range rrs {
+		_, _ = h.WriteString(rr.String())
+		_ = h.WriteByte('\n')
+	}
+
+	sum := h.Sum64()
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	st, ok := x.serials[origin]
+	if ok && st.sum == sum {
+		return st.serial
+	}
+
+	serial = uint32(now.Unix())
+	if ok && serial <= st.serial {
+		serial = st.serial + 1
+	}
+
+	x.serials[origin] = &xfrZoneState{
+		sum:    sum,
+		serial: serial,
+	}
+
+	return serial
+}
+
+// apex returns the SOA and the NS records of the zone with origin.
+func (x *zoneTransfer) apex(origin string, serial, ttl uint32) (soa *dns.SOA, nss []dns.RR) {
+	hdr := func(rrType uint16) (h dns.RR_Header) {
+		return dns.RR_Header{
+			Name:   origin,
+			Rrtype: rrType,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		}
+	}
+
+	soa = &dns.SOA{
+		Hdr:     hdr(dns.TypeSOA),
+		Ns:      x.nameServers[0],
+		Mbox:    "hostmaster." + origin,
+		Serial:  serial,
+		Refresh: xfrSOARefresh,
+		Retry:   xfrSOARetry,
+		Expire:  xfrSOAExpire,
+		Minttl:  ttl,
+	}
+
+	for _, ns := range x.nameServers {
+		nss = append(nss, &dns.NS{
+			Hdr: hdr(dns.TypeNS),
+			Ns:  ns,
+		})
+	}
+
+	return soa, nss
+}
+
+// zoneRecords returns the sorted records of the zone with origin other than
+// the SOA and the NS ones: the hosts from the DHCP leases and the legacy DNS
+// rewrites within it.
+func (s *Server) zoneRecords(origin string) (rrs []dns.RR) {
+	ttl := s.conf.BlockedResponseTTL
+	addrRR := func(name string, ip netip.Addr) (rr dns.RR) {
+		hdr := dns.RR_Header{
+			Name:  name,
+			Class: dns.ClassINET,
+			Ttl:   ttl,
+		}
+
+		if ip.Is4() {
+			hdr.Rrtype = dns.TypeA
+
+			return &dns.A{Hdr: hdr, A: ip.AsSlice()}
+		}
+
+		hdr.Rrtype = dns.TypeAAAA
+
+		return &dns.AAAA{Hdr: hdr, AAAA: ip.AsSlice()}
+	}
+
+	if s.dhcpServer != nil && s.dhcpServer.Enabled() {
+		func() {
+			s.tableHostToIPLock.Lock()
+			defer s.tableHostToIPLock.Unlock()
+
+			for _, t := range []hostToIPTable{s.tableHostToIP, s.tableHostToIP6} {
+				for host, ip := range t {
+					name := dns.Fqdn(host)
+					if dns.IsSubDomain(origin, name) {
+						rrs = append(rrs, addrRR(name, ip))
+					}
+				}
+			}
+		}()
+	}
+
+	var rws []*filtering.LegacyRewrite
+	if s.dnsFilter != nil {
+		rws = s.dnsFilter.LegacyRewrites()
+	}
+
+	var cnames []dns.RR
+	for _, rw := range rws {
+		name := dns.Fqdn(rw.Domain)
+		if !dns.IsSubDomain(origin, name) {
+			continue
+		}
+
+		switch rw.Type {
+		case dns.TypeA, dns.TypeAAAA:
+			// The rewrites keeping the upstream answers have no IP addresses.
+			ip, ok := netip.AddrFromSlice(rw.IP)
+			if ok {
+				rrs = append(rrs, addrRR(name, ip.Unmap()))
+			}
+		case dns.TypeCNAME:
+			target := dns.Fqdn(rw.Answer)
+			if name != origin && !strings.EqualFold(target, name) {
+				cnames = append(cnames, &dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name:   name,
+						Rrtype: dns.TypeCNAME,
+						Class:  dns.ClassINET,
+						Ttl:    ttl,
+					},
+					Target: target,
+				})
+			}
+		default:
+			// Go on.
+		}
+	}
+
+	return sortZoneRecords(rrs, cnames)
+}
+
+// sortZoneRecords returns the deduplicated addrs and cnames sorted by their
+// owner names, the CNAME records which conflict with other ones removed.
+func sortZoneRecords(addrs, cnames []dns.RR) (rrs []dns.RR) {
+	names := map[string]unit{}
+	for _, rr := range addrs {
+		if !containsRR(rrs, rr) {
+			rrs = append(rrs, rr)
+			names[rr.Header().Name] = unit{}
+		}
+	}
+
+	for _, rr := range cnames {
+		name := rr.Header().Name
+		if _, ok := names[name]; ok {
+			log.Debug("dnsforward: zone transfer: skipping conflicting cname for %q", name)
+
+			continue
+		}
+
+		rrs = append(rrs, rr)
+		names[name] = unit{}
+	}
+
+	slices.SortFunc(rrs, func(a, b dns.RR) (sortsBefore bool) {
+		return a.String() < b.String()
+	})
+
+	return rrs
+}
+
+// containsRR returns true if rrs contain the records equal to rr.
+func containsRR(rrs []dns.RR, rr dns.RR) (ok bool) {
+	for _, r := range rrs {
+		if dns.IsDuplicate(r, rr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// processZoneTransfer responds to the zone transfer requests, see RFC 5936 and
+// RFC 1995, and to the SOA requests for the apexes of the transferred zones
+// from the secondaries.  The incremental transfers aren't supported, so the
+// IXFR requests are responded to with the full zones.
+func (s *Server) processZoneTransfer(dctx *dnsContext) (rc resultCode) {
+	s.serverLock.RLock()
+	x := s.xfr
+	s.serverLock.RUnlock()
+
+	if x == nil {
+		return resultCodeSuccess
+	}
+
+	pctx := dctx.proxyCtx
+	req := pctx.Req
+	q := req.Question[0]
+	qt := q.Qtype
+	if q.Qclass != dns.ClassINET || (qt != dns.TypeAXFR && qt != dns.TypeIXFR && qt != dns.TypeSOA) {
+		return resultCodeSuccess
+	}
+
+	origin := x.zoneFor(q.Name)
+	if origin == "" {
+		return resultCodeSuccess
+	}
+
+	isSecondary := x.isSecondary(netutil.NetAddrToAddrPort(pctx.Addr).Addr())
+	if qt == dns.TypeSOA && !isSecondary {
+		// Let the SOA requests from everyone else be processed as usual.
+		return resultCodeSuccess
+	}
+
+	resp, err := s.zoneTransferResponse(x, pctx, origin, isSecondary)
+	if err != nil {
+		log.Error("dnsforward: zone transfer of %q to %s: %s", origin, pctx.Addr, err)
+		resp = s.genServerFailure(req)
+	}
+
+	pctx.Res = resp
+
+	// Don't put the transfers into the query log.
+	return resultCodeFinish
+}
+
+// zoneTransferResponse returns the response to the zone transfer or the SOA
+// request in pctx for the zone with origin.  isSecondary is true if pctx is
+// from one of the secondaries.  The transfer requests must be signed, while
+// the SOA ones are only responded to with a signature if they are signed.
+func (s *Server) zoneTransferResponse(
+	x *zoneTransfer,
+	pctx *proxy.DNSContext,
+	origin string,
+	isSecondary bool,
+) (resp *dns.Msg, err error) {
+	req := pctx.Req
+	qt := req.Question[0].Qtype
+	isStream := pctx.Proto == proxy.ProtoTCP || pctx.Proto == proxy.ProtoTLS
+	t := req.IsTsig()
+	switch {
+	case !isSecondary:
+		log.Info("dnsforward: zone transfer of %q refused for %s: not a secondary", origin, pctx.Addr)
+
+		return s.makeResponseREFUSED(req), nil
+	case t == nil && qt != dns.TypeSOA:
+		log.Info("dnsforward: zone transfer of %q refused for %s: not signed", origin, pctx.Addr)
+
+		return s.makeResponseREFUSED(req), nil
+	case qt == dns.TypeAXFR && !isStream:
+		log.Debug("dnsforward: zone transfer of %q refused for %s: over udp", origin, pctx.Addr)
+
+		return s.makeResponseREFUSED(req), nil
+	}
+
+	now := time.Now()
+	var key *xfrKey
+	if t != nil {
+		var tsigErr uint16
+		key, tsigErr = x.verify(req)
+		if tsigErr != dns.RcodeSuccess {
+			log.Info(
+				"dnsforward: zone transfer of %q refused for %s: tsig: %s",
+				origin,
+				pctx.Addr,
+				dns.RcodeToString[int(tsigErr)],
+			)
+
+			return tsigErrorResponse(req, tsigErr, now), nil
+		}
+	}
+
+	rrs := s.zoneRecords(origin)
+	ttl := s.conf.BlockedResponseTTL
+	soa, nss := x.apex(origin, x.serial(origin, rrs, now), ttl)
+
+	ans := []dns.RR{soa}
+	if qt == dns.TypeAXFR || (qt == dns.TypeIXFR && isStream && !isUpToDate(req, soa.Serial)) {
+		ans = append(ans, nss...)
+		ans = append(ans, rrs...)
+		ans = append(ans, dns.Copy(soa))
+
+		log.Debug("dnsforward: transferring %q with %d records to %s", origin, len(rrs), pctx.Addr)
+	}
+
+	return s.writeEnvelopes(pctx, key, splitEnvelopes(ans, xfrEnvelopeSize), now)
+}
+
+// splitEnvelopes splits the answer records rrs into the envelopes, the
+// records of each of which take no more than size bytes uncompressed, see RFC
+// 5936 Section 2.2.  A record larger than size is put into an envelope of its
+// own.
+func splitEnvelopes(rrs []dns.RR, size int) (envs [][]dns.RR) {
+	var env []dns.RR
+	envSize := 0
+	for _, rr := range rrs {
+		l := dns.Len(rr)
+		if len(env) > 0 && envSize+l > size {
+			envs = append(envs, env)
+			env, envSize = nil, 0
+		}
+
+		env = append(env, rr)
+		envSize += l
+	}
+
+	return append(envs, env)
+}
+
+// writeEnvelopes writes all the envelopes of the response to the request in
+// pctx with the answer records from envs but the last one to the connection of
+// pctx and returns the last one.  envs must not be empty.  The envelopes are
+// signed with key, unless it's nil, see RFC 8945 Section 5.3.1.
+func (s *Server) writeEnvelopes(
+	pctx *proxy.DNSContext,
+	key *xfrKey,
+	envs [][]dns.RR,
+	now time.Time,
+) (resp *dns.Msg, err error) {
+	mac := ""
+	if t := pctx.Req.IsTsig(); t != nil {
+		mac = t.MAC
+	}
+
+	var b []byte
+	last := len(envs) - 1
+	for i, env := range envs[:last] {
+		b, mac, err = s.packEnvelope(pctx.Req, env, key, mac, i > 0, now)
+		if err != nil {
+			return nil, fmt.Errorf("envelope at index %d: %w", i, err)
+		}
+
+		err = proxyutil.WritePrefixed(b, pctx.Conn)
+		if err != nil {
+			return nil, fmt.Errorf("writing envelope at index %d: %w", i, err)
+		}
+	}
+
+	b, _, err = s.packEnvelope(pctx.Req, envs[last], key, mac, last > 0, now)
+	if err != nil {
+		return nil, fmt.Errorf("envelope at index %d: %w", last, err)
+	}
+
+	resp = &dns.Msg{}
+	err = resp.Unpack(b)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking envelope: %w", err)
+	}
+
+	// Write the response in the compressed form, so that its signature
+	// remains valid.
+	resp.Compress = true
+
+	return resp, nil
+}
+
+// packEnvelope returns the wire form of the response to req with the answer
+// records ans, signed with key, unless it's nil, and its MAC.  prevMAC and
+// timersOnly are passed to [xfrKey.sign].
+func (s *Server) packEnvelope(
+	req *dns.Msg,
+	ans []dns.RR,
+	key *xfrKey,
+	prevMAC string,
+	timersOnly bool,
+	now time.Time,
+) (b []byte, mac string, err error) {
+	resp := s.makeResponse(req)
+	resp.Authoritative = true
+	resp.Answer = ans
+	setReplyEDNS(resp, req)
+
+	if key != nil {
+		b, mac, err = key.sign(resp, prevMAC, timersOnly, now)
+	} else {
+		resp.Compress = true
+		b, err = resp.Pack()
+	}
+
+	if err != nil {
+		return nil, "", err
+	} else if len(b) > dns.MaxMsgSize {
+		return nil, "", fmt.Errorf("%d bytes is too large", len(b))
+	}
+
+	return b, mac, nil
+}
+
+// isUpToDate returns true if the IXFR request req has the SOA record with the
+// serial not older than serial, see RFC 1982.
+func isUpToDate(req *dns.Msg, serial uint32) (ok bool) {
+	if len(req.Ns) == 0 {
+		return false
+	}
+
+	soa, ok := req.Ns[0].(*dns.SOA)
+
+	return ok && int32(serial-soa.Serial) <= 0
+}
+
+// setReplyEDNS adds the OPT record to resp if req has one.  It must be called
+// before signing resp, since the OPT record must precede the TSIG one.
+func setReplyEDNS(resp, req *dns.Msg) {
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+}
+
+// tsigErrorResponse returns the unsigned NOTAUTH response to req with the TSIG
+// error tsigErr, see RFC 8945.
+func tsigErrorResponse(req *dns.Msg, tsigErr uint16, now time.Time) (resp *dns.Msg) {
+	t := req.IsTsig()
+
+	resp = (&dns.Msg{}).SetRcode(req, dns.RcodeNotAuth)
+	setReplyEDNS(resp, req)
+	resp.Extra = append(resp.Extra, &dns.TSIG{
+		Hdr: dns.RR_Header{
+			Name:   t.Hdr.Name,
+			Rrtype: dns.TypeTSIG,
+			Class:  dns.ClassANY,
+		},
+		Algorithm:  t.Algorithm,
+		TimeSigned: uint64(now.Unix()),
+		Fudge:      xfrTSIGFudge,
+		OrigId:     req.Id,
+		Error:      tsigErr,
+	})
+
+	return resp
+}
+
+// sign returns the wire form of resp signed with k and its MAC.  prevMAC is
+// the MAC of the request for the first envelope of the response and the MAC of
+// the previous envelope otherwise, in which case timersOnly must be true.
+func (k *xfrKey) sign(
+	resp *dns.Msg,
+	prevMAC string,
+	timersOnly bool,
+	now time.Time,
+) (b []byte, mac string, err error) {
+	resp.SetTsig(k.name, k.algorithm, xfrTSIGFudge, now.Unix())
+
+	// Sign the response in the compressed form, since it's written so.
+	resp.Compress = true
+	b, mac, err = dns.TsigGenerate(resp, k.secret, prevMAC, timersOnly)
+	if err != nil {
+		return nil, "", fmt.Errorf("signing: %w", err)
+	}
+
+	return b, mac, nil
+}
@@ -0,0 +1,496 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testXFRSecret is the base64-encoded TSIG secret for tests.
+const testXFRSecret = "c2VjcmV0LWtleS1mb3ItdGVzdHM="
+
+// newTestXFRConf returns a new valid zone transfer configuration for tests.
+func newTestXFRConf() (c *ZoneTransferConfig) {
+	return &ZoneTransferConfig{
+		NameServers: []string{"ns1.lan", "ns2.example"},
+		Secondaries: []netip.Addr{netip.MustParseAddr("192.0.2.53")},
+		TSIGKeys: []*TSIGKey{{
+			Name:   "xfr-key",
+			Secret: testXFRSecret,
+		}},
+		Enabled: true,
+	}
+}
+
+func TestZoneTransferConfig_validate(t *testing.T) {
+	testCases := []struct {
+		modify  func(c *ZoneTransferConfig)
+		name    string
+		wantErr string
+	}{{
+		modify:  func(c *ZoneTransferConfig) {},
+		name:    "valid",
+		wantErr: "",
+	}, {
+		modify: func(c *ZoneTransferConfig) {
+			*c = ZoneTransferConfig{}
+		},
+		name:    "disabled",
+		wantErr: "",
+	}, {
+		modify: func(c *ZoneTransferConfig) {
+			c.Zones = []string{"bad..zone"}
+		},
+		name:    "bad_zone",
+		wantErr: "zones: at index 0: ",
+	}, {
+		modify: func(c *ZoneTransferConfig) {
+			c.NameServers = nil
+		},
+		name:    "no_name_servers",
+		wantErr: "name_servers: no values",
+	}, {
+		modify: func(c *ZoneTransferConfig) {
+			c.Secondaries = nil
+		},
+		name:    "no_secondaries",
+		wantErr: "secondaries: no values",
+	}, {
+		modify: func(c *ZoneTransferConfig) {
+			c.TSIGKeys = nil
+		},
+		name:    "no_keys",
+		wantErr: "tsig_keys: no values",
+	}, {
+		modify: func(c *ZoneTransferConfig) {
+			c.TSIGKeys[0].Algorithm = "hmac-md5"
+		},
+		name:    "bad_algorithm",
+		wantErr: `tsig_keys: at index 0: algorithm: unsupported value "hmac-md5"`,
+	}, {
+		modify: func(c *ZoneTransferConfig) {
+			c.TSIGKeys[0].Secret = "not base64"
+		},
+		name:    "bad_secret",
+		wantErr: "tsig_keys: at index 0: secret: ",
+	}, {
+		modify: func(c *ZoneTransferConfig) {
+			c.TSIGKeys = append(c.TSIGKeys, &TSIGKey{
+				Name:   "XFR-KEY.",
+				Secret: testXFRSecret,
+			})
+		},
+		name:    "duplicate_key",
+		wantErr: `tsig_keys: at index 1: duplicate name "XFR-KEY."`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestXFRConf()
+			tc.modify(c)
+
+			err := c.validate()
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+// newXFRReq returns a new zone transfer request for the name of type qt signed
+// with the key, unless it's empty.
+func newXFRReq(t *testing.T, name string, qt uint16, key, secret string) (req *dns.Msg) {
+	t.Helper()
+
+	req = (&dns.Msg{}).SetQuestion(name, qt)
+	if qt == dns.TypeIXFR {
+		req.Ns = []dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeSOA,
+				Class:  dns.ClassINET,
+			},
+			Ns:     "ns1." + name,
+			Mbox:   "hostmaster." + name,
+			Serial: 1,
+		}}
+	}
+
+	if key == "" {
+		return req
+	}
+
+	// Use the compression to make sure that the requests with the compressed
+	// names are verified as well.
+	req.Compress = true
+	req.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	b, _, err := dns.TsigGenerate(req, secret, "", false)
+	require.NoError(t, err)
+
+	req = &dns.Msg{}
+	err = req.Unpack(b)
+	require.NoError(t, err)
+
+	return req
+}
+
+func TestServer_processZoneTransfer(t *testing.T) {
+	x, err := newZoneTransfer(newTestXFRConf(), defaultLocalDomainSuffix)
+	require.NoError(t, err)
+
+	f, err := filtering.New(&filtering.Config{
+		Rewrites: []*filtering.LegacyRewrite{{
+			Domain: "nas.lan",
+			Answer: "192.168.1.10",
+		}, {
+			Domain: "*.dev.lan",
+			Answer: "fd00::10",
+		}, {
+			Domain: "www.lan",
+			Answer: "nas.lan",
+		}, {
+			// Conflicts with the DHCP host.
+			Domain: "myhost.lan",
+			Answer: "nas.lan",
+		}, {
+			Domain: "keep.lan",
+			Answer: "A",
+		}, {
+			Domain: "other.example",
+			Answer: "192.168.1.11",
+		}},
+	}, nil)
+	require.NoError(t, err)
+
+	s := &Server{
+		dnsFilter:         f,
+		dhcpServer:        testDHCP,
+		localDomainSuffix: defaultLocalDomainSuffix,
+		tableHostToIP: hostToIPTable{
+			"myhost.lan": netip.MustParseAddr("192.168.12.34"),
+		},
+		xfr: x,
+	}
+	s.conf.BlockedResponseTTL = 10
+
+	secondary := &net.TCPAddr{IP: net.IP{192, 0, 2, 53}, Port: 53}
+	stranger := &net.TCPAddr{IP: net.IP{192, 0, 2, 99}, Port: 53}
+
+	wantZone := []string{
+		"lan.\t10\tIN\tNS\tns1.lan.",
+		"lan.\t10\tIN\tNS\tns2.example.",
+		"*.dev.lan.\t10\tIN\tAAAA\tfd00::10",
+		"myhost.lan.\t10\tIN\tA\t192.168.12.34",
+		"nas.lan.\t10\tIN\tA\t192.168.1.10",
+		"www.lan.\t10\tIN\tCNAME\tnas.lan.",
+	}
+
+	testCases := []struct {
+		addr        net.Addr
+		req         *dns.Msg
+		name        string
+		proto       proxy.Proto
+		wantZone    []string
+		wantRcode   int
+		wantTSIGErr uint16
+		wantRC      resultCode
+		wantNoResp  bool
+	}{{
+		addr:        secondary,
+		req:         newXFRReq(t, "lan.", dns.TypeAXFR, "xfr-key.", testXFRSecret),
+		name:        "axfr",
+		proto:       proxy.ProtoTCP,
+		wantZone:    wantZone,
+		wantRcode:   dns.RcodeSuccess,
+		wantTSIGErr: dns.RcodeSuccess,
+		wantRC:      resultCodeFinish,
+	}, {
+		addr:        secondary,
+		req:         newXFRReq(t, "LAN.", dns.TypeIXFR, "xfr-key.", testXFRSecret),
+		name:        "ixfr",
+		proto:       proxy.ProtoTLS,
+		wantZone:    wantZone,
+		wantRcode:   dns.RcodeSuccess,
+		wantTSIGErr: dns.RcodeSuccess,
+		wantRC:      resultCodeFinish,
+	}, {
+		addr:        secondary,
+		req:         newXFRReq(t, "lan.", dns.TypeIXFR, "xfr-key.", testXFRSecret),
+		name:        "ixfr_udp",
+		proto:       proxy.ProtoUDP,
+		wantZone:    nil,
+		wantRcode:   dns.RcodeSuccess,
+		wantTSIGErr: dns.RcodeSuccess,
+		wantRC:      resultCodeFinish,
+	}, {
+		addr:        secondary,
+		req:         newXFRReq(t, "lan.", dns.TypeSOA, "", ""),
+		name:        "soa_unsigned",
+		proto:       proxy.ProtoUDP,
+		wantZone:    nil,
+		wantRcode:   dns.RcodeSuccess,
+		wantTSIGErr: dns.RcodeSuccess,
+		wantRC:      resultCodeFinish,
+	}, {
+		addr:       stranger,
+		req:        newXFRReq(t, "lan.", dns.TypeSOA, "", ""),
+		name:       "soa_stranger",
+		proto:      proxy.ProtoUDP,
+		wantRC:     resultCodeSuccess,
+		wantNoResp: true,
+	}, {
+		addr:       secondary,
+		req:        newXFRReq(t, "example.", dns.TypeAXFR, "xfr-key.", testXFRSecret),
+		name:       "other_zone",
+		proto:      proxy.ProtoTCP,
+		wantRC:     resultCodeSuccess,
+		wantNoResp: true,
+	}, {
+		addr:        stranger,
+		req:         newXFRReq(t, "lan.", dns.TypeAXFR, "xfr-key.", testXFRSecret),
+		name:        "not_secondary",
+		proto:       proxy.ProtoTCP,
+		wantRcode:   dns.RcodeRefused,
+		wantTSIGErr: dns.RcodeSuccess,
+		wantRC:      resultCodeFinish,
+	}, {
+		addr:        secondary,
+		req:         newXFRReq(t, "lan.", dns.TypeAXFR, "", ""),
+		name:        "unsigned",
+		proto:       proxy.ProtoTCP,
+		wantRcode:   dns.RcodeRefused,
+		wantTSIGErr: dns.RcodeSuccess,
+		wantRC:      resultCodeFinish,
+	}, {
+		addr:        secondary,
+		req:         newXFRReq(t, "lan.", dns.TypeAXFR, "xfr-key.", testXFRSecret),
+		name:        "udp",
+		proto:       proxy.ProtoUDP,
+		wantRcode:   dns.RcodeRefused,
+		wantTSIGErr: dns.RcodeSuccess,
+		wantRC:      resultCodeFinish,
+	}, {
+		addr:        secondary,
+		req:         newXFRReq(t, "lan.", dns.TypeAXFR, "other-key.", testXFRSecret),
+		name:        "bad_key",
+		proto:       proxy.ProtoTCP,
+		wantRcode:   dns.RcodeNotAuth,
+		wantTSIGErr: dns.RcodeBadKey,
+		wantRC:      resultCodeFinish,
+	}, {
+		addr:        secondary,
+		req:         newXFRReq(t, "lan.", dns.TypeAXFR, "xfr-key.", "b3RoZXItc2VjcmV0"),
+		name:        "bad_sig",
+		proto:       proxy.ProtoTCP,
+		wantRcode:   dns.RcodeNotAuth,
+		wantTSIGErr: dns.RcodeBadSig,
+		wantRC:      resultCodeFinish,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Proto: tc.proto,
+					Req:   tc.req,
+					Addr:  tc.addr,
+				},
+			}
+
+			rc := s.processZoneTransfer(dctx)
+			require.Equal(t, tc.wantRC, rc)
+
+			resp := dctx.proxyCtx.Res
+			if tc.wantNoResp {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+			require.Equal(t, tc.wantRcode, resp.Rcode)
+
+			reqTSIG, respTSIG := tc.req.IsTsig(), resp.IsTsig()
+			if reqTSIG == nil || tc.wantRcode == dns.RcodeRefused {
+				assert.Nil(t, respTSIG)
+			} else {
+				require.NotNil(t, respTSIG)
+
+				assert.Equal(t, tc.wantTSIGErr, respTSIG.Error)
+			}
+
+			if tc.wantRcode != dns.RcodeSuccess {
+				assert.Empty(t, resp.Answer)
+
+				return
+			}
+
+			if respTSIG != nil {
+				resp.Compress = true
+				b, packErr := resp.Pack()
+				require.NoError(t, packErr)
+
+				assert.NoError(t, dns.TsigVerify(b, testXFRSecret, reqTSIG.MAC, false))
+			}
+
+			require.NotEmpty(t, resp.Answer)
+
+			assert.True(t, resp.Authoritative)
+
+			soa, ok := resp.Answer[0].(*dns.SOA)
+			require.True(t, ok)
+
+			assert.Equal(t, "lan.", soa.Hdr.Name)
+			assert.Equal(t, "ns1.lan.", soa.Ns)
+
+			if tc.wantZone == nil {
+				assert.Len(t, resp.Answer, 1)
+
+				return
+			}
+
+			ans := resp.Answer
+			require.Len(t, ans, len(tc.wantZone)+2)
+			assert.Equal(t, soa.String(), ans[len(ans)-1].String())
+
+			var got []string
+			for _, rr := range ans[1 : len(ans)-1] {
+				got = append(got, rr.String())
+			}
+
+			assert.Equal(t, tc.wantZone, got)
+		})
+	}
+}
+
+func TestServer_processZoneTransfer_envelopes(t *testing.T) {
+	x, err := newZoneTransfer(newTestXFRConf(), defaultLocalDomainSuffix)
+	require.NoError(t, err)
+
+	// Make the zone large enough to not fit into a single message.
+	const hostsNum = 5_000
+
+	rws := make([]*filtering.LegacyRewrite, 0, hostsNum)
+	for i := 0; i < hostsNum; i++ {
+		rws = append(rws, &filtering.LegacyRewrite{
+			Domain: fmt.Sprintf("host%d.lan", i),
+			Answer: fmt.Sprintf("192.168.%d.%d", i/256, i%256),
+		})
+	}
+
+	f, err := filtering.New(&filtering.Config{Rewrites: rws}, nil)
+	require.NoError(t, err)
+
+	s := &Server{
+		dnsFilter:         f,
+		localDomainSuffix: defaultLocalDomainSuffix,
+		xfr:               x,
+	}
+	s.conf.BlockedResponseTTL = 10
+
+	srvConn, cliConn := net.Pipe()
+	t.Cleanup(func() { _ = cliConn.Close() })
+
+	leading := make(chan []byte)
+	go func() {
+		defer close(leading)
+
+		for {
+			b, rerr := proxyutil.ReadPrefixed(cliConn)
+			if rerr != nil {
+				return
+			}
+
+			leading <- b
+		}
+	}()
+
+	req := newXFRReq(t, "lan.", dns.TypeAXFR, "xfr-key.", testXFRSecret)
+	dctx := &dnsContext{
+		proxyCtx: &proxy.DNSContext{
+			Proto: proxy.ProtoTCP,
+			Req:   req,
+			Addr:  &net.TCPAddr{IP: net.IP{192, 0, 2, 53}, Port: 53},
+			Conn:  srvConn,
+		},
+	}
+
+	var envs [][]byte
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for b := range leading {
+			envs = append(envs, b)
+		}
+	}()
+
+	rc := s.processZoneTransfer(dctx)
+	require.Equal(t, resultCodeFinish, rc)
+
+	require.NoError(t, srvConn.Close())
+	<-done
+
+	resp := dctx.proxyCtx.Res
+	require.NotNil(t, resp)
+	require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	b, err := resp.Pack()
+	require.NoError(t, err)
+
+	envs = append(envs, b)
+	require.Greater(t, len(envs), 1)
+
+	mac, recsNum := req.IsTsig().MAC, 0
+	for i, env := range envs {
+		m := &dns.Msg{}
+		require.NoError(t, m.Unpack(env))
+
+		respTSIG := m.IsTsig()
+		require.NotNil(t, respTSIG)
+
+		// Verify after unpacking, since the verification modifies env.
+		require.NoError(t, dns.TsigVerify(env, testXFRSecret, mac, i > 0))
+
+		mac = respTSIG.MAC
+		recsNum += len(m.Answer)
+	}
+
+	// The records, the two NS records, and the two SOA ones.
+	assert.Equal(t, hostsNum+4, recsNum)
+}
+
+func TestZoneTransfer_serial(t *testing.T) {
+	x, err := newZoneTransfer(newTestXFRConf(), defaultLocalDomainSuffix)
+	require.NoError(t, err)
+
+	rr, err := dns.NewRR("host.lan. 10 IN A 192.168.1.1")
+	require.NoError(t, err)
+
+	now := time.Unix(1_700_000_000, 0)
+	const wantSerial = 1_700_000_000
+
+	assert.Equal(t, uint32(wantSerial), x.serial("lan.", nil, now))
+	assert.Equal(t, uint32(wantSerial), x.serial("lan.", nil, now.Add(time.Hour)))
+
+	// The data change within the same second.
+	assert.Equal(t, uint32(wantSerial+1), x.serial("lan.", []dns.RR{rr}, now))
+
+	later := now.Add(time.Hour)
+	assert.Equal(t, uint32(later.Unix()), x.serial("lan.", nil, later))
+}
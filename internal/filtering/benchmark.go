@@ -0,0 +1,235 @@
+package filtering
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// defaultBenchmarkQueries is the default number of queries made by a
+	// filtering benchmark.
+	defaultBenchmarkQueries = 10_000
+
+	// maxBenchmarkQueries is the maximum number of queries made by a filtering
+	// benchmark.
+	maxBenchmarkQueries = 1_000_000
+
+	// maxBenchmarkDuration is the maximum expected duration of a filtering
+	// benchmark limited by QPS.
+	maxBenchmarkDuration = 1 * time.Minute
+)
+
+// benchmarkReq is the request to the POST /control/filtering/benchmark HTTP
+// API.
+type benchmarkReq struct {
+	// Domains is the corpus of the domain names to check.  If empty, a
+	// synthetic one is used.
+	Domains []string `json:"domains"`
+
+	// Queries is the number of queries to make.  The domains are checked in
+	// turn.  If zero, defaultBenchmarkQueries is used.
+	Queries int `json:"queries"`
+
+	// QPS is the rate of queries per second.  If zero, the queries are made
+	// as fast as possible.
+	QPS int `json:"qps"`
+}
+
+// benchmarkResp is the response to the POST /control/filtering/benchmark HTTP
+// API.  The latencies are in microseconds.
+type benchmarkResp struct {
+	Queries  int     `json:"queries"`
+	Filtered int     `json:"filtered"`
+	TimeMs   float64 `json:"time_ms"`
+	P50Us    float64 `json:"p50_us"`
+	P95Us    float64 `json:"p95_us"`
+	P99Us    float64 `json:"p99_us"`
+	MaxUs    float64 `json:"max_us"`
+
+	// AllocsPerQuery and BytesPerQuery are measured by the whole process, so
+	// they are approximate.
+	AllocsPerQuery float64 `json:"allocs_per_query"`
+	BytesPerQuery  float64 `json:"bytes_per_query"`
+}
+
+// validate returns an error if req is invalid.  It also sets the default
+// values.
+func (req *benchmarkReq) validate() (err error) {
+	if req.Queries == 0 {
+		req.Queries = defaultBenchmarkQueries
+	}
+
+	if req.Queries < 0 || req.Queries > maxBenchmarkQueries {
+		return fmt.Errorf("queries: %d out of range [1, %d]", req.Queries, maxBenchmarkQueries)
+	} else if req.QPS < 0 {
+		return fmt.Errorf("qps: negative value %d", req.QPS)
+	}
+
+	if req.QPS > 0 {
+		dur := time.Duration(req.Queries) * time.Second / time.Duration(req.QPS)
+		if dur > maxBenchmarkDuration {
+			return fmt.Errorf("benchmark would take %s, max %s", dur, maxBenchmarkDuration)
+		}
+	}
+
+	for i, host := range req.Domains {
+		if host == "" {
+			return fmt.Errorf("domains: empty domain at index %d", i)
+		}
+	}
+
+	if len(req.Domains) == 0 {
+		req.Domains = syntheticDomains(1000)
+	}
+
+	return nil
+}
+
+// syntheticDomains returns n distinct domain names of different depth.
+func syntheticDomains(n int) (domains []string) {
+	domains = make([]string, n)
+	for i := range domains {
+		switch i % 3 {
+		case 0:
+			domains[i] = fmt.Sprintf("domain%d.example", i)
+		case 1:
+			domains[i] = fmt.Sprintf("www.domain%d.example", i)
+		default:
+			domains[i] = fmt.Sprintf("cdn%d.static.domain%d.example", i%10, i)
+		}
+	}
+
+	return domains
+}
+
+// benchmark checks the domains from req against the filtering rules and
+// measures the latencies of matching.  req must be valid.
+func (d *DNSFilter) benchmark(req *benchmarkReq, setts *Settings) (resp *benchmarkResp, err error) {
+	lats := make([]time.Duration, req.Queries)
+
+	var interval time.Duration
+	if req.QPS > 0 {
+		interval = time.Second / time.Duration(req.QPS)
+	}
+
+	resp = &benchmarkResp{
+		Queries: req.Queries,
+	}
+
+	memBefore := &runtime.MemStats{}
+	runtime.ReadMemStats(memBefore)
+
+	start := time.Now()
+	for i := range lats {
+		if interval > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(i) * interval)))
+		}
+
+		host := req.Domains[i%len(req.Domains)]
+
+		qStart := time.Now()
+		var res Result
+		res, err = d.CheckHostRules(host, dns.TypeA, setts)
+		lats[i] = time.Since(qStart)
+		if err != nil {
+			return nil, fmt.Errorf("checking %q: %w", host, err)
+		}
+
+		if res.IsFiltered {
+			resp.Filtered++
+		}
+	}
+
+	resp.TimeMs = toMs(time.Since(start))
+
+	memAfter := &runtime.MemStats{}
+	runtime.ReadMemStats(memAfter)
+
+	n := float64(req.Queries)
+	resp.AllocsPerQuery = float64(memAfter.Mallocs-memBefore.Mallocs) / n
+	resp.BytesPerQuery = float64(memAfter.TotalAlloc-memBefore.TotalAlloc) / n
+
+	slices.Sort(lats)
+	resp.P50Us = toUs(percentile(lats, 50))
+	resp.P95Us = toUs(percentile(lats, 95))
+	resp.P99Us = toUs(percentile(lats, 99))
+	resp.MaxUs = toUs(lats[len(lats)-1])
+
+	return resp, nil
+}
+
+// percentile returns the p-th percentile of sorted, which must not be empty,
+// using the nearest-rank method.
+func percentile(sorted []time.Duration, p int) (d time.Duration) {
+	rank := int(math.Ceil(float64(p) / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+// toUs returns d in microseconds.
+func toUs(d time.Duration) (us float64) {
+	return float64(d.Nanoseconds()) / 1e3
+}
+
+// toMs returns d in milliseconds.
+func toMs(d time.Duration) (ms float64) {
+	return float64(d.Microseconds()) / 1e3
+}
+
+// handleBenchmark is the handler for the POST /control/filtering/benchmark HTTP
+// API.
+func (d *DNSFilter) handleBenchmark(w http.ResponseWriter, r *http.Request) {
+	req := &benchmarkReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	err = req.validate()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	if !d.benchmarkLock.TryLock() {
+		aghhttp.Error(r, w, http.StatusConflict, "benchmark is already running")
+
+		return
+	}
+	defer d.benchmarkLock.Unlock()
+
+	setts := d.GetConfig()
+	setts.FilteringEnabled = true
+	setts.ProtectionEnabled = true
+
+	log.Debug(
+		"filtering: benchmark: %d queries at %d qps over %d domains",
+		req.Queries,
+		req.QPS,
+		len(req.Domains),
+	)
+
+	resp, err := d.benchmark(req, &setts)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "benchmark: %s", err)
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
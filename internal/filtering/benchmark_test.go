@@ -0,0 +1,104 @@
+package filtering
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBenchmarkReq_validate(t *testing.T) {
+	testCases := []struct {
+		req        *benchmarkReq
+		name       string
+		wantErrMsg string
+	}{{
+		req:        &benchmarkReq{},
+		name:       "defaults",
+		wantErrMsg: "",
+	}, {
+		req:        &benchmarkReq{Queries: -1},
+		name:       "negative_queries",
+		wantErrMsg: "queries: -1 out of range [1, 1000000]",
+	}, {
+		req:        &benchmarkReq{Queries: maxBenchmarkQueries + 1},
+		name:       "too_many_queries",
+		wantErrMsg: "queries: 1000001 out of range [1, 1000000]",
+	}, {
+		req:        &benchmarkReq{QPS: -1},
+		name:       "negative_qps",
+		wantErrMsg: "qps: negative value -1",
+	}, {
+		req:        &benchmarkReq{Queries: 1000, QPS: 1},
+		name:       "too_long",
+		wantErrMsg: "benchmark would take 16m40s, max 1m0s",
+	}, {
+		req:        &benchmarkReq{Domains: []string{"example.org", ""}},
+		name:       "empty_domain",
+		wantErrMsg: "domains: empty domain at index 1",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.req.validate()
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+
+	t.Run("defaults_set", func(t *testing.T) {
+		req := &benchmarkReq{}
+		require.NoError(t, req.validate())
+
+		assert.Equal(t, defaultBenchmarkQueries, req.Queries)
+		assert.Len(t, req.Domains, 1000)
+	})
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i + 1)
+	}
+
+	assert.Equal(t, time.Duration(1), percentile(sorted, 0))
+	assert.Equal(t, time.Duration(50), percentile(sorted, 50))
+	assert.Equal(t, time.Duration(95), percentile(sorted, 95))
+	assert.Equal(t, time.Duration(100), percentile(sorted, 100))
+	assert.Equal(t, time.Duration(7), percentile([]time.Duration{7}, 99))
+}
+
+func TestDNSFilter_handleBenchmark(t *testing.T) {
+	filters := []Filter{{
+		ID: 0, Data: []byte("||blocked.example^\n"),
+	}}
+	d, _ := newForTest(t, &Config{}, filters)
+	t.Cleanup(d.Close)
+
+	body, err := json.Marshal(&benchmarkReq{
+		Domains: []string{"blocked.example", "allowed.example"},
+		Queries: 100,
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/control/filtering/benchmark", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	d.handleBenchmark(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &benchmarkResp{}
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	assert.Equal(t, 100, resp.Queries)
+	assert.Equal(t, 50, resp.Filtered)
+	assert.LessOrEqual(t, resp.P50Us, resp.P95Us)
+	assert.LessOrEqual(t, resp.P95Us, resp.P99Us)
+	assert.LessOrEqual(t, resp.P99Us, resp.MaxUs)
+}
@@ -3,57 +3,56 @@ package filtering
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/AdguardTeam/urlfilter/rules"
-	"golang.org/x/exp/slices"
 )
 
-// serviceRules maps a service ID to its filtering rules.
-var serviceRules map[string][]*rules.NetworkRule
-
-// serviceIDs contains service IDs sorted alphabetically.
-var serviceIDs []string
-
-// initBlockedServices initializes package-level blocked service data.
+// initBlockedServices initializes the catalog of the blocked services with
+// the built-in one.
 func initBlockedServices() {
-	l := len(blockedServices)
-	serviceIDs = make([]string, l)
-	serviceRules = make(map[string][]*rules.NetworkRule, l)
+	c, errs := newServicesSnapshot(blockedServices, 0, time.Time{})
+	for _, err := range errs {
+		log.Error("parsing blocked services: %s", err)
+	}
+
+	builtinServices = c
 
-	for i, s := range blockedServices {
-		netRules := make([]*rules.NetworkRule, 0, len(s.Rules))
-		for _, text := range s.Rules {
-			rule, err := rules.NewNetworkRule(text, BlockedSvcsListID)
-			if err != nil {
-				log.Error("parsing blocked service %q rule %q: %s", s.ID, text, err)
+	log.Debug("filtering: initialized %d services", len(c.ids))
+}
 
-				continue
-			}
+// knownBlockedServices returns the known services from names skipping the
+// unknown ones.
+func (d *DNSFilter) knownBlockedServices(names []string) (known []string) {
+	known = []string{}
+	for _, s := range names {
+		if !d.ServicesCatalog.Known(s) {
+			log.Debug("skipping unknown blocked-service %q", s)
 
-			netRules = append(netRules, rule)
+			continue
 		}
 
-		serviceIDs[i] = s.ID
-		serviceRules[s.ID] = netRules
+		known = append(known, s)
 	}
 
-	slices.Sort(serviceIDs)
-
-	log.Debug("filtering: initialized %d services", l)
+	return known
 }
 
-// BlockedSvcKnown returns true if a blocked service ID is known.
-func BlockedSvcKnown(s string) (ok bool) {
-	_, ok = serviceRules[s]
+// CheckBlockedServices checks host against the rules of the blocked services
+// from setts.  It's used to check the hosts the service discovery records,
+// such as SRV and NAPTR ones, point to, since those records may be published
+// under the names not covered by the rules of the services.
+func CheckBlockedServices(host string, setts *Settings) (res Result) {
+	// The error is always nil.
+	res, _ = matchBlockedServicesRules(strings.ToLower(host), 0, setts)
 
-	return ok
+	return res
 }
 
 // ApplyBlockedServices - set blocked services settings for this DNS request
 func (d *DNSFilter) ApplyBlockedServices(setts *Settings, list []string) {
-	setts.ServicesRules = []ServiceEntry{}
 	if list == nil {
 		d.confLock.RLock()
 		defer d.confLock.RUnlock()
@@ -61,30 +60,56 @@ func (d *DNSFilter) ApplyBlockedServices(setts *Settings, list []string) {
 		list = d.Config.BlockedServices
 	}
 
+	setts.ServicesRules = d.serviceEntries(list)
+}
+
+// ApplyAllowedServices sets the rules of the services from list allowed in the
+// default deny mode.
+func (d *DNSFilter) ApplyAllowedServices(setts *Settings, list []string) {
+	setts.AllowedServicesRules = d.serviceEntries(list)
+}
+
+// serviceEntries returns the entries with the rules of the services from list.
+// The unknown services are skipped.
+func (d *DNSFilter) serviceEntries(list []string) (entries []ServiceEntry) {
+	c := d.ServicesCatalog.load()
+	entries = []ServiceEntry{}
 	for _, name := range list {
-		rules, ok := serviceRules[name]
+		rules, ok := c.serviceRules(name)
 		if !ok {
 			log.Error("unknown service name: %s", name)
 
 			continue
 		}
 
-		setts.ServicesRules = append(setts.ServicesRules, ServiceEntry{
+		entries = append(entries, ServiceEntry{
 			Name:  name,
 			Rules: rules,
 		})
 	}
+
+	return entries
 }
 
 func (d *DNSFilter) handleBlockedServicesIDs(w http.ResponseWriter, r *http.Request) {
-	_ = aghhttp.WriteJSONResponse(w, r, serviceIDs)
+	ids := []string{}
+	if c := d.ServicesCatalog.load(); c != nil {
+		ids = c.ids
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, ids)
 }
 
 func (d *DNSFilter) handleBlockedServicesAll(w http.ResponseWriter, r *http.Request) {
+	services := []blockedService{}
+	if c := d.ServicesCatalog.load(); c != nil {
+		services = c.services
+	}
+
 	_ = aghhttp.WriteJSONResponse(w, r, struct {
 		BlockedServices []blockedService `json:"blocked_services"`
 	}{
-		BlockedServices: blockedServices,
+		BlockedServices: services,
 	})
 }
 
@@ -0,0 +1,257 @@
+package filtering
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/filterlist"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"golang.org/x/exp/slices"
+)
+
+// shardKey identifies the state of a filter list an engine shard is built
+// from.  The shard is only rebuilt when the key of its list changes.
+type shardKey struct {
+	// data is the content of the in-memory list, if any.
+	data string
+
+	// path is the path to the file of the list, if any.
+	path string
+
+	// modTime is the modification time of the file in nanoseconds.
+	modTime int64
+
+	// size is the size of the file in bytes.
+	size int64
+}
+
+// newShardKey returns the key of the current state of f.  ok is false if f has
+// neither data nor an existing file, so there are no rules to build the shard
+// from.
+func newShardKey(f Filter) (key shardKey, ok bool, err error) {
+	if len(f.Data) != 0 {
+		return shardKey{data: string(f.Data)}, true, nil
+	} else if f.FilePath == "" {
+		return shardKey{}, false, nil
+	}
+
+	fi, err := os.Stat(f.FilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return shardKey{}, false, nil
+	} else if err != nil {
+		return shardKey{}, false, fmt.Errorf("getting filter file info: %w", err)
+	}
+
+	return shardKey{
+		path:    f.FilePath,
+		modTime: fi.ModTime().UnixNano(),
+		size:    fi.Size(),
+	}, true, nil
+}
+
+// engineShard is the filtering engine of a single filter list.
+type engineShard struct {
+	// loadedAt is the time the shard has been built at.
+	loadedAt time.Time
+
+	// storage is the rule storage of the list.
+	storage *filterlist.RuleStorage
+
+	// engine matches the requests against the rules of storage.
+	engine *urlfilter.DNSEngine
+
+	// key is the state of the list the shard has been built from.
+	key shardKey
+
+	// id is the ID of the list.
+	id int64
+
+	// loadTime is the time it took to build the shard.
+	loadTime time.Duration
+
+	// memEstimate is the estimated size of the shard in memory in bytes.
+	memEstimate uint64
+}
+
+// estimatedRuleSize is the estimated size in bytes of a compiled rule in the
+// lookup tables of an engine and the cache of its rule storage.
+const estimatedRuleSize = 64
+
+// newEngineShard builds the shard for f in the state of key.
+func newEngineShard(f Filter, key shardKey) (sh *engineShard, err error) {
+	start := time.Now()
+	rs, err := newRuleStorage([]Filter{f})
+	if err != nil {
+		return nil, fmt.Errorf("filter %d: %w", f.ID, err)
+	}
+
+	engine := urlfilter.NewDNSEngine(rs)
+
+	// The text of the in-memory lists is kept by their rule storages, while
+	// the file lists are read from the files on demand.  See newRuleStorage.
+	textSize := uint64(len(key.data))
+	if key.path != "" && runtime.GOOS == "windows" {
+		textSize = uint64(key.size)
+	}
+
+	return &engineShard{
+		loadedAt:    start,
+		storage:     rs,
+		engine:      engine,
+		key:         key,
+		id:          f.ID,
+		loadTime:    time.Since(start),
+		memEstimate: textSize + uint64(engine.RulesCount)*estimatedRuleSize,
+	}, nil
+}
+
+// closeShards closes the rule storages of shards and logs the errors, if any.
+func closeShards(shards []*engineShard) {
+	for _, sh := range shards {
+		err := sh.storage.Close()
+		if err != nil {
+			log.Error("filtering: closing rule storage of filter %d: %s", sh.id, err)
+		}
+	}
+}
+
+// shardedEngine matches the requests against a set of filter lists, each
+// with its own engine shard, so that updating a list only requires rebuilding
+// its own shard instead of the whole set.  A nil *shardedEngine is valid and
+// matches nothing.
+type shardedEngine struct {
+	// shards are the shards of the lists in the order of the lists.
+	shards []*engineShard
+}
+
+// newShardedEngine returns a new engine for filters.  The shards of prev built
+// from the lists which haven't changed since are reused.  stale are the shards
+// of prev which aren't used by e, they should be closed once prev is no longer
+// in use.  prev may be nil.
+func newShardedEngine(
+	prev *shardedEngine,
+	filters []Filter,
+) (e *shardedEngine, stale []*engineShard, err error) {
+	reusable := map[int64]*engineShard{}
+	if prev != nil {
+		for _, sh := range prev.shards {
+			reusable[sh.id] = sh
+		}
+	}
+
+	e = &shardedEngine{
+		shards: make([]*engineShard, 0, len(filters)),
+	}
+
+	var created []*engineShard
+	for _, f := range filters {
+		sh, isNew, shErr := shardFor(f, reusable)
+		if shErr != nil {
+			closeShards(created)
+
+			return nil, nil, shErr
+		} else if sh == nil {
+			continue
+		}
+
+		if isNew {
+			created = append(created, sh)
+		}
+
+		e.shards = append(e.shards, sh)
+	}
+
+	log.Debug(
+		"filtering: built %d engine shards, reused %d",
+		len(created),
+		len(e.shards)-len(created),
+	)
+
+	for _, sh := range reusable {
+		stale = append(stale, sh)
+	}
+
+	return e, stale, nil
+}
+
+// shardFor returns the shard of f, taking it from reusable if the list hasn't
+// changed and building a new one otherwise.  The taken shard is removed from
+// reusable.  sh is nil if f has no rules.
+func shardFor(f Filter, reusable map[int64]*engineShard) (sh *engineShard, isNew bool, err error) {
+	key, ok, err := newShardKey(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("filter %d: %w", f.ID, err)
+	} else if !ok {
+		return nil, false, nil
+	}
+
+	if sh = reusable[f.ID]; sh != nil && sh.key == key {
+		delete(reusable, f.ID)
+
+		return sh, false, nil
+	}
+
+	sh, err = newEngineShard(f, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return sh, true, nil
+}
+
+// newShards returns the shards of e which aren't the shards of prev.  prev may
+// be nil.
+func newShards(e, prev *shardedEngine) (shards []*engineShard) {
+	for _, sh := range e.shards {
+		if prev == nil || !slices.Contains(prev.shards, sh) {
+			shards = append(shards, sh)
+		}
+	}
+
+	return shards
+}
+
+// close closes the rule storages of all shards of e.
+func (e *shardedEngine) close() {
+	if e != nil {
+		closeShards(e.shards)
+	}
+}
+
+// MatchRequest matches req against the rules of all shards of e.  The results
+// of the shards are merged with the same priorities the rules would have in a
+// single engine.  res is never nil.
+func (e *shardedEngine) MatchRequest(req *urlfilter.DNSRequest) (res *urlfilter.DNSResult, ok bool) {
+	if e == nil || len(e.shards) == 0 {
+		return &urlfilter.DNSResult{}, false
+	} else if len(e.shards) == 1 {
+		return e.shards[0].engine.MatchRequest(req)
+	}
+
+	res = &urlfilter.DNSResult{}
+	hostMatched := false
+	for _, sh := range e.shards {
+		shRes, shOK := sh.engine.MatchRequest(req)
+		res.NetworkRules = append(res.NetworkRules, shRes.NetworkRules...)
+		res.HostRulesV4 = append(res.HostRulesV4, shRes.HostRulesV4...)
+		res.HostRulesV6 = append(res.HostRulesV6, shRes.HostRulesV6...)
+		hostMatched = hostMatched || (shOK && shRes.NetworkRule == nil)
+	}
+
+	// The network rules of any list take precedence over the host rules, just
+	// like within a single engine.
+	res.NetworkRule = rules.NewMatchingResult(res.NetworkRules, nil).GetBasicResult()
+	if res.NetworkRule != nil {
+		res.HostRulesV4, res.HostRulesV6 = nil, nil
+
+		return res, true
+	}
+
+	return res, hostMatched
+}
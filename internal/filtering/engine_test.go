@@ -0,0 +1,176 @@
+package filtering
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewShardedEngine_reuse(t *testing.T) {
+	dir := t.TempDir()
+	pathA := filepath.Join(dir, "a.txt")
+	pathB := filepath.Join(dir, "b.txt")
+
+	err := os.WriteFile(pathA, []byte("||a.example^\n"), 0o644)
+	require.NoError(t, err)
+
+	err = os.WriteFile(pathB, []byte("||b.example^\n"), 0o644)
+	require.NoError(t, err)
+
+	filters := []Filter{{
+		ID:   CustomListID,
+		Data: []byte("||user.example^"),
+	}, {
+		ID:       1,
+		FilePath: pathA,
+	}, {
+		ID:       2,
+		FilePath: pathB,
+	}, {
+		ID:       3,
+		FilePath: filepath.Join(dir, "missing.txt"),
+	}}
+
+	e, stale, err := newShardedEngine(nil, filters)
+	require.NoError(t, err)
+	require.Len(t, e.shards, 3)
+
+	assert.Empty(t, stale)
+
+	// Change the second list and make sure its modification time differs.
+	err = os.WriteFile(pathB, []byte("||b.example^\n||c.example^\n"), 0o644)
+	require.NoError(t, err)
+
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(pathB, later, later)
+	require.NoError(t, err)
+
+	next, stale, err := newShardedEngine(e, filters)
+	require.NoError(t, err)
+	require.Len(t, next.shards, 3)
+	require.Len(t, stale, 1)
+
+	assert.True(t, e.shards[0] == next.shards[0])
+	assert.True(t, e.shards[1] == next.shards[1])
+	assert.True(t, e.shards[2] != next.shards[2])
+	assert.True(t, e.shards[2] == stale[0])
+
+	closeShards(stale)
+
+	res, ok := next.MatchRequest(&urlfilter.DNSRequest{
+		Hostname: "c.example",
+		DNSType:  dns.TypeA,
+	})
+	require.True(t, ok)
+	require.NotNil(t, res.NetworkRule)
+
+	assert.Equal(t, 2, res.NetworkRule.GetFilterListID())
+
+	// Remove the file lists.
+	last, stale, err := newShardedEngine(next, filters[:1])
+	require.NoError(t, err)
+	require.Len(t, last.shards, 1)
+
+	assert.True(t, next.shards[0] == last.shards[0])
+	assert.Len(t, stale, 2)
+
+	closeShards(stale)
+	last.close()
+}
+
+func TestShardedEngine_MatchRequest(t *testing.T) {
+	filters := []Filter{{
+		ID: 1,
+		Data: []byte("||blocked.example^\n" +
+			"||important.example^$important\n" +
+			"||badfiltered.example^\n" +
+			"0.0.0.0 hosts.example\n" +
+			"0.0.0.0 allowed-host.example\n"),
+	}, {
+		ID: 2,
+		Data: []byte("@@||blocked.example^\n" +
+			"@@||important.example^\n" +
+			"||badfiltered.example^$badfilter\n" +
+			"::1 hosts.example\n" +
+			"@@||allowed-host.example^\n"),
+	}}
+
+	e, _, err := newShardedEngine(nil, filters)
+	require.NoError(t, err)
+	t.Cleanup(e.close)
+
+	testCases := []struct {
+		name        string
+		host        string
+		wantRule    string
+		wantHostsV4 int
+		wantHostsV6 int
+		wantOK      bool
+	}{{
+		name:     "allowlist_wins",
+		host:     "blocked.example",
+		wantRule: "@@||blocked.example^",
+		wantOK:   true,
+	}, {
+		name:     "important_wins",
+		host:     "important.example",
+		wantRule: "||important.example^$important",
+		wantOK:   true,
+	}, {
+		name:     "badfilter",
+		host:     "badfiltered.example",
+		wantRule: "",
+		wantOK:   false,
+	}, {
+		name:        "hosts_merged",
+		host:        "hosts.example",
+		wantRule:    "",
+		wantHostsV4: 1,
+		wantHostsV6: 1,
+		wantOK:      true,
+	}, {
+		name:     "network_over_hosts",
+		host:     "allowed-host.example",
+		wantRule: "@@||allowed-host.example^",
+		wantOK:   true,
+	}, {
+		name:     "none",
+		host:     "other.example",
+		wantRule: "",
+		wantOK:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, ok := e.MatchRequest(&urlfilter.DNSRequest{
+				Hostname: tc.host,
+				DNSType:  dns.TypeA,
+			})
+			require.NotNil(t, res)
+
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Len(t, res.HostRulesV4, tc.wantHostsV4)
+			assert.Len(t, res.HostRulesV6, tc.wantHostsV6)
+
+			if tc.wantRule == "" {
+				assert.Nil(t, res.NetworkRule)
+			} else {
+				require.NotNil(t, res.NetworkRule)
+
+				assert.Equal(t, tc.wantRule, res.NetworkRule.Text())
+			}
+		})
+	}
+
+	var nilEngine *shardedEngine
+	res, ok := nilEngine.MatchRequest(&urlfilter.DNSRequest{Hostname: "blocked.example"})
+	require.NotNil(t, res)
+
+	assert.False(t, ok)
+}
@@ -0,0 +1,163 @@
+package filtering
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+)
+
+// listEngineJSON is the state of the filtering engine of a single rule list in
+// the GET /control/filtering/status_detailed HTTP API.
+type listEngineJSON struct {
+	// LoadedAt is the time the rules of the list have been compiled at.  It's
+	// empty if the list isn't loaded into the engine.
+	LoadedAt string `json:"loaded_at,omitempty"`
+
+	// URL is the URL or the path of the list.
+	URL string `json:"url"`
+
+	// Name is the name of the list.
+	Name string `json:"name"`
+
+	// ID is the ID of the list.
+	ID int64 `json:"id"`
+
+	// RulesCount is the number of the rules in the list.
+	RulesCount int `json:"rules_count"`
+
+	// CompiledRulesCount is the number of the rules of the list compiled into
+	// the engine.
+	CompiledRulesCount int `json:"compiled_rules_count"`
+
+	// LoadTimeMs is the time in milliseconds it took to compile the rules of
+	// the list.
+	LoadTimeMs int64 `json:"load_time_ms"`
+
+	// MemoryEstimate is the estimated size of the compiled list in memory in
+	// bytes.
+	MemoryEstimate uint64 `json:"memory_estimate_bytes"`
+
+	// Enabled shows if the list is enabled.
+	Enabled bool `json:"enabled"`
+
+	// Loaded shows if the list is loaded into the engine.
+	Loaded bool `json:"loaded"`
+}
+
+// setShard sets the engine state fields of j from sh.  sh may be nil.
+func (j *listEngineJSON) setShard(sh *engineShard) {
+	if sh == nil {
+		return
+	}
+
+	j.LoadedAt = sh.loadedAt.Format(time.RFC3339)
+	j.CompiledRulesCount = sh.engine.RulesCount
+	j.LoadTimeMs = sh.loadTime.Milliseconds()
+	j.MemoryEstimate = sh.memEstimate
+	j.Loaded = true
+}
+
+// filteringStatusDetailedJSON is the response for the GET
+// /control/filtering/status_detailed HTTP API.
+type filteringStatusDetailedJSON struct {
+	// UserRules is the state of the engine of the user rules.
+	UserRules *listEngineJSON `json:"user_rules"`
+
+	// Filters are the states of the engines of the blocklists.
+	Filters []*listEngineJSON `json:"filters"`
+
+	// WhitelistFilters are the states of the engines of the allowlists.
+	WhitelistFilters []*listEngineJSON `json:"whitelist_filters"`
+
+	// CompiledRulesCount is the total number of the compiled rules.
+	CompiledRulesCount int `json:"compiled_rules_count"`
+
+	// MemoryEstimate is the total estimated size of the compiled lists in
+	// memory in bytes.
+	MemoryEstimate uint64 `json:"memory_estimate_bytes"`
+}
+
+// add appends the state of the engine of j to the totals of resp.
+func (resp *filteringStatusDetailedJSON) add(j *listEngineJSON) {
+	resp.CompiledRulesCount += j.CompiledRulesCount
+	resp.MemoryEstimate += j.MemoryEstimate
+}
+
+// shardsByID returns the shards of e by the IDs of their lists.
+func (e *shardedEngine) shardsByID() (shards map[int64]*engineShard) {
+	shards = map[int64]*engineShard{}
+	if e == nil {
+		return shards
+	}
+
+	for _, sh := range e.shards {
+		shards[sh.id] = sh
+	}
+
+	return shards
+}
+
+// listsEngineJSON returns the states of the engines of the lists.
+func listsEngineJSON(
+	lists []FilterYAML,
+	shards map[int64]*engineShard,
+) (res []*listEngineJSON) {
+	res = make([]*listEngineJSON, 0, len(lists))
+	for _, f := range lists {
+		j := &listEngineJSON{
+			URL:        f.URL,
+			Name:       f.Name,
+			ID:         f.ID,
+			RulesCount: f.RulesCount,
+			Enabled:    f.Enabled,
+		}
+
+		if f.Enabled {
+			j.setShard(shards[f.ID])
+		}
+
+		res = append(res, j)
+	}
+
+	return res
+}
+
+// handleFilteringStatusDetailed is the handler for the GET
+// /control/filtering/status_detailed HTTP API.
+func (d *DNSFilter) handleFilteringStatusDetailed(w http.ResponseWriter, r *http.Request) {
+	var blockShards, allowShards map[int64]*engineShard
+	func() {
+		d.engineLock.RLock()
+		defer d.engineLock.RUnlock()
+
+		blockShards = d.filteringEngine.shardsByID()
+		allowShards = d.filteringEngineAllow.shardsByID()
+	}()
+
+	resp := &filteringStatusDetailedJSON{}
+	func() {
+		d.filtersMu.RLock()
+		defer d.filtersMu.RUnlock()
+
+		resp.UserRules = &listEngineJSON{
+			ID:         CustomListID,
+			RulesCount: len(d.UserRules),
+			Enabled:    true,
+		}
+		resp.Filters = listsEngineJSON(d.Filters, blockShards)
+		resp.WhitelistFilters = listsEngineJSON(d.WhitelistFilters, allowShards)
+	}()
+
+	resp.UserRules.setShard(blockShards[CustomListID])
+	resp.add(resp.UserRules)
+	for _, j := range resp.Filters {
+		resp.add(j)
+	}
+
+	for _, j := range resp.WhitelistFilters {
+		resp.add(j)
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
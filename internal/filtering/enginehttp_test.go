@@ -0,0 +1,91 @@
+package filtering
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_handleFilteringStatusDetailed(t *testing.T) {
+	const (
+		userRules  = "||user.example^"
+		blockRules = "||a.example^\n||b.example^\n"
+		allowRules = "@@||c.example^\n"
+	)
+
+	d, _ := newForTest(t, &Config{
+		Filters: []FilterYAML{{
+			Enabled:    true,
+			URL:        "https://filters.example/block.txt",
+			Name:       "Block",
+			RulesCount: 2,
+			Filter:     Filter{ID: 1},
+		}, {
+			Enabled: false,
+			URL:     "https://filters.example/disabled.txt",
+			Name:    "Disabled",
+			Filter:  Filter{ID: 2},
+		}},
+		WhitelistFilters: []FilterYAML{{
+			Enabled:    true,
+			URL:        "https://filters.example/allow.txt",
+			Name:       "Allow",
+			RulesCount: 1,
+			Filter:     Filter{ID: 3},
+		}},
+		UserRules: []string{userRules},
+	}, nil)
+	t.Cleanup(d.Close)
+
+	err := d.initFiltering([]Filter{{ID: 3, Data: []byte(allowRules)}}, []Filter{{
+		ID:   CustomListID,
+		Data: []byte(userRules),
+	}, {
+		ID:   1,
+		Data: []byte(blockRules),
+	}})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/control/filtering/status_detailed", nil)
+	w := httptest.NewRecorder()
+
+	d.handleFilteringStatusDetailed(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &filteringStatusDetailedJSON{}
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	require.NotNil(t, resp.UserRules)
+	require.Len(t, resp.Filters, 2)
+	require.Len(t, resp.WhitelistFilters, 1)
+
+	assert.True(t, resp.UserRules.Loaded)
+	assert.Equal(t, 1, resp.UserRules.CompiledRulesCount)
+
+	block := resp.Filters[0]
+	assert.True(t, block.Loaded)
+	assert.NotEmpty(t, block.LoadedAt)
+	assert.Equal(t, 2, block.CompiledRulesCount)
+	assert.Equal(t, uint64(len(blockRules)+2*estimatedRuleSize), block.MemoryEstimate)
+
+	disabled := resp.Filters[1]
+	assert.False(t, disabled.Loaded)
+	assert.Empty(t, disabled.LoadedAt)
+	assert.Zero(t, disabled.MemoryEstimate)
+
+	allow := resp.WhitelistFilters[0]
+	assert.True(t, allow.Loaded)
+	assert.Equal(t, 1, allow.CompiledRulesCount)
+
+	assert.Equal(t, 4, resp.CompiledRulesCount)
+	assert.Equal(
+		t,
+		resp.UserRules.MemoryEstimate+block.MemoryEstimate+allow.MemoryEstimate,
+		resp.MemoryEstimate,
+	)
+}
@@ -41,6 +41,14 @@ type FilterYAML struct {
 	checksum    uint32    // checksum of the file data
 	white       bool
 
+	// UpdateInterval is the period of updating the list in hours.  If it's
+	// zero, [Config.FiltersUpdateIntervalHours] is used.
+	UpdateInterval uint32 `yaml:"update_interval,omitempty"`
+
+	// QuietWindow, if not nil, is the time of day when the list isn't updated
+	// automatically.
+	QuietWindow *QuietWindow `yaml:"quiet_window,omitempty"`
+
 	Filter `yaml:",inline"`
 }
 
@@ -50,6 +58,37 @@ func (filter *FilterYAML) unload() {
 	filter.checksum = 0
 }
 
+// validateUpdates returns an error if the update settings of filter are
+// invalid.
+func (filter *FilterYAML) validateUpdates() (err error) {
+	if !ValidateUpdateIvl(filter.UpdateInterval) {
+		return fmt.Errorf("unsupported update interval %d", filter.UpdateInterval)
+	}
+
+	err = filter.QuietWindow.validate()
+	if err != nil {
+		return fmt.Errorf("quiet window: %w", err)
+	}
+
+	return nil
+}
+
+// isUpdateDue returns true if filter should be updated automatically at now.
+// defaultHours is the global update interval, used if filter has none.  A zero
+// interval disables the automatic updates.
+func (filter *FilterYAML) isUpdateDue(defaultHours uint32, now time.Time) (ok bool) {
+	hours := filter.UpdateInterval
+	if hours == 0 {
+		hours = defaultHours
+	}
+
+	if hours == 0 || filter.QuietWindow.contains(now) {
+		return false
+	}
+
+	return !now.Before(filter.LastUpdated.Add(time.Duration(hours) * time.Hour))
+}
+
 // Path to the filter contents
 func (filter *FilterYAML) Path(dataDir string) string {
 	return filepath.Join(dataDir, filterDir, strconv.FormatInt(filter.ID, 10)+".txt")
@@ -99,17 +138,21 @@ func (d *DNSFilter) filterSetProperties(
 		filt.URL,
 	)
 
-	defer func(oldURL, oldName string, oldEnabled bool, oldUpdated time.Time, oldRulesCount int) {
+	defer func(old FilterYAML) {
 		if err != nil {
-			filt.URL = oldURL
-			filt.Name = oldName
-			filt.Enabled = oldEnabled
-			filt.LastUpdated = oldUpdated
-			filt.RulesCount = oldRulesCount
+			filt.URL = old.URL
+			filt.Name = old.Name
+			filt.Enabled = old.Enabled
+			filt.LastUpdated = old.LastUpdated
+			filt.RulesCount = old.RulesCount
+			filt.UpdateInterval = old.UpdateInterval
+			filt.QuietWindow = old.QuietWindow
 		}
-	}(filt.URL, filt.Name, filt.Enabled, filt.LastUpdated, filt.RulesCount)
+	}(*filt)
 
 	filt.Name = newList.Name
+	filt.UpdateInterval = newList.UpdateInterval
+	filt.QuietWindow = newList.QuietWindow
 
 	if filt.URL != newList.URL {
 		if d.filterExistsLocked(newList.URL) {
@@ -202,12 +245,19 @@ func (d *DNSFilter) loadFilters(array []FilterYAML) {
 			filter.ID = assignUniqueFilterID()
 		}
 
+		err := filter.validateUpdates()
+		if err != nil {
+			log.Error("filtering: filter %d: %s; using global update settings", filter.ID, err)
+
+			filter.UpdateInterval, filter.QuietWindow = 0, nil
+		}
+
 		if !filter.Enabled {
 			// No need to load a filter that is not enabled
 			continue
 		}
 
-		err := d.load(filter)
+		err = d.load(filter)
 		if err != nil {
 			log.Error("Couldn't load filter %d contents due to %s", filter.ID, err)
 		}
@@ -249,12 +299,11 @@ func (d *DNSFilter) periodicallyRefreshFilters() {
 	const maxInterval = 1 * 60 * 60
 	intval := 5 // use a dynamically increasing time interval
 	for {
-		isNetErr, ok := false, false
-		if d.FiltersUpdateIntervalHours != 0 {
-			_, isNetErr, ok = d.tryRefreshFilters(true, true, false)
-			if ok && !isNetErr {
-				intval = maxInterval
-			}
+		// Check the lists even if the global interval is zero, since they
+		// may have their own ones.
+		_, isNetErr, ok := d.tryRefreshFilters(true, true, false)
+		if ok && !isNetErr {
+			intval = maxInterval
 		}
 
 		if isNetErr {
@@ -298,11 +347,8 @@ func (d *DNSFilter) listsToUpdate(filters *[]FilterYAML, force bool) (toUpd []Fi
 			continue
 		}
 
-		if !force {
-			exp := flt.LastUpdated.Add(time.Duration(d.FiltersUpdateIntervalHours) * time.Hour)
-			if now.Before(exp) {
-				continue
-			}
+		if !force && !flt.isUpdateDue(d.FiltersUpdateIntervalHours, now) {
+			continue
 		}
 
 		toUpd = append(toUpd, FilterYAML{
@@ -318,6 +364,61 @@ func (d *DNSFilter) listsToUpdate(filters *[]FilterYAML, force bool) (toUpd []Fi
 	return toUpd
 }
 
+// FiltersSummary is the brief summary of the filter lists.
+type FiltersSummary struct {
+	// LastUpdated is the time of the latest update of an enabled list.  It's
+	// nil if none of them have been updated yet.
+	LastUpdated *time.Time `json:"last_updated,omitempty"`
+
+	// EnabledLists is the number of the enabled blocklists and allowlists.
+	EnabledLists int `json:"enabled_lists"`
+
+	// RulesCount is the total number of the rules in the enabled lists.
+	RulesCount int `json:"rules_count"`
+
+	// UpdatesDue is the number of the enabled lists the automatic update of
+	// which is due, for example because the previous attempts have failed.
+	UpdatesDue int `json:"updates_due"`
+
+	// Enabled is true if the filtering is enabled.
+	Enabled bool `json:"enabled"`
+}
+
+// Summary returns the brief summary of the filter lists.
+func (d *DNSFilter) Summary() (sum *FiltersSummary) {
+	now := time.Now()
+
+	d.filtersMu.RLock()
+	defer d.filtersMu.RUnlock()
+
+	sum = &FiltersSummary{
+		Enabled: d.FilteringEnabled,
+	}
+
+	for _, filters := range [][]FilterYAML{d.Filters, d.WhitelistFilters} {
+		for i := range filters {
+			flt := &filters[i]
+			if !flt.Enabled {
+				continue
+			}
+
+			sum.EnabledLists++
+			sum.RulesCount += flt.RulesCount
+			if flt.isUpdateDue(d.FiltersUpdateIntervalHours, now) {
+				sum.UpdatesDue++
+			}
+
+			if !flt.LastUpdated.IsZero() &&
+				(sum.LastUpdated == nil || flt.LastUpdated.After(*sum.LastUpdated)) {
+				lastUpdated := flt.LastUpdated
+				sum.LastUpdated = &lastUpdated
+			}
+		}
+	}
+
+	return sum
+}
+
 func (d *DNSFilter) refreshFiltersArray(filters *[]FilterYAML, force bool) (int, []FilterYAML, []bool, bool) {
 	var updateFlags []bool // 'true' if filter data has changed
 
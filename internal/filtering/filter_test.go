@@ -120,3 +120,42 @@ func TestFilters(t *testing.T) {
 		f.unload()
 	})
 }
+
+func TestDNSFilter_Summary(t *testing.T) {
+	d, _ := newForTest(t, &Config{
+		FilteringEnabled:           true,
+		FiltersUpdateIntervalHours: 24,
+	}, nil)
+	t.Cleanup(d.Close)
+
+	now := time.Now()
+	older := now.Add(-48 * time.Hour)
+
+	assert.Equal(t, &FiltersSummary{Enabled: true}, d.Summary())
+
+	d.Filters = []FilterYAML{{
+		Enabled:     true,
+		RulesCount:  10,
+		LastUpdated: now,
+	}, {
+		Enabled:     true,
+		RulesCount:  5,
+		LastUpdated: older,
+	}, {
+		Enabled:     false,
+		RulesCount:  100,
+		LastUpdated: now.Add(time.Hour),
+	}}
+	d.WhitelistFilters = []FilterYAML{{
+		Enabled:    true,
+		RulesCount: 1,
+	}}
+
+	assert.Equal(t, &FiltersSummary{
+		LastUpdated:  &now,
+		EnabledLists: 3,
+		RulesCount:   16,
+		UpdatesDue:   2,
+		Enabled:      true,
+	}, d.Summary())
+}
@@ -15,6 +15,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
@@ -23,6 +24,7 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/mathutil"
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/AdguardTeam/urlfilter"
 	"github.com/AdguardTeam/urlfilter/filterlist"
@@ -42,6 +44,8 @@ const (
 	ParentalListID
 	SafeBrowsingListID
 	SafeSearchListID
+	DefaultDenyListID
+	RebindingListID
 )
 
 // ServiceEntry - blocked service array element
@@ -58,14 +62,44 @@ type Settings struct {
 
 	ServicesRules []ServiceEntry
 
+	// AllowedServicesRules are the rules of the services allowed in the
+	// default deny mode.
+	AllowedServicesRules []ServiceEntry
+
 	ProtectionEnabled   bool
 	FilteringEnabled    bool
 	SafeSearchEnabled   bool
 	SafeBrowsingEnabled bool
 	ParentalEnabled     bool
 
+	// ParentalStrictSearch, if true, enforces the DuckDuckGo safe mode and the
+	// strict image search of the search engines.  It doesn't depend on
+	// ParentalEnabled.
+	ParentalStrictSearch bool
+
+	// DefaultDeny, if true, blocks all hosts not matched by an allowlist rule
+	// or AllowedServicesRules.  It requires FilteringEnabled.
+	DefaultDeny bool
+
+	// DryRun, if true, means that the filtering results must only be recorded
+	// and never applied to the responses.
+	DryRun bool
+
 	// ClientSafeSearch is a client configured safe search.
 	ClientSafeSearch SafeSearch
+
+	// Rewrites are the legacy DNS rewrites checked before the global ones, for
+	// example the ones of the client's DNS view.  They must be prepared with
+	// [PrepareRewrites].
+	Rewrites []*LegacyRewrite
+
+	// UseOwnBlockedServices is true if ServicesRules contain the client's own
+	// blocked services and not the global ones.
+	UseOwnBlockedServices bool
+
+	// IgnoreLogging, if true, means that the requests must be neither written
+	// into the query log nor counted in the statistics.
+	IgnoreLogging bool
 }
 
 // Resolver is the interface for net.Resolver to simplify testing.
@@ -85,9 +119,25 @@ type Config struct {
 	FilteringEnabled           bool   `yaml:"filtering_enabled"`       // whether or not use filter lists
 	FiltersUpdateIntervalHours uint32 `yaml:"filters_update_interval"` // time period to update filters (in hours)
 
+	// DryRun, if true, makes the filtering results only recorded in the query
+	// log and the statistics, while the requests are never actually blocked.
+	// Per-client settings can override this configuration.
+	DryRun bool `yaml:"filtering_dry_run"`
+
 	ParentalEnabled     bool `yaml:"parental_enabled"`
 	SafeBrowsingEnabled bool `yaml:"safebrowsing_enabled"`
 
+	// ParentalStrictSearch, if true, enforces the DuckDuckGo safe mode and the
+	// strict image search of the search engines regardless of
+	// ParentalEnabled.  Per-client settings can override this configuration.
+	ParentalStrictSearch bool `yaml:"parental_strict_search"`
+
+	// SafeBrowsingService is the lookup service of the safe browsing.
+	SafeBrowsingService LookupServiceConfig `yaml:"safebrowsing_service"`
+
+	// ParentalService is the lookup service of the parental control.
+	ParentalService LookupServiceConfig `yaml:"parental_service"`
+
 	SafeBrowsingCacheSize uint `yaml:"safebrowsing_cache_size"` // (in bytes)
 	SafeSearchCacheSize   uint `yaml:"safesearch_cache_size"`   // (in bytes)
 	ParentalCacheSize     uint `yaml:"parental_cache_size"`     // (in bytes)
@@ -103,6 +153,14 @@ type Config struct {
 	// Per-client settings can override this configuration.
 	BlockedServices []string `yaml:"blocked_services"`
 
+	// BlockedServicesCatalog is the configuration of the remote catalog of the
+	// blocked services.
+	BlockedServicesCatalog ServicesCatalogConfig `yaml:"blocked_services_catalog"`
+
+	// ServicesCatalog is the catalog of the blocked services in use.  If nil,
+	// a new one with the built-in services is used.
+	ServicesCatalog *ServicesCatalog `yaml:"-"`
+
 	// EtcHosts is a container of IP-hostname pairs taken from the operating
 	// system configuration files (e.g. /etc/hosts).
 	EtcHosts *aghnet.HostsContainer `yaml:"-"`
@@ -113,6 +171,11 @@ type Config struct {
 	// Register an HTTP handler
 	HTTPRegister aghhttp.RegisterFunc `yaml:"-"`
 
+	// ApplyClientSettings, if not nil, applies the settings of the client to
+	// setts, so that the hosts could be checked on behalf of the client.  id
+	// is an IP address, a ClientID, or a name of a persistent client.
+	ApplyClientSettings func(id string, setts *Settings) `yaml:"-"`
+
 	// HTTPClient is the client to use for updating the remote filters.
 	HTTPClient *http.Client `yaml:"-"`
 
@@ -130,6 +193,14 @@ type Config struct {
 
 	// UserRules is the global list of custom rules.
 	UserRules []string `yaml:"-"`
+
+	// UserRuleGroups are the named groups of the custom rules.  If not nil,
+	// UserRules are compiled from the enabled ones.
+	UserRuleGroups []*UserRuleGroup `yaml:"-"`
+
+	// UserRulesRevisionsLimit is the maximum number of the saved revisions of
+	// the custom rules.  Zero disables saving them.
+	UserRulesRevisionsLimit uint32 `yaml:"user_rules_revisions_limit"`
 }
 
 // LookupStats store stats collected during safebrowsing or parental checks
@@ -160,19 +231,32 @@ type hostChecker struct {
 
 // DNSFilter matches hostnames and DNS requests against filtering rules.
 type DNSFilter struct {
-	rulesStorage    *filterlist.RuleStorage
-	filteringEngine *urlfilter.DNSEngine
+	// filteringEngine and filteringEngineAllow match the requests against the
+	// blocklists and the allowlists respectively.
+	filteringEngine      *shardedEngine
+	filteringEngineAllow *shardedEngine
 
-	rulesStorageAllow    *filterlist.RuleStorage
-	filteringEngineAllow *urlfilter.DNSEngine
+	// sizeRules are the user rules with the size modifiers, which aren't
+	// passed to filteringEngine.
+	sizeRules []*sizeRule
 
 	engineLock sync.RWMutex
 
+	// engineInitLock serializes the initializations of the filtering engines,
+	// since each of them reuses the shards of the previous engines.
+	engineInitLock sync.Mutex
+
 	parentalServer       string // access via methods
 	safeBrowsingServer   string // access via methods
+	parentalSuffix       string
+	safeBrowsingSuffix   string
 	parentalUpstream     upstream.Upstream
 	safeBrowsingUpstream upstream.Upstream
 
+	// ruleRevisions are the saved revisions of the user rule groups, the
+	// latest last.  It's protected by Config.filtersMu.
+	ruleRevisions []*UserRulesRevision
+
 	safebrowsingCache cache.Cache
 	parentalCache     cache.Cache
 
@@ -180,20 +264,45 @@ type DNSFilter struct {
 	// confLock protects Config.
 	confLock sync.RWMutex
 
+	// servicesMu serializes the updates of the catalog of the blocked
+	// services and protects the fields below.
+	servicesMu *sync.Mutex
+
+	// servicesCheckedAt is the time of the latest successful check for a new
+	// version of the catalog of the blocked services.
+	servicesCheckedAt time.Time
+
+	// servicesErr is the error of the latest check for a new version of the
+	// catalog of the blocked services.
+	servicesErr error
+
 	// Channel for passing data to filters-initializer goroutine
 	filtersInitializerChan chan filtersInitializerParams
 	filtersInitializerLock sync.Mutex
 
 	refreshLock *sync.Mutex
 
+	// benchmarkLock prevents running several benchmarks simultaneously.
+	benchmarkLock *sync.Mutex
+
 	// filterTitleRegexp is the regular expression to retrieve a name of a
 	// filter list.
 	//
 	// TODO(e.burkov):  Don't use regexp for such a simple text processing task.
 	filterTitleRegexp *regexp.Regexp
 
+	// strictSearchEngine matches the hosts of the search engines in the strict
+	// search mode of the parental control.
+	strictSearchEngine *urlfilter.DNSEngine
+
 	safeSearch   SafeSearch
 	hostCheckers []hostChecker
+
+	// learningMu protects learning.
+	learningMu *sync.Mutex
+
+	// learning is the current allowlist learning session, if any.
+	learning *learningSession
 }
 
 // Filter represents a filter list
@@ -252,6 +361,16 @@ const (
 	//
 	// See https://github.com/AdguardTeam/AdGuardHome/issues/2499.
 	RewrittenRule
+
+	// FilteredDefaultDeny is returned when the host isn't allowed in the
+	// default deny mode.  It's placed after all other reasons to keep the
+	// numeric values of those in the query log.
+	FilteredDefaultDeny
+
+	// FilteredRebinding is returned when the response for a public domain
+	// name contains a private IP address and the DNS rebinding protection is
+	// enabled.
+	FilteredRebinding
 )
 
 // TODO(a.garipov): Resync with actual code names or replace completely
@@ -271,6 +390,9 @@ var reasonNames = []string{
 	Rewritten:          "Rewrite",
 	RewrittenAutoHosts: "RewriteEtcHosts",
 	RewrittenRule:      "RewriteRule",
+
+	FilteredDefaultDeny: "FilteredDefaultDeny",
+	FilteredRebinding:   "FilteredRebinding",
 }
 
 func (r Reason) String() string {
@@ -295,10 +417,12 @@ func (d *DNSFilter) GetConfig() (s Settings) {
 	defer d.confLock.RUnlock()
 
 	return Settings{
-		FilteringEnabled:    atomic.LoadUint32(&d.Config.enabled) != 0,
-		SafeSearchEnabled:   d.Config.SafeSearchConf.Enabled,
-		SafeBrowsingEnabled: d.Config.SafeBrowsingEnabled,
-		ParentalEnabled:     d.Config.ParentalEnabled,
+		FilteringEnabled:     atomic.LoadUint32(&d.Config.enabled) != 0,
+		SafeSearchEnabled:    d.Config.SafeSearchConf.Enabled,
+		SafeBrowsingEnabled:  d.Config.SafeBrowsingEnabled,
+		ParentalEnabled:      d.Config.ParentalEnabled,
+		DryRun:               d.Config.DryRun,
+		ParentalStrictSearch: d.Config.ParentalStrictSearch,
 	}
 }
 
@@ -318,6 +442,62 @@ func (d *DNSFilter) WriteDiskConfig(c *Config) {
 	c.Filters = slices.Clone(d.Filters)
 	c.WhitelistFilters = slices.Clone(d.WhitelistFilters)
 	c.UserRules = slices.Clone(d.UserRules)
+	c.UserRuleGroups = cloneRuleGroups(d.UserRuleGroups)
+}
+
+// Reload replaces the settings, the legacy rewrites, the blocked services, and
+// the filter lists of d with the ones from c and enables the new filter lists.
+// The callbacks, the caches, the lookup services, and the safe search of d are
+// kept.  c must not be nil.
+func (d *DNSFilter) Reload(c *Config) (err error) {
+	rewrites := cloneRewrites(c.Rewrites)
+	for i, r := range rewrites {
+		err = r.normalize()
+		if err != nil {
+			return fmt.Errorf("rewrites: at index %d: %w", i, err)
+		}
+	}
+
+	filters := deduplicateFilters(slices.Clone(c.Filters))
+	allowFilters := deduplicateFilters(slices.Clone(c.WhitelistFilters))
+
+	d.loadFilters(filters)
+	d.loadFilters(allowFilters)
+
+	updateUniqueFilterID(filters)
+	updateUniqueFilterID(allowFilters)
+
+	func() {
+		d.confLock.Lock()
+		defer d.confLock.Unlock()
+
+		d.DryRun = c.DryRun
+		d.ParentalEnabled = c.ParentalEnabled
+		d.SafeBrowsingEnabled = c.SafeBrowsingEnabled
+		d.ParentalStrictSearch = c.ParentalStrictSearch
+		d.Rewrites = rewrites
+		d.BlockedServices = d.knownBlockedServices(c.BlockedServices)
+		d.BlockedServicesCatalog = c.BlockedServicesCatalog
+	}()
+
+	d.filtersMu.Lock()
+	defer d.filtersMu.Unlock()
+
+	d.FilteringEnabled = c.FilteringEnabled
+	d.FiltersUpdateIntervalHours = c.FiltersUpdateIntervalHours
+	d.Filters = filters
+	d.WhitelistFilters = allowFilters
+	d.UserRules = slices.Clone(c.UserRules)
+	d.UserRuleGroups = cloneRuleGroups(c.UserRuleGroups)
+	if d.UserRuleGroups != nil {
+		d.UserRules = compileRuleGroups(d.UserRuleGroups)
+	}
+
+	d.UserRulesRevisionsLimit = c.UserRulesRevisionsLimit
+
+	d.enableFiltersLocked(false)
+
+	return nil
 }
 
 // cloneRewrites returns a deep copy of entries.
@@ -371,6 +551,15 @@ func (d *DNSFilter) SetFilters(blockFilters, allowFilters []Filter, async bool)
 	return nil
 }
 
+// RulesLoaded returns true if the filtering engines have been initialized, so
+// that the requests are matched against the filtering rules.
+func (d *DNSFilter) RulesLoaded() (ok bool) {
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	return d.filteringEngine != nil
+}
+
 // Starts initializing new filters by signal from channel
 func (d *DNSFilter) filtersInitializer() {
 	for {
@@ -391,18 +580,12 @@ func (d *DNSFilter) Close() {
 	d.reset()
 }
 
+// reset closes the filtering engines.  d.engineLock is expected to be locked.
 func (d *DNSFilter) reset() {
-	if d.rulesStorage != nil {
-		if err := d.rulesStorage.Close(); err != nil {
-			log.Error("filtering: rulesStorage.Close: %s", err)
-		}
-	}
+	d.filteringEngine.close()
+	d.filteringEngineAllow.close()
 
-	if d.rulesStorageAllow != nil {
-		if err := d.rulesStorageAllow.Close(); err != nil {
-			log.Error("filtering: rulesStorageAllow.Close: %s", err)
-		}
-	}
+	d.filteringEngine, d.filteringEngineAllow = nil, nil
 }
 
 // ResultRule contains information about applied rules.
@@ -447,6 +630,10 @@ type Result struct {
 
 	// IsFiltered is true if the request is filtered.
 	IsFiltered bool `json:",omitempty"`
+
+	// DryRun is true if the request is filtered in the dry-run mode, so the
+	// result must only be recorded and not applied to the response.
+	DryRun bool `json:",omitempty"`
 }
 
 // Matched returns true if any match at all was found regardless of
@@ -476,7 +663,14 @@ func (d *DNSFilter) CheckHost(
 	host = strings.ToLower(host)
 
 	if setts.FilteringEnabled {
-		res = d.processRewrites(host, qtype)
+		if _, matched := findRewrites(setts.Rewrites, host, qtype); matched {
+			// The rewrites from the settings, for example the ones of the
+			// client's DNS view, take precedence over the global ones.
+			res = processLegacyRewrites(setts.Rewrites, host, qtype)
+		} else {
+			res = d.processRewrites(host, qtype)
+		}
+
 		if res.Reason == Rewritten {
 			return res, nil
 		}
@@ -493,9 +687,51 @@ func (d *DNSFilter) CheckHost(
 		}
 	}
 
+	if setts.DefaultDeny {
+		return checkDefaultDeny(host, setts), nil
+	}
+
 	return Result{}, nil
 }
 
+// checkDefaultDeny returns the result for host, which hasn't been matched by
+// any other checks, in the default deny mode.  The reverse lookups and other
+// special-use names within the arpa domain are always allowed.
+func checkDefaultDeny(host string, setts *Settings) (res Result) {
+	if !setts.ProtectionEnabled || !setts.FilteringEnabled || netutil.IsSubdomain(host, "arpa") {
+		return Result{}
+	}
+
+	req := rules.NewRequestForHostname(host)
+	for _, s := range setts.AllowedServicesRules {
+		for _, rule := range s.Rules {
+			if rule.Match(req) {
+				log.Debug("default deny: host %s allowed by service %s", host, s.Name)
+
+				return Result{
+					Rules: []*ResultRule{{
+						FilterListID: int64(rule.GetFilterListID()),
+						Text:         rule.Text(),
+					}},
+					Reason:      NotFilteredAllowList,
+					ServiceName: s.Name,
+				}
+			}
+		}
+	}
+
+	log.Debug("default deny: host %s denied", host)
+
+	return Result{
+		Rules: []*ResultRule{{
+			FilterListID: DefaultDenyListID,
+			Text:         "default deny",
+		}},
+		Reason:     FilteredDefaultDeny,
+		IsFiltered: true,
+	}
+}
+
 // matchSysHosts tries to match the host against the operating system's hosts
 // database.  err is always nil.
 func (d *DNSFilter) matchSysHosts(
@@ -546,7 +782,13 @@ func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 	d.confLock.RLock()
 	defer d.confLock.RUnlock()
 
-	rewrites, matched := findRewrites(d.Rewrites, host, qtype)
+	return processLegacyRewrites(d.Rewrites, host, qtype)
+}
+
+// processLegacyRewrites performs filtering of host based on the legacy rewrite
+// records from entries, as described by [DNSFilter.processRewrites].
+func processLegacyRewrites(entries []*LegacyRewrite, host string, qtype uint16) (res Result) {
+	rewrites, matched := findRewrites(entries, host, qtype)
 	if !matched {
 		return Result{}
 	}
@@ -586,7 +828,7 @@ func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 
 		cnames.Add(host)
 		res.CanonName = host
-		rewrites, matched = findRewrites(d.Rewrites, host, qtype)
+		rewrites, matched = findRewrites(entries, host, qtype)
 	}
 
 	setRewriteResult(&res, host, rewrites, qtype)
@@ -708,32 +950,46 @@ func newRuleStorage(filters []Filter) (rs *filterlist.RuleStorage, err error) {
 	return rs, nil
 }
 
-// Initialize urlfilter objects.
-func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter) error {
-	rulesStorage, err := newRuleStorage(blockFilters)
+// initFiltering initializes the filtering engines.  Only the shards of the
+// lists which have changed since the previous initialization are rebuilt.
+func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter) (err error) {
+	d.engineInitLock.Lock()
+	defer d.engineInitLock.Unlock()
+
+	var prevBlock, prevAllow *shardedEngine
+	func() {
+		d.engineLock.RLock()
+		defer d.engineLock.RUnlock()
+
+		prevBlock, prevAllow = d.filteringEngine, d.filteringEngineAllow
+	}()
+
+	blockFilters, sizeRules := extractSizeRules(blockFilters)
+	filteringEngine, staleBlock, err := newShardedEngine(prevBlock, blockFilters)
 	if err != nil {
 		return err
 	}
 
-	rulesStorageAllow, err := newRuleStorage(allowFilters)
+	filteringEngineAllow, staleAllow, err := newShardedEngine(prevAllow, allowFilters)
 	if err != nil {
+		// Only close the new shards, since the others are still in use.
+		closeShards(newShards(filteringEngine, prevBlock))
+
 		return err
 	}
 
-	filteringEngine := urlfilter.NewDNSEngine(rulesStorage)
-	filteringEngineAllow := urlfilter.NewDNSEngine(rulesStorageAllow)
-
 	func() {
 		d.engineLock.Lock()
 		defer d.engineLock.Unlock()
 
-		d.reset()
-		d.rulesStorage = rulesStorage
 		d.filteringEngine = filteringEngine
-		d.rulesStorageAllow = rulesStorageAllow
 		d.filteringEngineAllow = filteringEngineAllow
+		d.sizeRules = sizeRules
 	}()
 
+	closeShards(staleBlock)
+	closeShards(staleAllow)
+
 	// Make sure that the OS reclaims memory as soon as possible.
 	debug.FreeOSMemory()
 	log.Debug("initialized filtering engine")
@@ -941,6 +1197,8 @@ func InitModule() {
 func New(c *Config, blockFilters []Filter) (d *DNSFilter, err error) {
 	d = &DNSFilter{
 		refreshLock:       &sync.Mutex{},
+		benchmarkLock:     &sync.Mutex{},
+		learningMu:        &sync.Mutex{},
 		filterTitleRegexp: regexp.MustCompile(`^! Title: +(.*)$`),
 	}
 
@@ -970,6 +1228,9 @@ func New(c *Config, blockFilters []Filter) (d *DNSFilter, err error) {
 	}, {
 		check: d.checkParental,
 		name:  "parental",
+	}, {
+		check: d.checkStrictSearch,
+		name:  "strict search",
 	}, {
 		check: d.checkSafeSearch,
 		name:  "safe search",
@@ -977,29 +1238,39 @@ func New(c *Config, blockFilters []Filter) (d *DNSFilter, err error) {
 
 	defer func() { err = errors.Annotate(err, "filtering: %w") }()
 
-	err = d.initSecurityServices()
+	err = d.initSecurityServices(c)
 	if err != nil {
 		return nil, fmt.Errorf("initializing services: %s", err)
 	}
 
+	d.strictSearchEngine, err = newStrictSearchEngine()
+	if err != nil {
+		return nil, fmt.Errorf("strict search: %w", err)
+	}
+
 	d.Config = *c
 	d.filtersMu = &sync.RWMutex{}
+	d.servicesMu = &sync.Mutex{}
+	if d.ServicesCatalog == nil {
+		d.ServicesCatalog = newBuiltinServicesCatalog()
+	}
+
+	if d.UserRuleGroups != nil {
+		d.UserRules = compileRuleGroups(d.UserRuleGroups)
+	}
+
+	err = d.readRuleRevisions()
+	if err != nil {
+		// Don't fail, since the revisions aren't required.
+		log.Error("filtering: user rules: %s", err)
+	}
 
 	err = d.prepareRewrites()
 	if err != nil {
 		return nil, fmt.Errorf("rewrites: preparing: %s", err)
 	}
 
-	bsvcs := []string{}
-	for _, s := range d.BlockedServices {
-		if !BlockedSvcKnown(s) {
-			log.Debug("skipping unknown blocked-service %q", s)
-
-			continue
-		}
-		bsvcs = append(bsvcs, s)
-	}
-	d.BlockedServices = bsvcs
+	d.BlockedServices = d.knownBlockedServices(d.BlockedServices)
 
 	if blockFilters != nil {
 		err = d.initFiltering(nil, blockFilters)
@@ -1037,4 +1308,5 @@ func (d *DNSFilter) Start() {
 	//  but currently we can't wake up the periodic task to do so.
 	// So for now we just start this periodic task from here.
 	go d.periodicallyRefreshFilters()
+	go d.periodicallyRefreshServices()
 }
@@ -576,6 +576,94 @@ func TestWhitelist(t *testing.T) {
 	assert.Equal(t, "||host2^", res.Rules[0].Text)
 }
 
+func TestDefaultDeny(t *testing.T) {
+	InitModule()
+
+	filters := []Filter{{
+		ID: 0, Data: []byte("||blocked.example^\n"),
+	}}
+	whiteFilters := []Filter{{
+		ID: 0, Data: []byte("@@||allowed.example^\n"),
+	}}
+
+	d, setts := newForTest(t, nil, filters)
+	t.Cleanup(d.Close)
+
+	err := d.SetFilters(filters, whiteFilters, false)
+	require.NoError(t, err)
+
+	setts.DefaultDeny = true
+	d.ApplyAllowedServices(setts, []string{"youtube"})
+
+	testCases := []struct {
+		name        string
+		host        string
+		wantRule    string
+		wantService string
+		wantReason  Reason
+	}{{
+		name:        "allowlist",
+		host:        "allowed.example",
+		wantRule:    "@@||allowed.example^",
+		wantService: "",
+		wantReason:  NotFilteredAllowList,
+	}, {
+		name:        "service",
+		host:        "www.youtube.com",
+		wantRule:    "||youtube.com^",
+		wantService: "youtube",
+		wantReason:  NotFilteredAllowList,
+	}, {
+		name:        "blocklist",
+		host:        "blocked.example",
+		wantRule:    "||blocked.example^",
+		wantService: "",
+		wantReason:  FilteredBlockList,
+	}, {
+		name:        "denied",
+		host:        "other.example",
+		wantRule:    "default deny",
+		wantService: "",
+		wantReason:  FilteredDefaultDeny,
+	}, {
+		name:        "arpa",
+		host:        "1.0.0.127.in-addr.arpa",
+		wantRule:    "",
+		wantService: "",
+		wantReason:  NotFilteredNotFound,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, cErr := d.CheckHost(tc.host, dns.TypeA, setts)
+			require.NoError(t, cErr)
+
+			assert.Equal(t, tc.wantReason, res.Reason)
+			assert.Equal(t, tc.wantService, res.ServiceName)
+
+			if tc.wantRule == "" {
+				assert.Empty(t, res.Rules)
+
+				return
+			}
+
+			require.Len(t, res.Rules, 1)
+
+			assert.Equal(t, tc.wantRule, res.Rules[0].Text)
+		})
+	}
+
+	t.Run("filtering_disabled", func(t *testing.T) {
+		disabled := *setts
+		disabled.FilteringEnabled = false
+
+		res, cErr := d.CheckHost("other.example", dns.TypeA, &disabled)
+		require.NoError(t, cErr)
+
+		assert.False(t, res.IsFiltered)
+	})
+}
+
 // Client Settings.
 
 func applyClientSettings(setts *Settings) {
@@ -693,3 +781,34 @@ func BenchmarkSafeBrowsingParallel(b *testing.B) {
 		}
 	})
 }
+
+func TestDNSFilter_Reload(t *testing.T) {
+	const host = "example.org"
+
+	f, setts := newForTest(t, &Config{DataDir: t.TempDir()}, nil)
+	t.Cleanup(f.Close)
+
+	f.checkMatchEmpty(t, host, setts)
+
+	err := f.Reload(&Config{
+		Rewrites: []*LegacyRewrite{{
+			Domain: "example.net",
+			Answer: "1.2.3.4",
+		}},
+		BlockedServices:  []string{"unknown_service"},
+		UserRules:        []string{"||" + host + "^"},
+		FilteringEnabled: true,
+		DryRun:           true,
+	})
+	require.NoError(t, err)
+
+	f.checkMatch(t, host, setts)
+	assert.True(t, f.GetConfig().DryRun)
+	assert.Empty(t, f.BlockedServices)
+
+	res, err := f.CheckHost("example.net", dns.TypeA, setts)
+	require.NoError(t, err)
+
+	assert.Equal(t, Rewritten, res.Reason)
+	assert.Equal(t, []net.IP{{1, 2, 3, 4}}, res.IPList)
+}
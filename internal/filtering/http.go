@@ -8,12 +8,16 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
 )
 
 // validateFilterURL validates the filter list URL or file name.
@@ -179,9 +183,11 @@ func (d *DNSFilter) handleFilteringRemoveURL(w http.ResponseWriter, r *http.Requ
 }
 
 type filterURLReqData struct {
-	Name    string `json:"name"`
-	URL     string `json:"url"`
-	Enabled bool   `json:"enabled"`
+	QuietWindow    *QuietWindow `json:"quiet_window"`
+	Name           string       `json:"name"`
+	URL            string       `json:"url"`
+	UpdateInterval uint32       `json:"update_interval"`
+	Enabled        bool         `json:"enabled"`
 }
 
 type filterURLReq struct {
@@ -213,9 +219,18 @@ func (d *DNSFilter) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 	}
 
 	filt := FilterYAML{
-		Enabled: fj.Data.Enabled,
-		Name:    fj.Data.Name,
-		URL:     fj.Data.URL,
+		Enabled:        fj.Data.Enabled,
+		Name:           fj.Data.Name,
+		URL:            fj.Data.URL,
+		UpdateInterval: fj.Data.UpdateInterval,
+		QuietWindow:    fj.Data.QuietWindow,
+	}
+
+	err = filt.validateUpdates()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
 	}
 
 	restart, err := d.filterSetProperties(fj.URL, filt, fj.Whitelist)
@@ -231,6 +246,218 @@ func (d *DNSFilter) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// filterListJSON is a rule list in the GET /control/filtering/filters and the
+// PUT /control/filtering/filters/replace HTTP APIs.  Unlike [filterJSON], it
+// only contains the configurable properties of the list.
+type filterListJSON struct {
+	QuietWindow    *QuietWindow `json:"quiet_window,omitempty"`
+	URL            string       `json:"url"`
+	Name           string       `json:"name"`
+	UpdateInterval uint32       `json:"update_interval,omitempty"`
+	Enabled        bool         `json:"enabled"`
+}
+
+// filterListsJSON is the full set of the rule lists.
+type filterListsJSON struct {
+	Filters          []*filterListJSON `json:"filters"`
+	WhitelistFilters []*filterListJSON `json:"whitelist_filters"`
+}
+
+// validate returns an error if lists contain invalid or duplicate URLs.
+func (lists *filterListsJSON) validate() (err error) {
+	urls := stringutil.NewSet()
+	for _, fjs := range [][]*filterListJSON{lists.Filters, lists.WhitelistFilters} {
+		for _, fj := range fjs {
+			if fj == nil {
+				return errors.Error("rule list is null")
+			}
+
+			err = validateFilterURL(fj.URL)
+			if err != nil {
+				return fmt.Errorf("invalid url: %w", err)
+			}
+
+			if urls.Has(fj.URL) {
+				return fmt.Errorf("duplicate url %q", fj.URL)
+			}
+
+			err = (&FilterYAML{
+				UpdateInterval: fj.UpdateInterval,
+				QuietWindow:    fj.QuietWindow,
+			}).validateUpdates()
+			if err != nil {
+				return fmt.Errorf("rule list %q: %w", fj.URL, err)
+			}
+
+			urls.Add(fj.URL)
+		}
+	}
+
+	return nil
+}
+
+// toFilterListsJSON converts flts into their JSON representations.
+func toFilterListsJSON(flts []FilterYAML) (fjs []*filterListJSON) {
+	fjs = make([]*filterListJSON, 0, len(flts))
+	for _, f := range flts {
+		fjs = append(fjs, &filterListJSON{
+			QuietWindow:    f.QuietWindow,
+			URL:            f.URL,
+			Name:           f.Name,
+			UpdateInterval: f.UpdateInterval,
+			Enabled:        f.Enabled,
+		})
+	}
+
+	return fjs
+}
+
+// filterListsJSON returns the JSON representation of the current rule lists.
+// It's safe for concurrent use.
+func (d *DNSFilter) filterListsJSON() (lists *filterListsJSON) {
+	d.filtersMu.RLock()
+	defer d.filtersMu.RUnlock()
+
+	return &filterListsJSON{
+		Filters:          toFilterListsJSON(d.Filters),
+		WhitelistFilters: toFilterListsJSON(d.WhitelistFilters),
+	}
+}
+
+// handleFilterLists is the handler for the GET /control/filtering/filters HTTP
+// API.
+func (d *DNSFilter) handleFilterLists(w http.ResponseWriter, r *http.Request) {
+	lists := d.filterListsJSON()
+
+	err := aghhttp.SetETag(w, r, lists)
+	if err != nil {
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, lists)
+}
+
+// handleFilterListsReplace is the handler for the PUT
+// /control/filtering/filters/replace HTTP API.  It replaces all rule lists with
+// the ones from the request.  The request is rejected if its If-Match header
+// doesn't match the entity tag of the current lists, see
+// [DNSFilter.handleFilterLists].
+func (d *DNSFilter) handleFilterListsReplace(w http.ResponseWriter, r *http.Request) {
+	req := &filterListsJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	err = req.validate()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	// The modifying HTTP APIs are serialized by the control lock, so the lists
+	// can't be changed between the check and the replacement.
+	if !aghhttp.CheckIfMatch(w, r, d.filterListsJSON()) {
+		return
+	}
+
+	d.filtersMu.RLock()
+	curFilters := slices.Clone(d.Filters)
+	curAllowlists := slices.Clone(d.WhitelistFilters)
+	d.filtersMu.RUnlock()
+
+	filters, err := d.replacedFilterLists(curFilters, req.Filters, false)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	allowlists, err := d.replacedFilterLists(curAllowlists, req.WhitelistFilters, true)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	d.filtersMu.Lock()
+	d.removeReplacedFilterLists(d.Filters, filters)
+	d.removeReplacedFilterLists(d.WhitelistFilters, allowlists)
+	d.Filters, d.WhitelistFilters = filters, allowlists
+	d.filtersMu.Unlock()
+
+	d.ConfigModified()
+	d.EnableFilters(true)
+}
+
+// replacedFilterLists returns the rule lists built from the current ones cur
+// and the requested ones fjs.  The lists with the same URLs keep their IDs and
+// contents, while the new and the newly enabled ones are downloaded.
+func (d *DNSFilter) replacedFilterLists(
+	cur []FilterYAML,
+	fjs []*filterListJSON,
+	isAllowlist bool,
+) (flts []FilterYAML, err error) {
+	flts = make([]FilterYAML, 0, len(fjs))
+	for _, fj := range fjs {
+		var flt FilterYAML
+		isNew, needsUpdate := false, fj.Enabled
+		if i := slices.IndexFunc(cur, func(f FilterYAML) bool { return f.URL == fj.URL }); i >= 0 {
+			flt = cur[i]
+			needsUpdate = fj.Enabled && !flt.Enabled
+		} else {
+			isNew = true
+			flt = FilterYAML{
+				URL:   fj.URL,
+				white: isAllowlist,
+				Filter: Filter{
+					ID: assignUniqueFilterID(),
+				},
+			}
+		}
+
+		flt.Name = fj.Name
+		flt.Enabled = fj.Enabled
+		flt.UpdateInterval = fj.UpdateInterval
+		flt.QuietWindow = fj.QuietWindow
+
+		if !flt.Enabled {
+			flt.unload()
+		} else if needsUpdate {
+			var ok bool
+			ok, err = d.update(&flt)
+			if err != nil {
+				return nil, fmt.Errorf("fetching filter from url %s: %w", flt.URL, err)
+			} else if isNew && !ok {
+				return nil, fmt.Errorf("filter at the url %s is invalid", flt.URL)
+			}
+		}
+
+		flts = append(flts, flt)
+	}
+
+	return flts, nil
+}
+
+// removeReplacedFilterLists renames the files of the rule lists from cur that
+// aren't present in flts.  d.filtersMu is expected to be locked.
+func (d *DNSFilter) removeReplacedFilterLists(cur, flts []FilterYAML) {
+	for _, f := range cur {
+		if slices.IndexFunc(flts, func(nf FilterYAML) bool { return nf.ID == f.ID }) >= 0 {
+			continue
+		}
+
+		path := f.Path(d.DataDir)
+		err := os.Rename(path, path+".old")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error("deleting filter %q: %s", path, err)
+		}
+	}
+}
+
 // filteringRulesReq is the JSON structure for settings custom filtering rules.
 type filteringRulesReq struct {
 	Rules []string `json:"rules"`
@@ -249,7 +476,27 @@ func (d *DNSFilter) handleFilteringSetRules(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	d.UserRules = req.Rules
+	rulesToASCII(req.Rules)
+
+	func() {
+		d.filtersMu.Lock()
+		defer d.filtersMu.Unlock()
+
+		if d.UserRuleGroups == nil {
+			d.UserRules = req.Rules
+			d.addRuleRevisionLocked(d.ruleGroupsLocked())
+
+			return
+		}
+
+		// Replace the groups, since the rules are set without them.
+		d.setRuleGroupsLocked([]*UserRuleGroup{{
+			Name:    defaultRuleGroupName,
+			Rules:   req.Rules,
+			Enabled: true,
+		}})
+	}()
+
 	d.ConfigModified()
 	d.EnableFilters(true)
 }
@@ -289,29 +536,36 @@ func (d *DNSFilter) handleFilteringRefresh(w http.ResponseWriter, r *http.Reques
 }
 
 type filterJSON struct {
-	URL         string `json:"url"`
-	Name        string `json:"name"`
-	LastUpdated string `json:"last_updated,omitempty"`
-	ID          int64  `json:"id"`
-	RulesCount  uint32 `json:"rules_count"`
-	Enabled     bool   `json:"enabled"`
+	QuietWindow    *QuietWindow `json:"quiet_window,omitempty"`
+	URL            string       `json:"url"`
+	Name           string       `json:"name"`
+	LastUpdated    string       `json:"last_updated,omitempty"`
+	ID             int64        `json:"id"`
+	RulesCount     uint32       `json:"rules_count"`
+	UpdateInterval uint32       `json:"update_interval,omitempty"`
+	Enabled        bool         `json:"enabled"`
 }
 
 type filteringConfig struct {
 	Filters          []filterJSON `json:"filters"`
 	WhitelistFilters []filterJSON `json:"whitelist_filters"`
 	UserRules        []string     `json:"user_rules"`
-	Interval         uint32       `json:"interval"` // in hours
-	Enabled          bool         `json:"enabled"`
+	// DryRun is nil in the requests which don't change the dry-run mode.
+	DryRun *bool `json:"dry_run,omitempty"`
+
+	Interval uint32 `json:"interval"` // in hours
+	Enabled  bool   `json:"enabled"`
 }
 
 func filterToJSON(f FilterYAML) filterJSON {
 	fj := filterJSON{
-		ID:         f.ID,
-		Enabled:    f.Enabled,
-		URL:        f.URL,
-		Name:       f.Name,
-		RulesCount: uint32(f.RulesCount),
+		QuietWindow:    f.QuietWindow,
+		ID:             f.ID,
+		Enabled:        f.Enabled,
+		URL:            f.URL,
+		Name:           f.Name,
+		RulesCount:     uint32(f.RulesCount),
+		UpdateInterval: f.UpdateInterval,
 	}
 
 	if !f.LastUpdated.IsZero() {
@@ -338,6 +592,9 @@ func (d *DNSFilter) handleFilteringStatus(w http.ResponseWriter, r *http.Request
 	resp.UserRules = d.UserRules
 	d.filtersMu.RUnlock()
 
+	dryRun := d.GetConfig().DryRun
+	resp.DryRun = &dryRun
+
 	_ = aghhttp.WriteJSONResponse(w, r, resp)
 }
 
@@ -365,6 +622,12 @@ func (d *DNSFilter) handleFilteringConfig(w http.ResponseWriter, r *http.Request
 		d.FiltersUpdateIntervalHours = req.Interval
 	}()
 
+	if req.DryRun != nil {
+		d.confLock.Lock()
+		d.DryRun = *req.DryRun
+		d.confLock.Unlock()
+	}
+
 	d.ConfigModified()
 	d.EnableFilters(true)
 }
@@ -398,14 +661,26 @@ type checkHostResp struct {
 }
 
 func (d *DNSFilter) handleCheckHost(w http.ResponseWriter, r *http.Request) {
-	host := r.URL.Query().Get("name")
+	q := r.URL.Query()
+	host := hostToASCII(q.Get("name"))
+
+	qtype, err := parseCheckHostQType(q.Get("qtype"))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "qtype: %s", err)
+
+		return
+	}
 
 	setts := d.GetConfig()
 	setts.FilteringEnabled = true
 	setts.ProtectionEnabled = true
 
 	d.ApplyBlockedServices(&setts, nil)
-	result, err := d.CheckHost(host, dns.TypeA, &setts)
+	if cli := q.Get("client"); cli != "" && d.ApplyClientSettings != nil {
+		d.ApplyClientSettings(cli, &setts)
+	}
+
+	result, err := d.CheckHost(host, qtype, &setts)
 	if err != nil {
 		aghhttp.Error(
 			r,
@@ -443,6 +718,26 @@ func (d *DNSFilter) handleCheckHost(w http.ResponseWriter, r *http.Request) {
 	_ = aghhttp.WriteJSONResponse(w, r, resp)
 }
 
+// parseCheckHostQType parses the DNS record type from s, which is either the
+// name of the type or its number.  qtype is [dns.TypeA] if s is empty.
+func parseCheckHostQType(s string) (qtype uint16, err error) {
+	if s == "" {
+		return dns.TypeA, nil
+	}
+
+	qtype, ok := dns.StringToType[strings.ToUpper(s)]
+	if ok {
+		return qtype, nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown dns type %q", s)
+	}
+
+	return uint16(n), nil
+}
+
 // RegisterFilteringHandlers - register handlers
 func (d *DNSFilter) RegisterFilteringHandlers() {
 	registerHTTP := d.HTTPRegister
@@ -457,6 +752,7 @@ func (d *DNSFilter) RegisterFilteringHandlers() {
 	registerHTTP(http.MethodPost, "/control/parental/enable", d.handleParentalEnable)
 	registerHTTP(http.MethodPost, "/control/parental/disable", d.handleParentalDisable)
 	registerHTTP(http.MethodGet, "/control/parental/status", d.handleParentalStatus)
+	registerHTTP(http.MethodPost, "/control/parental/strict_search", d.handleParentalStrictSearch)
 
 	registerHTTP(http.MethodPost, "/control/safesearch/enable", d.handleSafeSearchEnable)
 	registerHTTP(http.MethodPost, "/control/safesearch/disable", d.handleSafeSearchDisable)
@@ -465,20 +761,41 @@ func (d *DNSFilter) RegisterFilteringHandlers() {
 	registerHTTP(http.MethodGet, "/control/rewrite/list", d.handleRewriteList)
 	registerHTTP(http.MethodPost, "/control/rewrite/add", d.handleRewriteAdd)
 	registerHTTP(http.MethodPost, "/control/rewrite/delete", d.handleRewriteDelete)
+	registerHTTP(http.MethodPut, "/control/rewrite/replace", d.handleRewriteReplace)
 
 	registerHTTP(http.MethodGet, "/control/blocked_services/services", d.handleBlockedServicesIDs)
 	registerHTTP(http.MethodGet, "/control/blocked_services/all", d.handleBlockedServicesAll)
 	registerHTTP(http.MethodGet, "/control/blocked_services/list", d.handleBlockedServicesList)
 	registerHTTP(http.MethodPost, "/control/blocked_services/set", d.handleBlockedServicesSet)
+	registerHTTP(http.MethodGet, "/control/blocked_services/catalog", d.handleServicesCatalog)
+	registerHTTP(
+		http.MethodPost,
+		"/control/blocked_services/catalog/refresh",
+		d.handleServicesCatalogRefresh,
+	)
+	registerHTTP(http.MethodPost, "/control/blocked_services/catalog/pin", d.handleServicesCatalogPin)
 
 	registerHTTP(http.MethodGet, "/control/filtering/status", d.handleFilteringStatus)
+	registerHTTP(http.MethodGet, "/control/filtering/status_detailed", d.handleFilteringStatusDetailed)
 	registerHTTP(http.MethodPost, "/control/filtering/config", d.handleFilteringConfig)
 	registerHTTP(http.MethodPost, "/control/filtering/add_url", d.handleFilteringAddURL)
 	registerHTTP(http.MethodPost, "/control/filtering/remove_url", d.handleFilteringRemoveURL)
 	registerHTTP(http.MethodPost, "/control/filtering/set_url", d.handleFilteringSetURL)
+	registerHTTP(http.MethodGet, "/control/filtering/filters", d.handleFilterLists)
+	registerHTTP(http.MethodPut, "/control/filtering/filters/replace", d.handleFilterListsReplace)
 	registerHTTP(http.MethodPost, "/control/filtering/refresh", d.handleFilteringRefresh)
 	registerHTTP(http.MethodPost, "/control/filtering/set_rules", d.handleFilteringSetRules)
+	registerHTTP(http.MethodGet, "/control/filtering/rule_groups", d.handleRuleGroups)
+	registerHTTP(http.MethodPost, "/control/filtering/rule_groups/set", d.handleRuleGroupsSet)
+	registerHTTP(http.MethodGet, "/control/filtering/rule_groups/revisions", d.handleRuleGroupsRevisions)
+	registerHTTP(http.MethodGet, "/control/filtering/rule_groups/diff", d.handleRuleGroupsDiff)
+	registerHTTP(http.MethodPost, "/control/filtering/rule_groups/rollback", d.handleRuleGroupsRollback)
+	registerHTTP(http.MethodPost, "/control/filtering/learning/start", d.handleLearningStart)
+	registerHTTP(http.MethodPost, "/control/filtering/learning/stop", d.handleLearningStop)
+	registerHTTP(http.MethodGet, "/control/filtering/learning/status", d.handleLearningStatus)
+	registerHTTP(http.MethodPost, "/control/filtering/learning/apply", d.handleLearningApply)
 	registerHTTP(http.MethodGet, "/control/filtering/check_host", d.handleCheckHost)
+	registerHTTP(http.MethodPost, "/control/filtering/benchmark", d.handleBenchmark)
 }
 
 // ValidateUpdateIvl returns false if i is not a valid filters update interval.
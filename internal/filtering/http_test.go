@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -136,3 +138,193 @@ func TestDNSFilter_handleFilteringSetURL(t *testing.T) {
 		})
 	}
 }
+
+func TestDNSFilter_handleFilterListsReplace(t *testing.T) {
+	goodURL := serveFiltersLocally(t, []byte(`||example.org^`))
+	anotherGoodURL := serveFiltersLocally(t, []byte(`||example.com^`))
+	badURL := serveFiltersLocally(t, []byte(`<html></html>`))
+
+	confModifiedCalled := false
+	d, err := New(&Config{
+		FilteringEnabled: true,
+		Filters: []FilterYAML{{
+			Enabled: true,
+			URL:     goodURL,
+			Name:    "one",
+		}},
+		HTTPClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+		ConfigModified: func() { confModifiedCalled = true },
+		DataDir:        t.TempDir(),
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(d.Close)
+
+	d.Start()
+
+	require.Len(t, d.Filters, 1)
+
+	id := d.Filters[0].ID
+
+	getETag := func(t *testing.T) (etag string) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "http://example.org", nil)
+		w := httptest.NewRecorder()
+		d.handleFilterLists(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		etag = w.Header().Get(aghhttp.HdrNameETag)
+		require.NotEmpty(t, etag)
+
+		return etag
+	}
+
+	replace := func(t *testing.T, etag, body string) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodPut, "http://example.org", strings.NewReader(body))
+		r.Header.Set(aghhttp.HdrNameIfMatch, etag)
+		w = httptest.NewRecorder()
+		d.handleFilterListsReplace(w, r)
+
+		return w
+	}
+
+	etag := getETag(t)
+
+	t.Run("bad_rules", func(t *testing.T) {
+		w := replace(t, etag, `{"filters":[{"url":"`+badURL+`","name":"bad","enabled":true}]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.False(t, confModifiedCalled)
+		assert.Equal(t, etag, getETag(t))
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		w := replace(t, etag, `{"filters":[{"url":"`+goodURL+`","name":"one","enabled":true}],`+
+			`"whitelist_filters":[{"url":"`+goodURL+`","name":"two","enabled":true}]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.False(t, confModifiedCalled)
+	})
+
+	t.Run("bad_quiet_window", func(t *testing.T) {
+		w := replace(t, etag, `{"filters":[{"url":"`+goodURL+`","name":"one","enabled":true,`+
+			`"quiet_window":{"start":"18:00","end":"25:00"}}]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.False(t, confModifiedCalled)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		w := replace(t, etag, `{"filters":[`+
+			`{"url":"`+goodURL+`","name":"renamed","enabled":true},`+
+			`{"url":"`+anotherGoodURL+`","name":"two","enabled":true,"update_interval":12,`+
+			`"quiet_window":{"start":"18:00","end":"23:00"}}`+
+			`],"whitelist_filters":[]}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, confModifiedCalled)
+
+		d.filtersMu.RLock()
+		defer d.filtersMu.RUnlock()
+
+		require.Len(t, d.Filters, 2)
+
+		assert.Equal(t, id, d.Filters[0].ID)
+		assert.Equal(t, "renamed", d.Filters[0].Name)
+		assert.NotEqual(t, id, d.Filters[1].ID)
+		assert.Equal(t, 1, d.Filters[1].RulesCount)
+		assert.Equal(t, uint32(12), d.Filters[1].UpdateInterval)
+		assert.Equal(t, &QuietWindow{Start: "18:00", End: "23:00"}, d.Filters[1].QuietWindow)
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		confModifiedCalled = false
+
+		w := replace(t, etag, `{"filters":[],"whitelist_filters":[]}`)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+		assert.False(t, confModifiedCalled)
+		assert.Equal(t, getETag(t), w.Header().Get(aghhttp.HdrNameETag))
+	})
+}
+
+func TestDNSFilter_handleCheckHost(t *testing.T) {
+	const rules = `||aaaa.example^$dnstype=AAAA
+||kids.example^$client='Kids-iPad'
+||deny.example^$denyallow=allowed.deny.example
+`
+
+	d, _ := newForTest(t, &Config{
+		ApplyClientSettings: func(id string, setts *Settings) {
+			if id == "kids" {
+				setts.ClientName = "Kids-iPad"
+			}
+		},
+	}, []Filter{{ID: 0, Data: []byte(rules)}})
+	t.Cleanup(d.Close)
+
+	testCases := []struct {
+		name       string
+		query      string
+		wantReason string
+		wantCode   int
+	}{{
+		name:       "dnstype_a",
+		query:      "name=aaaa.example",
+		wantReason: NotFilteredNotFound.String(),
+		wantCode:   http.StatusOK,
+	}, {
+		name:       "dnstype_aaaa",
+		query:      "name=aaaa.example&qtype=aaaa",
+		wantReason: FilteredBlockList.String(),
+		wantCode:   http.StatusOK,
+	}, {
+		name:       "dnstype_number",
+		query:      "name=aaaa.example&qtype=28",
+		wantReason: FilteredBlockList.String(),
+		wantCode:   http.StatusOK,
+	}, {
+		name:       "bad_qtype",
+		query:      "name=aaaa.example&qtype=bad",
+		wantReason: "",
+		wantCode:   http.StatusBadRequest,
+	}, {
+		name:       "client_other",
+		query:      "name=kids.example&client=adult",
+		wantReason: NotFilteredNotFound.String(),
+		wantCode:   http.StatusOK,
+	}, {
+		name:       "client_match",
+		query:      "name=kids.example&client=kids",
+		wantReason: FilteredBlockList.String(),
+		wantCode:   http.StatusOK,
+	}, {
+		name:       "denyallow_blocked",
+		query:      "name=sub.deny.example",
+		wantReason: FilteredBlockList.String(),
+		wantCode:   http.StatusOK,
+	}, {
+		name:       "denyallow_allowed",
+		query:      "name=allowed.deny.example",
+		wantReason: NotFilteredNotFound.String(),
+		wantCode:   http.StatusOK,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/control/filtering/check_host?"+tc.query, nil)
+			w := httptest.NewRecorder()
+			d.handleCheckHost(w, r)
+			require.Equal(t, tc.wantCode, w.Code)
+
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+
+			resp := &checkHostResp{}
+			err := json.NewDecoder(w.Body).Decode(resp)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantReason, resp.Reason)
+		})
+	}
+}
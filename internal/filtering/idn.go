@@ -0,0 +1,97 @@
+package filtering
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/idna"
+)
+
+// isASCII returns true if s only contains ASCII characters.
+func isASCII(s string) (ok bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hostToASCII converts the internationalized domain name host into its
+// lowercased punycode form.  host is returned as is if it's already in ASCII or
+// if it cannot be converted.
+func hostToASCII(host string) (ascii string) {
+	if isASCII(host) {
+		return host
+	}
+
+	ascii, err := idna.ToASCII(strings.ToLower(host))
+	if err != nil {
+		log.Debug("filtering: translating %q into punycode: %s", host, err)
+
+		return host
+	}
+
+	return ascii
+}
+
+// isHostRune returns true if r may be a part of a domain name in a rule.
+func isHostRune(r rune) (ok bool) {
+	return r == '-' || r == '.' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// ruleToASCII converts the internationalized domain names in the pattern of
+// the filtering rule text into their punycode forms.  The comments, the
+// regular expressions, and the modifiers, which may contain the client names,
+// are kept as is.
+func ruleToASCII(text string) (res string) {
+	if isASCII(text) {
+		return text
+	}
+
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" || trimmed[0] == '!' || trimmed[0] == '#' || trimmed[0] == '/' {
+		return text
+	}
+
+	pattern, modifiers := text, ""
+	if i := strings.IndexByte(text, '$'); i >= 0 {
+		pattern, modifiers = text[:i], text[i:]
+	}
+
+	b := &strings.Builder{}
+	for pattern != "" {
+		i := strings.IndexFunc(pattern, isHostRune)
+		if i < 0 {
+			b.WriteString(pattern)
+
+			break
+		}
+
+		b.WriteString(pattern[:i])
+		pattern = pattern[i:]
+
+		j := strings.IndexFunc(pattern, func(r rune) (ok bool) { return !isHostRune(r) })
+		if j < 0 {
+			j = len(pattern)
+		}
+
+		b.WriteString(hostToASCII(pattern[:j]))
+		pattern = pattern[j:]
+	}
+
+	b.WriteString(modifiers)
+
+	return b.String()
+}
+
+// rulesToASCII converts the internationalized domain names in the patterns of
+// the filtering rules into their punycode forms in place.  See ruleToASCII.
+func rulesToASCII(rules []string) {
+	for i, text := range rules {
+		rules[i] = ruleToASCII(text)
+	}
+}
@@ -0,0 +1,73 @@
+package filtering
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleToASCII(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   string
+		want string
+	}{{
+		name: "ascii",
+		in:   "||example.org^",
+		want: "||example.org^",
+	}, {
+		name: "adblock",
+		in:   "||пример.рф^",
+		want: "||xn--e1afmkfd.xn--p1ai^",
+	}, {
+		name: "upper_case",
+		in:   "||Пример.РФ^",
+		want: "||xn--e1afmkfd.xn--p1ai^",
+	}, {
+		name: "wildcard",
+		in:   "||*.münchen.de^",
+		want: "||*.xn--mnchen-3ya.de^",
+	}, {
+		name: "hosts",
+		in:   "0.0.0.0 пример.рф",
+		want: "0.0.0.0 xn--e1afmkfd.xn--p1ai",
+	}, {
+		name: "modifiers",
+		in:   "||пример.рф^$client='Пётр'",
+		want: "||xn--e1afmkfd.xn--p1ai^$client='Пётр'",
+	}, {
+		name: "exception",
+		in:   "@@||пример.рф^",
+		want: "@@||xn--e1afmkfd.xn--p1ai^",
+	}, {
+		name: "comment",
+		in:   "! пример.рф",
+		want: "! пример.рф",
+	}, {
+		name: "hosts_comment",
+		in:   "# пример.рф",
+		want: "# пример.рф",
+	}, {
+		name: "regexp",
+		in:   "/пример\\.рф/",
+		want: "/пример\\.рф/",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, ruleToASCII(tc.in))
+		})
+	}
+}
+
+func TestLegacyRewrite_normalize_idn(t *testing.T) {
+	rw := &LegacyRewrite{
+		Domain: "*.Пример.рф",
+		Answer: "1.2.3.4",
+	}
+
+	err := rw.normalize()
+	assert.NoError(t, err)
+
+	assert.Equal(t, "*.xn--e1afmkfd.xn--p1ai", rw.Domain)
+}
@@ -0,0 +1,340 @@
+package filtering
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// learnedRuleGroupName is the name of the user rule group to which the
+// allowlist rules proposed by the learning mode are applied.
+const learnedRuleGroupName = "learned"
+
+// maxLearnedHosts is the maximum number of the blocked hosts recorded during a
+// single learning session.
+const maxLearnedHosts = 1000
+
+// learnedHost is a blocked host recorded during a learning session.
+type learnedHost struct {
+	// LastSeen is the time of the latest blocked request for the host.
+	LastSeen time.Time `json:"last_seen"`
+
+	// Name is the blocked hostname.
+	Name string `json:"name"`
+
+	// BlockedBy is the text of the rule which blocked the host, if any.
+	BlockedBy string `json:"blocked_by"`
+
+	// Proposed is the allowlist rule which unblocks the host.
+	Proposed string `json:"proposed_rule"`
+
+	// Count is the number of the blocked requests for the host.
+	Count uint64 `json:"count"`
+}
+
+// learningSession records the hosts blocked for a single client during its
+// training window.
+type learningSession struct {
+	// start and end are the bounds of the training window.
+	start time.Time
+	end   time.Time
+
+	// hosts are the blocked hosts by their names.
+	hosts map[string]*learnedHost
+
+	// client is the IP address or the name of the persistent client.
+	client string
+}
+
+// matches returns true if the request with setts made at now should be
+// recorded by s.  s may be nil.
+func (s *learningSession) matches(setts *Settings, now time.Time) (ok bool) {
+	if s == nil || !now.Before(s.end) {
+		return false
+	}
+
+	return s.client == setts.ClientName || (setts.ClientIP != nil && s.client == setts.ClientIP.String())
+}
+
+// sortedHosts returns the copies of the recorded hosts sorted by names.
+func (s *learningSession) sortedHosts() (hosts []*learnedHost) {
+	hosts = make([]*learnedHost, 0, len(s.hosts))
+	for _, h := range s.hosts {
+		c := *h
+		hosts = append(hosts, &c)
+	}
+
+	slices.SortFunc(hosts, func(a, b *learnedHost) (less bool) { return a.Name < b.Name })
+
+	return hosts
+}
+
+// RecordBlocked records host blocked with res for the client of setts, if
+// there is an active learning session for it.
+func (d *DNSFilter) RecordBlocked(host string, setts *Settings, res *Result) {
+	if res == nil || !res.IsFiltered {
+		return
+	}
+
+	d.learningMu.Lock()
+	defer d.learningMu.Unlock()
+
+	now := time.Now()
+	s := d.learning
+	if !s.matches(setts, now) {
+		return
+	}
+
+	h, ok := s.hosts[host]
+	if !ok {
+		if len(s.hosts) >= maxLearnedHosts {
+			log.Debug("filtering: learning: too many hosts, ignoring %q", host)
+
+			return
+		}
+
+		h = &learnedHost{
+			Name:     host,
+			Proposed: "@@||" + host + "^",
+		}
+		s.hosts[host] = h
+	}
+
+	if len(res.Rules) > 0 {
+		h.BlockedBy = res.Rules[0].Text
+	}
+
+	h.LastSeen = now
+	h.Count++
+}
+
+// learningStartReq is the request for the POST
+// /control/filtering/learning/start HTTP API.
+type learningStartReq struct {
+	// Client is the IP address or the name of the persistent client.
+	Client string `json:"client"`
+
+	// Duration is the length of the training window.
+	Duration timeutil.Duration `json:"duration"`
+}
+
+// handleLearningStart is the handler for the POST
+// /control/filtering/learning/start HTTP API.  It starts a new learning
+// session replacing the previous one, if any.
+func (d *DNSFilter) handleLearningStart(w http.ResponseWriter, r *http.Request) {
+	req := &learningStartReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	if req.Client == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "client is required")
+
+		return
+	} else if req.Duration.Duration <= 0 {
+		aghhttp.Error(r, w, http.StatusBadRequest, "duration must be positive")
+
+		return
+	}
+
+	now := time.Now()
+	s := &learningSession{
+		start:  now,
+		end:    now.Add(req.Duration.Duration),
+		hosts:  map[string]*learnedHost{},
+		client: req.Client,
+	}
+
+	d.learningMu.Lock()
+	defer d.learningMu.Unlock()
+
+	d.learning = s
+
+	log.Debug("filtering: learning: started for %q until %s", s.client, s.end)
+}
+
+// handleLearningStop is the handler for the POST
+// /control/filtering/learning/stop HTTP API.  It removes the current learning
+// session along with the recorded hosts.
+func (d *DNSFilter) handleLearningStop(w http.ResponseWriter, r *http.Request) {
+	d.learningMu.Lock()
+	defer d.learningMu.Unlock()
+
+	if d.learning == nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no learning session")
+
+		return
+	}
+
+	d.learning = nil
+}
+
+// learningStatusJSON is the response to the GET
+// /control/filtering/learning/status HTTP API.
+type learningStatusJSON struct {
+	// Start and End are the bounds of the training window.  They are nil if
+	// there is no session.
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+
+	// Client is the client of the session.
+	Client string `json:"client,omitempty"`
+
+	// Hosts are the recorded blocked hosts.
+	Hosts []*learnedHost `json:"hosts"`
+
+	// ProposedRules are the rules allowing all the recorded hosts.
+	ProposedRules []string `json:"proposed_rules"`
+
+	// Enabled is true if there is a session.
+	Enabled bool `json:"enabled"`
+
+	// Active is true if the training window hasn't ended yet.
+	Active bool `json:"active"`
+}
+
+// handleLearningStatus is the handler for the GET
+// /control/filtering/learning/status HTTP API.
+func (d *DNSFilter) handleLearningStatus(w http.ResponseWriter, r *http.Request) {
+	resp := &learningStatusJSON{
+		Hosts:         []*learnedHost{},
+		ProposedRules: []string{},
+	}
+
+	func() {
+		d.learningMu.Lock()
+		defer d.learningMu.Unlock()
+
+		s := d.learning
+		if s == nil {
+			return
+		}
+
+		start, end := s.start, s.end
+		resp.Start, resp.End = &start, &end
+		resp.Client = s.client
+		resp.Enabled = true
+		resp.Active = time.Now().Before(end)
+		resp.Hosts = s.sortedHosts()
+	}()
+
+	for _, h := range resp.Hosts {
+		resp.ProposedRules = append(resp.ProposedRules, h.Proposed)
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// learningApplyReq is the request for the POST
+// /control/filtering/learning/apply HTTP API.
+type learningApplyReq struct {
+	// Hosts are the names of the recorded hosts to allow.  If empty, all the
+	// recorded hosts are allowed.
+	Hosts []string `json:"hosts"`
+}
+
+// handleLearningApply is the handler for the POST
+// /control/filtering/learning/apply HTTP API.  It adds the proposed rules for
+// the requested hosts to the user rule group named learnedRuleGroupName and
+// removes the hosts from the session.
+func (d *DNSFilter) handleLearningApply(w http.ResponseWriter, r *http.Request) {
+	req := &learningApplyReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	rules, err := d.takeLearnedRules(req.Hosts)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	} else if len(rules) == 0 {
+		return
+	}
+
+	func() {
+		d.filtersMu.Lock()
+		defer d.filtersMu.Unlock()
+
+		d.setRuleGroupsLocked(withLearnedRules(d.ruleGroupsLocked(), rules))
+	}()
+
+	d.ConfigModified()
+	d.EnableFilters(true)
+
+	log.Debug("filtering: learning: applied %d rules", len(rules))
+}
+
+// takeLearnedRules removes hosts from the current learning session and returns
+// their proposed rules, all of the recorded ones if hosts is empty.
+func (d *DNSFilter) takeLearnedRules(hosts []string) (rules []string, err error) {
+	d.learningMu.Lock()
+	defer d.learningMu.Unlock()
+
+	s := d.learning
+	if s == nil {
+		return nil, errors.Error("no learning session")
+	}
+
+	if len(hosts) == 0 {
+		hosts = maps.Keys(s.hosts)
+		slices.Sort(hosts)
+	}
+
+	for _, host := range hosts {
+		if _, ok := s.hosts[host]; !ok {
+			return nil, fmt.Errorf("host %q hasn't been recorded", host)
+		}
+	}
+
+	for _, host := range hosts {
+		if h, ok := s.hosts[host]; ok {
+			rules = append(rules, ruleToASCII(h.Proposed))
+			delete(s.hosts, host)
+		}
+	}
+
+	return rules, nil
+}
+
+// withLearnedRules returns a copy of groups with rules added to the group
+// named learnedRuleGroupName, which is created if necessary.  The rules already
+// present in the group aren't duplicated.
+func withLearnedRules(groups []*UserRuleGroup, rules []string) (res []*UserRuleGroup) {
+	res = cloneRuleGroups(groups)
+
+	i := slices.IndexFunc(res, func(g *UserRuleGroup) (ok bool) {
+		return g.Name == learnedRuleGroupName
+	})
+	if i < 0 {
+		res = append(res, &UserRuleGroup{
+			Name:    learnedRuleGroupName,
+			Comment: "Allowlist rules applied from the learning mode",
+			Enabled: true,
+		})
+		i = len(res) - 1
+	}
+
+	g := res[i]
+	for _, rule := range rules {
+		if !slices.Contains(g.Rules, rule) {
+			g.Rules = append(g.Rules, rule)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,148 @@
+package filtering
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_learning(t *testing.T) {
+	const (
+		clientIP = "192.168.0.10"
+		otherIP  = "192.168.0.11"
+		tvRule   = "||tv.example^"
+		adsRule  = "||ads.example^"
+		tvAllow  = "@@||tv.example^"
+		adsAllow = "@@||ads.example^"
+	)
+
+	confModifiedCalled := false
+	d, setts := newForTest(t, &Config{
+		ConfigModified:          func() { confModifiedCalled = true },
+		UserRules:               []string{"||legacy.example^"},
+		UserRulesRevisionsLimit: 10,
+	}, []Filter{{
+		ID:   0,
+		Data: []byte(tvRule + "\n" + adsRule + "\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	d.Start()
+
+	do := func(
+		t *testing.T,
+		h http.HandlerFunc,
+		method string,
+		body any,
+	) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		var data []byte
+		if body != nil {
+			var err error
+			data, err = json.Marshal(body)
+			require.NoError(t, err)
+		}
+
+		r := httptest.NewRequest(method, "http://example.org", bytes.NewReader(data))
+		w = httptest.NewRecorder()
+		h(w, r)
+
+		return w
+	}
+
+	status := func(t *testing.T) (resp *learningStatusJSON) {
+		t.Helper()
+
+		w := do(t, d.handleLearningStatus, http.MethodGet, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp = &learningStatusJSON{}
+		err := json.NewDecoder(w.Body).Decode(resp)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	check := func(t *testing.T, host, ip string) {
+		t.Helper()
+
+		s := *setts
+		s.ClientIP = net.ParseIP(ip)
+
+		res, err := d.CheckHost(host, dns.TypeA, &s)
+		require.NoError(t, err)
+
+		d.RecordBlocked(host, &s, &res)
+	}
+
+	assert.False(t, status(t).Enabled)
+
+	w := do(t, d.handleLearningStart, http.MethodPost, &learningStartReq{
+		Client: clientIP,
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = do(t, d.handleLearningStart, http.MethodPost, &learningStartReq{
+		Client:   clientIP,
+		Duration: timeutil.Duration{Duration: time.Hour},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	check(t, "tv.example", clientIP)
+	check(t, "tv.example", clientIP)
+	check(t, "ads.example", clientIP)
+	check(t, "allowed.example", clientIP)
+	check(t, "ads.example", otherIP)
+
+	resp := status(t)
+	assert.True(t, resp.Enabled)
+	assert.True(t, resp.Active)
+	assert.Equal(t, clientIP, resp.Client)
+	assert.Equal(t, []string{adsAllow, tvAllow}, resp.ProposedRules)
+
+	require.Len(t, resp.Hosts, 2)
+
+	assert.Equal(t, "ads.example", resp.Hosts[0].Name)
+	assert.Equal(t, uint64(1), resp.Hosts[0].Count)
+	assert.Equal(t, adsRule, resp.Hosts[0].BlockedBy)
+	assert.Equal(t, "tv.example", resp.Hosts[1].Name)
+	assert.Equal(t, uint64(2), resp.Hosts[1].Count)
+
+	w = do(t, d.handleLearningApply, http.MethodPost, &learningApplyReq{
+		Hosts: []string{"unknown.example"},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.False(t, confModifiedCalled)
+
+	w = do(t, d.handleLearningApply, http.MethodPost, &learningApplyReq{
+		Hosts: []string{"tv.example"},
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.True(t, confModifiedCalled)
+	assert.Equal(t, []string{"||legacy.example^", tvAllow}, d.UserRules)
+
+	require.Len(t, d.UserRuleGroups, 2)
+
+	assert.Equal(t, defaultRuleGroupName, d.UserRuleGroups[0].Name)
+	assert.Equal(t, learnedRuleGroupName, d.UserRuleGroups[1].Name)
+	assert.Equal(t, []string{adsAllow}, status(t).ProposedRules)
+
+	w = do(t, d.handleLearningStop, http.MethodPost, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.False(t, status(t).Enabled)
+
+	w = do(t, d.handleLearningApply, http.MethodPost, &learningApplyReq{})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,187 @@
+package filtering
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// LookupServiceConfig is the configuration of the hash-prefix lookup service
+// used by the safe browsing or the parental control.  The zero value means the
+// AdGuard DNS family service.
+type LookupServiceConfig struct {
+	// Address is the address of the DNS upstream of the service, for example
+	// "https://threat-intel.example/dns-query".  If empty, the AdGuard DNS
+	// family server is used, and only TXTSuffix and Timeout are applied.
+	Address string `yaml:"address"`
+
+	// TXTSuffix is the domain name suffix of the TXT requests containing the
+	// hash prefixes.  If empty, the suffix of the AdGuard service is used.
+	TXTSuffix string `yaml:"txt_suffix"`
+
+	// RootCAPath is the path to the file with the PEM-encoded root
+	// certificates used to verify the certificate of the service instead of
+	// the system ones.
+	RootCAPath string `yaml:"root_ca_path"`
+
+	// Bootstrap are the plain DNS servers used to resolve the hostname of
+	// Address.  If empty, the system resolver is used.
+	Bootstrap []string `yaml:"bootstrap"`
+
+	// ServerIPs are the IP addresses of the host of Address, used instead of
+	// resolving it.
+	ServerIPs []netip.Addr `yaml:"server_ips"`
+
+	// Timeout is the timeout of a single lookup.  If zero, the default timeout
+	// is used.
+	Timeout timeutil.Duration `yaml:"timeout"`
+
+	// InsecureSkipVerify, if true, disables the verification of the TLS
+	// certificate of the service.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// defaultServiceIPs are the IP addresses of the AdGuard DNS family server.
+var defaultServiceIPs = []net.IP{
+	{94, 140, 14, 15},
+	{94, 140, 15, 16},
+	net.ParseIP("2a10:50c0::bad1:ff"),
+	net.ParseIP("2a10:50c0::bad2:ff"),
+}
+
+// newLookupUpstream returns the upstream of the lookup service configured by
+// conf and the address and the TXT suffix of it.  defAddr and defSuffix are
+// used if conf doesn't set them.  conf must not be nil.
+func newLookupUpstream(
+	conf *LookupServiceConfig,
+	defAddr string,
+	defSuffix string,
+) (addr, suffix string, u upstream.Upstream, err error) {
+	opts := &upstream.Options{
+		Timeout: dnsTimeout,
+	}
+
+	if conf.Timeout.Duration > 0 {
+		opts.Timeout = conf.Timeout.Duration
+	}
+
+	suffix = defSuffix
+	if conf.TXTSuffix != "" {
+		suffix = dnsFQDN(conf.TXTSuffix)
+		err = netutil.ValidateDomainName(suffix[:len(suffix)-1])
+		if err != nil {
+			return "", "", nil, fmt.Errorf("txt suffix: %w", err)
+		}
+	}
+
+	addr = conf.Address
+	if addr == "" {
+		addr = defAddr
+		opts.ServerIPAddrs = defaultServiceIPs
+	} else {
+		err = setLookupOptions(opts, conf)
+		if err != nil {
+			return "", "", nil, err
+		}
+	}
+
+	u, err = upstream.AddressToUpstream(addr, opts)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("converting server %q: %w", addr, err)
+	}
+
+	return addr, suffix, u, nil
+}
+
+// dnsFQDN returns name with the trailing dot added, if needed.
+func dnsFQDN(name string) (fqdn string) {
+	if name != "" && name[len(name)-1] == '.' {
+		return name
+	}
+
+	return name + "."
+}
+
+// setLookupOptions sets the bootstrap and the TLS settings of the custom lookup
+// service from conf to opts.
+func setLookupOptions(opts *upstream.Options, conf *LookupServiceConfig) (err error) {
+	opts.Bootstrap = conf.Bootstrap
+	opts.InsecureSkipVerify = conf.InsecureSkipVerify
+	for _, ip := range conf.ServerIPs {
+		opts.ServerIPAddrs = append(opts.ServerIPAddrs, ip.AsSlice())
+	}
+
+	if conf.RootCAPath == "" || conf.InsecureSkipVerify {
+		return nil
+	}
+
+	data, err := os.ReadFile(conf.RootCAPath)
+	if err != nil {
+		return fmt.Errorf("reading root certificates: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return fmt.Errorf("root certificates: %w", errors.Error("no certificates found"))
+	}
+
+	u, err := url.Parse(conf.Address)
+	if err != nil {
+		return fmt.Errorf("parsing address: %w", err)
+	}
+
+	// Skip the default verification, since it uses the system roots, and
+	// verify the certificate against roots instead.
+	opts.InsecureSkipVerify = true
+	opts.VerifyServerCertificate = newCertVerifier(roots, u.Hostname())
+
+	return nil
+}
+
+// newCertVerifier returns a function verifying the certificate chain of the
+// server with srvName against roots.
+func newCertVerifier(
+	roots *x509.CertPool,
+	srvName string,
+) (verify func(rawCerts [][]byte, _ [][]*x509.Certificate) (err error)) {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) (err error) {
+		if len(rawCerts) == 0 {
+			return errors.Error("no certificates")
+		}
+
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for i, raw := range rawCerts {
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("parsing certificate at index %d: %w", i, err)
+			}
+
+			certs = append(certs, cert)
+		}
+
+		inters := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			inters.AddCert(cert)
+		}
+
+		_, err = certs[0].Verify(x509.VerifyOptions{
+			DNSName:       srvName,
+			Roots:         roots,
+			Intermediates: inters,
+		})
+		if err != nil {
+			return fmt.Errorf("certificate does not verify: %w", err)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,91 @@
+package filtering
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLookupUpstream(t *testing.T) {
+	emptyCAPath := filepath.Join(t.TempDir(), "empty.pem")
+	err := os.WriteFile(emptyCAPath, []byte("not a certificate"), 0o600)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		conf       *LookupServiceConfig
+		name       string
+		wantAddr   string
+		wantSuffix string
+		wantErrMsg string
+	}{{
+		conf:       &LookupServiceConfig{},
+		name:       "default",
+		wantAddr:   defaultSafebrowsingServer,
+		wantSuffix: sbTXTSuffix,
+		wantErrMsg: "",
+	}, {
+		conf: &LookupServiceConfig{
+			Address:   "tls://threat-intel.example",
+			TXTSuffix: "sb.threat-intel.example",
+			Bootstrap: []string{"192.168.0.1"},
+			Timeout:   timeutil.Duration{Duration: time.Second},
+		},
+		name:       "custom",
+		wantAddr:   "tls://threat-intel.example",
+		wantSuffix: "sb.threat-intel.example.",
+		wantErrMsg: "",
+	}, {
+		conf: &LookupServiceConfig{
+			Address:    "https://threat-intel.example/dns-query",
+			RootCAPath: emptyCAPath,
+		},
+		name:       "no_certs",
+		wantAddr:   "",
+		wantSuffix: "",
+		wantErrMsg: "root certificates: no certificates found",
+	}, {
+		conf: &LookupServiceConfig{
+			Address:   "tls://threat-intel.example",
+			TXTSuffix: "bad..suffix",
+		},
+		name:       "bad_suffix",
+		wantAddr:   "",
+		wantSuffix: "",
+		wantErrMsg: `txt suffix: bad domain name "bad..suffix": ` +
+			`bad domain name label "": domain name label is empty`,
+	}, {
+		conf: &LookupServiceConfig{
+			Address: "bad://threat-intel.example",
+		},
+		name:       "bad_address",
+		wantAddr:   "",
+		wantSuffix: "",
+		wantErrMsg: `converting server "bad://threat-intel.example": ` +
+			`unsupported url scheme: bad`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, suffix, u, lookupErr := newLookupUpstream(
+				tc.conf,
+				defaultSafebrowsingServer,
+				sbTXTSuffix,
+			)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, lookupErr)
+			if tc.wantErrMsg != "" {
+				return
+			}
+
+			require.NotNil(t, u)
+
+			assert.Equal(t, tc.wantAddr, addr)
+			assert.Equal(t, tc.wantSuffix, suffix)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package filtering
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// quietWindowLayout is the layout of the bounds of a [QuietWindow].
+const quietWindowLayout = "15:04"
+
+// QuietWindow is the daily period of time, in the local time zone, during which
+// a rule list isn't updated automatically.  If End is before Start, the window
+// spans midnight.
+type QuietWindow struct {
+	// Start is the beginning of the window in the "HH:MM" format.
+	Start string `yaml:"start" json:"start"`
+
+	// End is the end of the window, exclusive, in the "HH:MM" format.
+	End string `yaml:"end" json:"end"`
+}
+
+// validate returns an error if w has bad bounds.  w may be nil.
+func (w *QuietWindow) validate() (err error) {
+	if w == nil {
+		return nil
+	}
+
+	start, end, err := w.bounds()
+	if err != nil {
+		return err
+	} else if start == end {
+		return errors.Error("start and end are equal")
+	}
+
+	return nil
+}
+
+// bounds returns the bounds of w in minutes since midnight.
+func (w *QuietWindow) bounds() (start, end int, err error) {
+	start, err = minuteOfDay(w.Start)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad start: %w", err)
+	}
+
+	end, err = minuteOfDay(w.End)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad end: %w", err)
+	}
+
+	return start, end, nil
+}
+
+// minuteOfDay parses s as the time of day in the [quietWindowLayout] format and
+// returns the number of minutes since midnight.
+func minuteOfDay(s string) (m int, err error) {
+	t, err := time.Parse(quietWindowLayout, s)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return 0, err
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains returns true if t is within w.  w may be nil, which contains no
+// time.  w must be valid.
+func (w *QuietWindow) contains(t time.Time) (ok bool) {
+	if w == nil {
+		return false
+	}
+
+	start, end, err := w.bounds()
+	if err != nil {
+		// Shouldn't happen, since w is validated.
+		return false
+	}
+
+	m := t.Hour()*60 + t.Minute()
+	if start < end {
+		return m >= start && m < end
+	}
+
+	return m >= start || m < end
+}
@@ -0,0 +1,175 @@
+package filtering
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuietWindow_validate(t *testing.T) {
+	testCases := []struct {
+		w          *QuietWindow
+		name       string
+		wantErrMsg string
+	}{{
+		w:          nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		w:          &QuietWindow{Start: "18:00", End: "23:00"},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		w:          &QuietWindow{Start: "23:00", End: "6:30"},
+		name:       "midnight",
+		wantErrMsg: "",
+	}, {
+		w:          &QuietWindow{Start: "18:00", End: "18:00"},
+		name:       "equal",
+		wantErrMsg: "start and end are equal",
+	}, {
+		w:    &QuietWindow{Start: "25:00", End: "23:00"},
+		name: "bad_start",
+		wantErrMsg: `bad start: parsing time "25:00": ` +
+			`hour out of range`,
+	}, {
+		w:    &QuietWindow{Start: "18:00", End: ""},
+		name: "bad_end",
+		wantErrMsg: `bad end: parsing time "" as "15:04": ` +
+			`cannot parse "" as "15"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.w.validate())
+		})
+	}
+}
+
+func TestQuietWindow_contains(t *testing.T) {
+	at := func(hour, min int) (t time.Time) {
+		return time.Date(2023, 1, 1, hour, min, 0, 0, time.Local)
+	}
+
+	evening := &QuietWindow{Start: "18:00", End: "23:00"}
+	night := &QuietWindow{Start: "23:00", End: "06:30"}
+
+	testCases := []struct {
+		w    *QuietWindow
+		t    time.Time
+		name string
+		want bool
+	}{{
+		w:    nil,
+		t:    at(12, 0),
+		name: "nil",
+		want: false,
+	}, {
+		w:    evening,
+		t:    at(18, 0),
+		name: "start",
+		want: true,
+	}, {
+		w:    evening,
+		t:    at(22, 59),
+		name: "inside",
+		want: true,
+	}, {
+		w:    evening,
+		t:    at(23, 0),
+		name: "end",
+		want: false,
+	}, {
+		w:    evening,
+		t:    at(12, 0),
+		name: "outside",
+		want: false,
+	}, {
+		w:    night,
+		t:    at(0, 30),
+		name: "midnight_after",
+		want: true,
+	}, {
+		w:    night,
+		t:    at(23, 30),
+		name: "midnight_before",
+		want: true,
+	}, {
+		w:    night,
+		t:    at(12, 0),
+		name: "midnight_outside",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.w.contains(tc.t))
+		})
+	}
+}
+
+func TestFilterYAML_isUpdateDue(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.Local)
+
+	testCases := []struct {
+		filter      *FilterYAML
+		name        string
+		globalHours uint32
+		want        bool
+	}{{
+		filter:      &FilterYAML{LastUpdated: now.Add(-25 * time.Hour)},
+		name:        "global",
+		globalHours: 24,
+		want:        true,
+	}, {
+		filter:      &FilterYAML{LastUpdated: now.Add(-2 * time.Hour)},
+		name:        "global_not_expired",
+		globalHours: 24,
+		want:        false,
+	}, {
+		filter:      &FilterYAML{LastUpdated: now.Add(-25 * time.Hour)},
+		name:        "global_disabled",
+		globalHours: 0,
+		want:        false,
+	}, {
+		filter: &FilterYAML{
+			LastUpdated:    now.Add(-2 * time.Hour),
+			UpdateInterval: 1,
+		},
+		name:        "own",
+		globalHours: 24,
+		want:        true,
+	}, {
+		filter: &FilterYAML{
+			LastUpdated:    now.Add(-2 * time.Hour),
+			UpdateInterval: 1,
+		},
+		name:        "own_global_disabled",
+		globalHours: 0,
+		want:        true,
+	}, {
+		filter: &FilterYAML{
+			LastUpdated:    now.Add(-25 * time.Hour),
+			UpdateInterval: 7 * 24,
+		},
+		name:        "own_not_expired",
+		globalHours: 24,
+		want:        false,
+	}, {
+		filter: &FilterYAML{
+			LastUpdated: now.Add(-25 * time.Hour),
+			QuietWindow: &QuietWindow{Start: "11:00", End: "13:00"},
+		},
+		name:        "quiet",
+		globalHours: 24,
+		want:        false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.filter.isUpdateDue(tc.globalHours, now))
+		})
+	}
+}
@@ -14,18 +14,31 @@ type rewriteEntryJSON struct {
 	Answer string `json:"answer"`
 }
 
-func (d *DNSFilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
-	arr := []*rewriteEntryJSON{}
+// rewritesJSON returns the JSON representations of the current legacy
+// rewrites.  It's safe for concurrent use.
+func (d *DNSFilter) rewritesJSON() (arr []*rewriteEntryJSON) {
+	arr = []*rewriteEntryJSON{}
 
 	d.confLock.Lock()
+	defer d.confLock.Unlock()
+
 	for _, ent := range d.Config.Rewrites {
-		jsent := rewriteEntryJSON{
+		arr = append(arr, &rewriteEntryJSON{
 			Domain: ent.Domain,
 			Answer: ent.Answer,
-		}
-		arr = append(arr, &jsent)
+		})
+	}
+
+	return arr
+}
+
+func (d *DNSFilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
+	arr := d.rewritesJSON()
+
+	err := aghhttp.SetETag(w, r, arr)
+	if err != nil {
+		return
 	}
-	d.confLock.Unlock()
 
 	_ = aghhttp.WriteJSONResponse(w, r, arr)
 }
@@ -71,7 +84,7 @@ func (d *DNSFilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request)
 	}
 
 	entDel := &LegacyRewrite{
-		Domain: jsent.Domain,
+		Domain: hostToASCII(jsent.Domain),
 		Answer: jsent.Answer,
 	}
 	arr := []*LegacyRewrite{}
@@ -91,3 +104,55 @@ func (d *DNSFilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request)
 
 	d.Config.ConfigModified()
 }
+
+// handleRewriteReplace is the handler for the PUT /control/rewrite/replace HTTP
+// API.  It replaces all legacy rewrites with the ones from the request.  The
+// request is rejected if its If-Match header doesn't match the entity tag of
+// the current rewrites, see [DNSFilter.handleRewriteList].
+func (d *DNSFilter) handleRewriteReplace(w http.ResponseWriter, r *http.Request) {
+	var arr []*rewriteEntryJSON
+	err := json.NewDecoder(r.Body).Decode(&arr)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	rws := make([]*LegacyRewrite, 0, len(arr))
+	for i, rwJSON := range arr {
+		if rwJSON == nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "rewrite at index %d is null", i)
+
+			return
+		}
+
+		rw := &LegacyRewrite{
+			Domain: rwJSON.Domain,
+			Answer: rwJSON.Answer,
+		}
+
+		err = rw.normalize()
+		if err != nil {
+			// Shouldn't happen currently, since normalize only returns a
+			// non-nil error when a rewrite is nil, but be change-proof.
+			aghhttp.Error(r, w, http.StatusBadRequest, "rewrite at index %d: normalizing: %s", i, err)
+
+			return
+		}
+
+		rws = append(rws, rw)
+	}
+
+	// The modifying HTTP APIs are serialized by the control lock, so the
+	// rewrites can't be changed between the check and the replacement.
+	if !aghhttp.CheckIfMatch(w, r, d.rewritesJSON()) {
+		return
+	}
+
+	d.confLock.Lock()
+	d.Config.Rewrites = rws
+	d.confLock.Unlock()
+	log.Debug("rewrite: replaced elements [%d]", len(rws))
+
+	d.Config.ConfigModified()
+}
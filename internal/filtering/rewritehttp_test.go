@@ -0,0 +1,76 @@
+package filtering
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_handleRewriteReplace(t *testing.T) {
+	confModifiedCalled := false
+	d := &DNSFilter{
+		Config: Config{
+			Rewrites: []*LegacyRewrite{{
+				Domain: "example.org",
+				Answer: "1.2.3.4",
+			}},
+			ConfigModified: func() { confModifiedCalled = true },
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.org", nil)
+	w := httptest.NewRecorder()
+	d.handleRewriteList(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	etag := w.Header().Get(aghhttp.HdrNameETag)
+	require.NotEmpty(t, etag)
+
+	const body = `[{"domain":"Пример.рф","answer":"5.6.7.8"},{"domain":"example.net","answer":"example.com"}]`
+
+	testCases := []struct {
+		name       string
+		ifMatch    string
+		wantDomain string
+		wantCode   int
+	}{{
+		name:       "success",
+		ifMatch:    etag,
+		wantDomain: "xn--e1afmkfd.xn--p1ai",
+		wantCode:   http.StatusOK,
+	}, {
+		// The entity tag is outdated after the previous replacement.
+		name:       "modified",
+		ifMatch:    etag,
+		wantDomain: "xn--e1afmkfd.xn--p1ai",
+		wantCode:   http.StatusPreconditionFailed,
+	}, {
+		name:       "any",
+		ifMatch:    "*",
+		wantDomain: "xn--e1afmkfd.xn--p1ai",
+		wantCode:   http.StatusOK,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			confModifiedCalled = false
+
+			r = httptest.NewRequest(http.MethodPut, "http://example.org", strings.NewReader(body))
+			r.Header.Set(aghhttp.HdrNameIfMatch, tc.ifMatch)
+			w = httptest.NewRecorder()
+			d.handleRewriteReplace(w, r)
+
+			assert.Equal(t, tc.wantCode, w.Code)
+			assert.Equal(t, tc.wantCode == http.StatusOK, confModifiedCalled)
+
+			require.Len(t, d.Config.Rewrites, 2)
+
+			assert.Equal(t, tc.wantDomain, d.Config.Rewrites[0].Domain)
+		})
+	}
+}
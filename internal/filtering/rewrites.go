@@ -76,7 +76,7 @@ func (rw *LegacyRewrite) normalize() (err error) {
 	// TODO(a.garipov): Write a case-agnostic version of strings.HasSuffix and
 	// use it in matchDomainWildcard instead of using strings.ToLower
 	// everywhere.
-	rw.Domain = strings.ToLower(rw.Domain)
+	rw.Domain = hostToASCII(strings.ToLower(rw.Domain))
 
 	switch rw.Answer {
 	case "AAAA":
@@ -142,9 +142,22 @@ func legacyRewriteSortsBefore(a, b *LegacyRewrite) (sortsBefore bool) {
 	return len(a.Domain) > len(b.Domain)
 }
 
+// LegacyRewrites returns a deep copy of the legacy DNS rewrites of d.
+func (d *DNSFilter) LegacyRewrites() (rws []*LegacyRewrite) {
+	d.confLock.RLock()
+	defer d.confLock.RUnlock()
+
+	return cloneRewrites(d.Rewrites)
+}
+
 // prepareRewrites normalizes and validates all legacy DNS rewrites.
 func (d *DNSFilter) prepareRewrites() (err error) {
-	for i, r := range d.Rewrites {
+	return PrepareRewrites(d.Rewrites)
+}
+
+// PrepareRewrites normalizes and validates the legacy DNS rewrites from rws.
+func PrepareRewrites(rws []*LegacyRewrite) (err error) {
+	for i, r := range rws {
 		err = r.normalize()
 		if err != nil {
 			return fmt.Errorf("at index %d: %w", i, err)
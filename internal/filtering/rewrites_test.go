@@ -369,3 +369,49 @@ func TestRewritesExceptionIP(t *testing.T) {
 		})
 	}
 }
+
+func TestDNSFilter_CheckHost_settingsRewrites(t *testing.T) {
+	d, setts := newForTest(t, nil, nil)
+	t.Cleanup(d.Close)
+
+	d.Rewrites = []*LegacyRewrite{{
+		Domain: "host.com",
+		Answer: "1.2.3.4",
+	}, {
+		Domain: "other.com",
+		Answer: "1.2.3.5",
+	}}
+	require.NoError(t, d.prepareRewrites())
+
+	setts.Rewrites = []*LegacyRewrite{{
+		Domain: "host.com",
+		Answer: "10.0.0.1",
+	}}
+	require.NoError(t, PrepareRewrites(setts.Rewrites))
+
+	testCases := []struct {
+		name string
+		host string
+		want net.IP
+	}{{
+		name: "settings",
+		host: "host.com",
+		want: net.IP{10, 0, 0, 1},
+	}, {
+		name: "global",
+		host: "other.com",
+		want: net.IP{1, 2, 3, 5},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := d.CheckHost(tc.host, dns.TypeA, setts)
+			require.NoError(t, err)
+
+			assert.Equal(t, Rewritten, res.Reason)
+			require.Len(t, res.IPList, 1)
+
+			assert.True(t, tc.want.Equal(res.IPList[0]))
+		})
+	}
+}
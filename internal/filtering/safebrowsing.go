@@ -6,7 +6,6 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"net"
 	"net/http"
 	"strings"
 	"sync"
@@ -24,7 +23,6 @@ import (
 
 // Safe browsing and parental control methods.
 
-// TODO(a.garipov): Make configurable.
 const (
 	dnsTimeout                = 3 * time.Second
 	defaultSafebrowsingServer = `https://family.adguard-dns.com/dns-query`
@@ -47,29 +45,28 @@ func (d *DNSFilter) SetSafeBrowsingUpstream(u upstream.Upstream) {
 	d.safeBrowsingUpstream = u
 }
 
-func (d *DNSFilter) initSecurityServices() error {
-	var err error
-	d.safeBrowsingServer = defaultSafebrowsingServer
-	d.parentalServer = defaultParentalServer
-	opts := &upstream.Options{
-		Timeout: dnsTimeout,
-		ServerIPAddrs: []net.IP{
-			{94, 140, 14, 15},
-			{94, 140, 15, 16},
-			net.ParseIP("2a10:50c0::bad1:ff"),
-			net.ParseIP("2a10:50c0::bad2:ff"),
-		},
-	}
-
-	parUps, err := upstream.AddressToUpstream(d.parentalServer, opts)
+// initSecurityServices initializes the upstreams of the safe browsing and the
+// parental control lookup services configured in c.
+func (d *DNSFilter) initSecurityServices(c *Config) (err error) {
+	var parUps upstream.Upstream
+	d.parentalServer, d.parentalSuffix, parUps, err = newLookupUpstream(
+		&c.ParentalService,
+		defaultParentalServer,
+		pcTXTSuffix,
+	)
 	if err != nil {
-		return fmt.Errorf("converting parental server: %w", err)
+		return fmt.Errorf("parental service: %w", err)
 	}
 	d.SetParentalUpstream(parUps)
 
-	sbUps, err := upstream.AddressToUpstream(d.safeBrowsingServer, opts)
+	var sbUps upstream.Upstream
+	d.safeBrowsingServer, d.safeBrowsingSuffix, sbUps, err = newLookupUpstream(
+		&c.SafeBrowsingService,
+		defaultSafebrowsingServer,
+		sbTXTSuffix,
+	)
 	if err != nil {
-		return fmt.Errorf("converting safe browsing server: %w", err)
+		return fmt.Errorf("safe browsing service: %w", err)
 	}
 	d.SetSafeBrowsingUpstream(sbUps)
 
@@ -137,6 +134,9 @@ type sbCtx struct {
 	hashToHost map[[32]byte]string
 	cache      cache.Cache
 	cacheTime  uint
+
+	// txtSuffix is the domain name suffix of the TXT requests to the service.
+	txtSuffix string
 }
 
 func hostnameToHashes(host string) map[[32]byte]string {
@@ -190,13 +190,7 @@ func (c *sbCtx) getQuestion() string {
 		stringutil.WriteToBuilder(b, hex.EncodeToString(hash[0:2]), ".")
 	}
 
-	if c.svc == "SafeBrowsing" {
-		stringutil.WriteToBuilder(b, sbTXTSuffix)
-
-		return b.String()
-	}
-
-	stringutil.WriteToBuilder(b, pcTXTSuffix)
+	stringutil.WriteToBuilder(b, c.txtSuffix)
 
 	return b.String()
 }
@@ -322,6 +316,7 @@ func (d *DNSFilter) checkSafeBrowsing(
 		svc:       "SafeBrowsing",
 		cache:     d.safebrowsingCache,
 		cacheTime: d.Config.CacheTime,
+		txtSuffix: d.safeBrowsingSuffix,
 	}
 
 	res = Result{
@@ -356,6 +351,7 @@ func (d *DNSFilter) checkParental(
 		svc:       "Parental",
 		cache:     d.parentalCache,
 		cacheTime: d.Config.CacheTime,
+		txtSuffix: d.parentalSuffix,
 	}
 
 	res = Result{
@@ -424,9 +420,11 @@ func (d *DNSFilter) handleParentalDisable(w http.ResponseWriter, r *http.Request
 
 func (d *DNSFilter) handleParentalStatus(w http.ResponseWriter, r *http.Request) {
 	resp := &struct {
-		Enabled bool `json:"enabled"`
+		Enabled      bool `json:"enabled"`
+		StrictSearch bool `json:"strict_search"`
 	}{
-		Enabled: protectedBool(&d.confLock, &d.Config.ParentalEnabled),
+		Enabled:      protectedBool(&d.confLock, &d.Config.ParentalEnabled),
+		StrictSearch: protectedBool(&d.confLock, &d.Config.ParentalStrictSearch),
 	}
 
 	_ = aghhttp.WriteJSONResponse(w, r, resp)
@@ -28,6 +28,7 @@ func TestSafeBrowsingHash(t *testing.T) {
 	c := &sbCtx{
 		svc:        "SafeBrowsing",
 		hashToHost: hashes,
+		txtSuffix:  sbTXTSuffix,
 	}
 
 	q := c.getQuestion()
@@ -37,7 +37,7 @@ type SafeSearchConfig struct {
 // [hostChecker.check].
 func (d *DNSFilter) checkSafeSearch(
 	host string,
-	_ uint16,
+	qtype uint16,
 	setts *Settings,
 ) (res Result, err error) {
 	if !setts.ProtectionEnabled || !setts.SafeSearchEnabled {
@@ -48,10 +48,16 @@ func (d *DNSFilter) checkSafeSearch(
 		return Result{}, nil
 	}
 
+	// Check the requests of the other types as the A ones, since only the
+	// addresses are rewritten.
+	if qtype != dns.TypeAAAA {
+		qtype = dns.TypeA
+	}
+
 	clientSafeSearch := setts.ClientSafeSearch
 	if clientSafeSearch != nil {
-		return clientSafeSearch.CheckHost(host, dns.TypeA)
+		return clientSafeSearch.CheckHost(host, qtype)
 	}
 
-	return d.safeSearch.CheckHost(host, dns.TypeA)
+	return d.safeSearch.CheckHost(host, qtype)
 }
@@ -145,7 +145,7 @@ func (ss *DefaultSafeSearch) CheckHost(
 	}
 
 	// Check cache. Return cached result if it was found
-	cachedValue, isFound := ss.getCachedResult(host)
+	cachedValue, isFound := ss.getCachedResult(host, qtype)
 	if isFound {
 		log.Debug("safesearch: found in cache: %s", host)
 
@@ -166,7 +166,7 @@ func (ss *DefaultSafeSearch) CheckHost(
 
 	if dRes != nil {
 		res = *dRes
-		ss.setCacheResult(host, res)
+		ss.setCacheResult(host, qtype, res)
 
 		return res, nil
 	}
@@ -174,7 +174,9 @@ func (ss *DefaultSafeSearch) CheckHost(
 	return filtering.Result{}, fmt.Errorf("no ipv4 addresses in safe search response for %s", host)
 }
 
-// newResult creates Result object from rewrite rule.
+// newResult creates Result object from rewrite rule.  For AAAA requests, the
+// result without any IP address is returned if the enforced endpoint has no
+// IPv6 addresses, so that the clients can't bypass the enforcement using them.
 func (ss *DefaultSafeSearch) newResult(
 	rewrite *rules.DNSRewrite,
 	qtype uint16,
@@ -187,14 +189,16 @@ func (ss *DefaultSafeSearch) newResult(
 		IsFiltered: true,
 	}
 
-	if rewrite.RRType == qtype && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+	if rt := rewrite.RRType; rt == dns.TypeA || rt == dns.TypeAAAA {
 		ip, ok := rewrite.Value.(net.IP)
 		if !ok || ip == nil {
 			return nil, nil
+		} else if rt == qtype {
+			res.Rules[0].IP = ip
+		} else if qtype != dns.TypeAAAA {
+			return nil, nil
 		}
 
-		res.Rules[0].IP = ip
-
 		return res, nil
 	}
 
@@ -202,26 +206,56 @@ func (ss *DefaultSafeSearch) newResult(
 		return nil, nil
 	}
 
-	ips, err := ss.resolver.LookupIP(context.Background(), "ip", rewrite.NewCNAME)
+	network := "ip4"
+	if qtype == dns.TypeAAAA {
+		network = "ip6"
+	}
+
+	ips, err := ss.resolver.LookupIP(context.Background(), network, rewrite.NewCNAME)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, ip := range ips {
-		if ip = ip.To4(); ip == nil {
-			continue
-		}
+		if ip = familyIP(ip, qtype); ip != nil {
+			res.Rules[0].IP = ip
 
-		res.Rules[0].IP = ip
+			return res, nil
+		}
+	}
 
+	if qtype == dns.TypeAAAA {
 		return res, nil
 	}
 
 	return nil, nil
 }
 
-// setCacheResult stores data in cache for host.
-func (ss *DefaultSafeSearch) setCacheResult(host string, res filtering.Result) {
+// familyIP returns ip in the form appropriate for the response to the request
+// of qtype.  ip is nil if it's of the other family.
+func familyIP(ip net.IP, qtype uint16) (famIP net.IP) {
+	ip4 := ip.To4()
+	if qtype == dns.TypeAAAA {
+		if ip4 != nil {
+			return nil
+		}
+
+		return ip.To16()
+	}
+
+	return ip4
+}
+
+// cacheKey returns the key of the cache item for host and qtype.
+func cacheKey(host string, qtype uint16) (key []byte) {
+	key = make([]byte, 2, 2+len(host))
+	binary.BigEndian.PutUint16(key, qtype)
+
+	return append(key, host...)
+}
+
+// setCacheResult stores data in cache for host and qtype.
+func (ss *DefaultSafeSearch) setCacheResult(host string, qtype uint16, res filtering.Result) {
 	expire := uint32(time.Now().Add(ss.cacheTime).Unix())
 	exp := make([]byte, 4)
 	binary.BigEndian.PutUint32(exp, expire)
@@ -235,23 +269,27 @@ func (ss *DefaultSafeSearch) setCacheResult(host string, res filtering.Result) {
 	}
 
 	val := buf.Bytes()
-	_ = ss.safeSearchCache.Set([]byte(host), val)
+	_ = ss.safeSearchCache.Set(cacheKey(host, qtype), val)
 
 	log.Debug("safesearch: stored in cache: %s (%d bytes)", host, len(val))
 }
 
-// getCachedResult returns stored data from cache for host.
-func (ss *DefaultSafeSearch) getCachedResult(host string) (res filtering.Result, ok bool) {
+// getCachedResult returns stored data from cache for host and qtype.
+func (ss *DefaultSafeSearch) getCachedResult(
+	host string,
+	qtype uint16,
+) (res filtering.Result, ok bool) {
 	res = filtering.Result{}
 
-	data := ss.safeSearchCache.Get([]byte(host))
+	key := cacheKey(host, qtype)
+	data := ss.safeSearchCache.Get(key)
 	if data == nil {
 		return res, false
 	}
 
 	exp := binary.BigEndian.Uint32(data[:4])
 	if exp <= uint32(time.Now().Unix()) {
-		ss.safeSearchCache.Del([]byte(host))
+		ss.safeSearchCache.Del(key)
 
 		return res, false
 	}
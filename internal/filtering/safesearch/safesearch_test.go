@@ -100,6 +100,49 @@ func TestCheckHostSafeSearchGoogle(t *testing.T) {
 	}
 }
 
+func TestDefaultSafeSearch_CheckHost_aaaa(t *testing.T) {
+	resolver := &aghtest.TestResolver{}
+	_, googleIPv6 := resolver.HostToIPs("forcesafesearch.google.com")
+
+	ss := newForTest(t, defaultSafeSearchConf)
+	ss.resolver = resolver
+
+	testCases := []struct {
+		name   string
+		host   string
+		wantIP net.IP
+	}{{
+		name:   "cname",
+		host:   "www.google.com",
+		wantIP: googleIPv6,
+	}, {
+		name:   "ipv4_only",
+		host:   "yandex.ru",
+		wantIP: nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := ss.CheckHost(tc.host, dns.TypeAAAA)
+			require.NoError(t, err)
+
+			assert.True(t, res.IsFiltered)
+			assert.Equal(t, filtering.FilteredSafeSearch, res.Reason)
+
+			require.Len(t, res.Rules, 1)
+
+			assert.Equal(t, tc.wantIP, res.Rules[0].IP)
+
+			// The results for A requests are cached separately.
+			res, err = ss.CheckHost(tc.host, dns.TypeA)
+			require.NoError(t, err)
+			require.Len(t, res.Rules, 1)
+
+			assert.NotNil(t, res.Rules[0].IP.To4())
+		})
+	}
+}
+
 func TestSafeSearchCacheYandex(t *testing.T) {
 	const domain = "yandex.ru"
 
@@ -122,7 +165,7 @@ func TestSafeSearchCacheYandex(t *testing.T) {
 	assert.Equal(t, res.Rules[0].IP, yandexIP)
 
 	// Check cache.
-	cachedValue, isFound := ss.getCachedResult(domain)
+	cachedValue, isFound := ss.getCachedResult(domain, dns.TypeA)
 	require.True(t, isFound)
 	require.Len(t, cachedValue.Rules, 1)
 
@@ -166,7 +209,7 @@ func TestSafeSearchCacheGoogle(t *testing.T) {
 	assert.True(t, res.Rules[0].IP.Equal(foundIP))
 
 	// Check cache.
-	cachedValue, isFound := ss.getCachedResult(domain)
+	cachedValue, isFound := ss.getCachedResult(domain, dns.TypeA)
 	require.True(t, isFound)
 	require.Len(t, cachedValue.Rules, 1)
 
@@ -0,0 +1,626 @@
+package filtering
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghio"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/google/renameio/maybe"
+	"golang.org/x/exp/slices"
+)
+
+// ServicesCatalogConfig is the configuration of the remote catalog of the
+// blocked services, which replaces the built-in one.
+type ServicesCatalogConfig struct {
+	// URL is the URL of the index of the blocked services.  Its Ed25519
+	// signature is downloaded from the same URL with the ".sig" extension
+	// appended.  If empty, the built-in catalog is used.
+	URL string `yaml:"url"`
+
+	// PublicKey is the base64-encoded Ed25519 public key the index is signed
+	// with.  It must be set if URL is set.
+	PublicKey string `yaml:"public_key"`
+
+	// UpdateInterval is the interval between the checks for a new version of
+	// the index.  Zero means [defaultServicesUpdateIvl].
+	UpdateInterval timeutil.Duration `yaml:"update_interval"`
+
+	// Pinned, if true, disables the scheduled checks, so the locally saved
+	// catalog keeps being used until it's refreshed manually.
+	Pinned bool `yaml:"pinned"`
+}
+
+// Validate returns an error if c is invalid.
+func (c *ServicesCatalogConfig) Validate() (err error) {
+	if c.UpdateInterval.Duration < 0 {
+		return errors.Error("update_interval: negative value")
+	}
+
+	if c.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("url: %w", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url: bad scheme %q", u.Scheme)
+	}
+
+	_, err = c.publicKey()
+	if err != nil {
+		return fmt.Errorf("public_key: %w", err)
+	}
+
+	return nil
+}
+
+// publicKey returns the decoded public key of c.
+func (c *ServicesCatalogConfig) publicKey() (key ed25519.PublicKey, err error) {
+	if c.PublicKey == "" {
+		return nil, errors.Error("empty")
+	}
+
+	key, err = base64.StdEncoding.DecodeString(c.PublicKey)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	} else if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("bad length %d", len(key))
+	}
+
+	return key, nil
+}
+
+// updateInterval returns the interval between the checks of c.
+func (c *ServicesCatalogConfig) updateInterval() (ivl time.Duration) {
+	if c.UpdateInterval.Duration > 0 {
+		return c.UpdateInterval.Duration
+	}
+
+	return defaultServicesUpdateIvl
+}
+
+const (
+	// defaultServicesUpdateIvl is the default interval between the checks for
+	// a new version of the catalog.
+	defaultServicesUpdateIvl = 24 * time.Hour
+
+	// servicesCheckIvl is the interval at which the periodic updater checks if
+	// the catalog should be updated.  It's also the retry interval after the
+	// failed updates.
+	servicesCheckIvl = 1 * time.Hour
+
+	// servicesDownloadTimeout is the timeout for downloading both the index of
+	// the blocked services and its signature.
+	servicesDownloadTimeout = 1 * time.Minute
+
+	// servicesIndexMaxSize is the maximum size of the index of the blocked
+	// services.
+	servicesIndexMaxSize = 16 * 1024 * 1024
+
+	// servicesIndexFile is the name of the file within the filters directory
+	// the latest index is saved to.  Its signature is saved next to it with
+	// the [servicesSigExt] extension.
+	servicesIndexFile = "services.json"
+
+	// servicesSigExt is the extension of the signature of the index.
+	servicesSigExt = ".sig"
+)
+
+// servicesIndex is the index of the blocked services.
+type servicesIndex struct {
+	// BlockedServices are the definitions of the services.
+	BlockedServices []blockedService `json:"blocked_services"`
+
+	// Version is the version of the index.  The indexes of the earlier
+	// versions than the current one are rejected.
+	Version uint64 `json:"version"`
+}
+
+// servicesSnapshot is an immutable version of the catalog of the blocked
+// services.  A nil *servicesSnapshot is an empty catalog.
+type servicesSnapshot struct {
+	// rules maps a service ID to its filtering rules.
+	rules map[string][]*rules.NetworkRule
+
+	// updated is the time the catalog has been downloaded at.  It's zero for
+	// the built-in catalog.
+	updated time.Time
+
+	// services are the definitions of the services.
+	services []blockedService
+
+	// ids are the service IDs sorted alphabetically.
+	ids []string
+
+	// version is the version of the index.  It's zero for the built-in
+	// catalog.
+	version uint64
+}
+
+// builtinServices is the built-in catalog of the blocked services.  It's set
+// by [InitModule].
+var builtinServices *servicesSnapshot
+
+// ServicesCatalog is the catalog of the blocked services used by a filter,
+// which is either the built-in or the remote one.  A nil *ServicesCatalog is
+// the built-in catalog.  It's safe for concurrent use.
+type ServicesCatalog struct {
+	// current is the version of the catalog currently in use.  It's never
+	// nil.
+	current atomic.Pointer[servicesSnapshot]
+}
+
+// newBuiltinServicesCatalog returns a new catalog of the blocked services
+// initialized with the built-in one.
+func newBuiltinServicesCatalog() (sc *ServicesCatalog) {
+	sc = &ServicesCatalog{}
+	sc.current.Store(builtinServices)
+
+	return sc
+}
+
+// load returns the version of the catalog currently in use.
+func (sc *ServicesCatalog) load() (c *servicesSnapshot) {
+	if sc == nil {
+		return builtinServices
+	}
+
+	return sc.current.Load()
+}
+
+// Known returns true if the blocked service with id is known.
+func (sc *ServicesCatalog) Known(id string) (ok bool) {
+	_, ok = sc.load().serviceRules(id)
+
+	return ok
+}
+
+// newServicesSnapshot returns a new catalog of services.  errs are the errors
+// of the invalid services and rules, which are skipped.
+func newServicesSnapshot(
+	services []blockedService,
+	version uint64,
+	updated time.Time,
+) (c *servicesSnapshot, errs []error) {
+	c = &servicesSnapshot{
+		rules:    make(map[string][]*rules.NetworkRule, len(services)),
+		updated:  updated,
+		services: make([]blockedService, 0, len(services)),
+		ids:      make([]string, 0, len(services)),
+		version:  version,
+	}
+
+	for i, s := range services {
+		if s.ID == "" {
+			errs = append(errs, fmt.Errorf("service at index %d: empty id", i))
+
+			continue
+		} else if _, ok := c.rules[s.ID]; ok {
+			errs = append(errs, fmt.Errorf("service %q: duplicated id", s.ID))
+
+			continue
+		}
+
+		netRules := make([]*rules.NetworkRule, 0, len(s.Rules))
+		for _, text := range s.Rules {
+			rule, err := rules.NewNetworkRule(text, BlockedSvcsListID)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("service %q: rule %q: %w", s.ID, text, err))
+
+				continue
+			}
+
+			netRules = append(netRules, rule)
+		}
+
+		c.services = append(c.services, s)
+		c.ids = append(c.ids, s.ID)
+		c.rules[s.ID] = netRules
+	}
+
+	slices.Sort(c.ids)
+
+	return c, errs
+}
+
+// serviceRules returns the rules of the service with id.  ok is false if
+// there is no such service.
+func (c *servicesSnapshot) serviceRules(id string) (netRules []*rules.NetworkRule, ok bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	netRules, ok = c.rules[id]
+
+	return netRules, ok
+}
+
+// parseServicesIndex verifies the signature sig of the index data with key and
+// returns the catalog of services from it.
+func parseServicesIndex(
+	data []byte,
+	sig []byte,
+	key ed25519.PublicKey,
+	updated time.Time,
+) (c *servicesSnapshot, err error) {
+	if !ed25519.Verify(key, data, sig) {
+		return nil, errors.Error("bad signature")
+	}
+
+	idx := &servicesIndex{}
+	err = json.Unmarshal(data, idx)
+	if err != nil {
+		return nil, fmt.Errorf("decoding index: %w", err)
+	} else if len(idx.BlockedServices) == 0 {
+		return nil, errors.Error("no services")
+	}
+
+	c, errs := newServicesSnapshot(idx.BlockedServices, idx.Version, updated)
+	if len(errs) > 0 {
+		return nil, errors.List("bad services", errs...)
+	}
+
+	return c, nil
+}
+
+// servicesIndexPath returns the path to the saved index within dataDir.
+func servicesIndexPath(dataDir string) (p string) {
+	return filepath.Join(dataDir, filterDir, servicesIndexFile)
+}
+
+// NewServicesCatalog returns the catalog of the blocked services for the
+// filter with configuration c.  It's the saved remote one, if
+// c.BlockedServicesCatalog is configured and it has been downloaded before, and
+// the built-in one otherwise.  sc is never nil, even if err is not nil, in
+// which case it's the built-in catalog.  It must be called after [InitModule].
+func NewServicesCatalog(c *Config) (sc *ServicesCatalog, err error) {
+	sc = newBuiltinServicesCatalog()
+
+	conf := &c.BlockedServicesCatalog
+	if conf.URL == "" {
+		return sc, nil
+	}
+
+	catalog, err := loadServicesIndex(conf, c.DataDir)
+	if err != nil {
+		return sc, err
+	} else if catalog == nil {
+		log.Debug("filtering: no saved services catalog")
+
+		return sc, nil
+	}
+
+	sc.current.Store(catalog)
+
+	log.Info(
+		"filtering: loaded services catalog version %d with %d services",
+		catalog.version,
+		len(catalog.ids),
+	)
+
+	return sc, nil
+}
+
+// loadServicesIndex returns the catalog from the index saved within dataDir
+// and verified according to conf.  c is nil if there is no saved index.
+func loadServicesIndex(
+	conf *ServicesCatalogConfig,
+	dataDir string,
+) (c *servicesSnapshot, err error) {
+	key, err := conf.publicKey()
+	if err != nil {
+		return nil, fmt.Errorf("public key: %w", err)
+	}
+
+	p := servicesIndexPath(dataDir)
+	fi, err := os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	sig, err := os.ReadFile(p + servicesSigExt)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	c, err = parseServicesIndex(data, sig, key, fi.ModTime())
+	if err != nil {
+		return nil, fmt.Errorf("saved catalog: %w", err)
+	}
+
+	return c, nil
+}
+
+// servicesCatalogConfig returns the copy of the configuration of the catalog.
+func (d *DNSFilter) servicesCatalogConfig() (conf ServicesCatalogConfig) {
+	d.confLock.RLock()
+	defer d.confLock.RUnlock()
+
+	return d.BlockedServicesCatalog
+}
+
+// periodicallyRefreshServices checks for the new versions of the catalog of
+// the blocked services according to its configuration.
+func (d *DNSFilter) periodicallyRefreshServices() {
+	defer log.OnPanic("filtering: services catalog")
+
+	for {
+		conf := d.servicesCatalogConfig()
+		if conf.URL != "" && !conf.Pinned && d.servicesCheckDue(&conf, time.Now()) {
+			d.refreshServicesWithTimeout(context.Background(), &conf)
+		}
+
+		time.Sleep(servicesCheckIvl)
+	}
+}
+
+// servicesCheckDue returns true if the catalog should be checked at now
+// according to conf.
+func (d *DNSFilter) servicesCheckDue(conf *ServicesCatalogConfig, now time.Time) (ok bool) {
+	d.servicesMu.Lock()
+	defer d.servicesMu.Unlock()
+
+	last := d.servicesCheckedAt
+	if c := d.ServicesCatalog.load(); c != nil && c.updated.After(last) {
+		last = c.updated
+	}
+
+	return !now.Before(last.Add(conf.updateInterval()))
+}
+
+// refreshServicesWithTimeout is a wrapper around [DNSFilter.refreshServices]
+// for the periodic updater, which bounds the downloads with
+// [servicesDownloadTimeout] and logs the error.
+func (d *DNSFilter) refreshServicesWithTimeout(ctx context.Context, conf *ServicesCatalogConfig) {
+	ctx, cancel := context.WithTimeout(ctx, servicesDownloadTimeout)
+	defer cancel()
+
+	_, err := d.refreshServices(ctx, conf)
+	if err != nil {
+		log.Error("filtering: updating services catalog: %s", err)
+	}
+}
+
+// refreshServices downloads the index of the blocked services according to
+// conf and replaces the current catalog with it, if it's newer.  updated is
+// true if the catalog has been replaced.
+func (d *DNSFilter) refreshServices(
+	ctx context.Context,
+	conf *ServicesCatalogConfig,
+) (updated bool, err error) {
+	d.servicesMu.Lock()
+	defer d.servicesMu.Unlock()
+
+	defer func() { d.servicesErr = err }()
+
+	key, err := conf.publicKey()
+	if err != nil {
+		return false, fmt.Errorf("public key: %w", err)
+	}
+
+	data, err := d.download(ctx, conf.URL, servicesIndexMaxSize)
+	if err != nil {
+		return false, fmt.Errorf("downloading index: %w", err)
+	}
+
+	sig, err := d.download(ctx, conf.URL+servicesSigExt, ed25519.SignatureSize)
+	if err != nil {
+		return false, fmt.Errorf("downloading signature: %w", err)
+	}
+
+	now := time.Now()
+	catalog, err := parseServicesIndex(data, sig, key, now)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return false, err
+	}
+
+	d.servicesCheckedAt = now
+
+	cur := d.ServicesCatalog.load()
+	if cur != nil && catalog.version <= cur.version {
+		if catalog.version < cur.version {
+			return false, fmt.Errorf(
+				"version %d is older than current version %d",
+				catalog.version,
+				cur.version,
+			)
+		}
+
+		log.Debug("filtering: services catalog version %d is up to date", cur.version)
+
+		return false, nil
+	}
+
+	p := servicesIndexPath(d.DataDir)
+	err = maybe.WriteFile(p, data, 0o644)
+	if err != nil {
+		return false, fmt.Errorf("saving index: %w", err)
+	}
+
+	err = maybe.WriteFile(p+servicesSigExt, sig, 0o644)
+	if err != nil {
+		return false, fmt.Errorf("saving signature: %w", err)
+	}
+
+	d.ServicesCatalog.current.Store(catalog)
+
+	log.Info(
+		"filtering: updated services catalog to version %d with %d services",
+		catalog.version,
+		len(catalog.ids),
+	)
+
+	return true, nil
+}
+
+// download returns the body of the response to the GET request to u, which
+// must not be longer than maxSize bytes.
+func (d *DNSFilter) download(ctx context.Context, u string, maxSize int64) (body []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := d.HTTPClient.Do(req)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status code %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	r, err := aghio.LimitReader(resp.Body, maxSize)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	// Don't wrap the error, since it's informative enough as is.
+	return io.ReadAll(r)
+}
+
+// servicesCatalogJSON is the response for the GET
+// /control/blocked_services/catalog HTTP API.
+type servicesCatalogJSON struct {
+	// Updated is the time the catalog has been downloaded at.  It's empty for
+	// the built-in catalog.
+	Updated string `json:"updated,omitempty"`
+
+	// LastChecked is the time of the latest successful check for a new
+	// version.  It's empty if there have been none since the start.
+	LastChecked string `json:"last_checked,omitempty"`
+
+	// Error is the error of the latest check, if any.
+	Error string `json:"error,omitempty"`
+
+	URL string `json:"url"`
+
+	Version  uint64 `json:"version"`
+	Services int    `json:"services"`
+
+	Builtin bool `json:"builtin"`
+	Pinned  bool `json:"pinned"`
+}
+
+// servicesCatalogStatus returns the status of the catalog of the blocked
+// services.
+func (d *DNSFilter) servicesCatalogStatus() (resp *servicesCatalogJSON) {
+	conf := d.servicesCatalogConfig()
+	resp = &servicesCatalogJSON{
+		URL:     conf.URL,
+		Pinned:  conf.Pinned,
+		Builtin: true,
+	}
+
+	if c := d.ServicesCatalog.load(); c != nil {
+		resp.Version = c.version
+		resp.Services = len(c.ids)
+		if !c.updated.IsZero() {
+			resp.Builtin = false
+			resp.Updated = c.updated.Format(time.RFC3339)
+		}
+	}
+
+	d.servicesMu.Lock()
+	defer d.servicesMu.Unlock()
+
+	if !d.servicesCheckedAt.IsZero() {
+		resp.LastChecked = d.servicesCheckedAt.Format(time.RFC3339)
+	}
+
+	if d.servicesErr != nil {
+		resp.Error = d.servicesErr.Error()
+	}
+
+	return resp
+}
+
+// handleServicesCatalog is the handler for the GET
+// /control/blocked_services/catalog HTTP API.
+func (d *DNSFilter) handleServicesCatalog(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, d.servicesCatalogStatus())
+}
+
+// handleServicesCatalogRefresh is the handler for the POST
+// /control/blocked_services/catalog/refresh HTTP API.  It checks for a new
+// version of the catalog regardless of its pinning.
+func (d *DNSFilter) handleServicesCatalogRefresh(w http.ResponseWriter, r *http.Request) {
+	conf := d.servicesCatalogConfig()
+	if conf.URL == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "services catalog url is not configured")
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), servicesDownloadTimeout)
+	defer cancel()
+
+	_, err := d.refreshServices(ctx, &conf)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadGateway, "updating services catalog: %s", err)
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, d.servicesCatalogStatus())
+}
+
+// servicesCatalogPinReq is the request for the POST
+// /control/blocked_services/catalog/pin HTTP API.
+type servicesCatalogPinReq struct {
+	Pinned bool `json:"pinned"`
+}
+
+// handleServicesCatalogPin is the handler for the POST
+// /control/blocked_services/catalog/pin HTTP API.
+func (d *DNSFilter) handleServicesCatalogPin(w http.ResponseWriter, r *http.Request) {
+	req := &servicesCatalogPinReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	func() {
+		d.confLock.Lock()
+		defer d.confLock.Unlock()
+
+		d.BlockedServicesCatalog.Pinned = req.Pinned
+	}()
+
+	log.Debug("filtering: services catalog pinned: %t", req.Pinned)
+
+	d.Config.ConfigModified()
+}
@@ -0,0 +1,282 @@
+package filtering
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testServicesKey is the private key the test indexes are signed with.
+var testServicesKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+// testServicesPubKey is the base64-encoded public key of testServicesKey.
+var testServicesPubKey = base64.StdEncoding.EncodeToString(
+	testServicesKey.Public().(ed25519.PublicKey),
+)
+
+// newTestIndex returns the JSON index of version with services and its
+// signature by testServicesKey.
+func newTestIndex(
+	t *testing.T,
+	version uint64,
+	services ...blockedService,
+) (data, sig []byte) {
+	t.Helper()
+
+	data, err := json.Marshal(&servicesIndex{
+		BlockedServices: services,
+		Version:         version,
+	})
+	require.NoError(t, err)
+
+	return data, ed25519.Sign(testServicesKey, data)
+}
+
+func TestServicesCatalogConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		conf       ServicesCatalogConfig
+		wantErrMsg string
+	}{{
+		name:       "empty",
+		conf:       ServicesCatalogConfig{},
+		wantErrMsg: "",
+	}, {
+		name: "valid",
+		conf: ServicesCatalogConfig{
+			URL:       "https://services.example/index.json",
+			PublicKey: testServicesPubKey,
+		},
+		wantErrMsg: "",
+	}, {
+		name: "bad_scheme",
+		conf: ServicesCatalogConfig{
+			URL:       "ftp://services.example/index.json",
+			PublicKey: testServicesPubKey,
+		},
+		wantErrMsg: `url: bad scheme "ftp"`,
+	}, {
+		name: "no_key",
+		conf: ServicesCatalogConfig{
+			URL: "https://services.example/index.json",
+		},
+		wantErrMsg: "public_key: empty",
+	}, {
+		name: "short_key",
+		conf: ServicesCatalogConfig{
+			URL:       "https://services.example/index.json",
+			PublicKey: "AAAA",
+		},
+		wantErrMsg: "public_key: bad length 3",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.Validate())
+		})
+	}
+}
+
+func TestDNSFilter_refreshServices(t *testing.T) {
+	InitModule()
+
+	svc := blockedService{
+		ID:    "newservice",
+		Name:  "New Service",
+		Rules: []string{"||newservice.example^"},
+	}
+
+	var data, sig []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, servicesSigExt) {
+			_, _ = w.Write(sig)
+		} else {
+			_, _ = w.Write(data)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	dataDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dataDir, filterDir), 0o755)
+	require.NoError(t, err)
+
+	conf := &ServicesCatalogConfig{
+		URL:       srv.URL + "/index.json",
+		PublicKey: testServicesPubKey,
+	}
+
+	d := &DNSFilter{
+		Config: Config{
+			BlockedServicesCatalog: *conf,
+			ServicesCatalog:        newBuiltinServicesCatalog(),
+			HTTPClient:             srv.Client(),
+			DataDir:                dataDir,
+		},
+		servicesMu: &sync.Mutex{},
+	}
+
+	ctx := context.Background()
+
+	require.False(t, d.ServicesCatalog.Known(svc.ID))
+
+	t.Run("update", func(t *testing.T) {
+		data, sig = newTestIndex(t, 2, svc)
+
+		updated, rerr := d.refreshServices(ctx, conf)
+		require.NoError(t, rerr)
+
+		assert.True(t, updated)
+		assert.True(t, d.ServicesCatalog.Known(svc.ID))
+		assert.False(t, d.ServicesCatalog.Known("youtube"))
+
+		// Other filters keep using their own catalogs.
+		assert.False(t, newBuiltinServicesCatalog().Known(svc.ID))
+		assert.True(t, (*ServicesCatalog)(nil).Known("youtube"))
+
+		status := d.servicesCatalogStatus()
+		assert.Equal(t, uint64(2), status.Version)
+		assert.Equal(t, 1, status.Services)
+		assert.False(t, status.Builtin)
+		assert.Empty(t, status.Error)
+	})
+
+	t.Run("same_version", func(t *testing.T) {
+		updated, rerr := d.refreshServices(ctx, conf)
+		require.NoError(t, rerr)
+
+		assert.False(t, updated)
+	})
+
+	t.Run("older_version", func(t *testing.T) {
+		data, sig = newTestIndex(t, 1, svc)
+
+		_, rerr := d.refreshServices(ctx, conf)
+		testutil.AssertErrorMsg(t, "version 1 is older than current version 2", rerr)
+
+		assert.Equal(t, rerr.Error(), d.servicesCatalogStatus().Error)
+	})
+
+	t.Run("bad_signature", func(t *testing.T) {
+		data, _ = newTestIndex(t, 3, svc)
+
+		_, rerr := d.refreshServices(ctx, conf)
+		testutil.AssertErrorMsg(t, "bad signature", rerr)
+	})
+
+	t.Run("bad_rule", func(t *testing.T) {
+		data, sig = newTestIndex(t, 3, blockedService{
+			ID:    "bad",
+			Rules: []string{"||bad.example^$badmodifier"},
+		})
+
+		_, rerr := d.refreshServices(ctx, conf)
+		require.Error(t, rerr)
+
+		assert.Contains(t, rerr.Error(), `service "bad": rule "||bad.example^$badmodifier"`)
+	})
+
+	t.Run("load", func(t *testing.T) {
+		sc, lerr := NewServicesCatalog(&d.Config)
+		require.NoError(t, lerr)
+
+		assert.True(t, sc.Known(svc.ID))
+		assert.Equal(t, uint64(2), sc.load().version)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		cancelledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, rerr := d.refreshServices(cancelledCtx, conf)
+		require.Error(t, rerr)
+
+		assert.ErrorIs(t, rerr, context.Canceled)
+	})
+}
+
+func TestNewServicesCatalog(t *testing.T) {
+	InitModule()
+
+	dataDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dataDir, filterDir), 0o755)
+	require.NoError(t, err)
+
+	c := &Config{
+		BlockedServicesCatalog: ServicesCatalogConfig{
+			URL:       "https://services.example/index.json",
+			PublicKey: testServicesPubKey,
+		},
+		DataDir: dataDir,
+	}
+
+	t.Run("not_saved", func(t *testing.T) {
+		sc, lerr := NewServicesCatalog(c)
+		require.NoError(t, lerr)
+
+		assert.True(t, sc.Known("youtube"))
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		data, sig := newTestIndex(t, 1, blockedService{
+			ID:    "newservice",
+			Rules: []string{"||newservice.example^"},
+		})
+
+		p := servicesIndexPath(dataDir)
+		err = os.WriteFile(p, append(data, ' '), 0o644)
+		require.NoError(t, err)
+
+		err = os.WriteFile(p+servicesSigExt, sig, 0o644)
+		require.NoError(t, err)
+
+		sc, lerr := NewServicesCatalog(c)
+		testutil.AssertErrorMsg(t, "saved catalog: bad signature", lerr)
+
+		require.NotNil(t, sc)
+
+		assert.True(t, sc.Known("youtube"))
+		assert.False(t, sc.Known("newservice"))
+	})
+}
+
+func TestDNSFilter_handleServicesCatalogPin(t *testing.T) {
+	InitModule()
+
+	modified := false
+	d := &DNSFilter{
+		Config: Config{
+			ConfigModified: func() { modified = true },
+		},
+		servicesMu: &sync.Mutex{},
+	}
+
+	r := httptest.NewRequest(
+		http.MethodPost,
+		"/control/blocked_services/catalog/pin",
+		strings.NewReader(`{"pinned":true}`),
+	)
+	w := httptest.NewRecorder()
+
+	d.handleServicesCatalogPin(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.True(t, modified)
+	assert.True(t, d.BlockedServicesCatalog.Pinned)
+
+	status := d.servicesCatalogStatus()
+	assert.True(t, status.Pinned)
+	assert.True(t, status.Builtin)
+	assert.Equal(t, len(blockedServices), status.Services)
+}
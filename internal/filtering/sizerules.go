@@ -0,0 +1,182 @@
+package filtering
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+// The names of the modifiers limiting the sizes of the responses.  These are
+// handled by AdGuard Home itself, since urlfilter doesn't support them.
+const (
+	// maxSizeModifier makes the responses larger than its value in bytes
+	// blocked.
+	maxSizeModifier = "maxsize"
+
+	// truncateModifier makes the DNS-over-UDP responses larger than its value
+	// in bytes truncated, so that the clients retry over TCP.
+	truncateModifier = "truncate"
+)
+
+// sizeRule is a user rule limiting the size of the responses to the requests
+// matching it.
+type sizeRule struct {
+	// rule is the rule without the size modifier used for matching the
+	// requests.
+	rule *rules.NetworkRule
+
+	// text is the original text of the rule.
+	text string
+
+	// limit is the maximum size of the response in bytes.
+	limit int
+
+	// truncate is true if the larger responses are truncated instead of being
+	// blocked.
+	truncate bool
+}
+
+// parseSizeRule parses text as a rule with one of the size modifiers.  ok is
+// false if text has none of them.
+func parseSizeRule(text string) (r *sizeRule, ok bool, err error) {
+	i := strings.LastIndexByte(text, '$')
+	if i < 0 {
+		return nil, false, nil
+	}
+
+	r = &sizeRule{
+		text: text,
+	}
+
+	var found bool
+	var mods []string
+	for _, m := range strings.Split(text[i+1:], ",") {
+		name, val, _ := strings.Cut(m, "=")
+		if name != maxSizeModifier && name != truncateModifier {
+			mods = append(mods, m)
+
+			continue
+		} else if found {
+			return nil, true, errors.Error("more than one size modifier")
+		}
+
+		found = true
+		r.truncate = name == truncateModifier
+		r.limit, err = strconv.Atoi(val)
+		if err != nil || r.limit <= 0 || r.limit > dns.MaxMsgSize {
+			return nil, true, fmt.Errorf("bad value of $%s: %q", name, val)
+		}
+	}
+
+	if !found {
+		return nil, false, nil
+	}
+
+	pattern := text[:i]
+	if len(mods) > 0 {
+		pattern += "$" + strings.Join(mods, ",")
+	}
+
+	r.rule, err = rules.NewNetworkRule(pattern, CustomListID)
+	if err != nil {
+		return nil, true, err
+	} else if r.rule.Whitelist {
+		return nil, true, errors.Error("size modifiers are not supported in allowlist rules")
+	}
+
+	return r, true, nil
+}
+
+// splitSizeRules separates the rules with the size modifiers from the rest of
+// userRules.  The invalid size rules are logged and dropped.
+func splitSizeRules(userRules []string) (rest []string, sizeRules []*sizeRule) {
+	rest = make([]string, 0, len(userRules))
+	for _, text := range userRules {
+		r, ok, err := parseSizeRule(text)
+		if !ok {
+			rest = append(rest, text)
+		} else if err != nil {
+			log.Error("filtering: invalid size rule %q: %s", text, err)
+		} else {
+			sizeRules = append(sizeRules, r)
+		}
+	}
+
+	return rest, sizeRules
+}
+
+// extractSizeRules returns a copy of blockFilters with the rules with the size
+// modifiers removed from the user rules and the removed rules.
+func extractSizeRules(blockFilters []Filter) (filters []Filter, sizeRules []*sizeRule) {
+	filters = slices.Clone(blockFilters)
+	for i, f := range filters {
+		if f.ID != CustomListID || len(f.Data) == 0 {
+			continue
+		}
+
+		var rest []string
+		rest, sizeRules = splitSizeRules(strings.Split(string(f.Data), "\n"))
+		filters[i].Data = []byte(strings.Join(rest, "\n"))
+	}
+
+	return filters, sizeRules
+}
+
+// CheckResponseSize checks the response of the size bytes to the request for
+// host of qtype against the rules with the size modifiers.  tooLarge is not nil
+// if the response must be blocked.  Otherwise, truncLimit is the size to
+// truncate the response to, if it's greater than zero.  udp defines if the
+// response is sent over UDP, since only those are truncated.
+func (d *DNSFilter) CheckResponseSize(
+	host string,
+	qtype uint16,
+	size int,
+	udp bool,
+	setts *Settings,
+) (tooLarge *Result, truncLimit int) {
+	if !setts.ProtectionEnabled || !setts.FilteringEnabled {
+		return nil, 0
+	}
+
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	if len(d.sizeRules) == 0 {
+		return nil, 0
+	}
+
+	req := rules.NewRequestForHostname(host)
+	req.SortedClientTags = setts.ClientTags
+	req.ClientIP = setts.ClientIP.String()
+	req.ClientName = setts.ClientName
+	req.DNSType = qtype
+
+	for _, r := range d.sizeRules {
+		if size <= r.limit || (r.truncate && !udp) || !r.rule.Match(req) {
+			continue
+		}
+
+		if !r.truncate {
+			log.Debug("filtering: response of %d bytes for %q blocked by %q", size, host, r.text)
+
+			return &Result{
+				Rules: []*ResultRule{{
+					FilterListID: CustomListID,
+					Text:         r.text,
+				}},
+				Reason:     FilteredBlockList,
+				IsFiltered: true,
+			}, 0
+		} else if truncLimit == 0 || r.limit < truncLimit {
+			truncLimit = r.limit
+		}
+	}
+
+	return nil, truncLimit
+}
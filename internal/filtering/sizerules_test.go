@@ -0,0 +1,190 @@
+package filtering
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSizeRule(t *testing.T) {
+	testCases := []struct {
+		name         string
+		in           string
+		wantErrMsg   string
+		wantLimit    int
+		wantOK       bool
+		wantTruncate bool
+	}{{
+		name:   "no_modifiers",
+		in:     "||example.org^",
+		wantOK: false,
+	}, {
+		name:   "other_modifiers",
+		in:     "||example.org^$dnstype=TXT",
+		wantOK: false,
+	}, {
+		name:      "maxsize",
+		in:        "||example.org^$maxsize=1232",
+		wantOK:    true,
+		wantLimit: 1232,
+	}, {
+		name:         "truncate",
+		in:           "||example.org^$dnstype=ANY|TXT,truncate=512,client=192.168.10.0/24",
+		wantOK:       true,
+		wantLimit:    512,
+		wantTruncate: true,
+	}, {
+		name:       "bad_value",
+		in:         "||example.org^$maxsize=big",
+		wantOK:     true,
+		wantErrMsg: `bad value of $maxsize: "big"`,
+	}, {
+		name:       "too_large",
+		in:         "||example.org^$maxsize=65536",
+		wantOK:     true,
+		wantErrMsg: `bad value of $maxsize: "65536"`,
+	}, {
+		name:       "both",
+		in:         "||example.org^$maxsize=1000,truncate=512",
+		wantOK:     true,
+		wantErrMsg: "more than one size modifier",
+	}, {
+		name:       "allowlist",
+		in:         "@@||example.org^$maxsize=1000",
+		wantOK:     true,
+		wantErrMsg: "size modifiers are not supported in allowlist rules",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, ok, err := parseSizeRule(tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantOK, ok)
+			if !ok || err != nil {
+				return
+			}
+
+			require.NotNil(t, r)
+
+			assert.Equal(t, tc.in, r.text)
+			assert.Equal(t, tc.wantLimit, r.limit)
+			assert.Equal(t, tc.wantTruncate, r.truncate)
+		})
+	}
+}
+
+func TestDNSFilter_CheckResponseSize(t *testing.T) {
+	userRules := strings.Join([]string{
+		"||example.org^",
+		"||large.example^$maxsize=1000",
+		"||*^$dnstype=ANY|TXT,truncate=512,client=192.168.10.0/24",
+	}, "\n")
+
+	d, setts := newForTest(t, nil, []Filter{{ID: CustomListID, Data: []byte(userRules)}})
+	t.Cleanup(d.Close)
+
+	require.Len(t, d.sizeRules, 2)
+
+	// The size rules must not block the requests themselves.
+	res, err := d.CheckHost("large.example", dns.TypeA, setts)
+	require.NoError(t, err)
+
+	assert.False(t, res.IsFiltered)
+
+	guestSetts := *setts
+	guestSetts.ClientIP = net.IP{192, 168, 10, 2}
+
+	testCases := []struct {
+		setts         *Settings
+		name          string
+		host          string
+		wantRule      string
+		size          int
+		wantTruncSize int
+		qtype         uint16
+		udp           bool
+	}{{
+		setts:    setts,
+		name:     "small",
+		host:     "large.example",
+		wantRule: "",
+		size:     1000,
+		qtype:    dns.TypeA,
+		udp:      true,
+	}, {
+		setts:    setts,
+		name:     "large",
+		host:     "large.example",
+		wantRule: "||large.example^$maxsize=1000",
+		size:     1001,
+		qtype:    dns.TypeA,
+		udp:      false,
+	}, {
+		setts:    setts,
+		name:     "other_host",
+		host:     "other.example",
+		wantRule: "",
+		size:     4000,
+		qtype:    dns.TypeA,
+		udp:      true,
+	}, {
+		setts:         &guestSetts,
+		name:          "guest_txt",
+		host:          "other.example",
+		wantRule:      "",
+		size:          4000,
+		wantTruncSize: 512,
+		qtype:         dns.TypeTXT,
+		udp:           true,
+	}, {
+		setts:    &guestSetts,
+		name:     "guest_txt_tcp",
+		host:     "other.example",
+		wantRule: "",
+		size:     4000,
+		qtype:    dns.TypeTXT,
+		udp:      false,
+	}, {
+		setts:    &guestSetts,
+		name:     "guest_a",
+		host:     "other.example",
+		wantRule: "",
+		size:     4000,
+		qtype:    dns.TypeA,
+		udp:      true,
+	}, {
+		setts:    setts,
+		name:     "not_guest_any",
+		host:     "other.example",
+		wantRule: "",
+		size:     4000,
+		qtype:    dns.TypeANY,
+		udp:      true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tooLarge, truncSize := d.CheckResponseSize(tc.host, tc.qtype, tc.size, tc.udp, tc.setts)
+			assert.Equal(t, tc.wantTruncSize, truncSize)
+
+			if tc.wantRule == "" {
+				assert.Nil(t, tooLarge)
+
+				return
+			}
+
+			require.NotNil(t, tooLarge)
+			require.Len(t, tooLarge.Rules, 1)
+
+			assert.True(t, tooLarge.IsFiltered)
+			assert.Equal(t, FilteredBlockList, tooLarge.Reason)
+			assert.Equal(t, tc.wantRule, tooLarge.Rules[0].Text)
+		})
+	}
+}
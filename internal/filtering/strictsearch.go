@@ -0,0 +1,91 @@
+package filtering
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/filterlist"
+)
+
+// strictSearchRules are the rules of the parental control strict search mode.
+// They enforce the DuckDuckGo safe mode and the strict image search of the
+// search engines either by rewriting their hosts to the CNAMEs of the
+// engines' restricted versions or, if there are none, to the IP addresses of
+// the family versions.
+var strictSearchRules = []string{
+	"|duckduckgo.com^$dnsrewrite=NOERROR;CNAME;safe.duckduckgo.com",
+	"|start.duckduckgo.com^$dnsrewrite=NOERROR;CNAME;safe.duckduckgo.com",
+	"|www.duckduckgo.com^$dnsrewrite=NOERROR;CNAME;safe.duckduckgo.com",
+	"|images.google.com^$dnsrewrite=NOERROR;CNAME;forcesafesearch.google.com",
+	"|www.google.com^$dnsrewrite=NOERROR;CNAME;forcesafesearch.google.com",
+	"|www.bing.com^$dnsrewrite=NOERROR;CNAME;strict.bing.com",
+	"|pixabay.com^$dnsrewrite=NOERROR;CNAME;safesearch.pixabay.com",
+	"|yandex.com^$dnsrewrite=NOERROR;A;213.180.193.56",
+	"|yandex.ru^$dnsrewrite=NOERROR;A;213.180.193.56",
+}
+
+// newStrictSearchEngine returns a new DNS engine with the strict search rules.
+func newStrictSearchEngine() (engine *urlfilter.DNSEngine, err error) {
+	rs, err := filterlist.NewRuleStorage([]filterlist.RuleList{&filterlist.StringRuleList{
+		ID:             ParentalListID,
+		RulesText:      strings.Join(strictSearchRules, "\n"),
+		IgnoreCosmetic: true,
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("creating rule storage: %w", err)
+	}
+
+	return urlfilter.NewDNSEngine(rs), nil
+}
+
+// checkStrictSearch enforces the strict search mode of the parental control
+// for host.  Matches [hostChecker.check].
+func (d *DNSFilter) checkStrictSearch(
+	host string,
+	qtype uint16,
+	setts *Settings,
+) (res Result, err error) {
+	if !setts.ProtectionEnabled || !setts.ParentalStrictSearch {
+		return Result{}, nil
+	}
+
+	dnsres, _ := d.strictSearchEngine.MatchRequest(&urlfilter.DNSRequest{
+		Hostname: host,
+		DNSType:  qtype,
+	})
+
+	dnsr := dnsres.DNSRewrites()
+	if len(dnsr) == 0 {
+		return Result{}, nil
+	}
+
+	log.Debug("filtering: strict search: rewriting %q", host)
+
+	return d.processDNSRewrites(dnsr), nil
+}
+
+// strictSearchJSON is the JSON structure for the strict search mode of the
+// parental control.
+type strictSearchJSON struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleParentalStrictSearch is the handler for the POST
+// /control/parental/strict_search HTTP API.
+func (d *DNSFilter) handleParentalStrictSearch(w http.ResponseWriter, r *http.Request) {
+	req := &strictSearchJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	setProtectedBool(&d.confLock, &d.Config.ParentalStrictSearch, req.Enabled)
+	d.Config.ConfigModified()
+}
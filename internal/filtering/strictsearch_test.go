@@ -0,0 +1,100 @@
+package filtering
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_CheckHost_strictSearch(t *testing.T) {
+	f, setts := newForTest(t, &Config{}, nil)
+	t.Cleanup(f.Close)
+
+	setts.ParentalStrictSearch = true
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantCNAME string
+		wantIP    net.IP
+		qtype     uint16
+		wantMatch bool
+	}{{
+		name:      "duckduckgo",
+		host:      "duckduckgo.com",
+		wantCNAME: "safe.duckduckgo.com",
+		wantIP:    nil,
+		qtype:     dns.TypeA,
+		wantMatch: true,
+	}, {
+		name:      "bing_images",
+		host:      "www.bing.com",
+		wantCNAME: "strict.bing.com",
+		wantIP:    nil,
+		qtype:     dns.TypeAAAA,
+		wantMatch: true,
+	}, {
+		name:      "yandex",
+		host:      "yandex.ru",
+		wantCNAME: "",
+		wantIP:    net.IPv4(213, 180, 193, 56),
+		qtype:     dns.TypeA,
+		wantMatch: true,
+	}, {
+		name:      "subdomain",
+		host:      "mail.yandex.ru",
+		wantCNAME: "",
+		wantIP:    nil,
+		qtype:     dns.TypeA,
+		wantMatch: false,
+	}, {
+		name:      "other",
+		host:      "example.org",
+		wantCNAME: "",
+		wantIP:    nil,
+		qtype:     dns.TypeA,
+		wantMatch: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := f.CheckHost(tc.host, tc.qtype, setts)
+			require.NoError(t, err)
+
+			if !tc.wantMatch {
+				assert.Equal(t, NotFilteredNotFound, res.Reason)
+
+				return
+			}
+
+			assert.Equal(t, RewrittenRule, res.Reason)
+			assert.Equal(t, tc.wantCNAME, res.CanonName)
+
+			require.Len(t, res.Rules, 1)
+
+			assert.EqualValues(t, ParentalListID, res.Rules[0].FilterListID)
+
+			if tc.wantIP != nil {
+				require.NotNil(t, res.DNSRewriteResult)
+
+				vals := res.DNSRewriteResult.Response[dns.TypeA]
+				require.Len(t, vals, 1)
+
+				assert.Equal(t, tc.wantIP, vals[0])
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		disabled := *setts
+		disabled.ParentalStrictSearch = false
+
+		res, err := f.CheckHost("duckduckgo.com", dns.TypeA, &disabled)
+		require.NoError(t, err)
+
+		assert.Equal(t, NotFilteredNotFound, res.Reason)
+	})
+}
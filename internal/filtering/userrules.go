@@ -0,0 +1,423 @@
+package filtering
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/google/renameio/maybe"
+	"golang.org/x/exp/slices"
+)
+
+// defaultRuleGroupName is the name of the group containing the user rules set
+// without groups.
+const defaultRuleGroupName = "default"
+
+// userRulesRevisionsFile is the name of the file in the data directory
+// containing the revisions of the user rule groups.
+const userRulesRevisionsFile = "user_rules_revisions.json"
+
+// UserRuleGroup is a named group of the user's filtering rules.
+type UserRuleGroup struct {
+	// Name is the unique name of the group.
+	Name string `yaml:"name" json:"name"`
+
+	// Comment is the user's description of the group.
+	Comment string `yaml:"comment" json:"comment"`
+
+	// Rules are the filtering rules of the group.
+	Rules []string `yaml:"rules" json:"rules"`
+
+	// Enabled defines if the rules of the group are applied.
+	Enabled bool `yaml:"enabled" json:"enabled"`
+}
+
+// clone returns a deep copy of g.
+func (g *UserRuleGroup) clone() (c *UserRuleGroup) {
+	return &UserRuleGroup{
+		Name:    g.Name,
+		Comment: g.Comment,
+		Rules:   slices.Clone(g.Rules),
+		Enabled: g.Enabled,
+	}
+}
+
+// cloneRuleGroups returns a deep copy of groups.
+func cloneRuleGroups(groups []*UserRuleGroup) (clone []*UserRuleGroup) {
+	if groups == nil {
+		return nil
+	}
+
+	clone = make([]*UserRuleGroup, len(groups))
+	for i, g := range groups {
+		clone[i] = g.clone()
+	}
+
+	return clone
+}
+
+// compileRuleGroups returns the rules of the enabled groups.
+func compileRuleGroups(groups []*UserRuleGroup) (compiled []string) {
+	compiled = []string{}
+	for _, g := range groups {
+		if g.Enabled {
+			compiled = append(compiled, g.Rules...)
+		}
+	}
+
+	return compiled
+}
+
+// UserRulesRevision is a saved state of the user rule groups.
+type UserRulesRevision struct {
+	// Time is the time at which the revision has been saved.
+	Time time.Time `json:"time"`
+
+	// Groups are the rule groups of the revision.
+	Groups []*UserRuleGroup `json:"groups"`
+
+	// ID is the unique identifier of the revision.  The identifiers of the
+	// later revisions are greater.
+	ID uint64 `json:"id"`
+}
+
+// ruleError is an error of a user rule group or of a single rule of it.
+type ruleError struct {
+	// Group is the name of the group.
+	Group string `json:"group"`
+
+	// Rule is the text of the invalid rule, if the error is about a rule.
+	Rule string `json:"rule,omitempty"`
+
+	// Message is the description of the error.
+	Message string `json:"message"`
+
+	// Line is the number of the invalid rule within the group starting from
+	// one, or zero if the error is about the group itself.
+	Line int `json:"line"`
+}
+
+// type check
+var _ error = (*ruleError)(nil)
+
+// Error implements the error interface for *ruleError.
+func (e *ruleError) Error() (msg string) {
+	switch {
+	case e.Line != 0:
+		return fmt.Sprintf("group %q: rule at line %d: %q: %s", e.Group, e.Line, e.Rule, e.Message)
+	case e.Group != "":
+		return fmt.Sprintf("group %q: %s", e.Group, e.Message)
+	default:
+		return e.Message
+	}
+}
+
+// ValidateUserRules returns the errors of the user rules, if any.  If groups
+// isn't nil, the rules are compiled from them, so they're validated instead of
+// rules.
+func ValidateUserRules(rules []string, groups []*UserRuleGroup) (errs []error) {
+	if groups == nil {
+		groups = []*UserRuleGroup{{Name: defaultRuleGroupName, Rules: rules}}
+	}
+
+	for _, e := range validateRuleGroups(groups) {
+		errs = append(errs, e)
+	}
+
+	return errs
+}
+
+// validateRuleGroups returns the errors of groups and their rules, if any.
+func validateRuleGroups(groups []*UserRuleGroup) (errs []*ruleError) {
+	names := stringutil.NewSet()
+	for i, g := range groups {
+		if g == nil {
+			errs = append(errs, &ruleError{
+				Message: fmt.Sprintf("group at index %d is null", i),
+			})
+
+			continue
+		}
+
+		if g.Name == "" {
+			errs = append(errs, &ruleError{
+				Message: fmt.Sprintf("group at index %d: empty name", i),
+			})
+		} else if names.Has(g.Name) {
+			errs = append(errs, &ruleError{
+				Group:   g.Name,
+				Message: "duplicated name",
+			})
+		}
+
+		names.Add(g.Name)
+
+		for j, text := range g.Rules {
+			err := validateRule(text)
+			if err != nil {
+				errs = append(errs, &ruleError{
+					Group:   g.Name,
+					Rule:    text,
+					Message: err.Error(),
+					Line:    j + 1,
+				})
+			}
+		}
+	}
+
+	return errs
+}
+
+// validateRule returns an error if text isn't a comment, an empty line, or a
+// valid DNS filtering rule.
+func validateRule(text string) (err error) {
+	if strings.ContainsAny(text, "\r\n") {
+		return errors.Error("rule must be a single line")
+	}
+
+	if _, ok, sizeErr := parseSizeRule(text); ok {
+		return sizeErr
+	}
+
+	r, err := rules.NewRule(text, CustomListID)
+	if err != nil {
+		return err
+	}
+
+	switch r := r.(type) {
+	case *rules.CosmeticRule:
+		return errors.Error("cosmetic rules are not supported")
+	case *rules.NetworkRule:
+		// The DNS filtering engine silently ignores the rules with the
+		// modifiers which only make sense for the browsers, such as $domain or
+		// $third-party.
+		if !r.IsHostLevelNetworkRule() {
+			return errors.Error("modifiers are not supported by dns filtering")
+		}
+	}
+
+	return nil
+}
+
+// ruleGroupsLocked returns the current rule groups.  If the user rules have
+// been set without groups, they are returned as a single default group.
+// d.filtersMu is expected to be locked.
+func (d *DNSFilter) ruleGroupsLocked() (groups []*UserRuleGroup) {
+	if d.UserRuleGroups != nil {
+		return d.UserRuleGroups
+	}
+
+	if len(d.UserRules) == 0 {
+		return []*UserRuleGroup{}
+	}
+
+	return []*UserRuleGroup{{
+		Name:    defaultRuleGroupName,
+		Rules:   d.UserRules,
+		Enabled: true,
+	}}
+}
+
+// setRuleGroupsLocked replaces the rule groups and the user rules with the
+// ones compiled from groups and saves them as a new revision.  d.filtersMu is
+// expected to be locked.
+func (d *DNSFilter) setRuleGroupsLocked(groups []*UserRuleGroup) {
+	d.UserRuleGroups = groups
+	d.UserRules = compileRuleGroups(groups)
+
+	d.addRuleRevisionLocked(groups)
+}
+
+// addRuleRevisionLocked saves groups as a new revision, removing the oldest
+// ones if there are more than configured.  d.filtersMu is expected to be
+// locked.
+func (d *DNSFilter) addRuleRevisionLocked(groups []*UserRuleGroup) {
+	limit := int(d.UserRulesRevisionsLimit)
+	if limit == 0 {
+		d.ruleRevisions = nil
+
+		return
+	}
+
+	var id uint64 = 1
+	if l := len(d.ruleRevisions); l > 0 {
+		id = d.ruleRevisions[l-1].ID + 1
+	}
+
+	d.ruleRevisions = append(d.ruleRevisions, &UserRulesRevision{
+		Time:   time.Now(),
+		Groups: cloneRuleGroups(groups),
+		ID:     id,
+	})
+	if l := len(d.ruleRevisions); l > limit {
+		d.ruleRevisions = slices.Delete(d.ruleRevisions, 0, l-limit)
+	}
+
+	err := d.writeRuleRevisionsLocked()
+	if err != nil {
+		log.Error("filtering: writing user rules revisions: %s", err)
+	}
+}
+
+// findRuleRevisionLocked returns the revision with id or nil if there is none.
+// d.filtersMu is expected to be locked.
+func (d *DNSFilter) findRuleRevisionLocked(id uint64) (rev *UserRulesRevision) {
+	for _, rev = range d.ruleRevisions {
+		if rev.ID == id {
+			return rev
+		}
+	}
+
+	return nil
+}
+
+// ruleRevisionsPath returns the path to the file with the revisions of the
+// user rule groups, or an empty string if the data directory isn't set.
+func (d *DNSFilter) ruleRevisionsPath() (p string) {
+	if d.DataDir == "" {
+		return ""
+	}
+
+	return filepath.Join(d.DataDir, userRulesRevisionsFile)
+}
+
+// readRuleRevisions reads the revisions of the user rule groups from the data
+// directory, if any.
+func (d *DNSFilter) readRuleRevisions() (err error) {
+	p := d.ruleRevisionsPath()
+	if p == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading revisions: %w", err)
+	}
+
+	var revs []*UserRulesRevision
+	err = json.Unmarshal(data, &revs)
+	if err != nil {
+		return fmt.Errorf("decoding revisions: %w", err)
+	}
+
+	d.ruleRevisions = revs
+
+	return nil
+}
+
+// writeRuleRevisionsLocked writes the revisions of the user rule groups into
+// the data directory.  d.filtersMu is expected to be locked.
+func (d *DNSFilter) writeRuleRevisionsLocked() (err error) {
+	p := d.ruleRevisionsPath()
+	if p == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(d.ruleRevisions)
+	if err != nil {
+		return fmt.Errorf("encoding revisions: %w", err)
+	}
+
+	return maybe.WriteFile(p, data, 0o644)
+}
+
+// ruleGroupDiff is the difference between two states of a user rule group.
+type ruleGroupDiff struct {
+	// Enabled is the new state of the group, if it has changed.
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// Group is the name of the group.
+	Group string `json:"group"`
+
+	// Added are the rules which are only present in the new state.
+	Added []string `json:"added"`
+
+	// Removed are the rules which are only present in the old state.
+	Removed []string `json:"removed"`
+}
+
+// diffRuleGroups returns the differences between the groups with the same
+// names in from and to.  The groups missing from one of them are considered
+// empty and disabled there.  The groups without changes are omitted.
+func diffRuleGroups(from, to []*UserRuleGroup) (diffs []*ruleGroupDiff) {
+	diffs = []*ruleGroupDiff{}
+
+	old := make(map[string]*UserRuleGroup, len(from))
+	for _, g := range from {
+		old[g.Name] = g
+	}
+
+	empty := &UserRuleGroup{}
+	for _, g := range to {
+		o, ok := old[g.Name]
+		if !ok {
+			o = empty
+		}
+
+		delete(old, g.Name)
+		if diff := diffRuleGroup(g.Name, o, g); diff != nil {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	// Keep the order of the removed groups.
+	for _, g := range from {
+		if _, ok := old[g.Name]; ok {
+			diffs = append(diffs, diffRuleGroup(g.Name, g, empty))
+		}
+	}
+
+	return diffs
+}
+
+// diffRuleGroup returns the difference between the states from and to of the
+// group with name, or nil if there is none.
+func diffRuleGroup(name string, from, to *UserRuleGroup) (diff *ruleGroupDiff) {
+	diff = &ruleGroupDiff{
+		Group:   name,
+		Added:   subtractRules(to.Rules, from.Rules),
+		Removed: subtractRules(from.Rules, to.Rules),
+	}
+
+	if from.Enabled != to.Enabled {
+		enabled := to.Enabled
+		diff.Enabled = &enabled
+	}
+
+	if diff.Enabled == nil && len(diff.Added) == 0 && len(diff.Removed) == 0 {
+		return nil
+	}
+
+	return diff
+}
+
+// subtractRules returns the rules of a which aren't in b, keeping their order.
+// The duplicated rules are counted separately.
+func subtractRules(a, b []string) (diff []string) {
+	counts := make(map[string]int, len(b))
+	for _, r := range b {
+		counts[r]++
+	}
+
+	diff = []string{}
+	for _, r := range a {
+		if counts[r] > 0 {
+			counts[r]--
+
+			continue
+		}
+
+		diff = append(diff, r)
+	}
+
+	return diff
+}
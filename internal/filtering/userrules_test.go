@@ -0,0 +1,275 @@
+package filtering
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRuleGroups(t *testing.T) {
+	testCases := []struct {
+		name     string
+		groups   []*UserRuleGroup
+		wantErrs []*ruleError
+	}{{
+		name: "valid",
+		groups: []*UserRuleGroup{{
+			Name: "ads",
+			Rules: []string{
+				"! comment",
+				"",
+				"||example.org^",
+				"127.0.0.1 host.example",
+				"||example.com^$dnstype=AAAA",
+				"||example.net^$client='Kids-iPad'",
+				"||example.info^$denyallow=allowed.example.info",
+			},
+		}},
+		wantErrs: nil,
+	}, {
+		name:   "empty_name",
+		groups: []*UserRuleGroup{{}},
+		wantErrs: []*ruleError{{
+			Message: "group at index 0: empty name",
+		}},
+	}, {
+		name:   "duplicated_name",
+		groups: []*UserRuleGroup{{Name: "ads"}, {Name: "ads"}},
+		wantErrs: []*ruleError{{
+			Group:   "ads",
+			Message: "duplicated name",
+		}},
+	}, {
+		name: "bad_rules",
+		groups: []*UserRuleGroup{{
+			Name:  "ads",
+			Rules: []string{"||example.org^", "||example.com^$badmodifier", "example.net##.banner"},
+		}},
+		wantErrs: []*ruleError{{
+			Group:   "ads",
+			Rule:    "||example.com^$badmodifier",
+			Message: "unknown filter modifier: badmodifier=",
+			Line:    2,
+		}, {
+			Group:   "ads",
+			Rule:    "example.net##.banner",
+			Message: "cosmetic rules are not supported",
+			Line:    3,
+		}},
+	}, {
+		name: "browser_modifiers",
+		groups: []*UserRuleGroup{{
+			Name:  "ads",
+			Rules: []string{"||example.org^$domain=example.com", "||example.net^$third-party"},
+		}},
+		wantErrs: []*ruleError{{
+			Group:   "ads",
+			Rule:    "||example.org^$domain=example.com",
+			Message: "modifiers are not supported by dns filtering",
+			Line:    1,
+		}, {
+			Group:   "ads",
+			Rule:    "||example.net^$third-party",
+			Message: "modifiers are not supported by dns filtering",
+			Line:    2,
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := validateRuleGroups(tc.groups)
+			require.Len(t, errs, len(tc.wantErrs))
+
+			for i, want := range tc.wantErrs {
+				assert.Equal(t, *want, *errs[i])
+			}
+		})
+	}
+}
+
+func TestDiffRuleGroups(t *testing.T) {
+	from := []*UserRuleGroup{{
+		Name:    "ads",
+		Rules:   []string{"||a.example^", "||b.example^"},
+		Enabled: true,
+	}, {
+		Name:    "old",
+		Rules:   []string{"||old.example^"},
+		Enabled: true,
+	}, {
+		Name:    "same",
+		Rules:   []string{"||same.example^"},
+		Enabled: true,
+	}}
+
+	to := []*UserRuleGroup{{
+		Name:    "ads",
+		Rules:   []string{"||b.example^", "||c.example^"},
+		Enabled: false,
+	}, {
+		Name:    "same",
+		Rules:   []string{"||same.example^"},
+		Enabled: true,
+	}, {
+		Name:    "new",
+		Rules:   []string{"||new.example^"},
+		Enabled: true,
+	}}
+
+	disabled, enabled := false, true
+	assert.Equal(t, []*ruleGroupDiff{{
+		Enabled: &disabled,
+		Group:   "ads",
+		Added:   []string{"||c.example^"},
+		Removed: []string{"||a.example^"},
+	}, {
+		Enabled: &enabled,
+		Group:   "new",
+		Added:   []string{"||new.example^"},
+		Removed: []string{},
+	}, {
+		Enabled: &disabled,
+		Group:   "old",
+		Added:   []string{},
+		Removed: []string{"||old.example^"},
+	}}, diffRuleGroups(from, to))
+}
+
+func TestDNSFilter_setRuleGroupsLocked(t *testing.T) {
+	dataDir := t.TempDir()
+	conf := &Config{
+		UserRules:               []string{"||legacy.example^"},
+		UserRulesRevisionsLimit: 2,
+		DataDir:                 dataDir,
+	}
+
+	d, _ := newForTest(t, conf, nil)
+	t.Cleanup(d.Close)
+
+	groups := d.ruleGroupsLocked()
+	require.Len(t, groups, 1)
+
+	assert.Equal(t, defaultRuleGroupName, groups[0].Name)
+	assert.Equal(t, []string{"||legacy.example^"}, groups[0].Rules)
+
+	for _, rule := range []string{"||1.example^", "||2.example^", "||3.example^"} {
+		d.setRuleGroupsLocked([]*UserRuleGroup{{
+			Name:    "ads",
+			Rules:   []string{rule},
+			Enabled: true,
+		}, {
+			Name:    "disabled",
+			Rules:   []string{"||disabled.example^"},
+			Enabled: false,
+		}})
+	}
+
+	assert.Equal(t, []string{"||3.example^"}, d.UserRules)
+
+	require.Len(t, d.ruleRevisions, 2)
+
+	assert.Equal(t, uint64(2), d.ruleRevisions[0].ID)
+	assert.Equal(t, uint64(3), d.ruleRevisions[1].ID)
+	assert.Nil(t, d.findRuleRevisionLocked(1))
+
+	// Make sure the revisions are read back.
+	conf.UserRuleGroups = d.UserRuleGroups
+	restarted, _ := newForTest(t, conf, nil)
+	t.Cleanup(restarted.Close)
+
+	require.Len(t, restarted.ruleRevisions, 2)
+
+	assert.Equal(t, uint64(3), restarted.ruleRevisions[1].ID)
+	assert.Equal(t, []string{"||3.example^"}, restarted.UserRules)
+}
+
+func TestDNSFilter_handleRuleGroupsSet(t *testing.T) {
+	confModifiedCalled := false
+	d, _ := newForTest(t, &Config{
+		ConfigModified:          func() { confModifiedCalled = true },
+		UserRulesRevisionsLimit: 10,
+	}, nil)
+	t.Cleanup(d.Close)
+
+	d.Start()
+
+	set := func(t *testing.T, groups []*UserRuleGroup) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		data, err := json.Marshal(&ruleGroupsJSON{Groups: groups})
+		require.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodPost, "http://example.org", bytes.NewReader(data))
+		w = httptest.NewRecorder()
+		d.handleRuleGroupsSet(w, r)
+
+		return w
+	}
+
+	w := set(t, []*UserRuleGroup{{
+		Name:    "ads",
+		Rules:   []string{"||example.org^$badmodifier"},
+		Enabled: true,
+	}})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	resp := &ruleErrorsJSON{}
+	err := json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+	require.Len(t, resp.Errors, 1)
+
+	assert.Equal(t, 1, resp.Errors[0].Line)
+	assert.False(t, confModifiedCalled)
+
+	w = set(t, []*UserRuleGroup{{
+		Name:    "ads",
+		Rules:   []string{"||example.org^"},
+		Enabled: true,
+	}})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.True(t, confModifiedCalled)
+	assert.Equal(t, []string{"||example.org^"}, d.UserRules)
+
+	w = set(t, []*UserRuleGroup{})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Empty(t, d.UserRules)
+
+	t.Run("rollback", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "http://example.org", bytes.NewReader([]byte(`{"id":1}`)))
+		w = httptest.NewRecorder()
+		d.handleRuleGroupsRollback(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, []string{"||example.org^"}, d.UserRules)
+		assert.Len(t, d.ruleRevisions, 3)
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://example.org?from=1&to=2", nil)
+		w = httptest.NewRecorder()
+		d.handleRuleGroupsDiff(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		diff := &ruleDiffJSON{}
+		err = json.NewDecoder(w.Body).Decode(diff)
+		require.NoError(t, err)
+		require.Len(t, diff.Groups, 1)
+
+		assert.Equal(t, []string{"||example.org^"}, diff.Groups[0].Removed)
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://example.org?from=100", nil)
+		w = httptest.NewRecorder()
+		d.handleRuleGroupsDiff(w, r)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,239 @@
+package filtering
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ruleGroupsJSON is the response to the GET /control/filtering/rule_groups
+// HTTP API and the request to the POST /control/filtering/rule_groups/set one.
+type ruleGroupsJSON struct {
+	// Groups are the user rule groups.
+	Groups []*UserRuleGroup `json:"groups"`
+
+	// Revision is the identifier of the latest revision, or zero if there are
+	// none.  It's ignored in requests.
+	Revision uint64 `json:"revision"`
+}
+
+// handleRuleGroups is the handler for the GET /control/filtering/rule_groups
+// HTTP API.
+func (d *DNSFilter) handleRuleGroups(w http.ResponseWriter, r *http.Request) {
+	resp := &ruleGroupsJSON{}
+	func() {
+		d.filtersMu.RLock()
+		defer d.filtersMu.RUnlock()
+
+		resp.Groups = cloneRuleGroups(d.ruleGroupsLocked())
+		if l := len(d.ruleRevisions); l > 0 {
+			resp.Revision = d.ruleRevisions[l-1].ID
+		}
+	}()
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// ruleErrorsJSON is the response to the requests with invalid rule groups.
+type ruleErrorsJSON struct {
+	// Errors are the errors of the groups and the rules.
+	Errors []*ruleError `json:"errors"`
+}
+
+// handleRuleGroupsSet is the handler for the POST
+// /control/filtering/rule_groups/set HTTP API.
+func (d *DNSFilter) handleRuleGroupsSet(w http.ResponseWriter, r *http.Request) {
+	req := &ruleGroupsJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "reading req: %s", err)
+
+		return
+	}
+
+	if errs := validateRuleGroups(req.Groups); len(errs) > 0 {
+		_ = aghhttp.WriteJSONResponseCode(w, r, http.StatusBadRequest, &ruleErrorsJSON{
+			Errors: errs,
+		})
+
+		return
+	}
+
+	if req.Groups == nil {
+		req.Groups = []*UserRuleGroup{}
+	}
+
+	for _, g := range req.Groups {
+		rulesToASCII(g.Rules)
+	}
+
+	func() {
+		d.filtersMu.Lock()
+		defer d.filtersMu.Unlock()
+
+		d.setRuleGroupsLocked(req.Groups)
+	}()
+
+	d.ConfigModified()
+	d.EnableFilters(true)
+}
+
+// ruleRevisionJSON is the summary of a revision of the user rule groups.
+type ruleRevisionJSON struct {
+	// Time is the time at which the revision has been saved.
+	Time time.Time `json:"time"`
+
+	// ID is the identifier of the revision.
+	ID uint64 `json:"id"`
+
+	// GroupsCount is the number of the groups in the revision.
+	GroupsCount int `json:"groups_count"`
+
+	// RulesCount is the number of the rules in the enabled groups.
+	RulesCount int `json:"rules_count"`
+}
+
+// ruleRevisionsJSON is the response to the GET
+// /control/filtering/rule_groups/revisions HTTP API.
+type ruleRevisionsJSON struct {
+	// Revisions are the saved revisions, the latest first.
+	Revisions []*ruleRevisionJSON `json:"revisions"`
+}
+
+// handleRuleGroupsRevisions is the handler for the GET
+// /control/filtering/rule_groups/revisions HTTP API.
+func (d *DNSFilter) handleRuleGroupsRevisions(w http.ResponseWriter, r *http.Request) {
+	d.filtersMu.RLock()
+	resp := &ruleRevisionsJSON{
+		Revisions: make([]*ruleRevisionJSON, 0, len(d.ruleRevisions)),
+	}
+	for i := len(d.ruleRevisions) - 1; i >= 0; i-- {
+		rev := d.ruleRevisions[i]
+		resp.Revisions = append(resp.Revisions, &ruleRevisionJSON{
+			Time:        rev.Time,
+			ID:          rev.ID,
+			GroupsCount: len(rev.Groups),
+			RulesCount:  len(compileRuleGroups(rev.Groups)),
+		})
+	}
+	d.filtersMu.RUnlock()
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// ruleDiffJSON is the response to the GET /control/filtering/rule_groups/diff
+// HTTP API.
+type ruleDiffJSON struct {
+	// Groups are the differences of the changed groups.
+	Groups []*ruleGroupDiff `json:"groups"`
+}
+
+// parseRevisionID parses the revision identifier from the URL query parameter
+// with name.  ok is false if the response has already been written.
+func parseRevisionID(
+	w http.ResponseWriter,
+	r *http.Request,
+	name string,
+) (id uint64, ok bool) {
+	id, err := strconv.ParseUint(r.URL.Query().Get(name), 10, 64)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing %s: %s", name, err)
+
+		return 0, false
+	}
+
+	return id, true
+}
+
+// handleRuleGroupsDiff is the handler for the GET
+// /control/filtering/rule_groups/diff HTTP API.  The from query parameter is
+// the identifier of the old revision, and the optional to parameter is the one
+// of the new revision; the current groups are used if it's absent.
+func (d *DNSFilter) handleRuleGroupsDiff(w http.ResponseWriter, r *http.Request) {
+	fromID, ok := parseRevisionID(w, r, "from")
+	if !ok {
+		return
+	}
+
+	var toID uint64
+	if r.URL.Query().Has("to") {
+		toID, ok = parseRevisionID(w, r, "to")
+		if !ok {
+			return
+		}
+	}
+
+	d.filtersMu.RLock()
+	defer d.filtersMu.RUnlock()
+
+	from := d.findRuleRevisionLocked(fromID)
+	if from == nil {
+		aghhttp.Error(r, w, http.StatusNotFound, "revision %d not found", fromID)
+
+		return
+	}
+
+	to := d.ruleGroupsLocked()
+	if toID != 0 {
+		toRev := d.findRuleRevisionLocked(toID)
+		if toRev == nil {
+			aghhttp.Error(r, w, http.StatusNotFound, "revision %d not found", toID)
+
+			return
+		}
+
+		to = toRev.Groups
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, &ruleDiffJSON{
+		Groups: diffRuleGroups(from.Groups, to),
+	})
+}
+
+// ruleRollbackReq is the request to the POST
+// /control/filtering/rule_groups/rollback HTTP API.
+type ruleRollbackReq struct {
+	// ID is the identifier of the revision to roll back to.
+	ID uint64 `json:"id"`
+}
+
+// handleRuleGroupsRollback is the handler for the POST
+// /control/filtering/rule_groups/rollback HTTP API.  The rollback is saved as
+// a new revision.
+func (d *DNSFilter) handleRuleGroupsRollback(w http.ResponseWriter, r *http.Request) {
+	req := &ruleRollbackReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "reading req: %s", err)
+
+		return
+	}
+
+	found := func() (ok bool) {
+		d.filtersMu.Lock()
+		defer d.filtersMu.Unlock()
+
+		rev := d.findRuleRevisionLocked(req.ID)
+		if rev == nil {
+			return false
+		}
+
+		d.setRuleGroupsLocked(cloneRuleGroups(rev.Groups))
+
+		return true
+	}()
+	if !found {
+		aghhttp.Error(r, w, http.StatusNotFound, "revision %d not found", req.ID)
+
+		return
+	}
+
+	log.Info("filtering: rolled back user rules to revision %d", req.ID)
+
+	d.ConfigModified()
+	d.EnableFilters(true)
+}
@@ -0,0 +1,457 @@
+package home
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// alertsConfig is the configuration of the alerts about the queries of the
+// clients.
+type alertsConfig struct {
+	// WebhookURL is the URL to which the alerts are sent with POST requests.
+	// If it's empty, the alerts aren't sent to a webhook.
+	WebhookURL string `yaml:"webhook_url"`
+
+	// Rules are the rules the queries are checked against.  The alerts are
+	// always logged.
+	Rules []*alertRule `yaml:"rules"`
+}
+
+// alertRuleType is the type of an alert rule.
+type alertRuleType string
+
+// Alert rule types.
+const (
+	// alertRuleDomain alerts when a domain name matching the pattern of the
+	// rule is queried.
+	alertRuleDomain alertRuleType = "domain"
+
+	// alertRuleUniqueDomains alerts when a client queries more unique domain
+	// names than the threshold of the rule within its window.
+	alertRuleUniqueDomains alertRuleType = "unique_domains"
+)
+
+// defaultAlertWindow is the default window of the alert rules.
+const defaultAlertWindow = 1 * time.Hour
+
+// alertRule is a user-defined alert rule.
+type alertRule struct {
+	// Name is the unique name of the rule.
+	Name string `yaml:"name"`
+
+	// Type is the type of the rule.
+	Type alertRuleType `yaml:"type"`
+
+	// Pattern is the pattern of the domain names for [alertRuleDomain], for
+	// example "*.dyndns.*".  The syntax is the one of [path.Match].
+	Pattern string `yaml:"pattern"`
+
+	// Threshold is the number of the unique domain names for
+	// [alertRuleUniqueDomains].
+	Threshold uint32 `yaml:"threshold"`
+
+	// Window is the period within which the unique domain names are counted
+	// for [alertRuleUniqueDomains].  A client only triggers each rule once per
+	// window.  Zero means [defaultAlertWindow].
+	Window timeutil.Duration `yaml:"window"`
+}
+
+// validate returns an error if r is invalid.
+func (r *alertRule) validate() (err error) {
+	if r.Window.Duration < 0 {
+		return errors.Error("window: negative value")
+	}
+
+	switch r.Type {
+	case alertRuleDomain:
+		if r.Pattern == "" {
+			return errors.Error("pattern: empty")
+		}
+
+		_, err = path.Match(r.Pattern, "")
+		if err != nil {
+			return fmt.Errorf("pattern: %w", err)
+		}
+	case alertRuleUniqueDomains:
+		if r.Threshold == 0 {
+			return errors.Error("threshold: must be positive")
+		}
+	default:
+		return fmt.Errorf("type: bad value %q", r.Type)
+	}
+
+	return nil
+}
+
+// validate returns the errors of c, if any.
+func (c *alertsConfig) validate() (errs []error) {
+	if c.WebhookURL != "" {
+		u, err := url.Parse(c.WebhookURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("webhook_url: %w", err))
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			errs = append(errs, fmt.Errorf("webhook_url: bad scheme %q", u.Scheme))
+		}
+	}
+
+	names := stringutil.NewSet()
+	for i, r := range c.Rules {
+		if r == nil {
+			errs = append(errs, fmt.Errorf("rule at index %d: empty", i))
+
+			continue
+		} else if r.Name == "" {
+			errs = append(errs, fmt.Errorf("rule at index %d: name: empty", i))
+
+			continue
+		} else if err := validateHeaderValue(r.Name); err != nil {
+			errs = append(errs, fmt.Errorf("rule at index %d: name: %w", i, err))
+
+			continue
+		} else if names.Has(r.Name) {
+			errs = append(errs, fmt.Errorf("rule %q: name: duplicated", r.Name))
+
+			continue
+		}
+
+		names.Add(r.Name)
+
+		err := r.validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %q: %w", r.Name, err))
+		}
+	}
+
+	return errs
+}
+
+// alert is a triggered alert.
+type alert struct {
+	// Time is the time the alert has been triggered at.
+	Time time.Time `json:"time"`
+
+	// Rule is the name of the triggered rule.
+	Rule string `json:"rule"`
+
+	// Type is the type of the triggered rule.
+	Type alertRuleType `json:"type"`
+
+	// Client is the ID or the IP address of the client which triggered the
+	// alert.
+	Client string `json:"client"`
+
+	// Domain is the queried domain name which triggered the alert.
+	Domain string `json:"domain"`
+
+	// Message is the human-readable description of the alert.
+	Message string `json:"message"`
+}
+
+// alertQueueSize is the maximum number of the alerts waiting for the delivery.
+// The alerts triggered while the queue is full are dropped.
+const alertQueueSize = 100
+
+// alertDeliveryTimeout is the timeout for delivering a single alert to the
+// webhook.
+const alertDeliveryTimeout = 30 * time.Second
+
+// alertRuleState is the state of an alert rule within its current window.
+type alertRuleState struct {
+	// rule is the rule itself.
+	rule *alertRule
+
+	// windowStart is the start of the current window.
+	windowStart time.Time
+
+	// domains are the unique domain names queried by the clients within the
+	// current window.  It's only used for [alertRuleUniqueDomains].
+	domains map[string]*stringutil.Set
+
+	// alerted are the clients which have already triggered the rule within
+	// the current window.
+	alerted *stringutil.Set
+
+	// window is the duration of the window.
+	window time.Duration
+}
+
+// reset starts a new window of s at now.
+func (s *alertRuleState) reset(now time.Time) {
+	s.windowStart = now
+	s.domains = map[string]*stringutil.Set{}
+	s.alerted = stringutil.NewSet()
+}
+
+// observe checks the query for domain from client against the rule at now.  It
+// returns the alert if the rule is triggered.
+func (s *alertRuleState) observe(client, domain string, now time.Time) (a *alert) {
+	if now.Sub(s.windowStart) >= s.window {
+		s.reset(now)
+	}
+
+	if s.alerted.Has(client) {
+		return nil
+	}
+
+	r := s.rule
+	var msg string
+	switch r.Type {
+	case alertRuleDomain:
+		if ok, _ := path.Match(r.Pattern, domain); !ok {
+			return nil
+		}
+
+		msg = fmt.Sprintf("client %s queried %s matching %q", client, domain, r.Pattern)
+	case alertRuleUniqueDomains:
+		set, ok := s.domains[client]
+		if !ok {
+			set = stringutil.NewSet()
+			s.domains[client] = set
+		}
+
+		set.Add(domain)
+		if set.Len() <= int(r.Threshold) {
+			return nil
+		}
+
+		delete(s.domains, client)
+		msg = fmt.Sprintf(
+			"client %s queried more than %d unique domains within %s",
+			client,
+			r.Threshold,
+			timeutil.Duration{Duration: s.window},
+		)
+	default:
+		return nil
+	}
+
+	s.alerted.Add(client)
+
+	return &alert{
+		Time:    now,
+		Rule:    r.Name,
+		Type:    r.Type,
+		Client:  client,
+		Domain:  domain,
+		Message: msg,
+	}
+}
+
+// alerter checks the queries from the statistics against the alert rules and
+// delivers the triggered alerts.  A nil *alerter is valid and does nothing.
+type alerter struct {
+	// deliver delivers a single alert according to conf.
+	deliver func(conf *alertsConfig, a *alert) (err error)
+
+	// queue are the alerts waiting for the delivery.
+	queue chan *alert
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// conf is the current configuration.
+	conf *alertsConfig
+
+	// states are the states of the rules from conf.
+	states []*alertRuleState
+}
+
+// newAlerter returns a new properly initialized *alerter.  client is used for
+// the webhook requests and n sends the email notifications.  conf must be
+// valid.
+func newAlerter(conf alertsConfig, client *http.Client, n *notifier) (a *alerter) {
+	a = &alerter{
+		queue: make(chan *alert, alertQueueSize),
+		mu:    &sync.Mutex{},
+	}
+
+	a.deliver = func(c *alertsConfig, al *alert) (err error) {
+		return deliverAlert(c, al, client, n)
+	}
+
+	a.setConfig(conf)
+
+	return a
+}
+
+// setConfig replaces the configuration of a and resets the states of the
+// rules.  conf must be valid.
+func (a *alerter) setConfig(conf alertsConfig) {
+	if a == nil {
+		return
+	}
+
+	now := time.Now()
+	states := make([]*alertRuleState, 0, len(conf.Rules))
+	for _, r := range conf.Rules {
+		s := &alertRuleState{
+			rule: r,
+		}
+
+		if r.Window.Duration > 0 {
+			s.window = r.Window.Duration
+		} else {
+			s.window = defaultAlertWindow
+		}
+
+		s.reset(now)
+		states = append(states, s)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.conf, a.states = &conf, states
+}
+
+// observe checks the statistics entry e against the rules of a at now and
+// queues the triggered alerts.
+func (a *alerter) observe(e *stats.Entry, now time.Time) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, s := range a.states {
+		al := s.observe(e.Client, e.Domain, now)
+		if al == nil {
+			continue
+		}
+
+		select {
+		case a.queue <- al:
+			// Go on.
+		default:
+			log.Error("alerts: queue is full, dropping alert of rule %q", al.Rule)
+		}
+	}
+}
+
+// start starts delivering the alerts in a separate goroutine.
+func (a *alerter) start() {
+	go func() {
+		defer log.OnPanic("alerts")
+
+		for al := range a.queue {
+			log.Info("alerts: rule %q: %s", al.Rule, al.Message)
+
+			a.mu.Lock()
+			conf := a.conf
+			a.mu.Unlock()
+
+			err := a.deliver(conf, al)
+			if err != nil {
+				log.Error("alerts: rule %q: %s", al.Rule, err)
+			}
+		}
+	}()
+}
+
+// deliverAlert sends a to the webhook according to conf, if configured, and by
+// email using n, if enabled.  client is used for the webhook requests.
+func deliverAlert(
+	conf *alertsConfig,
+	a *alert,
+	client *http.Client,
+	n *notifier,
+) (err error) {
+	var errs []error
+	if conf.WebhookURL != "" {
+		err = sendAlertWebhook(conf.WebhookURL, a, client)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("webhook: %w", err))
+		}
+	}
+
+	err = n.notify(notifyAlerts, "AdGuard Home alert: "+a.Rule, a.Message)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("email: %w", err))
+	}
+
+	if len(errs) > 0 {
+		return errors.List("sending alert", errs...)
+	}
+
+	return nil
+}
+
+// sendAlertWebhook sends a to the webhook at u.
+func sendAlertWebhook(u string, a *alert, client *http.Client) (err error) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), alertDeliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set(aghhttp.HdrNameContentType, aghhttp.HdrValApplicationJSON)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("got status code %d, want 2xx", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// alertingStats is a [stats.Interface] which checks the entries against the
+// alert rules before collecting them.
+type alertingStats struct {
+	stats.Interface
+
+	// alerts checks the entries.
+	alerts *alerter
+}
+
+// type check
+var _ stats.Interface = (*alertingStats)(nil)
+
+// Update implements the [stats.Interface] interface for *alertingStats.
+func (s *alertingStats) Update(e stats.Entry) {
+	s.alerts.observe(&e, time.Now())
+	s.Interface.Update(e)
+}
+
+// initAlerts initializes and starts [Context.alerts].
+func initAlerts() (err error) {
+	conf := config.Alerts
+
+	errs := conf.validate()
+	if len(errs) > 0 {
+		return errors.List("alerts", errs...)
+	}
+
+	Context.alerts = newAlerter(conf, Context.client, Context.notifier)
+	Context.alerts.start()
+
+	return nil
+}
@@ -0,0 +1,218 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlertsConfig_validate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		conf       *alertsConfig
+		wantErrMsg string
+	}{{
+		name:       "empty",
+		conf:       &alertsConfig{},
+		wantErrMsg: "",
+	}, {
+		name: "valid",
+		conf: &alertsConfig{
+			WebhookURL: "https://hooks.example/alerts",
+			Rules: []*alertRule{{
+				Name:      "many_domains",
+				Type:      alertRuleUniqueDomains,
+				Threshold: 500,
+			}, {
+				Name:    "dyndns",
+				Type:    alertRuleDomain,
+				Pattern: "*.dyndns.*",
+			}},
+		},
+		wantErrMsg: "",
+	}, {
+		name:       "bad_webhook",
+		conf:       &alertsConfig{WebhookURL: "ftp://hooks.example"},
+		wantErrMsg: `webhook_url: bad scheme "ftp"`,
+	}, {
+		name: "duplicated_name",
+		conf: &alertsConfig{
+			Rules: []*alertRule{{
+				Name:    "dyndns",
+				Type:    alertRuleDomain,
+				Pattern: "*.dyndns.*",
+			}, {
+				Name:    "dyndns",
+				Type:    alertRuleDomain,
+				Pattern: "*.dyndns.*",
+			}},
+		},
+		wantErrMsg: `rule "dyndns": name: duplicated`,
+	}, {
+		name: "bad_name",
+		conf: &alertsConfig{
+			Rules: []*alertRule{{
+				Name:    "dyndns\r\nBcc: evil@example.org",
+				Type:    alertRuleDomain,
+				Pattern: "*.dyndns.*",
+			}},
+		},
+		wantErrMsg: "rule at index 0: name: contains line breaks",
+	}, {
+		name: "bad_pattern",
+		conf: &alertsConfig{
+			Rules: []*alertRule{{
+				Name:    "bad",
+				Type:    alertRuleDomain,
+				Pattern: "[",
+			}},
+		},
+		wantErrMsg: `rule "bad": pattern: syntax error in pattern`,
+	}, {
+		name: "no_threshold",
+		conf: &alertsConfig{
+			Rules: []*alertRule{{
+				Name: "many_domains",
+				Type: alertRuleUniqueDomains,
+			}},
+		},
+		wantErrMsg: `rule "many_domains": threshold: must be positive`,
+	}, {
+		name: "bad_type",
+		conf: &alertsConfig{
+			Rules: []*alertRule{{
+				Name: "bad",
+				Type: "bad",
+			}},
+		},
+		wantErrMsg: `rule "bad": type: bad value "bad"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			errs := tc.conf.validate()
+			if tc.wantErrMsg == "" {
+				assert.Empty(t, errs)
+
+				return
+			}
+
+			require.Len(t, errs, 1)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, errs[0])
+		})
+	}
+}
+
+func TestAlerter_observe(t *testing.T) {
+	a := newAlerter(alertsConfig{
+		Rules: []*alertRule{{
+			Name:      "many_domains",
+			Type:      alertRuleUniqueDomains,
+			Threshold: 2,
+			Window:    timeutil.Duration{Duration: time.Hour},
+		}, {
+			Name:    "dyndns",
+			Type:    alertRuleDomain,
+			Pattern: "*.dyndns.*",
+		}},
+	}, nil, nil)
+
+	now := time.Now()
+	observe := func(client, domain string, at time.Time) {
+		a.observe(&stats.Entry{Client: client, Domain: domain}, at)
+	}
+
+	nextAlert := func(t *testing.T) (al *alert) {
+		t.Helper()
+
+		select {
+		case al = <-a.queue:
+			return al
+		default:
+			t.Fatal("no alert queued")
+
+			return nil
+		}
+	}
+
+	requireNoAlert := func(t *testing.T) {
+		t.Helper()
+
+		select {
+		case al := <-a.queue:
+			t.Fatalf("unexpected alert %+v", al)
+		default:
+			// Go on.
+		}
+	}
+
+	t.Run("unique_domains", func(t *testing.T) {
+		observe("1.2.3.4", "a.example", now)
+		observe("1.2.3.4", "a.example", now)
+		observe("1.2.3.4", "b.example", now)
+		observe("5.6.7.8", "c.example", now)
+		requireNoAlert(t)
+
+		observe("1.2.3.4", "c.example", now)
+		al := nextAlert(t)
+		assert.Equal(t, "many_domains", al.Rule)
+		assert.Equal(t, "1.2.3.4", al.Client)
+		assert.Equal(t, "client 1.2.3.4 queried more than 2 unique domains within 1h", al.Message)
+
+		// Only alert once per window.
+		observe("1.2.3.4", "d.example", now)
+		requireNoAlert(t)
+	})
+
+	t.Run("domain", func(t *testing.T) {
+		observe("9.9.9.9", "host.dyndns.org", now)
+		al := nextAlert(t)
+		assert.Equal(t, "dyndns", al.Rule)
+		assert.Equal(t, "host.dyndns.org", al.Domain)
+
+		observe("9.9.9.9", "other.dyndns.org", now)
+		requireNoAlert(t)
+	})
+
+	t.Run("next_window", func(t *testing.T) {
+		later := now.Add(time.Hour)
+		observe("9.9.9.9", "other.dyndns.org", later)
+		al := nextAlert(t)
+		assert.Equal(t, "dyndns", al.Rule)
+
+		observe("1.2.3.4", "d.example", later)
+		requireNoAlert(t)
+	})
+}
+
+func TestSendAlertWebhook(t *testing.T) {
+	var got *alert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = &alert{}
+		err := json.NewDecoder(r.Body).Decode(got)
+		require.NoError(t, err)
+	}))
+	t.Cleanup(srv.Close)
+
+	want := &alert{
+		Time:    time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		Rule:    "dyndns",
+		Type:    alertRuleDomain,
+		Client:  "1.2.3.4",
+		Domain:  "host.dyndns.org",
+		Message: "client 1.2.3.4 queried host.dyndns.org matching \"*.dyndns.*\"",
+	}
+
+	err := sendAlertWebhook(srv.URL, want, srv.Client())
+	require.NoError(t, err)
+
+	assert.Equal(t, want, got)
+}
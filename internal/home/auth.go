@@ -34,6 +34,10 @@ const sessionTokenSize = 16
 
 type session struct {
 	userName string
+	// role is the role of the user authenticated by an external identity
+	// provider.  It's empty for the local users, whose roles are taken from
+	// the configuration.
+	role userRole
 	// expire is the expiration time, in seconds.
 	expire uint32
 }
@@ -47,6 +51,14 @@ func (s *session) serialize() []byte {
 	binary.BigEndian.PutUint32(data[0:4], s.expire)
 	binary.BigEndian.PutUint16(data[4:6], uint16(len(s.userName)))
 	copy(data[6:], []byte(s.userName))
+
+	// The role is only stored for the external users, so that the sessions of
+	// the local ones stay compatible with the previous versions.
+	if s.role != "" {
+		data = append(data, byte(len(s.role)))
+		data = append(data, s.role...)
+	}
+
 	return data
 }
 
@@ -61,7 +73,19 @@ func (s *session) deserialize(data []byte) bool {
 	if len(data) < int(nameLen) {
 		return false
 	}
-	s.userName = string(data)
+	s.userName = string(data[:nameLen])
+
+	data = data[nameLen:]
+	if len(data) == 0 {
+		return true
+	}
+
+	roleLen := int(data[0])
+	if len(data) != 1+roleLen {
+		return false
+	}
+	s.role = userRole(data[1:])
+
 	return true
 }
 
@@ -71,27 +95,67 @@ type Auth struct {
 	raleLimiter *authRateLimiter
 	sessions    map[string]*session
 	users       []webUser
-	lock        sync.Mutex
-	sessionTTL  uint32
+	// totpUsed is the last used TOTP time step for each user, to prevent
+	// the codes from being reused.
+	totpUsed map[string]uint64
+	// totpPending are the TOTP secrets generated for the users which aren't
+	// confirmed with a valid code yet.
+	totpPending map[string]string
+	// trustedProxies are the networks of the reverse proxies, whose headers
+	// with the addresses of the clients are accepted.
+	trustedProxies netutil.SubnetSet
+
+	// oidc is the OpenID Connect provider used for the external
+	// authentication.  It's nil if the external authentication is disabled.
+	oidc *oidcProvider
+
+	lock       sync.Mutex
+	sessionTTL uint32
 }
 
 // webUser represents a user of the Web UI.
 type webUser struct {
 	Name         string `yaml:"name"`
 	PasswordHash string `yaml:"password"`
+
+	// Role is the role of the user.  The empty role means userRoleAdmin.
+	Role userRole `yaml:"role,omitempty"`
+
+	// TOTPSecret is the secret for the two-factor authentication encoded
+	// with base32.  If it's empty, the two-factor authentication is disabled.
+	TOTPSecret string `yaml:"totp_secret,omitempty"`
+
+	// RecoveryCodes are the hex-encoded SHA-256 hashes of the unused one-time
+	// codes which can be used instead of the TOTP codes.
+	RecoveryCodes []string `yaml:"totp_recovery_codes,omitempty"`
 }
 
 // InitAuth - create a global object
-func InitAuth(dbFilename string, users []webUser, sessionTTL uint32, rateLimiter *authRateLimiter) *Auth {
+func InitAuth(
+	dbFilename string,
+	users []webUser,
+	sessionTTL uint32,
+	rateLimiter *authRateLimiter,
+	trustedProxies netutil.SubnetSet,
+) *Auth {
 	log.Info("Initializing auth module: %s", dbFilename)
 
+	err := validateUsers(users)
+	if err != nil {
+		log.Error("auth: validating users: %s", err)
+
+		return nil
+	}
+
 	a := &Auth{
-		sessionTTL:  sessionTTL,
-		raleLimiter: rateLimiter,
-		sessions:    make(map[string]*session),
-		users:       users,
+		sessionTTL:     sessionTTL,
+		raleLimiter:    rateLimiter,
+		trustedProxies: trustedProxies,
+		sessions:       make(map[string]*session),
+		users:          users,
+		totpUsed:       map[string]uint64{},
+		totpPending:    map[string]string{},
 	}
-	var err error
 	a.db, err = bbolt.Open(dbFilename, 0o644, nil)
 	if err != nil {
 		log.Error("auth: open DB: %s: %s", dbFilename, err)
@@ -312,6 +376,13 @@ func (a *Auth) RemoveSession(sess string) {
 type loginJSON struct {
 	Name     string `json:"name"`
 	Password string `json:"password"`
+
+	// TOTP is the two-factor authentication code.  Either it or RecoveryCode
+	// is required for the users with the two-factor authentication enabled.
+	TOTP string `json:"totp,omitempty"`
+
+	// RecoveryCode is a one-time recovery code used instead of TOTP.
+	RecoveryCode string `json:"recovery_code,omitempty"`
 }
 
 // newSessionToken returns cryptographically secure randomly generated slice of
@@ -341,10 +412,29 @@ func (a *Auth) newCookie(req loginJSON, addr string) (c *http.Cookie, err error)
 		return nil, errors.Error("invalid username or password")
 	}
 
+	if u.TOTPSecret != "" && !a.checkSecondFactor(&u, req) {
+		if rateLimiter != nil {
+			rateLimiter.inc(addr)
+		}
+
+		if req.TOTP == "" && req.RecoveryCode == "" {
+			return nil, errors.Error("two-factor authentication code required")
+		}
+
+		return nil, errInvalidTOTP
+	}
+
 	if rateLimiter != nil {
 		rateLimiter.remove(addr)
 	}
 
+	return a.newSessionCookie(u.Name, "")
+}
+
+// newSessionCookie creates a new session for the user with name and returns
+// its cookie.  role must only be set for the users authenticated by an
+// external identity provider.
+func (a *Auth) newSessionCookie(name string, role userRole) (c *http.Cookie, err error) {
 	sess, err := newSessionToken()
 	if err != nil {
 		return nil, fmt.Errorf("generating token: %w", err)
@@ -353,7 +443,8 @@ func (a *Auth) newCookie(req loginJSON, addr string) (c *http.Cookie, err error)
 	now := time.Now().UTC()
 
 	a.addSession(sess, &session{
-		userName: u.Name,
+		userName: name,
+		role:     role,
 		expire:   uint32(now.Unix()) + a.sessionTTL,
 	})
 
@@ -368,16 +459,34 @@ func (a *Auth) newCookie(req loginJSON, addr string) (c *http.Cookie, err error)
 	}, nil
 }
 
-// realIP extracts the real IP address of the client from an HTTP request using
-// the known HTTP headers.
-//
-// TODO(a.garipov): Currently, this is basically a copy of a similar function in
-// module dnsproxy.  This should really become a part of module golibs and be
-// replaced both here and there.  Or be replaced in both places by
-// a well-maintained third-party module.
+// checkSecondFactor returns true if req contains either a valid TOTP code or a
+// valid recovery code for u.
+func (a *Auth) checkSecondFactor(u *webUser, req loginJSON) (ok bool) {
+	if req.TOTP != "" {
+		return a.checkTOTP(u, req.TOTP)
+	} else if req.RecoveryCode != "" {
+		return a.useRecoveryCode(u, req.RecoveryCode)
+	}
+
+	return false
+}
+
+// realIP extracts the real IP address of the client from an HTTP request.  The
+// known HTTP headers are only used if the request comes from one of the trusted
+// proxies.  trusted may be nil.
 //
 // TODO(a.garipov): Support header Forwarded from RFC 7329.
-func realIP(r *http.Request) (ip net.IP, err error) {
+func realIP(r *http.Request, trusted netutil.SubnetSet) (ip net.IP, err error) {
+	ipStr, err := netutil.SplitHost(r.RemoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("getting ip from client addr: %w", err)
+	}
+
+	ip = net.ParseIP(ipStr)
+	if trusted == nil || !trusted.Contains(ip) {
+		return ip, nil
+	}
+
 	proxyHeaders := []string{
 		"CF-Connecting-IP",
 		"True-Client-IP",
@@ -385,30 +494,30 @@ func realIP(r *http.Request) (ip net.IP, err error) {
 	}
 
 	for _, h := range proxyHeaders {
-		v := r.Header.Get(h)
-		ip = net.ParseIP(v)
-		if ip != nil {
-			return ip, nil
+		hdrIP := net.ParseIP(r.Header.Get(h))
+		if hdrIP != nil {
+			return hdrIP, nil
 		}
 	}
 
-	// If none of the above yielded any results, get the leftmost IP address
-	// from the X-Forwarded-For header.
-	s := r.Header.Get("X-Forwarded-For")
-	ipStrs := strings.SplitN(s, ", ", 2)
-	ip = net.ParseIP(ipStrs[0])
-	if ip != nil {
-		return ip, nil
-	}
+	// If none of the above yielded any results, get the rightmost IP address
+	// from the X-Forwarded-For header, which isn't a trusted proxy, since the
+	// leftmost ones may be forged by the client.
+	var fwdIP net.IP
+	fwd := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(fwd) - 1; i >= 0; i-- {
+		fwdIP = net.ParseIP(strings.TrimSpace(fwd[i]))
+		if fwdIP == nil {
+			break
+		}
 
-	// When everything else fails, just return the remote address as understood
-	// by the stdlib.
-	ipStr, err := netutil.SplitHost(r.RemoteAddr)
-	if err != nil {
-		return nil, fmt.Errorf("getting ip from client addr: %w", err)
+		ip = fwdIP
+		if !trusted.Contains(ip) {
+			break
+		}
 	}
 
-	return net.ParseIP(ipStr), nil
+	return ip, nil
 }
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -420,19 +529,19 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var remoteAddr string
-	// realIP cannot be used here without taking TrustedProxies into account due
-	// to security issues.
+	// Only the headers set by the trusted proxies are taken into account to
+	// prevent the clients from evading the rate limiter.
 	//
 	// See https://github.com/AdguardTeam/AdGuardHome/issues/2799.
-	//
-	// TODO(e.burkov): Use realIP when the issue will be fixed.
-	if remoteAddr, err = netutil.SplitHost(r.RemoteAddr); err != nil {
+	ip, err := realIP(r, Context.auth.trustedProxies)
+	if err != nil {
 		aghhttp.Error(r, w, http.StatusBadRequest, "auth: getting remote address: %s", err)
 
 		return
 	}
 
+	remoteAddr := ip.String()
+
 	if rateLimiter := Context.auth.raleLimiter; rateLimiter != nil {
 		if left := rateLimiter.check(remoteAddr); left > 0 {
 			w.Header().Set("Retry-After", strconv.Itoa(int(left.Seconds())))
@@ -449,17 +558,13 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Use realIP here, since this IP address is only used for logging.
-	ip, err := realIP(r)
-	if err != nil {
-		log.Error("auth: getting real ip from request: %s", err)
-	} else if ip == nil {
-		// Technically shouldn't happen.
-		log.Error("auth: unknown ip")
-	}
-
 	log.Info("auth: user %q successfully logged in from ip %v", req.Name, ip)
 
+	if req.RecoveryCode != "" {
+		// Save the removal of the used recovery code.
+		onConfigModified()
+	}
+
 	http.SetCookie(w, cookie)
 
 	h := w.Header()
@@ -503,6 +608,17 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 func RegisterAuthHandlers() {
 	Context.mux.Handle("/control/login", postInstallHandler(ensureHandler(http.MethodPost, handleLogin)))
 	httpRegister(http.MethodGet, "/control/logout", handleLogout)
+
+	Context.mux.Handle("/control/login/oidc", postInstallHandler(ensureHandler(http.MethodGet, handleOIDCLogin)))
+	Context.mux.Handle(
+		"/control/login/oidc/callback",
+		postInstallHandler(ensureHandler(http.MethodGet, handleOIDCCallback)),
+	)
+
+	httpRegister(http.MethodGet, "/control/auth/blocked", handleGetBlocked)
+	httpRegister(http.MethodPost, "/control/auth/unblock", handleUnblock)
+
+	registerUsersHandlers()
 }
 
 // optionalAuthThird return true if user should authenticate first.
@@ -515,15 +631,21 @@ func optionalAuthThird(w http.ResponseWriter, r *http.Request) (mustAuth bool) {
 
 	// redirect to login page if not authenticated
 	isAuthenticated := false
+	var u webUser
 	cookie, err := r.Cookie(sessionCookieName)
 	if err != nil {
 		// The only error that is returned from r.Cookie is [http.ErrNoCookie].
 		// Check Basic authentication.
 		user, pass, hasBasic := r.BasicAuth()
 		if hasBasic {
-			_, isAuthenticated = Context.auth.findUser(user, pass)
+			u, isAuthenticated = Context.auth.findUser(user, pass)
 			if !isAuthenticated {
 				log.Info("auth: invalid Basic Authorization value")
+			} else if u.TOTPSecret != "" {
+				// Basic authentication can't carry the two-factor
+				// authentication code.
+				log.Info("auth: Basic Authorization for user %q with totp enabled", u.Name)
+				isAuthenticated = false
 			}
 		}
 	} else {
@@ -531,10 +653,22 @@ func optionalAuthThird(w http.ResponseWriter, r *http.Request) (mustAuth bool) {
 		isAuthenticated = res == checkSessionOK
 		if !isAuthenticated {
 			log.Debug("auth: invalid cookie value: %s", cookie)
+		} else {
+			u = Context.auth.getCurrentUser(r)
+			isAuthenticated = u.Name != ""
 		}
 	}
 
 	if isAuthenticated {
+		if !u.role().allows(r.Method, r.URL.Path) {
+			log.Info("auth: user %q (%s) is not allowed to %s %s", u.Name, u.role(), r.Method, r.URL.Path)
+			aghhttp.Error(r, w, http.StatusForbidden, "not allowed for role %s", u.role())
+
+			return true
+		}
+
+		logAudit(&u, r)
+
 		return false
 	}
 
@@ -676,6 +810,9 @@ func (a *Auth) getCurrentUser(r *http.Request) (u webUser) {
 	s, ok := a.sessions[cookie.Value]
 	if !ok {
 		return webUser{}
+	} else if s.role != "" {
+		// The user is authenticated by an external identity provider.
+		return webUser{Name: s.userName, Role: s.role}
 	}
 
 	for _, u = range a.users {
@@ -702,7 +839,7 @@ func (a *Auth) AuthRequired() bool {
 	}
 
 	a.lock.Lock()
-	r := (len(a.users) != 0)
+	r := len(a.users) != 0 || a.oidc != nil
 	a.lock.Unlock()
 	return r
 }
@@ -12,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -42,7 +43,7 @@ func TestAuth(t *testing.T) {
 		Name:         "name",
 		PasswordHash: "$2y$05$..vyzAECIhJPfaQiOK17IukcQnqEgKJHy0iETyYqxn3YXJl8yZuo2",
 	}}
-	a := InitAuth(fn, nil, 60, nil)
+	a := InitAuth(fn, nil, 60, nil, nil)
 	s := session{}
 
 	user := webUser{Name: "name"}
@@ -70,7 +71,7 @@ func TestAuth(t *testing.T) {
 	a.Close()
 
 	// load saved session
-	a = InitAuth(fn, users, 60, nil)
+	a = InitAuth(fn, users, 60, nil, nil)
 
 	// the session is still alive
 	assert.Equal(t, checkSessionOK, a.checkSession(sessStr))
@@ -86,7 +87,7 @@ func TestAuth(t *testing.T) {
 	time.Sleep(3 * time.Second)
 
 	// load and remove expired sessions
-	a = InitAuth(fn, users, 60, nil)
+	a = InitAuth(fn, users, 60, nil, nil)
 	assert.Equal(t, checkSessionNotFound, a.checkSession(sessStr))
 
 	a.Close()
@@ -117,7 +118,7 @@ func TestAuthHTTP(t *testing.T) {
 	users := []webUser{
 		{Name: "name", PasswordHash: "$2y$05$..vyzAECIhJPfaQiOK17IukcQnqEgKJHy0iETyYqxn3YXJl8yZuo2"},
 	}
-	Context.auth = InitAuth(fn, users, 60, nil)
+	Context.auth = InitAuth(fn, users, 60, nil, nil)
 
 	handlerCalled := false
 	handler := func(_ http.ResponseWriter, _ *http.Request) {
@@ -198,6 +199,14 @@ func TestAuthHTTP(t *testing.T) {
 func TestRealIP(t *testing.T) {
 	const remoteAddr = "1.2.3.4:5678"
 
+	trusted := netutil.SliceSubnetSet{{
+		IP:   net.IP{1, 2, 3, 4},
+		Mask: net.CIDRMask(32, 32),
+	}, {
+		IP:   net.IP{10, 0, 0, 0},
+		Mask: net.CIDRMask(8, 32),
+	}}
+
 	testCases := []struct {
 		name       string
 		header     http.Header
@@ -227,7 +236,27 @@ func TestRealIP(t *testing.T) {
 		},
 		remoteAddr: remoteAddr,
 		wantErrMsg: "",
+		wantIP:     net.IPv4(1, 2, 3, 5),
+	}, {
+		name: "success_proxy_chain",
+		header: http.Header{
+			textproto.CanonicalMIMEHeaderKey("X-Forwarded-For"): []string{
+				"1.2.3.7, 1.2.3.6",
+				"10.0.0.2",
+			},
+		},
+		remoteAddr: remoteAddr,
+		wantErrMsg: "",
 		wantIP:     net.IPv4(1, 2, 3, 6),
+	}, {
+		name: "untrusted_proxy",
+		header: http.Header{
+			textproto.CanonicalMIMEHeaderKey("X-Real-IP"):       []string{"1.2.3.5"},
+			textproto.CanonicalMIMEHeaderKey("X-Forwarded-For"): []string{"1.2.3.6"},
+		},
+		remoteAddr: "5.6.7.8:5678",
+		wantErrMsg: "",
+		wantIP:     net.IPv4(5, 6, 7, 8),
 	}, {
 		name:       "error_no_proxy",
 		header:     nil,
@@ -244,10 +273,24 @@ func TestRealIP(t *testing.T) {
 				RemoteAddr: tc.remoteAddr,
 			}
 
-			ip, err := realIP(r)
+			ip, err := realIP(r, trusted)
 			assert.Equal(t, tc.wantIP, ip)
 
 			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
 		})
 	}
+
+	t.Run("no_trusted", func(t *testing.T) {
+		r := &http.Request{
+			Header: http.Header{
+				textproto.CanonicalMIMEHeaderKey("X-Real-IP"): []string{"1.2.3.5"},
+			},
+			RemoteAddr: remoteAddr,
+		}
+
+		ip, err := realIP(r, nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, net.IPv4(1, 2, 3, 4), ip)
+	})
 }
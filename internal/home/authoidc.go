@@ -0,0 +1,957 @@
+package home
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	// Register the hash functions used by the supported signing algorithms.
+	_ "crypto/sha512"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// oidcStateCookieName is the name of the cookie binding the login attempt
+	// to the browser which has started it.
+	oidcStateCookieName = "agh_oidc_state"
+
+	// oidcLoginTTL is the time during which the user must finish the login at
+	// the identity provider.
+	oidcLoginTTL = 10 * time.Minute
+
+	// oidcMaxPendingLogins is the maximum number of the unfinished logins.
+	// The login handler doesn't require authentication, so the number is
+	// limited to prevent memory exhaustion.
+	oidcMaxPendingLogins = 1000
+
+	// oidcMaxRespSize is the maximum size of the responses of the identity
+	// provider.
+	oidcMaxRespSize = 1 * 1024 * 1024
+
+	// oidcKeysRefreshIvl is the minimum interval between the requests of the
+	// signing keys of the identity provider caused by unknown key IDs.
+	oidcKeysRefreshIvl = 1 * time.Minute
+
+	// oidcClockSkew is the allowed difference between the clocks of AdGuard
+	// Home and the identity provider.
+	oidcClockSkew = 1 * time.Minute
+
+	// oidcDefaultUsernameClaim is the claim with the name of the user used
+	// when none is configured.
+	oidcDefaultUsernameClaim = "preferred_username"
+
+	// oidcDefaultGroupsClaim is the claim with the groups of the user used
+	// when none is configured.
+	oidcDefaultGroupsClaim = "groups"
+)
+
+// oidcConfig is the configuration of the login via an OpenID Connect identity
+// provider.
+type oidcConfig struct {
+	// Issuer is the URL of the identity provider.  It's used to discover the
+	// endpoints of the provider and must match the issuer of the ID tokens.
+	Issuer string `yaml:"issuer"`
+
+	// ClientID is the identifier of AdGuard Home registered at the provider.
+	ClientID string `yaml:"client_id"`
+
+	// ClientSecret is the secret of AdGuard Home registered at the provider.
+	// It may be empty for the public clients.
+	ClientSecret string `yaml:"client_secret"`
+
+	// RedirectURL is the absolute URL of the callback handler registered at
+	// the provider, e.g. https://adguard.example/control/login/oidc/callback.
+	RedirectURL string `yaml:"redirect_url"`
+
+	// UsernameClaim is the claim of the ID token containing the name of the
+	// user.  If it's empty, preferred_username is used.  The email and sub
+	// claims are used if the configured one is missing.
+	UsernameClaim string `yaml:"username_claim"`
+
+	// GroupsClaim is the claim of the ID token containing the groups of the
+	// user.  If it's empty, groups is used.
+	GroupsClaim string `yaml:"groups_claim"`
+
+	// DefaultRole is the role of the users which aren't in any of the groups
+	// from Roles.  If it's empty, such users aren't allowed to log in.
+	DefaultRole userRole `yaml:"default_role"`
+
+	// Scopes are the requested scopes in addition to openid.
+	Scopes []string `yaml:"scopes"`
+
+	// Roles maps the groups of the users to their roles.  The most
+	// privileged role of all groups of a user is used.
+	Roles map[string]userRole `yaml:"roles"`
+
+	// Enabled defines if the login via the identity provider is allowed.  The
+	// local users are still able to log in.
+	Enabled bool `yaml:"enabled"`
+}
+
+// validate returns an error if c is not a valid configuration.
+func (c *oidcConfig) validate() (err error) {
+	if c.ClientID == "" {
+		return errors.Error("client_id: empty value")
+	}
+
+	err = validateAbsURL(c.Issuer)
+	if err != nil {
+		return fmt.Errorf("issuer: %w", err)
+	}
+
+	err = validateAbsURL(c.RedirectURL)
+	if err != nil {
+		return fmt.Errorf("redirect_url: %w", err)
+	}
+
+	if c.DefaultRole != "" {
+		err = c.DefaultRole.validate()
+		if err != nil {
+			return fmt.Errorf("default_role: %w", err)
+		}
+	}
+
+	for g, r := range c.Roles {
+		err = r.validate()
+		if err != nil {
+			return fmt.Errorf("roles: group %q: %w", g, err)
+		}
+	}
+
+	return nil
+}
+
+// validateAbsURL returns an error if s isn't an absolute HTTP(S) URL.
+func validateAbsURL(s string) (err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("bad url %q: scheme must be http or https", s)
+	} else if u.Host == "" {
+		return fmt.Errorf("bad url %q: empty host", s)
+	}
+
+	return nil
+}
+
+// oidcMetadata is the metadata of an OpenID Connect identity provider.  See
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is an unfinished login via the identity provider.
+type oidcLogin struct {
+	// expire is the time after which the login can't be finished.
+	expire time.Time
+
+	// nonce is the value expected in the nonce claim of the ID token.
+	nonce string
+
+	// verifier is the PKCE code verifier, see RFC 7636.
+	verifier string
+}
+
+// oidcProvider performs the login via an OpenID Connect identity provider
+// using the authorization code flow.
+type oidcProvider struct {
+	conf   *oidcConfig
+	client *http.Client
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// meta is the discovered metadata of the provider.  It's nil until the
+	// first login.
+	meta *oidcMetadata
+
+	// keys are the signing keys of the provider by their IDs.
+	keys map[string]crypto.PublicKey
+
+	// keysUpdated is the time of the last request of keys.
+	keysUpdated time.Time
+
+	// logins are the unfinished logins by their states.
+	logins map[string]*oidcLogin
+}
+
+// newOIDCProvider returns a new properly initialized OpenID Connect provider.
+// It returns nil if conf is nil or the external authentication is disabled.
+func newOIDCProvider(conf *oidcConfig, client *http.Client) (p *oidcProvider, err error) {
+	if conf == nil || !conf.Enabled {
+		return nil, nil
+	}
+
+	err = conf.validate()
+	if err != nil {
+		return nil, fmt.Errorf("validating oidc config: %w", err)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &oidcProvider{
+		conf:   conf,
+		client: client,
+		mu:     &sync.Mutex{},
+		keys:   map[string]crypto.PublicKey{},
+		logins: map[string]*oidcLogin{},
+	}, nil
+}
+
+// getJSON requests the JSON document from u and decodes it into v.
+func (p *oidcProvider) getJSON(ctx context.Context, u string, v any) (err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("requesting: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, oidcMaxRespSize)).Decode(v)
+	if err != nil {
+		return fmt.Errorf("decoding: %w", err)
+	}
+
+	return nil
+}
+
+// metadata returns the metadata of the provider discovering it if necessary.
+func (p *oidcProvider) metadata(ctx context.Context) (meta *oidcMetadata, err error) {
+	p.mu.Lock()
+	meta = p.meta
+	p.mu.Unlock()
+
+	if meta != nil {
+		return meta, nil
+	}
+
+	u := strings.TrimSuffix(p.conf.Issuer, "/") + "/.well-known/openid-configuration"
+	meta = &oidcMetadata{}
+	err = p.getJSON(ctx, u, meta)
+	if err != nil {
+		return nil, fmt.Errorf("discovering provider: %w", err)
+	}
+
+	// See https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfigurationValidation.
+	if meta.Issuer != p.conf.Issuer {
+		return nil, fmt.Errorf("discovering provider: issuer %q doesn't match", meta.Issuer)
+	} else if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.Error("discovering provider: missing endpoints")
+	}
+
+	p.mu.Lock()
+	p.meta = meta
+	p.mu.Unlock()
+
+	return meta, nil
+}
+
+// jsonWebKey is a public key from a JSON Web Key Set, see RFC 7517.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+
+	// N and E are the modulus and the exponent of an RSA key.
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// Crv, X, and Y are the curve and the coordinates of an EC key.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey returns the public key described by k.
+func (k *jsonWebKey) publicKey() (pub crypto.PublicKey, err error) {
+	switch k.Kty {
+	case "RSA":
+		var n, e *big.Int
+		n, err = decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("modulus: %w", err)
+		}
+
+		e, err = decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("exponent: %w", err)
+		} else if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.Error("exponent is too large")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		return k.ecdsaKey()
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// ecdsaKey returns the ECDSA public key described by k.
+func (k *jsonWebKey) ecdsaKey() (pub *ecdsa.PublicKey, err error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+
+	x, err := decodeBigInt(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("x: %w", err)
+	}
+
+	y, err := decodeBigInt(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("y: %w", err)
+	}
+
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.Error("point is not on curve")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// decodeBigInt decodes a base64url-encoded big-endian unsigned integer.
+func decodeBigInt(s string) (i *big.Int, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	} else if len(b) == 0 {
+		return nil, errors.Error("empty value")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
+
+// key returns the signing key of the provider with id.  An empty id is only
+// accepted if the provider has a single key.
+func (p *oidcProvider) key(
+	ctx context.Context,
+	meta *oidcMetadata,
+	id string,
+) (pub crypto.PublicKey, err error) {
+	p.mu.Lock()
+	pub, ok := p.findKeyLocked(id)
+	refresh := time.Since(p.keysUpdated) >= oidcKeysRefreshIvl
+	p.mu.Unlock()
+
+	if ok {
+		return pub, nil
+	} else if !refresh {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+
+	set := &struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}{}
+	err = p.getJSON(ctx, meta.JWKSURI, set)
+	if err != nil {
+		return nil, fmt.Errorf("requesting keys: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var kpub crypto.PublicKey
+		kpub, err = k.publicKey()
+		if err != nil {
+			// Skip the unsupported keys, since the provider may have keys for
+			// other purposes.
+			log.Debug("auth: oidc: key at index %d: %s", i, err)
+
+			continue
+		}
+
+		keys[k.Kid] = kpub
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.keys, p.keysUpdated = keys, time.Now()
+	pub, ok = p.findKeyLocked(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+
+	return pub, nil
+}
+
+// findKeyLocked returns the cached key with id.  p.mu is expected to be
+// locked.
+func (p *oidcProvider) findKeyLocked(id string) (pub crypto.PublicKey, ok bool) {
+	if id == "" && len(p.keys) == 1 {
+		for _, pub = range p.keys {
+			return pub, true
+		}
+	}
+
+	pub, ok = p.keys[id]
+
+	return pub, ok
+}
+
+// jwtHeader is the header of a JSON Web Token, see RFC 7515.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verifyJWTSignature returns an error if sig isn't a valid signature of signed
+// made with pub using alg.
+func verifyJWTSignature(alg string, pub crypto.PublicKey, signed, sig []byte) (err error) {
+	var h crypto.Hash
+	switch alg[2:] {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	case "512":
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	hasher := h.New()
+	_, _ = hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %q doesn't match rsa key", alg)
+		}
+
+		return rsa.VerifyPKCS1v15(k, h, digest, sig)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("algorithm %q doesn't match ec key", alg)
+		}
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.Error("bad signature length")
+		}
+
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.Error("ecdsa verification error")
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+}
+
+// audience is the aud claim of an ID token, which may be either a single
+// string or an array of strings.
+type audience []string
+
+// type check
+var _ json.Unmarshaler = (*audience)(nil)
+
+// UnmarshalJSON implements the [json.Unmarshaler] interface for *audience.
+func (a *audience) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+
+		return nil
+	}
+
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// idTokenClaims are the registered claims of an ID token.  See
+// https://openid.net/specs/openid-connect-core-1_0.html#IDToken.
+type idTokenClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	AuthorizedParty string   `json:"azp"`
+	Nonce           string   `json:"nonce"`
+	Audience        audience `json:"aud"`
+	Expiry          int64    `json:"exp"`
+}
+
+// oidcIdentity is the user authenticated by the identity provider.
+type oidcIdentity struct {
+	name   string
+	groups []string
+}
+
+// verifyIDToken verifies the signature and the claims of the ID token tok and
+// returns the identity of the user.
+func (p *oidcProvider) verifyIDToken(
+	ctx context.Context,
+	meta *oidcMetadata,
+	tok string,
+	nonce string,
+) (id *oidcIdentity, err error) {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return nil, errors.Error("malformed token")
+	}
+
+	hdr := &jwtHeader{}
+	err = decodeJWTPart(parts[0], hdr)
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+
+	// Only the asymmetric algorithms are supported, since the client secret
+	// may be empty.
+	if len(hdr.Alg) != 5 || (!strings.HasPrefix(hdr.Alg, "RS") && !strings.HasPrefix(hdr.Alg, "ES")) {
+		return nil, fmt.Errorf("unsupported algorithm %q", hdr.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+
+	pub, err := p.key(ctx, meta, hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyJWTSignature(hdr.Alg, pub, []byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return nil, fmt.Errorf("verifying signature: %w", err)
+	}
+
+	claims := &idTokenClaims{}
+	err = decodeJWTPart(parts[1], claims)
+	if err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+
+	err = p.validateClaims(meta, claims, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]any{}
+	err = decodeJWTPart(parts[1], &raw)
+	if err != nil {
+		// Shouldn't happen, since the claims have already been decoded.
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+
+	return p.identity(claims, raw)
+}
+
+// decodeJWTPart decodes the base64url-encoded JSON part of a JWT into v.
+func decodeJWTPart(part string, v any) (err error) {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// validateClaims returns an error if the registered claims of an ID token
+// aren't valid.
+func (p *oidcProvider) validateClaims(meta *oidcMetadata, c *idTokenClaims, nonce string) (err error) {
+	if c.Issuer != meta.Issuer {
+		return fmt.Errorf("bad issuer %q", c.Issuer)
+	}
+
+	found := false
+	for _, aud := range c.Audience {
+		found = found || aud == p.conf.ClientID
+	}
+
+	if !found {
+		return fmt.Errorf("bad audience %q", c.Audience)
+	} else if len(c.Audience) > 1 && c.AuthorizedParty != p.conf.ClientID {
+		return fmt.Errorf("bad authorized party %q", c.AuthorizedParty)
+	}
+
+	if time.Unix(c.Expiry, 0).Add(oidcClockSkew).Before(time.Now()) {
+		return errors.Error("token is expired")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(c.Nonce), []byte(nonce)) != 1 {
+		return errors.Error("bad nonce")
+	}
+
+	return nil
+}
+
+// identity returns the identity of the user from the claims of a valid ID
+// token.
+func (p *oidcProvider) identity(c *idTokenClaims, raw map[string]any) (id *oidcIdentity, err error) {
+	claim := p.conf.UsernameClaim
+	if claim == "" {
+		claim = oidcDefaultUsernameClaim
+	}
+
+	id = &oidcIdentity{}
+	for _, cl := range []string{claim, "email", "sub"} {
+		if name, ok := raw[cl].(string); ok && name != "" {
+			id.name = name
+
+			break
+		}
+	}
+
+	if id.name == "" {
+		return nil, fmt.Errorf("no user name in claims of %q", c.Subject)
+	}
+
+	claim = p.conf.GroupsClaim
+	if claim == "" {
+		claim = oidcDefaultGroupsClaim
+	}
+
+	switch groups := raw[claim].(type) {
+	case string:
+		id.groups = []string{groups}
+	case []any:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				id.groups = append(id.groups, s)
+			}
+		}
+	}
+
+	return id, nil
+}
+
+// role returns the most privileged role of the user in groups according to the
+// configured roles.  It returns the default role if none of the groups matches,
+// and an empty role if the user isn't allowed to log in.
+func (p *oidcProvider) role(groups []string) (r userRole) {
+	for _, g := range groups {
+		if gr, ok := p.conf.Roles[g]; ok && gr.rank() > r.rank() {
+			r = gr
+		}
+	}
+
+	if r == "" {
+		return p.conf.DefaultRole
+	}
+
+	return r
+}
+
+// tokenResponse is the response of the token endpoint, see RFC 6749.
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// exchange exchanges the authorization code for an ID token.
+func (p *oidcProvider) exchange(
+	ctx context.Context,
+	meta *oidcMetadata,
+	code string,
+	verifier string,
+) (tok string, err error) {
+	form := url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"code":          []string{code},
+		"redirect_uri":  []string{p.conf.RedirectURL},
+		"client_id":     []string{p.conf.ClientID},
+		"code_verifier": []string{verifier},
+	}
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		meta.TokenEndpoint,
+		strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return "", fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set(aghhttp.HdrNameContentType, "application/x-www-form-urlencoded")
+	if p.conf.ClientSecret != "" {
+		// See RFC 6749, section 2.3.1.
+		req.SetBasicAuth(url.QueryEscape(p.conf.ClientID), url.QueryEscape(p.conf.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("requesting token: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	tr := &tokenResponse{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, oidcMaxRespSize)).Decode(tr)
+	if err != nil {
+		return "", fmt.Errorf("decoding token response with status code %d: %w", resp.StatusCode, err)
+	}
+
+	if tr.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s: %s", tr.Error, tr.ErrorDescription)
+	} else if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: unexpected status code %d", resp.StatusCode)
+	} else if tr.IDToken == "" {
+		return "", errors.Error("token endpoint: no id_token in response")
+	}
+
+	return tr.IDToken, nil
+}
+
+// newOIDCRandom returns a random base64url-encoded string suitable for the
+// state, the nonce, and the PKCE code verifier.
+func newOIDCRandom() (s string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// startLogin starts a new login and returns the URL of the identity provider
+// to redirect the user to as well as the state of the login.
+func (p *oidcProvider) startLogin(ctx context.Context) (authURL, state string, err error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing authorization endpoint: %w", err)
+	}
+
+	var vals [3]string
+	for i := range vals {
+		vals[i], err = newOIDCRandom()
+		if err != nil {
+			return "", "", fmt.Errorf("generating random value: %w", err)
+		}
+	}
+
+	state, nonce, verifier := vals[0], vals[1], vals[2]
+
+	err = p.addLogin(state, &oidcLogin{
+		expire:   time.Now().Add(oidcLoginTTL),
+		nonce:    nonce,
+		verifier: verifier,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.conf.ClientID)
+	q.Set("redirect_uri", p.conf.RedirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, p.conf.Scopes...), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), state, nil
+}
+
+// addLogin saves the unfinished login l with state, removing the expired ones.
+func (p *oidcProvider) addLogin(state string, l *oidcLogin) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for s, pl := range p.logins {
+		if now.After(pl.expire) {
+			delete(p.logins, s)
+		}
+	}
+
+	if len(p.logins) >= oidcMaxPendingLogins {
+		return errors.Error("too many unfinished logins")
+	}
+
+	p.logins[state] = l
+
+	return nil
+}
+
+// finishLogin exchanges the authorization code of the login with state and
+// returns the identity of the user.
+func (p *oidcProvider) finishLogin(ctx context.Context, state, code string) (id *oidcIdentity, err error) {
+	p.mu.Lock()
+	l, ok := p.logins[state]
+	delete(p.logins, state)
+	p.mu.Unlock()
+
+	if !ok || time.Now().After(l.expire) {
+		return nil, errors.Error("unknown or expired login")
+	}
+
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := p.exchange(ctx, meta, code, l.verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.verifyIDToken(ctx, meta, tok, l.nonce)
+}
+
+// oidcStateCookie returns the cookie with the state of the login.  An empty
+// state removes the cookie.
+func oidcStateCookie(r *http.Request, state string) (c *http.Cookie) {
+	c = &http.Cookie{
+		Name:  oidcStateCookieName,
+		Value: state,
+		Path:  "/control/login/oidc",
+
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// The strict mode would prevent the cookie from being sent with the
+		// redirect from the identity provider.
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	if state == "" {
+		c.MaxAge = -1
+	} else {
+		c.MaxAge = int(oidcLoginTTL.Seconds())
+	}
+
+	return c
+}
+
+// handleOIDCLogin is the handler for the GET /control/login/oidc HTTP API.  It
+// redirects the user to the identity provider.
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	p := Context.auth.oidc
+	if p == nil {
+		aghhttp.Error(r, w, http.StatusNotFound, "oidc login is disabled")
+
+		return
+	}
+
+	authURL, state, err := p.startLogin(r.Context())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadGateway, "auth: oidc: %s", err)
+
+		return
+	}
+
+	http.SetCookie(w, oidcStateCookie(r, state))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handleOIDCCallback is the handler for the GET /control/login/oidc/callback
+// HTTP API.  The identity provider redirects the user there after the
+// authentication.
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	p := Context.auth.oidc
+	if p == nil {
+		aghhttp.Error(r, w, http.StatusNotFound, "oidc login is disabled")
+
+		return
+	}
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		aghhttp.Error(r, w, http.StatusForbidden, "auth: oidc: %s: %s", e, q.Get("error_description"))
+
+		return
+	}
+
+	// Make sure that the login has been started by the same browser to
+	// prevent login CSRF.
+	state := q.Get("state")
+	c, err := r.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		aghhttp.Error(r, w, http.StatusForbidden, "auth: oidc: state mismatch")
+
+		return
+	}
+
+	http.SetCookie(w, oidcStateCookie(r, ""))
+
+	id, err := p.finishLogin(r.Context(), state, q.Get("code"))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusForbidden, "auth: oidc: %s", err)
+
+		return
+	}
+
+	role := p.role(id.groups)
+	if role == "" {
+		aghhttp.Error(r, w, http.StatusForbidden, "auth: oidc: user %q has no role", id.name)
+
+		return
+	}
+
+	cookie, err := Context.auth.newSessionCookie(id.name, role)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "auth: %s", err)
+
+		return
+	}
+
+	log.Info("auth: user %q (%s) successfully logged in via oidc", id.name, role)
+
+	http.SetCookie(w, cookie)
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-store, no-cache, must-revalidate, proxy-revalidate")
+	h.Set("Pragma", "no-cache")
+	h.Set("Expires", "0")
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
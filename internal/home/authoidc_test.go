@@ -0,0 +1,505 @@
+package home
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testOIDCClientID = "adguard-home"
+	testOIDCKeyID    = "key-1"
+)
+
+// signTestJWT returns a JWT with claims signed by key.
+func signTestJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]any) (tok string) {
+	t.Helper()
+
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+
+	hdr, err := json.Marshal(&jwtHeader{Alg: alg, Kid: kid})
+	require.NoError(t, err)
+
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(hdr) + "." + enc.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		require.NoError(t, err)
+
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+// testOIDCServer is a fake OpenID Connect identity provider.
+type testOIDCServer struct {
+	srv    *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	// claims are the claims of the ID token issued by the token endpoint.
+	// The nonce is taken from the authorization request.
+	claims map[string]any
+}
+
+// newTestOIDCServer returns a new running fake identity provider.
+func newTestOIDCServer(t *testing.T) (s *testOIDCServer) {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	s = &testOIDCServer{
+		rsaKey: rsaKey,
+		ecKey:  ecKey,
+	}
+
+	var nonce string
+	enc := base64.RawURLEncoding
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(&oidcMetadata{
+			Issuer:                s.srv.URL,
+			AuthorizationEndpoint: s.srv.URL + "/authorize",
+			TokenEndpoint:         s.srv.URL + "/token",
+			JWKSURI:               s.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, _ *http.Request) {
+		keys := []*jsonWebKey{{
+			Kty: "RSA",
+			Kid: testOIDCKeyID,
+			Use: "sig",
+			N:   enc.EncodeToString(rsaKey.N.Bytes()),
+			E:   enc.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}, {
+			Kty: "EC",
+			Kid: "key-2",
+			Crv: "P-256",
+			X:   enc.EncodeToString(ecKey.X.Bytes()),
+			Y:   enc.EncodeToString(ecKey.Y.Bytes()),
+		}, {
+			Kty: "oct",
+			Kid: "symmetric",
+		}}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		nonce = r.URL.Query().Get("nonce")
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" || r.FormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(&tokenResponse{Error: "invalid_grant"})
+
+			return
+		}
+
+		claims := map[string]any{"nonce": nonce}
+		for k, v := range s.claims {
+			claims[k] = v
+		}
+
+		_ = json.NewEncoder(w).Encode(&tokenResponse{
+			IDToken: signTestJWT(t, rsaKey, testOIDCKeyID, claims),
+		})
+	})
+
+	s.srv = httptest.NewServer(mux)
+	t.Cleanup(s.srv.Close)
+
+	return s
+}
+
+// newTestOIDCProvider returns a provider configured to use s.
+func newTestOIDCProvider(t *testing.T, s *testOIDCServer) (p *oidcProvider) {
+	t.Helper()
+
+	p, err := newOIDCProvider(&oidcConfig{
+		Issuer:      s.srv.URL,
+		ClientID:    testOIDCClientID,
+		RedirectURL: "http://adguard.example/control/login/oidc/callback",
+		DefaultRole: userRoleViewer,
+		Roles: map[string]userRole{
+			"ops":    userRoleOperator,
+			"admins": userRoleAdmin,
+		},
+		Enabled: true,
+	}, s.srv.Client())
+	require.NoError(t, err)
+	require.NotNil(t, p)
+
+	return p
+}
+
+func TestOIDCProvider_verifyIDToken(t *testing.T) {
+	s := newTestOIDCServer(t)
+	p := newTestOIDCProvider(t, s)
+
+	meta, err := p.metadata(context.Background())
+	require.NoError(t, err)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	newClaims := func(upd map[string]any) (c map[string]any) {
+		c = map[string]any{
+			"iss":                s.srv.URL,
+			"sub":                "1234",
+			"aud":                testOIDCClientID,
+			"exp":                exp,
+			"nonce":              "nonce",
+			"preferred_username": "alice",
+			"groups":             []string{"ops", "users"},
+		}
+		for k, v := range upd {
+			c[k] = v
+		}
+
+		return c
+	}
+
+	testCases := []struct {
+		key        crypto.Signer
+		claims     map[string]any
+		name       string
+		kid        string
+		wantName   string
+		wantErrMsg string
+	}{{
+		key:        s.rsaKey,
+		claims:     newClaims(nil),
+		name:       "rsa",
+		kid:        testOIDCKeyID,
+		wantName:   "alice",
+		wantErrMsg: "",
+	}, {
+		key:        s.ecKey,
+		claims:     newClaims(map[string]any{"preferred_username": nil}),
+		name:       "ec_sub",
+		kid:        "key-2",
+		wantName:   "1234",
+		wantErrMsg: "",
+	}, {
+		key: s.rsaKey,
+		claims: newClaims(map[string]any{
+			"aud": []string{"other", testOIDCClientID},
+			"azp": testOIDCClientID,
+		}),
+		name:       "many_audiences",
+		kid:        testOIDCKeyID,
+		wantName:   "alice",
+		wantErrMsg: "",
+	}, {
+		key:        otherKey,
+		claims:     newClaims(nil),
+		name:       "bad_signature",
+		kid:        testOIDCKeyID,
+		wantName:   "",
+		wantErrMsg: "verifying signature: crypto/rsa: verification error",
+	}, {
+		key:        s.rsaKey,
+		claims:     newClaims(nil),
+		name:       "unknown_key",
+		kid:        "key-3",
+		wantName:   "",
+		wantErrMsg: `unknown key "key-3"`,
+	}, {
+		key:        s.rsaKey,
+		claims:     newClaims(map[string]any{"aud": "other"}),
+		name:       "bad_audience",
+		kid:        testOIDCKeyID,
+		wantName:   "",
+		wantErrMsg: `bad audience ["other"]`,
+	}, {
+		key:        s.rsaKey,
+		claims:     newClaims(map[string]any{"iss": "https://evil.example"}),
+		name:       "bad_issuer",
+		kid:        testOIDCKeyID,
+		wantName:   "",
+		wantErrMsg: `bad issuer "https://evil.example"`,
+	}, {
+		key:        s.rsaKey,
+		claims:     newClaims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}),
+		name:       "expired",
+		kid:        testOIDCKeyID,
+		wantName:   "",
+		wantErrMsg: "token is expired",
+	}, {
+		key:        s.rsaKey,
+		claims:     newClaims(map[string]any{"nonce": "other"}),
+		name:       "bad_nonce",
+		kid:        testOIDCKeyID,
+		wantName:   "",
+		wantErrMsg: "bad nonce",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tok := signTestJWT(t, tc.key, tc.kid, tc.claims)
+
+			ctx := context.Background()
+			id, verifyErr := p.verifyIDToken(ctx, meta, tok, "nonce")
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, verifyErr)
+			if tc.wantErrMsg != "" {
+				return
+			}
+
+			require.NotNil(t, id)
+
+			assert.Equal(t, tc.wantName, id.name)
+		})
+	}
+
+	t.Run("alg_none", func(t *testing.T) {
+		enc := base64.RawURLEncoding
+		tok := enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+			enc.EncodeToString([]byte(`{}`)) + "."
+
+		ctx := context.Background()
+		_, verifyErr := p.verifyIDToken(ctx, meta, tok, "nonce")
+		testutil.AssertErrorMsg(t, `unsupported algorithm "none"`, verifyErr)
+	})
+}
+
+func TestOIDCProvider_role(t *testing.T) {
+	p := &oidcProvider{
+		conf: &oidcConfig{
+			Roles: map[string]userRole{
+				"ops":    userRoleOperator,
+				"admins": userRoleAdmin,
+			},
+		},
+	}
+
+	testCases := []struct {
+		name    string
+		defRole userRole
+		want    userRole
+		groups  []string
+	}{{
+		name:    "most_privileged",
+		defRole: "",
+		want:    userRoleAdmin,
+		groups:  []string{"ops", "admins"},
+	}, {
+		name:    "single",
+		defRole: userRoleViewer,
+		want:    userRoleOperator,
+		groups:  []string{"users", "ops"},
+	}, {
+		name:    "default",
+		defRole: userRoleViewer,
+		want:    userRoleViewer,
+		groups:  []string{"users"},
+	}, {
+		name:    "not_allowed",
+		defRole: "",
+		want:    "",
+		groups:  nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p.conf.DefaultRole = tc.defRole
+
+			assert.Equal(t, tc.want, p.role(tc.groups))
+		})
+	}
+}
+
+func TestNewOIDCProvider(t *testing.T) {
+	testCases := []struct {
+		conf       *oidcConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+	}, {
+		conf:       &oidcConfig{Enabled: false},
+		name:       "disabled",
+		wantErrMsg: "",
+	}, {
+		conf:       &oidcConfig{Enabled: true},
+		name:       "no_client_id",
+		wantErrMsg: "validating oidc config: client_id: empty value",
+	}, {
+		conf: &oidcConfig{
+			Issuer:   "ftp://idp.example",
+			ClientID: testOIDCClientID,
+			Enabled:  true,
+		},
+		name: "bad_issuer",
+		wantErrMsg: `validating oidc config: issuer: bad url "ftp://idp.example": ` +
+			`scheme must be http or https`,
+	}, {
+		conf: &oidcConfig{
+			Issuer:      "https://idp.example",
+			ClientID:    testOIDCClientID,
+			RedirectURL: "https://adguard.example/control/login/oidc/callback",
+			Roles:       map[string]userRole{"admins": "root"},
+			Enabled:     true,
+		},
+		name:       "bad_role",
+		wantErrMsg: `validating oidc config: roles: group "admins": bad role "root"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newOIDCProvider(tc.conf, nil)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	s := newTestOIDCServer(t)
+	s.claims = map[string]any{
+		"iss":                s.srv.URL,
+		"sub":                "1234",
+		"aud":                testOIDCClientID,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"preferred_username": "alice",
+		"groups":             []string{"ops"},
+	}
+
+	Context.auth = InitAuth(filepath.Join(t.TempDir(), "sessions.db"), nil, 60, nil, nil)
+	require.NotNil(t, Context.auth)
+	t.Cleanup(func() {
+		Context.auth.Close()
+		Context.auth = nil
+	})
+
+	Context.auth.oidc = newTestOIDCProvider(t, s)
+	assert.True(t, Context.auth.AuthRequired())
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "http://adguard.example/control/login/oidc", nil)
+	handleOIDCLogin(w, r)
+	require.Equal(t, http.StatusFound, w.Code)
+
+	authURL, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+
+	q := authURL.Query()
+	assert.Equal(t, testOIDCClientID, q.Get("client_id"))
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+
+	// Make the fake provider remember the nonce.
+	resp, err := s.srv.Client().Get(authURL.String())
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	stateCookie := cookies[0]
+	callback := func(state, code string) (cw *httptest.ResponseRecorder) {
+		cw = httptest.NewRecorder()
+		cr := httptest.NewRequest(
+			http.MethodGet,
+			"http://adguard.example/control/login/oidc/callback?"+url.Values{
+				"state": []string{state},
+				"code":  []string{code},
+			}.Encode(),
+			nil,
+		)
+		cr.AddCookie(stateCookie)
+		handleOIDCCallback(cw, cr)
+
+		return cw
+	}
+
+	t.Run("bad_state", func(t *testing.T) {
+		cw := callback("other", "good-code")
+
+		assert.Equal(t, http.StatusForbidden, cw.Code)
+	})
+
+	cw := callback(q.Get("state"), "good-code")
+	require.Equal(t, http.StatusFound, cw.Code)
+
+	var sessCookie *http.Cookie
+	for _, c := range cw.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			sessCookie = c
+		}
+	}
+	require.NotNil(t, sessCookie)
+
+	r = httptest.NewRequest(http.MethodGet, "http://adguard.example/control/status", nil)
+	r.AddCookie(sessCookie)
+	u := Context.auth.getCurrentUser(r)
+
+	assert.Equal(t, "alice", u.Name)
+	assert.Equal(t, userRoleOperator, u.Role)
+
+	t.Run("replay", func(t *testing.T) {
+		cw = callback(q.Get("state"), "good-code")
+
+		assert.Equal(t, http.StatusForbidden, cw.Code)
+	})
+}
+
+func TestSession_serialize(t *testing.T) {
+	testCases := []struct {
+		sess *session
+		name string
+	}{{
+		sess: &session{userName: "local", expire: 1234},
+		name: "local",
+	}, {
+		sess: &session{userName: "alice", role: userRoleViewer, expire: 1234},
+		name: "external",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := &session{}
+			require.True(t, got.deserialize(tc.sess.serialize()))
+
+			assert.Equal(t, tc.sess, got)
+		})
+	}
+}
@@ -1,12 +1,21 @@
 package home
 
 import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
 	"sync"
 	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"golang.org/x/exp/slices"
 )
 
-// failedAuthTTL is the period of time for which the failed attempt will stay in
-// cache.
+// failedAuthTTL is the default period of time for which the failed attempt will
+// stay in cache.
 const failedAuthTTL = 1 * time.Minute
 
 // failedAuth is an entry of authRateLimiter's cache.
@@ -18,21 +27,47 @@ type failedAuth struct {
 // authRateLimiter used to cache failed authentication attempts.
 type authRateLimiter struct {
 	failedAuths map[string]failedAuth
+	// exempt are the networks of the attempters which are never blocked.  It
+	// may be nil.
+	exempt netutil.SubnetSet
 	// failedAuthsLock protects failedAuths.
 	failedAuthsLock sync.Mutex
 	blockDur        time.Duration
-	maxAttempts     uint
+	// window is the period of time during which the failed attempts are
+	// counted.
+	window      time.Duration
+	maxAttempts uint
 }
 
-// newAuthRateLimiter returns properly initialized *authRateLimiter.
-func newAuthRateLimiter(blockDur time.Duration, maxAttempts uint) (ab *authRateLimiter) {
+// newAuthRateLimiter returns properly initialized *authRateLimiter.  exempt may
+// be nil.
+func newAuthRateLimiter(
+	blockDur time.Duration,
+	window time.Duration,
+	maxAttempts uint,
+	exempt netutil.SubnetSet,
+) (ab *authRateLimiter) {
 	return &authRateLimiter{
 		failedAuths: make(map[string]failedAuth),
+		exempt:      exempt,
 		blockDur:    blockDur,
+		window:      window,
 		maxAttempts: maxAttempts,
 	}
 }
 
+// isExempt returns true if the attempter with usrID, which is an IP address,
+// is within the exempt networks.
+func (ab *authRateLimiter) isExempt(usrID string) (ok bool) {
+	if ab.exempt == nil {
+		return false
+	}
+
+	ip := net.ParseIP(usrID)
+
+	return ip != nil && ab.exempt.Contains(ip)
+}
+
 // cleanupLocked checks each blocked users removing ones with expired TTL.  For
 // internal use only.
 func (ab *authRateLimiter) cleanupLocked(now time.Time) {
@@ -60,6 +95,10 @@ func (ab *authRateLimiter) checkLocked(usrID string, now time.Time) (left time.D
 // check returns the time left until unblocking.  The nonpositive result should
 // be interpreted as not blocked attempter.
 func (ab *authRateLimiter) check(usrID string) (left time.Duration) {
+	if ab.isExempt(usrID) {
+		return 0
+	}
+
 	now := time.Now()
 
 	ab.failedAuthsLock.Lock()
@@ -73,7 +112,7 @@ func (ab *authRateLimiter) check(usrID string) (left time.Duration) {
 // incLocked increments the number of unsuccessful attempts for attempter with
 // usrID and updates it's blocking moment if needed.  For internal use only.
 func (ab *authRateLimiter) incLocked(usrID string, now time.Time) {
-	until := now.Add(failedAuthTTL)
+	until := now.Add(ab.window)
 	var attNum uint = 1
 
 	a, ok := ab.failedAuths[usrID]
@@ -93,6 +132,10 @@ func (ab *authRateLimiter) incLocked(usrID string, now time.Time) {
 
 // inc updates the failed attempt in cache.
 func (ab *authRateLimiter) inc(usrID string) {
+	if ab.isExempt(usrID) {
+		return
+	}
+
 	now := time.Now()
 
 	ab.failedAuthsLock.Lock()
@@ -108,3 +151,127 @@ func (ab *authRateLimiter) remove(usrID string) {
 
 	delete(ab.failedAuths, usrID)
 }
+
+// blockedAttempter is an attempter blocked after too many failed attempts.
+type blockedAttempter struct {
+	// until is the time of unblocking.
+	until time.Time
+
+	// usrID is the IP address of the attempter.
+	usrID string
+
+	// num is the number of the failed attempts.
+	num uint
+}
+
+// blocked returns the currently blocked attempters sorted by their IDs.
+func (ab *authRateLimiter) blocked() (attempters []*blockedAttempter) {
+	now := time.Now()
+
+	ab.failedAuthsLock.Lock()
+	defer ab.failedAuthsLock.Unlock()
+
+	ab.cleanupLocked(now)
+
+	for usrID, a := range ab.failedAuths {
+		if a.num >= ab.maxAttempts {
+			attempters = append(attempters, &blockedAttempter{
+				until: a.until,
+				usrID: usrID,
+				num:   a.num,
+			})
+		}
+	}
+
+	slices.SortFunc(attempters, func(a, b *blockedAttempter) (sortsBefore bool) {
+		return a.usrID < b.usrID
+	})
+
+	return attempters
+}
+
+// unblock stops the blocking of the attempter with usrID.  ok is false if it
+// isn't blocked.
+func (ab *authRateLimiter) unblock(usrID string) (ok bool) {
+	ab.failedAuthsLock.Lock()
+	defer ab.failedAuthsLock.Unlock()
+
+	a, ok := ab.failedAuths[usrID]
+	if !ok || a.num < ab.maxAttempts {
+		return false
+	}
+
+	delete(ab.failedAuths, usrID)
+
+	return true
+}
+
+// blockedAttempterJSON is the JSON form of a blocked attempter.
+type blockedAttempterJSON struct {
+	// Until is the time of unblocking in the RFC 3339 format.
+	Until string `json:"until"`
+
+	// IP is the IP address of the attempter.
+	IP string `json:"ip"`
+
+	// Attempts is the number of the failed login attempts.
+	Attempts uint `json:"attempts"`
+}
+
+// blockedJSON is the response to the GET /control/auth/blocked HTTP API.
+type blockedJSON struct {
+	// Blocked are the currently blocked addresses.
+	Blocked []*blockedAttempterJSON `json:"blocked"`
+}
+
+// handleGetBlocked is the handler for the GET /control/auth/blocked HTTP API.
+func handleGetBlocked(w http.ResponseWriter, r *http.Request) {
+	resp := &blockedJSON{
+		Blocked: []*blockedAttempterJSON{},
+	}
+
+	if rateLimiter := Context.auth.raleLimiter; rateLimiter != nil {
+		for _, a := range rateLimiter.blocked() {
+			resp.Blocked = append(resp.Blocked, &blockedAttempterJSON{
+				Until:    a.until.Format(time.RFC3339),
+				IP:       a.usrID,
+				Attempts: a.num,
+			})
+		}
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// unblockJSON is the request to the POST /control/auth/unblock HTTP API.
+type unblockJSON struct {
+	// IP is the IP address to unblock.
+	IP netip.Addr `json:"ip"`
+}
+
+// handleUnblock is the handler for the POST /control/auth/unblock HTTP API.
+func handleUnblock(w http.ResponseWriter, r *http.Request) {
+	req := &unblockJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	} else if !req.IP.IsValid() {
+		aghhttp.Error(r, w, http.StatusBadRequest, "ip is required")
+
+		return
+	}
+
+	// The attempters are identified by the string form of net.IP, which
+	// doesn't keep the IPv4-mapped IPv6 form.
+	ip := req.IP.Unmap().String()
+	rateLimiter := Context.auth.raleLimiter
+	if rateLimiter == nil || !rateLimiter.unblock(ip) {
+		aghhttp.Error(r, w, http.StatusNotFound, "%s is not blocked", ip)
+
+		return
+	}
+
+	log.Info("auth: %s unblocked manually", ip)
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -205,3 +206,57 @@ func TestAuthRateLimiter_Remove(t *testing.T) {
 
 	assert.Empty(t, ab.failedAuths)
 }
+
+func TestAuthRateLimiter_exempt(t *testing.T) {
+	_, exemptNet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+
+	ab := newAuthRateLimiter(
+		15*time.Minute,
+		failedAuthTTL,
+		1,
+		netutil.SliceSubnetSet([]*net.IPNet{exemptNet}),
+	)
+
+	const (
+		exemptAddr = "192.168.1.2"
+		otherAddr  = "192.168.2.2"
+	)
+
+	ab.inc(exemptAddr)
+	ab.inc(otherAddr)
+
+	assert.Zero(t, ab.check(exemptAddr))
+	assert.Greater(t, ab.check(otherAddr), time.Duration(0))
+}
+
+func TestAuthRateLimiter_blocked(t *testing.T) {
+	const maxAtt = 2
+
+	ab := newAuthRateLimiter(15*time.Minute, failedAuthTTL, maxAtt, nil)
+
+	const (
+		blockedAddr = "1.2.3.4"
+		trackedAddr = "5.6.7.8"
+	)
+
+	for i := 0; i < maxAtt; i++ {
+		ab.inc(blockedAddr)
+	}
+
+	ab.inc(trackedAddr)
+
+	blocked := ab.blocked()
+	require.Len(t, blocked, 1)
+
+	assert.Equal(t, blockedAddr, blocked[0].usrID)
+	assert.Equal(t, uint(maxAtt), blocked[0].num)
+	assert.True(t, blocked[0].until.After(time.Now()))
+
+	assert.False(t, ab.unblock(trackedAddr))
+	assert.True(t, ab.unblock(blockedAddr))
+	assert.False(t, ab.unblock(blockedAddr))
+
+	assert.Empty(t, ab.blocked())
+	assert.Zero(t, ab.check(blockedAddr))
+}
@@ -0,0 +1,974 @@
+package home
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/slices"
+)
+
+// userRole is the role of a user of the Web UI, which defines the HTTP APIs
+// available to them.
+type userRole string
+
+// userRole values.
+const (
+	// userRoleAdmin is allowed to do anything, including managing the other
+	// users.
+	userRoleAdmin userRole = "admin"
+
+	// userRoleOperator is allowed to do anything except managing the users.
+	userRoleOperator userRole = "operator"
+
+	// userRoleViewer is only allowed to view the data and the settings, except
+	// for the raw configuration sections, which may contain secrets.
+	userRoleViewer userRole = "viewer"
+)
+
+// validate returns an error if r is not a valid role.
+func (r userRole) validate() (err error) {
+	switch r {
+	case userRoleAdmin, userRoleOperator, userRoleViewer:
+		return nil
+	default:
+		return fmt.Errorf("bad role %q", r)
+	}
+}
+
+// isUsersPath returns true if p is a path of the users management HTTP APIs.
+func isUsersPath(p string) (ok bool) {
+	return p == "/control/users" || strings.HasPrefix(p, "/control/users/")
+}
+
+// isAuthPath returns true if p is a path of the login blocking management HTTP
+// APIs, which are only allowed to the administrators.
+func isAuthPath(p string) (ok bool) {
+	return strings.HasPrefix(p, "/control/auth/")
+}
+
+// isNotificationsPath returns true if p is a path of the email notifications
+// HTTP APIs, which are only allowed to the administrators, since the SMTP
+// credentials are used by them.
+func isNotificationsPath(p string) (ok bool) {
+	return p == "/control/notifications" || strings.HasPrefix(p, "/control/notifications/")
+}
+
+// isTOTPPath returns true if p is a path of the two-factor authentication
+// management HTTP APIs.  Every user may manage their own two-factor
+// authentication, which is checked by the handlers.
+func isTOTPPath(p string) (ok bool) {
+	return strings.HasPrefix(p, "/control/users/totp/")
+}
+
+// allows returns true if r allows the request with method to the path p.
+func (r userRole) allows(method, p string) (ok bool) {
+	if isTOTPPath(p) {
+		return r.validate() == nil
+	}
+
+	switch r {
+	case userRoleAdmin:
+		return true
+	case userRoleOperator:
+		return !isUsersPath(p) && !isAuthPath(p) && !isNotificationsPath(p)
+	case userRoleViewer:
+		return !isUsersPath(p) && !isAuthPath(p) && !isNotificationsPath(p) &&
+			!isConfigSectionPath(p) && (method == http.MethodGet || method == http.MethodHead)
+	default:
+		return false
+	}
+}
+
+// rank returns the privilege level of r.  The greater levels are more
+// privileged, and the invalid roles have the level of zero.
+func (r userRole) rank() (lvl int) {
+	switch r {
+	case userRoleAdmin:
+		return 3
+	case userRoleOperator:
+		return 2
+	case userRoleViewer:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// role returns the role of u.  Users without a role are administrators, since
+// that's how the users created before the roles were introduced should be
+// treated.
+func (u *webUser) role() (r userRole) {
+	if u.Role == "" {
+		return userRoleAdmin
+	}
+
+	return u.Role
+}
+
+// queryLogRedaction returns the fields of the query log entries hidden from the
+// user making r according to their role.
+func queryLogRedaction(r *http.Request) (red querylog.Redaction) {
+	if Context.auth == nil {
+		return querylog.Redaction{}
+	}
+
+	u := Context.auth.getCurrentUser(r)
+
+	config.RLock()
+	defer config.RUnlock()
+
+	return config.QueryLog.Redaction[u.role()]
+}
+
+// logAudit records the data-modifying request r made by u.
+func logAudit(u *webUser, r *http.Request) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return
+	}
+
+	log.Info("auth: audit: user %q (%s): %s %s", u.Name, u.role(), r.Method, r.URL.Path)
+}
+
+const (
+	// totpPeriod is the time step of the TOTP codes, see RFC 6238.
+	totpPeriod = 30 * time.Second
+
+	// totpDigits is the number of digits in the TOTP codes.
+	totpDigits = 6
+
+	// totpSecretLen is the length of the TOTP secrets in bytes.
+	totpSecretLen = 20
+
+	// totpMinSecretLen is the minimum length of the TOTP secrets from the
+	// configuration file in bytes, see RFC 4226.
+	totpMinSecretLen = 16
+
+	// totpIssuer is the issuer of the TOTP secrets shown in authenticator
+	// apps.
+	totpIssuer = "AdGuard Home"
+
+	// recoveryCodesNum is the number of the recovery codes generated for a
+	// user.
+	recoveryCodesNum = 10
+
+	// recoveryCodeLen is the length of the recovery codes in bytes.
+	recoveryCodeLen = 10
+)
+
+// totpEncoding is the encoding of the TOTP secrets, as expected by the
+// authenticator apps.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a new random TOTP secret encoded with totpEncoding.
+func newTOTPSecret() (secret string, err error) {
+	key := make([]byte, totpSecretLen)
+	_, err = rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// validateTOTPSecret returns an error if secret is not a valid TOTP secret.
+func validateTOTPSecret(secret string) (err error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return fmt.Errorf("bad totp secret: %w", err)
+	} else if len(key) < totpMinSecretLen {
+		return fmt.Errorf(
+			"bad totp secret: got %d bytes, want at least %d",
+			len(key),
+			totpMinSecretLen,
+		)
+	}
+
+	return nil
+}
+
+// newRecoveryCodes returns new random recovery codes and their hashes, see
+// [hashRecoveryCode].
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	codes = make([]string, 0, recoveryCodesNum)
+	hashes = make([]string, 0, recoveryCodesNum)
+	for i := 0; i < recoveryCodesNum; i++ {
+		key := make([]byte, recoveryCodeLen)
+		_, err = rand.Read(key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Split the code into groups of four characters for readability.
+		enc := strings.ToLower(totpEncoding.EncodeToString(key))
+		groups := make([]string, 0, len(enc)/4)
+		for ; len(enc) > 4; enc = enc[4:] {
+			groups = append(groups, enc[:4])
+		}
+
+		code := strings.Join(append(groups, enc), "-")
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hex-encoded SHA-256 hash of the recovery code,
+// ignoring the case and the separators.  The codes are long random strings, so
+// there is no need in a slow password hash, which would make checking all of
+// the user's codes on each login too slow.
+func hashRecoveryCode(code string) (hash string) {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// validateRecoveryCodes returns an error if hashes aren't valid hashes of the
+// recovery codes.
+func validateRecoveryCodes(hashes []string) (err error) {
+	for i, h := range hashes {
+		b, decErr := hex.DecodeString(h)
+		if decErr != nil || len(b) != sha256.Size {
+			return fmt.Errorf("bad recovery code hash at index %d", i)
+		}
+	}
+
+	return nil
+}
+
+// validateUsers returns an error if any of the users from the configuration
+// file has an invalid role, TOTP secret, or recovery codes.
+func validateUsers(users []webUser) (err error) {
+	for i, u := range users {
+		if u.Role != "" {
+			err = u.Role.validate()
+		}
+
+		if err == nil && u.TOTPSecret != "" {
+			err = validateTOTPSecret(u.TOTPSecret)
+		}
+
+		if err == nil {
+			err = validateRecoveryCodes(u.RecoveryCodes)
+		}
+
+		if err != nil {
+			return fmt.Errorf("user %q at index %d: %w", u.Name, i, err)
+		}
+	}
+
+	return nil
+}
+
+// totpURL returns the key URI of the secret for the user with name, to be used
+// in authenticator apps.
+func totpURL(name, secret string) (u string) {
+	return (&url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + totpIssuer + ":" + name,
+		RawQuery: url.Values{
+			"secret": []string{secret},
+			"issuer": []string{totpIssuer},
+		}.Encode(),
+	}).String()
+}
+
+// totpCode returns the code for key at the time step counter, see RFC 4226.
+func totpCode(key []byte, counter uint64) (code string) {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, key)
+	_, _ = mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, v%1_000_000)
+}
+
+// matchTOTP returns the time step of the code valid for secret at now, the
+// adjacent steps included to account for the clock drift.  ok is false if the
+// code doesn't match.
+func matchTOTP(secret, code string, now time.Time) (counter uint64, ok bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		log.Error("auth: decoding totp secret: %s", err)
+
+		return 0, false
+	}
+
+	cur := uint64(now.Unix() / int64(totpPeriod/time.Second))
+	for _, c := range []uint64{cur - 1, cur, cur + 1} {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, c)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+
+	return 0, false
+}
+
+// checkTOTP returns true if code is a valid TOTP code for u which hasn't been
+// used before.
+func (a *Auth) checkTOTP(u *webUser, code string) (ok bool) {
+	counter, ok := matchTOTP(u.TOTPSecret, code, time.Now())
+	if !ok {
+		return false
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if last, used := a.totpUsed[u.Name]; used && counter <= last {
+		log.Info("auth: reused totp code for user %q", u.Name)
+
+		return false
+	}
+
+	a.totpUsed[u.Name] = counter
+
+	return true
+}
+
+// useRecoveryCode returns true if code is one of the recovery codes of u.  The
+// matched code is removed, so that it can't be used again.
+func (a *Auth) useRecoveryCode(u *webUser, code string) (ok bool) {
+	hash := []byte(hashRecoveryCode(code))
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	i := a.userIndexLocked(u.Name)
+	if i < 0 {
+		return false
+	}
+
+	codes := a.users[i].RecoveryCodes
+	j := slices.IndexFunc(codes, func(h string) (found bool) {
+		return subtle.ConstantTimeCompare([]byte(h), hash) == 1
+	})
+	if j < 0 {
+		return false
+	}
+
+	users := slices.Clone(a.users)
+	users[i].RecoveryCodes = slices.Delete(slices.Clone(codes), j, j+1)
+	a.users = users
+
+	log.Info("auth: user %q used a recovery code, %d left", u.Name, len(codes)-1)
+
+	return true
+}
+
+// userIndexLocked returns the index of the user with name, or -1 if there is no
+// such user.  a.lock is expected to be locked.
+func (a *Auth) userIndexLocked(name string) (i int) {
+	return slices.IndexFunc(a.users, func(u webUser) (ok bool) { return u.Name == name })
+}
+
+// isLastAdminLocked returns true if the user at index i is the only
+// administrator.  a.lock is expected to be locked.
+func (a *Auth) isLastAdminLocked(i int) (ok bool) {
+	if a.users[i].role() != userRoleAdmin {
+		return false
+	}
+
+	for j, u := range a.users {
+		if j != i && u.role() == userRoleAdmin {
+			return false
+		}
+	}
+
+	return true
+}
+
+// errUserNotFound is returned when there is no user with the requested name.
+const errUserNotFound errors.Error = "user not found"
+
+// errLastAdmin is returned when a change would leave no administrators.
+const errLastAdmin errors.Error = "cannot remove the last admin"
+
+// errInvalidTOTP is returned when the two-factor authentication code is not
+// valid.
+const errInvalidTOTP errors.Error = "invalid two-factor authentication code"
+
+// errNoPendingTOTP is returned when there is no TOTP secret to confirm.
+const errNoPendingTOTP errors.Error = "two-factor authentication is not being enabled"
+
+// errTOTPDisabled is returned when an operation requires the two-factor
+// authentication to be enabled.
+const errTOTPDisabled errors.Error = "two-factor authentication is not enabled"
+
+// addUser adds a new user with password.
+func (a *Auth) addUser(u webUser, password string) (err error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hashing password: %w", err)
+	}
+
+	u.PasswordHash = string(hash)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.userIndexLocked(u.Name) >= 0 {
+		return fmt.Errorf("user %q already exists", u.Name)
+	}
+
+	// Don't modify the slice in place, since it may be used by the config.
+	a.users = append(slices.Clip(a.users), u)
+
+	log.Debug("auth: added user %q with role %s", u.Name, u.role())
+
+	return nil
+}
+
+// updateUser sets the password of the user with name to password, if it's not
+// empty, and the role to role, if it's not empty.
+func (a *Auth) updateUser(name, password string, role userRole) (err error) {
+	var hash []byte
+	if password != "" {
+		hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("hashing password: %w", err)
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	i := a.userIndexLocked(name)
+	if i < 0 {
+		return errUserNotFound
+	} else if role != "" && role != userRoleAdmin && a.isLastAdminLocked(i) {
+		return errLastAdmin
+	}
+
+	users := slices.Clone(a.users)
+	if hash != nil {
+		users[i].PasswordHash = string(hash)
+	}
+
+	if role != "" {
+		users[i].Role = role
+	}
+
+	a.users = users
+
+	log.Debug("auth: updated user %q", name)
+
+	return nil
+}
+
+// disableTOTP disables the two-factor authentication of the user with name and
+// removes their recovery codes.
+func (a *Auth) disableTOTP(name string) (err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	i := a.userIndexLocked(name)
+	if i < 0 {
+		return errUserNotFound
+	}
+
+	a.setTOTPSecretLocked(i, "", nil)
+	delete(a.totpUsed, name)
+
+	return nil
+}
+
+// setTOTPSecretLocked sets the TOTP secret and the hashes of the recovery
+// codes of the user at index i and drops the pending secret.  a.lock is
+// expected to be locked.
+func (a *Auth) setTOTPSecretLocked(i int, secret string, recoveryHashes []string) {
+	users := slices.Clone(a.users)
+	users[i].TOTPSecret = secret
+	users[i].RecoveryCodes = recoveryHashes
+	a.users = users
+
+	delete(a.totpPending, users[i].Name)
+}
+
+// setRecoveryCodes replaces the recovery codes of the user with name, who must
+// have the two-factor authentication enabled, with the ones with hashes.
+func (a *Auth) setRecoveryCodes(name string, hashes []string) (err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	i := a.userIndexLocked(name)
+	if i < 0 {
+		return errUserNotFound
+	} else if a.users[i].TOTPSecret == "" {
+		return errTOTPDisabled
+	}
+
+	a.setTOTPSecretLocked(i, a.users[i].TOTPSecret, hashes)
+
+	return nil
+}
+
+// setPendingTOTPSecret sets the TOTP secret of the user with name which only
+// takes effect after it's confirmed with [Auth.confirmTOTPSecret].
+func (a *Auth) setPendingTOTPSecret(name, secret string) (err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.userIndexLocked(name) < 0 {
+		return errUserNotFound
+	}
+
+	a.totpPending[name] = secret
+
+	return nil
+}
+
+// confirmTOTPSecret enables the two-factor authentication for the user with
+// name using the pending secret, if code is valid for it, and sets the hashes
+// of their recovery codes.  All sessions of the user except keepSess, which may
+// be empty, are removed, since they were created without the two-factor
+// authentication.
+func (a *Auth) confirmTOTPSecret(
+	name string,
+	code string,
+	recoveryHashes []string,
+	keepSess string,
+) (err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	i := a.userIndexLocked(name)
+	if i < 0 {
+		return errUserNotFound
+	}
+
+	secret, ok := a.totpPending[name]
+	if !ok {
+		return errNoPendingTOTP
+	}
+
+	counter, ok := matchTOTP(secret, code, time.Now())
+	if !ok {
+		return errInvalidTOTP
+	}
+
+	a.setTOTPSecretLocked(i, secret, recoveryHashes)
+
+	// Don't accept the confirmation code for logging in.
+	a.totpUsed[name] = counter
+
+	a.removeUserSessionsLocked(name, keepSess)
+
+	return nil
+}
+
+// removeUser removes the user with name and all their sessions.
+func (a *Auth) removeUser(name string) (err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	i := a.userIndexLocked(name)
+	if i < 0 {
+		return errUserNotFound
+	} else if a.isLastAdminLocked(i) {
+		return errLastAdmin
+	}
+
+	a.users = slices.Delete(slices.Clone(a.users), i, i+1)
+	delete(a.totpUsed, name)
+	delete(a.totpPending, name)
+
+	a.removeUserSessionsLocked(name, "")
+
+	log.Debug("auth: removed user %q", name)
+
+	return nil
+}
+
+// removeUserSessionsLocked removes all sessions of the user with name except
+// keep, which may be empty.  The sessions of the external users with the same
+// name are kept.  a.lock is expected to be locked.
+func (a *Auth) removeUserSessionsLocked(name, keep string) {
+	for sess, s := range a.sessions {
+		if s.userName != name || s.role != "" || sess == keep {
+			continue
+		}
+
+		delete(a.sessions, sess)
+		key, _ := hex.DecodeString(sess)
+		a.removeSession(key)
+	}
+}
+
+// userJSON is the JSON representation of a user of the Web UI.
+type userJSON struct {
+	Name        string   `json:"name"`
+	Role        userRole `json:"role"`
+	TOTPEnabled bool     `json:"totp_enabled"`
+}
+
+// usersJSON is the response to the GET /control/users HTTP API.
+type usersJSON struct {
+	Users []*userJSON `json:"users"`
+}
+
+// handleGetUsers is the handler for the GET /control/users HTTP API.
+func handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	users := Context.auth.GetUsers()
+
+	resp := &usersJSON{
+		Users: make([]*userJSON, 0, len(users)),
+	}
+
+	for _, u := range users {
+		resp.Users = append(resp.Users, &userJSON{
+			Name:        u.Name,
+			Role:        u.role(),
+			TOTPEnabled: u.TOTPSecret != "",
+		})
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// userReqJSON is the request to the POST /control/users/add HTTP API and the
+// data of the request to the POST /control/users/update HTTP API.
+type userReqJSON struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password"`
+	Role     userRole `json:"role"`
+}
+
+// handleAddUser is the handler for the POST /control/users/add HTTP API.
+func handleAddUser(w http.ResponseWriter, r *http.Request) {
+	req := &userReqJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	if req.Name == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "user's name must be non-empty")
+
+		return
+	} else if req.Password == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "user's password must be non-empty")
+
+		return
+	} else if err = req.Role.validate(); err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	err = Context.auth.addUser(webUser{Name: req.Name, Role: req.Role}, req.Password)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// userUpdateJSON is the request to the POST /control/users/update HTTP API.
+type userUpdateJSON struct {
+	Name string      `json:"name"`
+	Data userReqJSON `json:"data"`
+}
+
+// handleUpdateUser is the handler for the POST /control/users/update HTTP API.
+// The empty fields of the data are left unchanged.
+func handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	req := &userUpdateJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	if req.Name == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "user's name must be non-empty")
+
+		return
+	} else if req.Data.Name != "" && req.Data.Name != req.Name {
+		aghhttp.Error(r, w, http.StatusBadRequest, "renaming users is not supported")
+
+		return
+	}
+
+	if role := req.Data.Role; role != "" {
+		if err = role.validate(); err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+			return
+		}
+	}
+
+	err = Context.auth.updateUser(req.Name, req.Data.Password, req.Data.Role)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// userNameJSON is the request to the HTTP APIs for a single user.
+type userNameJSON struct {
+	Name string `json:"name"`
+}
+
+// canManageTOTP returns true if the current user may manage the two-factor
+// authentication of the user with name, which is the case for the user
+// themselves and for the admins.  Otherwise, it writes an error response.
+func canManageTOTP(w http.ResponseWriter, r *http.Request, name string) (ok bool) {
+	u := Context.auth.getCurrentUser(r)
+	if u.Name == name || (u.Name != "" && u.role() == userRoleAdmin) {
+		return true
+	}
+
+	aghhttp.Error(r, w, http.StatusForbidden, "not allowed to manage two-factor authentication of %q", name)
+
+	return false
+}
+
+// decodeTOTPUserName decodes the request with a user's name from r and checks
+// that the current user may manage their two-factor authentication.  It writes
+// an error response and returns false on failure.
+func decodeTOTPUserName(w http.ResponseWriter, r *http.Request) (name string, ok bool) {
+	name, ok = decodeUserName(w, r)
+	if !ok {
+		return "", false
+	}
+
+	return name, canManageTOTP(w, r, name)
+}
+
+// decodeUserName decodes the request with a user's name from r.  It writes an
+// error response and returns false on failure.
+func decodeUserName(w http.ResponseWriter, r *http.Request) (name string, ok bool) {
+	req := &userNameJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return "", false
+	} else if req.Name == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "user's name must be non-empty")
+
+		return "", false
+	}
+
+	return req.Name, true
+}
+
+// handleDeleteUser is the handler for the POST /control/users/delete HTTP API.
+func handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	name, ok := decodeUserName(w, r)
+	if !ok {
+		return
+	}
+
+	err := Context.auth.removeUser(name)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// totpJSON is the response to the POST /control/users/totp/enable HTTP API.
+type totpJSON struct {
+	// Secret is the TOTP secret encoded with base32.
+	Secret string `json:"secret"`
+
+	// URL is the key URI of the secret for the authenticator apps.
+	URL string `json:"url"`
+
+	// QRCode is the PNG image of the QR code with URL as a data URL.
+	QRCode string `json:"qr_code"`
+}
+
+// handleEnableTOTP is the handler for the POST /control/users/totp/enable HTTP
+// API.  It generates a new TOTP secret for the user which only replaces the
+// previous one, if any, after it's confirmed using the POST
+// /control/users/totp/verify HTTP API.
+func handleEnableTOTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := decodeTOTPUserName(w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "generating secret: %s", err)
+
+		return
+	}
+
+	err = Context.auth.setPendingTOTPSecret(name, secret)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	u := totpURL(name, secret)
+	qr, err := qrDataURL(u)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "generating qr code: %s", err)
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, &totpJSON{
+		Secret: secret,
+		URL:    u,
+		QRCode: qr,
+	})
+}
+
+// recoveryCodesJSON is the response to the POST /control/users/totp/verify and
+// POST /control/users/totp/recovery_codes HTTP APIs.
+type recoveryCodesJSON struct {
+	// RecoveryCodes are the one-time codes which can be used instead of the
+	// TOTP codes.  They're only shown once.
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// totpVerifyJSON is the request to the POST /control/users/totp/verify HTTP
+// API.
+type totpVerifyJSON struct {
+	Name string `json:"name"`
+	Code string `json:"code"`
+}
+
+// handleVerifyTOTP is the handler for the POST /control/users/totp/verify HTTP
+// API.  It enables the two-factor authentication with the secret generated by
+// the POST /control/users/totp/enable HTTP API if the code is valid for it and
+// responds with new recovery codes.  The other sessions of the user are
+// terminated.
+func handleVerifyTOTP(w http.ResponseWriter, r *http.Request) {
+	req := &totpVerifyJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	} else if req.Name == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "user's name must be non-empty")
+
+		return
+	}
+
+	if !canManageTOTP(w, r, req.Name) {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "generating recovery codes: %s", err)
+
+		return
+	}
+
+	var keepSess string
+	if c, cErr := r.Cookie(sessionCookieName); cErr == nil {
+		keepSess = c.Value
+	}
+
+	err = Context.auth.confirmTOTPSecret(req.Name, req.Code, hashes, keepSess)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+
+	_ = aghhttp.WriteJSONResponse(w, r, &recoveryCodesJSON{RecoveryCodes: codes})
+}
+
+// handleRecoveryCodes is the handler for the POST
+// /control/users/totp/recovery_codes HTTP API.  It replaces the recovery codes
+// of the user with new ones.
+func handleRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	name, ok := decodeTOTPUserName(w, r)
+	if !ok {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "generating recovery codes: %s", err)
+
+		return
+	}
+
+	err = Context.auth.setRecoveryCodes(name, hashes)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+
+	_ = aghhttp.WriteJSONResponse(w, r, &recoveryCodesJSON{RecoveryCodes: codes})
+}
+
+// handleDisableTOTP is the handler for the POST /control/users/totp/disable
+// HTTP API.
+func handleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	name, ok := decodeTOTPUserName(w, r)
+	if !ok {
+		return
+	}
+
+	err := Context.auth.disableTOTP(name)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// registerUsersHandlers registers the HTTP handlers for the users management.
+func registerUsersHandlers() {
+	httpRegister(http.MethodGet, "/control/users", handleGetUsers)
+	httpRegister(http.MethodPost, "/control/users/add", handleAddUser)
+	httpRegister(http.MethodPost, "/control/users/update", handleUpdateUser)
+	httpRegister(http.MethodPost, "/control/users/delete", handleDeleteUser)
+	httpRegister(http.MethodPost, "/control/users/totp/enable", handleEnableTOTP)
+	httpRegister(http.MethodPost, "/control/users/totp/verify", handleVerifyTOTP)
+	httpRegister(http.MethodPost, "/control/users/totp/recovery_codes", handleRecoveryCodes)
+	httpRegister(http.MethodPost, "/control/users/totp/disable", handleDisableTOTP)
+}
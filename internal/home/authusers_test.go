@@ -0,0 +1,394 @@
+package home
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTOTPSecret is the secret from the test vectors of RFC 6238 encoded with
+// totpEncoding.
+var testTOTPSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestMatchTOTP(t *testing.T) {
+	// The code for the time of 59 seconds from the test vectors of RFC 6238,
+	// truncated to totpDigits.
+	const code = "287082"
+
+	testCases := []struct {
+		name    string
+		code    string
+		now     time.Time
+		wantOK  bool
+		wantCtr uint64
+	}{{
+		name:    "exact",
+		code:    code,
+		now:     time.Unix(59, 0),
+		wantOK:  true,
+		wantCtr: 1,
+	}, {
+		name:    "drift",
+		code:    code,
+		now:     time.Unix(89, 0),
+		wantOK:  true,
+		wantCtr: 1,
+	}, {
+		name:    "expired",
+		code:    code,
+		now:     time.Unix(119, 0),
+		wantOK:  false,
+		wantCtr: 0,
+	}, {
+		name:    "bad",
+		code:    "123456",
+		now:     time.Unix(59, 0),
+		wantOK:  false,
+		wantCtr: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctr, ok := matchTOTP(testTOTPSecret, tc.code, tc.now)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantCtr, ctr)
+		})
+	}
+}
+
+func TestUserRole_allows(t *testing.T) {
+	testCases := []struct {
+		name   string
+		role   userRole
+		method string
+		path   string
+		want   bool
+	}{{
+		name:   "admin_users",
+		role:   userRoleAdmin,
+		method: http.MethodPost,
+		path:   "/control/users/add",
+		want:   true,
+	}, {
+		name:   "operator_users",
+		role:   userRoleOperator,
+		method: http.MethodGet,
+		path:   "/control/users",
+		want:   false,
+	}, {
+		name:   "operator_post",
+		role:   userRoleOperator,
+		method: http.MethodPost,
+		path:   "/control/filtering/refresh",
+		want:   true,
+	}, {
+		name:   "viewer_get",
+		role:   userRoleViewer,
+		method: http.MethodGet,
+		path:   "/control/status",
+		want:   true,
+	}, {
+		name:   "viewer_post",
+		role:   userRoleViewer,
+		method: http.MethodPost,
+		path:   "/control/filtering/refresh",
+		want:   false,
+	}, {
+		name:   "viewer_users",
+		role:   userRoleViewer,
+		method: http.MethodGet,
+		path:   "/control/users",
+		want:   false,
+	}, {
+		name:   "viewer_totp",
+		role:   userRoleViewer,
+		method: http.MethodPost,
+		path:   "/control/users/totp/enable",
+		want:   true,
+	}, {
+		name:   "operator_auth",
+		role:   userRoleOperator,
+		method: http.MethodPost,
+		path:   "/control/auth/unblock",
+		want:   false,
+	}, {
+		name:   "admin_auth",
+		role:   userRoleAdmin,
+		method: http.MethodGet,
+		path:   "/control/auth/blocked",
+		want:   true,
+	}, {
+		name:   "viewer_config_section",
+		role:   userRoleViewer,
+		method: http.MethodGet,
+		path:   "/control/config/tls",
+		want:   false,
+	}, {
+		name:   "operator_config_section",
+		role:   userRoleOperator,
+		method: http.MethodPut,
+		path:   "/control/config/dns/update",
+		want:   true,
+	}, {
+		name:   "operator_notifications",
+		role:   userRoleOperator,
+		method: http.MethodPost,
+		path:   "/control/notifications/test",
+		want:   false,
+	}, {
+		name:   "admin_notifications",
+		role:   userRoleAdmin,
+		method: http.MethodGet,
+		path:   "/control/notifications",
+		want:   true,
+	}, {
+		name:   "unknown",
+		role:   "superuser",
+		method: http.MethodGet,
+		path:   "/control/status",
+		want:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.role.allows(tc.method, tc.path))
+		})
+	}
+}
+
+func TestAuth_users(t *testing.T) {
+	a := InitAuth(filepath.Join(t.TempDir(), "sessions.db"), nil, 60, nil, nil)
+	require.NotNil(t, a)
+
+	t.Cleanup(a.Close)
+
+	require.NoError(t, a.addUser(webUser{Name: "admin"}, "password"))
+	require.NoError(t, a.addUser(webUser{Name: "viewer", Role: userRoleViewer}, "password"))
+
+	err := a.addUser(webUser{Name: "viewer"}, "password")
+	testutil.AssertErrorMsg(t, `user "viewer" already exists`, err)
+
+	err = a.updateUser("admin", "", userRoleOperator)
+	assert.ErrorIs(t, err, errLastAdmin)
+
+	err = a.removeUser("admin")
+	assert.ErrorIs(t, err, errLastAdmin)
+
+	err = a.updateUser("none", "", userRoleOperator)
+	assert.ErrorIs(t, err, errUserNotFound)
+
+	require.NoError(t, a.updateUser("viewer", "new-password", userRoleAdmin))
+
+	_, ok := a.findUser("viewer", "new-password")
+	assert.True(t, ok)
+
+	require.NoError(t, a.removeUser("admin"))
+
+	users := a.GetUsers()
+	require.Len(t, users, 1)
+
+	assert.Equal(t, "viewer", users[0].Name)
+	assert.Equal(t, userRoleAdmin, users[0].role())
+}
+
+func TestAuth_newCookie_totp(t *testing.T) {
+	a := InitAuth(filepath.Join(t.TempDir(), "sessions.db"), nil, 60, nil, nil)
+	require.NotNil(t, a)
+
+	t.Cleanup(a.Close)
+
+	secret, err := newTOTPSecret()
+	require.NoError(t, err)
+
+	require.NoError(t, a.addUser(webUser{Name: "name", TOTPSecret: secret}, "password"))
+
+	req := loginJSON{Name: "name", Password: "password"}
+	_, err = a.newCookie(req, "")
+	testutil.AssertErrorMsg(t, "two-factor authentication code required", err)
+
+	req.TOTP = "000000x"
+	_, err = a.newCookie(req, "")
+	testutil.AssertErrorMsg(t, "invalid two-factor authentication code", err)
+
+	key, err := totpEncoding.DecodeString(secret)
+	require.NoError(t, err)
+
+	req.TOTP = totpCode(key, uint64(time.Now().Unix()/int64(totpPeriod/time.Second)))
+	c, err := a.newCookie(req, "")
+	require.NoError(t, err)
+
+	assert.Equal(t, checkSessionOK, a.checkSession(c.Value))
+
+	// The code must not be accepted twice.
+	_, err = a.newCookie(req, "")
+	testutil.AssertErrorMsg(t, "invalid two-factor authentication code", err)
+}
+
+func TestAuth_confirmTOTPSecret(t *testing.T) {
+	a := InitAuth(filepath.Join(t.TempDir(), "sessions.db"), nil, 60, nil, nil)
+	require.NotNil(t, a)
+
+	t.Cleanup(a.Close)
+
+	require.NoError(t, a.addUser(webUser{Name: "name"}, "password"))
+
+	err := a.confirmTOTPSecret("name", "000000", nil, "")
+	assert.ErrorIs(t, err, errNoPendingTOTP)
+
+	secret, err := newTOTPSecret()
+	require.NoError(t, err)
+
+	require.NoError(t, a.setPendingTOTPSecret("name", secret))
+
+	// The pending secret isn't required for logging in.
+	kept, err := a.newCookie(loginJSON{Name: "name", Password: "password"}, "")
+	require.NoError(t, err)
+
+	other, err := a.newCookie(loginJSON{Name: "name", Password: "password"}, "")
+	require.NoError(t, err)
+
+	err = a.confirmTOTPSecret("name", "000000x", nil, "")
+	assert.ErrorIs(t, err, errInvalidTOTP)
+
+	key, err := totpEncoding.DecodeString(secret)
+	require.NoError(t, err)
+
+	code := totpCode(key, uint64(time.Now().Unix()/int64(totpPeriod/time.Second)))
+	_, hashes, err := newRecoveryCodes()
+	require.NoError(t, err)
+
+	require.NoError(t, a.confirmTOTPSecret("name", code, hashes, kept.Value))
+
+	users := a.GetUsers()
+	require.Len(t, users, 1)
+
+	assert.Equal(t, secret, users[0].TOTPSecret)
+	assert.Equal(t, hashes, users[0].RecoveryCodes)
+
+	// The sessions created without the two-factor authentication must be
+	// removed, except for the one used to enable it.
+	assert.Equal(t, checkSessionOK, a.checkSession(kept.Value))
+	assert.Equal(t, checkSessionNotFound, a.checkSession(other.Value))
+
+	// The confirmation code must not be accepted for logging in.
+	_, err = a.newCookie(loginJSON{Name: "name", Password: "password", TOTP: code}, "")
+	assert.ErrorIs(t, err, errInvalidTOTP)
+}
+
+func TestValidateUsers(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		users      []webUser
+	}{{
+		name:       "valid",
+		wantErrMsg: "",
+		users: []webUser{{
+			Name: "admin",
+		}, {
+			Name:       "viewer",
+			Role:       userRoleViewer,
+			TOTPSecret: testTOTPSecret,
+		}},
+	}, {
+		name:       "bad_role",
+		wantErrMsg: `user "root" at index 0: bad role "root"`,
+		users: []webUser{{
+			Name: "root",
+			Role: "root",
+		}},
+	}, {
+		name: "bad_secret",
+		wantErrMsg: `user "admin" at index 0: bad totp secret: ` +
+			`illegal base32 data at input byte 0`,
+		users: []webUser{{
+			Name:       "admin",
+			TOTPSecret: "!!!",
+		}},
+	}, {
+		name:       "bad_recovery_code",
+		wantErrMsg: `user "admin" at index 0: bad recovery code hash at index 0`,
+		users: []webUser{{
+			Name:          "admin",
+			TOTPSecret:    testTOTPSecret,
+			RecoveryCodes: []string{"abcd"},
+		}},
+	}, {
+		name:       "short_secret",
+		wantErrMsg: `user "admin" at index 0: bad totp secret: got 5 bytes, want at least 16`,
+		users: []webUser{{
+			Name:       "admin",
+			TOTPSecret: "ABCDEFGH",
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, validateUsers(tc.users))
+		})
+	}
+}
+
+func TestAuth_newCookie_recoveryCode(t *testing.T) {
+	a := InitAuth(filepath.Join(t.TempDir(), "sessions.db"), nil, 60, nil, nil)
+	require.NotNil(t, a)
+
+	t.Cleanup(a.Close)
+
+	codes, hashes, err := newRecoveryCodes()
+	require.NoError(t, err)
+	require.Len(t, codes, recoveryCodesNum)
+
+	u := webUser{
+		Name:          "name",
+		TOTPSecret:    testTOTPSecret,
+		RecoveryCodes: hashes,
+	}
+	require.NoError(t, a.addUser(u, "password"))
+
+	req := loginJSON{Name: "name", Password: "password", RecoveryCode: "aaaa-bbbb"}
+	_, err = a.newCookie(req, "")
+	assert.ErrorIs(t, err, errInvalidTOTP)
+
+	// The codes are accepted regardless of the case and the separators.
+	req.RecoveryCode = strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	c, err := a.newCookie(req, "")
+	require.NoError(t, err)
+
+	assert.Equal(t, checkSessionOK, a.checkSession(c.Value))
+
+	// The code must not be accepted twice.
+	_, err = a.newCookie(req, "")
+	assert.ErrorIs(t, err, errInvalidTOTP)
+
+	users := a.GetUsers()
+	require.Len(t, users, 1)
+
+	assert.Equal(t, hashes[1:], users[0].RecoveryCodes)
+
+	_, newHashes, err := newRecoveryCodes()
+	require.NoError(t, err)
+
+	require.NoError(t, a.setRecoveryCodes("name", newHashes))
+
+	req.RecoveryCode = codes[1]
+	_, err = a.newCookie(req, "")
+	assert.ErrorIs(t, err, errInvalidTOTP)
+
+	require.NoError(t, a.disableTOTP("name"))
+
+	users = a.GetUsers()
+	require.Len(t, users, 1)
+
+	assert.Empty(t, users[0].TOTPSecret)
+	assert.Empty(t, users[0].RecoveryCodes)
+
+	err = a.setRecoveryCodes("name", newHashes)
+	assert.ErrorIs(t, err, errTOTPDisabled)
+}
@@ -0,0 +1,381 @@
+package home
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// captureConfig is the configuration of the capture mode, in which the A
+// queries of the unknown local clients are answered with the address of
+// AdGuard Home until the clients are acknowledged, so that they are shown the
+// landing page first.
+type captureConfig struct {
+	// IP is the IPv4 address of AdGuard Home the A queries of the captured
+	// clients are answered with.
+	IP netip.Addr `yaml:"ip"`
+
+	// LandingAddress is the address the landing page server listens on, for
+	// example ":80".  If empty, the landing page isn't served.
+	LandingAddress string `yaml:"landing_address"`
+
+	// Terms is the text shown on the landing page.
+	Terms string `yaml:"terms"`
+
+	// Acknowledged are the IP addresses of the clients which aren't captured
+	// anymore.
+	Acknowledged []netip.Addr `yaml:"acknowledged"`
+
+	// Enabled defines if the capture mode is enabled.
+	Enabled bool `yaml:"enabled"`
+}
+
+// captureMaxPending is the maximum number of the captured clients waiting for
+// the acknowledgment which are remembered.
+const captureMaxPending = 1000
+
+// capturePortal captures the unknown local clients and serves the landing page
+// for them.
+type capturePortal struct {
+	// isKnown returns true if ip belongs to a persistent client.  Known
+	// clients are never captured.
+	isKnown func(ip netip.Addr) (ok bool)
+
+	// landing is the landing page server.  It's nil if the landing page isn't
+	// served.
+	landing *http.Server
+
+	// mu protects acked and pending.
+	mu *sync.Mutex
+
+	// acked is the set of the acknowledged clients.
+	acked map[netip.Addr]struct{}
+
+	// pending are the last times the captured clients have been seen.
+	pending map[netip.Addr]time.Time
+
+	// terms is the text shown on the landing page.
+	terms string
+
+	// ip is the address the A queries of the captured clients are answered
+	// with.
+	ip netip.Addr
+}
+
+// newCapturePortal returns a new properly initialized *capturePortal.  conf
+// must not be nil.
+func newCapturePortal(
+	conf *captureConfig,
+	isKnown func(ip netip.Addr) (ok bool),
+) (p *capturePortal, err error) {
+	if !conf.IP.Is4() {
+		return nil, fmt.Errorf("ip: %q is not an ipv4 address", conf.IP)
+	}
+
+	acked := make(map[netip.Addr]struct{}, len(conf.Acknowledged))
+	for _, ip := range conf.Acknowledged {
+		acked[ip] = struct{}{}
+	}
+
+	p = &capturePortal{
+		isKnown: isKnown,
+		mu:      &sync.Mutex{},
+		acked:   acked,
+		pending: map[netip.Addr]time.Time{},
+		terms:   conf.Terms,
+		ip:      conf.IP,
+	}
+
+	if conf.LandingAddress != "" {
+		p.landing = &http.Server{
+			Addr:              conf.LandingAddress,
+			Handler:           http.HandlerFunc(p.serveLanding),
+			ReadTimeout:       readTimeout,
+			ReadHeaderTimeout: readHdrTimeout,
+			WriteTimeout:      writeTimeout,
+		}
+	}
+
+	return p, nil
+}
+
+// captureIP returns the address the A queries of the client with ip must be
+// answered with, or nil if the client isn't captured.  It also remembers the
+// captured client.  p may be nil.
+func (p *capturePortal) captureIP(ip net.IP) (captureIP net.IP) {
+	if p == nil {
+		return nil
+	}
+
+	addr, err := netutil.IPToAddrNoMapped(ip)
+	if err != nil || p.isKnown(addr) {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.acked[addr]; ok {
+		return nil
+	}
+
+	if _, ok := p.pending[addr]; ok || len(p.pending) < captureMaxPending {
+		p.pending[addr] = time.Now()
+	}
+
+	return p.ip.AsSlice()
+}
+
+// acknowledge stops capturing the client with ip.
+func (p *capturePortal) acknowledge(ip netip.Addr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.acked[ip] = struct{}{}
+	delete(p.pending, ip)
+}
+
+// revoke starts capturing the client with ip again.  ok is false if the client
+// hasn't been acknowledged.
+func (p *capturePortal) revoke(ip netip.Addr) (ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok = p.acked[ip]
+	delete(p.acked, ip)
+
+	return ok
+}
+
+// acknowledged returns the sorted addresses of the acknowledged clients.
+func (p *capturePortal) acknowledged() (ips []netip.Addr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ips = maps.Keys(p.acked)
+	slices.SortFunc(ips, netip.Addr.Less)
+
+	return ips
+}
+
+// start starts serving the landing page, if it's configured.
+func (p *capturePortal) start() {
+	if p.landing == nil {
+		return
+	}
+
+	go func() {
+		defer log.OnPanic("capture: landing page server")
+
+		log.Info("capture: serving landing page on %s", p.landing.Addr)
+		err := p.landing.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Error("capture: landing page server: %s", err)
+		}
+	}()
+}
+
+// shutdown stops serving the landing page, if it's configured.
+func (p *capturePortal) shutdown(ctx context.Context) {
+	if p.landing == nil {
+		return
+	}
+
+	err := p.landing.Shutdown(ctx)
+	if err != nil {
+		log.Error("capture: shutting down landing page server: %s", err)
+	}
+}
+
+// landingTmpl is the template of the landing page.
+var landingTmpl = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Network access</title>
+</head>
+<body>
+<h1>Network access</h1>
+{{if .Terms}}<p style="white-space: pre-wrap">{{.Terms}}</p>
+{{end}}<p>Your device is waiting for the network administrator to grant the
+access.  Its address is <b>{{.IP}}</b>.</p>
+</body>
+</html>
+`))
+
+// serveLanding serves the landing page for any request.
+func (p *capturePortal) serveLanding(w http.ResponseWriter, r *http.Request) {
+	ip, _, _ := netutil.SplitHostPort(r.RemoteAddr)
+
+	w.Header().Set(aghhttp.HdrNameContentType, "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Don't respond with a 204 or a 200 with the expected content to the
+	// connectivity checks of the operating systems, so that they show the
+	// page.
+	err := landingTmpl.Execute(w, struct {
+		Terms string
+		IP    string
+	}{
+		Terms: p.terms,
+		IP:    ip,
+	})
+	if err != nil {
+		log.Debug("capture: writing landing page: %s", err)
+	}
+}
+
+// initCapture initializes and starts [Context.capture], unless the capture
+// mode is disabled in the configuration.
+func initCapture() (err error) {
+	conf := config.Capture
+	if !conf.Enabled {
+		return nil
+	}
+
+	Context.capture, err = newCapturePortal(&conf, Context.clients.isPersistent)
+	if err != nil {
+		return fmt.Errorf("initializing capture mode: %w", err)
+	}
+
+	Context.capture.start()
+
+	return nil
+}
+
+// captureIPForClient returns the address the A queries of the client with ip
+// must be answered with, or nil if the client isn't captured.
+func captureIPForClient(ip net.IP) (captureIP net.IP) {
+	return Context.capture.captureIP(ip)
+}
+
+// capturePendingJSON is a captured client waiting for the acknowledgment.
+type capturePendingJSON struct {
+	LastSeen time.Time  `json:"last_seen"`
+	IP       netip.Addr `json:"ip"`
+}
+
+// captureStatusJSON is the response to the GET /control/capture/status HTTP
+// API.
+type captureStatusJSON struct {
+	IP           netip.Addr           `json:"ip"`
+	Pending      []capturePendingJSON `json:"pending"`
+	Acknowledged []netip.Addr         `json:"acknowledged"`
+	Enabled      bool                 `json:"enabled"`
+}
+
+// captureClientJSON is the request to the POST /control/capture/acknowledge
+// and POST /control/capture/revoke HTTP APIs.
+type captureClientJSON struct {
+	IP netip.Addr `json:"ip"`
+}
+
+// handleCaptureStatus is the handler for the GET /control/capture/status HTTP
+// API.
+func handleCaptureStatus(w http.ResponseWriter, r *http.Request) {
+	resp := &captureStatusJSON{
+		Pending:      []capturePendingJSON{},
+		Acknowledged: []netip.Addr{},
+	}
+
+	if p := Context.capture; p != nil {
+		resp.Enabled = true
+		resp.IP = p.ip
+		resp.Acknowledged = p.acknowledged()
+
+		p.mu.Lock()
+		for ip, seen := range p.pending {
+			resp.Pending = append(resp.Pending, capturePendingJSON{
+				LastSeen: seen,
+				IP:       ip,
+			})
+		}
+		p.mu.Unlock()
+
+		slices.SortFunc(resp.Pending, func(a, b capturePendingJSON) (less bool) {
+			return a.IP.Less(b.IP)
+		})
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// decodeCaptureClient decodes the request body of the capture client HTTP
+// APIs.  ok is false if the response has already been written.
+func decodeCaptureClient(w http.ResponseWriter, r *http.Request) (ip netip.Addr, ok bool) {
+	if Context.capture == nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "capture mode is disabled")
+
+		return netip.Addr{}, false
+	}
+
+	cj := captureClientJSON{}
+	err := json.NewDecoder(r.Body).Decode(&cj)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return netip.Addr{}, false
+	}
+
+	if !cj.IP.IsValid() {
+		aghhttp.Error(r, w, http.StatusBadRequest, "client's ip must be non-empty")
+
+		return netip.Addr{}, false
+	}
+
+	return cj.IP.Unmap(), true
+}
+
+// handleCaptureAcknowledge is the handler for the POST
+// /control/capture/acknowledge HTTP API.
+func handleCaptureAcknowledge(w http.ResponseWriter, r *http.Request) {
+	ip, ok := decodeCaptureClient(w, r)
+	if !ok {
+		return
+	}
+
+	Context.capture.acknowledge(ip)
+	log.Info("capture: acknowledged client %s", ip)
+
+	onConfigModified()
+}
+
+// handleCaptureRevoke is the handler for the POST /control/capture/revoke HTTP
+// API.
+func handleCaptureRevoke(w http.ResponseWriter, r *http.Request) {
+	ip, ok := decodeCaptureClient(w, r)
+	if !ok {
+		return
+	}
+
+	if !Context.capture.revoke(ip) {
+		aghhttp.Error(r, w, http.StatusBadRequest, "client %s is not acknowledged", ip)
+
+		return
+	}
+
+	log.Info("capture: revoked acknowledgment of client %s", ip)
+
+	onConfigModified()
+}
+
+// registerCaptureHandlers registers the HTTP handlers of the capture mode.
+func registerCaptureHandlers() {
+	httpRegister(http.MethodGet, "/control/capture/status", handleCaptureStatus)
+	httpRegister(http.MethodPost, "/control/capture/acknowledge", handleCaptureAcknowledge)
+	httpRegister(http.MethodPost, "/control/capture/revoke", handleCaptureRevoke)
+}
@@ -0,0 +1,57 @@
+package home
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapturePortal(t *testing.T) {
+	var (
+		captureIP = netip.MustParseAddr("192.168.0.1")
+		knownIP   = netip.MustParseAddr("192.168.0.2")
+		ackedIP   = netip.MustParseAddr("192.168.0.3")
+		unknownIP = netip.MustParseAddr("192.168.0.4")
+		isKnown   = func(ip netip.Addr) (ok bool) { return ip == knownIP }
+	)
+
+	p, err := newCapturePortal(&captureConfig{
+		IP:           captureIP,
+		Acknowledged: []netip.Addr{ackedIP},
+		Enabled:      true,
+	}, isKnown)
+	require.NoError(t, err)
+
+	wantCaptureIP := net.IP(captureIP.AsSlice())
+
+	assert.Nil(t, p.captureIP(knownIP.AsSlice()))
+	assert.Nil(t, p.captureIP(ackedIP.AsSlice()))
+	assert.Equal(t, wantCaptureIP, p.captureIP(unknownIP.AsSlice()))
+	assert.Contains(t, p.pending, unknownIP)
+
+	p.acknowledge(unknownIP)
+	assert.Nil(t, p.captureIP(unknownIP.AsSlice()))
+	assert.NotContains(t, p.pending, unknownIP)
+	assert.Equal(t, []netip.Addr{ackedIP, unknownIP}, p.acknowledged())
+
+	assert.True(t, p.revoke(ackedIP))
+	assert.False(t, p.revoke(ackedIP))
+	assert.Equal(t, wantCaptureIP, p.captureIP(ackedIP.AsSlice()))
+
+	t.Run("nil", func(t *testing.T) {
+		var nilPortal *capturePortal
+		assert.Nil(t, nilPortal.captureIP(unknownIP.AsSlice()))
+	})
+
+	t.Run("bad_ip", func(t *testing.T) {
+		_, err = newCapturePortal(&captureConfig{
+			IP:      netip.MustParseAddr("::1"),
+			Enabled: true,
+		}, isKnown)
+		testutil.AssertErrorMsg(t, `ip: "::1" is not an ipv4 address`, err)
+	})
+}
@@ -0,0 +1,146 @@
+package home
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// validateConfig returns the errors of the values of the parsed configuration
+// conf, which are otherwise only found when the corresponding modules are
+// started.  errs is nil if conf is valid.
+func validateConfig(conf *configuration) (errs []error) {
+	dnsConf := &conf.DNS
+	for _, err := range dnsConf.FilteringConfig.Validate() {
+		errs = append(errs, fmt.Errorf("dns: %w", err))
+	}
+
+	privateNets, err := parseSubnetSet(dnsConf.PrivateNets)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("dns: private_networks: %w", err))
+	} else {
+		err = dnsforward.ValidateUpstreamsPrivate(dnsConf.LocalPTRResolvers, privateNets)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dns: local_ptr_upstreams: %w", err))
+		}
+	}
+
+	_, err = conf.timeZone()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("time_zone: %w", err))
+	}
+
+	_, err = netutil.ParseSubnets(conf.AuthExemptSubnets...)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("auth_exempt_subnets: %w", err))
+	}
+
+	err = stats.ValidateHistoryYears(conf.Stats.HistoryYears)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("statistics: history_years: %w", err))
+	}
+
+	for _, err = range filtering.ValidateUserRules(conf.UserRules, conf.UserRuleGroups) {
+		errs = append(errs, fmt.Errorf("user_rules: %w", err))
+	}
+
+	if fc := conf.DNS.DnsfilterConf; fc != nil {
+		err = fc.BlockedServicesCatalog.Validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("dns: blocked_services_catalog: %w", err))
+		}
+	}
+
+	err = validateRedaction(conf.QueryLog.Redaction)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("querylog: redaction: %w", err))
+	}
+
+	err = validateDoHPaths(conf.TLS.DoHPaths)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("tls: doh_paths: %w", err))
+	}
+
+	if conf.TLS.Enabled {
+		tlsConf := conf.TLS
+		err = loadTLSConf(&tlsConf, &tlsConfigStatus{})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tls: %w", err))
+		}
+	}
+
+	for _, err = range conf.Alerts.validate() {
+		errs = append(errs, fmt.Errorf("alerts: %w", err))
+	}
+
+	err = conf.Notifications.Email.validate()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("notifications: email: %w", err))
+	}
+
+	return append(errs, validateClients(conf.Clients.Persistent)...)
+}
+
+// validateRedaction returns an error if red contains an unknown role.
+func validateRedaction(red map[userRole]querylog.Redaction) (err error) {
+	roles := maps.Keys(red)
+	slices.Sort(roles)
+	for _, role := range roles {
+		err = role.validate()
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateClients returns the errors of the persistent clients from objs,
+// which would prevent adding them.  The values skipped with a warning, like
+// unknown tags, aren't reported.
+func validateClients(objs []*clientObject) (errs []error) {
+	clients := &clientsContainer{allTags: stringutil.NewSet(clientTags...)}
+	for _, o := range objs {
+		err := clients.check(&Client{
+			Name: o.Name,
+			// Clone the identifiers, since they're normalized in place.
+			IDs:         slices.Clone(o.IDs),
+			Upstreams:   o.Upstreams,
+			AnswerRules: o.AnswerRules,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("clients: client %q: %w", o.Name, err))
+		}
+	}
+
+	return errs
+}
+
+// checkConfig logs the errors of the parsed configuration, if any, and exits
+// with the corresponding status code.
+func checkConfig() {
+	errs := validateConfig(config)
+	if len(errs) == 0 {
+		log.Info("configuration file is ok")
+
+		os.Exit(0)
+	}
+
+	for _, err := range errs {
+		log.Error("configuration file: %s", err)
+	}
+
+	log.Error("configuration file has %d errors", len(errs))
+
+	os.Exit(1)
+}
@@ -0,0 +1,90 @@
+package home
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateConfig(t *testing.T) {
+	newConf := func() (conf *configuration) {
+		return &configuration{
+			DNS: dnsConfig{
+				FilteringConfig: dnsforward.FilteringConfig{
+					UpstreamDNS:  []string{"1.1.1.1"},
+					BootstrapDNS: []string{"9.9.9.9"},
+					BlockingMode: dnsforward.BlockingModeDefault,
+				},
+				DnsfilterConf: &filtering.Config{},
+			},
+			UserRules: []string{"||example.org^"},
+			Clients:   &clientsConfig{},
+		}
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		assert.Empty(t, validateConfig(newConf()))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		conf := newConf()
+		conf.DNS.UpstreamDNS = []string{"bad://1.1.1.1"}
+		conf.DNS.TrustedProxies = []string{"1.2.3.4/33"}
+		conf.DNS.LocalPTRResolvers = []string{"[/1.in-addr.arpa/]1.1.1.1"}
+		conf.AuthExemptSubnets = []string{"bad"}
+		conf.Stats.HistoryYears = 500_000
+		conf.UserRules = []string{"||example.org^", "example.com##.ad"}
+		conf.QueryLog.Redaction = map[userRole]querylog.Redaction{
+			"bad": {Client: true},
+		}
+		conf.TLS = tlsConfigSettings{
+			Enabled: true,
+			TLSConfig: dnsforward.TLSConfig{
+				CertificatePath: filepath.Join(t.TempDir(), "missing.pem"),
+			},
+		}
+		conf.Clients.Persistent = []*clientObject{{
+			Name: "client",
+			IDs:  []string{"1.2.3.4", "bad id"},
+		}}
+
+		errs := validateConfig(conf)
+		require.Len(t, errs, 9)
+
+		for i, prefix := range []string{
+			"dns: upstream_dns: ",
+			"dns: trusted_proxies: ",
+			"dns: local_ptr_upstreams: ",
+			"auth_exempt_subnets: ",
+			"statistics: history_years: ",
+			"user_rules: ",
+			"querylog: redaction: ",
+			"tls: ",
+			"clients: ",
+		} {
+			assert.Contains(t, errs[i].Error(), prefix)
+		}
+
+		// The identifiers of the client are kept intact.
+		assert.Equal(t, []string{"1.2.3.4", "bad id"}, conf.Clients.Persistent[0].IDs)
+	})
+}
+
+func TestSetupConfig_redaction(t *testing.T) {
+	prev := config.QueryLog.Redaction
+	t.Cleanup(func() { config.QueryLog.Redaction = prev })
+
+	config.QueryLog.Redaction = map[userRole]querylog.Redaction{
+		userRoleViewer: {Answer: true},
+		"bad":          {Client: true},
+	}
+
+	err := setupConfig(options{})
+	testutil.AssertErrorMsg(t, `querylog: redaction: bad role "bad"`, err)
+}
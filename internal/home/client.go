@@ -4,6 +4,7 @@ import (
 	"encoding"
 	"fmt"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 )
@@ -16,6 +17,9 @@ type Client struct {
 	// these upstream must be used.
 	upstreamConfig *proxy.UpstreamConfig
 
+	// answerRules are the parsed AnswerRules.  It's nil if there are none.
+	answerRules *dnsforward.AnswerRules
+
 	safeSearchConf filtering.SafeSearchConfig
 	SafeSearch     filtering.SafeSearch
 
@@ -26,11 +30,37 @@ type Client struct {
 	BlockedServices []string
 	Upstreams       []string
 
+	// AllowedServices are the services allowed in the default deny mode.
+	AllowedServices []string
+
+	// AnswerRules are the answer post-processing rules of the client, see
+	// [dnsforward.AnswerRules].
+	AnswerRules []string
+
 	UseOwnSettings        bool
 	FilteringEnabled      bool
 	SafeBrowsingEnabled   bool
 	ParentalEnabled       bool
 	UseOwnBlockedServices bool
+
+	// DefaultDeny, if true, blocks all hosts except for the ones allowed by
+	// the allowlist rules or AllowedServices.
+	DefaultDeny bool
+
+	// DryRun, if true, makes the filtering results of the client's requests
+	// only recorded and never applied.  It's only used if UseOwnSettings is
+	// true.
+	DryRun bool
+
+	// ParentalStrictSearch, if true, enforces the DuckDuckGo safe mode and the
+	// strict image search for the client regardless of ParentalEnabled.  It's
+	// only used if UseOwnSettings is true.
+	ParentalStrictSearch bool
+
+	// IgnoreLogging, if true, excludes the client's requests from the query
+	// log and the statistics.  Unlike the filtering settings, it's used
+	// regardless of UseOwnSettings.
+	IgnoreLogging bool
 }
 
 // closeUpstreams closes the client-specific upstream config of c if any.
@@ -49,12 +79,14 @@ func (c *Client) closeUpstreams() (err error) {
 // client has been obtained.
 type clientSource uint
 
-// Clients information sources.  The order determines the priority.
+// Clients information sources.  The order determines the default priority,
+// see [clientSourceRanks].
 const (
 	ClientSourceNone clientSource = iota
 	ClientSourceWHOIS
 	ClientSourceARP
 	ClientSourceRDNS
+	ClientSourceSSDP
 	ClientSourceDHCP
 	ClientSourceHostsFile
 	ClientSourcePersistent
@@ -72,10 +104,14 @@ func (cs clientSource) String() (s string) {
 		return "ARP"
 	case ClientSourceRDNS:
 		return "rDNS"
+	case ClientSourceSSDP:
+		return "SSDP"
 	case ClientSourceDHCP:
 		return "DHCP"
 	case ClientSourceHostsFile:
 		return "etc/hosts"
+	case ClientSourcePersistent:
+		return "persistent"
 	default:
 		return ""
 	}
@@ -93,8 +129,13 @@ func (cs clientSource) MarshalText() (text []byte, err error) {
 // source described in the Source field.
 type RuntimeClient struct {
 	WHOISInfo *RuntimeClientWHOISInfo
-	Host      string
-	Source    clientSource
+
+	// SSDPInfo is the information about the UPnP device with the address of
+	// the client, if any.
+	SSDPInfo *RuntimeClientSSDPInfo
+
+	Host   string
+	Source clientSource
 }
 
 // RuntimeClientWHOISInfo is the filtered WHOIS data for a runtime client.
@@ -103,3 +144,10 @@ type RuntimeClientWHOISInfo struct {
 	Country string `json:"country,omitempty"`
 	Orgname string `json:"orgname,omitempty"`
 }
+
+// RuntimeClientSSDPInfo is the information about a runtime client discovered
+// using SSDP.
+type RuntimeClientSSDPInfo struct {
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+}
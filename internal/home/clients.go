@@ -14,6 +14,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering/safesearch"
+	"github.com/AdguardTeam/AdGuardHome/internal/oui"
 	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -50,12 +51,36 @@ type clientsContainer struct {
 	// arpdb stores the neighbors retrieved from ARP.
 	arpdb aghnet.ARPDB
 
-	// lock protects all fields.
+	// oui is used for looking up the hardware vendors of the runtime clients.
+	// It's nil if the lookup is disabled.
+	oui *oui.DB
+
+	// ssdp discovers the UPnP devices.  It's nil if the container isn't
+	// started or SSDP is disabled.
+	ssdp *aghnet.SSDPListener
+
+	// services is the catalog of the blocked services the services of the
+	// clients are checked against.  If it's nil, the built-in one is used.
+	services *filtering.ServicesCatalog
+
+	// srcRanks are the ranks of the client information sources.  If it's nil,
+	// the default order of [clientSource] is used.
+	srcRanks *clientSourceRanks
+
+	// lock protects all fields except for lastSeen.
 	//
 	// TODO(a.garipov): Use a pointer and describe which fields are protected in
 	// more detail.
 	lock sync.Mutex
 
+	// lastSeen are the times of the last requests from the addresses of the
+	// clients.
+	lastSeen map[netip.Addr]time.Time
+
+	// seenLock protects lastSeen.  It's separate from lock, since lastSeen is
+	// updated on every DNS request.
+	seenLock sync.Mutex
+
 	// testing is a flag that disables some features for internal tests.
 	//
 	// TODO(a.garipov): Awful.  Remove.
@@ -84,6 +109,10 @@ func (clients *clientsContainer) Init(
 	clients.dhcpServer = dhcpServer
 	clients.etcHosts = etcHosts
 	clients.arpdb = arpdb
+	if filteringConf != nil {
+		clients.services = filteringConf.ServicesCatalog
+	}
+
 	clients.addFromConfig(objects, filteringConf)
 
 	if clients.testing {
@@ -123,9 +152,36 @@ func (clients *clientsContainer) Start() {
 		clients.registerWebHandlers()
 	}
 
+	if config.Clients.Sources.SSDP {
+		clients.startSSDP()
+	}
+
 	go clients.periodicUpdate()
 }
 
+// ssdpSearchInterval defines how often the UPnP devices are searched for.
+const ssdpSearchInterval = 30 * time.Minute
+
+// startSSDP starts discovering the UPnP devices.  The errors are only logged,
+// since the discovery is optional.
+func (clients *clientsContainer) startSSDP() {
+	l := aghnet.NewSSDPListener(&aghnet.SSDPConfig{
+		OnDevice:       clients.addFromSSDP,
+		OnGone:         clients.rmFromSSDP,
+		Client:         Context.client,
+		SearchInterval: ssdpSearchInterval,
+	})
+
+	err := l.Start()
+	if err != nil {
+		log.Error("clients: starting ssdp: %s", err)
+
+		return
+	}
+
+	clients.ssdp = l
+}
+
 // reloadARP reloads runtime clients from ARP, if configured.
 func (clients *clientsContainer) reloadARP() {
 	if clients.arpdb != nil {
@@ -133,6 +189,26 @@ func (clients *clientsContainer) reloadARP() {
 	}
 }
 
+// reload replaces the persistent clients with objects from the configuration
+// file.
+func (clients *clientsContainer) reload(objects []*clientObject, filteringConf *filtering.Config) {
+	func() {
+		clients.lock.Lock()
+		defer clients.lock.Unlock()
+
+		for _, cli := range clients.list {
+			if err := cli.closeUpstreams(); err != nil {
+				log.Error("clients: reloading client %s: %s", cli.Name, err)
+			}
+		}
+
+		clients.list = make(map[string]*Client)
+		clients.idIndex = make(map[string]*Client)
+	}()
+
+	clients.addFromConfig(objects, filteringConf)
+}
+
 // clientObject is the YAML representation of a persistent client.
 type clientObject struct {
 	SafeSearchConf filtering.SafeSearchConfig `yaml:"safe_search"`
@@ -143,72 +219,106 @@ type clientObject struct {
 	IDs             []string `yaml:"ids"`
 	BlockedServices []string `yaml:"blocked_services"`
 	Upstreams       []string `yaml:"upstreams"`
+	AllowedServices []string `yaml:"allowed_services"`
+	AnswerRules     []string `yaml:"answer_rules"`
 
 	UseGlobalSettings        bool `yaml:"use_global_settings"`
 	FilteringEnabled         bool `yaml:"filtering_enabled"`
 	ParentalEnabled          bool `yaml:"parental_enabled"`
 	SafeBrowsingEnabled      bool `yaml:"safebrowsing_enabled"`
 	UseGlobalBlockedServices bool `yaml:"use_global_blocked_services"`
+	DefaultDeny              bool `yaml:"default_deny"`
+	DryRun                   bool `yaml:"dry_run"`
+	ParentalStrictSearch     bool `yaml:"parental_strict_search"`
+	IgnoreLogging            bool `yaml:"ignore_logging"`
 }
 
 // addFromConfig initializes the clients container with objects from the
 // configuration file.
 func (clients *clientsContainer) addFromConfig(objects []*clientObject, filteringConf *filtering.Config) {
 	for _, o := range objects {
-		cli := &Client{
-			Name: o.Name,
-
-			IDs:       o.IDs,
-			Upstreams: o.Upstreams,
+		cli, err := clients.objectToClient(o, filteringConf)
+		if err != nil {
+			log.Error("clients: init client %s: %s", o.Name, err)
 
-			UseOwnSettings:        !o.UseGlobalSettings,
-			FilteringEnabled:      o.FilteringEnabled,
-			ParentalEnabled:       o.ParentalEnabled,
-			safeSearchConf:        o.SafeSearchConf,
-			SafeBrowsingEnabled:   o.SafeBrowsingEnabled,
-			UseOwnBlockedServices: !o.UseGlobalBlockedServices,
+			continue
 		}
 
-		if o.SafeSearchConf.Enabled {
-			o.SafeSearchConf.CustomResolver = safeSearchResolver{}
+		_, err = clients.Add(cli)
+		if err != nil {
+			log.Error("clients: adding clients %s: %s", cli.Name, err)
+		}
+	}
+}
 
-			ss, err := safesearch.NewDefaultSafeSearch(
-				o.SafeSearchConf,
-				filteringConf.SafeSearchCacheSize,
-				time.Minute*time.Duration(filteringConf.CacheTime),
-			)
-			if err != nil {
-				log.Error("clients: init client safesearch %s: %s", cli.Name, err)
+// objectToClient converts o into a persistent client.  The unknown services
+// and tags are skipped.
+func (clients *clientsContainer) objectToClient(
+	o *clientObject,
+	filteringConf *filtering.Config,
+) (cli *Client, err error) {
+	cli = &Client{
+		Name: o.Name,
+
+		IDs:         o.IDs,
+		Upstreams:   o.Upstreams,
+		AnswerRules: o.AnswerRules,
+
+		UseOwnSettings:        !o.UseGlobalSettings,
+		FilteringEnabled:      o.FilteringEnabled,
+		ParentalEnabled:       o.ParentalEnabled,
+		safeSearchConf:        o.SafeSearchConf,
+		SafeBrowsingEnabled:   o.SafeBrowsingEnabled,
+		UseOwnBlockedServices: !o.UseGlobalBlockedServices,
+		DefaultDeny:           o.DefaultDeny,
+		DryRun:                o.DryRun,
+		ParentalStrictSearch:  o.ParentalStrictSearch,
+		IgnoreLogging:         o.IgnoreLogging,
+	}
+
+	if o.SafeSearchConf.Enabled {
+		o.SafeSearchConf.CustomResolver = safeSearchResolver{}
+
+		var ss filtering.SafeSearch
+		ss, err = safesearch.NewDefaultSafeSearch(
+			o.SafeSearchConf,
+			filteringConf.SafeSearchCacheSize,
+			time.Minute*time.Duration(filteringConf.CacheTime),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("safesearch: %w", err)
+		}
 
-				continue
-			}
+		cli.SafeSearch = ss
+	}
 
-			cli.SafeSearch = ss
+	for _, s := range o.BlockedServices {
+		if clients.services.Known(s) {
+			cli.BlockedServices = append(cli.BlockedServices, s)
+		} else {
+			log.Info("clients: skipping unknown blocked service %q", s)
 		}
+	}
 
-		for _, s := range o.BlockedServices {
-			if filtering.BlockedSvcKnown(s) {
-				cli.BlockedServices = append(cli.BlockedServices, s)
-			} else {
-				log.Info("clients: skipping unknown blocked service %q", s)
-			}
+	for _, s := range o.AllowedServices {
+		if clients.services.Known(s) {
+			cli.AllowedServices = append(cli.AllowedServices, s)
+		} else {
+			log.Info("clients: skipping unknown allowed service %q", s)
 		}
+	}
 
-		for _, t := range o.Tags {
-			if clients.allTags.Has(t) {
-				cli.Tags = append(cli.Tags, t)
-			} else {
-				log.Info("clients: skipping unknown tag %q", t)
-			}
+	for _, t := range o.Tags {
+		if clients.allTags.Has(t) {
+			cli.Tags = append(cli.Tags, t)
+		} else {
+			log.Info("clients: skipping unknown tag %q", t)
 		}
+	}
 
-		slices.Sort(cli.Tags)
+	slices.Sort(cli.Tags)
 
-		_, err := clients.Add(cli)
-		if err != nil {
-			log.Error("clients: adding clients %s: %s", cli.Name, err)
-		}
-	}
+	return cli, nil
 }
 
 // forConfig returns all currently known persistent clients as objects for the
@@ -226,6 +336,8 @@ func (clients *clientsContainer) forConfig() (objs []*clientObject) {
 			IDs:             stringutil.CloneSlice(cli.IDs),
 			BlockedServices: stringutil.CloneSlice(cli.BlockedServices),
 			Upstreams:       stringutil.CloneSlice(cli.Upstreams),
+			AllowedServices: stringutil.CloneSlice(cli.AllowedServices),
+			AnswerRules:     stringutil.CloneSlice(cli.AnswerRules),
 
 			UseGlobalSettings:        !cli.UseOwnSettings,
 			FilteringEnabled:         cli.FilteringEnabled,
@@ -233,6 +345,10 @@ func (clients *clientsContainer) forConfig() (objs []*clientObject) {
 			SafeSearchConf:           cli.safeSearchConf,
 			SafeBrowsingEnabled:      cli.SafeBrowsingEnabled,
 			UseGlobalBlockedServices: !cli.UseOwnBlockedServices,
+			DefaultDeny:              cli.DefaultDeny,
+			DryRun:                   cli.DryRun,
+			ParentalStrictSearch:     cli.ParentalStrictSearch,
+			IgnoreLogging:            cli.IgnoreLogging,
 		}
 
 		objs = append(objs, o)
@@ -334,27 +450,49 @@ func (clients *clientsContainer) clientOrArtificial(
 	ip netip.Addr,
 	id string,
 ) (c *querylog.Client, art bool) {
-	defer func() {
-		c.Disallowed, c.DisallowedRule = clients.dnsServer.IsBlockedClient(ip, id)
-		if c.WHOIS == nil {
-			c.WHOIS = &querylog.ClientWHOIS{}
-		}
-	}()
+	c, art = clients.clientInfo(ip, id)
+	c.Disallowed, c.DisallowedRule = clients.dnsServer.IsBlockedClient(ip, id)
+	if c.WHOIS == nil {
+		c.WHOIS = &querylog.ClientWHOIS{}
+	}
+
+	return c, art
+}
 
+// clientInfo is like [clientsContainer.clientOrArtificial] but doesn't check
+// the access settings.  The name is obtained from the source with the highest
+// priority.
+func (clients *clientsContainer) clientInfo(
+	ip netip.Addr,
+	id string,
+) (c *querylog.Client, art bool) {
+	rc, rcOK := clients.findRuntimeClient(ip)
 	client, ok := clients.Find(id)
 	if ok {
+		if rcOK && clients.nameOutranks(ip, ClientSourcePersistent) {
+			return &querylog.Client{
+				Name:       rc.Host,
+				NameSource: rc.Source.String(),
+			}, false
+		}
+
 		return &querylog.Client{
-			Name: client.Name,
+			Name:       client.Name,
+			NameSource: ClientSourcePersistent.String(),
 		}, false
 	}
 
-	var rc *RuntimeClient
-	rc, ok = clients.findRuntimeClient(ip)
-	if ok {
-		return &querylog.Client{
+	if rcOK {
+		c = &querylog.Client{
 			Name:  rc.Host,
 			WHOIS: toQueryLogWHOIS(rc.WHOISInfo),
-		}, false
+		}
+
+		if rc.Host != "" {
+			c.NameSource = rc.Source.String()
+		}
+
+		return c, false
 	}
 
 	return &querylog.Client{
@@ -375,10 +513,41 @@ func (clients *clientsContainer) Find(id string) (c *Client, ok bool) {
 	c.Tags = stringutil.CloneSlice(c.Tags)
 	c.BlockedServices = stringutil.CloneSlice(c.BlockedServices)
 	c.Upstreams = stringutil.CloneSlice(c.Upstreams)
+	c.AllowedServices = stringutil.CloneSlice(c.AllowedServices)
+	c.AnswerRules = stringutil.CloneSlice(c.AnswerRules)
 
 	return c, true
 }
 
+// idsByName returns the identifiers of the persistent client with name, if
+// any.
+func (clients *clientsContainer) idsByName(name string) (ids []string, ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.list[name]
+	if !ok {
+		return nil, false
+	}
+
+	return stringutil.CloneSlice(c.IDs), true
+}
+
+// findAnswerRules returns the answer post-processing rules of the client,
+// identified either by its IP address or its ClientID.  rules is nil if the
+// client isn't found or if the client has no rules.
+func (clients *clientsContainer) findAnswerRules(id string) (rules *dnsforward.AnswerRules) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.findLocked(id)
+	if !ok {
+		return nil
+	}
+
+	return c.answerRules
+}
+
 // findUpstreams returns upstreams configured for the client, identified either
 // by its IP address or its ClientID.  upsConf is nil if the client isn't found
 // or if the client has no custom upstreams.
@@ -402,14 +571,20 @@ func (clients *clientsContainer) findUpstreams(
 		return c.upstreamConfig, nil
 	}
 
+	var pool *dnsforward.UpstreamPool
+	if Context.dnsServer != nil {
+		pool = Context.dnsServer.UpstreamPool()
+	}
+
 	var conf *proxy.UpstreamConfig
-	conf, err = proxy.ParseUpstreamsConfig(
+	conf, err = dnsforward.ParseUpstreamsConfig(
 		upstreams,
 		&upstream.Options{
 			Bootstrap:    config.DNS.BootstrapDNS,
 			Timeout:      config.DNS.UpstreamTimeout.Duration,
 			HTTPVersions: dnsforward.UpstreamHTTPVersions(config.DNS.UseHTTP3Upstreams),
 		},
+		pool,
 	)
 	if err != nil {
 		return nil, err
@@ -420,6 +595,16 @@ func (clients *clientsContainer) findUpstreams(
 	return conf, nil
 }
 
+// isPersistent returns true if ip belongs to a persistent client.
+func (clients *clientsContainer) isPersistent(ip netip.Addr) (ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	_, ok = clients.findLocked(ip.String())
+
+	return ok
+}
+
 // findLocked searches for a client by its ID.  clients.lock is expected to be
 // locked.
 func (clients *clientsContainer) findLocked(id string) (c *Client, ok bool) {
@@ -523,11 +708,22 @@ func (clients *clientsContainer) check(c *Client) (err error) {
 
 	slices.Sort(c.Tags)
 
+	for _, s := range c.AllowedServices {
+		if !clients.services.Known(s) {
+			return fmt.Errorf("invalid allowed service: %q", s)
+		}
+	}
+
 	err = dnsforward.ValidateUpstreams(c.Upstreams)
 	if err != nil {
 		return fmt.Errorf("invalid upstream servers: %w", err)
 	}
 
+	c.answerRules, err = dnsforward.ParseAnswerRules(c.AnswerRules)
+	if err != nil {
+		return fmt.Errorf("invalid answer rules: %w", err)
+	}
+
 	return nil
 }
 
@@ -672,6 +868,156 @@ func (clients *clientsContainer) Update(name string, c *Client) (err error) {
 	return nil
 }
 
+// clientsBatchAction is the action of a single operation of a clients batch.
+type clientsBatchAction string
+
+// clientsBatchAction values.
+const (
+	clientsBatchAdd    clientsBatchAction = "add"
+	clientsBatchUpdate clientsBatchAction = "update"
+	clientsBatchDelete clientsBatchAction = "delete"
+)
+
+// clientsBatchOp is a single operation of a clients batch.
+type clientsBatchOp struct {
+	// cli is the new data of the client.  It's nil for the delete action.
+	cli *Client
+
+	// action is the action of the operation.
+	action clientsBatchAction
+
+	// name is the name of the client to update or delete.  It's empty for the
+	// add action.
+	name string
+}
+
+// applyBatch applies ops in order atomically, so that either all of them are
+// applied or none of them are, if any fails.
+func (clients *clientsContainer) applyBatch(ops []*clientsBatchOp) (err error) {
+	for i, op := range ops {
+		if op.action == clientsBatchDelete {
+			continue
+		}
+
+		err = clients.check(op.cli)
+		if err != nil {
+			return fmt.Errorf("operation at index %d: %w", i, err)
+		}
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	list := maps.Clone(clients.list)
+	idIndex := maps.Clone(clients.idIndex)
+
+	var replaced []*Client
+	for i, op := range ops {
+		var prev *Client
+		prev, err = applyBatchOp(list, idIndex, op)
+		if err != nil {
+			return fmt.Errorf("operation at index %d: %w", i, err)
+		}
+
+		if prev != nil {
+			replaced = append(replaced, prev)
+		}
+	}
+
+	clients.list, clients.idIndex = list, idIndex
+
+	for _, c := range replaced {
+		err = c.closeUpstreams()
+		if err != nil {
+			log.Error("clients: closing upstreams of %q: %s", c.Name, err)
+		}
+	}
+
+	log.Debug("clients: applied batch of %d operations [%d]", len(ops), len(list))
+
+	return nil
+}
+
+// applyBatchOp applies op to the name index list and the ID index idIndex.
+// prev is the client updated or deleted by op, if any.
+func applyBatchOp(
+	list map[string]*Client,
+	idIndex map[string]*Client,
+	op *clientsBatchOp,
+) (prev *Client, err error) {
+	if op.action != clientsBatchAdd {
+		var ok bool
+		prev, ok = list[op.name]
+		if !ok {
+			return nil, fmt.Errorf("client %q not found", op.name)
+		}
+
+		delete(list, prev.Name)
+		for _, id := range prev.IDs {
+			delete(idIndex, id)
+		}
+
+		if op.action == clientsBatchDelete {
+			return prev, nil
+		}
+	}
+
+	c := op.cli
+	if _, ok := list[c.Name]; ok {
+		return nil, fmt.Errorf("client %q already exists", c.Name)
+	}
+
+	for _, id := range c.IDs {
+		if existing, ok := idIndex[id]; ok {
+			return nil, fmt.Errorf("id %q is used by client with name %q", id, existing.Name)
+		}
+	}
+
+	list[c.Name] = c
+	for _, id := range c.IDs {
+		idIndex[id] = c
+	}
+
+	return prev, nil
+}
+
+// replaceAll atomically replaces all persistent clients with clis, so that
+// either all of them are set or, if any of them is invalid, none of them are.
+func (clients *clientsContainer) replaceAll(clis []*Client) (err error) {
+	for i, c := range clis {
+		err = clients.check(c)
+		if err != nil {
+			return fmt.Errorf("client at index %d: %w", i, err)
+		}
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	list := make(map[string]*Client, len(clis))
+	idIndex := make(map[string]*Client, len(clis))
+	for i, c := range clis {
+		_, err = applyBatchOp(list, idIndex, &clientsBatchOp{cli: c, action: clientsBatchAdd})
+		if err != nil {
+			return fmt.Errorf("client at index %d: %w", i, err)
+		}
+	}
+
+	prev := clients.list
+	clients.list, clients.idIndex = list, idIndex
+
+	for _, c := range prev {
+		err = c.closeUpstreams()
+		if err != nil {
+			log.Error("clients: closing upstreams of %q: %s", c.Name, err)
+		}
+	}
+
+	log.Debug("clients: replaced %d clients with %d", len(prev), len(list))
+
+	return nil
+}
+
 // updateIDIndex updates the ID index data for cli using the information from
 // newIDs.
 func (clients *clientsContainer) updateIDIndex(cli *Client, newIDs []string) (err error) {
@@ -752,7 +1098,9 @@ func (clients *clientsContainer) addHostLocked(
 ) (ok bool) {
 	rc, ok := clients.ipToRC[ip]
 	if ok {
-		if rc.Source > src {
+		// The runtime clients created for the WHOIS information only have no
+		// names, so any source may set one.
+		if rc.Host != "" && clients.rankLocked(rc.Source) > clients.rankLocked(src) {
 			return false
 		}
 
@@ -836,6 +1184,46 @@ func (clients *clientsContainer) addFromSystemARP() {
 	log.Debug("clients: added %d client aliases from arp neighborhood", added)
 }
 
+// addFromSSDP adds the IP-name pairing and the device information of the UPnP
+// device d.
+func (clients *clientsContainer) addFromSSDP(d *aghnet.SSDPDevice) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	clients.addHostLocked(d.IP, d.FriendlyName, ClientSourceSSDP)
+
+	// Keep the device information even if the name is taken from a source
+	// with a higher priority.
+	if rc, ok := clients.ipToRC[d.IP]; ok {
+		rc.SSDPInfo = &RuntimeClientSSDPInfo{
+			Manufacturer: d.Manufacturer,
+			Model:        d.Model,
+		}
+	}
+
+	log.Debug("clients: added ssdp device %s -> %q", d.IP, d.FriendlyName)
+}
+
+// rmFromSSDP removes the information about the UPnP device with ip, which has
+// left the network.
+func (clients *clientsContainer) rmFromSSDP(ip netip.Addr) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	rc, ok := clients.ipToRC[ip]
+	if !ok {
+		return
+	}
+
+	if rc.Source == ClientSourceSSDP {
+		delete(clients.ipToRC, ip)
+	} else {
+		rc.SSDPInfo = nil
+	}
+
+	log.Debug("clients: removed ssdp device %s", ip)
+}
+
 // updateFromDHCP adds the clients that have a non-empty hostname from the DHCP
 // server.
 func (clients *clientsContainer) updateFromDHCP(add bool) {
@@ -890,9 +1278,134 @@ func (clients *clientsContainer) close() (err error) {
 		}
 	}
 
+	if clients.ssdp != nil {
+		if err = clients.ssdp.Close(); err != nil {
+			errs = append(errs, err)
+		}
+
+		clients.ssdp = nil
+	}
+
 	if len(errs) > 0 {
 		return errors.List("closing client specific upstreams", errs...)
 	}
 
 	return nil
 }
+
+// wakeTarget is a device to send the Wake-on-LAN magic packet to.
+type wakeTarget struct {
+	// ip is the IP address of the device, if known.
+	ip netip.Addr
+
+	// mac is the hardware address of the device.
+	mac net.HardwareAddr
+}
+
+// findWakeTargets returns the devices known for the client with id, which is
+// either the name of a persistent client or any of its identifiers.  The
+// hardware and IP addresses are taken from the client's identifiers, the DHCP
+// leases, and the ARP neighborhood.  ok is false if there is no such client and
+// id isn't an IP address of a runtime client.
+func (clients *clientsContainer) findWakeTargets(id string) (targets []wakeTarget, ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	var ids []string
+	if c, found := clients.list[id]; found {
+		ids = c.IDs
+	} else if c, found = clients.findLocked(id); found {
+		ids = c.IDs
+	} else if ip, err := netip.ParseAddr(id); err == nil {
+		if _, found = clients.ipToRC[ip]; !found {
+			return nil, false
+		}
+
+		ids = []string{id}
+	} else {
+		return nil, false
+	}
+
+	seen := stringutil.NewSet()
+	addTarget := func(mac net.HardwareAddr, ip netip.Addr) {
+		if len(mac) != 0 && !seen.Has(mac.String()) {
+			seen.Add(mac.String())
+			targets = append(targets, wakeTarget{ip: ip, mac: mac})
+		}
+	}
+
+	for _, cid := range ids {
+		if mac, err := net.ParseMAC(cid); err == nil {
+			addTarget(mac, clients.ipByMACLocked(mac))
+
+			continue
+		}
+
+		ip, err := netip.ParseAddr(cid)
+		if err != nil {
+			continue
+		}
+
+		if clients.dhcpServer != nil {
+			addTarget(clients.dhcpServer.FindMACbyIP(ip), ip)
+		}
+
+		if clients.arpdb != nil {
+			for _, n := range clients.arpdb.Neighbors() {
+				if n.IP == ip {
+					addTarget(n.MAC, ip)
+				}
+			}
+		}
+	}
+
+	return targets, true
+}
+
+// macsByIPLocked returns the hardware addresses of the devices by their IP
+// addresses from the DHCP leases and the ARP neighborhood, the former taking
+// precedence.  clients.lock is expected to be locked.
+func (clients *clientsContainer) macsByIPLocked() (macs map[netip.Addr]net.HardwareAddr) {
+	macs = map[netip.Addr]net.HardwareAddr{}
+	if clients.arpdb != nil {
+		for _, n := range clients.arpdb.Neighbors() {
+			macs[n.IP] = n.MAC
+		}
+	}
+
+	if clients.dhcpServer != nil {
+		for _, l := range clients.dhcpServer.Leases(dhcpd.LeasesAll) {
+			ip, ok := netip.AddrFromSlice(l.IP)
+			if ok {
+				macs[ip.Unmap()] = l.HWAddr
+			}
+		}
+	}
+
+	return macs
+}
+
+// ipByMACLocked returns the IP address of the device with mac from the DHCP
+// leases or the ARP neighborhood.  ip is not valid if there is none.
+// clients.lock is expected to be locked.
+func (clients *clientsContainer) ipByMACLocked(mac net.HardwareAddr) (ip netip.Addr) {
+	if clients.dhcpServer != nil {
+		for _, l := range clients.dhcpServer.Leases(dhcpd.LeasesAll) {
+			if bytes.Equal(l.HWAddr, mac) {
+				ip, _ = netip.AddrFromSlice(l.IP)
+
+				return ip.Unmap()
+			}
+		}
+	}
+
+	if clients.arpdb != nil {
+		for _, n := range clients.arpdb.Neighbors() {
+			if bytes.Equal(n.MAC, mac) {
+				return n.IP
+			}
+		}
+	}
+
+	return netip.Addr{}
+}
@@ -2,17 +2,24 @@ package home
 
 import (
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"os"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/golibs/testutil"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"howett.net/plist"
 )
 
 func TestClients(t *testing.T) {
@@ -90,6 +97,35 @@ func TestClients(t *testing.T) {
 		assert.False(t, ok)
 	})
 
+	t.Run("add_fail_allowed_service", func(t *testing.T) {
+		filtering.InitModule()
+
+		ok, err := clients.Add(&Client{
+			IDs:             []string{"3.3.3.3"},
+			Name:            "client3",
+			DefaultDeny:     true,
+			AllowedServices: []string{"youtube", "unknown"},
+		})
+		testutil.AssertErrorMsg(t, `invalid allowed service: "unknown"`, err)
+
+		assert.False(t, ok)
+	})
+
+	t.Run("add_fail_answer_rules", func(t *testing.T) {
+		ok, err := clients.Add(&Client{
+			IDs:         []string{"3.3.3.3"},
+			Name:        "client3",
+			AnswerRules: []string{"strip AAAA", "ttl"},
+		})
+		testutil.AssertErrorMsg(
+			t,
+			"invalid answer rules: answer rule at index 1: ttl: want 1 argument, got 0",
+			err,
+		)
+
+		assert.False(t, ok)
+	})
+
 	t.Run("update_fail_name", func(t *testing.T) {
 		err := clients.Update("client3", &Client{
 			IDs:  []string{"1.2.3.0"},
@@ -246,6 +282,63 @@ func TestClientsWHOIS(t *testing.T) {
 	})
 }
 
+func TestClientsSSDP(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil, nil)
+
+	wantInfo := &RuntimeClientSSDPInfo{
+		Manufacturer: "ACME",
+		Model:        "TV-3000",
+	}
+
+	t.Run("new_client", func(t *testing.T) {
+		ip := netip.MustParseAddr("1.1.1.1")
+		clients.addFromSSDP(&aghnet.SSDPDevice{
+			IP:           ip,
+			FriendlyName: "Living Room TV",
+			Manufacturer: "ACME",
+			Model:        "TV-3000",
+		})
+
+		rc := clients.ipToRC[ip]
+		require.NotNil(t, rc)
+
+		assert.Equal(t, "Living Room TV", rc.Host)
+		assert.Equal(t, ClientSourceSSDP, rc.Source)
+		assert.Equal(t, wantInfo, rc.SSDPInfo)
+
+		clients.rmFromSSDP(ip)
+		assert.NotContains(t, clients.ipToRC, ip)
+	})
+
+	t.Run("dhcp_client", func(t *testing.T) {
+		ip := netip.MustParseAddr("1.1.1.2")
+		ok := clients.AddHost(ip, "tv.lan", ClientSourceDHCP)
+		require.True(t, ok)
+
+		clients.addFromSSDP(&aghnet.SSDPDevice{
+			IP:           ip,
+			FriendlyName: "Living Room TV",
+			Manufacturer: "ACME",
+			Model:        "TV-3000",
+		})
+
+		rc := clients.ipToRC[ip]
+		require.NotNil(t, rc)
+
+		assert.Equal(t, "tv.lan", rc.Host)
+		assert.Equal(t, ClientSourceDHCP, rc.Source)
+		assert.Equal(t, wantInfo, rc.SSDPInfo)
+
+		clients.rmFromSSDP(ip)
+		require.Contains(t, clients.ipToRC, ip)
+
+		assert.Nil(t, clients.ipToRC[ip].SSDPInfo)
+	})
+}
+
 func TestClientsAddExisting(t *testing.T) {
 	clients := clientsContainer{
 		testing: true,
@@ -352,3 +445,544 @@ func TestClientsCustomUpstream(t *testing.T) {
 	assert.Len(t, config.Upstreams, 1)
 	assert.Len(t, config.DomainReservedUpstreams, 1)
 }
+
+// fakeARPDB is a fake aghnet.ARPDB implementation for tests.
+type fakeARPDB struct {
+	ns []aghnet.Neighbor
+}
+
+// Refresh implements the aghnet.ARPDB interface for *fakeARPDB.
+func (*fakeARPDB) Refresh() (err error) { return nil }
+
+// Neighbors implements the aghnet.ARPDB interface for *fakeARPDB.
+func (db *fakeARPDB) Neighbors() (ns []aghnet.Neighbor) { return db.ns }
+
+func TestClientsContainer_findWakeTargets(t *testing.T) {
+	var (
+		dhcpMAC = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+		arpMAC  = net.HardwareAddr{0x66, 0x77, 0x88, 0x99, 0xAA, 0xBB}
+		cfgMAC  = net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA}
+
+		dhcpIP    = netip.MustParseAddr("1.2.3.4")
+		arpIP     = netip.MustParseAddr("1.2.3.5")
+		runtimeIP = netip.MustParseAddr("1.2.3.6")
+		leaseIP   = netip.MustParseAddr("1.2.3.7")
+	)
+
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil, nil)
+
+	clients.dhcpServer = &dhcpd.MockInterface{
+		OnFindMACbyIP: func(ip netip.Addr) (mac net.HardwareAddr) {
+			if ip == dhcpIP {
+				return dhcpMAC
+			}
+
+			return nil
+		},
+		OnLeases: func(_ dhcpd.GetLeasesFlags) (ls []*dhcpd.Lease) {
+			return []*dhcpd.Lease{{
+				HWAddr: cfgMAC,
+				IP:     leaseIP.AsSlice(),
+			}}
+		},
+	}
+	clients.arpdb = &fakeARPDB{ns: []aghnet.Neighbor{{
+		IP:  arpIP,
+		MAC: arpMAC,
+	}, {
+		IP:  runtimeIP,
+		MAC: arpMAC,
+	}}}
+
+	ok, err := clients.Add(&Client{
+		IDs:  []string{dhcpIP.String(), arpIP.String(), cfgMAC.String()},
+		Name: "client1",
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = clients.Add(&Client{
+		IDs:  []string{"9.9.9.9"},
+		Name: "client2",
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok = clients.AddHost(runtimeIP, "runtime", ClientSourceRDNS)
+	require.True(t, ok)
+
+	client1Targets := []wakeTarget{{
+		ip:  dhcpIP,
+		mac: dhcpMAC,
+	}, {
+		ip:  arpIP,
+		mac: arpMAC,
+	}, {
+		ip:  leaseIP,
+		mac: cfgMAC,
+	}}
+
+	testCases := []struct {
+		name   string
+		id     string
+		want   []wakeTarget
+		wantOK bool
+	}{{
+		name:   "by_name",
+		id:     "client1",
+		want:   client1Targets,
+		wantOK: true,
+	}, {
+		name:   "by_id",
+		id:     arpIP.String(),
+		want:   client1Targets,
+		wantOK: true,
+	}, {
+		name:   "no_mac",
+		id:     "client2",
+		want:   nil,
+		wantOK: true,
+	}, {
+		name: "runtime",
+		id:   runtimeIP.String(),
+		want: []wakeTarget{{
+			ip:  runtimeIP,
+			mac: arpMAC,
+		}},
+		wantOK: true,
+	}, {
+		name:   "not_found",
+		id:     "client3",
+		want:   nil,
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targets, found := clients.findWakeTargets(tc.id)
+			require.Equal(t, tc.wantOK, found)
+
+			assert.Equal(t, tc.want, targets)
+		})
+	}
+}
+
+func TestClientsContainer_findClientID(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:  []string{"1.2.3.4", "aa:aa:aa:aa:aa:aa", "laptop", "phone"},
+		Name: "client1",
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = clients.Add(&Client{
+		IDs:  []string{"5.6.7.8"},
+		Name: "client2",
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	testCases := []struct {
+		name   string
+		id     string
+		want   string
+		wantOK bool
+	}{{
+		name:   "by_name",
+		id:     "client1",
+		want:   "laptop",
+		wantOK: true,
+	}, {
+		name:   "by_id",
+		id:     "1.2.3.4",
+		want:   "laptop",
+		wantOK: true,
+	}, {
+		name:   "no_clientid",
+		id:     "client2",
+		want:   "",
+		wantOK: true,
+	}, {
+		name:   "not_found",
+		id:     "client3",
+		want:   "",
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clientID, found := clients.findClientID(tc.id)
+			require.Equal(t, tc.wantOK, found)
+
+			assert.Equal(t, tc.want, clientID)
+		})
+	}
+}
+
+func TestNewClientSetup(t *testing.T) {
+	testCases := []struct {
+		tlsConf     *tlsConfigSettings
+		name        string
+		wantDoH     string
+		wantDoT     string
+		wantDoTHost string
+		wantAndroid string
+	}{{
+		tlsConf: &tlsConfigSettings{
+			PortHTTPS:      defaultPortHTTPS,
+			PortDNSOverTLS: defaultPortTLS,
+		},
+		name:        "default_ports",
+		wantDoH:     "https://dns.example/dns-query/phone",
+		wantDoT:     "tls://phone.dns.example",
+		wantDoTHost: "phone.dns.example",
+		wantAndroid: "phone.dns.example",
+	}, {
+		tlsConf: &tlsConfigSettings{
+			PortHTTPS:      8443,
+			PortDNSOverTLS: 8853,
+		},
+		name:        "custom_ports",
+		wantDoH:     "https://dns.example:8443/dns-query/phone",
+		wantDoT:     "tls://phone.dns.example:8853",
+		wantDoTHost: "phone.dns.example",
+		wantAndroid: "",
+	}, {
+		tlsConf: &tlsConfigSettings{
+			PortHTTPS:      0,
+			PortDNSOverTLS: defaultPortTLS,
+		},
+		name:        "no_doh",
+		wantDoH:     "",
+		wantDoT:     "tls://phone.dns.example",
+		wantDoTHost: "phone.dns.example",
+		wantAndroid: "phone.dns.example",
+	}, {
+		tlsConf: &tlsConfigSettings{
+			PortHTTPS:      defaultPortHTTPS,
+			PortDNSOverTLS: 0,
+		},
+		name:        "no_dot",
+		wantDoH:     "https://dns.example/dns-query/phone",
+		wantDoT:     "",
+		wantDoTHost: "",
+		wantAndroid: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setup, err := newClientSetup("phone", "dns.example", tc.tlsConf)
+			require.NoError(t, err)
+
+			assert.Equal(t, "phone", setup.ClientID)
+			assert.Equal(t, tc.wantDoH, setup.DoHURL)
+			assert.Equal(t, tc.wantDoT, setup.DoTURL)
+			assert.Equal(t, tc.wantDoTHost, setup.DoTHostname)
+			assert.Equal(t, tc.wantAndroid, setup.AndroidPrivateDNS)
+
+			if tc.wantDoH == "" {
+				assert.Empty(t, setup.AppleMobileconfig)
+
+				return
+			}
+
+			mc := &mobileConfig{}
+			_, err = plist.Unmarshal([]byte(setup.AppleMobileconfig), mc)
+			require.NoError(t, err)
+			require.Len(t, mc.PayloadContent, 1)
+
+			assert.Equal(t, tc.wantDoH, mc.PayloadContent[0].DNSSettings.ServerURL)
+		})
+	}
+}
+
+func TestClientsContainer_handleClientSetup_disabled(t *testing.T) {
+	prevTLS := Context.tls
+	t.Cleanup(func() { Context.tls = prevTLS })
+
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:  []string{"phone"},
+		Name: "client",
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	testCases := []struct {
+		name    string
+		wantMsg string
+		conf    tlsConfigSettings
+	}{{
+		name:    "encryption",
+		wantMsg: "encryption is disabled\n",
+		conf: tlsConfigSettings{
+			Enabled:        false,
+			ServerName:     "dns.example",
+			PortHTTPS:      defaultPortHTTPS,
+			PortDNSOverTLS: defaultPortTLS,
+		},
+	}, {
+		name:    "protocols",
+		wantMsg: "both dns-over-https and dns-over-tls are disabled\n",
+		conf: tlsConfigSettings{
+			Enabled:    true,
+			ServerName: "dns.example",
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			Context.tls = &tlsManager{conf: tc.conf}
+
+			r := httptest.NewRequest(http.MethodGet, "/control/clients/setup?id=client", nil)
+			w := httptest.NewRecorder()
+
+			clients.handleClientSetup(w, r)
+
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Equal(t, tc.wantMsg, w.Body.String())
+		})
+	}
+}
+
+func TestClientsContainer_reload(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+
+	clients.Init([]*clientObject{{
+		Name: "old",
+		IDs:  []string{"1.1.1.1"},
+	}}, nil, nil, nil, &filtering.Config{})
+
+	clients.reload([]*clientObject{{
+		Name: "new",
+		IDs:  []string{"2.2.2.2"},
+	}}, &filtering.Config{})
+
+	_, ok := clients.Find("1.1.1.1")
+	assert.False(t, ok)
+
+	c, ok := clients.Find("2.2.2.2")
+	require.True(t, ok)
+
+	assert.Equal(t, "new", c.Name)
+}
+
+func TestClientsContainer_applyBatch(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+
+	clients.Init([]*clientObject{{
+		Name: "first",
+		IDs:  []string{"1.1.1.1"},
+	}, {
+		Name: "second",
+		IDs:  []string{"2.2.2.2"},
+	}}, nil, nil, nil, &filtering.Config{})
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		ops        []*clientsBatchOp
+	}{{
+		name:       "not_found",
+		wantErrMsg: `operation at index 1: client "none" not found`,
+		ops: []*clientsBatchOp{{
+			cli:    &Client{Name: "third", IDs: []string{"3.3.3.3"}},
+			action: clientsBatchAdd,
+		}, {
+			cli:    &Client{Name: "none", IDs: []string{"4.4.4.4"}},
+			action: clientsBatchUpdate,
+			name:   "none",
+		}},
+	}, {
+		name:       "same_id",
+		wantErrMsg: `operation at index 1: id "3.3.3.3" is used by client with name "third"`,
+		ops: []*clientsBatchOp{{
+			cli:    &Client{Name: "third", IDs: []string{"3.3.3.3"}},
+			action: clientsBatchAdd,
+		}, {
+			cli:    &Client{Name: "fourth", IDs: []string{"3.3.3.3"}},
+			action: clientsBatchAdd,
+		}},
+	}, {
+		name:       "invalid",
+		wantErrMsg: `operation at index 0: id required`,
+		ops: []*clientsBatchOp{{
+			cli:    &Client{Name: "third"},
+			action: clientsBatchAdd,
+		}},
+	}, {
+		name:       "success",
+		wantErrMsg: "",
+		ops: []*clientsBatchOp{{
+			action: clientsBatchDelete,
+			name:   "second",
+		}, {
+			// The ID of the deleted client must be reusable.
+			cli:    &Client{Name: "renamed", IDs: []string{"2.2.2.2"}},
+			action: clientsBatchUpdate,
+			name:   "first",
+		}, {
+			cli:    &Client{Name: "third", IDs: []string{"3.3.3.3"}},
+			action: clientsBatchAdd,
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := clients.applyBatch(tc.ops)
+			if tc.wantErrMsg != "" {
+				testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+				// Make sure nothing is changed.
+				assert.Len(t, clients.list, 2)
+				assert.Len(t, clients.idIndex, 2)
+
+				_, ok := clients.Find("3.3.3.3")
+				assert.False(t, ok)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Len(t, clients.list, 2)
+			assert.Len(t, clients.idIndex, 2)
+
+			_, ok := clients.Find("1.1.1.1")
+			assert.False(t, ok)
+
+			c, ok := clients.Find("2.2.2.2")
+			require.True(t, ok)
+
+			assert.Equal(t, "renamed", c.Name)
+
+			c, ok = clients.Find("3.3.3.3")
+			require.True(t, ok)
+
+			assert.Equal(t, "third", c.Name)
+		})
+	}
+}
+
+func TestClientsContainer_replaceAll(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+
+	clients.Init([]*clientObject{{
+		Name: "first",
+		IDs:  []string{"1.1.1.1"},
+	}, {
+		Name: "second",
+		IDs:  []string{"2.2.2.2"},
+	}}, nil, nil, nil, &filtering.Config{})
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		clis       []*Client
+	}{{
+		name:       "same_name",
+		wantErrMsg: `client at index 1: client "third" already exists`,
+		clis: []*Client{
+			{Name: "third", IDs: []string{"3.3.3.3"}},
+			{Name: "third", IDs: []string{"4.4.4.4"}},
+		},
+	}, {
+		name:       "invalid",
+		wantErrMsg: `client at index 0: id required`,
+		clis:       []*Client{{Name: "third"}},
+	}, {
+		name:       "success",
+		wantErrMsg: "",
+		clis: []*Client{
+			// The IDs of the replaced clients must be reusable.
+			{Name: "renamed", IDs: []string{"1.1.1.1"}},
+			{Name: "third", IDs: []string{"3.3.3.3"}},
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := clients.replaceAll(tc.clis)
+			if tc.wantErrMsg != "" {
+				testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+				// Make sure nothing is changed.
+				assert.Len(t, clients.list, 2)
+				assert.Len(t, clients.idIndex, 2)
+
+				_, ok := clients.Find("3.3.3.3")
+				assert.False(t, ok)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Len(t, clients.list, 2)
+			assert.Len(t, clients.idIndex, 2)
+
+			_, ok := clients.Find("2.2.2.2")
+			assert.False(t, ok)
+
+			c, ok := clients.Find("1.1.1.1")
+			require.True(t, ok)
+
+			assert.Equal(t, "renamed", c.Name)
+		})
+	}
+}
+
+func TestClientsContainer_handleReplaceClients_ifMatch(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+
+	clients.Init([]*clientObject{{
+		Name: "first",
+		IDs:  []string{"1.1.1.1"},
+	}}, nil, nil, nil, &filtering.Config{})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/control/clients", nil)
+	clients.handleGetClients(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	etag := w.Header().Get(aghhttp.HdrNameETag)
+	require.NotEmpty(t, etag)
+
+	// Make sure the entity tag is stable.
+	w = httptest.NewRecorder()
+	clients.handleGetClients(w, r)
+	assert.Equal(t, etag, w.Header().Get(aghhttp.HdrNameETag))
+
+	_, err := clients.Add(&Client{Name: "second", IDs: []string{"2.2.2.2"}})
+	require.NoError(t, err)
+
+	body := strings.NewReader(`{"clients":[{"name":"third","ids":["3.3.3.3"]}]}`)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPut, "/control/clients/replace", body)
+	r.Header.Set(aghhttp.HdrNameIfMatch, etag)
+	clients.handleReplaceClients(w, r)
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get(aghhttp.HdrNameETag))
+	assert.Len(t, clients.list, 2)
+}
@@ -0,0 +1,186 @@
+package home
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// clientSetupJSON is the response to the GET /control/clients/setup HTTP API.
+// It contains the settings of the encrypted DNS protocols for a device of a
+// persistent client.  The settings of the disabled protocols are empty.
+type clientSetupJSON struct {
+	// ClientID is the ClientID of the client used in the settings.
+	ClientID string `json:"client_id"`
+
+	// DoHURL is the URL of the DNS-over-HTTPS server.
+	DoHURL string `json:"doh_url,omitempty"`
+
+	// DoTURL is the URL of the DNS-over-TLS server.
+	DoTURL string `json:"dot_url,omitempty"`
+
+	// DoTHostname is the hostname of the DNS-over-TLS server.
+	DoTHostname string `json:"dot_hostname,omitempty"`
+
+	// AndroidPrivateDNS is the hostname to use as the Android Private DNS.  It
+	// is empty if the DNS-over-TLS server isn't listening on the default port,
+	// since Android doesn't support setting the port.
+	AndroidPrivateDNS string `json:"android_private_dns,omitempty"`
+
+	// AppleMobileconfig is the Apple configuration profile which sets up
+	// DNS-over-HTTPS.
+	AppleMobileconfig string `json:"apple_mobileconfig,omitempty"`
+}
+
+// errEncryptionDisabled is returned when the client setup is requested while
+// the encryption is disabled.
+const errEncryptionDisabled errors.Error = "encryption is disabled"
+
+// errNoEncryptedProtos is returned when the client setup is requested while
+// both DNS-over-HTTPS and DNS-over-TLS are disabled.
+const errNoEncryptedProtos errors.Error = "both dns-over-https and dns-over-tls are disabled"
+
+// handleClientSetup is the handler for the GET /control/clients/setup HTTP
+// API.  It generates the settings for a device of the persistent client with
+// the name or the identifier from the id query parameter, using its first
+// ClientID.  The server name is taken from the host query parameter or the
+// encryption settings.
+func (clients *clientsContainer) handleClientSetup(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("id")
+	if id == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "client's id must be non-empty")
+
+		return
+	}
+
+	tlsConf := &tlsConfigSettings{}
+	Context.tls.WriteDiskConfig(tlsConf)
+
+	if !tlsConf.Enabled {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", errEncryptionDisabled)
+
+		return
+	} else if tlsConf.PortHTTPS == 0 && tlsConf.PortDNSOverTLS == 0 {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", errNoEncryptedProtos)
+
+		return
+	}
+
+	host := q.Get("host")
+	if host == "" {
+		host = tlsConf.ServerName
+	}
+
+	if host == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", errEmptyHost)
+
+		return
+	}
+
+	clientID, ok := clients.findClientID(id)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusBadRequest, "Client not found")
+
+		return
+	} else if clientID == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no clientid known for client %q", id)
+
+		return
+	}
+
+	setup, err := newClientSetup(clientID, host, tlsConf)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "generating setup: %s", err)
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, setup)
+}
+
+// newClientSetup returns the encrypted DNS settings for clientID with the
+// server's hostname host and the encryption settings tlsConf.  The settings of
+// the protocols with the zero port in tlsConf, which means that they are
+// disabled, are left empty.
+func newClientSetup(
+	clientID string,
+	host string,
+	tlsConf *tlsConfigSettings,
+) (setup *clientSetupJSON, err error) {
+	setup = &clientSetupJSON{
+		ClientID: clientID,
+	}
+
+	if p := tlsConf.PortHTTPS; p != 0 {
+		dohHost := host
+		if p != defaultPortHTTPS {
+			dohHost = netutil.JoinHostPort(host, p)
+		}
+
+		var mc []byte
+		mc, err = encodeMobileConfig(&dnsSettings{
+			DNSProtocol: dnsProtoHTTPS,
+			ServerName:  dohHost,
+		}, clientID)
+		if err != nil {
+			return nil, err
+		}
+
+		setup.DoHURL = (&url.URL{
+			Scheme: aghhttp.SchemeHTTPS,
+			Host:   dohHost,
+			Path:   path.Join("/dns-query", clientID),
+		}).String()
+		setup.AppleMobileconfig = string(mc)
+	}
+
+	if p := tlsConf.PortDNSOverTLS; p != 0 {
+		dotHost := clientID + "." + host
+		dotAddr := dotHost
+		if p != defaultPortTLS {
+			dotAddr = netutil.JoinHostPort(dotHost, p)
+		} else {
+			setup.AndroidPrivateDNS = dotHost
+		}
+
+		setup.DoTURL = "tls://" + dotAddr
+		setup.DoTHostname = dotHost
+	}
+
+	return setup, nil
+}
+
+// findClientID returns the first ClientID of the persistent client with the
+// name or the identifier id.  clientID is empty if the client has no
+// ClientIDs.  ok is false if there is no such client.
+func (clients *clientsContainer) findClientID(id string) (clientID string, ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	c, ok := clients.list[id]
+	if !ok {
+		c, ok = clients.findLocked(id)
+		if !ok {
+			return "", false
+		}
+	}
+
+	for _, cid := range c.IDs {
+		if _, err := net.ParseMAC(cid); err == nil {
+			continue
+		}
+
+		if dnsforward.ValidateClientID(cid) == nil {
+			return cid, true
+		}
+	}
+
+	return "", true
+}
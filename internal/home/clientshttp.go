@@ -3,11 +3,17 @@ package home
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/netip"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/slices"
 )
 
 // clientJSON is a common structure used by several handlers to deal with
@@ -29,12 +35,27 @@ type clientJSON struct {
 
 	WHOISInfo *RuntimeClientWHOISInfo `json:"whois_info,omitempty"`
 
+	// SSDPInfo is the information about the UPnP device of a runtime client,
+	// if any.  It's ignored in requests.
+	SSDPInfo *RuntimeClientSSDPInfo `json:"ssdp_info,omitempty"`
+
+	// LastSeen is the time of the last request from any of the addresses of
+	// the client, if any.  It's ignored in requests.
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+
 	Name string `json:"name"`
 
+	// NameSource is the source which the name of a client found by the GET
+	// /control/clients/find HTTP API has been obtained from, if any.  It's
+	// ignored in requests.
+	NameSource string `json:"name_source,omitempty"`
+
 	BlockedServices []string `json:"blocked_services"`
 	IDs             []string `json:"ids"`
 	Tags            []string `json:"tags"`
 	Upstreams       []string `json:"upstreams"`
+	AllowedServices []string `json:"allowed_services"`
+	AnswerRules     []string `json:"answer_rules"`
 
 	FilteringEnabled    bool `json:"filtering_enabled"`
 	ParentalEnabled     bool `json:"parental_enabled"`
@@ -43,51 +64,153 @@ type clientJSON struct {
 	SafeSearchEnabled        bool `json:"safesearch_enabled"`
 	UseGlobalBlockedServices bool `json:"use_global_blocked_services"`
 	UseGlobalSettings        bool `json:"use_global_settings"`
+	DefaultDeny              bool `json:"default_deny"`
+	DryRun                   bool `json:"dry_run"`
+	ParentalStrictSearch     bool `json:"parental_strict_search"`
+	IgnoreLogging            bool `json:"ignore_logging"`
 }
 
 type runtimeClientJSON struct {
 	WHOISInfo *RuntimeClientWHOISInfo `json:"whois_info"`
 
+	// SSDPInfo is the information about the UPnP device, if any.
+	SSDPInfo *RuntimeClientSSDPInfo `json:"ssdp_info,omitempty"`
+
+	// LastSeen is the time of the last request of the client, if any.
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+
 	Name   string       `json:"name"`
 	IP     netip.Addr   `json:"ip"`
 	Source clientSource `json:"source"`
+
+	// Vendor is the name of the vendor of the hardware address of the client,
+	// if known.
+	Vendor string `json:"vendor,omitempty"`
 }
 
 type clientListJSON struct {
 	Clients        []*clientJSON       `json:"clients"`
 	RuntimeClients []runtimeClientJSON `json:"auto_clients"`
 	Tags           []string            `json:"supported_tags"`
+
+	// ClientsTotal and RuntimeClientsTotal are the numbers of the matched
+	// clients before the pagination.
+	ClientsTotal        int `json:"clients_total"`
+	RuntimeClientsTotal int `json:"auto_clients_total"`
+}
+
+// timePtr returns a pointer to t or nil if t is zero.
+func timePtr(t time.Time) (p *time.Time) {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
 }
 
-// respond with information about configured clients
+// handleGetClients is the handler for the GET /control/clients HTTP API.  The
+// optional query parameters filter the clients and paginate both lists
+// separately, see [parseClientsSearch].
 func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, r *http.Request) {
+	s, err := parseClientsSearch(r.URL.Query(), time.Now())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing search: %s", err)
+
+		return
+	}
+
 	data := clientListJSON{}
 
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
+	// The entity tag is calculated over all persistent clients regardless of
+	// the search, so that it may be used to replace them all.
+	err = aghhttp.SetETag(w, r, clients.persistentJSONLocked())
+	if err != nil {
+		return
+	}
+
+	clients.seenLock.Lock()
+	defer clients.seenLock.Unlock()
+
 	for _, c := range clients.list {
+		lastSeen := clients.lastSeenLocked(c)
+		if !s.matchesPersistent(c, lastSeen) {
+			continue
+		}
+
 		cj := clientToJSON(c)
+		cj.LastSeen = timePtr(lastSeen)
 		data.Clients = append(data.Clients, cj)
 	}
 
+	var macs map[netip.Addr]net.HardwareAddr
+	if clients.oui != nil {
+		macs = clients.macsByIPLocked()
+	}
+
 	for ip, rc := range clients.ipToRC {
+		lastSeen := clients.lastSeen[ip]
+		if !s.matchesRuntime(ip, rc, lastSeen) {
+			continue
+		}
+
 		cj := runtimeClientJSON{
 			WHOISInfo: rc.WHOISInfo,
+			SSDPInfo:  rc.SSDPInfo,
+			LastSeen:  timePtr(lastSeen),
 
 			Name:   rc.Host,
 			Source: rc.Source,
 			IP:     ip,
+			Vendor: clients.oui.Vendor(macs[ip]),
 		}
 
 		data.RuntimeClients = append(data.RuntimeClients, cj)
 	}
 
+	// Sort the lists to make the pagination stable.
+	slices.SortFunc(data.Clients, func(a, b *clientJSON) (less bool) { return a.Name < b.Name })
+	slices.SortFunc(data.RuntimeClients, func(a, b runtimeClientJSON) (less bool) {
+		return a.IP.Less(b.IP)
+	})
+
+	data.ClientsTotal, data.RuntimeClientsTotal = len(data.Clients), len(data.RuntimeClients)
+
+	start, end := s.page(len(data.Clients))
+	data.Clients = data.Clients[start:end]
+
+	start, end = s.page(len(data.RuntimeClients))
+	data.RuntimeClients = data.RuntimeClients[start:end]
+
 	data.Tags = clientTags
 
 	_ = aghhttp.WriteJSONResponse(w, r, data)
 }
 
+// persistentJSONLocked returns the JSON representations of all persistent
+// clients sorted by name.  clients.lock is expected to be locked.
+func (clients *clientsContainer) persistentJSONLocked() (cjs []*clientJSON) {
+	cjs = make([]*clientJSON, 0, len(clients.list))
+	for _, c := range clients.list {
+		cjs = append(cjs, clientToJSON(c))
+	}
+
+	slices.SortFunc(cjs, func(a, b *clientJSON) (less bool) { return a.Name < b.Name })
+
+	return cjs
+}
+
+// persistentJSON is like [clientsContainer.persistentJSONLocked] but locks
+// clients.lock itself.
+func (clients *clientsContainer) persistentJSON() (cjs []*clientJSON) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	return clients.persistentJSONLocked()
+}
+
 // Convert JSON object to Client object
 func jsonToClient(cj clientJSON) (c *Client) {
 	// TODO(d.kolyshev): Remove after cleaning the deprecated
@@ -113,11 +236,19 @@ func jsonToClient(cj clientJSON) (c *Client) {
 		ParentalEnabled:     cj.ParentalEnabled,
 		safeSearchConf:      safeSearchConf,
 		SafeBrowsingEnabled: cj.SafeBrowsingEnabled,
+		DryRun:              cj.DryRun,
+
+		ParentalStrictSearch: cj.ParentalStrictSearch,
+		IgnoreLogging:        cj.IgnoreLogging,
 
 		UseOwnBlockedServices: !cj.UseGlobalBlockedServices,
 		BlockedServices:       cj.BlockedServices,
 
-		Upstreams: cj.Upstreams,
+		DefaultDeny:     cj.DefaultDeny,
+		AllowedServices: cj.AllowedServices,
+
+		Upstreams:   cj.Upstreams,
+		AnswerRules: cj.AnswerRules,
 	}
 }
 
@@ -137,11 +268,19 @@ func clientToJSON(c *Client) (cj *clientJSON) {
 		ParentalEnabled:     c.ParentalEnabled,
 		SafeSearchEnabled:   safeSearchConf.Enabled,
 		SafeBrowsingEnabled: c.SafeBrowsingEnabled,
+		DryRun:              c.DryRun,
+
+		ParentalStrictSearch: c.ParentalStrictSearch,
+		IgnoreLogging:        c.IgnoreLogging,
 
 		UseGlobalBlockedServices: !c.UseOwnBlockedServices,
 		BlockedServices:          c.BlockedServices,
 
-		Upstreams: c.Upstreams,
+		DefaultDeny:     c.DefaultDeny,
+		AllowedServices: c.AllowedServices,
+
+		Upstreams:   c.Upstreams,
+		AnswerRules: c.AnswerRules,
 	}
 }
 
@@ -229,6 +368,145 @@ func (clients *clientsContainer) handleUpdateClient(w http.ResponseWriter, r *ht
 	onConfigModified()
 }
 
+// clientsBatchOpJSON is a single operation of the POST /control/clients/batch
+// HTTP API.
+type clientsBatchOpJSON struct {
+	// Data is the new data of the client.  It's required for the add and the
+	// update actions.
+	Data *clientJSON `json:"data"`
+
+	// Action is the action of the operation.
+	Action clientsBatchAction `json:"action"`
+
+	// Name is the name of the client to update or delete.
+	Name string `json:"name"`
+}
+
+// toOp converts j into a clients batch operation.
+func (j *clientsBatchOpJSON) toOp() (op *clientsBatchOp, err error) {
+	if j == nil {
+		return nil, errors.Error("operation is null")
+	}
+
+	switch j.Action {
+	case clientsBatchAdd, clientsBatchUpdate, clientsBatchDelete:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("bad action %q", j.Action)
+	}
+
+	op = &clientsBatchOp{
+		action: j.Action,
+		name:   j.Name,
+	}
+
+	if j.Action != clientsBatchAdd && j.Name == "" {
+		return nil, errors.Error("client's name must be non-empty")
+	}
+
+	if j.Action != clientsBatchDelete {
+		if j.Data == nil {
+			return nil, errors.Error("data is required")
+		}
+
+		op.cli = jsonToClient(*j.Data)
+	}
+
+	return op, nil
+}
+
+// clientsBatchJSON is the request of the POST /control/clients/batch HTTP API.
+type clientsBatchJSON struct {
+	Operations []*clientsBatchOpJSON `json:"operations"`
+}
+
+// handleBatchClients is the handler for the POST /control/clients/batch HTTP
+// API.  It applies all the operations or, if any of them fails, none of them.
+func (clients *clientsContainer) handleBatchClients(w http.ResponseWriter, r *http.Request) {
+	req := &clientsBatchJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	ops := make([]*clientsBatchOp, 0, len(req.Operations))
+	for i, oj := range req.Operations {
+		var op *clientsBatchOp
+		op, err = oj.toOp()
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "operation at index %d: %s", i, err)
+
+			return
+		}
+
+		ops = append(ops, op)
+	}
+
+	// The modifying HTTP APIs are serialized by the control lock, so the
+	// clients can't be changed between the check and the application.
+	if !aghhttp.CheckIfMatch(w, r, clients.persistentJSON()) {
+		return
+	}
+
+	err = clients.applyBatch(ops)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
+// clientsReplaceJSON is the request of the PUT /control/clients/replace HTTP
+// API.
+type clientsReplaceJSON struct {
+	Clients []*clientJSON `json:"clients"`
+}
+
+// handleReplaceClients is the handler for the PUT /control/clients/replace
+// HTTP API.  It replaces all persistent clients with the ones from the request
+// or, if any of them is invalid, keeps the current ones.  The request is
+// rejected if its If-Match header doesn't match the entity tag of the current
+// clients, see [clientsContainer.handleGetClients].
+func (clients *clientsContainer) handleReplaceClients(w http.ResponseWriter, r *http.Request) {
+	req := &clientsReplaceJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	clis := make([]*Client, 0, len(req.Clients))
+	for i, cj := range req.Clients {
+		if cj == nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "client at index %d is null", i)
+
+			return
+		}
+
+		clis = append(clis, jsonToClient(*cj))
+	}
+
+	// The modifying HTTP APIs are serialized by the control lock, so the
+	// clients can't be changed between the check and the replacement.
+	if !aghhttp.CheckIfMatch(w, r, clients.persistentJSON()) {
+		return
+	}
+
+	err = clients.replaceAll(clis)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+}
+
 // Get the list of clients by IP address list
 func (clients *clientsContainer) handleFindClient(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
@@ -246,6 +524,7 @@ func (clients *clientsContainer) handleFindClient(w http.ResponseWriter, r *http
 			cj = clients.findRuntime(ip, idStr)
 		} else {
 			cj = clientToJSON(c)
+			cj.NameSource = ClientSourcePersistent.String()
 			disallowed, rule := clients.dnsServer.IsBlockedClient(ip, idStr)
 			cj.Disallowed, cj.DisallowedRule = &disallowed, &rule
 		}
@@ -284,6 +563,11 @@ func (clients *clientsContainer) findRuntime(ip netip.Addr, idStr string) (cj *c
 		Name:      rc.Host,
 		IDs:       []string{idStr},
 		WHOISInfo: rc.WHOISInfo,
+		SSDPInfo:  rc.SSDPInfo,
+	}
+
+	if rc.Host != "" {
+		cj.NameSource = rc.Source.String()
 	}
 
 	disallowed, rule := clients.dnsServer.IsBlockedClient(ip, idStr)
@@ -292,11 +576,142 @@ func (clients *clientsContainer) findRuntime(ip netip.Addr, idStr string) (cj *c
 	return cj
 }
 
+// clientSourcesJSON is the response of the GET /control/clients/name_sources
+// HTTP API and the request of the PUT /control/clients/name_sources/update one.
+type clientSourcesJSON struct {
+	// Priority are the names of the client information sources, the highest
+	// priority first.
+	Priority []string `json:"priority"`
+}
+
+// handleGetNameSources is the handler for the GET /control/clients/name_sources
+// HTTP API.  It returns the effective priority order of all sources.
+func (clients *clientsContainer) handleGetNameSources(w http.ResponseWriter, r *http.Request) {
+	resp := &clientSourcesJSON{
+		Priority: []string{},
+	}
+
+	for _, src := range clients.sourcePriority() {
+		resp.Priority = append(resp.Priority, src.String())
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// handlePutNameSources is the handler for the PUT
+// /control/clients/name_sources/update HTTP API.  The sources missing from the
+// request have the lower priority than the ones in it.
+func (clients *clientsContainer) handlePutNameSources(w http.ResponseWriter, r *http.Request) {
+	req := &clientSourcesJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	err = clients.setSourcePriority(req.Priority)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	func() {
+		config.Lock()
+		defer config.Unlock()
+
+		config.Clients.Sources.Priority = req.Priority
+	}()
+
+	// Reload the names from the DHCP leases, so that the new priority applies
+	// to them right away.  The names from the other sources are updated when
+	// these sources are refreshed.
+	clients.updateFromDHCP(true)
+
+	onConfigModified()
+}
+
+// wakeJSON is the request to the POST /control/clients/wake HTTP API.
+type wakeJSON struct {
+	// ID is either the name of a persistent client or the identifier of a
+	// client.
+	ID string `json:"id"`
+}
+
+// handleWakeClient is the handler for the POST /control/clients/wake HTTP API.
+// It sends the Wake-on-LAN magic packets to each hardware address known for the
+// client.
+func (clients *clientsContainer) handleWakeClient(w http.ResponseWriter, r *http.Request) {
+	wj := wakeJSON{}
+	err := json.NewDecoder(r.Body).Decode(&wj)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	if wj.ID == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "client's id must be non-empty")
+
+		return
+	}
+
+	targets, ok := clients.findWakeTargets(wj.ID)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusBadRequest, "Client not found")
+
+		return
+	} else if len(targets) == 0 {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no hardware address known for client %q", wj.ID)
+
+		return
+	}
+
+	subnets := localSubnets()
+	for _, tgt := range targets {
+		dst := aghnet.WOLDestination(tgt.ip, subnets)
+		err = aghnet.WakeOnLAN(tgt.mac, dst)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusInternalServerError, "waking client: %s", err)
+
+			return
+		}
+
+		log.Debug("clients: sent wake-on-lan packet to %s via %s for %q", tgt.mac, dst, wj.ID)
+	}
+}
+
+// localSubnets returns the subnets of the network interfaces of the machine.
+// It returns nil if they can't be received.
+func localSubnets() (subnets []netip.Prefix) {
+	ifaces, err := aghnet.GetValidNetInterfacesForWeb()
+	if err != nil {
+		log.Debug("clients: getting interfaces: %s", err)
+
+		return nil
+	}
+
+	for _, iface := range ifaces {
+		subnets = append(subnets, iface.Subnets...)
+	}
+
+	return subnets
+}
+
 // RegisterClientsHandlers registers HTTP handlers
 func (clients *clientsContainer) registerWebHandlers() {
 	httpRegister(http.MethodGet, "/control/clients", clients.handleGetClients)
 	httpRegister(http.MethodPost, "/control/clients/add", clients.handleAddClient)
 	httpRegister(http.MethodPost, "/control/clients/delete", clients.handleDelClient)
 	httpRegister(http.MethodPost, "/control/clients/update", clients.handleUpdateClient)
+	httpRegister(http.MethodPost, "/control/clients/batch", clients.handleBatchClients)
+	httpRegister(http.MethodPut, "/control/clients/replace", clients.handleReplaceClients)
+	httpRegister(http.MethodGet, "/control/clients/export", clients.handleExportClients)
+	httpRegister(http.MethodPost, "/control/clients/import", clients.handleImportClients)
+	httpRegister(http.MethodGet, "/control/clients/name_sources", clients.handleGetNameSources)
+	httpRegister(http.MethodPut, "/control/clients/name_sources/update", clients.handlePutNameSources)
 	httpRegister(http.MethodGet, "/control/clients/find", clients.handleFindClient)
+	httpRegister(http.MethodPost, "/control/clients/wake", clients.handleWakeClient)
+	httpRegister(http.MethodGet, "/control/clients/setup", clients.handleClientSetup)
 }
@@ -0,0 +1,540 @@
+package home
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"golang.org/x/exp/slices"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// clientsFormat is the format of the exported and imported persistent clients.
+type clientsFormat string
+
+// clientsFormat values.
+const (
+	// clientsFormatYAML is the format of the persistent clients in the
+	// configuration file, a sequence of the objects of the clients.persistent
+	// property.
+	clientsFormatYAML clientsFormat = "yaml"
+
+	// clientsFormatCSV is the comma-separated values with a header row, see
+	// [clientsCSVColumns].  The values of the list columns are separated by
+	// newlines.
+	clientsFormatCSV clientsFormat = "csv"
+)
+
+// parseClientsFormat parses the format of the persistent clients.  The empty
+// string means [clientsFormatYAML].
+func parseClientsFormat(s string) (f clientsFormat, err error) {
+	switch f = clientsFormat(s); f {
+	case "":
+		return clientsFormatYAML, nil
+	case clientsFormatYAML, clientsFormatCSV:
+		return f, nil
+	default:
+		return "", fmt.Errorf("bad format %q", s)
+	}
+}
+
+// clientsCSVColumns are the columns of the persistent clients in the CSV
+// format.  The safe_search column only contains whether the safe search is
+// enabled, so the export in [clientsFormatYAML] should be used to keep the
+// settings of the particular search engines.
+var clientsCSVColumns = []string{
+	"name",
+	"ids",
+	"tags",
+	"use_global_settings",
+	"filtering_enabled",
+	"parental_enabled",
+	"safebrowsing_enabled",
+	"safe_search",
+	"use_global_blocked_services",
+	"blocked_services",
+	"default_deny",
+	"allowed_services",
+	"dry_run",
+	"parental_strict_search",
+	"ignore_logging",
+	"upstreams",
+	"answer_rules",
+}
+
+// encodeClients writes objs to w in format f.
+func encodeClients(w io.Writer, objs []*clientObject, f clientsFormat) (err error) {
+	if f == clientsFormatYAML {
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+
+		return enc.Encode(objs)
+	}
+
+	cw := csv.NewWriter(w)
+	err = cw.Write(clientsCSVColumns)
+	if err != nil {
+		return fmt.Errorf("writing header: %w", err)
+	}
+
+	for _, o := range objs {
+		err = cw.Write(o.csvRecord())
+		if err != nil {
+			return fmt.Errorf("writing client %q: %w", o.Name, err)
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// csvRecord returns the values of o in the order of [clientsCSVColumns].
+func (o *clientObject) csvRecord() (rec []string) {
+	list := func(vals []string) (s string) { return strings.Join(vals, "\n") }
+	flag := strconv.FormatBool
+
+	return []string{
+		o.Name,
+		list(o.IDs),
+		list(o.Tags),
+		flag(o.UseGlobalSettings),
+		flag(o.FilteringEnabled),
+		flag(o.ParentalEnabled),
+		flag(o.SafeBrowsingEnabled),
+		flag(o.SafeSearchConf.Enabled),
+		flag(o.UseGlobalBlockedServices),
+		list(o.BlockedServices),
+		flag(o.DefaultDeny),
+		list(o.AllowedServices),
+		flag(o.DryRun),
+		flag(o.ParentalStrictSearch),
+		flag(o.IgnoreLogging),
+		list(o.Upstreams),
+		list(o.AnswerRules),
+	}
+}
+
+// decodeClients reads the persistent clients in format f from r.
+func decodeClients(r io.Reader, f clientsFormat) (objs []*clientObject, err error) {
+	if f == clientsFormatYAML {
+		err = yaml.NewDecoder(r).Decode(&objs)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("decoding yaml: %w", err)
+		}
+
+		for i, o := range objs {
+			if o == nil {
+				return nil, fmt.Errorf("client at index %d is null", i)
+			}
+		}
+
+		return objs, nil
+	}
+
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	for _, col := range header {
+		if !slices.Contains(clientsCSVColumns, col) {
+			return nil, fmt.Errorf("unknown column %q", col)
+		}
+	}
+
+	for i := 0; ; i++ {
+		var rec []string
+		rec, err = cr.Read()
+		if errors.Is(err, io.EOF) {
+			return objs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading record: %w", err)
+		}
+
+		var o *clientObject
+		o, err = clientFromCSV(header, rec)
+		if err != nil {
+			return nil, fmt.Errorf("client at index %d: %w", i, err)
+		}
+
+		objs = append(objs, o)
+	}
+}
+
+// clientFromCSV returns the persistent client from the CSV record rec with
+// the columns from header.  The clients use the global settings and the global
+// blocked services unless the corresponding columns say otherwise.
+func clientFromCSV(header, rec []string) (o *clientObject, err error) {
+	o = &clientObject{
+		UseGlobalSettings:        true,
+		UseGlobalBlockedServices: true,
+	}
+
+	for i, col := range header {
+		val := strings.TrimSpace(rec[i])
+		err = o.setCSVValue(col, val)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: %w", col, err)
+		}
+	}
+
+	return o, nil
+}
+
+// setCSVValue sets the field of o corresponding to the CSV column col to val.
+// The empty value of a boolean column keeps the field unchanged.
+func (o *clientObject) setCSVValue(col, val string) (err error) {
+	var list *[]string
+	var flag *bool
+	switch col {
+	case "name":
+		o.Name = val
+
+		return nil
+	case "ids":
+		list = &o.IDs
+	case "tags":
+		list = &o.Tags
+	case "blocked_services":
+		list = &o.BlockedServices
+	case "allowed_services":
+		list = &o.AllowedServices
+	case "upstreams":
+		list = &o.Upstreams
+	case "answer_rules":
+		list = &o.AnswerRules
+	case "safe_search":
+		return o.setCSVSafeSearch(val)
+	default:
+		flag = o.csvFlag(col)
+	}
+
+	if list != nil {
+		*list = stringutil.SplitTrimmed(val, "\n")
+
+		return nil
+	}
+
+	if val == "" {
+		return nil
+	}
+
+	*flag, err = strconv.ParseBool(val)
+
+	return err
+}
+
+// csvFlag returns the pointer to the boolean field of o corresponding to the
+// CSV column col.  col must be one of the boolean columns.
+func (o *clientObject) csvFlag(col string) (flag *bool) {
+	switch col {
+	case "use_global_settings":
+		return &o.UseGlobalSettings
+	case "filtering_enabled":
+		return &o.FilteringEnabled
+	case "parental_enabled":
+		return &o.ParentalEnabled
+	case "safebrowsing_enabled":
+		return &o.SafeBrowsingEnabled
+	case "use_global_blocked_services":
+		return &o.UseGlobalBlockedServices
+	case "default_deny":
+		return &o.DefaultDeny
+	case "dry_run":
+		return &o.DryRun
+	case "parental_strict_search":
+		return &o.ParentalStrictSearch
+	case "ignore_logging":
+		return &o.IgnoreLogging
+	default:
+		// Shouldn't happen, since the header is validated.
+		panic(fmt.Errorf("unexpected column %q", col))
+	}
+}
+
+// setCSVSafeSearch sets the safe search settings of o from the value of the
+// safe_search CSV column.  The safe search is enabled for all search engines,
+// just like with the deprecated safesearch_enabled field of the HTTP API.
+func (o *clientObject) setCSVSafeSearch(val string) (err error) {
+	if val == "" {
+		return nil
+	}
+
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		return err
+	}
+
+	o.SafeSearchConf.Enabled = enabled
+	if enabled {
+		o.SafeSearchConf.Bing = true
+		o.SafeSearchConf.DuckDuckGo = true
+		o.SafeSearchConf.Google = true
+		o.SafeSearchConf.Pixabay = true
+		o.SafeSearchConf.Yandex = true
+		o.SafeSearchConf.YouTube = true
+	}
+
+	return nil
+}
+
+// clientsConflict is the way an imported client is handled when it has the
+// same name or shares an identifier with an existing persistent client.
+type clientsConflict string
+
+// clientsConflict values.
+const (
+	// clientsConflictSkip keeps the existing client and ignores the imported
+	// one.
+	clientsConflictSkip clientsConflict = "skip"
+
+	// clientsConflictOverwrite removes the existing clients and adds the
+	// imported one.
+	clientsConflictOverwrite clientsConflict = "overwrite"
+
+	// clientsConflictMergeTags keeps the settings of the existing client and
+	// adds the tags of the imported one to it.
+	clientsConflictMergeTags clientsConflict = "merge_tags"
+)
+
+// parseClientsConflict parses the way of handling the conflicting imported
+// clients.  The empty string means [clientsConflictSkip].
+func parseClientsConflict(s string) (c clientsConflict, err error) {
+	switch c = clientsConflict(s); c {
+	case "":
+		return clientsConflictSkip, nil
+	case clientsConflictSkip, clientsConflictOverwrite, clientsConflictMergeTags:
+		return c, nil
+	default:
+		return "", fmt.Errorf("bad on_conflict %q", s)
+	}
+}
+
+// clientsImportJSON is the response of the POST /control/clients/import HTTP
+// API.
+type clientsImportJSON struct {
+	Added       int `json:"added"`
+	Overwritten int `json:"overwritten"`
+	Merged      int `json:"merged"`
+	Skipped     int `json:"skipped"`
+}
+
+// importClients adds clis to the persistent clients, handling the ones
+// conflicting with the existing clients according to onConflict.  Either all
+// of them are imported or, if any of them is invalid, none of them are.
+func (clients *clientsContainer) importClients(
+	clis []*Client,
+	onConflict clientsConflict,
+) (res *clientsImportJSON, err error) {
+	for i, c := range clis {
+		err = clients.check(c)
+		if err != nil {
+			return nil, fmt.Errorf("client at index %d: %w", i, err)
+		}
+	}
+
+	res = &clientsImportJSON{}
+	ops, err := clients.importOps(clis, onConflict, res)
+	if err != nil {
+		return nil, err
+	}
+
+	// The modifying HTTP APIs are serialized by the control lock, so the
+	// clients can't be changed between the planning and the application.
+	err = clients.applyBatch(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// importOps returns the operations importing clis and accounts them in res.
+// clis must be valid.
+func (clients *clientsContainer) importOps(
+	clis []*Client,
+	onConflict clientsConflict,
+	res *clientsImportJSON,
+) (ops []*clientsBatchOp, err error) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	deleted := stringutil.NewSet()
+	for i, c := range clis {
+		conflicts := clients.conflictsLocked(c)
+		if len(conflicts) == 0 {
+			res.Added++
+			ops = append(ops, &clientsBatchOp{cli: c, action: clientsBatchAdd})
+
+			continue
+		}
+
+		switch onConflict {
+		case clientsConflictSkip:
+			res.Skipped++
+		case clientsConflictOverwrite:
+			res.Overwritten++
+			for _, prev := range conflicts {
+				if !deleted.Has(prev.Name) {
+					deleted.Add(prev.Name)
+					ops = append(ops, &clientsBatchOp{action: clientsBatchDelete, name: prev.Name})
+				}
+			}
+
+			ops = append(ops, &clientsBatchOp{cli: c, action: clientsBatchAdd})
+		case clientsConflictMergeTags:
+			if len(conflicts) > 1 {
+				return nil, fmt.Errorf(
+					"client at index %d: conflicts with %d clients, can't merge tags",
+					i,
+					len(conflicts),
+				)
+			}
+
+			res.Merged++
+			ops = append(ops, mergeTagsOp(conflicts[0], c))
+		}
+	}
+
+	return ops, nil
+}
+
+// conflictsLocked returns the persistent clients which have the same name as c
+// or share any of its identifiers.  clients.lock is expected to be locked.
+func (clients *clientsContainer) conflictsLocked(c *Client) (conflicts []*Client) {
+	if prev, ok := clients.list[c.Name]; ok {
+		conflicts = append(conflicts, prev)
+	}
+
+	for _, id := range c.IDs {
+		prev, ok := clients.idIndex[id]
+		if ok && !slices.Contains(conflicts, prev) {
+			conflicts = append(conflicts, prev)
+		}
+	}
+
+	return conflicts
+}
+
+// mergeTagsOp returns the operation updating prev with the tags of c.
+func mergeTagsOp(prev, c *Client) (op *clientsBatchOp) {
+	merged := *prev
+
+	// The upstreams of prev are closed after the update, so make sure the
+	// merged client creates its own ones.
+	merged.upstreamConfig = nil
+
+	tags := stringutil.NewSet(prev.Tags...)
+	for _, t := range c.Tags {
+		tags.Add(t)
+	}
+
+	merged.Tags = tags.Values()
+	slices.Sort(merged.Tags)
+
+	return &clientsBatchOp{
+		cli:    &merged,
+		action: clientsBatchUpdate,
+		name:   prev.Name,
+	}
+}
+
+// handleExportClients is the handler for the GET /control/clients/export HTTP
+// API.  It writes all persistent clients in the format from the format query
+// parameter, see [clientsFormat].
+func (clients *clientsContainer) handleExportClients(w http.ResponseWriter, r *http.Request) {
+	f, err := parseClientsFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = encodeClients(buf, clients.forConfig(), f)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding clients: %s", err)
+
+		return
+	}
+
+	contType := "application/yaml"
+	if f == clientsFormatCSV {
+		contType = "text/csv"
+	}
+
+	w.Header().Set(aghhttp.HdrNameContentType, contType)
+	w.Header().Set("Content-Disposition", "attachment; filename=clients."+string(f))
+
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		log.Debug("clients: writing export: %s", err)
+	}
+}
+
+// handleImportClients is the handler for the POST /control/clients/import
+// HTTP API.  It adds the persistent clients from the request body in the
+// format from the format query parameter, handling the ones conflicting with
+// the existing clients according to the on_conflict query parameter, see
+// [clientsConflict].
+func (clients *clientsContainer) handleImportClients(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := parseClientsFormat(q.Get("format"))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConflict, err := parseClientsConflict(q.Get("on_conflict"))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	objs, err := decodeClients(r.Body, f)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	clis := make([]*Client, 0, len(objs))
+	for i, o := range objs {
+		var c *Client
+		c, err = clients.objectToClient(o, config.DNS.DnsfilterConf)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "client at index %d: %s", i, err)
+
+			return
+		}
+
+		clis = append(clis, c)
+	}
+
+	res, err := clients.importClients(clis, onConflict)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	if res.Added+res.Overwritten+res.Merged > 0 {
+		onConfigModified()
+	}
+
+	log.Debug("clients: imported %d clients: %+v", len(clis), res)
+
+	_ = aghhttp.WriteJSONResponse(w, r, res)
+}
@@ -0,0 +1,240 @@
+package home
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClients_encodeDecode(t *testing.T) {
+	objs := []*clientObject{{
+		SafeSearchConf: filtering.SafeSearchConfig{
+			Enabled:    true,
+			Bing:       true,
+			DuckDuckGo: true,
+			Google:     true,
+			Pixabay:    true,
+			Yandex:     true,
+			YouTube:    true,
+		},
+		Name:                     "laptop",
+		Tags:                     []string{"device_laptop", "user_admin"},
+		IDs:                      []string{"192.0.2.1", "laptop"},
+		BlockedServices:          []string{},
+		Upstreams:                []string{"1.1.1.1", "[/example.org/]8.8.8.8"},
+		AllowedServices:          []string{},
+		AnswerRules:              []string{"ttl 60"},
+		UseGlobalSettings:        false,
+		FilteringEnabled:         true,
+		UseGlobalBlockedServices: true,
+	}, {
+		Name:                     "phone",
+		Tags:                     []string{},
+		IDs:                      []string{"192.0.2.2"},
+		BlockedServices:          []string{"9gag"},
+		Upstreams:                []string{},
+		AllowedServices:          []string{},
+		AnswerRules:              []string{},
+		UseGlobalSettings:        true,
+		UseGlobalBlockedServices: false,
+	}}
+
+	for _, f := range []clientsFormat{clientsFormatYAML, clientsFormatCSV} {
+		t.Run(string(f), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := encodeClients(buf, objs, f)
+			require.NoError(t, err)
+
+			got, err := decodeClients(buf, f)
+			require.NoError(t, err)
+
+			assert.Equal(t, objs, got)
+		})
+	}
+}
+
+func TestDecodeClients_csv(t *testing.T) {
+	testCases := []struct {
+		want       []*clientObject
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		want: []*clientObject{{
+			Name:                     "tv",
+			Tags:                     []string{"device_tv"},
+			IDs:                      []string{"192.0.2.3", "aa:bb:cc:dd:ee:ff"},
+			UseGlobalSettings:        true,
+			UseGlobalBlockedServices: true,
+		}},
+		name:       "partial_columns",
+		in:         "name,ids,tags\ntv,\"192.0.2.3\naa:bb:cc:dd:ee:ff\",device_tv\n",
+		wantErrMsg: "",
+	}, {
+		want:       nil,
+		name:       "unknown_column",
+		in:         "name,ids,color\ntv,192.0.2.3,red\n",
+		wantErrMsg: `unknown column "color"`,
+	}, {
+		want: nil,
+		name: "bad_bool",
+		in:   "name,ids,dry_run\ntv,192.0.2.3,maybe\n",
+		wantErrMsg: `client at index 0: column "dry_run": ` +
+			`strconv.ParseBool: parsing "maybe": invalid syntax`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeClients(strings.NewReader(tc.in), clientsFormatCSV)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+// newImportTestClients returns a new clients container with two persistent
+// clients for the import tests.
+func newImportTestClients(t *testing.T) (clients *clientsContainer) {
+	t.Helper()
+
+	clients = &clientsContainer{
+		testing: true,
+	}
+
+	clients.Init([]*clientObject{{
+		Name:      "first",
+		IDs:       []string{"192.0.2.1"},
+		Tags:      []string{"device_pc"},
+		Upstreams: []string{"1.1.1.1"},
+	}, {
+		Name: "second",
+		IDs:  []string{"192.0.2.2"},
+	}}, nil, nil, nil, &filtering.Config{})
+
+	return clients
+}
+
+func TestClientsContainer_importClients(t *testing.T) {
+	newClis := func() (clis []*Client) {
+		return []*Client{{
+			Name: "first",
+			IDs:  []string{"192.0.2.10"},
+			Tags: []string{"user_child"},
+		}, {
+			Name: "third",
+			IDs:  []string{"192.0.2.3"},
+		}}
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		clients := newImportTestClients(t)
+
+		res, err := clients.importClients(newClis(), clientsConflictSkip)
+		require.NoError(t, err)
+
+		assert.Equal(t, &clientsImportJSON{Added: 1, Skipped: 1}, res)
+		assert.Len(t, clients.list, 3)
+
+		c, ok := clients.Find("192.0.2.1")
+		require.True(t, ok)
+
+		assert.Equal(t, []string{"device_pc"}, c.Tags)
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		clients := newImportTestClients(t)
+
+		res, err := clients.importClients(newClis(), clientsConflictOverwrite)
+		require.NoError(t, err)
+
+		assert.Equal(t, &clientsImportJSON{Added: 1, Overwritten: 1}, res)
+		assert.Len(t, clients.list, 3)
+
+		_, ok := clients.Find("192.0.2.1")
+		assert.False(t, ok)
+
+		c, ok := clients.Find("192.0.2.10")
+		require.True(t, ok)
+
+		assert.Equal(t, "first", c.Name)
+		assert.Empty(t, c.Upstreams)
+	})
+
+	t.Run("merge_tags", func(t *testing.T) {
+		clients := newImportTestClients(t)
+
+		res, err := clients.importClients(newClis(), clientsConflictMergeTags)
+		require.NoError(t, err)
+
+		assert.Equal(t, &clientsImportJSON{Added: 1, Merged: 1}, res)
+
+		c, ok := clients.Find("192.0.2.1")
+		require.True(t, ok)
+
+		assert.Equal(t, []string{"device_pc", "user_child"}, c.Tags)
+		assert.Equal(t, []string{"1.1.1.1"}, c.Upstreams)
+	})
+
+	t.Run("merge_tags_ambiguous", func(t *testing.T) {
+		clients := newImportTestClients(t)
+
+		_, err := clients.importClients([]*Client{{
+			Name: "first",
+			IDs:  []string{"192.0.2.2"},
+		}}, clientsConflictMergeTags)
+		testutil.AssertErrorMsg(
+			t,
+			"client at index 0: conflicts with 2 clients, can't merge tags",
+			err,
+		)
+
+		assert.Len(t, clients.list, 2)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		clients := newImportTestClients(t)
+
+		_, err := clients.importClients([]*Client{{
+			Name: "third",
+			IDs:  []string{"192.0.2.3"},
+		}, {
+			Name: "fourth",
+		}}, clientsConflictSkip)
+		testutil.AssertErrorMsg(t, "client at index 1: id required", err)
+
+		assert.Len(t, clients.list, 2)
+	})
+}
+
+func TestClientsContainer_handleExportClients(t *testing.T) {
+	clients := newImportTestClients(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/control/clients/export?format=csv", nil)
+	clients.handleExportClients(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, "text/csv", w.Header().Get(aghhttp.HdrNameContentType))
+
+	got, err := decodeClients(w.Body, clientsFormatCSV)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+
+	assert.Equal(t, "first", got[0].Name)
+	assert.Equal(t, "second", got[1].Name)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/control/clients/export?format=xml", nil)
+	clients.handleExportClients(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
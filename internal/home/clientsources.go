@@ -0,0 +1,139 @@
+package home
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// clientSourceRanks are the ranks of the client information sources.  The name
+// from the source with the greater rank takes precedence over the names from
+// the others.  [ClientSourceNone] always has the zero rank.
+type clientSourceRanks [ClientSourcePersistent + 1]int
+
+// newClientSourceRanks returns the ranks of the client information sources in
+// order, the highest priority first.  The sources missing from order have the
+// lower priority than the ones in it and keep their default relative order.
+// order must not contain duplicates or [ClientSourceNone].
+func newClientSourceRanks(order []clientSource) (ranks *clientSourceRanks) {
+	ranks = &clientSourceRanks{}
+
+	rank := len(ranks) - 1
+	for _, src := range order {
+		ranks[src] = rank
+		rank--
+	}
+
+	for src := ClientSourcePersistent; src > ClientSourceNone; src-- {
+		if ranks[src] == 0 {
+			ranks[src] = rank
+			rank--
+		}
+	}
+
+	return ranks
+}
+
+// order returns all client information sources except [ClientSourceNone], the
+// highest priority first.
+func (ranks *clientSourceRanks) order() (order []clientSource) {
+	for src := ClientSourceNone + 1; src <= ClientSourcePersistent; src++ {
+		order = append(order, src)
+	}
+
+	slices.SortFunc(order, func(a, b clientSource) (less bool) { return ranks[a] > ranks[b] })
+
+	return order
+}
+
+// parseClientSource parses the client information source from its name as
+// returned by [clientSource.String], case-insensitively.
+func parseClientSource(name string) (src clientSource, err error) {
+	for src = ClientSourceNone + 1; src <= ClientSourcePersistent; src++ {
+		if strings.EqualFold(name, src.String()) {
+			return src, nil
+		}
+	}
+
+	return ClientSourceNone, fmt.Errorf("unknown client source %q", name)
+}
+
+// parseClientSources parses the priority order of the client information
+// sources from their names.
+func parseClientSources(names []string) (order []clientSource, err error) {
+	order = make([]clientSource, 0, len(names))
+	for i, name := range names {
+		var src clientSource
+		src, err = parseClientSource(name)
+		if err != nil {
+			return nil, fmt.Errorf("source at index %d: %w", i, err)
+		}
+
+		if slices.Contains(order, src) {
+			return nil, fmt.Errorf("source at index %d: duplicate source %q", i, name)
+		}
+
+		order = append(order, src)
+	}
+
+	return order, nil
+}
+
+// setSourcePriority sets the priority order of the client information sources
+// from their names, the highest priority first.  It may be called before
+// [clientsContainer.Init].  The names from the sources already known are kept
+// until these sources are updated.
+func (clients *clientsContainer) setSourcePriority(names []string) (err error) {
+	order, err := parseClientSources(names)
+	if err != nil {
+		return fmt.Errorf("parsing client sources priority: %w", err)
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	clients.srcRanks = newClientSourceRanks(order)
+
+	return nil
+}
+
+// sourcePriority returns the effective priority order of the client
+// information sources, the highest priority first.
+func (clients *clientsContainer) sourcePriority() (order []clientSource) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	ranks := clients.srcRanks
+	if ranks == nil {
+		ranks = newClientSourceRanks(nil)
+	}
+
+	return ranks.order()
+}
+
+// rankLocked returns the rank of src.  clients.lock is expected to be locked.
+func (clients *clientsContainer) rankLocked(src clientSource) (rank int) {
+	if clients.srcRanks == nil {
+		return int(src)
+	}
+
+	return clients.srcRanks[src]
+}
+
+// nameOutranks returns true if the name of the client with ip is obtained from
+// a source with the higher priority than src.
+func (clients *clientsContainer) nameOutranks(ip netip.Addr, src clientSource) (ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	srcRank := clients.rankLocked(src)
+	if _, ok = clients.findLocked(ip.String()); ok && clients.rankLocked(ClientSourcePersistent) > srcRank {
+		return true
+	}
+
+	rc, ok := clients.ipToRC[ip]
+
+	return ok && rc.Host != "" && clients.rankLocked(rc.Source) > srcRank
+}
@@ -0,0 +1,149 @@
+package home
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClientSources(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		names      []string
+		want       []clientSource
+	}{{
+		name:       "empty",
+		wantErrMsg: "",
+		names:      nil,
+		want:       []clientSource{},
+	}, {
+		name:       "case_insensitive",
+		wantErrMsg: "",
+		names:      []string{"rdns", "ETC/HOSTS", "Persistent"},
+		want:       []clientSource{ClientSourceRDNS, ClientSourceHostsFile, ClientSourcePersistent},
+	}, {
+		name:       "unknown",
+		wantErrMsg: `source at index 1: unknown client source "mdns"`,
+		names:      []string{"DHCP", "mdns"},
+		want:       nil,
+	}, {
+		name:       "duplicate",
+		wantErrMsg: `source at index 1: duplicate source "dhcp"`,
+		names:      []string{"DHCP", "dhcp"},
+		want:       nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			order, err := parseClientSources(tc.names)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, order)
+		})
+	}
+}
+
+func TestClientSourceRanks_order(t *testing.T) {
+	testCases := []struct {
+		name  string
+		order []clientSource
+		want  []clientSource
+	}{{
+		name:  "default",
+		order: nil,
+		want: []clientSource{
+			ClientSourcePersistent,
+			ClientSourceHostsFile,
+			ClientSourceDHCP,
+			ClientSourceSSDP,
+			ClientSourceRDNS,
+			ClientSourceARP,
+			ClientSourceWHOIS,
+		},
+	}, {
+		name:  "partial",
+		order: []clientSource{ClientSourceRDNS, ClientSourceARP},
+		want: []clientSource{
+			ClientSourceRDNS,
+			ClientSourceARP,
+			ClientSourcePersistent,
+			ClientSourceHostsFile,
+			ClientSourceDHCP,
+			ClientSourceSSDP,
+			ClientSourceWHOIS,
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ranks := newClientSourceRanks(tc.order)
+			assert.Equal(t, tc.want, ranks.order())
+			assert.Zero(t, ranks[ClientSourceNone])
+		})
+	}
+}
+
+func TestClientsContainer_setSourcePriority(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+
+	persistentIP := netip.MustParseAddr("1.1.1.1")
+	runtimeIP := netip.MustParseAddr("2.2.2.2")
+
+	clients.Init([]*clientObject{{
+		Name: "persistent",
+		IDs:  []string{persistentIP.String()},
+	}}, nil, nil, nil, &filtering.Config{})
+
+	ok := clients.AddHost(runtimeIP, "hosts.example", ClientSourceHostsFile)
+	require.True(t, ok)
+
+	// The hosts file has the higher priority by default.
+	ok = clients.AddHost(runtimeIP, "rdns.example", ClientSourceRDNS)
+	require.False(t, ok)
+
+	assert.True(t, clients.nameOutranks(runtimeIP, ClientSourceRDNS))
+
+	err := clients.setSourcePriority([]string{"rDNS", "persistent"})
+	require.NoError(t, err)
+
+	assert.False(t, clients.nameOutranks(runtimeIP, ClientSourceRDNS))
+
+	ok = clients.AddHost(runtimeIP, "rdns.example", ClientSourceRDNS)
+	require.True(t, ok)
+
+	ok = clients.AddHost(runtimeIP, "hosts.example", ClientSourceHostsFile)
+	require.False(t, ok)
+
+	c, _ := clients.clientInfo(runtimeIP, runtimeIP.String())
+	assert.Equal(t, "rdns.example", c.Name)
+	assert.Equal(t, "rDNS", c.NameSource)
+
+	// The name from rDNS takes precedence over the persistent client.
+	ok = clients.AddHost(persistentIP, "rdns-persistent.example", ClientSourceRDNS)
+	require.True(t, ok)
+
+	c, _ = clients.clientInfo(persistentIP, persistentIP.String())
+	assert.Equal(t, "rdns-persistent.example", c.Name)
+	assert.Equal(t, "rDNS", c.NameSource)
+
+	err = clients.setSourcePriority(nil)
+	require.NoError(t, err)
+
+	c, _ = clients.clientInfo(persistentIP, persistentIP.String())
+	assert.Equal(t, "persistent", c.Name)
+	assert.Equal(t, "persistent", c.NameSource)
+
+	err = clients.setSourcePriority([]string{"mdns"})
+	testutil.AssertErrorMsg(
+		t,
+		`parsing client sources priority: source at index 0: unknown client source "mdns"`,
+		err,
+	)
+}
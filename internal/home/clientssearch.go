@@ -0,0 +1,239 @@
+package home
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// clientsMaxSeen is the maximum number of the addresses, for which the
+	// time of the last request is kept.
+	clientsMaxSeen = 100_000
+
+	// clientsSeenRetention is the time after which the addresses which haven't
+	// sent any requests may be forgotten to free the space for new ones.
+	clientsSeenRetention = 7 * 24 * time.Hour
+)
+
+// markSeen records that the client with ip has sent a request at now.
+func (clients *clientsContainer) markSeen(ip netip.Addr, now time.Time) {
+	clients.seenLock.Lock()
+	defer clients.seenLock.Unlock()
+
+	if clients.lastSeen == nil {
+		clients.lastSeen = map[netip.Addr]time.Time{}
+	}
+
+	if _, ok := clients.lastSeen[ip]; !ok && len(clients.lastSeen) >= clientsMaxSeen {
+		for seenIP, t := range clients.lastSeen {
+			if now.Sub(t) > clientsSeenRetention {
+				delete(clients.lastSeen, seenIP)
+			}
+		}
+
+		if len(clients.lastSeen) >= clientsMaxSeen {
+			log.Debug("clients: too many active addresses, not recording %s", ip)
+
+			return
+		}
+	}
+
+	clients.lastSeen[ip] = now
+}
+
+// lastSeenLocked returns the time of the last request from any of the
+// addresses and subnets of c, or a zero time if there were none.
+// clients.seenLock is expected to be locked.
+func (clients *clientsContainer) lastSeenLocked(c *Client) (last time.Time) {
+	for _, id := range c.IDs {
+		if ip, err := netip.ParseAddr(id); err == nil {
+			if t := clients.lastSeen[ip]; t.After(last) {
+				last = t
+			}
+
+			continue
+		}
+
+		subnet, err := netip.ParsePrefix(id)
+		if err != nil {
+			continue
+		}
+
+		for ip, t := range clients.lastSeen {
+			if t.After(last) && subnet.Contains(ip) {
+				last = t
+			}
+		}
+	}
+
+	return last
+}
+
+// clientsSearch are the criteria of the search of the clients in the GET
+// /control/clients HTTP API.  The zero values of the fields mean no criteria.
+type clientsSearch struct {
+	// since is the time after which the clients must have sent requests.
+	since time.Time
+
+	// subnet is the network, which the addresses of the clients must belong
+	// to.
+	subnet netip.Prefix
+
+	// name is the lowercased substring of the names of the clients.
+	name string
+
+	// tag is the tag of the persistent clients.  Runtime clients have no tags
+	// and don't match any.
+	tag string
+
+	// offset is the number of the matched clients to skip.
+	offset int
+
+	// limit is the maximum number of the returned clients.
+	limit int
+}
+
+// parseClientsSearch parses the search criteria from the URL query q.
+func parseClientsSearch(q url.Values, now time.Time) (s *clientsSearch, err error) {
+	s = &clientsSearch{
+		name: strings.ToLower(q.Get("name")),
+		tag:  q.Get("tag"),
+	}
+
+	if v := q.Get("cidr"); v != "" {
+		s.subnet, err = parseSubnet(v)
+		if err != nil {
+			return nil, fmt.Errorf("cidr: %w", err)
+		}
+	}
+
+	if v := q.Get("seen_hours"); v != "" {
+		var hours uint64
+		hours, err = strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("seen_hours: %w", err)
+		}
+
+		s.since = now.Add(-time.Duration(hours) * time.Hour)
+	}
+
+	s.offset, err = parseNonNegative(q, "offset")
+	if err != nil {
+		return nil, err
+	}
+
+	s.limit, err = parseNonNegative(q, "limit")
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// parseSubnet parses a CIDR or a single IP address, which is treated as a
+// subnet with a single address.
+func parseSubnet(s string) (subnet netip.Prefix, err error) {
+	if ip, ipErr := netip.ParseAddr(s); ipErr == nil {
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+
+	subnet, err = netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return subnet.Masked(), nil
+}
+
+// parseNonNegative parses the optional non-negative integer query parameter
+// with name.
+func parseNonNegative(q url.Values, name string) (n int, err error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err = strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	} else if n < 0 {
+		return 0, fmt.Errorf("%s: negative value %d", name, n)
+	}
+
+	return n, nil
+}
+
+// matchesPersistent returns true if c, which has last sent a request at
+// lastSeen, matches s.
+func (s *clientsSearch) matchesPersistent(c *Client, lastSeen time.Time) (ok bool) {
+	if s.name != "" && !strings.Contains(strings.ToLower(c.Name), s.name) {
+		return false
+	}
+
+	if s.tag != "" && !slices.Contains(c.Tags, s.tag) {
+		return false
+	}
+
+	if s.subnet.IsValid() && !s.containsAnyID(c.IDs) {
+		return false
+	}
+
+	return s.since.IsZero() || !lastSeen.Before(s.since)
+}
+
+// containsAnyID returns true if any of the IP addresses and subnets from ids
+// overlaps with s.subnet.
+func (s *clientsSearch) containsAnyID(ids []string) (ok bool) {
+	for _, id := range ids {
+		subnet, err := parseSubnet(id)
+		if err == nil && s.subnet.Overlaps(subnet) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesRuntime returns true if the runtime client rc with ip, which has last
+// sent a request at lastSeen, matches s.
+func (s *clientsSearch) matchesRuntime(
+	ip netip.Addr,
+	rc *RuntimeClient,
+	lastSeen time.Time,
+) (ok bool) {
+	if s.name != "" && !strings.Contains(strings.ToLower(rc.Host), s.name) {
+		return false
+	}
+
+	if s.tag != "" {
+		return false
+	}
+
+	if s.subnet.IsValid() && !s.subnet.Contains(ip) {
+		return false
+	}
+
+	return s.since.IsZero() || !lastSeen.Before(s.since)
+}
+
+// page returns the bounds of the page of a list of n elements according to
+// the offset and the limit of s.
+func (s *clientsSearch) page(n int) (start, end int) {
+	start, end = s.offset, n
+	if start > n {
+		start = n
+	}
+
+	if s.limit > 0 && start+s.limit < end {
+		end = start + s.limit
+	}
+
+	return start, end
+}
@@ -0,0 +1,203 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClientsSearch(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		want       *clientsSearch
+		query      string
+		name       string
+		wantErrMsg string
+	}{{
+		want:       &clientsSearch{},
+		query:      "",
+		name:       "empty",
+		wantErrMsg: "",
+	}, {
+		want: &clientsSearch{
+			since:  now.Add(-2 * time.Hour),
+			subnet: netip.MustParsePrefix("192.168.0.0/16"),
+			name:   "laptop",
+			tag:    "user_child",
+			offset: 10,
+			limit:  5,
+		},
+		query:      "name=Laptop&tag=user_child&cidr=192.168.1.1/16&seen_hours=2&offset=10&limit=5",
+		name:       "all",
+		wantErrMsg: "",
+	}, {
+		want: &clientsSearch{
+			subnet: netip.MustParsePrefix("1.2.3.4/32"),
+		},
+		query:      "cidr=1.2.3.4",
+		name:       "single_ip",
+		wantErrMsg: "",
+	}, {
+		want:       nil,
+		query:      "cidr=bad",
+		name:       "bad_cidr",
+		wantErrMsg: `cidr: netip.ParsePrefix("bad"): no '/'`,
+	}, {
+		want:       nil,
+		query:      "seen_hours=-1",
+		name:       "bad_seen_hours",
+		wantErrMsg: `seen_hours: strconv.ParseUint: parsing "-1": invalid syntax`,
+	}, {
+		want:       nil,
+		query:      "limit=-1",
+		name:       "negative_limit",
+		wantErrMsg: "limit: negative value -1",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tc.query)
+			require.NoError(t, err)
+
+			s, err := parseClientsSearch(q, now)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, s)
+		})
+	}
+}
+
+func TestClientsContainer_handleGetClients_search(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil, nil)
+
+	for _, c := range []*Client{{
+		Name: "kids-tablet",
+		IDs:  []string{"192.168.1.10"},
+		Tags: []string{"user_child"},
+	}, {
+		Name: "office",
+		IDs:  []string{"10.0.0.0/24"},
+	}, {
+		Name: "phone",
+		IDs:  []string{"192.168.1.20", "aa:aa:aa:aa:aa:aa"},
+	}} {
+		ok, err := clients.Add(c)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	for _, ip := range []string{"192.168.1.100", "192.168.1.101", "172.16.0.1"} {
+		ok := clients.AddHost(netip.MustParseAddr(ip), "host-"+ip, ClientSourceRDNS)
+		require.True(t, ok)
+	}
+
+	now := time.Now()
+	clients.markSeen(netip.MustParseAddr("10.0.0.5"), now)
+	clients.markSeen(netip.MustParseAddr("192.168.1.101"), now)
+	clients.markSeen(netip.MustParseAddr("192.168.1.20"), now.Add(-3*time.Hour))
+
+	testCases := []struct {
+		name        string
+		query       string
+		wantClients []string
+		wantRuntime []string
+		wantTotal   int
+	}{{
+		name:        "all",
+		query:       "",
+		wantClients: []string{"kids-tablet", "office", "phone"},
+		wantRuntime: []string{"host-172.16.0.1", "host-192.168.1.100", "host-192.168.1.101"},
+		wantTotal:   3,
+	}, {
+		name:        "name",
+		query:       "name=TAB",
+		wantClients: []string{"kids-tablet"},
+		wantRuntime: nil,
+		wantTotal:   1,
+	}, {
+		name:        "tag",
+		query:       "tag=user_child",
+		wantClients: []string{"kids-tablet"},
+		wantRuntime: nil,
+		wantTotal:   1,
+	}, {
+		name:        "cidr",
+		query:       "cidr=192.168.1.0/24",
+		wantClients: []string{"kids-tablet", "phone"},
+		wantRuntime: []string{"host-192.168.1.100", "host-192.168.1.101"},
+		wantTotal:   2,
+	}, {
+		name:        "seen",
+		query:       "seen_hours=1",
+		wantClients: []string{"office"},
+		wantRuntime: []string{"host-192.168.1.101"},
+		wantTotal:   1,
+	}, {
+		name:        "page",
+		query:       "offset=1&limit=1",
+		wantClients: []string{"office"},
+		wantRuntime: []string{"host-192.168.1.100"},
+		wantTotal:   3,
+	}, {
+		name:        "offset_too_large",
+		query:       "offset=10",
+		wantClients: nil,
+		wantRuntime: nil,
+		wantTotal:   3,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/control/clients?"+tc.query, nil)
+			w := httptest.NewRecorder()
+			clients.handleGetClients(w, r)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			// Don't use clientListJSON, since clientSource can't be decoded.
+			resp := &struct {
+				Clients []struct {
+					Name string `json:"name"`
+				} `json:"clients"`
+				RuntimeClients []struct {
+					Name string `json:"name"`
+				} `json:"auto_clients"`
+				ClientsTotal int `json:"clients_total"`
+			}{}
+			err := json.NewDecoder(w.Body).Decode(resp)
+			require.NoError(t, err)
+
+			var gotClients, gotRuntime []string
+			for _, c := range resp.Clients {
+				gotClients = append(gotClients, c.Name)
+			}
+
+			for _, rc := range resp.RuntimeClients {
+				gotRuntime = append(gotRuntime, rc.Name)
+			}
+
+			assert.Equal(t, tc.wantClients, gotClients)
+			assert.Equal(t, tc.wantRuntime, gotRuntime)
+			assert.Equal(t, tc.wantTotal, resp.ClientsTotal)
+		})
+	}
+
+	t.Run("bad_request", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/control/clients?limit=x", nil)
+		w := httptest.NewRecorder()
+		clients.handleGetClients(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
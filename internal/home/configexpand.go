@@ -0,0 +1,222 @@
+package home
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// configRefPrefix is the prefix of the references of the configuration values
+// to environment variables and files, like "${NAME}" or "${file:/path}".
+const configRefPrefix = "${"
+
+// configFileRefPrefix is the prefix of the references to files within the
+// braces of a reference.
+const configFileRefPrefix = "file:"
+
+// configTemplate is a value of the configuration file containing references.
+type configTemplate struct {
+	// raw is the value as written in the configuration file.
+	raw string
+
+	// expanded is the value with all the references replaced.
+	expanded string
+}
+
+// configTemplates are the values of the configuration file containing
+// references by the paths of those values, like "users[0].password".
+type configTemplates map[string]*configTemplate
+
+// unmarshalConfig is like [yaml.Unmarshal], but also replaces the references in
+// the scalar values of data, see [expandConfigValue].  tmpls contains the
+// values which had the references.
+func unmarshalConfig(data []byte, v any) (tmpls configTemplates, err error) {
+	doc := &yaml.Node{}
+	err = yaml.Unmarshal(data, doc)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	} else if doc.Kind == 0 {
+		// The document is empty.
+		return nil, nil
+	}
+
+	tmpls, err = expandConfigNode(doc, "")
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return tmpls, doc.Decode(v)
+}
+
+// expandConfigNode replaces the references in the scalar values within the
+// YAML node n, which has the path, see [expandConfigValue].  tmpls contains the
+// values which had the references.
+func expandConfigNode(n *yaml.Node, path string) (tmpls configTemplates, err error) {
+	tmpls = configTemplates{}
+	err = walkConfigScalars(n, path, func(n *yaml.Node, path string) (wErr error) {
+		if !strings.Contains(n.Value, configRefPrefix) {
+			return nil
+		}
+
+		expanded, wErr := expandConfigValue(n.Value)
+		if wErr != nil {
+			return fmt.Errorf("%s: %w", path, wErr)
+		}
+
+		tmpls[path] = &configTemplate{
+			raw:      n.Value,
+			expanded: expanded,
+		}
+
+		n.Value = expanded
+		if n.Style == 0 {
+			// Let the decoder resolve the type of the plain scalar once again,
+			// so that the references could be used for numbers too.
+			n.Tag = ""
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("expanding references: %w", err)
+	}
+
+	return tmpls, nil
+}
+
+// restore replaces the expanded values in the YAML node n, encoded from the
+// part of the configuration with the path, with the templates they were
+// expanded from, so that the secrets aren't written into the configuration
+// file.  The values changed since the loading are kept as is.
+func (tmpls configTemplates) restore(n *yaml.Node, path string) {
+	if len(tmpls) == 0 {
+		return
+	}
+
+	_ = walkConfigScalars(n, path, func(n *yaml.Node, path string) (_ error) {
+		t := tmpls[path]
+		if t != nil && n.Value == t.expanded {
+			n.Value, n.Tag = t.raw, "!!str"
+		}
+
+		return nil
+	})
+}
+
+// walkConfigScalars calls f for each scalar value within n, which has the
+// path.  The mapping keys and the aliases aren't walked.
+func walkConfigScalars(
+	n *yaml.Node,
+	path string,
+	f func(n *yaml.Node, path string) (err error),
+) (err error) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			err = walkConfigScalars(c, path, f)
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			p := n.Content[i].Value
+			if path != "" {
+				p = path + "." + p
+			}
+
+			err = walkConfigScalars(n.Content[i+1], p, f)
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			err = walkConfigScalars(c, path+"["+strconv.Itoa(i)+"]", f)
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		return f(n, path)
+	default:
+		// Go on.
+	}
+
+	return nil
+}
+
+// expandConfigValue replaces the references in the configuration value s with
+// the values of the environment variables, "${NAME}", or with the contents of
+// the files without the trailing newlines, "${file:/path/to/file}".  "$${"
+// is replaced with a literal "${".
+func expandConfigValue(s string) (expanded string, err error) {
+	b := &strings.Builder{}
+	for {
+		i := strings.Index(s, configRefPrefix)
+		if i < 0 {
+			b.WriteString(s)
+
+			return b.String(), nil
+		}
+
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1])
+			b.WriteString(configRefPrefix)
+			s = s[i+len(configRefPrefix):]
+
+			continue
+		}
+
+		b.WriteString(s[:i])
+		s = s[i+len(configRefPrefix):]
+
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "", errors.Error("unclosed reference")
+		}
+
+		var val string
+		val, err = resolveConfigRef(s[:end])
+		if err != nil {
+			return "", err
+		}
+
+		b.WriteString(val)
+		s = s[end+1:]
+	}
+}
+
+// resolveConfigRef returns the value the reference ref, without the braces,
+// points to.
+func resolveConfigRef(ref string) (val string, err error) {
+	if ref == "" {
+		return "", errors.Error("empty reference")
+	}
+
+	if strings.HasPrefix(ref, configFileRefPrefix) {
+		name := strings.TrimPrefix(ref, configFileRefPrefix)
+
+		var data []byte
+		data, err = os.ReadFile(name)
+		if err != nil {
+			// Don't wrap the error since it contains the file name.
+			return "", err
+		}
+
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	val, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %q is not set", ref)
+	}
+
+	return val, nil
+}
@@ -0,0 +1,133 @@
+package home
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestExpandConfigValue(t *testing.T) {
+	t.Setenv("AGH_TEST_USER", "admin")
+	t.Setenv("AGH_TEST_EMPTY", "")
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	err := os.WriteFile(secretFile, []byte("s3cret\n"), 0o600)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		in         string
+		want       string
+		wantErrMsg string
+	}{{
+		name:       "env",
+		in:         "${AGH_TEST_USER}",
+		want:       "admin",
+		wantErrMsg: "",
+	}, {
+		name:       "env_in_text",
+		in:         "https://${AGH_TEST_USER}@dns.example/${AGH_TEST_EMPTY}",
+		want:       "https://admin@dns.example/",
+		wantErrMsg: "",
+	}, {
+		name:       "file",
+		in:         "${file:" + secretFile + "}",
+		want:       "s3cret",
+		wantErrMsg: "",
+	}, {
+		name:       "escaped",
+		in:         "$${AGH_TEST_USER}",
+		want:       "${AGH_TEST_USER}",
+		wantErrMsg: "",
+	}, {
+		name:       "unset",
+		in:         "${AGH_TEST_UNSET}",
+		want:       "",
+		wantErrMsg: `environment variable "AGH_TEST_UNSET" is not set`,
+	}, {
+		name:       "unclosed",
+		in:         "${AGH_TEST_USER",
+		want:       "",
+		wantErrMsg: "unclosed reference",
+	}, {
+		name:       "empty",
+		in:         "${}",
+		want:       "",
+		wantErrMsg: "empty reference",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, expErr := expandConfigValue(tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, expErr)
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestUnmarshalConfig(t *testing.T) {
+	t.Setenv("AGH_TEST_PORT", "3001")
+	t.Setenv("AGH_TEST_UPS", "tls://dns.example")
+
+	type testConfig struct {
+		Upstreams []string `yaml:"upstreams"`
+		Port      int      `yaml:"port"`
+		Name      string   `yaml:"name"`
+	}
+
+	data := []byte(`upstreams:
+- '${AGH_TEST_UPS}'
+- 1.1.1.1
+port: ${AGH_TEST_PORT}
+name: "${AGH_TEST_PORT}"
+`)
+
+	conf := &testConfig{}
+	tmpls, err := unmarshalConfig(data, conf)
+	require.NoError(t, err)
+
+	assert.Equal(t, &testConfig{
+		Upstreams: []string{"tls://dns.example", "1.1.1.1"},
+		Port:      3001,
+		Name:      "3001",
+	}, conf)
+
+	require.Len(t, tmpls, 3)
+
+	t.Run("restore", func(t *testing.T) {
+		conf.Name = "changed"
+
+		doc := &yaml.Node{}
+		err = doc.Encode(conf)
+		require.NoError(t, err)
+
+		tmpls.restore(doc, "")
+
+		var out []byte
+		out, err = yaml.Marshal(doc)
+		require.NoError(t, err)
+
+		assert.Equal(t, `upstreams:
+    - ${AGH_TEST_UPS}
+    - 1.1.1.1
+port: ${AGH_TEST_PORT}
+name: changed
+`, string(out))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		_, err = unmarshalConfig([]byte("users:\n- password: ${AGH_TEST_UNSET}\n"), conf)
+		testutil.AssertErrorMsg(
+			t,
+			`expanding references: users[0].password: `+
+				`environment variable "AGH_TEST_UNSET" is not set`,
+			err,
+		)
+	})
+}
@@ -0,0 +1,377 @@
+package home
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// configSectionPathPrefix is the path prefix of the HTTP APIs of the
+// configuration sections.
+const configSectionPathPrefix = "/control/config/"
+
+// configSectionUpdateSuffix is the suffix of the path of the HTTP API
+// replacing a configuration section.
+const configSectionUpdateSuffix = "/update"
+
+// maxConfigSectionSize is the maximum size of the request body of the PUT
+// /control/config/{section}/update HTTP API.
+const maxConfigSectionSize = 16 * 1024 * 1024
+
+// configSectionValue is a copy of the current value of a configuration
+// section.
+type configSectionValue struct {
+	// ptr is the pointer to the value to encode from and to decode into.
+	ptr any
+
+	// validate returns the errors of the decoded value, if any.  It's nil if
+	// the section can't be changed without a restart.
+	validate func() (errs []error)
+
+	// apply applies the validated value.  tmpls are the values of the section
+	// which had references, see [unmarshalConfig].
+	apply func(tmpls configTemplates) (err error)
+}
+
+// configSections are the functions returning the copies of the configuration
+// sections by their names, which are the same as in the configuration file.
+var configSections = map[string]func() (v *configSectionValue){
+	"alerts":  alertsSection,
+	"clients": reloadedSection(func(c *reloadedConfig) (ptr any) { return c.Clients }),
+	"dhcp":    dhcpSection,
+	"dns":     reloadedSection(func(c *reloadedConfig) (ptr any) { return &c.DNS }),
+	"filters": reloadedSection(func(c *reloadedConfig) (ptr any) { return &c.Filters }),
+	"tls":     tlsSection,
+	"user_rule_groups": reloadedSection(func(c *reloadedConfig) (ptr any) {
+		return &c.UserRuleGroups
+	}),
+	"user_rules": reloadedSection(func(c *reloadedConfig) (ptr any) { return &c.UserRules }),
+	"whitelist_filters": reloadedSection(func(c *reloadedConfig) (ptr any) {
+		return &c.WhitelistFilters
+	}),
+}
+
+// reloadedSection returns the function returning the copy of the section of
+// the reloadable part of the configuration, see [reloadConfig].  field returns
+// the pointer to the section within c.
+func reloadedSection(field func(c *reloadedConfig) (ptr any)) (f func() (v *configSectionValue)) {
+	return func() (v *configSectionValue) {
+		c := newReloadedConfig()
+
+		return &configSectionValue{
+			ptr: field(c),
+			validate: func() (errs []error) {
+				if c.Clients == nil {
+					c.Clients = &reloadedClientsConfig{}
+				}
+
+				return validateConfig(&configuration{
+					DNS:            c.DNS,
+					Clients:        &clientsConfig{Persistent: c.Clients.Persistent},
+					UserRules:      c.UserRules,
+					UserRuleGroups: c.UserRuleGroups,
+				})
+			},
+			apply: func(tmpls configTemplates) (err error) {
+				err = applyReloadedConfig(c, tmpls)
+				if err != nil {
+					// Don't wrap the error, since it's informative enough as
+					// is.
+					return err
+				}
+
+				onConfigModified()
+
+				return nil
+			},
+		}
+	}
+}
+
+// tlsSectionConfig is the TLS configuration section with the private key
+// hidden, like in [tlsConfigSettingsExt].
+type tlsSectionConfig struct {
+	tlsConfigSettings `yaml:",inline"`
+
+	// PrivateKeySaved is true if the private key is saved as a string.  If it's
+	// true and the private key is empty, the saved one is kept.
+	PrivateKeySaved bool `yaml:"private_key_saved"`
+}
+
+// tlsSection returns the copy of the TLS configuration section.  The private
+// key saved as a string isn't returned.
+func tlsSection() (v *configSectionValue) {
+	sect := &tlsSectionConfig{}
+	conf := &sect.tlsConfigSettings
+	Context.tls.WriteDiskConfig(conf)
+	status := &tlsConfigStatus{}
+
+	savedKey := conf.PrivateKey
+	conf.PrivateKey, sect.PrivateKeySaved = "", savedKey != ""
+
+	return &configSectionValue{
+		ptr: sect,
+		validate: func() (errs []error) {
+			if sect.PrivateKeySaved && conf.PrivateKey == "" {
+				conf.PrivateKey = savedKey
+			}
+
+			err := validateTLSSettings(conf)
+			if err != nil {
+				return []error{err}
+			}
+
+			err = loadTLSConf(conf, status)
+			if err != nil {
+				return []error{err}
+			}
+
+			return nil
+		},
+		apply: func(tmpls configTemplates) (err error) {
+			func() {
+				config.Lock()
+				defer config.Unlock()
+
+				if config.templates == nil {
+					config.templates = configTemplates{}
+				}
+
+				maps.Copy(config.templates, tmpls)
+			}()
+
+			restartHTTPS, err := Context.tls.apply(*conf, status)
+			if restartHTTPS {
+				// Restart the server in a separate goroutine, since it waits
+				// for the current request to complete.  See
+				// [tlsManager.handleTLSConfigure].
+				go Context.web.TLSConfigChanged(context.Background(), *conf)
+			}
+
+			// Don't wrap the error, since it's informative enough as is.
+			return err
+		},
+	}
+}
+
+// alertsSection returns the copy of the alerts configuration section.
+func alertsSection() (v *configSectionValue) {
+	conf := &alertsConfig{}
+	func() {
+		config.RLock()
+		defer config.RUnlock()
+
+		*conf = config.Alerts
+	}()
+
+	return &configSectionValue{
+		ptr: conf,
+		validate: func() (errs []error) {
+			return conf.validate()
+		},
+		apply: func(tmpls configTemplates) (err error) {
+			func() {
+				config.Lock()
+				defer config.Unlock()
+
+				if config.templates == nil {
+					config.templates = configTemplates{}
+				}
+
+				maps.Copy(config.templates, tmpls)
+				config.Alerts = *conf
+			}()
+
+			Context.alerts.setConfig(*conf)
+			onConfigModified()
+
+			return nil
+		},
+	}
+}
+
+// dhcpSection returns the copy of the DHCP configuration section.  It can't be
+// changed without a restart, so use the DHCP HTTP APIs instead.
+func dhcpSection() (v *configSectionValue) {
+	conf := &dhcpd.ServerConfig{}
+	func() {
+		config.RLock()
+		defer config.RUnlock()
+
+		if config.DHCP != nil {
+			*conf = *config.DHCP
+		}
+	}()
+
+	if Context.dhcpServer != nil {
+		Context.dhcpServer.WriteDiskConfig(conf)
+	}
+
+	return &configSectionValue{
+		ptr: conf,
+	}
+}
+
+// isConfigSectionPath returns true if p is a path of the HTTP APIs of the
+// configuration sections, which may contain secrets, like the private key of
+// the TLS section.
+func isConfigSectionPath(p string) (ok bool) {
+	return strings.HasPrefix(p, configSectionPathPrefix)
+}
+
+// sectionFromPath returns the name of the configuration section from the URL
+// path of the request and the function returning its copy.  ok is false if
+// there is no such section.
+func sectionFromPath(p string) (name string, f func() (v *configSectionValue), ok bool) {
+	name = strings.TrimSuffix(p, configSectionUpdateSuffix)
+	name = strings.TrimPrefix(name, configSectionPathPrefix)
+	f, ok = configSections[name]
+
+	return name, f, ok
+}
+
+// handleGetConfigSection is the handler for the GET /control/config/{section}
+// HTTP API.  It responds with the value of the section in the JSON form of
+// its YAML representation.  The values containing references are returned as
+// written in the configuration file, see [unmarshalConfig].
+func handleGetConfigSection(w http.ResponseWriter, r *http.Request) {
+	name, section, ok := sectionFromPath(r.URL.Path)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusNotFound, "unknown config section %q", name)
+
+		return
+	}
+
+	n := &yaml.Node{}
+	err := n.Encode(section().ptr)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "encoding %s: %s", name, err)
+
+		return
+	}
+
+	func() {
+		config.RLock()
+		defer config.RUnlock()
+
+		config.templates.restore(n, name)
+	}()
+
+	var resp any
+	err = n.Decode(&resp)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "converting %s: %s", name, err)
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// handlePutConfigSection is the handler for the PUT
+// /control/config/{section}/update HTTP API.  It validates the value of the section in the JSON form of its
+// YAML representation from the request body and applies it without a
+// restart.  The fields missing from the request keep their current values.
+func handlePutConfigSection(w http.ResponseWriter, r *http.Request) {
+	name, section, ok := sectionFromPath(r.URL.Path)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusNotFound, "unknown config section %q", name)
+
+		return
+	}
+
+	v := section()
+	if v.validate == nil {
+		aghhttp.Error(
+			r,
+			w,
+			http.StatusMethodNotAllowed,
+			"config section %q can't be changed without a restart",
+			name,
+		)
+
+		return
+	}
+
+	tmpls, err := decodeConfigSection(http.MaxBytesReader(w, r.Body, maxConfigSectionSize), name, v)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding %s: %s", name, err)
+
+		return
+	}
+
+	errs := v.validate()
+	if len(errs) > 0 {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", errors.List("validating "+name, errs...))
+
+		return
+	}
+
+	err = v.apply(tmpls)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "applying %s: %s", name, err)
+
+		return
+	}
+
+	log.Info("config: section %s is replaced via http api", name)
+}
+
+// decodeConfigSection decodes the value of the section with name from body
+// into v, replacing the references, see [unmarshalConfig].  The unknown
+// fields are rejected.
+func decodeConfigSection(
+	body io.Reader,
+	name string,
+	v *configSectionValue,
+) (tmpls configTemplates, err error) {
+	n := &yaml.Node{}
+	err = yaml.NewDecoder(body).Decode(n)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	tmpls, err = expandConfigNode(n, name)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	// Encode the expanded node once again, since the unknown fields can only
+	// be rejected by the decoder.
+	data, err := yaml.Marshal(n)
+	if err != nil {
+		return nil, fmt.Errorf("encoding expanded value: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	// Don't wrap the error since it's informative enough as is.
+	return tmpls, dec.Decode(v.ptr)
+}
+
+// registerConfigSectionHandlers registers the HTTP APIs of the configuration
+// sections.
+func registerConfigSectionHandlers() {
+	names := maps.Keys(configSections)
+	slices.Sort(names)
+
+	for _, name := range names {
+		p := configSectionPathPrefix + name
+		httpRegister(http.MethodGet, p, handleGetConfigSection)
+		httpRegister(http.MethodPut, p+configSectionUpdateSuffix, handlePutConfigSection)
+	}
+}
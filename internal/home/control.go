@@ -15,6 +15,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/version"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/NYTimes/gziphandler"
 )
 
@@ -107,10 +108,17 @@ type statusResponse struct {
 	// openapi.yaml declares.
 	IsDHCPAvailable bool `json:"dhcp_available"`
 	IsRunning       bool `json:"running"`
+
+	// DiskSpaceWarning is the warning about the low free disk space, if any.
+	DiskSpaceWarning string `json:"disk_space_warning,omitempty"`
+
+	// TLSWarnings are the warnings about the configured TLS certificate, if
+	// any.
+	TLSWarnings []*tlsCertWarning `json:"tls_warnings,omitempty"`
 }
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
-	dnsAddrs, err := collectDNSAddresses()
+	resp, err := newStatusResponse()
 	if err != nil {
 		// Don't add a lot of formatting, since the error is already
 		// wrapped by collectDNSAddresses.
@@ -119,12 +127,21 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var resp statusResponse
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// newStatusResponse returns the current status of AdGuard Home.
+func newStatusResponse() (resp *statusResponse, err error) {
+	dnsAddrs, err := collectDNSAddresses()
+	if err != nil {
+		return nil, err
+	}
+
 	func() {
 		config.RLock()
 		defer config.RUnlock()
 
-		resp = statusResponse{
+		resp = &statusResponse{
 			Version:   version.Version(),
 			DNSAddrs:  dnsAddrs,
 			DNSPort:   config.DNS.Port,
@@ -141,12 +158,20 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		resp.IsProtectionEnabled = c.ProtectionEnabled
 	}
 
+	if Context.diskMonitor != nil {
+		resp.DiskSpaceWarning = Context.diskMonitor.currentWarning()
+	}
+
+	if Context.tls != nil {
+		resp.TLSWarnings = Context.tls.certWarnings(time.Now())
+	}
+
 	// IsDHCPAvailable field is now false by default for Windows.
 	if runtime.GOOS != "windows" {
 		resp.IsDHCPAvailable = Context.dhcpServer != nil
 	}
 
-	_ = aghhttp.WriteJSONResponse(w, r, resp)
+	return resp, nil
 }
 
 // ------------------------
@@ -154,12 +179,19 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 // ------------------------
 func registerControlHandlers() {
 	httpRegister(http.MethodGet, "/control/status", handleStatus)
+	httpRegister(http.MethodGet, "/control/dashboard", handleDashboard)
 	httpRegister(http.MethodPost, "/control/i18n/change_language", handleI18nChangeLanguage)
 	httpRegister(http.MethodGet, "/control/i18n/current_language", handleI18nCurrentLanguage)
 	Context.mux.HandleFunc("/control/version.json", postInstall(optionalAuth(handleGetVersionJSON)))
 	httpRegister(http.MethodPost, "/control/update", handleUpdate)
+	httpRegister(http.MethodPost, "/control/update/rollback", handleUpdateRollback)
+	httpRegister(http.MethodPost, "/control/update/channel", handleUpdateChannel)
 	httpRegister(http.MethodGet, "/control/profile", handleGetProfile)
 	httpRegister(http.MethodPut, "/control/profile/update", handlePutProfile)
+	httpRegister(http.MethodPost, "/control/reload", handleReload)
+	registerConfigSectionHandlers()
+	registerCaptureHandlers()
+	registerNotificationsHandlers()
 
 	// No auth is necessary for DoH/DoT configurations
 	Context.mux.HandleFunc("/apple/doh.mobileconfig", postInstall(handleMobileConfigDoH))
@@ -167,6 +199,13 @@ func registerControlHandlers() {
 	RegisterAuthHandlers()
 }
 
+// streamPaths are the paths of the HTTP API handlers which stream their
+// responses.  These aren't wrapped with gzip handler, since it buffers the
+// writes until there is enough data to compress and so stalls the stream.
+var streamPaths = stringutil.NewSet(
+	"/control/querylog/stream",
+)
+
 func httpRegister(method, url string, handler http.HandlerFunc) {
 	if method == "" {
 		// "/dns-query" handler doesn't need auth, gzip and isn't restricted by 1 HTTP method
@@ -174,7 +213,12 @@ func httpRegister(method, url string, handler http.HandlerFunc) {
 		return
 	}
 
-	Context.mux.Handle(url, postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureHandler(method, handler)))))
+	h := ensureHandler(method, handler)
+	if !streamPaths.Has(url) {
+		h = gziphandler.GzipHandler(h)
+	}
+
+	Context.mux.Handle(url, postInstallHandler(optionalAuthHandler(h)))
 }
 
 // ensure returns a wrapped handler that makes sure that the request has the
@@ -0,0 +1,60 @@
+package home
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPRegister_stream(t *testing.T) {
+	prevMux, prevWeb, prevAuth := Context.mux, Context.web, Context.auth
+	t.Cleanup(func() { Context.mux, Context.web, Context.auth = prevMux, prevWeb, prevAuth })
+
+	Context.mux, Context.web, Context.auth = http.NewServeMux(), &Web{}, nil
+
+	ql, err := querylog.New(querylog.Config{
+		HTTPRegister: httpRegister,
+		Enabled:      true,
+		RotationIvl:  timeutil.Day,
+		MemSize:      100,
+		BaseDir:      t.TempDir(),
+		Anonymizer:   aghnet.NewIPMut(nil),
+	})
+	require.NoError(t, err)
+
+	ql.Start()
+	t.Cleanup(ql.Close)
+
+	srv := httptest.NewServer(Context.mux)
+	t.Cleanup(srv.Close)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/control/querylog/stream", nil)
+	require.NoError(t, err)
+
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	// Both the headers and the first event must be flushed right away and not
+	// buffered until the end of the response.
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, resp.Body.Close)
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+
+	sc := bufio.NewScanner(resp.Body)
+	require.True(t, sc.Scan())
+	require.NoError(t, sc.Err())
+
+	assert.Equal(t, "retry: 1000", sc.Text())
+}
@@ -0,0 +1,149 @@
+package home
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// controlBucketsCleanupIvl is the interval between the removals of the buckets
+// of the addresses which haven't made any requests recently.
+const controlBucketsCleanupIvl = 1 * time.Minute
+
+// tokenBucket is the state of the rate limit of a single address.
+type tokenBucket struct {
+	// last is the time of the last update of tokens.
+	last time.Time
+
+	// tokens is the number of the requests the address may make right away.
+	tokens float64
+}
+
+// controlRateLimiter limits the rate of the requests to the HTTP API from each
+// IP address using the token bucket algorithm.  A nil *controlRateLimiter is
+// valid and limits nothing.
+type controlRateLimiter struct {
+	// mu protects buckets and lastCleanup.
+	mu *sync.Mutex
+
+	// buckets are the token buckets of the addresses.
+	buckets map[string]*tokenBucket
+
+	// lastCleanup is the time buckets have been cleaned up last time.
+	lastCleanup time.Time
+
+	// exempt are the networks of the clients which aren't limited.  It may be
+	// nil.
+	exempt netutil.SubnetSet
+
+	// trustedProxies are the networks of the reverse proxies, whose headers
+	// with the addresses of the clients are accepted.  It may be nil.
+	trustedProxies netutil.SubnetSet
+
+	// rps is the maximum number of requests per second, which is also the
+	// size of the bucket.
+	rps float64
+}
+
+// newControlRateLimiter returns a new properly initialized
+// *controlRateLimiter.  l is nil if rps is zero.  exempt and trustedProxies may
+// be nil.
+func newControlRateLimiter(
+	rps uint,
+	exempt netutil.SubnetSet,
+	trustedProxies netutil.SubnetSet,
+) (l *controlRateLimiter) {
+	if rps == 0 {
+		return nil
+	}
+
+	return &controlRateLimiter{
+		mu:             &sync.Mutex{},
+		buckets:        map[string]*tokenBucket{},
+		exempt:         exempt,
+		trustedProxies: trustedProxies,
+		rps:            float64(rps),
+	}
+}
+
+// allow returns true if the address with key may make a request at now and
+// takes the token for it.
+func (l *controlRateLimiter) allow(key string, now time.Time) (ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastCleanup) >= controlBucketsCleanupIvl {
+		l.cleanupLocked(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.rps}
+		l.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * l.rps
+		if b.tokens > l.rps {
+			b.tokens = l.rps
+		}
+	}
+
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// cleanupLocked removes the buckets which would have been full at now anyway.
+// l.mu is expected to be locked.
+func (l *controlRateLimiter) cleanupLocked(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rps >= l.rps {
+			delete(l.buckets, k)
+		}
+	}
+
+	l.lastCleanup = now
+}
+
+// wrap returns h wrapped so that the requests to the HTTP API exceeding the
+// rate limit are responded with 429 Too Many Requests.
+func (l *controlRateLimiter) wrap(h http.Handler) (wrapped http.Handler) {
+	if l == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/control/") {
+			h.ServeHTTP(w, r)
+
+			return
+		}
+
+		ip, err := realIP(r, l.trustedProxies)
+		if err != nil {
+			log.Debug("control: ratelimit: getting remote address: %s", err)
+		} else if (l.exempt == nil || !l.exempt.Contains(ip)) && !l.allow(ip.String(), time.Now()) {
+			w.Header().Set(aghhttp.HdrNameRetryAfter, strconv.Itoa(1))
+			aghhttp.Error(r, w, http.StatusTooManyRequests, "control: rate limit exceeded")
+
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// limitControlRate wraps h with the rate limiter of the HTTP API, if any.
+func limitControlRate(h http.Handler) (limited http.Handler) {
+	return Context.controlLimiter.wrap(h)
+}
@@ -0,0 +1,87 @@
+package home
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlRateLimiter_allow(t *testing.T) {
+	const key = "1.2.3.4"
+
+	l := newControlRateLimiter(2, nil, nil)
+	require.NotNil(t, l)
+
+	now := time.Now()
+
+	assert.True(t, l.allow(key, now))
+	assert.True(t, l.allow(key, now))
+	assert.False(t, l.allow(key, now))
+
+	// Other addresses have their own buckets.
+	assert.True(t, l.allow("5.6.7.8", now))
+
+	// Half a second refills one token at two requests per second.
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.allow(key, now))
+	assert.False(t, l.allow(key, now))
+
+	// The full buckets are removed during the cleanup.
+	now = now.Add(controlBucketsCleanupIvl)
+	l.cleanupLocked(now)
+	assert.Empty(t, l.buckets)
+
+	assert.Nil(t, newControlRateLimiter(0, nil, nil))
+}
+
+func TestControlRateLimiter_wrap(t *testing.T) {
+	_, exemptNet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+
+	l := newControlRateLimiter(1, netutil.SliceSubnetSet([]*net.IPNet{exemptNet}), nil)
+	h := l.wrap(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		path       string
+		wantCodes  []int
+	}{{
+		name:       "limited",
+		remoteAddr: "1.2.3.4:1234",
+		path:       "/control/status",
+		wantCodes:  []int{http.StatusOK, http.StatusTooManyRequests},
+	}, {
+		name:       "not_control",
+		remoteAddr: "1.2.3.5:1234",
+		path:       "/index.html",
+		wantCodes:  []int{http.StatusOK, http.StatusOK},
+	}, {
+		name:       "exempt",
+		remoteAddr: "192.168.1.2:1234",
+		path:       "/control/status",
+		wantCodes:  []int{http.StatusOK, http.StatusOK},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, wantCode := range tc.wantCodes {
+				r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+				r.RemoteAddr = tc.remoteAddr
+				w := httptest.NewRecorder()
+
+				h.ServeHTTP(w, r)
+
+				assert.Equal(t, wantCode, w.Code)
+			}
+		})
+	}
+}
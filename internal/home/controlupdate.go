@@ -2,6 +2,8 @@ package home
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -15,6 +17,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/updater"
+	"github.com/AdguardTeam/AdGuardHome/internal/version"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 )
@@ -28,7 +31,9 @@ type temporaryError interface {
 
 // Get the latest available version from the Internet
 func handleGetVersionJSON(w http.ResponseWriter, r *http.Request) {
-	resp := &versionResponse{}
+	resp := &versionResponse{
+		Channel: Context.updater.Channel(),
+	}
 	if Context.disableUpdate {
 		resp.Disabled = true
 		err := json.NewEncoder(w).Encode(resp)
@@ -101,6 +106,11 @@ func requestVersionInfo(resp *versionResponse, recheck bool) (err error) {
 		return fmt.Errorf("getting version info from %s: %w", vcu, err)
 	}
 
+	info := resp.VersionInfo
+	if info.NewVersion != "" && info.NewVersion != version.Version() {
+		Context.notifier.notifyUpdate(info.NewVersion, info.AnnouncementURL)
+	}
+
 	return nil
 }
 
@@ -141,10 +151,118 @@ func handleUpdate(w http.ResponseWriter, r *http.Request) {
 	go finishUpdate(context.Background(), execPath)
 }
 
+// handleUpdateRollback restores the previous version from the backup made by
+// the last update and restarts AdGuard Home.
+func handleUpdateRollback(w http.ResponseWriter, r *http.Request) {
+	if Context.disableUpdate {
+		aghhttp.Error(r, w, http.StatusBadRequest, "updates are disabled")
+
+		return
+	}
+
+	// Retain the current absolute path of the executable, since the updater
+	// moves the current one to the backup directory.
+	execPath, err := os.Executable()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "getting path: %s", err)
+
+		return
+	}
+
+	err = Context.updater.Rollback()
+	if errors.Is(err, updater.ErrNoBackup) {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	} else if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "%s", err)
+
+		return
+	}
+
+	aghhttp.OK(w)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	// See the comment in handleUpdate.
+	go finishUpdate(context.Background(), execPath)
+}
+
+// updateChannelJSON is the request body for the /control/update/channel
+// endpoint.
+type updateChannelJSON struct {
+	Channel string `json:"channel"`
+}
+
+// handleUpdateChannel sets the release channel the updates are received from.
+func handleUpdateChannel(w http.ResponseWriter, r *http.Request) {
+	req := &updateChannelJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing request: %s", err)
+
+		return
+	}
+
+	err = Context.updater.SetChannel(req.Channel)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	func() {
+		config.Lock()
+		defer config.Unlock()
+
+		config.UpdateChannel = req.Channel
+	}()
+
+	onConfigModified()
+
+	aghhttp.OK(w)
+}
+
+// newUpdaterConfig returns the configuration of the updater based on the
+// current build and the configuration file.
+func newUpdaterConfig() (conf *updater.Config, err error) {
+	channel := config.UpdateChannel
+	if channel == "" {
+		channel = version.Channel()
+	} else if err = updater.ValidateChannel(channel); err != nil {
+		return nil, err
+	}
+
+	var key ed25519.PublicKey
+	if config.UpdatePublicKey != "" {
+		key, err = base64.StdEncoding.DecodeString(config.UpdatePublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("decoding update public key: %w", err)
+		} else if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("update public key: bad length %d", len(key))
+		}
+	}
+
+	return &updater.Config{
+		Client:    Context.client,
+		PublicKey: key,
+		Version:   version.Version(),
+		Channel:   channel,
+		GOARCH:    runtime.GOARCH,
+		GOOS:      runtime.GOOS,
+		GOARM:     version.GOARM(),
+		GOMIPS:    version.GOMIPS(),
+		WorkDir:   Context.workDir,
+		ConfName:  config.getConfigFilename(),
+	}, nil
+}
+
 // versionResponse is the response for /control/version.json endpoint.
 type versionResponse struct {
 	updater.VersionInfo
-	Disabled bool `json:"disabled"`
+	Channel  string `json:"channel"`
+	Disabled bool   `json:"disabled"`
 }
 
 // setAllowedToAutoUpdate sets CanAutoUpdate to true if AdGuard Home is actually
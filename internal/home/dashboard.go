@@ -0,0 +1,132 @@
+package home
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// dashboardTopLimit is the maximum number of the top domains and clients in
+// the dashboard.
+const dashboardTopLimit = 10
+
+// dashboardWarningType is the type of a dashboard warning.
+type dashboardWarningType string
+
+// Dashboard warning types.  The types of the TLS certificate warnings are the
+// values of [certWarningType].
+const (
+	dashboardWarningDiskSpace       dashboardWarningType = "low_disk_space"
+	dashboardWarningStats           dashboardWarningType = "stats_unavailable"
+	dashboardWarningUpdateAvailable dashboardWarningType = "update_available"
+)
+
+// dashboardWarning is a warning to show on the dashboard.
+type dashboardWarning struct {
+	// Type is the type of the warning.
+	Type dashboardWarningType `json:"type"`
+
+	// Message is the human-readable description of the warning.
+	Message string `json:"message"`
+}
+
+// dashboardDHCP is the brief status of the DHCP server.
+type dashboardDHCP struct {
+	// DynamicLeases is the number of the dynamic leases.
+	DynamicLeases int `json:"dynamic_leases"`
+
+	// StaticLeases is the number of the static leases.
+	StaticLeases int `json:"static_leases"`
+
+	// Enabled is true if the DHCP server is enabled.
+	Enabled bool `json:"enabled"`
+}
+
+// dashboardResponse is the response for the GET /control/dashboard endpoint.
+type dashboardResponse struct {
+	// Status is the same as the response for the GET /control/status
+	// endpoint.
+	Status *statusResponse `json:"status"`
+
+	// Stats is the summary of the statistics.  It's nil if the statistics
+	// aren't available.
+	Stats *stats.Summary `json:"stats"`
+
+	// Filtering is the summary of the filter lists.  It's nil if the
+	// filtering isn't initialized.
+	Filtering *filtering.FiltersSummary `json:"filtering"`
+
+	// DHCP is the status of the DHCP server.  It's nil if the DHCP server
+	// isn't available.
+	DHCP *dashboardDHCP `json:"dhcp"`
+
+	// Warnings are the pending warnings.  It's never nil.
+	Warnings []*dashboardWarning `json:"warnings"`
+}
+
+// handleDashboard handles requests to the GET /control/dashboard endpoint.  It
+// aggregates the data the web UI needs on its initial load.
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	status, err := newStatusResponse()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "%s", err)
+
+		return
+	}
+
+	resp := &dashboardResponse{
+		Status:   status,
+		Warnings: []*dashboardWarning{},
+	}
+
+	if status.DiskSpaceWarning != "" {
+		resp.addWarning(dashboardWarningDiskSpace, status.DiskSpaceWarning)
+	}
+
+	for _, cw := range status.TLSWarnings {
+		resp.addWarning(dashboardWarningType(cw.Type), cw.Message)
+	}
+
+	if Context.stats != nil {
+		var ok bool
+		resp.Stats, ok = Context.stats.Summary(dashboardTopLimit)
+		if !ok {
+			resp.addWarning(dashboardWarningStats, "couldn't get statistics data")
+		}
+	}
+
+	if Context.filters != nil {
+		resp.Filtering = Context.filters.Summary()
+	}
+
+	if Context.dhcpServer != nil {
+		resp.DHCP = &dashboardDHCP{
+			DynamicLeases: len(Context.dhcpServer.Leases(dhcpd.LeasesDynamic)),
+			StaticLeases:  len(Context.dhcpServer.Leases(dhcpd.LeasesStatic)),
+			Enabled:       Context.dhcpServer.Enabled(),
+		}
+	}
+
+	if Context.updater != nil {
+		if nv := Context.updater.NewVersion(); nv != "" {
+			resp.addWarning(dashboardWarningUpdateAvailable, fmt.Sprintf("version %s is available", nv))
+		}
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
+
+// addWarning adds a warning of type typ with msg to resp.
+func (resp *dashboardResponse) addWarning(typ dashboardWarningType, msg string) {
+	log.Debug("dashboard: warning %s: %s", typ, msg)
+
+	resp.Warnings = append(resp.Warnings, &dashboardWarning{
+		Type:    typ,
+		Message: msg,
+	})
+}
@@ -0,0 +1,76 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleDashboard(t *testing.T) {
+	prevFilters, prevDHCP, prevTLS := Context.filters, Context.dhcpServer, Context.tls
+	prevBindHosts := config.DNS.BindHosts
+	t.Cleanup(func() {
+		Context.filters, Context.dhcpServer, Context.tls = prevFilters, prevDHCP, prevTLS
+		config.DNS.BindHosts = prevBindHosts
+	})
+
+	config.DNS.BindHosts = []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+
+	f, err := filtering.New(&filtering.Config{FilteringEnabled: true}, nil)
+	require.NoError(t, err)
+
+	Context.filters = f
+	Context.dhcpServer = &dhcpd.MockInterface{
+		OnEnabled: func() (ok bool) { return true },
+		OnLeases: func(flags dhcpd.GetLeasesFlags) (leases []*dhcpd.Lease) {
+			if flags == dhcpd.LeasesStatic {
+				return []*dhcpd.Lease{{}, {}}
+			}
+
+			return []*dhcpd.Lease{{}}
+		},
+	}
+	Context.tls = &tlsManager{
+		status: &tlsConfigStatus{
+			NotAfter: time.Now().Add(24 * time.Hour),
+		},
+		conf: tlsConfigSettings{
+			Enabled: true,
+			CertExpiry: certExpiryConfig{
+				WarnDays: 14,
+			},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	handleDashboard(w, httptest.NewRequest(http.MethodGet, "/control/dashboard", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &dashboardResponse{}
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	require.NotNil(t, resp.Status)
+	assert.Equal(t, []string{"127.0.0.1"}, resp.Status.DNSAddrs)
+
+	require.NotNil(t, resp.Filtering)
+	assert.True(t, resp.Filtering.Enabled)
+
+	assert.Equal(t, &dashboardDHCP{
+		DynamicLeases: 1,
+		StaticLeases:  2,
+		Enabled:       true,
+	}, resp.DHCP)
+
+	require.Len(t, resp.Warnings, 1)
+
+	assert.Equal(t, dashboardWarningType(certWarningExpiring), resp.Warnings[0].Type)
+}
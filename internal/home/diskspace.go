@@ -0,0 +1,195 @@
+package home
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// diskSpaceConfig is the configuration of the free disk space monitor.
+type diskSpaceConfig struct {
+	// CheckInterval is the interval between the checks of the free space.
+	CheckInterval timeutil.Duration `yaml:"check_interval"`
+
+	// MinFreeMiB is the minimum free space, in mebibytes, on the partitions
+	// holding the query log, the statistics, and the filters.  Below it, the
+	// oldest query log files are removed and a warning is shown.  Zero
+	// disables the monitor.
+	MinFreeMiB uint64 `yaml:"min_free_mib"`
+}
+
+// diskMonitor watches the free space on the partitions of the data
+// directories and trims the query log when it's low.
+type diskMonitor struct {
+	// freeSpace returns the number of bytes available on the file system
+	// containing path.
+	freeSpace func(path string) (free uint64, err error)
+
+	// removeOldest removes the oldest query log file.  removed is false if
+	// there are no files left to remove.
+	removeOldest func() (removed bool, err error)
+
+	// mu protects warning.
+	mu *sync.Mutex
+
+	// warning is the current warning about the low free space, if any.  It's
+	// kept until the free space is above the threshold again.
+	warning string
+
+	// dirs are the directories to check.
+	dirs []string
+
+	// minFree is the minimum free space in bytes.
+	minFree uint64
+}
+
+// newDiskMonitor returns a new properly initialized *diskMonitor.  conf must
+// not be nil.
+func newDiskMonitor(
+	conf *diskSpaceConfig,
+	dirs []string,
+	removeOldest func() (removed bool, err error),
+) (m *diskMonitor) {
+	return &diskMonitor{
+		freeSpace:    aghos.FreeSpace,
+		removeOldest: removeOldest,
+		mu:           &sync.Mutex{},
+		dirs:         dirs,
+		minFree:      conf.MinFreeMiB * 1024 * 1024,
+	}
+}
+
+// start starts checking the free space every ivl in a separate goroutine.
+func (m *diskMonitor) start(ivl time.Duration) {
+	go func() {
+		defer log.OnPanic("disk monitor")
+
+		m.check()
+
+		t := time.NewTicker(ivl)
+		defer t.Stop()
+
+		for range t.C {
+			m.check()
+		}
+	}()
+}
+
+// check checks the free space on the partitions of m.dirs and removes the
+// oldest query log files until it's enough or there are no files left.
+func (m *diskMonitor) check() {
+	dir, free, err := m.lowestFree()
+	if err != nil {
+		log.Error("disk monitor: %s", err)
+
+		return
+	}
+
+	for free < m.minFree {
+		var removed bool
+		removed, err = m.removeOldest()
+		if err != nil {
+			log.Error("disk monitor: trimming query log: %s", err)
+
+			break
+		} else if !removed {
+			break
+		}
+
+		dir, free, err = m.lowestFree()
+		if err != nil {
+			log.Error("disk monitor: %s", err)
+
+			return
+		}
+	}
+
+	var warning string
+	if free < m.minFree {
+		warning = fmt.Sprintf(
+			"only %d MiB of disk space left for %s, want at least %d MiB",
+			free/1024/1024,
+			dir,
+			m.minFree/1024/1024,
+		)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if warning != "" && m.warning == "" {
+		log.Error("disk monitor: %s", warning)
+	} else if warning == "" && m.warning != "" {
+		log.Info("disk monitor: free disk space is above the threshold again")
+	}
+
+	m.warning = warning
+}
+
+// lowestFree returns the directory from m.dirs with the least free space on
+// its partition.  The directories that don't exist are skipped.
+func (m *diskMonitor) lowestFree() (dir string, free uint64, err error) {
+	found := false
+	for _, d := range m.dirs {
+		var f uint64
+		f, err = m.freeSpace(d)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return "", 0, fmt.Errorf("getting free space for %s: %w", d, err)
+		}
+
+		if !found || f < free {
+			dir, free, found = d, f, true
+		}
+	}
+
+	if !found {
+		// There is nothing to check, so assume that the space is enough.
+		return "", m.minFree, nil
+	}
+
+	return dir, free, nil
+}
+
+// currentWarning returns the current warning about the low free space, if any.
+func (m *diskMonitor) currentWarning() (warning string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.warning
+}
+
+// initDiskMonitor initializes and starts [Context.diskMonitor], unless it's
+// disabled in the configuration.
+func initDiskMonitor() {
+	conf := config.DiskSpace
+	if conf.MinFreeMiB == 0 || conf.CheckInterval.Duration <= 0 {
+		log.Info("disk monitor: disabled")
+
+		return
+	}
+
+	dataDir := Context.getDataDir()
+	dirs := []string{dataDir, filepath.Join(dataDir, "filters")}
+
+	Context.diskMonitor = newDiskMonitor(&conf, dirs, removeOldestQueryLogFile)
+	Context.diskMonitor.start(conf.CheckInterval.Duration)
+}
+
+// removeOldestQueryLogFile removes the oldest file of [Context.queryLog], if
+// it's initialized.
+func removeOldestQueryLogFile() (removed bool, err error) {
+	if Context.queryLog == nil {
+		return false, nil
+	}
+
+	return Context.queryLog.RemoveOldestFile()
+}
@@ -0,0 +1,90 @@
+package home
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskMonitor_check(t *testing.T) {
+	const (
+		mib     = 1024 * 1024
+		dataDir = "data"
+		filtDir = "data/filters"
+	)
+
+	testCases := []struct {
+		name        string
+		free        map[string]uint64
+		files       int
+		freed       uint64
+		wantRemoved int
+		wantWarning string
+	}{{
+		name:        "enough",
+		free:        map[string]uint64{dataDir: 200 * mib, filtDir: 300 * mib},
+		files:       2,
+		freed:       0,
+		wantRemoved: 0,
+		wantWarning: "",
+	}, {
+		name:        "trimmed",
+		free:        map[string]uint64{dataDir: 50 * mib, filtDir: 300 * mib},
+		files:       2,
+		freed:       60 * mib,
+		wantRemoved: 1,
+		wantWarning: "",
+	}, {
+		name:        "not_enough",
+		free:        map[string]uint64{dataDir: 10 * mib, filtDir: 300 * mib},
+		files:       2,
+		freed:       10 * mib,
+		wantRemoved: 2,
+		wantWarning: "only 30 MiB of disk space left for data, want at least 100 MiB",
+	}, {
+		name:        "no_filters_dir",
+		free:        map[string]uint64{dataDir: 10 * mib},
+		files:       0,
+		freed:       0,
+		wantRemoved: 0,
+		wantWarning: "only 10 MiB of disk space left for data, want at least 100 MiB",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			files := tc.files
+			removed := 0
+			m := &diskMonitor{
+				freeSpace: func(path string) (free uint64, err error) {
+					free, ok := tc.free[path]
+					if !ok {
+						return 0, os.ErrNotExist
+					}
+
+					return free, nil
+				},
+				removeOldest: func() (ok bool, err error) {
+					if files == 0 {
+						return false, nil
+					}
+
+					files--
+					removed++
+					tc.free[dataDir] += tc.freed
+
+					return true, nil
+				},
+				mu:      &sync.Mutex{},
+				dirs:    []string{dataDir, filtDir},
+				minFree: 100 * mib,
+			}
+
+			m.check()
+
+			assert.Equal(t, tc.wantRemoved, removed)
+			assert.Equal(t, tc.wantWarning, m.currentWarning())
+		})
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
@@ -22,7 +22,6 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
-	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/ameshkov/dnscrypt/v2"
 	yaml "gopkg.in/yaml.v3"
 )
@@ -52,20 +51,27 @@ func initDNS() (err error) {
 
 	anonymizer := config.anonymizer()
 
+	loc, err := config.timeZone()
+	if err != nil {
+		return fmt.Errorf("time_zone: %w", err)
+	}
+
 	statsConf := stats.Config{
 		Filename:       filepath.Join(baseDir, "stats.db"),
 		LimitDays:      config.Stats.Interval,
+		HistoryYears:   config.Stats.HistoryYears,
 		ConfigModified: onConfigModified,
 		HTTPRegister:   httpRegister,
 		Enabled:        config.Stats.Enabled,
+		TimeZone:       loc,
 	}
 
-	set, err := nonDupEmptyHostNames(config.Stats.Ignored)
+	ignored, err := aghnet.NewIgnoreMatcher(config.Stats.Ignored)
 	if err != nil {
 		return fmt.Errorf("statistics: ignored list: %w", err)
 	}
 
-	statsConf.Ignored = set
+	statsConf.Ignored = ignored
 	Context.stats, err = stats.New(statsConf)
 	if err != nil {
 		return fmt.Errorf("init stats: %w", err)
@@ -77,20 +83,29 @@ func initDNS() (err error) {
 		HTTPRegister:      httpRegister,
 		FindClient:        Context.clients.findMultiple,
 		BaseDir:           baseDir,
+		BackendDSN:        config.QueryLog.BackendDSN,
 		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
 		RotationIvl:       config.QueryLog.Interval.Duration,
 		MemSize:           config.QueryLog.MemSize,
+		FlushInterval:     config.QueryLog.FlushInterval.Duration,
 		Enabled:           config.QueryLog.Enabled,
 		FileEnabled:       config.QueryLog.FileEnabled,
+		FileSync:          config.QueryLog.FileSync,
+		FullResponse:      config.QueryLog.FullResponse,
+		TimeZone:          loc,
+		Redaction:         queryLogRedaction,
 	}
 
-	set, err = nonDupEmptyHostNames(config.QueryLog.Ignored)
+	ignored, err = aghnet.NewIgnoreMatcher(config.QueryLog.Ignored)
 	if err != nil {
 		return fmt.Errorf("querylog: ignored list: %w", err)
 	}
 
-	conf.Ignored = set
-	Context.queryLog = querylog.New(conf)
+	conf.Ignored = ignored
+	Context.queryLog, err = querylog.New(conf)
+	if err != nil {
+		return fmt.Errorf("init querylog: %w", err)
+	}
 
 	Context.filters, err = filtering.New(config.DNS.DnsfilterConf, nil)
 	if err != nil {
@@ -103,7 +118,7 @@ func initDNS() (err error) {
 
 	return initDNSServer(
 		Context.filters,
-		Context.stats,
+		&alertingStats{Interface: Context.stats, alerts: Context.alerts},
 		Context.queryLog,
 		Context.dhcpServer,
 		anonymizer,
@@ -168,7 +183,7 @@ func initDNSServer(
 	}
 
 	if config.Clients.Sources.WHOIS {
-		Context.whois = initWHOIS(&Context.clients)
+		Context.whois = initWHOIS(&Context.clients, Context.client)
 	}
 
 	return nil
@@ -211,6 +226,8 @@ func onDNSRequest(pctx *proxy.DNSContext) {
 		return
 	}
 
+	Context.clients.markSeen(ip, time.Now())
+
 	srcs := config.Clients.Sources
 	if srcs.RDNS && !ip.IsLoopback() {
 		Context.rdns.Begin(ip)
@@ -259,9 +276,13 @@ func generateServerConfig(
 		FilteringConfig: dnsConf.FilteringConfig,
 		ConfigModified:  onConfigModified,
 		HTTPRegister:    httpReg,
+		ZonesDir:        filepath.Join(Context.getDataDir(), "zones"),
 		OnDNSRequest:    onDNSRequest,
 		UseDNS64:        config.DNS.UseDNS64,
 		DNS64Prefixes:   config.DNS.DNS64Prefixes,
+
+		ActivatedTCPListeners: Context.activatedSockets.TCPListeners(uint16(dnsConf.Port)),
+		ActivatedUDPConns:     Context.activatedSockets.UDPConns(uint16(dnsConf.Port)),
 	}
 
 	if tlsConf.Enabled {
@@ -280,6 +301,8 @@ func generateServerConfig(
 			newConf.QUICListenAddrs = ipsToUDPAddrs(hosts, tlsConf.PortDNSOverQUIC)
 		}
 
+		newConf.PureProxy = newPureProxyConfig(hosts, tlsConf.PureProxyPorts)
+
 		if tlsConf.PortDNSCrypt != 0 {
 			newConf.DNSCryptConfig, err = newDNSCrypt(hosts, *tlsConf)
 			if err != nil {
@@ -291,10 +314,15 @@ func generateServerConfig(
 	}
 
 	newConf.TLSv12Roots = Context.tlsRoots
+	newConf.TLSCiphers = Context.tlsCipherIDs
+	newConf.TLSMinVersion = Context.tlsMinVersion
+	newConf.TLSHandshakeStats = Context.dnsTLSStats
 	newConf.TLSAllowUnencryptedDoH = tlsConf.AllowUnencryptedDoH
 
 	newConf.FilterHandler = applyAdditionalFiltering
 	newConf.GetCustomUpstreamByClient = Context.clients.findUpstreams
+	newConf.GetAnswerRulesByClient = Context.clients.findAnswerRules
+	newConf.GetCaptureIPByClient = captureIPForClient
 
 	newConf.LocalPTRResolvers = dnsConf.LocalPTRResolvers
 	newConf.UpstreamTimeout = dnsConf.UpstreamTimeout.Duration
@@ -307,6 +335,24 @@ func generateServerConfig(
 	return newConf, nil
 }
 
+// newPureProxyConfig returns the configuration of the pure proxy listeners on
+// hosts using the non-zero ports.
+func newPureProxyConfig(hosts []netip.Addr, ports pureProxyPorts) (c dnsforward.PureProxyConfig) {
+	if ports.PortHTTPS != 0 {
+		c.HTTPSListenAddrs = ipsToTCPAddrs(hosts, ports.PortHTTPS)
+	}
+
+	if ports.PortDNSOverTLS != 0 {
+		c.TLSListenAddrs = ipsToTCPAddrs(hosts, ports.PortDNSOverTLS)
+	}
+
+	if ports.PortDNSOverQUIC != 0 {
+		c.QUICListenAddrs = ipsToUDPAddrs(hosts, ports.PortDNSOverQUIC)
+	}
+
+	return c
+}
+
 func newDNSCrypt(hosts []netip.Addr, tlsConf tlsConfigSettings) (dnscc dnsforward.DNSCryptConfig, err error) {
 	if tlsConf.DNSCryptConfigFile == "" {
 		return dnscc, errors.Error("no dnscrypt_config_file")
@@ -392,20 +438,19 @@ func applyAdditionalFiltering(clientIP net.IP, clientID string, setts *filtering
 
 	log.Debug("%s: looking for client with ip %s and clientid %q", pref, clientIP, clientID)
 
-	if clientIP == nil {
-		return
+	if clientIP != nil {
+		setts.ClientIP = clientIP
 	}
 
-	setts.ClientIP = clientIP
-
 	c, ok := Context.clients.Find(clientID)
-	if !ok {
+	if !ok && clientIP != nil {
 		c, ok = Context.clients.Find(clientIP.String())
-		if !ok {
-			log.Debug("%s: no clients with ip %s and clientid %q", pref, clientIP, clientID)
+	}
 
-			return
-		}
+	if !ok {
+		log.Debug("%s: no clients with ip %s and clientid %q", pref, clientIP, clientID)
+
+		return
 	}
 
 	log.Debug("%s: using settings for client %q (%s; %q)", pref, c.Name, clientIP, clientID)
@@ -417,11 +462,21 @@ func applyAdditionalFiltering(clientIP net.IP, clientID string, setts *filtering
 			svcs = []string{}
 		}
 		Context.filters.ApplyBlockedServices(setts, svcs)
+		setts.UseOwnBlockedServices = true
 		log.Debug("%s: services for client %q set: %s", pref, c.Name, svcs)
 	}
 
 	setts.ClientName = c.Name
 	setts.ClientTags = c.Tags
+
+	if c.DefaultDeny {
+		setts.DefaultDeny = true
+		Context.filters.ApplyAllowedServices(setts, c.AllowedServices)
+		log.Debug("%s: default deny, allowed services: %s", pref, c.AllowedServices)
+	}
+
+	setts.IgnoreLogging = c.IgnoreLogging
+
 	if !c.UseOwnSettings {
 		return
 	}
@@ -431,6 +486,34 @@ func applyAdditionalFiltering(clientIP net.IP, clientID string, setts *filtering
 	setts.ClientSafeSearch = c.SafeSearch
 	setts.SafeBrowsingEnabled = c.SafeBrowsingEnabled
 	setts.ParentalEnabled = c.ParentalEnabled
+	setts.DryRun = c.DryRun
+	setts.ParentalStrictSearch = c.ParentalStrictSearch
+}
+
+// applyClientSettings applies the settings of the client identified by id,
+// which is an IP address, a ClientID, or a name of a persistent client, to
+// setts.  It's used to check the hosts on behalf of the clients.
+func applyClientSettings(id string, setts *filtering.Settings) {
+	ip := net.ParseIP(id)
+	if ip != nil {
+		applyAdditionalFiltering(ip, "", setts)
+
+		return
+	}
+
+	clientID := id
+	if ids, ok := Context.clients.idsByName(id); ok && len(ids) > 0 {
+		// Use the first identifier to find the client and the first IP address
+		// among the identifiers to match the $client modifiers.
+		clientID = ids[0]
+		for _, cid := range ids {
+			if ip = net.ParseIP(cid); ip != nil {
+				break
+			}
+		}
+	}
+
+	applyAdditionalFiltering(ip, clientID, setts)
 }
 
 func startDNSServer() error {
@@ -488,6 +571,25 @@ func reconfigureDNSServer() (err error) {
 	return nil
 }
 
+// reloadDNSServer applies the current DNS configuration to the running DNS
+// server restarting its listeners only if their configuration has changed.
+func reloadDNSServer() (err error) {
+	tlsConf := &tlsConfigSettings{}
+	Context.tls.WriteDiskConfig(tlsConf)
+
+	newConf, err := generateServerConfig(tlsConf, httpRegister)
+	if err != nil {
+		return fmt.Errorf("generating forwarding dns server config: %w", err)
+	}
+
+	err = Context.dnsServer.Reload(&newConf)
+	if err != nil {
+		return fmt.Errorf("reloading forwarding dns server: %w", err)
+	}
+
+	return nil
+}
+
 func stopDNSServer() (err error) {
 	if !isRunning() {
 		return nil
@@ -535,30 +637,6 @@ func closeDNSServer() {
 	log.Debug("all dns modules are closed")
 }
 
-// nonDupEmptyHostNames returns nil and error, if list has duplicate or empty
-// host name.  Otherwise returns a set, which contains lowercase host names
-// without dot at the end, and nil error.
-func nonDupEmptyHostNames(list []string) (set *stringutil.Set, err error) {
-	set = stringutil.NewSet()
-
-	for _, v := range list {
-		host := strings.ToLower(strings.TrimSuffix(v, "."))
-		// TODO(a.garipov): Think about ignoring empty (".") names in
-		// the future.
-		if host == "" {
-			return nil, errors.Error("host name is empty")
-		}
-
-		if set.Has(host) {
-			return nil, fmt.Errorf("duplicate host name %q", host)
-		}
-
-		set.Add(host)
-	}
-
-	return set, nil
-}
-
 // safeSearchResolver is a [filtering.Resolver] implementation used for safe
 // search.
 type safeSearchResolver struct{}
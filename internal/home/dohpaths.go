@@ -0,0 +1,85 @@
+package home
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// dohPathPrefix is the path of the DNS-over-HTTPS handler, which may be
+// followed by a ClientID.
+const dohPathPrefix = "/dns-query"
+
+// reservedPathPrefixes are the prefixes of the paths handled by AdGuard Home
+// which can't be used for serving DNS-over-HTTPS.
+var reservedPathPrefixes = []string{
+	"/apple/",
+	"/control/",
+	dohPathPrefix,
+}
+
+// validateDoHPaths returns an error if any of the custom DNS-over-HTTPS paths
+// or the ClientIDs those are mapped to is invalid.
+func validateDoHPaths(paths map[string]string) (err error) {
+	sorted := maps.Keys(paths)
+	slices.Sort(sorted)
+
+	for _, p := range sorted {
+		if p == "" || p[0] != '/' || p == "/" || path.Clean(p) != p {
+			return fmt.Errorf("path %q: must be an absolute clean path", p)
+		}
+
+		for _, prefix := range reservedPathPrefixes {
+			if strings.HasPrefix(p, prefix) {
+				return fmt.Errorf("path %q: reserved prefix %q", p, prefix)
+			}
+		}
+
+		err = dnsforward.ValidateClientID(paths[p])
+		if err != nil {
+			return fmt.Errorf("path %q: %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+// dohPathClientID returns the ClientID the custom DNS-over-HTTPS path p is
+// mapped to.  ok is false if p isn't a custom DNS-over-HTTPS path.
+func (m *tlsManager) dohPathClientID(p string) (clientID string, ok bool) {
+	if m == nil {
+		return "", false
+	}
+
+	m.confLock.Lock()
+	defer m.confLock.Unlock()
+
+	clientID, ok = m.conf.DoHPaths[path.Clean(p)]
+
+	return clientID, ok
+}
+
+// rewriteDoHPath wraps h and routes the DNS-over-HTTPS requests on the custom
+// paths to the ClientID-in-path handler, so that those are attributed to the
+// ClientIDs the paths are mapped to.
+func rewriteDoHPath(h http.Handler) (wrapped http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, ok := Context.tls.dohPathClientID(r.URL.Path)
+		if !ok {
+			h.ServeHTTP(w, r)
+
+			return
+		}
+
+		rr := r.Clone(r.Context())
+		rr.URL.Path = path.Join(dohPathPrefix, clientID)
+		rr.URL.RawPath = ""
+
+		h.ServeHTTP(w, rr)
+	})
+}
@@ -0,0 +1,96 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDoHPaths(t *testing.T) {
+	testCases := []struct {
+		paths      map[string]string
+		name       string
+		wantErrMsg string
+	}{{
+		paths:      nil,
+		name:       "empty",
+		wantErrMsg: "",
+	}, {
+		paths: map[string]string{
+			"/dns/kids":  "kids",
+			"/dns/guest": "guest",
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		paths:      map[string]string{"dns/kids": "kids"},
+		name:       "relative",
+		wantErrMsg: `path "dns/kids": must be an absolute clean path`,
+	}, {
+		paths:      map[string]string{"/dns/kids/": "kids"},
+		name:       "not_clean",
+		wantErrMsg: `path "/dns/kids/": must be an absolute clean path`,
+	}, {
+		paths:      map[string]string{"/dns-query/kids": "kids"},
+		name:       "reserved",
+		wantErrMsg: `path "/dns-query/kids": reserved prefix "/dns-query"`,
+	}, {
+		paths:      map[string]string{"/dns/kids": "kids!"},
+		name:       "bad_clientid",
+		wantErrMsg: `path "/dns/kids": invalid clientid "kids!": bad hostname label rune '!'`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, validateDoHPaths(tc.paths))
+		})
+	}
+}
+
+func TestRewriteDoHPath(t *testing.T) {
+	prevTLS := Context.tls
+	t.Cleanup(func() { Context.tls = prevTLS })
+
+	Context.tls = &tlsManager{conf: tlsConfigSettings{
+		DoHPaths: map[string]string{"/dns/kids": "kids"},
+	}}
+
+	var gotPath string
+	h := rewriteDoHPath(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+
+	testCases := []struct {
+		name     string
+		path     string
+		wantPath string
+	}{{
+		name:     "custom",
+		path:     "/dns/kids",
+		wantPath: "/dns-query/kids",
+	}, {
+		name:     "custom_slash",
+		path:     "/dns/kids/",
+		wantPath: "/dns-query/kids",
+	}, {
+		name:     "other",
+		path:     "/dns/guest",
+		wantPath: "/dns/guest",
+	}, {
+		name:     "dns_query",
+		path:     "/dns-query/laptop",
+		wantPath: "/dns-query/laptop",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "https://dns.example"+tc.path, nil)
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			assert.Equal(t, tc.wantPath, gotPath)
+		})
+	}
+}
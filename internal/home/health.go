@@ -0,0 +1,90 @@
+package home
+
+import (
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+)
+
+// componentState is the state of a component of AdGuard Home reported by the
+// health checks.
+type componentState string
+
+// componentState values.
+const (
+	componentStateOK       componentState = "ok"
+	componentStateNotReady componentState = "not_ready"
+)
+
+// healthResp is the response to the health check HTTP APIs.
+type healthResp struct {
+	// Components are the states of the checked components by their names.
+	// It's nil for the liveness check.
+	Components map[string]componentState `json:"components,omitempty"`
+
+	// Status is componentStateOK if all the components are ready.
+	Status componentState `json:"status"`
+}
+
+// registerHealthHandlers registers the health check HTTP API handlers.  They
+// require no authentication, since they are used by the container
+// orchestrators, and are available before the installation.
+func registerHealthHandlers() {
+	Context.mux.Handle("/control/healthz", ensureHandler(http.MethodGet, handleHealthz))
+	Context.mux.Handle("/control/readyz", ensureHandler(http.MethodGet, handleReadyz))
+}
+
+// handleHealthz is the handler for the GET /control/healthz HTTP API.  It
+// reports that the HTTP server is up.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	_ = aghhttp.WriteJSONResponse(w, r, &healthResp{
+		Status: componentStateOK,
+	})
+}
+
+// handleReadyz is the handler for the GET /control/readyz HTTP API.  It
+// reports whether AdGuard Home is installed, its DNS listeners are bound, and
+// its filtering rules are loaded.  It responds with 503 Service Unavailable if
+// any of them isn't ready.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	resp := readiness()
+	code := http.StatusOK
+	if resp.Status != componentStateOK {
+		code = http.StatusServiceUnavailable
+	}
+
+	_ = aghhttp.WriteJSONResponseCode(w, r, code, resp)
+}
+
+// readiness returns the current states of the components of AdGuard Home.
+func readiness() (resp *healthResp) {
+	resp = &healthResp{
+		Components: map[string]componentState{
+			"http":      componentStateOK,
+			"install":   stateOf(!Context.firstRun),
+			"dns":       stateOf(isRunning()),
+			"filtering": stateOf(Context.filters != nil && Context.filters.RulesLoaded()),
+		},
+		Status: componentStateOK,
+	}
+
+	for _, st := range resp.Components {
+		if st != componentStateOK {
+			resp.Status = componentStateNotReady
+
+			break
+		}
+	}
+
+	return resp
+}
+
+// stateOf returns componentStateOK if ready is true and
+// componentStateNotReady otherwise.
+func stateOf(ready bool) (st componentState) {
+	if ready {
+		return componentStateOK
+	}
+
+	return componentStateNotReady
+}
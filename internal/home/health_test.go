@@ -0,0 +1,78 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthHandlers(t *testing.T) {
+	prevMux, prevFirstRun, prevFilters := Context.mux, Context.firstRun, Context.filters
+	t.Cleanup(func() {
+		Context.mux, Context.firstRun, Context.filters = prevMux, prevFirstRun, prevFilters
+	})
+
+	Context.mux, Context.firstRun = http.NewServeMux(), false
+	registerHealthHandlers()
+
+	f, err := filtering.New(&filtering.Config{}, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		filters  *filtering.DNSFilter
+		wantComp map[string]componentState
+		name     string
+		path     string
+		wantCode int
+	}{{
+		filters:  nil,
+		wantComp: nil,
+		name:     "healthz",
+		path:     "/control/healthz",
+		wantCode: http.StatusOK,
+	}, {
+		filters: f,
+		wantComp: map[string]componentState{
+			"http":      componentStateOK,
+			"install":   componentStateOK,
+			"dns":       componentStateNotReady,
+			"filtering": componentStateNotReady,
+		},
+		name:     "readyz_not_ready",
+		path:     "/control/readyz",
+		wantCode: http.StatusServiceUnavailable,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			Context.filters = tc.filters
+
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+
+			Context.mux.ServeHTTP(w, r)
+
+			require.Equal(t, tc.wantCode, w.Code)
+
+			resp := &healthResp{}
+			err = json.NewDecoder(w.Body).Decode(resp)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantComp, resp.Components)
+		})
+	}
+
+	t.Run("readyz_ready_filtering", func(t *testing.T) {
+		err = f.SetFilters(nil, nil, false)
+		require.NoError(t, err)
+
+		Context.filters = f
+
+		assert.Equal(t, componentStateOK, readiness().Components["filtering"])
+	})
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering/safesearch"
+	"github.com/AdguardTeam/AdGuardHome/internal/oui"
 	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/AdGuardHome/internal/updater"
@@ -43,6 +44,10 @@ import (
 const (
 	// Used in config to indicate that syslog or eventlog (win) should be used for logger output
 	configSyslog = "syslog"
+
+	// ouiCacheFilename is the name of the file in the data directory
+	// containing the downloaded OUI registry.
+	ouiCacheFilename = "oui.csv"
 )
 
 // Global context
@@ -61,6 +66,35 @@ type homeContext struct {
 	filters    *filtering.DNSFilter // DNS filtering module
 	web        *Web                 // Web (HTTP, HTTPS) module
 	tls        *tlsManager          // TLS module
+
+	// oui is the database of the hardware vendors.  It's nil if the vendor
+	// lookup is disabled.
+	oui *oui.DB
+
+	// diskMonitor trims the query log when the free disk space is low.  It's
+	// nil if the monitor is disabled.
+	diskMonitor *diskMonitor
+
+	// capture captures the unknown local clients.  It's nil if the capture
+	// mode is disabled.
+	capture *capturePortal
+
+	// alerts checks the queries against the alert rules and delivers the
+	// alerts.
+	alerts *alerter
+
+	// notifier sends the email notifications about the updates, the TLS
+	// certificate expiry, and the alerts.
+	notifier *notifier
+
+	// controlLimiter limits the rate of the requests to the HTTP API.  It's
+	// nil if the rate isn't limited.
+	controlLimiter *controlRateLimiter
+
+	// activatedSockets are the sockets passed by the service manager.  It's
+	// nil if there are none.
+	activatedSockets *aghnet.ActivatedSockets
+
 	// etcHosts is an IP-hostname pairs set taken from system configuration
 	// (e.g. /etc/hosts) files.
 	etcHosts *aghnet.HostsContainer
@@ -87,6 +121,18 @@ type homeContext struct {
 	// tlsCipherIDs are the ID of the cipher suites that AdGuard Home must use.
 	tlsCipherIDs []uint16
 
+	// tlsMinVersion is the minimum version of TLS accepted by the encrypted
+	// listeners.
+	tlsMinVersion uint16
+
+	// dnsTLSStats are the statistics of the TLS handshakes of the encrypted
+	// DNS listeners, except for DNS-over-HTTPS.
+	dnsTLSStats *aghtls.HandshakeStats
+
+	// webTLSStats are the statistics of the TLS handshakes of the HTTPS
+	// server, which serves both the web interface and DNS-over-HTTPS.
+	webTLSStats *aghtls.HandshakeStats
+
 	// disableUpdate, if true, tells AdGuard Home to not check for updates.
 	disableUpdate bool
 
@@ -128,6 +174,11 @@ func Main(clientBuildFS fs.FS) {
 			case syscall.SIGHUP:
 				Context.clients.reloadARP()
 				Context.tls.reload()
+
+				err := reloadConfig()
+				if err != nil {
+					log.Error("%s", err)
+				}
 			default:
 				cleanup(context.Background())
 				cleanupAlways()
@@ -150,6 +201,10 @@ func setupContext(opts options) {
 	setupContextFlags(opts)
 
 	Context.tlsRoots = aghtls.SystemRootCAs()
+	// Use the default minimum version until the configuration is parsed.
+	Context.tlsMinVersion = tls.VersionTLS12
+	Context.dnsTLSStats = aghtls.NewHandshakeStats()
+	Context.webTLSStats = aghtls.NewHandshakeStats()
 	Context.transport = &http.Transport{
 		DialContext: customDialContext,
 		Proxy:       getHTTPProxy,
@@ -176,9 +231,7 @@ func setupContext(opts options) {
 		}
 
 		if opts.checkConfig {
-			log.Info("configuration file is ok")
-
-			os.Exit(0)
+			checkConfig()
 		}
 
 		if !opts.noEtcHosts && config.Clients.Sources.HostsFile {
@@ -290,15 +343,33 @@ func setupHostsContainer() (err error) {
 }
 
 func setupConfig(opts options) (err error) {
+	// Don't start with an unknown role in the redaction of the query log, since
+	// the users with that role would see the hidden fields.
+	err = validateRedaction(config.QueryLog.Redaction)
+	if err != nil {
+		return fmt.Errorf("querylog: redaction: %w", err)
+	}
+
 	config.DNS.DnsfilterConf.EtcHosts = Context.etcHosts
 	config.DNS.DnsfilterConf.ConfigModified = onConfigModified
 	config.DNS.DnsfilterConf.HTTPRegister = httpRegister
+	config.DNS.DnsfilterConf.ApplyClientSettings = applyClientSettings
 	config.DNS.DnsfilterConf.DataDir = Context.getDataDir()
 	config.DNS.DnsfilterConf.Filters = slices.Clone(config.Filters)
 	config.DNS.DnsfilterConf.WhitelistFilters = slices.Clone(config.WhitelistFilters)
 	config.DNS.DnsfilterConf.UserRules = slices.Clone(config.UserRules)
+	config.DNS.DnsfilterConf.UserRuleGroups = slices.Clone(config.UserRuleGroups)
 	config.DNS.DnsfilterConf.HTTPClient = Context.client
 
+	// Load the saved catalog of the blocked services before the clients, since
+	// their settings may refer to the services which aren't built in.
+	config.DNS.DnsfilterConf.ServicesCatalog, err = filtering.NewServicesCatalog(
+		config.DNS.DnsfilterConf,
+	)
+	if err != nil {
+		log.Error("loading blocked services catalog: %s; using built-in one", err)
+	}
+
 	config.DNS.DnsfilterConf.SafeSearchConf.CustomResolver = safeSearchResolver{}
 	config.DNS.DnsfilterConf.SafeSearch, err = safesearch.NewDefaultSafeSearch(
 		config.DNS.DnsfilterConf.SafeSearchConf,
@@ -309,6 +380,15 @@ func setupConfig(opts options) (err error) {
 		return fmt.Errorf("initializing safesearch: %w", err)
 	}
 
+	if vl := config.Clients.VendorLookup; vl != nil && vl.Enabled {
+		Context.oui = oui.New(&oui.Config{
+			Client:    Context.client,
+			URL:       vl.URL,
+			CachePath: filepath.Join(Context.getDataDir(), ouiCacheFilename),
+		})
+		config.DHCP.VendorByMAC = Context.oui.Vendor
+	}
+
 	config.DHCP.WorkDir = Context.workDir
 	config.DHCP.HTTPRegister = httpRegister
 	config.DHCP.ConfigModified = onConfigModified
@@ -322,24 +402,25 @@ func setupConfig(opts options) (err error) {
 		return fmt.Errorf("initing dhcp: %w", err)
 	}
 
-	Context.updater = updater.NewUpdater(&updater.Config{
-		Client:   Context.client,
-		Version:  version.Version(),
-		Channel:  version.Channel(),
-		GOARCH:   runtime.GOARCH,
-		GOOS:     runtime.GOOS,
-		GOARM:    version.GOARM(),
-		GOMIPS:   version.GOMIPS(),
-		WorkDir:  Context.workDir,
-		ConfName: config.getConfigFilename(),
-	})
+	updConf, err := newUpdaterConfig()
+	if err != nil {
+		return fmt.Errorf("initing updater: %w", err)
+	}
+
+	Context.updater = updater.NewUpdater(updConf)
 
 	var arpdb aghnet.ARPDB
 	if config.Clients.Sources.ARP {
 		arpdb = aghnet.NewARPDB()
 	}
 
+	err = Context.clients.setSourcePriority(config.Clients.Sources.Priority)
+	if err != nil {
+		return fmt.Errorf("initing clients: %w", err)
+	}
+
 	Context.clients.Init(config.Clients.Persistent, Context.dhcpServer, Context.etcHosts, arpdb, config.DNS.DnsfilterConf)
+	Context.clients.oui = Context.oui
 
 	if opts.bindPort != 0 {
 		config.BindPort = opts.bindPort
@@ -376,9 +457,15 @@ func checkPorts() (err error) {
 			tcpPort(config.TLS.PortHTTPS),
 			tcpPort(config.TLS.PortDNSOverTLS),
 			tcpPort(config.TLS.PortDNSCrypt),
+			tcpPort(config.TLS.PureProxyPorts.PortHTTPS),
+			tcpPort(config.TLS.PureProxyPorts.PortDNSOverTLS),
 		)
 
-		addPorts(udpPorts, udpPort(config.TLS.PortDNSOverQUIC))
+		addPorts(
+			udpPorts,
+			udpPort(config.TLS.PortDNSOverQUIC),
+			udpPort(config.TLS.PureProxyPorts.PortDNSOverQUIC),
+		)
 	}
 
 	if err = tcpPorts.Validate(); err != nil {
@@ -415,6 +502,9 @@ func initWeb(opts options, clientBuildFS fs.FS) (web *Web, err error) {
 		clientFS: clientFS,
 
 		serveHTTP3: config.DNS.ServeHTTP3,
+
+		activated:  Context.activatedSockets,
+		unixSocket: config.WebUnixSocket,
 	}
 
 	web = newWeb(&webConf)
@@ -454,7 +544,17 @@ func run(opts options, clientBuildFS fs.FS) {
 	err := configureOS(config)
 	fatalOnError(err)
 
-	// clients package uses filtering package's static data (filtering.BlockedSvcKnown()),
+	Context.activatedSockets, err = aghnet.ListenActivated()
+	if err != nil {
+		// Use the sockets which have been converted successfully anyway.
+		log.Error("%s", err)
+	}
+
+	if socks := Context.activatedSockets; socks != nil {
+		log.Info("socket activation: got %d tcp and %d udp sockets", len(socks.TCP), len(socks.UDP))
+	}
+
+	// clients package uses filtering package's static data (the built-in blocked services),
 	//  so we have to initialize filtering's static data first,
 	//  but also avoid relying on automatic Go init() function
 	filtering.InitModule()
@@ -502,27 +602,61 @@ func run(opts options, clientBuildFS fs.FS) {
 
 	sessFilename := filepath.Join(Context.getDataDir(), "sessions.db")
 	GLMode = opts.glinetMode
+	exempt, err := netutil.ParseSubnets(config.AuthExemptSubnets...)
+	if err != nil {
+		log.Fatalf("Cannot parse auth exempt subnets: %s", err)
+	}
+
+	exemptSet := netutil.SliceSubnetSet(exempt)
+
 	var rateLimiter *authRateLimiter
 	if config.AuthAttempts > 0 && config.AuthBlockMin > 0 {
+		window := config.AuthAttemptsWindow.Duration
+		if window <= 0 {
+			window = failedAuthTTL
+		}
+
 		rateLimiter = newAuthRateLimiter(
 			time.Duration(config.AuthBlockMin)*time.Minute,
+			window,
 			config.AuthAttempts,
+			exemptSet,
 		)
 	} else {
 		log.Info("authratelimiter is disabled")
 	}
 
+	trusted, err := netutil.ParseSubnets(config.DNS.TrustedProxies...)
+	if err != nil {
+		log.Fatalf("Cannot parse trusted proxies: %s", err)
+	}
+
+	Context.controlLimiter = newControlRateLimiter(
+		config.ControlRateLimit,
+		exemptSet,
+		netutil.SliceSubnetSet(trusted),
+	)
+
 	Context.auth = InitAuth(
 		sessFilename,
 		config.Users,
 		config.WebSessionTTLHours*60*60,
 		rateLimiter,
+		netutil.SliceSubnetSet(trusted),
 	)
 	if Context.auth == nil {
 		log.Fatalf("Couldn't initialize Auth module")
 	}
 	config.Users = nil
 
+	Context.auth.oidc, err = newOIDCProvider(config.OIDC, Context.client)
+	if err != nil {
+		log.Fatalf("auth: %s", err)
+	}
+
+	err = initNotifier()
+	fatalOnError(err)
+
 	Context.tls, err = newTLSManager(config.TLS)
 	if err != nil {
 		log.Error("initializing tls: %s", err)
@@ -532,6 +666,14 @@ func run(opts options, clientBuildFS fs.FS) {
 	Context.web, err = initWeb(opts, clientBuildFS)
 	fatalOnError(err)
 
+	initDiskMonitor()
+
+	err = initCapture()
+	fatalOnError(err)
+
+	err = initAlerts()
+	fatalOnError(err)
+
 	if !Context.firstRun {
 		err = initDNS()
 		fatalOnError(err)
@@ -742,6 +884,10 @@ func cleanup(ctx context.Context) {
 		Context.auth = nil
 	}
 
+	if Context.capture != nil {
+		Context.capture.shutdown(ctx)
+	}
+
 	err := stopDNSServer()
 	if err != nil {
 		log.Error("stopping dns server: %s", err)
@@ -0,0 +1,535 @@
+package home
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtls"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+)
+
+// notificationsConfig is the configuration of the email notifications.
+type notificationsConfig struct {
+	// Email is the configuration of the SMTP server the notifications are
+	// sent through.
+	Email emailConfig `yaml:"email"`
+
+	// Updates, if true, enables the notifications about the new versions of
+	// AdGuard Home.
+	Updates bool `yaml:"updates"`
+
+	// CertExpiry, if true, enables the notifications about the changes of the
+	// TLS certificate warnings, see [certExpiryConfig].
+	CertExpiry bool `yaml:"cert_expiry"`
+
+	// Alerts, if true, enables the notifications about the triggered alert
+	// rules, see [alertsConfig].
+	Alerts bool `yaml:"alerts"`
+}
+
+// smtpSecurity is the way the connection to the SMTP server is secured.
+type smtpSecurity string
+
+// SMTP security modes.
+const (
+	// smtpSecuritySTARTTLS upgrades the plain connection with the STARTTLS
+	// command, which the server must support.  It's the default mode.
+	smtpSecuritySTARTTLS smtpSecurity = "starttls"
+
+	// smtpSecurityTLS connects to the server over TLS, which is also known as
+	// SMTPS or implicit TLS.
+	smtpSecurityTLS smtpSecurity = "tls"
+
+	// smtpSecurityNone doesn't secure the connection.  The authentication is
+	// only performed over it, if the server is on the localhost.
+	smtpSecurityNone smtpSecurity = "none"
+)
+
+// emailConfig is the configuration of the SMTP server.
+type emailConfig struct {
+	// SMTPServer is the address of the SMTP server, for example
+	// "smtp.example.com:587".  If it's empty, the notifications are disabled.
+	SMTPServer string `yaml:"smtp_server"`
+
+	// Security is the way the connection is secured.  If empty,
+	// [smtpSecuritySTARTTLS] is used.
+	Security smtpSecurity `yaml:"security"`
+
+	// Username is the username for the PLAIN authentication.  If it's empty,
+	// no authentication is performed.
+	Username string `yaml:"username"`
+
+	// Password is the password for the PLAIN authentication.
+	Password string `yaml:"password"`
+
+	// From is the sender address.
+	From string `yaml:"from"`
+
+	// To are the recipient addresses.
+	To []string `yaml:"to"`
+}
+
+// validate returns an error if c is invalid.
+func (c *emailConfig) validate() (err error) {
+	switch c.Security {
+	case "", smtpSecuritySTARTTLS, smtpSecurityTLS, smtpSecurityNone:
+		// Go on.
+	default:
+		return fmt.Errorf("security: bad value %q", c.Security)
+	}
+
+	if c.SMTPServer == "" {
+		return nil
+	}
+
+	_, _, err = net.SplitHostPort(c.SMTPServer)
+	if err != nil {
+		return fmt.Errorf("smtp_server: %w", err)
+	}
+
+	if c.From == "" {
+		return errors.Error("from: empty")
+	} else if err = validateHeaderValue(c.From); err != nil {
+		return fmt.Errorf("from: %w", err)
+	} else if len(c.To) == 0 {
+		return errors.Error("to: empty")
+	}
+
+	for i, to := range c.To {
+		err = validateHeaderValue(to)
+		if err != nil {
+			return fmt.Errorf("to: at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validateHeaderValue returns an error if v can't be written into an email
+// header as is, since it contains line breaks, which would start new headers.
+func validateHeaderValue(v string) (err error) {
+	if strings.ContainsAny(v, "\r\n") {
+		return errors.Error("contains line breaks")
+	}
+
+	return nil
+}
+
+// emailTimeout is the timeout for sending a single email, including the
+// connection to the SMTP server.
+const emailTimeout = 30 * time.Second
+
+// sendEmail sends the message with subj and body according to conf.  conf must
+// be valid and enabled.
+func sendEmail(conf *emailConfig, subj, body string, now time.Time) (err error) {
+	host, _, err := net.SplitHostPort(conf.SMTPServer)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+
+	tlsConf := &tls.Config{
+		ServerName: host,
+		RootCAs:    aghtls.SystemRootCAs(),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	dialer := &net.Dialer{Timeout: emailTimeout}
+
+	var conn net.Conn
+	if conf.Security == smtpSecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", conf.SMTPServer, tlsConf)
+	} else {
+		conn, err = dialer.Dial("tcp", conf.SMTPServer)
+	}
+	if err != nil {
+		return fmt.Errorf("connecting: %w", err)
+	}
+
+	err = conn.SetDeadline(now.Add(emailTimeout))
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("setting deadline: %w", err), conn.Close())
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("greeting: %w", err), conn.Close())
+	}
+
+	err = writeEmail(c, conf, tlsConf, emailMessage(conf, subj, body, now))
+	if err != nil {
+		return errors.WithDeferred(err, c.Close())
+	}
+
+	// Don't wrap the error, since it's informative enough as is.
+	return c.Quit()
+}
+
+// writeEmail secures the connection of c according to conf, authenticates,
+// and sends msg.
+func writeEmail(c *smtp.Client, conf *emailConfig, tlsConf *tls.Config, msg []byte) (err error) {
+	if conf.Security == "" || conf.Security == smtpSecuritySTARTTLS {
+		err = c.StartTLS(tlsConf)
+		if err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+
+	if conf.Username != "" {
+		err = c.Auth(smtp.PlainAuth("", conf.Username, conf.Password, tlsConf.ServerName))
+		if err != nil {
+			return fmt.Errorf("authenticating: %w", err)
+		}
+	}
+
+	err = c.Mail(conf.From)
+	if err != nil {
+		return fmt.Errorf("sender: %w", err)
+	}
+
+	for _, to := range conf.To {
+		err = c.Rcpt(to)
+		if err != nil {
+			return fmt.Errorf("recipient %q: %w", to, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+
+	_, err = w.Write(msg)
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("writing message: %w", err), w.Close())
+	}
+
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("writing message: %w", err)
+	}
+
+	return nil
+}
+
+// emailMessage returns the message with subj and body according to conf.  subj
+// is encoded as described in RFC 2047, if necessary, since it may contain the
+// values from the configuration, like the names of the alert rules.
+func emailMessage(conf *emailConfig, subj, body string, now time.Time) (msg []byte) {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "From: %s\r\n", conf.From)
+	fmt.Fprintf(b, "To: %s\r\n", strings.Join(conf.To, ", "))
+	fmt.Fprintf(b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subj))
+	fmt.Fprintf(b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+
+	return b.Bytes()
+}
+
+// notificationKind is the kind of an email notification.
+type notificationKind uint8
+
+// Notification kinds.
+const (
+	notifyUpdates notificationKind = iota
+	notifyCertExpiry
+	notifyAlerts
+)
+
+// notifier sends the email notifications.  A nil *notifier is valid and sends
+// nothing.
+type notifier struct {
+	// send sends a single email according to conf.
+	send func(conf *emailConfig, subj, body string, now time.Time) (err error)
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// conf is the current configuration.
+	conf notificationsConfig
+
+	// notifiedVersion is the latest new version of AdGuard Home the
+	// notification has been sent about.
+	notifiedVersion string
+}
+
+// newNotifier returns a new properly initialized *notifier.  conf must be
+// valid.
+func newNotifier(conf notificationsConfig) (n *notifier) {
+	return &notifier{
+		send: sendEmail,
+		mu:   &sync.Mutex{},
+		conf: conf,
+	}
+}
+
+// config returns the copy of the current configuration of n.
+func (n *notifier) config() (conf notificationsConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	conf = n.conf
+	conf.Email.To = stringutil.CloneSlice(n.conf.Email.To)
+
+	return conf
+}
+
+// setConfig replaces the configuration of n.  conf must be valid.
+func (n *notifier) setConfig(conf notificationsConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.conf = conf
+}
+
+// enabled returns the email configuration if the notifications of kind are
+// enabled.  ok is false if they aren't.
+func (n *notifier) enabled(kind notificationKind) (email *emailConfig, ok bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	conf := n.config()
+	if conf.Email.SMTPServer == "" {
+		return nil, false
+	}
+
+	switch kind {
+	case notifyUpdates:
+		ok = conf.Updates
+	case notifyCertExpiry:
+		ok = conf.CertExpiry
+	case notifyAlerts:
+		ok = conf.Alerts
+	default:
+		ok = false
+	}
+
+	return &conf.Email, ok
+}
+
+// notify sends the notification of kind with subj and body, if such
+// notifications are enabled.
+func (n *notifier) notify(kind notificationKind, subj, body string) (err error) {
+	email, ok := n.enabled(kind)
+	if !ok {
+		return nil
+	}
+
+	// Don't wrap the error, since it's informative enough as is.
+	return n.send(email, subj, body, time.Now())
+}
+
+// notifyUpdate sends the notification about the new version of AdGuard Home
+// in a separate goroutine, unless it has already been sent.
+func (n *notifier) notifyUpdate(newVersion, announcementURL string) {
+	if _, ok := n.enabled(notifyUpdates); !ok {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.notifiedVersion == newVersion {
+		return
+	}
+
+	n.notifiedVersion = newVersion
+
+	go func() {
+		defer log.OnPanic("notifications: update")
+
+		body := fmt.Sprintf("AdGuard Home %s is available.", newVersion)
+		if announcementURL != "" {
+			body += "\n\nSee " + announcementURL + " for the details."
+		}
+
+		err := n.notify(notifyUpdates, "AdGuard Home "+newVersion+" is available", body)
+		if err != nil {
+			log.Error("notifications: sending update notification: %s", err)
+		}
+	}()
+}
+
+// emailJSON is the JSON representation of [emailConfig].  The password is
+// never returned.
+type emailJSON struct {
+	SMTPServer string       `json:"smtp_server"`
+	Security   smtpSecurity `json:"security"`
+	Username   string       `json:"username"`
+	From       string       `json:"from"`
+	To         []string     `json:"to"`
+
+	// Password is the new password.  If it's empty and PasswordSaved is true,
+	// the current password is kept.
+	Password string `json:"password,omitempty"`
+
+	// PasswordSaved is true if the password is set.
+	PasswordSaved bool `json:"password_saved"`
+}
+
+// notificationsJSON is the request and the response for the GET and PUT
+// /control/notifications HTTP APIs.
+type notificationsJSON struct {
+	Email      *emailJSON `json:"email"`
+	Updates    bool       `json:"updates"`
+	CertExpiry bool       `json:"cert_expiry"`
+	Alerts     bool       `json:"alerts"`
+}
+
+// handleGetNotifications is the handler for the GET /control/notifications
+// HTTP API.
+func handleGetNotifications(w http.ResponseWriter, r *http.Request) {
+	conf := Context.notifier.config()
+	email := conf.Email
+	if email.Security == "" {
+		email.Security = smtpSecuritySTARTTLS
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, &notificationsJSON{
+		Email: &emailJSON{
+			SMTPServer:    email.SMTPServer,
+			Security:      email.Security,
+			Username:      email.Username,
+			From:          email.From,
+			To:            stringutil.CloneSliceOrEmpty(email.To),
+			PasswordSaved: email.Password != "",
+		},
+		Updates:    conf.Updates,
+		CertExpiry: conf.CertExpiry,
+		Alerts:     conf.Alerts,
+	})
+}
+
+// notificationsFromRequest decodes the notifications configuration from the
+// body of r.  The saved password is kept if requested, unless the SMTP server
+// or the username are changed.
+func notificationsFromRequest(r *http.Request) (conf notificationsConfig, err error) {
+	req := &notificationsJSON{}
+	err = json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return conf, fmt.Errorf("decoding request: %w", err)
+	} else if req.Email == nil {
+		return conf, errors.Error("email: no value")
+	}
+
+	j := req.Email
+	conf = notificationsConfig{
+		Email: emailConfig{
+			SMTPServer: j.SMTPServer,
+			Security:   j.Security,
+			Username:   j.Username,
+			Password:   j.Password,
+			From:       j.From,
+			To:         j.To,
+		},
+		Updates:    req.Updates,
+		CertExpiry: req.CertExpiry,
+		Alerts:     req.Alerts,
+	}
+
+	if j.Password == "" && j.PasswordSaved {
+		// Only reuse the saved password with the same server and username, so
+		// that it's never sent anywhere else.
+		saved := Context.notifier.config().Email
+		if saved.SMTPServer != j.SMTPServer || saved.Username != j.Username {
+			return conf, errors.Error("email: password_saved: smtp_server or username changed")
+		}
+
+		conf.Email.Password = saved.Password
+	}
+
+	err = conf.Email.validate()
+	if err != nil {
+		return conf, fmt.Errorf("email: %w", err)
+	}
+
+	return conf, nil
+}
+
+// handlePutNotifications is the handler for the PUT
+// /control/notifications/update HTTP API.
+func handlePutNotifications(w http.ResponseWriter, r *http.Request) {
+	conf, err := notificationsFromRequest(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	func() {
+		config.Lock()
+		defer config.Unlock()
+
+		config.Notifications = conf
+	}()
+
+	Context.notifier.setConfig(conf)
+	onConfigModified()
+}
+
+// handleTestNotification is the handler for the POST
+// /control/notifications/test HTTP API.  It sends a test email using the
+// configuration from the request body, which isn't saved.
+func handleTestNotification(w http.ResponseWriter, r *http.Request) {
+	conf, err := notificationsFromRequest(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	} else if conf.Email.SMTPServer == "" {
+		aghhttp.Error(r, w, http.StatusBadRequest, "email: smtp_server: empty")
+
+		return
+	}
+
+	err = Context.notifier.send(
+		&conf.Email,
+		"AdGuard Home test notification",
+		"This is a test notification from AdGuard Home.",
+		time.Now(),
+	)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadGateway, "sending test email: %s", err)
+
+		return
+	}
+}
+
+// registerNotificationsHandlers registers the HTTP APIs of the email
+// notifications.
+func registerNotificationsHandlers() {
+	httpRegister(http.MethodGet, "/control/notifications", handleGetNotifications)
+	httpRegister(http.MethodPut, "/control/notifications/update", handlePutNotifications)
+	httpRegister(http.MethodPost, "/control/notifications/test", handleTestNotification)
+}
+
+// initNotifier initializes [Context.notifier].
+func initNotifier() (err error) {
+	conf := config.Notifications
+
+	err = conf.Email.validate()
+	if err != nil {
+		return fmt.Errorf("notifications: email: %w", err)
+	}
+
+	Context.notifier = newNotifier(conf)
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sentEmail is an email sent by the notifier in tests.
+type sentEmail struct {
+	conf *emailConfig
+	subj string
+	body string
+}
+
+// newTestNotifier returns a *notifier with conf which sends the emails to the
+// returned channel.  It also sets it as [Context.notifier] for the duration of
+// the test.
+func newTestNotifier(
+	t *testing.T,
+	conf notificationsConfig,
+	sendErr error,
+) (n *notifier, sent chan *sentEmail) {
+	t.Helper()
+
+	sent = make(chan *sentEmail, 1)
+	n = newNotifier(conf)
+	n.send = func(c *emailConfig, subj, body string, _ time.Time) (err error) {
+		sent <- &sentEmail{conf: c, subj: subj, body: body}
+
+		return sendErr
+	}
+
+	prev := Context.notifier
+	t.Cleanup(func() { Context.notifier = prev })
+	Context.notifier = n
+
+	return n, sent
+}
+
+// testEmailConfig is the valid email configuration for tests.
+var testEmailConfig = emailConfig{
+	SMTPServer: "smtp.example:587",
+	Username:   "agh",
+	Password:   "secret",
+	From:       "agh@example.org",
+	To:         []string{"admin@example.org"},
+}
+
+func TestEmailConfig_validate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		conf       emailConfig
+		wantErrMsg string
+	}{{
+		name:       "empty",
+		conf:       emailConfig{},
+		wantErrMsg: "",
+	}, {
+		name:       "valid",
+		conf:       testEmailConfig,
+		wantErrMsg: "",
+	}, {
+		name: "bad_security",
+		conf: emailConfig{
+			Security: "ssl",
+		},
+		wantErrMsg: `security: bad value "ssl"`,
+	}, {
+		name: "no_port",
+		conf: emailConfig{
+			SMTPServer: "smtp.example",
+		},
+		wantErrMsg: "smtp_server: address smtp.example: missing port in address",
+	}, {
+		name: "no_sender",
+		conf: emailConfig{
+			SMTPServer: "smtp.example:465",
+			Security:   smtpSecurityTLS,
+		},
+		wantErrMsg: "from: empty",
+	}, {
+		name: "bad_sender",
+		conf: emailConfig{
+			SMTPServer: "smtp.example:25",
+			From:       "agh@example.org\r\nBcc: evil@example.org",
+		},
+		wantErrMsg: "from: contains line breaks",
+	}, {
+		name: "bad_recipient",
+		conf: emailConfig{
+			SMTPServer: "smtp.example:25",
+			From:       "agh@example.org",
+			To:         []string{"admin@example.org", "evil@example.org\nBcc: x"},
+		},
+		wantErrMsg: "to: at index 1: contains line breaks",
+	}, {
+		name: "no_recipients",
+		conf: emailConfig{
+			SMTPServer: "smtp.example:25",
+			Security:   smtpSecurityNone,
+			From:       "agh@example.org",
+		},
+		wantErrMsg: "to: empty",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
+
+func TestEmailMessage(t *testing.T) {
+	conf := &emailConfig{
+		From: "agh@example.org",
+		To:   []string{"admin@example.org", "ops@example.org"},
+	}
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg := emailMessage(conf, "Subject", "line 1\nline 2", now)
+
+	assert.Equal(t, "From: agh@example.org\r\n"+
+		"To: admin@example.org, ops@example.org\r\n"+
+		"Subject: Subject\r\n"+
+		"Date: Sun, 01 Jan 2023 00:00:00 +0000\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"line 1\r\nline 2\r\n", string(msg))
+
+	msg = emailMessage(conf, "Rule\r\nBcc: evil@example.org", "body", now)
+
+	assert.Contains(t, string(msg), "Subject: =?utf-8?q?Rule=0D=0ABcc:_evil@example.org?=\r\n")
+}
+
+func TestNotifier_notify(t *testing.T) {
+	n, sent := newTestNotifier(t, notificationsConfig{
+		Email:  testEmailConfig,
+		Alerts: true,
+	}, nil)
+
+	t.Run("enabled", func(t *testing.T) {
+		err := n.notify(notifyAlerts, "subj", "body")
+		require.NoError(t, err)
+
+		e := <-sent
+		assert.Equal(t, "subj", e.subj)
+		assert.Equal(t, "body", e.body)
+		assert.Equal(t, testEmailConfig.SMTPServer, e.conf.SMTPServer)
+	})
+
+	t.Run("disabled_kind", func(t *testing.T) {
+		err := n.notify(notifyCertExpiry, "subj", "body")
+		require.NoError(t, err)
+
+		assert.Empty(t, sent)
+	})
+
+	t.Run("no_server", func(t *testing.T) {
+		n.setConfig(notificationsConfig{Alerts: true})
+
+		err := n.notify(notifyAlerts, "subj", "body")
+		require.NoError(t, err)
+
+		assert.Empty(t, sent)
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var nilNotifier *notifier
+		err := nilNotifier.notify(notifyAlerts, "subj", "body")
+		require.NoError(t, err)
+	})
+}
+
+func TestNotifier_notifyUpdate(t *testing.T) {
+	n, sent := newTestNotifier(t, notificationsConfig{
+		Email:   testEmailConfig,
+		Updates: true,
+	}, nil)
+
+	n.notifyUpdate("v0.107.99", "https://example.org/release")
+
+	e := <-sent
+	assert.Equal(t, "AdGuard Home v0.107.99 is available", e.subj)
+	assert.Equal(t, "AdGuard Home v0.107.99 is available.\n\n"+
+		"See https://example.org/release for the details.", e.body)
+
+	// Only notify once per version.
+	n.notifyUpdate("v0.107.99", "https://example.org/release")
+	assert.Empty(t, sent)
+}
+
+func TestHandleGetNotifications(t *testing.T) {
+	newTestNotifier(t, notificationsConfig{
+		Email:      testEmailConfig,
+		CertExpiry: true,
+	}, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/control/notifications", nil)
+	w := httptest.NewRecorder()
+
+	handleGetNotifications(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.JSONEq(t, `{
+		"email": {
+			"smtp_server": "smtp.example:587",
+			"security": "starttls",
+			"username": "agh",
+			"from": "agh@example.org",
+			"to": ["admin@example.org"],
+			"password_saved": true
+		},
+		"updates": false,
+		"cert_expiry": true,
+		"alerts": false
+	}`, w.Body.String())
+}
+
+func TestHandleTestNotification(t *testing.T) {
+	_, sent := newTestNotifier(t, notificationsConfig{
+		Email: testEmailConfig,
+	}, nil)
+
+	const validBody = `{"email":{"smtp_server":"smtp.example:587","username":"agh",` +
+		`"security":"tls","from":"agh@example.org","to":["test@example.org"],` +
+		`"password_saved":true}}`
+
+	testCases := []struct {
+		name     string
+		body     string
+		wantBody string
+		wantCode int
+	}{{
+		name:     "no_email",
+		body:     `{}`,
+		wantBody: "email: no value\n",
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "no_server",
+		body:     `{"email":{}}`,
+		wantBody: "email: smtp_server: empty\n",
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "bad_security",
+		body:     `{"email":{"security":"ssl"}}`,
+		wantBody: "email: security: bad value \"ssl\"\n",
+		wantCode: http.StatusBadRequest,
+	}, {
+		name: "other_server",
+		body: `{"email":{"smtp_server":"evil.example:587","username":"agh",` +
+			`"from":"agh@example.org","to":["test@example.org"],"password_saved":true}}`,
+		wantBody: "email: password_saved: smtp_server or username changed\n",
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "success",
+		body:     validBody,
+		wantBody: "",
+		wantCode: http.StatusOK,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(
+				http.MethodPost,
+				"/control/notifications/test",
+				strings.NewReader(tc.body),
+			)
+			w := httptest.NewRecorder()
+
+			handleTestNotification(w, r)
+			assert.Equal(t, tc.wantCode, w.Code)
+			assert.Equal(t, tc.wantBody, w.Body.String())
+		})
+	}
+
+	e := <-sent
+	assert.Equal(t, smtpSecurityTLS, e.conf.Security)
+	assert.Equal(t, []string{"test@example.org"}, e.conf.To)
+
+	// The saved password is used for the test.
+	assert.Equal(t, testEmailConfig.Password, e.conf.Password)
+
+	t.Run("send_error", func(t *testing.T) {
+		newTestNotifier(t, notificationsConfig{}, errors.Error("test error"))
+
+		r := httptest.NewRequest(
+			http.MethodPost,
+			"/control/notifications/test",
+			strings.NewReader(`{"email":{"smtp_server":"smtp.example:465",`+
+				`"from":"agh@example.org","to":["test@example.org"]}}`),
+		)
+		w := httptest.NewRecorder()
+
+		handleTestNotification(w, r)
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+		assert.Equal(t, "sending test email: test error\n", w.Body.String())
+	})
+}
@@ -43,6 +43,14 @@ type profileJSON struct {
 	Name     string `json:"name"`
 	Language string `json:"language"`
 	Theme    Theme  `json:"theme"`
+
+	// Role is the role of the current user.  It's empty if the
+	// authentication is disabled.
+	Role userRole `json:"role,omitempty"`
+
+	// TOTPEnabled is true if the current user has the two-factor
+	// authentication enabled.  It's ignored in requests.
+	TOTPEnabled bool `json:"totp_enabled,omitempty"`
 }
 
 // handleGetProfile is the handler for GET /control/profile endpoint.
@@ -50,15 +58,18 @@ func handleGetProfile(w http.ResponseWriter, r *http.Request) {
 	u := Context.auth.getCurrentUser(r)
 
 	var resp profileJSON
+	if u.Name != "" {
+		resp.Role = u.role()
+		resp.TOTPEnabled = u.TOTPSecret != ""
+	}
+
 	func() {
 		config.RLock()
 		defer config.RUnlock()
 
-		resp = profileJSON{
-			Name:     u.Name,
-			Language: config.Language,
-			Theme:    config.Theme,
-		}
+		resp.Name = u.Name
+		resp.Language = config.Language
+		resp.Theme = config.Theme
 	}()
 
 	_ = aghhttp.WriteJSONResponse(w, r, resp)
@@ -0,0 +1,170 @@
+package home
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/net/proxy"
+)
+
+// dialContextFunc is the signature of the functions dialing the TCP
+// connections.
+type dialContextFunc func(ctx context.Context, network, addr string) (conn net.Conn, err error)
+
+// Dial implements the [proxy.Dialer] interface for dialContextFunc.
+func (f dialContextFunc) Dial(network, addr string) (conn net.Conn, err error) {
+	return f(context.Background(), network, addr)
+}
+
+// DialContext implements the [proxy.ContextDialer] interface for
+// dialContextFunc.
+func (f dialContextFunc) DialContext(
+	ctx context.Context,
+	network string,
+	addr string,
+) (conn net.Conn, err error) {
+	return f(ctx, network, addr)
+}
+
+// proxyDialContext connects to addr through the outbound proxy from the
+// configuration, if there is one, and using customDialContext otherwise.  It
+// is used for the raw TCP connections, such as the WHOIS ones, which can't rely
+// on the proxy support of the HTTP client.
+func proxyDialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	proxyURL, err := getHTTPProxy(nil)
+	if err != nil {
+		return nil, fmt.Errorf("parsing proxy url: %w", err)
+	} else if proxyURL == nil {
+		return customDialContext(ctx, network, addr)
+	}
+
+	return dialThroughProxy(ctx, proxyURL, customDialContext, network, addr)
+}
+
+// dialThroughProxy connects to addr through the proxy with the URL u, using
+// forward to connect to the proxy itself.  The SOCKS5 proxies and the HTTP and
+// HTTPS proxies supporting the CONNECT method are supported.
+func dialThroughProxy(
+	ctx context.Context,
+	u *url.URL,
+	forward dialContextFunc,
+	network string,
+	addr string,
+) (conn net.Conn, err error) {
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var d proxy.Dialer
+		d, err = proxy.FromURL(u, forward)
+		if err != nil {
+			return nil, fmt.Errorf("creating socks5 dialer: %w", err)
+		}
+
+		// The dialer returned by [proxy.FromURL] for SOCKS5 always implements
+		// [proxy.ContextDialer].
+		return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	case "http", "https":
+		return dialHTTPConnect(ctx, u, forward, addr)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+}
+
+// dialHTTPConnect establishes a tunnel to addr through the HTTP proxy with the
+// URL u using the CONNECT method.  See RFC 9110, section 9.3.6.
+func dialHTTPConnect(
+	ctx context.Context,
+	u *url.URL,
+	forward dialContextFunc,
+	addr string,
+) (conn net.Conn, err error) {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+
+		proxyAddr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	c, err := forward(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to proxy: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, c.Close())
+		}
+	}()
+
+	if u.Scheme == "https" {
+		c = tls.Client(c, &tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		})
+	}
+
+	// Don't let a stuck proxy block the tunnel establishment forever.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(deadline)
+		defer func() { _ = c.SetDeadline(time.Time{}) }()
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+		req.Header.Set(aghhttp.HdrNameProxyAuthorization, "Basic "+creds)
+	}
+
+	err = req.Write(c)
+	if err != nil {
+		return nil, fmt.Errorf("writing connect request: %w", err)
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("reading connect response: %w", err)
+	}
+
+	// Don't close the body, since the response to a successful CONNECT request
+	// has none and the rest of the stream belongs to the tunnel.
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy responded with status %q", resp.Status)
+	}
+
+	return &bufferedConn{Conn: c, r: br}, nil
+}
+
+// bufferedConn is a connection the beginning of which may have already been
+// read into r.
+type bufferedConn struct {
+	net.Conn
+
+	// r is the reader the data from net.Conn must be read through.
+	r *bufio.Reader
+}
+
+// type check
+var _ net.Conn = (*bufferedConn)(nil)
+
+// Read implements the [net.Conn] interface for *bufferedConn.
+func (c *bufferedConn) Read(b []byte) (n int, err error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,196 @@
+package home
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDial is the dial function used to connect to the test proxies.
+func testDial(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+// startTestListener starts serving the connections accepted from a new local
+// listener with handle and returns the address of the listener.
+func startTestListener(t *testing.T, handle func(c net.Conn)) (addr string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	go func() {
+		for {
+			c, aErr := l.Accept()
+			if aErr != nil {
+				return
+			}
+
+			go func() {
+				defer func() { _ = c.Close() }()
+
+				handle(c)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// newTestWHOISServer returns the address of a server which responds to every
+// line with the line itself prefixed with "whois: ".
+func newTestWHOISServer(t *testing.T) (addr string) {
+	t.Helper()
+
+	return startTestListener(t, func(c net.Conn) {
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		_, _ = io.WriteString(c, "whois: "+line)
+	})
+}
+
+// pipeConns copies the data between a and b until either of them is closed.
+func pipeConns(a, b net.Conn) {
+	go func() { _, _ = io.Copy(a, b) }()
+	_, _ = io.Copy(b, a)
+}
+
+// newTestHTTPProxy returns the address of an HTTP proxy supporting only the
+// CONNECT method and requiring the authorization with wantAuth, if it isn't
+// empty.
+func newTestHTTPProxy(t *testing.T, wantAuth string) (addr string) {
+	t.Helper()
+
+	return startTestListener(t, func(c net.Conn) {
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+
+		if req.Method != http.MethodConnect {
+			_, _ = io.WriteString(c, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+
+			return
+		} else if req.Header.Get("Proxy-Authorization") != wantAuth {
+			_, _ = io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+
+			return
+		}
+
+		dst, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			_, _ = io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+
+			return
+		}
+		defer func() { _ = dst.Close() }()
+
+		_, _ = io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+		pipeConns(c, dst)
+	})
+}
+
+// newTestSOCKS5Proxy returns the address of a SOCKS5 proxy supporting only the
+// CONNECT command to the IPv4 addresses without authentication.  See RFC 1928.
+func newTestSOCKS5Proxy(t *testing.T) (addr string) {
+	t.Helper()
+
+	return startTestListener(t, func(c net.Conn) {
+		// Version and the number of the authentication methods.
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			return
+		} else if _, err = io.ReadFull(c, make([]byte, hdr[1])); err != nil {
+			return
+		}
+
+		_, _ = c.Write([]byte{5, 0})
+
+		// Version, command, reserved, address type, IPv4 address, and port.
+		req := make([]byte, 10)
+		if _, err := io.ReadFull(c, req); err != nil || req[1] != 1 || req[3] != 1 {
+			return
+		}
+
+		dstAddr := &net.TCPAddr{
+			IP:   net.IP(req[4:8]),
+			Port: int(binary.BigEndian.Uint16(req[8:])),
+		}
+
+		dst, err := net.DialTCP("tcp", nil, dstAddr)
+		if err != nil {
+			return
+		}
+		defer func() { _ = dst.Close() }()
+
+		_, _ = c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		pipeConns(c, dst)
+	})
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	whoisAddr := newTestWHOISServer(t)
+
+	const authHdr = "Basic dXNlcjpwYXNz"
+	httpAddr := newTestHTTPProxy(t, authHdr)
+	socksAddr := newTestSOCKS5Proxy(t)
+
+	testCases := []struct {
+		name       string
+		proxyURL   string
+		wantErrMsg string
+	}{{
+		name:       "http",
+		proxyURL:   "http://user:pass@" + httpAddr,
+		wantErrMsg: "",
+	}, {
+		name:       "http_unauthorized",
+		proxyURL:   "http://" + httpAddr,
+		wantErrMsg: `proxy responded with status "407 Proxy Authentication Required"`,
+	}, {
+		name:       "socks5",
+		proxyURL:   "socks5://" + socksAddr,
+		wantErrMsg: "",
+	}, {
+		name:       "unsupported",
+		proxyURL:   "ftp://" + httpAddr,
+		wantErrMsg: `unsupported proxy scheme "ftp"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.proxyURL)
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			t.Cleanup(cancel)
+
+			conn, err := dialThroughProxy(ctx, u, testDial, "tcp", whoisAddr)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if tc.wantErrMsg != "" {
+				return
+			}
+
+			testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+			_, err = io.WriteString(conn, "1.2.3.4\r\n")
+			require.NoError(t, err)
+
+			resp, err := bufio.NewReader(conn).ReadString('\n')
+			require.NoError(t, err)
+
+			assert.Equal(t, "whois: 1.2.3.4\r\n", resp)
+		})
+	}
+}
@@ -0,0 +1,584 @@
+package home
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// qrVersion is the parameters of a QR code version with the error correction
+// level M, see ISO/IEC 18004.
+type qrVersion struct {
+	// align are the coordinates of the centers of the alignment patterns.
+	align []int
+
+	// blocks are the numbers of data codewords in each block.
+	blocks []int
+
+	// ecLen is the number of error correction codewords in each block.
+	ecLen int
+}
+
+// qrVersions are the supported QR code versions, from 1 to 9.  The higher
+// versions require 16-bit character counts and aren't needed for the TOTP key
+// URIs.
+var qrVersions = []*qrVersion{{
+	align:  nil,
+	blocks: []int{16},
+	ecLen:  10,
+}, {
+	align:  []int{6, 18},
+	blocks: []int{28},
+	ecLen:  16,
+}, {
+	align:  []int{6, 22},
+	blocks: []int{44},
+	ecLen:  26,
+}, {
+	align:  []int{6, 26},
+	blocks: []int{32, 32},
+	ecLen:  18,
+}, {
+	align:  []int{6, 30},
+	blocks: []int{43, 43},
+	ecLen:  24,
+}, {
+	align:  []int{6, 34},
+	blocks: []int{27, 27, 27, 27},
+	ecLen:  16,
+}, {
+	align:  []int{6, 22, 38},
+	blocks: []int{31, 31, 31, 31},
+	ecLen:  18,
+}, {
+	align:  []int{6, 24, 42},
+	blocks: []int{38, 38, 39, 39},
+	ecLen:  22,
+}, {
+	align:  []int{6, 26, 46},
+	blocks: []int{36, 36, 36, 37, 37},
+	ecLen:  22,
+}}
+
+// dataLen returns the total number of data codewords of v.
+func (v *qrVersion) dataLen() (n int) {
+	for _, b := range v.blocks {
+		n += b
+	}
+
+	return n
+}
+
+// qrCode is a QR code matrix.
+type qrCode struct {
+	// modules are the dark modules, indexed by row and column.
+	modules [][]bool
+
+	// isFunc are the modules of the function patterns, which aren't masked.
+	isFunc [][]bool
+
+	size int
+}
+
+// newQRCode returns the QR code with the error correction level M encoding
+// data in the byte mode using the smallest suitable version.
+func newQRCode(data []byte) (qr *qrCode, err error) {
+	// The mode indicator takes 4 bits and the character count takes 8 bits.
+	ver := 0
+	for i, v := range qrVersions {
+		if 12+8*len(data) <= 8*v.dataLen() {
+			ver = i + 1
+
+			break
+		}
+	}
+
+	if ver == 0 {
+		return nil, fmt.Errorf("qr: data of %d bytes is too long", len(data))
+	}
+
+	v := qrVersions[ver-1]
+	size := 17 + 4*ver
+	qr = &qrCode{
+		modules: make([][]bool, size),
+		isFunc:  make([][]bool, size),
+		size:    size,
+	}
+
+	for i := range qr.modules {
+		qr.modules[i] = make([]bool, size)
+		qr.isFunc[i] = make([]bool, size)
+	}
+
+	qr.drawFunctionPatterns(ver, v)
+	qr.drawCodewords(qrCodewords(v, data))
+
+	mask, minPenalty := 0, -1
+	for m := 0; m < 8; m++ {
+		qr.applyMask(m)
+		qr.drawFormat(m)
+
+		if p := qr.penalty(); minPenalty < 0 || p < minPenalty {
+			mask, minPenalty = m, p
+		}
+
+		// Revert the mask, since it's an XOR.
+		qr.applyMask(m)
+	}
+
+	qr.applyMask(mask)
+	qr.drawFormat(mask)
+
+	return qr, nil
+}
+
+// set sets the function module at row y and column x.
+func (qr *qrCode) set(y, x int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.isFunc[y][x] = true
+}
+
+// drawFunctionPatterns draws the finder, timing, and alignment patterns,
+// reserves the format areas, and draws the version information of v.
+func (qr *qrCode) drawFunctionPatterns(ver int, v *qrVersion) {
+	size := qr.size
+	for i := 0; i < size; i++ {
+		qr.set(6, i, i%2 == 0)
+		qr.set(i, 6, i%2 == 0)
+	}
+
+	qr.drawFinder(3, 3)
+	qr.drawFinder(3, size-4)
+	qr.drawFinder(size-4, 3)
+
+	n := len(v.align)
+	for i, y := range v.align {
+		for j, x := range v.align {
+			// Skip the corners occupied by the finder patterns.
+			if (i == 0 && j == 0) || (i == 0 && j == n-1) || (i == n-1 && j == 0) {
+				continue
+			}
+
+			qr.drawAlignment(y, x)
+		}
+	}
+
+	// Reserve the format areas, the actual bits are drawn later.
+	qr.drawFormat(0)
+
+	if ver >= 7 {
+		qr.drawVersion(ver)
+	}
+}
+
+// drawFinder draws the finder pattern with its separator centered at row y and
+// column x.
+func (qr *qrCode) drawFinder(y, x int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			yy, xx := y+dy, x+dx
+			if yy < 0 || yy >= qr.size || xx < 0 || xx >= qr.size {
+				continue
+			}
+
+			d := qrDist(dy, dx)
+			qr.set(yy, xx, d != 2 && d != 4)
+		}
+	}
+}
+
+// drawAlignment draws the alignment pattern centered at row y and column x.
+func (qr *qrCode) drawAlignment(y, x int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			qr.set(y+dy, x+dx, qrDist(dy, dx) != 1)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information for the error
+// correction level M and mask, as well as the dark module.
+func (qr *qrCode) drawFormat(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) (ok bool) { return bits>>i&1 != 0 }
+
+	size := qr.size
+	for i := 0; i <= 5; i++ {
+		qr.set(i, 8, bit(i))
+	}
+
+	qr.set(7, 8, bit(6))
+	qr.set(8, 8, bit(7))
+	qr.set(8, 7, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.set(8, 14-i, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		qr.set(8, size-1-i, bit(i))
+	}
+
+	for i := 8; i < 15; i++ {
+		qr.set(size-15+i, 8, bit(i))
+	}
+
+	qr.set(size-8, 8, true)
+}
+
+// qrFormatBits returns the 15-bit format information for the error correction
+// level M and mask with the BCH error correction bits.
+func qrFormatBits(mask int) (bits int) {
+	// The bits of the level M are zero.
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// qrVersionBits returns the 18-bit version information for ver with the BCH
+// error correction bits.
+func qrVersionBits(ver int) (bits int) {
+	rem := ver
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+	}
+
+	return ver<<12 | rem
+}
+
+// drawVersion draws both copies of the version information of ver.
+func (qr *qrCode) drawVersion(ver int) {
+	bits := qrVersionBits(ver)
+	for i := 0; i < 18; i++ {
+		dark := bits>>i&1 != 0
+		a, b := qr.size-11+i%3, i/3
+		qr.set(b, a, dark)
+		qr.set(a, b, dark)
+	}
+}
+
+// drawCodewords draws the data and error correction codewords in the zigzag
+// order.
+func (qr *qrCode) drawCodewords(cw []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		// Skip the vertical timing pattern.
+		if right == 6 {
+			right = 5
+		}
+
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < qr.size; vert++ {
+			y := vert
+			if upward {
+				y = qr.size - 1 - vert
+			}
+
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if qr.isFunc[y][x] || i >= len(cw)*8 {
+					continue
+				}
+
+				qr.modules[y][x] = cw[i/8]>>(7-i%8)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules according to the mask pattern.
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if !qr.isFunc[y][x] && qrMaskBit(mask, y, x) {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// qrMaskBit returns true if the module at row y and column x is inverted by
+// mask.
+func qrMaskBit(mask, y, x int) (ok bool) {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// penalty returns the penalty score of the current modules used to choose the
+// mask.
+func (qr *qrCode) penalty() (p int) {
+	size := qr.size
+	at := func(y, x int, transposed bool) (dark bool) {
+		if transposed {
+			return qr.modules[x][y]
+		}
+
+		return qr.modules[y][x]
+	}
+
+	// The runs of the same color and the finder-like patterns in rows and
+	// columns.
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for _, transposed := range []bool{false, true} {
+		for y := 0; y < size; y++ {
+			run := 1
+			for x := 1; x <= size; x++ {
+				if x < size && at(y, x, transposed) == at(y, x-1, transposed) {
+					run++
+
+					continue
+				}
+
+				if run >= 5 {
+					p += 3 + run - 5
+				}
+
+				run = 1
+			}
+
+			for x := 0; x+len(finderLike) <= size; x++ {
+				if qr.matches(y, x, finderLike, transposed, at) {
+					p += 40
+				}
+			}
+		}
+	}
+
+	// The 2×2 blocks of the same color.
+	dark := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := qr.modules[y][x]
+			if c {
+				dark++
+			}
+
+			if y+1 < size && x+1 < size &&
+				c == qr.modules[y][x+1] &&
+				c == qr.modules[y+1][x] &&
+				c == qr.modules[y+1][x+1] {
+				p += 3
+			}
+		}
+	}
+
+	// The deviation of the proportion of the dark modules from 50%.
+	total := size * size
+	k := dark*20 - total*10
+	if k < 0 {
+		k = -k
+	}
+
+	k /= total
+
+	return p + k*10
+}
+
+// matches returns true if pattern starts at row y and column x and is
+// surrounded by four light modules on at least one side.
+func (qr *qrCode) matches(
+	y int,
+	x int,
+	pattern []bool,
+	transposed bool,
+	at func(y, x int, transposed bool) (dark bool),
+) (ok bool) {
+	for i, c := range pattern {
+		if at(y, x+i, transposed) != c {
+			return false
+		}
+	}
+
+	// The modules outside the symbol are light.
+	isLight := func(from, to int) (light bool) {
+		for i := from; i < to; i++ {
+			if i >= 0 && i < qr.size && at(y, i, transposed) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return isLight(x-4, x) || isLight(x+len(pattern), x+len(pattern)+4)
+}
+
+// qrCodewords returns the interleaved data and error correction codewords of
+// data encoded in the byte mode for v.
+func qrCodewords(v *qrVersion, data []byte) (cw []byte) {
+	n := v.dataLen()
+	buf := make([]byte, 0, n)
+
+	// The byte mode indicator 0100 and the 8-bit character count, followed by
+	// the data shifted by four bits and the terminator.
+	buf = append(buf, 0x40|byte(len(data))>>4)
+	prev := byte(len(data)) << 4
+	for _, b := range data {
+		buf = append(buf, prev|b>>4)
+		prev = b << 4
+	}
+
+	buf = append(buf, prev)
+	for pad := byte(0xec); len(buf) < n; pad ^= 0xec ^ 0x11 {
+		buf = append(buf, pad)
+	}
+
+	blocks := make([][]byte, len(v.blocks))
+	ecs := make([][]byte, len(v.blocks))
+	off := 0
+	for i, l := range v.blocks {
+		blocks[i] = buf[off : off+l]
+		ecs[i] = rsRemainder(blocks[i], v.ecLen)
+		off += l
+	}
+
+	cw = make([]byte, 0, n+len(v.blocks)*v.ecLen)
+	for i := 0; i < v.blocks[len(v.blocks)-1]; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				cw = append(cw, b[i])
+			}
+		}
+	}
+
+	for i := 0; i < v.ecLen; i++ {
+		for _, ec := range ecs {
+			cw = append(cw, ec[i])
+		}
+	}
+
+	return cw
+}
+
+// rsRemainder returns the n Reed-Solomon error correction codewords of data
+// over GF(256) with the primitive polynomial 0x11d.
+func rsRemainder(data []byte, n int) (rem []byte) {
+	// Compute the generator polynomial, the product of (x - α^i) for i from
+	// zero to n - 1, without the leading coefficient.
+	gen := make([]byte, n)
+	gen[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			gen[j] = gfMul(gen[j], root)
+			if j+1 < n {
+				gen[j] ^= gen[j+1]
+			}
+		}
+
+		root = gfMul(root, 2)
+	}
+
+	rem = make([]byte, n)
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[n-1] = 0
+		for i := range rem {
+			rem[i] ^= gfMul(gen[i], factor)
+		}
+	}
+
+	return rem
+}
+
+// gfMul returns the product of x and y in GF(256) with the primitive
+// polynomial 0x11d.
+func gfMul(x, y byte) (z byte) {
+	for i := 7; i >= 0; i-- {
+		hi := z >> 7
+		z = z<<1 ^ hi*0x1d
+		z ^= (y >> i & 1) * x
+	}
+
+	return z
+}
+
+// qrScale is the size of a single module of the QR code images in pixels.
+const qrScale = 4
+
+// qrQuietZone is the width of the light border around the QR codes in modules.
+const qrQuietZone = 4
+
+// qrDataURL returns the PNG image of the QR code encoding data as a data URL,
+// which can be used as the source of an image in the Web UI.
+func qrDataURL(data string) (u string, err error) {
+	qr, err := newQRCode([]byte(data))
+	if err != nil {
+		return "", err
+	}
+
+	side := (qr.size + 2*qrQuietZone) * qrScale
+	img := image.NewPaletted(
+		image.Rect(0, 0, side, side),
+		color.Palette{color.White, color.Black},
+	)
+
+	for y, row := range qr.modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+
+			for dy := 0; dy < qrScale; dy++ {
+				for dx := 0; dx < qrScale; dx++ {
+					img.SetColorIndex(
+						(x+qrQuietZone)*qrScale+dx,
+						(y+qrQuietZone)*qrScale+dy,
+						1,
+					)
+				}
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	err = png.Encode(buf, img)
+	if err != nil {
+		return "", fmt.Errorf("qr: encoding png: %w", err)
+	}
+
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// qrDist returns the distance of the module at the offsets dy and dx from the
+// center of a pattern, so that the modules at the same distance form a square
+// ring.
+func qrDist(dy, dx int) (d int) {
+	if dy < 0 {
+		dy = -dy
+	}
+
+	if dx < 0 {
+		dx = -dx
+	}
+
+	if dy > dx {
+		return dy
+	}
+
+	return dx
+}
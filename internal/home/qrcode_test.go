@@ -0,0 +1,198 @@
+package home
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRSRemainder(t *testing.T) {
+	// The data and the error correction codewords of the "HELLO WORLD" symbol
+	// of version 1-M.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	assert.Equal(t, want, rsRemainder(data, len(want)))
+}
+
+func TestQRFormatBits(t *testing.T) {
+	// The format information for the level M from ISO/IEC 18004, Annex C.
+	want := []int{
+		0b101010000010010,
+		0b101000100100101,
+		0b101111001111100,
+		0b101101101001011,
+		0b100010111111001,
+		0b100000011001110,
+		0b100111110010111,
+		0b100101010100000,
+	}
+
+	for mask, w := range want {
+		assert.Equalf(t, w, qrFormatBits(mask), "mask %d", mask)
+	}
+
+	// The version information from ISO/IEC 18004, Annex D.
+	assert.Equal(t, 0x07c94, qrVersionBits(7))
+	assert.Equal(t, 0x085bc, qrVersionBits(8))
+	assert.Equal(t, 0x09a99, qrVersionBits(9))
+}
+
+func TestNewQRCode(t *testing.T) {
+	testCases := []struct {
+		name     string
+		data     string
+		wantSize int
+	}{{
+		name:     "short",
+		data:     "hello",
+		wantSize: 21,
+	}, {
+		name:     "totp",
+		data:     totpURL("admin", testTOTPSecret),
+		wantSize: 41,
+	}, {
+		name:     "version_information",
+		data:     strings.Repeat("a", 150),
+		wantSize: 49,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			qr, err := newQRCode([]byte(tc.data))
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantSize, qr.size)
+			assert.Equal(t, tc.data, string(qrTestDecode(t, qr)))
+		})
+	}
+
+	t.Run("too_long", func(t *testing.T) {
+		_, err := newQRCode(make([]byte, 181))
+		testutil.AssertErrorMsg(t, "qr: data of 181 bytes is too long", err)
+	})
+}
+
+// qrTestDecode returns the data read back from qr.
+func qrTestDecode(t *testing.T, qr *qrCode) (data []byte) {
+	t.Helper()
+
+	// Read the first copy of the format information.
+	bits := 0
+	for i := 0; i <= 5; i++ {
+		bits |= qrTestBit(qr, i, 8) << i
+	}
+
+	bits |= qrTestBit(qr, 7, 8)<<6 | qrTestBit(qr, 8, 8)<<7 | qrTestBit(qr, 8, 7)<<8
+	for i := 9; i < 15; i++ {
+		bits |= qrTestBit(qr, 8, 14-i) << i
+	}
+
+	mask := -1
+	for m := 0; m < 8; m++ {
+		if qrFormatBits(m) == bits {
+			mask = m
+		}
+	}
+
+	require.GreaterOrEqual(t, mask, 0)
+
+	v := qrVersions[(qr.size-17)/4-1]
+	total := v.dataLen() + len(v.blocks)*v.ecLen
+	cw := make([]byte, total)
+
+	// Read the codewords in the zigzag order, unmasking the modules.
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < qr.size; vert++ {
+			y := vert
+			if upward {
+				y = qr.size - 1 - vert
+			}
+
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if qr.isFunc[y][x] || i >= total*8 {
+					continue
+				}
+
+				if qr.modules[y][x] != qrMaskBit(mask, y, x) {
+					cw[i/8] |= 1 << (7 - i%8)
+				}
+
+				i++
+			}
+		}
+	}
+
+	// Deinterleave the blocks and check the error correction codewords.
+	blocks := make([][]byte, len(v.blocks))
+	k := 0
+	for n := 0; n < v.blocks[len(v.blocks)-1]; n++ {
+		for b, l := range v.blocks {
+			if n < l {
+				blocks[b] = append(blocks[b], cw[k])
+				k++
+			}
+		}
+	}
+
+	for b := range blocks {
+		ec := make([]byte, 0, v.ecLen)
+		for n := 0; n < v.ecLen; n++ {
+			ec = append(ec, cw[k+n*len(blocks)+b])
+		}
+
+		require.Equal(t, rsRemainder(blocks[b], v.ecLen), ec)
+
+		data = append(data, blocks[b]...)
+	}
+
+	require.Equal(t, byte(0x40), data[0]&0xf0)
+
+	n := int(data[0]<<4 | data[1]>>4)
+	res := make([]byte, n)
+	for j := range res {
+		res[j] = data[j+1]<<4 | data[j+2]>>4
+	}
+
+	return res
+}
+
+// qrTestBit returns 1 if the module at row y and column x of qr is dark.
+func qrTestBit(qr *qrCode, y, x int) (b int) {
+	if qr.modules[y][x] {
+		return 1
+	}
+
+	return 0
+}
+
+func TestQRDataURL(t *testing.T) {
+	const prefix = "data:image/png;base64,"
+
+	u, err := qrDataURL("hello")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(u, prefix))
+
+	b, err := base64.StdEncoding.DecodeString(u[len(prefix):])
+	require.NoError(t, err)
+
+	img, err := png.Decode(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	side := (21 + 2*qrQuietZone) * qrScale
+	assert.Equal(t, side, img.Bounds().Dx())
+	assert.Equal(t, side, img.Bounds().Dy())
+}
@@ -0,0 +1,413 @@
+package home
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// defaultRDAPBootstrapURL is the base URL of the IANA RDAP bootstrap
+	// registries of the IP addresses.  See RFC 7484.
+	defaultRDAPBootstrapURL = "https://data.iana.org/rdap/"
+
+	// rdapBootstrapTTL is the time after which the bootstrap registries are
+	// requested again.
+	rdapBootstrapTTL = 24 * time.Hour
+
+	// rdapDefaultRetryAfter is the time during which an RDAP server isn't
+	// queried after it has limited the rate of the requests without
+	// specifying the time.
+	rdapDefaultRetryAfter = 1 * time.Minute
+
+	// rdapMaxRespSize is the maximum size of the RDAP responses and the
+	// bootstrap registries in bytes.
+	rdapMaxRespSize = 512 * 1024
+
+	// rdapMediaType is the media type of RDAP responses.  See RFC 7480.
+	rdapMediaType = "application/rdap+json"
+)
+
+// errRDAPRateLimited is returned by [rdapClient.lookup] when the RDAP server
+// has limited the rate of the requests.
+const errRDAPRateLimited errors.Error = "rate limited"
+
+// rdapService is a service of the RDAP bootstrap registry.
+type rdapService struct {
+	// prefixes are the networks served by the service.
+	prefixes []netip.Prefix
+
+	// url is the base URL of the service with a trailing slash.
+	url string
+}
+
+// rdapRegistry is an RDAP bootstrap registry of the IPv4 or IPv6 addresses.
+type rdapRegistry struct {
+	// updated is the time of the last successful update.
+	updated time.Time
+
+	// services are the services of the registry.
+	services []*rdapService
+}
+
+// rdapClient looks up the information about IP addresses using the
+// Registration Data Access Protocol.  See RFC 7480, RFC 7482, and RFC 7483.
+type rdapClient struct {
+	// httpClient is used to make the requests.
+	httpClient *http.Client
+
+	// mu protects registries and retryAfter.
+	mu *sync.Mutex
+
+	// registries are the bootstrap registries by the file names, "ipv4.json"
+	// and "ipv6.json".
+	registries map[string]*rdapRegistry
+
+	// retryAfter are the times until which the RDAP servers with the base URLs
+	// aren't queried because of rate limiting.
+	retryAfter map[string]time.Time
+
+	// bootstrapURL is the base URL of the bootstrap registries with a
+	// trailing slash.
+	bootstrapURL string
+}
+
+// newRDAPClient returns a new properly initialized *rdapClient.  httpClient
+// must not be nil.
+func newRDAPClient(httpClient *http.Client, bootstrapURL string) (c *rdapClient) {
+	return &rdapClient{
+		httpClient:   httpClient,
+		mu:           &sync.Mutex{},
+		registries:   map[string]*rdapRegistry{},
+		retryAfter:   map[string]time.Time{},
+		bootstrapURL: bootstrapURL,
+	}
+}
+
+// getJSON requests the JSON document from u and decodes it into v.  If the
+// server limits the rate of the requests, retryAfter is the time after which
+// the requests may be repeated and err is errRDAPRateLimited.
+func (c *rdapClient) getJSON(
+	ctx context.Context,
+	u string,
+	v any,
+) (retryAfter time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set(aghhttp.HdrNameAccept, rdapMediaType+", application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("requesting: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Go on.
+	case http.StatusTooManyRequests:
+		return parseRetryAfter(resp.Header.Get(aghhttp.HdrNameRetryAfter)), errRDAPRateLimited
+	default:
+		return 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, rdapMaxRespSize)).Decode(v)
+	if err != nil {
+		return 0, fmt.Errorf("decoding: %w", err)
+	}
+
+	return 0, nil
+}
+
+// parseRetryAfter parses the value of the Retry-After header, which is either
+// a number of seconds or an HTTP date.  d is rdapDefaultRetryAfter if the value
+// is missing or invalid.
+func parseRetryAfter(v string) (d time.Duration) {
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d = time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return rdapDefaultRetryAfter
+}
+
+// rdapBootstrapJSON is the bootstrap registry in the format of RFC 7484.
+type rdapBootstrapJSON struct {
+	// Services are the services, each being a pair of the arrays of the
+	// prefixes and of the base URLs.
+	Services [][][]string `json:"services"`
+}
+
+// toRegistry converts the registry into its internal form.  The invalid
+// prefixes and the services without the URLs are skipped.  The HTTPS URLs are
+// preferred.
+func (b *rdapBootstrapJSON) toRegistry(now time.Time) (reg *rdapRegistry) {
+	reg = &rdapRegistry{
+		updated: now,
+	}
+
+	for _, svc := range b.Services {
+		if len(svc) != 2 || len(svc[1]) == 0 {
+			continue
+		}
+
+		urls := svc[1]
+		u := urls[0]
+		if i := slices.IndexFunc(urls, func(u string) (ok bool) {
+			return strings.HasPrefix(u, "https://")
+		}); i >= 0 {
+			u = urls[i]
+		}
+
+		s := &rdapService{
+			url: strings.TrimSuffix(u, "/") + "/",
+		}
+
+		for _, p := range svc[0] {
+			pref, err := netip.ParsePrefix(p)
+			if err != nil {
+				log.Debug("whois: rdap: bootstrap: bad prefix %q: %s", p, err)
+
+				continue
+			}
+
+			s.prefixes = append(s.prefixes, pref.Masked())
+		}
+
+		reg.services = append(reg.services, s)
+	}
+
+	return reg
+}
+
+// serviceURL returns the base URL of the service with the most specific
+// network containing ip.  u is empty if there is none.
+func (reg *rdapRegistry) serviceURL(ip netip.Addr) (u string) {
+	bits := -1
+	for _, s := range reg.services {
+		for _, p := range s.prefixes {
+			if p.Bits() > bits && p.Contains(ip) {
+				u, bits = s.url, p.Bits()
+			}
+		}
+	}
+
+	return u
+}
+
+// registry returns the bootstrap registry with the name, requesting it if it's
+// missing or outdated.  The outdated registry is returned if the request fails.
+func (c *rdapClient) registry(ctx context.Context, name string) (reg *rdapRegistry, err error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	reg = c.registries[name]
+	c.mu.Unlock()
+
+	if reg != nil && now.Sub(reg.updated) < rdapBootstrapTTL {
+		return reg, nil
+	}
+
+	b := &rdapBootstrapJSON{}
+	_, err = c.getJSON(ctx, c.bootstrapURL+name, b)
+	if err != nil {
+		if reg != nil {
+			log.Debug("whois: rdap: updating bootstrap %s: %s; using outdated", name, err)
+
+			return reg, nil
+		}
+
+		return nil, fmt.Errorf("getting bootstrap %s: %w", name, err)
+	}
+
+	reg = b.toRegistry(now)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.registries[name] = reg
+
+	return reg, nil
+}
+
+// serverFor returns the base URL of the RDAP server for ip.
+func (c *rdapClient) serverFor(ctx context.Context, ip netip.Addr) (u string, err error) {
+	name := "ipv4.json"
+	if ip.Is6() {
+		name = "ipv6.json"
+	}
+
+	reg, err := c.registry(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	u = reg.serviceURL(ip)
+	if u == "" {
+		return "", fmt.Errorf("no rdap server for %s", ip)
+	}
+
+	return u, nil
+}
+
+// lookup returns the information about ip from its RDAP server.  wi is nil if
+// the server has no information.
+func (c *rdapClient) lookup(ctx context.Context, ip netip.Addr) (wi *RuntimeClientWHOISInfo, err error) {
+	ip = ip.Unmap()
+	srv, err := c.serverFor(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	until := c.retryAfter[srv]
+	c.mu.Unlock()
+
+	if now.Before(until) {
+		return nil, fmt.Errorf("%s: %w until %s", srv, errRDAPRateLimited, until.Format(time.RFC3339))
+	}
+
+	ipNet := &rdapIPNetworkJSON{}
+	retryAfter, err := c.getJSON(ctx, srv+"ip/"+ip.String(), ipNet)
+	if errors.Is(err, errRDAPRateLimited) {
+		c.mu.Lock()
+		c.retryAfter[srv] = now.Add(retryAfter)
+		c.mu.Unlock()
+
+		return nil, fmt.Errorf("%s: %w for %s", srv, err, retryAfter)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", srv, err)
+	}
+
+	return ipNet.toInfo(), nil
+}
+
+// rdapIPNetworkJSON is the subset of the IP network object of RDAP.  See RFC
+// 7483, section 5.4.
+type rdapIPNetworkJSON struct {
+	// Name is the name of the network.
+	Name string `json:"name"`
+
+	// Country is the two-letter country code of the network.
+	Country string `json:"country"`
+
+	// Entities are the entities related to the network.
+	Entities []*rdapEntityJSON `json:"entities"`
+}
+
+// rdapEntityJSON is the subset of the entity object of RDAP.  See RFC 7483,
+// section 5.1.
+type rdapEntityJSON struct {
+	// Roles are the roles of the entity, such as "registrant".
+	Roles []string `json:"roles"`
+
+	// VCardArray is the jCard of the entity.  See RFC 7095.
+	VCardArray []json.RawMessage `json:"vcardArray"`
+
+	// Entities are the entities related to this one.
+	Entities []*rdapEntityJSON `json:"entities"`
+}
+
+// registrant returns the first entity with the registrant role among ents and
+// their related entities.
+func registrant(ents []*rdapEntityJSON) (ent *rdapEntityJSON) {
+	for _, e := range ents {
+		if e == nil {
+			continue
+		} else if slices.Contains(e.Roles, "registrant") {
+			return e
+		} else if ent = registrant(e.Entities); ent != nil {
+			return ent
+		}
+	}
+
+	return nil
+}
+
+// vcard returns the name of the entity and the city of its address from its
+// jCard, if any.
+func (e *rdapEntityJSON) vcard() (name, city string) {
+	if len(e.VCardArray) != 2 {
+		return "", ""
+	}
+
+	var props [][]json.RawMessage
+	err := json.Unmarshal(e.VCardArray[1], &props)
+	if err != nil {
+		log.Debug("whois: rdap: bad vcard: %s", err)
+
+		return "", ""
+	}
+
+	for _, p := range props {
+		// Each property is an array of the name, the parameters, the value
+		// type, and the value.
+		if len(p) < 4 {
+			continue
+		}
+
+		var propName string
+		_ = json.Unmarshal(p[0], &propName)
+
+		switch propName {
+		case "fn":
+			_ = json.Unmarshal(p[3], &name)
+		case "adr":
+			// The structured address has the locality as the fourth
+			// component.  See RFC 6350, section 6.3.1.
+			var adr []json.RawMessage
+			if json.Unmarshal(p[3], &adr) == nil && len(adr) > 3 {
+				_ = json.Unmarshal(adr[3], &city)
+			}
+		}
+	}
+
+	return name, city
+}
+
+// toInfo converts the network into the WHOIS information of a runtime client.
+// wi is nil if there is no information.
+func (n *rdapIPNetworkJSON) toInfo() (wi *RuntimeClientWHOISInfo) {
+	wi = &RuntimeClientWHOISInfo{
+		Country: trimValue(n.Country),
+		Orgname: trimValue(n.Name),
+	}
+
+	if ent := registrant(n.Entities); ent != nil {
+		name, city := ent.vcard()
+		if name != "" {
+			wi.Orgname = trimValue(name)
+		}
+
+		wi.City = trimValue(city)
+	}
+
+	// Don't return an empty struct so that the frontend doesn't get
+	// confused.
+	if *wi == (RuntimeClientWHOISInfo{}) {
+		return nil
+	}
+
+	return wi
+}
@@ -0,0 +1,148 @@
+package home
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRDAPNetwork is the RDAP response of the test server.
+const testRDAPNetwork = `{
+  "objectClassName": "ip network",
+  "name": "FAKENET",
+  "country": "IM",
+  "entities": [{
+    "roles": ["abuse"],
+    "vcardArray": ["vcard", [["fn", {}, "text", "Abuse Desk"]]]
+  }, {
+    "roles": ["administrative"],
+    "entities": [{
+      "roles": ["registrant"],
+      "vcardArray": ["vcard", [
+        ["version", {}, "text", "4.0"],
+        ["fn", {}, "text", "FakeOrg LLC"],
+        ["adr", {}, "text", ["", "", "1 Fake St", "Nonreal", "", "12345", "Imagiland"]]
+      ]]
+    }]
+  }]
+}`
+
+// newTestRDAPServer returns a test server serving the bootstrap registries
+// and the RDAP responses.  limited, if positive, is the number of the first
+// RDAP requests answered with 429 Too Many Requests.
+func newTestRDAPServer(t *testing.T, limited int64) (srv *httptest.Server, reqs *int64) {
+	t.Helper()
+
+	reqs = new(int64)
+	mux := http.NewServeMux()
+	srv = httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	bootstrap := `{"services": [
+	  [["1.0.0.0/8"], ["http://other.example/rdap/"]],
+	  [["1.2.0.0/16"], ["http://rdap.example/", "` + srv.URL + `/rdap"]]
+	]}`
+
+	mux.HandleFunc("/bootstrap/ipv4.json", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(bootstrap))
+	})
+	mux.HandleFunc("/rdap/ip/1.2.3.4", func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("Accept"), rdapMediaType)
+
+		if atomic.AddInt64(reqs, 1) <= limited {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", rdapMediaType)
+		_, _ = w.Write([]byte(testRDAPNetwork))
+	})
+
+	return srv, reqs
+}
+
+func TestRDAPClient_lookup(t *testing.T) {
+	ip := netip.MustParseAddr("1.2.3.4")
+
+	t.Run("success", func(t *testing.T) {
+		srv, _ := newTestRDAPServer(t, 0)
+		c := newRDAPClient(srv.Client(), srv.URL+"/bootstrap/")
+
+		wi, err := c.lookup(context.Background(), ip)
+		require.NoError(t, err)
+
+		assert.Equal(t, &RuntimeClientWHOISInfo{
+			City:    "Nonreal",
+			Country: "IM",
+			Orgname: "FakeOrg LLC",
+		}, wi)
+	})
+
+	t.Run("rate_limited", func(t *testing.T) {
+		srv, reqs := newTestRDAPServer(t, 1)
+		c := newRDAPClient(srv.Client(), srv.URL+"/bootstrap/")
+
+		_, err := c.lookup(context.Background(), ip)
+		assert.True(t, errors.Is(err, errRDAPRateLimited))
+
+		// The server mustn't be queried again until the retry time.
+		_, err = c.lookup(context.Background(), ip)
+		assert.True(t, errors.Is(err, errRDAPRateLimited))
+		assert.Equal(t, int64(1), atomic.LoadInt64(reqs))
+	})
+
+	t.Run("no_server", func(t *testing.T) {
+		srv, _ := newTestRDAPServer(t, 0)
+		c := newRDAPClient(srv.Client(), srv.URL+"/bootstrap/")
+
+		_, err := c.lookup(context.Background(), netip.MustParseAddr("8.8.8.8"))
+		assert.Error(t, err)
+	})
+}
+
+func TestRDAPIPNetworkJSON_toInfo(t *testing.T) {
+	testCases := []struct {
+		in   *rdapIPNetworkJSON
+		want *RuntimeClientWHOISInfo
+		name string
+	}{{
+		in:   &rdapIPNetworkJSON{},
+		want: nil,
+		name: "empty",
+	}, {
+		in: &rdapIPNetworkJSON{
+			Name:    "FAKENET",
+			Country: "IM",
+		},
+		want: &RuntimeClientWHOISInfo{
+			Country: "IM",
+			Orgname: "FAKENET",
+		},
+		name: "no_registrant",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.in.toInfo())
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120"))
+	assert.Equal(t, rdapDefaultRetryAfter, parseRetryAfter(""))
+	assert.Equal(t, rdapDefaultRetryAfter, parseRetryAfter("soon"))
+
+	d := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, d > 59*time.Minute && d <= time.Hour, "got %s", d)
+}
@@ -0,0 +1,188 @@
+package home
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// errDNSNotRunning is returned by [reloadConfig] when the DNS server isn't
+// running, for example before the initial setup is completed.
+const errDNSNotRunning errors.Error = "dns server is not running"
+
+// reloadedConfig is the part of the configuration file applied by
+// [reloadConfig].
+type reloadedConfig struct {
+	// Clients contains the persistent clients.  Other client settings require
+	// a restart.
+	Clients *reloadedClientsConfig `yaml:"clients"`
+
+	DNS dnsConfig `yaml:"dns"`
+
+	Filters          []filtering.FilterYAML `yaml:"filters"`
+	WhitelistFilters []filtering.FilterYAML `yaml:"whitelist_filters"`
+	UserRules        []string               `yaml:"user_rules"`
+
+	UserRuleGroups []*filtering.UserRuleGroup `yaml:"user_rule_groups"`
+
+	SchemaVersion int `yaml:"schema_version"`
+}
+
+// reloadedClientsConfig is the part of the clients configuration applied by
+// [reloadConfig].
+type reloadedClientsConfig struct {
+	Persistent []*clientObject `yaml:"persistent"`
+}
+
+// newReloadedConfig returns the reloadable part of the current configuration,
+// so that the values missing from the configuration file are kept.
+func newReloadedConfig() (c *reloadedConfig) {
+	config.RLock()
+	defer config.RUnlock()
+
+	c = &reloadedConfig{
+		Clients: &reloadedClientsConfig{
+			Persistent: config.Clients.Persistent,
+		},
+		DNS:              config.DNS,
+		Filters:          config.Filters,
+		WhitelistFilters: config.WhitelistFilters,
+		UserRules:        config.UserRules,
+		UserRuleGroups:   config.UserRuleGroups,
+		SchemaVersion:    config.SchemaVersion,
+	}
+
+	// Copy the values under the pointers, since they're decoded in place.
+	filterConf := *config.DNS.DnsfilterConf
+	c.DNS.DnsfilterConf = &filterConf
+
+	if ecs := config.DNS.EDNSClientSubnet; ecs != nil {
+		ecsConf := *ecs
+		c.DNS.EDNSClientSubnet = &ecsConf
+	}
+
+	return c
+}
+
+// reloadConfig re-reads the configuration file and applies the filtering, the
+// persistent clients, and the DNS server settings from it without restarting
+// AdGuard Home.  The DNS listeners are only restarted if their addresses have
+// changed.
+func reloadConfig() (err error) {
+	defer func() { err = errors.Annotate(err, "reloading config: %w") }()
+
+	if !isRunning() {
+		return errDNSNotRunning
+	}
+
+	fileData, err := readConfigFile()
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+
+	c := newReloadedConfig()
+	tmpls, err := unmarshalConfig(fileData, c)
+	if err != nil {
+		return fmt.Errorf("parsing: %w", err)
+	}
+
+	if c.SchemaVersion != currentSchemaVersion {
+		return fmt.Errorf(
+			"schema version is %d, want %d; restart to upgrade",
+			c.SchemaVersion,
+			currentSchemaVersion,
+		)
+	}
+
+	err = applyReloadedConfig(c, tmpls)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+
+	log.Info("reloaded configuration from %s", config.getConfigFilename())
+
+	return nil
+}
+
+// applyReloadedConfig applies the filtering, the persistent clients, and the
+// DNS server settings from c.  tmpls are the values of c which had references,
+// see [unmarshalConfig].
+func applyReloadedConfig(c *reloadedConfig, tmpls configTemplates) (err error) {
+	if !isRunning() {
+		return errDNSNotRunning
+	}
+
+	if c.Clients == nil {
+		c.Clients = &reloadedClientsConfig{}
+	}
+
+	tlsConf := &tlsConfigSettings{}
+	Context.tls.WriteDiskConfig(tlsConf)
+
+	if tlsConf.Enabled {
+		err = validatePorts(
+			tcpPort(config.BindPort),
+			tcpPort(tlsConf.PortHTTPS),
+			tcpPort(tlsConf.PortDNSOverTLS),
+			tcpPort(tlsConf.PortDNSCrypt),
+			udpPort(c.DNS.Port),
+			udpPort(tlsConf.PortDNSOverQUIC),
+		)
+		if err != nil {
+			// Don't wrap the error, since it's informative enough as is.
+			return err
+		}
+	}
+
+	setDNSDefaults(&c.DNS)
+
+	filterConf := c.DNS.DnsfilterConf
+	filterConf.Filters = slices.Clone(c.Filters)
+	filterConf.WhitelistFilters = slices.Clone(c.WhitelistFilters)
+	filterConf.UserRules = slices.Clone(c.UserRules)
+	filterConf.UserRuleGroups = slices.Clone(c.UserRuleGroups)
+
+	err = Context.filters.Reload(filterConf)
+	if err != nil {
+		return fmt.Errorf("filtering: %w", err)
+	}
+
+	func() {
+		config.Lock()
+		defer config.Unlock()
+
+		config.DNS = c.DNS
+		config.Filters = c.Filters
+		config.WhitelistFilters = c.WhitelistFilters
+		config.UserRules = c.UserRules
+		config.UserRuleGroups = c.UserRuleGroups
+		config.Clients.Persistent = c.Clients.Persistent
+
+		if config.templates == nil {
+			config.templates = configTemplates{}
+		}
+
+		maps.Copy(config.templates, tmpls)
+	}()
+
+	Context.clients.reload(c.Clients.Persistent, filterConf)
+
+	// Don't wrap the error, since it's informative enough as is.
+	return reloadDNSServer()
+}
+
+// handleReload is the handler for the POST /control/reload HTTP API.
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	err := reloadConfig()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "%s", err)
+	}
+}
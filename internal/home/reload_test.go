@@ -0,0 +1,75 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestNewReloadedConfig(t *testing.T) {
+	prev := config
+	t.Cleanup(func() { config = prev })
+
+	config = &configuration{
+		DNS: dnsConfig{
+			FilteringConfig: dnsforward.FilteringConfig{
+				UpstreamDNS:      []string{"1.1.1.1"},
+				EDNSClientSubnet: &dnsforward.EDNSClientSubnet{},
+			},
+			DnsfilterConf: &filtering.Config{
+				CacheTime: 30,
+			},
+			Port: 53,
+		},
+		Clients:       &clientsConfig{},
+		UserRules:     []string{"||example.org^"},
+		SchemaVersion: currentSchemaVersion,
+	}
+
+	c := newReloadedConfig()
+
+	const data = `
+dns:
+  port: 5353
+  upstream_dns:
+  - 8.8.8.8
+  edns_client_subnet:
+    enabled: true
+  cache_time: 60
+clients:
+  persistent:
+  - name: client
+    ids:
+    - 1.2.3.4
+`
+
+	err := yaml.Unmarshal([]byte(data), c)
+	require.NoError(t, err)
+
+	assert.Equal(t, 5353, c.DNS.Port)
+	assert.Equal(t, []string{"8.8.8.8"}, c.DNS.UpstreamDNS)
+	assert.True(t, c.DNS.EDNSClientSubnet.Enabled)
+	assert.Equal(t, uint(60), c.DNS.DnsfilterConf.CacheTime)
+	assert.Equal(t, []string{"||example.org^"}, c.UserRules)
+
+	require.Len(t, c.Clients.Persistent, 1)
+
+	assert.Equal(t, "client", c.Clients.Persistent[0].Name)
+
+	// The current configuration must stay intact.
+	assert.Equal(t, 53, config.DNS.Port)
+	assert.Equal(t, []string{"1.1.1.1"}, config.DNS.UpstreamDNS)
+	assert.False(t, config.DNS.EDNSClientSubnet.Enabled)
+	assert.Equal(t, uint(30), config.DNS.DnsfilterConf.CacheTime)
+	assert.Empty(t, config.Clients.Persistent)
+}
+
+func TestReloadConfig_notRunning(t *testing.T) {
+	err := reloadConfig()
+	testutil.AssertErrorMsg(t, "reloading config: dns server is not running", err)
+}
@@ -33,9 +33,21 @@ type tlsManager struct {
 	// status is the current status of the configuration.  It is never nil.
 	status *tlsConfigStatus
 
+	// webhookClient is used to send the notifications about the certificate
+	// warnings.
+	webhookClient *http.Client
+
+	// notifier sends the email notifications about the certificate warnings.
+	notifier *notifier
+
 	// certLastMod is the last modification time of the certificate file.
 	certLastMod time.Time
 
+	// certReported are the comma-separated types of the certificate warnings
+	// reported last time.  It's only accessed by the certificate checks
+	// goroutine.
+	certReported string
+
 	confLock sync.Mutex
 	conf     tlsConfigSettings
 }
@@ -45,8 +57,10 @@ type tlsManager struct {
 // valid.  Thus TLS may be initialized later, e.g. via the web UI.
 func newTLSManager(conf tlsConfigSettings) (m *tlsManager, err error) {
 	m = &tlsManager{
-		status: &tlsConfigStatus{},
-		conf:   conf,
+		status:        &tlsConfigStatus{},
+		webhookClient: Context.client,
+		notifier:      Context.notifier,
+		conf:          conf,
 	}
 
 	if m.conf.Enabled {
@@ -100,6 +114,7 @@ func (m *tlsManager) setCertFileTime() {
 // start updates the configuration of t and starts it.
 func (m *tlsManager) start() {
 	m.registerWebHandlers()
+	m.startCertChecks()
 
 	m.confLock.Lock()
 	tlsConf := m.conf
@@ -314,6 +329,13 @@ func (m *tlsManager) handleTLSValidate(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	err = validateDoHPaths(setts.DoHPaths)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "doh_paths: %s", err)
+
+		return
+	}
+
 	if !webCheckPortAvailable(setts.PortHTTPS) {
 		aghhttp.Error(
 			r,
@@ -342,12 +364,21 @@ func (m *tlsManager) setConfig(newConf tlsConfigSettings, status *tlsConfigStatu
 	m.confLock.Lock()
 	defer m.confLock.Unlock()
 
-	// Reset the DNSCrypt data before comparing, since we currently do not
-	// accept these from the frontend.
+	// Reset the DNSCrypt and the pure proxy data before comparing, since we
+	// currently do not accept these from the frontend.
 	//
 	// TODO(a.garipov): Define a custom comparer for dnsforward.TLSConfig.
 	newConf.DNSCryptConfigFile = m.conf.DNSCryptConfigFile
 	newConf.PortDNSCrypt = m.conf.PortDNSCrypt
+	newConf.PureProxyPorts = m.conf.PureProxyPorts
+	newConf.CertExpiry = m.conf.CertExpiry
+
+	// Keep the custom DoH paths, if the frontend doesn't send those.  An empty
+	// object removes all of them.
+	if newConf.DoHPaths == nil {
+		newConf.DoHPaths = m.conf.DoHPaths
+	}
+
 	if !cmp.Equal(m.conf, newConf, cmp.AllowUnexported(dnsforward.TLSConfig{})) {
 		log.Info("tls config has changed, restarting https server")
 		restartHTTPS = true
@@ -368,6 +399,8 @@ func (m *tlsManager) setConfig(newConf tlsConfigSettings, status *tlsConfigStatu
 	m.conf.PrivateKey = newConf.PrivateKey
 	m.conf.PrivateKeyPath = newConf.PrivateKeyPath
 	m.conf.PrivateKeyData = newConf.PrivateKeyData
+	m.conf.QUIC = newConf.QUIC
+	m.conf.DoHPaths = newConf.DoHPaths
 	m.status = status
 
 	return restartHTTPS
@@ -385,31 +418,9 @@ func (m *tlsManager) handleTLSConfigure(w http.ResponseWriter, r *http.Request)
 		req.PrivateKey = m.conf.PrivateKey
 	}
 
-	if req.Enabled {
-		err = validatePorts(
-			tcpPort(config.BindPort),
-			tcpPort(req.PortHTTPS),
-			tcpPort(req.PortDNSOverTLS),
-			tcpPort(req.PortDNSCrypt),
-			udpPort(config.DNS.Port),
-			udpPort(req.PortDNSOverQUIC),
-		)
-		if err != nil {
-			aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
-
-			return
-		}
-	}
-
-	// TODO(e.burkov):  Investigate and perhaps check other ports.
-	if !webCheckPortAvailable(req.PortHTTPS) {
-		aghhttp.Error(
-			r,
-			w,
-			http.StatusBadRequest,
-			"port %d is not available, cannot enable https on it",
-			req.PortHTTPS,
-		)
+	err = validateTLSSettings(&req.tlsConfigSettings)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
 
 		return
 	}
@@ -427,11 +438,7 @@ func (m *tlsManager) handleTLSConfigure(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	restartHTTPS := m.setConfig(req.tlsConfigSettings, status)
-	m.setCertFileTime()
-	onConfigModified()
-
-	err = reconfigureDNSServer()
+	restartHTTPS, err := m.apply(req.tlsConfigSettings, status)
 	if err != nil {
 		aghhttp.Error(r, w, http.StatusInternalServerError, "%s", err)
 
@@ -459,6 +466,58 @@ func (m *tlsManager) handleTLSConfigure(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// validateTLSSettings returns an error if the ports or the protocol settings
+// of conf are invalid.  It doesn't load the certificates, see [loadTLSConf].
+func validateTLSSettings(conf *tlsConfigSettings) (err error) {
+	if conf.Enabled {
+		err = validatePorts(
+			tcpPort(config.BindPort),
+			tcpPort(conf.PortHTTPS),
+			tcpPort(conf.PortDNSOverTLS),
+			tcpPort(conf.PortDNSCrypt),
+			udpPort(config.DNS.Port),
+			udpPort(conf.PortDNSOverQUIC),
+		)
+		if err != nil {
+			// Don't wrap the error, since it's informative enough as is.
+			return err
+		}
+
+		err = conf.QUIC.Validate()
+		if err != nil {
+			return fmt.Errorf("quic: %w", err)
+		}
+	}
+
+	err = validateDoHPaths(conf.DoHPaths)
+	if err != nil {
+		return fmt.Errorf("doh_paths: %w", err)
+	}
+
+	// TODO(e.burkov):  Investigate and perhaps check other ports.
+	if !webCheckPortAvailable(conf.PortHTTPS) {
+		return fmt.Errorf("port %d is not available, cannot enable https on it", conf.PortHTTPS)
+	}
+
+	return nil
+}
+
+// apply sets the validated configuration conf with the loaded certificates
+// status and reconfigures the DNS server.  restartHTTPS is true if the HTTPS
+// server should be restarted with the new configuration, see
+// [Web.TLSConfigChanged].
+func (m *tlsManager) apply(
+	conf tlsConfigSettings,
+	status *tlsConfigStatus,
+) (restartHTTPS bool, err error) {
+	restartHTTPS = m.setConfig(conf, status)
+	m.setCertFileTime()
+	onConfigModified()
+
+	// Don't wrap the error, since it's informative enough as is.
+	return restartHTTPS, reconfigureDNSServer()
+}
+
 // validatePorts validates the uniqueness of TCP and UDP ports for AdGuard Home
 // DNS protocols.
 func validatePorts(
@@ -758,4 +817,5 @@ func (m *tlsManager) registerWebHandlers() {
 	httpRegister(http.MethodGet, "/control/tls/status", m.handleTLSStatus)
 	httpRegister(http.MethodPost, "/control/tls/configure", m.handleTLSConfigure)
 	httpRegister(http.MethodPost, "/control/tls/validate", m.handleTLSValidate)
+	httpRegister(http.MethodGet, "/control/tls/sessions", m.handleTLSSessions)
 }
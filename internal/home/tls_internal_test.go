@@ -1,11 +1,19 @@
 package home
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtls"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testCertChainData = []byte(`-----BEGIN CERTIFICATE-----
@@ -75,3 +83,96 @@ func TestValidateCertificates(t *testing.T) {
 		assert.True(t, status.ValidPair)
 	})
 }
+
+func TestTLSManager_setConfig_quic(t *testing.T) {
+	m, err := newTLSManager(tlsConfigSettings{})
+	require.NoError(t, err)
+
+	quicConf := dnsforward.QUICConfig{
+		MaxIdleTimeout:  timeutil.Duration{Duration: time.Minute},
+		KeepAlivePeriod: timeutil.Duration{Duration: 30 * time.Second},
+		Disable0RTT:     true,
+	}
+
+	restart := m.setConfig(tlsConfigSettings{
+		TLSConfig: dnsforward.TLSConfig{QUIC: quicConf},
+	}, &tlsConfigStatus{})
+	assert.True(t, restart)
+
+	w := httptest.NewRecorder()
+	m.handleTLSStatus(w, httptest.NewRequest(http.MethodGet, "/control/tls/status", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &struct {
+		QUIC dnsforward.QUICConfig `json:"quic"`
+	}{}
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	assert.Equal(t, quicConf, resp.QUIC)
+}
+
+func TestTLSManager_handleTLSSessions(t *testing.T) {
+	prevDNS, prevWeb := Context.dnsTLSStats, Context.webTLSStats
+	prevMin, prevCiphers := Context.tlsMinVersion, Context.tlsCipherIDs
+	t.Cleanup(func() {
+		Context.dnsTLSStats, Context.webTLSStats = prevDNS, prevWeb
+		Context.tlsMinVersion, Context.tlsCipherIDs = prevMin, prevCiphers
+	})
+
+	Context.dnsTLSStats, Context.webTLSStats = aghtls.NewHandshakeStats(), nil
+	Context.tlsMinVersion = tls.VersionTLS13
+	Context.tlsCipherIDs = []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+
+	for _, cs := range []tls.ConnectionState{{
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+	}, {
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+		DidResume:   true,
+	}, {
+		Version:     tls.VersionTLS12,
+		CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}, {
+		Version:     tls.VersionTLS13,
+		CipherSuite: tls.TLS_AES_256_GCM_SHA384,
+		DidResume:   true,
+	}} {
+		require.NoError(t, Context.dnsTLSStats.VerifyConnection(cs))
+	}
+
+	m, err := newTLSManager(tlsConfigSettings{})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	m.handleTLSSessions(w, httptest.NewRequest(http.MethodGet, "/control/tls/sessions", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &tlsSessionsResp{}
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	assert.Equal(t, &tlsSessionsResp{
+		DNS: &tlsHandshakesJSON{
+			Versions: map[string]uint64{
+				"TLS 1.2": 1,
+				"TLS 1.3": 3,
+			},
+			CipherSuites: map[string]uint64{
+				"TLS_AES_128_GCM_SHA256":                2,
+				"TLS_AES_256_GCM_SHA384":                1,
+				"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256": 1,
+			},
+			Handshakes:     4,
+			Resumed:        2,
+			ResumptionRate: 0.5,
+		},
+		HTTPS: &tlsHandshakesJSON{
+			Versions:     map[string]uint64{},
+			CipherSuites: map[string]uint64{},
+		},
+		MinVersion:   "TLS 1.3",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	}, resp)
+}
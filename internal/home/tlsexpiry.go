@@ -0,0 +1,247 @@
+package home
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// certExpiryConfig is the configuration of the TLS certificate expiration
+// monitoring.
+type certExpiryConfig struct {
+	// WebhookURL is the URL to which the notifications about the changes of
+	// the certificate warnings are sent with POST requests.  If it's empty,
+	// the notifications are only logged.
+	WebhookURL string `yaml:"webhook_url"`
+
+	// CheckInterval is the interval between the checks of the certificate.
+	CheckInterval timeutil.Duration `yaml:"check_interval"`
+
+	// WarnDays is the number of days before the expiration of the certificate
+	// starting from which it's reported as expiring.  Zero disables the
+	// warning, but the expired certificates are reported anyway.
+	WarnDays uint32 `yaml:"warn_days"`
+}
+
+// certWebhookTimeout is the timeout for sending a single webhook notification.
+const certWebhookTimeout = 30 * time.Second
+
+// certWarningType is the type of a TLS certificate warning.
+type certWarningType string
+
+// TLS certificate warning types.
+const (
+	certWarningExpired  certWarningType = "cert_expired"
+	certWarningExpiring certWarningType = "cert_expiring"
+	certWarningInvalid  certWarningType = "cert_invalid"
+)
+
+// tlsCertWarning is a warning about the configured TLS certificate.
+type tlsCertWarning struct {
+	// NotAfter is the expiration time of the certificate.  It's zero if the
+	// certificate couldn't be parsed.
+	NotAfter time.Time `json:"not_after"`
+
+	// Type is the type of the warning.
+	Type certWarningType `json:"type"`
+
+	// Message is the human-readable description of the warning.
+	Message string `json:"message"`
+
+	// ValidChain is true if the certificate chain is verified and issued by a
+	// known CA.
+	ValidChain bool `json:"valid_chain"`
+}
+
+// certWarnings returns the current warnings about the TLS certificate of m,
+// if the encryption is enabled.  now is the current time.
+func (m *tlsManager) certWarnings(now time.Time) (warnings []*tlsCertWarning) {
+	m.confLock.Lock()
+	defer m.confLock.Unlock()
+
+	if !m.conf.Enabled {
+		return nil
+	}
+
+	st := m.status
+	newWarning := func(typ certWarningType, msg string) (w *tlsCertWarning) {
+		return &tlsCertWarning{
+			NotAfter:   st.NotAfter,
+			Type:       typ,
+			Message:    msg,
+			ValidChain: st.ValidChain,
+		}
+	}
+
+	if st.WarningValidation != "" {
+		warnings = append(warnings, newWarning(certWarningInvalid, st.WarningValidation))
+	}
+
+	if st.NotAfter.IsZero() {
+		return warnings
+	}
+
+	notAfter := st.NotAfter.UTC().Format(time.RFC3339)
+	warnPeriod := time.Duration(m.conf.CertExpiry.WarnDays) * timeutil.Day
+	if left := st.NotAfter.Sub(now); left <= 0 {
+		msg := "tls certificate expired at " + notAfter
+		warnings = append(warnings, newWarning(certWarningExpired, msg))
+	} else if left < warnPeriod {
+		msg := fmt.Sprintf(
+			"tls certificate expires in %d days, at %s",
+			left/timeutil.Day,
+			notAfter,
+		)
+		warnings = append(warnings, newWarning(certWarningExpiring, msg))
+	}
+
+	return warnings
+}
+
+// startCertChecks starts checking the TLS certificate of m every check interval
+// in a separate goroutine, unless the interval isn't positive.
+func (m *tlsManager) startCertChecks() {
+	m.confLock.Lock()
+	ivl := m.conf.CertExpiry.CheckInterval.Duration
+	m.confLock.Unlock()
+
+	if ivl <= 0 {
+		log.Info("tls: certificate checks disabled")
+
+		return
+	}
+
+	go func() {
+		defer log.OnPanic("tls: certificate checks")
+
+		m.checkCert(time.Now())
+
+		t := time.NewTicker(ivl)
+		defer t.Stop()
+
+		for now := range t.C {
+			m.checkCert(now)
+		}
+	}()
+}
+
+// certWebhookPayload is the body of the webhook notification about the changes
+// of the TLS certificate warnings.
+type certWebhookPayload struct {
+	// ServerName is the configured server name of AdGuard Home.
+	ServerName string `json:"server_name"`
+
+	// Warnings are the current warnings.  An empty list means that the
+	// previously reported issues are resolved.  It's never nil.
+	Warnings []*tlsCertWarning `json:"warnings"`
+}
+
+// checkCert checks the TLS certificate of m and reports the warnings, if their
+// types have changed since the previous report.  now is the current time.  It
+// must only be called from a single goroutine.
+func (m *tlsManager) checkCert(now time.Time) {
+	warnings := m.certWarnings(now)
+
+	types := make([]string, 0, len(warnings))
+	for _, w := range warnings {
+		types = append(types, string(w.Type))
+	}
+
+	reported := strings.Join(types, ",")
+	if reported == m.certReported {
+		return
+	}
+
+	for _, w := range warnings {
+		log.Error("tls: %s", w.Message)
+	}
+
+	if len(warnings) == 0 {
+		log.Info("tls: certificate issues are resolved")
+	}
+
+	m.confLock.Lock()
+	serverName, webhookURL := m.conf.ServerName, m.conf.CertExpiry.WebhookURL
+	m.confLock.Unlock()
+
+	if webhookURL != "" {
+		payload := &certWebhookPayload{
+			ServerName: serverName,
+			Warnings:   append([]*tlsCertWarning{}, warnings...),
+		}
+
+		err := m.sendCertWebhook(webhookURL, payload)
+		if err != nil {
+			// Don't update the reported warnings to retry on the next check.
+			log.Error("tls: sending certificate webhook: %s", err)
+
+			return
+		}
+	}
+
+	if len(warnings) > 0 {
+		m.notifyCertWarnings(serverName, warnings)
+	}
+
+	m.certReported = reported
+}
+
+// notifyCertWarnings sends the email notification about the warnings of the
+// certificate for serverName, if enabled.
+func (m *tlsManager) notifyCertWarnings(serverName string, warnings []*tlsCertWarning) {
+	msgs := make([]string, 0, len(warnings))
+	for _, w := range warnings {
+		msgs = append(msgs, w.Message)
+	}
+
+	subj := "AdGuard Home: TLS certificate issues"
+	if serverName != "" {
+		subj += " for " + serverName
+	}
+
+	err := m.notifier.notify(notifyCertExpiry, subj, strings.Join(msgs, "\n"))
+	if err != nil {
+		log.Error("tls: sending certificate email: %s", err)
+	}
+}
+
+// sendCertWebhook sends payload to the webhook at u.
+func (m *tlsManager) sendCertWebhook(u string, payload *certWebhookPayload) (err error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), certWebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set(aghhttp.HdrNameContentType, aghhttp.HdrValApplicationJSON)
+
+	resp, err := m.webhookClient.Do(req)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("got status code %d, want 2xx", resp.StatusCode)
+	}
+
+	return nil
+}
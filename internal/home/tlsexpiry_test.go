@@ -0,0 +1,190 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSManager_certWarnings(t *testing.T) {
+	const warnDays = 14
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	warnPeriod := warnDays * timeutil.Day
+
+	testCases := []struct {
+		status    *tlsConfigStatus
+		name      string
+		wantTypes []certWarningType
+		enabled   bool
+	}{{
+		status:    &tlsConfigStatus{NotAfter: now.Add(-time.Hour)},
+		name:      "disabled",
+		wantTypes: nil,
+		enabled:   false,
+	}, {
+		status:    &tlsConfigStatus{NotAfter: now.Add(-time.Hour)},
+		name:      "expired",
+		wantTypes: []certWarningType{certWarningExpired},
+		enabled:   true,
+	}, {
+		status:    &tlsConfigStatus{NotAfter: now.Add(warnPeriod - time.Hour)},
+		name:      "expiring",
+		wantTypes: []certWarningType{certWarningExpiring},
+		enabled:   true,
+	}, {
+		status:    &tlsConfigStatus{NotAfter: now.Add(warnPeriod + time.Hour)},
+		name:      "valid",
+		wantTypes: nil,
+		enabled:   true,
+	}, {
+		status: &tlsConfigStatus{
+			WarningValidation: "certificate has no matching private key",
+		},
+		name:      "invalid",
+		wantTypes: []certWarningType{certWarningInvalid},
+		enabled:   true,
+	}, {
+		status: &tlsConfigStatus{
+			NotAfter:          now.Add(time.Hour),
+			WarningValidation: "x509: certificate signed by unknown authority",
+		},
+		name:      "expiring_invalid_chain",
+		wantTypes: []certWarningType{certWarningInvalid, certWarningExpiring},
+		enabled:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &tlsManager{
+				status: tc.status,
+				conf: tlsConfigSettings{
+					Enabled: tc.enabled,
+					CertExpiry: certExpiryConfig{
+						WarnDays: warnDays,
+					},
+				},
+			}
+
+			var types []certWarningType
+			for _, w := range m.certWarnings(now) {
+				types = append(types, w.Type)
+
+				assert.Equal(t, tc.status.NotAfter, w.NotAfter)
+				assert.False(t, w.ValidChain)
+			}
+
+			assert.Equal(t, tc.wantTypes, types)
+		})
+	}
+}
+
+func TestTLSManager_checkCert(t *testing.T) {
+	const serverName = "dns.example"
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	mu := &sync.Mutex{}
+	var payloads []*certWebhookPayload
+	failing := false
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		p := &certWebhookPayload{}
+		err := json.NewDecoder(r.Body).Decode(p)
+		require.NoError(t, err)
+
+		payloads = append(payloads, p)
+	}))
+	t.Cleanup(srv.Close)
+
+	gotPayloads := func() (ps []*certWebhookPayload) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append(ps, payloads...)
+	}
+
+	setFailing := func(f bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		failing = f
+	}
+
+	m := &tlsManager{
+		status: &tlsConfigStatus{
+			NotAfter:   now.Add(2 * timeutil.Day),
+			ValidChain: true,
+		},
+		webhookClient: srv.Client(),
+		conf: tlsConfigSettings{
+			Enabled:    true,
+			ServerName: serverName,
+			CertExpiry: certExpiryConfig{
+				WebhookURL: srv.URL,
+				WarnDays:   14,
+			},
+		},
+	}
+
+	m.checkCert(now)
+	ps := gotPayloads()
+	require.Len(t, ps, 1)
+
+	got := ps[0]
+	assert.Equal(t, serverName, got.ServerName)
+	require.Len(t, got.Warnings, 1)
+
+	assert.Equal(t, certWarningExpiring, got.Warnings[0].Type)
+	assert.True(t, got.Warnings[0].ValidChain)
+
+	t.Run("unchanged", func(t *testing.T) {
+		m.checkCert(now.Add(timeutil.Day))
+
+		assert.Len(t, gotPayloads(), 1)
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		setFailing(true)
+		m.checkCert(now.Add(3 * timeutil.Day))
+		require.Len(t, gotPayloads(), 1)
+
+		setFailing(false)
+		m.checkCert(now.Add(3 * timeutil.Day))
+		ps = gotPayloads()
+		require.Len(t, ps, 2)
+		require.Len(t, ps[1].Warnings, 1)
+
+		assert.Equal(t, certWarningExpired, ps[1].Warnings[0].Type)
+	})
+
+	t.Run("resolved", func(t *testing.T) {
+		m.status = &tlsConfigStatus{
+			NotAfter:   now.Add(90 * timeutil.Day),
+			ValidChain: true,
+		}
+
+		m.checkCert(now.Add(3 * timeutil.Day))
+		ps = gotPayloads()
+		require.Len(t, ps, 3)
+
+		assert.NotNil(t, ps[2].Warnings)
+		assert.Empty(t, ps[2].Warnings)
+	})
+}
@@ -0,0 +1,90 @@
+package home
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtls"
+)
+
+// tlsSessionsResp is the response to the GET /control/tls/sessions HTTP API.
+type tlsSessionsResp struct {
+	// DNS are the statistics of the encrypted DNS listeners of the DNS
+	// server.
+	DNS *tlsHandshakesJSON `json:"dns"`
+
+	// HTTPS are the statistics of the HTTPS server, which serves both the web
+	// interface and DNS-over-HTTPS.
+	HTTPS *tlsHandshakesJSON `json:"https"`
+
+	// MinVersion is the minimum accepted version of TLS.
+	MinVersion string `json:"min_version"`
+
+	// CipherSuites are the names of the allowed cipher suites.  The TLS 1.3
+	// cipher suites aren't configurable and are always allowed.
+	CipherSuites []string `json:"cipher_suites"`
+}
+
+// tlsHandshakesJSON are the statistics of the TLS handshakes of a group of
+// listeners.
+type tlsHandshakesJSON struct {
+	// Versions are the numbers of the handshakes by the names of the
+	// negotiated protocol versions.
+	Versions map[string]uint64 `json:"versions"`
+
+	// CipherSuites are the numbers of the handshakes by the names of the
+	// negotiated cipher suites.
+	CipherSuites map[string]uint64 `json:"cipher_suites"`
+
+	// Handshakes is the total number of the handshakes.
+	Handshakes uint64 `json:"handshakes"`
+
+	// Resumed is the number of the handshakes which resumed a previous
+	// session.
+	Resumed uint64 `json:"resumed"`
+
+	// ResumptionRate is the ratio of Resumed to Handshakes.  It's zero if
+	// there were no handshakes.
+	ResumptionRate float64 `json:"resumption_rate"`
+}
+
+// newTLSHandshakesJSON converts c into its JSON representation.
+func newTLSHandshakesJSON(c *aghtls.HandshakeCounts) (j *tlsHandshakesJSON) {
+	j = &tlsHandshakesJSON{
+		Versions:     make(map[string]uint64, len(c.Versions)),
+		CipherSuites: make(map[string]uint64, len(c.Ciphers)),
+		Handshakes:   c.Total,
+		Resumed:      c.Resumed,
+	}
+
+	for v, n := range c.Versions {
+		j.Versions[aghtls.VersionName(v)] = n
+	}
+
+	for id, n := range c.Ciphers {
+		j.CipherSuites[tls.CipherSuiteName(id)] = n
+	}
+
+	if c.Total > 0 {
+		j.ResumptionRate = float64(c.Resumed) / float64(c.Total)
+	}
+
+	return j
+}
+
+// handleTLSSessions is the handler for the GET /control/tls/sessions HTTP API.
+func (m *tlsManager) handleTLSSessions(w http.ResponseWriter, r *http.Request) {
+	resp := &tlsSessionsResp{
+		DNS:          newTLSHandshakesJSON(Context.dnsTLSStats.Counts()),
+		HTTPS:        newTLSHandshakesJSON(Context.webTLSStats.Counts()),
+		MinVersion:   aghtls.VersionName(Context.tlsMinVersion),
+		CipherSuites: make([]string, 0, len(Context.tlsCipherIDs)),
+	}
+
+	for _, id := range Context.tlsCipherIDs {
+		resp.CipherSuites = append(resp.CipherSuites, tls.CipherSuiteName(id))
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
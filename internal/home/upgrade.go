@@ -22,7 +22,7 @@ import (
 )
 
 // currentSchemaVersion is the current schema version.
-const currentSchemaVersion = 19
+const currentSchemaVersion = 20
 
 // These aliases are provided for convenience.
 type (
@@ -92,6 +92,7 @@ func upgradeConfigSchema(oldVersion int, diskConf yobj) (err error) {
 		upgradeSchema16to17,
 		upgradeSchema17to18,
 		upgradeSchema18to19,
+		upgradeSchema19to20,
 	}
 
 	n := 0
@@ -1064,6 +1065,83 @@ func upgradeSchema18to19(diskConf yobj) (err error) {
 	return nil
 }
 
+// upgradeSchema19to20 performs the following changes:
+//
+//	# BEFORE:
+//	'alerts':
+//	  'email':
+//	    'smtp_server': 'smtp.example.com:587'
+//	    'username': 'user'
+//	    'password': 'password'
+//	    'from': 'agh@example.com'
+//	    'to':
+//	    - 'admin@example.com'
+//
+//	# AFTER:
+//	'alerts': {}
+//	'notifications':
+//	  'email':
+//	    'smtp_server': 'smtp.example.com:587'
+//	    'username': 'user'
+//	    'password': 'password'
+//	    'from': 'agh@example.com'
+//	    'to':
+//	    - 'admin@example.com'
+//	  'alerts': true
+//
+// The email settings of the alerts are dropped if the SMTP server of the
+// notifications is already set.
+func upgradeSchema19to20(diskConf yobj) (err error) {
+	log.Printf("Upgrade yaml: 19 to 20")
+	diskConf["schema_version"] = 20
+
+	alertsVal, ok := diskConf["alerts"]
+	if !ok {
+		return nil
+	}
+
+	alerts, ok := alertsVal.(yobj)
+	if !ok {
+		return fmt.Errorf("unexpected type of alerts: %T", alertsVal)
+	}
+
+	emailVal, ok := alerts["email"]
+	if !ok {
+		return nil
+	}
+
+	delete(alerts, "email")
+
+	email, ok := emailVal.(yobj)
+	if !ok {
+		return fmt.Errorf("unexpected type of alerts.email: %T", emailVal)
+	} else if srv, _ := email["smtp_server"].(string); srv == "" {
+		return nil
+	}
+
+	notifs := yobj{}
+	if notifsVal, has := diskConf["notifications"]; has {
+		notifs, ok = notifsVal.(yobj)
+		if !ok {
+			return fmt.Errorf("unexpected type of notifications: %T", notifsVal)
+		}
+	}
+
+	if notifEmail, _ := notifs["email"].(yobj); notifEmail != nil {
+		if srv, _ := notifEmail["smtp_server"].(string); srv != "" {
+			log.Info("warning: upgrade yaml: alerts.email is dropped, since notifications.email is set")
+
+			return nil
+		}
+	}
+
+	notifs["email"] = email
+	notifs["alerts"] = true
+	diskConf["notifications"] = notifs
+
+	return nil
+}
+
 // TODO(a.garipov): Replace with log.Output when we port it to our logging
 // package.
 func funcName() string {
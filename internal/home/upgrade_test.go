@@ -951,3 +951,100 @@ func TestUpgradeSchema18to19(t *testing.T) {
 		})
 	}
 }
+
+func TestUpgradeSchema19to20(t *testing.T) {
+	const newSchemaVer = 20
+
+	newEmail := func(srv string) (email yobj) {
+		return yobj{
+			"smtp_server": srv,
+			"from":        "agh@example.com",
+			"to":          yarr{"admin@example.com"},
+		}
+	}
+
+	testCases := []struct {
+		in   yobj
+		want yobj
+		name string
+	}{{
+		in: yobj{},
+		want: yobj{
+			"schema_version": newSchemaVer,
+		},
+		name: "no_alerts",
+	}, {
+		in: yobj{
+			"alerts": yobj{"webhook_url": ""},
+		},
+		want: yobj{
+			"alerts":         yobj{"webhook_url": ""},
+			"schema_version": newSchemaVer,
+		},
+		name: "no_email",
+	}, {
+		in: yobj{
+			"alerts": yobj{"email": newEmail("")},
+		},
+		want: yobj{
+			"alerts":         yobj{},
+			"schema_version": newSchemaVer,
+		},
+		name: "empty_email",
+	}, {
+		in: yobj{
+			"alerts": yobj{"email": newEmail("smtp.example.com:587")},
+		},
+		want: yobj{
+			"alerts": yobj{},
+			"notifications": yobj{
+				"email":  newEmail("smtp.example.com:587"),
+				"alerts": true,
+			},
+			"schema_version": newSchemaVer,
+		},
+		name: "moved",
+	}, {
+		in: yobj{
+			"alerts": yobj{"email": newEmail("smtp.example.com:587")},
+			"notifications": yobj{
+				"email":   newEmail(""),
+				"updates": true,
+			},
+		},
+		want: yobj{
+			"alerts": yobj{},
+			"notifications": yobj{
+				"email":   newEmail("smtp.example.com:587"),
+				"updates": true,
+				"alerts":  true,
+			},
+			"schema_version": newSchemaVer,
+		},
+		name: "empty_notifications",
+	}, {
+		in: yobj{
+			"alerts": yobj{"email": newEmail("smtp.example.com:587")},
+			"notifications": yobj{
+				"email": newEmail("smtp.example.org:465"),
+			},
+		},
+		want: yobj{
+			"alerts": yobj{},
+			"notifications": yobj{
+				"email": newEmail("smtp.example.org:465"),
+			},
+			"schema_version": newSchemaVer,
+		},
+		name: "notifications_set",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := upgradeSchema19to20(tc.in)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, tc.in)
+		})
+	}
+}
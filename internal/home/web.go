@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"io/fs"
+	"net"
 	"net/http"
 	"net/netip"
 	"sync"
@@ -51,6 +52,15 @@ type webConfig struct {
 	// appropriate field.
 	WriteTimeout time.Duration
 
+	// activated are the sockets passed by the service manager.  The TCP
+	// listener bound to BindPort, if any, is used instead of listening on it.
+	// It may be nil.
+	activated *aghnet.ActivatedSockets
+
+	// unixSocket is the configuration of the additional Unix socket.  It may
+	// be nil.
+	unixSocket *unixSocketConfig
+
 	firstRun bool
 
 	serveHTTP3 bool
@@ -79,6 +89,10 @@ type Web struct {
 	// TODO(a.garipov): Refactor all these servers.
 	httpServer *http.Server
 
+	// unixServer is the server that handles the requests received through the
+	// Unix socket.  It's nil if the socket isn't configured.
+	unixServer *http.Server
+
 	// httpsServer is the server that handles HTTPS traffic.  If it is not nil,
 	// [Web.http3Server] must also not be nil.
 	httpsServer httpsServer
@@ -99,6 +113,9 @@ func newWeb(conf *webConfig) (w *Web) {
 	// if not configured, redirect / to /install.html, otherwise redirect /install.html to /
 	Context.mux.Handle("/", withMiddlewares(clientFS, gziphandler.GzipHandler, optionalAuthHandler, postInstallHandler))
 
+	// The health checks must work before the installation as well.
+	registerHealthHandlers()
+
 	// add handlers for /install paths, we only need them when we're not configured yet
 	if conf.firstRun {
 		log.Info("This is the first launch of AdGuard Home, redirecting everything to /install.html ")
@@ -168,28 +185,32 @@ func (web *Web) Start() {
 	// for https, we have a separate goroutine loop
 	go web.tlsServerLoop()
 
+	web.startUnixServer()
+
 	// this loop is used as an ability to change listening host and/or port
 	for !web.httpsServer.inShutdown {
 		printHTTPAddresses(aghhttp.SchemeHTTP)
 		errs := make(chan error, 2)
 
-		// Use an h2c handler to support unencrypted HTTP/2, e.g. for proxies.
-		hdlr := h2c.NewHandler(withMiddlewares(Context.mux, limitRequestBody), &http2.Server{})
-
 		// Create a new instance, because the Web is not usable after Shutdown.
 		hostStr := web.conf.BindHost.String()
 		web.httpServer = &http.Server{
 			ErrorLog:          log.StdLog("web: plain", log.DEBUG),
 			Addr:              netutil.JoinHostPort(hostStr, web.conf.BindPort),
-			Handler:           hdlr,
+			Handler:           web.handler(),
 			ReadTimeout:       web.conf.ReadTimeout,
 			ReadHeaderTimeout: web.conf.ReadHeaderTimeout,
 			WriteTimeout:      web.conf.WriteTimeout,
 		}
+		l := web.activatedListener()
 		go func() {
 			defer log.OnPanic("web: plain")
 
-			errs <- web.httpServer.ListenAndServe()
+			if l != nil {
+				errs <- web.httpServer.Serve(l)
+			} else {
+				errs <- web.httpServer.ListenAndServe()
+			}
 		}()
 
 		err := <-errs
@@ -203,6 +224,33 @@ func (web *Web) Start() {
 	}
 }
 
+// handler returns the handler of the plain HTTP requests.
+func (web *Web) handler() (h http.Handler) {
+	// Use an h2c handler to support unencrypted HTTP/2, e.g. for proxies.
+	return h2c.NewHandler(withMiddlewares(Context.mux, rewriteDoHPath, limitRequestBody, limitControlRate), &http2.Server{})
+}
+
+// activatedListener returns the duplicate of the listener passed by the
+// service manager for the HTTP port, if any, since the server closes it on
+// shutdown.  l is nil if there is none.
+func (web *Web) activatedListener() (l net.Listener) {
+	ls := web.conf.activated.TCPListeners(uint16(web.conf.BindPort))
+	if len(ls) == 0 {
+		return nil
+	}
+
+	l, err := aghnet.DupListener(ls[0])
+	if err != nil {
+		log.Error("web: using activated listener: %s", err)
+
+		return nil
+	}
+
+	log.Info("web: listening to http://%s from service manager", l.Addr())
+
+	return l
+}
+
 // Close gracefully shuts down the HTTP servers.
 func (web *Web) Close(ctx context.Context) {
 	log.Info("stopping http server...")
@@ -218,6 +266,7 @@ func (web *Web) Close(ctx context.Context) {
 	shutdownSrv(ctx, web.httpsServer.server)
 	shutdownSrv3(web.httpsServer.server3)
 	shutdownSrv(ctx, web.httpServer)
+	shutdownSrv(ctx, web.unixServer)
 
 	log.Info("stopped http server")
 }
@@ -246,12 +295,13 @@ func (web *Web) tlsServerLoop() {
 			ErrorLog: log.StdLog("web: https", log.DEBUG),
 			Addr:     addr,
 			TLSConfig: &tls.Config{
-				Certificates: []tls.Certificate{web.httpsServer.cert},
-				RootCAs:      Context.tlsRoots,
-				CipherSuites: Context.tlsCipherIDs,
-				MinVersion:   tls.VersionTLS12,
+				Certificates:     []tls.Certificate{web.httpsServer.cert},
+				RootCAs:          Context.tlsRoots,
+				VerifyConnection: Context.webTLSStats.VerifyConnection,
+				CipherSuites:     Context.tlsCipherIDs,
+				MinVersion:       Context.tlsMinVersion,
 			},
-			Handler:           withMiddlewares(Context.mux, limitRequestBody),
+			Handler:           withMiddlewares(Context.mux, rewriteDoHPath, limitRequestBody, limitControlRate),
 			ReadTimeout:       web.conf.ReadTimeout,
 			ReadHeaderTimeout: web.conf.ReadHeaderTimeout,
 			WriteTimeout:      web.conf.WriteTimeout,
@@ -280,12 +330,13 @@ func (web *Web) mustStartHTTP3(address string) {
 		// well as timeouts here.
 		Addr: address,
 		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{web.httpsServer.cert},
-			RootCAs:      Context.tlsRoots,
-			CipherSuites: Context.tlsCipherIDs,
-			MinVersion:   tls.VersionTLS12,
+			Certificates:     []tls.Certificate{web.httpsServer.cert},
+			RootCAs:          Context.tlsRoots,
+			VerifyConnection: Context.webTLSStats.VerifyConnection,
+			CipherSuites:     Context.tlsCipherIDs,
+			MinVersion:       Context.tlsMinVersion,
 		},
-		Handler: withMiddlewares(Context.mux, limitRequestBody),
+		Handler: withMiddlewares(Context.mux, rewriteDoHPath, limitRequestBody, limitControlRate),
 	}
 
 	log.Debug("web: starting http/3 server")
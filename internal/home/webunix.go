@@ -0,0 +1,147 @@
+package home
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultUnixSocketMode is the default permissions of the socket file of the
+// web interface.
+const defaultUnixSocketMode fs.FileMode = 0o660
+
+// unixSocketConfig is the configuration of the Unix domain socket the web
+// interface additionally listens on, so that the reverse proxies on the same
+// host can reach it without a TCP port.
+type unixSocketConfig struct {
+	// Path is the path to the socket file.  If empty, the socket isn't used.
+	Path string `yaml:"path"`
+
+	// Mode are the octal permissions of the socket file, which define the
+	// users allowed to connect to it.  If empty, defaultUnixSocketMode is
+	// used.
+	Mode string `yaml:"mode"`
+}
+
+// fileMode returns the parsed permissions of the socket file.  c may be nil.
+func (c *unixSocketConfig) fileMode() (m fs.FileMode, err error) {
+	if c == nil || c.Mode == "" {
+		return defaultUnixSocketMode, nil
+	}
+
+	u, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad mode %q: %w", c.Mode, err)
+	} else if u&^uint64(fs.ModePerm) != 0 {
+		return 0, fmt.Errorf("bad mode %q: only permission bits are allowed", c.Mode)
+	}
+
+	return fs.FileMode(u), nil
+}
+
+// validate returns an error if c is invalid.  c may be nil.
+func (c *unixSocketConfig) validate() (err error) {
+	if c == nil || c.Path == "" {
+		return nil
+	}
+
+	_, err = c.fileMode()
+
+	return err
+}
+
+// listenUnix listens on the socket file from c with the configured
+// permissions, removing the one left from the previous run, if any.  c must be
+// valid.
+func listenUnix(c *unixSocketConfig) (l net.Listener, err error) {
+	mode, err := c.fileMode()
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Lstat(c.Path)
+	if err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%q exists and is not a socket", c.Path)
+		}
+
+		err = os.Remove(c.Path)
+		if err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("checking socket file: %w", err)
+	}
+
+	l, err = net.Listen("unix", c.Path)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	err = os.Chmod(c.Path, mode)
+	if err != nil {
+		return nil, errors.WithDeferred(fmt.Errorf("setting socket mode: %w", err), l.Close())
+	}
+
+	return l, nil
+}
+
+// unixRemoteAddr is the remote address set to the requests received through
+// the Unix socket, so that they are treated as the ones from the loopback
+// interface.  In particular, the headers of the reverse proxies are used if
+// the loopback addresses are trusted.
+const unixRemoteAddr = "127.0.0.1:0"
+
+// withUnixRemoteAddr returns a handler setting the remote address of the
+// requests to unixRemoteAddr, since the addresses of the Unix socket peers are
+// empty.
+func withUnixRemoteAddr(h http.Handler) (wrapped http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.RemoteAddr = unixRemoteAddr
+		h.ServeHTTP(w, r)
+	})
+}
+
+// startUnixServer starts serving the web interface on the configured Unix
+// socket, if any.
+func (web *Web) startUnixServer() {
+	c := web.conf.unixSocket
+	if c == nil || c.Path == "" {
+		return
+	}
+
+	l, err := listenUnix(c)
+	if err != nil {
+		log.Error("web: listening to unix socket: %s", err)
+
+		return
+	}
+
+	web.unixServer = &http.Server{
+		ErrorLog:          log.StdLog("web: unix", log.DEBUG),
+		Addr:              c.Path,
+		Handler:           withUnixRemoteAddr(web.handler()),
+		ReadTimeout:       web.conf.ReadTimeout,
+		ReadHeaderTimeout: web.conf.ReadHeaderTimeout,
+		WriteTimeout:      web.conf.WriteTimeout,
+	}
+
+	log.Info("web: listening to unix socket %s", c.Path)
+
+	srv := web.unixServer
+	go func() {
+		defer log.OnPanic("web: unix")
+
+		serveErr := srv.Serve(l)
+		if !errors.Is(serveErr, http.ErrServerClosed) {
+			log.Error("web: serving unix socket: %s", serveErr)
+		}
+	}()
+}
@@ -0,0 +1,135 @@
+//go:build darwin || freebsd || linux || openbsd
+
+package home
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixSocketConfig_fileMode(t *testing.T) {
+	testCases := []struct {
+		conf       *unixSocketConfig
+		name       string
+		wantErrMsg string
+		want       fs.FileMode
+	}{{
+		conf:       nil,
+		name:       "nil",
+		wantErrMsg: "",
+		want:       defaultUnixSocketMode,
+	}, {
+		conf:       &unixSocketConfig{Mode: ""},
+		name:       "default",
+		wantErrMsg: "",
+		want:       defaultUnixSocketMode,
+	}, {
+		conf:       &unixSocketConfig{Mode: "0600"},
+		name:       "custom",
+		wantErrMsg: "",
+		want:       0o600,
+	}, {
+		conf:       &unixSocketConfig{Mode: "rw-rw----"},
+		name:       "bad",
+		wantErrMsg: `bad mode "rw-rw----": strconv.ParseUint: parsing "rw-rw----": invalid syntax`,
+		want:       0,
+	}, {
+		conf:       &unixSocketConfig{Mode: "4755"},
+		name:       "setuid",
+		wantErrMsg: `bad mode "4755": only permission bits are allowed`,
+		want:       0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := tc.conf.fileMode()
+			if tc.wantErrMsg != "" {
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, m)
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "web.sock")
+	conf := &unixSocketConfig{
+		Path: sockPath,
+		Mode: "0600",
+	}
+
+	l, err := listenUnix(conf)
+	require.NoError(t, err)
+
+	fi, err := os.Stat(sockPath)
+	require.NoError(t, err)
+
+	assert.Equal(t, fs.FileMode(0o600), fi.Mode().Perm())
+
+	var gotAddr string
+	srv := &http.Server{
+		Handler: withUnixRemoteAddr(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotAddr = r.RemoteAddr
+		})),
+	}
+	go func() { _ = srv.Serve(l) }()
+
+	cli := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (conn net.Conn, err error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
+			},
+		},
+	}
+
+	resp, err := cli.Get("http://adguard.home/")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, unixRemoteAddr, gotAddr)
+
+	err = srv.Shutdown(context.Background())
+	require.NoError(t, err)
+
+	t.Run("stale", func(t *testing.T) {
+		// Leave a socket file as if the previous run has crashed.
+		stale, lErr := net.Listen("unix", sockPath)
+		require.NoError(t, lErr)
+
+		ul, ok := stale.(*net.UnixListener)
+		require.True(t, ok)
+
+		ul.SetUnlinkOnClose(false)
+		require.NoError(t, stale.Close())
+
+		l, lErr = listenUnix(conf)
+		require.NoError(t, lErr)
+		require.NoError(t, l.Close())
+	})
+
+	t.Run("not_socket", func(t *testing.T) {
+		filePath := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(filePath, nil, 0o600))
+
+		_, lErr := listenUnix(&unixSocketConfig{Path: filePath})
+		require.Error(t, lErr)
+
+		assert.FileExists(t, filePath)
+	})
+}
@@ -3,10 +3,13 @@ package home
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/netip"
+	"net/url"
 	"strings"
 	"time"
 
@@ -24,6 +27,21 @@ const (
 	whoisTTL       = 1 * 60 * 60 // 1 hour
 )
 
+// whoisIPv6PrefixLen is the length of the IPv6 networks, which clients share
+// the WHOIS information.  The IPv6 clients often change their addresses within
+// such networks, see RFC 8981.
+const whoisIPv6PrefixLen = 64
+
+// rirWHOISServers are the WHOIS servers of the regional internet registries by
+// the domains of their RDAP servers.
+var rirWHOISServers = map[string]string{
+	"afrinic.net": "whois.afrinic.net",
+	"apnic.net":   "whois.apnic.net",
+	"arin.net":    "whois.arin.net",
+	"lacnic.net":  "whois.lacnic.net",
+	"ripe.net":    "whois.ripe.net",
+}
+
 // WHOIS - module context
 type WHOIS struct {
 	clients *clientsContainer
@@ -33,17 +51,28 @@ type WHOIS struct {
 	// connections.
 	dialContext func(ctx context.Context, network, addr string) (conn net.Conn, err error)
 
+	// rdap is queried before falling back to the plain-text WHOIS protocol.
+	// It may be nil.
+	rdap *rdapClient
+
 	// Contains IP addresses of clients
 	// An active IP address is resolved once again after it expires.
 	// If IP address couldn't be resolved, it stays here for some time to prevent further attempts to resolve the same IP.
 	ipAddrs cache.Cache
 
+	// prefixes contains the WHOIS information by the networks of the clients,
+	// see [whoisPrefix], so that the clients of the same network are only
+	// looked up once.  The values are the expiration times followed by the
+	// JSON-encoded information, if there is any.
+	prefixes cache.Cache
+
 	// TODO(a.garipov): Rewrite to use time.Duration.  Like, seriously, why?
 	timeoutMsec uint
 }
 
-// initWHOIS creates the WHOIS module context.
-func initWHOIS(clients *clientsContainer) *WHOIS {
+// initWHOIS creates the WHOIS module context.  httpClient is used for the RDAP
+// requests.
+func initWHOIS(clients *clientsContainer, httpClient *http.Client) *WHOIS {
 	w := WHOIS{
 		timeoutMsec: 5000,
 		clients:     clients,
@@ -51,7 +80,12 @@ func initWHOIS(clients *clientsContainer) *WHOIS {
 			EnableLRU: true,
 			MaxCount:  10000,
 		}),
-		dialContext: customDialContext,
+		prefixes: cache.New(cache.Config{
+			EnableLRU: true,
+			MaxCount:  10000,
+		}),
+		dialContext: proxyDialContext,
+		rdap:        newRDAPClient(httpClient, defaultRDAPBootstrapURL),
 		ipChan:      make(chan netip.Addr, 255),
 	}
 
@@ -100,7 +134,7 @@ func whoisParse(data string) (m strmap) {
 		}
 
 		switch k {
-		case "orgname", "org-name":
+		case "orgname", "org-name", "owner":
 			k = "orgname"
 			v = trimValue(v)
 			orgname = v
@@ -110,7 +144,7 @@ func whoisParse(data string) (m strmap) {
 			k = "orgname"
 			v = stringutil.Coalesce(orgname, v)
 			orgname = v
-		case "whois":
+		case "whois", "refer":
 			k = "whois"
 		case "referralserver":
 			k = "whois"
@@ -162,9 +196,8 @@ func (w *WHOIS) query(ctx context.Context, target, serverAddr string) (data stri
 	return string(whoisData), nil
 }
 
-// Query WHOIS servers (handle redirects)
-func (w *WHOIS) queryAll(ctx context.Context, target string) (string, error) {
-	server := net.JoinHostPort(defaultServer, defaultPort)
+// Query WHOIS servers starting from server (handle redirects)
+func (w *WHOIS) queryAll(ctx context.Context, target, server string) (string, error) {
 	const maxRedirects = 5
 	for i := 0; i != maxRedirects; i++ {
 		resp, err := w.query(ctx, target, server)
@@ -194,7 +227,17 @@ func (w *WHOIS) queryAll(ctx context.Context, target string) (string, error) {
 
 // Request WHOIS information
 func (w *WHOIS) process(ctx context.Context, ip netip.Addr) (wi *RuntimeClientWHOISInfo) {
-	resp, err := w.queryAll(ctx, ip.String())
+	if w.rdap != nil {
+		var err error
+		wi, err = w.lookupRDAP(ctx, ip)
+		if err == nil {
+			return wi
+		}
+
+		log.Debug("whois: rdap: %s; falling back to whois  IP:%s", err, ip)
+	}
+
+	resp, err := w.queryAll(ctx, ip.String(), w.whoisServer(ctx, ip))
 	if err != nil {
 		log.Debug("whois: error: %s  IP:%s", err, ip)
 
@@ -220,8 +263,115 @@ func (w *WHOIS) process(ctx context.Context, ip netip.Addr) (wi *RuntimeClientWH
 	return wi
 }
 
+// whoisServer returns the address of the WHOIS server of the regional internet
+// registry responsible for ip, as reported by the RDAP bootstrap registries, so
+// that the queries for the addresses of other registries, especially the IPv6
+// ones, aren't redirected.  It returns the address of the default server if
+// the registry is unknown.
+func (w *WHOIS) whoisServer(ctx context.Context, ip netip.Addr) (addr string) {
+	addr = net.JoinHostPort(defaultServer, defaultPort)
+	if w.rdap == nil {
+		return addr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(w.timeoutMsec)*time.Millisecond)
+	defer cancel()
+
+	rdapURL, err := w.rdap.serverFor(ctx, ip)
+	if err != nil {
+		log.Debug("whois: choosing server: %s  IP:%s", err, ip)
+
+		return addr
+	}
+
+	u, err := url.Parse(rdapURL)
+	if err != nil {
+		log.Debug("whois: choosing server: %s  IP:%s", err, ip)
+
+		return addr
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for domain, srv := range rirWHOISServers {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return net.JoinHostPort(srv, defaultPort)
+		}
+	}
+
+	return addr
+}
+
+// lookupRDAP requests the information about ip using RDAP.
+func (w *WHOIS) lookupRDAP(ctx context.Context, ip netip.Addr) (wi *RuntimeClientWHOISInfo, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(w.timeoutMsec)*time.Millisecond)
+	defer cancel()
+
+	return w.rdap.lookup(ctx, ip)
+}
+
+// whoisPrefix returns the network of ip, which clients share the WHOIS
+// information.
+func whoisPrefix(ip netip.Addr) (p netip.Prefix) {
+	if ip.Is4() {
+		return netip.PrefixFrom(ip, ip.BitLen())
+	}
+
+	// The error is only returned for invalid addresses and too long prefixes.
+	p, _ = ip.WithZone("").Prefix(whoisIPv6PrefixLen)
+
+	return p
+}
+
+// whoisPrefixKey returns the key of the network of ip in the prefixes cache.
+func whoisPrefixKey(ip netip.Addr) (key []byte) {
+	p := whoisPrefix(ip)
+
+	return append(p.Addr().AsSlice(), byte(p.Bits()))
+}
+
+// prefixInfo returns the cached WHOIS information about the network of ip.
+// ok is false if there is no fresh information in the cache.  wi is nil if the
+// network has been looked up but nothing was found.
+func (w *WHOIS) prefixInfo(ip netip.Addr) (wi *RuntimeClientWHOISInfo, ok bool) {
+	val := w.prefixes.Get(whoisPrefixKey(ip))
+	if len(val) < 8 || binary.BigEndian.Uint64(val) <= uint64(time.Now().Unix()) {
+		return nil, false
+	} else if len(val) == 8 {
+		return nil, true
+	}
+
+	wi = &RuntimeClientWHOISInfo{}
+	err := json.Unmarshal(val[8:], wi)
+	if err != nil {
+		log.Debug("whois: decoding cached info: %s  IP:%s", err, ip)
+
+		return nil, false
+	}
+
+	return wi, true
+}
+
+// setPrefixInfo caches wi, which may be nil, as the WHOIS information about
+// the network of ip.
+func (w *WHOIS) setPrefixInfo(ip netip.Addr, wi *RuntimeClientWHOISInfo) {
+	val := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix())+whoisTTL)
+	if wi != nil {
+		data, err := json.Marshal(wi)
+		if err != nil {
+			log.Debug("whois: encoding info: %s  IP:%s", err, ip)
+
+			return
+		}
+
+		val = append(val, data...)
+	}
+
+	_ = w.prefixes.Set(whoisPrefixKey(ip), val)
+}
+
 // Begin - begin requesting WHOIS info
 func (w *WHOIS) Begin(ip netip.Addr) {
+	ip = ip.Unmap()
 	ipBytes := ip.AsSlice()
 	now := uint64(time.Now().Unix())
 	expire := w.ipAddrs.Get(ipBytes)
@@ -236,6 +386,16 @@ func (w *WHOIS) Begin(ip netip.Addr) {
 	binary.BigEndian.PutUint64(expire, now+whoisTTL)
 	_ = w.ipAddrs.Set(ipBytes, expire)
 
+	if wi, ok := w.prefixInfo(ip); ok {
+		log.Debug("whois: using cached info for network of %s", ip)
+
+		if wi != nil {
+			w.clients.setWHOISInfo(ip, wi)
+		}
+
+		return
+	}
+
 	log.Debug("whois: adding %s", ip)
 
 	select {
@@ -246,10 +406,16 @@ func (w *WHOIS) Begin(ip netip.Addr) {
 }
 
 // workerLoop processes the IP addresses it got from the channel and associates
-// the retrieving WHOIS info with a client.
+// the retrieving WHOIS info with a client.  The addresses of the networks
+// looked up while they were in the queue aren't looked up once again.
 func (w *WHOIS) workerLoop() {
 	for ip := range w.ipChan {
-		info := w.process(context.Background(), ip)
+		info, ok := w.prefixInfo(ip)
+		if !ok {
+			info = w.process(context.Background(), ip)
+			w.setPrefixInfo(ip, info)
+		}
+
 		if info == nil {
 			continue
 		}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/golibs/cache"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -66,7 +70,7 @@ func TestWHOIS(t *testing.T) {
 		timeoutMsec: 5000,
 		dialContext: fc.fakeDial,
 	}
-	resp, err := w.queryAll(context.Background(), "1.2.3.4")
+	resp, err := w.queryAll(context.Background(), "1.2.3.4", net.JoinHostPort(defaultServer, defaultPort))
 	assert.NoError(t, err)
 
 	m := whoisParse(resp)
@@ -133,6 +137,14 @@ func TestWHOISParse(t *testing.T) {
 		want: strmap{"whois": whois},
 		name: "whois",
 		in:   `whois: ` + whois,
+	}, {
+		want: strmap{"orgname": orgname},
+		name: "orgname_owner",
+		in:   `owner: ` + orgname,
+	}, {
+		want: strmap{"whois": whois},
+		name: "refer",
+		in:   `refer: ` + whois,
 	}, {
 		want: strmap{"whois": whois},
 		name: "referralserver",
@@ -150,3 +162,103 @@ func TestWHOISParse(t *testing.T) {
 		})
 	}
 }
+
+func TestWHOIS_whoisServer(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewTLSServer(mux)
+	t.Cleanup(srv.Close)
+
+	mux.HandleFunc("/bootstrap/ipv6.json", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"services": [
+		  [["2001:4000::/23"], ["https://rdap.db.ripe.net/"]],
+		  [["2001:400::/23"], ["https://rdap.arin.net/registry/"]],
+		  [["2001:1000::/23"], ["https://rdap.example/"]]
+		]}`))
+	})
+
+	w := &WHOIS{
+		timeoutMsec: 5000,
+		rdap:        newRDAPClient(srv.Client(), srv.URL+"/bootstrap/"),
+	}
+
+	testCases := []struct {
+		name string
+		ip   string
+		want string
+	}{{
+		name: "ripe",
+		ip:   "2001:4000::1",
+		want: "whois.ripe.net:43",
+	}, {
+		name: "arin",
+		ip:   "2001:400::1",
+		want: "whois.arin.net:43",
+	}, {
+		name: "unknown_registry",
+		ip:   "2001:1000::1",
+		want: "whois.arin.net:43",
+	}, {
+		name: "no_service",
+		ip:   "2001:db8::1",
+		want: "whois.arin.net:43",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := w.whoisServer(context.Background(), netip.MustParseAddr(tc.ip))
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestWHOIS_prefixInfo(t *testing.T) {
+	w := &WHOIS{
+		prefixes: cache.New(cache.Config{
+			EnableLRU: true,
+			MaxCount:  10,
+		}),
+	}
+
+	wi := &RuntimeClientWHOISInfo{
+		Country: "Imagiland",
+		Orgname: "FakeOrg LLC",
+	}
+
+	w.setPrefixInfo(netip.MustParseAddr("2001:db8:1:1::1"), wi)
+	w.setPrefixInfo(netip.MustParseAddr("1.2.3.4"), nil)
+
+	testCases := []struct {
+		want   *RuntimeClientWHOISInfo
+		name   string
+		ip     string
+		wantOK bool
+	}{{
+		want:   wi,
+		name:   "same_ipv6_network",
+		ip:     "2001:db8:1:1:abcd::2",
+		wantOK: true,
+	}, {
+		want:   nil,
+		name:   "other_ipv6_network",
+		ip:     "2001:db8:1:2::1",
+		wantOK: false,
+	}, {
+		want:   nil,
+		name:   "ipv4_no_info",
+		ip:     "1.2.3.4",
+		wantOK: true,
+	}, {
+		want:   nil,
+		name:   "other_ipv4",
+		ip:     "1.2.3.5",
+		wantOK: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := w.prefixInfo(netip.MustParseAddr(tc.ip))
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
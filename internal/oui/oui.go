@@ -0,0 +1,231 @@
+// Package oui contains the database of the hardware vendors by the
+// organizationally unique identifiers of their MAC addresses.
+package oui
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/google/renameio/maybe"
+)
+
+// DefaultURL is the default address of the IEEE MA-L registry in the CSV
+// format.
+const DefaultURL = "https://standards-oui.ieee.org/oui/oui.csv"
+
+// defaultRefreshIvl is the default interval between the downloads of the
+// registry.
+const defaultRefreshIvl = 30 * timeutil.Day
+
+// retryIvl is the interval after which a failed download is retried.
+const retryIvl = 1 * time.Hour
+
+// maxRegistrySize is the maximum size of the downloaded registry.
+const maxRegistrySize = 32 * 1024 * 1024
+
+// Config is the configuration of a [*DB].
+type Config struct {
+	// Client is used to download the registry.  It must not be nil.
+	Client *http.Client
+
+	// URL is the address of the registry in the IEEE CSV format.  If empty,
+	// [DefaultURL] is used.
+	URL string
+
+	// CachePath is the path to the file the downloaded registry is saved to.
+	// If empty, the registry isn't cached.
+	CachePath string
+
+	// RefreshIvl is the interval between the downloads of the registry.  If
+	// zero, 30 days are used.
+	RefreshIvl time.Duration
+}
+
+// DB is the database of the vendors by the OUIs.  The registry is loaded
+// lazily, on the first lookup, from the cache or, if it's outdated, from the
+// network.  A nil *DB is valid and knows no vendors.
+type DB struct {
+	// mu protects vendors, nextLoad, and loading.
+	mu *sync.Mutex
+
+	// vendors are the names of the organizations by the OUIs.
+	vendors map[[3]byte]string
+
+	// nextLoad is the time since which the registry should be loaded again.
+	nextLoad time.Time
+
+	conf *Config
+
+	// loading is true while the registry is being loaded.
+	loading bool
+}
+
+// New returns a new properly initialized *DB.  conf must not be nil.
+func New(conf *Config) (db *DB) {
+	c := *conf
+	if c.URL == "" {
+		c.URL = DefaultURL
+	}
+
+	if c.RefreshIvl == 0 {
+		c.RefreshIvl = defaultRefreshIvl
+	}
+
+	return &DB{
+		mu:      &sync.Mutex{},
+		vendors: map[[3]byte]string{},
+		conf:    &c,
+	}
+}
+
+// Vendor returns the name of the vendor of mac, if known.  It also starts
+// loading the registry in the background, if necessary.  The locally
+// administered addresses, for example the randomized ones, have no vendors.
+func (db *DB) Vendor(mac net.HardwareAddr) (vendor string) {
+	if db == nil || len(mac) < 3 || mac[0]&0x02 != 0 {
+		return ""
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	if !db.loading && !now.Before(db.nextLoad) {
+		db.loading = true
+		go db.load(now)
+	}
+
+	return db.vendors[[3]byte{mac[0], mac[1], mac[2]}]
+}
+
+// load loads the registry from the cache or, if it's outdated, downloads it.
+func (db *DB) load(now time.Time) {
+	defer log.OnPanic("oui: loading")
+
+	vendors, next, err := db.read(now)
+	if err != nil {
+		log.Error("oui: loading registry: %s", err)
+
+		next = now.Add(retryIvl)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if vendors != nil {
+		db.vendors = vendors
+	}
+
+	db.nextLoad = next
+	db.loading = false
+}
+
+// read returns the vendors from the cache, if it's fresh, or from the
+// network.  next is the time of the next load.
+func (db *DB) read(now time.Time) (vendors map[[3]byte]string, next time.Time, err error) {
+	fi, err := os.Stat(db.conf.CachePath)
+	if err == nil && now.Sub(fi.ModTime()) < db.conf.RefreshIvl {
+		var f *os.File
+		f, err = os.Open(db.conf.CachePath)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("opening cache: %w", err)
+		}
+		defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+		vendors, err = Parse(f)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("parsing cache: %w", err)
+		}
+
+		log.Debug("oui: loaded %d vendors from cache", len(vendors))
+
+		return vendors, fi.ModTime().Add(db.conf.RefreshIvl), nil
+	}
+
+	data, err := db.download()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	vendors, err = Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("parsing registry: %w", err)
+	}
+
+	if db.conf.CachePath != "" {
+		err = maybe.WriteFile(db.conf.CachePath, data, 0o644)
+		if err != nil {
+			// Don't return the error, since the registry is usable anyway.
+			log.Error("oui: writing cache: %s", err)
+		}
+	}
+
+	log.Debug("oui: downloaded %d vendors", len(vendors))
+
+	return vendors, now.Add(db.conf.RefreshIvl), nil
+}
+
+// download returns the contents of the registry from the network.
+func (db *DB) download() (data []byte, err error) {
+	resp, err := db.conf.Client.Get(db.conf.URL)
+	if err != nil {
+		return nil, fmt.Errorf("requesting registry: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("requesting registry: got status code %d", resp.StatusCode)
+	}
+
+	data, err = io.ReadAll(io.LimitReader(resp.Body, maxRegistrySize))
+	if err != nil {
+		return nil, fmt.Errorf("reading registry: %w", err)
+	}
+
+	return data, nil
+}
+
+// Parse parses the registry in the IEEE CSV format, with the assignments in
+// the second column and the organization names in the third one.  The lines
+// with bad assignments, including the header, are skipped.
+func Parse(r io.Reader) (vendors map[[3]byte]string, err error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.ReuseRecord = true
+
+	vendors = map[[3]byte]string{}
+	for {
+		var rec []string
+		rec, err = cr.Read()
+		if errors.Is(err, io.EOF) {
+			return vendors, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(rec) < 3 || len(rec[1]) != 6 {
+			continue
+		}
+
+		var oui [3]byte
+		_, err = hex.Decode(oui[:], []byte(rec[1]))
+		if err != nil {
+			continue
+		}
+
+		vendors[oui] = strings.TrimSpace(rec[2])
+	}
+}
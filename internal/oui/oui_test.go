@@ -0,0 +1,92 @@
+package oui_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/oui"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	testutil.DiscardLogOutput(m)
+}
+
+// testRegistry is a part of the IEEE MA-L registry for tests.
+const testRegistry = `Registry,Assignment,Organization Name,Organization Address
+MA-L,A8032A,Espressif Inc.,"Room 204, Building 2, 690 Bibo Rd, Shanghai CN 201203"
+MA-L,F0D5BF,"Intel Corporate",Lot 8 Jalan Hi-Tech 2/3  Kulim Kedah MY 09000
+MA-L,BADHEX,Bad Assignment,Nowhere
+`
+
+func TestParse(t *testing.T) {
+	vendors, err := oui.Parse(strings.NewReader(testRegistry))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[[3]byte]string{
+		{0xA8, 0x03, 0x2A}: "Espressif Inc.",
+		{0xF0, 0xD5, 0xBF}: "Intel Corporate",
+	}, vendors)
+}
+
+func TestDB_Vendor(t *testing.T) {
+	var reqNum atomic.Uint32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		reqNum.Add(1)
+		_, _ = w.Write([]byte(testRegistry))
+	}))
+	t.Cleanup(srv.Close)
+
+	cachePath := filepath.Join(t.TempDir(), "oui.csv")
+	newDB := func() (db *oui.DB) {
+		return oui.New(&oui.Config{
+			Client:    srv.Client(),
+			URL:       srv.URL,
+			CachePath: cachePath,
+		})
+	}
+
+	espressif := net.HardwareAddr{0xA8, 0x03, 0x2A, 0x01, 0x02, 0x03}
+	randomized := net.HardwareAddr{0xAA, 0x03, 0x2A, 0x01, 0x02, 0x03}
+
+	db := newDB()
+
+	// The first lookup only starts the download.
+	assert.Empty(t, db.Vendor(espressif))
+	require.Eventually(t, func() (ok bool) {
+		return db.Vendor(espressif) != ""
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "Espressif Inc.", db.Vendor(espressif))
+	assert.Empty(t, db.Vendor(randomized))
+	assert.Empty(t, db.Vendor(nil))
+	assert.Equal(t, uint32(1), reqNum.Load())
+
+	data, err := os.ReadFile(cachePath)
+	require.NoError(t, err)
+
+	assert.Equal(t, testRegistry, string(data))
+
+	t.Run("cached", func(t *testing.T) {
+		cached := newDB()
+		require.Eventually(t, func() (ok bool) {
+			return cached.Vendor(espressif) != ""
+		}, time.Second, 10*time.Millisecond)
+
+		assert.Equal(t, uint32(1), reqNum.Load())
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var nilDB *oui.DB
+		assert.Empty(t, nilDB.Vendor(espressif))
+	})
+}
@@ -0,0 +1,270 @@
+package querylog
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+	"golang.org/x/exp/slices"
+)
+
+// backend is a storage the query log entries are written to.
+type backend interface {
+	// write writes entries to the storage.  entries must not be modified.
+	write(entries []*logEntry) (err error)
+
+	// Closer closes the storage.
+	io.Closer
+}
+
+// Supported schemes of the DSNs of the external backends.
+const (
+	schemeClickHouse = "clickhouse"
+	schemePostgres   = "postgres"
+	schemePostgreSQL = "postgresql"
+)
+
+// defaultExternalTable is the default name of the table of the external
+// backends.
+const defaultExternalTable = "querylog"
+
+// tableNameRe matches the valid names of the tables of the external backends.
+// The names are inserted into SQL statements as is, so they mustn't contain any
+// special characters.
+var tableNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// newExternalBackend returns a new external backend for dsn.  The scheme of
+// dsn selects the database, either "clickhouse" or "postgres", the query
+// parameter "table" selects the table, which is created if necessary.  The
+// backends connect to the databases lazily, on the first write.  anonymizer
+// masks the client's IP addresses if needed.
+func newExternalBackend(dsn string, anonymizer *aghnet.IPMut) (b backend, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		// Don't wrap the error, since it may contain the password.
+		return nil, errors.Error("bad backend dsn")
+	}
+
+	q := u.Query()
+	table := q.Get("table")
+	if table == "" {
+		table = defaultExternalTable
+	} else if !tableNameRe.MatchString(table) {
+		return nil, fmt.Errorf("bad backend table name %q", table)
+	}
+
+	switch u.Scheme {
+	case schemeClickHouse:
+		return newClickHouseBackend(u, table, anonymizer)
+	case schemePostgres, schemePostgreSQL:
+		return newPostgresBackend(u, table, anonymizer)
+	default:
+		return nil, fmt.Errorf("unsupported backend scheme %q", u.Scheme)
+	}
+}
+
+// externalRow is the flat representation of a query log entry written to the
+// external backends.
+type externalRow struct {
+	Time        time.Time
+	ClientIP    string
+	ClientID    string
+	ClientProto string
+	Host        string
+	QType       string
+	QClass      string
+	Upstream    string
+	Status      string
+	Reason      string
+	Rule        string
+	Elapsed     time.Duration
+	FilterID    int64
+	Cached      bool
+	AD          bool
+	IsFiltered  bool
+}
+
+// newExternalRows converts entries into rows for the external backends.
+// anonymizer masks the client's IP addresses if needed.
+func newExternalRows(entries []*logEntry, anonymizer *aghnet.IPMut) (rows []*externalRow) {
+	anonFunc := anonymizer.Load()
+	rows = make([]*externalRow, 0, len(entries))
+	for _, e := range entries {
+		rows = append(rows, newExternalRow(e, anonFunc))
+	}
+
+	return rows
+}
+
+// newExternalRow converts e into a row for the external backends.  anonFunc
+// anonymizes the client's IP address.
+func newExternalRow(e *logEntry, anonFunc aghnet.IPMutFunc) (r *externalRow) {
+	ip := slices.Clone(e.IP)
+	anonFunc(ip)
+
+	r = &externalRow{
+		Time:        e.Time,
+		ClientIP:    ip.String(),
+		ClientID:    e.ClientID,
+		ClientProto: string(e.ClientProto),
+		Host:        e.QHost,
+		QType:       e.QType,
+		QClass:      e.QClass,
+		Upstream:    e.Upstream,
+		Reason:      e.Result.Reason.String(),
+		Elapsed:     e.Elapsed,
+		Cached:      e.Cached,
+		AD:          e.AuthenticatedData,
+		IsFiltered:  e.Result.IsFiltered,
+	}
+
+	if len(e.Result.Rules) > 0 {
+		rule := e.Result.Rules[0]
+		r.Rule, r.FilterID = rule.Text, rule.FilterListID
+	}
+
+	if len(e.Answer) > 0 {
+		msg := &dns.Msg{}
+		if err := msg.Unpack(e.Answer); err == nil {
+			r.Status = dns.RcodeToString[msg.Rcode]
+		}
+	}
+
+	return r
+}
+
+// Settings of the asynchronous writes to the external backends.
+const (
+	// asyncQueueSize is the maximum number of entries waiting to be written.
+	// The new entries are dropped when the queue is full.
+	asyncQueueSize = 10_000
+
+	// asyncBatchSize is the maximum number of entries written at once.
+	asyncBatchSize = 500
+
+	// asyncFlushIvl is the maximum time the entries wait before being written.
+	asyncFlushIvl = 1 * time.Second
+)
+
+// asyncBackend writes the entries to the underlying backend in batches from a
+// separate goroutine, so that a slow or unavailable database doesn't slow down
+// the processing of the DNS queries.
+type asyncBackend struct {
+	backend backend
+
+	// mu protects entries from being written to after closing.
+	mu *sync.RWMutex
+
+	// entries is the queue of the entries to write.
+	entries chan *logEntry
+
+	// done is closed when the writing goroutine exits.
+	done chan struct{}
+
+	// closed is true if the backend is closed.
+	closed bool
+}
+
+// newAsyncBackend returns a new properly initialized *asyncBackend and starts
+// its writing goroutine.
+func newAsyncBackend(b backend) (ab *asyncBackend) {
+	ab = &asyncBackend{
+		backend: b,
+		mu:      &sync.RWMutex{},
+		entries: make(chan *logEntry, asyncQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go ab.loop()
+
+	return ab
+}
+
+// add queues e for writing.  e must not be modified.
+func (ab *asyncBackend) add(e *logEntry) {
+	ab.mu.RLock()
+	defer ab.mu.RUnlock()
+
+	if ab.closed {
+		return
+	}
+
+	select {
+	case ab.entries <- e:
+		// Go on.
+	default:
+		log.Debug("querylog: external backend: queue is full, dropping entry")
+	}
+}
+
+// loop writes the queued entries in batches until the queue is closed.
+func (ab *asyncBackend) loop() {
+	defer log.OnPanic("querylog: external backend")
+	defer close(ab.done)
+
+	ticker := time.NewTicker(asyncFlushIvl)
+	defer ticker.Stop()
+
+	batch := make([]*logEntry, 0, asyncBatchSize)
+	for {
+		select {
+		case e, ok := <-ab.entries:
+			if !ok {
+				ab.flush(batch)
+
+				return
+			}
+
+			batch = append(batch, e)
+			if len(batch) < asyncBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			// Go on.
+		}
+
+		ab.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush writes batch to the backend.
+func (ab *asyncBackend) flush(batch []*logEntry) {
+	if len(batch) == 0 {
+		return
+	}
+
+	err := ab.backend.write(batch)
+	if err != nil {
+		log.Error("querylog: external backend: writing %d entries: %s", len(batch), err)
+	}
+}
+
+// type check
+var _ io.Closer = (*asyncBackend)(nil)
+
+// Close implements the [io.Closer] interface for *asyncBackend.  It writes the
+// remaining queued entries and closes the underlying backend.
+func (ab *asyncBackend) Close() (err error) {
+	ab.mu.Lock()
+	if ab.closed {
+		ab.mu.Unlock()
+
+		return nil
+	}
+
+	ab.closed = true
+	close(ab.entries)
+	ab.mu.Unlock()
+
+	<-ab.done
+
+	return ab.backend.Close()
+}
@@ -3,10 +3,15 @@ package querylog
 // Client is the information required by the query log to match against clients
 // during searches.
 type Client struct {
-	WHOIS          *ClientWHOIS `json:"whois,omitempty"`
-	Name           string       `json:"name"`
-	DisallowedRule string       `json:"disallowed_rule"`
-	Disallowed     bool         `json:"disallowed"`
+	WHOIS *ClientWHOIS `json:"whois,omitempty"`
+	Name  string       `json:"name"`
+
+	// NameSource is the source which the name has been obtained from.  It's
+	// empty if the name is unknown.
+	NameSource string `json:"name_source,omitempty"`
+
+	DisallowedRule string `json:"disallowed_rule"`
+	Disallowed     bool   `json:"disallowed"`
 }
 
 // ClientWHOIS is the filtered WHOIS data for the client.
@@ -0,0 +1,455 @@
+package querylog
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/slices"
+)
+
+// defaultCompareLimit is the default maximum number of the new and the
+// disappeared domains in the comparison of the query log time ranges.
+const defaultCompareLimit = 100
+
+// compareWindow is a time range of the query log compared to another one.
+type compareWindow struct {
+	// start is the beginning of the range.
+	start time.Time
+
+	// end is the end of the range, exclusive.
+	end time.Time
+}
+
+// contains returns true if t is within w.
+func (w compareWindow) contains(t time.Time) (ok bool) {
+	return !t.Before(w.start) && t.Before(w.end)
+}
+
+// clientSummary is the summary of the queries of a single client within a
+// [compareWindow].
+type clientSummary struct {
+	// domains are the queried hostnames.
+	domains map[string]struct{}
+
+	// name is the name of the client, if known.
+	name string
+
+	// queries is the number of the queries.
+	queries uint64
+
+	// blocked is the number of the filtered queries.
+	blocked uint64
+}
+
+// windowSummary is the summary of the query log entries within a
+// [compareWindow].
+type windowSummary struct {
+	// domains are the numbers of the queries by the queried hostnames.
+	domains map[string]uint64
+
+	// clients are the summaries of the clients by their ClientIDs or, if
+	// there are none, IP addresses.
+	clients map[string]*clientSummary
+
+	// window is the summarized time range.
+	window compareWindow
+
+	// total is the number of the queries.
+	total uint64
+}
+
+// newWindowSummary returns a new empty *windowSummary for w.
+func newWindowSummary(w compareWindow) (s *windowSummary) {
+	return &windowSummary{
+		domains: map[string]uint64{},
+		clients: map[string]*clientSummary{},
+		window:  w,
+	}
+}
+
+// add counts e, if it's within the window of s.
+func (s *windowSummary) add(e *logEntry) {
+	if !s.window.contains(e.Time) {
+		return
+	}
+
+	s.total++
+	s.domains[e.QHost]++
+
+	key := e.ClientID
+	if key == "" {
+		key = e.IP.String()
+	}
+
+	c, ok := s.clients[key]
+	if !ok {
+		c = &clientSummary{
+			domains: map[string]struct{}{},
+		}
+		s.clients[key] = c
+	}
+
+	if e.client != nil && e.client.Name != "" {
+		c.name = e.client.Name
+	}
+
+	c.domains[e.QHost] = struct{}{}
+	c.queries++
+	if e.Result.IsFiltered {
+		c.blocked++
+	}
+}
+
+// summarize collects the summaries of the query log entries within the
+// windows.
+func (l *queryLog) summarize(windows ...compareWindow) (sums []*windowSummary) {
+	oldest := time.Time{}
+	for _, w := range windows {
+		sums = append(sums, newWindowSummary(w))
+		if oldest.IsZero() || w.start.Before(oldest) {
+			oldest = w.start
+		}
+	}
+
+	add := func(e *logEntry) {
+		for _, s := range sums {
+			s.add(e)
+		}
+	}
+
+	cache := clientCache{}
+	l.summarizeFiles(oldest, cache, add)
+
+	l.bufferLock.Lock()
+	defer l.bufferLock.Unlock()
+
+	for _, e := range l.buffer {
+		e = e.shallowClone()
+
+		var err error
+		e.client, err = l.client(e.ClientID, e.IP.String(), cache)
+		if err != nil {
+			log.Debug("querylog: comparing: enriching memory record for %q: %s", e.IP, err)
+		}
+
+		add(e)
+	}
+
+	return sums
+}
+
+// summarizeFiles calls add for each entry from the log files not older than
+// oldest.
+func (l *queryLog) summarizeFiles(oldest time.Time, cache clientCache, add func(e *logEntry)) {
+	r, err := NewQLogReader([]string{l.file.path + ".1", l.file.path})
+	if err != nil {
+		log.Error("querylog: comparing: opening qlog reader: %s", err)
+
+		return
+	}
+	defer func() {
+		err = r.Close()
+		if err != nil {
+			log.Error("querylog: comparing: closing file: %s", err)
+		}
+	}()
+
+	err = r.SeekStart()
+	if err != nil {
+		log.Debug("querylog: comparing: seeking to start: %s", err)
+
+		return
+	}
+
+	params := newSearchParams()
+	oldestNano := oldest.UnixNano()
+	for {
+		var e *logEntry
+		var ts int64
+		e, ts, err = l.readNextEntry(r, params, cache)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			log.Error("querylog: comparing: reading next entry: %s", err)
+
+			return
+		}
+
+		// The entries are read from newer to older.
+		if ts != 0 && ts < oldestNano {
+			return
+		}
+
+		if e != nil {
+			add(e)
+		}
+	}
+}
+
+// domainCountJSON is the number of the queries for a domain.
+type domainCountJSON struct {
+	// Name is the queried hostname.
+	Name string `json:"name"`
+
+	// Count is the number of the queries within the time range.
+	Count uint64 `json:"count"`
+}
+
+// clientDeltaJSON is the change in the queries of a client between the time
+// ranges.
+type clientDeltaJSON struct {
+	// Client is the ClientID or the IP address of the client.
+	Client string `json:"client"`
+
+	// Name is the name of the client, if known.
+	Name string `json:"name,omitempty"`
+
+	// BaselineQueries and CurrentQueries are the numbers of the queries in
+	// the baseline and the current ranges.
+	BaselineQueries uint64 `json:"baseline_queries"`
+	CurrentQueries  uint64 `json:"current_queries"`
+
+	// QueriesDelta is the difference between CurrentQueries and
+	// BaselineQueries.
+	QueriesDelta int64 `json:"queries_delta"`
+
+	// BaselineBlocked and CurrentBlocked are the numbers of the filtered
+	// queries in the baseline and the current ranges.
+	BaselineBlocked uint64 `json:"baseline_blocked"`
+	CurrentBlocked  uint64 `json:"current_blocked"`
+
+	// BlockedDelta is the difference between CurrentBlocked and
+	// BaselineBlocked.
+	BlockedDelta int64 `json:"blocked_delta"`
+
+	// NewDomains is the number of the domains queried by the client in the
+	// current range, but not in the baseline one.
+	NewDomains int `json:"new_domains"`
+}
+
+// compareRangeJSON is a compared time range.
+type compareRangeJSON struct {
+	// Start is the beginning of the range.
+	Start time.Time `json:"start"`
+
+	// End is the end of the range, exclusive.
+	End time.Time `json:"end"`
+
+	// Total is the number of the queries within the range.
+	Total uint64 `json:"total"`
+}
+
+// compareJSON is the response to the GET /control/querylog/compare HTTP API.
+type compareJSON struct {
+	// Baseline and Current are the compared time ranges.
+	Baseline *compareRangeJSON `json:"baseline"`
+	Current  *compareRangeJSON `json:"current"`
+
+	// NewDomains are the domains queried in the current range, but not in
+	// the baseline one, the most queried first.
+	NewDomains []*domainCountJSON `json:"new_domains"`
+
+	// DisappearedDomains are the domains queried in the baseline range, but
+	// not in the current one, the most queried first.
+	DisappearedDomains []*domainCountJSON `json:"disappeared_domains"`
+
+	// Clients are the changes of the clients, the ones with the largest
+	// change in the number of the queries first.
+	Clients []*clientDeltaJSON `json:"clients"`
+}
+
+// newCompareRangeJSON returns the JSON representation of the range of s.
+func newCompareRangeJSON(s *windowSummary) (r *compareRangeJSON) {
+	return &compareRangeJSON{
+		Start: s.window.start,
+		End:   s.window.end,
+		Total: s.total,
+	}
+}
+
+// compareSummaries returns the comparison of the current summary with the
+// baseline one.  limit is the maximum number of the new and the disappeared
+// domains.
+func compareSummaries(baseline, current *windowSummary, limit int) (resp *compareJSON) {
+	return &compareJSON{
+		Baseline:           newCompareRangeJSON(baseline),
+		Current:            newCompareRangeJSON(current),
+		NewDomains:         subtractDomains(current.domains, baseline.domains, limit),
+		DisappearedDomains: subtractDomains(baseline.domains, current.domains, limit),
+		Clients:            clientDeltas(baseline.clients, current.clients),
+	}
+}
+
+// subtractDomains returns at most limit domains from a, which are absent in b,
+// the most queried first.
+func subtractDomains(a, b map[string]uint64, limit int) (diff []*domainCountJSON) {
+	diff = []*domainCountJSON{}
+	for name, count := range a {
+		if _, ok := b[name]; !ok {
+			diff = append(diff, &domainCountJSON{
+				Name:  name,
+				Count: count,
+			})
+		}
+	}
+
+	slices.SortFunc(diff, func(x, y *domainCountJSON) (less bool) {
+		if x.Count != y.Count {
+			return x.Count > y.Count
+		}
+
+		return x.Name < y.Name
+	})
+
+	if len(diff) > limit {
+		diff = diff[:limit]
+	}
+
+	return diff
+}
+
+// clientDeltas returns the changes of the clients between the baseline and the
+// current summaries, the ones with the largest change in the number of the
+// queries first.
+func clientDeltas(baseline, current map[string]*clientSummary) (deltas []*clientDeltaJSON) {
+	deltas = []*clientDeltaJSON{}
+	empty := &clientSummary{}
+	keys := map[string]struct{}{}
+	for k := range baseline {
+		keys[k] = struct{}{}
+	}
+
+	for k := range current {
+		keys[k] = struct{}{}
+	}
+
+	for k := range keys {
+		b, c := baseline[k], current[k]
+		if b == nil {
+			b = empty
+		}
+
+		if c == nil {
+			c = empty
+		}
+
+		d := &clientDeltaJSON{
+			Client:          k,
+			Name:            c.name,
+			BaselineQueries: b.queries,
+			CurrentQueries:  c.queries,
+			QueriesDelta:    int64(c.queries) - int64(b.queries),
+			BaselineBlocked: b.blocked,
+			CurrentBlocked:  c.blocked,
+			BlockedDelta:    int64(c.blocked) - int64(b.blocked),
+		}
+
+		if d.Name == "" {
+			d.Name = b.name
+		}
+
+		for host := range c.domains {
+			if _, ok := b.domains[host]; !ok {
+				d.NewDomains++
+			}
+		}
+
+		deltas = append(deltas, d)
+	}
+
+	slices.SortFunc(deltas, func(x, y *clientDeltaJSON) (less bool) {
+		dx, dy := absInt64(x.QueriesDelta), absInt64(y.QueriesDelta)
+		if dx != dy {
+			return dx > dy
+		}
+
+		return x.Client < y.Client
+	})
+
+	return deltas
+}
+
+// absInt64 returns the absolute value of n.
+func absInt64(n int64) (abs int64) {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
+
+// parseCompareWindow parses the bounds of the time range with the prefix from
+// q.
+func parseCompareWindow(q url.Values, prefix string) (w compareWindow, err error) {
+	for _, b := range []struct {
+		t    *time.Time
+		name string
+	}{{
+		t:    &w.start,
+		name: prefix + "_start",
+	}, {
+		t:    &w.end,
+		name: prefix + "_end",
+	}} {
+		*b.t, err = time.Parse(time.RFC3339Nano, q.Get(b.name))
+		if err != nil {
+			return compareWindow{}, fmt.Errorf("parsing %s: %w", b.name, err)
+		}
+	}
+
+	if !w.start.Before(w.end) {
+		return compareWindow{}, fmt.Errorf("%s_start must be before %[1]s_end", prefix)
+	}
+
+	return w, nil
+}
+
+// handleQueryLogCompare is the handler for the GET /control/querylog/compare
+// HTTP API.  It compares the queries within the current time range with the
+// ones within the baseline time range.
+func (l *queryLog) handleQueryLogCompare(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	baseline, err := parseCompareWindow(q, "baseline")
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	current, err := parseCompareWindow(q, "current")
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	limit := defaultCompareLimit
+	if limitStr := q.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			aghhttp.Error(r, w, http.StatusBadRequest, "bad limit %q", limitStr)
+
+			return
+		}
+	}
+
+	sums := func() (sums []*windowSummary) {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		return l.summarize(baseline, current)
+	}()
+
+	resp := compareSummaries(sums[0], sums[1], limit)
+	if l.redaction(r).Client {
+		resp.Clients = []*clientDeltaJSON{}
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, resp)
+}
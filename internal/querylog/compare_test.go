@@ -0,0 +1,122 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_handleQueryLogCompare(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	now := time.Now().Truncate(time.Second)
+	cli1, cli2 := net.IPv4(2, 2, 2, 1), net.IPv4(2, 2, 2, 2)
+	answer := net.IPv4(1, 1, 1, 1)
+
+	addAt := func(host string, client net.IP, t time.Time) {
+		addEntry(l, host, answer, client)
+		l.buffer[len(l.buffer)-1].Time = t
+	}
+
+	// Add the disk entries.
+	addAt("ancient.example", cli1, now.Add(-3*time.Hour))
+	addAt("old.example", cli1, now.Add(-110*time.Minute))
+	addAt("both.example", cli1, now.Add(-100*time.Minute))
+	addAt("both.example", cli1, now.Add(-50*time.Minute))
+	require.NoError(t, l.flushLogBuffer(true))
+
+	// Add the memory entries.
+	addAt("new.example", cli2, now.Add(-10*time.Minute))
+	addAt("new.example", cli1, now.Add(-5*time.Minute))
+
+	compare := func(t *testing.T, q url.Values) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		u := &url.URL{
+			Scheme:   "http",
+			Host:     "example.org",
+			Path:     "/control/querylog/compare",
+			RawQuery: q.Encode(),
+		}
+
+		r := httptest.NewRequest(http.MethodGet, u.String(), nil)
+		w = httptest.NewRecorder()
+		l.handleQueryLogCompare(w, r)
+
+		return w
+	}
+
+	q := url.Values{
+		"baseline_start": []string{now.Add(-2 * time.Hour).Format(time.RFC3339)},
+		"baseline_end":   []string{now.Add(-time.Hour).Format(time.RFC3339)},
+		"current_start":  []string{now.Add(-time.Hour).Format(time.RFC3339)},
+		"current_end":    []string{now.Format(time.RFC3339)},
+	}
+
+	w := compare(t, q)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &compareJSON{}
+	err := json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(2), resp.Baseline.Total)
+	assert.Equal(t, uint64(3), resp.Current.Total)
+	assert.Equal(t, []*domainCountJSON{{Name: "new.example", Count: 2}}, resp.NewDomains)
+	assert.Equal(t, []*domainCountJSON{{Name: "old.example", Count: 1}}, resp.DisappearedDomains)
+
+	assert.Equal(t, []*clientDeltaJSON{{
+		Client:          cli2.String(),
+		BaselineQueries: 0,
+		CurrentQueries:  1,
+		QueriesDelta:    1,
+		BaselineBlocked: 0,
+		CurrentBlocked:  1,
+		BlockedDelta:    1,
+		NewDomains:      1,
+	}, {
+		Client:          cli1.String(),
+		BaselineQueries: 2,
+		CurrentQueries:  2,
+		QueriesDelta:    0,
+		BaselineBlocked: 2,
+		CurrentBlocked:  2,
+		BlockedDelta:    0,
+		NewDomains:      1,
+	}}, resp.Clients)
+
+	t.Run("bad_range", func(t *testing.T) {
+		badQ := url.Values{}
+		for k, v := range q {
+			badQ[k] = v
+		}
+
+		badQ.Set("current_end", badQ.Get("current_start"))
+
+		assert.Equal(t, http.StatusBadRequest, compare(t, badQ).Code)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		limitQ := url.Values{}
+		for k, v := range q {
+			limitQ[k] = v
+		}
+
+		limitQ.Set("limit", "0")
+		assert.Equal(t, http.StatusBadRequest, compare(t, limitQ).Code)
+	})
+}
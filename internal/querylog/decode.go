@@ -109,6 +109,17 @@ var logEntryHandlers = map[string]logEntryHandler{
 
 		return err
 	},
+	"FR": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		var err error
+		ent.FullResponse, err = base64.StdEncoding.DecodeString(v)
+
+		return err
+	},
 	"ECS": func(t json.Token, ent *logEntry) error {
 		v, ok := t.(string)
 		if !ok {
@@ -175,6 +186,16 @@ var resultHandlers = map[string]logEntryHandler{
 		ent.Result.IsFiltered = v
 		return nil
 	},
+	"DryRun": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(bool)
+		if !ok {
+			return nil
+		}
+
+		ent.Result.DryRun = v
+
+		return nil
+	},
 	"Rule": func(t json.Token, ent *logEntry) error {
 		s, ok := t.(string)
 		if !ok {
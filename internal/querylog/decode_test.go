@@ -38,6 +38,7 @@ func TestDecodeLogEntry(t *testing.T) {
 			`"AD":true,` +
 			`"Result":{` +
 			`"IsFiltered":true,` +
+			`"DryRun":true,` +
 			`"Reason":3,` +
 			`"IPList":["127.0.0.2"],` +
 			`"Rules":[{"FilterListID":42,"Text":"||an.yandex.ru","IP":"127.0.0.2"},` +
@@ -83,6 +84,7 @@ func TestDecodeLogEntry(t *testing.T) {
 				}},
 				Reason:     filtering.FilteredBlockList,
 				IsFiltered: true,
+				DryRun:     true,
 			},
 			Upstream:          "https://some.upstream",
 			Elapsed:           837429,
@@ -0,0 +1,199 @@
+package querylog
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// maxFullResponseSize is the maximum size of the unpacked full response.  It
+// is the maximum size of a DNS message.
+const maxFullResponseSize = dns.MaxMsgSize
+
+// packFullResponse returns the compressed wire form of the original response,
+// which is orig if it's not nil, and resp otherwise.  data is nil if both are
+// nil.
+func packFullResponse(orig, resp *dns.Msg) (data []byte, err error) {
+	msg := orig
+	if msg == nil {
+		msg = resp
+	}
+
+	if msg == nil {
+		return nil, nil
+	}
+
+	msg = msg.Copy()
+	msg.Compress = true
+
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing: %w", err)
+	}
+
+	buf := &bytes.Buffer{}
+
+	// Don't check the error, since it's only returned for an invalid level.
+	fw, _ := flate.NewWriter(buf, flate.BestSpeed)
+	_, err = fw.Write(packed)
+	if err != nil {
+		return nil, fmt.Errorf("compressing: %w", err)
+	}
+
+	err = fw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("compressing: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// unpackFullResponse decodes the response stored by packFullResponse.
+func unpackFullResponse(data []byte) (msg *dns.Msg, err error) {
+	fr := flate.NewReader(bytes.NewReader(data))
+	defer func() { err = errors.WithDeferred(err, fr.Close()) }()
+
+	packed, err := io.ReadAll(io.LimitReader(fr, maxFullResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing: %w", err)
+	} else if len(packed) > maxFullResponseSize {
+		return nil, fmt.Errorf("decompressing: message is larger than %d bytes", maxFullResponseSize)
+	}
+
+	msg = &dns.Msg{}
+	err = msg.Unpack(packed)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking: %w", err)
+	}
+
+	return msg, nil
+}
+
+// entryID returns the identifier of the log entry for the HTTP API.  It's the
+// entry's time in Unix nanoseconds, since it's unique enough and allows
+// looking the entry up in the files using a binary search.
+func entryID(e *logEntry) (id string) {
+	return strconv.FormatInt(e.Time.UnixNano(), 10)
+}
+
+// findEntry returns the log entry with the time in Unix nanoseconds equal to
+// ts.  e is nil if there is no such entry.
+func (l *queryLog) findEntry(ts int64) (e *logEntry, err error) {
+	l.bufferLock.RLock()
+	for _, be := range l.buffer {
+		if be.Time.UnixNano() == ts {
+			e = be
+		}
+	}
+	l.bufferLock.RUnlock()
+
+	if e != nil {
+		return e, nil
+	}
+
+	r, err := NewQLogReader([]string{l.file.path + ".1", l.file.path})
+	if err != nil {
+		return nil, fmt.Errorf("opening qlog reader: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, r.Close()) }()
+
+	err = r.seekTS(ts)
+	if errors.Is(err, ErrTSNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("seeking: %w", err)
+	}
+
+	line, err := r.ReadNext()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+
+	// The reader may have been moved to the start of the log, if ts is newer
+	// than all the records in the files, so check the timestamp.
+	if readQLogTimestamp(line) != ts {
+		return nil, nil
+	}
+
+	e = &logEntry{}
+	decodeLogEntry(e, line)
+
+	return e, nil
+}
+
+// fullResponseJSON is the JSON structure for the complete response of a log
+// entry.
+type fullResponseJSON struct {
+	Status     string       `json:"status"`
+	Answer     []*dnsAnswer `json:"answer"`
+	Authority  []*dnsAnswer `json:"authority"`
+	Additional []*dnsAnswer `json:"additional"`
+}
+
+// handleQueryLogEntryAnswer handles the GET /control/querylog/{id}/answer
+// queries.
+func (l *queryLog) handleQueryLogEntryAnswer(w http.ResponseWriter, r *http.Request) {
+	const suffix = "/answer"
+
+	idStr := strings.TrimPrefix(r.URL.Path, "/control/querylog/")
+	if !strings.HasSuffix(idStr, suffix) {
+		aghhttp.Error(r, w, http.StatusNotFound, "not found")
+
+		return
+	}
+
+	ts, err := strconv.ParseInt(strings.TrimSuffix(idStr, suffix), 10, 64)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad entry id: %s", err)
+
+		return
+	}
+
+	if l.redaction(r).Answer {
+		aghhttp.Error(r, w, http.StatusForbidden, "answers are hidden")
+
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	e, err := l.findEntry(ts)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "finding entry: %s", err)
+
+		return
+	} else if e == nil {
+		aghhttp.Error(r, w, http.StatusNotFound, "entry %d not found", ts)
+
+		return
+	} else if len(e.FullResponse) == 0 {
+		aghhttp.Error(r, w, http.StatusNotFound, "full response of entry %d is not stored", ts)
+
+		return
+	}
+
+	msg, err := unpackFullResponse(e.FullResponse)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "decoding full response: %s", err)
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, &fullResponseJSON{
+		Status:     dns.RcodeToString[msg.Rcode],
+		Answer:     rrsToJSON(msg.Answer),
+		Authority:  rrsToJSON(msg.Ns),
+		Additional: rrsToJSON(msg.Extra),
+	})
+}
@@ -0,0 +1,143 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// addFullEntry adds an entry with the full response for host to l and returns
+// its ID.
+func addFullEntry(t *testing.T, l *queryLog, host string) (id string) {
+	t.Helper()
+
+	q := &dns.Msg{}
+	q.SetQuestion(host+".", dns.TypeA)
+
+	resp := &dns.Msg{}
+	resp.SetRcode(q, dns.RcodeNameError)
+	resp.Ns = []dns.RR{&dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   host + ".",
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    10,
+		},
+		Ns:      "ns.example.",
+		Mbox:    "hostmaster.example.",
+		Serial:  1,
+		Refresh: 2,
+		Retry:   3,
+		Expire:  4,
+		Minttl:  5,
+	}}
+	resp.Extra = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   host + ".",
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    10,
+		},
+		Txt: []string{"extra"},
+	}}
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+
+	l.Add(&AddParams{
+		Question: q,
+		Answer:   resp,
+		ClientIP: net.IP{1, 2, 3, 4},
+	})
+
+	l.bufferLock.RLock()
+	defer l.bufferLock.RUnlock()
+
+	require.NotEmpty(t, l.buffer)
+
+	return entryID(l.buffer[len(l.buffer)-1])
+}
+
+func TestQueryLog_handleQueryLogEntryAnswer(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:      true,
+		FileEnabled:  true,
+		FullResponse: true,
+		RotationIvl:  timeutil.Day,
+		MemSize:      100,
+		BaseDir:      t.TempDir(),
+	})
+
+	fileID := addFullEntry(t, l, "file.example")
+	require.NoError(t, l.flushLogBuffer(true))
+
+	memID := addFullEntry(t, l, "memory.example")
+
+	l.conf.FullResponse = false
+	notStoredID := addFullEntry(t, l, "not-stored.example")
+
+	testCases := []struct {
+		name     string
+		path     string
+		wantCode int
+	}{{
+		name:     "file",
+		path:     "/control/querylog/" + fileID + "/answer",
+		wantCode: http.StatusOK,
+	}, {
+		name:     "memory",
+		path:     "/control/querylog/" + memID + "/answer",
+		wantCode: http.StatusOK,
+	}, {
+		name:     "not_stored",
+		path:     "/control/querylog/" + notStoredID + "/answer",
+		wantCode: http.StatusNotFound,
+	}, {
+		name:     "not_found",
+		path:     "/control/querylog/1/answer",
+		wantCode: http.StatusNotFound,
+	}, {
+		name:     "bad_id",
+		path:     "/control/querylog/bad/answer",
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "bad_path",
+		path:     "/control/querylog/" + memID,
+		wantCode: http.StatusNotFound,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			w := httptest.NewRecorder()
+
+			l.handleQueryLogEntryAnswer(w, r)
+			require.Equal(t, tc.wantCode, w.Code)
+
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+
+			resp := &fullResponseJSON{}
+			err := json.NewDecoder(w.Body).Decode(resp)
+			require.NoError(t, err)
+
+			assert.Equal(t, "NXDOMAIN", resp.Status)
+			assert.Empty(t, resp.Answer)
+
+			require.Len(t, resp.Authority, 1)
+			assert.Equal(t, "SOA", resp.Authority[0].Type)
+			assert.Equal(t, "ns.example. hostmaster.example. 1 2 3 4 5", resp.Authority[0].Value)
+
+			// The OPT pseudo-record must be skipped.
+			require.Len(t, resp.Additional, 1)
+			assert.Equal(t, "TXT", resp.Additional[0].Type)
+			assert.Equal(t, `"extra"`, resp.Additional[0].Value)
+		})
+	}
+}
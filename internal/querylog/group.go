@@ -0,0 +1,64 @@
+package querylog
+
+import "time"
+
+// maxGroupWindow is the maximum window for grouping the repeated queries.
+const maxGroupWindow = 24 * time.Hour
+
+// entryGroup is a group of the log entries of the same query from the same
+// client.
+type entryGroup struct {
+	// newest is the newest entry of the group, which represents it.
+	newest *logEntry
+
+	// oldest is the time of the oldest entry of the group.
+	oldest time.Time
+
+	// count is the number of the entries in the group.
+	count int
+}
+
+// entryGroupKey is the key identifying the entries of the same query from the
+// same client.
+type entryGroupKey struct {
+	clientID string
+	ip       string
+	qHost    string
+	qType    string
+}
+
+// groupEntries collapses the entries of the same query from the same client
+// into groups, each spanning no more than window from its newest entry.
+// entries must be sorted from newer to older, and so are the groups by their
+// newest entries.  The entries of other queries between the grouped ones don't
+// split the group.
+func groupEntries(entries []*logEntry, window time.Duration) (groups []*entryGroup) {
+	groups = make([]*entryGroup, 0, len(entries))
+	open := map[entryGroupKey]*entryGroup{}
+	for _, e := range entries {
+		k := entryGroupKey{
+			clientID: e.ClientID,
+			ip:       e.IP.String(),
+			qHost:    e.QHost,
+			qType:    e.QType,
+		}
+
+		g, ok := open[k]
+		if ok && g.newest.Time.Sub(e.Time) <= window {
+			g.oldest = e.Time
+			g.count++
+
+			continue
+		}
+
+		g = &entryGroup{
+			newest: e,
+			oldest: e.Time,
+			count:  1,
+		}
+		open[k] = g
+		groups = append(groups, g)
+	}
+
+	return groups
+}
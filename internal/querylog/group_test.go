@@ -0,0 +1,82 @@
+package querylog
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupEntries(t *testing.T) {
+	const window = 10 * time.Second
+
+	now := time.Now()
+	newEntry := func(ago time.Duration, ip net.IP, host, qtype string) (e *logEntry) {
+		return &logEntry{
+			Time:  now.Add(-ago),
+			QHost: host,
+			QType: qtype,
+			IP:    ip,
+		}
+	}
+
+	device := net.IP{192, 168, 0, 2}
+	other := net.IP{192, 168, 0, 3}
+
+	entries := []*logEntry{
+		newEntry(0, device, "iot.example", "A"),
+		newEntry(1*time.Second, other, "iot.example", "A"),
+		newEntry(2*time.Second, device, "iot.example", "A"),
+		newEntry(3*time.Second, device, "iot.example", "AAAA"),
+		newEntry(4*time.Second, device, "iot.example", "A"),
+		newEntry(10*time.Second, device, "iot.example", "A"),
+		newEntry(11*time.Second, device, "iot.example", "A"),
+		newEntry(12*time.Second, device, "other.example", "A"),
+	}
+
+	groups := groupEntries(entries, window)
+	require.Len(t, groups, 5)
+
+	testCases := []struct {
+		wantNewest *logEntry
+		wantOldest time.Time
+		name       string
+		wantCount  int
+	}{{
+		wantNewest: entries[0],
+		wantOldest: entries[5].Time,
+		name:       "repeated",
+		wantCount:  4,
+	}, {
+		wantNewest: entries[1],
+		wantOldest: entries[1].Time,
+		name:       "other_client",
+		wantCount:  1,
+	}, {
+		wantNewest: entries[3],
+		wantOldest: entries[3].Time,
+		name:       "other_qtype",
+		wantCount:  1,
+	}, {
+		wantNewest: entries[6],
+		wantOldest: entries[6].Time,
+		name:       "outside_window",
+		wantCount:  1,
+	}, {
+		wantNewest: entries[7],
+		wantOldest: entries[7].Time,
+		name:       "other_host",
+		wantCount:  1,
+	}}
+
+	for i, tc := range testCases {
+		g := groups[i]
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantNewest, g.newest)
+			assert.Equal(t, tc.wantOldest, g.oldest)
+			assert.Equal(t, tc.wantCount, g.count)
+		})
+	}
+}
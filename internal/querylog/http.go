@@ -38,12 +38,18 @@ type configJSON struct {
 // Register web handlers
 func (l *queryLog) initWeb() {
 	l.conf.HTTPRegister(http.MethodGet, "/control/querylog", l.handleQueryLog)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/stream", l.handleQueryLogStream)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/compare", l.handleQueryLogCompare)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/", l.handleQueryLogEntryAnswer)
 	l.conf.HTTPRegister(http.MethodGet, "/control/querylog_info", l.handleQueryLogInfo)
 	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_clear", l.handleQueryLogClear)
 	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_config", l.handleQueryLogConfig)
+	l.conf.HTTPRegister(http.MethodPost, "/control/querylog/flush", l.handleQueryLogFlush)
 }
 
 func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
+	red := l.redaction(r)
+
 	l.lock.Lock()
 	defer l.lock.Unlock()
 
@@ -55,7 +61,13 @@ func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 	}
 
 	entries, oldest := l.search(params)
-	data := l.entriesToJSON(entries, oldest)
+
+	var data jobject
+	if params.groupWindow > 0 {
+		data = l.groupsToJSON(groupEntries(entries, params.groupWindow), oldest, red)
+	} else {
+		data = l.entriesToJSON(entries, oldest, red)
+	}
 
 	_ = aghhttp.WriteJSONResponse(w, r, data)
 }
@@ -64,6 +76,16 @@ func (l *queryLog) handleQueryLogClear(_ http.ResponseWriter, _ *http.Request) {
 	l.clear()
 }
 
+// handleQueryLogFlush is the handler for the POST /control/querylog/flush HTTP
+// API.  It writes the buffered entries to the file regardless of the buffer
+// size and the flush interval.
+func (l *queryLog) handleQueryLogFlush(w http.ResponseWriter, r *http.Request) {
+	err := l.flushLogBuffer(true)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "flushing query log: %s", err)
+	}
+}
+
 // Get configuration
 func (l *queryLog) handleQueryLogInfo(w http.ResponseWriter, r *http.Request) {
 	_ = aghhttp.WriteJSONResponse(w, r, configJSON{
@@ -198,9 +220,12 @@ func (l *queryLog) parseSearchCriterion(q url.Values, name string, ct criterionT
 	return true, sc, nil
 }
 
-// parseSearchParams - parses "searchParams" from the HTTP request's query string
+// parseSearchParams - parses "searchParams" from the HTTP request's query
+// string.  The search terms aren't matched against the fields hidden from the
+// user making r.
 func (l *queryLog) parseSearchParams(r *http.Request) (p *searchParams, err error) {
 	p = newSearchParams()
+	red := l.redaction(r)
 
 	q := r.URL.Query()
 	olderThan := q.Get("older_than")
@@ -225,6 +250,19 @@ func (l *queryLog) parseSearchParams(r *http.Request) (p *searchParams, err erro
 		p.maxFileScanEntries = 0
 	}
 
+	if groupWindow := q.Get("group_window"); groupWindow != "" {
+		p.groupWindow, err = time.ParseDuration(groupWindow)
+		if err != nil {
+			return nil, fmt.Errorf("group_window: %w", err)
+		} else if p.groupWindow <= 0 || p.groupWindow > maxGroupWindow {
+			return nil, fmt.Errorf(
+				"group_window: %s out of range: must be positive and at most %s",
+				p.groupWindow,
+				maxGroupWindow,
+			)
+		}
+	}
+
 	for _, v := range []struct {
 		urlField string
 		ct       criterionType
@@ -243,6 +281,7 @@ func (l *queryLog) parseSearchParams(r *http.Request) (p *searchParams, err erro
 		}
 
 		if ok {
+			c.domainOnly = c.criterionType == ctTerm && red.Client
 			p.searchCriteria = append(p.searchCriteria, c)
 		}
 	}
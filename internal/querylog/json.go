@@ -18,16 +18,48 @@ import (
 // jobject is a JSON object alias.
 type jobject = map[string]any
 
-// entriesToJSON converts query log entries to JSON.
-func (l *queryLog) entriesToJSON(entries []*logEntry, oldest time.Time) (res jobject) {
+// entriesToJSON converts query log entries to JSON.  The fields hidden by red
+// are removed.
+func (l *queryLog) entriesToJSON(
+	entries []*logEntry,
+	oldest time.Time,
+	red Redaction,
+) (res jobject) {
 	data := make([]jobject, 0, len(entries))
 
 	// The elements order is already reversed to be from newer to older.
 	for _, entry := range entries {
-		jsonEntry := l.entryToJSON(entry, l.anonymizer.Load())
+		jsonEntry := l.entryToJSON(entry, l.anonymizer.Load(), red)
 		data = append(data, jsonEntry)
 	}
 
+	return searchResultJSON(data, oldest)
+}
+
+// groupsToJSON converts the groups of query log entries to JSON.  Each group is
+// represented by its newest entry with the additional "count" and "oldest_time"
+// fields.  The fields hidden by red are removed.
+func (l *queryLog) groupsToJSON(
+	groups []*entryGroup,
+	oldest time.Time,
+	red Redaction,
+) (res jobject) {
+	data := make([]jobject, 0, len(groups))
+
+	anonFunc := l.anonymizer.Load()
+	for _, g := range groups {
+		jsonEntry := l.entryToJSON(g.newest, anonFunc, red)
+		jsonEntry["count"] = g.count
+		jsonEntry["oldest_time"] = g.oldest.Format(time.RFC3339Nano)
+		data = append(data, jsonEntry)
+	}
+
+	return searchResultJSON(data, oldest)
+}
+
+// searchResultJSON returns the response of the query log search API with data
+// and the time of the oldest processed entry.
+func searchResultJSON(data []jobject, oldest time.Time) (res jobject) {
 	res = jobject{
 		"data":   data,
 		"oldest": "",
@@ -39,8 +71,13 @@ func (l *queryLog) entriesToJSON(entries []*logEntry, oldest time.Time) (res job
 	return res
 }
 
-// entryToJSON converts a log entry's data into an entry for the JSON API.
-func (l *queryLog) entryToJSON(entry *logEntry, anonFunc aghnet.IPMutFunc) (jsonEntry jobject) {
+// entryToJSON converts a log entry's data into an entry for the JSON API.  The
+// fields hidden by red are removed.
+func (l *queryLog) entryToJSON(
+	entry *logEntry,
+	anonFunc aghnet.IPMutFunc,
+	red Redaction,
+) (jsonEntry jobject) {
 	hostname := entry.QHost
 	question := jobject{
 		"type":  entry.QType,
@@ -58,6 +95,7 @@ func (l *queryLog) entryToJSON(entry *logEntry, anonFunc aghnet.IPMutFunc) (json
 	anonFunc(entIP)
 
 	jsonEntry = jobject{
+		"id":           entryID(entry),
 		"reason":       entry.Result.Reason.String(),
 		"elapsedMs":    strconv.FormatFloat(entry.Elapsed.Seconds()*1000, 'f', -1, 64),
 		"time":         entry.Time.Format(time.RFC3339Nano),
@@ -92,9 +130,15 @@ func (l *queryLog) entryToJSON(entry *logEntry, anonFunc aghnet.IPMutFunc) (json
 		jsonEntry["service_name"] = entry.Result.ServiceName
 	}
 
+	if entry.Result.DryRun {
+		jsonEntry["dry_run"] = true
+	}
+
 	l.setMsgData(entry, jsonEntry)
 	l.setOrigAns(entry, jsonEntry)
 
+	red.redact(jsonEntry, entry.Result.Reason)
+
 	return jsonEntry
 }
 
@@ -160,13 +204,27 @@ type dnsAnswer struct {
 
 // answerToJSON converts the answer records of msg, if any, to their JSON form.
 func answerToJSON(msg *dns.Msg) (answers []*dnsAnswer) {
-	if msg == nil || len(msg.Answer) == 0 {
+	if msg == nil {
+		return nil
+	}
+
+	return rrsToJSON(msg.Answer)
+}
+
+// rrsToJSON converts the resource records, if any, to their JSON form.  The OPT
+// pseudo-records are skipped.
+func rrsToJSON(rrs []dns.RR) (answers []*dnsAnswer) {
+	if len(rrs) == 0 {
 		return nil
 	}
 
-	answers = make([]*dnsAnswer, 0, len(msg.Answer))
-	for _, rr := range msg.Answer {
+	answers = make([]*dnsAnswer, 0, len(rrs))
+	for _, rr := range rrs {
 		header := rr.Header()
+		if header.Rrtype == dns.TypeOPT {
+			continue
+		}
+
 		a := &dnsAnswer{
 			Type: dns.TypeToString[header.Rrtype],
 			// Remove the header string from the answer value since it's mostly
@@ -0,0 +1,601 @@
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The frontend and backend message types of the PostgreSQL protocol, see
+// https://www.postgresql.org/docs/current/protocol-message-formats.html.
+const (
+	pgMsgAuth          byte = 'R'
+	pgMsgBind          byte = 'B'
+	pgMsgError         byte = 'E'
+	pgMsgExecute       byte = 'E'
+	pgMsgParse         byte = 'P'
+	pgMsgPassword      byte = 'p'
+	pgMsgQuery         byte = 'Q'
+	pgMsgReadyForQuery byte = 'Z'
+	pgMsgSync          byte = 'S'
+	pgMsgTerminate     byte = 'X'
+)
+
+// The authentication request codes of the PostgreSQL protocol.
+const (
+	pgAuthOK           = 0
+	pgAuthCleartext    = 3
+	pgAuthMD5          = 5
+	pgAuthSASL         = 10
+	pgAuthSASLContinue = 11
+	pgAuthSASLFinal    = 12
+)
+
+const (
+	// pgProtoVersion is the version 3.0 of the PostgreSQL protocol.
+	pgProtoVersion = 3 << 16
+
+	// pgSSLRequestCode is the code of the SSLRequest message.
+	pgSSLRequestCode = 80877103
+
+	// pgMaxMsgLen is the maximum length of the received messages.
+	pgMaxMsgLen = 1 << 24
+
+	// pgSCRAMSHA256 is the name of the only supported SASL mechanism.
+	pgSCRAMSHA256 = "SCRAM-SHA-256"
+)
+
+// pgErrNotSSL is returned when the server refuses an SSL connection.
+const pgErrNotSSL errors.Error = "server does not support ssl"
+
+// pgError is an ErrorResponse message of the PostgreSQL protocol.
+type pgError struct {
+	severity string
+	code     string
+	message  string
+}
+
+// type check
+var _ error = (*pgError)(nil)
+
+// Error implements the [error] interface for *pgError.
+func (err *pgError) Error() (msg string) {
+	return fmt.Sprintf("%s: %s (sqlstate %s)", err.severity, err.message, err.code)
+}
+
+// parsePGError parses the payload of an ErrorResponse message.
+func parsePGError(payload []byte) (err *pgError) {
+	err = &pgError{}
+	for len(payload) > 1 {
+		field := payload[0]
+		val, rest, _ := bytes.Cut(payload[1:], []byte{0})
+		payload = rest
+
+		switch field {
+		case 'S':
+			err.severity = string(val)
+		case 'C':
+			err.code = string(val)
+		case 'M':
+			err.message = string(val)
+		}
+	}
+
+	return err
+}
+
+// pgConnConfig is the configuration of a PostgreSQL connection.
+type pgConnConfig struct {
+	// tlsConf is the TLS configuration of the connection.  If it's nil, TLS
+	// isn't used.
+	tlsConf *tls.Config
+
+	addr     string
+	user     string
+	password string
+	database string
+
+	// timeout is the timeout of both connecting and each query.
+	timeout time.Duration
+}
+
+// pgConn is a minimal PostgreSQL client connection supporting the simple and
+// the unnamed extended queries with text parameters.  It's not safe for
+// concurrent use.
+type pgConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// buf is the buffer of the messages to send.
+	buf *bytes.Buffer
+
+	timeout time.Duration
+
+	// lenPos is the position of the length of the last message in buf.
+	lenPos int
+}
+
+// dialPG connects to the PostgreSQL server and authenticates.
+func dialPG(conf *pgConnConfig) (c *pgConn, err error) {
+	conn, err := net.DialTimeout("tcp", conf.addr, conf.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c = &pgConn{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		buf:     &bytes.Buffer{},
+		timeout: conf.timeout,
+	}
+
+	err = c.startup(conf)
+	if err != nil {
+		return nil, errors.WithDeferred(err, conn.Close())
+	}
+
+	return c, nil
+}
+
+// startup negotiates TLS, if needed, and sends the startup message.
+func (c *pgConn) startup(conf *pgConnConfig) (err error) {
+	err = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	if conf.tlsConf != nil {
+		err = c.startTLS(conf.tlsConf)
+		if err != nil {
+			return fmt.Errorf("starting tls: %w", err)
+		}
+	}
+
+	c.begin(0)
+	c.writeInt32(pgProtoVersion)
+	for _, kv := range [][2]string{
+		{"user", conf.user},
+		{"database", conf.database},
+		{"application_name", "AdGuardHome"},
+	} {
+		if kv[1] != "" {
+			c.writeString(kv[0])
+			c.writeString(kv[1])
+		}
+	}
+	c.buf.WriteByte(0)
+
+	err = c.send()
+	if err != nil {
+		return fmt.Errorf("sending startup message: %w", err)
+	}
+
+	return c.authenticate(conf.user, conf.password)
+}
+
+// startTLS upgrades the connection to TLS.
+func (c *pgConn) startTLS(conf *tls.Config) (err error) {
+	c.begin(0)
+	c.writeInt32(pgSSLRequestCode)
+
+	err = c.send()
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	} else if resp != 'S' {
+		return pgErrNotSSL
+	}
+
+	tlsConn := tls.Client(c.conn, conf)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+
+	return nil
+}
+
+// authenticate handles the authentication requests of the server until it's
+// ready for queries.
+func (c *pgConn) authenticate(user, password string) (err error) {
+	var scram *scramClient
+	for {
+		var typ byte
+		var payload []byte
+		typ, payload, err = c.receive()
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case pgMsgAuth:
+			if len(payload) < 4 {
+				return errors.Error("bad authentication message")
+			}
+
+			scram, err = c.handleAuth(payload, user, password, scram)
+			if err != nil {
+				return fmt.Errorf("authenticating: %w", err)
+			}
+		case pgMsgError:
+			return parsePGError(payload)
+		case pgMsgReadyForQuery:
+			return nil
+		default:
+			// Skip ParameterStatus, BackendKeyData, and NoticeResponse.
+		}
+	}
+}
+
+// handleAuth handles a single authentication request from payload.  scram is
+// the state of the SCRAM authentication, if it's in progress.
+func (c *pgConn) handleAuth(
+	payload []byte,
+	user string,
+	password string,
+	scram *scramClient,
+) (next *scramClient, err error) {
+	code, data := binary.BigEndian.Uint32(payload), payload[4:]
+	switch code {
+	case pgAuthOK:
+		return nil, nil
+	case pgAuthCleartext:
+		c.begin(pgMsgPassword)
+		c.writeString(password)
+
+		return nil, c.send()
+	case pgAuthMD5:
+		if len(data) != 4 {
+			return nil, errors.Error("bad md5 salt")
+		}
+
+		c.begin(pgMsgPassword)
+		c.writeString(pgMD5Password(user, password, data))
+
+		return nil, c.send()
+	case pgAuthSASL:
+		if !bytes.Contains(data, []byte(pgSCRAMSHA256+"\x00")) {
+			return nil, errors.Error("no supported sasl mechanisms")
+		}
+
+		scram, err = newSCRAMClient("", password)
+		if err != nil {
+			return nil, err
+		}
+
+		first := scram.first()
+		c.begin(pgMsgPassword)
+		c.writeString(pgSCRAMSHA256)
+		c.writeInt32(int32(len(first)))
+		c.buf.WriteString(first)
+
+		return scram, c.send()
+	case pgAuthSASLContinue:
+		if scram == nil {
+			return nil, errors.Error("unexpected sasl continue")
+		}
+
+		var final string
+		final, err = scram.final(string(data))
+		if err != nil {
+			return nil, err
+		}
+
+		c.begin(pgMsgPassword)
+		c.buf.WriteString(final)
+
+		return scram, c.send()
+	case pgAuthSASLFinal:
+		if scram == nil {
+			return nil, errors.Error("unexpected sasl final")
+		}
+
+		return nil, scram.verify(string(data))
+	default:
+		return nil, fmt.Errorf("unsupported authentication method %d", code)
+	}
+}
+
+// pgMD5Password returns the password for the MD5 authentication.
+func pgMD5Password(user, password string, salt []byte) (pass string) {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// exec executes query.  If args are not empty, they are sent as the text
+// parameters of an extended query.  Otherwise, query is sent as a simple one,
+// which may contain several statements.
+func (c *pgConn) exec(query string, args []string) (err error) {
+	err = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	if len(args) == 0 {
+		c.begin(pgMsgQuery)
+		c.writeString(query)
+	} else {
+		c.writeExtendedQuery(query, args)
+	}
+
+	err = c.send()
+	if err != nil {
+		return err
+	}
+
+	var qErr error
+	for {
+		var typ byte
+		var payload []byte
+		typ, payload, err = c.receive()
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case pgMsgError:
+			if qErr == nil {
+				qErr = parsePGError(payload)
+			}
+		case pgMsgReadyForQuery:
+			return qErr
+		default:
+			// Skip ParseComplete, BindComplete, CommandComplete, and all the
+			// other messages.
+		}
+	}
+}
+
+// writeExtendedQuery writes the Parse, Bind, Execute, and Sync messages of an
+// unnamed extended query with args as text parameters into the buffer.
+func (c *pgConn) writeExtendedQuery(query string, args []string) {
+	c.begin(pgMsgParse)
+	c.writeString("")
+	c.writeString(query)
+	c.writeInt16(0)
+	c.end()
+
+	c.begin(pgMsgBind)
+	c.writeString("")
+	c.writeString("")
+	// Use the text format for all parameters and results.
+	c.writeInt16(0)
+	c.writeInt16(int16(len(args)))
+	for _, a := range args {
+		c.writeInt32(int32(len(a)))
+		c.buf.WriteString(a)
+	}
+	c.writeInt16(0)
+	c.end()
+
+	c.begin(pgMsgExecute)
+	c.writeString("")
+	c.writeInt32(0)
+	c.end()
+
+	c.begin(pgMsgSync)
+}
+
+// begin starts a new message of type typ in the buffer.  typ of zero means
+// that the message has no type, like the startup message.
+func (c *pgConn) begin(typ byte) {
+	if typ != 0 {
+		c.buf.WriteByte(typ)
+	}
+
+	// Reserve the space for the length.
+	c.lenPos = c.buf.Len()
+	c.writeInt32(0)
+}
+
+// end sets the length of the last message in the buffer.
+func (c *pgConn) end() {
+	b := c.buf.Bytes()
+	binary.BigEndian.PutUint32(b[c.lenPos:], uint32(len(b)-c.lenPos))
+}
+
+// send ends the last message in the buffer and writes the buffer into the
+// connection.
+func (c *pgConn) send() (err error) {
+	c.end()
+	defer c.buf.Reset()
+
+	_, err = c.conn.Write(c.buf.Bytes())
+
+	return err
+}
+
+// receive reads a single message from the connection.
+func (c *pgConn) receive() (typ byte, payload []byte, err error) {
+	hdr := make([]byte, 5)
+	_, err = io.ReadFull(c.r, hdr)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	typ, l := hdr[0], binary.BigEndian.Uint32(hdr[1:])
+	if l < 4 || l > pgMaxMsgLen {
+		return 0, nil, fmt.Errorf("bad message length %d", l)
+	}
+
+	payload = make([]byte, l-4)
+	_, err = io.ReadFull(c.r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return typ, payload, nil
+}
+
+// writeString writes a null-terminated string into the buffer.
+func (c *pgConn) writeString(s string) {
+	c.buf.WriteString(s)
+	c.buf.WriteByte(0)
+}
+
+// writeInt16 writes a big-endian 16-bit integer into the buffer.
+func (c *pgConn) writeInt16(n int16) {
+	_ = binary.Write(c.buf, binary.BigEndian, n)
+}
+
+// writeInt32 writes a big-endian 32-bit integer into the buffer.
+func (c *pgConn) writeInt32(n int32) {
+	_ = binary.Write(c.buf, binary.BigEndian, n)
+}
+
+// type check
+var _ io.Closer = (*pgConn)(nil)
+
+// Close implements the [io.Closer] interface for *pgConn.
+func (c *pgConn) Close() (err error) {
+	c.buf.Reset()
+	c.begin(pgMsgTerminate)
+
+	// Don't wait for the server, since it just closes the connection.
+	_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	err = c.send()
+
+	return errors.WithDeferred(err, c.conn.Close())
+}
+
+// scramClient is the client side of the SCRAM-SHA-256 authentication, see RFC
+// 5802 and RFC 7677.
+type scramClient struct {
+	user     string
+	password string
+	nonce    string
+
+	// clientFirstBare is the client-first-message without the GS2 header.
+	clientFirstBare string
+
+	// authMsg is the AuthMessage used to compute the signatures.
+	authMsg string
+
+	// saltedPassword is the SaltedPassword computed from the server's salt
+	// and number of iterations.
+	saltedPassword []byte
+}
+
+// newSCRAMClient returns a new SCRAM client with a random nonce.  PostgreSQL
+// ignores the user name in the SCRAM messages, so it may be empty.
+func newSCRAMClient(user, password string) (s *scramClient, err error) {
+	nonce := make([]byte, 18)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	return &scramClient{
+		user:     user,
+		password: password,
+		nonce:    base64.StdEncoding.EncodeToString(nonce),
+	}, nil
+}
+
+// first returns the client-first-message.
+func (s *scramClient) first() (msg string) {
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s.user)
+	s.clientFirstBare = "n=" + name + ",r=" + s.nonce
+
+	return "n,," + s.clientFirstBare
+}
+
+// final returns the client-final-message for the server-first-message.
+func (s *scramClient) final(serverFirst string) (msg string, err error) {
+	attrs := scramAttrs(serverFirst)
+	nonce, salt64, iterStr := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) {
+		return "", errors.Error("scram: bad server nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return "", fmt.Errorf("scram: bad salt: %w", err)
+	}
+
+	iter, err := strconv.Atoi(iterStr)
+	if err != nil || iter < 1 {
+		return "", fmt.Errorf("scram: bad iteration count %q", iterStr)
+	}
+
+	s.saltedPassword = pbkdf2.Key([]byte(s.password), salt, iter, sha256.Size, sha256.New)
+	clientKey := scramHMAC(s.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=biws,r=" + nonce
+	s.authMsg = s.clientFirstBare + "," + serverFirst + "," + withoutProof
+
+	proof := scramHMAC(storedKey[:], s.authMsg)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server signature from the server-final-message.
+func (s *scramClient) verify(serverFinal string) (err error) {
+	attrs := scramAttrs(serverFinal)
+	if e := attrs["e"]; e != "" {
+		return fmt.Errorf("scram: server error: %s", e)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return fmt.Errorf("scram: bad server signature: %w", err)
+	}
+
+	serverKey := scramHMAC(s.saltedPassword, "Server Key")
+	want := scramHMAC(serverKey, s.authMsg)
+	if subtle.ConstantTimeCompare(sig, want) != 1 {
+		return errors.Error("scram: server signature mismatch")
+	}
+
+	return nil
+}
+
+// scramHMAC returns the HMAC-SHA-256 of msg with key.
+func scramHMAC(key []byte, msg string) (sum []byte) {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(msg))
+
+	return h.Sum(nil)
+}
+
+// scramAttrs parses the comma-separated attributes of a SCRAM message.
+func scramAttrs(msg string) (attrs map[string]string) {
+	attrs = map[string]string{}
+	for _, a := range strings.Split(msg, ",") {
+		k, v, ok := strings.Cut(a, "=")
+		if ok {
+			attrs[k] = v
+		}
+	}
+
+	return attrs
+}
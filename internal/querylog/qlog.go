@@ -4,6 +4,7 @@ package querylog
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"strings"
 	"sync"
@@ -25,9 +26,15 @@ const (
 type queryLog struct {
 	findClient func(ids []string) (c *Client, err error)
 
-	conf    *Config
-	lock    sync.Mutex
-	logFile string // path to the log file
+	conf *Config
+	lock sync.Mutex
+
+	// file is the default backend.  It's also used to search the log.
+	file *fileBackend
+
+	// external is the optional external backend the entries are also written
+	// to.  It's nil if there is none.
+	external *asyncBackend
 
 	// bufferLock protects buffer.
 	bufferLock sync.RWMutex
@@ -37,9 +44,17 @@ type queryLog struct {
 
 	fileFlushLock sync.Mutex // synchronize a file-flushing goroutine and main thread
 	flushPending  bool       // don't start another goroutine while the previous one is still running
-	fileWriteLock sync.Mutex
 
 	anonymizer *aghnet.IPMut
+
+	// done is closed when the query log is closed to stop the periodic
+	// flushing.
+	done chan struct{}
+
+	// streamLock protects streams.
+	streamLock sync.Mutex
+	// streams are the subscriptions to the live query log entries.
+	streams map[*streamSub]struct{}
 }
 
 // ClientProto values are names of the client protocols.
@@ -90,6 +105,10 @@ type logEntry struct {
 	Answer     []byte `json:",omitempty"` // sometimes empty answers happen like binerdunt.top or rev2.globalrootservers.net
 	OrigAnswer []byte `json:",omitempty"`
 
+	// FullResponse is the compressed complete original response.  It's only
+	// stored if [Config.FullResponse] is true.  See [packFullResponse].
+	FullResponse []byte `json:"FR,omitempty"`
+
 	Result   filtering.Result
 	Upstream string `json:",omitempty"`
 
@@ -113,10 +132,23 @@ func (l *queryLog) Start() {
 		l.initWeb()
 	}
 	go l.periodicRotate()
+
+	if l.conf.FlushInterval > 0 {
+		go l.periodicFlush(l.conf.FlushInterval)
+	}
 }
 
 func (l *queryLog) Close() {
+	close(l.done)
+
 	_ = l.flushLogBuffer(true)
+
+	if l.external != nil {
+		err := l.external.Close()
+		if err != nil {
+			log.Error("querylog: closing external backend: %s", err)
+		}
+	}
 }
 
 func checkInterval(ivl time.Duration) (ok bool) {
@@ -146,15 +178,15 @@ func (l *queryLog) clear() {
 	l.flushPending = false
 	l.bufferLock.Unlock()
 
-	oldLogFile := l.logFile + ".1"
+	oldLogFile := l.file.path + ".1"
 	err := os.Remove(oldLogFile)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		log.Error("removing old log file %q: %s", oldLogFile, err)
 	}
 
-	err = os.Remove(l.logFile)
+	err = os.Remove(l.file.path)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Error("removing log file %q: %s", l.logFile, err)
+		log.Error("removing log file %q: %s", l.file.path, err)
 	}
 
 	log.Debug("querylog: cleared")
@@ -227,6 +259,15 @@ func (l *queryLog) Add(params *AddParams) {
 		entry.OrigAnswer = a
 	}
 
+	if l.conf.FullResponse {
+		entry.FullResponse, err = packFullResponse(params.OrigAnswer, params.Answer)
+		if err != nil {
+			log.Error("querylog: packing full response: %s", err)
+
+			return
+		}
+	}
+
 	l.bufferLock.Lock()
 	l.buffer = append(l.buffer, &entry)
 	needFlush := false
@@ -248,6 +289,12 @@ func (l *queryLog) Add(params *AddParams) {
 	}
 	l.bufferLock.Unlock()
 
+	l.publish(&entry)
+
+	if l.external != nil {
+		l.external.add(&entry)
+	}
+
 	// if buffer needs to be flushed to disk, do it now
 	if needFlush {
 		go func() {
@@ -256,12 +303,8 @@ func (l *queryLog) Add(params *AddParams) {
 	}
 }
 
-// ShouldLog returns true if request for the host should be logged.
-func (l *queryLog) ShouldLog(host string, _, _ uint16) bool {
-	return !l.isIgnored(host)
-}
-
-// isIgnored returns true if the host is in the Ignored list.
-func (l *queryLog) isIgnored(host string) bool {
-	return l.conf.Ignored.Has(host)
+// ShouldLog returns true if request for the host from the client with ip
+// should be logged.
+func (l *queryLog) ShouldLog(host string, _, _ uint16, ip netip.Addr) bool {
+	return !l.conf.Ignored.Has(host, ip)
 }
@@ -3,11 +3,15 @@ package querylog
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
-	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/miekg/dns"
@@ -226,6 +230,137 @@ func TestQueryLogMaxFileScanEntries(t *testing.T) {
 	}
 }
 
+func TestQueryLog_RemoveOldestFile(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.NoError(t, l.flushLogBuffer(true))
+	require.NoError(t, l.rotate())
+
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	require.NoError(t, l.flushLogBuffer(true))
+
+	removed, err := l.RemoveOldestFile()
+	require.NoError(t, err)
+
+	assert.True(t, removed)
+	assert.NoFileExists(t, l.file.path+".1")
+	assert.FileExists(t, l.file.path)
+
+	removed, err = l.RemoveOldestFile()
+	require.NoError(t, err)
+
+	assert.True(t, removed)
+	assert.NoFileExists(t, l.file.path)
+
+	removed, err = l.RemoveOldestFile()
+	require.NoError(t, err)
+
+	assert.False(t, removed)
+}
+
+func TestQueryLog_periodicFlush(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:       true,
+		FileEnabled:   true,
+		FileSync:      true,
+		RotationIvl:   timeutil.Day,
+		MemSize:       100,
+		FlushInterval: 10 * time.Millisecond,
+		BaseDir:       t.TempDir(),
+	})
+
+	go l.periodicFlush(l.conf.FlushInterval)
+	t.Cleanup(l.Close)
+
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	// The entry is written before the buffer is full.
+	assert.Eventually(t, func() (ok bool) {
+		l.bufferLock.RLock()
+		defer l.bufferLock.RUnlock()
+
+		return len(l.buffer) == 0
+	}, time.Second, time.Millisecond)
+
+	assert.FileExists(t, l.file.path)
+}
+
+func TestQueryLog_handleQueryLogFlush(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	assert.NoFileExists(t, l.file.path)
+
+	w := httptest.NewRecorder()
+	l.handleQueryLogFlush(w, httptest.NewRequest(http.MethodPost, "/control/querylog/flush", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.FileExists(t, l.file.path)
+	assert.Empty(t, l.buffer)
+
+	params := newSearchParams()
+	entries, _ := l.search(params)
+	require.Len(t, entries, 1)
+
+	assert.Equal(t, "example.org", entries[0].QHost)
+}
+
+func TestQueryLog_rotationTime(t *testing.T) {
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	oldest := time.Date(2023, 1, 1, 15, 30, 0, 0, loc)
+
+	testCases := []struct {
+		loc  *time.Location
+		want time.Time
+		name string
+		ivl  time.Duration
+	}{{
+		loc:  nil,
+		want: oldest.Add(timeutil.Day),
+		name: "no_time_zone",
+		ivl:  timeutil.Day,
+	}, {
+		loc:  loc,
+		want: time.Date(2023, 1, 2, 0, 0, 0, 0, loc),
+		name: "day",
+		ivl:  timeutil.Day,
+	}, {
+		loc:  loc,
+		want: time.Date(2023, 1, 8, 0, 0, 0, 0, loc),
+		name: "week",
+		ivl:  7 * timeutil.Day,
+	}, {
+		loc:  loc,
+		want: oldest.Add(timeutil.Day / 4),
+		name: "quarter_day",
+		ivl:  timeutil.Day / 4,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &queryLog{conf: &Config{
+				RotationIvl: tc.ivl,
+				TimeZone:    tc.loc,
+			}}
+
+			assert.True(t, tc.want.Equal(l.rotationTime(oldest)))
+		})
+	}
+}
+
 func TestQueryLogFileDisabled(t *testing.T) {
 	l := newQueryLog(Config{
 		Enabled:     true,
@@ -252,37 +387,74 @@ func TestQueryLogShouldLog(t *testing.T) {
 		ignored1 = "ignor.ed"
 		ignored2 = "ignored.to"
 	)
-	set := stringutil.NewSet(ignored1, ignored2)
+
+	ignored, err := aghnet.NewIgnoreMatcher([]string{
+		ignored1,
+		ignored2,
+		"*.wildcard.example",
+		"192.168.1.50",
+		"10.0.0.0/8",
+	})
+	require.NoError(t, err)
 
 	l := newQueryLog(Config{
 		Enabled:     true,
 		RotationIvl: timeutil.Day,
 		MemSize:     100,
 		BaseDir:     t.TempDir(),
-		Ignored:     set,
+		Ignored:     ignored,
 	})
 
 	testCases := []struct {
+		ip      netip.Addr
 		name    string
 		host    string
 		wantLog bool
 	}{{
+		ip:      netip.Addr{},
 		name:    "log",
 		host:    "example.com",
 		wantLog: true,
 	}, {
+		ip:      netip.Addr{},
 		name:    "no_log_ignored_1",
 		host:    ignored1,
 		wantLog: false,
 	}, {
+		ip:      netip.Addr{},
 		name:    "no_log_ignored_2",
 		host:    ignored2,
 		wantLog: false,
+	}, {
+		ip:      netip.Addr{},
+		name:    "no_log_wildcard",
+		host:    "sub.wildcard.example",
+		wantLog: false,
+	}, {
+		ip:      netip.Addr{},
+		name:    "log_wildcard_apex",
+		host:    "wildcard.example",
+		wantLog: true,
+	}, {
+		ip:      netip.MustParseAddr("192.168.1.50"),
+		name:    "no_log_client",
+		host:    "example.com",
+		wantLog: false,
+	}, {
+		ip:      netip.MustParseAddr("10.1.2.3"),
+		name:    "no_log_subnet",
+		host:    "example.com",
+		wantLog: false,
+	}, {
+		ip:      netip.MustParseAddr("192.168.1.51"),
+		name:    "log_client",
+		host:    "example.com",
+		wantLog: true,
 	}}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			res := l.ShouldLog(tc.host, dns.TypeA, dns.ClassINET)
+			res := l.ShouldLog(tc.host, dns.TypeA, dns.ClassINET, tc.ip)
 
 			assert.Equal(t, tc.wantLog, res)
 		})
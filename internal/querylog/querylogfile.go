@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
 )
 
 // flushLogBuffer flushes the current buffer to file and resets the current buffer
@@ -45,11 +48,61 @@ func (l *queryLog) flushToFile(buffer []*logEntry) (err error) {
 		log.Debug("querylog: there's nothing to write to a file")
 		return nil
 	}
+
+	return l.file.write(buffer)
+}
+
+// periodicFlush flushes the buffer to the file each ivl until the query log is
+// closed.
+func (l *queryLog) periodicFlush(ivl time.Duration) {
+	defer log.OnPanic("querylog: flushing")
+
+	flushes := time.NewTicker(ivl)
+	defer flushes.Stop()
+
+	for {
+		select {
+		case <-flushes.C:
+			_ = l.flushLogBuffer(true)
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// fileBackend is the default backend, which writes the entries to a JSON-lines
+// file.  The file is also used to search the query log.
+type fileBackend struct {
+	// mu protects the file from concurrent writes.
+	mu *sync.Mutex
+
+	// path is the path to the log file.
+	path string
+
+	// sync tells if the file is synced to the storage after each write.
+	sync bool
+}
+
+// newFileBackend returns a new *fileBackend for the log file at path.  If
+// syncFile is true, the file is synced to the storage after each write.
+func newFileBackend(path string, syncFile bool) (b *fileBackend) {
+	return &fileBackend{
+		mu:   &sync.Mutex{},
+		path: path,
+		sync: syncFile,
+	}
+}
+
+// type check
+var _ backend = (*fileBackend)(nil)
+
+// write implements the [backend] interface for *fileBackend.
+func (b *fileBackend) write(entries []*logEntry) (err error) {
 	start := time.Now()
 
-	var b bytes.Buffer
-	e := json.NewEncoder(&b)
-	for _, entry := range buffer {
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	for _, entry := range entries {
 		err = e.Encode(entry)
 		if err != nil {
 			log.Error("Failed to marshal entry: %s", err)
@@ -59,14 +112,12 @@ func (l *queryLog) flushToFile(buffer []*logEntry) (err error) {
 	}
 
 	elapsed := time.Since(start)
-	log.Debug("%d elements serialized via json in %v: %d kB, %v/entry, %v/entry", len(buffer), elapsed, b.Len()/1024, float64(b.Len())/float64(len(buffer)), elapsed/time.Duration(len(buffer)))
+	log.Debug("%d elements serialized via json in %v: %d kB, %v/entry, %v/entry", len(entries), elapsed, buf.Len()/1024, float64(buf.Len())/float64(len(entries)), elapsed/time.Duration(len(entries)))
 
-	var zb bytes.Buffer
-	filename := l.logFile
-	zb = b
+	filename := b.path
 
-	l.fileWriteLock.Lock()
-	defer l.fileWriteLock.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
 	if err != nil {
 		log.Error("failed to create file \"%s\": %s", filename, err)
@@ -74,20 +125,36 @@ func (l *queryLog) flushToFile(buffer []*logEntry) (err error) {
 	}
 	defer func() { err = errors.WithDeferred(err, f.Close()) }()
 
-	n, err := f.Write(zb.Bytes())
+	n, err := f.Write(buf.Bytes())
 	if err != nil {
 		log.Error("Couldn't write to file: %s", err)
 		return err
 	}
 
+	if b.sync {
+		err = f.Sync()
+		if err != nil {
+			return fmt.Errorf("syncing file: %w", err)
+		}
+	}
+
 	log.Debug("querylog: ok \"%s\": %v bytes written", filename, n)
 
 	return nil
 }
 
+// type check
+var _ io.Closer = (*fileBackend)(nil)
+
+// Close implements the [io.Closer] interface for *fileBackend.  The file is
+// opened for each write, so there is nothing to close.
+func (b *fileBackend) Close() (err error) {
+	return nil
+}
+
 func (l *queryLog) rotate() error {
-	from := l.logFile
-	to := l.logFile + ".1"
+	from := l.file.path
+	to := l.file.path + ".1"
 
 	err := os.Rename(from, to)
 	if err != nil {
@@ -105,9 +172,32 @@ func (l *queryLog) rotate() error {
 	return nil
 }
 
+// RemoveOldestFile implements the [QueryLog] interface for *queryLog.  The
+// rotated file is removed first.
+func (l *queryLog) RemoveOldestFile() (removed bool, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.fileFlushLock.Lock()
+	defer l.fileFlushLock.Unlock()
+
+	for _, p := range []string{l.file.path + ".1", l.file.path} {
+		err = os.Remove(p)
+		if err == nil {
+			log.Info("querylog: removed %s", p)
+
+			return true, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("removing log file: %w", err)
+		}
+	}
+
+	return false, nil
+}
+
 func (l *queryLog) readFileFirstTimeValue() (first time.Time, err error) {
 	var f *os.File
-	f, err = os.Open(l.logFile)
+	f, err = os.Open(l.file.path)
 	if err != nil {
 		return time.Time{}, err
 	}
@@ -152,6 +242,23 @@ func (l *queryLog) periodicRotate() {
 	}
 }
 
+// rotationTime returns the time the log files with the oldest entry written at
+// oldest should be rotated at.
+func (l *queryLog) rotationTime(oldest time.Time) (rot time.Time) {
+	ivl := l.conf.RotationIvl
+	rot = oldest.Add(ivl)
+
+	loc := l.conf.TimeZone
+	if loc == nil || ivl < timeutil.Day {
+		return rot
+	}
+
+	rot = rot.In(loc)
+	y, m, d := rot.Date()
+
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
 // checkAndRotate rotates log files if those are older than the specified
 // rotation interval.
 func (l *queryLog) checkAndRotate() {
@@ -165,7 +272,7 @@ func (l *queryLog) checkAndRotate() {
 		return
 	}
 
-	if rot, now := oldest.Add(l.conf.RotationIvl), time.Now(); rot.After(now) {
+	if rot, now := l.rotationTime(oldest), time.Now(); rot.After(now) {
 		log.Debug(
 			"querylog: %s <= %s, not rotating",
 			now.Format(time.RFC3339),
@@ -0,0 +1,64 @@
+package querylog
+
+import (
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+)
+
+// Redaction is the set of the fields of the query log entries hidden from a
+// user of the HTTP API.  The zero value hides nothing.
+type Redaction struct {
+	// Client, if true, hides the IP addresses, the ClientIDs, the EDNS Client
+	// Subnets, and the information about the clients, including the clients
+	// in the comparison of the periods.  The search terms are only matched
+	// against the domain names then.
+	Client bool `yaml:"client"`
+
+	// Answer, if true, hides the answers, the original answers, the full
+	// responses, the DNSSEC statuses of the answers, and the texts of the
+	// rewrite rules.
+	Answer bool `yaml:"answer"`
+}
+
+// redact removes the fields hidden by red from jsonEntry of the query filtered
+// with reason.
+func (red Redaction) redact(jsonEntry jobject, reason filtering.Reason) {
+	if red.Client {
+		jsonEntry["client"] = ""
+		delete(jsonEntry, "client_info")
+		delete(jsonEntry, "client_id")
+		delete(jsonEntry, "ecs")
+	}
+
+	if red.Answer {
+		delete(jsonEntry, "answer")
+		delete(jsonEntry, "original_answer")
+		delete(jsonEntry, "answer_dnssec")
+
+		// The texts of the rewrite rules contain the rewritten answers.
+		if reason.In(filtering.Rewritten, filtering.RewrittenAutoHosts, filtering.RewrittenRule) {
+			redactRuleTexts(jsonEntry)
+		}
+	}
+}
+
+// redactRuleTexts removes the texts of the rules from jsonEntry keeping the
+// filter list IDs.
+func redactRuleTexts(jsonEntry jobject) {
+	delete(jsonEntry, "rule")
+
+	rules, _ := jsonEntry["rules"].([]jobject)
+	for _, r := range rules {
+		r["text"] = ""
+	}
+}
+
+// redaction returns the fields hidden from the user making r.
+func (l *queryLog) redaction(r *http.Request) (red Redaction) {
+	if l.conf.Redaction == nil {
+		return Redaction{}
+	}
+
+	return l.conf.Redaction(r)
+}
@@ -0,0 +1,156 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_redaction(t *testing.T) {
+	// testRoleHdr is the header containing the role of the user in tests.
+	const testRoleHdr = "X-Test-Role"
+
+	redactions := map[string]Redaction{
+		"client": {Client: true},
+		"answer": {Answer: true},
+	}
+
+	l := newQueryLog(Config{
+		Enabled:      true,
+		FullResponse: true,
+		RotationIvl:  timeutil.Day,
+		MemSize:      100,
+		BaseDir:      t.TempDir(),
+		Anonymizer:   aghnet.NewIPMut(nil),
+		Redaction: func(r *http.Request) (red Redaction) {
+			return redactions[r.Header.Get(testRoleHdr)]
+		},
+	})
+
+	q := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(q)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   "example.org.",
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    10,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}}
+
+	l.Add(&AddParams{
+		Question: q,
+		Answer:   resp,
+		ClientID: "cli",
+		ClientIP: net.IP{5, 6, 7, 8},
+	})
+
+	l.bufferLock.RLock()
+	id := entryID(l.buffer[0])
+	l.bufferLock.RUnlock()
+
+	search := func(t *testing.T, role, query string) (data []map[string]any) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog?"+query, nil)
+		r.Header.Set(testRoleHdr, role)
+		w := httptest.NewRecorder()
+
+		l.handleQueryLog(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var body struct {
+			Data []map[string]any `json:"data"`
+		}
+
+		err := json.NewDecoder(w.Body).Decode(&body)
+		require.NoError(t, err)
+
+		return body.Data
+	}
+
+	getEntry := func(t *testing.T, role string) (e map[string]any) {
+		t.Helper()
+
+		data := search(t, role, "")
+		require.Len(t, data, 1)
+
+		return data[0]
+	}
+
+	t.Run("none", func(t *testing.T) {
+		e := getEntry(t, "")
+
+		assert.Equal(t, "5.6.7.8", e["client"])
+		assert.Equal(t, "cli", e["client_id"])
+		assert.Contains(t, e, "answer")
+	})
+
+	t.Run("client", func(t *testing.T) {
+		e := getEntry(t, "client")
+
+		assert.Equal(t, "", e["client"])
+		assert.NotContains(t, e, "client_id")
+		assert.NotContains(t, e, "client_info")
+		assert.Contains(t, e, "answer")
+	})
+
+	t.Run("client_search", func(t *testing.T) {
+		for _, term := range []string{"5.6.7.8", "5.6.7", "cli", `"cli"`} {
+			assert.Len(t, search(t, "", "search="+url.QueryEscape(term)), 1)
+			assert.Empty(t, search(t, "client", "search="+url.QueryEscape(term)))
+		}
+
+		assert.Len(t, search(t, "client", "search=example"), 1)
+	})
+
+	t.Run("answer", func(t *testing.T) {
+		e := getEntry(t, "answer")
+
+		assert.Equal(t, "5.6.7.8", e["client"])
+		assert.NotContains(t, e, "answer")
+		assert.NotContains(t, e, "answer_dnssec")
+		assert.Equal(t, "NOERROR", e["status"])
+	})
+
+	t.Run("answer_rewrite", func(t *testing.T) {
+		const filterListID = 42
+
+		e := jobject{
+			"rule": "||example.org^$dnsrewrite=1.2.3.4",
+			"rules": resultRulesToJSONRules([]*filtering.ResultRule{{
+				Text:         "||example.org^$dnsrewrite=1.2.3.4",
+				FilterListID: filterListID,
+			}}),
+		}
+
+		Redaction{Answer: true}.redact(e, filtering.RewrittenRule)
+
+		assert.NotContains(t, e, "rule")
+		assert.Equal(t, []jobject{{
+			"filter_list_id": int64(filterListID),
+			"text":           "",
+		}}, e["rules"])
+	})
+
+	t.Run("full_response", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog/"+id+"/answer", nil)
+		r.Header.Set(testRoleHdr, "answer")
+		w := httptest.NewRecorder()
+
+		l.handleQueryLogEntryAnswer(w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, "answers are hidden\n", w.Body.String())
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
 	"golang.org/x/exp/slices"
 )
 
@@ -139,8 +140,8 @@ func (l *queryLog) searchFiles(
 	cache clientCache,
 ) (entries []*logEntry, oldest time.Time, total int) {
 	files := []string{
-		l.logFile + ".1",
-		l.logFile,
+		l.file.path + ".1",
+		l.file.path,
 	}
 
 	r, err := NewQLogReader(files)
@@ -265,7 +266,8 @@ func (l *queryLog) readNextEntry(
 	e = &logEntry{}
 	decodeLogEntry(e, line)
 
-	if l.isIgnored(e.QHost) {
+	ip, _ := netutil.IPToAddrNoMapped(e.IP)
+	if l.conf.Ignored.Has(e.QHost, ip) {
 		return nil, ts, nil
 	}
 
@@ -52,6 +52,10 @@ type searchCriterion struct {
 	// whole value rather than the part of it.  That is, equality and not
 	// containment.
 	strict bool
+	// domainOnly, if true, means that the ctTerm criterion is only matched
+	// against the domain name, since the information about the clients is
+	// hidden from the user, see [Redaction.Client].
+	domainOnly bool
 }
 
 func ctDomainOrClientCaseStrict(
@@ -91,12 +95,14 @@ func (c *searchCriterion) quickMatch(line string, findClient quickMatchClientFun
 	switch c.criterionType {
 	case ctTerm:
 		host := readJSONValue(line, `"QH":"`)
-		ip := readJSONValue(line, `"IP":"`)
-		clientID := readJSONValue(line, `"CID":"`)
 
-		var name string
-		if cli := findClient(clientID, ip); cli != nil {
-			name = cli.Name
+		var clientID, name, ip string
+		if !c.domainOnly {
+			ip = readJSONValue(line, `"IP":"`)
+			clientID = readJSONValue(line, `"CID":"`)
+			if cli := findClient(clientID, ip); cli != nil {
+				name = cli.Name
+			}
 		}
 
 		if c.strict {
@@ -126,15 +132,18 @@ func (c *searchCriterion) match(entry *logEntry) bool {
 }
 
 func (c *searchCriterion) ctDomainOrClientCase(e *logEntry) bool {
-	clientID := e.ClientID
 	host := e.QHost
 
-	var name string
-	if e.client != nil {
-		name = e.client.Name
+	var clientID, name, ip string
+	if !c.domainOnly {
+		clientID = e.ClientID
+		if e.client != nil {
+			name = e.client.Name
+		}
+
+		ip = e.IP.String()
 	}
 
-	ip := e.IP.String()
 	if c.strict {
 		return ctDomainOrClientCaseStrict(c.value, c.asciiVal, clientID, name, host, ip)
 	}
@@ -170,6 +179,8 @@ func (c *searchCriterion) ctFilteringStatusCase(
 		return !reason.In(
 			filtering.FilteredBlockList,
 			filtering.FilteredBlockedService,
+			filtering.FilteredDefaultDeny,
+			filtering.FilteredRebinding,
 			filtering.NotFilteredAllowList,
 		)
 	default:
@@ -189,7 +200,12 @@ func (c *searchCriterion) ctFilteringStatusCase(
 func (c *searchCriterion) isFilteredWithReason(reason filtering.Reason) (matched bool) {
 	switch c.value {
 	case filteringStatusBlocked:
-		return reason.In(filtering.FilteredBlockList, filtering.FilteredBlockedService)
+		return reason.In(
+			filtering.FilteredBlockList,
+			filtering.FilteredBlockedService,
+			filtering.FilteredDefaultDeny,
+			filtering.FilteredRebinding,
+		)
 	case filteringStatusBlockedParental:
 		return reason == filtering.FilteredParental
 	case filteringStatusBlockedSafebrowsing:
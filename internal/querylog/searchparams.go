@@ -11,6 +11,10 @@ type searchParams struct {
 	// if not set - disregard it and return any value
 	olderThan time.Time
 
+	// groupWindow, if not zero, is the window for collapsing the repeated
+	// queries from the same client into a single row, see [groupEntries].
+	groupWindow time.Duration
+
 	offset             int // offset for the search
 	limit              int // limit the number of records returned
 	maxFileScanEntries int // maximum log entries to scan in query log files. if 0 - no limit
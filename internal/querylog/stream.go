@@ -0,0 +1,202 @@
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// streamBufferSize is the number of entries buffered for each of the
+	// streams.  The entries are dropped when a stream's buffer is full, so
+	// that slow clients don't slow down the handling of DNS queries.
+	streamBufferSize = 256
+
+	// streamKeepAliveIvl is the interval of sending comments to keep idle
+	// streams open.
+	streamKeepAliveIvl = 15 * time.Second
+
+	// streamMaxDuration is the maximum duration of a single stream.  It must
+	// be less than the write timeout of the HTTP server, after which the
+	// connection is closed anyway.  The clients are expected to reconnect,
+	// as EventSource does by default.
+	streamMaxDuration = 50 * time.Second
+
+	// streamRetryMs is the reconnection delay for the clients, in
+	// milliseconds.
+	streamRetryMs = 1000
+)
+
+// streamSub is a subscription to the live query log entries.
+type streamSub struct {
+	// params are used to filter the entries.
+	params *searchParams
+
+	// entries receives the entries added to the query log.  The entries must
+	// not be modified.
+	entries chan *logEntry
+
+	// dropped is the number of entries dropped because entries is full.  It
+	// must only be accessed with queryLog.streamLock locked.
+	dropped uint64
+}
+
+// subscribe registers a new subscription filtering the entries with params.
+func (l *queryLog) subscribe(params *searchParams) (sub *streamSub) {
+	sub = &streamSub{
+		params:  params,
+		entries: make(chan *logEntry, streamBufferSize),
+	}
+
+	l.streamLock.Lock()
+	defer l.streamLock.Unlock()
+
+	if l.streams == nil {
+		l.streams = map[*streamSub]struct{}{}
+	}
+
+	l.streams[sub] = struct{}{}
+
+	return sub
+}
+
+// unsubscribe removes sub from the subscriptions.
+func (l *queryLog) unsubscribe(sub *streamSub) {
+	l.streamLock.Lock()
+	defer l.streamLock.Unlock()
+
+	delete(l.streams, sub)
+
+	if sub.dropped > 0 {
+		log.Debug("querylog: stream: dropped %d entries", sub.dropped)
+	}
+}
+
+// publish sends e to all the subscriptions without blocking.  e must not be
+// modified after that.
+func (l *queryLog) publish(e *logEntry) {
+	l.streamLock.Lock()
+	defer l.streamLock.Unlock()
+
+	for sub := range l.streams {
+		select {
+		case sub.entries <- e:
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// handleQueryLogStream handles requests to the GET /control/querylog/stream
+// endpoint.  It sends the new query log entries matching the search and
+// response_status parameters as server-sent events.
+func (l *queryLog) handleQueryLogStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "streaming is not supported")
+
+		return
+	}
+
+	params, err := l.parseSearchParams(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "failed to parse params: %s", err)
+
+		return
+	}
+
+	sub := l.subscribe(params)
+	defer l.unsubscribe(sub)
+
+	h := w.Header()
+	h.Set(aghhttp.HdrNameContentType, "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	_, err = fmt.Fprintf(w, "retry: %d\n\n", streamRetryMs)
+	if err != nil {
+		log.Debug("querylog: stream: writing: %s", err)
+
+		return
+	}
+
+	flusher.Flush()
+
+	err = l.stream(w, flusher, r, sub)
+	if err != nil {
+		log.Debug("querylog: stream: %s", err)
+	}
+}
+
+// stream writes the entries from sub to w until the request is done or the
+// maximum duration of the stream is reached.
+func (l *queryLog) stream(
+	w http.ResponseWriter,
+	flusher http.Flusher,
+	r *http.Request,
+	sub *streamSub,
+) (err error) {
+	keepAlive := time.NewTicker(streamKeepAliveIvl)
+	defer keepAlive.Stop()
+
+	deadline := time.NewTimer(streamMaxDuration)
+	defer deadline.Stop()
+
+	red := l.redaction(r)
+	cache := clientCache{}
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-deadline.C:
+			return nil
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case e := <-sub.entries:
+			err = l.writeStreamEntry(w, e, sub.params, cache, red)
+		}
+
+		if err != nil {
+			return fmt.Errorf("writing: %w", err)
+		}
+
+		flusher.Flush()
+	}
+}
+
+// writeStreamEntry writes e to w as a server-sent event, if e matches params.
+// The fields hidden by red are removed.
+func (l *queryLog) writeStreamEntry(
+	w http.ResponseWriter,
+	e *logEntry,
+	params *searchParams,
+	cache clientCache,
+	red Redaction,
+) (err error) {
+	// A shallow clone is enough, since only the client field is modified.
+	e = e.shallowClone()
+
+	e.client, err = l.client(e.ClientID, e.IP.String(), cache)
+	if err != nil {
+		log.Debug("querylog: stream: finding client %q (clientid %q): %s", e.IP, e.ClientID, err)
+
+		// Go on and try to match anyway.
+	}
+
+	if !params.match(e) {
+		return nil
+	}
+
+	data, err := json.Marshal(l.entryToJSON(e, l.anonymizer.Load(), red))
+	if err != nil {
+		return fmt.Errorf("encoding entry: %w", err)
+	}
+
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+
+	return err
+}
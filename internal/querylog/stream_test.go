@@ -0,0 +1,87 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_handleQueryLogStream(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+		Anonymizer:  aghnet.NewIPMut(nil),
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(l.handleQueryLogStream))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "/control/querylog/stream?search=example.com")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, resp.Body.Close)
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	sc := bufio.NewScanner(resp.Body)
+	require.True(t, sc.Scan())
+	assert.Equal(t, "retry: 1000", sc.Text())
+
+	// The subscription is registered before the first event is written.
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "example.com", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+
+	var data string
+	for sc.Scan() {
+		if line := sc.Text(); strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(line, "data: ")
+
+			break
+		}
+	}
+	require.NoError(t, sc.Err())
+
+	entry := jobject{}
+	err = json.Unmarshal([]byte(data), &entry)
+	require.NoError(t, err)
+
+	assert.Equal(t, "2.2.2.2", entry["client"])
+
+	question, ok := entry["question"].(jobject)
+	require.True(t, ok)
+
+	assert.Equal(t, "example.com", question["name"])
+}
+
+func TestQueryLog_publish(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+	})
+
+	sub := l.subscribe(newSearchParams())
+	for i := 0; i < streamBufferSize+1; i++ {
+		addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	}
+
+	assert.Len(t, sub.entries, streamBufferSize)
+	assert.Equal(t, uint64(1), sub.dropped)
+
+	l.unsubscribe(sub)
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	assert.Len(t, sub.entries, streamBufferSize)
+}
@@ -0,0 +1,280 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	"go.etcd.io/bbolt"
+	"golang.org/x/exp/slices"
+)
+
+// historyGranularity is the time resolution of the statistics history.
+type historyGranularity string
+
+// historyGranularity values.
+const (
+	historyGranularitySubHour historyGranularity = "10min"
+	historyGranularityHour    historyGranularity = "hour"
+	historyGranularityDay     historyGranularity = "day"
+)
+
+// hours returns the number of hours in a single entry of the history with the
+// granularity g.  It returns zero if g is invalid or less than an hour.
+func (g historyGranularity) hours() (n uint32) {
+	switch g {
+	case historyGranularityHour:
+		return 1
+	case historyGranularityDay:
+		return 24
+	default:
+		return 0
+	}
+}
+
+// historyEntry is a single entry of the statistics history.
+type historyEntry struct {
+	// Time is the start of the time range the entry covers.
+	Time time.Time `json:"time"`
+
+	DNSQueries           uint64 `json:"dns_queries"`
+	BlockedFiltering     uint64 `json:"blocked_filtering"`
+	ReplacedSafebrowsing uint64 `json:"replaced_safebrowsing"`
+	ReplacedSafesearch   uint64 `json:"replaced_safesearch"`
+	ReplacedParental     uint64 `json:"replaced_parental"`
+
+	// AvgProcessingTime is the average processing time of the requests in
+	// seconds.
+	AvgProcessingTime float64 `json:"avg_processing_time"`
+
+	// timeSum is the sum of the processing times of all the requests in
+	// microseconds.
+	timeSum uint64
+}
+
+// add adds the counters of udb to e.
+func (e *historyEntry) add(udb *unitDB) {
+	e.DNSQueries += udb.NTotal
+	e.timeSum += uint64(udb.TimeAvg) * udb.NTotal
+
+	nums := make([]uint64, resultLast)
+	copy(nums, udb.NResult)
+
+	e.BlockedFiltering += nums[RFiltered]
+	e.ReplacedSafebrowsing += nums[RSafeBrowsing]
+	e.ReplacedSafesearch += nums[RSafeSearch]
+	e.ReplacedParental += nums[RParental]
+}
+
+// historyResp is the response to the GET /control/stats/history.
+type historyResp struct {
+	Granularity historyGranularity `json:"granularity"`
+	Entries     []*historyEntry    `json:"entries"`
+}
+
+// handleStatsHistory handles requests to the GET /control/stats/history
+// endpoint.
+func (s *StatsCtx) handleStatsHistory(w http.ResponseWriter, r *http.Request) {
+	g := historyGranularityDay
+	if gStr := r.URL.Query().Get("granularity"); gStr != "" {
+		g = historyGranularity(gStr)
+	}
+
+	unitHours := g.hours()
+	if unitHours == 0 && g != historyGranularitySubHour {
+		aghhttp.Error(r, w, http.StatusBadRequest, "granularity: bad value %q", g)
+
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	start := time.Now()
+
+	var entries []*historyEntry
+	var err error
+	if g == historyGranularitySubHour {
+		entries, err = s.subHistory()
+	} else {
+		entries, err = s.history(unitHours)
+	}
+
+	log.Debug("stats: prepared history in %v", time.Since(start))
+
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "getting history: %s", err)
+
+		return
+	}
+
+	_ = aghhttp.WriteJSONResponse(w, r, &historyResp{
+		Granularity: g,
+		Entries:     entries,
+	})
+}
+
+// history returns the statistics data from both the units and the tiers of at
+// most unitHours resolution aggregated into entries of unitHours hours.  The
+// entries are sorted by time, the oldest first.
+func (s *StatsCtx) history(unitHours uint32) (entries []*historyEntry, err error) {
+	byID := map[uint32]*historyEntry{}
+	add := func(id uint32, udb *unitDB) {
+		if unitHours == 24 {
+			id = dayStartID(id, s.loc)
+		} else {
+			id = id / unitHours * unitHours
+		}
+
+		e, ok := byID[id]
+		if !ok {
+			e = &historyEntry{Time: time.Unix(int64(id)*int64(time.Hour/time.Second), 0).In(s.loc)}
+			byID[id] = e
+		}
+
+		e.add(udb)
+	}
+
+	s.currMu.RLock()
+	cur := s.curr
+	if cur != nil {
+		add(cur.id, cur.serialize())
+	}
+	s.currMu.RUnlock()
+
+	db := s.db.Load()
+	if db != nil {
+		err = db.View(func(tx *bbolt.Tx) (txErr error) {
+			return s.historyFromDB(tx, cur, unitHours, add)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sortedHistory(byID), nil
+}
+
+// subHistory returns the statistics data from the sub-hour tier and the
+// current sub-hour unit in entries of subUnitMinutes minutes.  The entries are
+// sorted by time, the oldest first.
+func (s *StatsCtx) subHistory() (entries []*historyEntry, err error) {
+	byID := map[uint32]*historyEntry{}
+	add := func(id uint32, udb *unitDB) {
+		e, ok := byID[id]
+		if !ok {
+			e = &historyEntry{Time: time.Unix(int64(id)*subUnitMinutes*60, 0).In(s.loc)}
+			byID[id] = e
+		}
+
+		e.add(udb)
+	}
+
+	s.currMu.RLock()
+	if cur := s.currSub; cur != nil {
+		add(cur.id, cur.serialize())
+	}
+	s.currMu.RUnlock()
+
+	db := s.db.Load()
+	if db != nil {
+		err = db.View(func(tx *bbolt.Tx) (txErr error) {
+			bkt := tx.Bucket(s.subTier.bucket)
+			if bkt == nil {
+				return nil
+			}
+
+			return forEachTierUnit(bkt, add)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading tier %q: %w", s.subTier.bucket, err)
+		}
+	}
+
+	return sortedHistory(byID), nil
+}
+
+// sortedHistory returns the entries from byID sorted by time, the oldest first,
+// with the average processing time calculated.
+func sortedHistory(byID map[uint32]*historyEntry) (entries []*historyEntry) {
+	entries = make([]*historyEntry, 0, len(byID))
+	for _, e := range byID {
+		if e.DNSQueries != 0 {
+			e.AvgProcessingTime = float64(e.timeSum/e.DNSQueries) / 1000000
+		}
+
+		entries = append(entries, e)
+	}
+
+	slices.SortFunc(entries, func(a, b *historyEntry) (sortsBefore bool) {
+		return a.Time.Before(b.Time)
+	})
+
+	return entries
+}
+
+// historyFromDB passes the units and the units of the tiers of at most
+// unitHours resolution available to tx to add.  cur is the current unit, which
+// is skipped in the database, since it's collected separately.
+func (s *StatsCtx) historyFromDB(
+	tx *bbolt.Tx,
+	cur *unit,
+	unitHours uint32,
+	add func(id uint32, udb *unitDB),
+) (err error) {
+	err = tx.ForEach(func(name []byte, _ *bbolt.Bucket) (_ error) {
+		id, ok := unitNameToID(name)
+		if isTierBucket(name) || !ok || (cur != nil && id == cur.id) {
+			return nil
+		}
+
+		if udb := loadUnitFromDB(tx, id); udb != nil {
+			add(id, udb)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading units: %w", err)
+	}
+
+	for _, t := range s.tiers {
+		bkt := tx.Bucket(t.bucket)
+		if bkt == nil || t.unitHours > unitHours {
+			continue
+		}
+
+		err = forEachTierUnit(bkt, add)
+		if err != nil {
+			return fmt.Errorf("reading tier %q: %w", t.bucket, err)
+		}
+	}
+
+	return nil
+}
+
+// forEachTierUnit passes each valid unit of the tier's bkt to f.
+func forEachTierUnit(bkt *bbolt.Bucket, f func(id uint32, udb *unitDB)) (err error) {
+	return bkt.ForEach(func(k, v []byte) (_ error) {
+		id, ok := unitNameToID(k)
+		if !ok {
+			return nil
+		}
+
+		udb := &unitDB{}
+		decErr := gob.NewDecoder(bytes.NewReader(v)).Decode(udb)
+		if decErr != nil {
+			log.Debug("stats: decoding tier unit %d: %s", id, decErr)
+
+			return nil
+		}
+
+		f(id, udb)
+
+		return nil
+	})
+}
@@ -23,6 +23,17 @@ type StatsResp struct {
 	TopClients []topAddrs `json:"top_clients"`
 	TopBlocked []topAddrs `json:"top_blocked_domains"`
 
+	// TopSafeBrowsingClients and TopParentalClients are the numbers of the
+	// requests blocked by the safe browsing and the parental control services
+	// respectively for the most active clients.
+	TopSafeBrowsingClients []topAddrs `json:"top_safebrowsing_clients"`
+	TopParentalClients     []topAddrs `json:"top_parental_clients"`
+
+	// UnicodeDomains maps the internationalized domain names from TopQueried
+	// and TopBlocked to their Unicode forms.  The names in the tables are kept
+	// in their raw, punycode form.
+	UnicodeDomains map[string]string `json:"unicode_domains,omitempty"`
+
 	DNSQueries []uint64 `json:"dns_queries"`
 
 	BlockedFiltering     []uint64 `json:"blocked_filtering"`
@@ -35,9 +46,53 @@ type StatsResp struct {
 	NumReplacedSafesearch   uint64 `json:"num_replaced_safesearch"`
 	NumReplacedParental     uint64 `json:"num_replaced_parental"`
 
+	// UpstreamServFail, UpstreamTimeouts, UpstreamTLSFailures, and
+	// UpstreamOtherErrors are the numbers of the requests failed because of
+	// the upstreams per time unit.  Such requests aren't counted in the other
+	// fields.
+	UpstreamServFail    []uint64 `json:"upstream_servfail"`
+	UpstreamTimeouts    []uint64 `json:"upstream_timeouts"`
+	UpstreamTLSFailures []uint64 `json:"upstream_tls_failures"`
+	UpstreamOtherErrors []uint64 `json:"upstream_other_errors"`
+
+	// NumUpstreamErrors is the total number of the requests failed because of
+	// the upstreams.
+	NumUpstreamErrors uint64 `json:"num_upstream_errors"`
+
+	// ServedStale is the number of the requests answered with the cached
+	// responses because of the upstream failures per time unit.
+	ServedStale []uint64 `json:"served_stale"`
+
+	// NumServedStale is the total number of the requests answered with the
+	// cached responses because of the upstream failures.
+	NumServedStale uint64 `json:"num_served_stale"`
+
 	AvgProcessingTime float64 `json:"avg_processing_time"`
 }
 
+// Summary is the brief summary of the statistics.
+type Summary struct {
+	TopQueried []topAddrs `json:"top_queried_domains"`
+	TopClients []topAddrs `json:"top_clients"`
+	TopBlocked []topAddrs `json:"top_blocked_domains"`
+
+	// UnicodeDomains maps the internationalized domain names from TopQueried
+	// and TopBlocked to their Unicode forms.
+	UnicodeDomains map[string]string `json:"unicode_domains,omitempty"`
+
+	NumDNSQueries           uint64 `json:"num_dns_queries"`
+	NumBlockedFiltering     uint64 `json:"num_blocked_filtering"`
+	NumReplacedSafebrowsing uint64 `json:"num_replaced_safebrowsing"`
+	NumReplacedSafesearch   uint64 `json:"num_replaced_safesearch"`
+	NumReplacedParental     uint64 `json:"num_replaced_parental"`
+	NumUpstreamErrors       uint64 `json:"num_upstream_errors"`
+
+	AvgProcessingTime float64 `json:"avg_processing_time"`
+
+	// Enabled is true if the statistics are collected.
+	Enabled bool `json:"enabled"`
+}
+
 // handleStats handles requests to the GET /control/stats endpoint.
 func (s *StatsCtx) handleStats(w http.ResponseWriter, r *http.Request) {
 	s.lock.Lock()
@@ -114,4 +169,5 @@ func (s *StatsCtx) initWeb() {
 	s.httpRegister(http.MethodPost, "/control/stats_reset", s.handleStatsReset)
 	s.httpRegister(http.MethodPost, "/control/stats_config", s.handleStatsConfig)
 	s.httpRegister(http.MethodGet, "/control/stats_info", s.handleStatsInfo)
+	s.httpRegister(http.MethodGet, "/control/stats/history", s.handleStatsHistory)
 }
@@ -13,9 +13,9 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/AdguardTeam/golibs/stringutil"
 	"go.etcd.io/bbolt"
 )
 
@@ -31,6 +31,10 @@ type Config struct {
 	// nil, the default function is used, see newUnitID.
 	UnitID UnitIDGenFunc
 
+	// SubUnitID is the function to generate the identifier for the current
+	// sub-hour unit.  If nil, the default function is used, see newSubUnitID.
+	SubUnitID UnitIDGenFunc
+
 	// ConfigModified will be called each time the configuration changed via web
 	// interface.
 	ConfigModified func()
@@ -46,11 +50,22 @@ type Config struct {
 	// current unit.
 	LimitDays uint32
 
+	// HistoryYears is the maximum number of years to keep the daily
+	// aggregates of the statistics data rotated out of the interval for.  If
+	// zero, [DefaultHistoryYears] is used.  It must not be greater than
+	// [MaxHistoryYears].
+	HistoryYears uint32
+
 	// Enabled tells if the statistics are enabled.
 	Enabled bool
 
-	// Ignored is the list of host names, which should not be counted.
-	Ignored *stringutil.Set
+	// Ignored matches the host names and the clients, which requests should
+	// not be counted.
+	Ignored *aghnet.IgnoreMatcher
+
+	// TimeZone is the time zone the days of the statistics start in.  If nil,
+	// UTC is used.
+	TimeZone *time.Location
 }
 
 // Interface is the statistics interface to be used by other packages.
@@ -67,20 +82,29 @@ type Interface interface {
 	// clients with the most number of requests.
 	TopClientsIP(limit uint) []netip.Addr
 
+	// Summary returns the total numbers of the requests and at most limit
+	// top domains and clients over the statistics interval.  ok is false if
+	// the statistics can't be loaded.
+	Summary(limit uint) (sum *Summary, ok bool)
+
 	// WriteDiskConfig puts the Interface's configuration to the dc.
 	WriteDiskConfig(dc *Config)
 
-	// ShouldCount returns true if request for the host should be counted.
-	ShouldCount(host string, qType, qClass uint16) bool
+	// ShouldCount returns true if request for the host from the client with
+	// ip should be counted.
+	ShouldCount(host string, qType, qClass uint16, ip netip.Addr) bool
 }
 
 // StatsCtx collects the statistics and flushes it to the database.  Its default
 // flushing interval is one hour.
 type StatsCtx struct {
-	// currMu protects curr.
+	// currMu protects curr and currSub.
 	currMu *sync.RWMutex
 	// curr is the actual statistics collection result.
 	curr *unit
+	// currSub is the actual statistics collection result of the current
+	// sub-hour unit, see subTier.
+	currSub *unit
 
 	// db is the opened statistics database, if any.
 	db atomic.Pointer[bbolt.DB]
@@ -89,6 +113,10 @@ type StatsCtx struct {
 	// unit.  It's here for only testing purposes.
 	unitIDGen UnitIDGenFunc
 
+	// subUnitIDGen is the function that generates an identifier for the
+	// current sub-hour unit.  It's here for only testing purposes.
+	subUnitIDGen UnitIDGenFunc
+
 	// httpRegister is used to set HTTP handlers.
 	httpRegister aghhttp.RegisterFunc
 
@@ -111,8 +139,20 @@ type StatsCtx struct {
 	// TODO(s.chzhen):  Rewrite to use time.Duration.
 	limitHours uint32
 
-	// ignored is the list of host names, which should not be counted.
-	ignored *stringutil.Set
+	// ignored matches the host names and the clients, which requests should
+	// not be counted.
+	ignored *aghnet.IgnoreMatcher
+
+	// tiers are the levels of downsampled data the units rotated out of the
+	// statistics interval are merged into.
+	tiers []tier
+
+	// subTier is the tier of the sub-hour data.
+	subTier subTier
+
+	// loc is the time zone the days of the statistics start in.  It's never
+	// nil.
+	loc *time.Location
 }
 
 // New creates s from conf and properly initializes it.  Don't use s before
@@ -120,6 +160,16 @@ type StatsCtx struct {
 func New(conf Config) (s *StatsCtx, err error) {
 	defer withRecovered(&err)
 
+	err = ValidateHistoryYears(conf.HistoryYears)
+	if err != nil {
+		return nil, fmt.Errorf("history years: %w", err)
+	}
+
+	loc := conf.TimeZone
+	if loc == nil {
+		loc = time.UTC
+	}
+
 	s = &StatsCtx{
 		enabled:        conf.Enabled,
 		currMu:         &sync.RWMutex{},
@@ -127,6 +177,9 @@ func New(conf Config) (s *StatsCtx, err error) {
 		configModified: conf.ConfigModified,
 		httpRegister:   conf.HTTPRegister,
 		ignored:        conf.Ignored,
+		tiers:          newTiers(conf.HistoryYears, loc),
+		subTier:        newSubTier(),
+		loc:            loc,
 	}
 	if s.limitHours = conf.LimitDays * 24; !checkInterval(conf.LimitDays) {
 		s.limitHours = 24
@@ -134,6 +187,9 @@ func New(conf Config) (s *StatsCtx, err error) {
 	if s.unitIDGen = newUnitID; conf.UnitID != nil {
 		s.unitIDGen = conf.UnitID
 	}
+	if s.subUnitIDGen = newSubUnitID; conf.SubUnitID != nil {
+		s.subUnitIDGen = conf.SubUnitID
+	}
 
 	// TODO(e.burkov):  Move the code below to the Start method.
 
@@ -150,7 +206,7 @@ func New(conf Config) (s *StatsCtx, err error) {
 		return nil, fmt.Errorf("stats: opening a transaction: %w", err)
 	}
 
-	deleted := deleteOldUnits(tx, id-s.limitHours-1)
+	deleted := deleteOldUnits(tx, s.tiers, id, id-s.limitHours-1)
 	udb = loadUnitFromDB(tx, id)
 
 	err = finishTxn(tx, deleted > 0)
@@ -160,6 +216,7 @@ func New(conf Config) (s *StatsCtx, err error) {
 
 	s.curr = newUnit(id)
 	s.curr.deserialize(udb)
+	s.currSub = newUnit(s.subUnitIDGen())
 
 	log.Debug("stats: initialized")
 
@@ -221,6 +278,11 @@ func (s *StatsCtx) Close() (err error) {
 	s.currMu.RLock()
 	defer s.currMu.RUnlock()
 
+	err = s.subTier.flush(tx, s.currSub.id, s.currSub.id, s.currSub.serialize())
+	if err != nil {
+		return fmt.Errorf("flushing sub-hour unit: %w", err)
+	}
+
 	udb := s.curr.serialize()
 
 	return udb.flushUnitToDB(tx, s.curr.id)
@@ -235,7 +297,12 @@ func (s *StatsCtx) Update(e Entry) {
 		return
 	}
 
-	if e.Result == 0 || e.Result >= resultLast || e.Domain == "" || e.Client == "" {
+	if e.Result == 0 ||
+		e.Result >= resultLast ||
+		e.UpstreamError < UpstreamErrNone ||
+		e.UpstreamError >= upstreamErrLast ||
+		e.Domain == "" ||
+		e.Client == "" {
 		log.Debug("stats: malformed entry")
 
 		return
@@ -255,7 +322,8 @@ func (s *StatsCtx) Update(e Entry) {
 		clientID = ip.String()
 	}
 
-	s.curr.add(e.Result, e.Domain, clientID, uint64(e.Time))
+	s.curr.add(&e, clientID)
+	s.currSub.add(&e, clientID)
 }
 
 // WriteDiskConfig implements the Interface interface for *StatsCtx.
@@ -264,8 +332,49 @@ func (s *StatsCtx) WriteDiskConfig(dc *Config) {
 	defer s.lock.Unlock()
 
 	dc.LimitDays = s.limitHours / 24
+	dc.HistoryYears = s.tiers[len(s.tiers)-1].limitHours / (365 * 24)
 	dc.Enabled = s.enabled
 	dc.Ignored = s.ignored
+	dc.TimeZone = s.loc
+}
+
+// Summary implements the [Interface] interface for *StatsCtx.
+func (s *StatsCtx) Summary(limit uint) (sum *Summary, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, ok := s.getData(s.limitHours)
+	if !ok {
+		return nil, false
+	}
+
+	sum = &Summary{
+		TopQueried: cropTop(data.TopQueried, limit),
+		TopClients: cropTop(data.TopClients, limit),
+		TopBlocked: cropTop(data.TopBlocked, limit),
+
+		NumDNSQueries:           data.NumDNSQueries,
+		NumBlockedFiltering:     data.NumBlockedFiltering,
+		NumReplacedSafebrowsing: data.NumReplacedSafebrowsing,
+		NumReplacedSafesearch:   data.NumReplacedSafesearch,
+		NumReplacedParental:     data.NumReplacedParental,
+		NumUpstreamErrors:       data.NumUpstreamErrors,
+
+		AvgProcessingTime: data.AvgProcessingTime,
+		Enabled:           s.enabled,
+	}
+	sum.UnicodeDomains = unicodeDomains(sum.TopQueried, sum.TopBlocked)
+
+	return sum, true
+}
+
+// cropTop returns at most limit first elements of top.  It never returns nil.
+func cropTop(top []topAddrs, limit uint) (cropped []topAddrs) {
+	if uint(len(top)) > limit {
+		top = top[:limit]
+	}
+
+	return append([]topAddrs{}, top...)
 }
 
 // TopClientsIP implements the [Interface] interface for *StatsCtx.
@@ -303,9 +412,10 @@ func (s *StatsCtx) TopClientsIP(maxCount uint) (ips []netip.Addr) {
 	return ips
 }
 
-// deleteOldUnits walks the buckets available to tx and deletes old units.  It
-// returns the number of deletions performed.
-func deleteOldUnits(tx *bbolt.Tx, firstID uint32) (deleted int) {
+// deleteOldUnits walks the buckets available to tx and deletes old units
+// downsampling them into tiers.  curID is the identifier of the current unit.
+// It returns the number of deletions performed.
+func deleteOldUnits(tx *bbolt.Tx, tiers []tier, curID, firstID uint32) (deleted int) {
 	log.Debug("stats: deleting old units until id %d", firstID)
 
 	// TODO(a.garipov): See if this is actually necessary.  Looks like a rather
@@ -313,11 +423,22 @@ func deleteOldUnits(tx *bbolt.Tx, firstID uint32) (deleted int) {
 	const errStop errors.Error = "stop iteration"
 
 	walk := func(name []byte, _ *bbolt.Bucket) (err error) {
+		if isTierBucket(name) {
+			return nil
+		}
+
 		nameID, ok := unitNameToID(name)
 		if ok && nameID >= firstID {
 			return errStop
 		}
 
+		if ok {
+			err = downsample(tx, tiers, curID, nameID, loadUnitFromDB(tx, nameID))
+			if err != nil {
+				log.Debug("stats: downsampling unit %d: %s", nameID, err)
+			}
+		}
+
 		err = tx.DeleteBucket(name)
 		if err != nil {
 			log.Debug("stats: deleting bucket: %s", err)
@@ -337,6 +458,11 @@ func deleteOldUnits(tx *bbolt.Tx, firstID uint32) (deleted int) {
 		log.Debug("stats: deleting units: %s", err)
 	}
 
+	err = rotateTiers(tx, tiers, curID)
+	if err != nil {
+		log.Debug("stats: rotating tiers: %s", err)
+	}
+
 	return deleted
 }
 
@@ -364,7 +490,7 @@ func (s *StatsCtx) openDB() (err error) {
 }
 
 func (s *StatsCtx) flush() (cont bool, sleepFor time.Duration) {
-	id := s.unitIDGen()
+	id, subID := s.unitIDGen(), s.subUnitIDGen()
 
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -377,6 +503,10 @@ func (s *StatsCtx) flush() (cont bool, sleepFor time.Duration) {
 		return false, 0
 	}
 
+	if s.currSub.id != subID {
+		s.flushSubLocked(subID)
+	}
+
 	limit := s.limitHours
 	if limit == 0 || ptr.id == id {
 		return true, time.Second
@@ -408,7 +538,20 @@ func (s *StatsCtx) flush() (cont bool, sleepFor time.Duration) {
 		isCommitable = false
 	}
 
-	delErr := tx.DeleteBucket(idToUnitName(id - limit))
+	oldID := id - limit
+	if old := loadUnitFromDB(tx, oldID); old != nil {
+		err = downsample(tx, s.tiers, id, oldID, old)
+		if err != nil {
+			log.Error("stats: downsampling unit: %s", err)
+		}
+	}
+
+	err = rotateTiers(tx, s.tiers, id)
+	if err != nil {
+		log.Error("stats: rotating tiers: %s", err)
+	}
+
+	delErr := tx.DeleteBucket(idToUnitName(oldID))
 	if delErr != nil {
 		// TODO(e.burkov):  Improve the algorithm of deleting the oldest bucket
 		// to avoid the error.
@@ -423,6 +566,26 @@ func (s *StatsCtx) flush() (cont bool, sleepFor time.Duration) {
 	return true, 0
 }
 
+// flushSubLocked replaces the current sub-hour unit with the new one with
+// subID and writes the data of the former into the sub-hour tier.  s.currMu is
+// expected to be locked.
+func (s *StatsCtx) flushSubLocked(subID uint32) {
+	ptr := s.currSub
+	s.currSub = newUnit(subID)
+
+	db := s.db.Load()
+	if db == nil {
+		return
+	}
+
+	err := db.Update(func(tx *bbolt.Tx) (txErr error) {
+		return s.subTier.flush(tx, subID, ptr.id, ptr.serialize())
+	})
+	if err != nil {
+		log.Error("stats: flushing sub-hour unit: %s", err)
+	}
+}
+
 // periodicFlush checks and flushes the unit to the database if the freshly
 // generated unit ID differs from the current's ID.  Flushing process includes:
 //   - swapping the current unit with the new empty one;
@@ -499,6 +662,7 @@ func (s *StatsCtx) clear() (err error) {
 	defer s.currMu.Unlock()
 
 	s.curr = newUnit(s.unitIDGen())
+	s.currSub = newUnit(s.subUnitIDGen())
 
 	return nil
 }
@@ -557,12 +721,8 @@ func (s *StatsCtx) loadUnits(limit uint32) (units []*unitDB, firstID uint32) {
 	return units, firstID
 }
 
-// ShouldCount returns true if request for the host should be counted.
-func (s *StatsCtx) ShouldCount(host string, _, _ uint16) bool {
-	return !s.isIgnored(host)
-}
-
-// isIgnored returns true if the host is in the Ignored list.
-func (s *StatsCtx) isIgnored(host string) bool {
-	return s.ignored.Has(host)
+// ShouldCount returns true if request for the host from the client with ip
+// should be counted.
+func (s *StatsCtx) ShouldCount(host string, _, _ uint16, ip netip.Addr) bool {
+	return !s.ignored.Has(host, ip)
 }
@@ -1,8 +1,14 @@
 package stats
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -19,16 +25,68 @@ func TestStatsCollector(t *testing.T) {
 	units := make([]*unitDB, 720)
 
 	t.Run("hours", func(t *testing.T) {
-		statsData := statsCollector(units, 0, Hours, ng)
+		statsData := statsCollector(units, 0, Hours, time.UTC, ng)
 		assert.Len(t, statsData, 720)
 	})
 
 	t.Run("days", func(t *testing.T) {
 		for i := 0; i != 25; i++ {
-			statsData := statsCollector(units, uint32(i), Days, ng)
+			statsData := statsCollector(units, uint32(i), Days, time.UTC, ng)
 			require.Lenf(t, statsData, 30, "i=%d", i)
 		}
 	})
+
+	t.Run("time_zone", func(t *testing.T) {
+		loc := time.FixedZone("UTC+3", 3*60*60)
+		firstID := uint32(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC).Unix() / 3600)
+
+		one := func(_ *unitDB) uint64 { return 1 }
+		statsData := statsCollector(units, firstID, Days, loc, one)
+		require.Len(t, statsData, 30)
+
+		// The first 21 hours belong to the previous day in UTC+3, and the
+		// last day is only started.
+		assert.Equal(t, uint64(24), statsData[0])
+		assert.Equal(t, uint64(720-21-29*24), statsData[29])
+	})
+}
+
+func TestDayStartID(t *testing.T) {
+	hourID := func(t time.Time) (id uint32) { return uint32(t.Unix() / 3600) }
+	midnightUTC := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		loc  *time.Location
+		time time.Time
+		want time.Time
+		name string
+	}{{
+		loc:  time.UTC,
+		time: midnightUTC.Add(5 * time.Hour),
+		want: midnightUTC,
+		name: "utc",
+	}, {
+		loc:  time.FixedZone("UTC+3", 3*60*60),
+		time: midnightUTC,
+		want: midnightUTC.Add(-3 * time.Hour),
+		name: "east",
+	}, {
+		loc:  time.FixedZone("UTC-5", -5*60*60),
+		time: midnightUTC,
+		want: midnightUTC.Add(-19 * time.Hour),
+		name: "west",
+	}, {
+		loc:  time.FixedZone("UTC+5:30", (5*60+30)*60),
+		time: midnightUTC,
+		want: midnightUTC.Add(-6 * time.Hour),
+		name: "half_hour",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, hourID(tc.want), dayStartID(hourID(tc.time), tc.loc))
+		})
+	}
 }
 
 func TestStats_races(t *testing.T) {
@@ -101,3 +159,414 @@ func TestStats_races(t *testing.T) {
 		finWG.Wait()
 	}
 }
+
+// loadTierUnit is a helper that returns the unit of tier t with id from the
+// database of s.
+func loadTierUnit(t *testing.T, s *StatsCtx, tr tier, id uint32) (udb *unitDB) {
+	t.Helper()
+
+	tx, err := s.db.Load().Begin(false)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, tx.Rollback()) }()
+
+	bkt := tx.Bucket(tr.bucket)
+	if bkt == nil {
+		return nil
+	}
+
+	data := bkt.Get(idToUnitName(id))
+	if data == nil {
+		return nil
+	}
+
+	udb = &unitDB{}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(udb)
+	require.NoError(t, err)
+
+	return udb
+}
+
+func TestStats_downsample(t *testing.T) {
+	const startID = 1000
+
+	var curID uint32 = startID
+	conf := Config{
+		UnitID:    func() (id uint32) { return atomic.LoadUint32(&curID) },
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		Enabled:   true,
+	}
+
+	s, err := New(conf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	hourTier, dayTier := s.tiers[0], s.tiers[1]
+
+	for _, e := range []Entry{{
+		Domain: "example.org",
+		Client: "1.2.3.4",
+		Result: RNotFiltered,
+		Time:   100,
+	}, {
+		Domain: "blocked.example",
+		Client: "1.2.3.4",
+		Result: RFiltered,
+		Time:   300,
+	}} {
+		s.Update(e)
+	}
+
+	// Flush the current unit.
+	atomic.StoreUint32(&curID, startID+1)
+	cont, _ := s.flush()
+	require.True(t, cont)
+	assert.Nil(t, loadTierUnit(t, s, hourTier, startID))
+
+	// Rotate the unit out of the statistics interval.
+	atomic.StoreUint32(&curID, startID+s.limitHours)
+	cont, _ = s.flush()
+	require.True(t, cont)
+
+	udb := loadTierUnit(t, s, hourTier, startID)
+	require.NotNil(t, udb)
+
+	assert.Equal(t, uint64(2), udb.NTotal)
+	assert.Equal(t, uint64(1), udb.NResult[RFiltered])
+	assert.Equal(t, uint32(200), udb.TimeAvg)
+	assert.Equal(t, []countPair{{Name: "example.org", Count: 1}}, udb.Domains)
+	assert.Equal(t, []countPair{{Name: "1.2.3.4", Count: 2}}, udb.Clients)
+
+	// Rotate the unit out of the hourly tier.
+	atomic.StoreUint32(&curID, startID+hourTier.limitHours)
+	cont, _ = s.flush()
+	require.True(t, cont)
+
+	assert.Nil(t, loadTierUnit(t, s, hourTier, startID))
+
+	udb = loadTierUnit(t, s, dayTier, startID/24*24)
+	require.NotNil(t, udb)
+
+	assert.Equal(t, uint64(2), udb.NTotal)
+	assert.Equal(t, []countPair{{Name: "blocked.example", Count: 1}}, udb.BlockedDomains)
+}
+
+func TestStats_subTier(t *testing.T) {
+	const startSubID = 6000
+
+	var curSubID uint32 = startSubID
+	conf := Config{
+		UnitID:    func() (id uint32) { return startSubID / 6 },
+		SubUnitID: func() (id uint32) { return atomic.LoadUint32(&curSubID) },
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		Enabled:   true,
+	}
+
+	s, err := New(conf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	e := Entry{
+		Domain: "example.org",
+		Client: "1.2.3.4",
+		Result: RNotFiltered,
+		Time:   100,
+	}
+
+	s.Update(e)
+	s.Update(e)
+
+	// Flush the current sub-hour unit.
+	atomic.StoreUint32(&curSubID, startSubID+1)
+	cont, _ := s.flush()
+	require.True(t, cont)
+
+	udb := loadTierUnit(t, s, tier{bucket: s.subTier.bucket}, startSubID)
+	require.NotNil(t, udb)
+
+	assert.Equal(t, uint64(2), udb.NTotal)
+
+	s.Update(e)
+
+	r := httptest.NewRequest(http.MethodGet, "/control/stats/history?granularity=10min", nil)
+	w := httptest.NewRecorder()
+
+	s.handleStatsHistory(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &historyResp{}
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	assert.Equal(t, historyGranularitySubHour, resp.Granularity)
+	require.Len(t, resp.Entries, 2)
+
+	assert.Equal(t, time.Unix(startSubID*600, 0).UTC(), resp.Entries[0].Time)
+	assert.Equal(t, uint64(2), resp.Entries[0].DNSQueries)
+
+	assert.Equal(t, time.Unix((startSubID+1)*600, 0).UTC(), resp.Entries[1].Time)
+	assert.Equal(t, uint64(1), resp.Entries[1].DNSQueries)
+
+	// Rotate the first unit out of the sub-hour tier.
+	atomic.StoreUint32(&curSubID, startSubID+s.subTier.limit)
+	cont, _ = s.flush()
+	require.True(t, cont)
+
+	assert.Nil(t, loadTierUnit(t, s, tier{bucket: s.subTier.bucket}, startSubID))
+
+	udb = loadTierUnit(t, s, tier{bucket: s.subTier.bucket}, startSubID+1)
+	require.NotNil(t, udb)
+
+	assert.Equal(t, uint64(1), udb.NTotal)
+}
+
+func TestUnitDB_merge(t *testing.T) {
+	udb := &unitDB{
+		NTotal:  2,
+		NResult: []uint64{0, 1, 1, 0, 0, 0},
+		Domains: []countPair{{Name: "a.example", Count: 1}},
+		Clients: []countPair{{Name: "1.2.3.4", Count: 2}},
+		TimeAvg: 100,
+
+		SafeBrowsingClients: []countPair{{Name: "1.2.3.4", Count: 1}},
+		NServedStale:        1,
+	}
+
+	udb.merge(&unitDB{
+		NTotal:  2,
+		NResult: []uint64{0, 2, 0, 0, 0, 0},
+		Domains: []countPair{
+			{Name: "a.example", Count: 1},
+			{Name: "b.example", Count: 1},
+		},
+		Clients: []countPair{{Name: "1.2.3.4", Count: 2}},
+		TimeAvg: 300,
+
+		SafeBrowsingClients: []countPair{{Name: "1.2.3.5", Count: 1}},
+		ParentalClients:     []countPair{{Name: "1.2.3.5", Count: 1}},
+		NServedStale:        2,
+	})
+
+	assert.Equal(t, uint64(4), udb.NTotal)
+	assert.Equal(t, []uint64{0, 3, 1, 0, 0, 0}, udb.NResult)
+	assert.Equal(t, uint32(200), udb.TimeAvg)
+	assert.Equal(t, uint64(3), udb.NServedStale)
+	assert.Equal(t, []countPair{
+		{Name: "a.example", Count: 2},
+		{Name: "b.example", Count: 1},
+	}, udb.Domains)
+	assert.Equal(t, []countPair{{Name: "1.2.3.4", Count: 4}}, udb.Clients)
+	assert.ElementsMatch(t, []countPair{
+		{Name: "1.2.3.4", Count: 1},
+		{Name: "1.2.3.5", Count: 1},
+	}, udb.SafeBrowsingClients)
+	assert.Equal(t, []countPair{{Name: "1.2.3.5", Count: 1}}, udb.ParentalClients)
+
+	udb.merge(nil)
+	assert.Equal(t, uint64(4), udb.NTotal)
+}
+
+func TestUnicodeDomains(t *testing.T) {
+	testCases := []struct {
+		want map[string]string
+		name string
+		tops [][]topAddrs
+	}{{
+		want: nil,
+		name: "empty",
+		tops: nil,
+	}, {
+		want: nil,
+		name: "ascii",
+		tops: [][]topAddrs{{{"example.org": 1}}},
+	}, {
+		want: map[string]string{
+			"xn--e1afmkfd.xn--p1ai": "пример.рф",
+			"xn--mnchen-3ya.de":     "münchen.de",
+		},
+		name: "idn",
+		tops: [][]topAddrs{{
+			{"xn--e1afmkfd.xn--p1ai": 2},
+			{"example.org": 1},
+		}, {
+			{"xn--mnchen-3ya.de": 1},
+		}},
+	}, {
+		want: nil,
+		name: "bad_punycode",
+		tops: [][]topAddrs{{{"xn--a.example": 1}}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, unicodeDomains(tc.tops...))
+		})
+	}
+}
+
+func TestStatsCtx_handleStatsHistory(t *testing.T) {
+	// startID is the first hour of a day.
+	const startID = 2000 * 24
+
+	var curID uint32 = startID
+	conf := Config{
+		UnitID:    func() (id uint32) { return atomic.LoadUint32(&curID) },
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		Enabled:   true,
+	}
+
+	s, err := New(conf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	e := Entry{
+		Domain: "example.org",
+		Client: "1.2.3.4",
+		Result: RFiltered,
+		Time:   100,
+	}
+
+	s.Update(e)
+	s.Update(e)
+
+	atomic.StoreUint32(&curID, startID+1)
+	cont, _ := s.flush()
+	require.True(t, cont)
+
+	s.Update(e)
+
+	getHistory := func(t *testing.T, query string) (resp *historyResp) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "/control/stats/history"+query, nil)
+		w := httptest.NewRecorder()
+
+		s.handleStatsHistory(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp = &historyResp{}
+		err = json.NewDecoder(w.Body).Decode(resp)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	hourTime := func(id uint32) (t time.Time) {
+		return time.Unix(int64(id)*3600, 0).UTC()
+	}
+
+	t.Run("hour", func(t *testing.T) {
+		resp := getHistory(t, "?granularity=hour")
+		assert.Equal(t, historyGranularityHour, resp.Granularity)
+
+		require.Len(t, resp.Entries, 2)
+
+		assert.Equal(t, hourTime(startID), resp.Entries[0].Time)
+		assert.Equal(t, uint64(2), resp.Entries[0].DNSQueries)
+		assert.Equal(t, uint64(2), resp.Entries[0].BlockedFiltering)
+		assert.Equal(t, 0.0001, resp.Entries[0].AvgProcessingTime)
+
+		assert.Equal(t, hourTime(startID+1), resp.Entries[1].Time)
+		assert.Equal(t, uint64(1), resp.Entries[1].DNSQueries)
+	})
+
+	// Rotate the first unit out of the statistics interval into the tiers.
+	atomic.StoreUint32(&curID, startID+s.limitHours)
+	cont, _ = s.flush()
+	require.True(t, cont)
+
+	t.Run("day", func(t *testing.T) {
+		resp := getHistory(t, "")
+		assert.Equal(t, historyGranularityDay, resp.Granularity)
+
+		require.Len(t, resp.Entries, 2)
+
+		assert.Equal(t, hourTime(startID), resp.Entries[0].Time)
+		assert.Equal(t, uint64(3), resp.Entries[0].DNSQueries)
+
+		assert.Equal(t, hourTime(startID+24), resp.Entries[1].Time)
+		assert.Zero(t, resp.Entries[1].DNSQueries)
+	})
+
+	t.Run("bad_granularity", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/control/stats/history?granularity=week", nil)
+		w := httptest.NewRecorder()
+
+		s.handleStatsHistory(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "granularity: bad value \"week\"\n", w.Body.String())
+	})
+}
+
+func TestTopCounter(t *testing.T) {
+	t.Run("exact", func(t *testing.T) {
+		c := newTopCounter(2)
+		c.add("a.example", 1)
+		c.add("b.example", 3)
+		c.add("a.example", 1)
+		c.add("c.example", 1)
+
+		assert.Equal(t, []countPair{{
+			Name:  "b.example",
+			Count: 3,
+		}, {
+			Name:  "a.example",
+			Count: 2,
+		}}, c.pairs())
+	})
+
+	t.Run("many_names", func(t *testing.T) {
+		const (
+			size         = 10
+			heavyCount   = 1_000
+			uniqueCount  = 100_000
+			maxOverCount = uniqueCount / 100
+		)
+
+		c := newTopCounter(size)
+		for i := 0; i < uniqueCount; i++ {
+			c.add(fmt.Sprintf("dga-%d.example", i), 1)
+			if i%(uniqueCount/heavyCount) == 0 {
+				for j := 0; j < size; j++ {
+					c.add(fmt.Sprintf("heavy-%d.example", j), 1)
+				}
+			}
+		}
+
+		pairs := c.pairs()
+		require.Len(t, pairs, size)
+
+		for _, p := range pairs {
+			assert.True(t, strings.HasPrefix(p.Name, "heavy-"), p.Name)
+			assert.GreaterOrEqual(t, p.Count, uint64(heavyCount))
+			assert.LessOrEqual(t, p.Count, uint64(heavyCount+maxOverCount))
+		}
+
+		assert.Len(t, c.top.index, size)
+		assert.Len(t, c.sketch, sketchDepth*sketchWidth)
+	})
+
+	t.Run("from_pairs", func(t *testing.T) {
+		pairs := []countPair{{
+			Name:  "b.example",
+			Count: 5,
+		}, {
+			Name:  "a.example",
+			Count: 2,
+		}}
+
+		c := topCounterFromPairs(pairs, maxDomains)
+		assert.Equal(t, pairs, c.pairs())
+
+		c.add("a.example", 4)
+		assert.Equal(t, []countPair{{
+			Name:  "a.example",
+			Count: 6,
+		}, {
+			Name:  "b.example",
+			Count: 5,
+		}}, c.pairs())
+	})
+}
@@ -75,10 +75,17 @@ func TestStats(t *testing.T) {
 			Result: stats.RFiltered,
 			Time:   123456,
 		}, {
-			Domain: reqDomain,
-			Client: cliIPStr,
-			Result: stats.RNotFiltered,
-			Time:   123456,
+			Domain:      reqDomain,
+			Client:      cliIPStr,
+			Result:      stats.RNotFiltered,
+			Time:        123456,
+			ServedStale: true,
+		}, {
+			Domain:        "failed",
+			Client:        cliIPStr,
+			Result:        stats.RNotFiltered,
+			Time:          5000000,
+			UpstreamError: stats.UpstreamErrTimeout,
 		}}
 
 		wantData := &stats.StatsResp{
@@ -86,6 +93,10 @@ func TestStats(t *testing.T) {
 			TopQueried: []map[string]uint64{0: {reqDomain: 1}},
 			TopClients: []map[string]uint64{0: {cliIPStr: 2}},
 			TopBlocked: []map[string]uint64{0: {reqDomain: 1}},
+
+			TopSafeBrowsingClients: []map[string]uint64{},
+			TopParentalClients:     []map[string]uint64{},
+
 			DNSQueries: []uint64{
 				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
 				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
@@ -107,7 +118,29 @@ func TestStats(t *testing.T) {
 			NumReplacedSafebrowsing: 0,
 			NumReplacedSafesearch:   0,
 			NumReplacedParental:     0,
-			AvgProcessingTime:       0.123456,
+			UpstreamServFail: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+			UpstreamTimeouts: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			},
+			UpstreamTLSFailures: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+			UpstreamOtherErrors: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			},
+			NumUpstreamErrors: 1,
+			ServedStale: []uint64{
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			},
+			NumServedStale:    1,
+			AvgProcessingTime: 0.123456,
 		}
 
 		for _, e := range entries {
@@ -128,20 +161,51 @@ func TestStats(t *testing.T) {
 		assert.Equal(t, cliIP, topClients[0])
 	})
 
+	t.Run("summary", func(t *testing.T) {
+		sum, ok := s.Summary(1)
+		require.True(t, ok)
+
+		assert.Equal(t, &stats.Summary{
+			TopQueried:          []map[string]uint64{{"domain": 1}},
+			TopClients:          []map[string]uint64{{cliIPStr: 2}},
+			TopBlocked:          []map[string]uint64{{"domain": 1}},
+			NumDNSQueries:       2,
+			NumBlockedFiltering: 1,
+			NumUpstreamErrors:   1,
+			AvgProcessingTime:   0.123456,
+			Enabled:             true,
+		}, sum)
+
+		sum, ok = s.Summary(0)
+		require.True(t, ok)
+
+		assert.Empty(t, sum.TopQueried)
+		assert.NotNil(t, sum.TopQueried)
+	})
+
 	t.Run("reset", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/control/stats_reset", nil)
 		assertSuccessAndUnmarshal(t, nil, handlers["/control/stats_reset"], req)
 
 		_24zeroes := [24]uint64{}
 		emptyData := &stats.StatsResp{
-			TimeUnits:            "hours",
-			TopQueried:           []map[string]uint64{},
-			TopClients:           []map[string]uint64{},
-			TopBlocked:           []map[string]uint64{},
+			TimeUnits:  "hours",
+			TopQueried: []map[string]uint64{},
+			TopClients: []map[string]uint64{},
+			TopBlocked: []map[string]uint64{},
+
+			TopSafeBrowsingClients: []map[string]uint64{},
+			TopParentalClients:     []map[string]uint64{},
+
 			DNSQueries:           _24zeroes[:],
 			BlockedFiltering:     _24zeroes[:],
 			ReplacedSafebrowsing: _24zeroes[:],
 			ReplacedParental:     _24zeroes[:],
+			UpstreamServFail:     _24zeroes[:],
+			UpstreamTimeouts:     _24zeroes[:],
+			UpstreamTLSFailures:  _24zeroes[:],
+			UpstreamOtherErrors:  _24zeroes[:],
+			ServedStale:          _24zeroes[:],
 		}
 
 		req = httptest.NewRequest(http.MethodGet, "/control/stats", nil)
@@ -152,6 +216,68 @@ func TestStats(t *testing.T) {
 	})
 }
 
+func TestStats_clientTops(t *testing.T) {
+	const (
+		kidCli    = "192.168.0.2"
+		parentCli = "192.168.0.3"
+	)
+
+	handlers := map[string]http.Handler{}
+	s, err := stats.New(stats.Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		Enabled:   true,
+		UnitID:    constUnitID,
+		HTTPRegister: func(_, url string, handler http.HandlerFunc) {
+			handlers[url] = handler
+		},
+	})
+	require.NoError(t, err)
+
+	s.Start()
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	for _, e := range []stats.Entry{{
+		Domain: "adult.example",
+		Client: kidCli,
+		Result: stats.RParental,
+	}, {
+		Domain: "adult.example",
+		Client: kidCli,
+		Result: stats.RParental,
+	}, {
+		Domain: "malware.example",
+		Client: kidCli,
+		Result: stats.RSafeBrowsing,
+	}, {
+		Domain: "phishing.example",
+		Client: parentCli,
+		Result: stats.RSafeBrowsing,
+	}, {
+		Domain: "phishing.example",
+		Client: parentCli,
+		Result: stats.RSafeBrowsing,
+	}, {
+		Domain: "example.org",
+		Client: parentCli,
+		Result: stats.RNotFiltered,
+	}} {
+		s.Update(e)
+	}
+
+	data := &stats.StatsResp{}
+	req := httptest.NewRequest(http.MethodGet, "/control/stats", nil)
+	assertSuccessAndUnmarshal(t, data, handlers["/control/stats"], req)
+
+	assert.Equal(t, []map[string]uint64{
+		{parentCli: 2},
+		{kidCli: 1},
+	}, data.TopSafeBrowsingClients)
+	assert.Equal(t, []map[string]uint64{{kidCli: 2}}, data.TopParentalClients)
+	assert.Equal(t, uint64(3), data.NumReplacedSafebrowsing)
+	assert.Equal(t, uint64(2), data.NumReplacedParental)
+}
+
 func TestLargeNumbers(t *testing.T) {
 	var curHour uint32 = 1
 	handlers := map[string]http.Handler{}
@@ -0,0 +1,318 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+	"go.etcd.io/bbolt"
+)
+
+// tierBucketPrefix is the prefix of the names of database buckets containing
+// the downsampled statistics data.  It's used to distinguish them from the
+// buckets of hourly units.
+const tierBucketPrefix = "tier:"
+
+// tier is a level of downsampled statistics data.  The hourly units which are
+// rotated out of the statistics interval are merged into the tiers, so that
+// long-term trends are kept in a lower resolution instead of being lost.
+type tier struct {
+	// bucket is the name of the database bucket containing the units of the
+	// tier.  It must start with tierBucketPrefix.
+	bucket []byte
+
+	// unitHours is the number of hours aggregated into a single unit of the
+	// tier.
+	unitHours uint32
+
+	// loc is the time zone the days of the tier's units start in.  It's only
+	// used for the tiers of daily units.
+	loc *time.Location
+
+	// limitHours is the maximum age of the data kept in the tier, in hours.
+	limitHours uint32
+}
+
+// DefaultHistoryYears is the default number of years to keep the daily
+// statistics data for.
+const DefaultHistoryYears = 5
+
+// MaxHistoryYears is the maximum number of years to keep the daily statistics
+// data for.
+const MaxHistoryYears = 100
+
+// ValidateHistoryYears returns an error if years is not a valid number of years
+// to keep the daily statistics data for.
+func ValidateHistoryYears(years uint32) (err error) {
+	if years > MaxHistoryYears {
+		return fmt.Errorf("%d is greater than %d", years, MaxHistoryYears)
+	}
+
+	return nil
+}
+
+// newTiers returns the tiers used to downsample the statistics data.  The
+// hourly units are kept for three months and the daily ones are kept for
+// years, or for [DefaultHistoryYears] if years is zero.  Tiers are sorted by
+// limitHours.  The daily units start at the midnight in loc, which must not be
+// nil.  The 10-minute data is kept separately, see subTier.
+func newTiers(years uint32, loc *time.Location) (tiers []tier) {
+	if years == 0 {
+		years = DefaultHistoryYears
+	}
+
+	return []tier{{
+		bucket:     []byte(tierBucketPrefix + "hour"),
+		unitHours:  1,
+		limitHours: 90 * 24,
+	}, {
+		bucket:     []byte(tierBucketPrefix + "day"),
+		unitHours:  24,
+		loc:        loc,
+		limitHours: years * 365 * 24,
+	}}
+}
+
+// isTierBucket returns true if name is a name of the database bucket
+// containing the tier's data.
+func isTierBucket(name []byte) (ok bool) {
+	return bytes.HasPrefix(name, []byte(tierBucketPrefix))
+}
+
+// downsample merges udb, the data of the unit with id, into the first of the
+// tiers still keeping the data of such age.  curID is the identifier of the
+// current unit.  The data is dropped if no such tier exists.
+func downsample(tx *bbolt.Tx, tiers []tier, curID, id uint32, udb *unitDB) (err error) {
+	var age uint32
+	if curID > id {
+		age = curID - id
+	}
+
+	for _, t := range tiers {
+		if age >= t.limitHours {
+			continue
+		}
+
+		return t.merge(tx, id, udb)
+	}
+
+	log.Debug("stats: dropping unit %d of age %d hours", id, age)
+
+	return nil
+}
+
+// merge adds udb, the data of the unit with id, to the tier's unit covering
+// it.
+func (t tier) merge(tx *bbolt.Tx, id uint32, udb *unitDB) (err error) {
+	return mergeTierUnit(tx, t.bucket, t.unitID(id), udb)
+}
+
+// unitID returns the identifier of the tier's unit covering the hourly unit
+// with id.
+func (t tier) unitID(id uint32) (tierID uint32) {
+	if t.unitHours == 24 && t.loc != nil {
+		return dayStartID(id, t.loc)
+	}
+
+	return id / t.unitHours * t.unitHours
+}
+
+// mergeTierUnit adds udb to the unit with id in the tier's bucket.
+func mergeTierUnit(tx *bbolt.Tx, bucket []byte, id uint32, udb *unitDB) (err error) {
+	bkt, err := tx.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return fmt.Errorf("creating tier bucket: %w", err)
+	}
+
+	key := idToUnitName(id)
+	merged := &unitDB{NResult: make([]uint64, resultLast)}
+	if data := bkt.Get(key); data != nil {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(merged)
+		if err != nil {
+			return fmt.Errorf("decoding tier unit: %w", err)
+		}
+	}
+
+	merged.merge(udb)
+
+	buf := &bytes.Buffer{}
+	err = gob.NewEncoder(buf).Encode(merged)
+	if err != nil {
+		return fmt.Errorf("encoding tier unit: %w", err)
+	}
+
+	return bkt.Put(key, buf.Bytes())
+}
+
+// subUnitMinutes is the length of the units of the sub-hour tier in minutes.
+const subUnitMinutes = 10
+
+// newSubUnitID is the default UnitIDGenFunc for the sub-hour units.  It returns
+// the number of the subUnitMinutes intervals since the beginning of UNIX time.
+func newSubUnitID() (id uint32) {
+	const secsInSubUnit = int64(subUnitMinutes * time.Minute / time.Second)
+
+	return uint32(time.Now().Unix() / secsInSubUnit)
+}
+
+// subTier is the tier of the sub-hour statistics data.  Unlike the other
+// tiers, it isn't filled by downsampling the hourly units, which don't have
+// such a resolution, but directly by the sub-hour units collected along with
+// the hourly ones.  Its units are identified by the number of the
+// subUnitMinutes intervals since the beginning of UNIX time.
+type subTier struct {
+	// bucket is the name of the database bucket containing the units of the
+	// tier.  It must start with tierBucketPrefix.
+	bucket []byte
+
+	// limit is the maximum age of the data kept in the tier, in units.
+	limit uint32
+}
+
+// newSubTier returns the sub-hour tier keeping the 10-minute units for a week.
+func newSubTier() (t subTier) {
+	return subTier{
+		bucket: []byte(tierBucketPrefix + "10min"),
+		limit:  7 * 24 * 60 / subUnitMinutes,
+	}
+}
+
+// flush adds udb, the data of the sub-hour unit with id, to the tier and
+// removes the units older than the tier's limit.  curID is the identifier of
+// the current sub-hour unit.  The empty units aren't stored.
+func (t subTier) flush(tx *bbolt.Tx, curID, id uint32, udb *unitDB) (err error) {
+	if udb.NTotal == 0 {
+		return nil
+	}
+
+	err = mergeTierUnit(tx, t.bucket, id, udb)
+	if err != nil {
+		return err
+	}
+
+	bkt := tx.Bucket(t.bucket)
+
+	var expired []uint32
+	c := bkt.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		kid, ok := unitNameToID(k)
+		if !ok {
+			continue
+		} else if kid > curID || curID-kid < t.limit {
+			// The keys are sorted, so all the following units are fresh.
+			break
+		}
+
+		expired = append(expired, kid)
+	}
+
+	for _, kid := range expired {
+		err = bkt.Delete(idToUnitName(kid))
+		if err != nil {
+			return fmt.Errorf("deleting sub-hour unit: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// rotateTiers removes the units older than the tier's limit from each of the
+// tiers and merges them into the tiers of lower resolution.  curID is the
+// identifier of the current unit.
+func rotateTiers(tx *bbolt.Tx, tiers []tier, curID uint32) (err error) {
+	for i, t := range tiers {
+		bkt := tx.Bucket(t.bucket)
+		if bkt == nil {
+			continue
+		}
+
+		var expired []uint32
+		var udbs []*unitDB
+
+		c := bkt.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			id, ok := unitNameToID(k)
+			if !ok {
+				continue
+			} else if id > curID || curID-id < t.limitHours {
+				// The keys are sorted, so all the following units are fresh.
+				break
+			}
+
+			udb := &unitDB{}
+			err = gob.NewDecoder(bytes.NewReader(v)).Decode(udb)
+			if err != nil {
+				log.Debug("stats: decoding tier unit %d: %s", id, err)
+			} else {
+				expired = append(expired, id)
+				udbs = append(udbs, udb)
+			}
+		}
+
+		for j, id := range expired {
+			err = bkt.Delete(idToUnitName(id))
+			if err != nil {
+				return fmt.Errorf("deleting tier unit: %w", err)
+			}
+
+			err = downsample(tx, tiers[i+1:], curID, id, udbs[j])
+			if err != nil {
+				return fmt.Errorf("downsampling tier unit: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// merge adds the data of other to udb, keeping at most maxDomains domains and
+// maxClients clients in the tops.  udb must not be nil.
+func (udb *unitDB) merge(other *unitDB) {
+	if other == nil {
+		return
+	}
+
+	if total := udb.NTotal + other.NTotal; total != 0 {
+		udb.TimeAvg = uint32(
+			(uint64(udb.TimeAvg)*udb.NTotal + uint64(other.TimeAvg)*other.NTotal) / total,
+		)
+	}
+
+	udb.NTotal += other.NTotal
+	udb.NResult = addNums(udb.NResult, other.NResult)
+	udb.NUpstreamErr = addNums(udb.NUpstreamErr, other.NUpstreamErr)
+	udb.NServedStale += other.NServedStale
+
+	udb.Domains = mergePairs(udb.Domains, other.Domains, maxDomains)
+	udb.BlockedDomains = mergePairs(udb.BlockedDomains, other.BlockedDomains, maxDomains)
+	udb.Clients = mergePairs(udb.Clients, other.Clients, maxClients)
+	udb.SafeBrowsingClients = mergePairs(udb.SafeBrowsingClients, other.SafeBrowsingClients, maxClients)
+	udb.ParentalClients = mergePairs(udb.ParentalClients, other.ParentalClients, maxClients)
+}
+
+// addNums adds the numbers of b to the numbers of a with the same indexes,
+// extending a if necessary, and returns the result.
+func addNums(a, b []uint64) (sum []uint64) {
+	if len(a) < len(b) {
+		a = append(a, make([]uint64, len(b)-len(a))...)
+	}
+
+	for i, n := range b {
+		a[i] += n
+	}
+
+	return a
+}
+
+// mergePairs sums the counts of a and b and returns at most max pairs with the
+// highest counts.
+func mergePairs(a, b []countPair, max int) (merged []countPair) {
+	m := convertSliceToMap(a)
+	for _, p := range b {
+		m[p.Name] += p.Count
+	}
+
+	return convertMapToSlice(m, max)
+}
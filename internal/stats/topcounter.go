@@ -0,0 +1,164 @@
+package stats
+
+import (
+	"container/heap"
+	"hash/maphash"
+	"math"
+
+	"github.com/AdguardTeam/golibs/mathutil"
+	"golang.org/x/exp/slices"
+)
+
+// Count-min sketch dimensions.  The counts are overestimated by at most
+// e/sketchWidth of the total count with the probability of 1-e^(-sketchDepth),
+// while each sketch takes sketchDepth*sketchWidth*8 bytes.
+const (
+	sketchDepth = 4
+	sketchWidth = 1024
+)
+
+// topCounter counts the occurrences of names keeping only the most frequent
+// ones, so that its memory usage doesn't depend on the number of distinct
+// names.  The counts are estimated using a count-min sketch with conservative
+// update, so they may be overestimated but never underestimated.
+type topCounter struct {
+	// top is the min-heap of the most frequent names.
+	top *topHeap
+
+	// sketch are the rows of the counters of the count-min sketch.  It's
+	// allocated on the first addition.
+	sketch []uint64
+
+	// seed is the seed of the hash function of the sketch.
+	seed maphash.Seed
+
+	// size is the maximum number of the names in top.
+	size int
+}
+
+// newTopCounter returns a new *topCounter keeping at most size most frequent
+// names.
+func newTopCounter(size int) (c *topCounter) {
+	return &topCounter{
+		top: &topHeap{
+			index: map[string]int{},
+		},
+		seed: maphash.MakeSeed(),
+		size: size,
+	}
+}
+
+// topCounterFromPairs returns a new *topCounter keeping at most size most
+// frequent names with the counts from pairs.
+func topCounterFromPairs(pairs []countPair, size int) (c *topCounter) {
+	c = newTopCounter(size)
+	for _, p := range pairs {
+		c.add(p.Name, p.Count)
+	}
+
+	return c
+}
+
+// add adds n to the count of name.
+func (c *topCounter) add(name string, n uint64) {
+	if c.sketch == nil {
+		c.sketch = make([]uint64, sketchDepth*sketchWidth)
+	}
+
+	// Use double hashing to get the independent indexes for each row.
+	h := maphash.String(c.seed, name)
+	lo, hi := uint32(h), uint32(h>>32)|1
+
+	var idxs [sketchDepth]int
+	var est uint64 = math.MaxUint64
+	for i := range idxs {
+		idxs[i] = i*sketchWidth + int((lo+uint32(i)*hi)%sketchWidth)
+		est = mathutil.Min(est, c.sketch[idxs[i]])
+	}
+
+	// Only increase the counters which would otherwise be lower than the new
+	// estimate, which decreases the overestimation.
+	est += n
+	for _, idx := range idxs {
+		if c.sketch[idx] < est {
+			c.sketch[idx] = est
+		}
+	}
+
+	c.update(name, est)
+}
+
+// update sets the count of name in the top, if it's among the most frequent
+// names.
+func (c *topCounter) update(name string, count uint64) {
+	t := c.top
+	if i, ok := t.index[name]; ok {
+		t.pairs[i].Count = count
+		heap.Fix(t, i)
+	} else if len(t.pairs) < c.size {
+		heap.Push(t, countPair{Name: name, Count: count})
+	} else if len(t.pairs) > 0 && count > t.pairs[0].Count {
+		delete(t.index, t.pairs[0].Name)
+		t.pairs[0] = countPair{Name: name, Count: count}
+		t.index[name] = 0
+		heap.Fix(t, 0)
+	}
+}
+
+// pairs returns the most frequent names with their counts sorted by the count
+// in descending order.
+func (c *topCounter) pairs() (pairs []countPair) {
+	pairs = slices.Clone(c.top.pairs)
+	slices.SortFunc(pairs, func(a, b countPair) (sortsBefore bool) {
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+
+		return a.Name < b.Name
+	})
+
+	return pairs
+}
+
+// topHeap is a min-heap of the name-number pairs by the count.
+type topHeap struct {
+	// index are the indexes of the names in pairs.
+	index map[string]int
+
+	// pairs are the pairs in the heap order.
+	pairs []countPair
+}
+
+// type check
+var _ heap.Interface = (*topHeap)(nil)
+
+// Len implements the [heap.Interface] interface for *topHeap.
+func (t *topHeap) Len() (n int) { return len(t.pairs) }
+
+// Less implements the [heap.Interface] interface for *topHeap.
+func (t *topHeap) Less(i, j int) (less bool) { return t.pairs[i].Count < t.pairs[j].Count }
+
+// Swap implements the [heap.Interface] interface for *topHeap.
+func (t *topHeap) Swap(i, j int) {
+	t.pairs[i], t.pairs[j] = t.pairs[j], t.pairs[i]
+	t.index[t.pairs[i].Name] = i
+	t.index[t.pairs[j].Name] = j
+}
+
+// Push implements the [heap.Interface] interface for *topHeap.  x must be a
+// countPair.
+func (t *topHeap) Push(x any) {
+	p := x.(countPair)
+	t.index[p.Name] = len(t.pairs)
+	t.pairs = append(t.pairs, p)
+}
+
+// Pop implements the [heap.Interface] interface for *topHeap.
+func (t *topHeap) Pop() (x any) {
+	last := len(t.pairs) - 1
+	p := t.pairs[last]
+	t.pairs = t.pairs[:last]
+	delete(t.index, p.Name)
+
+	return p
+}
@@ -5,13 +5,15 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/AdguardTeam/golibs/stringutil"
 	"go.etcd.io/bbolt"
 	"golang.org/x/exp/slices"
+	"golang.org/x/net/idna"
 )
 
 // TODO(a.garipov): Rewrite all of this.  Add proper error handling and
@@ -53,6 +55,32 @@ const (
 	resultLast = RParental + 1
 )
 
+// UpstreamError is the kind of the upstream failure which prevented the DNS
+// request from being resolved.
+type UpstreamError int
+
+// Supported UpstreamError values.
+const (
+	// UpstreamErrNone means that there was no upstream failure.
+	UpstreamErrNone UpstreamError = iota
+
+	// UpstreamErrServFail means that the upstream responded with SERVFAIL.
+	UpstreamErrServFail
+
+	// UpstreamErrTimeout means that the upstream didn't respond in time.
+	UpstreamErrTimeout
+
+	// UpstreamErrTLS means that the TLS connection to the upstream failed, for
+	// example, because of an invalid certificate.
+	UpstreamErrTLS
+
+	// UpstreamErrOther means any other upstream failure, for example, a
+	// refused connection.
+	UpstreamErrOther
+
+	upstreamErrLast = UpstreamErrOther + 1
+)
+
 // Entry is a statistics data entry.
 type Entry struct {
 	// Clients is the client's primary ID.
@@ -68,6 +96,15 @@ type Entry struct {
 
 	// Time is the duration of the request processing in milliseconds.
 	Time uint32
+
+	// UpstreamError is the kind of the upstream failure, if any.  The failed
+	// requests are only counted in the upstream errors, so that they don't
+	// affect the other statistics.
+	UpstreamError UpstreamError
+
+	// ServedStale is true if the request has been answered with a cached,
+	// possibly expired, response because of the upstream failure.
+	ServedStale bool
 }
 
 // unit collects the statistics data for a specific period of time.
@@ -87,13 +124,27 @@ type unit struct {
 	// written by the unit.
 	timeSum uint64
 
-	// domains stores the number of requests for each domain.
-	domains map[string]uint64
-	// blockedDomains stores the number of requests for each domain that has
-	// been blocked.
-	blockedDomains map[string]uint64
-	// clients stores the number of requests from each client.
-	clients map[string]uint64
+	// domains stores the number of requests for the most requested domains.
+	domains *topCounter
+	// blockedDomains stores the number of requests for the most requested
+	// domains that have been blocked.
+	blockedDomains *topCounter
+	// clients stores the number of requests from the most active clients.
+	clients *topCounter
+	// safeBrowsingClients stores the number of requests blocked by the safe
+	// browsing service for the most active clients.
+	safeBrowsingClients *topCounter
+	// parentalClients stores the number of requests blocked by the parental
+	// control service for the most active clients.
+	parentalClients *topCounter
+
+	// nUpstreamErr stores the number of requests failed because of the
+	// upstreams grouped by the kind of the failure.
+	nUpstreamErr []uint64
+
+	// nServedStale stores the number of requests answered with the cached
+	// responses because of the upstream failures.
+	nServedStale uint64
 }
 
 // newUnit allocates the new *unit.
@@ -101,9 +152,13 @@ func newUnit(id uint32) (u *unit) {
 	return &unit{
 		id:             id,
 		nResult:        make([]uint64, resultLast),
-		domains:        make(map[string]uint64),
-		blockedDomains: make(map[string]uint64),
-		clients:        make(map[string]uint64),
+		nUpstreamErr:   make([]uint64, upstreamErrLast),
+		domains:        newTopCounter(maxDomains),
+		blockedDomains: newTopCounter(maxDomains),
+		clients:        newTopCounter(maxClients),
+
+		safeBrowsingClients: newTopCounter(maxClients),
+		parentalClients:     newTopCounter(maxClients),
 	}
 }
 
@@ -127,10 +182,36 @@ type unitDB struct {
 	BlockedDomains []countPair
 	// Clients is the number of requests from each client.
 	Clients []countPair
+	// SafeBrowsingClients is the number of requests blocked by the safe
+	// browsing service for each client.  It's empty for the units stored by
+	// the previous versions.
+	SafeBrowsingClients []countPair
+	// ParentalClients is the number of requests blocked by the parental
+	// control service for each client.  It's empty for the units stored by the
+	// previous versions.
+	ParentalClients []countPair
 
 	// TimeAvg is the average of processing times in milliseconds of all the
 	// requests in the unit.
 	TimeAvg uint32
+
+	// NUpstreamErr is the number of requests failed because of the upstreams
+	// by the failure's kind.  It may be shorter than upstreamErrLast or empty
+	// for the units stored by the previous versions.
+	NUpstreamErr []uint64
+
+	// NServedStale is the number of requests answered with the cached
+	// responses because of the upstream failures.
+	NServedStale uint64
+}
+
+// upstreamErrs returns the number of upstream failures of kind in udb.
+func (udb *unitDB) upstreamErrs(kind UpstreamError) (n uint64) {
+	if int(kind) >= len(udb.NUpstreamErr) {
+		return 0
+	}
+
+	return udb.NUpstreamErr[kind]
 }
 
 // newUnitID is the default UnitIDGenFunc that generates the unique id hourly.
@@ -140,6 +221,16 @@ func newUnitID() (id uint32) {
 	return uint32(time.Now().Unix() / secsInHour)
 }
 
+// dayStartID returns the identifier of the hourly unit containing the start of
+// the day in loc, which contains the hourly unit with id.  loc must not be nil.
+func dayStartID(id uint32, loc *time.Location) (startID uint32) {
+	const secsInHour = int64(time.Hour / time.Second)
+
+	y, m, d := time.Unix(int64(id)*secsInHour, 0).In(loc).Date()
+
+	return uint32(time.Date(y, m, d, 0, 0, 0, 0, loc).Unix() / secsInHour)
+}
+
 func finishTxn(tx *bbolt.Tx, commit bool) (err error) {
 	if commit {
 		err = errors.Annotate(tx.Commit(), "committing: %w")
@@ -210,10 +301,15 @@ func (u *unit) serialize() (udb *unitDB) {
 	return &unitDB{
 		NTotal:         u.nTotal,
 		NResult:        append([]uint64{}, u.nResult...),
-		Domains:        convertMapToSlice(u.domains, maxDomains),
-		BlockedDomains: convertMapToSlice(u.blockedDomains, maxDomains),
-		Clients:        convertMapToSlice(u.clients, maxClients),
+		Domains:        u.domains.pairs(),
+		BlockedDomains: u.blockedDomains.pairs(),
+		Clients:        u.clients.pairs(),
 		TimeAvg:        timeAvg,
+		NUpstreamErr:   append([]uint64{}, u.nUpstreamErr...),
+
+		SafeBrowsingClients: u.safeBrowsingClients.pairs(),
+		ParentalClients:     u.parentalClients.pairs(),
+		NServedStale:        u.nServedStale,
 	}
 }
 
@@ -249,22 +345,46 @@ func (u *unit) deserialize(udb *unitDB) {
 	u.nTotal = udb.NTotal
 	u.nResult = make([]uint64, resultLast)
 	copy(u.nResult, udb.NResult)
-	u.domains = convertSliceToMap(udb.Domains)
-	u.blockedDomains = convertSliceToMap(udb.BlockedDomains)
-	u.clients = convertSliceToMap(udb.Clients)
+	u.domains = topCounterFromPairs(udb.Domains, maxDomains)
+	u.blockedDomains = topCounterFromPairs(udb.BlockedDomains, maxDomains)
+	u.clients = topCounterFromPairs(udb.Clients, maxClients)
+	u.safeBrowsingClients = topCounterFromPairs(udb.SafeBrowsingClients, maxClients)
+	u.parentalClients = topCounterFromPairs(udb.ParentalClients, maxClients)
 	u.timeSum = uint64(udb.TimeAvg) * udb.NTotal
+	u.nUpstreamErr = make([]uint64, upstreamErrLast)
+	copy(u.nUpstreamErr, udb.NUpstreamErr)
+	u.nServedStale = udb.NServedStale
 }
 
-// add adds new data to u.  It's safe for concurrent use.
-func (u *unit) add(res Result, domain, cli string, dur uint64) {
+// add adds new data to u.  The requests failed because of the upstreams are
+// only counted in nUpstreamErr.  It's safe for concurrent use.
+func (u *unit) add(e *Entry, cli string) {
+	res, upsErr, domain, dur := e.Result, e.UpstreamError, e.Domain, uint64(e.Time)
+	if upsErr != UpstreamErrNone {
+		u.nUpstreamErr[upsErr]++
+
+		return
+	}
+
 	u.nResult[res]++
 	if res == RNotFiltered {
-		u.domains[domain]++
+		u.domains.add(domain, 1)
 	} else {
-		u.blockedDomains[domain]++
+		u.blockedDomains.add(domain, 1)
+	}
+
+	switch res {
+	case RSafeBrowsing:
+		u.safeBrowsingClients.add(cli, 1)
+	case RParental:
+		u.parentalClients.add(cli, 1)
+	}
+
+	if e.ServedStale {
+		u.nServedStale++
 	}
 
-	u.clients[cli]++
+	u.clients.add(cli, 1)
 	u.timeSum += dur
 	u.nTotal++
 }
@@ -305,35 +425,52 @@ func convertTopSlice(a []countPair) (m []map[string]uint64) {
 type numsGetter func(u *unitDB) (num uint64)
 
 // statsCollector collects statisctics for the given *unitDB slice by specified
-// timeUnit using ng to retrieve data.
-func statsCollector(units []*unitDB, firstID uint32, timeUnit TimeUnit, ng numsGetter) (nums []uint64) {
+// timeUnit using ng to retrieve data.  The days start at the midnight in loc,
+// which must not be nil.
+func statsCollector(
+	units []*unitDB,
+	firstID uint32,
+	timeUnit TimeUnit,
+	loc *time.Location,
+	ng numsGetter,
+) (nums []uint64) {
 	if timeUnit == Hours {
 		nums = make([]uint64, 0, len(units))
 		for _, u := range units {
 			nums = append(nums, ng(u))
 		}
-	} else {
-		// Per time unit counters: 720 hours may span 31 days, so we
-		// skip data for the first day in this case.
-		// align_ceil(24)
-		firstDayID := (firstID + 24 - 1) / 24 * 24
-
-		var sum uint64
-		id := firstDayID
-		nextDayID := firstDayID + 24
-		for i := int(firstDayID - firstID); i != len(units); i++ {
-			sum += ng(units[i])
-			if id == nextDayID {
+
+		return nums
+	}
+
+	// Per time unit counters: 720 hours may span 31 days, so skip the data
+	// for the first day unless it's complete.
+	var sum uint64
+	started := false
+	for i, u := range units {
+		if id := firstID + uint32(i); dayStartID(id, loc) == id {
+			if started {
 				nums = append(nums, sum)
-				sum = 0
-				nextDayID += 24
 			}
-			id++
+
+			started, sum = true, 0
 		}
-		if id <= nextDayID {
-			nums = append(nums, sum)
+
+		if started {
+			sum += ng(u)
 		}
 	}
+
+	if started {
+		nums = append(nums, sum)
+	}
+
+	// The interval may contain an extra start of a day if it includes a
+	// shorter day, like the one of the daylight saving time transition.
+	if maxDays := len(units) / 24; len(nums) > maxDays {
+		nums = nums[len(nums)-maxDays:]
+	}
+
 	return nums
 }
 
@@ -342,11 +479,11 @@ type pairsGetter func(u *unitDB) (pairs []countPair)
 
 // topsCollector collects statistics about highest values from the given *unitDB
 // slice using pg to retrieve data.
-func topsCollector(units []*unitDB, max int, ignored *stringutil.Set, pg pairsGetter) []map[string]uint64 {
+func topsCollector(units []*unitDB, max int, ignored *aghnet.IgnoreMatcher, pg pairsGetter) []map[string]uint64 {
 	m := map[string]uint64{}
 	for _, u := range units {
 		for _, cp := range pg(u) {
-			if !ignored.Has(cp.Name) {
+			if !ignored.HasHost(cp.Name) {
 				m[cp.Name] += cp.Count
 			}
 		}
@@ -384,10 +521,20 @@ func (s *StatsCtx) getData(limit uint32) (StatsResp, bool) {
 			TopClients: []topAddrs{},
 			TopQueried: []topAddrs{},
 
+			TopSafeBrowsingClients: []topAddrs{},
+			TopParentalClients:     []topAddrs{},
+
 			BlockedFiltering:     []uint64{},
 			DNSQueries:           []uint64{},
 			ReplacedParental:     []uint64{},
 			ReplacedSafebrowsing: []uint64{},
+
+			UpstreamServFail:    []uint64{},
+			UpstreamTimeouts:    []uint64{},
+			UpstreamTLSFailures: []uint64{},
+			UpstreamOtherErrors: []uint64{},
+
+			ServedStale: []uint64{},
 		}, true
 	}
 
@@ -401,19 +548,25 @@ func (s *StatsCtx) getData(limit uint32) (StatsResp, bool) {
 		return StatsResp{}, false
 	}
 
-	dnsQueries := statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) { return u.NTotal })
-	if timeUnit != Hours && len(dnsQueries) != int(limit/24) {
-		log.Fatalf("len(dnsQueries) != limit: %d %d", len(dnsQueries), limit)
-	}
-
+	dnsQueries := statsCollector(units, firstID, timeUnit, s.loc, func(u *unitDB) (num uint64) { return u.NTotal })
 	data := StatsResp{
 		DNSQueries:           dnsQueries,
-		BlockedFiltering:     statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) { return u.NResult[RFiltered] }),
-		ReplacedSafebrowsing: statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) { return u.NResult[RSafeBrowsing] }),
-		ReplacedParental:     statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) { return u.NResult[RParental] }),
+		BlockedFiltering:     statsCollector(units, firstID, timeUnit, s.loc, func(u *unitDB) (num uint64) { return u.NResult[RFiltered] }),
+		ReplacedSafebrowsing: statsCollector(units, firstID, timeUnit, s.loc, func(u *unitDB) (num uint64) { return u.NResult[RSafeBrowsing] }),
+		ReplacedParental:     statsCollector(units, firstID, timeUnit, s.loc, func(u *unitDB) (num uint64) { return u.NResult[RParental] }),
 		TopQueried:           topsCollector(units, maxDomains, s.ignored, func(u *unitDB) (pairs []countPair) { return u.Domains }),
 		TopBlocked:           topsCollector(units, maxDomains, s.ignored, func(u *unitDB) (pairs []countPair) { return u.BlockedDomains }),
 		TopClients:           topsCollector(units, maxClients, nil, func(u *unitDB) (pairs []countPair) { return u.Clients }),
+
+		UpstreamServFail:    statsCollector(units, firstID, timeUnit, s.loc, func(u *unitDB) (num uint64) { return u.upstreamErrs(UpstreamErrServFail) }),
+		UpstreamTimeouts:    statsCollector(units, firstID, timeUnit, s.loc, func(u *unitDB) (num uint64) { return u.upstreamErrs(UpstreamErrTimeout) }),
+		UpstreamTLSFailures: statsCollector(units, firstID, timeUnit, s.loc, func(u *unitDB) (num uint64) { return u.upstreamErrs(UpstreamErrTLS) }),
+		UpstreamOtherErrors: statsCollector(units, firstID, timeUnit, s.loc, func(u *unitDB) (num uint64) { return u.upstreamErrs(UpstreamErrOther) }),
+
+		TopSafeBrowsingClients: topsCollector(units, maxClients, nil, func(u *unitDB) (pairs []countPair) { return u.SafeBrowsingClients }),
+		TopParentalClients:     topsCollector(units, maxClients, nil, func(u *unitDB) (pairs []countPair) { return u.ParentalClients }),
+
+		ServedStale: statsCollector(units, firstID, timeUnit, s.loc, func(u *unitDB) (num uint64) { return u.NServedStale }),
 	}
 
 	// Total counters:
@@ -431,6 +584,12 @@ func (s *StatsCtx) getData(limit uint32) (StatsResp, bool) {
 		sum.NResult[RSafeBrowsing] += u.NResult[RSafeBrowsing]
 		sum.NResult[RSafeSearch] += u.NResult[RSafeSearch]
 		sum.NResult[RParental] += u.NResult[RParental]
+
+		for kind := UpstreamErrServFail; kind < upstreamErrLast; kind++ {
+			data.NumUpstreamErrors += u.upstreamErrs(kind)
+		}
+
+		data.NumServedStale += u.NServedStale
 	}
 
 	data.NumDNSQueries = sum.NTotal
@@ -448,5 +607,38 @@ func (s *StatsCtx) getData(limit uint32) (StatsResp, bool) {
 		data.TimeUnits = "days"
 	}
 
+	data.UnicodeDomains = unicodeDomains(data.TopQueried, data.TopBlocked)
+
 	return data, true
 }
+
+// unicodeDomains returns the Unicode forms of the internationalized domain
+// names in tops.  m is nil if there are none.
+func unicodeDomains(tops ...[]topAddrs) (m map[string]string) {
+	for _, top := range tops {
+		for _, pair := range top {
+			for host := range pair {
+				if !strings.Contains(host, "xn--") {
+					continue
+				}
+
+				uhost, err := idna.Lookup.ToUnicode(host)
+				if err != nil {
+					log.Debug("stats: translating %q into unicode: %s", host, err)
+
+					continue
+				} else if uhost == host {
+					continue
+				}
+
+				if m == nil {
+					m = map[string]string{}
+				}
+
+				m[host] = uhost
+			}
+		}
+	}
+
+	return m
+}
@@ -1,6 +1,8 @@
 package updater
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -31,6 +33,11 @@ type VersionInfo struct {
 // MaxResponseSize is responses on server's requests maximum length in bytes.
 const MaxResponseSize = 64 * 1024
 
+// checksumKeySuffix is the suffix of the keys of the hex-encoded SHA-256
+// checksums of the packages in version.json, appended to the key of the
+// download URL, for example "download_linux_amd64_sha256".
+const checksumKeySuffix = "_sha256"
+
 // VersionInfo downloads the latest version information.  If forceRecheck is
 // false and there are cached results, those results are returned.
 func (u *Updater) VersionInfo(forceRecheck bool) (vi VersionInfo, err error) {
@@ -99,10 +106,19 @@ func (u *Updater) parseVersionResponse(data []byte) (VersionInfo, error) {
 		return info, fmt.Errorf("version.json: no package URL: key %q not found in object", key)
 	}
 
+	var checksum []byte
+	if sumHex, ok := versionJSON[key+checksumKeySuffix]; ok {
+		checksum, err = hex.DecodeString(sumHex)
+		if err != nil || len(checksum) != sha256.Size {
+			return info, fmt.Errorf("version.json: bad checksum for key %q", key)
+		}
+	}
+
 	info.CanAutoUpdate = aghalg.BoolToNullBool(info.NewVersion != u.version)
 
 	u.newVersion = info.NewVersion
 	u.packageURL = packageURL
+	u.packageChecksum = checksum
 
 	return info, nil
 }
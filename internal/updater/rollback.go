@@ -0,0 +1,104 @@
+package updater
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ErrNoBackup is returned by [Updater.Rollback] when there is no backup of the
+// previous version on disk.
+const ErrNoBackup errors.Error = "no backup of the previous version"
+
+// Rollback restores the executable and the configuration file of the previous
+// version from the backup made by the last update.  The current ones are put
+// into the backup instead, so that the rollback can be undone by another one.
+func (u *Updater) Rollback() (err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	log.Info("updater: rolling back")
+	defer func() {
+		if err != nil {
+			log.Error("updater: rollback failed: %v", err)
+		} else {
+			log.Info("updater: rolled back")
+		}
+	}()
+
+	execPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("getting executable path: %w", err)
+	}
+
+	return u.rollback(execPath)
+}
+
+// rollback swaps the executable at execPath and the configuration file with
+// the ones from the backup directory.
+func (u *Updater) rollback(execPath string) (err error) {
+	backupDir := filepath.Join(u.workDir, "agh-backup")
+	backupExeName := filepath.Join(backupDir, filepath.Base(execPath))
+
+	_, err = os.Stat(backupExeName)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNoBackup
+	} else if err != nil {
+		return fmt.Errorf("checking %q: %w", backupExeName, err)
+	}
+
+	err = u.swapConfig(filepath.Join(backupDir, "AdGuardHome.yaml"))
+	if err != nil {
+		return fmt.Errorf("restoring config: %w", err)
+	}
+
+	tmpExeName := backupExeName + ".tmp"
+
+	log.Debug("updater: renaming: %s to %s", execPath, tmpExeName)
+	err = os.Rename(execPath, tmpExeName)
+	if err != nil {
+		return err
+	}
+
+	if u.goos == "windows" {
+		// rename fails with "File in use" error
+		err = copyFile(backupExeName, execPath)
+	} else {
+		err = os.Rename(backupExeName, execPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Debug("updater: restored: %s to %s", backupExeName, execPath)
+
+	return os.Rename(tmpExeName, backupExeName)
+}
+
+// swapConfig swaps the contents of the current configuration file and the one
+// at backupConfName, if the latter exists.
+func (u *Updater) swapConfig(backupConfName string) (err error) {
+	backup, err := os.ReadFile(backupConfName)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Debug("updater: no config backup at %q", backupConfName)
+
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	current, err := os.ReadFile(u.confName)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(backupConfName, current, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(u.confName, backup, 0o644)
+}
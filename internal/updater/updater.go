@@ -4,7 +4,10 @@ package updater
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net/http"
@@ -27,20 +30,25 @@ import (
 type Updater struct {
 	client *http.Client
 
+	// publicKey is the key used to verify the signatures of the packages.  If
+	// it's nil, the signatures aren't verified.
+	publicKey ed25519.PublicKey
+
 	version string
-	channel string
 	goarch  string
 	goos    string
 	goarm   string
 	gomips  string
 
-	workDir         string
-	confName        string
-	versionCheckURL string
+	workDir  string
+	confName string
 
 	// mu protects all fields below.
 	mu *sync.RWMutex
 
+	channel         string
+	versionCheckURL string
+
 	// TODO(a.garipov): See if all of these fields actually have to be in
 	// this struct.
 	currentExeName string // current binary executable
@@ -54,6 +62,10 @@ type Updater struct {
 	newVersion string
 	packageURL string
 
+	// packageChecksum is the SHA-256 checksum of the package file.  If it's
+	// nil, the checksum isn't verified.
+	packageChecksum []byte
+
 	// Cached fields to prevent too many API requests.
 	prevCheckError  error
 	prevCheckTime   time.Time
@@ -64,6 +76,10 @@ type Updater struct {
 type Config struct {
 	Client *http.Client
 
+	// PublicKey is the Ed25519 public key used to verify the signatures of the
+	// downloaded packages.  If it's nil, the signatures aren't verified.
+	PublicKey ed25519.PublicKey
+
 	Version string
 	Channel string
 	GOARCH  string
@@ -80,28 +96,82 @@ type Config struct {
 
 // NewUpdater creates a new Updater.
 func NewUpdater(conf *Config) *Updater {
-	u := &url.URL{
-		Scheme: "https",
-		// TODO(a.garipov): Make configurable.
-		Host: "static.adtidy.org",
-		Path: path.Join("adguardhome", conf.Channel, "version.json"),
-	}
 	return &Updater{
-		client: conf.Client,
+		client:    conf.Client,
+		publicKey: conf.PublicKey,
 
 		version: conf.Version,
-		channel: conf.Channel,
 		goarch:  conf.GOARCH,
 		goos:    conf.GOOS,
 		goarm:   conf.GOARM,
 		gomips:  conf.GOMIPS,
 
-		confName:        conf.ConfName,
-		workDir:         conf.WorkDir,
-		versionCheckURL: u.String(),
+		confName: conf.ConfName,
+		workDir:  conf.WorkDir,
 
 		mu: &sync.RWMutex{},
+
+		channel:         conf.Channel,
+		versionCheckURL: versionCheckURL(conf.Channel),
+	}
+}
+
+// versionCheckURL returns the URL of the version information for channel.
+func versionCheckURL(channel string) (vcu string) {
+	u := &url.URL{
+		Scheme: "https",
+		// TODO(a.garipov): Make configurable.
+		Host: "static.adtidy.org",
+		Path: path.Join("adguardhome", channel, "version.json"),
 	}
+
+	return u.String()
+}
+
+// ValidateChannel returns an error if channel isn't a channel the updates can
+// be received from.
+func ValidateChannel(channel string) (err error) {
+	switch channel {
+	case
+		version.ChannelRelease,
+		version.ChannelBeta,
+		version.ChannelEdge:
+		return nil
+	default:
+		return fmt.Errorf("bad update channel %q", channel)
+	}
+}
+
+// Channel returns the release channel the updates are received from.
+func (u *Updater) Channel() (channel string) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	return u.channel
+}
+
+// SetChannel sets the release channel the updates are received from and resets
+// the cached version information.
+func (u *Updater) SetChannel(channel string) (err error) {
+	err = ValidateChannel(channel)
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.channel == channel {
+		return nil
+	}
+
+	u.channel = channel
+	u.versionCheckURL = versionCheckURL(channel)
+
+	u.newVersion, u.packageURL, u.packageChecksum = "", "", nil
+	u.prevCheckTime, u.prevCheckResult, u.prevCheckError = time.Time{}, VersionInfo{}, nil
+
+	return nil
 }
 
 // Update performs the auto-update.  It returns an error if the update failed.
@@ -317,35 +387,90 @@ func (u *Updater) clean() {
 // approximately 9 MiB.
 const MaxPackageFileSize = 32 * 1024 * 1024
 
-// Download package file and save it to disk
+// Download package file, verify it, and save it to disk
 func (u *Updater) downloadPackageFile() (err error) {
+	body, err := u.download(u.packageURL, MaxPackageFileSize)
+	if err != nil {
+		return fmt.Errorf("downloading package: %w", err)
+	}
+
+	err = u.verify(body)
+	if err != nil {
+		return fmt.Errorf("verifying package: %w", err)
+	}
+
+	_ = os.Mkdir(u.updateDir, 0o755)
+
+	log.Debug("updater: saving package to file")
+	err = os.WriteFile(u.packageName, body, 0o644)
+	if err != nil {
+		return fmt.Errorf("os.WriteFile() failed: %w", err)
+	}
+	return nil
+}
+
+// download returns the body of the response to the GET request to dlURL,
+// which must not be longer than maxSize bytes.
+func (u *Updater) download(dlURL string, maxSize int64) (body []byte, err error) {
 	var resp *http.Response
-	resp, err = u.client.Get(u.packageURL)
+	resp, err = u.client.Get(dlURL)
 	if err != nil {
-		return fmt.Errorf("http request failed: %w", err)
+		return nil, fmt.Errorf("http request failed: %w", err)
 	}
 	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http request failed: status code %d", resp.StatusCode)
+	}
+
 	var r io.Reader
-	r, err = aghio.LimitReader(resp.Body, MaxPackageFileSize)
+	r, err = aghio.LimitReader(resp.Body, maxSize)
 	if err != nil {
-		return fmt.Errorf("http request failed: %w", err)
+		return nil, fmt.Errorf("http request failed: %w", err)
 	}
 
 	log.Debug("updater: reading http body")
 	// This use of ReadAll is now safe, because we limited body's Reader.
-	body, err := io.ReadAll(r)
+	body, err = io.ReadAll(r)
 	if err != nil {
-		return fmt.Errorf("io.ReadAll() failed: %w", err)
+		return nil, fmt.Errorf("io.ReadAll() failed: %w", err)
 	}
 
-	_ = os.Mkdir(u.updateDir, 0o755)
+	return body, nil
+}
 
-	log.Debug("updater: saving package to file")
-	err = os.WriteFile(u.packageName, body, 0o644)
+// signatureExt is the extension of the file containing the Ed25519 signature
+// of the package file, which is downloaded from the package URL with this
+// extension appended.
+const signatureExt = ".sig"
+
+// verify returns an error if the checksum or the signature of the package
+// file data pkg don't match the expected ones.
+func (u *Updater) verify(pkg []byte) (err error) {
+	if u.packageChecksum != nil {
+		sum := sha256.Sum256(pkg)
+		if !bytes.Equal(sum[:], u.packageChecksum) {
+			return fmt.Errorf("checksum mismatch: got %x, want %x", sum, u.packageChecksum)
+		}
+
+		log.Debug("updater: checksum verified")
+	}
+
+	if u.publicKey == nil {
+		return nil
+	}
+
+	sig, err := u.download(u.packageURL+signatureExt, ed25519.SignatureSize)
 	if err != nil {
-		return fmt.Errorf("os.WriteFile() failed: %w", err)
+		return fmt.Errorf("downloading signature: %w", err)
 	}
+
+	if !ed25519.Verify(u.publicKey, pkg, sig) {
+		return errors.Error("bad signature")
+	}
+
+	log.Debug("updater: signature verified")
+
 	return nil
 }
 
@@ -1,14 +1,21 @@
 package updater
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/version"
@@ -329,3 +336,176 @@ func TestUpdater_VersionInto_MIPS(t *testing.T) {
 	assert.Equal(t, "https://github.com/AdguardTeam/AdGuardHome/internal/releases", info.AnnouncementURL)
 	assert.Equal(t, aghalg.NBTrue, info.CanAutoUpdate)
 }
+
+func TestUpdater_SetChannel(t *testing.T) {
+	u := NewUpdater(&Config{
+		Client:  &http.Client{},
+		Version: "v0.103.0",
+		Channel: version.ChannelRelease,
+	})
+
+	u.newVersion = "v0.103.1"
+	u.prevCheckTime = time.Now()
+
+	err := u.SetChannel("stable")
+	testutil.AssertErrorMsg(t, `bad update channel "stable"`, err)
+
+	assert.Equal(t, version.ChannelRelease, u.Channel())
+
+	err = u.SetChannel(version.ChannelBeta)
+	require.NoError(t, err)
+
+	assert.Equal(t, version.ChannelBeta, u.Channel())
+	assert.Equal(t, "https://static.adtidy.org/adguardhome/beta/version.json", u.VersionCheckURL())
+	assert.Empty(t, u.NewVersion())
+	assert.True(t, u.prevCheckTime.IsZero())
+}
+
+func TestUpdater_downloadPackageFile_verify(t *testing.T) {
+	const pkgData = "package data"
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	sum := sha256.Sum256([]byte(pkgData))
+	sig := ed25519.Sign(priv, []byte(pkgData))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/AdGuardHome.tar.gz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(pkgData))
+	})
+	mux.HandleFunc("/AdGuardHome.tar.gz.sig", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(sig)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	testCases := []struct {
+		name       string
+		checksum   []byte
+		key        ed25519.PublicKey
+		wantErrMsg string
+	}{{
+		name:       "no_verification",
+		checksum:   nil,
+		key:        nil,
+		wantErrMsg: "",
+	}, {
+		name:       "good",
+		checksum:   sum[:],
+		key:        pub,
+		wantErrMsg: "",
+	}, {
+		name:     "bad_checksum",
+		checksum: make([]byte, sha256.Size),
+		key:      nil,
+		wantErrMsg: fmt.Sprintf(
+			"verifying package: checksum mismatch: got %x, want %x",
+			sum,
+			make([]byte, sha256.Size),
+		),
+	}, {
+		name:       "bad_signature",
+		checksum:   sum[:],
+		key:        make(ed25519.PublicKey, ed25519.PublicKeySize),
+		wantErrMsg: "verifying package: bad signature",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			wd := t.TempDir()
+
+			u := NewUpdater(&Config{
+				Client:    srv.Client(),
+				PublicKey: tc.key,
+				Version:   "v0.103.0",
+			})
+
+			u.updateDir = wd
+			u.packageName = filepath.Join(wd, "AdGuardHome.tar.gz")
+			u.packageURL = srv.URL + "/AdGuardHome.tar.gz"
+			u.packageChecksum = tc.checksum
+
+			err = u.downloadPackageFile()
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			_, statErr := os.Stat(u.packageName)
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, statErr)
+			} else {
+				assert.ErrorIs(t, statErr, os.ErrNotExist)
+			}
+		})
+	}
+}
+
+func TestUpdater_parseVersionResponse_checksum(t *testing.T) {
+	u := NewUpdater(&Config{
+		Client:  &http.Client{},
+		Version: "v0.103.0",
+		GOARCH:  "amd64",
+		GOOS:    "linux",
+	})
+
+	sum := sha256.Sum256([]byte("package data"))
+	data := fmt.Sprintf(`{
+  "version": "v0.103.1",
+  "announcement": "AdGuard Home v0.103.1 is now available!",
+  "announcement_url": "https://github.com/AdguardTeam/AdGuardHome/internal/releases",
+  "download_linux_amd64": "https://static.adtidy.org/adguardhome/release/AdGuardHome_linux_amd64.tar.gz",
+  "download_linux_amd64_sha256": "%x"
+}`, sum)
+
+	_, err := u.parseVersionResponse([]byte(data))
+	require.NoError(t, err)
+
+	assert.Equal(t, sum[:], u.packageChecksum)
+
+	data = strings.Replace(data, fmt.Sprintf("%x", sum), "bad", 1)
+	_, err = u.parseVersionResponse([]byte(data))
+	testutil.AssertErrorMsg(t, `version.json: bad checksum for key "download_linux_amd64"`, err)
+}
+
+func TestUpdater_rollback(t *testing.T) {
+	wd := t.TempDir()
+
+	exePath := filepath.Join(wd, "AdGuardHome")
+	yamlPath := filepath.Join(wd, "AdGuardHome.yaml")
+	backupDir := filepath.Join(wd, "agh-backup")
+
+	u := NewUpdater(&Config{
+		Client:   &http.Client{},
+		Version:  "v0.103.1",
+		WorkDir:  wd,
+		ConfName: yamlPath,
+	})
+
+	require.NoError(t, os.WriteFile(exePath, []byte("new"), 0o755))
+	require.NoError(t, os.WriteFile(yamlPath, []byte("new.yaml"), 0o644))
+
+	err := u.rollback(exePath)
+	assert.ErrorIs(t, err, ErrNoBackup)
+
+	require.NoError(t, os.Mkdir(backupDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(backupDir, "AdGuardHome"), []byte("old"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(backupDir, "AdGuardHome.yaml"), []byte("old.yaml"), 0o644))
+
+	err = u.rollback(exePath)
+	require.NoError(t, err)
+
+	for path, want := range map[string]string{
+		exePath:                                 "old",
+		yamlPath:                                "old.yaml",
+		filepath.Join(backupDir, "AdGuardHome"): "new",
+		filepath.Join(backupDir, "AdGuardHome.yaml"): "new.yaml",
+	} {
+		d, rerr := os.ReadFile(path)
+		require.NoError(t, rerr)
+
+		assert.Equal(t, want, string(d), path)
+	}
+
+	_, err = os.Stat(filepath.Join(backupDir, "AdGuardHome.tmp"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}